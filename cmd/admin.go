@@ -4,13 +4,16 @@
 package cmd
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -19,12 +22,17 @@ import (
 
 const (
 	defaultServerURL = "https://localhost:8080"
+	unixScheme       = "unix://"
 )
 
 var (
 	serverURL   string
 	serverCA    string
 	insecureTLS bool
+	apiToken    string
+	clientCert  string
+	clientKey   string
+	adminSocket string
 )
 
 var adminCmd = &cobra.Command{
@@ -36,19 +44,33 @@ var adminCmd = &cobra.Command{
 	always override both defaults and environment variables.`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		serverURL = viper.GetString("server")
+		// the Unix socket of the admin API, whose requests go to a host that is not dialed
+		if strings.HasPrefix(serverURL, unixScheme) {
+			adminSocket = strings.TrimPrefix(serverURL, unixScheme)
+			serverURL = "http://adam"
+		}
 		serverCA = viper.GetString("server-ca")
 		insecureTLS = viper.GetBool("insecure")
+		apiToken = viper.GetString("token")
+		clientCert = viper.GetString("client-cert")
+		clientKey = viper.GetString("client-key")
 	},
 }
 
 func adminInit() {
-	adminCmd.PersistentFlags().String("server", defaultServerURL, "full URL to running Adam server, can also be set via env var ADAM_SERVER")
+	adminCmd.PersistentFlags().String("server", defaultServerURL, "full URL to running Adam server, or unix://<path> for its --admin-socket, can also be set via env var ADAM_SERVER")
 	adminCmd.MarkFlagRequired("server")
 	viper.BindPFlag("server", adminCmd.PersistentFlags().Lookup("server"))
 	adminCmd.PersistentFlags().String("server-ca", path.Join(defaultDatabaseURL, serverCertFilename), "path to CA certificate for trusting server; set to blank if using a certificate signed by a CA already on your system; can also be set via env var ADAM_SERVER_CA")
 	viper.BindPFlag("server-ca", adminCmd.PersistentFlags().Lookup("server-ca"))
 	adminCmd.PersistentFlags().Bool("insecure", false, "accept invalid, expired or mismatched hostname errors for adam server certificate, can also be set via env var ADAM_INSECURE")
 	viper.BindPFlag("insecure", adminCmd.PersistentFlags().Lookup("insecure"))
+	adminCmd.PersistentFlags().String("token", "", "admin API token to authenticate with, as created by 'adam admin token add'; can also be set via env var ADAM_TOKEN")
+	viper.BindPFlag("token", adminCmd.PersistentFlags().Lookup("token"))
+	adminCmd.PersistentFlags().String("client-cert", "", "path to a client certificate to authenticate with, signed by a CA in the server --admin-ca; can also be set via env var ADAM_CLIENT_CERT")
+	viper.BindPFlag("client-cert", adminCmd.PersistentFlags().Lookup("client-cert"))
+	adminCmd.PersistentFlags().String("client-key", "", "path to the key of --client-cert; can also be set via env var ADAM_CLIENT_KEY")
+	viper.BindPFlag("client-key", adminCmd.PersistentFlags().Lookup("client-key"))
 
 	// onboard
 	adminCmd.AddCommand(onboardCmd)
@@ -56,6 +78,69 @@ func adminInit() {
 	// device
 	adminCmd.AddCommand(deviceCmd)
 	deviceInit()
+	// revoked certificates
+	adminCmd.AddCommand(revocationCmd)
+	revocationInit()
+	// pending devices
+	adminCmd.AddCommand(pendingCmd)
+	pendingInit()
+	// audit
+	adminCmd.AddCommand(auditCmd)
+	auditInit()
+	// garbage collection
+	adminCmd.AddCommand(gcCmd)
+	gcInit()
+	// archiving of device streams
+	adminCmd.AddCommand(archiveCmd)
+	// storage usage
+	adminCmd.AddCommand(usageCmd)
+	usageInit()
+	// request stats
+	adminCmd.AddCommand(statsCmd)
+	// API tokens
+	adminCmd.AddCommand(tokenCmd)
+	tokenInit()
+	// config rollouts
+	adminCmd.AddCommand(rolloutCmd)
+	rolloutInit()
+	// config canaries
+	adminCmd.AddCommand(canaryCmd)
+	canaryInit()
+	// scheduled config changes
+	adminCmd.AddCommand(scheduleCmd)
+	scheduleInit()
+	// alerts
+	adminCmd.AddCommand(alertCmd)
+	alertInit()
+	// config snapshots
+	adminCmd.AddCommand(snapshotCmd)
+	snapshotInit()
+	// hardware models
+	adminCmd.AddCommand(hardwareModelCmd)
+	hardwareModelInit()
+	// datastores and images of the catalog
+	adminCmd.AddCommand(datastoreCmd)
+	adminCmd.AddCommand(imageCmd)
+	catalogInit()
+	// replays of stored messages
+	adminCmd.AddCommand(replayCmd)
+	replayInit()
+	// dead letters
+	adminCmd.AddCommand(deadLetterCmd)
+	deadLetterInit()
+	// certificate backups
+	adminCmd.AddCommand(certsCmd)
+	certsInit()
+	// log levels of the server
+	adminCmd.AddCommand(logLevelCmd)
+	logLevelInit()
+	// fault injection
+	adminCmd.AddCommand(faultCmd)
+	faultInit()
+	// backpressure
+	adminCmd.AddCommand(backpressureCmd)
+	// federation
+	adminCmd.AddCommand(federationCmd)
 }
 
 func getClient() *http.Client {
@@ -68,7 +153,8 @@ func getStreamingClient() *http.Client {
 // http client with correct config
 func getClientStreamingOption(stream bool) *http.Client {
 	tlsConfig := &tls.Config{}
-	if serverCA != "" {
+	// the admin socket has no TLS
+	if serverCA != "" && adminSocket == "" {
 		caCert, err := ioutil.ReadFile(serverCA)
 		if err != nil {
 			log.Fatalf("unable to read server CA file at %s: %v", serverCA, err)
@@ -80,6 +166,13 @@ func getClientStreamingOption(stream bool) *http.Client {
 	if insecureTLS {
 		tlsConfig.InsecureSkipVerify = true
 	}
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			log.Fatalf("unable to load client certificate %s and key %s: %v", clientCert, clientKey, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 
 	// if we are streaming, then wait forever, but at least put a timeout
 	// on the handshake and the response headers
@@ -87,17 +180,41 @@ func getClientStreamingOption(stream bool) *http.Client {
 	if stream {
 		timeout = timeout * 0
 	}
+	base := &http.Transport{
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	}
+	if adminSocket != "" {
+		base.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", adminSocket)
+		}
+	}
+	var transport http.RoundTripper = base
+	if apiToken != "" {
+		transport = &tokenTransport{token: apiToken, next: transport}
+	}
 	var client = &http.Client{
-		Timeout: timeout,
-		Transport: &http.Transport{
-			TLSClientConfig:       tlsConfig,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ResponseHeaderTimeout: 10 * time.Second,
-		},
+		Timeout:   timeout,
+		Transport: transport,
 	}
 
 	return client
 }
+
+// tokenTransport add an admin API token to each request
+type tokenTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not change the request it is given
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(req)
+}
 func resolveURL(b, p string) (string, error) {
 	u, err := url.Parse(p)
 	if err != nil {
@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/spf13/cobra"
+)
+
+var (
+	alertRuleID       string
+	alertRuleName     string
+	alertRuleDevices  []string
+	alertRuleSerials  []string
+	alertRuleMetric   string
+	alertRuleOp       string
+	alertRuleValue    float64
+	alertRuleAppState string
+	alertRuleApp      string
+	alertRuleLog      bool
+	alertRuleWebhooks []string
+	alertRuleMQTT     string
+	alertRuleTopic    string
+)
+
+var alertCmd = &cobra.Command{
+	Use:   "alert",
+	Short: "manage alerts",
+	Long:  `Alert rules are conditions on the metrics devices send, or on the state of their app instances, evaluated as the server receives them. An alert is sent when a rule starts holding for a device, and again once it stops`,
+}
+
+var alertListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list firing alerts in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/alert", nil, http.StatusOK))
+	},
+}
+
+var alertRuleCmd = &cobra.Command{
+	Use:   "rule",
+	Short: "manage alert rules",
+}
+
+var alertRuleListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list alert rules in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/alert/rule", nil, http.StatusOK))
+	},
+}
+
+var alertRuleGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get an alert rule in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/alert/rule", alertRuleID), nil, http.StatusOK))
+	},
+}
+
+var alertRuleAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "add an alert rule, and print it",
+	Long: `Add an alert rule, and print it. The rule is either on a metric, with --metric, --op and --value, e.g. --metric dm.cpuMetric.total --op '>' --value 90, or on the state of app instances, with --app-state, e.g. --app-state HALTED.
+The rule applies to the devices given with --device and those whose serial matches a --serial pattern, or every device if there are neither. Alerts go to the server log with --log, to webhooks with --webhook, and to an MQTT broker with --mqtt and --mqtt-topic`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rule := common.AlertRule{
+			Name:     alertRuleName,
+			Devices:  alertRuleDevices,
+			Serials:  alertRuleSerials,
+			Metric:   alertRuleMetric,
+			Op:       alertRuleOp,
+			Value:    alertRuleValue,
+			AppState: alertRuleAppState,
+			App:      alertRuleApp,
+		}
+		if rule.Metric == "" {
+			// the default op is only for metric rules
+			rule.Op = ""
+		}
+		if alertRuleLog {
+			rule.Actions = append(rule.Actions, common.AlertAction{Type: common.AlertLog})
+		}
+		for _, u := range alertRuleWebhooks {
+			rule.Actions = append(rule.Actions, common.AlertAction{Type: common.AlertWebhook, URL: u})
+		}
+		if alertRuleMQTT != "" {
+			rule.Actions = append(rule.Actions, common.AlertAction{Type: common.AlertMQTT, URL: alertRuleMQTT, Topic: alertRuleTopic})
+		}
+		if err := rule.Validate(); err != nil {
+			log.Fatalf("invalid alert rule: %v", err)
+		}
+		b, err := json.Marshal(rule)
+		if err != nil {
+			log.Fatalf("error encoding alert rule: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", "/admin/alert/rule", bytes.NewBuffer(b), http.StatusCreated))
+	},
+}
+
+var alertRuleRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove an alert rule; its firing alerts are dropped",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/alert/rule", alertRuleID), nil, http.StatusOK)
+	},
+}
+
+func alertInit() {
+	alertCmd.AddCommand(alertListCmd)
+	alertCmd.AddCommand(alertRuleCmd)
+	alertRuleCmd.AddCommand(alertRuleListCmd)
+	alertRuleCmd.AddCommand(alertRuleGetCmd)
+	alertRuleGetCmd.Flags().StringVar(&alertRuleID, "id", "", "id of the alert rule, as listed")
+	alertRuleGetCmd.MarkFlagRequired("id")
+	alertRuleCmd.AddCommand(alertRuleAddCmd)
+	alertRuleAddCmd.Flags().StringVar(&alertRuleName, "name", "", "name of the rule, sent with its alerts")
+	alertRuleAddCmd.Flags().StringSliceVar(&alertRuleDevices, "device", nil, "UUID of a device the rule applies to; can be repeated")
+	alertRuleAddCmd.Flags().StringSliceVar(&alertRuleSerials, "serial", nil, "pattern, e.g. 'lab-*', of the serials of devices the rule applies to; can be repeated")
+	alertRuleAddCmd.Flags().StringVar(&alertRuleMetric, "metric", "", "path to a number in the metrics, as JSON, e.g. dm.cpuMetric.total")
+	alertRuleAddCmd.Flags().StringVar(&alertRuleOp, "op", ">", "comparison of the metric with --value, one of >, >=, <, <=, == and !=")
+	alertRuleAddCmd.Flags().Float64Var(&alertRuleValue, "value", 0, "value to compare the metric with")
+	alertRuleAddCmd.Flags().StringVar(&alertRuleAppState, "app-state", "", "state of app instances the rule holds in, e.g. HALTED")
+	alertRuleAddCmd.Flags().StringVar(&alertRuleApp, "app", "", "pattern of the names of the app instances an app state rule applies to; all of them if empty")
+	alertRuleAddCmd.Flags().BoolVar(&alertRuleLog, "log", false, "write alerts to the server log")
+	alertRuleAddCmd.Flags().StringSliceVar(&alertRuleWebhooks, "webhook", nil, "URL to POST alerts to, in JSON; can be repeated")
+	alertRuleAddCmd.Flags().StringVar(&alertRuleMQTT, "mqtt", "", "URL of an MQTT broker to publish alerts to, as mqtt://[user:password@]host[:port], or mqtts:// for TLS")
+	alertRuleAddCmd.Flags().StringVar(&alertRuleTopic, "mqtt-topic", "adam/alerts", "MQTT topic to publish alerts to")
+	alertRuleCmd.AddCommand(alertRuleRemoveCmd)
+	alertRuleRemoveCmd.Flags().StringVar(&alertRuleID, "id", "", "id of the alert rule, as listed")
+	alertRuleRemoveCmd.MarkFlagRequired("id")
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+var archiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "archive the older entries of device streams now, in JSON format",
+	Long:  `Move the entries of device streams older than the archive-after of the database URL of a running Adam server to its archive now, instead of waiting for its --archive-interval, and report the entries and segments archived for each stream, in JSON format. Only supported by the redis driver, with an archive in its database URL`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("POST", "/admin/archive", nil, http.StatusOK))
+	},
+}
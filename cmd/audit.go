@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"io"
+	"log"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	auditAction string
+	auditActor  string
+	auditTarget string
+	auditSince  string
+	auditUntil  string
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "view the audit log of admin actions",
+	Long:  `View the audit log of admin actions in a running Adam server, one JSON record per line, optionally filtered`,
+	Run: func(cmd *cobra.Command, args []string) {
+		q := url.Values{}
+		for k, v := range map[string]string{
+			"action": auditAction,
+			"actor":  auditActor,
+			"target": auditTarget,
+			"since":  auditSince,
+			"until":  auditUntil,
+		} {
+			if v != "" {
+				q.Set(k, v)
+			}
+		}
+		p := "/admin/audit"
+		if len(q) > 0 {
+			p += "?" + q.Encode()
+		}
+		u, err := resolveURL(serverURL, p)
+		if err != nil {
+			log.Fatalf("error constructing URL: %v", err)
+		}
+		response, err := getClient().Get(u)
+		if err != nil {
+			log.Fatalf("error reading URL %s: %v", u, err)
+		}
+		defer response.Body.Close()
+		if _, err := io.Copy(os.Stdout, response.Body); err != nil {
+			log.Fatalf("error writing output: %v", err)
+		}
+	},
+}
+
+func auditInit() {
+	auditCmd.Flags().StringVar(&auditAction, "action", "", "only show records for this action, e.g. onboard-add, device-remove or config-set")
+	auditCmd.Flags().StringVar(&auditActor, "actor", "", "only show records for this actor, e.g. cert:<CN>")
+	auditCmd.Flags().StringVar(&auditTarget, "target", "", "only show records for this target, e.g. a device UUID or onboard CN")
+	auditCmd.Flags().StringVar(&auditSince, "since", "", "only show records at or after this RFC3339 time")
+	auditCmd.Flags().StringVar(&auditUntil, "until", "", "only show records at or before this RFC3339 time")
+}
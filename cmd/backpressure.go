@@ -0,0 +1,20 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+var backpressureCmd = &cobra.Command{
+	Use:   "backpressure",
+	Short: "report whether the backpressure config items are served to devices, in JSON format",
+	Long:  `Report whether a running Adam server serves devices the config items of its --backpressure, as ingest is overloaded, since when, and the ingest requests per second and requests shed at its last check, in JSON format. Only available when the server runs with --backpressure`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/backpressure", nil, http.StatusOK))
+	},
+}
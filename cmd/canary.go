@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	canaryID           string
+	canaryName         string
+	canaryDevices      []string
+	canarySerials      []string
+	canaryPatchPath    string
+	canaryTemplatePath string
+	canarySoakPeriod   int
+	canaryMaxReboots   int
+	canaryWaveSize     int
+	canaryWaveTimeout  int
+	canaryMaxFailures  int
+)
+
+var canaryCmd = &cobra.Command{
+	Use:   "canary",
+	Short: "manage config canaries",
+	Long:  `Apply a config change to a few canary devices first, and watch them for a soak period. A canary that reports app instance errors, reboots too often or does not acknowledge the change reverts all of them to their previous config; once the soak period is over without that, the change can be promoted to a rollout to the fleet`,
+}
+
+var canaryListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list config canaries, with their state, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/canary", nil, http.StatusOK))
+	},
+}
+
+var canaryGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get a config canary, with the state of each device, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/canary", canaryID), nil, http.StatusOK))
+	},
+}
+
+var canaryCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "create a config canary, applying its change to the canary devices, and print it",
+	Long: `Create a config canary, applying its change to the canary devices, and print it. The change is either a JSON merge patch applied to the config of each device, with --patch-path, or a config set on each of them, with --template-path.
+The canaries are the devices given with --device and those whose serial matches a --serial pattern`,
+	Run: func(cmd *cobra.Command, args []string) {
+		req := server.CanaryRequest{
+			Name:       canaryName,
+			Devices:    canaryDevices,
+			Serials:    canarySerials,
+			SoakPeriod: canarySoakPeriod,
+			MaxReboots: canaryMaxReboots,
+		}
+		switch {
+		case (canaryPatchPath == "") == (canaryTemplatePath == ""):
+			log.Fatalf("exactly one of --patch-path and --template-path is required")
+		case canaryPatchPath != "":
+			req.Patch = readRolloutFile(canaryPatchPath)
+		default:
+			req.Template = readRolloutFile(canaryTemplatePath)
+		}
+		b, err := json.Marshal(req)
+		if err != nil {
+			log.Fatalf("error encoding canary request: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", "/admin/canary", bytes.NewBuffer(b), http.StatusCreated))
+	},
+}
+
+var canaryRevertCmd = &cobra.Command{
+	Use:   "revert",
+	Short: "revert a config canary, setting the previous config back on its devices, and print it",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("POST", path.Join("/admin/canary", canaryID, "revert"), nil, http.StatusOK))
+	},
+}
+
+var canaryPromoteCmd = &cobra.Command{
+	Use:   "promote",
+	Short: "roll the change of a config canary that passed out to devices, and print the rollout",
+	Long:  `Roll the change of a config canary that passed out to devices, as a config rollout, and print the rollout, which is managed as any other. The devices are those given with --device and those whose serial matches a --serial pattern, or every device if there are neither`,
+	Run: func(cmd *cobra.Command, args []string) {
+		req := server.RolloutRequest{
+			Name:        canaryName,
+			Devices:     canaryDevices,
+			Serials:     canarySerials,
+			WaveSize:    canaryWaveSize,
+			WaveTimeout: canaryWaveTimeout,
+			MaxFailures: canaryMaxFailures,
+		}
+		b, err := json.Marshal(req)
+		if err != nil {
+			log.Fatalf("error encoding rollout request: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", path.Join("/admin/canary", canaryID, "promote"), bytes.NewBuffer(b), http.StatusCreated))
+	},
+}
+
+var canaryRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove a config canary; the configs of its devices stay as they are",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/canary", canaryID), nil, http.StatusOK)
+	},
+}
+
+func canaryInit() {
+	canaryCmd.AddCommand(canaryListCmd)
+	canaryCmd.AddCommand(canaryGetCmd)
+	canaryGetCmd.Flags().StringVar(&canaryID, "id", "", "id of the canary, as listed")
+	canaryGetCmd.MarkFlagRequired("id")
+	canaryCmd.AddCommand(canaryCreateCmd)
+	canaryCreateCmd.Flags().StringVar(&canaryName, "name", "", "name of the canary, e.g. what the change is")
+	canaryCreateCmd.Flags().StringSliceVar(&canaryDevices, "device", nil, "UUID of a canary device; can be repeated")
+	canaryCreateCmd.Flags().StringSliceVar(&canarySerials, "serial", nil, "pattern, e.g. 'lab-*', of the serials of the canary devices; can be repeated")
+	canaryCreateCmd.Flags().StringVar(&canaryPatchPath, "patch-path", "", "path to a JSON merge patch to apply to the config of each canary; use '-' to read from stdin")
+	canaryCreateCmd.Flags().StringVar(&canaryTemplatePath, "template-path", "", "path to a config to set on each canary, with its UUID; use '-' to read from stdin")
+	canaryCreateCmd.Flags().IntVar(&canarySoakPeriod, "soak-period", 1800, "how long, in seconds, to watch the canaries for before the change can be promoted")
+	canaryCreateCmd.Flags().IntVar(&canaryMaxReboots, "max-reboots", 0, "how many times a canary can reboot during the soak period before it counts as regressed")
+	canaryCmd.AddCommand(canaryRevertCmd)
+	canaryRevertCmd.Flags().StringVar(&canaryID, "id", "", "id of the canary, as listed")
+	canaryRevertCmd.MarkFlagRequired("id")
+	canaryCmd.AddCommand(canaryPromoteCmd)
+	canaryPromoteCmd.Flags().StringVar(&canaryID, "id", "", "id of the canary, as listed")
+	canaryPromoteCmd.MarkFlagRequired("id")
+	canaryPromoteCmd.Flags().StringVar(&canaryName, "name", "", "name of the rollout; canary and the name of the canary if not given")
+	canaryPromoteCmd.Flags().StringSliceVar(&canaryDevices, "device", nil, "UUID of a device to roll the change out to; can be repeated")
+	canaryPromoteCmd.Flags().StringSliceVar(&canarySerials, "serial", nil, "pattern, e.g. 'lab-*', of the serials of devices to roll the change out to; can be repeated")
+	canaryPromoteCmd.Flags().IntVar(&canaryWaveSize, "wave-size", 10, "percentage of the devices to apply the change to at a time")
+	canaryPromoteCmd.Flags().IntVar(&canaryWaveTimeout, "wave-timeout", 600, "how long, in seconds, each device has to acknowledge the change before it counts as failed")
+	canaryPromoteCmd.Flags().IntVar(&canaryMaxFailures, "max-failures", 0, "how many devices can fail before the rollout halts")
+	canaryCmd.AddCommand(canaryRemoveCmd)
+	canaryRemoveCmd.Flags().StringVar(&canaryID, "id", "", "id of the canary, as listed")
+	canaryRemoveCmd.MarkFlagRequired("id")
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	catalogName       string
+	catalogConfigPath string
+	imageDatastore    string
+)
+
+var datastoreCmd = &cobra.Command{
+	Use:   "datastore",
+	Short: "manage the datastores of the catalog",
+	Long:  `Datastores are defined once, e.g. a container registry, and referenced by name in device configs, rollouts, schedules and canaries, as {"$ref": "<name>"} in datastores. Adam resolves each reference when it sets the config, with a UUID that stays the same for every device as long as the name does`,
+}
+
+var datastoreListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list datastores in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/datastore", nil, http.StatusOK))
+	},
+}
+
+var datastoreGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get a datastore in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/datastore", catalogName), nil, http.StatusOK))
+	},
+}
+
+var datastoreSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "add a datastore, or replace the one of the same name keeping its UUID, and print it",
+	Long:  `Add a datastore, or replace the one of the same name keeping its UUID, and print it. The config is JSON as in the datastores of a device config, without an id, e.g. {"dType":"DsContainerRegistry","fqdn":"docker://docker.io"}`,
+	Run: func(cmd *cobra.Command, args []string) {
+		body, err := json.Marshal(server.DatastoreRequest{Config: readCatalogConfig()})
+		if err != nil {
+			log.Fatalf("error encoding datastore: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("PUT", path.Join("/admin/datastore", catalogName), bytes.NewBuffer(body), http.StatusOK))
+	},
+}
+
+var datastoreRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove a datastore, which no image can be in",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/datastore", catalogName), nil, http.StatusOK)
+	},
+}
+
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "manage the images of the catalog",
+	Long:  `Images are defined once, e.g. a container or VM image in a datastore of the catalog, and referenced by name in device configs, rollouts, schedules and canaries, as {"$ref": "<name>"} in contentInfo or as the downloadContentTreeID of the origin of volumes. Adam resolves each reference when it sets the config, adding the image and its datastore, with UUIDs that stay the same for every device as long as the names do`,
+}
+
+var imageListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list images in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/image", nil, http.StatusOK))
+	},
+}
+
+var imageGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get an image in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/image", catalogName), nil, http.StatusOK))
+	},
+}
+
+var imageSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "add an image, or replace the one of the same name keeping its UUID, and print it",
+	Long:  `Add an image, or replace the one of the same name keeping its UUID, and print it. The config is JSON as in the contentInfo of a device config, without a uuid and dsId, e.g. {"URL":"library/nginx:1.21","iformat":"CONTAINER"}`,
+	Run: func(cmd *cobra.Command, args []string) {
+		body, err := json.Marshal(server.ImageRequest{Datastore: imageDatastore, Config: readCatalogConfig()})
+		if err != nil {
+			log.Fatalf("error encoding image: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("PUT", path.Join("/admin/image", catalogName), bytes.NewBuffer(body), http.StatusOK))
+	},
+}
+
+var imageRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove an image",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/image", catalogName), nil, http.StatusOK)
+	},
+}
+
+// readCatalogConfig read the config of a datastore or image from its path, or stdin for '-'
+func readCatalogConfig() []byte {
+	var (
+		b   []byte
+		err error
+	)
+	if catalogConfigPath == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(catalogConfigPath)
+	}
+	if err != nil {
+		log.Fatalf("error reading config: %v", err)
+	}
+	return b
+}
+
+func catalogInit() {
+	datastoreCmd.AddCommand(datastoreListCmd)
+	datastoreCmd.AddCommand(datastoreGetCmd)
+	datastoreGetCmd.Flags().StringVar(&catalogName, "name", "", "name of the datastore")
+	datastoreGetCmd.MarkFlagRequired("name")
+	datastoreCmd.AddCommand(datastoreSetCmd)
+	datastoreSetCmd.Flags().StringVar(&catalogName, "name", "", "name of the datastore, e.g. docker-hub")
+	datastoreSetCmd.MarkFlagRequired("name")
+	datastoreSetCmd.Flags().StringVar(&catalogConfigPath, "config-path", "", "path to the JSON config of the datastore; use '-' to read from stdin")
+	datastoreSetCmd.MarkFlagRequired("config-path")
+	datastoreCmd.AddCommand(datastoreRemoveCmd)
+	datastoreRemoveCmd.Flags().StringVar(&catalogName, "name", "", "name of the datastore")
+	datastoreRemoveCmd.MarkFlagRequired("name")
+
+	imageCmd.AddCommand(imageListCmd)
+	imageCmd.AddCommand(imageGetCmd)
+	imageGetCmd.Flags().StringVar(&catalogName, "name", "", "name of the image")
+	imageGetCmd.MarkFlagRequired("name")
+	imageCmd.AddCommand(imageSetCmd)
+	imageSetCmd.Flags().StringVar(&catalogName, "name", "", "name of the image, e.g. nginx")
+	imageSetCmd.MarkFlagRequired("name")
+	imageSetCmd.Flags().StringVar(&imageDatastore, "datastore", "", "name of the datastore of the catalog the image is in")
+	imageSetCmd.MarkFlagRequired("datastore")
+	imageSetCmd.Flags().StringVar(&catalogConfigPath, "config-path", "", "path to the JSON config of the image; use '-' to read from stdin")
+	imageSetCmd.MarkFlagRequired("config-path")
+	imageCmd.AddCommand(imageRemoveCmd)
+	imageRemoveCmd.Flags().StringVar(&catalogName, "name", "", "name of the image")
+	imageRemoveCmd.MarkFlagRequired("name")
+}
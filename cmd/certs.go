@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	certsOut string
+	certsIn  string
+)
+
+var certsCmd = &cobra.Command{
+	Use:   "certs",
+	Short: "back up and restore onboarding and device certificates",
+	Long: `Export all onboarding certificates with their serials, and all device certificates with the onboarding certificate and serial they registered with, as a tar.gz, to back up the identities apart from the storage. No private keys are in it.
+An export can be imported into the same or another Adam server`,
+}
+
+var certsExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export all onboarding and device certificates as a tar.gz",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := resolveURL(serverURL, "/admin/export/certs")
+		if err != nil {
+			log.Fatalf("error constructing URL: %v", err)
+		}
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			log.Fatalf("unable to create new http request: %v", err)
+		}
+		res, err := getStreamingClient().Do(req)
+		if err != nil {
+			log.Fatalf("error reading URL %s: %v", u, err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			b, _ := ioutil.ReadAll(res.Body)
+			log.Fatalf("error reading URL %s: %d %s", u, res.StatusCode, errorText(b))
+		}
+		out := os.Stdout
+		if certsOut != "-" {
+			if out, err = os.Create(certsOut); err != nil {
+				log.Fatalf("error creating %s: %v", certsOut, err)
+			}
+		}
+		if _, err := io.Copy(out, res.Body); err != nil {
+			log.Fatalf("error writing %s: %v", certsOut, err)
+		}
+		if err := out.Close(); err != nil {
+			log.Fatalf("error writing %s: %v", certsOut, err)
+		}
+	},
+}
+
+var certsImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "import an export of onboarding and device certificates, and print what was registered",
+	Long: `Import an export of onboarding and device certificates, and print what was registered in JSON format. Onboarding certificates get the serials of the export; devices are registered with the UUID they had, unless a device is already registered with that UUID or certificate, in which case it is listed as skipped.
+A bad export is refused before anything is registered`,
+	Run: func(cmd *cobra.Command, args []string) {
+		in := os.Stdin
+		if certsIn != "-" {
+			f, err := os.Open(certsIn)
+			if err != nil {
+				log.Fatalf("error opening %s: %v", certsIn, err)
+			}
+			defer f.Close()
+			in = f
+		}
+		fmt.Printf("%s\n", adminRequest("POST", "/admin/import/certs", in, http.StatusOK))
+	},
+}
+
+func certsInit() {
+	certsCmd.AddCommand(certsExportCmd)
+	certsExportCmd.Flags().StringVar(&certsOut, "out", "", "path to write the tar.gz to; - for stdout")
+	certsExportCmd.MarkFlagRequired("out")
+	certsCmd.AddCommand(certsImportCmd)
+	certsImportCmd.Flags().StringVar(&certsIn, "in", "", "path of the tar.gz to import, as exported; - for stdin")
+	certsImportCmd.MarkFlagRequired("in")
+}
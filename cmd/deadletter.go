@@ -0,0 +1,71 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	deadLetterID     string
+	deadLetterDevice string
+)
+
+var deadLetterCmd = &cobra.Command{
+	Use:   "dead-letter",
+	Short: "manage dead letters",
+	Long:  `Dead letters are the messages of devices that could not be parsed, kept as received with why they failed, to be replayed once the cause is fixed`,
+}
+
+var deadLetterListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list dead letters in JSON format, without their payloads",
+	Run: func(cmd *cobra.Command, args []string) {
+		u := "/admin/dead-letter"
+		if deadLetterDevice != "" {
+			u += "?" + url.Values{"device": {deadLetterDevice}}.Encode()
+		}
+		fmt.Printf("%s\n", adminRequest("GET", u, nil, http.StatusOK))
+	},
+}
+
+var deadLetterGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get a dead letter in JSON format, with its payload",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/dead-letter", deadLetterID), nil, http.StatusOK))
+	},
+}
+
+var deadLetterReplayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "send a dead letter again to the endpoint it was sent to, as the device that sent it",
+	Long:  `Send a dead letter again to the endpoint it was sent to, as the device that sent it, e.g. once adam parses it. It is removed if it is stored this time; otherwise it is kept with the reason it failed again, and the error is printed`,
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("POST", path.Join("/admin/dead-letter", deadLetterID, "replay"), nil, http.StatusOK)
+	},
+}
+
+var deadLetterRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove a dead letter",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/dead-letter", deadLetterID), nil, http.StatusOK)
+	},
+}
+
+func deadLetterInit() {
+	deadLetterCmd.AddCommand(deadLetterListCmd)
+	deadLetterListCmd.Flags().StringVar(&deadLetterDevice, "uuid", "", "UUID of the device to list the dead letters of; all if empty")
+	for _, c := range []*cobra.Command{deadLetterGetCmd, deadLetterReplayCmd, deadLetterRemoveCmd} {
+		deadLetterCmd.AddCommand(c)
+		c.Flags().StringVar(&deadLetterID, "id", "", "ID of the dead letter")
+		c.MarkFlagRequired("id")
+	}
+}
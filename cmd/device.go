@@ -11,17 +11,72 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/lf-edge/adam/pkg/driver/common"
 	"github.com/lf-edge/adam/pkg/server"
 	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 var (
-	devUUID    string
-	configPath string
-	follow     bool
+	devUUID     string
+	configPath  string
+	follow      bool
+	quotaMaxLen string
+	quotaBytes  string
+	forceConfig bool
+	ifMatch     string
+	mergeModel  bool
+	devModel    string
+	devFlag     string
+	quarReason  string
+	appName     string
+	appCommand  string
+	appCmdID    string
+	opsConfirm  string
+	osVersion   string
+	osImage     string
+	osCurrent   string
+	softRemove  bool
+	retention   int
+	listDeleted bool
+	listQuar    bool
+	listLong    bool
+	minSeverity string
+	logSampling int
+	lpToken     string
+	lpProfile   string
+	radioSilent bool
+	mdName      string
+	mdSite      string
+	mdOwner     string
+	mdTags      []string
+	mdUntag     []string
+	listTags    []string
+	searchWhere []string
+	rawJSON     bool
+	noColor     bool
+	logSource   string
+	rngAfter    string
+	rngBefore   string
+	rngSince    string
+	rngUntil    string
+	rngFirst    int
+	rngLast     int
+	rngReverse  bool
+	watch       bool
+	interval    time.Duration
+	mtFormat    string
+	mtFrom      string
+	mtTo        string
+	mtOut       string
 )
 
 var deviceCmd = &cobra.Command{
@@ -35,7 +90,24 @@ var deviceListCmd = &cobra.Command{
 	Short: "list UUIDs of known devices",
 	Long:  `List the current registered UUIDs`,
 	Run: func(cmd *cobra.Command, args []string) {
-		u, err := resolveURL(serverURL, "/admin/device")
+		p := "/admin/device"
+		q := url.Values{}
+		if listDeleted {
+			q.Set("deleted", "true")
+		}
+		if listQuar {
+			q.Set("quarantined", "true")
+		}
+		if listLong {
+			q.Set("format", "json")
+		}
+		for _, t := range listTags {
+			q.Add("tag", t)
+		}
+		if len(q) > 0 {
+			p += "?" + q.Encode()
+		}
+		u, err := resolveURL(serverURL, p)
 		if err != nil {
 			log.Fatalf("error constructing URL: %v", err)
 		}
@@ -73,6 +145,27 @@ var deviceGetCmd = &cobra.Command{
 		var t server.DeviceCert
 		err = json.Unmarshal(buf, &t)
 		fmt.Printf("\nUUID: %s\nDevice Cert:\n%s\nOnboard Cert:\n%s\nOnboard Serial: %s", devUUID, string(t.Cert), string(t.Onboard), string(t.Serial))
+		if t.Deleted != nil {
+			fmt.Printf("\nDeleted: %s\nExpires: %s", t.Deleted.Deleted.Format(time.RFC3339), t.Deleted.Expires.Format(time.RFC3339))
+		}
+		if md := t.Metadata; md != nil {
+			fmt.Printf("\nName: %s\nSite: %s\nOwner: %s", md.Name, md.Site, md.Owner)
+			keys := make([]string, 0, len(md.Tags))
+			for k := range md.Tags {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Printf("\nTag: %s=%s", k, md.Tags[k])
+			}
+		}
+		for _, s := range t.Sources {
+			addr := s.IP
+			if s.Forwarded != "" {
+				addr = fmt.Sprintf("%s (for %s)", s.IP, s.Forwarded)
+			}
+			fmt.Printf("\nSource: %s %s %q, %d requests from %s to %s", addr, s.TLSVersion, s.UserAgent, s.Requests, s.FirstSeen.Format(time.RFC3339), s.LastSeen.Format(time.RFC3339))
+		}
 	},
 }
 
@@ -109,9 +202,18 @@ var deviceAddCmd = &cobra.Command{
 var deviceRemoveCmd = &cobra.Command{
 	Use:   "remove",
 	Short: "remove registered device",
-	Long:  `Remove a registered device`,
+	Long:  `Remove a registered device, for good or, with --soft, keeping it until its retention is over so that it can be restored`,
 	Run: func(cmd *cobra.Command, args []string) {
-		u, err := resolveURL(serverURL, path.Join("/admin/device", devUUID))
+		p := path.Join("/admin/device", devUUID)
+		if softRemove {
+			q := url.Values{}
+			q.Set("soft", "true")
+			if retention > 0 {
+				q.Set("retention", fmt.Sprintf("%d", retention))
+			}
+			p += "?" + q.Encode()
+		}
+		u, err := resolveURL(serverURL, p)
 		if err != nil {
 			log.Fatalf("error constructing URL: %v", err)
 		}
@@ -129,6 +231,15 @@ var deviceRemoveCmd = &cobra.Command{
 	},
 }
 
+var deviceRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "restore a device deleted softly",
+	Long:  `Restore a device deleted softly, before its retention is over, so that it is accepted again with its certificates, config and data`,
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("POST", path.Join("/admin/device", devUUID, "restore"), nil, http.StatusOK)
+	},
+}
+
 var deviceClearCmd = &cobra.Command{
 	Use:   "clear",
 	Short: "clear all registered devices",
@@ -161,9 +272,13 @@ var deviceConfigCmd = &cobra.Command{
 var deviceConfigGetCmd = &cobra.Command{
 	Use:   "get",
 	Short: "get a device config, in JSON format",
-	Long:  `Get the configuration for a device in JSON format.`,
+	Long:  `Get the configuration for a device in JSON format. With --merged, get the config served to the device, with its hardware model merged in.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		u, err := resolveURL(serverURL, path.Join("/admin/device", devUUID, "config"))
+		p := path.Join("/admin/device", devUUID, "config")
+		if mergeModel {
+			p += "?merged=true"
+		}
+		u, err := resolveURL(serverURL, p)
 		if err != nil {
 			log.Fatalf("error constructing URL: %v", err)
 		}
@@ -176,7 +291,11 @@ var deviceConfigGetCmd = &cobra.Command{
 		if err != nil {
 			log.Fatalf("unable to read data from URL %s: %v", u, err)
 		}
-		log.Printf("config for %s", devUUID)
+		if etag := response.Header.Get("ETag"); etag != "" {
+			log.Printf("config for %s, etag %s", devUUID, etag)
+		} else {
+			log.Printf("config for %s", devUUID)
+		}
 		fmt.Printf("%s\n", string(buf))
 	},
 }
@@ -209,28 +328,564 @@ var deviceConfigSetCmd = &cobra.Command{
 		if err != nil {
 			log.Fatalf("error constructing URL: %v", err)
 		}
+		if forceConfig {
+			u += "?force=true"
+		}
 		client := getClient()
 		req, err := http.NewRequest("PUT", u, bytes.NewBuffer(b))
 		if err != nil {
 			log.Fatalf("unable to create new http request: %v", err)
 		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
 		res, err := client.Do(req)
 		if err != nil {
 			log.Fatalf("error PUT URL %s: %v", u, err)
 		}
 		if res.StatusCode != 200 {
 			b, _ := ioutil.ReadAll(res.Body)
-			log.Fatalf("error PUT URL %s: %d %s", u, res.StatusCode, string(b))
+			log.Fatalf("error PUT URL %s: %d %s", u, res.StatusCode, errorText(b))
+		}
+		log.Printf("config for %s set, etag %s", devUUID, res.Header.Get("ETag"))
+	},
+}
+
+var deviceConfigDriftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "show how the config of a device differs from the one it last acknowledged",
+	Long:  `Show whether a device has the current config, and if not, the diff from the config it last reported having to the current one`,
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := resolveURL(serverURL, path.Join("/admin/device", devUUID, "config", "drift"))
+		if err != nil {
+			log.Fatalf("error constructing URL: %v", err)
+		}
+		response, err := getClient().Get(u)
+		if err != nil {
+			log.Fatalf("error reading URL %s: %v", u, err)
+		}
+		defer response.Body.Close()
+		buf, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			log.Fatalf("unable to read data from URL %s: %v", u, err)
+		}
+		if response.StatusCode != http.StatusOK {
+			log.Fatalf("error reading URL %s: %d %s", u, response.StatusCode, string(buf))
+		}
+		var drift server.ConfigDrift
+		if err := json.Unmarshal(buf, &drift); err != nil {
+			log.Fatalf("unable to parse config drift: %v", err)
+		}
+		fmt.Printf("up to date: %t\n", drift.UpToDate)
+		fmt.Printf("current: %s %s\n", drift.Hash, drift.Version)
+		switch {
+		case drift.Acknowledged == "":
+			fmt.Printf("acknowledged: none\n")
+		default:
+			fmt.Printf("acknowledged: %s %s at %s\n", drift.Acknowledged, drift.AcknowledgedVersion, drift.AcknowledgedAt.Format(time.RFC3339))
+		}
+		if drift.Diff != "" {
+			fmt.Printf("\n%s\n", drift.Diff)
+		}
+	},
+}
+
+var deviceQuotasCmd = &cobra.Command{
+	Use:   "quotas",
+	Short: "get, set or clear the quotas of a device",
+	Long:  `Manage the stream lengths and byte quotas of a device, overriding the global ones set when starting the server`,
+}
+
+var deviceQuotasGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get the quotas of a device, as set for it and as applied, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := resolveURL(serverURL, path.Join("/admin/device", devUUID, "quotas"))
+		if err != nil {
+			log.Fatalf("error constructing URL: %v", err)
+		}
+		response, err := getClient().Get(u)
+		if err != nil {
+			log.Fatalf("error reading URL %s: %v", u, err)
+		}
+		defer response.Body.Close()
+		buf, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			log.Fatalf("unable to read data from URL %s: %v", u, err)
+		}
+		if response.StatusCode != http.StatusOK {
+			log.Fatalf("error reading URL %s: %d %s", u, response.StatusCode, string(buf))
+		}
+		fmt.Printf("%s\n", string(buf))
+	},
+}
+
+var deviceQuotasSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "set the quotas of a device",
+	Long:  `Set the quotas of a device, as <default>,<kind>=<limit>,... with kinds logs, info, metrics, requests and apps. A default replaces all of the global limits, kinds only replace their own`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			q   common.Quotas
+			err error
+		)
+		if q.MaxLen, err = common.ParseLimits(quotaMaxLen); err != nil {
+			log.Fatalf("invalid --max-stream-len: %v", err)
+		}
+		if q.MaxBytes, err = common.ParseLimits(quotaBytes); err != nil {
+			log.Fatalf("invalid --quota: %v", err)
+		}
+		b, err := json.Marshal(q)
+		if err != nil {
+			log.Fatalf("error encoding quotas: %v", err)
+		}
+		deviceQuotasRequest("PUT", bytes.NewBuffer(b))
+	},
+}
+
+var deviceQuotasClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "clear the quotas of a device, so the global ones apply",
+	Run: func(cmd *cobra.Command, args []string) {
+		deviceQuotasRequest("DELETE", nil)
+	},
+}
+
+// addStreamRangeFlags add the flags of the range of the entries of a stream to view to a command
+func addStreamRangeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&rngAfter, "after", "", "view the entries after the one with this ID, e.g. the cursor of the previous page")
+	cmd.Flags().StringVar(&rngBefore, "before", "", "view the entries before the one with this ID")
+	cmd.Flags().StringVar(&rngSince, "since", "", "view the entries written at or after this time, in RFC3339 format")
+	cmd.Flags().StringVar(&rngUntil, "until", "", "view the entries written at or before this time, in RFC3339 format")
+	cmd.Flags().IntVar(&rngFirst, "first", 0, "view only the first entries, this many")
+	cmd.Flags().IntVar(&rngLast, "last", 0, "view only the last entries, this many")
+	cmd.Flags().BoolVar(&rngReverse, "reverse", false, "view the newest entries first")
+}
+
+// streamRangeQuery the query of the range of the entries of a stream set by the flags
+func streamRangeQuery() url.Values {
+	q := url.Values{}
+	for param, v := range map[string]string{"after": rngAfter, "before": rngBefore, "since": rngSince, "until": rngUntil} {
+		if v != "" {
+			q.Set(param, v)
 		}
+	}
+	if rngFirst > 0 {
+		q.Set("first", strconv.Itoa(rngFirst))
+	}
+	if rngLast > 0 {
+		q.Set("last", strconv.Itoa(rngLast))
+	}
+	if rngReverse {
+		q.Set("reverse", "true")
+	}
+	return q
+}
+
+// printStreamCursor print the ID of the last entry of a page of a stream, if the server sent it, to read the next
+func printStreamCursor(response *http.Response) {
+	cursor := response.Header.Get(server.StreamCursorHeader)
+	if cursor == "" {
+		return
+	}
+	flag := "--after"
+	if rngReverse {
+		flag = "--before"
+	}
+	fmt.Fprintf(os.Stderr, "next page: %s %s\n", flag, cursor)
+}
+
+// deviceQuotasRequest send a request to change the quotas of the device
+func deviceQuotasRequest(method string, body io.Reader) {
+	u, err := resolveURL(serverURL, path.Join("/admin/device", devUUID, "quotas"))
+	if err != nil {
+		log.Fatalf("error constructing URL: %v", err)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		log.Fatalf("unable to create new http request: %v", err)
+	}
+	res, err := getClient().Do(req)
+	if err != nil {
+		log.Fatalf("error %s URL %s: %v", method, u, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		log.Fatalf("error %s URL %s: %d %s", method, u, res.StatusCode, errorText(b))
+	}
+}
+
+var deviceLogFilterCmd = &cobra.Command{
+	Use:   "log-filter",
+	Short: "get, set or clear the log filter of a device",
+	Long:  `Manage the filter of the log entries of a device, dropping those below a severity before they are stored, overriding the global one set when starting the server`,
+}
+
+var deviceLogFilterGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get the log filter of a device, as set for it and as applied, with the entries it dropped, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "logfilter"), nil, http.StatusOK))
+	},
+}
+
+var deviceLogFilterSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "set the log filter of a device",
+	Long:  `Set the log filter of a device, replacing the global one. Log entries below --min-severity are dropped, but one of every --sample of them`,
+	Run: func(cmd *cobra.Command, args []string) {
+		f := common.LogFilter{MinSeverity: minSeverity, Sample: logSampling}
+		if err := f.Validate(); err != nil {
+			log.Fatalf("invalid log filter: %v", err)
+		}
+		b, err := json.Marshal(f)
+		if err != nil {
+			log.Fatalf("error encoding log filter: %v", err)
+		}
+		adminRequest("PUT", path.Join("/admin/device", devUUID, "logfilter"), bytes.NewBuffer(b), http.StatusOK)
+	},
+}
+
+var deviceLogFilterClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "clear the log filter of a device, so the global one applies",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/device", devUUID, "logfilter"), nil, http.StatusOK)
+	},
+}
+
+var deviceLocalProfileCmd = &cobra.Command{
+	Use:   "local-profile",
+	Short: "get, set or clear the local profile server state of a device",
+	Long:  `Manage what adam, as the local profile server of a device, tells it: which profile to use instead of the global one of its config, and whether to silence its radios`,
+}
+
+var deviceLocalProfileGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get the local profile server state of a device, with the radio status it last reported, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "localprofile"), nil, http.StatusOK))
+	},
+}
+
+var deviceLocalProfileSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "set the local profile server state of a device",
+	Long:  `Set the local profile server state of a device. --token must match the profile server token of the config of the device, or it ignores what it is told`,
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := json.Marshal(common.LocalProfile{Token: lpToken, Profile: lpProfile, RadioSilence: radioSilent})
+		if err != nil {
+			log.Fatalf("error encoding local profile: %v", err)
+		}
+		adminRequest("PUT", path.Join("/admin/device", devUUID, "localprofile"), bytes.NewBuffer(b), http.StatusOK)
+	},
+}
+
+var deviceLocalProfileClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "clear the local profile server state of a device, so adam no longer serves it one",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/device", devUUID, "localprofile"), nil, http.StatusOK)
+	},
+}
+
+var deviceMetadataCmd = &cobra.Command{
+	Use:   "metadata",
+	Short: "get, set or clear the name, site, owner and tags of a device",
+	Long:  `Manage what is recorded about a device to organize the fleet: its name, site and owner, and any other tags, by which the devices can be listed with device list --tag`,
+}
+
+var deviceMetadataGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get the metadata of a device, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "metadata"), nil, http.StatusOK))
+	},
+}
+
+var deviceMetadataSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "set the metadata of a device",
+	Long:  `Set the metadata of a device, changing only what is given: --name, --site and --owner, the tags of --tag <key>=<value>, adding them or changing their value, and the tags of --remove-tag <key>, removing them`,
+	Run: func(cmd *cobra.Command, args []string) {
+		p := path.Join("/admin/device", devUUID, "metadata")
+		var md common.DeviceMetadata
+		if err := json.Unmarshal(adminRequest("GET", p, nil, http.StatusOK), &md); err != nil {
+			log.Fatalf("error decoding metadata: %v", err)
+		}
+		if cmd.Flags().Changed("name") {
+			md.Name = mdName
+		}
+		if cmd.Flags().Changed("site") {
+			md.Site = mdSite
+		}
+		if cmd.Flags().Changed("owner") {
+			md.Owner = mdOwner
+		}
+		for _, t := range mdTags {
+			k, v := t, ""
+			if i := strings.Index(t, "="); i >= 0 {
+				k, v = t[:i], t[i+1:]
+			}
+			if md.Tags == nil {
+				md.Tags = map[string]string{}
+			}
+			md.Tags[k] = v
+		}
+		for _, k := range mdUntag {
+			delete(md.Tags, k)
+		}
+		if err := md.Validate(); err != nil {
+			log.Fatalf("invalid metadata: %v", err)
+		}
+		b, err := json.Marshal(md)
+		if err != nil {
+			log.Fatalf("error encoding metadata: %v", err)
+		}
+		adminRequest("PUT", p, bytes.NewBuffer(b), http.StatusOK)
+	},
+}
+
+var deviceMetadataClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "clear the metadata of a device, with all of its tags",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/device", devUUID, "metadata"), nil, http.StatusOK)
+	},
+}
+
+var deviceModelCmd = &cobra.Command{
+	Use:   "hardware-model",
+	Short: "get, set or clear the hardware model of a device",
+	Long:  `Manage the hardware model of a device, from the catalog of hardware-model, whose IO adapters, system adapters, manufacturer and product name are merged into the config served to the device. What the config of the device has itself is kept`,
+}
+
+var deviceModelGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get the hardware model of a device, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "hardware-model"), nil, http.StatusOK))
+	},
+}
+
+var deviceModelSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "set the hardware model of a device",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := json.Marshal(server.DeviceModel{Model: devModel})
+		if err != nil {
+			log.Fatalf("error encoding hardware model: %v", err)
+		}
+		adminRequest("PUT", path.Join("/admin/device", devUUID, "hardware-model"), bytes.NewBuffer(b), http.StatusOK)
+	},
+}
+
+var deviceModelClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "clear the hardware model of a device, so it is served its config alone",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/device", devUUID, "hardware-model"), nil, http.StatusOK)
+	},
+}
+
+var deviceFlagsCmd = &cobra.Command{
+	Use:   "flags",
+	Short: "get, set or clear the flags of a device",
+	Long:  `Manage the flags of a device, which change how adam serves it: hold-config serves the device the config it had when the flag was set, read-only refuses changes to its config, and verbose-debug logs each of its requests with their headers`,
+}
+
+var deviceFlagsGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get the flags of a device, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "flags"), nil, http.StatusOK))
+	},
+}
+
+var deviceFlagsSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "set a flag of a device",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("PUT", path.Join("/admin/device", devUUID, "flags", devFlag), nil, http.StatusOK))
+	},
+}
+
+var deviceFlagsClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "clear a flag of a device",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("DELETE", path.Join("/admin/device", devUUID, "flags", devFlag), nil, http.StatusOK))
+	},
+}
+
+var deviceQuarantineCmd = &cobra.Command{
+	Use:   "quarantine",
+	Short: "get, set or release the quarantine of a device",
+	Long:  `Manage the quarantine of a device: while quarantined, its telemetry is still accepted, but it is served a minimal config, without app instances and with its management network only, until it is released`,
+}
+
+var deviceQuarantineGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get whether a device is quarantined, with the reason, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "quarantine"), nil, http.StatusOK))
+	},
+}
+
+var deviceQuarantineSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "quarantine a device, or change the reason of its quarantine",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := json.Marshal(server.QuarantineRequest{Reason: quarReason})
+		if err != nil {
+			log.Fatalf("error encoding quarantine: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("PUT", path.Join("/admin/device", devUUID, "quarantine"), bytes.NewBuffer(b), http.StatusOK))
+	},
+}
+
+var deviceQuarantineReleaseCmd = &cobra.Command{
+	Use:   "release",
+	Short: "release a device from quarantine, so it is served its own config again",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("DELETE", path.Join("/admin/device", devUUID, "quarantine"), nil, http.StatusOK))
+	},
+}
+
+var deviceAttestationCmd = &cobra.Command{
+	Use:   "attestation",
+	Short: "get or reset the attestation of a device",
+	Long:  `Manage the attestation of a device with a TPM: the certificates it published, when it last attested, and the keys of its volume vaults it escrowed, which it is given back once it attests`,
+}
+
+var deviceAttestationGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get the attestation of a device, with the digests of the keys it escrowed, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "attestation"), nil, http.StatusOK))
+	},
+}
+
+var deviceAttestationResetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "reset the attestation of a device, removing its certificates and the keys it escrowed",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("DELETE", path.Join("/admin/device", devUUID, "attestation"), nil, http.StatusOK))
+	},
+}
+
+var deviceAppCommandCmd = &cobra.Command{
+	Use:   "app-command",
+	Short: "restart or purge the app instances of a device",
+	Long:  `Queue commands to the app instances of a device. A command is sent through the config of the device, by bumping the restart or purge counter of the app instance, once the command before it on the same app instance finished; its state then follows the info messages of the device about the app instance: sent, in-progress while it restarts or purges, and done once it runs again, or failed with the error it reported`,
+}
+
+var deviceAppCommandListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the commands to the app instances of a device, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "app-command"), nil, http.StatusOK))
+	},
+}
+
+var deviceAppCommandGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get a command to an app instance of a device, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "app-command", appCmdID), nil, http.StatusOK))
+	},
+}
+
+var deviceAppCommandAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "queue a command to an app instance of a device, and print it",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := json.Marshal(server.AppCommandRequest{App: appName, Command: appCommand})
+		if err != nil {
+			log.Fatalf("error encoding app command: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", path.Join("/admin/device", devUUID, "app-command"), bytes.NewBuffer(b), http.StatusCreated))
+	},
+}
+
+var deviceAppCommandRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove a command to an app instance of a device, queued or finished",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/device", devUUID, "app-command", appCmdID), nil, http.StatusOK)
+	},
+}
+
+var deviceRebootCmd = &cobra.Command{
+	Use:   "reboot",
+	Short: "reboot a device, and follow the reboot",
+	Long:  `Reboot a device by bumping the reboot counter in its config. The status of the reboot, from the info messages of the device, has a confirmation token, which the reboot must be sent with, so that it is refused if the config of the device changed since`,
+}
+
+var deviceRebootGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get the status of the reboot of a device, with the token to confirm a reboot with, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "reboot"), nil, http.StatusOK))
+	},
+}
+
+var deviceRebootSendCmd = &cobra.Command{
+	Use:   "send",
+	Short: "reboot a device, and print the status of the reboot",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := json.Marshal(server.RebootRequest{Confirm: opsConfirm})
+		if err != nil {
+			log.Fatalf("error encoding reboot: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", path.Join("/admin/device", devUUID, "reboot"), bytes.NewBuffer(b), http.StatusOK))
+	},
+}
+
+var deviceBaseOSCmd = &cobra.Command{
+	Use:   "baseos",
+	Short: "update the EVE version of a device, and follow the update",
+	Long:  `Update the EVE version of a device by setting the base OS in its config. The status of the update, from the info messages of the device, has a confirmation token, which the update must be sent with, with the EVE version the device runs, so that it is refused if the config of the device changed since or the device runs another version`,
+}
+
+var deviceBaseOSGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get the status of the EVE update of a device, with the token to confirm an update with, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "baseos"), nil, http.StatusOK))
+	},
+}
+
+var deviceBaseOSUpdateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "update the EVE version of a device, and print the status of the update",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := json.Marshal(server.BaseOSRequest{Version: osVersion, Image: osImage, CurrentVersion: osCurrent, Confirm: opsConfirm})
+		if err != nil {
+			log.Fatalf("error encoding base OS update: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", path.Join("/admin/device", devUUID, "baseos"), bytes.NewBuffer(b), http.StatusOK))
 	},
 }
 
 var deviceLogsCmd = &cobra.Command{
 	Use:   "logs",
 	Short: "view logs",
-	Long:  `View logs for a specific device, either those already in storage or streaming new`,
+	Long: `View logs for a specific device, either those already in storage or streaming new.
+Each entry is shown with its time, severity, source and content, colored by severity on a terminal, or as the JSON it is stored as with --json.
+With --source, only the entries of that source, e.g. zedagent, are shown.
+With --first or --last, only that many entries are shown, newest first with --reverse, from an entry with --after or --before, or a time with --since or --until`,
 	Run: func(cmd *cobra.Command, args []string) {
-		u, err := resolveURL(serverURL, path.Join("/admin/device", devUUID, "logs"))
+		p := path.Join("/admin/device", devUUID, "logs")
+		q := streamRangeQuery()
+		if logSource != "" {
+			q.Set("source", logSource)
+		}
+		if len(q) > 0 {
+			p += "?" + q.Encode()
+		}
+		u, err := resolveURL(serverURL, p)
 		if err != nil {
 			log.Fatalf("error constructing URL: %v", err)
 		}
@@ -247,18 +902,202 @@ var deviceLogsCmd = &cobra.Command{
 		if err != nil {
 			log.Fatalf("error reading URL %s: %v", u, err)
 		}
-		if _, err := io.Copy(os.Stdout, response.Body); err != nil {
-			log.Fatalf("error writing output: %v", err)
+		if rawJSON {
+			if _, err := io.Copy(os.Stdout, response.Body); err != nil {
+				log.Fatalf("error writing output: %v", err)
+			}
+			return
+		}
+		if response.StatusCode != http.StatusOK {
+			b, _ := ioutil.ReadAll(response.Body)
+			log.Fatalf("error reading URL %s: %d %s", u, response.StatusCode, errorText(b))
+		}
+		if err := printLogs(response.Body, os.Stdout, useColor(noColor)); err != nil {
+			log.Fatalf("error reading logs: %v", err)
 		}
+		printStreamCursor(response)
+	},
+}
+
+var deviceLogSourcesCmd = &cobra.Command{
+	Use:   "sources",
+	Short: "get the sources of the logs of a device, in JSON format",
+	Long:  `Get the sources of the logs stored for a device, e.g. zedagent, with the number of entries of each, in JSON format.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "logs", "sources"), nil, http.StatusOK))
+	},
+}
+
+var deviceMetricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "view metrics",
+	Long: `View the metrics of a specific device: the time, uptime and CPU seconds of each message, the memory and /persist use in MB, what the interfaces received and sent, and the number of app instances.
+With --watch, the latest message is shown, then the new ones as they come, checking every --interval. With --json, the messages are shown as the JSON they are stored as.
+With --first or --last, only that many messages are shown, newest first with --reverse, from an entry with --after or --before, or a time with --since or --until`,
+	Run: func(cmd *cobra.Command, args []string) {
+		p := path.Join("/admin/device", devUUID, "metrics")
+		if q := streamRangeQuery(); len(q) > 0 {
+			if watch {
+				log.Fatalf("a range of the metrics cannot be watched")
+			}
+			p += "?" + q.Encode()
+		}
+		if rawJSON && !watch {
+			fmt.Printf("%s", adminRequest("GET", p, nil, http.StatusOK))
+			return
+		}
+		msgs, err := readMetrics(bytes.NewReader(adminRequest("GET", p, nil, http.StatusOK)))
+		if err != nil {
+			log.Fatalf("error reading metrics: %v", err)
+		}
+		if !watch {
+			printMetricsHeader(os.Stdout)
+			for _, msg := range msgs {
+				printMetrics(os.Stdout, msg)
+			}
+			return
+		}
+		if interval <= 0 {
+			log.Fatalf("--interval must be positive")
+		}
+		if !rawJSON {
+			printMetricsHeader(os.Stdout)
+		}
+		// start from the latest message, then show those after the last one shown
+		var last time.Time
+		if len(msgs) > 0 {
+			msgs = msgs[len(msgs)-1:]
+		}
+		for {
+			for _, msg := range msgs {
+				at := msg.GetAtTimeStamp().AsTime()
+				if !at.After(last) {
+					continue
+				}
+				last = at
+				if rawJSON {
+					b, err := protojson.Marshal(msg)
+					if err != nil {
+						log.Fatalf("error encoding metrics: %v", err)
+					}
+					fmt.Printf("%s\n", b)
+					continue
+				}
+				printMetrics(os.Stdout, msg)
+			}
+			time.Sleep(interval)
+			if msgs, err = readMetrics(bytes.NewReader(adminRequest("GET", p, nil, http.StatusOK))); err != nil {
+				log.Fatalf("error reading metrics: %v", err)
+			}
+		}
+	},
+}
+
+var deviceMetricsExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export the metrics of a device in a time range as CSV or Parquet",
+	Long: `Export the metrics of a device as CSV, or Parquet with --format parquet, a row per message and a column per metric and its labels, e.g. eve_device_disk_used_mb{disk=sda,mount=/persist}, after the time of the message.
+--from and --to, in RFC3339 format, limit the range of messages, all of them by default. It is written to --out, stdout by default, as it is received`,
+	Run: func(cmd *cobra.Command, args []string) {
+		q := url.Values{"format": {mtFormat}}
+		if mtFrom != "" {
+			q.Set("from", mtFrom)
+		}
+		if mtTo != "" {
+			q.Set("to", mtTo)
+		}
+		u, err := resolveURL(serverURL, path.Join("/admin/device", devUUID, "metrics", "export")+"?"+q.Encode())
+		if err != nil {
+			log.Fatalf("error constructing URL: %v", err)
+		}
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			log.Fatalf("unable to create new http request: %v", err)
+		}
+		res, err := getStreamingClient().Do(req)
+		if err != nil {
+			log.Fatalf("error reading URL %s: %v", u, err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			b, _ := ioutil.ReadAll(res.Body)
+			log.Fatalf("error reading URL %s: %d %s", u, res.StatusCode, errorText(b))
+		}
+		out := os.Stdout
+		if mtOut != "-" {
+			if out, err = os.Create(mtOut); err != nil {
+				log.Fatalf("error creating %s: %v", mtOut, err)
+			}
+		}
+		if _, err := io.Copy(out, res.Body); err != nil {
+			log.Fatalf("error writing %s: %v", mtOut, err)
+		}
+		if err := out.Close(); err != nil {
+			log.Fatalf("error writing %s: %v", mtOut, err)
+		}
+	},
+}
+
+var deviceInventoryCmd = &cobra.Command{
+	Use:   "inventory",
+	Short: "get the current state of a device, in JSON format",
+	Long:  `Get the current state of a device, from the info messages it sent: its hardware, network interfaces, EVE version and app instances, in JSON format.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "inventory"), nil, http.StatusOK))
+	},
+}
+
+var deviceTwinCmd = &cobra.Command{
+	Use:   "twin",
+	Short: "get the config of a device and the state it last reported, in JSON format",
+	Long:  `Get the config a device is served and the state it last reported as one document, with whether its config, EVE version, reboot and app instances are in sync, in JSON format.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "twin"), nil, http.StatusOK))
+	},
+}
+
+var deviceSearchCmd = &cobra.Command{
+	Use:   "search",
+	Short: "find the devices whose inventory matches conditions, in JSON format",
+	Long:  `Find the devices whose inventory matches all the conditions of --where, e.g. 'eve-version<9.0', 'apps[name=web*].state==ERROR' or 'networks[interface=eth0].ips==', with the values of the fields that matched, in JSON format.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		q := url.Values{"where": searchWhere}
+		for _, t := range listTags {
+			q.Add("tag", t)
+		}
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/inventory?"+q.Encode(), nil, http.StatusOK))
+	},
+}
+
+var deviceUsageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "get the storage used by each kind of message of a device, in JSON format",
+	Long:  `Get the bytes, number and oldest and newest times of the logs, info, metrics, requests and app logs stored for a device, in JSON format.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "usage"), nil, http.StatusOK))
+	},
+}
+
+var deviceStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "get the requests of a device since the server started, in JSON format",
+	Long:  `Get the requests of a device per endpoint, its config polls, the bytes of logs, info, metrics and app logs it sent, its errors and the last one, over the last hour and since the server started, in JSON format.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/device", devUUID, "stats"), nil, http.StatusOK))
 	},
 }
 
 var deviceInfoCmd = &cobra.Command{
 	Use:   "info",
 	Short: "view info messages",
-	Long:  `View info messages for a specific device, either those already in storage or streaming new`,
+	Long: `View info messages for a specific device, either those already in storage or streaming new.
+With --first or --last, only that many messages are shown, newest first with --reverse, from an entry with --after or --before, or a time with --since or --until`,
 	Run: func(cmd *cobra.Command, args []string) {
-		u, err := resolveURL(serverURL, path.Join("/admin/device", devUUID, "info"))
+		p := path.Join("/admin/device", devUUID, "info")
+		if q := streamRangeQuery(); len(q) > 0 {
+			p += "?" + q.Encode()
+		}
+		u, err := resolveURL(serverURL, p)
 		if err != nil {
 			log.Fatalf("error constructing URL: %v", err)
 		}
@@ -278,6 +1117,7 @@ var deviceInfoCmd = &cobra.Command{
 		if _, err := io.Copy(os.Stdout, response.Body); err != nil {
 			log.Fatalf("error writing output: %v", err)
 		}
+		printStreamCursor(response)
 	},
 }
 
@@ -312,6 +1152,10 @@ var deviceRequestsCmd = &cobra.Command{
 func deviceInit() {
 	// deviceList
 	deviceCmd.AddCommand(deviceListCmd)
+	deviceListCmd.Flags().BoolVar(&listDeleted, "deleted", false, "list only the devices deleted softly")
+	deviceListCmd.Flags().BoolVar(&listQuar, "quarantined", false, "list only the devices quarantined")
+	deviceListCmd.Flags().BoolVar(&listLong, "long", false, "list the devices with their name, site, owner, tags and identity, as reported in their device info, as JSON")
+	deviceListCmd.Flags().StringArrayVar(&listTags, "tag", nil, "list only the devices with this tag, as <key>:<value> or <key> for any value, or with this name, site or owner, e.g. site:berlin; repeat to require several")
 	// deviceGet
 	deviceCmd.AddCommand(deviceGetCmd)
 	deviceGetCmd.Flags().StringVar(&devUUID, "uuid", "", "uuid of device to get")
@@ -324,6 +1168,12 @@ func deviceInit() {
 	deviceCmd.AddCommand(deviceRemoveCmd)
 	deviceRemoveCmd.Flags().StringVar(&devUUID, "uuid", "", "uuid of device to remove")
 	deviceRemoveCmd.MarkFlagRequired("uuid")
+	deviceRemoveCmd.Flags().BoolVar(&softRemove, "soft", false, "delete the device softly, refusing it but keeping it until its retention is over so that it can be restored")
+	deviceRemoveCmd.Flags().IntVar(&retention, "retention", 0, "how long, in seconds, to keep a device deleted softly; 0 means the retention of the server")
+	// deviceRestore
+	deviceCmd.AddCommand(deviceRestoreCmd)
+	deviceRestoreCmd.Flags().StringVar(&devUUID, "uuid", "", "uuid of device to restore")
+	deviceRestoreCmd.MarkFlagRequired("uuid")
 	// deviceClear
 	deviceCmd.AddCommand(deviceClearCmd)
 	// deviceConfig
@@ -332,20 +1182,179 @@ func deviceInit() {
 	deviceConfigCmd.MarkFlagRequired("uuid")
 	// deviceConfigGet
 	deviceConfigCmd.AddCommand(deviceConfigGetCmd)
+	deviceConfigGetCmd.Flags().BoolVar(&mergeModel, "merged", false, "get the config served to the device, with its hardware model merged in")
 	// deviceConfigSet
 	deviceConfigCmd.AddCommand(deviceConfigSetCmd)
 	deviceConfigSetCmd.Flags().StringVar(&configPath, "config-path", "", "path to config file to set; use '-' to read from stdin")
 	deviceConfigSetCmd.MarkFlagRequired("config-path")
+	deviceConfigSetCmd.Flags().BoolVar(&forceConfig, "force", false, "set the config even if it refers to objects it does not have, which EVE rejects")
+	deviceConfigSetCmd.Flags().StringVar(&ifMatch, "if-match", "", "ETag of the config read, as logged by config get, so that the config is only set if it did not change since")
+	// deviceConfigDrift
+	deviceConfigCmd.AddCommand(deviceConfigDriftCmd)
+	// deviceQuotas
+	deviceCmd.AddCommand(deviceQuotasCmd)
+	deviceQuotasCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device")
+	deviceQuotasCmd.MarkPersistentFlagRequired("uuid")
+	deviceQuotasCmd.AddCommand(deviceQuotasGetCmd)
+	deviceQuotasCmd.AddCommand(deviceQuotasSetCmd)
+	deviceQuotasSetCmd.Flags().StringVar(&quotaMaxLen, "max-stream-len", "", "maximum number of entries kept per stream, e.g. 10000,logs=50000")
+	deviceQuotasSetCmd.Flags().StringVar(&quotaBytes, "quota", "", "maximum number of bytes accepted per quota period, e.g. 1048576,metrics=0")
+	deviceQuotasCmd.AddCommand(deviceQuotasClearCmd)
+	// deviceLogFilter
+	deviceCmd.AddCommand(deviceLogFilterCmd)
+	deviceLogFilterCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device")
+	deviceLogFilterCmd.MarkPersistentFlagRequired("uuid")
+	deviceLogFilterCmd.AddCommand(deviceLogFilterGetCmd)
+	deviceLogFilterCmd.AddCommand(deviceLogFilterSetCmd)
+	deviceLogFilterSetCmd.Flags().StringVar(&minSeverity, "min-severity", "", "severity below which log entries are dropped, e.g. info; empty keeps all")
+	deviceLogFilterSetCmd.Flags().IntVar(&logSampling, "sample", 0, "keep one of every this many entries below --min-severity instead of dropping all of them; 0 drops all")
+	deviceLogFilterCmd.AddCommand(deviceLogFilterClearCmd)
+	// deviceLocalProfile
+	deviceCmd.AddCommand(deviceLocalProfileCmd)
+	deviceLocalProfileCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device")
+	deviceLocalProfileCmd.MarkPersistentFlagRequired("uuid")
+	deviceLocalProfileCmd.AddCommand(deviceLocalProfileGetCmd)
+	deviceLocalProfileCmd.AddCommand(deviceLocalProfileSetCmd)
+	deviceLocalProfileSetCmd.Flags().StringVar(&lpToken, "token", "", "server token, matching the profile server token of the config of the device")
+	deviceLocalProfileSetCmd.MarkFlagRequired("token")
+	deviceLocalProfileSetCmd.Flags().StringVar(&lpProfile, "profile", "", "local profile for the device to use instead of the global one of its config; empty for none")
+	deviceLocalProfileSetCmd.Flags().BoolVar(&radioSilent, "radio-silence", false, "whether the device is to turn its radios off")
+	deviceLocalProfileCmd.AddCommand(deviceLocalProfileClearCmd)
+	// deviceModel
+	deviceCmd.AddCommand(deviceModelCmd)
+	deviceModelCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device")
+	deviceModelCmd.MarkPersistentFlagRequired("uuid")
+	deviceModelCmd.AddCommand(deviceModelGetCmd)
+	deviceModelCmd.AddCommand(deviceModelSetCmd)
+	deviceModelSetCmd.Flags().StringVar(&devModel, "name", "", "name of the hardware model, from the catalog")
+	deviceModelSetCmd.MarkFlagRequired("name")
+	deviceModelCmd.AddCommand(deviceModelClearCmd)
+	// deviceFlags
+	deviceCmd.AddCommand(deviceFlagsCmd)
+	deviceFlagsCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device")
+	deviceFlagsCmd.MarkPersistentFlagRequired("uuid")
+	deviceFlagsCmd.AddCommand(deviceFlagsGetCmd)
+	deviceFlagsCmd.AddCommand(deviceFlagsSetCmd)
+	deviceFlagsSetCmd.Flags().StringVar(&devFlag, "flag", "", "flag to set: hold-config, read-only or verbose-debug")
+	deviceFlagsSetCmd.MarkFlagRequired("flag")
+	deviceFlagsCmd.AddCommand(deviceFlagsClearCmd)
+	deviceFlagsClearCmd.Flags().StringVar(&devFlag, "flag", "", "flag to clear: hold-config, read-only or verbose-debug")
+	deviceFlagsClearCmd.MarkFlagRequired("flag")
+	// deviceQuarantine
+	deviceCmd.AddCommand(deviceQuarantineCmd)
+	deviceQuarantineCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device")
+	deviceQuarantineCmd.MarkPersistentFlagRequired("uuid")
+	deviceQuarantineCmd.AddCommand(deviceQuarantineGetCmd)
+	deviceQuarantineCmd.AddCommand(deviceQuarantineSetCmd)
+	deviceQuarantineSetCmd.Flags().StringVar(&quarReason, "reason", "", "why the device is quarantined, shown with its status")
+	deviceQuarantineSetCmd.MarkFlagRequired("reason")
+	deviceQuarantineCmd.AddCommand(deviceQuarantineReleaseCmd)
+	// deviceAttestation
+	deviceCmd.AddCommand(deviceAttestationCmd)
+	deviceAttestationCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device")
+	deviceAttestationCmd.MarkPersistentFlagRequired("uuid")
+	deviceAttestationCmd.AddCommand(deviceAttestationGetCmd)
+	deviceAttestationCmd.AddCommand(deviceAttestationResetCmd)
+	// deviceAppCommand
+	deviceCmd.AddCommand(deviceAppCommandCmd)
+	deviceAppCommandCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device")
+	deviceAppCommandCmd.MarkPersistentFlagRequired("uuid")
+	deviceAppCommandCmd.AddCommand(deviceAppCommandListCmd)
+	deviceAppCommandCmd.AddCommand(deviceAppCommandGetCmd)
+	deviceAppCommandGetCmd.Flags().StringVar(&appCmdID, "id", "", "ID of the command")
+	deviceAppCommandGetCmd.MarkFlagRequired("id")
+	deviceAppCommandCmd.AddCommand(deviceAppCommandAddCmd)
+	deviceAppCommandAddCmd.Flags().StringVar(&appName, "app", "", "UUID or display name of the app instance, in the config of the device")
+	deviceAppCommandAddCmd.MarkFlagRequired("app")
+	deviceAppCommandAddCmd.Flags().StringVar(&appCommand, "command", "", "command to the app instance, restart or purge")
+	deviceAppCommandAddCmd.MarkFlagRequired("command")
+	deviceAppCommandCmd.AddCommand(deviceAppCommandRemoveCmd)
+	deviceAppCommandRemoveCmd.Flags().StringVar(&appCmdID, "id", "", "ID of the command")
+	deviceAppCommandRemoveCmd.MarkFlagRequired("id")
+	// deviceReboot
+	deviceCmd.AddCommand(deviceRebootCmd)
+	deviceRebootCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device")
+	deviceRebootCmd.MarkPersistentFlagRequired("uuid")
+	deviceRebootCmd.AddCommand(deviceRebootGetCmd)
+	deviceRebootCmd.AddCommand(deviceRebootSendCmd)
+	deviceRebootSendCmd.Flags().StringVar(&opsConfirm, "confirm", "", "confirmation token, from the reboot status of the device")
+	deviceRebootSendCmd.MarkFlagRequired("confirm")
+	// deviceBaseOS
+	deviceCmd.AddCommand(deviceBaseOSCmd)
+	deviceBaseOSCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device")
+	deviceBaseOSCmd.MarkPersistentFlagRequired("uuid")
+	deviceBaseOSCmd.AddCommand(deviceBaseOSGetCmd)
+	deviceBaseOSCmd.AddCommand(deviceBaseOSUpdateCmd)
+	deviceBaseOSUpdateCmd.Flags().StringVar(&osVersion, "version", "", "EVE version to update to, e.g. 6.1.0-kvm-amd64")
+	deviceBaseOSUpdateCmd.MarkFlagRequired("version")
+	deviceBaseOSUpdateCmd.Flags().StringVar(&osImage, "image", "", "name of the image of the catalog with the EVE version, or UUID of a volume or content tree in the config")
+	deviceBaseOSUpdateCmd.MarkFlagRequired("image")
+	deviceBaseOSUpdateCmd.Flags().StringVar(&osCurrent, "current-version", "", "EVE version the device must be running, as in its inventory")
+	deviceBaseOSUpdateCmd.MarkFlagRequired("current-version")
+	deviceBaseOSUpdateCmd.Flags().StringVar(&opsConfirm, "confirm", "", "confirmation token, from the base OS status of the device")
+	deviceBaseOSUpdateCmd.MarkFlagRequired("confirm")
+	// deviceMetadata
+	deviceCmd.AddCommand(deviceMetadataCmd)
+	deviceMetadataCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device")
+	deviceMetadataCmd.MarkPersistentFlagRequired("uuid")
+	deviceMetadataCmd.AddCommand(deviceMetadataGetCmd)
+	deviceMetadataCmd.AddCommand(deviceMetadataSetCmd)
+	deviceMetadataSetCmd.Flags().StringVar(&mdName, "name", "", "name of the device; empty to clear it")
+	deviceMetadataSetCmd.Flags().StringVar(&mdSite, "site", "", "site the device is at; empty to clear it")
+	deviceMetadataSetCmd.Flags().StringVar(&mdOwner, "owner", "", "owner of the device; empty to clear it")
+	deviceMetadataSetCmd.Flags().StringArrayVar(&mdTags, "tag", nil, "tag to set, as <key>=<value>; repeat for several")
+	deviceMetadataSetCmd.Flags().StringArrayVar(&mdUntag, "remove-tag", nil, "key of a tag to remove; repeat for several")
+	deviceMetadataCmd.AddCommand(deviceMetadataClearCmd)
 	// deviceLogsCmd
 	deviceCmd.AddCommand(deviceLogsCmd)
 	deviceLogsCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device to get logs")
 	deviceLogsCmd.MarkFlagRequired("uuid")
 	deviceLogsCmd.Flags().BoolVarP(&follow, "follow", "f", false, "follow new logs instead of viewing existing logs")
+	deviceLogsCmd.Flags().BoolVar(&rawJSON, "json", false, "show the entries as the JSON they are stored as")
+	deviceLogsCmd.Flags().BoolVar(&noColor, "no-color", false, "do not color the entries by severity")
+	deviceLogsCmd.Flags().StringVar(&logSource, "source", "", "show only the entries of a source, e.g. zedagent")
+	addStreamRangeFlags(deviceLogsCmd)
+	deviceLogsCmd.AddCommand(deviceLogSourcesCmd)
+	// deviceMetricsCmd
+	deviceCmd.AddCommand(deviceMetricsCmd)
+	deviceMetricsCmd.PersistentFlags().StringVar(&devUUID, "uuid", "", "uuid of device to get metrics")
+	deviceMetricsCmd.MarkFlagRequired("uuid")
+	deviceMetricsCmd.Flags().BoolVarP(&watch, "watch", "w", false, "show the latest metrics, then the new ones as they come")
+	deviceMetricsCmd.Flags().DurationVar(&interval, "interval", 5*time.Second, "how often to check for new metrics with --watch")
+	deviceMetricsCmd.Flags().BoolVar(&rawJSON, "json", false, "show the messages as the JSON they are stored as")
+	addStreamRangeFlags(deviceMetricsCmd)
+	deviceMetricsCmd.AddCommand(deviceMetricsExportCmd)
+	deviceMetricsExportCmd.Flags().StringVar(&mtFormat, "format", "csv", "format to export in, csv or parquet")
+	deviceMetricsExportCmd.Flags().StringVar(&mtFrom, "from", "", "export the messages at or after this time, in RFC3339 format")
+	deviceMetricsExportCmd.Flags().StringVar(&mtTo, "to", "", "export the messages at or before this time, in RFC3339 format")
+	deviceMetricsExportCmd.Flags().StringVar(&mtOut, "out", "-", "file to write the export to, - for stdout")
 	// deviceInfoCmd
 	deviceCmd.AddCommand(deviceInfoCmd)
 	deviceInfoCmd.Flags().StringVar(&devUUID, "uuid", "", "uuid of device to get info messages")
 	deviceInfoCmd.MarkFlagRequired("uuid")
 	deviceInfoCmd.Flags().BoolVarP(&follow, "follow", "f", false, "follow new info messages instead of viewing existing logs")
+	addStreamRangeFlags(deviceInfoCmd)
+	// deviceInventoryCmd
+	deviceCmd.AddCommand(deviceInventoryCmd)
+	deviceInventoryCmd.Flags().StringVar(&devUUID, "uuid", "", "uuid of device to get the inventory of")
+	deviceInventoryCmd.MarkFlagRequired("uuid")
+	// deviceTwinCmd
+	deviceCmd.AddCommand(deviceTwinCmd)
+	deviceTwinCmd.Flags().StringVar(&devUUID, "uuid", "", "uuid of device to get the twin of")
+	deviceTwinCmd.MarkFlagRequired("uuid")
+	// deviceSearchCmd
+	deviceCmd.AddCommand(deviceSearchCmd)
+	deviceSearchCmd.Flags().StringArrayVar(&searchWhere, "where", nil, "condition on the inventory, as <field><op><value>; repeat to require several")
+	deviceSearchCmd.MarkFlagRequired("where")
+	deviceSearchCmd.Flags().StringArrayVar(&listTags, "tag", nil, "search only the devices with this tag, as for device list; repeat to require several")
+	// deviceUsageCmd
+	deviceCmd.AddCommand(deviceUsageCmd)
+	deviceUsageCmd.Flags().StringVar(&devUUID, "uuid", "", "uuid of device to get the storage usage of")
+	deviceUsageCmd.MarkFlagRequired("uuid")
+	// deviceStatsCmd
+	deviceCmd.AddCommand(deviceStatsCmd)
+	deviceStatsCmd.Flags().StringVar(&devUUID, "uuid", "", "uuid of device to get the request stats of")
+	deviceStatsCmd.MarkFlagRequired("uuid")
 	// deviceRequestsCmd
 	deviceCmd.AddCommand(deviceRequestsCmd)
 	deviceRequestsCmd.Flags().StringVar(&devUUID, "uuid", "", "uuid of device to get request logs")
@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	faultID        string
+	faultKind      string
+	faultEndpoints []string
+	faultDevices   []string
+	faultPercent   float64
+	faultStatus    int
+	faultDelay     time.Duration
+	faultTruncate  int
+	faultLimit     uint64
+)
+
+var faultCmd = &cobra.Command{
+	Use:   "fault",
+	Short: "manage faults injected into the requests of devices",
+	Long:  `Fault rules inject faults into the requests of devices to a server run with --fault-injection, to test how EVE handles a failing controller: errors, delays, truncated responses and configs with stale hashes. Rules are kept in memory until the server stops, by the replica they were added to`,
+}
+
+var faultListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list fault rules in JSON format, with how many faults each injected",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/fault", nil, http.StatusOK))
+	},
+}
+
+var faultAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "add a fault rule, and print it",
+	Long: `Add a fault rule, and print it. --kind is one of:
+error         answer with --status instead of handling the request
+delay         handle the request after --delay
+truncate      send only --truncate bytes of the response body, half of it if 0, closing the connection before the rest
+stale-config  send the config to POST /api/v1/edgedevice/config with a hash other than its own
+The rule applies to the requests to the --endpoint paths, or every endpoint of the device API if there are none, of the --device devices, or every device if there are none, and injects into --percent of them, at random`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rule := server.FaultRule{
+			Kind:          faultKind,
+			Endpoints:     faultEndpoints,
+			Devices:       faultDevices,
+			Percent:       faultPercent,
+			Status:        faultStatus,
+			DelayMs:       faultDelay.Milliseconds(),
+			TruncateBytes: faultTruncate,
+			Limit:         faultLimit,
+		}
+		if err := rule.Validate(); err != nil {
+			log.Fatalf("invalid fault rule: %v", err)
+		}
+		b, err := json.Marshal(rule)
+		if err != nil {
+			log.Fatalf("error encoding fault rule: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", "/admin/fault", bytes.NewBuffer(b), http.StatusCreated))
+	},
+}
+
+var faultRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove a fault rule, so that it injects no more faults",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/fault", faultID), nil, http.StatusOK)
+	},
+}
+
+func faultInit() {
+	faultCmd.AddCommand(faultListCmd)
+	faultCmd.AddCommand(faultAddCmd)
+	faultAddCmd.Flags().StringVar(&faultKind, "kind", server.FaultError, "kind of fault, one of error, delay, truncate and stale-config")
+	faultAddCmd.Flags().StringSliceVar(&faultEndpoints, "endpoint", nil, "path or route template of an endpoint of the device API the rule applies to, e.g. /api/v1/edgedevice/config; can be repeated")
+	faultAddCmd.Flags().StringSliceVar(&faultDevices, "device", nil, "UUID of a device the rule applies to; can be repeated")
+	faultAddCmd.Flags().Float64Var(&faultPercent, "percent", 100, "percent of the matching requests to inject the fault into, at random")
+	faultAddCmd.Flags().IntVar(&faultStatus, "status", 0, "status of the error answered, for --kind error; 503 if 0")
+	faultAddCmd.Flags().DurationVar(&faultDelay, "delay", 0, "how long to delay requests by, for --kind delay, e.g. 30s")
+	faultAddCmd.Flags().IntVar(&faultTruncate, "truncate", 0, "how many bytes of the response body to send, for --kind truncate; half of it if 0")
+	faultAddCmd.Flags().Uint64Var(&faultLimit, "limit", 0, "after how many faults the rule stops injecting; never if 0")
+	faultCmd.AddCommand(faultRemoveCmd)
+	faultRemoveCmd.Flags().StringVar(&faultID, "id", "", "id of the fault rule, as listed")
+	faultRemoveCmd.MarkFlagRequired("id")
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+var federationCmd = &cobra.Command{
+	Use:   "federation",
+	Short: "report the state of the sync of a secondary Adam from its primary, in JSON format",
+	Long:  `Report, for an Adam server running as a secondary with --upstream-url, when it last synced the onboarding certificates and devices of its primary, the last error if any, how many it synced, and how many messages of devices it forwarded to the primary, in JSON format`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/federation", nil, http.StatusOK))
+	},
+}
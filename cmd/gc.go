@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var gcRemoveOrphans bool
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "find, and optionally remove, orphaned data",
+	Long:  `Find data left behind in the database of a running Adam server without a matching device or onboarding certificate, e.g. by a failed device removal, and optionally remove it`,
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := resolveURL(serverURL, "/admin/gc")
+		if err != nil {
+			log.Fatalf("error constructing URL: %v", err)
+		}
+		method := "GET"
+		if gcRemoveOrphans {
+			method = "POST"
+		}
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			log.Fatalf("unable to create new http request: %v", err)
+		}
+		response, err := getClient().Do(req)
+		if err != nil {
+			log.Fatalf("error reading URL %s: %v", u, err)
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			b, _ := ioutil.ReadAll(response.Body)
+			log.Fatalf("server returned %s: %s", response.Status, errorText(b))
+		}
+		if _, err := io.Copy(os.Stdout, response.Body); err != nil {
+			log.Fatalf("error writing output: %v", err)
+		}
+	},
+}
+
+func gcInit() {
+	gcCmd.Flags().BoolVar(&gcRemoveOrphans, "remove", false, "remove the orphaned data, instead of only listing it")
+}
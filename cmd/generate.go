@@ -20,6 +20,7 @@ const (
 var (
 	outpath      string
 	isServerCert bool
+	vaultKey     string
 )
 
 var generateCmd = &cobra.Command{
@@ -46,6 +47,26 @@ var generateCmd = &cobra.Command{
 		}
 		certFile := path.Join(outputDir, certFilename)
 		keyFile := path.Join(outputDir, keyFilename)
+		if keyProviderName != "file" {
+			// the key stays with the provider, only the certificate for it is written
+			if vaultKey == "" {
+				log.Fatalf("must name the key with --vault-key when using the %s key provider", keyProviderName)
+			}
+			provider := getKeyProvider()
+			signer, err := provider.Signer(vaultKey)
+			if err != nil {
+				log.Fatalf("error getting key %s from %s key provider: %v", vaultKey, provider.Name(), err)
+			}
+			certB, err := x509.GenerateWithSigner(cn, hosts, signer)
+			if err != nil {
+				log.Fatalf("error generating cert: %v", err)
+			}
+			if err := x509.WriteCert(certB, certFile, force); err != nil {
+				log.Fatalf("error writing cert: %v", err)
+			}
+			log.Printf("saved new %s certificate to %s, for %s key %s", certType, certFile, provider.Name(), vaultKey)
+			return
+		}
 		err = x509.GenerateAndWrite(cn, hosts, certFile, keyFile, force)
 		if err != nil {
 			log.Fatalf("error generating key/cert: %v", err)
@@ -65,4 +86,8 @@ func generateInit() {
 	generateCmd.Flags().StringVar(&outpath, "out", defaultPrivateKeyPath, "path to directory where we will store the keys and certificates. If --server provided, this is ignored.")
 	generateCmd.Flags().BoolVar(&isServerCert, "server", false, "save key and cert in server database directory with appropriate filenames")
 	generateCmd.Flags().BoolVar(&force, "force", false, "replace existing files")
+	generateCmd.Flags().StringVar(&keyProviderName, "key-provider", "file", "where to keep the key: 'file' to generate one and save it next to the certificate, or 'vault' to use the vault transit key named by --vault-key, so that it is never written to disk")
+	generateCmd.Flags().StringVar(&vaultKey, "vault-key", "", "name of the vault transit key to generate the certificate for, with --key-provider vault")
+	generateCmd.Flags().StringVar(&vaultAddr, "vault-addr", os.Getenv("VAULT_ADDR"), "address of the vault server, when using vault for keys; defaults to the VAULT_ADDR environment variable. The token is read from the VAULT_TOKEN environment variable")
+	generateCmd.Flags().StringVar(&vaultMount, "vault-transit-mount", "transit", "mount path of the vault transit secrets engine")
 }
@@ -0,0 +1,96 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	modelName        string
+	modelDescription string
+	modelConfigPath  string
+)
+
+var hardwareModelCmd = &cobra.Command{
+	Use:   "hardware-model",
+	Short: "manage the catalog of hardware models",
+	Long:  `Hardware models are the IO adapters, system adapters, manufacturer and product name of a model of hardware, as in a config. They are merged into the config served to each device of the model, set with device hardware-model set, so that they need not be repeated in the config of each`,
+}
+
+var hardwareModelListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list hardware models in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/hardware-model", nil, http.StatusOK))
+	},
+}
+
+var hardwareModelGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get a hardware model in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/hardware-model", modelName), nil, http.StatusOK))
+	},
+}
+
+var hardwareModelSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "add a hardware model, or replace the one of the same name, and print it",
+	Long: `Add a hardware model, or replace the one of the same name, and print it. The config is JSON as in a device config, with only deviceIoList, where each adapter needs a phylabel, systemAdapterList, where each adapter needs a name, manufacturer and productName.
+The configs served to the devices of the model change with it`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			b   []byte
+			err error
+		)
+		if modelConfigPath == "-" {
+			b, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			b, err = ioutil.ReadFile(modelConfigPath)
+		}
+		if err != nil {
+			log.Fatalf("error reading hardware model config: %v", err)
+		}
+		body, err := json.Marshal(server.HardwareModelRequest{Description: modelDescription, Config: b})
+		if err != nil {
+			log.Fatalf("error encoding hardware model: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("PUT", path.Join("/admin/hardware-model", modelName), bytes.NewBuffer(body), http.StatusOK))
+	},
+}
+
+var hardwareModelRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove a hardware model, which no device can have",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/hardware-model", modelName), nil, http.StatusOK)
+	},
+}
+
+func hardwareModelInit() {
+	hardwareModelCmd.AddCommand(hardwareModelListCmd)
+	hardwareModelCmd.AddCommand(hardwareModelGetCmd)
+	hardwareModelGetCmd.Flags().StringVar(&modelName, "name", "", "name of the hardware model")
+	hardwareModelGetCmd.MarkFlagRequired("name")
+	hardwareModelCmd.AddCommand(hardwareModelSetCmd)
+	hardwareModelSetCmd.Flags().StringVar(&modelName, "name", "", "name of the hardware model, e.g. acme-x1")
+	hardwareModelSetCmd.MarkFlagRequired("name")
+	hardwareModelSetCmd.Flags().StringVar(&modelDescription, "description", "", "description of the hardware model")
+	hardwareModelSetCmd.Flags().StringVar(&modelConfigPath, "config-path", "", "path to the JSON config of the hardware model; use '-' to read from stdin")
+	hardwareModelSetCmd.MarkFlagRequired("config-path")
+	hardwareModelCmd.AddCommand(hardwareModelRemoveCmd)
+	hardwareModelRemoveCmd.Flags().StringVar(&modelName, "name", "", "name of the hardware model")
+	hardwareModelRemoveCmd.MarkFlagRequired("name")
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/lf-edge/adam/pkg/logging"
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	logLevelDefault string
+	logLevelModules []string
+	logLevelResets  []string
+)
+
+var logLevelCmd = &cobra.Command{
+	Use:   "log-level",
+	Short: "manage the log levels of a running server",
+	Long:  `The log level of all modules of a running Adam server, e.g. server, http for the requests served, or the name of a driver, and those of modules with their own. Changes last until the server restarts, and are for the replica answering only`,
+}
+
+var logLevelGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get the log levels in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/log-levels", nil, http.StatusOK))
+	},
+}
+
+var logLevelSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "set log levels, and print those in effect",
+	Run: func(cmd *cobra.Command, args []string) {
+		req := server.LogLevelsRequest{Default: logLevelDefault, Modules: map[string]string{}}
+		for _, ml := range logLevelModules {
+			module, level, err := logging.ParseModuleLevel(ml)
+			if err != nil {
+				log.Fatalf("invalid --module %s: %v", ml, err)
+			}
+			req.Modules[module] = level.String()
+		}
+		for _, module := range logLevelResets {
+			req.Modules[module] = ""
+		}
+		if req.Default == "" && len(req.Modules) == 0 {
+			log.Fatal("nothing to set, use --level, --module or --reset")
+		}
+		b, err := json.Marshal(req)
+		if err != nil {
+			log.Fatalf("error converting log levels to json: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("PUT", "/admin/log-levels", bytes.NewBuffer(b), http.StatusOK))
+	},
+}
+
+func logLevelInit() {
+	logLevelCmd.AddCommand(logLevelGetCmd)
+	logLevelCmd.AddCommand(logLevelSetCmd)
+	logLevelSetCmd.Flags().StringVar(&logLevelDefault, "level", "", "level of all modules without one of their own: debug, info, warn or error")
+	logLevelSetCmd.Flags().StringSliceVar(&logLevelModules, "module", nil, "level of a module, as <module>=<level>, e.g. http=warn; may be repeated")
+	logLevelSetCmd.Flags().StringSliceVar(&logLevelResets, "reset", nil, "module to log at the level of all modules again; may be repeated")
+}
@@ -13,13 +13,19 @@ import (
 	"os"
 	"path"
 
+	"github.com/lf-edge/adam/pkg/driver/common"
 	"github.com/lf-edge/adam/pkg/server"
 	ax "github.com/lf-edge/adam/pkg/x509"
 	"github.com/spf13/cobra"
 )
 
 var (
-	serials string
+	serials       string
+	policySerials []string
+	policyModels  []string
+	policySnap    string
+	policyMax     int
+	policyQuota   int64
 )
 
 var onboardCmd = &cobra.Command{
@@ -74,10 +80,47 @@ var onboardAddCmd = &cobra.Command{
 			log.Fatalf("error constructing URL: %v", err)
 		}
 		client := getClient()
-		_, err = client.Post(u, jsonContentType, bytes.NewBuffer(body))
+		res, err := client.Post(u, jsonContentType, bytes.NewBuffer(body))
 		if err != nil {
 			log.Fatalf("unable to post data to URL %s: %v", u, err)
 		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusCreated {
+			b, _ := ioutil.ReadAll(res.Body)
+			log.Fatalf("error adding onboarding certificate: %d %s", res.StatusCode, errorText(b))
+		}
+	},
+}
+
+var onboardGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "generate a new onboarding certificate and key on the server, and register it",
+	Long:  `Have the server generate a new onboarding certificate and key, and register the certificate with the valid serials. The key is not kept by the server, so it is written here, to --key-out, the only time it is returned`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// the key cannot be fetched again, so make sure it can be written before generating it
+		for _, p := range []string{certPath, keyPath} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) && !force {
+				log.Fatalf("file already exists at %s, use --force to replace it", p)
+			}
+		}
+		body, err := json.Marshal(server.OnboardGenerateRequest{
+			CN:     cn,
+			Serial: serials,
+		})
+		if err != nil {
+			log.Fatalf("error encoding json: %v", err)
+		}
+		var bundle server.OnboardBundle
+		if err := json.Unmarshal(adminRequest("POST", "/admin/onboard/generate", bytes.NewBuffer(body), http.StatusCreated), &bundle); err != nil {
+			log.Fatalf("error decoding onboard bundle: %v", err)
+		}
+		if err := ioutil.WriteFile(keyPath, []byte(bundle.Key), 0600); err != nil {
+			log.Fatalf("failed to write key to %s: %v", keyPath, err)
+		}
+		if err := ioutil.WriteFile(certPath, []byte(bundle.Cert), 0644); err != nil {
+			log.Fatalf("failed to write certificate to %s: %v", certPath, err)
+		}
+		fmt.Printf("onboarding certificate %s registered with serials %s\n", bundle.CN, bundle.Serial)
 	},
 }
 
@@ -105,6 +148,15 @@ var onboardGetCmd = &cobra.Command{
 	},
 }
 
+var onboardUsageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "get how many of the serials of an onboarding certificate are used, in JSON format",
+	Long:  `Get how many of the serials of an onboarding certificate devices registered with, the devices by serial, and how many serials are left, in JSON format.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/onboard", getFriendlyCN(cn), "usage"), nil, http.StatusOK))
+	},
+}
+
 var onboardRemoveCmd = &cobra.Command{
 	Use:   "remove",
 	Short: "remove existing onboard certificate",
@@ -162,6 +214,78 @@ var onboardClearCmd = &cobra.Command{
 	},
 }
 
+var onboardPolicyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "get, set or clear the soft serials and hardware models an onboarding certificate allows",
+	Long:  `Manage the policy of an onboarding certificate: besides its serials, the soft serials devices must register with and the hardware models they must report, as shell patterns. Devices reporting a model that is not allowed are deleted softly`,
+}
+
+var onboardPolicyGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get the policy of an onboarding certificate, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/onboard", getFriendlyCN(cn), "policy"), nil, http.StatusOK))
+	},
+}
+
+var onboardPolicySetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "set the policy of an onboarding certificate",
+	Long:  `Set the policy of an onboarding certificate, replacing only what is given: the soft serials of --soft-serial and the hardware models of --model, each a shell pattern, e.g. --model 'X1*', an empty pattern list allowing any, the config snapshot devices start with of --snapshot, and the limits of --max-devices and --telemetry-quota`,
+	Run: func(cmd *cobra.Command, args []string) {
+		p := path.Join("/admin/onboard", getFriendlyCN(cn), "policy")
+		var policy common.OnboardPolicy
+		if err := json.Unmarshal(adminRequest("GET", p, nil, http.StatusOK), &policy); err != nil {
+			log.Fatalf("error decoding onboard policy: %v", err)
+		}
+		if cmd.Flags().Changed("soft-serial") {
+			policy.SoftSerials = nonEmpty(policySerials)
+		}
+		if cmd.Flags().Changed("model") {
+			policy.Models = nonEmpty(policyModels)
+		}
+		if cmd.Flags().Changed("snapshot") {
+			policy.Snapshot = policySnap
+		}
+		if cmd.Flags().Changed("max-devices") {
+			policy.MaxDevices = nil
+			if policyMax >= 0 {
+				policy.MaxDevices = &policyMax
+			}
+		}
+		if cmd.Flags().Changed("telemetry-quota") {
+			policy.TelemetryQuota = policyQuota
+		}
+		if err := policy.Validate(); err != nil {
+			log.Fatalf("invalid onboard policy: %v", err)
+		}
+		b, err := json.Marshal(policy)
+		if err != nil {
+			log.Fatalf("error encoding onboard policy: %v", err)
+		}
+		adminRequest("PUT", p, bytes.NewBuffer(b), http.StatusOK)
+	},
+}
+
+var onboardPolicyClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "clear the policy of an onboarding certificate, allowing any soft serial and hardware model",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/onboard", getFriendlyCN(cn), "policy"), nil, http.StatusOK)
+	},
+}
+
+// nonEmpty the strings that are not empty
+func nonEmpty(list []string) []string {
+	var out []string
+	for _, v := range list {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
 func onboardInit() {
 	// onboardList
 	onboardCmd.AddCommand(onboardListCmd)
@@ -169,15 +293,41 @@ func onboardInit() {
 	onboardCmd.AddCommand(onboardGetCmd)
 	onboardGetCmd.Flags().StringVar(&cn, "cn", "", "cn of certificate to get details")
 	onboardGetCmd.MarkFlagRequired("cn")
+	// onboardUsage
+	onboardCmd.AddCommand(onboardUsageCmd)
+	onboardUsageCmd.Flags().StringVar(&cn, "cn", "", "cn of the onboarding certificate")
+	onboardUsageCmd.MarkFlagRequired("cn")
 	// onboardAdd
 	onboardCmd.AddCommand(onboardAddCmd)
-	onboardAddCmd.Flags().StringVar(&serials, "serial", "", "serials to include with the certificate")
+	onboardAddCmd.Flags().StringVar(&serials, "serial", "", "serials to include with the certificate, comma-separated: exact serials, * for any, glob patterns, re:<regular expression>, or ranges as SN-0001..SN-0500")
 	onboardAddCmd.Flags().StringVar(&certPath, "path", "", "path to certificate to add")
 	onboardAddCmd.MarkFlagRequired("path")
+	// onboardGenerate
+	onboardCmd.AddCommand(onboardGenerateCmd)
+	onboardGenerateCmd.Flags().StringVar(&cn, "cn", "", "cn of the certificate to generate")
+	onboardGenerateCmd.MarkFlagRequired("cn")
+	onboardGenerateCmd.Flags().StringVar(&serials, "serial", "", "serials to include with the certificate, comma-separated, as for add")
+	onboardGenerateCmd.Flags().StringVar(&certPath, "cert-out", "", "path to write the certificate to")
+	onboardGenerateCmd.MarkFlagRequired("cert-out")
+	onboardGenerateCmd.Flags().StringVar(&keyPath, "key-out", "", "path to write the key to")
+	onboardGenerateCmd.MarkFlagRequired("key-out")
+	onboardGenerateCmd.Flags().BoolVar(&force, "force", false, "replace existing files")
 	// onboardRemove
 	onboardCmd.AddCommand(onboardRemoveCmd)
 	onboardRemoveCmd.Flags().StringVar(&cn, "cn", "", "cn of certificate to remove")
 	onboardRemoveCmd.Flags().StringVar(&certPath, "path", "", "path to certificate to remove; will read the Common Name from the certificate.")
 	// onboardClear
 	onboardCmd.AddCommand(onboardClearCmd)
+	// onboardPolicy
+	onboardCmd.AddCommand(onboardPolicyCmd)
+	onboardPolicyCmd.PersistentFlags().StringVar(&cn, "cn", "", "cn of the onboarding certificate")
+	onboardPolicyCmd.MarkPersistentFlagRequired("cn")
+	onboardPolicyCmd.AddCommand(onboardPolicyGetCmd)
+	onboardPolicyCmd.AddCommand(onboardPolicySetCmd)
+	onboardPolicySetCmd.Flags().StringArrayVar(&policySerials, "soft-serial", nil, "pattern of the soft serials allowed; repeat for several, or give once empty to allow any")
+	onboardPolicySetCmd.Flags().StringArrayVar(&policyModels, "model", nil, "pattern of the hardware models allowed, as the product name; repeat for several, or give once empty to allow any")
+	onboardPolicySetCmd.Flags().StringVar(&policySnap, "snapshot", "", "name of the config snapshot devices registered with the certificate start with, instead of the default one; empty for the default one")
+	onboardPolicySetCmd.Flags().IntVar(&policyMax, "max-devices", -1, "how many devices may be registered with the certificate, those deleted softly included; -1 for any number")
+	onboardPolicySetCmd.Flags().Int64Var(&policyQuota, "telemetry-quota", 0, "how many bytes of logs, info, metrics and app logs the devices of the certificate may send together per --quota-period of the server; 0 for no limit")
+	onboardPolicyCmd.AddCommand(onboardPolicyClearCmd)
 }
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/spf13/cobra"
+)
+
+var pendingID string
+
+var pendingCmd = &cobra.Command{
+	Use:   "pending",
+	Short: "manage devices waiting for approval to onboard",
+	Long:  `List, approve or reject devices that onboarded while the server runs with --onboard-approval, and are waiting for approval before they are registered`,
+}
+
+var pendingListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list devices waiting for approval, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		pendingRequest("GET", "/admin/pending", http.StatusOK, os.Stdout)
+	},
+}
+
+var pendingGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get a device waiting for approval, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		pendingRequest("GET", path.Join("/admin/pending", pendingID), http.StatusOK, os.Stdout)
+	},
+}
+
+var pendingApproveCmd = &cobra.Command{
+	Use:   "approve",
+	Short: "approve a device, registering it, and print its new UUID",
+	Run: func(cmd *cobra.Command, args []string) {
+		pendingRequest("POST", path.Join("/admin/pending", pendingID, "approve"), http.StatusCreated, os.Stdout)
+		fmt.Println()
+	},
+}
+
+var pendingRejectCmd = &cobra.Command{
+	Use:   "reject",
+	Short: "reject a device, removing it from the pending queue",
+	Long:  `Reject a device, removing it from the pending queue. If the device tries to onboard again, it is back in the queue; to stop it, remove its serial from the onboarding certificate`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pendingRequest("DELETE", path.Join("/admin/pending", pendingID), http.StatusOK, ioutil.Discard)
+	},
+}
+
+// pendingRequest send a request about pending devices, and copy the response to out
+func pendingRequest(method, p string, status int, out io.Writer) {
+	u, err := resolveURL(serverURL, p)
+	if err != nil {
+		log.Fatalf("error constructing URL: %v", err)
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		log.Fatalf("unable to create new http request: %v", err)
+	}
+	res, err := getClient().Do(req)
+	if err != nil {
+		log.Fatalf("error %s URL %s: %v", method, u, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != status {
+		b, _ := ioutil.ReadAll(res.Body)
+		log.Fatalf("error %s URL %s: %d %s", method, u, res.StatusCode, errorText(b))
+	}
+	if _, err := io.Copy(out, res.Body); err != nil {
+		log.Fatalf("error writing output: %v", err)
+	}
+}
+
+func pendingInit() {
+	pendingCmd.AddCommand(pendingListCmd)
+	for _, c := range []*cobra.Command{pendingGetCmd, pendingApproveCmd, pendingRejectCmd} {
+		pendingCmd.AddCommand(c)
+		c.Flags().StringVar(&pendingID, "id", "", "id of the pending device, as listed")
+		c.MarkFlagRequired("id")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/logs"
+	"github.com/lf-edge/eve/api/go/metrics"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorGray   = "\x1b[90m"
+	// timeLayout how the times of log entries and metrics are shown, in the local time zone
+	timeLayout = "2006-01-02 15:04:05.000"
+	// maxLineSize longest log entry or metrics message that can be read, as the drivers store them at most 1MB
+	maxLineSize = 1024 * 1024
+	// metricsFormat the columns of the key metrics of a message, one message per line
+	metricsFormat = "%-23s  %-11s  %9s  %17s  %21s  %9s  %9s  %4v\n"
+)
+
+var unmarshalLenient = protojson.UnmarshalOptions{DiscardUnknown: true}
+
+// useColor whether to color the output: only on a terminal, and unless --no-color
+func useColor(noColor bool) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// newLineScanner a scanner of the JSON lines of logs or metrics, as the admin API sends them
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	return scanner
+}
+
+// severityColor the color of the log entries of a severity: red for errors and worse, yellow for warnings, gray for
+// debug and trace
+func severityColor(severity string) string {
+	switch strings.ToLower(severity) {
+	case "panic", "fatal", "emerg", "alert", "crit", "critical", "err", "error":
+		return colorRed
+	case "warn", "warning":
+		return colorYellow
+	case "debug", "trace":
+		return colorGray
+	default:
+		return ""
+	}
+}
+
+// printLogs print the log entries of a device, one JSON entry per line, as time, severity, source and content. Lines
+// that are not log entries are printed as they are
+func printLogs(r io.Reader, w io.Writer, color bool) error {
+	scanner := newLineScanner(r)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry logs.LogEntry
+		if err := unmarshalLenient.Unmarshal(line, &entry); err != nil {
+			fmt.Fprintf(w, "%s\n", line)
+			continue
+		}
+		ts := "-"
+		if entry.Timestamp != nil {
+			ts = entry.Timestamp.AsTime().Local().Format(timeLayout)
+		}
+		severity := strings.ToUpper(entry.Severity)
+		if severity == "" {
+			severity = "-"
+		}
+		source := entry.Source
+		if entry.Function != "" {
+			source += " " + entry.Function
+		}
+		content := strings.TrimRight(entry.Content, "\n")
+		c := severityColor(entry.Severity)
+		if !color || c == "" {
+			fmt.Fprintf(w, "%s %-7s %s: %s\n", ts, severity, source, content)
+			continue
+		}
+		fmt.Fprintf(w, "%s %s%-7s%s %s: %s%s%s\n", ts, c, severity, colorReset, source, c, content, colorReset)
+	}
+	return scanner.Err()
+}
+
+// readMetrics the metrics messages of a device, one JSON message per line, skipping the lines that are not
+func readMetrics(r io.Reader) ([]*metrics.ZMetricMsg, error) {
+	var msgs []*metrics.ZMetricMsg
+	scanner := newLineScanner(r)
+	for scanner.Scan() {
+		msg := &metrics.ZMetricMsg{}
+		if err := unmarshalLenient.Unmarshal(scanner.Bytes(), msg); err != nil {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, scanner.Err()
+}
+
+// printMetricsHeader print the names of the columns of printMetrics
+func printMetricsHeader(w io.Writer) {
+	fmt.Fprintf(w, metricsFormat, "TIME", "UPTIME", "CPU(s)", "MEM USED/TOTAL MB", "PERSIST USED/TOTAL MB", "NET RX", "NET TX", "APPS")
+}
+
+// printMetrics print the key metrics of a message on one line: its time, the uptime and CPU seconds of the device,
+// its memory and /persist use, what its interfaces received and sent, and its number of app instances
+func printMetrics(w io.Writer, msg *metrics.ZMetricMsg) {
+	ts := "-"
+	at := time.Now()
+	if msg.AtTimeStamp != nil {
+		at = msg.AtTimeStamp.AsTime()
+		ts = at.Local().Format(timeLayout)
+	}
+	dm := msg.GetDm()
+	uptime, cpu := "-", "-"
+	if c := dm.GetCpuMetric(); c != nil {
+		if c.UpTime != nil {
+			uptime = at.Sub(c.UpTime.AsTime()).Round(time.Second).String()
+		}
+		cpu = fmt.Sprintf("%d", c.Total)
+	}
+	mem := "-"
+	if m := dm.GetMemory(); m != nil {
+		mem = fmt.Sprintf("%d/%d", m.UsedMem, m.UsedMem+m.AvailMem)
+	}
+	disk := "-"
+	for _, d := range dm.GetDisk() {
+		if d.MountPath == "/persist" {
+			disk = fmt.Sprintf("%d/%d", d.Used, d.Total)
+			break
+		}
+	}
+	var rx, tx uint64
+	for _, n := range dm.GetNetwork() {
+		rx += n.RxBytes
+		tx += n.TxBytes
+	}
+	fmt.Fprintf(w, metricsFormat, ts, uptime, cpu, mem, disk, humanBytes(rx), humanBytes(tx), len(msg.Am))
+}
+
+// humanBytes a number of bytes in the largest binary unit it is at least one of
+func humanBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	replayID         string
+	replayDevice     string
+	replayKinds      []string
+	replaySince      string
+	replayUntil      string
+	replayWebhook    string
+	replayMQTT       string
+	replayMQTTTopic  string
+	replayKafka      string
+	replayKafkaTopic string
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "manage replays of the stored messages of devices to sinks",
+	Long:  `Replays send again the logs, info and metrics stored for a device, all of them or those of a range of time, to a webhook, an MQTT broker or Kafka, e.g. for a pipeline added since or that lost data`,
+}
+
+var replayStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "start replaying the stored messages of a device, and print the replay",
+	Long: `Start replaying the stored messages of a device, and print the replay, which runs in the background. The messages go to a webhook with --webhook, to an MQTT broker with --mqtt and --mqtt-topic, or to Kafka through a Kafka REST proxy with --kafka and --kafka-topic.
+--since and --until, in RFC3339, e.g. 2021-06-01T00:00:00Z, limit the messages to those of a range of time`,
+	Run: func(cmd *cobra.Command, args []string) {
+		req := server.ReplayRequest{Kinds: replayKinds}
+		for _, t := range []struct {
+			flag, value string
+			into        **time.Time
+		}{{"since", replaySince, &req.Since}, {"until", replayUntil, &req.Until}} {
+			if t.value == "" {
+				continue
+			}
+			v, err := time.Parse(time.RFC3339, t.value)
+			if err != nil {
+				log.Fatalf("bad --%s %s: %v", t.flag, t.value, err)
+			}
+			*t.into = &v
+		}
+		switch {
+		case replayWebhook != "" && replayMQTT == "" && replayKafka == "":
+			req.Sink = server.ReplaySink{Type: server.SinkWebhook, URL: replayWebhook}
+		case replayMQTT != "" && replayWebhook == "" && replayKafka == "":
+			req.Sink = server.ReplaySink{Type: server.SinkMQTT, URL: replayMQTT, Topic: replayMQTTTopic}
+		case replayKafka != "" && replayWebhook == "" && replayMQTT == "":
+			req.Sink = server.ReplaySink{Type: server.SinkKafka, URL: replayKafka, Topic: replayKafkaTopic}
+		default:
+			log.Fatalf("one of --webhook, --mqtt and --kafka is required")
+		}
+		b, err := json.Marshal(req)
+		if err != nil {
+			log.Fatalf("error encoding replay request: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", path.Join("/admin/device", replayDevice, "replay"), bytes.NewBuffer(b), http.StatusAccepted))
+	},
+}
+
+var replayListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the replays since the server started in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/replay", nil, http.StatusOK))
+	},
+}
+
+var replayGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get a replay, with how many messages it sent, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/replay", replayID), nil, http.StatusOK))
+	},
+}
+
+var replayCancelCmd = &cobra.Command{
+	Use:   "cancel",
+	Short: "cancel a running replay, or forget a finished one",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/replay", replayID), nil, http.StatusOK)
+	},
+}
+
+func replayInit() {
+	replayCmd.AddCommand(replayStartCmd)
+	replayStartCmd.Flags().StringVar(&replayDevice, "uuid", "", "UUID of the device to replay the messages of")
+	replayStartCmd.MarkFlagRequired("uuid")
+	replayStartCmd.Flags().StringSliceVar(&replayKinds, "kind", nil, "kind of messages to replay, logs, info or metrics; can be repeated, all if not set")
+	replayStartCmd.Flags().StringVar(&replaySince, "since", "", "replay only the messages from then on, in RFC3339")
+	replayStartCmd.Flags().StringVar(&replayUntil, "until", "", "replay only the messages until then, in RFC3339")
+	replayStartCmd.Flags().StringVar(&replayWebhook, "webhook", "", "URL to POST the messages to, in batches of JSON arrays")
+	replayStartCmd.Flags().StringVar(&replayMQTT, "mqtt", "", "URL of the MQTT broker to publish the messages to, as mqtt[s]://[user:password@]host[:port]")
+	replayStartCmd.Flags().StringVar(&replayMQTTTopic, "mqtt-topic", "", "MQTT topic to publish the messages to")
+	replayStartCmd.Flags().StringVar(&replayKafka, "kafka", "", "URL of the Kafka REST proxy to produce the messages through")
+	replayStartCmd.Flags().StringVar(&replayKafkaTopic, "kafka-topic", "", "Kafka topic to produce the messages to")
+	replayCmd.AddCommand(replayListCmd)
+	for _, c := range []*cobra.Command{replayGetCmd, replayCancelCmd} {
+		replayCmd.AddCommand(c)
+		c.Flags().StringVar(&replayID, "id", "", "ID of the replay")
+		c.MarkFlagRequired("id")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	revocationFingerprint string
+	revocationDevice      string
+	revocationReason      string
+	revocationOut         string
+)
+
+var revocationCmd = &cobra.Command{
+	Use:   "revocation",
+	Short: "manage revoked device and onboarding certificates",
+	Long:  `Revoke device and onboarding certificates, so that the server refuses every request made with them, list them, or get a CRL of those issued by the device CA`,
+}
+
+var revocationListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list revoked certificates in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/revocation", nil, http.StatusOK))
+	},
+}
+
+var revocationAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "revoke a certificate, by its fingerprint, the device it is the certificate of, or the CN of the onboarding certificate",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := json.Marshal(server.RevocationRequest{Fingerprint: revocationFingerprint, Device: revocationDevice, Onboard: cn, Reason: revocationReason})
+		if err != nil {
+			log.Fatalf("error encoding revocation: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", "/admin/revocation", bytes.NewBuffer(b), http.StatusCreated))
+	},
+}
+
+var revocationRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove the revocation of a certificate, so that it is accepted again",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/revocation", revocationFingerprint), nil, http.StatusOK)
+	},
+}
+
+var revocationCRLCmd = &cobra.Command{
+	Use:   "crl",
+	Short: "get the PEM CRL of the revoked certificates issued by the device CA, signed by it",
+	Run: func(cmd *cobra.Command, args []string) {
+		b := adminRequest("GET", "/admin/revocation/crl", nil, http.StatusOK)
+		if revocationOut == "" {
+			fmt.Printf("%s", b)
+			return
+		}
+		if err := ioutil.WriteFile(revocationOut, b, 0644); err != nil {
+			log.Fatalf("error writing CRL to %s: %v", revocationOut, err)
+		}
+	},
+}
+
+func revocationInit() {
+	revocationCmd.AddCommand(revocationListCmd)
+	revocationCmd.AddCommand(revocationAddCmd)
+	revocationAddCmd.Flags().StringVar(&revocationFingerprint, "fingerprint", "", "hex-encoded SHA-256 of the certificate to revoke")
+	revocationAddCmd.Flags().StringVar(&revocationDevice, "device", "", "UUID of the device whose certificate to revoke")
+	revocationAddCmd.Flags().StringVar(&cn, "cn", "", "CN of the onboarding certificate to revoke")
+	revocationAddCmd.Flags().StringVar(&revocationReason, "reason", "", "why the certificate is revoked")
+	revocationCmd.AddCommand(revocationRemoveCmd)
+	revocationRemoveCmd.Flags().StringVar(&revocationFingerprint, "fingerprint", "", "hex-encoded SHA-256 of the certificate")
+	revocationRemoveCmd.MarkFlagRequired("fingerprint")
+	revocationCmd.AddCommand(revocationCRLCmd)
+	revocationCRLCmd.Flags().StringVar(&revocationOut, "out", "", "path to write the CRL to, instead of printing it")
+}
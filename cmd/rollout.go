@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rolloutID           string
+	rolloutName         string
+	rolloutDevices      []string
+	rolloutSerials      []string
+	rolloutPatchPath    string
+	rolloutTemplatePath string
+	rolloutWaveSize     int
+	rolloutWaveTimeout  int
+	rolloutMaxFailures  int
+)
+
+var rolloutCmd = &cobra.Command{
+	Use:   "rollout",
+	Short: "manage config rollouts",
+	Long:  `Roll a config change out to a group of devices in waves, each applied once the devices of the previous one acknowledged the change. A rollout halts once more devices fail to acknowledge it in time than allowed`,
+}
+
+var rolloutListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list config rollouts, with their progress, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/rollout", nil, http.StatusOK))
+	},
+}
+
+var rolloutGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get a config rollout, with the progress on each device, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/rollout", rolloutID), nil, http.StatusOK))
+	},
+}
+
+var rolloutCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "create a config rollout, applying its first wave, and print it",
+	Long: `Create a config rollout, applying its first wave, and print it. The change is either a JSON merge patch applied to the config of each device, with --patch-path, or a config set on each of them, with --template-path.
+The devices are those given with --device and those whose serial matches a --serial pattern, or every device if there are neither`,
+	Run: func(cmd *cobra.Command, args []string) {
+		req := server.RolloutRequest{
+			Name:        rolloutName,
+			Devices:     rolloutDevices,
+			Serials:     rolloutSerials,
+			WaveSize:    rolloutWaveSize,
+			WaveTimeout: rolloutWaveTimeout,
+			MaxFailures: rolloutMaxFailures,
+		}
+		switch {
+		case (rolloutPatchPath == "") == (rolloutTemplatePath == ""):
+			log.Fatalf("exactly one of --patch-path and --template-path is required")
+		case rolloutPatchPath != "":
+			req.Patch = readRolloutFile(rolloutPatchPath)
+		default:
+			req.Template = readRolloutFile(rolloutTemplatePath)
+		}
+		b, err := json.Marshal(req)
+		if err != nil {
+			log.Fatalf("error encoding rollout request: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", "/admin/rollout", bytes.NewBuffer(b), http.StatusCreated))
+	},
+}
+
+var rolloutPauseCmd = &cobra.Command{
+	Use:   "pause",
+	Short: "pause a running config rollout",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("POST", path.Join("/admin/rollout", rolloutID, "pause"), nil, http.StatusOK)
+	},
+}
+
+var rolloutResumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "resume a paused config rollout",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("POST", path.Join("/admin/rollout", rolloutID, "resume"), nil, http.StatusOK)
+	},
+}
+
+var rolloutRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove a config rollout, stopping it; configs already changed stay as they are",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/rollout", rolloutID), nil, http.StatusOK)
+	},
+}
+
+// readRolloutFile read a patch or template, from stdin for '-'
+func readRolloutFile(p string) []byte {
+	var (
+		b   []byte
+		err error
+	)
+	if p == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+		if err != nil && err != io.EOF {
+			log.Fatalf("Error reading stdin: %v", err)
+		}
+		return b
+	}
+	b, err = ioutil.ReadFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		log.Fatalf("file %s does not exist", p)
+	case err != nil:
+		log.Fatalf("error reading file %s: %v", p, err)
+	}
+	return b
+}
+
+func rolloutInit() {
+	rolloutCmd.AddCommand(rolloutListCmd)
+	rolloutCmd.AddCommand(rolloutGetCmd)
+	rolloutGetCmd.Flags().StringVar(&rolloutID, "id", "", "id of the rollout, as listed")
+	rolloutGetCmd.MarkFlagRequired("id")
+	rolloutCmd.AddCommand(rolloutCreateCmd)
+	rolloutCreateCmd.Flags().StringVar(&rolloutName, "name", "", "name of the rollout, e.g. what the change is")
+	rolloutCreateCmd.Flags().StringSliceVar(&rolloutDevices, "device", nil, "UUID of a device to roll the change out to; can be repeated")
+	rolloutCreateCmd.Flags().StringSliceVar(&rolloutSerials, "serial", nil, "pattern, e.g. 'lab-*', of the serials of devices to roll the change out to; can be repeated")
+	rolloutCreateCmd.Flags().StringVar(&rolloutPatchPath, "patch-path", "", "path to a JSON merge patch to apply to the config of each device; use '-' to read from stdin")
+	rolloutCreateCmd.Flags().StringVar(&rolloutTemplatePath, "template-path", "", "path to a config to set on each device, with its UUID; use '-' to read from stdin")
+	rolloutCreateCmd.Flags().IntVar(&rolloutWaveSize, "wave-size", 10, "percentage of the devices to apply the change to at a time")
+	rolloutCreateCmd.Flags().IntVar(&rolloutWaveTimeout, "wave-timeout", 600, "how long, in seconds, each device has to acknowledge the change before it counts as failed")
+	rolloutCreateCmd.Flags().IntVar(&rolloutMaxFailures, "max-failures", 0, "how many devices can fail before the rollout halts")
+	rolloutCmd.AddCommand(rolloutPauseCmd)
+	rolloutPauseCmd.Flags().StringVar(&rolloutID, "id", "", "id of the rollout, as listed")
+	rolloutPauseCmd.MarkFlagRequired("id")
+	rolloutCmd.AddCommand(rolloutResumeCmd)
+	rolloutResumeCmd.Flags().StringVar(&rolloutID, "id", "", "id of the rollout, as listed")
+	rolloutResumeCmd.MarkFlagRequired("id")
+	rolloutCmd.AddCommand(rolloutRemoveCmd)
+	rolloutRemoveCmd.Flags().StringVar(&rolloutID, "id", "", "id of the rollout, as listed")
+	rolloutRemoveCmd.MarkFlagRequired("id")
+}
@@ -23,6 +23,8 @@ func init() {
 	generateInit()
 	rootCmd.AddCommand(adminCmd)
 	adminInit()
+	rootCmd.AddCommand(simulateCmd)
+	simulateInit()
 }
 
 // Execute primary function for cobra
@@ -0,0 +1,135 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	scheduleID           string
+	scheduleAll          bool
+	scheduleName         string
+	scheduleDevices      []string
+	scheduleSerials      []string
+	schedulePatchPath    string
+	scheduleTemplatePath string
+	scheduleAt           string
+	scheduleDays         []string
+	scheduleStart        string
+	scheduleDuration     int
+	scheduleTimezone     string
+)
+
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "manage scheduled config changes",
+	Long:  `Schedule a config change to a group of devices for a time, for a recurring maintenance window, or for the first time the window is open from a time. Adam applies the change once it is due, so that the devices get it the next time they request their config`,
+}
+
+var scheduleListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list pending scheduled config changes in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		p := "/admin/schedule"
+		if scheduleAll {
+			p += "?all=true"
+		}
+		fmt.Printf("%s\n", adminRequest("GET", p, nil, http.StatusOK))
+	},
+}
+
+var scheduleGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get a scheduled config change, with the outcome on each device once applied, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/schedule", scheduleID), nil, http.StatusOK))
+	},
+}
+
+var scheduleAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "schedule a config change, and print it",
+	Long: `Schedule a config change, and print it. The change is either a JSON merge patch applied to the config of each device, with --patch-path, or a config set on each of them, with --template-path.
+It is applied no earlier than --at and, with --start and --duration, while the maintenance window is open; a change already due is applied at once.
+The devices are those given with --device and those whose serial matches a --serial pattern, or every device if there are neither`,
+	Run: func(cmd *cobra.Command, args []string) {
+		req := server.ScheduleRequest{
+			Name:    scheduleName,
+			Devices: scheduleDevices,
+			Serials: scheduleSerials,
+		}
+		switch {
+		case (schedulePatchPath == "") == (scheduleTemplatePath == ""):
+			log.Fatalf("exactly one of --patch-path and --template-path is required")
+		case schedulePatchPath != "":
+			req.Patch = readRolloutFile(schedulePatchPath)
+		default:
+			req.Template = readRolloutFile(scheduleTemplatePath)
+		}
+		if scheduleAt != "" {
+			at, err := time.Parse(time.RFC3339, scheduleAt)
+			if err != nil {
+				log.Fatalf("bad time %s, expected e.g. 2021-06-05T02:00:00Z: %v", scheduleAt, err)
+			}
+			req.At = &at
+		}
+		if scheduleStart != "" {
+			req.Window = &common.MaintenanceWindow{
+				Days:     scheduleDays,
+				Start:    scheduleStart,
+				Duration: scheduleDuration,
+				Timezone: scheduleTimezone,
+			}
+		}
+		if req.At == nil && req.Window == nil {
+			log.Fatalf("at least one of --at and --start is required")
+		}
+		b, err := json.Marshal(req)
+		if err != nil {
+			log.Fatalf("error encoding schedule request: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", "/admin/schedule", bytes.NewBuffer(b), http.StatusCreated))
+	},
+}
+
+var scheduleCancelCmd = &cobra.Command{
+	Use:   "cancel",
+	Short: "cancel a scheduled config change, removing it; the configs of one already applied stay as they are",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/schedule", scheduleID), nil, http.StatusOK)
+	},
+}
+
+func scheduleInit() {
+	scheduleCmd.AddCommand(scheduleListCmd)
+	scheduleListCmd.Flags().BoolVar(&scheduleAll, "all", false, "list the changes already applied too")
+	scheduleCmd.AddCommand(scheduleGetCmd)
+	scheduleGetCmd.Flags().StringVar(&scheduleID, "id", "", "id of the scheduled change, as listed")
+	scheduleGetCmd.MarkFlagRequired("id")
+	scheduleCmd.AddCommand(scheduleAddCmd)
+	scheduleAddCmd.Flags().StringVar(&scheduleName, "name", "", "name of the scheduled change, e.g. what the change is")
+	scheduleAddCmd.Flags().StringSliceVar(&scheduleDevices, "device", nil, "UUID of a device to apply the change to; can be repeated")
+	scheduleAddCmd.Flags().StringSliceVar(&scheduleSerials, "serial", nil, "pattern, e.g. 'lab-*', of the serials of devices to apply the change to; can be repeated")
+	scheduleAddCmd.Flags().StringVar(&schedulePatchPath, "patch-path", "", "path to a JSON merge patch to apply to the config of each device; use '-' to read from stdin")
+	scheduleAddCmd.Flags().StringVar(&scheduleTemplatePath, "template-path", "", "path to a config to set on each device, with its UUID; use '-' to read from stdin")
+	scheduleAddCmd.Flags().StringVar(&scheduleAt, "at", "", "earliest time to apply the change, in RFC3339 format, e.g. 2021-06-05T02:00:00Z")
+	scheduleAddCmd.Flags().StringSliceVar(&scheduleDays, "day", nil, "day the maintenance window opens on, as mon, tue, wed, thu, fri, sat or sun; can be repeated, every day if not given")
+	scheduleAddCmd.Flags().StringVar(&scheduleStart, "start", "", "time of the day the maintenance window opens at, as HH:MM")
+	scheduleAddCmd.Flags().IntVar(&scheduleDuration, "duration", 3600, "how long, in seconds, the maintenance window stays open")
+	scheduleAddCmd.Flags().StringVar(&scheduleTimezone, "timezone", "", "IANA timezone of --start, e.g. Europe/Berlin; UTC if not given")
+	scheduleCmd.AddCommand(scheduleCancelCmd)
+	scheduleCancelCmd.Flags().StringVar(&scheduleID, "id", "", "id of the scheduled change, as listed")
+	scheduleCancelCmd.MarkFlagRequired("id")
+}
@@ -4,6 +4,7 @@
 package cmd
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -11,13 +12,18 @@ import (
 	"log"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/adam/pkg/logging"
 
 	"github.com/lf-edge/adam/pkg/driver"
 	"github.com/lf-edge/adam/pkg/server"
 	ax509 "github.com/lf-edge/adam/pkg/x509"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/acme"
 )
 
 const (
@@ -27,22 +33,103 @@ const (
 )
 
 var (
-	serverCert      string
-	serverKey       string
-	certCN          string
-	certHosts       string
-	port            string
-	hostIP          string
-	clientCertPath  string
-	certRefresh     int
-	maxLogSize      int
-	maxInfoSize     int
-	maxMetricSize   int
-	maxRequestsSize int
-	maxAppLogsSize  int
-	autoCert        bool
-	localWebFiles   string
-	deviceManagers  = driver.GetDeviceManagers()
+	serverCert        string
+	serverKey         string
+	certCN            string
+	certHosts         string
+	port              string
+	hostIP            string
+	clientCertPath    string
+	certRefresh       int
+	maxLogSize        int
+	maxInfoSize       int
+	maxMetricSize     int
+	maxRequestsSize   int
+	maxAppLogsSize    int
+	autoCert          bool
+	localWebFiles     string
+	encryptionKey     string
+	encryptionVault   string
+	vaultCacheTTL     int
+	encryptionStrict  bool
+	encryptionMigrate bool
+	keyProviderName   string
+	vaultAddr         string
+	vaultMount        string
+	gcInterval        int
+	gcRemove          bool
+	archiveInterval   int
+	maxStreamLen      string
+	deviceQuota       string
+	maxBodySize       string
+	quotaPeriod       int
+	logMinSeverity    string
+	logSample         int
+	onboardApproval   bool
+	approveSerials    []string
+	approveCNs        []string
+	otlpEndpoint      string
+	otlpInsecure      bool
+	traceRatio        float64
+	shutdownTimeout   int
+	idleTimeout       int
+	noHTTP2           bool
+	http2Streams      uint32
+	maxConns          int
+	adminAuth         bool
+	adminCA           string
+	adminPolicy       string
+	requireIfMatch    bool
+	rolloutInterval   int
+	schedInterval     int
+	deviceRetention   int
+	lpsPort           string
+	lokiURL           string
+	lokiTenant        string
+	syslogURL         string
+	syslogCA          string
+	exportURL         string
+	exportFormat      string
+	exportToken       string
+	upstreamURL       string
+	upstreamToken     string
+	upstreamCA        string
+	syncInterval      int
+	acmeDomains       []string
+	acmeEmail         string
+	acmeDirectory     string
+	acmeChallenge     string
+	acmeHTTPAddress   string
+	acmeDNSHook       string
+	acmeRenewBefore   int
+	trustedProxies    []string
+	corsOrigins       []string
+	certHeader        string
+	certProxies       []string
+	certProxyCA       string
+	certProxyPort     string
+	serverSocket      string
+	adminSockMode     string
+	listenSpecs       []string
+	logFormat         string
+	logLevel          string
+	logModules        []string
+	faultInjection    bool
+	endpointBudgets   []string
+	shedRetryAfter    int
+	deviceCACert      string
+	deviceCAKey       string
+	deviceCABundles   []string
+	deviceCertDays    int
+	requireCSR        bool
+	pressureItems     []string
+	pressureWhen      string
+	pressureTags      []string
+	onboardHook       string
+	hookSecret        string
+	hookTimeout       int
+	baseConfigPath    string
+	deviceManagers    = driver.GetDeviceManagers()
 )
 
 var serverCmd = &cobra.Command{
@@ -50,6 +137,24 @@ var serverCmd = &cobra.Command{
 	Short: "Run the Adam server",
 	Long:  `Adam is an LF-Edge API compliant Controller. Complete API documentation is available at https://github.com/lf-edge/eve/api/API.md`,
 	Run: func(cmd *cobra.Command, args []string) {
+		// leveled and structured logs, for those of the log package too, before anything logs
+		if err := logging.SetFormat(logFormat); err != nil {
+			log.Fatalf("invalid --log-format: %v", err)
+		}
+		level, err := logging.ParseLevel(logLevel)
+		if err != nil {
+			log.Fatalf("invalid --log-level: %v", err)
+		}
+		logging.SetLevel(level)
+		for _, ml := range logModules {
+			module, level, err := logging.ParseModuleLevel(ml)
+			if err != nil {
+				log.Fatalf("invalid --log-module-level %s: %v", ml, err)
+			}
+			logging.SetModuleLevel(module, level)
+		}
+		logging.RedirectStd()
+
 		// create a handler based on where our device database is
 		// in the future, we may support other device manager types
 		var mgr driver.DeviceManager
@@ -75,9 +180,53 @@ var serverCmd = &cobra.Command{
 			log.Fatalf("could not find valid device manager")
 		}
 
+		keyProvider := getKeyProvider()
+
+		// encryption at rest for certificates, serials and configs, if a key was provided
+		var encKey []byte
+		if envKey, ok := os.LookupEnv("ENCRYPTION_KEY"); ok {
+			encKey, err = common.ParseAESKey([]byte(envKey))
+			if err != nil {
+				log.Fatalf("invalid encryption key in ENCRYPTION_KEY environment variable: %v", err)
+			}
+		} else if encryptionKey != "" {
+			encKey, err = common.ReadAESKeyFile(encryptionKey)
+			if err != nil {
+				log.Fatalf("invalid encryption key: %v", err)
+			}
+		}
+		if encKey != nil {
+			wrapper, err := common.NewAESKeyWrapper(encKey)
+			if err != nil {
+				log.Fatalf("unable to use encryption key: %v", err)
+			}
+			mgr.SetEncryptor(common.NewEncryptor(wrapper, encryptionStrict))
+			log.Printf("encryption at rest enabled for %s device manager", mgr.Name())
+		} else if encryptionVault != "" {
+			mgr.SetEncryptor(common.NewEncryptor(&ax509.VaultKeyWrapper{
+				Client:   getVaultClient(),
+				Mount:    vaultMount,
+				Key:      encryptionVault,
+				CacheTTL: getVaultCacheTTL(),
+			}, encryptionStrict))
+			log.Printf("encryption at rest enabled for %s device manager with vault transit key %s", mgr.Name(), encryptionVault)
+		} else if encryptionMigrate {
+			log.Fatalf("--encryption-migrate needs an encryption key, with --encryption-key, ENCRYPTION_KEY or --encryption-vault-key")
+		}
+		// before anything reads them, as a strict encryptor refuses them as they are
+		if encryptionMigrate {
+			if r, ok := mgr.(driver.Reencrypter); ok {
+				n, err := r.Reencrypt()
+				if err != nil {
+					log.Fatalf("error reencrypting the values of the %s device manager: %v", mgr.Name(), err)
+				}
+				log.Printf("reencrypted %d values of the %s device manager with the keys of their records", n, mgr.Name())
+			}
+		}
+
 		// we use MkdirAll, since we are willing to continue if the directory already exists; we only error if we cannot make it,
 		//   or if the _files_ already exist
-		err := os.MkdirAll(configDir, 0755)
+		err = os.MkdirAll(configDir, 0755)
 		if err != nil {
 			log.Fatalf("failed to make directory %s: %v", configDir, err)
 		}
@@ -87,17 +236,70 @@ var serverCmd = &cobra.Command{
 
 		// get the directory
 		certDir := path.Dir(serverCert)
-		keyDir := path.Dir(serverKey)
 		// make the directories or fail
 		if err := os.MkdirAll(certDir, 0755); err != nil {
 			log.Fatalf("failed to make cert directory %s: %v", certDir, err)
 		}
-		if err := os.MkdirAll(keyDir, 0755); err != nil {
-			log.Fatalf("failed to make key directory %s: %v", keyDir, err)
+		// keys from other providers never touch the filesystem
+		if keyProvider.Name() == "file" {
+			keyDir := path.Dir(serverKey)
+			if err := os.MkdirAll(keyDir, 0755); err != nil {
+				log.Fatalf("failed to make key directory %s: %v", keyDir, err)
+			}
+		}
+
+		var acmeManager *server.ACME
+		if len(acmeDomains) > 0 {
+			acmeManager = &server.ACME{
+				Domains:      acmeDomains,
+				Email:        acmeEmail,
+				DirectoryURL: acmeDirectory,
+				Challenge:    acmeChallenge,
+				HTTPAddress:  acmeHTTPAddress,
+				DNSHook:      acmeDNSHook,
+				RenewBefore:  time.Duration(acmeRenewBefore) * time.Second,
+				Manager:      mgr,
+			}
+			if err := acmeManager.Validate(); err != nil {
+				log.Fatalf("invalid ACME settings: %v", err)
+			}
 		}
 
 		var catls tls.Certificate
-		if serverENVCertProvided && serverENVKeyProvided {
+		switch {
+		case acmeManager != nil:
+			if catls, err = acmeManager.Certificate(); err != nil {
+				log.Fatalf("error obtaining server cert with ACME: %v", err)
+			}
+			log.Printf("using server certificate obtained with ACME for %s", strings.Join(acmeDomains, ","))
+		case keyProvider.Name() != "file":
+			signer, err := keyProvider.Signer(serverKey)
+			if err != nil {
+				log.Fatalf("error getting server key %s from %s key provider: %v", serverKey, keyProvider.Name(), err)
+			}
+			// if we were asked to autoCert, then we do it, but only if the cert does not exist
+			if _, err := os.Stat(serverCert); autoCert && os.IsNotExist(err) {
+				if certCN == certHosts && certCN == "" {
+					log.Fatalf("must specify at least one hostname/IP or CN")
+				}
+				certB, err := ax509.GenerateWithSigner(certCN, certHosts, signer)
+				if err != nil {
+					log.Fatalf("error generating server cert with %s key %s: %v", keyProvider.Name(), serverKey, err)
+				}
+				if err := ax509.WriteCert(certB, serverCert, false); err != nil {
+					log.Fatalf("error saving server cert: %v", err)
+				}
+				log.Printf("saved new server certificate to %s", serverCert)
+			}
+			cert, err := ax509.ReadCert(serverCert)
+			if err != nil {
+				log.Fatalf("error loading server cert %s: %v", serverCert, err)
+			}
+			catls = tls.Certificate{
+				Certificate: [][]byte{cert.Raw},
+				PrivateKey:  signer,
+			}
+		case serverENVCertProvided && serverENVKeyProvided:
 			catls, err = tls.X509KeyPair([]byte(serverENVCert), []byte(serverENVKey))
 			if err != nil {
 				log.Fatalf("error loading server cert and key from environment variables: %v", err)
@@ -108,7 +310,7 @@ var serverCmd = &cobra.Command{
 			if err = ioutil.WriteFile(serverKey, []byte(serverENVKey), 0600); err != nil {
 				log.Fatal(err)
 			}
-		} else {
+		default:
 			// if we were asked to autoCert, then we do it
 			if autoCert {
 				if certCN == certHosts && certCN == "" {
@@ -144,8 +346,11 @@ var serverCmd = &cobra.Command{
 			log.Fatalf("error writing hosts file: %v", err)
 		}
 
-		rootCert, err := ioutil.ReadFile(serverCert)
-		if err != nil {
+		var rootCert []byte
+		if acmeManager != nil {
+			// devices trust the top of the chain, as the root of a public CA is not sent
+			rootCert = ax509.PemEncodeCert(catls.Certificate[len(catls.Certificate)-1])
+		} else if rootCert, err = ioutil.ReadFile(serverCert); err != nil {
 			log.Fatalf("error reading %s file: %v", serverCert, err)
 		}
 		err = ioutil.WriteFile(path.Join(configDir, "root-certificate.pem"), rootCert, 0644)
@@ -160,14 +365,175 @@ var serverCmd = &cobra.Command{
 		}
 		log.Printf("EVE-compatible configuration directory output to %s", configDir)
 
+		var quotas common.Quotas
+		if quotas.MaxLen, err = common.ParseLimits(maxStreamLen); err != nil {
+			log.Fatalf("invalid --max-stream-len: %v", err)
+		}
+		if quotas.MaxBytes, err = common.ParseLimits(deviceQuota); err != nil {
+			log.Fatalf("invalid --device-quota: %v", err)
+		}
+		bodyLimits, err := common.ParseLimits(maxBodySize)
+		if err != nil {
+			log.Fatalf("invalid --max-body-size: %v", err)
+		}
+		logFilter := common.LogFilter{MinSeverity: logMinSeverity, Sample: logSample}
+		if err := logFilter.Validate(); err != nil {
+			log.Fatalf("invalid --log-min-severity or --log-sample: %v", err)
+		}
+
+		var approval *server.OnboardApproval
+		if onboardApproval {
+			for _, p := range append(approveSerials, approveCNs...) {
+				if _, err := path.Match(p, ""); err != nil {
+					log.Fatalf("invalid auto-approval pattern %s: %v", p, err)
+				}
+			}
+			approval = &server.OnboardApproval{Serials: approveSerials, CNs: approveCNs}
+		}
+
+		var deviceCA *server.DeviceCA
+		switch {
+		case deviceCACert != "" && deviceCAKey != "":
+			deviceCA = &server.DeviceCA{
+				CertPath:   deviceCACert,
+				KeyPath:    deviceCAKey,
+				Validity:   time.Duration(deviceCertDays) * 24 * time.Hour,
+				RequireCSR: requireCSR,
+			}
+		case deviceCACert != "" || deviceCAKey != "":
+			log.Fatal("--device-ca-cert and --device-ca-key go together")
+		case requireCSR:
+			log.Fatal("--require-csr without a --device-ca-cert to sign the requests with")
+		}
+
+		var bundles []server.DeviceCABundle
+		for _, spec := range deviceCABundles {
+			b, err := server.ParseDeviceCABundle(spec)
+			if err != nil {
+				log.Fatalf("invalid --device-ca-bundle %s: %v", spec, err)
+			}
+			bundles = append(bundles, b)
+		}
+
+		var shutdownHooks []func(context.Context) error
+		if otlpEndpoint != "" {
+			if traceRatio < 0 || traceRatio > 1 {
+				log.Fatalf("invalid --trace-sample-ratio %v, must be between 0 and 1", traceRatio)
+			}
+			tp, err := setupTracing(otlpEndpoint, otlpInsecure, traceRatio)
+			if err != nil {
+				log.Fatalf("unable to set up tracing: %v", err)
+			}
+			shutdownHooks = append(shutdownHooks, tp.Shutdown)
+			log.Printf("exporting traces to %s", otlpEndpoint)
+		}
+
+		socketMode, err := strconv.ParseUint(adminSockMode, 8, 32)
+		if err != nil {
+			log.Fatalf("invalid --admin-socket-mode %s, must be octal permissions such as 0660: %v", adminSockMode, err)
+		}
+
+		var budgets []server.EndpointBudget
+		for _, spec := range endpointBudgets {
+			b, err := server.ParseEndpointBudget(spec)
+			if err != nil {
+				log.Fatalf("invalid --endpoint-budget %s: %v", spec, err)
+			}
+			budgets = append(budgets, b)
+		}
+
+		var pressure *server.Backpressure
+		if len(pressureItems) > 0 || pressureWhen != "" {
+			if pressure, err = server.ParseBackpressure(pressureItems, pressureWhen); err != nil {
+				log.Fatalf("invalid --backpressure: %v", err)
+			}
+			pressure.Tags = pressureTags
+		}
+
+		var hook server.OnboardHook
+		if onboardHook != "" {
+			if hook, err = server.NewOnboardWebhook(onboardHook, hookSecret, time.Duration(hookTimeout)*time.Second); err != nil {
+				log.Fatalf("invalid --onboard-hook: %v", err)
+			}
+		}
+
+		var baseConfig []byte
+		if baseConfigPath != "" {
+			if baseConfig, err = server.LoadBaseConfig(baseConfigPath); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		var listeners []server.Listener
+		for _, spec := range listenSpecs {
+			l, err := server.ParseListener(spec)
+			if err != nil {
+				log.Fatalf("invalid --listen %s: %v", spec, err)
+			}
+			listeners = append(listeners, l)
+		}
+
 		s := &server.Server{
-			Port:          port,
-			Address:       hostIP,
-			CertPath:      serverCert,
-			KeyPath:       serverKey,
-			DeviceManager: mgr,
-			CertRefresh:   certRefresh,
-			WebDir:        localWebFiles,
+			Listeners:        listeners,
+			Port:             port,
+			Address:          hostIP,
+			CertPath:         serverCert,
+			KeyPath:          serverKey,
+			KeyProvider:      keyProvider,
+			ACME:             acmeManager,
+			DeviceManager:    mgr,
+			CertRefresh:      certRefresh,
+			GCInterval:       gcInterval,
+			GCRemove:         gcRemove,
+			ArchiveInterval:  archiveInterval,
+			Quotas:           quotas,
+			MaxBodySize:      bodyLimits,
+			QuotaPeriod:      time.Duration(quotaPeriod) * time.Second,
+			LogFilter:        logFilter,
+			OnboardApproval:  approval,
+			OnboardHook:      hook,
+			BaseConfig:       baseConfig,
+			DeviceCA:         deviceCA,
+			DeviceCABundles:  bundles,
+			WebDir:           localWebFiles,
+			Tracing:          otlpEndpoint != "",
+			ShutdownTimeout:  time.Duration(shutdownTimeout) * time.Second,
+			IdleTimeout:      time.Duration(idleTimeout) * time.Second,
+			DisableHTTP2:     noHTTP2,
+			HTTP2MaxStreams:  http2Streams,
+			MaxConnections:   maxConns,
+			ShutdownHooks:    shutdownHooks,
+			AdminAuth:        adminAuth,
+			AdminCA:          adminCA,
+			AdminPolicy:      adminPolicy,
+			RequireIfMatch:   requireIfMatch,
+			TrustedProxies:   trustedProxies,
+			CORSOrigins:      corsOrigins,
+			AdminSocket:      serverSocket,
+			AdminSocketMode:  os.FileMode(socketMode),
+			CertHeader:       certHeader,
+			CertProxies:      certProxies,
+			CertProxyCA:      certProxyCA,
+			CertProxyPort:    certProxyPort,
+			EndpointBudgets:  budgets,
+			ShedRetryAfter:   time.Duration(shedRetryAfter) * time.Second,
+			FaultInjection:   faultInjection,
+			RolloutInterval:  time.Duration(rolloutInterval) * time.Second,
+			ScheduleInterval: time.Duration(schedInterval) * time.Second,
+			DeviceRetention:  time.Duration(deviceRetention) * time.Second,
+			LocalProfilePort: lpsPort,
+			LokiURL:          lokiURL,
+			LokiTenant:       lokiTenant,
+			SyslogURL:        syslogURL,
+			SyslogCA:         syslogCA,
+			MetricsURL:       exportURL,
+			MetricsFormat:    exportFormat,
+			MetricsToken:     exportToken,
+			UpstreamURL:      upstreamURL,
+			UpstreamToken:    upstreamToken,
+			UpstreamCA:       upstreamCA,
+			SyncInterval:     time.Duration(syncInterval) * time.Second,
+			Backpressure:     pressure,
 		}
 		s.Start()
 	},
@@ -189,6 +555,16 @@ func serverInit() {
 	}
 	serverCmd.Flags().StringVar(&port, "port", defaultPort, "port on which to listen")
 	serverCmd.Flags().StringVar(&hostIP, "ip", defaultIP, "IP address on which to listen")
+	serverCmd.Flags().StringArrayVar(&endpointBudgets, "endpoint-budget", nil, "budget of an endpoint of the device API, as <endpoint>[,concurrency=<n>][,wait=<duration>][,timeout=<duration>], e.g. 'POST /api/v1/edgedevice/info,concurrency=64,wait=100ms,timeout=5s' or '*,timeout=10s' for each endpoint without one; requests past concurrency, after waiting up to wait, or not handled within timeout are answered 503 with a Retry-After. May be repeated")
+	serverCmd.Flags().StringVar(&pressureWhen, "backpressure", "", "when ingest is overloaded, so that devices are served the --backpressure-item config items until it has not been for recover checks in a row, as [rate=<requests per second>][,shed=<requests>][,interval=<duration>][,recover=<checks>], e.g. rate=500,shed=20,interval=30s; rate counts the info, metrics and logs posted, and shed the requests shed or timed out under the --endpoint-budget between two checks")
+	serverCmd.Flags().StringArrayVar(&pressureItems, "backpressure-item", nil, "config item served to devices while ingest is overloaded, as <key>=<value>, e.g. timer.metric.interval=300; numeric items of a device already larger are kept. May be repeated")
+	serverCmd.Flags().StringArrayVar(&pressureTags, "backpressure-tag", nil, "with --backpressure, only slow down the devices with the tag, as <key>[:<value>]; all devices if unset. May be repeated")
+	serverCmd.Flags().IntVar(&shedRetryAfter, "shed-retry-after", int(server.DefaultShedRetryAfter.Seconds()), "seconds devices whose requests are shed are told to wait before trying again, in Retry-After")
+	serverCmd.Flags().BoolVar(&faultInjection, "fault-injection", false, "allow injecting faults into the requests of devices, per rules added with adam admin fault add, to test how EVE handles a failing controller; not for production")
+	serverCmd.Flags().StringVar(&logFormat, "log-format", logging.FormatText, "format of the logs of the server: text, one line per message with key=value fields, or json, one object per line")
+	serverCmd.Flags().StringVar(&logLevel, "log-level", "info", "level of the logs of all modules without one of their own: debug, info, warn or error; adjustable while running with adam admin log-level set")
+	serverCmd.Flags().StringSliceVar(&logModules, "log-module-level", nil, "level of the logs of a module, as <module>=<level>, e.g. http=warn for the requests served, server or the name of a driver; may be repeated")
+	serverCmd.Flags().StringArrayVar(&listenSpecs, "listen", nil, "address to listen on instead of --ip and --port, as <host:port>[,api=device|admin][,cert=<path>,key=<path>][,ca=<name>...], e.g. [::]:8080 or 0.0.0.0:8080,api=device; an IPv4 or IPv6 address listens on that family only, so both can be bound on one port. api serves only the device or admin API, cert and key a server certificate of the listener, its key read as --server-key is, ca=<name> the --device-ca-bundle, repeated for several, devices on it are verified against. May be repeated")
 	serverCmd.Flags().StringVar(&serverCert, "server-cert", path.Join(defaultDatabaseURL, serverCertFilename), "path to server certificate")
 	serverCmd.Flags().StringVar(&serverKey, "server-key", path.Join(defaultDatabaseURL, serverKeyFilename), "path to server key")
 	serverCmd.Flags().StringVar(&databaseURL, "db-url", defaultDatabaseURL, "path to directory where we will store and find device information, including onboarding certificates, device certificates, config, logs and metrics. See the readme for more details.")
@@ -202,5 +578,116 @@ func serverInit() {
 	serverCmd.Flags().IntVar(&maxMetricSize, "max-metric-size", 0, fmt.Sprintf("the maximum size of the metrics before rotating. A setting of 0 means to use the default for the particular driver. Those are: %v", defaultMetricSizes))
 	serverCmd.Flags().IntVar(&maxRequestsSize, "max-requests-size", 0, fmt.Sprintf("the maximum size of the request logs before rotating. A setting of 0 means to use the default for the particular driver. Those are: %v", defaultRequestsSizes))
 	serverCmd.Flags().IntVar(&maxAppLogsSize, "max-app-logs-size", 0, fmt.Sprintf("the maximum size of the app logs before rotating. A setting of 0 means to use the default for the particular driver. Those are: %v", defaultAppLogsSizes))
+	serverCmd.Flags().IntVar(&gcInterval, "gc-interval", 0, "how often, in seconds, to look for data left behind without a matching device, e.g. by a failed device removal; 0 means never. Only supported by the redis driver")
+	serverCmd.Flags().BoolVar(&gcRemove, "gc-remove", false, "whether to remove the orphaned data found every --gc-interval, or only log it")
+	serverCmd.Flags().IntVar(&archiveInterval, "archive-interval", 3600, "how often, in seconds, to move the entries of device streams older than the archive-after of the database URL to its archive; 0 means only when asked to with adam admin archive. Only supported by the redis driver, with an archive in its database URL")
+	serverCmd.Flags().StringVar(&maxStreamLen, "max-stream-len", "", "maximum number of entries kept per device stream, older ones are trimmed, as <default>,<kind>=<entries>,... with kinds logs, info, metrics, requests and apps, e.g. 10000,logs=50000; empty means no limit. Only supported by the redis driver and overridable per device")
+	serverCmd.Flags().StringVar(&deviceQuota, "device-quota", "", "maximum number of bytes accepted from each device per --quota-period, as <default>,<kind>=<bytes>,..., same kinds as --max-stream-len; empty means no limit. Overridable per device")
+	serverCmd.Flags().StringVar(&maxBodySize, "max-body-size", fmt.Sprint(server.DefaultMaxBodySize), "maximum size in bytes of the body of a request from a device, larger ones are answered 413, as <default>,<kind>=<bytes>,..., same kinds as --max-stream-len, requests being for registering and the others, e.g. 16777216,logs=67108864; 0 means no limit")
+	serverCmd.Flags().StringVar(&logMinSeverity, "log-min-severity", "", "severity below which the log entries of devices are dropped before they are stored, e.g. info; empty keeps all. Overridable per device")
+	serverCmd.Flags().IntVar(&logSample, "log-sample", 0, "keep one of every this many log entries below --log-min-severity instead of dropping all of them; 0 drops all")
+	serverCmd.Flags().IntVar(&quotaPeriod, "quota-period", int(common.DefaultQuotaPeriod/time.Second), "period, in seconds, over which --device-quota is counted")
+	serverCmd.Flags().BoolVar(&onboardApproval, "onboard-approval", false, "whether devices that onboard wait in a pending queue for an admin to approve them, instead of being registered immediately")
+	serverCmd.Flags().StringSliceVar(&approveSerials, "auto-approve-serial", nil, "with --onboard-approval, serials to approve automatically, as glob patterns, e.g. 'lab-*'; can be repeated")
+	serverCmd.Flags().StringVar(&onboardHook, "onboard-hook", "", "URL of a webhook deciding on the registrations of devices, to allow, reject or hold them, and set their metadata and initial config; empty means none")
+	serverCmd.Flags().StringVar(&hookSecret, "onboard-hook-secret", "", "secret to sign the requests to the --onboard-hook with, as the HMAC-SHA256 of the body in X-Adam-Signature; empty means unsigned")
+	serverCmd.Flags().IntVar(&hookTimeout, "onboard-hook-timeout", int(server.DefaultOnboardHookTimeout/time.Second), "how long, in seconds, the --onboard-hook can take to decide, before the device is answered 503 to try again")
+	serverCmd.Flags().StringVar(&baseConfigPath, "base-config", "", "path to the JSON of the EdgeDevConfig newly registered devices start with when neither a config snapshot nor the --onboard-hook sets one, its UUID and version set for each; empty means a config with only those")
+	serverCmd.Flags().StringSliceVar(&approveCNs, "auto-approve-cn", nil, "with --onboard-approval, common names of the onboarding certificates whose devices are approved automatically, as glob patterns; can be repeated")
+	serverCmd.Flags().StringVar(&otlpEndpoint, "otlp-endpoint", "", "host:port of an OpenTelemetry collector to export traces of requests and the driver calls they make to, over OTLP/HTTP; empty means not to trace")
+	serverCmd.Flags().BoolVar(&otlpInsecure, "otlp-insecure", false, "whether to export traces over plain HTTP rather than HTTPS")
+	serverCmd.Flags().Float64Var(&traceRatio, "trace-sample-ratio", 1, "ratio of the requests to trace, between 0 and 1; requests from clients that sampled their trace are always traced")
+	serverCmd.Flags().IntVar(&shutdownTimeout, "shutdown-timeout", int(server.DefaultShutdownTimeout/time.Second), "how long, in seconds, shutting down on SIGINT or SIGTERM can take, waiting for the requests in flight and closing the connections to the database, before exiting anyway")
+	serverCmd.Flags().IntVar(&idleTimeout, "idle-timeout", int(server.DefaultIdleTimeout/time.Second), "how long, in seconds, a connection is kept open between requests, with HTTP/1.1 keep-alive and HTTP/2 alike; longer than the interval devices poll at lets them skip the TLS handshake of each poll")
+	serverCmd.Flags().BoolVar(&noHTTP2, "disable-http2", false, "serve HTTP/1.1 only, rather than HTTP/2 to the clients that offer it")
+	serverCmd.Flags().Uint32Var(&http2Streams, "http2-max-streams", server.DefaultHTTP2MaxStreams, "how many requests an HTTP/2 connection can have in flight at once")
+	serverCmd.Flags().IntVar(&maxConns, "max-connections", 0, "how many connections each listener has open at most, others waiting to be accepted until one closes; 0 means no limit")
+	serverCmd.Flags().BoolVar(&adminAuth, "admin-auth", false, "whether the admin API requires an API token, or a client certificate signed by --admin-ca; without it, tokens and certificates are checked when given, but not required")
+	serverCmd.Flags().StringVar(&adminCA, "admin-ca", "", "path to the PEM certificates of the CAs whose client certificates have full access to the admin API")
+	serverCmd.Flags().StringVar(&adminPolicy, "admin-policy", "", "path to a YAML or JSON access policy limiting the admin operations and devices of the certificates and tokens it has rules for, reloaded on SIGHUP; needs --admin-auth")
+	serverCmd.Flags().BoolVar(&requireIfMatch, "require-if-match", true, "require an If-Match with the ETag of the current config to set the config of a device through the admin API, so that stale writes are rejected; set to false to let sets without one replace any config")
+	serverCmd.Flags().StringSliceVar(&trustedProxies, "trusted-proxy", nil, "CIDR or IP address of a reverse proxy in front of the admin API, e.g. nginx or Traefik, whose X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers are believed, so that audit records have the IP address of the client; can be repeated")
+	serverCmd.Flags().StringVar(&serverSocket, "admin-socket", "", "path of a Unix socket to serve the admin API on too, in plain HTTP, for local tools, e.g. adam admin --server unix:///run/adam/admin.sock; requests on it need no API token, access being that to the socket file. 'systemd' takes the socket systemd passes, as with socket activation; the one named admin with FileDescriptorName= if it passes several")
+	serverCmd.Flags().StringVar(&adminSockMode, "admin-socket-mode", "0600", "permissions of the --admin-socket file, in octal")
+	serverCmd.Flags().StringVar(&certHeader, "cert-header", "", "header in which TLS-terminating proxies in front of the device API, e.g. nginx or HAProxy, pass the client certificate of the device, e.g. X-SSL-Client-Cert, as PEM, URL-encoded PEM or base64 DER; requires --cert-proxy. Empty means devices connect with TLS to adam itself")
+	serverCmd.Flags().StringSliceVar(&certProxies, "cert-proxy", nil, "CIDR or IP address of a proxy whose --cert-header is believed; requests from elsewhere keep their own client certificate; can be repeated")
+	serverCmd.Flags().StringVar(&certProxyCA, "cert-proxy-ca", "", "path to the PEM certificates of the CAs one of which must have signed the client certificate the proxies connect with; empty means they need none")
+	serverCmd.Flags().StringVar(&certProxyPort, "cert-proxy-port", "", "port of a plain HTTP listener of the device API, for the proxies to forward requests to without TLS; empty means none")
+	serverCmd.Flags().StringSliceVar(&corsOrigins, "cors-origin", nil, "origin of a browser-based UI allowed to call the admin API, as http[s]://host[:port], or * for any; can be repeated. Empty means cross-origin requests are not allowed")
+	serverCmd.Flags().IntVar(&rolloutInterval, "rollout-interval", int(server.DefaultRolloutInterval/time.Second), "how often, in seconds, to check whether the devices of running config rollouts acknowledged their change, and apply the next waves")
+	serverCmd.Flags().IntVar(&schedInterval, "schedule-interval", int(server.DefaultScheduleInterval/time.Second), "how often, in seconds, to check whether pending scheduled config changes are due, and apply them")
+	serverCmd.Flags().StringVar(&deviceCACert, "device-ca-cert", "", "path to the PEM certificate of a CA to sign the certificates of devices that register with a certificate signing request")
+	serverCmd.Flags().StringVar(&deviceCAKey, "device-ca-key", "", "key of the --device-ca-cert CA, from the --key-provider")
+	serverCmd.Flags().StringArrayVar(&deviceCABundles, "device-ca-bundle", nil, "CA bundle one of which must have signed the certificates of devices, as <name>=<path> to PEM CA certificates, e.g. old=old-root.pem, reloaded on SIGHUP; a listener takes only some with ca=<name>. May be repeated; empty means device certificates are only matched against those registered")
+	serverCmd.Flags().IntVar(&deviceCertDays, "device-cert-days", int(server.DefaultDeviceCertValidity/(24*time.Hour)), "how long, in days, the device certificates signed with the --device-ca-cert CA are valid, never past the CA")
+	serverCmd.Flags().BoolVar(&requireCSR, "require-csr", false, "with --device-ca-cert, refuse devices that register with a self-signed certificate instead of a certificate signing request")
+	serverCmd.Flags().IntVar(&deviceRetention, "device-retention", int(server.DefaultDeviceRetention/time.Second), "how long, in seconds, devices deleted softly are kept, with their certificates, config and data, before they are removed for good")
+	serverCmd.Flags().StringVar(&lokiURL, "loki-url", "", "URL of a Grafana Loki to forward the logs of devices and their app instances to, as http[s]://[user:password@]host[:port][/path], the path defaulting to that of the push API; empty means not to forward them")
+	serverCmd.Flags().StringVar(&lokiTenant, "loki-tenant", "", "tenant of the logs forwarded to Loki, sent as X-Scope-OrgID; empty means none")
+	serverCmd.Flags().StringVar(&syslogURL, "syslog-url", "", "URL of a syslog server to forward the logs of devices and their app instances to as RFC 5424 messages, as udp://, tcp:// or tls://host[:port][?facility=<facility>]; empty means not to forward them")
+	serverCmd.Flags().StringVar(&syslogCA, "syslog-ca", "", "path to the PEM certificates of the CAs to trust for the certificate of a tls:// --syslog-url server; empty means those of the system")
+	serverCmd.Flags().StringVar(&exportURL, "metrics-export-url", "", "URL to push the metrics of devices and their app instances to as time series, as http[s]://[user:password@]host[:port]/path, e.g. the write API of InfluxDB or a Prometheus remote-write endpoint; empty means not to push them")
+	serverCmd.Flags().StringVar(&exportFormat, "metrics-export-format", "influx", "how the metrics are pushed to --metrics-export-url, influx for the InfluxDB line protocol or prometheus for Prometheus remote-write")
+	serverCmd.Flags().StringVar(&exportToken, "metrics-export-token", "", "token to authorize the pushes of metrics with, sent as Authorization: Token for InfluxDB and Bearer for Prometheus; empty means none")
+	serverCmd.Flags().StringVar(&upstreamURL, "upstream-url", "", "URL of a primary Adam to run as a secondary of, as http[s]://host[:port]: its onboarding certificates and devices, with the config each is served, are synced every --sync-interval, and the telemetry of devices is forwarded to it. Empty means none")
+	serverCmd.Flags().StringVar(&upstreamToken, "upstream-token", os.Getenv("ADAM_UPSTREAM_TOKEN"), "admin API token of the --upstream-url primary to sync and forward with, limited to the devices of this site if it should only have those; defaults to the ADAM_UPSTREAM_TOKEN environment variable")
+	serverCmd.Flags().StringVar(&upstreamCA, "upstream-ca", "", "path to the PEM certificates of the CAs to trust for the server certificate of the --upstream-url primary; empty means those of the system")
+	serverCmd.Flags().IntVar(&syncInterval, "sync-interval", int(server.DefaultSyncInterval/time.Second), "how often, in seconds, to sync from the --upstream-url primary")
+	serverCmd.Flags().StringVar(&lpsPort, "local-profile-port", "", "port on which to serve the local profile server API to devices, over plain HTTP, at /<uuid> of each device; EVE uses 8888 by default. Empty means not to serve it")
 	serverCmd.Flags().StringVar(&localWebFiles, "web-dir", "", "path to static files on the local filesystem for the web server; if empty, will use those embedded in the Adam binary")
+	serverCmd.Flags().StringSliceVar(&acmeDomains, "acme-domain", nil, "domain to obtain the server certificate for from an ACME CA, e.g. Let's Encrypt, renewing it before it expires, instead of using --server-cert and --server-key; can be repeated, the first being the common name. The account key and the certificate are kept in the database")
+	serverCmd.Flags().StringVar(&acmeEmail, "acme-email", "", "contact email of the ACME account; empty means none")
+	serverCmd.Flags().StringVar(&acmeDirectory, "acme-directory", acme.LetsEncryptURL, "directory URL of the ACME CA, e.g. https://acme-staging-v02.api.letsencrypt.org/directory for the Let's Encrypt staging environment")
+	serverCmd.Flags().StringVar(&acmeChallenge, "acme-challenge", server.ACMEHTTP01, "how control of the --acme-domain is proven: http-01, answered on --acme-http-address, or dns-01, with TXT records published by --acme-dns-hook")
+	serverCmd.Flags().StringVar(&acmeHTTPAddress, "acme-http-address", server.DefaultACMEHTTPAddress, "address to listen on for http-01 challenges while obtaining a certificate; the CA connects to port 80 of each domain")
+	serverCmd.Flags().StringVar(&acmeDNSHook, "acme-dns-hook", "", "command run to publish the TXT record of dns-01 challenges, as <command> present <name> <value>, and to remove it, as <command> cleanup <name> <value>")
+	serverCmd.Flags().IntVar(&acmeRenewBefore, "acme-renew-before", int(server.DefaultACMERenewBefore/time.Second), "how long, in seconds, before it expires the certificate obtained with ACME is renewed")
+	serverCmd.Flags().StringVar(&keyProviderName, "key-provider", "file", "where to get the server key from: 'file' for a PEM file at --server-key, or 'vault' for a vault transit key named by --server-key")
+	serverCmd.Flags().StringVar(&vaultAddr, "vault-addr", os.Getenv("VAULT_ADDR"), "address of the vault server, when using vault for keys; defaults to the VAULT_ADDR environment variable. The token is read from the VAULT_TOKEN environment variable")
+	serverCmd.Flags().StringVar(&vaultMount, "vault-transit-mount", "transit", "mount path of the vault transit secrets engine")
+	serverCmd.Flags().StringVar(&encryptionVault, "encryption-vault-key", "", "name of a vault transit key used to wrap the encryption at rest data keys, instead of --encryption-key")
+	serverCmd.Flags().IntVar(&vaultCacheTTL, "encryption-vault-cache-ttl", int(ax509.DefaultVaultKeyCacheTTL/time.Second), "how long, in seconds, the data keys unwrapped with --encryption-vault-key are kept in memory, rather than unwrapped with vault each time they are read; 0 to not keep them")
+	serverCmd.Flags().BoolVar(&encryptionStrict, "encryption-strict", true, "with encryption at rest, refuse to read values stored in plaintext, or encrypted by older releases without the key of their record, rather than reading them as they are; set to false only until they are migrated with --encryption-migrate")
+	serverCmd.Flags().BoolVar(&encryptionMigrate, "encryption-migrate", false, "with encryption at rest, encrypt the values stored in plaintext, or encrypted by older releases without the key of their record, with the key of their record, on start, before serving")
+	serverCmd.Flags().StringVar(&encryptionKey, "encryption-key", "", "path to a file with a 16, 24 or 32 byte AES key, raw or base64-encoded, used to encrypt certificates, serials and configs at rest; can also be provided base64-encoded in the ENCRYPTION_KEY environment variable. If empty, data is stored in plaintext")
+}
+
+// getVaultCacheTTL how long the data keys unwrapped with vault are kept in memory, as set on the command-line
+func getVaultCacheTTL() time.Duration {
+	if vaultCacheTTL <= 0 {
+		return -1
+	}
+	return time.Duration(vaultCacheTTL) * time.Second
+}
+
+// getKeyProvider get the KeyProvider selected on the command-line
+func getKeyProvider() ax509.KeyProvider {
+	switch keyProviderName {
+	case "file":
+		return &ax509.FileKeyProvider{}
+	case "vault":
+		return &ax509.VaultKeyProvider{
+			Client: getVaultClient(),
+			Mount:  vaultMount,
+		}
+	default:
+		log.Fatalf("unknown key provider %s", keyProviderName)
+	}
+	return nil
+}
+
+// getVaultClient get a vault client based on the command-line and environment
+func getVaultClient() *ax509.VaultClient {
+	if vaultAddr == "" {
+		log.Fatalf("must provide vault address via --vault-addr or VAULT_ADDR")
+	}
+	token, ok := os.LookupEnv("VAULT_TOKEN")
+	if !ok {
+		log.Fatalf("must provide vault token via VAULT_TOKEN")
+	}
+	return &ax509.VaultClient{
+		Address:   vaultAddr,
+		Token:     token,
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+	}
 }
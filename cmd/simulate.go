@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/simulator"
+	"github.com/spf13/cobra"
+)
+
+var (
+	simServer           string
+	simServerCA         string
+	simInsecure         bool
+	simOnboardCert      string
+	simOnboardKey       string
+	simDevices          int
+	simSerialPrefix     string
+	simRampUp           int
+	simDuration         int
+	simConfigInterval   int
+	simInfoInterval     int
+	simMetricsInterval  int
+	simLogsInterval     int
+	simLogEntries       int
+	simTimeout          int
+	simProgressInterval int
+	simJSON             bool
+)
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Load test a running Adam server with simulated devices",
+	Long: `Simulate many EVE devices against a running Adam server: each one registers with the onboarding certificate,
+	then polls its config and sends info, metrics and logs at the given intervals, until the duration is over or the
+	command is interrupted. The number of requests, errors and latencies of each operation are reported at the end.
+	The onboarding certificate must be one Adam accepts the generated serials for, e.g. added with --serial '*'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		onboard, err := tls.LoadX509KeyPair(simOnboardCert, simOnboardKey)
+		if err != nil {
+			log.Fatalf("error loading onboarding certificate %s and key %s: %v", simOnboardCert, simOnboardKey, err)
+		}
+		c := simulator.Config{
+			URL:             simServer,
+			Onboard:         onboard,
+			Insecure:        simInsecure,
+			Devices:         simDevices,
+			SerialPrefix:    simSerialPrefix,
+			RampUp:          time.Duration(simRampUp) * time.Second,
+			Duration:        time.Duration(simDuration) * time.Second,
+			ConfigInterval:  time.Duration(simConfigInterval) * time.Second,
+			InfoInterval:    time.Duration(simInfoInterval) * time.Second,
+			MetricsInterval: time.Duration(simMetricsInterval) * time.Second,
+			LogsInterval:    time.Duration(simLogsInterval) * time.Second,
+			LogEntries:      simLogEntries,
+			Timeout:         time.Duration(simTimeout) * time.Second,
+		}
+		if simServerCA != "" {
+			ca, err := ioutil.ReadFile(simServerCA)
+			if err != nil {
+				log.Fatalf("error reading server CA certificate %s: %v", simServerCA, err)
+			}
+			c.RootCAs = x509.NewCertPool()
+			if !c.RootCAs.AppendCertsFromPEM(ca) {
+				log.Fatalf("no certificates found in server CA certificate %s", simServerCA)
+			}
+		}
+		if simProgressInterval > 0 {
+			c.ProgressInterval = time.Duration(simProgressInterval) * time.Second
+			c.Progress = func(r *simulator.Report) {
+				var requests, errors int
+				for _, o := range r.Operations {
+					requests += o.Requests
+					errors += o.Errors
+				}
+				log.Printf("%s: %d/%d devices registered, %d requests, %d errors", r.Elapsed.Round(time.Second), r.Registered, r.Devices, requests, errors)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		go func() {
+			select {
+			case <-signals:
+				log.Printf("interrupted, stopping the simulation")
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		log.Printf("simulating %d devices against %s for %ds", simDevices, simServer, simRampUp+simDuration)
+		report, err := simulator.Run(ctx, c)
+		if err != nil {
+			log.Fatalf("error running simulation: %v", err)
+		}
+		if simJSON {
+			b, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				log.Fatalf("error encoding report: %v", err)
+			}
+			fmt.Println(string(b))
+			return
+		}
+		printReport(report)
+	},
+}
+
+func simulateInit() {
+	simulateCmd.Flags().StringVar(&simServer, "server", defaultServerURL, "full URL to running Adam server")
+	simulateCmd.Flags().StringVar(&simServerCA, "server-ca", path.Join(defaultDatabaseURL, serverCertFilename), "path to CA certificate for trusting server; set to blank if using a certificate signed by a CA already on your system")
+	simulateCmd.Flags().BoolVar(&simInsecure, "insecure", false, "accept invalid, expired or mismatched hostname errors for adam server certificate")
+	simulateCmd.Flags().StringVar(&simOnboardCert, "onboard-cert", "", "path to the onboarding certificate the devices register with")
+	simulateCmd.MarkFlagRequired("onboard-cert")
+	simulateCmd.Flags().StringVar(&simOnboardKey, "onboard-key", "", "path to the key of the onboarding certificate")
+	simulateCmd.MarkFlagRequired("onboard-key")
+	simulateCmd.Flags().IntVar(&simDevices, "devices", 10, "number of devices to simulate")
+	simulateCmd.Flags().StringVar(&simSerialPrefix, "serial-prefix", "", "prefix of the serials of the devices, followed by their number; a random one if blank, as a serial cannot register twice")
+	simulateCmd.Flags().IntVar(&simRampUp, "ramp-up", 0, "seconds over which to start the devices, at even intervals; 0 starts them all at once")
+	simulateCmd.Flags().IntVar(&simDuration, "duration", 60, "seconds to run the simulation for once all the devices are started")
+	simulateCmd.Flags().IntVar(&simConfigInterval, "config-interval", int(simulator.DefaultConfigInterval/time.Second), "seconds between config requests of each device; negative to disable")
+	simulateCmd.Flags().IntVar(&simInfoInterval, "info-interval", int(simulator.DefaultInfoInterval/time.Second), "seconds between info messages of each device; negative to disable")
+	simulateCmd.Flags().IntVar(&simMetricsInterval, "metrics-interval", int(simulator.DefaultMetricsInterval/time.Second), "seconds between metrics of each device; negative to disable")
+	simulateCmd.Flags().IntVar(&simLogsInterval, "logs-interval", int(simulator.DefaultLogsInterval/time.Second), "seconds between log bundles of each device; negative to disable")
+	simulateCmd.Flags().IntVar(&simLogEntries, "log-entries", simulator.DefaultLogEntries, "number of log entries in each bundle")
+	simulateCmd.Flags().IntVar(&simTimeout, "timeout", int(simulator.DefaultTimeout/time.Second), "seconds a request may take before it fails")
+	simulateCmd.Flags().IntVar(&simProgressInterval, "progress-interval", 10, "seconds between progress lines; 0 to disable")
+	simulateCmd.Flags().BoolVar(&simJSON, "json", false, "print the report as json")
+}
+
+// printReport print the report of a simulation as a table
+func printReport(r *simulator.Report) {
+	fmt.Printf("devices: %d, registered: %d, elapsed: %s\n\n", r.Devices, r.Registered, r.Elapsed.Round(time.Millisecond))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "operation\trequests\terrors\tmean\tp50\tp90\tp99\tmax\t")
+	for _, o := range r.Operations {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t\n", o.Operation, o.Requests, o.Errors,
+			o.Mean.Round(time.Microsecond), o.P50.Round(time.Microsecond), o.P90.Round(time.Microsecond),
+			o.P99.Round(time.Microsecond), o.Max.Round(time.Microsecond))
+	}
+	w.Flush()
+	if len(r.Errors) == 0 {
+		return
+	}
+	fmt.Println("\nerrors:")
+	var ops []string
+	for op := range r.Errors {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		fmt.Printf("  %s: %s\n", op, r.Errors[op])
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	snapshotName        string
+	snapshotDevice      string
+	snapshotDefault     bool
+	snapshotDevices     []string
+	snapshotSerials     []string
+	snapshotWaveSize    int
+	snapshotWaveTimeout int
+	snapshotMaxFailures int
+	snapshotOut         string
+	snapshotIn          string
+	snapshotTelemetry   bool
+	snapshotReplace     bool
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "manage config snapshots",
+	Long: `Config snapshots are configs captured from devices, without what identifies them, to apply to other devices, or to start newly onboarded devices with.
+State snapshots, with create and restore, are the whole state of the server, whatever its driver, as a tar.gz with checksums, to recover from or move to another driver`,
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list config snapshots in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/snapshot", nil, http.StatusOK))
+	},
+}
+
+var snapshotGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "get a config snapshot in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", path.Join("/admin/snapshot", snapshotName), nil, http.StatusOK))
+	},
+}
+
+var snapshotCaptureCmd = &cobra.Command{
+	Use:   "capture",
+	Short: "capture the config of a device as a snapshot, and print it",
+	Long: `Capture the current config of a device as a snapshot, and print it, replacing the snapshot of the same name if any. The UUID and version of the device, and its reboot and backup commands, are left out.
+With --default, newly onboarded devices start with the config of the snapshot instead of an empty one; only one snapshot is the default at a time`,
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := json.Marshal(server.SnapshotRequest{Name: snapshotName, Device: snapshotDevice, Default: snapshotDefault})
+		if err != nil {
+			log.Fatalf("error encoding snapshot request: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", "/admin/snapshot", bytes.NewBuffer(b), http.StatusCreated))
+	},
+}
+
+var snapshotApplyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "apply a config snapshot to devices, as a config rollout, and print the rollout",
+	Long:  `Apply a config snapshot to devices, as a config rollout of it, and print the rollout, which is managed as any other. The devices are those given with --device and those whose serial matches a --serial pattern, or every device if there are neither`,
+	Run: func(cmd *cobra.Command, args []string) {
+		req := server.RolloutRequest{
+			Devices:     snapshotDevices,
+			Serials:     snapshotSerials,
+			WaveSize:    snapshotWaveSize,
+			WaveTimeout: snapshotWaveTimeout,
+			MaxFailures: snapshotMaxFailures,
+		}
+		b, err := json.Marshal(req)
+		if err != nil {
+			log.Fatalf("error encoding rollout request: %v", err)
+		}
+		fmt.Printf("%s\n", adminRequest("POST", path.Join("/admin/snapshot", snapshotName, "apply"), bytes.NewBuffer(b), http.StatusCreated))
+	},
+}
+
+var snapshotRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove a config snapshot; devices it was applied to keep their config",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/snapshot", snapshotName), nil, http.StatusOK)
+	},
+}
+
+var snapshotCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "create a snapshot of the whole state of the server as a tar.gz",
+	Long: `Create a snapshot of the whole state of the server as a tar.gz: onboarding and device certificates, configs, and every other record, with a manifest of their checksums. It is of one point in time.
+Requests changing state wait until it is sent. With --telemetry, the logs, info, metrics and requests of devices, and the audit log, are in it too. Secrets, e.g. API tokens, are in it, so keep it as safe as the storage`,
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := resolveURL(serverURL, fmt.Sprintf("/admin/export/state?telemetry=%t", snapshotTelemetry))
+		if err != nil {
+			log.Fatalf("error constructing URL: %v", err)
+		}
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			log.Fatalf("unable to create new http request: %v", err)
+		}
+		res, err := getStreamingClient().Do(req)
+		if err != nil {
+			log.Fatalf("error reading URL %s: %v", u, err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			b, _ := ioutil.ReadAll(res.Body)
+			log.Fatalf("error reading URL %s: %d %s", u, res.StatusCode, errorText(b))
+		}
+		out := os.Stdout
+		if snapshotOut != "-" {
+			if out, err = os.Create(snapshotOut); err != nil {
+				log.Fatalf("error creating %s: %v", snapshotOut, err)
+			}
+		}
+		if _, err := io.Copy(out, res.Body); err != nil {
+			log.Fatalf("error writing %s: %v", snapshotOut, err)
+		}
+		if err := out.Close(); err != nil {
+			log.Fatalf("error writing %s: %v", snapshotOut, err)
+		}
+	},
+}
+
+var snapshotRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "restore a snapshot of the state of a server, and print its manifest",
+	Long: `Restore a snapshot of the state of a server, as created, and print its manifest in JSON format. It is checked against its checksums first, so a damaged one changes nothing.
+The server must have no onboarding certificates or devices, unless --replace is set, which clears everything it has first`,
+	Run: func(cmd *cobra.Command, args []string) {
+		in := os.Stdin
+		if snapshotIn != "-" {
+			f, err := os.Open(snapshotIn)
+			if err != nil {
+				log.Fatalf("error opening %s: %v", snapshotIn, err)
+			}
+			defer f.Close()
+			in = f
+		}
+		// the streaming client, as a large snapshot takes longer to send than the timeout of the other
+		u, err := resolveURL(serverURL, fmt.Sprintf("/admin/import/state?replace=%t", snapshotReplace))
+		if err != nil {
+			log.Fatalf("error constructing URL: %v", err)
+		}
+		req, err := http.NewRequest("POST", u, in)
+		if err != nil {
+			log.Fatalf("unable to create new http request: %v", err)
+		}
+		res, err := getStreamingClient().Do(req)
+		if err != nil {
+			log.Fatalf("error POST URL %s: %v", u, err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			log.Fatalf("unable to read data from URL %s: %v", u, err)
+		}
+		if res.StatusCode != http.StatusOK {
+			log.Fatalf("error POST URL %s: %d %s", u, res.StatusCode, errorText(b))
+		}
+		fmt.Printf("%s\n", b)
+	},
+}
+
+func snapshotInit() {
+	snapshotCmd.AddCommand(snapshotListCmd)
+	snapshotCmd.AddCommand(snapshotGetCmd)
+	snapshotGetCmd.Flags().StringVar(&snapshotName, "name", "", "name of the snapshot")
+	snapshotGetCmd.MarkFlagRequired("name")
+	snapshotCmd.AddCommand(snapshotCaptureCmd)
+	snapshotCaptureCmd.Flags().StringVar(&snapshotName, "name", "", "name of the snapshot, e.g. golden")
+	snapshotCaptureCmd.MarkFlagRequired("name")
+	snapshotCaptureCmd.Flags().StringVar(&snapshotDevice, "uuid", "", "UUID of the device to capture the config of")
+	snapshotCaptureCmd.MarkFlagRequired("uuid")
+	snapshotCaptureCmd.Flags().BoolVar(&snapshotDefault, "default", false, "start newly onboarded devices with the config of the snapshot")
+	snapshotCmd.AddCommand(snapshotApplyCmd)
+	snapshotApplyCmd.Flags().StringVar(&snapshotName, "name", "", "name of the snapshot")
+	snapshotApplyCmd.MarkFlagRequired("name")
+	snapshotApplyCmd.Flags().StringSliceVar(&snapshotDevices, "device", nil, "UUID of a device to apply the snapshot to; can be repeated")
+	snapshotApplyCmd.Flags().StringSliceVar(&snapshotSerials, "serial", nil, "pattern, e.g. 'lab-*', of the serials of devices to apply the snapshot to; can be repeated")
+	snapshotApplyCmd.Flags().IntVar(&snapshotWaveSize, "wave-size", 10, "percentage of the devices to apply the snapshot to at a time")
+	snapshotApplyCmd.Flags().IntVar(&snapshotWaveTimeout, "wave-timeout", 600, "how long, in seconds, each device has to acknowledge the change before it counts as failed")
+	snapshotApplyCmd.Flags().IntVar(&snapshotMaxFailures, "max-failures", 0, "how many devices can fail before the rollout halts")
+	snapshotCmd.AddCommand(snapshotRemoveCmd)
+	snapshotRemoveCmd.Flags().StringVar(&snapshotName, "name", "", "name of the snapshot")
+	snapshotRemoveCmd.MarkFlagRequired("name")
+	snapshotCmd.AddCommand(snapshotCreateCmd)
+	snapshotCreateCmd.Flags().StringVar(&snapshotOut, "out", "", "path to write the tar.gz to; - for stdout")
+	snapshotCreateCmd.MarkFlagRequired("out")
+	snapshotCreateCmd.Flags().BoolVar(&snapshotTelemetry, "telemetry", false, "include the logs, info, metrics and requests of devices, and the audit log")
+	snapshotCmd.AddCommand(snapshotRestoreCmd)
+	snapshotRestoreCmd.Flags().StringVar(&snapshotIn, "in", "", "path of the tar.gz to restore, as created; - for stdin")
+	snapshotRestoreCmd.MarkFlagRequired("in")
+	snapshotRestoreCmd.Flags().BoolVar(&snapshotReplace, "replace", false, "clear the state of the server before restoring, rather than requiring it to be empty")
+}
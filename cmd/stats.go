@@ -0,0 +1,20 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "report the requests of each device since the server started, in JSON format",
+	Long:  `Report, for each endpoint of the device API and for each device, the requests over the last hour and since the server started, in JSON format. For each device, the config polls, the bytes of logs, info, metrics and app logs sent, the errors and the last one`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/stats", nil, http.StatusOK))
+	},
+}
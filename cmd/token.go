@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	tokenID        string
+	tokenName      string
+	tokenDevices   []string
+	tokenReadOnly  bool
+	tokenExpiresIn time.Duration
+)
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "manage admin API tokens",
+	Long:  `Create, list or remove tokens for the admin API, which scripts can use with --token instead of a client certificate. Tokens can be limited to some devices, or to reading`,
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list admin API tokens, without their secrets, in JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("%s\n", adminRequest("GET", "/admin/token", nil, http.StatusOK))
+	},
+}
+
+var tokenAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "create an admin API token and print it",
+	Long:  `Create an admin API token and print it. Only its hash is stored, so this is the only time the token can be seen`,
+	Run: func(cmd *cobra.Command, args []string) {
+		req := server.TokenRequest{Name: tokenName, Devices: tokenDevices, ReadOnly: tokenReadOnly}
+		if tokenExpiresIn > 0 {
+			expires := time.Now().Add(tokenExpiresIn)
+			req.Expires = &expires
+		}
+		b, err := json.Marshal(req)
+		if err != nil {
+			log.Fatalf("error encoding token request: %v", err)
+		}
+		var res server.TokenResponse
+		if err := json.Unmarshal(adminRequest("POST", "/admin/token", bytes.NewBuffer(b), http.StatusCreated), &res); err != nil {
+			log.Fatalf("error reading created token: %v", err)
+		}
+		fmt.Println(res.Token)
+	},
+}
+
+var tokenRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove an admin API token, so that it is no longer accepted",
+	Run: func(cmd *cobra.Command, args []string) {
+		adminRequest("DELETE", path.Join("/admin/token", tokenID), nil, http.StatusOK)
+	},
+}
+
+// adminRequest send an admin API request, and return the response body, exiting unless it has the expected status
+func adminRequest(method, p string, body io.Reader, status int) []byte {
+	u, err := resolveURL(serverURL, p)
+	if err != nil {
+		log.Fatalf("error constructing URL: %v", err)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		log.Fatalf("unable to create new http request: %v", err)
+	}
+	res, err := getClient().Do(req)
+	if err != nil {
+		log.Fatalf("error %s URL %s: %v", method, u, err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Fatalf("unable to read data from URL %s: %v", u, err)
+	}
+	if res.StatusCode != status {
+		log.Fatalf("error %s URL %s: %d %s", method, u, res.StatusCode, errorText(b))
+	}
+	return b
+}
+
+// errorText the code and message of an error the server answered with, and its details if any, or the body as is
+// if it is not an error response
+func errorText(b []byte) string {
+	var e server.ErrorResponse
+	if err := json.Unmarshal(b, &e); err != nil || e.Code == "" {
+		return string(bytes.TrimSpace(b))
+	}
+	text := fmt.Sprintf("%s: %s", e.Code, e.Message)
+	if e.Details != nil {
+		if d, err := json.Marshal(e.Details); err == nil {
+			text += " " + string(d)
+		}
+	}
+	return text
+}
+
+func tokenInit() {
+	tokenCmd.AddCommand(tokenListCmd)
+	tokenCmd.AddCommand(tokenAddCmd)
+	tokenAddCmd.Flags().StringVar(&tokenName, "name", "", "name of the token, e.g. what it is for")
+	tokenAddCmd.Flags().StringSliceVar(&tokenDevices, "device", nil, "UUID of a device to limit the token to; can be repeated. If none, the token can reach all devices and the other admin endpoints")
+	tokenAddCmd.Flags().BoolVar(&tokenReadOnly, "read-only", false, "limit the token to reading, i.e. GET requests")
+	tokenAddCmd.Flags().DurationVar(&tokenExpiresIn, "expires-in", 0, "how long the token is valid for, e.g. 720h; 0 means forever")
+	tokenCmd.AddCommand(tokenRemoveCmd)
+	tokenRemoveCmd.Flags().StringVar(&tokenID, "id", "", "id of the token, as listed")
+	tokenRemoveCmd.MarkFlagRequired("id")
+}
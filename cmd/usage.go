@@ -0,0 +1,43 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	usageKind  string
+	usageLimit int
+)
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "report the storage used by each device, those using the most first, in JSON format",
+	Long:  `Report the bytes, number and oldest and newest times of the logs, info, metrics, requests and app logs stored for each device, those using the most bytes first, in JSON format. With --kind, devices are ranked by the bytes of that kind of message only`,
+	Run: func(cmd *cobra.Command, args []string) {
+		p := "/admin/usage"
+		q := url.Values{}
+		if usageKind != "" {
+			q.Set("kind", usageKind)
+		}
+		if usageLimit > 0 {
+			q.Set("limit", strconv.Itoa(usageLimit))
+		}
+		if len(q) > 0 {
+			p += "?" + q.Encode()
+		}
+		fmt.Printf("%s\n", adminRequest("GET", p, nil, http.StatusOK))
+	},
+}
+
+func usageInit() {
+	usageCmd.Flags().StringVar(&usageKind, "kind", "", "rank devices by the bytes of one kind of message: logs, info, metrics, requests or apps")
+	usageCmd.Flags().IntVar(&usageLimit, "limit", 0, "report only that many devices, 0 for all")
+}
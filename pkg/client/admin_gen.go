@@ -0,0 +1,1078 @@
+// Code generated by go run ./gen; DO NOT EDIT.
+
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/adam/pkg/server"
+	"github.com/lf-edge/eve/api/go/config"
+)
+
+// OpenAPI get the OpenAPI document of the admin API (GET /admin/openapi.json)
+func (c *Client) OpenAPI(ctx context.Context) (map[string]interface{}, error) {
+	var out map[string]interface{}
+	err := c.do(ctx, http.MethodGet, "/admin/openapi.json", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// OnboardList list the common names of all onboarding certificates, one per line (GET /admin/onboard)
+func (c *Client) OnboardList(ctx context.Context) ([]byte, error) {
+	return c.doBytes(ctx, http.MethodGet, "/admin/onboard", nil, nil, nil, "")
+}
+
+// OnboardGet get a specific onboarding certificate (GET /admin/onboard/{cn})
+func (c *Client) OnboardGet(ctx context.Context, cn string) (*server.OnboardCert, error) {
+	out := new(server.OnboardCert)
+	if err := c.do(ctx, http.MethodGet, "/admin/onboard/"+url.PathEscape(cn), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OnboardAdd upload a new onboarding certificate (POST /admin/onboard)
+func (c *Client) OnboardAdd(ctx context.Context, body *server.OnboardCert) error {
+	return c.do(ctx, http.MethodPost, "/admin/onboard", nil, nil, body, "application/json", nil)
+}
+
+// OnboardGenerate generate a new onboarding certificate and key, and register it (POST /admin/onboard/generate)
+func (c *Client) OnboardGenerate(ctx context.Context, body *server.OnboardGenerateRequest) (*server.OnboardBundle, error) {
+	out := new(server.OnboardBundle)
+	if err := c.do(ctx, http.MethodPost, "/admin/onboard/generate", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OnboardClear clear all onboarding certificates (DELETE /admin/onboard)
+func (c *Client) OnboardClear(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/admin/onboard", nil, nil, nil, "", nil)
+}
+
+// OnboardRemove delete a specific onboarding certificate (DELETE /admin/onboard/{cn})
+func (c *Client) OnboardRemove(ctx context.Context, cn string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/onboard/"+url.PathEscape(cn), nil, nil, nil, "", nil)
+}
+
+// OnboardPolicyGet get the soft serials and hardware models an onboarding certificate allows, the config snapshot its devices start with, and its limits (GET /admin/onboard/{cn}/policy)
+func (c *Client) OnboardPolicyGet(ctx context.Context, cn string) (*common.OnboardPolicy, error) {
+	out := new(common.OnboardPolicy)
+	if err := c.do(ctx, http.MethodGet, "/admin/onboard/"+url.PathEscape(cn)+"/policy", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OnboardPolicySet set the policy of an onboarding certificate (PUT /admin/onboard/{cn}/policy)
+func (c *Client) OnboardPolicySet(ctx context.Context, cn string, body *common.OnboardPolicy) error {
+	return c.do(ctx, http.MethodPut, "/admin/onboard/"+url.PathEscape(cn)+"/policy", nil, nil, body, "application/json", nil)
+}
+
+// OnboardPolicyRemove clear the policy of an onboarding certificate, allowing any soft serial and model (DELETE /admin/onboard/{cn}/policy)
+func (c *Client) OnboardPolicyRemove(ctx context.Context, cn string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/onboard/"+url.PathEscape(cn)+"/policy", nil, nil, nil, "", nil)
+}
+
+// OnboardUsage get how many of the serials of an onboarding certificate devices used, by which, and how many are left, with the usage of its limits (GET /admin/onboard/{cn}/usage)
+func (c *Client) OnboardUsage(ctx context.Context, cn string) (*common.OnboardUsage, error) {
+	out := new(common.OnboardUsage)
+	if err := c.do(ctx, http.MethodGet, "/admin/onboard/"+url.PathEscape(cn)+"/usage", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceList list the UUIDs of all devices, one per line, or with their metadata and identity as JSON with format=json, of those deleted softly, quarantined or with tags if asked for (GET /admin/device)
+func (c *Client) DeviceList(ctx context.Context, query url.Values) ([]byte, error) {
+	return c.doBytes(ctx, http.MethodGet, "/admin/device", query, nil, nil, "")
+}
+
+// DeviceGet get details of one device (GET /admin/device/{uuid})
+func (c *Client) DeviceGet(ctx context.Context, uuid string) (*server.DeviceCert, error) {
+	out := new(server.DeviceCert)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceConfigGet get config for one device, with its ETag, or the one served to it, with its hardware model merged in (GET /admin/device/{uuid}/config)
+func (c *Client) DeviceConfigGet(ctx context.Context, uuid string, query url.Values) (*config.EdgeDevConfig, error) {
+	out := new(config.EdgeDevConfig)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/config", query, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceConfigSet update config for one device, once validated unless forced, and only if its ETag matches an If-Match (PUT /admin/device/{uuid}/config)
+func (c *Client) DeviceConfigSet(ctx context.Context, uuid string, query url.Values, body *config.EdgeDevConfig) error {
+	return c.do(ctx, http.MethodPut, "/admin/device/"+url.PathEscape(uuid)+"/config", query, nil, body, "application/json", nil)
+}
+
+// DeviceConfigDrift compare the config of one device with the one it last acknowledged (GET /admin/device/{uuid}/config/drift)
+func (c *Client) DeviceConfigDrift(ctx context.Context, uuid string) (*server.ConfigDrift, error) {
+	out := new(server.ConfigDrift)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/config/drift", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceLogsGet get all known logs for one device, or stream all new logs, of one source or in a range if asked for (GET /admin/device/{uuid}/logs)
+func (c *Client) DeviceLogsGet(ctx context.Context, uuid string, query url.Values, follow bool) (io.ReadCloser, error) {
+	return c.doStream(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/logs", query, followHeader(follow), nil, "")
+}
+
+// DeviceLogSources count the known logs of one device by source (GET /admin/device/{uuid}/logs/sources)
+func (c *Client) DeviceLogSources(ctx context.Context, uuid string) (map[string]int64, error) {
+	var out map[string]int64
+	err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/logs/sources", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// DeviceInfoGet get all known info messages for one device, or those in a range, or stream all new info (GET /admin/device/{uuid}/info)
+func (c *Client) DeviceInfoGet(ctx context.Context, uuid string, query url.Values, follow bool) (io.ReadCloser, error) {
+	return c.doStream(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/info", query, followHeader(follow), nil, "")
+}
+
+// DeviceMetricsGet get all known metrics messages for one device, or those in a range, or stream all new metrics (GET /admin/device/{uuid}/metrics)
+func (c *Client) DeviceMetricsGet(ctx context.Context, uuid string, query url.Values, follow bool) (io.ReadCloser, error) {
+	return c.doStream(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/metrics", query, followHeader(follow), nil, "")
+}
+
+// DeviceMetricsExport export the metrics of one device in a time range as CSV, or Parquet if asked for, a column per metric (GET /admin/device/{uuid}/metrics/export)
+func (c *Client) DeviceMetricsExport(ctx context.Context, uuid string, query url.Values) (io.ReadCloser, error) {
+	return c.doStream(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/metrics/export", query, nil, nil, "")
+}
+
+// GrafanaHealth check that the Grafana JSON datasource answers (GET /admin/grafana)
+func (c *Client) GrafanaHealth(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/admin/grafana", nil, nil, nil, "", nil)
+}
+
+// GrafanaMetrics list the metrics the Grafana JSON datasource can query (POST /admin/grafana/metrics)
+func (c *Client) GrafanaMetrics(ctx context.Context) ([]server.GrafanaMetric, error) {
+	var out []server.GrafanaMetric
+	err := c.do(ctx, http.MethodPost, "/admin/grafana/metrics", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// GrafanaPayloadOptions list the devices a query of the Grafana JSON datasource can select (POST /admin/grafana/metric-payload-options)
+func (c *Client) GrafanaPayloadOptions(ctx context.Context, body *server.GrafanaOptionsRequest) ([]server.GrafanaOption, error) {
+	var out []server.GrafanaOption
+	err := c.do(ctx, http.MethodPost, "/admin/grafana/metric-payload-options", nil, nil, body, "application/json", &out)
+	return out, err
+}
+
+// GrafanaVariable list the devices, or those with tags, as the values of a Grafana variable (POST /admin/grafana/variable)
+func (c *Client) GrafanaVariable(ctx context.Context, body *server.GrafanaVariableRequest) ([]server.GrafanaVariable, error) {
+	var out []server.GrafanaVariable
+	err := c.do(ctx, http.MethodPost, "/admin/grafana/variable", nil, nil, body, "application/json", &out)
+	return out, err
+}
+
+// GrafanaQuery get the series of metrics of devices in a time range, as the Grafana JSON datasource queries them (POST /admin/grafana/query)
+func (c *Client) GrafanaQuery(ctx context.Context, body *server.GrafanaQuery) ([]server.GrafanaSeries, error) {
+	var out []server.GrafanaSeries
+	err := c.do(ctx, http.MethodPost, "/admin/grafana/query", nil, nil, body, "application/json", &out)
+	return out, err
+}
+
+// DeviceGroupRead read new entries of one device stream as a member of a consumer group (GET /admin/device/{uuid}/{kind}/group/{group})
+func (c *Client) DeviceGroupRead(ctx context.Context, uuid string, kind string, group string, query url.Values) ([]common.StreamEntry, error) {
+	var out []common.StreamEntry
+	err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/"+url.PathEscape(kind)+"/group/"+url.PathEscape(group), query, nil, nil, "", &out)
+	return out, err
+}
+
+// DeviceGroupAck acknowledge entries read from a consumer group, by their IDs (POST /admin/device/{uuid}/{kind}/group/{group}/ack)
+func (c *Client) DeviceGroupAck(ctx context.Context, uuid string, kind string, group string, query url.Values, body []string) error {
+	return c.do(ctx, http.MethodPost, "/admin/device/"+url.PathEscape(uuid)+"/"+url.PathEscape(kind)+"/group/"+url.PathEscape(group)+"/ack", query, nil, body, "application/json", nil)
+}
+
+// DeviceInventoryGet get the current state of one device, from its info messages (GET /admin/device/{uuid}/inventory)
+func (c *Client) DeviceInventoryGet(ctx context.Context, uuid string) (*common.Inventory, error) {
+	out := new(common.Inventory)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/inventory", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// InventorySearch find the devices whose inventory matches conditions, with the values matched (GET /admin/inventory)
+func (c *Client) InventorySearch(ctx context.Context, query url.Values) ([]server.InventoryMatch, error) {
+	var out []server.InventoryMatch
+	err := c.do(ctx, http.MethodGet, "/admin/inventory", query, nil, nil, "", &out)
+	return out, err
+}
+
+// DeviceTwinGet get the config of one device and the state it last reported as one document, with whether each section is in sync (GET /admin/device/{uuid}/twin)
+func (c *Client) DeviceTwinGet(ctx context.Context, uuid string) (*common.Twin, error) {
+	out := new(common.Twin)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/twin", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceRequestsGet get all known requests of one device, or stream all new requests (GET /admin/device/{uuid}/requests)
+func (c *Client) DeviceRequestsGet(ctx context.Context, uuid string, follow bool) (io.ReadCloser, error) {
+	return c.doStream(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/requests", nil, followHeader(follow), nil, "")
+}
+
+// DeviceQuotasGet get the quotas set for one device, and those that apply to it (GET /admin/device/{uuid}/quotas)
+func (c *Client) DeviceQuotasGet(ctx context.Context, uuid string) (*server.DeviceQuotas, error) {
+	out := new(server.DeviceQuotas)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/quotas", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceQuotasSet set the quotas of one device, overriding the global ones (PUT /admin/device/{uuid}/quotas)
+func (c *Client) DeviceQuotasSet(ctx context.Context, uuid string, body *common.Quotas) error {
+	return c.do(ctx, http.MethodPut, "/admin/device/"+url.PathEscape(uuid)+"/quotas", nil, nil, body, "application/json", nil)
+}
+
+// DeviceQuotasRemove clear the quotas of one device, so the global ones apply (DELETE /admin/device/{uuid}/quotas)
+func (c *Client) DeviceQuotasRemove(ctx context.Context, uuid string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/device/"+url.PathEscape(uuid)+"/quotas", nil, nil, nil, "", nil)
+}
+
+// DeviceLogFilterGet get the log filter of one device, with the entries it dropped (GET /admin/device/{uuid}/logfilter)
+func (c *Client) DeviceLogFilterGet(ctx context.Context, uuid string) (*server.DeviceLogFilter, error) {
+	out := new(server.DeviceLogFilter)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/logfilter", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceLogFilterSet set the log filter of one device, overriding the global one (PUT /admin/device/{uuid}/logfilter)
+func (c *Client) DeviceLogFilterSet(ctx context.Context, uuid string, body *common.LogFilter) error {
+	return c.do(ctx, http.MethodPut, "/admin/device/"+url.PathEscape(uuid)+"/logfilter", nil, nil, body, "application/json", nil)
+}
+
+// DeviceLogFilterRemove clear the log filter of one device, so the global one applies (DELETE /admin/device/{uuid}/logfilter)
+func (c *Client) DeviceLogFilterRemove(ctx context.Context, uuid string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/device/"+url.PathEscape(uuid)+"/logfilter", nil, nil, nil, "", nil)
+}
+
+// DeviceLocalProfileGet get the local profile server state of one device (GET /admin/device/{uuid}/localprofile)
+func (c *Client) DeviceLocalProfileGet(ctx context.Context, uuid string) (*common.LocalProfile, error) {
+	out := new(common.LocalProfile)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/localprofile", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceLocalProfileSet set the local profile server state of one device (PUT /admin/device/{uuid}/localprofile)
+func (c *Client) DeviceLocalProfileSet(ctx context.Context, uuid string, body *common.LocalProfile) error {
+	return c.do(ctx, http.MethodPut, "/admin/device/"+url.PathEscape(uuid)+"/localprofile", nil, nil, body, "application/json", nil)
+}
+
+// DeviceLocalProfileRemove clear the local profile server state of one device, so adam no longer serves it (DELETE /admin/device/{uuid}/localprofile)
+func (c *Client) DeviceLocalProfileRemove(ctx context.Context, uuid string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/device/"+url.PathEscape(uuid)+"/localprofile", nil, nil, nil, "", nil)
+}
+
+// DeviceMetadataGet get the name, site, owner and tags of one device, with its identity from its device info (GET /admin/device/{uuid}/metadata)
+func (c *Client) DeviceMetadataGet(ctx context.Context, uuid string) (*common.DeviceMetadata, error) {
+	out := new(common.DeviceMetadata)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/metadata", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceMetadataSet set the name, site, owner and tags of one device, replacing those recorded but its identity (PUT /admin/device/{uuid}/metadata)
+func (c *Client) DeviceMetadataSet(ctx context.Context, uuid string, body *common.DeviceMetadata) error {
+	return c.do(ctx, http.MethodPut, "/admin/device/"+url.PathEscape(uuid)+"/metadata", nil, nil, body, "application/json", nil)
+}
+
+// DeviceMetadataRemove clear the name, site, owner and tags of one device (DELETE /admin/device/{uuid}/metadata)
+func (c *Client) DeviceMetadataRemove(ctx context.Context, uuid string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/device/"+url.PathEscape(uuid)+"/metadata", nil, nil, nil, "", nil)
+}
+
+// DeviceModelGet get the hardware model of one device (GET /admin/device/{uuid}/hardware-model)
+func (c *Client) DeviceModelGet(ctx context.Context, uuid string) (*server.DeviceModel, error) {
+	out := new(server.DeviceModel)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/hardware-model", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceModelSet set the hardware model of one device, from the catalog (PUT /admin/device/{uuid}/hardware-model)
+func (c *Client) DeviceModelSet(ctx context.Context, uuid string, body *server.DeviceModel) error {
+	return c.do(ctx, http.MethodPut, "/admin/device/"+url.PathEscape(uuid)+"/hardware-model", nil, nil, body, "application/json", nil)
+}
+
+// DeviceModelRemove clear the hardware model of one device, so it is served its config alone (DELETE /admin/device/{uuid}/hardware-model)
+func (c *Client) DeviceModelRemove(ctx context.Context, uuid string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/device/"+url.PathEscape(uuid)+"/hardware-model", nil, nil, nil, "", nil)
+}
+
+// DeviceFlagsGet get the flags set on one device, with the config it is held at (GET /admin/device/{uuid}/flags)
+func (c *Client) DeviceFlagsGet(ctx context.Context, uuid string) (*common.DeviceFlags, error) {
+	out := new(common.DeviceFlags)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/flags", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceFlagSet set a flag on one device: hold-config, read-only or verbose-debug (PUT /admin/device/{uuid}/flags/{flag})
+func (c *Client) DeviceFlagSet(ctx context.Context, uuid string, flag string) (*common.DeviceFlags, error) {
+	out := new(common.DeviceFlags)
+	if err := c.do(ctx, http.MethodPut, "/admin/device/"+url.PathEscape(uuid)+"/flags/"+url.PathEscape(flag), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceFlagRemove clear a flag of one device (DELETE /admin/device/{uuid}/flags/{flag})
+func (c *Client) DeviceFlagRemove(ctx context.Context, uuid string, flag string) (*common.DeviceFlags, error) {
+	out := new(common.DeviceFlags)
+	if err := c.do(ctx, http.MethodDelete, "/admin/device/"+url.PathEscape(uuid)+"/flags/"+url.PathEscape(flag), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceQuarantineGet get whether one device is quarantined, with the reason (GET /admin/device/{uuid}/quarantine)
+func (c *Client) DeviceQuarantineGet(ctx context.Context, uuid string) (*server.DeviceQuarantine, error) {
+	out := new(server.DeviceQuarantine)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/quarantine", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceQuarantineSet quarantine one device, serving it a minimal config until released, or change the reason (PUT /admin/device/{uuid}/quarantine)
+func (c *Client) DeviceQuarantineSet(ctx context.Context, uuid string, body *server.QuarantineRequest) (*server.DeviceQuarantine, error) {
+	out := new(server.DeviceQuarantine)
+	if err := c.do(ctx, http.MethodPut, "/admin/device/"+url.PathEscape(uuid)+"/quarantine", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceQuarantineRemove release one device from quarantine, so it is served its own config again (DELETE /admin/device/{uuid}/quarantine)
+func (c *Client) DeviceQuarantineRemove(ctx context.Context, uuid string) (*server.DeviceQuarantine, error) {
+	out := new(server.DeviceQuarantine)
+	if err := c.do(ctx, http.MethodDelete, "/admin/device/"+url.PathEscape(uuid)+"/quarantine", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceAttestationGet get the attestation of one device, with its certificates and the digests of the keys it escrowed (GET /admin/device/{uuid}/attestation)
+func (c *Client) DeviceAttestationGet(ctx context.Context, uuid string) (*server.DeviceAttestation, error) {
+	out := new(server.DeviceAttestation)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/attestation", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceAttestationRemove reset the attestation of one device, removing its certificates and the keys it escrowed (DELETE /admin/device/{uuid}/attestation)
+func (c *Client) DeviceAttestationRemove(ctx context.Context, uuid string) (*server.DeviceAttestation, error) {
+	out := new(server.DeviceAttestation)
+	if err := c.do(ctx, http.MethodDelete, "/admin/device/"+url.PathEscape(uuid)+"/attestation", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AppCommandList list the commands to the app instances of one device (GET /admin/device/{uuid}/app-command)
+func (c *Client) AppCommandList(ctx context.Context, uuid string) ([]common.AppCommand, error) {
+	var out []common.AppCommand
+	err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/app-command", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// AppCommandAdd queue a restart or purge of an app instance of one device, returning the command (POST /admin/device/{uuid}/app-command)
+func (c *Client) AppCommandAdd(ctx context.Context, uuid string, body *server.AppCommandRequest) (*common.AppCommand, error) {
+	out := new(common.AppCommand)
+	if err := c.do(ctx, http.MethodPost, "/admin/device/"+url.PathEscape(uuid)+"/app-command", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AppCommandGet get one command to an app instance of one device (GET /admin/device/{uuid}/app-command/{id})
+func (c *Client) AppCommandGet(ctx context.Context, uuid string, id string) (*common.AppCommand, error) {
+	out := new(common.AppCommand)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/app-command/"+url.PathEscape(id), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AppCommandRemove remove a queued or finished command to an app instance of one device (DELETE /admin/device/{uuid}/app-command/{id})
+func (c *Client) AppCommandRemove(ctx context.Context, uuid string, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/device/"+url.PathEscape(uuid)+"/app-command/"+url.PathEscape(id), nil, nil, nil, "", nil)
+}
+
+// DeviceRebootGet get the status of the reboot of one device, with a confirmation token (GET /admin/device/{uuid}/reboot)
+func (c *Client) DeviceRebootGet(ctx context.Context, uuid string) (*server.RebootStatus, error) {
+	out := new(server.RebootStatus)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/reboot", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceReboot reboot one device, returning the status of the reboot (POST /admin/device/{uuid}/reboot)
+func (c *Client) DeviceReboot(ctx context.Context, uuid string, body *server.RebootRequest) (*server.RebootStatus, error) {
+	out := new(server.RebootStatus)
+	if err := c.do(ctx, http.MethodPost, "/admin/device/"+url.PathEscape(uuid)+"/reboot", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceBaseOSGet get the status of the EVE update of one device, with a confirmation token (GET /admin/device/{uuid}/baseos)
+func (c *Client) DeviceBaseOSGet(ctx context.Context, uuid string) (*server.BaseOSStatus, error) {
+	out := new(server.BaseOSStatus)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/baseos", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceBaseOS update the EVE version of one device, returning the status of the update (POST /admin/device/{uuid}/baseos)
+func (c *Client) DeviceBaseOS(ctx context.Context, uuid string, body *server.BaseOSRequest) (*server.BaseOSStatus, error) {
+	out := new(server.BaseOSStatus)
+	if err := c.do(ctx, http.MethodPost, "/admin/device/"+url.PathEscape(uuid)+"/baseos", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceUsageGet get the storage used by each kind of message of one device (GET /admin/device/{uuid}/usage)
+func (c *Client) DeviceUsageGet(ctx context.Context, uuid string) (*common.DeviceUsage, error) {
+	out := new(common.DeviceUsage)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/usage", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceStatsGet get the requests of one device since the server started (GET /admin/device/{uuid}/stats)
+func (c *Client) DeviceStatsGet(ctx context.Context, uuid string) (*server.DeviceStats, error) {
+	out := new(server.DeviceStats)
+	if err := c.do(ctx, http.MethodGet, "/admin/device/"+url.PathEscape(uuid)+"/stats", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceReplay start replaying the stored messages of a device to a sink, returning the replay (POST /admin/device/{uuid}/replay)
+func (c *Client) DeviceReplay(ctx context.Context, uuid string, body *server.ReplayRequest) (*server.Replay, error) {
+	out := new(server.Replay)
+	if err := c.do(ctx, http.MethodPost, "/admin/device/"+url.PathEscape(uuid)+"/replay", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceAdd create a new device (POST /admin/device)
+func (c *Client) DeviceAdd(ctx context.Context, body *server.DeviceCert) error {
+	return c.do(ctx, http.MethodPost, "/admin/device", nil, nil, body, "text/plain", nil)
+}
+
+// DeviceClear delete all devices (DELETE /admin/device)
+func (c *Client) DeviceClear(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/admin/device", nil, nil, nil, "", nil)
+}
+
+// DeviceRemove delete one specific device, or delete it softly, with a retention in seconds other than the default (DELETE /admin/device/{uuid})
+func (c *Client) DeviceRemove(ctx context.Context, uuid string, query url.Values) error {
+	return c.do(ctx, http.MethodDelete, "/admin/device/"+url.PathEscape(uuid), query, nil, nil, "", nil)
+}
+
+// DeviceRestore restore one device deleted softly (POST /admin/device/{uuid}/restore)
+func (c *Client) DeviceRestore(ctx context.Context, uuid string) error {
+	return c.do(ctx, http.MethodPost, "/admin/device/"+url.PathEscape(uuid)+"/restore", nil, nil, nil, "", nil)
+}
+
+// RevocationList list revoked device and onboarding certificates (GET /admin/revocation)
+func (c *Client) RevocationList(ctx context.Context) ([]*common.Revocation, error) {
+	var out []*common.Revocation
+	err := c.do(ctx, http.MethodGet, "/admin/revocation", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// RevocationCRL get a CRL of the revoked certificates issued by the device CA (GET /admin/revocation/crl)
+func (c *Client) RevocationCRL(ctx context.Context) ([]byte, error) {
+	return c.doBytes(ctx, http.MethodGet, "/admin/revocation/crl", nil, nil, nil, "")
+}
+
+// RevocationGet get the revocation of one certificate (GET /admin/revocation/{fingerprint})
+func (c *Client) RevocationGet(ctx context.Context, fingerprint string) (*common.Revocation, error) {
+	out := new(common.Revocation)
+	if err := c.do(ctx, http.MethodGet, "/admin/revocation/"+url.PathEscape(fingerprint), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RevocationAdd revoke a certificate (POST /admin/revocation)
+func (c *Client) RevocationAdd(ctx context.Context, body *server.RevocationRequest) (*common.Revocation, error) {
+	out := new(common.Revocation)
+	if err := c.do(ctx, http.MethodPost, "/admin/revocation", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RevocationRemove remove the revocation of a certificate, so that it is accepted again (DELETE /admin/revocation/{fingerprint})
+func (c *Client) RevocationRemove(ctx context.Context, fingerprint string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/revocation/"+url.PathEscape(fingerprint), nil, nil, nil, "", nil)
+}
+
+// PendingList list devices waiting for approval to onboard (GET /admin/pending)
+func (c *Client) PendingList(ctx context.Context) ([]*common.PendingDevice, error) {
+	var out []*common.PendingDevice
+	err := c.do(ctx, http.MethodGet, "/admin/pending", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// PendingGet get one device waiting for approval (GET /admin/pending/{id})
+func (c *Client) PendingGet(ctx context.Context, id string) (*common.PendingDevice, error) {
+	out := new(common.PendingDevice)
+	if err := c.do(ctx, http.MethodGet, "/admin/pending/"+url.PathEscape(id), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PendingApprove approve and register one waiting device, returning its new UUID (POST /admin/pending/{id}/approve)
+func (c *Client) PendingApprove(ctx context.Context, id string) ([]byte, error) {
+	return c.doBytes(ctx, http.MethodPost, "/admin/pending/"+url.PathEscape(id)+"/approve", nil, nil, nil, "")
+}
+
+// PendingReject reject one waiting device (DELETE /admin/pending/{id})
+func (c *Client) PendingReject(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/pending/"+url.PathEscape(id), nil, nil, nil, "", nil)
+}
+
+// AuditGet get the audit log of admin actions, of an action, actor or target, or between two times in RFC 3339 (GET /admin/audit)
+func (c *Client) AuditGet(ctx context.Context, query url.Values) (io.ReadCloser, error) {
+	return c.doStream(ctx, http.MethodGet, "/admin/audit", query, nil, nil, "")
+}
+
+// UsageList get the storage used by every device, those using the most first (GET /admin/usage)
+func (c *Client) UsageList(ctx context.Context, query url.Values) ([]*common.DeviceUsage, error) {
+	var out []*common.DeviceUsage
+	err := c.do(ctx, http.MethodGet, "/admin/usage", query, nil, nil, "", &out)
+	return out, err
+}
+
+// StatsList get the requests of every device and to every endpoint of the device API since the server started (GET /admin/stats)
+func (c *Client) StatsList(ctx context.Context) (*server.Stats, error) {
+	out := new(server.Stats)
+	if err := c.do(ctx, http.MethodGet, "/admin/stats", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GcGet list data left behind without a matching device or onboarding certificate (GET /admin/gc)
+func (c *Client) GcGet(ctx context.Context) ([]common.Orphan, error) {
+	var out []common.Orphan
+	err := c.do(ctx, http.MethodGet, "/admin/gc", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// GcRun remove data left behind without a matching device or onboarding certificate (POST /admin/gc)
+func (c *Client) GcRun(ctx context.Context) ([]common.Orphan, error) {
+	var out []common.Orphan
+	err := c.do(ctx, http.MethodPost, "/admin/gc", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// ArchiveRun archive the entries of device streams older than the archive-after of the database URL now (POST /admin/archive)
+func (c *Client) ArchiveRun(ctx context.Context) ([]common.Archived, error) {
+	var out []common.Archived
+	err := c.do(ctx, http.MethodPost, "/admin/archive", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// TokenList list admin API tokens, without their secrets (GET /admin/token)
+func (c *Client) TokenList(ctx context.Context) ([]*common.APIToken, error) {
+	var out []*common.APIToken
+	err := c.do(ctx, http.MethodGet, "/admin/token", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// TokenAdd create an admin API token, returning it (POST /admin/token)
+func (c *Client) TokenAdd(ctx context.Context, body *server.TokenRequest) (*server.TokenResponse, error) {
+	out := new(server.TokenResponse)
+	if err := c.do(ctx, http.MethodPost, "/admin/token", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TokenRemove remove an admin API token (DELETE /admin/token/{id})
+func (c *Client) TokenRemove(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/token/"+url.PathEscape(id), nil, nil, nil, "", nil)
+}
+
+// RolloutList list config rollouts, with their progress (GET /admin/rollout)
+func (c *Client) RolloutList(ctx context.Context) ([]*common.Rollout, error) {
+	var out []*common.Rollout
+	err := c.do(ctx, http.MethodGet, "/admin/rollout", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// RolloutCreate create a config rollout, applying its first wave (POST /admin/rollout)
+func (c *Client) RolloutCreate(ctx context.Context, body *server.RolloutRequest) (*common.Rollout, error) {
+	out := new(common.Rollout)
+	if err := c.do(ctx, http.MethodPost, "/admin/rollout", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RolloutGet get one config rollout, with the progress on each device (GET /admin/rollout/{id})
+func (c *Client) RolloutGet(ctx context.Context, id string) (*common.Rollout, error) {
+	out := new(common.Rollout)
+	if err := c.do(ctx, http.MethodGet, "/admin/rollout/"+url.PathEscape(id), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RolloutPause pause a running config rollout (POST /admin/rollout/{id}/pause)
+func (c *Client) RolloutPause(ctx context.Context, id string) (*common.Rollout, error) {
+	out := new(common.Rollout)
+	if err := c.do(ctx, http.MethodPost, "/admin/rollout/"+url.PathEscape(id)+"/pause", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RolloutResume resume a paused config rollout (POST /admin/rollout/{id}/resume)
+func (c *Client) RolloutResume(ctx context.Context, id string) (*common.Rollout, error) {
+	out := new(common.Rollout)
+	if err := c.do(ctx, http.MethodPost, "/admin/rollout/"+url.PathEscape(id)+"/resume", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RolloutRemove remove a config rollout, stopping it (DELETE /admin/rollout/{id})
+func (c *Client) RolloutRemove(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/rollout/"+url.PathEscape(id), nil, nil, nil, "", nil)
+}
+
+// CanaryList list config canaries, with their state (GET /admin/canary)
+func (c *Client) CanaryList(ctx context.Context) ([]*common.Canary, error) {
+	var out []*common.Canary
+	err := c.do(ctx, http.MethodGet, "/admin/canary", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// CanaryCreate create a config canary, applying its change to the canary devices (POST /admin/canary)
+func (c *Client) CanaryCreate(ctx context.Context, body *server.CanaryRequest) (*common.Canary, error) {
+	out := new(common.Canary)
+	if err := c.do(ctx, http.MethodPost, "/admin/canary", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CanaryGet get one config canary, with the state of each canary device (GET /admin/canary/{id})
+func (c *Client) CanaryGet(ctx context.Context, id string) (*common.Canary, error) {
+	out := new(common.Canary)
+	if err := c.do(ctx, http.MethodGet, "/admin/canary/"+url.PathEscape(id), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CanaryRevert revert a config canary, setting the previous config back on its devices (POST /admin/canary/{id}/revert)
+func (c *Client) CanaryRevert(ctx context.Context, id string) (*common.Canary, error) {
+	out := new(common.Canary)
+	if err := c.do(ctx, http.MethodPost, "/admin/canary/"+url.PathEscape(id)+"/revert", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CanaryPromote roll the change of a config canary that passed out to devices, as a config rollout, returning the rollout (POST /admin/canary/{id}/promote)
+func (c *Client) CanaryPromote(ctx context.Context, id string, body *server.RolloutRequest) (*common.Rollout, error) {
+	out := new(common.Rollout)
+	if err := c.do(ctx, http.MethodPost, "/admin/canary/"+url.PathEscape(id)+"/promote", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CanaryRemove remove a config canary (DELETE /admin/canary/{id})
+func (c *Client) CanaryRemove(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/canary/"+url.PathEscape(id), nil, nil, nil, "", nil)
+}
+
+// ScheduleList list pending scheduled config changes, or all of them (GET /admin/schedule)
+func (c *Client) ScheduleList(ctx context.Context, query url.Values) ([]*common.ScheduledChange, error) {
+	var out []*common.ScheduledChange
+	err := c.do(ctx, http.MethodGet, "/admin/schedule", query, nil, nil, "", &out)
+	return out, err
+}
+
+// ScheduleAdd schedule a config change, returning it (POST /admin/schedule)
+func (c *Client) ScheduleAdd(ctx context.Context, body *server.ScheduleRequest) (*common.ScheduledChange, error) {
+	out := new(common.ScheduledChange)
+	if err := c.do(ctx, http.MethodPost, "/admin/schedule", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ScheduleGet get one scheduled config change, with the outcome on each device once applied (GET /admin/schedule/{id})
+func (c *Client) ScheduleGet(ctx context.Context, id string) (*common.ScheduledChange, error) {
+	out := new(common.ScheduledChange)
+	if err := c.do(ctx, http.MethodGet, "/admin/schedule/"+url.PathEscape(id), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ScheduleRemove remove a scheduled config change, cancelling it if pending (DELETE /admin/schedule/{id})
+func (c *Client) ScheduleRemove(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/schedule/"+url.PathEscape(id), nil, nil, nil, "", nil)
+}
+
+// AlertList list firing alerts (GET /admin/alert)
+func (c *Client) AlertList(ctx context.Context) ([]server.Alert, error) {
+	var out []server.Alert
+	err := c.do(ctx, http.MethodGet, "/admin/alert", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// AlertRuleList list alert rules (GET /admin/alert/rule)
+func (c *Client) AlertRuleList(ctx context.Context) ([]*common.AlertRule, error) {
+	var out []*common.AlertRule
+	err := c.do(ctx, http.MethodGet, "/admin/alert/rule", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// AlertRuleAdd add an alert rule, returning it (POST /admin/alert/rule)
+func (c *Client) AlertRuleAdd(ctx context.Context, body *common.AlertRule) (*common.AlertRule, error) {
+	out := new(common.AlertRule)
+	if err := c.do(ctx, http.MethodPost, "/admin/alert/rule", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AlertRuleGet get one alert rule (GET /admin/alert/rule/{id})
+func (c *Client) AlertRuleGet(ctx context.Context, id string) (*common.AlertRule, error) {
+	out := new(common.AlertRule)
+	if err := c.do(ctx, http.MethodGet, "/admin/alert/rule/"+url.PathEscape(id), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AlertRuleRemove remove an alert rule (DELETE /admin/alert/rule/{id})
+func (c *Client) AlertRuleRemove(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/alert/rule/"+url.PathEscape(id), nil, nil, nil, "", nil)
+}
+
+// SnapshotList list config snapshots (GET /admin/snapshot)
+func (c *Client) SnapshotList(ctx context.Context) ([]*common.ConfigSnapshot, error) {
+	var out []*common.ConfigSnapshot
+	err := c.do(ctx, http.MethodGet, "/admin/snapshot", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// SnapshotCapture capture the config of a device as a snapshot, returning it (POST /admin/snapshot)
+func (c *Client) SnapshotCapture(ctx context.Context, body *server.SnapshotRequest) (*common.ConfigSnapshot, error) {
+	out := new(common.ConfigSnapshot)
+	if err := c.do(ctx, http.MethodPost, "/admin/snapshot", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SnapshotGet get one config snapshot (GET /admin/snapshot/{name})
+func (c *Client) SnapshotGet(ctx context.Context, name string) (*common.ConfigSnapshot, error) {
+	out := new(common.ConfigSnapshot)
+	if err := c.do(ctx, http.MethodGet, "/admin/snapshot/"+url.PathEscape(name), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SnapshotApply apply a config snapshot to devices, as a config rollout, returning the rollout (POST /admin/snapshot/{name}/apply)
+func (c *Client) SnapshotApply(ctx context.Context, name string, body *server.RolloutRequest) (*common.Rollout, error) {
+	out := new(common.Rollout)
+	if err := c.do(ctx, http.MethodPost, "/admin/snapshot/"+url.PathEscape(name)+"/apply", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SnapshotRemove remove a config snapshot (DELETE /admin/snapshot/{name})
+func (c *Client) SnapshotRemove(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/snapshot/"+url.PathEscape(name), nil, nil, nil, "", nil)
+}
+
+// HardwareModelList list the catalog of hardware models (GET /admin/hardware-model)
+func (c *Client) HardwareModelList(ctx context.Context) ([]*common.HardwareModel, error) {
+	var out []*common.HardwareModel
+	err := c.do(ctx, http.MethodGet, "/admin/hardware-model", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// HardwareModelGet get one hardware model (GET /admin/hardware-model/{name})
+func (c *Client) HardwareModelGet(ctx context.Context, name string) (*common.HardwareModel, error) {
+	out := new(common.HardwareModel)
+	if err := c.do(ctx, http.MethodGet, "/admin/hardware-model/"+url.PathEscape(name), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// HardwareModelSet add a hardware model, or replace the one of the same name, returning it (PUT /admin/hardware-model/{name})
+func (c *Client) HardwareModelSet(ctx context.Context, name string, body *server.HardwareModelRequest) (*common.HardwareModel, error) {
+	out := new(common.HardwareModel)
+	if err := c.do(ctx, http.MethodPut, "/admin/hardware-model/"+url.PathEscape(name), nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// HardwareModelRemove remove a hardware model no device has (DELETE /admin/hardware-model/{name})
+func (c *Client) HardwareModelRemove(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/hardware-model/"+url.PathEscape(name), nil, nil, nil, "", nil)
+}
+
+// DatastoreList list the datastores of the catalog (GET /admin/datastore)
+func (c *Client) DatastoreList(ctx context.Context) ([]*common.Datastore, error) {
+	var out []*common.Datastore
+	err := c.do(ctx, http.MethodGet, "/admin/datastore", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// DatastoreGet get one datastore (GET /admin/datastore/{name})
+func (c *Client) DatastoreGet(ctx context.Context, name string) (*common.Datastore, error) {
+	out := new(common.Datastore)
+	if err := c.do(ctx, http.MethodGet, "/admin/datastore/"+url.PathEscape(name), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DatastoreSet add a datastore, or replace the one of the same name keeping its UUID, returning it (PUT /admin/datastore/{name})
+func (c *Client) DatastoreSet(ctx context.Context, name string, body *server.DatastoreRequest) (*common.Datastore, error) {
+	out := new(common.Datastore)
+	if err := c.do(ctx, http.MethodPut, "/admin/datastore/"+url.PathEscape(name), nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DatastoreRemove remove a datastore no image is in (DELETE /admin/datastore/{name})
+func (c *Client) DatastoreRemove(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/datastore/"+url.PathEscape(name), nil, nil, nil, "", nil)
+}
+
+// ImageList list the images of the catalog (GET /admin/image)
+func (c *Client) ImageList(ctx context.Context) ([]*common.Image, error) {
+	var out []*common.Image
+	err := c.do(ctx, http.MethodGet, "/admin/image", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// ImageGet get one image (GET /admin/image/{name})
+func (c *Client) ImageGet(ctx context.Context, name string) (*common.Image, error) {
+	out := new(common.Image)
+	if err := c.do(ctx, http.MethodGet, "/admin/image/"+url.PathEscape(name), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ImageSet add an image, or replace the one of the same name keeping its UUID, returning it (PUT /admin/image/{name})
+func (c *Client) ImageSet(ctx context.Context, name string, body *server.ImageRequest) (*common.Image, error) {
+	out := new(common.Image)
+	if err := c.do(ctx, http.MethodPut, "/admin/image/"+url.PathEscape(name), nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ImageRemove remove an image (DELETE /admin/image/{name})
+func (c *Client) ImageRemove(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/image/"+url.PathEscape(name), nil, nil, nil, "", nil)
+}
+
+// ReplayList list the replays since the server started (GET /admin/replay)
+func (c *Client) ReplayList(ctx context.Context) ([]*server.Replay, error) {
+	var out []*server.Replay
+	err := c.do(ctx, http.MethodGet, "/admin/replay", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// ReplayGet get one replay, with how many messages it sent (GET /admin/replay/{id})
+func (c *Client) ReplayGet(ctx context.Context, id string) (*server.Replay, error) {
+	out := new(server.Replay)
+	if err := c.do(ctx, http.MethodGet, "/admin/replay/"+url.PathEscape(id), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReplayCancel cancel a running replay, or forget a finished one (DELETE /admin/replay/{id})
+func (c *Client) ReplayCancel(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/replay/"+url.PathEscape(id), nil, nil, nil, "", nil)
+}
+
+// DeadLetterList list the messages of devices that could not be parsed, without their payloads, of one device if asked for (GET /admin/dead-letter)
+func (c *Client) DeadLetterList(ctx context.Context, query url.Values) ([]*common.DeadLetter, error) {
+	var out []*common.DeadLetter
+	err := c.do(ctx, http.MethodGet, "/admin/dead-letter", query, nil, nil, "", &out)
+	return out, err
+}
+
+// DeadLetterGet get one dead letter, with its payload and certificate (GET /admin/dead-letter/{id})
+func (c *Client) DeadLetterGet(ctx context.Context, id string) (*common.DeadLetter, error) {
+	out := new(common.DeadLetter)
+	if err := c.do(ctx, http.MethodGet, "/admin/dead-letter/"+url.PathEscape(id), nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeadLetterReplay send a dead letter again to the endpoint it was sent to, removing it if it is stored this time (POST /admin/dead-letter/{id}/replay)
+func (c *Client) DeadLetterReplay(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/admin/dead-letter/"+url.PathEscape(id)+"/replay", nil, nil, nil, "", nil)
+}
+
+// DeadLetterRemove remove a dead letter (DELETE /admin/dead-letter/{id})
+func (c *Client) DeadLetterRemove(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/dead-letter/"+url.PathEscape(id), nil, nil, nil, "", nil)
+}
+
+// Metrics counters of the server in the Prometheus text format (GET /admin/metrics)
+func (c *Client) Metrics(ctx context.Context) ([]byte, error) {
+	return c.doBytes(ctx, http.MethodGet, "/admin/metrics", nil, nil, nil, "")
+}
+
+// LogLevelsGet get the log levels of the modules of the server (GET /admin/log-levels)
+func (c *Client) LogLevelsGet(ctx context.Context) (*server.LogLevels, error) {
+	out := new(server.LogLevels)
+	if err := c.do(ctx, http.MethodGet, "/admin/log-levels", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// LogLevelsSet change the log levels of the modules of the server, returning them (PUT /admin/log-levels)
+func (c *Client) LogLevelsSet(ctx context.Context, body *server.LogLevelsRequest) (*server.LogLevels, error) {
+	out := new(server.LogLevels)
+	if err := c.do(ctx, http.MethodPut, "/admin/log-levels", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BackpressureGet whether the backpressure config items are served to devices, with the load of ingest at the last check (GET /admin/backpressure)
+func (c *Client) BackpressureGet(ctx context.Context) (*server.BackpressureStatus, error) {
+	out := new(server.BackpressureStatus)
+	if err := c.do(ctx, http.MethodGet, "/admin/backpressure", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FaultList list the fault injection rules, with how many faults each injected (GET /admin/fault)
+func (c *Client) FaultList(ctx context.Context) ([]server.FaultRule, error) {
+	var out []server.FaultRule
+	err := c.do(ctx, http.MethodGet, "/admin/fault", nil, nil, nil, "", &out)
+	return out, err
+}
+
+// FaultAdd add a fault injection rule, returning it (POST /admin/fault)
+func (c *Client) FaultAdd(ctx context.Context, body *server.FaultRule) (*server.FaultRule, error) {
+	out := new(server.FaultRule)
+	if err := c.do(ctx, http.MethodPost, "/admin/fault", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FaultRemove remove a fault injection rule (DELETE /admin/fault/{id})
+func (c *Client) FaultRemove(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/fault/"+url.PathEscape(id), nil, nil, nil, "", nil)
+}
+
+// FederationSync get the onboarding certificates and devices, with the config each is served, for a secondary to sync (GET /admin/federation/sync)
+func (c *Client) FederationSync(ctx context.Context) (*server.FederationSync, error) {
+	out := new(server.FederationSync)
+	if err := c.do(ctx, http.MethodGet, "/admin/federation/sync", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FederationTelemetry store the telemetry of devices forwarded by a secondary (POST /admin/federation/telemetry)
+func (c *Client) FederationTelemetry(ctx context.Context, body *server.FederationTelemetry) (*server.FederationResult, error) {
+	out := new(server.FederationResult)
+	if err := c.do(ctx, http.MethodPost, "/admin/federation/telemetry", nil, nil, body, "application/json", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FederationStatus get the state of the sync of this secondary from its primary (GET /admin/federation)
+func (c *Client) FederationStatus(ctx context.Context) (*server.FederationStatus, error) {
+	out := new(server.FederationStatus)
+	if err := c.do(ctx, http.MethodGet, "/admin/federation", nil, nil, nil, "", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CertsExport export all onboarding and device certificates, with their serials, as a tar.gz (GET /admin/export/certs)
+func (c *Client) CertsExport(ctx context.Context) (io.ReadCloser, error) {
+	return c.doStream(ctx, http.MethodGet, "/admin/export/certs", nil, nil, nil, "")
+}
+
+// CertsImport import an export of onboarding and device certificates (POST /admin/import/certs)
+func (c *Client) CertsImport(ctx context.Context, body io.Reader) (*server.CertsImportResult, error) {
+	out := new(server.CertsImportResult)
+	if err := c.do(ctx, http.MethodPost, "/admin/import/certs", nil, nil, body, "application/gzip", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StateExport a snapshot of the whole state of the server as a tar.gz, with the telemetry of devices if asked for (GET /admin/export/state)
+func (c *Client) StateExport(ctx context.Context, query url.Values) (io.ReadCloser, error) {
+	return c.doStream(ctx, http.MethodGet, "/admin/export/state", query, nil, nil, "")
+}
+
+// StateImport restore a state snapshot, returning its manifest, replacing the state there is if asked for (POST /admin/import/state)
+func (c *Client) StateImport(ctx context.Context, query url.Values, body io.Reader) (*driver.StateManifest, error) {
+	out := new(driver.StateManifest)
+	if err := c.do(ctx, http.MethodPost, "/admin/import/state", query, nil, body, "application/gzip", out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package client a client of the admin API of Adam, whose methods, one per operation, are generated from the
+// operations the server describes in its OpenAPI document
+package client
+
+//go:generate go run ./gen -o admin_gen.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lf-edge/adam/pkg/server"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Client calls the admin API of an Adam server
+type Client struct {
+	// BaseURL the URL of the server, e.g. https://localhost:8080, without /admin
+	BaseURL string
+	// HTTPClient the client the requests are made with, to set the TLS config and the client certificate on
+	HTTPClient *http.Client
+	// Token an admin API token sent with each request, if set
+	Token string
+}
+
+// New a client of the server at a URL, with an http.Client, http.DefaultClient if nil
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: httpClient}
+}
+
+// Error an error answered by the server, of its ErrorResponse
+type Error struct {
+	// Status the HTTP status of the response
+	Status  int             `json:"-"`
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// request send a request, with a body as JSON, protobuf JSON for a proto.Message, or as it is for an io.Reader. An
+// *Error unless the server answered 2xx
+func (c *Client) request(ctx context.Context, method, path string, query url.Values, header http.Header, body interface{}, contentType string) (*http.Response, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		r = b
+	case proto.Message:
+		p, err := protojson.Marshal(b)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding request body: %v", err)
+		}
+		r = bytes.NewReader(p)
+	default:
+		p, err := json.Marshal(b)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding request body: %v", err)
+		}
+		r = bytes.NewReader(p)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %v", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if r != nil && contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling %s %s: %v", method, path, err)
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	e := &Error{Status: res.StatusCode}
+	if err := json.Unmarshal(b, e); err != nil || e.Code == "" {
+		e.Code, e.Message = http.StatusText(res.StatusCode), strings.TrimSpace(string(b))
+	}
+	return nil, e
+}
+
+// do send a request, decoding the body of the response into out, as protobuf JSON for a proto.Message, unless out
+// is nil
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, body interface{}, contentType string, out interface{}) error {
+	res, err := c.request(ctx, method, path, query, header, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		_, err := io.Copy(ioutil.Discard, res.Body)
+		return err
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %v", err)
+	}
+	if m, ok := out.(proto.Message); ok {
+		err = protojson.Unmarshal(b, m)
+	} else {
+		err = json.Unmarshal(b, out)
+	}
+	if err != nil {
+		return fmt.Errorf("error decoding response body: %v", err)
+	}
+	return nil
+}
+
+// doBytes send a request, returning the body of the response
+func (c *Client) doBytes(ctx context.Context, method, path string, query url.Values, header http.Header, body interface{}, contentType string) ([]byte, error) {
+	res, err := c.request(ctx, method, path, query, header, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+	return b, nil
+}
+
+// doStream send a request, returning the body of the response, for the caller to close
+func (c *Client) doStream(ctx context.Context, method, path string, query url.Values, header http.Header, body interface{}, contentType string) (io.ReadCloser, error) {
+	res, err := c.request(ctx, method, path, query, header, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// followHeader the header asking a stream to stay open for the new entries, if follow is set
+func followHeader(follow bool) http.Header {
+	if !follow {
+		return nil
+	}
+	return http.Header{server.StreamHeader: []string{server.StreamValue}}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// gen generates the methods of the admin API client, one per operation of server.AdminOperations
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/lf-edge/adam/pkg/server"
+)
+
+func main() {
+	out := flag.String("o", "admin_gen.go", "file to write the generated client to")
+	flag.Parse()
+	b, err := generate()
+	if err != nil {
+		log.Fatalf("error generating the admin API client: %v", err)
+	}
+	if err := ioutil.WriteFile(*out, b, 0644); err != nil {
+		log.Fatalf("error writing %s: %v", *out, err)
+	}
+}
+
+// generate the source of the methods of the client
+func generate() ([]byte, error) {
+	ops, err := server.AdminOperations()
+	if err != nil {
+		return nil, err
+	}
+	imports := map[string]string{
+		"context":  "context",
+		"net/http": "http",
+	}
+	var methods bytes.Buffer
+	for _, op := range ops {
+		method(&methods, op, imports)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by go run ./gen; DO NOT EDIT.\n\npackage client\n\nimport (\n")
+	// the standard library first, as goimports groups them
+	var std, others []string
+	for p := range imports {
+		if strings.Contains(strings.Split(p, "/")[0], ".") {
+			others = append(others, p)
+		} else {
+			std = append(std, p)
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(others)
+	for i, group := range [][]string{std, others} {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		for _, p := range group {
+			if path.Base(p) == imports[p] {
+				fmt.Fprintf(&b, "\t%q\n", p)
+			} else {
+				fmt.Fprintf(&b, "\t%s %q\n", imports[p], p)
+			}
+		}
+	}
+	b.WriteString(")\n")
+	b.Write(methods.Bytes())
+	return format.Source(b.Bytes())
+}
+
+// method write the method of the client calling an operation
+func method(b *bytes.Buffer, op server.AdminOperation, imports map[string]string) {
+	var (
+		args    = []string{"ctx context.Context"}
+		pathArg = fmt.Sprintf("%q", op.Path)
+		query   = "nil"
+		header  = "nil"
+		body    = "nil"
+		ctype   = `""`
+	)
+	for _, p := range op.Params {
+		args = append(args, p+" string")
+		pathArg = strings.Replace(pathArg, "{"+p+"}", `" + url.PathEscape(`+p+`) + "`, 1)
+		imports["net/url"] = "url"
+	}
+	pathArg = strings.TrimSuffix(pathArg, ` + ""`)
+	if len(op.Query) > 0 {
+		args = append(args, "query url.Values")
+		query = "query"
+		imports["net/url"] = "url"
+	}
+	if op.Follow {
+		args = append(args, "follow bool")
+		header = "followHeader(follow)"
+	}
+	switch {
+	case op.Request != nil:
+		args = append(args, "body "+typeExpr(reflect.TypeOf(op.Request), imports))
+		body = "body"
+		ctype = fmt.Sprintf("%q", "application/json")
+		if op.RequestType != "" {
+			ctype = fmt.Sprintf("%q", op.RequestType)
+		}
+	case op.RequestType != "":
+		args = append(args, "body io.Reader")
+		body = "body"
+		ctype = fmt.Sprintf("%q", op.RequestType)
+		imports["io"] = "io"
+	}
+	call := fmt.Sprintf("ctx, http.Method%s, %s, %s, %s, %s, %s", strings.Title(strings.ToLower(op.Method)), pathArg, query, header, body, ctype)
+
+	fmt.Fprintf(b, "\n// %s %s (%s %s)\n", strings.Title(op.ID), op.Summary, op.Method, op.Path)
+	name := strings.Title(op.ID)
+	signature := strings.Join(args, ", ")
+	switch {
+	case op.Stream:
+		imports["io"] = "io"
+		fmt.Fprintf(b, "func (c *Client) %s(%s) (io.ReadCloser, error) {\n\treturn c.doStream(%s)\n}\n", name, signature, call)
+	case op.Response != nil:
+		t := reflect.TypeOf(op.Response)
+		expr := typeExpr(t, imports)
+		if t.Kind() == reflect.Ptr {
+			fmt.Fprintf(b, "func (c *Client) %s(%s) (%s, error) {\n\tout := new(%s)\n\tif err := c.do(%s, out); err != nil {\n\t\treturn nil, err\n\t}\n\treturn out, nil\n}\n",
+				name, signature, expr, strings.TrimPrefix(expr, "*"), call)
+		} else {
+			fmt.Fprintf(b, "func (c *Client) %s(%s) (%s, error) {\n\tvar out %s\n\terr := c.do(%s, &out)\n\treturn out, err\n}\n",
+				name, signature, expr, expr, call)
+		}
+	case op.ResponseType != "":
+		fmt.Fprintf(b, "func (c *Client) %s(%s) ([]byte, error) {\n\treturn c.doBytes(%s)\n}\n", name, signature, call)
+	default:
+		fmt.Fprintf(b, "func (c *Client) %s(%s) error {\n\treturn c.do(%s, nil)\n}\n", name, signature, call)
+	}
+}
+
+// typeExpr the Go expression of a type, adding the packages it names to the imports
+func typeExpr(t reflect.Type, imports map[string]string) string {
+	addImports(t, imports)
+	return t.String()
+}
+
+func addImports(t reflect.Type, imports map[string]string) {
+	if t.Name() != "" && t.PkgPath() != "" {
+		imports[t.PkgPath()] = t.String()[:strings.Index(t.String(), ".")]
+		return
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		addImports(t.Elem(), imports)
+	case reflect.Map:
+		addImports(t.Key(), imports)
+		addImports(t.Elem(), imports)
+	}
+}
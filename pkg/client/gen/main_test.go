@@ -0,0 +1,26 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// TestGenerated the generated client is that of the operations of the server, so that a route added without
+// regenerating it fails
+func TestGenerated(t *testing.T) {
+	b, err := generate()
+	if err != nil {
+		t.Fatalf("error generating: %v", err)
+	}
+	current, err := ioutil.ReadFile("../admin_gen.go")
+	if err != nil {
+		t.Fatalf("error reading generated client: %v", err)
+	}
+	if !bytes.Equal(b, current) {
+		t.Errorf("admin_gen.go is out of date, run go generate ./pkg/client")
+	}
+}
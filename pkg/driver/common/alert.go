@@ -0,0 +1,236 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/info"
+	uuid "github.com/satori/go.uuid"
+)
+
+// kinds of alert actions
+const (
+	AlertLog     = "log"
+	AlertWebhook = "webhook"
+	AlertMQTT    = "mqtt"
+)
+
+// AlertRule a condition on the telemetry of devices, and where to send an alert when it starts and stops holding.
+// A rule is either on a metric, with Metric, Op and Value, or on the state of app instances, with AppState
+type AlertRule struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Devices UUIDs of devices the rule applies to
+	Devices []string `json:"devices,omitempty"`
+	// Serials patterns, as for path.Match, of the serials of devices the rule applies to. With Devices empty too, the
+	// rule applies to every device
+	Serials []string `json:"serials,omitempty"`
+	// Metric path to a number in the metrics of a device, as JSON, e.g. dm.cpuMetric.total. Where it goes through a
+	// list, the rule holds if it does for any element
+	Metric string `json:"metric,omitempty"`
+	// Op comparison of the metric with Value, one of >, >=, <, <=, == and !=
+	Op    string  `json:"op,omitempty"`
+	Value float64 `json:"value,omitempty"`
+	// AppState state of app instances, e.g. HALTED, the rule holds in
+	AppState string `json:"app-state,omitempty"`
+	// App pattern, as for path.Match, of the names of the app instances the rule applies to; all of them if empty
+	App     string        `json:"app,omitempty"`
+	Actions []AlertAction `json:"actions"`
+	Created time.Time     `json:"created"`
+}
+
+// AlertAction where to send an alert
+type AlertAction struct {
+	// Type one of log, webhook and mqtt
+	Type string `json:"type"`
+	// URL of the webhook, or of the MQTT broker, as mqtt://[user:password@]host[:port], or mqtts:// for TLS
+	URL string `json:"url,omitempty"`
+	// Topic MQTT topic to publish to
+	Topic string `json:"topic,omitempty"`
+}
+
+// Validate check that a rule is complete and consistent
+func (r *AlertRule) Validate() error {
+	switch {
+	case (r.Metric == "") == (r.AppState == ""):
+		return fmt.Errorf("a rule needs either a metric or an app state")
+	case r.Metric != "" && r.App != "":
+		return fmt.Errorf("an app pattern is only for app state rules")
+	case r.Metric != "" && !validAlertOp(r.Op):
+		return fmt.Errorf("invalid op %q, must be one of >, >=, <, <=, == and !=", r.Op)
+	case r.AppState != "":
+		if _, ok := info.ZSwState_value[r.AppState]; !ok {
+			return fmt.Errorf("unknown app state %s", r.AppState)
+		}
+	}
+	for _, d := range r.Devices {
+		if _, err := uuid.FromString(d); err != nil {
+			return fmt.Errorf("bad device UUID %s: %v", d, err)
+		}
+	}
+	for _, pattern := range append([]string{r.App}, r.Serials...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %s: %v", pattern, err)
+		}
+	}
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("a rule needs at least one action")
+	}
+	for _, a := range r.Actions {
+		switch a.Type {
+		case AlertLog:
+		case AlertWebhook:
+			if u, err := url.Parse(a.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("bad webhook URL %q, must be http or https", a.URL)
+			}
+		case AlertMQTT:
+			if u, err := url.Parse(a.URL); err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Host == "" {
+				return fmt.Errorf("bad MQTT URL %q, must be mqtt://host[:port] or mqtts://host[:port]", a.URL)
+			}
+			if a.Topic == "" || strings.ContainsAny(a.Topic, "+#") {
+				return fmt.Errorf("bad MQTT topic %q, must be set and without wildcards", a.Topic)
+			}
+		default:
+			return fmt.Errorf("unknown action type %q, must be one of log, webhook and mqtt", a.Type)
+		}
+	}
+	return nil
+}
+
+// AppliesTo whether the rule applies to a device. serial is called only when the rule is for some serials
+func (r *AlertRule) AppliesTo(u string, serial func() string) bool {
+	if len(r.Devices) == 0 && len(r.Serials) == 0 {
+		return true
+	}
+	for _, d := range r.Devices {
+		if strings.EqualFold(d, u) {
+			return true
+		}
+	}
+	if len(r.Serials) == 0 {
+		return false
+	}
+	s := serial()
+	for _, pattern := range r.Serials {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AppliesToApp whether an app state rule applies to an app instance with a name
+func (r *AlertRule) AppliesToApp(name string) bool {
+	if r.App == "" {
+		return true
+	}
+	ok, _ := path.Match(r.App, name)
+	return ok
+}
+
+// Breached whether the metric of the rule, in metrics decoded from JSON, compares to Value as Op says, returning
+// the first value that does. Values missing from the metrics do not breach the rule
+func (r *AlertRule) Breached(metrics interface{}) (bool, float64) {
+	for _, v := range MetricValues(metrics, r.Metric) {
+		if compareAlert(v, r.Op, r.Value) {
+			return true, v
+		}
+	}
+	return false, 0
+}
+
+// MetricValues the numbers at a dot separated path in a document decoded from JSON, going through every element of
+// the lists on the way. Numbers in strings, as protojson writes 64 bit integers, are included
+func MetricValues(doc interface{}, p string) []float64 {
+	var values []float64
+	var walk func(v interface{}, keys []string)
+	walk = func(v interface{}, keys []string) {
+		if l, ok := v.([]interface{}); ok {
+			for _, e := range l {
+				walk(e, keys)
+			}
+			return
+		}
+		if len(keys) == 0 {
+			switch n := v.(type) {
+			case float64:
+				values = append(values, n)
+			case string:
+				if f, err := strconv.ParseFloat(n, 64); err == nil {
+					values = append(values, f)
+				}
+			}
+			return
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			walk(m[keys[0]], keys[1:])
+		}
+	}
+	walk(doc, strings.Split(p, "."))
+	return values
+}
+
+func validAlertOp(op string) bool {
+	switch op {
+	case ">", ">=", "<", "<=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+func compareAlert(v float64, op string, threshold float64) bool {
+	switch op {
+	case ">":
+		return v > threshold
+	case ">=":
+		return v >= threshold
+	case "<":
+		return v < threshold
+	case "<=":
+		return v <= threshold
+	case "==":
+		return v == threshold
+	case "!=":
+		return v != threshold
+	}
+	return false
+}
+
+// AlertRuleAdd add an alert rule
+func AlertRuleAdd(s RecordStore, r *AlertRule) error {
+	return putJSON(s, RecordAlertRules, r.ID, r)
+}
+
+// AlertRuleGet get an alert rule by ID. Return a *NotFoundError if there is none
+func AlertRuleGet(s RecordStore, id string) (*AlertRule, error) {
+	var r AlertRule
+	if err := getJSON(s, RecordAlertRules, id, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// AlertRuleList list the alert rules
+func AlertRuleList(s RecordStore) ([]*AlertRule, error) {
+	rules := []*AlertRule{}
+	err := listJSON(s, RecordAlertRules, func() interface{} {
+		rules = append(rules, &AlertRule{})
+		return rules[len(rules)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// AlertRuleRemove remove an alert rule
+func AlertRuleRemove(s RecordStore, id string) error {
+	return s.RemoveRecord(RecordAlertRules, id)
+}
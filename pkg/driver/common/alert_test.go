@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAlertRuleValidate(t *testing.T) {
+	log := []AlertAction{{Type: AlertLog}}
+	tests := []struct {
+		name  string
+		rule  AlertRule
+		valid bool
+	}{
+		{"metric", AlertRule{Metric: "dm.cpuMetric.total", Op: ">", Value: 90, Actions: log}, true},
+		{"app state", AlertRule{AppState: "HALTED", App: "web-*", Actions: log}, true},
+		{"neither", AlertRule{Actions: log}, false},
+		{"both", AlertRule{Metric: "dm.cpuMetric.total", Op: ">", AppState: "HALTED", Actions: log}, false},
+		{"bad op", AlertRule{Metric: "dm.cpuMetric.total", Op: "=>", Actions: log}, false},
+		{"unknown state", AlertRule{AppState: "SLEEPING", Actions: log}, false},
+		{"app pattern on metric", AlertRule{Metric: "dm.cpuMetric.total", Op: ">", App: "web", Actions: log}, false},
+		{"bad device", AlertRule{AppState: "HALTED", Devices: []string{"abc"}, Actions: log}, false},
+		{"bad serial pattern", AlertRule{AppState: "HALTED", Serials: []string{"["}, Actions: log}, false},
+		{"no actions", AlertRule{AppState: "HALTED"}, false},
+		{"webhook", AlertRule{AppState: "HALTED", Actions: []AlertAction{{Type: AlertWebhook, URL: "https://example.com/hook"}}}, true},
+		{"bad webhook", AlertRule{AppState: "HALTED", Actions: []AlertAction{{Type: AlertWebhook, URL: "ftp://example.com"}}}, false},
+		{"mqtt", AlertRule{AppState: "HALTED", Actions: []AlertAction{{Type: AlertMQTT, URL: "mqtt://broker:1883", Topic: "adam/alerts"}}}, true},
+		{"mqtt without topic", AlertRule{AppState: "HALTED", Actions: []AlertAction{{Type: AlertMQTT, URL: "mqtt://broker"}}}, false},
+		{"mqtt wildcard", AlertRule{AppState: "HALTED", Actions: []AlertAction{{Type: AlertMQTT, URL: "mqtt://broker", Topic: "adam/#"}}}, false},
+		{"unknown action", AlertRule{AppState: "HALTED", Actions: []AlertAction{{Type: "email"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("mismatched validity, expected %v, got error %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestAlertRuleAppliesTo(t *testing.T) {
+	u := "a8e0f3e4-5e0f-4b4a-8c61-3f2e3f0d7d1a"
+	tests := []struct {
+		devices []string
+		serials []string
+		serial  string
+		applies bool
+	}{
+		{nil, nil, "lab-1", true},
+		{[]string{"A8E0F3E4-5E0F-4B4A-8C61-3F2E3F0D7D1A"}, nil, "lab-1", true},
+		{[]string{"c1d3f2a4-9b8e-4f0a-8d1c-2e3f4a5b6c7d"}, nil, "lab-1", false},
+		{nil, []string{"lab-*"}, "lab-1", true},
+		{nil, []string{"lab-*"}, "prod-1", false},
+		{[]string{"c1d3f2a4-9b8e-4f0a-8d1c-2e3f4a5b6c7d"}, []string{"lab-*"}, "lab-1", true},
+	}
+	for _, tt := range tests {
+		r := AlertRule{Devices: tt.devices, Serials: tt.serials}
+		if applies := r.AppliesTo(u, func() string { return tt.serial }); applies != tt.applies {
+			t.Errorf("mismatched for devices %v serials %v serial %s, actual %v expected %v", tt.devices, tt.serials, tt.serial, applies, tt.applies)
+		}
+	}
+}
+
+func TestAlertRuleBreached(t *testing.T) {
+	var metrics interface{}
+	b := []byte(`{"dm":{"cpuMetric":{"total":"95"},"disk":[{"mountPath":"/","usedMB":"100"},{"mountPath":"/persist","usedMB":"900"}]},"am":[{"AppName":"web","cpu":{"total":"3"}}]}`)
+	if err := json.Unmarshal(b, &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if v := MetricValues(metrics, "dm.disk.usedMB"); !reflect.DeepEqual(v, []float64{100, 900}) {
+		t.Errorf("mismatched values, actual %v", v)
+	}
+	tests := []struct {
+		metric   string
+		op       string
+		value    float64
+		breached bool
+		actual   float64
+	}{
+		{"dm.cpuMetric.total", ">", 90, true, 95},
+		{"dm.cpuMetric.total", "<", 90, false, 0},
+		{"dm.disk.usedMB", ">=", 500, true, 900},
+		{"dm.disk.usedMB", "<", 500, true, 100},
+		{"dm.disk.mountPath", "==", 0, false, 0},
+		{"am.cpu.total", "!=", 0, true, 3},
+		{"dm.missing", "<", 1, false, 0},
+	}
+	for _, tt := range tests {
+		r := AlertRule{Metric: tt.metric, Op: tt.op, Value: tt.value}
+		breached, actual := r.Breached(metrics)
+		if breached != tt.breached || actual != tt.actual {
+			t.Errorf("mismatched for %s %s %v, actual %v %v expected %v %v", tt.metric, tt.op, tt.value, breached, actual, tt.breached, tt.actual)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/config"
+	"github.com/lf-edge/eve/api/go/info"
+)
+
+// commands of an app instance
+const (
+	// AppRestart restart the app instance, keeping its volumes
+	AppRestart = "restart"
+	// AppPurge restart the app instance with its volumes recreated from their origin
+	AppPurge = "purge"
+)
+
+// states of a command of an app instance
+const (
+	// AppCommandQueued the command waits for the one before it on the same app instance to finish
+	AppCommandQueued = "queued"
+	// AppCommandSent the command is in the config of the device, which has not reported acting on it yet
+	AppCommandSent = "sent"
+	// AppCommandInProgress the device reported the app instance restarting or purging
+	AppCommandInProgress = "in-progress"
+	// AppCommandDone the device reported the app instance running again
+	AppCommandDone = "done"
+	// AppCommandFailed the command could not be sent, or the device reported an error for the app instance
+	AppCommandFailed = "failed"
+)
+
+// AppCommand a command to an app instance of a device. EVE acts on a command when the counter of the command in the
+// config of the app instance goes up, so only one command of an app instance is sent at a time, and the state of the
+// command is followed from the info messages the device sends about the app instance
+type AppCommand struct {
+	ID string `json:"id"`
+	// App UUID of the app instance
+	App     string `json:"app"`
+	Command string `json:"command"`
+	State   string `json:"state"`
+	// Counter the counter of the command in the config that sent it
+	Counter uint32 `json:"counter,omitempty"`
+	// Error why the command failed
+	Error   string     `json:"error,omitempty"`
+	Created time.Time  `json:"created"`
+	Sent    *time.Time `json:"sent,omitempty"`
+	Updated time.Time  `json:"updated"`
+}
+
+// ValidateAppCommand check a command is one EVE has for app instances
+func ValidateAppCommand(command string) error {
+	switch command {
+	case AppRestart, AppPurge:
+		return nil
+	}
+	return fmt.Errorf("unknown app command %q, must be %s or %s", command, AppRestart, AppPurge)
+}
+
+// Finished whether the command is done or failed
+func (c *AppCommand) Finished() bool {
+	return c.State == AppCommandDone || c.State == AppCommandFailed
+}
+
+// Apply bump the counter of the command in the config of its app instance, recording it as sent at a time
+func (c *AppCommand) Apply(app *config.AppInstanceConfig, at time.Time) {
+	ops := app.Restart
+	if c.Command == AppPurge {
+		ops = app.Purge
+	}
+	if ops == nil {
+		ops = &config.InstanceOpsCmd{}
+	}
+	ops.Counter++
+	if c.Command == AppPurge {
+		app.Purge = ops
+	} else {
+		app.Restart = ops
+	}
+	c.Counter = ops.Counter
+	c.State = AppCommandSent
+	c.Sent = &at
+	c.Updated = at
+}
+
+// Observe follow a sent command from an info message about its app instance, sent at a time. The command is in
+// progress once the app instance is reported restarting or purging, and done once it is reported running again, or
+// running since a boot after the command was sent. An error reported for the app instance after the command was sent,
+// while it is not running, fails it. Returns whether the command changed
+func (c *AppCommand) Observe(a *info.ZInfoApp, at time.Time) bool {
+	if c.Sent == nil || c.Finished() || at.Before(*c.Sent) {
+		return false
+	}
+	restarted := a.GetBootTime() != nil && a.GetBootTime().AsTime().After(*c.Sent)
+	switch state := a.GetState(); {
+	case state == info.ZSwState_RESTARTING || state == info.ZSwState_PURGING:
+		if c.State == AppCommandInProgress {
+			return false
+		}
+		c.State = AppCommandInProgress
+	case state == info.ZSwState_RUNNING:
+		if c.State != AppCommandInProgress && !restarted {
+			return false
+		}
+		c.State = AppCommandDone
+	default:
+		e := appError(a, *c.Sent)
+		if e == "" {
+			return false
+		}
+		c.State = AppCommandFailed
+		c.Error = e
+	}
+	c.Updated = at
+	return true
+}
+
+// appError the first error reported for an app instance after a time, empty if there is none
+func appError(a *info.ZInfoApp, since time.Time) string {
+	for _, e := range a.GetAppErr() {
+		if ts := e.GetTimestamp(); ts != nil && ts.AsTime().Before(since) {
+			continue
+		}
+		return e.GetDescription()
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/config"
+	"github.com/lf-edge/eve/api/go/info"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAppCommandApply(t *testing.T) {
+	now := time.Now()
+	app := &config.AppInstanceConfig{Restart: &config.InstanceOpsCmd{Counter: 3}}
+	restart := &AppCommand{Command: AppRestart, State: AppCommandQueued}
+	restart.Apply(app, now)
+	if app.Restart.Counter != 4 || restart.Counter != 4 || restart.State != AppCommandSent || !restart.Sent.Equal(now) {
+		t.Errorf("mismatched restart %+v of app %v", restart, app)
+	}
+	purge := &AppCommand{Command: AppPurge, State: AppCommandQueued}
+	purge.Apply(app, now)
+	if app.Purge.GetCounter() != 1 || purge.Counter != 1 || app.Restart.Counter != 4 {
+		t.Errorf("mismatched purge %+v of app %v", purge, app)
+	}
+}
+
+func TestAppCommandObserve(t *testing.T) {
+	sent := time.Now()
+	before, after := sent.Add(-time.Minute), sent.Add(time.Minute)
+	tests := []struct {
+		name    string
+		state   string
+		app     *info.ZInfoApp
+		at      time.Time
+		changed bool
+		expect  string
+	}{
+		{"restarting", AppCommandSent, &info.ZInfoApp{State: info.ZSwState_RESTARTING}, after, true, AppCommandInProgress},
+		{"purging", AppCommandSent, &info.ZInfoApp{State: info.ZSwState_PURGING}, after, true, AppCommandInProgress},
+		{"still restarting", AppCommandInProgress, &info.ZInfoApp{State: info.ZSwState_RESTARTING}, after, false, AppCommandInProgress},
+		{"running again", AppCommandInProgress, &info.ZInfoApp{State: info.ZSwState_RUNNING}, after, true, AppCommandDone},
+		{"running, not acted on yet", AppCommandSent, &info.ZInfoApp{State: info.ZSwState_RUNNING, BootTime: timestamppb.New(before)}, after, false, AppCommandSent},
+		{"running since a boot after", AppCommandSent, &info.ZInfoApp{State: info.ZSwState_RUNNING, BootTime: timestamppb.New(after)}, after, true, AppCommandDone},
+		{"message from before", AppCommandSent, &info.ZInfoApp{State: info.ZSwState_RESTARTING}, before, false, AppCommandSent},
+		{"error after", AppCommandInProgress, &info.ZInfoApp{State: info.ZSwState_HALTED, AppErr: []*info.ErrorInfo{{Description: "boom", Timestamp: timestamppb.New(after)}}}, after, true, AppCommandFailed},
+		{"error from before", AppCommandInProgress, &info.ZInfoApp{State: info.ZSwState_HALTED, AppErr: []*info.ErrorInfo{{Description: "old", Timestamp: timestamppb.New(before)}}}, after, false, AppCommandInProgress},
+		{"done already", AppCommandDone, &info.ZInfoApp{State: info.ZSwState_RESTARTING}, after, false, AppCommandDone},
+	}
+	for _, tt := range tests {
+		c := &AppCommand{Command: AppRestart, State: tt.state, Sent: &sent}
+		if changed := c.Observe(tt.app, tt.at); changed != tt.changed || c.State != tt.expect {
+			t.Errorf("%s: expected changed %v and state %s, got %v and %s", tt.name, tt.changed, tt.expect, changed, c.State)
+		}
+		if c.State == AppCommandFailed && c.Error != "boom" {
+			t.Errorf("%s: mismatched error %q", tt.name, c.Error)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ArchiveSuffix the suffix of the keys of archived segments, JSON lines compressed with zstd
+const ArchiveSuffix = ".jsonl.zst"
+
+// ColdStore storage of archived stream entries, cheaper than the database they are moved out of, by key
+type ColdStore interface {
+	// Name where the entries are archived, for logs
+	Name() string
+	// Put store an object, replacing any with the same key
+	Put(key string, b []byte) error
+	// Get get an object. Return a *NotFoundError if there is none
+	Get(key string) ([]byte, error)
+	// List list the keys of the objects under a prefix, sorted
+	List(prefix string) ([]string, error)
+	// Delete remove an object, if there is one
+	Delete(key string) error
+}
+
+// ArchivedEntry a stream entry in an archived segment
+type ArchivedEntry struct {
+	// ID of the entry in the stream it was archived from
+	ID     string          `json:"id"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Archived the entries of a stream moved to a ColdStore
+type Archived struct {
+	Stream string `json:"stream"`
+	// Entries how many entries were moved
+	Entries int `json:"entries"`
+	// Segments keys of the segments written
+	Segments []string `json:"segments"`
+}
+
+// NewColdStore the cold store of a location: s3://<bucket>[/<prefix>] for an S3 bucket, see NewS3Store, or the
+// path of a directory, as is or as file://<path>
+func NewColdStore(location string) (ColdStore, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("bad archive location %s: %v", location, err)
+	}
+	switch u.Scheme {
+	case "s3":
+		return NewS3Store(u.Host, strings.Trim(u.Path, "/"))
+	case "file":
+		return NewFileStore(u.Path)
+	case "":
+		return NewFileStore(location)
+	}
+	return nil, fmt.Errorf("unknown archive location %s, must be a directory or s3://<bucket>[/<prefix>]", location)
+}
+
+// fileStore a ColdStore in a directory, with an object per file
+type fileStore struct {
+	dir string
+}
+
+// NewFileStore a ColdStore in a directory, created if missing
+func NewFileStore(dir string) (ColdStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no archive directory")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create archive directory %s: %v", dir, err)
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (f *fileStore) Name() string {
+	return f.dir
+}
+
+func (f *fileStore) file(key string) string {
+	return filepath.Join(f.dir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (f *fileStore) Put(key string, b []byte) error {
+	p := f.file(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("unable to create archive directory for %s: %v", key, err)
+	}
+	// written aside and renamed, so that readers never see a partial segment
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("unable to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return fmt.Errorf("unable to rename %s: %v", tmp, err)
+	}
+	return nil
+}
+
+func (f *fileStore) Get(key string) ([]byte, error) {
+	b, err := ioutil.ReadFile(f.file(key))
+	if err != nil && os.IsNotExist(err) {
+		return nil, &NotFoundError{Err: fmt.Sprintf("archived %s not found", key)}
+	}
+	return b, err
+}
+
+func (f *fileStore) List(prefix string) ([]string, error) {
+	var keys []string
+	root := filepath.Dir(f.file(prefix + "x"))
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(f.dir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list archive %s: %v", prefix, err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (f *fileStore) Delete(key string) error {
+	if err := os.Remove(f.file(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove %s: %v", key, err)
+	}
+	return nil
+}
+
+// EncodeSegment the entries of a segment as JSON lines, compressed with zstd
+func EncodeSegment(entries []ArchivedEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode entry %s: %v", e.ID, err)
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return Compress(CompressionZstd, buf.Bytes())
+}
+
+// DecodeSegment reverse EncodeSegment
+func DecodeSegment(b []byte) ([]ArchivedEntry, error) {
+	b, err := Decompress(CompressionZstd, b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress segment: %v", err)
+	}
+	var entries []ArchivedEntry
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e ArchivedEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("unable to decode entry: %v", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// ArchiveReader reads the objects of the archived segments of a stream, in order, as JSON lines, as the readers of
+// streams do. Segments are fetched one at a time, as they are read
+type ArchiveReader struct {
+	store ColdStore
+	keys  []string
+	last  string
+	buf   bytes.Buffer
+}
+
+// NewArchiveReader a reader of the archived segments of a stream, whose keys are under a prefix in the store
+func NewArchiveReader(store ColdStore, prefix string) (*ArchiveReader, error) {
+	keys, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, k := range keys {
+		if strings.HasSuffix(k, ArchiveSuffix) {
+			segments = append(segments, k)
+		}
+	}
+	a := &ArchiveReader{store: store, keys: segments}
+	if len(segments) > 0 {
+		_, a.last = SegmentRange(segments[len(segments)-1])
+	}
+	return a, nil
+}
+
+// LastID the ID of the last archived entry, from the name of the last segment, empty if there is none. Entries of
+// the stream up to it are archived, so readers of the stream skip them
+func (a *ArchiveReader) LastID() string {
+	return a.last
+}
+
+func (a *ArchiveReader) Read(p []byte) (int, error) {
+	for a.buf.Len() == 0 {
+		if len(a.keys) == 0 {
+			return 0, io.EOF
+		}
+		key := a.keys[0]
+		a.keys = a.keys[1:]
+		b, err := a.store.Get(key)
+		if err != nil {
+			return 0, fmt.Errorf("unable to get archived segment %s: %v", key, err)
+		}
+		entries, err := DecodeSegment(b)
+		if err != nil {
+			return 0, fmt.Errorf("bad archived segment %s: %v", key, err)
+		}
+		for _, e := range entries {
+			a.buf.Write(e.Object)
+			a.buf.WriteByte('\n')
+		}
+	}
+	return a.buf.Read(p)
+}
+
+// SegmentKey the key of a segment of the entries of a stream between two IDs, <ms>-<seq> as in Redis, padded so
+// that the keys of a stream sort as its entries do
+func SegmentKey(stream, first, last string) string {
+	return fmt.Sprintf("%s/%s_%s%s", stream, padStreamID(first), padStreamID(last), ArchiveSuffix)
+}
+
+// SegmentRange the IDs of the first and last entries of a segment, from its key
+func SegmentRange(key string) (string, string) {
+	name := strings.TrimSuffix(path.Base(key), ArchiveSuffix)
+	parts := strings.SplitN(name, "_", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return unpadStreamID(parts[0]), unpadStreamID(parts[1])
+}
+
+func padStreamID(id string) string {
+	var ms, seq uint64
+	fmt.Sscanf(id, "%d-%d", &ms, &seq)
+	return fmt.Sprintf("%013d-%010d", ms, seq)
+}
+
+func unpadStreamID(id string) string {
+	var ms, seq uint64
+	if _, err := fmt.Sscanf(id, "%d-%d", &ms, &seq); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", ms, seq)
+}
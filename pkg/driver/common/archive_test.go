@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adam-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewColdStore("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testColdStore(t, store)
+	if _, err := NewColdStore("ftp://host/dir"); err == nil {
+		t.Errorf("expected an error for an unknown location")
+	}
+}
+
+func TestSegment(t *testing.T) {
+	entries := []ArchivedEntry{
+		{ID: "1600000000000-0", Object: json.RawMessage(`{"content":"a"}`)},
+		{ID: "1600000000001-12", Object: json.RawMessage(`{"content":"b"}`)},
+	}
+	b, err := EncodeSegment(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeSegment(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, entries) {
+		t.Errorf("mismatched entries, actual %v expected %v", decoded, entries)
+	}
+	key := SegmentKey("LOGS_EVE_1", entries[0].ID, entries[1].ID)
+	if key != "LOGS_EVE_1/1600000000000-0000000000_1600000000001-0000000012"+ArchiveSuffix {
+		t.Errorf("mismatched key %s", key)
+	}
+	if first, last := SegmentRange(key); first != entries[0].ID || last != entries[1].ID {
+		t.Errorf("mismatched range, actual %s %s", first, last)
+	}
+	// keys sort as their entries do, whatever the number of digits of their sequence
+	if a, b := SegmentKey("s", "1-9", "1-9"), SegmentKey("s", "1-10", "1-10"); a >= b {
+		t.Errorf("keys of segments out of order, %s >= %s", a, b)
+	}
+}
+
+func TestArchiveReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adam-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewArchiveReader(store, "LOGS_EVE_1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || len(b) != 0 || r.LastID() != "" {
+		t.Errorf("mismatched empty archive, actual %q %v last %s", b, err, r.LastID())
+	}
+	segments := [][]ArchivedEntry{
+		{{ID: "1-0", Object: json.RawMessage(`{"n":1}`)}, {ID: "2-0", Object: json.RawMessage(`{"n":2}`)}},
+		{{ID: "10-0", Object: json.RawMessage(`{"n":3}`)}},
+	}
+	// written out of order, read in order
+	for i := len(segments) - 1; i >= 0; i-- {
+		s := segments[i]
+		b, err := EncodeSegment(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Put(SegmentKey("LOGS_EVE_1", s[0].ID, s[len(s)-1].ID), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Put("LOGS_EVE_1/other", []byte("not a segment"))
+	r, err = NewArchiveReader(store, "LOGS_EVE_1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := r.LastID(); last != "10-0" {
+		t.Errorf("mismatched last ID, actual %s expected 10-0", last)
+	}
+	b, err := ioutil.ReadAll(r)
+	if expected := "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n"; err != nil || string(b) != expected {
+		t.Errorf("mismatched objects, actual %q %v expected %q", b, err, expected)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"time"
+)
+
+// Attestation the state of the attestation of a device with a TPM: the certificates it published, e.g. the one it
+// shares keys with by ECDH, the nonce it is to quote, and the keys of its volume vaults it escrowed, encrypted, to be
+// given back once it attests, so that it can unlock its encrypted storage when it boots
+type Attestation struct {
+	// Certs the certificates the device published, one per type
+	Certs []AttestCert `json:"certs,omitempty"`
+	// Nonce the nonce the device was given to quote, until it does
+	Nonce []byte `json:"nonce,omitempty"`
+	// IntegrityToken the token given to the device when it last attested, which it stores its keys with
+	IntegrityToken []byte `json:"integrity-token,omitempty"`
+	// Attested when the device last attested
+	Attested time.Time `json:"attested,omitempty"`
+	// PCRs the values of the PCRs in the last quote of the device, as <algorithm>:<index> to the hex value
+	PCRs map[string]string `json:"pcrs,omitempty"`
+	// Keys the encrypted keys of the volume vaults of the device
+	Keys []VaultKey `json:"keys,omitempty"`
+}
+
+// AttestCert a certificate a device published for attestation
+type AttestCert struct {
+	// Type the type of the certificate, as in the EVE API, e.g. CERT_TYPE_DEVICE_ECDH_EXCHANGE
+	Type string `json:"type"`
+	// Cert the certificate, in PEM format
+	Cert []byte `json:"cert"`
+	// TPM whether the key of the certificate is in the TPM of the device
+	TPM      bool      `json:"tpm,omitempty"`
+	Received time.Time `json:"received"`
+}
+
+// VaultKey the key of a volume vault of a device, encrypted by the device, and held for it
+type VaultKey struct {
+	// Type the type of the key, as in the EVE API, e.g. ATTEST_VOLUME_KEY_TYPE_VSK
+	Type         string    `json:"type"`
+	EncryptedKey []byte    `json:"encrypted-key,omitempty"`
+	DigestSHA256 []byte    `json:"digest-sha256,omitempty"`
+	Stored       time.Time `json:"stored"`
+}
+
+// Cert the certificate the device published of a type, nil if none
+func (a *Attestation) Cert(certType string) *AttestCert {
+	for i := range a.Certs {
+		if a.Certs[i].Type == certType {
+			return &a.Certs[i]
+		}
+	}
+	return nil
+}
+
+// SetCert set the certificate the device published of its type, replacing any
+func (a *Attestation) SetCert(c AttestCert) {
+	if existing := a.Cert(c.Type); existing != nil {
+		*existing = c
+		return
+	}
+	a.Certs = append(a.Certs, c)
+}
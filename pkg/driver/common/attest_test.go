@@ -0,0 +1,30 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAttestationSetCert(t *testing.T) {
+	a := &Attestation{}
+	if c := a.Cert("CERT_TYPE_DEVICE_ECDH_EXCHANGE"); c != nil {
+		t.Fatalf("unexpected certificate %v", c)
+	}
+	a.SetCert(AttestCert{Type: "CERT_TYPE_DEVICE_ECDH_EXCHANGE", Cert: []byte("ecdh")})
+	a.SetCert(AttestCert{Type: "CERT_TYPE_DEVICE_RESTRICTED_SIGNING", Cert: []byte("signing"), TPM: true})
+	// replaces the certificate of the same type, in place
+	a.SetCert(AttestCert{Type: "CERT_TYPE_DEVICE_ECDH_EXCHANGE", Cert: []byte("ecdh2"), TPM: true})
+	expected := []AttestCert{
+		{Type: "CERT_TYPE_DEVICE_ECDH_EXCHANGE", Cert: []byte("ecdh2"), TPM: true},
+		{Type: "CERT_TYPE_DEVICE_RESTRICTED_SIGNING", Cert: []byte("signing"), TPM: true},
+	}
+	if !reflect.DeepEqual(a.Certs, expected) {
+		t.Errorf("mismatched certificates, actual %v expected %v", a.Certs, expected)
+	}
+	if c := a.Cert("CERT_TYPE_DEVICE_RESTRICTED_SIGNING"); c == nil || string(c.Cert) != "signing" {
+		t.Errorf("mismatched certificate, actual %v", c)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// states of a canary
+const (
+	// CanarySoaking the change is applied to the canaries, which are watched until the soak period is over
+	CanarySoaking = "soaking"
+	// CanaryPassed the canaries went through the soak period without regressing, so the change can be promoted
+	CanaryPassed = "passed"
+	// CanaryReverted a canary regressed, or it was reverted by hand, so the canaries have their previous config back
+	CanaryReverted = "reverted"
+)
+
+// states of a device in a canary
+const (
+	CanaryDeviceSoaking = "soaking"
+	CanaryDevicePassed  = "passed"
+	// CanaryDeviceRegressed the device regressed with the change, or the change could not be applied to it
+	CanaryDeviceRegressed = "regressed"
+	// CanaryDeviceReverted the device has its previous config back, as another canary regressed
+	CanaryDeviceReverted = "reverted"
+)
+
+// CanaryDevice the state of one canary device
+type CanaryDevice struct {
+	UUID   string `json:"uuid"`
+	Status string `json:"status"`
+	// Hash of the config applied, that the device has to acknowledge
+	Hash string `json:"hash,omitempty"`
+	// Previous config of the device, set back when the canary is reverted
+	Previous json.RawMessage `json:"previous,omitempty"`
+	// BootTime the boot time the device last reported
+	BootTime *time.Time `json:"boot-time,omitempty"`
+	// Reboots number of times the device rebooted since the change was applied
+	Reboots      int        `json:"reboots"`
+	Acknowledged *time.Time `json:"acknowledged,omitempty"`
+	// Error why the device regressed, or its previous config could not be set back
+	Error string `json:"error,omitempty"`
+}
+
+// CanaryObservation what a canary device reported since the change was applied
+type CanaryObservation struct {
+	// Acknowledged whether the device reported having the config applied
+	Acknowledged bool
+	// BootTime the boot time the device reported last, nil if it did not report one
+	BootTime *time.Time
+	// Errors the error states the device reported since the change was applied, e.g. of its app instances
+	Errors []string
+}
+
+// Canary a config change applied to a few canary devices first, which are watched for a soak period. Once over, the
+// change can be promoted to a rollout to the fleet, unless a canary regressed, in which case all are reverted
+type Canary struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Patch JSON merge patch applied to the config of each device
+	Patch json.RawMessage `json:"patch,omitempty"`
+	// Template config set on each device instead of patching theirs, with the UUID of the device
+	Template json.RawMessage `json:"template,omitempty"`
+	// SoakPeriod how long, in seconds, the canaries are watched once the change is applied
+	SoakPeriod int `json:"soak-period"`
+	// MaxReboots number of times a canary can reboot during the soak period before it counts as regressed
+	MaxReboots int    `json:"max-reboots"`
+	State      string `json:"state"`
+	// Reason why the canary was reverted
+	Reason  string         `json:"reason,omitempty"`
+	Created time.Time      `json:"created"`
+	Updated time.Time      `json:"updated"`
+	Devices []CanaryDevice `json:"devices"`
+}
+
+// NewCanary watch a change applied to canary devices for a soak period
+func NewCanary(id, name string, devices []string, soakPeriod int) *Canary {
+	now := time.Now()
+	c := &Canary{
+		ID:         id,
+		Name:       name,
+		SoakPeriod: soakPeriod,
+		State:      CanarySoaking,
+		Created:    now,
+		Updated:    now,
+		Devices:    make([]CanaryDevice, 0, len(devices)),
+	}
+	for _, u := range devices {
+		c.Devices = append(c.Devices, CanaryDevice{UUID: u, Status: CanaryDeviceSoaking})
+	}
+	return c
+}
+
+// Regressions number of canaries that regressed
+func (c *Canary) Regressions() int {
+	n := 0
+	for _, d := range c.Devices {
+		if d.Status == CanaryDeviceRegressed {
+			n++
+		}
+	}
+	return n
+}
+
+// Advance move a soaking canary on. observe reports what a device reported since the change was applied: a canary
+// regresses once it reports an error state, or reboots more than MaxReboots times. Once the soak period is over, the
+// canaries that acknowledged the change pass, and those that have not regress. As soon as one regressed, revert sets
+// the previous config back on every canary. Returns whether anything changed
+func (c *Canary) Advance(now time.Time, observe func(u string) (CanaryObservation, error), revert func(d *CanaryDevice) error) (bool, error) {
+	if c.State != CanarySoaking {
+		return false, nil
+	}
+	over := now.Sub(c.Created) >= time.Duration(c.SoakPeriod)*time.Second
+	changed := false
+	for i := range c.Devices {
+		d := &c.Devices[i]
+		if d.Status != CanaryDeviceSoaking {
+			continue
+		}
+		o, err := observe(d.UUID)
+		if err != nil {
+			return changed, fmt.Errorf("unable to observe device %s: %v", d.UUID, err)
+		}
+		if d.observe(o, now) {
+			changed = true
+		}
+		switch {
+		case len(o.Errors) > 0:
+			d.Status = CanaryDeviceRegressed
+			d.Error = strings.Join(o.Errors, "; ")
+		case d.Reboots > c.MaxReboots:
+			d.Status = CanaryDeviceRegressed
+			d.Error = fmt.Sprintf("rebooted %d times, more than the %d allowed", d.Reboots, c.MaxReboots)
+		case over && d.Acknowledged == nil:
+			d.Status = CanaryDeviceRegressed
+			d.Error = fmt.Sprintf("config not acknowledged within %s", time.Duration(c.SoakPeriod)*time.Second)
+		default:
+			continue
+		}
+		changed = true
+	}
+	if n := c.Regressions(); n > 0 {
+		c.Revert(now, fmt.Sprintf("%d canaries regressed", n), revert)
+		return true, nil
+	}
+	if over {
+		for i := range c.Devices {
+			c.Devices[i].Status = CanaryDevicePassed
+		}
+		c.State = CanaryPassed
+		changed = true
+	}
+	if changed {
+		c.Updated = now
+	}
+	return changed, nil
+}
+
+// Revert set the previous config back on every canary with revert, for a reason
+func (c *Canary) Revert(now time.Time, reason string, revert func(d *CanaryDevice) error) {
+	for i := range c.Devices {
+		d := &c.Devices[i]
+		if err := revert(d); err != nil {
+			// the device keeps the status it had, with why it regressed if it did
+			if d.Error != "" {
+				d.Error += "; "
+			}
+			d.Error += fmt.Sprintf("unable to revert: %v", err)
+			continue
+		}
+		if d.Status != CanaryDeviceRegressed {
+			d.Status = CanaryDeviceReverted
+		}
+	}
+	c.State = CanaryReverted
+	c.Reason = reason
+	c.Updated = now
+}
+
+// observe update a device with what it reported, counting the reboots. Returns whether anything changed
+func (d *CanaryDevice) observe(o CanaryObservation, now time.Time) bool {
+	changed := false
+	if o.Acknowledged && d.Acknowledged == nil {
+		d.Acknowledged = &now
+		changed = true
+	}
+	if o.BootTime != nil && (d.BootTime == nil || !o.BootTime.Equal(*d.BootTime)) {
+		// without a boot time from before the change, the first one is where it starts from
+		if d.BootTime != nil {
+			d.Reboots++
+		}
+		d.BootTime = o.BootTime
+		changed = true
+	}
+	return changed
+}
+
+// CanarySet add a config canary, or replace the one with the same ID, e.g. to record what its devices reported
+func CanarySet(s RecordStore, c *Canary) error {
+	return putJSON(s, RecordCanaries, c.ID, c)
+}
+
+// CanaryGet get a config canary by ID. Return a *NotFoundError if there is none
+func CanaryGet(s RecordStore, id string) (*Canary, error) {
+	var c Canary
+	if err := getJSON(s, RecordCanaries, id, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// CanaryList list the config canaries
+func CanaryList(s RecordStore) ([]*Canary, error) {
+	canaries := []*Canary{}
+	err := listJSON(s, RecordCanaries, func() interface{} {
+		canaries = append(canaries, &Canary{})
+		return canaries[len(canaries)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return canaries, nil
+}
+
+// CanaryRemove remove a config canary
+func CanaryRemove(s RecordStore, id string) error {
+	return s.RemoveRecord(RecordCanaries, id)
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCanaryAdvance(t *testing.T) {
+	start := time.Now()
+	boot := start.Add(-time.Hour)
+	rebooted := start.Add(time.Minute)
+	status := func(c *Canary) []string {
+		s := []string{}
+		for _, d := range c.Devices {
+			s = append(s, d.Status)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name string
+		// observations of each device, at each step
+		observations []map[string]CanaryObservation
+		maxReboots   int
+		// revertFails the devices whose previous config cannot be set back
+		revertFails string
+		states      []string
+		devices     []string
+		reverted    []string
+	}{
+		{
+			name: "passes",
+			observations: []map[string]CanaryObservation{
+				{"a": {BootTime: &boot}, "b": {Acknowledged: true, BootTime: &boot}},
+				{"a": {Acknowledged: true, BootTime: &boot}, "b": {Acknowledged: true, BootTime: &boot}},
+			},
+			states:  []string{CanarySoaking, CanaryPassed},
+			devices: []string{CanaryDevicePassed, CanaryDevicePassed},
+		},
+		{
+			name: "error state",
+			observations: []map[string]CanaryObservation{
+				{"a": {Acknowledged: true}, "b": {Acknowledged: true, Errors: []string{"app web: ERROR"}}},
+			},
+			states:   []string{CanaryReverted},
+			devices:  []string{CanaryDeviceReverted, CanaryDeviceRegressed},
+			reverted: []string{"a", "b"},
+		},
+		{
+			name: "reboot loop",
+			observations: []map[string]CanaryObservation{
+				{"a": {Acknowledged: true, BootTime: &boot}, "b": {Acknowledged: true, BootTime: &boot}},
+				{"a": {Acknowledged: true, BootTime: &boot}, "b": {Acknowledged: true, BootTime: &rebooted}},
+				{"a": {Acknowledged: true, BootTime: &boot}, "b": {Acknowledged: true, BootTime: &boot}},
+			},
+			maxReboots: 1,
+			states:     []string{CanarySoaking, CanarySoaking, CanaryReverted},
+			devices:    []string{CanaryDeviceReverted, CanaryDeviceRegressed},
+			reverted:   []string{"a", "b"},
+		},
+		{
+			name: "not acknowledged",
+			observations: []map[string]CanaryObservation{
+				{"a": {Acknowledged: true}, "b": {}},
+				{"a": {Acknowledged: true}, "b": {}},
+			},
+			states:   []string{CanarySoaking, CanaryReverted},
+			devices:  []string{CanaryDeviceReverted, CanaryDeviceRegressed},
+			reverted: []string{"a", "b"},
+		},
+		{
+			name: "revert fails",
+			observations: []map[string]CanaryObservation{
+				{"a": {Errors: []string{"app web: ERROR"}}, "b": {}},
+			},
+			revertFails: "b",
+			states:      []string{CanaryReverted},
+			devices:     []string{CanaryDeviceRegressed, CanaryDeviceSoaking},
+			reverted:    []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCanary("id", "", []string{"a", "b"}, 60)
+			c.Created = start
+			c.MaxReboots = tt.maxReboots
+			reverted := []string{}
+			revert := func(d *CanaryDevice) error {
+				if d.UUID == tt.revertFails {
+					return fmt.Errorf("device gone")
+				}
+				reverted = append(reverted, d.UUID)
+				return nil
+			}
+			states := []string{}
+			for i, o := range tt.observations {
+				observe := func(u string) (CanaryObservation, error) {
+					return o[u], nil
+				}
+				// the steps are spread over the soak period, the last one at its end
+				now := start
+				if i > 0 {
+					now = start.Add(time.Duration(i) * time.Minute / time.Duration(len(tt.observations)-1))
+				}
+				if _, err := c.Advance(now, observe, revert); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				states = append(states, c.State)
+			}
+			if !reflect.DeepEqual(states, tt.states) {
+				t.Errorf("mismatched states, actual %v expected %v", states, tt.states)
+			}
+			if s := status(c); !reflect.DeepEqual(s, tt.devices) {
+				t.Errorf("mismatched devices, actual %v expected %v", s, tt.devices)
+			}
+			if len(tt.reverted) == 0 {
+				tt.reverted = []string{}
+			}
+			if !reflect.DeepEqual(reverted, tt.reverted) {
+				t.Errorf("mismatched reverted devices, actual %v expected %v", reverted, tt.reverted)
+			}
+			if c.State == CanaryReverted && c.Reason == "" {
+				t.Errorf("reverted without a reason")
+			}
+		})
+	}
+}
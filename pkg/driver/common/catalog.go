@@ -0,0 +1,334 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/config"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// refKey the key of a reference to a datastore or image of the catalog in a config, as in {"$ref": "<name>"}
+const refKey = "$ref"
+
+// Datastore a datastore of the catalog, e.g. a container registry, that configs reference by name. Its UUID stays the
+// same as long as the name does, so that every device sees the same datastore
+type Datastore struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	// Config the datastore as in a config, without its id
+	Config  json.RawMessage `json:"config"`
+	Updated time.Time       `json:"updated"`
+}
+
+// Image an image of the catalog, e.g. a container or VM image, that configs reference by name. It is a content tree of
+// a datastore of the catalog, whose UUID stays the same as long as the name does
+type Image struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	// Datastore name of the datastore of the catalog the image is in
+	Datastore string `json:"datastore"`
+	// Config the image as a content tree in a config, without its uuid and dsId
+	Config  json.RawMessage `json:"config"`
+	Updated time.Time       `json:"updated"`
+}
+
+// checkCatalogName check the name of a datastore or image, which is part of paths and keys
+func checkCatalogName(kind, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("empty %s name", kind)
+	case strings.ContainsAny(name, "/\\"):
+		return fmt.Errorf("invalid %s name %q, it cannot have slashes", kind, name)
+	}
+	return nil
+}
+
+// NewDatastore a datastore of the catalog, of the given UUID, from its config. Any id the config has is dropped
+func NewDatastore(name, id string, conf []byte) (*Datastore, error) {
+	if err := checkCatalogName("datastore", name); err != nil {
+		return nil, err
+	}
+	var ds config.DatastoreConfig
+	if err := protojson.Unmarshal(conf, &ds); err != nil {
+		return nil, fmt.Errorf("unable to read datastore config: %v", err)
+	}
+	if ds.DType == config.DsType_DsUnknown {
+		return nil, fmt.Errorf("datastore without a dType")
+	}
+	ds.Id = ""
+	b, err := protojson.Marshal(&ds)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode datastore config: %v", err)
+	}
+	return &Datastore{Name: name, ID: id, Config: b, Updated: time.Now()}, nil
+}
+
+// NewImage an image of the catalog, of the given UUID, in the named datastore, from its config as a content tree. Any
+// uuid and dsId the config has are dropped
+func NewImage(name, id, datastore string, conf []byte) (*Image, error) {
+	if err := checkCatalogName("image", name); err != nil {
+		return nil, err
+	}
+	if datastore == "" {
+		return nil, fmt.Errorf("image without a datastore")
+	}
+	var ct config.ContentTree
+	if err := protojson.Unmarshal(conf, &ct); err != nil {
+		return nil, fmt.Errorf("unable to read image config: %v", err)
+	}
+	if ct.URL == "" {
+		return nil, fmt.Errorf("image without a URL")
+	}
+	ct.Uuid = ""
+	ct.DsId = ""
+	b, err := protojson.Marshal(&ct)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode image config: %v", err)
+	}
+	return &Image{Name: name, ID: id, Datastore: datastore, Config: b, Updated: time.Now()}, nil
+}
+
+// ResolveRefs replace the references to datastores and images of the catalog in a config, {"$ref": "<name>"}, with
+// what they refer to. References go in place of the elements of datastores and contentInfo, and of the
+// downloadContentTreeID of the origin of volumes. Each image referenced is added to contentInfo, and its datastore to
+// datastores, unless they have it already, from those of s. A config without references is returned as is
+func ResolveRefs(conf []byte, s RecordStore) ([]byte, error) {
+	if !strings.Contains(string(conf), refKey) {
+		return conf, nil
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(conf, &doc); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	r := &resolver{store: s, datastores: map[string]interface{}{}, images: map[string]interface{}{}}
+	datastores, err := r.list(doc, "datastores", r.datastore)
+	if err != nil {
+		return nil, err
+	}
+	contentInfo, err := r.list(doc, "contentInfo", r.image)
+	if err != nil {
+		return nil, err
+	}
+	volumes, _ := doc["volumes"].([]interface{})
+	for i, v := range volumes {
+		origin, _ := v.(map[string]interface{})["origin"].(map[string]interface{})
+		name, ok := refName(origin["downloadContentTreeID"])
+		if !ok {
+			continue
+		}
+		image, err := r.image(name)
+		if err != nil {
+			return nil, fmt.Errorf("volume %d: %v", i, err)
+		}
+		origin["downloadContentTreeID"] = image["uuid"]
+	}
+	// what was referenced, but is not in the config yet
+	for _, ds := range datastores {
+		delete(r.datastores, stringField(ds, "id"))
+	}
+	for _, ct := range contentInfo {
+		delete(r.images, stringField(ct, "uuid"))
+	}
+	for _, ct := range sortedValues(r.images) {
+		contentInfo = append(contentInfo, ct)
+	}
+	for _, ds := range sortedValues(r.datastores) {
+		datastores = append(datastores, ds)
+	}
+	if len(datastores) > 0 {
+		doc["datastores"] = datastores
+	}
+	if len(contentInfo) > 0 {
+		doc["contentInfo"] = contentInfo
+	}
+	if path := findRef(doc, ""); path != "" {
+		return nil, fmt.Errorf("reference at %s, where no datastore or image goes", path)
+	}
+	return json.Marshal(doc)
+}
+
+// resolver the datastores and images a config references, by UUID
+type resolver struct {
+	store      RecordStore
+	datastores map[string]interface{}
+	images     map[string]interface{}
+}
+
+// list resolve the references among the elements of a list of a config
+func (r *resolver) list(doc map[string]interface{}, key string, resolve func(string) (map[string]interface{}, error)) ([]interface{}, error) {
+	l, _ := doc[key].([]interface{})
+	for i, v := range l {
+		name, ok := refName(v)
+		if !ok {
+			continue
+		}
+		resolved, err := resolve(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s %d: %v", key, i, err)
+		}
+		l[i] = resolved
+	}
+	return l, nil
+}
+
+// datastore a datastore of the catalog as in a config
+func (r *resolver) datastore(name string) (map[string]interface{}, error) {
+	ds, err := DatastoreGet(r.store, name)
+	if err != nil {
+		return nil, fmt.Errorf("datastore %s: %v", name, err)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(ds.Config, &v); err != nil {
+		return nil, fmt.Errorf("invalid datastore %s: %v", name, err)
+	}
+	v["id"] = ds.ID
+	r.datastores[ds.ID] = v
+	return v, nil
+}
+
+// image an image of the catalog as a content tree in a config, recording its datastore
+func (r *resolver) image(name string) (map[string]interface{}, error) {
+	image, err := ImageGet(r.store, name)
+	if err != nil {
+		return nil, fmt.Errorf("image %s: %v", name, err)
+	}
+	ds, err := r.datastore(image.Datastore)
+	if err != nil {
+		return nil, fmt.Errorf("image %s: %v", name, err)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(image.Config, &v); err != nil {
+		return nil, fmt.Errorf("invalid image %s: %v", name, err)
+	}
+	v["uuid"] = image.ID
+	v["dsId"] = ds["id"]
+	if _, ok := v["displayName"]; !ok {
+		v["displayName"] = image.Name
+	}
+	r.images[image.ID] = v
+	return v, nil
+}
+
+// refName the name a value refers to, if it is a reference
+func refName(v interface{}) (string, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	name, ok := m[refKey].(string)
+	return name, ok
+}
+
+// findRef the path of a reference left in a value, empty if there is none
+func findRef(v interface{}, path string) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if _, ok := v[refKey]; ok {
+			return path
+		}
+		for k, e := range v {
+			if p := findRef(e, path+"."+k); p != "" {
+				return p
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if p := findRef(e, fmt.Sprintf("%s[%d]", path, i)); p != "" {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// stringField a string field of an object, empty if the value is not an object or has no such field
+func stringField(v interface{}, key string) string {
+	m, _ := v.(map[string]interface{})
+	s, _ := m[key].(string)
+	return s
+}
+
+// sortedValues the values of a map by key, so that resolving a config always gives the same one
+func sortedValues(m map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]interface{}, 0, len(m))
+	for _, k := range keys {
+		values = append(values, m[k])
+	}
+	return values
+}
+
+// DatastoreAdd add a datastore, or replace the one with the same name
+func DatastoreAdd(s RecordStore, ds *Datastore) error {
+	return putJSON(s, RecordDatastores, ds.Name, ds)
+}
+
+// DatastoreGet get a datastore by name. Return a *NotFoundError if there is none
+func DatastoreGet(s RecordStore, name string) (*Datastore, error) {
+	var ds Datastore
+	if err := getJSON(s, RecordDatastores, name, &ds); err != nil {
+		return nil, err
+	}
+	return &ds, nil
+}
+
+// DatastoreList list the datastores
+func DatastoreList(s RecordStore) ([]*Datastore, error) {
+	datastores := []*Datastore{}
+	err := listJSON(s, RecordDatastores, func() interface{} {
+		datastores = append(datastores, &Datastore{})
+		return datastores[len(datastores)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return datastores, nil
+}
+
+// DatastoreRemove remove a datastore
+func DatastoreRemove(s RecordStore, name string) error {
+	return s.RemoveRecord(RecordDatastores, name)
+}
+
+// ImageAdd add an image, or replace the one with the same name
+func ImageAdd(s RecordStore, image *Image) error {
+	return putJSON(s, RecordImages, image.Name, image)
+}
+
+// ImageGet get an image by name. Return a *NotFoundError if there is none
+func ImageGet(s RecordStore, name string) (*Image, error) {
+	var image Image
+	if err := getJSON(s, RecordImages, name, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// ImageList list the images
+func ImageList(s RecordStore) ([]*Image, error) {
+	images := []*Image{}
+	err := listJSON(s, RecordImages, func() interface{} {
+		images = append(images, &Image{})
+		return images[len(images)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// ImageRemove remove an image
+func ImageRemove(s RecordStore, name string) error {
+	return s.RemoveRecord(RecordImages, name)
+}
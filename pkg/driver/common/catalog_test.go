@@ -0,0 +1,179 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+
+	"github.com/lf-edge/eve/api/go/config"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	testDatastoreID = "2c0b4e91-8a57-4b0e-9c2e-3a3f1e0c2f11"
+	testImageID     = "b5e2f0a1-7d35-4c8b-a5a9-1c6f4f3e2d22"
+)
+
+// newTestCatalog a catalog of a docker hub datastore and a nginx image in it
+func newTestCatalog(t *testing.T) testRecords {
+	ds, err := NewDatastore("hub", testDatastoreID, []byte(`{"dType":"DsContainerRegistry","fqdn":"docker://docker.io"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	image, err := NewImage("nginx", testImageID, "hub", []byte(`{"URL":"library/nginx:1.21","iformat":"CONTAINER"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := testRecords{}
+	if err := DatastoreAdd(c, ds); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ImageAdd(c, image); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return c
+}
+
+func TestNewDatastore(t *testing.T) {
+	ds, err := NewDatastore("hub", testDatastoreID, []byte(`{"id":"other","dType":"DsContainerRegistry","fqdn":"docker://docker.io"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var conf config.DatastoreConfig
+	if err := protojson.Unmarshal(ds.Config, &conf); err != nil {
+		t.Fatalf("unexpected error reading config: %v", err)
+	}
+	if ds.ID != testDatastoreID || conf.Id != "" || conf.Fqdn != "docker://docker.io" {
+		t.Errorf("mismatched datastore %+v", ds)
+	}
+
+	tests := []struct {
+		name string
+		conf string
+	}{
+		{"", `{"dType":"DsHttps"}`},
+		{"a/b", `{"dType":"DsHttps"}`},
+		{"hub", "{"},
+		{"hub", `{"fqdn":"docker://docker.io"}`},
+	}
+	for _, tt := range tests {
+		if _, err := NewDatastore(tt.name, testDatastoreID, []byte(tt.conf)); err == nil {
+			t.Errorf("%q %s: expected an error", tt.name, tt.conf)
+		}
+	}
+}
+
+func TestNewImage(t *testing.T) {
+	image, err := NewImage("nginx", testImageID, "hub", []byte(`{"uuid":"other","dsId":"other","URL":"library/nginx"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var conf config.ContentTree
+	if err := protojson.Unmarshal(image.Config, &conf); err != nil {
+		t.Fatalf("unexpected error reading config: %v", err)
+	}
+	if image.ID != testImageID || image.Datastore != "hub" || conf.Uuid != "" || conf.DsId != "" {
+		t.Errorf("mismatched image %+v", image)
+	}
+
+	tests := []struct {
+		name      string
+		datastore string
+		conf      string
+	}{
+		{"", "hub", `{"URL":"library/nginx"}`},
+		{"a/b", "hub", `{"URL":"library/nginx"}`},
+		{"nginx", "", `{"URL":"library/nginx"}`},
+		{"nginx", "hub", "{"},
+		{"nginx", "hub", `{"iformat":"CONTAINER"}`},
+	}
+	for _, tt := range tests {
+		if _, err := NewImage(tt.name, testImageID, tt.datastore, []byte(tt.conf)); err == nil {
+			t.Errorf("%q %q %s: expected an error", tt.name, tt.datastore, tt.conf)
+		}
+	}
+}
+
+func TestResolveRefs(t *testing.T) {
+	c := newTestCatalog(t)
+	tests := []struct {
+		conf        string
+		datastores  int
+		contentInfo int
+		err         bool
+	}{
+		// no references, as is
+		{`{"id":{"uuid":"x"}}`, 0, 0, false},
+		// a datastore
+		{`{"datastores":[{"$ref":"hub"}]}`, 1, 0, false},
+		// an image, with its datastore
+		{`{"contentInfo":[{"$ref":"nginx"}]}`, 1, 1, false},
+		// an image and its datastore, which is not repeated
+		{`{"datastores":[{"$ref":"hub"}],"contentInfo":[{"$ref":"nginx"}]}`, 1, 1, false},
+		// a volume of an image, which is added with its datastore
+		{`{"volumes":[{"uuid":"v","origin":{"type":"VCOT_DOWNLOAD","downloadContentTreeID":{"$ref":"nginx"}}}]}`, 1, 1, false},
+		// a volume of an image the config has already
+		{`{"contentInfo":[{"$ref":"nginx"}],"volumes":[{"uuid":"v","origin":{"downloadContentTreeID":{"$ref":"nginx"}}}]}`, 1, 1, false},
+		// unknown names
+		{`{"datastores":[{"$ref":"other"}]}`, 0, 0, true},
+		{`{"contentInfo":[{"$ref":"other"}]}`, 0, 0, true},
+		// a reference where none goes
+		{`{"apps":[{"$ref":"nginx"}]}`, 0, 0, true},
+	}
+	for _, tt := range tests {
+		b, err := ResolveRefs([]byte(tt.conf), c)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.conf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.conf, err)
+			continue
+		}
+		var conf config.EdgeDevConfig
+		if err := protojson.Unmarshal(b, &conf); err != nil {
+			t.Errorf("%s: resolved to an invalid config %s: %v", tt.conf, b, err)
+			continue
+		}
+		if len(conf.Datastores) != tt.datastores || len(conf.ContentInfo) != tt.contentInfo {
+			t.Errorf("%s: expected %d datastores and %d content trees, got %s", tt.conf, tt.datastores, tt.contentInfo, b)
+		}
+		for _, ds := range conf.Datastores {
+			if ds.Id != testDatastoreID || ds.DType != config.DsType_DsContainerRegistry {
+				t.Errorf("%s: mismatched datastore %v", tt.conf, ds)
+			}
+		}
+		for _, ct := range conf.ContentInfo {
+			if ct.Uuid != testImageID || ct.DsId != testDatastoreID || ct.URL != "library/nginx:1.21" || ct.DisplayName != "nginx" {
+				t.Errorf("%s: mismatched content tree %v", tt.conf, ct)
+			}
+		}
+		for _, v := range conf.Volumes {
+			if v.Origin.DownloadContentTreeID != testImageID {
+				t.Errorf("%s: mismatched volume %v", tt.conf, v)
+			}
+		}
+	}
+}
+
+func TestResolveRefsStable(t *testing.T) {
+	c := newTestCatalog(t)
+	conf := []byte(`{"volumes":[{"uuid":"v1","origin":{"downloadContentTreeID":{"$ref":"nginx"}}},` +
+		`{"uuid":"v2","origin":{"downloadContentTreeID":{"$ref":"nginx"}}}]}`)
+	first, err := ResolveRefs(conf, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		b, err := ResolveRefs(conf, c)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(b) != string(first) {
+			t.Errorf("mismatched resolved configs %s and %s", first, b)
+		}
+	}
+}
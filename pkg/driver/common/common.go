@@ -30,6 +30,15 @@ type MaxSizes struct {
 	MaxAppLogsSize  int
 }
 
+// Orphan data in the backing store without a matching device or onboarding certificate
+type Orphan struct {
+	// Key where the data is, e.g. a hash or stream name
+	Key string `json:"key"`
+	// Field within Key, if any, e.g. the device UUID in a hash
+	Field  string `json:"field,omitempty"`
+	Reason string `json:"reason"`
+}
+
 type BigData interface {
 	Get(index int) ([]byte, error)
 	Reader() (io.Reader, error)
@@ -0,0 +1,92 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// kinds of compression of stored messages
+const (
+	CompressionNone   = "none"
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// ParseCompression check the name of a kind of compression, empty meaning none
+func ParseCompression(s string) (string, error) {
+	switch s {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionZstd, CompressionSnappy:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown compression %q, must be one of none, zstd and snappy", s)
+}
+
+// Compress compress b with a kind of compression, returning it as is for none or an empty kind
+func Compress(kind string, b []byte) ([]byte, error) {
+	switch kind {
+	case "", CompressionNone:
+		return b, nil
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(b, nil), nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, b), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", kind)
+}
+
+// Decompress reverse Compress
+func Decompress(kind string, b []byte) ([]byte, error) {
+	switch kind {
+	case "", CompressionNone:
+		return b, nil
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		out, err := zstdDecoder.DecodeAll(b, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress zstd: %v", err)
+		}
+		return out, nil
+	case CompressionSnappy:
+		out, err := snappy.Decode(nil, b)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress snappy: %v", err)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", kind)
+}
+
+// initZstd create the zstd encoder and decoder on first use. Both are safe for concurrent use of EncodeAll and
+// DecodeAll, so they are shared
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	if zstdErr != nil {
+		return fmt.Errorf("unable to initialize zstd: %v", zstdErr)
+	}
+	return nil
+}
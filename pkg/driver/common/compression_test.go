@@ -0,0 +1,51 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	b := bytes.Repeat([]byte(`{"ztype":"ZiDevice","dinfo":{"machineArch":"x86_64"}}`), 100)
+	tests := []struct {
+		kind    string
+		smaller bool
+	}{
+		{"", false},
+		{CompressionNone, false},
+		{CompressionZstd, true},
+		{CompressionSnappy, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			kind, err := ParseCompression(tt.kind)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			c, err := Compress(kind, b)
+			if err != nil {
+				t.Fatalf("unexpected error compressing: %v", err)
+			}
+			if smaller := len(c) < len(b); smaller != tt.smaller {
+				t.Errorf("mismatched size, %d from %d", len(c), len(b))
+			}
+			out, err := Decompress(kind, c)
+			if err != nil {
+				t.Fatalf("unexpected error decompressing: %v", err)
+			}
+			if !bytes.Equal(out, b) {
+				t.Errorf("mismatched decompressed data")
+			}
+		})
+	}
+
+	if _, err := ParseCompression("gzip"); err == nil {
+		t.Errorf("expected an error for an unknown compression")
+	}
+	if _, err := Decompress(CompressionZstd, []byte("not zstd")); err == nil {
+		t.Errorf("expected an error for corrupt data")
+	}
+}
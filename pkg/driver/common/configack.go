@@ -0,0 +1,19 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ConfigAck the config a device last reported having, from the hash it sends when asking for its config
+type ConfigAck struct {
+	// Hash the config hash reported by the device
+	Hash string `json:"hash"`
+	// Config the config with that hash, as stored, if it is known
+	Config json.RawMessage `json:"config,omitempty"`
+	// Time when the device first reported the hash
+	Time time.Time `json:"time"`
+}
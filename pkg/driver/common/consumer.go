@@ -0,0 +1,25 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// StreamEntry an entry of a stream, as stored, with the ID to acknowledge it with
+type StreamEntry struct {
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// StreamConsumer a member of a consumer group of a stream. Each entry goes to one member of the group, and is read
+// again by that member until it acknowledges it
+type StreamConsumer interface {
+	// Read read up to count entries, waiting up to wait for one when there are none. Entries the member read before
+	// but did not acknowledge, e.g. before a restart, are read first
+	Read(count int, wait time.Duration) ([]StreamEntry, error)
+	// Ack acknowledge that entries were processed, so that they are not read again
+	Ack(ids ...string) error
+}
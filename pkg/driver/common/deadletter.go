@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import "time"
+
+// DeadLetter a message of a device that could not be parsed, kept as received with why it failed, so that it can
+// be looked at and replayed once the cause is fixed
+type DeadLetter struct {
+	ID       string    `json:"id"`
+	Received time.Time `json:"received"`
+	// Method, Path and ContentType those of the request, to replay it to the same endpoint
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	ContentType string `json:"content-type,omitempty"`
+	// Kind the kind of message, as for quotas
+	Kind string `json:"kind"`
+	// Device UUID of the device, if its certificate is registered
+	Device string `json:"device,omitempty"`
+	// Cert the client certificate the message was sent with, PEM encoded
+	Cert []byte `json:"cert,omitempty"`
+	// Reason why the message could not be parsed
+	Reason  string `json:"reason"`
+	Payload []byte `json:"payload,omitempty"`
+	// Size bytes of the payload as received, more than those kept if truncated
+	Size int64 `json:"size"`
+	// Truncated whether only the start of the payload was kept, as it was too large, in which case it cannot be
+	// replayed
+	Truncated bool `json:"truncated,omitempty"`
+	// Replays how many times the message was replayed and failed again
+	Replays int `json:"replays,omitempty"`
+}
+
+// DeadLetterAdd add a message of a device that could not be parsed, or replace the one with the same ID
+func DeadLetterAdd(s RecordStore, dl *DeadLetter) error {
+	return putJSON(s, RecordDeadLetters, dl.ID, dl)
+}
+
+// DeadLetterGet get a message that could not be parsed by ID. Return a *NotFoundError if there is none
+func DeadLetterGet(s RecordStore, id string) (*DeadLetter, error) {
+	var dl DeadLetter
+	if err := getJSON(s, RecordDeadLetters, id, &dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// DeadLetterList list the messages that could not be parsed
+func DeadLetterList(s RecordStore) ([]*DeadLetter, error) {
+	deadLetters := []*DeadLetter{}
+	err := listJSON(s, RecordDeadLetters, func() interface{} {
+		deadLetters = append(deadLetters, &DeadLetter{})
+		return deadLetters[len(deadLetters)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+// DeadLetterRemove remove a message that could not be parsed, once replayed or dismissed
+func DeadLetterRemove(s RecordStore, id string) error {
+	return s.RemoveRecord(RecordDeadLetters, id)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffCells beyond this many lines in a times lines in b, after dropping the common start and end, the lines in
+// between are shown as all removed and added rather than compared
+const maxDiffCells = 4 * 1024 * 1024
+
+// DiffLines a line by line diff of a and b, in the style of a unified diff: lines only in a start with "-", lines
+// only in b with "+", and up to context unchanged lines around each change with " ". Runs of unchanged lines
+// left out are marked with "@@ line <n> @@", n being the line in b. Empty if a and b are the same
+func DiffLines(a, b string, context int) string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	ops := diffOps(x, y)
+
+	var (
+		out     []string
+		changed bool
+		lineY   int
+	)
+	for i, op := range ops {
+		// the line in b of this op, or of the next one for a removal
+		n := lineY + 1
+		if op.kind != '-' {
+			lineY++
+		}
+		if op.kind != ' ' {
+			changed = true
+		}
+		// keep unchanged lines only near a change
+		if !wasNear(ops, i, context) {
+			continue
+		}
+		// mark where a hunk starts after skipped lines
+		if i > 0 && !wasNear(ops, i-1, context) {
+			out = append(out, fmt.Sprintf("@@ line %d @@", n))
+		}
+		out = append(out, string(op.kind)+op.line)
+	}
+	if !changed {
+		return ""
+	}
+	return strings.Join(out, "\n")
+}
+
+// wasNear whether the op at index i is within context lines of a change
+func wasNear(ops []diffOp, i, context int) bool {
+	for j := i - context; j <= i+context; j++ {
+		if j >= 0 && j < len(ops) && ops[j].kind != ' ' {
+			return true
+		}
+	}
+	return false
+}
+
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffOps the edits turning x into y, from their longest common subsequence
+func diffOps(x, y []string) []diffOp {
+	// the common start and end need no comparing
+	start := 0
+	for start < len(x) && start < len(y) && x[start] == y[start] {
+		start++
+	}
+	end := 0
+	for end < len(x)-start && end < len(y)-start && x[len(x)-1-end] == y[len(y)-1-end] {
+		end++
+	}
+	var ops []diffOp
+	for _, l := range x[:start] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	mx, my := x[start:len(x)-end], y[start:len(y)-end]
+	if len(mx)*len(my) > maxDiffCells {
+		for _, l := range mx {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range my {
+			ops = append(ops, diffOp{'+', l})
+		}
+	} else {
+		// lcs[i][j] length of the longest common subsequence of mx[i:] and my[j:]
+		lcs := make([][]int, len(mx)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(my)+1)
+		}
+		for i := len(mx) - 1; i >= 0; i-- {
+			for j := len(my) - 1; j >= 0; j-- {
+				switch {
+				case mx[i] == my[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(mx) || j < len(my) {
+			switch {
+			case i < len(mx) && j < len(my) && mx[i] == my[j]:
+				ops = append(ops, diffOp{' ', mx[i]})
+				i++
+				j++
+			case j == len(my) || (i < len(mx) && lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, diffOp{'-', mx[i]})
+				i++
+			default:
+				ops = append(ops, diffOp{'+', my[j]})
+				j++
+			}
+		}
+	}
+	for _, l := range x[len(x)-end:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	return ops
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	lines := func(l ...string) string {
+		return strings.Join(l, "\n")
+	}
+	tests := []struct {
+		name     string
+		a, b     string
+		context  int
+		expected string
+	}{
+		{"same", lines("a", "b"), lines("a", "b"), 1, ""},
+		{"added", lines("a", "b"), lines("a", "x", "b"), 1, lines(" a", "+x", " b")},
+		{"removed", lines("a", "b", "c"), lines("a", "c"), 0, lines("@@ line 2 @@", "-b")},
+		{"changed", lines("a", "b", "c", "d", "e", "f"), lines("a", "b", "c", "x", "e", "f"), 1, lines("@@ line 3 @@", " c", "-d", "+x", " e")},
+		{"two hunks", lines("a", "b", "c", "d", "e", "f", "g"), lines("x", "b", "c", "d", "e", "f", "y"), 1,
+			lines("-a", "+x", " b", "@@ line 6 @@", " f", "-g", "+y")},
+		{"from empty", "", lines("a"), 1, lines("-", "+a")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := DiffLines(tt.a, tt.b, tt.context); actual != tt.expected {
+				t.Errorf("mismatched diff, actual\n%s\nexpected\n%s", actual, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// encryptedPrefix marks a value as an encrypted envelope, sealed with the key of the record it is stored as, so
+	// that it cannot be moved to another record and still decrypt
+	encryptedPrefix = "adam:enc:v2:"
+	// legacyPrefix marks a value as an envelope of older releases, sealed without the key of its record. Such values,
+	// and plaintext ones, are only read by an Encryptor that is not strict, to migrate them
+	legacyPrefix = "adam:enc:v1:"
+	dataKeySize  = 32
+)
+
+// KeyWrapper wraps and unwraps per-object data keys with a master key. The master key
+// may live locally or in an external KMS.
+type KeyWrapper interface {
+	// WrapKey encrypt a data key with the master key
+	WrapKey([]byte) ([]byte, error)
+	// UnwrapKey decrypt a data key previously returned by WrapKey
+	UnwrapKey([]byte) ([]byte, error)
+}
+
+// Encryptor envelope-encrypts values before they are written to a backing store, and
+// decrypts them on read. A nil *Encryptor passes data through unchanged.
+type Encryptor struct {
+	wrapper KeyWrapper
+	// strict whether values in plaintext, or in the envelope of older releases, are refused rather than read as is
+	strict bool
+}
+
+// NewEncryptor create an Encryptor that protects its data keys with the given KeyWrapper. A strict one refuses to
+// read values that are not encrypted with the key of their record, so that a value written to the store in
+// plaintext, or moved from another record, is not taken as one it encrypted; one that is not reads them, to run
+// with a store whose values are still to be migrated, see Reencrypt
+func NewEncryptor(w KeyWrapper, strict bool) *Encryptor {
+	return &Encryptor{wrapper: w, strict: strict}
+}
+
+// Encrypt encrypt b, the value of the record named key, with a fresh data key, returning a text-safe envelope. The
+// key is authenticated with the value, so the envelope only decrypts as the value of the same record
+func (e *Encryptor) Encrypt(b []byte, key string) ([]byte, error) {
+	if e == nil || e.wrapper == nil {
+		return b, nil
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, fmt.Errorf("unable to generate data key: %v", err)
+	}
+	wrapped, err := e.wrapper.WrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to wrap data key: %v", err)
+	}
+	sealed, err := seal(dataKey, b, []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	// envelope: 2-byte wrapped key length | wrapped key | nonce+ciphertext
+	raw := make([]byte, 2, 2+len(wrapped)+len(sealed))
+	binary.BigEndian.PutUint16(raw, uint16(len(wrapped)))
+	raw = append(raw, wrapped...)
+	raw = append(raw, sealed...)
+
+	out := make([]byte, 0, len(encryptedPrefix)+base64.StdEncoding.EncodedLen(len(raw)))
+	out = append(out, encryptedPrefix...)
+	out = append(out, base64.StdEncoding.EncodeToString(raw)...)
+	return out, nil
+}
+
+// Decrypt reverse Encrypt for the value of the record named key. A strict Encryptor refuses values that are not
+// encrypted envelopes, or are envelopes of older releases; otherwise those are returned as is, or decrypted
+func (e *Encryptor) Decrypt(b []byte, key string) ([]byte, error) {
+	return e.decrypt(b, key, e != nil && e.strict)
+}
+
+// Reencrypt the value b of the record named key encrypted anew if it is in plaintext or in the envelope of older
+// releases, whether the Encryptor is strict or not, and whether it was, to migrate the values of a store to
+// encryption with the keys of their records. A value already encrypted so is returned as is
+func (e *Encryptor) Reencrypt(b []byte, key string) ([]byte, bool, error) {
+	if e == nil || e.wrapper == nil || bytes.HasPrefix(b, []byte(encryptedPrefix)) {
+		return b, false, nil
+	}
+	v, err := e.decrypt(b, key, false)
+	if err != nil {
+		return nil, false, err
+	}
+	if v, err = e.Encrypt(v, key); err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func (e *Encryptor) decrypt(b []byte, key string, strict bool) ([]byte, error) {
+	var aad []byte
+	switch {
+	case bytes.HasPrefix(b, []byte(encryptedPrefix)):
+		b, aad = b[len(encryptedPrefix):], []byte(key)
+	case !bytes.HasPrefix(b, []byte(legacyPrefix)):
+		if strict {
+			return nil, fmt.Errorf("value of %s is not encrypted; migrate the values stored before encryption was enabled", key)
+		}
+		return b, nil
+	case strict:
+		return nil, fmt.Errorf("value of %s is encrypted without its key, by an older release; migrate it to be read", key)
+	default:
+		b = b[len(legacyPrefix):]
+	}
+	if e == nil || e.wrapper == nil {
+		return nil, errors.New("value is encrypted, but no encryption key was configured")
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted envelope: %v", err)
+	}
+	if len(raw) < 2 {
+		return nil, errors.New("invalid encrypted envelope: too short")
+	}
+	keyLen := int(binary.BigEndian.Uint16(raw))
+	if len(raw) < 2+keyLen {
+		return nil, errors.New("invalid encrypted envelope: truncated data key")
+	}
+	dataKey, err := e.wrapper.UnwrapKey(raw[2 : 2+keyLen])
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key: %v", err)
+	}
+	v, err := open(dataKey, raw[2+keyLen:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the value of %s: %v", key, err)
+	}
+	return v, nil
+}
+
+// IsEncrypted report if b is an encrypted envelope, of this release or an older one
+func IsEncrypted(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(encryptedPrefix)) || bytes.HasPrefix(b, []byte(legacyPrefix))
+}
+
+// AESKeyWrapper wrap data keys locally with an AES master key
+type AESKeyWrapper struct {
+	key []byte
+}
+
+// NewAESKeyWrapper create a KeyWrapper from a 16, 24 or 32 byte AES key
+func NewAESKeyWrapper(key []byte) (*AESKeyWrapper, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("invalid AES key length %d, must be 16, 24 or 32 bytes", len(key))
+	}
+	return &AESKeyWrapper{key: key}, nil
+}
+
+// WrapKey encrypt a data key with the master key
+func (a *AESKeyWrapper) WrapKey(b []byte) ([]byte, error) {
+	return seal(a.key, b, nil)
+}
+
+// UnwrapKey decrypt a data key with the master key
+func (a *AESKeyWrapper) UnwrapKey(b []byte) ([]byte, error) {
+	return open(a.key, b, nil)
+}
+
+// ParseAESKey parse an AES key given either as base64 or as raw bytes
+func ParseAESKey(b []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(b)
+	if key, err := base64.StdEncoding.DecodeString(string(trimmed)); err == nil {
+		switch len(key) {
+		case 16, 24, 32:
+			return key, nil
+		}
+	}
+	switch len(b) {
+	case 16, 24, 32:
+		return b, nil
+	}
+	return nil, fmt.Errorf("key must be 16, 24 or 32 bytes, raw or base64-encoded")
+}
+
+// ReadAESKeyFile read an AES key from a file, raw or base64-encoded
+func ReadAESKeyFile(p string) ([]byte, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read encryption key file %s: %v", p, err)
+	}
+	return ParseAESKey(b)
+}
+
+// seal encrypt plaintext with AES-GCM, authenticating the additional data with it, returning the nonce and the
+// ciphertext
+func seal(key, plaintext, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create GCM: %v", err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %v", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// open reverse seal, with the same additional data
+func open(key, sealed, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create GCM: %v", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt: %v", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestEncryptor(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	wrapper, err := NewAESKeyWrapper(key)
+	if err != nil {
+		t.Fatalf("unexpected error creating key wrapper: %v", err)
+	}
+	e := NewEncryptor(wrapper, true)
+	lenient := NewEncryptor(wrapper, false)
+
+	t.Run("roundtrip", func(t *testing.T) {
+		plain := []byte("-----BEGIN CERTIFICATE-----\nabcdef\n-----END CERTIFICATE-----\n")
+		enc, err := e.Encrypt(plain, "device/a/cert")
+		if err != nil {
+			t.Fatalf("unexpected error encrypting: %v", err)
+		}
+		if !IsEncrypted(enc) {
+			t.Fatalf("encrypted value missing envelope prefix: %s", enc)
+		}
+		if bytes.Contains(enc, []byte("abcdef")) {
+			t.Errorf("encrypted value contains plaintext")
+		}
+		dec, err := e.Decrypt(enc, "device/a/cert")
+		if err != nil {
+			t.Fatalf("unexpected error decrypting: %v", err)
+		}
+		if !bytes.Equal(dec, plain) {
+			t.Errorf("mismatched roundtrip, actual %s expected %s", dec, plain)
+		}
+	})
+
+	t.Run("other record", func(t *testing.T) {
+		enc, _ := e.Encrypt([]byte("123456"), "device/a/serial")
+		if _, err := e.Decrypt(enc, "device/b/serial"); err == nil {
+			t.Errorf("a value moved to another record should fail to decrypt")
+		}
+		if _, err := lenient.Decrypt(enc, "device/b/serial"); err == nil {
+			t.Errorf("a value moved to another record should fail to decrypt when not strict")
+		}
+	})
+
+	t.Run("plaintext", func(t *testing.T) {
+		plain := []byte("123456")
+		if _, err := e.Decrypt(plain, "serial"); err == nil {
+			t.Errorf("a strict encryptor should refuse plaintext")
+		}
+		dec, err := lenient.Decrypt(plain, "serial")
+		if err != nil {
+			t.Fatalf("unexpected error decrypting plaintext: %v", err)
+		}
+		if !bytes.Equal(dec, plain) {
+			t.Errorf("mismatched plaintext, actual %s expected %s", dec, plain)
+		}
+	})
+
+	t.Run("legacy envelope", func(t *testing.T) {
+		plain := []byte("123456")
+		legacy := legacyEnvelope(t, wrapper, plain)
+		if _, err := e.Decrypt(legacy, "serial"); err == nil {
+			t.Errorf("a strict encryptor should refuse an envelope without the record key")
+		}
+		dec, err := lenient.Decrypt(legacy, "serial")
+		if err != nil || !bytes.Equal(dec, plain) {
+			t.Errorf("mismatched legacy value, actual %s %v expected %s", dec, err, plain)
+		}
+	})
+
+	t.Run("reencrypt", func(t *testing.T) {
+		plain := []byte("123456")
+		for _, v := range [][]byte{plain, legacyEnvelope(t, wrapper, plain)} {
+			enc, changed, err := e.Reencrypt(v, "serial")
+			if err != nil || !changed {
+				t.Fatalf("expected %s reencrypted, actual %v %v", v, changed, err)
+			}
+			if dec, err := e.Decrypt(enc, "serial"); err != nil || !bytes.Equal(dec, plain) {
+				t.Errorf("mismatched reencrypted value, actual %s %v expected %s", dec, err, plain)
+			}
+			if again, changed, err := e.Reencrypt(enc, "serial"); err != nil || changed || !bytes.Equal(again, enc) {
+				t.Errorf("expected a current envelope kept as is, actual %v %v", changed, err)
+			}
+		}
+	})
+
+	t.Run("nil encryptor", func(t *testing.T) {
+		var n *Encryptor
+		plain := []byte("123456")
+		enc, err := n.Encrypt(plain, "serial")
+		if err != nil || !bytes.Equal(enc, plain) {
+			t.Errorf("nil encryptor should pass through, got %s %v", enc, err)
+		}
+		if dec, err := n.Decrypt(plain, "serial"); err != nil || !bytes.Equal(dec, plain) {
+			t.Errorf("nil encryptor should pass plaintext through, got %s %v", dec, err)
+		}
+		enc, _ = e.Encrypt(plain, "serial")
+		if _, err := n.Decrypt(enc, "serial"); err == nil {
+			t.Errorf("nil encryptor should fail to decrypt encrypted data")
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		other, _ := NewAESKeyWrapper(bytes.Repeat([]byte{0x24}, 32))
+		enc, _ := e.Encrypt([]byte("123456"), "serial")
+		if _, err := NewEncryptor(other, true).Decrypt(enc, "serial"); err == nil {
+			t.Errorf("decrypting with the wrong key should fail")
+		}
+	})
+}
+
+// legacyEnvelope b encrypted as older releases did, without the key of its record
+func legacyEnvelope(t *testing.T, w KeyWrapper, b []byte) []byte {
+	dataKey := bytes.Repeat([]byte{0x07}, dataKeySize)
+	wrapped, err := w.WrapKey(dataKey)
+	if err != nil {
+		t.Fatalf("unexpected error wrapping data key: %v", err)
+	}
+	sealed, err := seal(dataKey, b, nil)
+	if err != nil {
+		t.Fatalf("unexpected error sealing: %v", err)
+	}
+	raw := []byte{byte(len(wrapped) >> 8), byte(len(wrapped))}
+	raw = append(append(raw, wrapped...), sealed...)
+	return []byte(legacyPrefix + base64.StdEncoding.EncodeToString(raw))
+}
+
+func TestParseAESKey(t *testing.T) {
+	raw := bytes.Repeat([]byte{0x01}, 16)
+	tests := []struct {
+		in  []byte
+		out []byte
+		err bool
+	}{
+		{raw, raw, false},
+		{[]byte(base64.StdEncoding.EncodeToString(raw) + "\n"), raw, false},
+		{[]byte("short"), nil, true},
+	}
+	for i, tt := range tests {
+		key, err := ParseAESKey(tt.in)
+		switch {
+		case (err != nil) != tt.err:
+			t.Errorf("%d: mismatched error, actual %v expected error %v", i, err, tt.err)
+		case !bytes.Equal(key, tt.out):
+			t.Errorf("%d: mismatched key, actual %x expected %x", i, key, tt.out)
+		}
+	}
+}
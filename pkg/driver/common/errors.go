@@ -35,3 +35,23 @@ type UsedSerialError struct {
 func (n *UsedSerialError) Error() string {
 	return n.Err
 }
+
+// UsedCertError error representing that a certificate is already used by a device
+type UsedCertError struct {
+	Err string
+}
+
+func (n *UsedCertError) Error() string {
+	return n.Err
+}
+
+// ConfigConflictError error representing that the config of a device is not the one it was to replace
+type ConfigConflictError struct {
+	Err string
+	// Current the config stored instead
+	Current []byte
+}
+
+func (n *ConfigConflictError) Error() string {
+	return n.Err
+}
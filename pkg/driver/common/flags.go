@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// flags of a device, altering how adam serves it
+const (
+	// FlagHoldConfig serve the device the config it was served when the flag was set, whatever its config changes to
+	FlagHoldConfig = "hold-config"
+	// FlagReadOnly refuse to change the config of the device
+	FlagReadOnly = "read-only"
+	// FlagVerboseDebug log each request of the device with its headers, whatever the log level
+	FlagVerboseDebug = "verbose-debug"
+)
+
+// deviceFlags the known flags
+var deviceFlags = []string{FlagHoldConfig, FlagReadOnly, FlagVerboseDebug}
+
+// ValidateDeviceFlag check that a flag is one adam knows
+func ValidateDeviceFlag(flag string) error {
+	for _, f := range deviceFlags {
+		if f == flag {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown device flag %q, must be one of %v", flag, deviceFlags)
+}
+
+// DeviceFlags the flags set on a device, with the config held while it has hold-config
+type DeviceFlags struct {
+	// Flags the flags set, sorted
+	Flags []string `json:"flags"`
+	// Held the config served to the device when hold-config was set, as served, with its hardware model
+	Held json.RawMessage `json:"held,omitempty"`
+	// HeldVersion the version of the held config
+	HeldVersion string `json:"held-version,omitempty"`
+	// Updated when the flags last changed
+	Updated time.Time `json:"updated"`
+}
+
+// Has whether a flag is set; no flags have none
+func (f *DeviceFlags) Has(flag string) bool {
+	if f == nil {
+		return false
+	}
+	for _, s := range f.Flags {
+		if s == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// Set set a flag, returning whether it was not set already
+func (f *DeviceFlags) Set(flag string) bool {
+	if f.Has(flag) {
+		return false
+	}
+	f.Flags = append(f.Flags, flag)
+	sort.Strings(f.Flags)
+	return true
+}
+
+// Unset clear a flag, returning whether it was set. Clearing hold-config releases the held config
+func (f *DeviceFlags) Unset(flag string) bool {
+	for i, s := range f.Flags {
+		if s == flag {
+			f.Flags = append(f.Flags[:i], f.Flags[i+1:]...)
+			if flag == FlagHoldConfig {
+				f.Held, f.HeldVersion = nil, ""
+			}
+			return true
+		}
+	}
+	return false
+}
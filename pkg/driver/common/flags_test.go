@@ -0,0 +1,50 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateDeviceFlag(t *testing.T) {
+	for _, flag := range []string{FlagHoldConfig, FlagReadOnly, FlagVerboseDebug} {
+		if err := ValidateDeviceFlag(flag); err != nil {
+			t.Errorf("unexpected error validating %s: %v", flag, err)
+		}
+	}
+	if err := ValidateDeviceFlag("hold"); err == nil {
+		t.Errorf("expected error validating an unknown flag")
+	}
+}
+
+func TestDeviceFlags(t *testing.T) {
+	var none *DeviceFlags
+	if none.Has(FlagReadOnly) {
+		t.Errorf("expected no flags to have none")
+	}
+	f := &DeviceFlags{}
+	if !f.Set(FlagVerboseDebug) || !f.Set(FlagHoldConfig) || f.Set(FlagHoldConfig) {
+		t.Errorf("mismatched changes setting flags")
+	}
+	if expected := []string{FlagHoldConfig, FlagVerboseDebug}; !reflect.DeepEqual(f.Flags, expected) {
+		t.Errorf("mismatched flags, actual %v expected %v", f.Flags, expected)
+	}
+	if !f.Has(FlagHoldConfig) || f.Has(FlagReadOnly) {
+		t.Errorf("mismatched flags set, actual %v", f.Flags)
+	}
+	f.Held, f.HeldVersion = []byte(`{"id":{"version":"3"}}`), "3"
+	if f.Unset(FlagReadOnly) {
+		t.Errorf("expected no change unsetting a flag not set")
+	}
+	if !f.Unset(FlagHoldConfig) {
+		t.Errorf("expected a change unsetting a flag set")
+	}
+	if f.Held != nil || f.HeldVersion != "" {
+		t.Errorf("expected the held config released, actual %s %s", f.Held, f.HeldVersion)
+	}
+	if expected := []string{FlagVerboseDebug}; !reflect.DeepEqual(f.Flags, expected) {
+		t.Errorf("mismatched flags, actual %v expected %v", f.Flags, expected)
+	}
+}
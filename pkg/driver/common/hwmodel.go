@@ -0,0 +1,137 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/config"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// HardwareModel the physical IO of a model of hardware, as the config of its devices describes it to EVE: its IO
+// adapters, the system adapters using them, and its manufacturer and product name. It is merged into the config served
+// to each device of the model, so that it need not be repeated in each of them
+type HardwareModel struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Config the deviceIoList, systemAdapterList, manufacturer and productName of the model, in JSON as in a config
+	Config  json.RawMessage `json:"config"`
+	Updated time.Time       `json:"updated"`
+}
+
+// NewHardwareModel a hardware model of the physical IO of a config, which must have nothing else. Each IO adapter
+// needs a phylabel, and each system adapter a name, by which they are merged
+func NewHardwareModel(name, description string, conf []byte) (*HardwareModel, error) {
+	switch {
+	case name == "":
+		return nil, fmt.Errorf("empty hardware model name")
+	case strings.ContainsAny(name, "/\\"):
+		return nil, fmt.Errorf("invalid hardware model name %q, it cannot have slashes", name)
+	}
+	var msg config.EdgeDevConfig
+	if err := protojson.Unmarshal(conf, &msg); err != nil {
+		return nil, fmt.Errorf("unable to read hardware model config: %v", err)
+	}
+	io := hardwareModelConfig(&msg)
+	if !proto.Equal(io, &msg) {
+		return nil, fmt.Errorf("a hardware model only has deviceIoList, systemAdapterList, manufacturer and productName")
+	}
+	for _, p := range io.DeviceIoList {
+		if p.GetPhylabel() == "" {
+			return nil, fmt.Errorf("IO adapter without a phylabel")
+		}
+	}
+	for _, a := range io.SystemAdapterList {
+		if a.GetName() == "" {
+			return nil, fmt.Errorf("system adapter without a name")
+		}
+	}
+	b, err := protojson.Marshal(io)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode hardware model config: %v", err)
+	}
+	return &HardwareModel{Name: name, Description: description, Config: b, Updated: time.Now()}, nil
+}
+
+// hardwareModelConfig the part of a config a hardware model has
+func hardwareModelConfig(conf *config.EdgeDevConfig) *config.EdgeDevConfig {
+	return &config.EdgeDevConfig{
+		DeviceIoList:      conf.DeviceIoList,
+		SystemAdapterList: conf.SystemAdapterList,
+		Manufacturer:      conf.Manufacturer,
+		ProductName:       conf.ProductName,
+	}
+}
+
+// Merge merge the physical IO of the model into a config: the IO adapters of a phylabel and the system adapters of
+// a name it does not have are added after its own, and the manufacturer and product name are set if it has none.
+// What the config has itself is kept, so that a device can override its model
+func (m *HardwareModel) Merge(conf *config.EdgeDevConfig) error {
+	var io config.EdgeDevConfig
+	if err := protojson.Unmarshal(m.Config, &io); err != nil {
+		return fmt.Errorf("unable to read hardware model %s: %v", m.Name, err)
+	}
+	phylabels := map[string]bool{}
+	for _, p := range conf.DeviceIoList {
+		phylabels[p.GetPhylabel()] = true
+	}
+	for _, p := range io.DeviceIoList {
+		if !phylabels[p.GetPhylabel()] {
+			conf.DeviceIoList = append(conf.DeviceIoList, p)
+		}
+	}
+	names := map[string]bool{}
+	for _, a := range conf.SystemAdapterList {
+		names[a.GetName()] = true
+	}
+	for _, a := range io.SystemAdapterList {
+		if !names[a.GetName()] {
+			conf.SystemAdapterList = append(conf.SystemAdapterList, a)
+		}
+	}
+	if conf.Manufacturer == "" {
+		conf.Manufacturer = io.Manufacturer
+	}
+	if conf.ProductName == "" {
+		conf.ProductName = io.ProductName
+	}
+	return nil
+}
+
+// HardwareModelAdd add a hardware model, or replace the one with the same name
+func HardwareModelAdd(s RecordStore, m *HardwareModel) error {
+	return putJSON(s, RecordHardwareModels, m.Name, m)
+}
+
+// HardwareModelGet get a hardware model by name. Return a *NotFoundError if there is none
+func HardwareModelGet(s RecordStore, name string) (*HardwareModel, error) {
+	var m HardwareModel
+	if err := getJSON(s, RecordHardwareModels, name, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// HardwareModelList list the hardware models
+func HardwareModelList(s RecordStore) ([]*HardwareModel, error) {
+	models := []*HardwareModel{}
+	err := listJSON(s, RecordHardwareModels, func() interface{} {
+		models = append(models, &HardwareModel{})
+		return models[len(models)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return models, nil
+}
+
+// HardwareModelRemove remove a hardware model
+func HardwareModelRemove(s RecordStore, name string) error {
+	return s.RemoveRecord(RecordHardwareModels, name)
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lf-edge/eve/api/go/config"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const testModelConfig = `{"deviceIoList":[{"ptype":"PhyIoNetEth","phylabel":"eth0","phyaddrs":{"ifname":"eth0"},"logicallabel":"eth0"},` +
+	`{"ptype":"PhyIoNetEth","phylabel":"eth1","phyaddrs":{"ifname":"eth1"},"logicallabel":"eth1"}],` +
+	`"systemAdapterList":[{"name":"eth0","uplink":true}],"manufacturer":"ACME","productName":"X1 Gateway"}`
+
+func TestNewHardwareModel(t *testing.T) {
+	m, err := NewHardwareModel("x1", "ACME X1", []byte(testModelConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.Name != "x1" || m.Description != "ACME X1" || m.Updated.IsZero() {
+		t.Errorf("mismatched hardware model %+v", m)
+	}
+
+	tests := []struct {
+		name string
+		conf string
+	}{
+		{"", testModelConfig},
+		{"../x1", testModelConfig},
+		{"x1", "{"},
+		{"x1", `{"deviceIoList":[{"ptype":"PhyIoNetEth"}]}`},
+		{"x1", `{"systemAdapterList":[{"uplink":true}]}`},
+		{"x1", `{"deviceIoList":[{"phylabel":"eth0"}],"maintenanceMode":true}`},
+	}
+	for _, tt := range tests {
+		if _, err := NewHardwareModel(tt.name, "", []byte(tt.conf)); err == nil {
+			t.Errorf("%q %s: expected an error", tt.name, tt.conf)
+		}
+	}
+}
+
+func TestHardwareModelMerge(t *testing.T) {
+	m, err := NewHardwareModel("x1", "", []byte(testModelConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the device has its own eth1 and system adapter of eth0, which are kept
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal([]byte(`{"deviceIoList":[{"ptype":"PhyIoNetEth","phylabel":"eth1","logicallabel":"wan"}],`+
+		`"systemAdapterList":[{"name":"eth0","uplink":false}],"productName":"X1 Custom"}`), &conf); err != nil {
+		t.Fatalf("unexpected error reading config: %v", err)
+	}
+	if err := m.Merge(&conf); err != nil {
+		t.Fatalf("unexpected error merging: %v", err)
+	}
+	var labels []string
+	for _, p := range conf.DeviceIoList {
+		labels = append(labels, p.Phylabel+"="+p.Logicallabel)
+	}
+	if strings.Join(labels, ",") != "eth1=wan,eth0=eth0" {
+		t.Errorf("mismatched IO adapters %v", labels)
+	}
+	if len(conf.SystemAdapterList) != 1 || conf.SystemAdapterList[0].Uplink {
+		t.Errorf("expected the system adapter of the device kept, got %v", conf.SystemAdapterList)
+	}
+	if conf.Manufacturer != "ACME" || conf.ProductName != "X1 Custom" {
+		t.Errorf("mismatched manufacturer and product name %q %q", conf.Manufacturer, conf.ProductName)
+	}
+}
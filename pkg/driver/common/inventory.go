@@ -0,0 +1,263 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/info"
+)
+
+// Inventory current state of a device, from the info messages it sent
+type Inventory struct {
+	// EVEVersion version of the active EVE image
+	EVEVersion string `json:"eve-version,omitempty"`
+	// Images EVE images in the partitions of the device
+	Images   []InventoryImage   `json:"images,omitempty"`
+	Hardware *InventoryHardware `json:"hardware,omitempty"`
+	Networks []InventoryNetwork `json:"networks,omitempty"`
+	// Apps app instances, by UUID
+	Apps []InventoryApp `json:"apps,omitempty"`
+	// RebootCounter the counter of the last reboot command in the config the device acted on
+	RebootCounter uint32 `json:"reboot-counter,omitempty"`
+	// Rebooting whether the device reported a reboot in progress
+	Rebooting bool `json:"rebooting,omitempty"`
+	// LastReboot when the device last rebooted, and why
+	LastReboot       *time.Time `json:"last-reboot,omitempty"`
+	LastRebootReason string     `json:"last-reboot-reason,omitempty"`
+	// DeviceUpdated when the device info was sent, that EVEVersion, Images, Hardware, Networks and the reboot are from
+	DeviceUpdated *time.Time `json:"device-updated,omitempty"`
+	// Updated when the latest info message was sent
+	Updated *time.Time `json:"updated,omitempty"`
+}
+
+// InventoryImage an EVE image in a partition
+type InventoryImage struct {
+	Partition string `json:"partition"`
+	Version   string `json:"version"`
+	// State of the image, e.g. INSTALLED
+	State     string `json:"state,omitempty"`
+	Activated bool   `json:"activated,omitempty"`
+	// Progress percentage of the image downloaded or installed, while it is
+	Progress uint32 `json:"progress,omitempty"`
+	// Error the error reported for the image, e.g. why it failed to install
+	Error string `json:"error,omitempty"`
+}
+
+// InventoryHardware the hardware of a device
+type InventoryHardware struct {
+	Manufacturer string `json:"manufacturer,omitempty"`
+	ProductName  string `json:"product-name,omitempty"`
+	Version      string `json:"version,omitempty"`
+	SerialNumber string `json:"serial-number,omitempty"`
+	MachineArch  string `json:"machine-arch,omitempty"`
+	CPUArch      string `json:"cpu-arch,omitempty"`
+	Platform     string `json:"platform,omitempty"`
+	CPUs         uint32 `json:"cpus,omitempty"`
+	// Memory and Storage in MB
+	Memory   uint64     `json:"memory,omitempty"`
+	Storage  uint64     `json:"storage,omitempty"`
+	HostName string     `json:"hostname,omitempty"`
+	BootTime *time.Time `json:"boot-time,omitempty"`
+}
+
+// InventoryNetwork a network interface of a device
+type InventoryNetwork struct {
+	// Name logical label of the interface
+	Name string `json:"name"`
+	// Interface name of the interface in the device, e.g. eth0
+	Interface string   `json:"interface,omitempty"`
+	MAC       string   `json:"mac,omitempty"`
+	IPs       []string `json:"ips,omitempty"`
+	Up        bool     `json:"up"`
+	// Uplink whether the interface is for management
+	Uplink bool `json:"uplink,omitempty"`
+}
+
+// InventoryApp an app instance on a device
+type InventoryApp struct {
+	UUID    string `json:"uuid"`
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	// State of the app instance, e.g. RUNNING
+	State string `json:"state"`
+	// Errors reported for the app instance
+	Errors []string `json:"errors,omitempty"`
+	// Updated when the app info was sent
+	Updated time.Time `json:"updated"`
+}
+
+// states of a reboot or an EVE update of a device
+const (
+	// DeviceOpNone the config has no reboot command, or no EVE image to update to
+	DeviceOpNone = "none"
+	// DeviceOpPending the device has not reported acting on the config yet
+	DeviceOpPending = "pending"
+	// DeviceOpInProgress the device reported rebooting, or downloading or installing the EVE image
+	DeviceOpInProgress = "in-progress"
+	// DeviceOpDone the device reported acting on the reboot command, or running the EVE version
+	DeviceOpDone = "done"
+	// DeviceOpFailed the device reported an error for the EVE image
+	DeviceOpFailed = "failed"
+)
+
+// RebootState the state of the reboot command of the config with a counter, from what the device reported
+func (inv *Inventory) RebootState(counter uint32) string {
+	switch {
+	case counter == 0:
+		return DeviceOpNone
+	case inv.RebootCounter >= counter:
+		return DeviceOpDone
+	case inv.Rebooting:
+		return DeviceOpInProgress
+	}
+	return DeviceOpPending
+}
+
+// BaseOSState the state of the update of the device to an EVE version, from what the device reported, with the image
+// of the version in a partition of the device, nil if there is none
+func (inv *Inventory) BaseOSState(version string) (string, *InventoryImage) {
+	if version == "" {
+		return DeviceOpNone, nil
+	}
+	var image *InventoryImage
+	for i := range inv.Images {
+		if inv.Images[i].Version == version {
+			image = &inv.Images[i]
+		}
+	}
+	switch {
+	case inv.EVEVersion == version:
+		return DeviceOpDone, image
+	case image == nil:
+		return DeviceOpPending, nil
+	case image.Error != "":
+		return DeviceOpFailed, image
+	}
+	return DeviceOpInProgress, image
+}
+
+// Update update the inventory with an info message sent at the time it has, or now if it has none. Messages older
+// than what the inventory has are ignored, as EVE resends the ones it could not send in time. Returns whether the
+// inventory changed
+func (inv *Inventory) Update(msg *info.ZInfoMsg, now time.Time) bool {
+	at := now
+	if ts := msg.GetAtTimeStamp(); ts != nil {
+		at = ts.AsTime()
+	}
+	switch {
+	case msg.GetDinfo() != nil:
+		if inv.DeviceUpdated != nil && at.Before(*inv.DeviceUpdated) {
+			return false
+		}
+		inv.updateDevice(msg.GetDinfo())
+		inv.DeviceUpdated = &at
+	case msg.GetAinfo() != nil:
+		if !inv.updateApp(msg.GetAinfo(), at) {
+			return false
+		}
+	default:
+		return false
+	}
+	if inv.Updated == nil || at.After(*inv.Updated) {
+		inv.Updated = &at
+	}
+	return true
+}
+
+func (inv *Inventory) updateDevice(d *info.ZInfoDevice) {
+	inv.EVEVersion = ""
+	inv.Images = nil
+	for _, sw := range d.GetSwList() {
+		inv.Images = append(inv.Images, InventoryImage{
+			Partition: sw.GetPartitionLabel(),
+			Version:   sw.GetShortVersion(),
+			State:     sw.GetStatus().String(),
+			Activated: sw.GetActivated(),
+			Progress:  sw.GetSubStatusProgress(),
+			Error:     sw.GetSwErr().GetDescription(),
+		})
+		if sw.GetActivated() {
+			inv.EVEVersion = sw.GetShortVersion()
+		}
+	}
+	m := d.GetMinfo()
+	inv.Hardware = &InventoryHardware{
+		Manufacturer: m.GetManufacturer(),
+		ProductName:  m.GetProductName(),
+		Version:      m.GetVersion(),
+		SerialNumber: m.GetSerialNumber(),
+		MachineArch:  d.GetMachineArch(),
+		CPUArch:      d.GetCpuArch(),
+		Platform:     d.GetPlatform(),
+		CPUs:         d.GetNcpu(),
+		Memory:       d.GetMemory(),
+		Storage:      d.GetStorage(),
+		HostName:     d.GetHostName(),
+	}
+	if d.GetBootTime() != nil {
+		t := d.GetBootTime().AsTime()
+		inv.Hardware.BootTime = &t
+	}
+	inv.RebootCounter = d.GetRebootConfigCounter()
+	inv.Rebooting = d.GetRebootInprogress()
+	inv.LastReboot = nil
+	if d.GetLastRebootTime() != nil {
+		t := d.GetLastRebootTime().AsTime()
+		inv.LastReboot = &t
+	}
+	inv.LastRebootReason = d.GetLastRebootReason()
+	inv.Networks = nil
+	for _, n := range d.GetNetwork() {
+		inv.Networks = append(inv.Networks, InventoryNetwork{
+			Name:      n.GetDevName(),
+			Interface: n.GetLocalName(),
+			MAC:       n.GetMacAddr(),
+			IPs:       n.GetIPAddrs(),
+			Up:        n.GetUp(),
+			Uplink:    n.GetUplink(),
+		})
+	}
+}
+
+// updateApp update or add an app instance, or remove it if EVE reports it with only its UUID, as it does for those
+// deleted. Returns whether the inventory changed
+func (inv *Inventory) updateApp(a *info.ZInfoApp, at time.Time) bool {
+	u := strings.ToLower(a.GetAppID())
+	if u == "" {
+		return false
+	}
+	i := sort.Search(len(inv.Apps), func(i int) bool { return inv.Apps[i].UUID >= u })
+	found := i < len(inv.Apps) && inv.Apps[i].UUID == u
+	if found && at.Before(inv.Apps[i].Updated) {
+		return false
+	}
+	if a.GetAppName() == "" && a.GetState() == info.ZSwState_INVALID {
+		if !found {
+			return false
+		}
+		inv.Apps = append(inv.Apps[:i], inv.Apps[i+1:]...)
+		return true
+	}
+	app := InventoryApp{
+		UUID:    u,
+		Name:    a.GetAppName(),
+		Version: a.GetAppVersion(),
+		State:   a.GetState().String(),
+		Updated: at,
+	}
+	for _, e := range a.GetAppErr() {
+		app.Errors = append(app.Errors, e.GetDescription())
+	}
+	if found {
+		inv.Apps[i] = app
+		return true
+	}
+	inv.Apps = append(inv.Apps, InventoryApp{})
+	copy(inv.Apps[i+1:], inv.Apps[i:])
+	inv.Apps[i] = app
+	return true
+}
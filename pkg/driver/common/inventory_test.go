@@ -0,0 +1,170 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/info"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestInventoryUpdate(t *testing.T) {
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *timestamppb.Timestamp {
+		return timestamppb.New(start.Add(d))
+	}
+	device := func(ts *timestamppb.Timestamp, version string) *info.ZInfoMsg {
+		return &info.ZInfoMsg{
+			Ztype:       info.ZInfoTypes_ZiDevice,
+			AtTimeStamp: ts,
+			InfoContent: &info.ZInfoMsg_Dinfo{Dinfo: &info.ZInfoDevice{
+				MachineArch: "x86_64",
+				Ncpu:        4,
+				Memory:      8192,
+				Minfo:       &info.ZInfoManufacturer{Manufacturer: "QEMU", SerialNumber: "31415926"},
+				Network: []*info.ZInfoNetwork{
+					{DevName: "eth0", LocalName: "eth0", MacAddr: "52:54:00:12:34:56", IPAddrs: []string{"10.0.2.15"}, Up: true, Uplink: true},
+				},
+				SwList: []*info.ZInfoDevSW{
+					{PartitionLabel: "IMGA", ShortVersion: version, Activated: true, Status: info.ZSwState_INSTALLED},
+					{PartitionLabel: "IMGB", ShortVersion: "6.0.0", Status: info.ZSwState_INITIAL},
+				},
+			}},
+		}
+	}
+	app := func(ts *timestamppb.Timestamp, id, name string, state info.ZSwState) *info.ZInfoMsg {
+		return &info.ZInfoMsg{
+			Ztype:       info.ZInfoTypes_ZiApp,
+			AtTimeStamp: ts,
+			InfoContent: &info.ZInfoMsg_Ainfo{Ainfo: &info.ZInfoApp{AppID: id, AppName: name, State: state}},
+		}
+	}
+	apps := func(inv *Inventory) []string {
+		var s []string
+		for _, a := range inv.Apps {
+			s = append(s, a.UUID+" "+a.State)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name     string
+		msgs     []*info.ZInfoMsg
+		changed  []bool
+		version  string
+		apps     []string
+		networks int
+	}{
+		{
+			name:     "device",
+			msgs:     []*info.ZInfoMsg{device(at(0), "6.1.0")},
+			changed:  []bool{true},
+			version:  "6.1.0",
+			networks: 1,
+		},
+		{
+			name:     "older device info ignored",
+			msgs:     []*info.ZInfoMsg{device(at(time.Minute), "6.1.0"), device(at(0), "6.0.0")},
+			changed:  []bool{true, false},
+			version:  "6.1.0",
+			networks: 1,
+		},
+		{
+			name:     "newer device info replaces",
+			msgs:     []*info.ZInfoMsg{device(at(0), "6.0.0"), device(at(time.Minute), "6.1.0")},
+			changed:  []bool{true, true},
+			version:  "6.1.0",
+			networks: 1,
+		},
+		{
+			name: "apps sorted and updated",
+			msgs: []*info.ZInfoMsg{
+				app(at(0), "B0000000-0000-0000-0000-000000000000", "web", info.ZSwState_BOOTING),
+				app(at(0), "a0000000-0000-0000-0000-000000000000", "db", info.ZSwState_RUNNING),
+				app(at(time.Minute), "b0000000-0000-0000-0000-000000000000", "web", info.ZSwState_RUNNING),
+			},
+			changed: []bool{true, true, true},
+			apps:    []string{"a0000000-0000-0000-0000-000000000000 RUNNING", "b0000000-0000-0000-0000-000000000000 RUNNING"},
+		},
+		{
+			name: "app removed",
+			msgs: []*info.ZInfoMsg{
+				app(at(0), "a0000000-0000-0000-0000-000000000000", "db", info.ZSwState_RUNNING),
+				app(at(time.Minute), "a0000000-0000-0000-0000-000000000000", "", info.ZSwState_INVALID),
+				app(at(time.Minute), "c0000000-0000-0000-0000-000000000000", "", info.ZSwState_INVALID),
+			},
+			changed: []bool{true, true, false},
+		},
+		{
+			name:    "other info ignored",
+			msgs:    []*info.ZInfoMsg{{Ztype: info.ZInfoTypes_ZiVolume, InfoContent: &info.ZInfoMsg_Vinfo{Vinfo: &info.ZInfoVolume{}}}},
+			changed: []bool{false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := &Inventory{}
+			for i, msg := range tt.msgs {
+				if changed := inv.Update(msg, start); changed != tt.changed[i] {
+					t.Errorf("mismatched change at message %d, actual %v expected %v", i, changed, tt.changed[i])
+				}
+			}
+			if inv.EVEVersion != tt.version {
+				t.Errorf("mismatched EVE version, actual %s expected %s", inv.EVEVersion, tt.version)
+			}
+			if a := apps(inv); !reflect.DeepEqual(a, tt.apps) {
+				t.Errorf("mismatched apps, actual %v expected %v", a, tt.apps)
+			}
+			if len(inv.Networks) != tt.networks {
+				t.Errorf("mismatched networks, actual %d expected %d", len(inv.Networks), tt.networks)
+			}
+		})
+	}
+}
+
+func TestInventoryRebootState(t *testing.T) {
+	tests := []struct {
+		name    string
+		inv     Inventory
+		counter uint32
+		expect  string
+	}{
+		{"no reboot", Inventory{}, 0, DeviceOpNone},
+		{"not acted on", Inventory{RebootCounter: 1}, 2, DeviceOpPending},
+		{"rebooting", Inventory{RebootCounter: 1, Rebooting: true}, 2, DeviceOpInProgress},
+		{"acted on", Inventory{RebootCounter: 2}, 2, DeviceOpDone},
+	}
+	for _, tt := range tests {
+		if state := tt.inv.RebootState(tt.counter); state != tt.expect {
+			t.Errorf("%s: mismatched state, actual %s expected %s", tt.name, state, tt.expect)
+		}
+	}
+}
+
+func TestInventoryBaseOSState(t *testing.T) {
+	running := InventoryImage{Partition: "IMGA", Version: "6.0.0", Activated: true}
+	tests := []struct {
+		name    string
+		images  []InventoryImage
+		version string
+		expect  string
+		image   bool
+	}{
+		{"no update", []InventoryImage{running}, "", DeviceOpNone, false},
+		{"not downloaded", []InventoryImage{running}, "6.1.0", DeviceOpPending, false},
+		{"installing", []InventoryImage{running, {Partition: "IMGB", Version: "6.1.0", State: "INSTALLED", Progress: 50}}, "6.1.0", DeviceOpInProgress, true},
+		{"failed", []InventoryImage{running, {Partition: "IMGB", Version: "6.1.0", Error: "no space"}}, "6.1.0", DeviceOpFailed, true},
+		{"running", []InventoryImage{running}, "6.0.0", DeviceOpDone, true},
+	}
+	for _, tt := range tests {
+		inv := Inventory{EVEVersion: "6.0.0", Images: tt.images}
+		state, image := inv.BaseOSState(tt.version)
+		if state != tt.expect || (image != nil) != tt.image {
+			t.Errorf("%s: mismatched state, actual %s with image %v expected %s", tt.name, state, image, tt.expect)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// inventoryOps the operators of inventory conditions, two character ones first, as they are looked for in order
+var inventoryOps = []string{"==", "!=", "<=", ">=", "<", ">", "~"}
+
+// InventoryCondition a condition on the inventory of a device, as a field, an operator and a value, e.g.
+// eve-version<9.0, apps[name=web*].state==ERROR or networks[interface=eth0].ips==
+type InventoryCondition struct {
+	// Field dot separated path to a field of the inventory, as JSON, e.g. hardware.memory. A list on the way can be
+	// narrowed to the elements whose fields match patterns, as for path.Match, e.g. apps[name=web*][state=ERROR]
+	Field string
+	// Op one of ==, !=, <, <=, >, >= and ~, to match the value as a pattern, as for path.Match
+	Op string
+	// Value compared with the field, as a number if both are, otherwise as a version, so that 9.10.0 > 9.9.0.
+	// Empty, == holds if the field is missing or an empty list, and != if it is not
+	Value string
+	steps []inventoryStep
+}
+
+// inventoryStep a key of the path of an InventoryCondition, with the filters on the elements of the list there
+type inventoryStep struct {
+	key     string
+	filters [][2]string
+}
+
+// ParseInventoryCondition parse a condition on the inventory of a device, as <field><op><value>
+func ParseInventoryCondition(s string) (*InventoryCondition, error) {
+	field, op, value := splitInventoryCondition(s)
+	if op == "" {
+		return nil, fmt.Errorf("no operator, must be one of %s", strings.Join(inventoryOps, ", "))
+	}
+	if op == "~" {
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %s: %v", value, err)
+		}
+	}
+	if value == "" && op != "==" && op != "!=" {
+		return nil, fmt.Errorf("an empty value is only for == and !=")
+	}
+	steps, err := parseInventoryField(field)
+	if err != nil {
+		return nil, err
+	}
+	return &InventoryCondition{Field: field, Op: op, Value: value, steps: steps}, nil
+}
+
+// splitInventoryCondition split a condition at its first operator outside of filters
+func splitInventoryCondition(s string) (field, op, value string) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+			continue
+		case ']':
+			depth--
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+		for _, o := range inventoryOps {
+			if strings.HasPrefix(s[i:], o) {
+				return strings.TrimSpace(s[:i]), o, strings.TrimSpace(s[i+len(o):])
+			}
+		}
+	}
+	return s, "", ""
+}
+
+func parseInventoryField(field string) ([]inventoryStep, error) {
+	if field == "" {
+		return nil, fmt.Errorf("no field")
+	}
+	var steps []inventoryStep
+	for _, part := range strings.Split(field, ".") {
+		i := strings.IndexByte(part, '[')
+		if i < 0 {
+			i = len(part)
+		}
+		step := inventoryStep{key: part[:i]}
+		if step.key == "" {
+			return nil, fmt.Errorf("bad field %s: empty key", field)
+		}
+		for rest := part[i:]; rest != ""; {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("bad field %s: filters must be [<key>=<pattern>]", field)
+			}
+			kv := strings.SplitN(rest[1:end], "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("bad field %s: filters must be [<key>=<pattern>]", field)
+			}
+			if _, err := path.Match(kv[1], ""); err != nil {
+				return nil, fmt.Errorf("bad pattern %s: %v", kv[1], err)
+			}
+			step.filters = append(step.filters, [2]string{kv[0], kv[1]})
+			rest = rest[end+1:]
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// Search whether the inventory matches all the conditions, returning the values of the fields that matched each,
+// by field; a condition on a missing field has no values
+func (inv *Inventory) Search(conditions []*InventoryCondition) (map[string][]string, bool) {
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return nil, false
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, false
+	}
+	matched := map[string][]string{}
+	for _, c := range conditions {
+		values, ok := c.match(doc)
+		if !ok {
+			return nil, false
+		}
+		if matched[c.Field] == nil {
+			matched[c.Field] = []string{}
+		}
+		matched[c.Field] = append(matched[c.Field], values...)
+	}
+	return matched, true
+}
+
+// match whether a condition holds for an inventory decoded from JSON, with the values that compared
+func (c *InventoryCondition) match(doc interface{}) ([]string, bool) {
+	values := inventoryValues(doc, c.steps)
+	if c.Value == "" && (c.Op == "==" || c.Op == "!=") {
+		return values, (len(values) == 0) == (c.Op == "==")
+	}
+	var matched []string
+	for _, v := range values {
+		if compareInventory(v, c.Op, c.Value) {
+			matched = append(matched, v)
+		}
+	}
+	return matched, len(matched) > 0
+}
+
+// inventoryValues the values at a path, as strings, going through every element of the lists on the way that its
+// filters match. The elements of a list at the end are values of their own
+func inventoryValues(doc interface{}, steps []inventoryStep) []string {
+	var values []string
+	var walk func(v interface{}, steps []inventoryStep)
+	walk = func(v interface{}, steps []inventoryStep) {
+		if len(steps) == 0 {
+			if l, ok := v.([]interface{}); ok {
+				for _, e := range l {
+					values = append(values, inventoryString(e))
+				}
+			} else if v != nil {
+				values = append(values, inventoryString(v))
+			}
+			return
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return
+		}
+		next, step := m[steps[0].key], steps[0]
+		l, isList := next.([]interface{})
+		if !isList {
+			if len(step.filters) == 0 {
+				walk(next, steps[1:])
+			}
+			return
+		}
+		var kept []interface{}
+		for _, e := range l {
+			if inventoryFiltered(e, step.filters) {
+				kept = append(kept, e)
+			}
+		}
+		if len(steps) == 1 {
+			walk(kept, nil)
+			return
+		}
+		for _, e := range kept {
+			walk(e, steps[1:])
+		}
+	}
+	walk(doc, steps)
+	return values
+}
+
+// inventoryFiltered whether an element of a list matches all the filters on it
+func inventoryFiltered(e interface{}, filters [][2]string) bool {
+	m, ok := e.(map[string]interface{})
+	if !ok {
+		return len(filters) == 0
+	}
+	for _, f := range filters {
+		v, present := m[f[0]]
+		if !present {
+			return false
+		}
+		if ok, _ := path.Match(f[1], inventoryString(v)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func inventoryString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(s)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func compareInventory(v, op, value string) bool {
+	if op == "~" {
+		ok, _ := path.Match(value, v)
+		return ok
+	}
+	c := compareVersions(v, value)
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// compareVersions compare two values as numbers if both are, otherwise as versions, by their runs of digits,
+// compared as numbers, and of other characters, compared as strings
+func compareVersions(a, b string) int {
+	if fa, err := strconv.ParseFloat(a, 64); err == nil {
+		if fb, err := strconv.ParseFloat(b, 64); err == nil {
+			switch {
+			case fa < fb:
+				return -1
+			case fa > fb:
+				return 1
+			}
+			return 0
+		}
+	}
+	ra, rb := versionRuns(a), versionRuns(b)
+	for i := 0; i < len(ra) && i < len(rb); i++ {
+		if c := compareRun(ra[i], rb[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(ra) < len(rb):
+		return -1
+	case len(ra) > len(rb):
+		return 1
+	}
+	return 0
+}
+
+// versionRuns split a version into its runs of digits and of other characters
+func versionRuns(s string) []string {
+	var runs []string
+	for i := 0; i < len(s); {
+		j := i + 1
+		for j < len(s) && isDigit(s[j]) == isDigit(s[i]) {
+			j++
+		}
+		runs = append(runs, s[i:j])
+		i = j
+	}
+	return runs
+}
+
+func compareRun(a, b string) int {
+	if !isDigit(a[0]) || !isDigit(b[0]) {
+		return strings.Compare(a, b)
+	}
+	// compared as numbers of any length: the longer without leading zeros is the larger, else lexically
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInventoryCondition(t *testing.T) {
+	tests := []struct {
+		condition string
+		field     string
+		op        string
+		value     string
+		valid     bool
+	}{
+		{"eve-version<9.0", "eve-version", "<", "9.0", true},
+		{"hardware.memory >= 4096", "hardware.memory", ">=", "4096", true},
+		{"apps[name=web*].state==ERROR", "apps[name=web*].state", "==", "ERROR", true},
+		{"networks[interface=eth0].ips==", "networks[interface=eth0].ips", "==", "", true},
+		{"hardware.product-name~*Gateway*", "hardware.product-name", "~", "*Gateway*", true},
+		{"eve-version", "", "", "", false},
+		{"==9.0", "", "", "", false},
+		{"eve-version<", "", "", "", false},
+		{"apps[name].state==ERROR", "", "", "", false},
+		{"apps[name=web.state==ERROR", "", "", "", false},
+		{"apps..state==ERROR", "", "", "", false},
+	}
+	for _, tt := range tests {
+		c, err := ParseInventoryCondition(tt.condition)
+		switch {
+		case tt.valid && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.condition, err)
+		case !tt.valid && err == nil:
+			t.Errorf("%s: expected an error", tt.condition)
+		case tt.valid && (c.Field != tt.field || c.Op != tt.op || c.Value != tt.value):
+			t.Errorf("%s: mismatched condition, actual %s %s %s", tt.condition, c.Field, c.Op, c.Value)
+		}
+	}
+}
+
+func TestInventorySearch(t *testing.T) {
+	inv := &Inventory{
+		EVEVersion: "9.10.0-kvm-amd64",
+		Hardware:   &InventoryHardware{Memory: 4096, ProductName: "X1 Gateway"},
+		Networks: []InventoryNetwork{
+			{Name: "uplink", Interface: "eth0", IPs: []string{"10.0.0.2"}, Up: true},
+			{Name: "local", Interface: "eth1"},
+		},
+		Apps: []InventoryApp{
+			{UUID: "a", Name: "web-1", State: "RUNNING"},
+			{UUID: "b", Name: "web-2", State: "ERROR", Errors: []string{"no image"}},
+		},
+	}
+	tests := []struct {
+		name       string
+		conditions []string
+		matched    map[string][]string
+	}{
+		{"older EVE", []string{"eve-version<9.9.0"}, nil},
+		{"newer EVE", []string{"eve-version>9.9.0"}, map[string][]string{"eve-version": {"9.10.0-kvm-amd64"}}},
+		{"memory", []string{"hardware.memory>=2048"}, map[string][]string{"hardware.memory": {"4096"}}},
+		{"app in error", []string{"apps[name=web*].state==ERROR"}, map[string][]string{"apps[name=web*].state": {"ERROR"}}},
+		{"named app in error", []string{"apps[name=web-1].state==ERROR"}, nil},
+		{"app errors", []string{"apps[state=ERROR].errors~*image*"}, map[string][]string{"apps[state=ERROR].errors": {"no image"}}},
+		{"interface without IP", []string{"networks[interface=eth1].ips=="}, map[string][]string{"networks[interface=eth1].ips": {}}},
+		{"interface with IP", []string{"networks[interface=eth0].ips=="}, nil},
+		{"interface down", []string{"networks[up=false].interface==eth1"}, map[string][]string{"networks[up=false].interface": {"eth1"}}},
+		{"missing field", []string{"last-reboot-reason!="}, nil},
+		{"all conditions", []string{"eve-version>=9.10", "hardware.product-name~*Gateway"}, map[string][]string{"eve-version": {"9.10.0-kvm-amd64"}, "hardware.product-name": {"X1 Gateway"}}},
+		{"one condition failing", []string{"eve-version>=9.10", "hardware.memory<1024"}, nil},
+	}
+	for _, tt := range tests {
+		var conditions []*InventoryCondition
+		for _, s := range tt.conditions {
+			c, err := ParseInventoryCondition(s)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", tt.name, err)
+			}
+			conditions = append(conditions, c)
+		}
+		matched, ok := inv.Search(conditions)
+		if ok != (tt.matched != nil) {
+			t.Errorf("%s: mismatched match, actual %v expected %v", tt.name, ok, tt.matched != nil)
+			continue
+		}
+		if ok && !reflect.DeepEqual(matched, tt.matched) {
+			t.Errorf("%s: mismatched fields, actual %v expected %v", tt.name, matched, tt.matched)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		expect int
+	}{
+		{"9.10.0", "9.9.0", 1},
+		{"9.9.0", "9.10.0", -1},
+		{"9.4.0-kvm-amd64", "9.4.0-kvm-amd64", 0},
+		{"9.4", "9.4.0", -1},
+		{"4096", "4096.0", 0},
+		{"0.0.0-master-1234", "10.1.0", -1},
+		{"RUNNING", "HALTED", 1},
+	}
+	for _, tt := range tests {
+		if c := compareVersions(tt.a, tt.b); c != tt.expect {
+			t.Errorf("%s %s: mismatched comparison, actual %d expected %d", tt.a, tt.b, c, tt.expect)
+		}
+	}
+}
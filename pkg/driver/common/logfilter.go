@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// severities rank of the log severities EVE and its apps use, from logrus and syslog, higher being more severe
+var severities = map[string]int{
+	"trace":     0,
+	"debug":     1,
+	"info":      2,
+	"notice":    3,
+	"warn":      4,
+	"warning":   4,
+	"err":       5,
+	"error":     5,
+	"crit":      6,
+	"critical":  6,
+	"alert":     7,
+	"emerg":     8,
+	"emergency": 8,
+	"fatal":     8,
+	"panic":     8,
+}
+
+// LogFilter filter of the log entries of a device, applied as they are received, before they are stored
+type LogFilter struct {
+	// MinSeverity severity below which entries are filtered, e.g. "info"; empty keeps all entries
+	MinSeverity string `json:"min-severity,omitempty"`
+	// Sample keep one of every Sample entries below MinSeverity, instead of dropping all of them; 0 drops all
+	Sample int `json:"sample,omitempty"`
+}
+
+// SeverityLevel the rank of a log severity, higher being more severe, and whether it is known. Case insensitive
+func SeverityLevel(s string) (int, bool) {
+	l, ok := severities[strings.ToLower(strings.TrimSpace(s))]
+	return l, ok
+}
+
+// Validate check the severity is known and the sample is not negative
+func (f LogFilter) Validate() error {
+	if f.MinSeverity != "" {
+		if _, ok := SeverityLevel(f.MinSeverity); !ok {
+			return fmt.Errorf("unknown severity %q", f.MinSeverity)
+		}
+	}
+	if f.Sample < 0 {
+		return fmt.Errorf("invalid sample %d, must not be negative", f.Sample)
+	}
+	return nil
+}
+
+// Below whether an entry of a severity is below the minimum severity of the filter. Entries of an unknown
+// severity are never below it, so that nothing is dropped for lack of a severity
+func (f LogFilter) Below(severity string) bool {
+	if f.MinSeverity == "" {
+		return false
+	}
+	min, ok := SeverityLevel(f.MinSeverity)
+	if !ok {
+		return false
+	}
+	l, ok := SeverityLevel(severity)
+	return ok && l < min
+}
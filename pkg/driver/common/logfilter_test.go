@@ -0,0 +1,58 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+)
+
+func TestLogFilterBelow(t *testing.T) {
+	tests := []struct {
+		filter   LogFilter
+		severity string
+		below    bool
+	}{
+		{LogFilter{}, "debug", false},
+		{LogFilter{MinSeverity: "info"}, "debug", true},
+		{LogFilter{MinSeverity: "info"}, "trace", true},
+		{LogFilter{MinSeverity: "info"}, "info", false},
+		{LogFilter{MinSeverity: "info"}, "error", false},
+		{LogFilter{MinSeverity: "warning"}, "notice", true},
+		{LogFilter{MinSeverity: "warning"}, "WARN", false},
+		{LogFilter{MinSeverity: "err"}, "warning", true},
+		{LogFilter{MinSeverity: "err"}, "", false},
+		{LogFilter{MinSeverity: "err"}, "verbose", false},
+		{LogFilter{MinSeverity: "unknown"}, "debug", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter.MinSeverity+"/"+tt.severity, func(t *testing.T) {
+			if below := tt.filter.Below(tt.severity); below != tt.below {
+				t.Errorf("mismatched below, actual %v expected %v", below, tt.below)
+			}
+		})
+	}
+}
+
+func TestLogFilterValidate(t *testing.T) {
+	tests := []struct {
+		filter LogFilter
+		valid  bool
+	}{
+		{LogFilter{}, true},
+		{LogFilter{MinSeverity: "Info", Sample: 10}, true},
+		{LogFilter{MinSeverity: "verbose"}, false},
+		{LogFilter{MinSeverity: "info", Sample: -1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter.MinSeverity, func(t *testing.T) {
+			err := tt.filter.Validate()
+			switch {
+			case tt.valid && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case !tt.valid && err == nil:
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
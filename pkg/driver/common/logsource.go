@@ -0,0 +1,54 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// LogSource the source of a log entry, as the JSON of a FullLogEntry, e.g. zedagent; empty if it has none or is not
+// JSON
+func LogSource(b []byte) string {
+	var entry struct {
+		Source string `json:"source"`
+	}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return ""
+	}
+	return entry.Source
+}
+
+// LogSourceFilter reads the log entries of one source from newline-delimited entries, for those not indexed by
+// source, e.g. archived or of a driver that does not index them
+type LogSourceFilter struct {
+	r      *bufio.Reader
+	source string
+	buf    bytes.Buffer
+	err    error
+}
+
+// NewLogSourceFilter a reader of the entries of the source from newline-delimited log entries
+func NewLogSourceFilter(r io.Reader, source string) *LogSourceFilter {
+	return &LogSourceFilter{r: bufio.NewReader(r), source: source}
+}
+
+// Read the next chunk of the entries of the source, io.EOF once all entries are read
+func (f *LogSourceFilter) Read(p []byte) (int, error) {
+	for f.buf.Len() == 0 && f.err == nil {
+		line, err := f.r.ReadBytes('\n')
+		f.err = err
+		line = bytes.TrimRight(line, "\n")
+		if len(line) > 0 && LogSource(line) == f.source {
+			f.buf.Write(line)
+			f.buf.WriteByte('\n')
+		}
+	}
+	if f.buf.Len() > 0 {
+		return f.buf.Read(p)
+	}
+	return 0, f.err
+}
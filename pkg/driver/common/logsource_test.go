@@ -0,0 +1,45 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestLogSource(t *testing.T) {
+	tests := []struct {
+		entry  string
+		source string
+	}{
+		{`{"source":"zedagent","content":"hello"}`, "zedagent"},
+		{`{"severity":"info","content":"hello"}`, ""},
+		{`not json`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			if source := LogSource([]byte(tt.entry)); source != tt.source {
+				t.Errorf("mismatched source, actual %q expected %q", source, tt.source)
+			}
+		})
+	}
+}
+
+func TestLogSourceFilter(t *testing.T) {
+	entries := `{"source":"zedagent","content":"a"}
+{"source":"nim","content":"b"}
+
+{"source":"zedagent","content":"c"}`
+	b, err := ioutil.ReadAll(NewLogSourceFilter(strings.NewReader(entries), "zedagent"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{"source":"zedagent","content":"a"}
+{"source":"zedagent","content":"c"}
+`
+	if string(b) != expected {
+		t.Errorf("mismatched entries, actual %q expected %q", b, expected)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/info"
+)
+
+const (
+	// tagSep separator of the key and value of a tag filter, e.g. site:berlin
+	tagSep = ":"
+	// pseudo-tags of the fields of the metadata of a device, filtered as tags are
+	tagName  = "name"
+	tagSite  = "site"
+	tagOwner = "owner"
+)
+
+// DeviceMetadata what is recorded about a device to organize a fleet: its name, where it is, who owns it, and any
+// other free-form tags. adam does not interpret any of it. Its identity is the one part adam records itself, from
+// the device info of the device
+type DeviceMetadata struct {
+	Name     string            `json:"name,omitempty"`
+	Site     string            `json:"site,omitempty"`
+	Owner    string            `json:"owner,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Identity *DeviceIdentity   `json:"identity,omitempty"`
+}
+
+// DeviceIdentity what identifies a device, as it reported in its device info: its hardware, its serial number, the
+// MAC addresses of its network interfaces and the version of EVE it runs
+type DeviceIdentity struct {
+	Manufacturer string `json:"manufacturer,omitempty"`
+	// Model the product name of the hardware, as opposed to the hardware model of adam the device is assigned
+	Model        string `json:"model,omitempty"`
+	SerialNumber string `json:"serial-number,omitempty"`
+	// MACs the MAC addresses of the network interfaces, sorted
+	MACs       []string `json:"macs,omitempty"`
+	EVEVersion string   `json:"eve-version,omitempty"`
+	// Updated when the device info it is from was sent
+	Updated time.Time `json:"updated"`
+}
+
+// NewDeviceIdentity the identity of a device from the device info it sent at a time
+func NewDeviceIdentity(d *info.ZInfoDevice, at time.Time) *DeviceIdentity {
+	id := &DeviceIdentity{
+		Manufacturer: d.GetMinfo().GetManufacturer(),
+		Model:        d.GetMinfo().GetProductName(),
+		SerialNumber: d.GetMinfo().GetSerialNumber(),
+		Updated:      at,
+	}
+	seen := map[string]bool{}
+	for _, n := range d.GetNetwork() {
+		mac := strings.ToLower(n.GetMacAddr())
+		if mac != "" && !seen[mac] {
+			seen[mac] = true
+			id.MACs = append(id.MACs, mac)
+		}
+	}
+	sort.Strings(id.MACs)
+	for _, sw := range d.GetSwList() {
+		if sw.GetActivated() {
+			id.EVEVersion = sw.GetShortVersion()
+		}
+	}
+	return id
+}
+
+// Same whether the identity has the same identifiers as another, whenever either was reported
+func (i *DeviceIdentity) Same(other *DeviceIdentity) bool {
+	if i == nil || other == nil {
+		return i == other
+	}
+	if i.Manufacturer != other.Manufacturer || i.Model != other.Model || i.SerialNumber != other.SerialNumber ||
+		i.EVEVersion != other.EVEVersion || len(i.MACs) != len(other.MACs) {
+		return false
+	}
+	for k := range i.MACs {
+		if i.MACs[k] != other.MACs[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate check the keys of the tags are not empty, contain no : or , and are not name, site or owner, which are
+// the fields of the metadata
+func (m DeviceMetadata) Validate() error {
+	for k := range m.Tags {
+		switch {
+		case strings.TrimSpace(k) == "":
+			return fmt.Errorf("empty tag key")
+		case strings.ContainsAny(k, tagSep+","):
+			return fmt.Errorf("invalid tag key %q, must not contain %s or ,", k, tagSep)
+		case k == tagName || k == tagSite || k == tagOwner:
+			return fmt.Errorf("invalid tag key %q, set it as the %s of the device instead", k, k)
+		}
+	}
+	return nil
+}
+
+// Value the value of a tag, or of the name, site or owner, and whether it is set
+func (m DeviceMetadata) Value(key string) (string, bool) {
+	switch key {
+	case tagName:
+		return m.Name, m.Name != ""
+	case tagSite:
+		return m.Site, m.Site != ""
+	case tagOwner:
+		return m.Owner, m.Owner != ""
+	}
+	v, ok := m.Tags[key]
+	return v, ok
+}
+
+// Match whether the metadata matches all of the tag filters, each <key>:<value> for a tag of that value, or
+// <key> for a tag of any value. The name, site and owner are filtered as tags, e.g. site:berlin. No metadata
+// only matches no filters
+func (m *DeviceMetadata) Match(filters []string) bool {
+	for _, f := range filters {
+		if m == nil {
+			return false
+		}
+		k, want := f, ""
+		i := strings.Index(f, tagSep)
+		if i >= 0 {
+			k, want = f[:i], f[i+1:]
+		}
+		v, ok := m.Value(k)
+		if !ok || (i >= 0 && v != want) {
+			return false
+		}
+	}
+	return true
+}
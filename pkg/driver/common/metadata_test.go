@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/info"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestDeviceMetadataMatch(t *testing.T) {
+	m := &DeviceMetadata{Name: "gw-1", Site: "berlin", Tags: map[string]string{"rack": "4", "canary": ""}}
+	tests := []struct {
+		metadata *DeviceMetadata
+		filters  []string
+		match    bool
+	}{
+		{m, nil, true},
+		{m, []string{"site:berlin"}, true},
+		{m, []string{"site:paris"}, false},
+		{m, []string{"site"}, true},
+		{m, []string{"owner"}, false},
+		{m, []string{"name:gw-1", "rack:4"}, true},
+		{m, []string{"name:gw-1", "rack:5"}, false},
+		{m, []string{"canary"}, true},
+		{m, []string{"canary:"}, true},
+		{m, []string{"rack:"}, false},
+		{m, []string{"zone"}, false},
+		{nil, nil, true},
+		{nil, []string{"site:berlin"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.filters, ","), func(t *testing.T) {
+			if match := tt.metadata.Match(tt.filters); match != tt.match {
+				t.Errorf("mismatched match, actual %v expected %v", match, tt.match)
+			}
+		})
+	}
+}
+
+func TestDeviceMetadataValidate(t *testing.T) {
+	tests := []struct {
+		tags  map[string]string
+		valid bool
+	}{
+		{nil, true},
+		{map[string]string{"rack": "4", "env": "prod:eu"}, true},
+		{map[string]string{"": "4"}, false},
+		{map[string]string{"rack:4": ""}, false},
+		{map[string]string{"a,b": ""}, false},
+		{map[string]string{"site": "berlin"}, false},
+	}
+	for _, tt := range tests {
+		err := DeviceMetadata{Tags: tt.tags}.Validate()
+		switch {
+		case tt.valid && err != nil:
+			t.Errorf("%v: unexpected error: %v", tt.tags, err)
+		case !tt.valid && err == nil:
+			t.Errorf("%v: expected an error", tt.tags)
+		}
+	}
+}
+
+func TestDeviceIdentity(t *testing.T) {
+	const dinfo = `{"minfo":{"manufacturer":"Supermicro","productName":"SYS-E100","serialNumber":"S123"},` +
+		`"network":[{"devName":"eth1","macAddr":"00:16:3E:00:00:02"},{"devName":"eth0","macAddr":"00:16:3e:00:00:01"},` +
+		`{"devName":"wlan0"},{"devName":"eth0.1","macAddr":"00:16:3e:00:00:01"}],` +
+		`"swList":[{"partitionLabel":"IMGA","shortVersion":"9.4.0"},{"partitionLabel":"IMGB","shortVersion":"9.5.0","activated":true}]}`
+	var d info.ZInfoDevice
+	if err := protojson.Unmarshal([]byte(dinfo), &d); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	at := time.Now()
+	id := NewDeviceIdentity(&d, at)
+	expected := &DeviceIdentity{
+		Manufacturer: "Supermicro",
+		Model:        "SYS-E100",
+		SerialNumber: "S123",
+		MACs:         []string{"00:16:3e:00:00:01", "00:16:3e:00:00:02"},
+		EVEVersion:   "9.5.0",
+		Updated:      at,
+	}
+	if !id.Same(expected) || !id.Updated.Equal(at) {
+		t.Errorf("mismatched identity, actual %+v expected %+v", id, expected)
+	}
+
+	// reported again later, it is the same
+	if later := NewDeviceIdentity(&d, at.Add(time.Minute)); !later.Same(id) {
+		t.Errorf("expected the same identity reported later, actual %+v", later)
+	}
+	d.SwList[0].Activated, d.SwList[1].Activated = true, false
+	if updated := NewDeviceIdentity(&d, at); updated.Same(id) || updated.EVEVersion != "9.4.0" {
+		t.Errorf("expected a new EVE version, actual %+v", updated)
+	}
+	if id.Same(nil) || !(*DeviceIdentity)(nil).Same(nil) {
+		t.Errorf("mismatched comparison with no identity")
+	}
+}
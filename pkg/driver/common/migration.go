@@ -0,0 +1,47 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+)
+
+// Migration a change of the layout of the storage of a driver, upgrading it from the version before to Version.
+// Apply is to be safe to run again on storage it already upgraded, as a migration interrupted before its version is
+// saved is run again
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func() error
+}
+
+// LatestSchema the version of the layout the migrations upgrade to, the last one, 0 if there are none
+func LatestSchema(migrations []Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrate apply the migrations of storage at a version, those of a greater version, in order, saving the version
+// after each so that a failed migration is resumed from it. Returns the version reached. Storage of a version
+// greater than the latest is refused, as a newer release upgraded it. Migrations are to be sorted by version
+func Migrate(version int, migrations []Migration, save func(int) error) (int, error) {
+	if latest := LatestSchema(migrations); version > latest {
+		return version, fmt.Errorf("storage schema version %d is newer than %d, the latest this release knows", version, latest)
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		if err := m.Apply(); err != nil {
+			return version, fmt.Errorf("migration to schema version %d, %s, failed: %v", m.Version, m.Description, err)
+		}
+		if err := save(m.Version); err != nil {
+			return version, fmt.Errorf("unable to save schema version %d: %v", m.Version, err)
+		}
+		version = m.Version
+	}
+	return version, nil
+}
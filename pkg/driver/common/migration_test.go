@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		failAt  int
+		reached int
+		applied []int
+		err     bool
+	}{
+		{"from scratch", 0, 0, 3, []int{1, 2, 3}, false},
+		{"part way", 1, 0, 3, []int{2, 3}, false},
+		{"up to date", 3, 0, 3, nil, false},
+		{"newer", 4, 0, 4, nil, true},
+		{"failed", 0, 2, 1, []int{1, 2}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var applied, saved []int
+			var migrations []Migration
+			for v := 1; v <= 3; v++ {
+				v := v
+				migrations = append(migrations, Migration{Version: v, Description: "test", Apply: func() error {
+					applied = append(applied, v)
+					if v == tt.failAt {
+						return errors.New("failed")
+					}
+					return nil
+				}})
+			}
+			reached, err := Migrate(tt.version, migrations, func(v int) error {
+				saved = append(saved, v)
+				return nil
+			})
+			switch {
+			case tt.err && err == nil:
+				t.Errorf("expected an error")
+			case !tt.err && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			}
+			if reached != tt.reached {
+				t.Errorf("mismatched version reached, actual %d expected %d", reached, tt.reached)
+			}
+			if !reflect.DeepEqual(applied, tt.applied) {
+				t.Errorf("mismatched migrations applied, actual %v expected %v", applied, tt.applied)
+			}
+			// each migration applied is saved, but a failed one
+			if want := tt.applied; tt.failAt > 0 {
+				if !reflect.DeepEqual(saved, want[:len(want)-1]) {
+					t.Errorf("mismatched versions saved, actual %v expected %v", saved, want[:len(want)-1])
+				}
+			} else if !reflect.DeepEqual(saved, want) {
+				t.Errorf("mismatched versions saved, actual %v expected %v", saved, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"path"
+)
+
+// OnboardPolicy which devices an onboarding certificate lets join besides its serials: the soft serials they must
+// register with, and the hardware models they must report in their first info. Each is a list of shell patterns,
+// e.g. ACME-X1-*, an empty list allowing any. It can also name the config snapshot the devices start with, and limit
+// how many devices register with the certificate and how much telemetry they send, should it leak
+type OnboardPolicy struct {
+	SoftSerials []string `json:"soft-serials,omitempty"`
+	// Models patterns of the product name of the hardware, as in the inventory
+	Models []string `json:"models,omitempty"`
+	// Snapshot name of the config snapshot devices registered with the certificate start with, instead of the
+	// default one
+	Snapshot string `json:"snapshot,omitempty"`
+	// MaxDevices how many devices may be registered with the certificate at once, those deleted softly included;
+	// nil for any number
+	MaxDevices *int `json:"max-devices,omitempty"`
+	// TelemetryQuota how many bytes of logs, info, metrics and app logs the devices registered with the certificate
+	// may send together per quota period, on top of the quotas of each device; 0 for no limit
+	TelemetryQuota int64 `json:"telemetry-quota,omitempty"`
+}
+
+// Validate check the patterns are well formed and not empty, and the limits not negative
+func (p OnboardPolicy) Validate() error {
+	if p.MaxDevices != nil && *p.MaxDevices < 0 {
+		return fmt.Errorf("negative max-devices %d", *p.MaxDevices)
+	}
+	if p.TelemetryQuota < 0 {
+		return fmt.Errorf("negative telemetry-quota %d", p.TelemetryQuota)
+	}
+	for _, patterns := range [][]string{p.SoftSerials, p.Models} {
+		for _, pattern := range patterns {
+			if pattern == "" {
+				return fmt.Errorf("empty pattern")
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// AllowsSoftSerial whether a device registering with a soft serial is allowed; no policy allows any
+func (p *OnboardPolicy) AllowsSoftSerial(serial string) bool {
+	if p == nil {
+		return true
+	}
+	return matchAny(p.SoftSerials, serial)
+}
+
+// AllowsModel whether a device reporting a hardware model is allowed; no policy allows any
+func (p *OnboardPolicy) AllowsModel(model string) bool {
+	if p == nil {
+		return true
+	}
+	return matchAny(p.Models, model)
+}
+
+// AllowsDevices whether a device may register with the certificate, with n devices registered with it already; no
+// policy allows any number
+func (p *OnboardPolicy) AllowsDevices(n int) bool {
+	return p == nil || p.MaxDevices == nil || n < *p.MaxDevices
+}
+
+// matchAny whether a value matches any of the patterns, or there are none
+func matchAny(patterns []string, v string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, v); ok {
+			return true
+		}
+	}
+	return false
+}
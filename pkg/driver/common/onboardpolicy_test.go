@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+)
+
+func TestOnboardPolicyAllows(t *testing.T) {
+	p := &OnboardPolicy{SoftSerials: []string{"ACME-*", "spare-1"}, Models: []string{"X1 Gateway", "X2*"}}
+	tests := []struct {
+		policy   *OnboardPolicy
+		serial   string
+		model    string
+		serialOK bool
+		modelOK  bool
+	}{
+		{p, "ACME-0001", "X1 Gateway", true, true},
+		{p, "spare-1", "X2 Pro", true, true},
+		{p, "spare-2", "X3", false, false},
+		{p, "", "", false, false},
+		{&OnboardPolicy{Models: []string{"X1*"}}, "anything", "X1", true, true},
+		{&OnboardPolicy{}, "anything", "anything", true, true},
+		{nil, "", "", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serial+"/"+tt.model, func(t *testing.T) {
+			if ok := tt.policy.AllowsSoftSerial(tt.serial); ok != tt.serialOK {
+				t.Errorf("mismatched soft serial, actual %v expected %v", ok, tt.serialOK)
+			}
+			if ok := tt.policy.AllowsModel(tt.model); ok != tt.modelOK {
+				t.Errorf("mismatched model, actual %v expected %v", ok, tt.modelOK)
+			}
+		})
+	}
+}
+
+func TestOnboardPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy OnboardPolicy
+		valid  bool
+	}{
+		{OnboardPolicy{}, true},
+		{OnboardPolicy{SoftSerials: []string{"ACME-*"}, Models: []string{"X[12]"}}, true},
+		{OnboardPolicy{SoftSerials: []string{""}}, false},
+		{OnboardPolicy{Models: []string{"X[1"}}, false},
+		{OnboardPolicy{MaxDevices: intp(0), TelemetryQuota: 1 << 20}, true},
+		{OnboardPolicy{MaxDevices: intp(-1)}, false},
+		{OnboardPolicy{TelemetryQuota: -1}, false},
+	}
+	for _, tt := range tests {
+		err := tt.policy.Validate()
+		switch {
+		case tt.valid && err != nil:
+			t.Errorf("%v: unexpected error: %v", tt.policy, err)
+		case !tt.valid && err == nil:
+			t.Errorf("%v: expected an error", tt.policy)
+		}
+	}
+}
+
+func intp(v int) *int {
+	return &v
+}
+
+func TestOnboardPolicyAllowsDevices(t *testing.T) {
+	tests := []struct {
+		policy  *OnboardPolicy
+		devices int
+		allowed bool
+	}{
+		{nil, 100, true},
+		{&OnboardPolicy{}, 100, true},
+		{&OnboardPolicy{MaxDevices: intp(2)}, 1, true},
+		{&OnboardPolicy{MaxDevices: intp(2)}, 2, false},
+		{&OnboardPolicy{MaxDevices: intp(0)}, 0, false},
+	}
+	for _, tt := range tests {
+		if ok := tt.policy.AllowsDevices(tt.devices); ok != tt.allowed {
+			t.Errorf("%+v with %d devices: mismatched allowed, actual %v expected %v", tt.policy, tt.devices, ok, tt.allowed)
+		}
+	}
+}
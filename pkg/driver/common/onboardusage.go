@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OnboardUsage how many of the serials of an onboarding certificate the devices registered with it used, and how
+// many are left. A serial is used until its device is removed, deleted softly or not
+type OnboardUsage struct {
+	CN string `json:"cn"`
+	// Serials the serials of the certificate, or patterns of serials, with how many each allows and how many are used
+	Serials []SerialUsage `json:"serials"`
+	// Allowed how many serials the certificate allows, nil if a pattern allows any number
+	Allowed *uint64 `json:"allowed"`
+	// Used how many serials devices registered with
+	Used int `json:"used"`
+	// Available how many serials are left, nil if a pattern allows any number
+	Available *uint64 `json:"available"`
+	// Devices the devices registered with the certificate, by serial
+	Devices []SerialDevice `json:"devices"`
+	// MaxDevices how many devices the policy of the certificate lets register with it, nil for any number
+	MaxDevices *int `json:"max-devices,omitempty"`
+	// DevicesAvailable how many more devices may register with the certificate, nil for any number
+	DevicesAvailable *int `json:"devices-available,omitempty"`
+	// Telemetry the telemetry the devices sent in the current quota period, nil if the policy sets no quota
+	Telemetry *TelemetryUsage `json:"telemetry,omitempty"`
+}
+
+// TelemetryUsage how many bytes of telemetry the devices of an onboarding certificate sent in the current quota
+// period, against the quota of its policy
+type TelemetryUsage struct {
+	Quota int64 `json:"quota"`
+	Used  int64 `json:"used"`
+	// Since when the current period started, nil if no telemetry was sent in it
+	Since *time.Time `json:"since,omitempty"`
+	// Reset when the current period ends, nil if no telemetry was sent in it
+	Reset *time.Time `json:"reset,omitempty"`
+}
+
+// Limit add the device limit of the policy of the certificate, if any, with how many more devices may register
+func (u *OnboardUsage) Limit(p *OnboardPolicy) {
+	if p == nil || p.MaxDevices == nil {
+		return
+	}
+	available := *p.MaxDevices - len(u.Devices)
+	if available < 0 {
+		available = 0
+	}
+	u.MaxDevices, u.DevicesAvailable = p.MaxDevices, &available
+}
+
+// SerialUsage how many serials a serial of an onboarding certificate allows, and how many devices used
+type SerialUsage struct {
+	Pattern string `json:"pattern"`
+	// Allowed how many serials it allows, nil if any number
+	Allowed *uint64 `json:"allowed"`
+	Used    int     `json:"used"`
+}
+
+// SerialDevice a device registered with a serial of an onboarding certificate
+type SerialDevice struct {
+	Serial string `json:"serial"`
+	UUID   string `json:"uuid"`
+	// Pattern the serial of the certificate the serial is counted against, empty if none allows it any more
+	Pattern string `json:"pattern"`
+	// Deleted whether the device was deleted softly, its serial used until it is removed for good
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// SerialCount how many serials a serial of an onboarding certificate allows, false if it allows any number, as the
+// wildcard, a glob pattern or a regular expression
+func SerialCount(pattern string) (uint64, bool) {
+	switch {
+	case strings.HasPrefix(pattern, serialRegexpPrefix):
+		return 0, false
+	case strings.Contains(pattern, serialRangeSep):
+		_, first, last, err := parseSerialRange(pattern)
+		if err != nil {
+			return 1, true
+		}
+		lo, _ := strconv.ParseUint(first, 10, 64)
+		hi, _ := strconv.ParseUint(last, 10, 64)
+		return hi - lo + 1, true
+	case strings.ContainsAny(pattern, `*?[\`):
+		return 0, false
+	}
+	return 1, true
+}
+
+// NewOnboardUsage the usage of the serials of an onboarding certificate by the devices registered with it. Each
+// device is counted against the serial of the certificate that allows its own, the exact one first
+func NewOnboardUsage(cn string, serials []string, devices []SerialDevice) *OnboardUsage {
+	usage := &OnboardUsage{CN: cn, Serials: []SerialUsage{}, Devices: []SerialDevice{}}
+	index := map[string]int{}
+	var allowed uint64
+	bounded := true
+	for _, s := range serials {
+		if _, ok := index[s]; ok {
+			continue
+		}
+		index[s] = len(usage.Serials)
+		su := SerialUsage{Pattern: s}
+		if n, ok := SerialCount(s); ok {
+			su.Allowed = &n
+			allowed += n
+		} else {
+			bounded = false
+		}
+		usage.Serials = append(usage.Serials, su)
+	}
+	var counted uint64
+	for _, d := range devices {
+		d.Pattern = ""
+		if i, ok := index[d.Serial]; ok {
+			d.Pattern = d.Serial
+			usage.Serials[i].Used++
+		} else {
+			for _, su := range usage.Serials {
+				if MatchSerial(su.Pattern, d.Serial) {
+					d.Pattern = su.Pattern
+					usage.Serials[index[su.Pattern]].Used++
+					break
+				}
+			}
+		}
+		if d.Pattern != "" {
+			counted++
+		}
+		usage.Devices = append(usage.Devices, d)
+	}
+	usage.Used = len(usage.Devices)
+	sort.Slice(usage.Devices, func(i, k int) bool {
+		if usage.Devices[i].Serial != usage.Devices[k].Serial {
+			return usage.Devices[i].Serial < usage.Devices[k].Serial
+		}
+		return usage.Devices[i].UUID < usage.Devices[k].UUID
+	})
+	if bounded {
+		available := uint64(0)
+		if allowed > counted {
+			available = allowed - counted
+		}
+		usage.Allowed, usage.Available = &allowed, &available
+	}
+	return usage
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSerialCount(t *testing.T) {
+	tests := []struct {
+		pattern string
+		count   uint64
+		bounded bool
+	}{
+		{"SN-0001", 1, true},
+		{"SN-0001..SN-0500", 500, true},
+		{"SN-8..SN-12", 5, true},
+		{"*", 0, false},
+		{"SN-*", 0, false},
+		{"SN-00[0-9]", 0, false},
+		{"re:^SN-[0-9]+$", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			count, bounded := SerialCount(tt.pattern)
+			if count != tt.count || bounded != tt.bounded {
+				t.Errorf("mismatched count, actual %d %v expected %d %v", count, bounded, tt.count, tt.bounded)
+			}
+		})
+	}
+}
+
+func TestNewOnboardUsage(t *testing.T) {
+	n := func(v uint64) *uint64 { return &v }
+	devices := []SerialDevice{
+		{Serial: "SN-0003", UUID: "b"},
+		{Serial: "ONE", UUID: "a"},
+		{Serial: "SN-0001", UUID: "c", Deleted: true},
+		{Serial: "GONE", UUID: "d"},
+	}
+	usage := NewOnboardUsage("acme", []string{"SN-0001..SN-0010", "ONE", "ONE"}, devices)
+	expected := &OnboardUsage{
+		CN: "acme",
+		Serials: []SerialUsage{
+			{Pattern: "SN-0001..SN-0010", Allowed: n(10), Used: 2},
+			{Pattern: "ONE", Allowed: n(1), Used: 1},
+		},
+		Allowed:   n(11),
+		Used:      4,
+		Available: n(8),
+		Devices: []SerialDevice{
+			{Serial: "GONE", UUID: "d"},
+			{Serial: "ONE", UUID: "a", Pattern: "ONE"},
+			{Serial: "SN-0001", UUID: "c", Pattern: "SN-0001..SN-0010", Deleted: true},
+			{Serial: "SN-0003", UUID: "b", Pattern: "SN-0001..SN-0010"},
+		},
+	}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Errorf("mismatched usage, actual %+v expected %+v", usage, expected)
+	}
+
+	// a pattern allowing any number leaves the total unbounded
+	usage = NewOnboardUsage("acme", []string{"ONE", "*"}, devices)
+	if usage.Allowed != nil || usage.Available != nil {
+		t.Errorf("unexpected bound, allowed %v available %v", usage.Allowed, usage.Available)
+	}
+	if usage.Serials[1].Used != 3 {
+		t.Errorf("mismatched used of the wildcard, actual %d expected 3", usage.Serials[1].Used)
+	}
+}
+
+func TestOnboardUsageLimit(t *testing.T) {
+	devices := []SerialDevice{{Serial: "A", UUID: "a"}, {Serial: "B", UUID: "b"}, {Serial: "C", UUID: "c"}}
+	usage := NewOnboardUsage("acme", []string{"*"}, devices)
+	usage.Limit(&OnboardPolicy{SoftSerials: []string{"X*"}})
+	if usage.MaxDevices != nil || usage.DevicesAvailable != nil {
+		t.Errorf("unexpected device limit, max %v available %v", usage.MaxDevices, usage.DevicesAvailable)
+	}
+	for _, tt := range []struct{ max, available int }{{5, 2}, {3, 0}, {2, 0}} {
+		max := tt.max
+		usage.Limit(&OnboardPolicy{MaxDevices: &max})
+		if usage.MaxDevices == nil || *usage.MaxDevices != tt.max || usage.DevicesAvailable == nil || *usage.DevicesAvailable != tt.available {
+			t.Errorf("max %d: mismatched limit, actual max %v available %v expected available %d", tt.max, usage.MaxDevices, usage.DevicesAvailable, tt.available)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// ParquetRowGroupSize the rows of a row group of a Parquet file, buffered before they are written
+const ParquetRowGroupSize = 10000
+
+// values of the enums of the Parquet format, from parquet.thrift. Parquet is not a module adam builds with, so the
+// few structures of a file of plain, uncompressed columns are encoded by hand, in the thrift compact protocol
+const (
+	// Type
+	parquetInt64  = 2
+	parquetDouble = 5
+	// FieldRepetitionType
+	parquetRequired = 0
+	parquetOptional = 1
+	// ConvertedType
+	parquetTimestampMillis = 9
+	// Encoding
+	parquetPlain = 0
+	parquetRLE   = 3
+	// CompressionCodec
+	parquetUncompressed = 0
+	// PageType
+	parquetDataPage = 0
+
+	parquetMagic = "PAR1"
+)
+
+// types of the fields of the thrift compact protocol
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// ParquetWriter write rows of a time and optional float values to a Parquet file, one required timestamp column
+// and one optional double column per name, a row group at a time, so that only a row group is held in memory
+type ParquetWriter struct {
+	w       *countingWriter
+	columns []string
+	index   map[string]int
+	// times and values the buffered rows of the row group, values holding the non-null values of each column, and
+	// defined whether each row has one
+	times   []int64
+	values  [][]float64
+	defined [][]bool
+	groups  []parquetRowGroup
+	rows    int64
+	closed  bool
+}
+
+// parquetRowGroup the metadata of a row group written
+type parquetRowGroup struct {
+	rows    int64
+	size    int64
+	columns []parquetColumnChunk
+}
+
+// parquetColumnChunk the metadata of the chunk of a column of a row group written
+type parquetColumnChunk struct {
+	offset int64
+	size   int64
+	values int64
+}
+
+// countingWriter count the bytes written, for the offsets of the column chunks
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewParquetWriter start a Parquet file with a timestamp column and a column for each name, in their order
+func NewParquetWriter(w io.Writer, timeColumn string, columns []string) (*ParquetWriter, error) {
+	p := &ParquetWriter{
+		w:       &countingWriter{w: w},
+		columns: append([]string{timeColumn}, columns...),
+		index:   map[string]int{},
+		values:  make([][]float64, len(columns)),
+		defined: make([][]bool, len(columns)),
+	}
+	for i, c := range columns {
+		if _, ok := p.index[c]; ok || c == timeColumn {
+			return nil, fmt.Errorf("column %s given twice", c)
+		}
+		p.index[c] = i
+	}
+	if _, err := io.WriteString(p.w, parquetMagic); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Write add a row at a time with the values of some of the columns, null for the others, ignoring values of columns
+// the file does not have
+func (p *ParquetWriter) Write(at time.Time, values map[string]float64) error {
+	if p.closed {
+		return fmt.Errorf("parquet writer closed")
+	}
+	p.times = append(p.times, at.UnixNano()/int64(time.Millisecond))
+	for i := range p.defined {
+		p.defined[i] = append(p.defined[i], false)
+	}
+	for name, v := range values {
+		if i, ok := p.index[name]; ok {
+			p.defined[i][len(p.defined[i])-1] = true
+			p.values[i] = append(p.values[i], v)
+		}
+	}
+	if len(p.times) >= ParquetRowGroupSize {
+		return p.flush()
+	}
+	return nil
+}
+
+// Close write the last row group and the footer of the file, without closing the underlying writer
+func (p *ParquetWriter) Close() error {
+	if p.closed {
+		return nil
+	}
+	if err := p.flush(); err != nil {
+		return err
+	}
+	p.closed = true
+	footer := p.footer()
+	var tail [4]byte
+	binary.LittleEndian.PutUint32(tail[:], uint32(len(footer)))
+	footer = append(append(footer, tail[:]...), parquetMagic...)
+	_, err := p.w.Write(footer)
+	return err
+}
+
+// flush write the buffered rows as a row group, a single data page per column
+func (p *ParquetWriter) flush() error {
+	if len(p.times) == 0 {
+		return nil
+	}
+	start := p.w.n
+	group := parquetRowGroup{rows: int64(len(p.times))}
+
+	var page bytes.Buffer
+	for _, t := range p.times {
+		binary.Write(&page, binary.LittleEndian, t)
+	}
+	if err := p.writePage(&group, page.Bytes(), len(p.times)); err != nil {
+		return err
+	}
+	for i := range p.values {
+		page.Reset()
+		levels := parquetLevels(p.defined[i])
+		binary.Write(&page, binary.LittleEndian, uint32(len(levels)))
+		page.Write(levels)
+		for _, v := range p.values[i] {
+			binary.Write(&page, binary.LittleEndian, math.Float64bits(v))
+		}
+		if err := p.writePage(&group, page.Bytes(), len(p.defined[i])); err != nil {
+			return err
+		}
+		p.values[i], p.defined[i] = p.values[i][:0], p.defined[i][:0]
+	}
+	group.size = p.w.n - start
+	p.groups = append(p.groups, group)
+	p.rows += group.rows
+	p.times = p.times[:0]
+	return nil
+}
+
+// writePage write a column chunk of a single data page of values
+func (p *ParquetWriter) writePage(group *parquetRowGroup, data []byte, values int) error {
+	t := &thriftWriter{}
+	t.i32(1, parquetDataPage)
+	t.i32(2, int32(len(data)))
+	t.i32(3, int32(len(data)))
+	t.beginStruct(5)
+	t.i32(1, int32(values))
+	t.i32(2, parquetPlain)
+	t.i32(3, parquetRLE)
+	t.i32(4, parquetRLE)
+	t.endStruct()
+	t.stop()
+	chunk := parquetColumnChunk{offset: p.w.n, size: int64(t.b.Len() + len(data)), values: int64(values)}
+	if _, err := p.w.Write(t.b.Bytes()); err != nil {
+		return err
+	}
+	if _, err := p.w.Write(data); err != nil {
+		return err
+	}
+	group.columns = append(group.columns, chunk)
+	return nil
+}
+
+// footer the FileMetaData of the file: its schema, and the row groups and column chunks written
+func (p *ParquetWriter) footer() []byte {
+	t := &thriftWriter{}
+	t.i32(1, 1)
+	t.beginList(2, thriftStruct, len(p.columns)+1)
+	t.beginElement()
+	t.binary(4, "schema")
+	t.i32(5, int32(len(p.columns)))
+	t.endStruct()
+	for i, c := range p.columns {
+		t.beginElement()
+		if i == 0 {
+			t.i32(1, parquetInt64)
+			t.i32(3, parquetRequired)
+			t.binary(4, c)
+			t.i32(6, parquetTimestampMillis)
+		} else {
+			t.i32(1, parquetDouble)
+			t.i32(3, parquetOptional)
+			t.binary(4, c)
+		}
+		t.endStruct()
+	}
+	t.i64(3, p.rows)
+	t.beginList(4, thriftStruct, len(p.groups))
+	for _, g := range p.groups {
+		t.beginElement()
+		t.beginList(1, thriftStruct, len(g.columns))
+		for i, c := range g.columns {
+			typ := int32(parquetDouble)
+			if i == 0 {
+				typ = parquetInt64
+			}
+			t.beginElement()
+			t.i64(2, c.offset)
+			t.beginStruct(3)
+			t.i32(1, typ)
+			t.beginList(2, thriftI32, 2)
+			t.varint(zigzag(parquetPlain))
+			t.varint(zigzag(parquetRLE))
+			t.beginList(3, thriftBinary, 1)
+			t.varint(uint64(len(p.columns[i])))
+			t.b.WriteString(p.columns[i])
+			t.i32(4, parquetUncompressed)
+			t.i64(5, c.values)
+			t.i64(6, c.size)
+			t.i64(7, c.size)
+			t.i64(9, c.offset)
+			t.endStruct()
+			t.endStruct()
+		}
+		t.i64(2, g.size)
+		t.i64(3, g.rows)
+		t.endStruct()
+	}
+	t.binary(6, "adam")
+	t.stop()
+	return t.b.Bytes()
+}
+
+// parquetLevels the definition levels of an optional column, 1 for a row with a value, in the bit-packed encoding
+// of the RLE/bit-packed hybrid, padded to groups of 8
+func parquetLevels(defined []bool) []byte {
+	groups := (len(defined) + 7) / 8
+	b := make([]byte, binary.MaxVarintLen64)
+	b = b[:binary.PutUvarint(b, uint64(groups)<<1|1)]
+	packed := make([]byte, groups)
+	for i, d := range defined {
+		if d {
+			packed[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return append(b, packed...)
+}
+
+// thriftWriter encode structs in the thrift compact protocol, tracking the last field id of each struct nested
+type thriftWriter struct {
+	b    bytes.Buffer
+	last []int16
+	id   int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	t.b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.id; delta > 0 && delta <= 15 {
+		t.b.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.b.WriteByte(typ)
+		t.varint(zigzag(int64(id)))
+	}
+	t.id = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.varint(uint64(len(s)))
+	t.b.WriteString(s)
+}
+
+// beginList start a list field of n elements of a type, written after it
+func (t *thriftWriter) beginList(id int16, typ byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.b.WriteByte(byte(n)<<4 | typ)
+		return
+	}
+	t.b.WriteByte(0xf0 | typ)
+	t.varint(uint64(n))
+}
+
+// beginStruct start a struct field, ended by endStruct
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.beginElement()
+}
+
+// beginElement start a struct element of a list, ended by endStruct
+func (t *thriftWriter) beginElement() {
+	t.last = append(t.last, t.id)
+	t.id = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.stop()
+	t.id = t.last[len(t.last)-1]
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.b.WriteByte(0)
+}
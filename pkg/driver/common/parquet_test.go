@@ -0,0 +1,154 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// thriftReader decode the thrift compact protocol, structs as maps of field id to value, for the tests
+type thriftReader struct {
+	b *bytes.Reader
+}
+
+func (r *thriftReader) varint(t *testing.T) uint64 {
+	v, err := binary.ReadUvarint(r.b)
+	if err != nil {
+		t.Fatalf("bad varint: %v", err)
+	}
+	return v
+}
+
+func (r *thriftReader) int(t *testing.T) int64 {
+	v := r.varint(t)
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(t *testing.T, typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.int(t)
+	case thriftBinary:
+		b := make([]byte, r.varint(t))
+		r.b.Read(b)
+		return string(b)
+	case thriftList:
+		h, _ := r.b.ReadByte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.varint(t))
+		}
+		l := []interface{}{}
+		for i := 0; i < n; i++ {
+			l = append(l, r.value(t, h&0x0f))
+		}
+		return l
+	case thriftStruct:
+		return r.structure(t)
+	}
+	t.Fatalf("unexpected thrift type %d", typ)
+	return nil
+}
+
+func (r *thriftReader) structure(t *testing.T) map[int64]interface{} {
+	s := map[int64]interface{}{}
+	var id int64
+	for {
+		h, err := r.b.ReadByte()
+		if err != nil {
+			t.Fatalf("truncated struct: %v", err)
+		}
+		if h == 0 {
+			return s
+		}
+		if delta := int64(h >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = r.int(t)
+		}
+		s[id] = r.value(t, h&0x0f)
+	}
+}
+
+func TestParquetWriter(t *testing.T) {
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	rows := ParquetRowGroupSize + 3
+	var buf bytes.Buffer
+	p, err := NewParquetWriter(&buf, "time", []string{"cpu", "mem"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < rows; i++ {
+		values := map[string]float64{"cpu": float64(i), "disk": 1}
+		if i%2 == 0 {
+			values["mem"] = float64(i) / 2
+		}
+		if err := p.Write(start.Add(time.Duration(i)*time.Second), values); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b := buf.Bytes()
+	if string(b[:4]) != parquetMagic || string(b[len(b)-4:]) != parquetMagic {
+		t.Fatalf("missing magic")
+	}
+	size := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	footer := (&thriftReader{bytes.NewReader(b[len(b)-8-size : len(b)-8])}).structure(t)
+	if footer[3] != int64(rows) {
+		t.Errorf("mismatched rows, actual %v expected %d", footer[3], rows)
+	}
+	var names []string
+	for _, e := range footer[2].([]interface{}) {
+		names = append(names, e.(map[int64]interface{})[4].(string))
+	}
+	if expected := []string{"schema", "time", "cpu", "mem"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("mismatched schema, actual %v expected %v", names, expected)
+	}
+	groups := footer[4].([]interface{})
+	if len(groups) != 2 {
+		t.Fatalf("mismatched row groups, actual %d expected 2", len(groups))
+	}
+
+	// the last row group: its times, and the values of mem, present every other row
+	columns := groups[1].(map[int64]interface{})[1].([]interface{})
+	chunk := func(i int) []byte {
+		meta := columns[i].(map[int64]interface{})[3].(map[int64]interface{})
+		offset, size := meta[9].(int64), meta[7].(int64)
+		r := &thriftReader{bytes.NewReader(b[offset : offset+size])}
+		header := r.structure(t)
+		if header[5].(map[int64]interface{})[1] != int64(3) {
+			t.Errorf("mismatched page values, actual %v expected 3", header[5])
+		}
+		data := make([]byte, header[2].(int64))
+		r.b.Read(data)
+		return data
+	}
+	times := chunk(0)
+	for i := 0; i < 3; i++ {
+		actual := int64(binary.LittleEndian.Uint64(times[i*8:]))
+		if expected := start.Add(time.Duration(ParquetRowGroupSize+i)*time.Second).UnixNano() / int64(time.Millisecond); actual != expected {
+			t.Errorf("mismatched time %d, actual %d expected %d", i, actual, expected)
+		}
+	}
+	mem := chunk(2)
+	levels := binary.LittleEndian.Uint32(mem)
+	if def := mem[4+levels-1]; def != 0x5 {
+		t.Errorf("mismatched definition levels, actual %b expected 101", def)
+	}
+	values := mem[4+levels:]
+	if len(values) != 16 {
+		t.Fatalf("mismatched mem values, actual %d bytes expected 16", len(values))
+	}
+	if v := math.Float64frombits(binary.LittleEndian.Uint64(values[8:])); v != float64(ParquetRowGroupSize+2)/2 {
+		t.Errorf("mismatched mem value, actual %v expected %v", v, float64(ParquetRowGroupSize+2)/2)
+	}
+}
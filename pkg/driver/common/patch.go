@@ -0,0 +1,41 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MergePatch apply a JSON merge patch, as in RFC 7386, to a JSON document: objects in the patch are merged into
+// those of the document, null removes a member, and anything else, including arrays, replaces what is there
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	var d, p interface{}
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return nil, fmt.Errorf("invalid document: %v", err)
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, fmt.Errorf("invalid patch: %v", err)
+	}
+	return json.Marshal(mergeValue(d, p))
+}
+
+func mergeValue(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+			continue
+		}
+		d[k] = mergeValue(d[k], v)
+	}
+	return d
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"time"
+)
+
+// PendingDevice a device that passed the onboarding checks, waiting for an admin to approve it before it is registered
+type PendingDevice struct {
+	// ID the SHA256 of the device certificate, so that retries of the same device update the same entry
+	ID       string `json:"id"`
+	Serial   string `json:"serial"`
+	DeviceCN string `json:"device-cn"`
+	// OnboardCN common name of the onboarding certificate used
+	OnboardCN string `json:"onboard-cn"`
+	// Cert and Onboard PEM encoded device and onboarding certificates
+	Cert      []byte    `json:"cert"`
+	Onboard   []byte    `json:"onboard"`
+	ClientIP  string    `json:"client-ip"`
+	FirstSeen time.Time `json:"first-seen"`
+	LastSeen  time.Time `json:"last-seen"`
+	// Attempts number of times the device tried to register while pending
+	Attempts int `json:"attempts"`
+}
+
+// NewPendingDevice create a pending device for a registration attempt
+func NewPendingDevice(cert, onboard *x509.Certificate, serial string) *PendingDevice {
+	now := time.Now()
+	return &PendingDevice{
+		ID:        PendingID(cert),
+		Serial:    serial,
+		DeviceCN:  cert.Subject.CommonName,
+		OnboardCN: onboard.Subject.CommonName,
+		Cert:      pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		Onboard:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: onboard.Raw}),
+		FirstSeen: now,
+		LastSeen:  now,
+		Attempts:  1,
+	}
+}
+
+// PendingID get the ID of the pending device with a device certificate
+func PendingID(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(hash[:])
+}
+
+// Certificates get the device and onboarding certificates of the pending device
+func (p *PendingDevice) Certificates() (*x509.Certificate, *x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, b := range [][]byte{p.Cert, p.Onboard} {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, nil, errors.New("no PEM data found")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs[0], certs[1], nil
+}
+
+// PendingAdd add a device waiting for approval to register, replacing any with the same ID
+func PendingAdd(s RecordStore, p *PendingDevice) error {
+	return putJSON(s, RecordPending, p.ID, p)
+}
+
+// PendingGet get a device waiting for approval by ID. Return a *NotFoundError if there is none
+func PendingGet(s RecordStore, id string) (*PendingDevice, error) {
+	var p PendingDevice
+	if err := getJSON(s, RecordPending, id, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// PendingList list the devices waiting for approval
+func PendingList(s RecordStore) ([]*PendingDevice, error) {
+	pending := []*PendingDevice{}
+	err := listJSON(s, RecordPending, func() interface{} {
+		pending = append(pending, &PendingDevice{})
+		return pending[len(pending)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// PendingRemove remove a device waiting for approval, once approved or rejected
+func PendingRemove(s RecordStore, id string) error {
+	return s.RemoveRecord(RecordPending, id)
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import "time"
+
+// LocalProfile state of the local profile server of a device, which tells it which profile to use and whether to
+// silence its radios
+type LocalProfile struct {
+	// Token server token sent to the device, which must match the profile server token of its config
+	Token string `json:"token"`
+	// Profile the local profile the device is to use instead of the global one of its config; empty for none
+	Profile string `json:"profile,omitempty"`
+	// RadioSilence whether the device is to turn its radios off
+	RadioSilence bool `json:"radio-silence"`
+	// Radio the status of its radios the device last reported, nil until it does
+	Radio *RadioStatus `json:"radio,omitempty"`
+}
+
+// RadioStatus status of the radios of a device, as reported to its local profile server
+type RadioStatus struct {
+	// Silence whether the radios are off
+	Silence bool `json:"silence"`
+	// ConfigError the error applying the radio config, if any
+	ConfigError string `json:"config-error,omitempty"`
+	// Time when it was reported
+	Time time.Time `json:"time"`
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"time"
+
+	"github.com/lf-edge/eve/api/go/config"
+	"google.golang.org/protobuf/proto"
+)
+
+// Quarantine a device set apart, e.g. while a security incident is looked into: its telemetry is still accepted, but
+// it is served a minimal config, see QuarantineConfig, until it is released
+type Quarantine struct {
+	// Reason why the device was quarantined, shown with its status
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	// Actor who quarantined the device, as in the audit log
+	Actor string `json:"actor,omitempty"`
+	// Version the version of the config the device was served when quarantined
+	Version string `json:"version,omitempty"`
+}
+
+// QuarantineConfig the config served to a quarantined device instead of its own: the same, but without app
+// instances, their volumes, content trees, network instances, datastores and cipher contexts, and with only the
+// uplink system adapters, those adam manages the device through, and their networks. Its IO adapters, EVE version,
+// config items and commands are kept, so that a device is not rebooted or updated by its quarantine alone. When no
+// system adapter is an uplink, they are all kept, rather than leaving the device with no way to reach adam
+func QuarantineConfig(conf *config.EdgeDevConfig) *config.EdgeDevConfig {
+	q := proto.Clone(conf).(*config.EdgeDevConfig)
+	q.Apps = nil
+	q.Volumes = nil
+	q.ContentInfo = nil
+	q.NetworkInstances = nil
+	q.Datastores = nil
+	q.CipherContexts = nil
+
+	var uplinks []*config.SystemAdapter
+	for _, a := range q.SystemAdapterList {
+		if a.GetUplink() {
+			uplinks = append(uplinks, a)
+		}
+	}
+	if len(uplinks) == 0 {
+		return q
+	}
+	q.SystemAdapterList = uplinks
+	networks := map[string]bool{}
+	for _, a := range uplinks {
+		networks[a.GetNetworkUUID()] = true
+	}
+	var kept []*config.NetworkConfig
+	for _, n := range q.Networks {
+		if networks[n.GetId()] {
+			kept = append(kept, n)
+		}
+	}
+	q.Networks = kept
+	return q
+}
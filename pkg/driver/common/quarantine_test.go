@@ -0,0 +1,47 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+
+	"github.com/lf-edge/eve/api/go/config"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestQuarantineConfig(t *testing.T) {
+	const full = `{"id":{"uuid":"9ad0d94c-3e2e-4bd0-8fb3-2ed0c1d4d1a1","version":"4"},` +
+		`"apps":[{"uuidandversion":{"uuid":"a","version":"1"},"displayname":"app"}],"volumes":[{"uuid":"v"}],` +
+		`"contentInfo":[{"uuid":"c"}],"networkInstances":[{"uuidandversion":{"uuid":"n","version":"1"}}],` +
+		`"datastores":[{"id":"d"}],"base":[{"baseOSVersion":"6.0.0"}],"reboot":{"counter":2},` +
+		`"networks":[{"id":"mgmt"},{"id":"apps"}],"deviceIoList":[{"phylabel":"eth0"},{"phylabel":"eth1"}],` +
+		`"systemAdapterList":[{"name":"eth0","uplink":true,"networkUUID":"mgmt"},{"name":"eth1","networkUUID":"apps"}],` +
+		`"configItems":[{"key":"timer.config.interval","value":"10"}]}`
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal([]byte(full), &conf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	q := QuarantineConfig(&conf)
+	if len(q.Apps) != 0 || len(q.Volumes) != 0 || len(q.ContentInfo) != 0 || len(q.NetworkInstances) != 0 || len(q.Datastores) != 0 {
+		t.Errorf("expected no apps, volumes, content, network instances or datastores, actual %v", q)
+	}
+	if len(q.SystemAdapterList) != 1 || q.SystemAdapterList[0].Name != "eth0" {
+		t.Errorf("expected only the uplink adapter, actual %v", q.SystemAdapterList)
+	}
+	if len(q.Networks) != 1 || q.Networks[0].Id != "mgmt" {
+		t.Errorf("expected only the network of the uplink, actual %v", q.Networks)
+	}
+	if len(q.DeviceIoList) != 2 || len(q.Base) != 1 || q.Reboot.GetCounter() != 2 || len(q.ConfigItems) != 1 || q.Id.GetVersion() != "4" {
+		t.Errorf("expected the IO adapters, EVE version, commands and config items kept, actual %v", q)
+	}
+	if len(conf.Apps) != 1 || len(conf.SystemAdapterList) != 2 {
+		t.Errorf("expected the config of the device unchanged, actual %v", &conf)
+	}
+
+	// with no uplink, all adapters are kept
+	conf.SystemAdapterList[0].Uplink = false
+	if q := QuarantineConfig(&conf); len(q.SystemAdapterList) != 2 || len(q.Networks) != 2 {
+		t.Errorf("expected all adapters and networks kept with no uplink, actual %v %v", q.SystemAdapterList, q.Networks)
+	}
+}
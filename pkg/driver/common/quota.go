@@ -0,0 +1,253 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// kinds of device messages that limits apply to
+const (
+	KindLogs     = "logs"
+	KindInfo     = "info"
+	KindMetrics  = "metrics"
+	KindRequests = "requests"
+	KindAppLogs  = "apps"
+)
+
+// DefaultQuotaPeriod period over which the byte quotas are counted, if none is set
+const DefaultQuotaPeriod = time.Hour
+
+// Limits a limit per kind of message, with a default for kinds not listed. 0 means no limit
+type Limits struct {
+	Default int64            `json:"default,omitempty"`
+	Kinds   map[string]int64 `json:"kinds,omitempty"`
+}
+
+// For get the limit for a kind of message
+func (l Limits) For(kind string) int64 {
+	if v, ok := l.Kinds[kind]; ok {
+		return v
+	}
+	return l.Default
+}
+
+// ParseLimits parse limits of the form "<default>,<kind>=<limit>,...", e.g. "10000,logs=50000". Either part
+// is optional, an empty string is no limits
+func ParseLimits(s string) (Limits, error) {
+	l := Limits{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kind, value := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			kind, value = part[:i], part[i+1:]
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return l, fmt.Errorf("invalid limit %s", part)
+		}
+		switch {
+		case kind == "":
+			l.Default = n
+		case validKind(kind):
+			if l.Kinds == nil {
+				l.Kinds = map[string]int64{}
+			}
+			l.Kinds[kind] = n
+		default:
+			return l, fmt.Errorf("invalid limit %s: unknown kind %s", part, kind)
+		}
+	}
+	return l, nil
+}
+
+// Validate check that the limits are not negative, and are only for known kinds of messages
+func (l Limits) Validate() error {
+	if l.Default < 0 {
+		return fmt.Errorf("invalid default limit %d", l.Default)
+	}
+	for k, v := range l.Kinds {
+		if !validKind(k) {
+			return fmt.Errorf("unknown kind %s", k)
+		}
+		if v < 0 {
+			return fmt.Errorf("invalid limit %d for %s", v, k)
+		}
+	}
+	return nil
+}
+
+func validKind(kind string) bool {
+	switch kind {
+	case KindLogs, KindInfo, KindMetrics, KindRequests, KindAppLogs:
+		return true
+	}
+	return false
+}
+
+// merge override these limits with the ones set in o
+func (l Limits) merge(o Limits) Limits {
+	merged := Limits{Default: l.Default, Kinds: map[string]int64{}}
+	for k, v := range l.Kinds {
+		merged.Kinds[k] = v
+	}
+	if o.Default != 0 {
+		merged.Default = o.Default
+		merged.Kinds = map[string]int64{}
+	}
+	for k, v := range o.Kinds {
+		merged.Kinds[k] = v
+	}
+	return merged
+}
+
+// Quotas limits on the data of a device
+type Quotas struct {
+	// MaxLen maximum number of entries kept per stream, older ones are trimmed
+	MaxLen Limits `json:"max-len"`
+	// MaxBytes maximum number of bytes accepted per quota period
+	MaxBytes Limits `json:"max-bytes"`
+}
+
+// Override get these quotas with the limits set in o replacing them; a default in o replaces all of the
+// limits here
+func (q Quotas) Override(o *Quotas) Quotas {
+	if o == nil {
+		return q
+	}
+	return Quotas{
+		MaxLen:   q.MaxLen.merge(o.MaxLen),
+		MaxBytes: q.MaxBytes.merge(o.MaxBytes),
+	}
+}
+
+// QuotaExceededError error representing that a device sent more than its quota
+type QuotaExceededError struct {
+	Err string
+}
+
+func (n *QuotaExceededError) Error() string {
+	return n.Err
+}
+
+// QuotaTracker keep track of the quotas of devices, global or per device, and of the bytes they used.
+// A nil tracker has no limits
+type QuotaTracker struct {
+	mu      sync.Mutex
+	global  Quotas
+	period  time.Duration
+	devices map[uuid.UUID]*Quotas
+	usage   map[uuid.UUID]*quotaUsage
+}
+
+type quotaUsage struct {
+	start time.Time
+	bytes map[string]int64
+}
+
+// NewQuotaTracker create a tracker with no limits
+func NewQuotaTracker() *QuotaTracker {
+	return &QuotaTracker{
+		devices: map[uuid.UUID]*Quotas{},
+		usage:   map[uuid.UUID]*quotaUsage{},
+	}
+}
+
+// SetGlobal set the quotas of devices without their own, and the period over which bytes are counted
+func (q *QuotaTracker) SetGlobal(quotas Quotas, period time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.global = quotas
+	q.period = period
+}
+
+// SetDevice set the quotas of a device, overriding the global ones. nil removes them
+func (q *QuotaTracker) SetDevice(u uuid.UUID, quotas *Quotas) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if quotas == nil {
+		delete(q.devices, u)
+		return
+	}
+	q.devices[u] = quotas
+}
+
+// Device get the quotas set for a device, nil if it uses the global ones
+func (q *QuotaTracker) Device(u uuid.UUID) *Quotas {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.devices[u]
+}
+
+// Effective get the quotas that apply to a device
+func (q *QuotaTracker) Effective(u uuid.UUID) Quotas {
+	if q == nil {
+		return Quotas{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.effective(u)
+}
+
+func (q *QuotaTracker) effective(u uuid.UUID) Quotas {
+	return q.global.Override(q.devices[u])
+}
+
+// MaxLen get the maximum number of entries to keep in a stream of a device, 0 for no limit
+func (q *QuotaTracker) MaxLen(u uuid.UUID, kind string) int64 {
+	return q.Effective(u).MaxLen.For(kind)
+}
+
+// Use count n bytes of a kind of message from a device, returning a QuotaExceededError, without counting them,
+// if that would exceed its quota for the current period
+func (q *QuotaTracker) Use(u uuid.UUID, kind string, n int) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limit := q.effective(u).MaxBytes.For(kind)
+	if limit == 0 {
+		return nil
+	}
+	period := q.period
+	if period == 0 {
+		period = DefaultQuotaPeriod
+	}
+	now := time.Now()
+	usage, ok := q.usage[u]
+	if !ok || now.Sub(usage.start) >= period {
+		usage = &quotaUsage{start: now, bytes: map[string]int64{}}
+		q.usage[u] = usage
+	}
+	if usage.bytes[kind]+int64(n) > limit {
+		return &QuotaExceededError{Err: fmt.Sprintf("device %s exceeded its %s quota of %d bytes per %s, %d bytes used, retry after %s",
+			u, kind, limit, period, usage.bytes[kind], usage.start.Add(period).Format(time.RFC3339))}
+	}
+	usage.bytes[kind] += int64(n)
+	return nil
+}
+
+// Forget drop the quotas and usage of a removed device
+func (q *QuotaTracker) Forget(u uuid.UUID) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.devices, u)
+	delete(q.usage, u)
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		s      string
+		limits Limits
+		valid  bool
+	}{
+		{"", Limits{}, true},
+		{"10000", Limits{Default: 10000}, true},
+		{"10000,logs=50000", Limits{Default: 10000, Kinds: map[string]int64{KindLogs: 50000}}, true},
+		{"info=1, apps=2", Limits{Kinds: map[string]int64{KindInfo: 1, KindAppLogs: 2}}, true},
+		{"metrics=0", Limits{Kinds: map[string]int64{KindMetrics: 0}}, true},
+		{"abc", Limits{}, false},
+		{"-1", Limits{}, false},
+		{"foo=1", Limits{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			l, err := ParseLimits(tt.s)
+			switch {
+			case tt.valid && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case !tt.valid && err == nil:
+				t.Errorf("expected an error, got %v", l)
+			case tt.valid && !reflect.DeepEqual(l, tt.limits):
+				t.Errorf("mismatched limits, actual %v expected %v", l, tt.limits)
+			}
+		})
+	}
+}
+
+func TestQuotasOverride(t *testing.T) {
+	global := Quotas{
+		MaxLen:   Limits{Default: 100, Kinds: map[string]int64{KindLogs: 1000}},
+		MaxBytes: Limits{Default: 10},
+	}
+	tests := []struct {
+		name     string
+		device   *Quotas
+		logs     int64
+		info     int64
+		metrics  int64
+		capBytes int64
+	}{
+		{"none", nil, 1000, 100, 100, 10},
+		{"kind", &Quotas{MaxLen: Limits{Kinds: map[string]int64{KindInfo: 5}}}, 1000, 5, 100, 10},
+		{"default", &Quotas{MaxLen: Limits{Default: 7, Kinds: map[string]int64{KindMetrics: 0}}}, 7, 7, 0, 10},
+		{"bytes", &Quotas{MaxBytes: Limits{Default: 20}}, 1000, 100, 100, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := global.Override(tt.device)
+			if v := q.MaxLen.For(KindLogs); v != tt.logs {
+				t.Errorf("mismatched logs max-len, actual %d expected %d", v, tt.logs)
+			}
+			if v := q.MaxLen.For(KindInfo); v != tt.info {
+				t.Errorf("mismatched info max-len, actual %d expected %d", v, tt.info)
+			}
+			if v := q.MaxLen.For(KindMetrics); v != tt.metrics {
+				t.Errorf("mismatched metrics max-len, actual %d expected %d", v, tt.metrics)
+			}
+			if v := q.MaxBytes.For(KindLogs); v != tt.capBytes {
+				t.Errorf("mismatched logs max-bytes, actual %d expected %d", v, tt.capBytes)
+			}
+		})
+	}
+	// the global quotas are left alone
+	if v := global.MaxLen.For(KindInfo); v != 100 {
+		t.Errorf("global quotas changed by override, info max-len %d", v)
+	}
+}
+
+func TestQuotaTracker(t *testing.T) {
+	u, _ := uuid.NewV4()
+	other, _ := uuid.NewV4()
+
+	var nilTracker *QuotaTracker
+	if err := nilTracker.Use(u, KindLogs, 1000); err != nil {
+		t.Errorf("unexpected error from nil tracker: %v", err)
+	}
+
+	q := NewQuotaTracker()
+	q.SetGlobal(Quotas{MaxBytes: Limits{Default: 10}}, 50*time.Millisecond)
+	if err := q.Use(u, KindLogs, 6); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := q.Use(u, KindLogs, 6)
+	if _, ok := err.(*QuotaExceededError); !ok {
+		t.Errorf("expected quota exceeded error, got %v", err)
+	}
+	// other kinds and devices are counted on their own
+	if err := q.Use(u, KindInfo, 6); err != nil {
+		t.Errorf("unexpected error for info: %v", err)
+	}
+	if err := q.Use(other, KindLogs, 6); err != nil {
+		t.Errorf("unexpected error for other device: %v", err)
+	}
+	// a device quota replaces the global one
+	q.SetDevice(u, &Quotas{MaxBytes: Limits{Kinds: map[string]int64{KindLogs: 0}}})
+	if err := q.Use(u, KindLogs, 100); err != nil {
+		t.Errorf("unexpected error with no device limit: %v", err)
+	}
+	q.SetDevice(u, nil)
+	if q.Device(u) != nil {
+		t.Errorf("device quotas not removed")
+	}
+	// a new period starts afresh
+	time.Sleep(60 * time.Millisecond)
+	if err := q.Use(u, KindLogs, 10); err != nil {
+		t.Errorf("unexpected error in new period: %v", err)
+	}
+}
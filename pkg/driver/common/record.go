@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// The kinds of records a RecordStore keeps by key. Each record is the JSON of a type of this package, read and
+// written with its typed accessors, e.g. PendingAdd and PendingGet; but for those of RecordACME, which are PEM
+const (
+	RecordPending        = "pending"         // PendingDevice by ID
+	RecordTokens         = "tokens"          // APIToken by ID
+	RecordRollouts       = "rollouts"        // Rollout by ID
+	RecordSchedules      = "schedules"       // ScheduledChange by ID
+	RecordCanaries       = "canaries"        // Canary by ID
+	RecordAlertRules     = "alert-rules"     // AlertRule by ID
+	RecordTombstones     = "tombstones"      // Tombstone by UUID of the device
+	RecordRevocations    = "revocations"     // Revocation by fingerprint of the certificate
+	RecordSnapshots      = "snapshots"       // ConfigSnapshot by name
+	RecordHardwareModels = "hardware-models" // HardwareModel by name
+	RecordDatastores     = "datastores"      // Datastore by name
+	RecordImages         = "images"          // Image by name
+	RecordDeadLetters    = "dead-letters"    // DeadLetter by ID
+	RecordACME           = "acme"            // ACME account key and certificate obtained with its key, by name
+)
+
+// RecordKinds every kind of record, each of which a RecordStore keeps
+var RecordKinds = []string{
+	RecordPending, RecordTokens, RecordRollouts, RecordSchedules, RecordCanaries, RecordAlertRules, RecordTombstones,
+	RecordRevocations, RecordSnapshots, RecordHardwareModels, RecordDatastores, RecordImages, RecordDeadLetters,
+	RecordACME,
+}
+
+// recordNames what the records of each kind are, for errors
+var recordNames = map[string]string{
+	RecordPending:        "pending device",
+	RecordTokens:         "API token",
+	RecordRollouts:       "rollout",
+	RecordSchedules:      "scheduled change",
+	RecordCanaries:       "canary",
+	RecordAlertRules:     "alert rule",
+	RecordTombstones:     "tombstone",
+	RecordRevocations:    "revocation",
+	RecordSnapshots:      "config snapshot",
+	RecordHardwareModels: "hardware model",
+	RecordDatastores:     "datastore",
+	RecordImages:         "image",
+	RecordDeadLetters:    "dead letter",
+	RecordACME:           "acme data",
+}
+
+// RecordStore keeps records of each of the RecordKinds by key, as the bytes they are encoded to, so that a driver
+// stores every kind the same way. The records are read and written with the typed accessors of this package
+type RecordStore interface {
+	// PutRecord add a record of a kind, or replace the one with the same key
+	PutRecord(kind, key string, b []byte) error
+	// GetRecord get a record of a kind by key. Return a *NotFoundError if there is none
+	GetRecord(kind, key string) ([]byte, error)
+	// ListRecords list the records of a kind, by key
+	ListRecords(kind string) (map[string][]byte, error)
+	// RemoveRecord remove a record of a kind by key. Return a *NotFoundError if there is none
+	RemoveRecord(kind, key string) error
+}
+
+// RecordNotFound the error of a RecordStore without a record of a kind
+func RecordNotFound(kind, key string) *NotFoundError {
+	return &NotFoundError{Err: fmt.Sprintf("%s not found: %s", recordName(kind), key)}
+}
+
+// recordName what the records of a kind are, the kind itself if it is unknown
+func recordName(kind string) string {
+	if name, ok := recordNames[kind]; ok {
+		return name
+	}
+	return kind
+}
+
+// putJSON add the JSON of a record of a kind, or replace the one with the same key
+func putJSON(s RecordStore, kind, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("unable to encode %s %s: %v", recordName(kind), key, err)
+	}
+	return s.PutRecord(kind, key, b)
+}
+
+// getJSON get a record of a kind by key, decoding its JSON into v
+func getJSON(s RecordStore, kind, key string, v interface{}) error {
+	b, err := s.GetRecord(kind, key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("unable to decode %s %s: %v", recordName(kind), key, err)
+	}
+	return nil
+}
+
+// listJSON list the records of a kind in the order of their keys, decoding the JSON of each into the value next
+// returns
+func listJSON(s RecordStore, kind string, next func() interface{}) error {
+	records, err := s.ListRecords(kind)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := json.Unmarshal(records[k], next()); err != nil {
+			return fmt.Errorf("unable to decode %s %s: %v", recordName(kind), k, err)
+		}
+	}
+	return nil
+}
+
+// ACMEGet get the named ACME data, the account key or the certificate obtained with its key. Return a
+// *NotFoundError if there is none
+func ACMEGet(s RecordStore, name string) ([]byte, error) {
+	return s.GetRecord(RecordACME, name)
+}
+
+// ACMESet set the named ACME data, replacing any
+func ACMESet(s RecordStore, name string, b []byte) error {
+	return s.PutRecord(RecordACME, name, b)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRecords a RecordStore in a map, by kind and key
+type testRecords map[string]map[string][]byte
+
+func (r testRecords) PutRecord(kind, key string, b []byte) error {
+	if r[kind] == nil {
+		r[kind] = map[string][]byte{}
+	}
+	r[kind][key] = append([]byte(nil), b...)
+	return nil
+}
+
+func (r testRecords) GetRecord(kind, key string) ([]byte, error) {
+	b, ok := r[kind][key]
+	if !ok {
+		return nil, RecordNotFound(kind, key)
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (r testRecords) ListRecords(kind string) (map[string][]byte, error) {
+	records := map[string][]byte{}
+	for k, b := range r[kind] {
+		records[k] = append([]byte(nil), b...)
+	}
+	return records, nil
+}
+
+func (r testRecords) RemoveRecord(kind, key string) error {
+	if _, ok := r[kind][key]; !ok {
+		return RecordNotFound(kind, key)
+	}
+	delete(r[kind], key)
+	return nil
+}
+
+func TestRecords(t *testing.T) {
+	at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := testRecords{}
+
+	list, err := RolloutList(s)
+	if err != nil {
+		t.Fatalf("unexpected error listing: %v", err)
+	}
+	// listed as an empty list, not null, when there is none
+	if list == nil || len(list) != 0 {
+		t.Errorf("mismatched rollouts, actual %v expected none", list)
+	}
+	_, err = RolloutGet(s, "b")
+	if _, ok := err.(*NotFoundError); !ok || !strings.Contains(err.Error(), "rollout not found: b") {
+		t.Errorf("mismatched error, actual %v expected rollout not found", err)
+	}
+
+	b := &Rollout{ID: "b", Name: "second", State: RolloutRunning, Created: at, Updated: at}
+	a := &Rollout{ID: "a", Name: "first", State: RolloutRunning, Created: at, Updated: at}
+	for _, ro := range []*Rollout{b, a} {
+		if err := RolloutSet(s, ro); err != nil {
+			t.Fatalf("unexpected error setting %s: %v", ro.ID, err)
+		}
+	}
+	got, err := RolloutGet(s, "b")
+	if err != nil {
+		t.Fatalf("unexpected error getting: %v", err)
+	}
+	if !reflect.DeepEqual(got, b) {
+		t.Errorf("mismatched rollout, actual %+v expected %+v", got, b)
+	}
+	// in the order of their keys
+	list, err = RolloutList(s)
+	if err != nil {
+		t.Fatalf("unexpected error listing: %v", err)
+	}
+	if !reflect.DeepEqual(list, []*Rollout{a, b}) {
+		t.Errorf("mismatched rollouts, actual %+v expected %+v", list, []*Rollout{a, b})
+	}
+
+	if err := RolloutRemove(s, "a"); err != nil {
+		t.Fatalf("unexpected error removing: %v", err)
+	}
+	if _, ok := RolloutRemove(s, "a").(*NotFoundError); !ok {
+		t.Errorf("expected a not found error removing again")
+	}
+
+	// a record that is not the JSON of its type is an error, not a record
+	s.PutRecord(RecordRollouts, "c", []byte("not json"))
+	if _, err := RolloutList(s); err == nil || !strings.Contains(err.Error(), "unable to decode rollout c") {
+		t.Errorf("mismatched error, actual %v expected unable to decode", err)
+	}
+}
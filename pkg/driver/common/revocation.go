@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const (
+	// RevokedDevice a revoked device certificate
+	RevokedDevice = "device"
+	// RevokedOnboard a revoked onboarding certificate
+	RevokedOnboard = "onboard"
+)
+
+// Revocation a device or onboarding certificate revoked, so that every request made with it is refused, by the
+// fingerprint of the certificate
+type Revocation struct {
+	// Fingerprint hex-encoded SHA-256 of the DER of the certificate, as returned by CertFingerprint
+	Fingerprint string `json:"fingerprint"`
+	// Kind RevokedDevice or RevokedOnboard, empty if it was revoked by fingerprint alone
+	Kind string `json:"kind,omitempty"`
+	// Subject common name of the certificate, if known
+	Subject string `json:"subject,omitempty"`
+	// SerialNumber hex-encoded serial number of the certificate, if known, for CRLs
+	SerialNumber string `json:"serial-number,omitempty"`
+	// Issuer common name of the issuer of the certificate, if known
+	Issuer string `json:"issuer,omitempty"`
+	// Reason why the certificate was revoked, free text
+	Reason  string    `json:"reason,omitempty"`
+	Revoked time.Time `json:"revoked"`
+	// Actor who revoked the certificate, as in the audit log
+	Actor string `json:"actor,omitempty"`
+}
+
+// CertFingerprint the fingerprint of a certificate, the hex-encoded SHA-256 of its DER
+func CertFingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(hash[:])
+}
+
+// NewRevocation the revocation of a certificate of a kind
+func NewRevocation(cert *x509.Certificate, kind, reason string) *Revocation {
+	return &Revocation{
+		Fingerprint:  CertFingerprint(cert),
+		Kind:         kind,
+		Subject:      cert.Subject.CommonName,
+		SerialNumber: cert.SerialNumber.Text(16),
+		Issuer:       cert.Issuer.CommonName,
+		Reason:       reason,
+		Revoked:      time.Now(),
+	}
+}
+
+// ValidateFingerprint check that a fingerprint is a hex-encoded SHA-256, and normalize it to lower case
+func ValidateFingerprint(fingerprint string) (string, error) {
+	b, err := hex.DecodeString(fingerprint)
+	if err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("bad fingerprint %q, must be the hex-encoded SHA-256 of the certificate", fingerprint)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// RevocationAdd revoke a device or onboarding certificate, replacing any revocation with the same fingerprint
+func RevocationAdd(s RecordStore, r *Revocation) error {
+	return putJSON(s, RecordRevocations, r.Fingerprint, r)
+}
+
+// RevocationGet get the revocation of a certificate by its fingerprint. Return a *NotFoundError if it is not revoked
+func RevocationGet(s RecordStore, fingerprint string) (*Revocation, error) {
+	var r Revocation
+	if err := getJSON(s, RecordRevocations, fingerprint, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// RevocationList list the revoked certificates
+func RevocationList(s RecordStore) ([]*Revocation, error) {
+	revocations := []*Revocation{}
+	err := listJSON(s, RecordRevocations, func() interface{} {
+		revocations = append(revocations, &Revocation{})
+		return revocations[len(revocations)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+// RevocationRemove remove the revocation of a certificate, so that it is accepted again
+func RevocationRemove(s RecordStore, fingerprint string) error {
+	return s.RemoveRecord(RecordRevocations, fingerprint)
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateFingerprint(t *testing.T) {
+	fingerprint := strings.Repeat("ab", 32)
+	tests := []struct {
+		name        string
+		fingerprint string
+		expected    string
+		valid       bool
+	}{
+		{"lower case", fingerprint, fingerprint, true},
+		{"upper case", strings.ToUpper(fingerprint), fingerprint, true},
+		{"too short", fingerprint[:62], "", false},
+		{"too long", fingerprint + "ab", "", false},
+		{"not hex", strings.Repeat("zz", 32), "", false},
+		{"empty", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := ValidateFingerprint(tt.fingerprint)
+			switch {
+			case tt.valid && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case !tt.valid && err == nil:
+				t.Errorf("expected an error")
+			case actual != tt.expected:
+				t.Errorf("mismatched fingerprint, actual %s expected %s", actual, tt.expected)
+			}
+		})
+	}
+}
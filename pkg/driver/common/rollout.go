@@ -0,0 +1,215 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// states of a rollout
+const (
+	RolloutRunning   = "running"
+	RolloutPaused    = "paused"
+	RolloutHalted    = "halted"
+	RolloutCompleted = "completed"
+)
+
+// states of a device in a rollout
+const (
+	// RolloutDevicePending the change is not applied to the device yet
+	RolloutDevicePending = "pending"
+	// RolloutDeviceApplied the change is applied, waiting for the device to acknowledge the new config
+	RolloutDeviceApplied      = "applied"
+	RolloutDeviceAcknowledged = "acknowledged"
+	// RolloutDeviceFailed the change could not be applied, or was not acknowledged within the wave timeout
+	RolloutDeviceFailed = "failed"
+)
+
+// RolloutDevice progress of the rollout on one device
+type RolloutDevice struct {
+	UUID string `json:"uuid"`
+	// Wave the wave the device is in, from 0
+	Wave   int    `json:"wave"`
+	Status string `json:"status"`
+	// Hash of the config applied, that the device has to acknowledge
+	Hash         string     `json:"hash,omitempty"`
+	Applied      *time.Time `json:"applied,omitempty"`
+	Acknowledged *time.Time `json:"acknowledged,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// Rollout a config change applied to a group of devices in waves. Each wave is applied once the devices of the
+// previous one acknowledged the change, or failed to in time, and the rollout halts once too many devices failed
+type Rollout struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Patch JSON merge patch applied to the config of each device
+	Patch json.RawMessage `json:"patch,omitempty"`
+	// Template config set on each device instead of patching theirs, with the UUID of the device
+	Template json.RawMessage `json:"template,omitempty"`
+	// WaveSize percentage of the devices in each wave, at least one device
+	WaveSize int `json:"wave-size"`
+	// WaveTimeout how long, in seconds, each device has to acknowledge the change once applied
+	WaveTimeout int `json:"wave-timeout"`
+	// MaxFailures number of devices that can fail before the rollout halts
+	MaxFailures int    `json:"max-failures"`
+	State       string `json:"state"`
+	// Reason why the rollout halted
+	Reason  string          `json:"reason,omitempty"`
+	Created time.Time       `json:"created"`
+	Updated time.Time       `json:"updated"`
+	Devices []RolloutDevice `json:"devices"`
+}
+
+// NewRollout plan a running rollout of a change to devices, splitting them into waves of waveSize percent
+func NewRollout(id, name string, devices []string, waveSize int) *Rollout {
+	perWave := (len(devices)*waveSize + 99) / 100
+	if perWave < 1 {
+		perWave = 1
+	}
+	now := time.Now()
+	r := &Rollout{
+		ID:       id,
+		Name:     name,
+		WaveSize: waveSize,
+		State:    RolloutRunning,
+		Created:  now,
+		Updated:  now,
+		Devices:  make([]RolloutDevice, 0, len(devices)),
+	}
+	for i, u := range devices {
+		r.Devices = append(r.Devices, RolloutDevice{UUID: u, Wave: i / perWave, Status: RolloutDevicePending})
+	}
+	return r
+}
+
+// Failures number of devices the rollout failed on
+func (r *Rollout) Failures() int {
+	n := 0
+	for _, d := range r.Devices {
+		if d.Status == RolloutDeviceFailed {
+			n++
+		}
+	}
+	return n
+}
+
+// Advance move a running rollout on. Devices of the current wave that acknowledged the change are done, and those that
+// have not within WaveTimeout failed; once none is left waiting, the next wave is applied. acknowledged reports
+// whether a device reported having the config of a hash, and apply applies the change to a device, returning the hash
+// of its new config. Returns whether anything changed
+func (r *Rollout) Advance(now time.Time, acknowledged func(u, hash string) (bool, error), apply func(u string) (string, error)) (bool, error) {
+	if r.State != RolloutRunning {
+		return false, nil
+	}
+	timeout := time.Duration(r.WaveTimeout) * time.Second
+	changed := false
+	waiting := false
+	for i := range r.Devices {
+		d := &r.Devices[i]
+		if d.Status != RolloutDeviceApplied {
+			continue
+		}
+		ok, err := acknowledged(d.UUID, d.Hash)
+		switch {
+		case err != nil:
+			return changed, fmt.Errorf("unable to check the config of device %s: %v", d.UUID, err)
+		case ok:
+			d.Status = RolloutDeviceAcknowledged
+			d.Acknowledged = &now
+			changed = true
+		case now.Sub(*d.Applied) > timeout:
+			d.Status = RolloutDeviceFailed
+			d.Error = fmt.Sprintf("config not acknowledged within %s", timeout)
+			changed = true
+		default:
+			waiting = true
+		}
+	}
+	if r.halt() {
+		r.Updated = now
+		return true, nil
+	}
+	if waiting {
+		if changed {
+			r.Updated = now
+		}
+		return changed, nil
+	}
+
+	// the next wave is the first with devices the change is not applied to
+	wave := -1
+	for _, d := range r.Devices {
+		if d.Status == RolloutDevicePending && (wave < 0 || d.Wave < wave) {
+			wave = d.Wave
+		}
+	}
+	if wave < 0 {
+		r.State = RolloutCompleted
+		r.Updated = now
+		return true, nil
+	}
+	for i := range r.Devices {
+		d := &r.Devices[i]
+		if d.Status != RolloutDevicePending || d.Wave != wave {
+			continue
+		}
+		hash, err := apply(d.UUID)
+		if err != nil {
+			d.Status = RolloutDeviceFailed
+			d.Error = err.Error()
+			continue
+		}
+		d.Status = RolloutDeviceApplied
+		d.Hash = hash
+		d.Applied = &now
+	}
+	r.halt()
+	r.Updated = now
+	return true, nil
+}
+
+// halt halt the rollout if more devices failed than allowed, returning whether it did
+func (r *Rollout) halt() bool {
+	if failures := r.Failures(); failures > r.MaxFailures {
+		r.State = RolloutHalted
+		r.Reason = fmt.Sprintf("%d devices failed, more than the %d allowed", failures, r.MaxFailures)
+		return true
+	}
+	return false
+}
+
+// RolloutSet add a config rollout, or replace the one with the same ID, e.g. to record its progress
+func RolloutSet(s RecordStore, ro *Rollout) error {
+	return putJSON(s, RecordRollouts, ro.ID, ro)
+}
+
+// RolloutGet get a config rollout by ID. Return a *NotFoundError if there is none
+func RolloutGet(s RecordStore, id string) (*Rollout, error) {
+	var ro Rollout
+	if err := getJSON(s, RecordRollouts, id, &ro); err != nil {
+		return nil, err
+	}
+	return &ro, nil
+}
+
+// RolloutList list the config rollouts
+func RolloutList(s RecordStore) ([]*Rollout, error) {
+	rollouts := []*Rollout{}
+	err := listJSON(s, RecordRollouts, func() interface{} {
+		rollouts = append(rollouts, &Rollout{})
+		return rollouts[len(rollouts)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rollouts, nil
+}
+
+// RolloutRemove remove a config rollout
+func RolloutRemove(s RecordStore, id string) error {
+	return s.RemoveRecord(RecordRollouts, id)
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewRollout(t *testing.T) {
+	tests := []struct {
+		devices  int
+		waveSize int
+		waves    []int
+	}{
+		{0, 10, []int{}},
+		{1, 10, []int{0}},
+		{4, 25, []int{0, 1, 2, 3}},
+		{5, 50, []int{0, 0, 0, 1, 1}},
+		{3, 100, []int{0, 0, 0}},
+		{3, 1, []int{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d/%d", tt.devices, tt.waveSize), func(t *testing.T) {
+			var devices []string
+			for i := 0; i < tt.devices; i++ {
+				devices = append(devices, fmt.Sprintf("dev%d", i))
+			}
+			r := NewRollout("id", "", devices, tt.waveSize)
+			waves := []int{}
+			for _, d := range r.Devices {
+				waves = append(waves, d.Wave)
+			}
+			if !reflect.DeepEqual(waves, tt.waves) {
+				t.Errorf("mismatched waves, actual %v expected %v", waves, tt.waves)
+			}
+		})
+	}
+}
+
+func TestRolloutAdvance(t *testing.T) {
+	start := time.Now()
+	// devices acknowledge the hash applied to them, unless they are broken
+	applied := map[string]string{}
+	apply := func(u string) (string, error) {
+		if u == "bad" {
+			return "", fmt.Errorf("invalid config")
+		}
+		applied[u] = "hash-" + u
+		return applied[u], nil
+	}
+	newRollout := func(maxFailures int, devices ...string) *Rollout {
+		r := NewRollout("id", "", devices, 50)
+		r.WaveTimeout = 60
+		r.MaxFailures = maxFailures
+		return r
+	}
+	status := func(r *Rollout) []string {
+		var s []string
+		for _, d := range r.Devices {
+			s = append(s, d.Status)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		rollout *Rollout
+		broken  map[string]bool
+		// steps times after start to advance at, with the state and device statuses after each
+		steps    []time.Duration
+		states   []string
+		statuses [][]string
+	}{
+		{
+			name:    "completes",
+			rollout: newRollout(0, "a", "b", "c", "d"),
+			steps:   []time.Duration{0, time.Second, 2 * time.Second},
+			states:  []string{RolloutRunning, RolloutRunning, RolloutCompleted},
+			statuses: [][]string{
+				{RolloutDeviceApplied, RolloutDeviceApplied, RolloutDevicePending, RolloutDevicePending},
+				{RolloutDeviceAcknowledged, RolloutDeviceAcknowledged, RolloutDeviceApplied, RolloutDeviceApplied},
+				{RolloutDeviceAcknowledged, RolloutDeviceAcknowledged, RolloutDeviceAcknowledged, RolloutDeviceAcknowledged},
+			},
+		},
+		{
+			name:    "waits for the wave",
+			rollout: newRollout(0, "a", "b", "c", "d"),
+			broken:  map[string]bool{"b": true},
+			steps:   []time.Duration{0, time.Second},
+			states:  []string{RolloutRunning, RolloutRunning},
+			statuses: [][]string{
+				{RolloutDeviceApplied, RolloutDeviceApplied, RolloutDevicePending, RolloutDevicePending},
+				{RolloutDeviceAcknowledged, RolloutDeviceApplied, RolloutDevicePending, RolloutDevicePending},
+			},
+		},
+		{
+			name:    "halts on timeout",
+			rollout: newRollout(0, "a", "b", "c", "d"),
+			broken:  map[string]bool{"b": true},
+			steps:   []time.Duration{0, 2 * time.Minute},
+			states:  []string{RolloutRunning, RolloutHalted},
+			statuses: [][]string{
+				{RolloutDeviceApplied, RolloutDeviceApplied, RolloutDevicePending, RolloutDevicePending},
+				{RolloutDeviceAcknowledged, RolloutDeviceFailed, RolloutDevicePending, RolloutDevicePending},
+			},
+		},
+		{
+			name:    "tolerates failures",
+			rollout: newRollout(1, "a", "bad", "c", "d"),
+			steps:   []time.Duration{0, time.Second, 2 * time.Second},
+			states:  []string{RolloutRunning, RolloutRunning, RolloutCompleted},
+			statuses: [][]string{
+				{RolloutDeviceApplied, RolloutDeviceFailed, RolloutDevicePending, RolloutDevicePending},
+				{RolloutDeviceAcknowledged, RolloutDeviceFailed, RolloutDeviceApplied, RolloutDeviceApplied},
+				{RolloutDeviceAcknowledged, RolloutDeviceFailed, RolloutDeviceAcknowledged, RolloutDeviceAcknowledged},
+			},
+		},
+		{
+			name:    "halts on apply failure",
+			rollout: newRollout(0, "bad", "b"),
+			steps:   []time.Duration{0},
+			states:  []string{RolloutHalted},
+			statuses: [][]string{
+				{RolloutDeviceFailed, RolloutDevicePending},
+			},
+		},
+		{
+			name:     "no devices",
+			rollout:  newRollout(0),
+			steps:    []time.Duration{0},
+			states:   []string{RolloutCompleted},
+			statuses: [][]string{nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acknowledged := func(u, hash string) (bool, error) {
+				return !tt.broken[u] && applied[u] == hash, nil
+			}
+			for i, step := range tt.steps {
+				if _, err := tt.rollout.Advance(start.Add(step), acknowledged, apply); err != nil {
+					t.Fatalf("unexpected error at step %d: %v", i, err)
+				}
+				if tt.rollout.State != tt.states[i] {
+					t.Errorf("mismatched state at step %d, actual %s expected %s", i, tt.rollout.State, tt.states[i])
+				}
+				if s := status(tt.rollout); !reflect.DeepEqual(s, tt.statuses[i]) {
+					t.Errorf("mismatched statuses at step %d, actual %v expected %v", i, s, tt.statuses[i])
+				}
+			}
+		})
+	}
+
+	r := newRollout(0, "a")
+	r.State = RolloutPaused
+	if changed, err := r.Advance(start, nil, nil); changed || err != nil {
+		t.Errorf("paused rollout advanced: %v %v", changed, err)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	s3Service       = "s3"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3DateFormat    = "20060102T150405Z"
+	s3Timeout       = 30 * time.Second
+)
+
+// s3Store a ColdStore in an S3 bucket, or any service with its API, e.g. MinIO, under a prefix
+type s3Store struct {
+	// endpoint of the service, the bucket being in the path, so that any bucket name works with any service
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+	// now the time requests are signed at, time.Now but in tests
+	now func() time.Time
+}
+
+// NewS3Store a ColdStore in an S3 bucket, under a prefix. The credentials are read from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and, for temporary ones, AWS_SESSION_TOKEN environment variables, the region from AWS_REGION,
+// us-east-1 if unset, and the endpoint from AWS_ENDPOINT_URL, for other services than AWS, e.g. http://minio:9000
+func NewS3Store(bucket, prefix string) (ColdStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket")
+	}
+	s := &s3Store{
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: s3Timeout},
+		now:          time.Now,
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("S3 credentials required, from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = s3DefaultRegion
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("bad S3 endpoint %q, must be http or https", endpoint)
+	}
+	s.endpoint = u
+	return s, nil
+}
+
+func (s *s3Store) Name() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.prefix)
+}
+
+// key the key of an object in the bucket, under the prefix
+func (s *s3Store) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *s3Store) Put(key string, b []byte) error {
+	res, err := s.do(http.MethodPut, s.key(key), nil, b)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res, "put", key)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(key string) ([]byte, error) {
+	res, err := s.do(http.MethodGet, s.key(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, &NotFoundError{Err: fmt.Sprintf("archived %s not found", key)}
+	default:
+		return nil, s3Error(res, "get", key)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read S3 object %s: %v", key, err)
+	}
+	return b, nil
+}
+
+// s3ListResult the answer to ListObjectsV2
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Store) List(prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.key(prefix)}}
+	for {
+		res, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read S3 objects %s: %v", prefix, err)
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unable to list S3 objects %s: %s %s", prefix, res.Status, bytes.TrimSpace(b))
+		}
+		var result s3ListResult
+		if err := xml.Unmarshal(b, &result); err != nil {
+			return nil, fmt.Errorf("bad list of S3 objects %s: %v", prefix, err)
+		}
+		for _, c := range result.Contents {
+			k := c.Key
+			if s.prefix != "" {
+				k = strings.TrimPrefix(k, s.prefix+"/")
+			}
+			keys = append(keys, k)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, s.key(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3Error(res, "remove", key)
+	}
+	return nil
+}
+
+// do send a signed request for an object of the bucket, or for the bucket itself if the key is empty
+func (s *s3Store) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create S3 request: %v", err)
+	}
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	signS3(req, body, s.accessKey, s.secretKey, s.region, s.now())
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error %s S3 %s: %v", method, u.Path, err)
+	}
+	return res, nil
+}
+
+func s3Error(res *http.Response, action, key string) error {
+	b, _ := ioutil.ReadAll(res.Body)
+	return fmt.Errorf("unable to %s S3 object %s: %s %s", action, key, res.Status, bytes.TrimSpace(b))
+}
+
+// signS3 sign a request with AWS Signature Version 4, over the host and every header set in the request
+func signS3(req *http.Request, body []byte, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3DateFormat)
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{now.Format("20060102"), region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, k := range []string{now.Format("20060102"), region, s3Service, "aws4_request"} {
+		key = hmacSHA256(key, k)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3Algorithm, accessKey, scope, signedHeaders, signature))
+}
+
+// s3CanonicalQuery the query of a request sorted by key, with its keys and values escaped as AWS requires
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encode everything but the unreserved characters of RFC 3986, and slashes unless asked to
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
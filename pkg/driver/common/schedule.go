@@ -0,0 +1,242 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// states of a scheduled config change
+const (
+	SchedulePending = "pending"
+	ScheduleApplied = "applied"
+)
+
+// states of a device in a scheduled config change
+const (
+	ScheduleDevicePending = "pending"
+	ScheduleDeviceApplied = "applied"
+	// ScheduleDeviceFailed the change could not be applied, e.g. the device was removed or the config is invalid
+	ScheduleDeviceFailed = "failed"
+)
+
+// weekdays the names of the days of a maintenance window, in the order of time.Weekday
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// MaintenanceWindow a recurring period, e.g. every saturday from 02:00 for 2 hours, a change can be applied in
+type MaintenanceWindow struct {
+	// Days the days the window opens on, as mon, tue, wed, thu, fri, sat and sun; every day if empty
+	Days []string `json:"days,omitempty"`
+	// Start the time of the day the window opens at, as HH:MM
+	Start string `json:"start"`
+	// Duration how long, in seconds, the window stays open, at most a day. A window can go past midnight
+	Duration int `json:"duration"`
+	// Timezone IANA name of the timezone of Start, e.g. Europe/Berlin; UTC if empty
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// Validate check the days, start, duration and timezone of the window
+func (w *MaintenanceWindow) Validate() error {
+	for _, d := range w.Days {
+		if weekday(d) < 0 {
+			return fmt.Errorf("unknown day %s, expected one of %s", d, strings.Join(weekdays, ", "))
+		}
+	}
+	if _, _, err := w.start(); err != nil {
+		return err
+	}
+	if w.Duration <= 0 || w.Duration > 24*60*60 {
+		return fmt.Errorf("duration %d is not between 1 second and a day", w.Duration)
+	}
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %s: %v", w.Timezone, err)
+	}
+	return nil
+}
+
+// Open whether the window is open at t. A window that is not valid is never open
+func (w *MaintenanceWindow) Open(t time.Time) bool {
+	hour, minute, err := w.start()
+	if err != nil {
+		return false
+	}
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return false
+	}
+	t = t.In(loc)
+	// the window open at t opened either on the day of t, or the day before and went past midnight
+	for _, days := range []int{0, -1} {
+		y, m, d := t.AddDate(0, 0, days).Date()
+		start := time.Date(y, m, d, hour, minute, 0, 0, loc)
+		if !w.on(start.Weekday()) {
+			continue
+		}
+		if !t.Before(start) && t.Before(start.Add(time.Duration(w.Duration)*time.Second)) {
+			return true
+		}
+	}
+	return false
+}
+
+// on whether the window opens on a day
+func (w *MaintenanceWindow) on(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekday(d) == int(day) {
+			return true
+		}
+	}
+	return false
+}
+
+// start the hour and minute the window opens at
+func (w *MaintenanceWindow) start() (int, int, error) {
+	t, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("start %s is not a time of the day as HH:MM", w.Start)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// weekday the time.Weekday of the name of a day, case insensitive, or -1 if it is not one
+func weekday(name string) int {
+	for i, d := range weekdays {
+		if strings.EqualFold(d, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ScheduledDevice the outcome of a scheduled change on one device
+type ScheduledDevice struct {
+	UUID   string `json:"uuid"`
+	Status string `json:"status"`
+	// Hash of the config applied
+	Hash  string `json:"hash,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ScheduledChange a config change applied to a group of devices at once, no earlier than At and, if there is one, while
+// Window is open
+type ScheduledChange struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Patch JSON merge patch applied to the config of each device
+	Patch json.RawMessage `json:"patch,omitempty"`
+	// Template config set on each device instead of patching theirs, with the UUID of the device
+	Template json.RawMessage `json:"template,omitempty"`
+	// At the earliest time the change is applied; nil for the first time Window is open
+	At *time.Time `json:"at,omitempty"`
+	// Window the maintenance window the change is applied in; nil for At, whatever the time of day
+	Window  *MaintenanceWindow `json:"window,omitempty"`
+	State   string             `json:"state"`
+	Created time.Time          `json:"created"`
+	Updated time.Time          `json:"updated"`
+	Applied *time.Time         `json:"applied,omitempty"`
+	Devices []ScheduledDevice  `json:"devices"`
+}
+
+// NewScheduledChange schedule a pending change to devices
+func NewScheduledChange(id, name string, devices []string) *ScheduledChange {
+	now := time.Now()
+	s := &ScheduledChange{
+		ID:      id,
+		Name:    name,
+		State:   SchedulePending,
+		Created: now,
+		Updated: now,
+		Devices: make([]ScheduledDevice, 0, len(devices)),
+	}
+	for _, u := range devices {
+		s.Devices = append(s.Devices, ScheduledDevice{UUID: u, Status: ScheduleDevicePending})
+	}
+	return s
+}
+
+// Due whether a pending change is to be applied at now
+func (s *ScheduledChange) Due(now time.Time) bool {
+	if s.State != SchedulePending {
+		return false
+	}
+	if s.At != nil && now.Before(*s.At) {
+		return false
+	}
+	return s.Window == nil || s.Window.Open(now)
+}
+
+// Failures number of devices the change failed on
+func (s *ScheduledChange) Failures() int {
+	n := 0
+	for _, d := range s.Devices {
+		if d.Status == ScheduleDeviceFailed {
+			n++
+		}
+	}
+	return n
+}
+
+// Apply apply a change that is due to all of its devices. apply applies the change to a device, returning the hash of
+// its new config. Returns whether the change was due
+func (s *ScheduledChange) Apply(now time.Time, apply func(u string) (string, error)) bool {
+	if !s.Due(now) {
+		return false
+	}
+	for i := range s.Devices {
+		d := &s.Devices[i]
+		if d.Status != ScheduleDevicePending {
+			continue
+		}
+		hash, err := apply(d.UUID)
+		if err != nil {
+			d.Status = ScheduleDeviceFailed
+			d.Error = err.Error()
+			continue
+		}
+		d.Status = ScheduleDeviceApplied
+		d.Hash = hash
+	}
+	s.State = ScheduleApplied
+	s.Applied = &now
+	s.Updated = now
+	return true
+}
+
+// ScheduleSet add a scheduled config change, or replace the one with the same ID, e.g. once applied
+func ScheduleSet(s RecordStore, sc *ScheduledChange) error {
+	return putJSON(s, RecordSchedules, sc.ID, sc)
+}
+
+// ScheduleGet get a scheduled config change by ID. Return a *NotFoundError if there is none
+func ScheduleGet(s RecordStore, id string) (*ScheduledChange, error) {
+	var sc ScheduledChange
+	if err := getJSON(s, RecordSchedules, id, &sc); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+// ScheduleList list the scheduled config changes
+func ScheduleList(s RecordStore) ([]*ScheduledChange, error) {
+	schedules := []*ScheduledChange{}
+	err := listJSON(s, RecordSchedules, func() interface{} {
+		schedules = append(schedules, &ScheduledChange{})
+		return schedules[len(schedules)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// ScheduleRemove remove a scheduled config change, cancelling it if pending
+func ScheduleRemove(s RecordStore, id string) error {
+	return s.RemoveRecord(RecordSchedules, id)
+}
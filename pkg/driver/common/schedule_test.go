@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowValidate(t *testing.T) {
+	tests := []struct {
+		window MaintenanceWindow
+		valid  bool
+	}{
+		{MaintenanceWindow{Start: "02:00", Duration: 3600}, true},
+		{MaintenanceWindow{Days: []string{"sat", "Sun"}, Start: "23:30", Duration: 86400, Timezone: "UTC"}, true},
+		{MaintenanceWindow{Days: []string{"someday"}, Start: "02:00", Duration: 3600}, false},
+		{MaintenanceWindow{Start: "2am", Duration: 3600}, false},
+		{MaintenanceWindow{Start: "24:00", Duration: 3600}, false},
+		{MaintenanceWindow{Start: "02:00"}, false},
+		{MaintenanceWindow{Start: "02:00", Duration: 86401}, false},
+		{MaintenanceWindow{Start: "02:00", Duration: 3600, Timezone: "Nowhere/Special"}, false},
+	}
+	for i, tt := range tests {
+		if err := tt.window.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%d: %+v valid %v, expected %v: %v", i, tt.window, err == nil, tt.valid, err)
+		}
+	}
+}
+
+func TestMaintenanceWindowOpen(t *testing.T) {
+	// a saturday
+	sat := func(hour, minute int) time.Time {
+		return time.Date(2021, 6, 5, hour, minute, 0, 0, time.UTC)
+	}
+	fixed := MaintenanceWindow{Start: "02:00", Duration: 7200, Timezone: "UTC"}
+	weekend := MaintenanceWindow{Days: []string{"fri"}, Start: "23:00", Duration: 7200}
+	tests := []struct {
+		window MaintenanceWindow
+		t      time.Time
+		open   bool
+	}{
+		{fixed, sat(1, 59), false},
+		{fixed, sat(2, 0), true},
+		{fixed, sat(3, 59), true},
+		{fixed, sat(4, 0), false},
+		// opened on friday and went past midnight
+		{weekend, sat(0, 30), true},
+		{weekend, sat(1, 0), false},
+		{weekend, sat(23, 30), false},
+		{weekend, sat(0, 0).AddDate(0, 0, -1).Add(23*time.Hour + 30*time.Minute), true},
+		// the start is in the timezone of the window
+		{MaintenanceWindow{Start: "04:00", Duration: 3600, Timezone: "Etc/GMT-2"}, sat(2, 30), true},
+		{MaintenanceWindow{Start: "04:00", Duration: 3600, Timezone: "Etc/GMT-2"}, sat(4, 30), false},
+		{MaintenanceWindow{Start: "bad", Duration: 3600}, sat(2, 30), false},
+	}
+	for i, tt := range tests {
+		if open := tt.window.Open(tt.t); open != tt.open {
+			t.Errorf("%d: %+v open at %v is %v, expected %v", i, tt.window, tt.t, open, tt.open)
+		}
+	}
+}
+
+func TestScheduledChangeApply(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+	apply := func(u string) (string, error) {
+		if u == "bad" {
+			return "", fmt.Errorf("invalid config")
+		}
+		return "hash-" + u, nil
+	}
+
+	s := NewScheduledChange("id", "", []string{"good", "bad"})
+	s.At = &later
+	if s.Apply(now, apply) {
+		t.Fatalf("applied a change before its time")
+	}
+	if !s.Apply(later, apply) {
+		t.Fatalf("did not apply a change that is due")
+	}
+	if s.State != ScheduleApplied || s.Applied == nil || !s.Applied.Equal(later) {
+		t.Errorf("mismatched state %s applied %v", s.State, s.Applied)
+	}
+	if d := s.Devices[0]; d.Status != ScheduleDeviceApplied || d.Hash != "hash-good" {
+		t.Errorf("mismatched device %+v", d)
+	}
+	if d := s.Devices[1]; d.Status != ScheduleDeviceFailed || d.Error == "" {
+		t.Errorf("mismatched device %+v", d)
+	}
+	if s.Failures() != 1 {
+		t.Errorf("%d failures, expected 1", s.Failures())
+	}
+	if s.Apply(later, apply) {
+		t.Errorf("applied a change twice")
+	}
+
+	// with a window, the change waits for it to open
+	s = NewScheduledChange("id", "", []string{"good"})
+	s.Window = &MaintenanceWindow{Start: later.UTC().Format("15:04"), Duration: 60}
+	if s.Due(now) {
+		t.Errorf("change due before its window opened")
+	}
+	if !s.Due(later) {
+		t.Errorf("change not due in its window")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SerialWildcard the serial of an onboarding certificate that allows any serial
+	SerialWildcard = "*"
+	// serialRegexpPrefix prefix of the serials of an onboarding certificate that are regular expressions, matched
+	// against the whole serial, e.g. re:^SN-2024-[0-9]{4}$
+	serialRegexpPrefix = "re:"
+	// serialRangeSep separator of the first and last serials of a range, e.g. SN-0001..SN-0500
+	serialRangeSep = ".."
+)
+
+// ValidateSerialPattern check that a serial of an onboarding certificate is valid: an exact serial, the wildcard, a
+// glob pattern as for path.Match, a regular expression prefixed with re:, or a range of serials
+func ValidateSerialPattern(pattern string) error {
+	switch {
+	case strings.HasPrefix(pattern, serialRegexpPrefix):
+		if _, err := regexp.Compile(strings.TrimPrefix(pattern, serialRegexpPrefix)); err != nil {
+			return fmt.Errorf("bad serial regular expression %s: %v", pattern, err)
+		}
+	case strings.Contains(pattern, serialRangeSep):
+		if _, _, _, err := parseSerialRange(pattern); err != nil {
+			return err
+		}
+	default:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad serial pattern %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// MatchSerial whether a serial of an onboarding certificate allows a serial. Patterns that are not valid match
+// nothing but themselves
+func MatchSerial(pattern, serial string) bool {
+	switch {
+	case pattern == serial || pattern == SerialWildcard:
+		return true
+	case strings.HasPrefix(pattern, serialRegexpPrefix):
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, serialRegexpPrefix))
+		return err == nil && re.MatchString(serial)
+	case strings.Contains(pattern, serialRangeSep):
+		prefix, first, last, err := parseSerialRange(pattern)
+		if err != nil || !strings.HasPrefix(serial, prefix) {
+			return false
+		}
+		digits := strings.TrimPrefix(serial, prefix)
+		// zero-padded ranges only allow serials of the same width
+		if len(first) == len(last) && len(digits) != len(first) {
+			return false
+		}
+		n, err := strconv.ParseUint(digits, 10, 64)
+		if err != nil {
+			return false
+		}
+		lo, _ := strconv.ParseUint(first, 10, 64)
+		hi, _ := strconv.ParseUint(last, 10, 64)
+		return n >= lo && n <= hi
+	default:
+		ok, _ := path.Match(pattern, serial)
+		return ok
+	}
+}
+
+// MatchSerials whether any of the serials of an onboarding certificate allows a serial, the exact serial first
+func MatchSerials(patterns map[string]bool, serial string) bool {
+	if patterns[serial] {
+		return true
+	}
+	for p := range patterns {
+		if MatchSerial(p, serial) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSerialRange the prefix the first and last serials of a range share, and the numbers they end with, e.g. SN-
+// and 0001 and 0500 for SN-0001..SN-0500
+func parseSerialRange(pattern string) (string, string, string, error) {
+	parts := strings.Split(pattern, serialRangeSep)
+	if len(parts) != 2 {
+		return "", "", "", fmt.Errorf("bad serial range %s: must be <first>..<last>", pattern)
+	}
+	prefix, first := splitSerialNumber(parts[0])
+	lastPrefix, last := splitSerialNumber(parts[1])
+	if first == "" || last == "" || prefix != lastPrefix {
+		return "", "", "", fmt.Errorf("bad serial range %s: the first and last serials must end with a number after the same prefix", pattern)
+	}
+	lo, err := strconv.ParseUint(first, 10, 64)
+	if err != nil {
+		return "", "", "", fmt.Errorf("bad serial range %s: %v", pattern, err)
+	}
+	hi, err := strconv.ParseUint(last, 10, 64)
+	if err != nil {
+		return "", "", "", fmt.Errorf("bad serial range %s: %v", pattern, err)
+	}
+	if lo > hi {
+		return "", "", "", fmt.Errorf("bad serial range %s: the first serial is after the last", pattern)
+	}
+	return prefix, first, last, nil
+}
+
+// splitSerialNumber split a serial into what comes before the digits it ends with, and those digits
+func splitSerialNumber(serial string) (string, string) {
+	i := len(serial)
+	for i > 0 && serial[i-1] >= '0' && serial[i-1] <= '9' {
+		i--
+	}
+	return serial[:i], serial[i:]
+}
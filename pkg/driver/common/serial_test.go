@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+)
+
+func TestMatchSerial(t *testing.T) {
+	tests := []struct {
+		pattern string
+		serial  string
+		match   bool
+	}{
+		{"SN-1", "SN-1", true},
+		{"SN-1", "SN-12", false},
+		{"*", "anything", true},
+		{"SN-2024-*", "SN-2024-0042", true},
+		{"SN-2024-*", "SN-2023-0042", false},
+		{"SN-202?-0042", "SN-2025-0042", true},
+		{"SN-[ab]1", "SN-b1", true},
+		{"re:^SN-2024-[0-9]{4}$", "SN-2024-0042", true},
+		{"re:^SN-2024-[0-9]{4}$", "SN-2024-042", false},
+		{"re:SN-", "X-SN-1", true},
+		{"re:(", "re:(", true},
+		{"re:(", "(", false},
+		{"SN-0001..SN-0500", "SN-0001", true},
+		{"SN-0001..SN-0500", "SN-0500", true},
+		{"SN-0001..SN-0500", "SN-0250", true},
+		{"SN-0001..SN-0500", "SN-0501", false},
+		{"SN-0001..SN-0500", "SN-250", false},
+		{"SN-0001..SN-0500", "XN-0250", false},
+		{"SN-1..SN-500", "SN-250", true},
+		{"SN-1..SN-500", "SN-0250", true},
+		{"SN-1..SN-500", "SN-501", false},
+		{"SN-500..SN-1", "SN-250", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.serial, func(t *testing.T) {
+			if match := MatchSerial(tt.pattern, tt.serial); match != tt.match {
+				t.Errorf("mismatched match, actual %v expected %v", match, tt.match)
+			}
+		})
+	}
+}
+
+func TestMatchSerials(t *testing.T) {
+	patterns := map[string]bool{"lab-1": true, "SN-2024-*": true, "B-100..B-199": true}
+	for serial, match := range map[string]bool{"lab-1": true, "lab-2": false, "SN-2024-7": true, "B-150": true, "B-200": false} {
+		if m := MatchSerials(patterns, serial); m != match {
+			t.Errorf("%s: mismatched match, actual %v expected %v", serial, m, match)
+		}
+	}
+}
+
+func TestValidateSerialPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"SN-1", true},
+		{"*", true},
+		{"SN-2024-*", true},
+		{"SN-[", false},
+		{"re:^SN-[0-9]+$", true},
+		{"re:(", false},
+		{"SN-0001..SN-0500", true},
+		{"SN-0500..SN-0001", false},
+		{"SN-0001..XN-0500", false},
+		{"SN-A..SN-B", false},
+		{"SN-1..SN-2..SN-3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			err := ValidateSerialPattern(tt.pattern)
+			switch {
+			case tt.valid && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case !tt.valid && err == nil:
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
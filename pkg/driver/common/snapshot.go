@@ -0,0 +1,81 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/config"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// ConfigSnapshot config of a device captured under a name, without its identity, to apply to other devices
+type ConfigSnapshot struct {
+	Name string `json:"name"`
+	// Source UUID of the device the config was captured from
+	Source string `json:"source,omitempty"`
+	// Config the config, in JSON, without the UUID and version of the device nor its one-off commands
+	Config json.RawMessage `json:"config"`
+	// Default whether newly onboarded devices start with this config instead of an empty one
+	Default bool      `json:"default,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// NewConfigSnapshot capture the config of a device as a named snapshot. What only makes sense to that device is
+// dropped: its UUID and version, and the reboot and backup commands, whose counters it alone tracks
+func NewConfigSnapshot(name, source string, conf []byte) (*ConfigSnapshot, error) {
+	switch {
+	case name == "":
+		return nil, fmt.Errorf("empty snapshot name")
+	case strings.ContainsAny(name, "/\\"):
+		return nil, fmt.Errorf("invalid snapshot name %q, it cannot have slashes", name)
+	}
+	var msg config.EdgeDevConfig
+	if err := protojson.Unmarshal(conf, &msg); err != nil {
+		return nil, fmt.Errorf("unable to read config: %v", err)
+	}
+	msg.Id = nil
+	msg.Reboot = nil
+	msg.Backup = nil
+	b, err := protojson.Marshal(&msg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode config: %v", err)
+	}
+	return &ConfigSnapshot{Name: name, Source: source, Config: b, Created: time.Now()}, nil
+}
+
+// SnapshotAdd add a config snapshot, or replace the one with the same name
+func SnapshotAdd(s RecordStore, sn *ConfigSnapshot) error {
+	return putJSON(s, RecordSnapshots, sn.Name, sn)
+}
+
+// SnapshotGet get a config snapshot by name. Return a *NotFoundError if there is none
+func SnapshotGet(s RecordStore, name string) (*ConfigSnapshot, error) {
+	var sn ConfigSnapshot
+	if err := getJSON(s, RecordSnapshots, name, &sn); err != nil {
+		return nil, err
+	}
+	return &sn, nil
+}
+
+// SnapshotList list the config snapshots
+func SnapshotList(s RecordStore) ([]*ConfigSnapshot, error) {
+	snapshots := []*ConfigSnapshot{}
+	err := listJSON(s, RecordSnapshots, func() interface{} {
+		snapshots = append(snapshots, &ConfigSnapshot{})
+		return snapshots[len(snapshots)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// SnapshotRemove remove a config snapshot
+func SnapshotRemove(s RecordStore, name string) error {
+	return s.RemoveRecord(RecordSnapshots, name)
+}
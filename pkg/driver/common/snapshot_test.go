@@ -0,0 +1,43 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"testing"
+
+	"github.com/lf-edge/eve/api/go/config"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestNewConfigSnapshot(t *testing.T) {
+	conf := []byte(`{"id":{"uuid":"c79b795c-f073-4750-974e-c632f9026f9d","version":"7"},"reboot":{"counter":3},` +
+		`"configItems":[{"key":"timer.config.interval","value":"10"}],"maintenanceMode":true}`)
+	s, err := NewConfigSnapshot("golden", "c79b795c-f073-4750-974e-c632f9026f9d", conf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Name != "golden" || s.Source != "c79b795c-f073-4750-974e-c632f9026f9d" || s.Created.IsZero() {
+		t.Errorf("mismatched snapshot %+v", s)
+	}
+	var msg config.EdgeDevConfig
+	if err := protojson.Unmarshal(s.Config, &msg); err != nil {
+		t.Fatalf("unexpected error reading snapshot config: %v", err)
+	}
+	if msg.Id != nil || msg.Reboot != nil {
+		t.Errorf("expected identity and commands dropped, got %s", s.Config)
+	}
+	if len(msg.ConfigItems) != 1 || !msg.MaintenanceMode {
+		t.Errorf("expected the rest of the config kept, got %s", s.Config)
+	}
+
+	if _, err := NewConfigSnapshot("", "", conf); err == nil {
+		t.Errorf("expected an error without a name")
+	}
+	if _, err := NewConfigSnapshot("../golden", "", conf); err == nil {
+		t.Errorf("expected an error with a slash in the name")
+	}
+	if _, err := NewConfigSnapshot("golden", "", []byte("{")); err == nil {
+		t.Errorf("expected an error with a bad config")
+	}
+}
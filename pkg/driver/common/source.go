@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"sort"
+	"time"
+)
+
+// MaxDeviceSources how many of the sources of the requests of a device are kept, the least recently seen being
+// dropped first
+const MaxDeviceSources = 8
+
+// DeviceSource where the requests of a device came from, and with what: a device seen from another address is
+// behind a NAT whose address changed, or moved, or its certificate is used by another
+type DeviceSource struct {
+	IP string `json:"ip"`
+	// Forwarded the X-Forwarded-For header of the requests, as set by the proxies in front of Adam; empty for the
+	// requests of other clients, which could make it up
+	Forwarded string `json:"forwarded,omitempty"`
+	// TLSVersion the version of TLS the requests came with, as the TLS connection to Adam; empty without TLS
+	TLSVersion string    `json:"tls-version,omitempty"`
+	UserAgent  string    `json:"user-agent,omitempty"`
+	FirstSeen  time.Time `json:"first-seen"`
+	LastSeen   time.Time `json:"last-seen"`
+	Requests   uint64    `json:"requests"`
+}
+
+// SameAddress whether two sources are the same address, forwarded for the same addresses if any
+func (s DeviceSource) SameAddress(o DeviceSource) bool {
+	return s.IP == o.IP && s.Forwarded == o.Forwarded
+}
+
+// AddDeviceSource count requests of a device from a source, last seen at a time, in the history of its sources:
+// added to the source with the same address, TLS version and user agent, or as a new one, first seen at that time,
+// dropping the least recently seen source past MaxDeviceSources. The history is returned the most recently seen
+// first, with the source the device was last seen from before if the address of the source is not in the history
+func AddDeviceSource(sources []DeviceSource, source DeviceSource, requests uint64, seen time.Time) ([]DeviceSource, *DeviceSource) {
+	sources = append([]DeviceSource(nil), sources...)
+	sort.SliceStable(sources, func(i, j int) bool { return sources[i].LastSeen.After(sources[j].LastSeen) })
+	var last *DeviceSource
+	if len(sources) > 0 {
+		s := sources[0]
+		last = &s
+	}
+	found := false
+	for i := range sources {
+		s := &sources[i]
+		if !s.SameAddress(source) {
+			continue
+		}
+		last = nil
+		if s.TLSVersion == source.TLSVersion && s.UserAgent == source.UserAgent {
+			if seen.After(s.LastSeen) {
+				s.LastSeen = seen
+			}
+			s.Requests += requests
+			found = true
+			break
+		}
+	}
+	if !found {
+		source.FirstSeen, source.LastSeen, source.Requests = seen, seen, requests
+		sources = append(sources, source)
+	}
+	sort.SliceStable(sources, func(i, j int) bool { return sources[i].LastSeen.After(sources[j].LastSeen) })
+	if len(sources) > MaxDeviceSources {
+		sources = sources[:MaxDeviceSources]
+	}
+	return sources, last
+}
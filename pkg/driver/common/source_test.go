@@ -0,0 +1,53 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAddDeviceSource(t *testing.T) {
+	at := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	nat := DeviceSource{IP: "203.0.113.7", TLSVersion: "TLS 1.3", UserAgent: "Go-http-client/1.1"}
+
+	sources, last := AddDeviceSource(nil, nat, 3, at)
+	if len(sources) != 1 || sources[0].Requests != 3 || !sources[0].FirstSeen.Equal(at) || last != nil {
+		t.Fatalf("expected the first source with 3 requests and none before, actual %v, %v", sources, last)
+	}
+
+	sources, last = AddDeviceSource(sources, nat, 2, at.Add(time.Minute))
+	if len(sources) != 1 || sources[0].Requests != 5 || !sources[0].FirstSeen.Equal(at) || !sources[0].LastSeen.Equal(at.Add(time.Minute)) || last != nil {
+		t.Fatalf("expected the requests added to the same source, actual %v, %v", sources, last)
+	}
+
+	upgraded := nat
+	upgraded.UserAgent = "Go-http-client/2.0"
+	sources, last = AddDeviceSource(sources, upgraded, 1, at.Add(2*time.Minute))
+	if len(sources) != 2 || sources[0].UserAgent != upgraded.UserAgent || last != nil {
+		t.Fatalf("expected another source from the same address, not a new address, actual %v, %v", sources, last)
+	}
+
+	moved := DeviceSource{IP: "198.51.100.20", TLSVersion: "TLS 1.3", UserAgent: upgraded.UserAgent}
+	sources, last = AddDeviceSource(sources, moved, 1, at.Add(3*time.Minute))
+	if len(sources) != 3 || sources[0].IP != moved.IP {
+		t.Fatalf("expected the new address first, actual %v", sources)
+	}
+	if last == nil || last.IP != nat.IP || last.UserAgent != upgraded.UserAgent {
+		t.Errorf("expected the address last seen before, actual %v", last)
+	}
+
+	for i := 0; i < MaxDeviceSources; i++ {
+		sources, _ = AddDeviceSource(sources, DeviceSource{IP: fmt.Sprintf("192.0.2.%d", i)}, 1, at.Add(time.Hour+time.Duration(i)*time.Minute))
+	}
+	if len(sources) != MaxDeviceSources {
+		t.Fatalf("expected %d sources, actual %d", MaxDeviceSources, len(sources))
+	}
+	for i, s := range sources {
+		if s.IP != fmt.Sprintf("192.0.2.%d", MaxDeviceSources-1-i) {
+			t.Errorf("expected the most recently seen first and the oldest dropped, actual %s at %d", s.IP, i)
+		}
+	}
+}
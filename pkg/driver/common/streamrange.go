@@ -0,0 +1,181 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamRange the part of a stream of a device to read, instead of all of it oldest first. After and Before are IDs
+// of entries, as a driver that can seek gives them; Since and Until are the times the entries were written
+type StreamRange struct {
+	// After read the entries after the one with this ID, empty for from the oldest
+	After string
+	// Before read the entries before the one with this ID, empty for up to the newest
+	Before string
+	// Since read the entries written at or after this time, zero for from the oldest
+	Since time.Time
+	// Until read the entries written at or before this time, zero for up to the newest
+	Until time.Time
+	// First read at most this many entries, the first in the order read; 0 for all of them
+	First int
+	// Last read at most this many entries, the last in the order read; 0 for all of them
+	Last int
+	// Reverse read the entries newest first
+	Reverse bool
+}
+
+// Seeks whether the range starts or ends at an entry or time, which only a driver that can seek reads
+func (r StreamRange) Seeks() bool {
+	return r.After != "" || r.Before != "" || !r.Since.IsZero() || !r.Until.IsZero()
+}
+
+// Validate check the range can be read
+func (r StreamRange) Validate() error {
+	switch {
+	case r.First < 0 || r.Last < 0:
+		return errors.New("the number of entries to read cannot be negative")
+	case r.First > 0 && r.Last > 0:
+		return errors.New("only one of the first or last entries can be read")
+	case !r.Since.IsZero() && !r.Until.IsZero() && r.Until.Before(r.Since):
+		return errors.New("the end of the range is before its start")
+	}
+	return nil
+}
+
+// ParseStreamID the milliseconds and sequence number of the ID of an entry, as <ms>-<seq>, when it was written and
+// how many were written before it in the same millisecond, or as <ms>, the first entry of the millisecond
+func ParseStreamID(id string) (uint64, uint64, error) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid stream ID %q", id)
+	}
+	if len(parts) == 1 {
+		return ms, 0, nil
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid stream ID %q", id)
+	}
+	return ms, seq, nil
+}
+
+// RangeReader reads the newline-delimited entries of a range of a stream
+type RangeReader interface {
+	io.Reader
+	// LastID the ID of the last entry read, to read the next page after, or before when reversed; empty if none
+	// was read or the entries have no IDs
+	LastID() string
+}
+
+// lineRange reads a range of the newline-delimited entries of a reader that cannot seek, keeping only those it
+// returns in memory
+type lineRange struct {
+	r   *bufio.Reader
+	rng StreamRange
+	// lines the entries kept, in the order returned, once all are read; nil to stream them
+	lines [][]byte
+	read  int
+	buf   bytes.Buffer
+	err   error
+}
+
+// NewLineRange a reader of the first or last entries of newline-delimited entries, or all of them, in the order of
+// the range. Entries are read oldest first, so that only the first ones are read without reading them all
+func NewLineRange(r io.Reader, rng StreamRange) (RangeReader, error) {
+	if err := rng.Validate(); err != nil {
+		return nil, err
+	}
+	if rng.Seeks() {
+		return nil, errors.New("entries without IDs cannot be read from an entry or time")
+	}
+	return &lineRange{r: bufio.NewReader(r), rng: rng}, nil
+}
+
+// LastID entries read line by line have no IDs
+func (l *lineRange) LastID() string {
+	return ""
+}
+
+func (l *lineRange) Read(p []byte) (int, error) {
+	// the first entries oldest first are streamed, the others need all entries read first
+	if !l.rng.Reverse && l.rng.Last == 0 {
+		for l.buf.Len() == 0 && l.err == nil {
+			if l.rng.First > 0 && l.read >= l.rng.First {
+				l.err = io.EOF
+				break
+			}
+			line, err := l.next()
+			l.err = err
+			if len(line) > 0 {
+				l.buf.Write(line)
+				l.buf.WriteByte('\n')
+				l.read++
+			}
+		}
+	} else if l.lines == nil {
+		if err := l.collect(); err != nil {
+			return 0, err
+		}
+	}
+	for l.buf.Len() == 0 && len(l.lines) > 0 {
+		l.buf.Write(l.lines[0])
+		l.buf.WriteByte('\n')
+		l.lines = l.lines[1:]
+	}
+	if l.buf.Len() > 0 {
+		return l.buf.Read(p)
+	}
+	if l.err == nil {
+		l.err = io.EOF
+	}
+	return 0, l.err
+}
+
+// next the next entry, without its newline
+func (l *lineRange) next() ([]byte, error) {
+	line, err := l.r.ReadBytes('\n')
+	return bytes.TrimRight(line, "\n"), err
+}
+
+// collect read the entries, keeping those of the range in the order returned
+func (l *lineRange) collect() error {
+	// in the order read, the oldest n entries are the last of a reversed range, the newest n the first of it
+	oldest, newest := l.rng.First, l.rng.Last
+	if l.rng.Reverse {
+		oldest, newest = l.rng.Last, l.rng.First
+	}
+	lines := [][]byte{}
+	for {
+		line, err := l.next()
+		if len(line) > 0 && (oldest == 0 || len(lines) < oldest) {
+			lines = append(lines, line)
+			if newest > 0 && len(lines) > newest {
+				lines = lines[1:]
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if l.rng.Reverse {
+		for i, k := 0, len(lines)-1; i < k; i, k = i+1, k-1 {
+			lines[i], lines[k] = lines[k], lines[i]
+		}
+	}
+	l.lines = lines
+	l.err = io.EOF
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineRange(t *testing.T) {
+	entries := "a\nb\n\nc\nd\n"
+	tests := []struct {
+		name     string
+		rng      StreamRange
+		expected string
+	}{
+		{"all", StreamRange{}, "a\nb\nc\nd\n"},
+		{"first", StreamRange{First: 2}, "a\nb\n"},
+		{"last", StreamRange{Last: 3}, "b\nc\nd\n"},
+		{"more than all", StreamRange{Last: 10}, "a\nb\nc\nd\n"},
+		{"reverse", StreamRange{Reverse: true}, "d\nc\nb\na\n"},
+		{"reverse first", StreamRange{First: 2, Reverse: true}, "d\nc\n"},
+		{"reverse last", StreamRange{Last: 1, Reverse: true}, "a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewLineRange(strings.NewReader(entries), tt.rng)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(b) != tt.expected {
+				t.Errorf("mismatched entries, actual %q expected %q", b, tt.expected)
+			}
+			if id := r.LastID(); id != "" {
+				t.Errorf("unexpected ID %q", id)
+			}
+		})
+	}
+}
+
+func TestLineRangeInvalid(t *testing.T) {
+	now := time.Now()
+	for _, rng := range []StreamRange{
+		{First: 1, Last: 1},
+		{First: -1},
+		{Since: now, Until: now.Add(-time.Hour)},
+		// entries read line by line have no IDs or times to start from
+		{After: "1-0"},
+		{Since: now},
+	} {
+		if _, err := NewLineRange(strings.NewReader(""), rng); err == nil {
+			t.Errorf("range %+v: expected an error", rng)
+		}
+	}
+}
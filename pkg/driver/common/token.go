@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// tokenPrefix start of every API token, so that they are easy to tell apart, e.g. by secret scanners
+	tokenPrefix = "adam"
+	tokenIDSize = 8
+	// tokenSecretSize bytes of randomness in the secret part of a token
+	tokenSecretSize = 32
+)
+
+// APIToken a token for the admin API, optionally limited to some devices or to reading. Only the hash of its secret
+// is stored, the token itself is given out once, when created
+type APIToken struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Hash the hex encoded SHA256 of the secret part of the token
+	Hash string `json:"hash,omitempty"`
+	// Devices UUIDs of the devices the token is limited to, empty for all of them
+	Devices []string `json:"devices,omitempty"`
+	// ReadOnly whether the token is limited to GET requests
+	ReadOnly bool      `json:"read-only,omitempty"`
+	Created  time.Time `json:"created"`
+	// Expires when the token stops being accepted, nil for never
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// NewAPIToken create a token with a random ID and secret, returning it with the token to give out, as
+// adam_<id>_<secret>
+func NewAPIToken(name string, devices []string, readOnly bool, expires *time.Time) (*APIToken, string, error) {
+	id := make([]byte, tokenIDSize)
+	secret := make([]byte, tokenSecretSize)
+	for _, b := range [][]byte{id, secret} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", fmt.Errorf("unable to generate token: %v", err)
+		}
+	}
+	t := &APIToken{
+		ID:       hex.EncodeToString(id),
+		Name:     name,
+		Hash:     hashSecret(hex.EncodeToString(secret)),
+		Devices:  devices,
+		ReadOnly: readOnly,
+		Created:  time.Now(),
+		Expires:  expires,
+	}
+	return t, strings.Join([]string{tokenPrefix, t.ID, hex.EncodeToString(secret)}, "_"), nil
+}
+
+// ParseAPIToken split a token given out by NewAPIToken into its ID and secret
+func ParseAPIToken(token string) (string, string, error) {
+	parts := strings.Split(token, "_")
+	if len(parts) != 3 || parts[0] != tokenPrefix || !ValidTokenID(parts[1]) || parts[2] == "" {
+		return "", "", fmt.Errorf("malformed API token")
+	}
+	return parts[1], parts[2], nil
+}
+
+// ValidTokenID whether an ID could be that of a token created by NewAPIToken
+func ValidTokenID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == tokenIDSize
+}
+
+// Verify check the secret of a token, in constant time, and that it has not expired
+func (t *APIToken) Verify(secret string, now time.Time) error {
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(t.Hash)) != 1 {
+		return fmt.Errorf("invalid secret for API token %s", t.ID)
+	}
+	if t.Expires != nil && now.After(*t.Expires) {
+		return fmt.Errorf("API token %s expired at %s", t.ID, t.Expires.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// AllowsDevice whether the token gives access to a device
+func (t *APIToken) AllowsDevice(u string) bool {
+	if len(t.Devices) == 0 {
+		return true
+	}
+	for _, d := range t.Devices {
+		if strings.EqualFold(d, u) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// TokenAdd add an admin API token
+func TokenAdd(s RecordStore, t *APIToken) error {
+	return putJSON(s, RecordTokens, t.ID, t)
+}
+
+// TokenGet get an admin API token by ID. Return a *NotFoundError if there is none
+func TokenGet(s RecordStore, id string) (*APIToken, error) {
+	var t APIToken
+	if err := getJSON(s, RecordTokens, id, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// TokenList list the admin API tokens
+func TokenList(s RecordStore) ([]*APIToken, error) {
+	tokens := []*APIToken{}
+	err := listJSON(s, RecordTokens, func() interface{} {
+		tokens = append(tokens, &APIToken{})
+		return tokens[len(tokens)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// TokenRemove remove an admin API token, so that it is no longer accepted
+func TokenRemove(s RecordStore, id string) error {
+	return s.RemoveRecord(RecordTokens, id)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIToken(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	token, s, err := NewAPIToken("ci", []string{"A8E0F3E4-5E0F-4B4A-8C61-3F2E3F0D7D1A"}, true, &expires)
+	if err != nil {
+		t.Fatalf("unexpected error creating token: %v", err)
+	}
+	if strings.Contains(token.Hash, strings.Split(s, "_")[2]) {
+		t.Errorf("token hash contains its secret")
+	}
+	id, secret, err := ParseAPIToken(s)
+	if err != nil {
+		t.Fatalf("unexpected error parsing token %s: %v", s, err)
+	}
+	if id != token.ID {
+		t.Errorf("mismatched ID, actual %s expected %s", id, token.ID)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		now    time.Time
+		valid  bool
+	}{
+		{"valid", secret, time.Now(), true},
+		{"wrong secret", secret + "0", time.Now(), false},
+		{"empty secret", "", time.Now(), false},
+		{"expired", secret, expires.Add(time.Second), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := token.Verify(tt.secret, tt.now)
+			switch {
+			case tt.valid && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case !tt.valid && err == nil:
+				t.Errorf("expected an error")
+			}
+		})
+	}
+
+	if !token.AllowsDevice("a8e0f3e4-5e0f-4b4a-8c61-3f2e3f0d7d1a") {
+		t.Errorf("token does not allow its device")
+	}
+	if token.AllowsDevice("b8e0f3e4-5e0f-4b4a-8c61-3f2e3f0d7d1a") {
+		t.Errorf("token allows another device")
+	}
+	if !(&APIToken{}).AllowsDevice("b8e0f3e4-5e0f-4b4a-8c61-3f2e3f0d7d1a") {
+		t.Errorf("token without devices does not allow all of them")
+	}
+}
+
+func TestParseAPIToken(t *testing.T) {
+	tests := []struct {
+		token string
+		valid bool
+	}{
+		{"adam_0123456789abcdef_abcd", true},
+		{"", false},
+		{"adam_0123456789abcdef", false},
+		{"other_0123456789abcdef_abcd", false},
+		{"adam__abcd", false},
+		{"adam_0123_abcd", false},
+		{"adam_0123456789abcdeg_abcd", false},
+		{"adam_0123456789abcdef_", false},
+		{"adam_0123456789abcdef_ab_cd", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			_, _, err := ParseAPIToken(tt.token)
+			switch {
+			case tt.valid && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case !tt.valid && err == nil:
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import "time"
+
+// Tombstone mark of a device deleted softly. The device is refused while its certificates, config and data are kept
+// until Expires, when it is removed for good, unless restored before
+type Tombstone struct {
+	UUID    string    `json:"uuid"`
+	Deleted time.Time `json:"deleted"`
+	Expires time.Time `json:"expires"`
+	// Actor who deleted the device, as in the audit log
+	Actor string `json:"actor,omitempty"`
+}
+
+// Expired whether the retention of the device is over at a time
+func (t *Tombstone) Expired(now time.Time) bool {
+	return !now.Before(t.Expires)
+}
+
+// TombstoneAdd add the tombstone of a device deleted softly, replacing any it has
+func TombstoneAdd(s RecordStore, t *Tombstone) error {
+	return putJSON(s, RecordTombstones, t.UUID, t)
+}
+
+// TombstoneGet get the tombstone of a device by its UUID. Return a *NotFoundError if it is not deleted
+func TombstoneGet(s RecordStore, u string) (*Tombstone, error) {
+	var t Tombstone
+	if err := getJSON(s, RecordTombstones, u, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// TombstoneList list the tombstones of the devices deleted softly
+func TombstoneList(s RecordStore) ([]*Tombstone, error) {
+	tombstones := []*Tombstone{}
+	err := listJSON(s, RecordTombstones, func() interface{} {
+		tombstones = append(tombstones, &Tombstone{})
+		return tombstones[len(tombstones)-1]
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tombstones, nil
+}
+
+// TombstoneRemove remove the tombstone of a device, once restored or removed for good
+func TombstoneRemove(s RecordStore, u string) error {
+	return s.RemoveRecord(RecordTombstones, u)
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/config"
+)
+
+// TwinInSync the status of a section of a twin whose reported state is that of the desired config; the others are
+// DeviceOpPending, DeviceOpInProgress and DeviceOpFailed
+const TwinInSync = "in-sync"
+
+// app instance states the device reports once it acted on the activation in the config
+const (
+	appStateRunning = "RUNNING"
+	appStateHalted  = "HALTED"
+)
+
+// Twin a device as one document: the config it is desired to run, the state it last reported, and how far each
+// section of the config is from being in the state, as the twin of other IoT platforms has
+type Twin struct {
+	// Status the least synced status of the sections
+	Status string `json:"status"`
+	// Desired the config the device is served, as protobuf JSON
+	Desired json.RawMessage `json:"desired"`
+	// Reported the inventory of the device, empty if it sent no info yet
+	Reported *Inventory   `json:"reported"`
+	Sections TwinSections `json:"sections"`
+	// Updated when the device last reported its config or info, nil if it has not
+	Updated *time.Time `json:"updated,omitempty"`
+	// Quarantine the quarantine of the device, if it is quarantined, in which case Desired is the config of its
+	// quarantine
+	Quarantine *Quarantine `json:"quarantine,omitempty"`
+}
+
+// TwinSections the sections of a twin
+type TwinSections struct {
+	// Config the hash of the config, and the one the device last reported running
+	Config TwinSection `json:"config"`
+	// BaseOS the EVE version to activate, and the one the device is running
+	BaseOS TwinSection `json:"baseos"`
+	// Reboot the counter of the reboot command, and that of the last one the device acted on
+	Reboot TwinSection `json:"reboot"`
+	// Apps the number of app instances of the config, and of those the device reported, with the status of each
+	Apps TwinSection `json:"apps"`
+}
+
+// TwinSection a section of the desired config of a twin, and what the device reported of it
+type TwinSection struct {
+	// Status in-sync, pending, in-progress or failed
+	Status   string `json:"status"`
+	Desired  string `json:"desired,omitempty"`
+	Reported string `json:"reported,omitempty"`
+	// Apps the app instances, of the config or reported, sorted by UUID
+	Apps []TwinApp `json:"apps,omitempty"`
+}
+
+// TwinApp an app instance of the config of a twin, or reported by the device only, as it is yet to remove it
+type TwinApp struct {
+	UUID   string `json:"uuid"`
+	Name   string `json:"name,omitempty"`
+	Status string `json:"status"`
+	// Desired the state the config asks for, RUNNING or HALTED, empty if the app instance is not in it
+	Desired string `json:"desired,omitempty"`
+	// Reported the state the device reported, empty if it has not reported the app instance
+	Reported string   `json:"reported,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// twinRank how far a status is from being in sync, the higher the further
+var twinRank = map[string]int{TwinInSync: 0, DeviceOpInProgress: 1, DeviceOpPending: 2, DeviceOpFailed: 3}
+
+// leastSynced the status of those given furthest from being in sync
+func leastSynced(statuses ...string) string {
+	least := TwinInSync
+	for _, s := range statuses {
+		if twinRank[s] > twinRank[least] {
+			least = s
+		}
+	}
+	return least
+}
+
+// NewTwin the twin of a device from the config it is served, as protobuf JSON and parsed, with its hash, the config
+// it last reported running, nil if none, and its inventory, nil if it sent no info yet
+func NewTwin(b []byte, conf *config.EdgeDevConfig, hash string, ack *ConfigAck, inv *Inventory) *Twin {
+	if inv == nil {
+		inv = &Inventory{}
+	}
+	t := &Twin{Desired: b, Reported: inv, Updated: inv.Updated}
+
+	t.Sections.Config = TwinSection{Status: TwinInSync, Desired: hash}
+	if ack != nil {
+		t.Sections.Config.Reported = ack.Hash
+		if t.Updated == nil || ack.Time.After(*t.Updated) {
+			at := ack.Time
+			t.Updated = &at
+		}
+	}
+	if t.Sections.Config.Reported != hash {
+		t.Sections.Config.Status = DeviceOpPending
+	}
+
+	var version string
+	for _, b := range conf.GetBase() {
+		if b.GetActivate() {
+			version = b.GetBaseOSVersion()
+		}
+	}
+	state, _ := inv.BaseOSState(version)
+	t.Sections.BaseOS = TwinSection{Status: opStatus(state), Desired: version, Reported: inv.EVEVersion}
+
+	counter := conf.GetReboot().GetCounter()
+	t.Sections.Reboot = TwinSection{Status: opStatus(inv.RebootState(counter))}
+	if counter > 0 {
+		t.Sections.Reboot.Desired = strconv.FormatUint(uint64(counter), 10)
+	}
+	if inv.RebootCounter > 0 {
+		t.Sections.Reboot.Reported = strconv.FormatUint(uint64(inv.RebootCounter), 10)
+	}
+
+	t.Sections.Apps = twinApps(conf, inv)
+	t.Status = leastSynced(t.Sections.Config.Status, t.Sections.BaseOS.Status, t.Sections.Reboot.Status, t.Sections.Apps.Status)
+	return t
+}
+
+// opStatus the status of the state of a reboot or EVE update
+func opStatus(state string) string {
+	switch state {
+	case DeviceOpNone, DeviceOpDone:
+		return TwinInSync
+	}
+	return state
+}
+
+// twinApps the apps section of a twin, comparing each app instance of the config with what the device reported of it
+func twinApps(conf *config.EdgeDevConfig, inv *Inventory) TwinSection {
+	reported := map[string]InventoryApp{}
+	for _, a := range inv.Apps {
+		reported[a.UUID] = a
+	}
+	section := TwinSection{
+		Desired:  strconv.Itoa(len(conf.GetApps())),
+		Reported: strconv.Itoa(len(inv.Apps)),
+		Apps:     []TwinApp{},
+	}
+	desired := map[string]bool{}
+	for _, a := range conf.GetApps() {
+		u := a.GetUuidandversion().GetUuid()
+		desired[u] = true
+		app := TwinApp{UUID: u, Name: a.GetDisplayname(), Desired: appStateHalted}
+		if a.GetActivate() {
+			app.Desired = appStateRunning
+		}
+		r, ok := reported[u]
+		switch {
+		case !ok:
+			app.Status = DeviceOpPending
+		case len(r.Errors) > 0:
+			app.Status = DeviceOpFailed
+		case r.State == app.Desired, !a.GetActivate() && r.State != appStateRunning:
+			app.Status = TwinInSync
+		default:
+			app.Status = DeviceOpInProgress
+		}
+		if ok {
+			app.Reported, app.Errors = r.State, r.Errors
+		}
+		section.Apps = append(section.Apps, app)
+	}
+	for _, r := range inv.Apps {
+		if !desired[r.UUID] {
+			section.Apps = append(section.Apps, TwinApp{UUID: r.UUID, Name: r.Name, Status: DeviceOpPending, Reported: r.State, Errors: r.Errors})
+		}
+	}
+	sort.Slice(section.Apps, func(i, j int) bool { return section.Apps[i].UUID < section.Apps[j].UUID })
+	statuses := make([]string, 0, len(section.Apps))
+	for _, a := range section.Apps {
+		statuses = append(statuses, a.Status)
+	}
+	section.Status = leastSynced(statuses...)
+	return section
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/config"
+)
+
+func TestNewTwin(t *testing.T) {
+	acked := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	reported := acked.Add(time.Minute)
+	app := func(id, name string, activate bool) *config.AppInstanceConfig {
+		return &config.AppInstanceConfig{Uuidandversion: &config.UUIDandVersion{Uuid: id}, Displayname: name, Activate: activate}
+	}
+	conf := &config.EdgeDevConfig{
+		Base:   []*config.BaseOSConfig{{BaseOSVersion: "6.1.0", Activate: true}},
+		Reboot: &config.DeviceOpsCmd{Counter: 2},
+		Apps:   []*config.AppInstanceConfig{app("a", "web", true), app("b", "db", true), app("c", "batch", false)},
+	}
+
+	tests := []struct {
+		name     string
+		ack      *ConfigAck
+		inv      *Inventory
+		status   string
+		sections map[string]string
+		apps     []string
+		updated  *time.Time
+	}{
+		{"no state reported", nil, nil, DeviceOpPending,
+			map[string]string{"config": DeviceOpPending, "baseos": DeviceOpPending, "reboot": DeviceOpPending, "apps": DeviceOpPending},
+			[]string{"a pending", "b pending", "c pending"}, nil},
+		{"in sync", &ConfigAck{Hash: "h", Time: acked}, &Inventory{
+			EVEVersion:    "6.1.0",
+			RebootCounter: 2,
+			Apps:          []InventoryApp{{UUID: "a", State: "RUNNING"}, {UUID: "b", State: "RUNNING"}, {UUID: "c", State: "HALTED"}},
+			Updated:       &reported,
+		}, TwinInSync,
+			map[string]string{"config": TwinInSync, "baseos": TwinInSync, "reboot": TwinInSync, "apps": TwinInSync},
+			[]string{"a in-sync", "b in-sync", "c in-sync"}, &reported},
+		{"apps converging", &ConfigAck{Hash: "old", Time: acked}, &Inventory{
+			EVEVersion:    "6.1.0",
+			RebootCounter: 2,
+			Rebooting:     true,
+			Apps: []InventoryApp{
+				{UUID: "a", State: "BOOTING"},
+				{UUID: "b", State: "RUNNING", Errors: []string{"out of memory"}},
+				{UUID: "d", State: "RUNNING"},
+			},
+		}, DeviceOpFailed,
+			map[string]string{"config": DeviceOpPending, "baseos": TwinInSync, "reboot": TwinInSync, "apps": DeviceOpFailed},
+			[]string{"a in-progress", "b failed", "c pending", "d pending"}, &acked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			twin := NewTwin([]byte("{}"), conf, "h", tt.ack, tt.inv)
+			if twin.Status != tt.status {
+				t.Errorf("mismatched status, actual %s expected %s", twin.Status, tt.status)
+			}
+			sections := map[string]string{
+				"config": twin.Sections.Config.Status,
+				"baseos": twin.Sections.BaseOS.Status,
+				"reboot": twin.Sections.Reboot.Status,
+				"apps":   twin.Sections.Apps.Status,
+			}
+			if !reflect.DeepEqual(sections, tt.sections) {
+				t.Errorf("mismatched sections, actual %v expected %v", sections, tt.sections)
+			}
+			var apps []string
+			for _, a := range twin.Sections.Apps.Apps {
+				apps = append(apps, a.UUID+" "+a.Status)
+			}
+			if !reflect.DeepEqual(apps, tt.apps) {
+				t.Errorf("mismatched apps, actual %v expected %v", apps, tt.apps)
+			}
+			if !reflect.DeepEqual(twin.Updated, tt.updated) {
+				t.Errorf("mismatched updated, actual %v expected %v", twin.Updated, tt.updated)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"time"
+)
+
+// UsageKinds kinds of device messages whose storage is reported, in the order they are listed
+var UsageKinds = []string{KindLogs, KindInfo, KindMetrics, KindRequests, KindAppLogs}
+
+// StreamUsage storage used by the messages of one kind of a device
+type StreamUsage struct {
+	// Bytes stored, as the backing store holds them, so compressed messages count their compressed size
+	Bytes   int64 `json:"bytes"`
+	Entries int64 `json:"entries"`
+	// Oldest and Newest when the oldest and newest messages stored were received, nil if there are none
+	Oldest *time.Time `json:"oldest,omitempty"`
+	Newest *time.Time `json:"newest,omitempty"`
+}
+
+// Add count the messages of s as well, e.g. those of another app instance
+func (s *StreamUsage) Add(o StreamUsage) {
+	s.Bytes += o.Bytes
+	s.Entries += o.Entries
+	if o.Oldest != nil && (s.Oldest == nil || o.Oldest.Before(*s.Oldest)) {
+		s.Oldest = o.Oldest
+	}
+	if o.Newest != nil && (s.Newest == nil || o.Newest.After(*s.Newest)) {
+		s.Newest = o.Newest
+	}
+}
+
+// DeviceUsage storage used by the messages of a device, per kind, and in total
+type DeviceUsage struct {
+	UUID    string                 `json:"uuid"`
+	Bytes   int64                  `json:"bytes"`
+	Entries int64                  `json:"entries"`
+	Kinds   map[string]StreamUsage `json:"kinds"`
+}
+
+// NewDeviceUsage the usage of a device with nothing stored yet, for each of UsageKinds
+func NewDeviceUsage(u string) *DeviceUsage {
+	d := &DeviceUsage{UUID: u, Kinds: map[string]StreamUsage{}}
+	for _, k := range UsageKinds {
+		d.Kinds[k] = StreamUsage{}
+	}
+	return d
+}
+
+// Add count the messages of a kind, adding to those already counted for it
+func (d *DeviceUsage) Add(kind string, s StreamUsage) {
+	k := d.Kinds[kind]
+	k.Add(s)
+	d.Kinds[kind] = k
+	d.Bytes += s.Bytes
+	d.Entries += s.Entries
+}
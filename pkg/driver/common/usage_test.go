@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeviceUsageAdd(t *testing.T) {
+	t1 := time.Unix(1000, 0)
+	t2 := time.Unix(2000, 0)
+	t3 := time.Unix(3000, 0)
+
+	tests := []struct {
+		name  string
+		kind  string
+		added []StreamUsage
+		usage StreamUsage
+		bytes int64
+	}{
+		{"nothing", KindLogs, nil, StreamUsage{}, 0},
+		{"one", KindInfo, []StreamUsage{{Bytes: 10, Entries: 2, Oldest: &t1, Newest: &t2}}, StreamUsage{Bytes: 10, Entries: 2, Oldest: &t1, Newest: &t2}, 10},
+		{"empty added", KindMetrics, []StreamUsage{{Bytes: 10, Entries: 2, Oldest: &t1, Newest: &t2}, {}}, StreamUsage{Bytes: 10, Entries: 2, Oldest: &t1, Newest: &t2}, 10},
+		{"app instances", KindAppLogs, []StreamUsage{{Bytes: 10, Entries: 2, Oldest: &t2, Newest: &t2}, {Bytes: 5, Entries: 1, Oldest: &t1, Newest: &t3}}, StreamUsage{Bytes: 15, Entries: 3, Oldest: &t1, Newest: &t3}, 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDeviceUsage("u")
+			for _, s := range tt.added {
+				d.Add(tt.kind, s)
+			}
+			if !reflect.DeepEqual(d.Kinds[tt.kind], tt.usage) {
+				t.Errorf("mismatched usage, actual %+v expected %+v", d.Kinds[tt.kind], tt.usage)
+			}
+			if d.Bytes != tt.bytes {
+				t.Errorf("mismatched total bytes, actual %d expected %d", d.Bytes, tt.bytes)
+			}
+			if len(d.Kinds) != len(UsageKinds) {
+				t.Errorf("mismatched kinds, actual %d expected %d", len(d.Kinds), len(UsageKinds))
+			}
+		})
+	}
+}
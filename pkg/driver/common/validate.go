@@ -0,0 +1,151 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lf-edge/eve/api/go/config"
+)
+
+// ConfigValidationError the problems found in a device config, each saying where in the config it is
+type ConfigValidationError struct {
+	Problems []string
+}
+
+func (e *ConfigValidationError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(e.Problems, "; "))
+}
+
+// configValidator collects the problems found in a config
+type configValidator struct {
+	problems []string
+}
+
+func (v *configValidator) addf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+// ids check the IDs of a list of objects are set and unique, and return them as a set
+func (v *configValidator) ids(kind string, ids []string) map[string]bool {
+	set := map[string]bool{}
+	for i, id := range ids {
+		switch {
+		case id == "":
+			v.addf("%s[%d]: missing ID", kind, i)
+		case set[id]:
+			v.addf("%s[%d]: duplicate ID %s", kind, i, id)
+		}
+		set[id] = true
+	}
+	return set
+}
+
+// ref check that a reference from one object to another, if set, is to a known ID
+func (v *configValidator) ref(where, field, id string, known map[string]bool, kind string) {
+	if id != "" && !known[id] {
+		v.addf("%s: %s %s not found in %s", where, field, id, kind)
+	}
+}
+
+// ValidateConfig check the referential integrity of a device config, as EVE rejects configs whose objects refer to
+// ones that do not exist, or that have duplicate IDs. Returns a *ConfigValidationError listing all the problems found
+func ValidateConfig(conf *config.EdgeDevConfig) error {
+	v := &configValidator{}
+
+	var ids []string
+	for _, d := range conf.Datastores {
+		ids = append(ids, d.GetId())
+	}
+	datastores := v.ids("datastores", ids)
+
+	ids = nil
+	for _, n := range conf.Networks {
+		ids = append(ids, n.GetId())
+	}
+	networks := v.ids("networks", ids)
+
+	ids = nil
+	for _, n := range conf.NetworkInstances {
+		ids = append(ids, n.GetUuidandversion().GetUuid())
+	}
+	networkInstances := v.ids("networkInstances", ids)
+
+	ids = nil
+	for _, c := range conf.CipherContexts {
+		ids = append(ids, c.GetContextId())
+	}
+	cipherContexts := v.ids("cipherContexts", ids)
+
+	ids = nil
+	for _, c := range conf.ContentInfo {
+		ids = append(ids, c.GetUuid())
+	}
+	contentTrees := v.ids("contentInfo", ids)
+
+	ids = nil
+	for _, vol := range conf.Volumes {
+		ids = append(ids, vol.GetUuid())
+	}
+	volumes := v.ids("volumes", ids)
+
+	ids = nil
+	for _, a := range conf.Apps {
+		ids = append(ids, a.GetUuidandversion().GetUuid())
+	}
+	v.ids("apps", ids)
+
+	ids = nil
+	for _, b := range conf.Base {
+		ids = append(ids, b.GetUuidandversion().GetUuid())
+	}
+	v.ids("base", ids)
+
+	for i, c := range conf.ContentInfo {
+		v.ref(fmt.Sprintf("contentInfo[%d]", i), "datastore", c.GetDsId(), datastores, "datastores")
+	}
+	for i, vol := range conf.Volumes {
+		where := fmt.Sprintf("volumes[%d]", i)
+		origin := vol.GetOrigin()
+		if origin.GetType() == config.VolumeContentOriginType_VCOT_DOWNLOAD && origin.GetDownloadContentTreeID() == "" {
+			v.addf("%s: download origin without a content tree", where)
+		}
+		v.ref(where, "content tree", origin.GetDownloadContentTreeID(), contentTrees, "contentInfo")
+	}
+	for i, s := range conf.SystemAdapterList {
+		v.ref(fmt.Sprintf("systemAdapterList[%d]", i), "network", s.GetNetworkUUID(), networks, "networks")
+	}
+	for i, a := range conf.Apps {
+		where := fmt.Sprintf("apps[%d]", i)
+		for _, ref := range a.GetVolumeRefList() {
+			v.ref(where, "volume", ref.GetUuid(), volumes, "volumes")
+		}
+		for _, n := range a.GetInterfaces() {
+			v.ref(where, "network instance", n.GetNetworkId(), networkInstances, "networkInstances")
+		}
+		for _, d := range a.GetDrives() {
+			v.ref(where, "datastore", d.GetImage().GetDsId(), datastores, "datastores")
+		}
+		v.ref(where, "cipher context", a.GetCipherData().GetCipherContextId(), cipherContexts, "cipherContexts")
+	}
+	for i, b := range conf.Base {
+		where := fmt.Sprintf("base[%d]", i)
+		for _, d := range b.GetDrives() {
+			v.ref(where, "datastore", d.GetImage().GetDsId(), datastores, "datastores")
+		}
+		// older EVE versions take a content tree rather than a volume
+		if id := b.GetVolumeID(); id != "" && !volumes[id] && !contentTrees[id] {
+			v.addf("%s: volume %s not found in volumes or contentInfo", where, id)
+		}
+	}
+	for i, d := range conf.Datastores {
+		v.ref(fmt.Sprintf("datastores[%d]", i), "cipher context", d.GetCipherData().GetCipherContextId(), cipherContexts, "cipherContexts")
+	}
+
+	if len(v.problems) > 0 {
+		return &ConfigValidationError{Problems: v.problems}
+	}
+	return nil
+}
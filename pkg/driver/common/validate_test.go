@@ -0,0 +1,90 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lf-edge/eve/api/go/config"
+)
+
+func TestValidateConfig(t *testing.T) {
+	// a valid config with one of everything, for the tests to break
+	valid := func() *config.EdgeDevConfig {
+		return &config.EdgeDevConfig{
+			Datastores:       []*config.DatastoreConfig{{Id: "ds"}},
+			Networks:         []*config.NetworkConfig{{Id: "net"}},
+			NetworkInstances: []*config.NetworkInstanceConfig{{Uuidandversion: &config.UUIDandVersion{Uuid: "ni"}}},
+			ContentInfo:      []*config.ContentTree{{Uuid: "ct", DsId: "ds"}},
+			Volumes: []*config.Volume{{
+				Uuid:   "vol",
+				Origin: &config.VolumeContentOrigin{Type: config.VolumeContentOriginType_VCOT_DOWNLOAD, DownloadContentTreeID: "ct"},
+			}},
+			SystemAdapterList: []*config.SystemAdapter{{Name: "eth0", NetworkUUID: "net"}},
+			Apps: []*config.AppInstanceConfig{{
+				Uuidandversion: &config.UUIDandVersion{Uuid: "app"},
+				VolumeRefList:  []*config.VolumeRef{{Uuid: "vol"}},
+				Interfaces:     []*config.NetworkAdapter{{Name: "eth0", NetworkId: "ni"}},
+			}},
+			Base: []*config.BaseOSConfig{{Uuidandversion: &config.UUIDandVersion{Uuid: "base"}, VolumeID: "ct"}},
+		}
+	}
+	tests := []struct {
+		name     string
+		change   func(*config.EdgeDevConfig)
+		problems []string
+	}{
+		{"empty", func(c *config.EdgeDevConfig) { *c = config.EdgeDevConfig{} }, nil},
+		{"valid", func(c *config.EdgeDevConfig) {}, nil},
+		{"duplicate app", func(c *config.EdgeDevConfig) {
+			c.Apps = append(c.Apps, &config.AppInstanceConfig{Uuidandversion: &config.UUIDandVersion{Uuid: "app"}})
+		}, []string{"apps[1]: duplicate ID app"}},
+		{"missing volume ID", func(c *config.EdgeDevConfig) {
+			c.Volumes = append(c.Volumes, &config.Volume{})
+		}, []string{"volumes[1]: missing ID"}},
+		{"missing volume", func(c *config.EdgeDevConfig) {
+			c.Apps[0].VolumeRefList[0].Uuid = "other"
+		}, []string{"apps[0]: volume other not found in volumes"}},
+		{"bad network instance", func(c *config.EdgeDevConfig) {
+			c.Apps[0].Interfaces[0].NetworkId = "net"
+		}, []string{"apps[0]: network instance net not found in networkInstances"}},
+		{"bad system adapter network", func(c *config.EdgeDevConfig) {
+			c.SystemAdapterList[0].NetworkUUID = "ni"
+		}, []string{"systemAdapterList[0]: network ni not found in networks"}},
+		{"missing content tree", func(c *config.EdgeDevConfig) {
+			c.ContentInfo = nil
+			c.Base = nil
+		}, []string{"volumes[0]: content tree ct not found in contentInfo"}},
+		{"download without content tree", func(c *config.EdgeDevConfig) {
+			c.Volumes[0].Origin.DownloadContentTreeID = ""
+		}, []string{"volumes[0]: download origin without a content tree"}},
+		{"missing datastore", func(c *config.EdgeDevConfig) {
+			c.ContentInfo[0].DsId = "other"
+			c.Apps[0].CipherData = &config.CipherBlock{CipherContextId: "cc"}
+		}, []string{"contentInfo[0]: datastore other not found in datastores", "apps[0]: cipher context cc not found in cipherContexts"}},
+		{"base volume", func(c *config.EdgeDevConfig) {
+			c.Base[0].VolumeID = "vol"
+			c.Base = append(c.Base, &config.BaseOSConfig{Uuidandversion: &config.UUIDandVersion{Uuid: "base2"}, VolumeID: "other"})
+		}, []string{"base[1]: volume other not found in volumes or contentInfo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.change(c)
+			err := ValidateConfig(c)
+			var problems []string
+			if err != nil {
+				verr, ok := err.(*ConfigValidationError)
+				if !ok {
+					t.Fatalf("mismatched error type %T: %v", err, err)
+				}
+				problems = verr.Problems
+			}
+			if !reflect.DeepEqual(problems, tt.problems) {
+				t.Errorf("mismatched problems, actual %q expected %q", problems, tt.problems)
+			}
+		})
+	}
+}
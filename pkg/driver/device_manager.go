@@ -6,6 +6,7 @@ package driver
 import (
 	"crypto/x509"
 	"io"
+	"time"
 
 	"github.com/lf-edge/adam/pkg/driver/common"
 	uuid "github.com/satori/go.uuid"
@@ -39,6 +40,9 @@ type DeviceManager interface {
 	// SetCacheTimeout set how long to keep onboard and device certificates in cache before rereading from a backing store. Value of 0 means
 	//   not to cache
 	SetCacheTimeout(int)
+	// SetEncryptor set the encryptor used to protect certificates, serials and configs at rest. A nil encryptor
+	//   means to store them in plaintext
+	SetEncryptor(*common.Encryptor)
 	// OnboardCheck check if a certificate+serial combination are valid to use for registration. Includes checking for duplicates in devices
 	OnboardCheck(*x509.Certificate, string) error
 	// OnboardRemove remove an onboarding cert
@@ -51,6 +55,10 @@ type DeviceManager interface {
 	OnboardList() ([]string, error)
 	// OnboardRegister apply an onboard cert and serials that apply to it. If the onboard cert already exists, will replace the serials and return without error. It is  idempotent.
 	OnboardRegister(*x509.Certificate, []string) error
+	// OnboardPolicyGet get the policy of an onboarding certificate by Common Name, nil if it has none
+	OnboardPolicyGet(string) (*common.OnboardPolicy, error)
+	// OnboardPolicySet set the policy of an onboarding certificate by Common Name, replacing any; nil removes it
+	OnboardPolicySet(string, *common.OnboardPolicy) error
 	// DeviceCheckCert check if a certificate is valid to use for a device
 	DeviceCheckCert(*x509.Certificate) (*uuid.UUID, error)
 	// DeviceRemove remove a device
@@ -63,6 +71,9 @@ type DeviceManager interface {
 	DeviceList() ([]*uuid.UUID, error)
 	// DeviceRegister register a new device certificate, including the onboarding certificate used to register it and its serial
 	DeviceRegister(uuid.UUID, *x509.Certificate, *x509.Certificate, string, []byte) error
+	// DeviceReplaceCert atomically replace the certificate of a registered device, keeping its UUID, config and history.
+	//   Return a *common.UsedCertError if the certificate is already used by another device
+	DeviceReplaceCert(uuid.UUID, *x509.Certificate) error
 	// WriteInfo write an information message
 	WriteInfo(uuid.UUID, []byte) error
 	// WriteLogs write log messages
@@ -77,10 +88,166 @@ type DeviceManager interface {
 	GetConfig(uuid.UUID) ([]byte, error)
 	// SetConfig set the config for a given uuid
 	SetConfig(uuid.UUID, []byte) error
+	// SwapConfig set the config for a given uuid only if the one stored is still old, checking and writing it as one
+	// step that other writers, including the adam replicas sharing the database, cannot come between
+	//   *common.ConfigConflictError with the config stored, if it is not old
+	SwapConfig(u uuid.UUID, old, b []byte) error
 	// GetLogsReader get the logs for a given uuid
 	GetLogsReader(u uuid.UUID) (io.Reader, error)
 	// GetInfoReader get the info for a given uuid
 	GetInfoReader(u uuid.UUID) (io.Reader, error)
+	// GetMetricsReader get the metrics for a given uuid
+	GetMetricsReader(u uuid.UUID) (io.Reader, error)
 	// GetRequestsReader get the request logs for a given uuid
 	GetRequestsReader(u uuid.UUID) (io.Reader, error)
+	// WriteAudit append a record of an admin action to the audit log. The audit log is append-only
+	WriteAudit([]byte) error
+	// GetAuditReader get the audit log
+	GetAuditReader() (io.Reader, error)
+	// SetQuotas set the quotas of devices without their own, and the period over which byte quotas are counted
+	SetQuotas(common.Quotas, time.Duration)
+	// GetDeviceQuotas get the quotas set for a device, nil if it uses the global ones
+	GetDeviceQuotas(uuid.UUID) (*common.Quotas, error)
+	// SetDeviceQuotas set the quotas of a device, overriding the global ones; nil removes them
+	SetDeviceQuotas(uuid.UUID, *common.Quotas) error
+	// GetConfigAck get the config a device last reported having, nil if it has not reported any
+	GetConfigAck(uuid.UUID) (*common.ConfigAck, error)
+	// SetConfigAck record the config a device reported having
+	SetConfigAck(uuid.UUID, *common.ConfigAck) error
+	// GetInventory get the current state of a device, from its info messages, nil if it has not sent any
+	GetInventory(uuid.UUID) (*common.Inventory, error)
+	// SetInventory record the current state of a device
+	SetInventory(uuid.UUID, *common.Inventory) error
+	// GetLogFilter get the filter of the logs of a device, nil if it uses the global one
+	GetLogFilter(uuid.UUID) (*common.LogFilter, error)
+	// SetLogFilter set the filter of the logs of a device, overriding the global one; nil removes it
+	SetLogFilter(uuid.UUID, *common.LogFilter) error
+	// GetLocalProfile get the local profile server state of a device, nil if it has none
+	GetLocalProfile(uuid.UUID) (*common.LocalProfile, error)
+	// SetLocalProfile set the local profile server state of a device; nil removes it
+	SetLocalProfile(uuid.UUID, *common.LocalProfile) error
+	// GetDeviceMetadata get the metadata of a device, nil if none is recorded
+	GetDeviceMetadata(uuid.UUID) (*common.DeviceMetadata, error)
+	// SetDeviceMetadata set the metadata of a device, replacing any recorded; nil removes it
+	SetDeviceMetadata(uuid.UUID, *common.DeviceMetadata) error
+	// GetDeviceModel get the name of the hardware model of a device, empty if it has none
+	GetDeviceModel(uuid.UUID) (string, error)
+	// SetDeviceModel set the name of the hardware model of a device; empty removes it
+	SetDeviceModel(uuid.UUID, string) error
+	// GetAppCommands get the commands to the app instances of a device, nil if it has none
+	GetAppCommands(uuid.UUID) ([]common.AppCommand, error)
+	// SetAppCommands set the commands to the app instances of a device; none removes them
+	SetAppCommands(uuid.UUID, []common.AppCommand) error
+	// GetDeviceFlags get the flags of a device, nil if it has none
+	GetDeviceFlags(uuid.UUID) (*common.DeviceFlags, error)
+	// SetDeviceFlags set the flags of a device, replacing any; nil removes them
+	SetDeviceFlags(uuid.UUID, *common.DeviceFlags) error
+	// GetQuarantine get the quarantine of a device, nil if it is not quarantined
+	GetQuarantine(uuid.UUID) (*common.Quarantine, error)
+	// SetQuarantine quarantine a device, replacing any quarantine; nil releases it
+	SetQuarantine(uuid.UUID, *common.Quarantine) error
+	// GetDeviceSources get where the requests of a device came from, the most recently seen first, nil if none is
+	// recorded
+	GetDeviceSources(uuid.UUID) ([]common.DeviceSource, error)
+	// SetDeviceSources set where the requests of a device came from, replacing those recorded; none removes them
+	SetDeviceSources(uuid.UUID, []common.DeviceSource) error
+	// GetAttestation get the attestation of a device, with the certificates and vault keys it published, nil if it
+	// has none
+	GetAttestation(uuid.UUID) (*common.Attestation, error)
+	// SetAttestation set the attestation of a device, replacing any; nil removes it
+	SetAttestation(uuid.UUID, *common.Attestation) error
+	// RecordStore the records kept by key, of each of common.RecordKinds, e.g. the devices waiting for approval, the
+	//   admin API tokens or the config rollouts; read and written with the typed accessors of common, e.g.
+	//   common.PendingAdd
+	common.RecordStore
+}
+
+// GarbageCollector optional interface of a DeviceManager that can find data left behind without a matching
+// device, e.g. by a device removal that failed half way
+type GarbageCollector interface {
+	// CollectGarbage find the orphaned data and, if remove is true, delete it. Returns the orphans found
+	CollectGarbage(remove bool) ([]common.Orphan, error)
+}
+
+// UsageReporter optional interface of a DeviceManager that can report how much storage the messages of each device
+// use, for capacity planning
+type UsageReporter interface {
+	// DeviceUsage get the storage used by each kind of message of a device
+	//   *common.NotFoundError if the device is not registered
+	DeviceUsage(u uuid.UUID) (*common.DeviceUsage, error)
+}
+
+// Migrator optional interface of a DeviceManager whose storage outlives it, upgrading the layout of storage written
+// by older releases when its format changes
+type Migrator interface {
+	// SchemaVersion get the version of the layout of the storage, 0 if it predates versions, and the latest one
+	SchemaVersion() (int, int, error)
+	// Migrate upgrade the storage to the latest version of its layout, applying the migrations it is missing in order.
+	// Returns the version it was at and the one it reached. Storage of a newer version is refused
+	Migrate() (int, int, error)
+}
+
+// Reencrypter optional interface of a DeviceManager that encrypts values at rest, migrating those stored in
+// plaintext, before encryption was enabled, or encrypted by older releases without the key of their record
+type Reencrypter interface {
+	// Reencrypt encrypt those values anew with the encryptor set, with the keys of their records. Returns how many
+	// were
+	Reencrypt() (int, error)
+}
+
+// HealthChecker optional interface of a DeviceManager that can check its backing store is usable, for readiness probes
+type HealthChecker interface {
+	// CheckHealth check the backing store, e.g. by pinging it, returning an error if it cannot be used
+	CheckHealth() error
+}
+
+// GroupConsumer optional interface of a DeviceManager whose logs, info and metrics can be consumed by groups of
+// processors, so that each entry is processed once, by one member of a group, even across restarts
+type GroupConsumer interface {
+	// GetLogsConsumer get a consumer of the logs of a device, as the named member of a group. A group starts
+	// from the oldest entry, the first time it is used, and resumes where it left off after that
+	GetLogsConsumer(u uuid.UUID, group, consumer string) (common.StreamConsumer, error)
+	// GetInfoConsumer get a consumer of the info of a device, as the named member of a group
+	GetInfoConsumer(u uuid.UUID, group, consumer string) (common.StreamConsumer, error)
+	// GetMetricsConsumer get a consumer of the metrics of a device, as the named member of a group
+	GetMetricsConsumer(u uuid.UUID, group, consumer string) (common.StreamConsumer, error)
+}
+
+// Closer optional interface of a DeviceManager with connections or open files to close on shutdown
+type Closer interface {
+	// Close flush anything buffered and close the connections or files; the DeviceManager cannot be used after
+	Close() error
+}
+
+// Archiver optional interface of a DeviceManager that can move the older entries of the streams of devices to cheaper
+// cold storage, still reading them from there, to bound the growth of the database without losing history
+type Archiver interface {
+	// ArchiveLocation where entries are archived, empty if they are not
+	ArchiveLocation() string
+	// Archive move the entries older than the archive age to the cold storage. Returns the streams archived from
+	Archive() ([]common.Archived, error)
+}
+
+// LogSourceIndexer optional interface of a DeviceManager that indexes the logs of devices by their source, e.g.
+// zedagent, as they are written, so that those of one source are read without scanning all the logs of the device
+type LogSourceIndexer interface {
+	// GetLogSources get the sources of the logs of a device, with how many entries of each are indexed
+	GetLogSources(u uuid.UUID) (map[string]int64, error)
+	// GetLogsSourceReader get the logs of a device from one source, oldest first
+	GetLogsSourceReader(u uuid.UUID, source string) (io.Reader, error)
+}
+
+// StreamSeeker optional interface of a DeviceManager that can read part of the logs, info and metrics of a device,
+// from or up to an entry or a time, without reading all of them. Drivers without it read the first or last entries,
+// or all of them newest first, by reading all entries
+type StreamSeeker interface {
+	// GetLogsRange get the logs of a device in a range
+	//   *common.NotFoundError if the device is not registered
+	GetLogsRange(u uuid.UUID, rng common.StreamRange) (common.RangeReader, error)
+	// GetInfoRange get the info of a device in a range
+	//   *common.NotFoundError if the device is not registered
+	GetInfoRange(u uuid.UUID, rng common.StreamRange) (common.RangeReader, error)
+	// GetMetricsRange get the metrics of a device in a range
+	//   *common.NotFoundError if the device is not registered
+	GetMetricsRange(u uuid.UUID, rng common.StreamRange) (common.RangeReader, error)
 }
@@ -6,6 +6,8 @@ package driver
 import (
 	"github.com/lf-edge/adam/pkg/driver/file"
 	"github.com/lf-edge/adam/pkg/driver/memory"
+	"github.com/lf-edge/adam/pkg/driver/mongo"
+	"github.com/lf-edge/adam/pkg/driver/nats"
 	"github.com/lf-edge/adam/pkg/driver/redis"
 )
 
@@ -14,9 +16,16 @@ import (
 // goes through them in order
 // called as a func so that the handler disappears after the server first is created
 func GetDeviceManagers() []DeviceManager {
+	return append([]DeviceManager{&kafkaManager{stores: storeManagers}}, storeManagers()...)
+}
+
+// storeManagers the device managers that store everything themselves, and can be the store of the kafka one
+func storeManagers() []DeviceManager {
 	return []DeviceManager{
 		&memory.DeviceManager{},
 		&redis.DeviceManager{},
+		&nats.DeviceManager{},
+		&mongo.DeviceManager{},
 		&file.DeviceManager{}, // this needs to be the last catch-all one
 	}
 }
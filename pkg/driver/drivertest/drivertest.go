@@ -0,0 +1,461 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package drivertest a conformance suite for implementations of driver.DeviceManager, those of adam as well as those
+// maintained elsewhere. It checks the contract the server relies on for each method, rather than how a driver stores
+// anything: which errors are returned, and of which type, what is idempotent, and the order in which entries are read
+//
+// A driver runs the suite from one of its tests:
+//
+//	func TestConformance(t *testing.T) {
+//		drivertest.Run(t, func(t *testing.T) driver.DeviceManager {
+//			d := &DeviceManager{}
+//			if _, err := d.Init(testURL, common.MaxSizes{}); err != nil {
+//				t.Fatalf("unable to initialize: %v", err)
+//			}
+//			return d
+//		})
+//	}
+package drivertest
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	ax "github.com/lf-edge/adam/pkg/x509"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// Factory create a DeviceManager for one test of the suite, initialized over an empty store. It may skip the test,
+// with t.Skip, if the backing store is not available
+type Factory func(t *testing.T) driver.DeviceManager
+
+// Run run the conformance suite against the DeviceManagers created by factory, each test as a subtest of t with a
+// DeviceManager of its own. Those that are a driver.Closer are closed once their test is done
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, driver.DeviceManager)
+	}{
+		{"Onboard", testOnboard},
+		{"OnboardCheck", testOnboardCheck},
+		{"OnboardPolicy", testOnboardPolicy},
+		{"Device", testDevice},
+		{"DeviceReplaceCert", testDeviceReplaceCert},
+		{"Config", testConfig},
+		{"SwapConfig", testSwapConfig},
+		{"Streams", testStreams},
+		{"Audit", testAudit},
+		{"DeviceRecords", testDeviceRecords},
+		{"Records", testRecords},
+		{"ACME", testACME},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			d := factory(t)
+			if c, ok := d.(driver.Closer); ok {
+				defer c.Close()
+			}
+			tt.test(t, d)
+		})
+	}
+}
+
+// generateCert generate a self-signed certificate for cn
+func generateCert(t *testing.T, cn string) *x509.Certificate {
+	cert, _, err := ax.GenerateCertAndKey(cn, "localhost")
+	if err != nil {
+		t.Fatalf("error generating cert for tests: %v", err)
+	}
+	return cert
+}
+
+// registerDevice register a new device with a certificate of its own and the base config
+func registerDevice(t *testing.T, d driver.DeviceManager, onboard *x509.Certificate, serial string) (uuid.UUID, *x509.Certificate) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		t.Fatalf("unable to generate new UUID: %v", err)
+	}
+	cert := generateCert(t, u.String())
+	if err := d.DeviceRegister(u, cert, onboard, serial, common.CreateBaseConfig(u)); err != nil {
+		t.Fatalf("unable to register device: %v", err)
+	}
+	return u, cert
+}
+
+// readAll read all from a reader returned with err, failing the test on any error
+func readAll(t *testing.T, r io.Reader, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unable to get reader: %v", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unable to read: %v", err)
+	}
+	return string(b)
+}
+
+func testOnboard(t *testing.T, d driver.DeviceManager) {
+	cns, err := d.OnboardList()
+	assert.Equal(t, nil, err)
+	assert.Empty(t, cns)
+
+	_, _, err = d.OnboardGet("foo")
+	assert.IsType(t, &common.NotFoundError{}, err)
+	assert.IsType(t, &common.NotFoundError{}, d.OnboardRemove("foo"))
+
+	cert := generateCert(t, "foo")
+	cert2 := generateCert(t, "bar")
+	assert.Equal(t, nil, d.OnboardRegister(cert, []string{"123456", "abcdef"}))
+	assert.Equal(t, nil, d.OnboardRegister(cert2, []string{"*"}))
+
+	certBack, serials, err := d.OnboardGet("foo")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, cert.Raw, certBack.Raw)
+	assert.ElementsMatch(t, []string{"123456", "abcdef"}, serials)
+
+	// registering again replaces the serials
+	assert.Equal(t, nil, d.OnboardRegister(cert, []string{"123456", "ghijkl"}))
+	assert.Equal(t, nil, d.OnboardRegister(cert, []string{"123456", "ghijkl"}))
+	_, serials, err = d.OnboardGet("foo")
+	assert.Equal(t, nil, err)
+	assert.ElementsMatch(t, []string{"123456", "ghijkl"}, serials)
+
+	cns, err = d.OnboardList()
+	assert.Equal(t, nil, err)
+	assert.ElementsMatch(t, []string{"foo", "bar"}, cns)
+
+	assert.Equal(t, nil, d.OnboardRemove("bar"))
+	assert.IsType(t, &common.NotFoundError{}, d.OnboardRemove("bar"))
+	_, _, err = d.OnboardGet("bar")
+	assert.IsType(t, &common.NotFoundError{}, err)
+	cns, err = d.OnboardList()
+	assert.Equal(t, nil, err)
+	assert.ElementsMatch(t, []string{"foo"}, cns)
+
+	assert.Equal(t, nil, d.OnboardClear())
+	assert.Equal(t, nil, d.OnboardClear())
+	cns, err = d.OnboardList()
+	assert.Equal(t, nil, err)
+	assert.Empty(t, cns)
+}
+
+func testOnboardCheck(t *testing.T, d driver.DeviceManager) {
+	cert := generateCert(t, "foo")
+	wildcard := generateCert(t, "bar")
+
+	assert.IsType(t, &common.InvalidCertError{}, d.OnboardCheck(cert, "123456"))
+
+	assert.Equal(t, nil, d.OnboardRegister(cert, []string{"123456", "abcdef"}))
+	assert.Equal(t, nil, d.OnboardRegister(wildcard, []string{"*"}))
+	assert.Equal(t, nil, d.OnboardCheck(cert, "123456"))
+	assert.Equal(t, nil, d.OnboardCheck(wildcard, "anything"))
+	assert.IsType(t, &common.InvalidSerialError{}, d.OnboardCheck(cert, "ghijkl"))
+
+	// a serial is used once registered with
+	registerDevice(t, d, cert, "123456")
+	assert.IsType(t, &common.UsedSerialError{}, d.OnboardCheck(cert, "123456"))
+	assert.Equal(t, nil, d.OnboardCheck(cert, "abcdef"))
+}
+
+func testOnboardPolicy(t *testing.T, d driver.DeviceManager) {
+	_, err := d.OnboardPolicyGet("foo")
+	assert.IsType(t, &common.NotFoundError{}, err)
+	assert.IsType(t, &common.NotFoundError{}, d.OnboardPolicySet("foo", &common.OnboardPolicy{}))
+
+	cert := generateCert(t, "foo")
+	assert.Equal(t, nil, d.OnboardRegister(cert, []string{"123456"}))
+	p, err := d.OnboardPolicyGet("foo")
+	assert.Equal(t, nil, err)
+	assert.Nil(t, p)
+
+	policy := &common.OnboardPolicy{SoftSerials: []string{"ACME-*"}, Models: []string{"X1 Gateway"}}
+	assert.Equal(t, nil, d.OnboardPolicySet("foo", policy))
+	p, err = d.OnboardPolicyGet("foo")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, policy, p)
+
+	// removing the policy of a certificate without one is not an error
+	assert.Equal(t, nil, d.OnboardPolicySet("foo", nil))
+	assert.Equal(t, nil, d.OnboardPolicySet("foo", nil))
+	p, err = d.OnboardPolicyGet("foo")
+	assert.Equal(t, nil, err)
+	assert.Nil(t, p)
+
+	// the policy goes with its certificate
+	assert.Equal(t, nil, d.OnboardPolicySet("foo", policy))
+	assert.Equal(t, nil, d.OnboardRemove("foo"))
+	assert.Equal(t, nil, d.OnboardRegister(cert, []string{"123456"}))
+	p, err = d.OnboardPolicyGet("foo")
+	assert.Equal(t, nil, err)
+	assert.Nil(t, p)
+}
+
+func testDevice(t *testing.T, d driver.DeviceManager) {
+	list, err := d.DeviceList()
+	assert.Equal(t, nil, err)
+	assert.Empty(t, list)
+
+	unknown, _ := uuid.NewV4()
+	_, _, _, err = d.DeviceGet(&unknown)
+	assert.IsType(t, &common.NotFoundError{}, err)
+	assert.IsType(t, &common.NotFoundError{}, d.DeviceRemove(&unknown))
+
+	// a certificate not registered is not an error, only no device
+	u, err := d.DeviceCheckCert(generateCert(t, "unknown"))
+	assert.Equal(t, nil, err)
+	assert.Nil(t, u)
+
+	onboard := generateCert(t, "onboard")
+	u1, cert1 := registerDevice(t, d, onboard, "123456")
+	u2, cert2 := registerDevice(t, d, onboard, "abcdef")
+	// devices added by an admin have no onboarding certificate
+	u3, _ := registerDevice(t, d, nil, "")
+
+	// a certificate registers one device
+	u4, _ := uuid.NewV4()
+	assert.NotEqual(t, nil, d.DeviceRegister(u4, cert1, onboard, "ghijkl", common.CreateBaseConfig(u4)))
+
+	u, err = d.DeviceCheckCert(cert2)
+	assert.Equal(t, nil, err)
+	if assert.NotNil(t, u) {
+		assert.Equal(t, u2, *u)
+	}
+
+	certBack, onboardBack, serial, err := d.DeviceGet(&u1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, cert1.Raw, certBack.Raw)
+	if assert.NotNil(t, onboardBack) {
+		assert.Equal(t, onboard.Raw, onboardBack.Raw)
+	}
+	assert.Equal(t, "123456", serial)
+	_, onboardBack, serial, err = d.DeviceGet(&u3)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, onboardBack)
+	assert.Equal(t, "", serial)
+
+	list, err = d.DeviceList()
+	assert.Equal(t, nil, err)
+	assert.ElementsMatch(t, []uuid.UUID{u1, u2, u3}, derefUUIDs(list))
+
+	assert.Equal(t, nil, d.DeviceRemove(&u2))
+	assert.IsType(t, &common.NotFoundError{}, d.DeviceRemove(&u2))
+	_, _, _, err = d.DeviceGet(&u2)
+	assert.IsType(t, &common.NotFoundError{}, err)
+	u, err = d.DeviceCheckCert(cert2)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, u)
+	list, err = d.DeviceList()
+	assert.Equal(t, nil, err)
+	assert.ElementsMatch(t, []uuid.UUID{u1, u3}, derefUUIDs(list))
+
+	// the certificate of a device removed can register again
+	u5, _ := uuid.NewV4()
+	assert.Equal(t, nil, d.DeviceRegister(u5, cert2, onboard, "abcdef", common.CreateBaseConfig(u5)))
+
+	assert.Equal(t, nil, d.DeviceClear())
+	assert.Equal(t, nil, d.DeviceClear())
+	list, err = d.DeviceList()
+	assert.Equal(t, nil, err)
+	assert.Empty(t, list)
+	u, err = d.DeviceCheckCert(cert1)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, u)
+}
+
+func derefUUIDs(list []*uuid.UUID) []uuid.UUID {
+	uids := make([]uuid.UUID, 0, len(list))
+	for _, u := range list {
+		uids = append(uids, *u)
+	}
+	return uids
+}
+
+func testDeviceReplaceCert(t *testing.T, d driver.DeviceManager) {
+	u1, cert1 := registerDevice(t, d, nil, "")
+	u2, cert2 := registerDevice(t, d, nil, "")
+	certNew := generateCert(t, "new")
+
+	unknown, _ := uuid.NewV4()
+	assert.IsType(t, &common.NotFoundError{}, d.DeviceReplaceCert(unknown, certNew))
+	assert.IsType(t, &common.UsedCertError{}, d.DeviceReplaceCert(u1, cert2))
+
+	assert.Equal(t, nil, d.DeviceReplaceCert(u1, certNew))
+	// replacing with the certificate the device has is not an error
+	assert.Equal(t, nil, d.DeviceReplaceCert(u1, certNew))
+
+	u, err := d.DeviceCheckCert(certNew)
+	assert.Equal(t, nil, err)
+	if assert.NotNil(t, u) {
+		assert.Equal(t, u1, *u)
+	}
+	u, err = d.DeviceCheckCert(cert1)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, u)
+	certBack, _, _, err := d.DeviceGet(&u1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, certNew.Raw, certBack.Raw)
+
+	// the device keeps its config
+	conf, err := d.GetConfig(u1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, string(common.CreateBaseConfig(u1)), string(conf))
+	u, err = d.DeviceCheckCert(cert2)
+	assert.Equal(t, nil, err)
+	if assert.NotNil(t, u) {
+		assert.Equal(t, u2, *u)
+	}
+}
+
+func testConfig(t *testing.T, d driver.DeviceManager) {
+	unknown, _ := uuid.NewV4()
+	assert.NotEqual(t, nil, d.SetConfig(unknown, []byte(`{}`)))
+
+	u, _ := registerDevice(t, d, nil, "")
+	conf, err := d.GetConfig(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, string(common.CreateBaseConfig(u)), string(conf))
+
+	assert.NotEqual(t, nil, d.SetConfig(u, nil))
+	update := `{"id":{"uuid":"` + u.String() + `","version":"5"}}`
+	assert.Equal(t, nil, d.SetConfig(u, []byte(update)))
+	assert.Equal(t, nil, d.SetConfig(u, []byte(update)))
+	conf, err = d.GetConfig(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, update, string(conf))
+}
+
+func testSwapConfig(t *testing.T, d driver.DeviceManager) {
+	unknown, _ := uuid.NewV4()
+	assert.NotEqual(t, nil, d.SwapConfig(unknown, nil, []byte(`{}`)))
+
+	u, _ := registerDevice(t, d, nil, "")
+	base, err := d.GetConfig(u)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, d.SwapConfig(u, base, nil))
+
+	first := `{"id":{"uuid":"` + u.String() + `","version":"2"}}`
+	second := `{"id":{"uuid":"` + u.String() + `","version":"3"}}`
+	assert.Equal(t, nil, d.SwapConfig(u, base, []byte(first)))
+	// replacing the base config again, as a writer that read it before the first swap would
+	err = d.SwapConfig(u, base, []byte(second))
+	if conflict, ok := err.(*common.ConfigConflictError); assert.True(t, ok, "expected a ConfigConflictError, got %v", err) {
+		assert.Equal(t, first, string(conflict.Current))
+	}
+	conf, err := d.GetConfig(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, first, string(conf))
+
+	assert.Equal(t, nil, d.SwapConfig(u, []byte(first), []byte(second)))
+	conf, err = d.GetConfig(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, second, string(conf))
+
+	// writers that all read the same config replace it at once: only one of them may succeed
+	const writers = 8
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- d.SwapConfig(u, []byte(second), []byte(fmt.Sprintf(`{"id":{"uuid":"%s","version":"%d"}}`, u, 10+i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	swapped := 0
+	for err := range errs {
+		if err == nil {
+			swapped++
+			continue
+		}
+		_, ok := err.(*common.ConfigConflictError)
+		assert.True(t, ok, "expected a ConfigConflictError, got %v", err)
+	}
+	assert.Equal(t, 1, swapped)
+}
+
+func testStreams(t *testing.T, d driver.DeviceManager) {
+	streams := []struct {
+		name  string
+		write func(uuid.UUID, []byte) error
+		read  func(uuid.UUID) (io.Reader, error)
+	}{
+		{"logs", d.WriteLogs, d.GetLogsReader},
+		{"info", d.WriteInfo, d.GetInfoReader},
+		{"metrics", d.WriteMetrics, d.GetMetricsReader},
+		{"requests", d.WriteRequest, d.GetRequestsReader},
+	}
+	unknown, _ := uuid.NewV4()
+	u, _ := registerDevice(t, d, nil, "")
+	other, _ := registerDevice(t, d, nil, "")
+	for _, s := range streams {
+		assert.NotEqual(t, nil, s.write(unknown, []byte(`{"n":1}`)), s.name)
+		_, err := s.read(unknown)
+		assert.NotEqual(t, nil, err, s.name)
+
+		// nothing written yet
+		r, err := s.read(u)
+		assert.Equal(t, "", readAll(t, r, err), s.name)
+		// writing nothing is not an entry
+		assert.Equal(t, nil, s.write(u, nil), s.name)
+
+		// entries are read oldest first, one per line, and only those of their device
+		for _, entry := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+			assert.Equal(t, nil, s.write(u, []byte(entry)), s.name)
+		}
+		assert.Equal(t, nil, s.write(other, []byte(`{"n":4}`)), s.name)
+		r, err = s.read(u)
+		assert.Equal(t, "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n", readAll(t, r, err), s.name)
+		r, err = s.read(other)
+		assert.Equal(t, "{\"n\":4}\n", readAll(t, r, err), s.name)
+	}
+
+	app, _ := uuid.NewV4()
+	assert.NotEqual(t, nil, d.WriteAppInstanceLogs(app, unknown, []byte(`{"n":1}`)))
+	assert.Equal(t, nil, d.WriteAppInstanceLogs(app, u, []byte(`{"n":1}`)))
+
+	// the entries go with their device
+	assert.Equal(t, nil, d.DeviceRemove(&u))
+	for _, s := range streams {
+		_, err := s.read(u)
+		assert.NotEqual(t, nil, err, s.name)
+	}
+}
+
+func testAudit(t *testing.T, d driver.DeviceManager) {
+	r, err := d.GetAuditReader()
+	assert.Equal(t, "", readAll(t, r, err))
+
+	records := []string{`{"action":"onboard-add"}`, `{"action":"device-remove"}`, `{"action":"onboard-clear"}`}
+	for _, rec := range records {
+		assert.Equal(t, nil, d.WriteAudit([]byte(rec)))
+	}
+	r, err = d.GetAuditReader()
+	assert.Equal(t, "{\"action\":\"onboard-add\"}\n{\"action\":\"device-remove\"}\n{\"action\":\"onboard-clear\"}\n", readAll(t, r, err))
+}
+
+func testACME(t *testing.T, d driver.DeviceManager) {
+	_, err := common.ACMEGet(d, "account")
+	assert.IsType(t, &common.NotFoundError{}, err)
+
+	assert.Equal(t, nil, common.ACMESet(d, "account", []byte("key")))
+	assert.Equal(t, nil, common.ACMESet(d, "account", []byte("new key")))
+	assert.Equal(t, nil, common.ACMESet(d, "cert", []byte("cert")))
+	b, err := common.ACMEGet(d, "account")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "new key", string(b))
+	b, err = common.ACMEGet(d, "cert")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "cert", string(b))
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package drivertest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// at a time for the records of the suite, in UTC and without a monotonic reading, so that it is the same once stored
+var at = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// deviceRecord a record kept for each device, set and got by UUID. get returns nil, untyped, for none
+type deviceRecord struct {
+	name  string
+	value interface{}
+	get   func(driver.DeviceManager, uuid.UUID) (interface{}, error)
+	// set set the record to value, or remove it if remove is true
+	set func(d driver.DeviceManager, u uuid.UUID, remove bool) error
+	// replaced whether the record is only ever replaced, never removed
+	replaced bool
+}
+
+func deviceRecords() []deviceRecord {
+	quotas := &common.Quotas{MaxLen: common.Limits{Default: 100}, MaxBytes: common.Limits{Kinds: map[string]int64{common.KindLogs: 1024}}}
+	ack := &common.ConfigAck{Hash: "abcdef", Config: json.RawMessage(`{"id":{"version":"4"}}`), Time: at}
+	inv := &common.Inventory{EVEVersion: "6.0.0", RebootCounter: 2, Updated: &at}
+	filter := &common.LogFilter{MinSeverity: "info", Sample: 10}
+	profile := &common.LocalProfile{Token: "token", Profile: "local", RadioSilence: true}
+	meta := &common.DeviceMetadata{Name: "gateway", Site: "berlin", Tags: map[string]string{"rack": "3"}}
+	flags := &common.DeviceFlags{Flags: []string{common.FlagReadOnly}, Updated: at}
+	q := &common.Quarantine{Reason: "compromised", Since: at, Actor: "admin", Version: "4"}
+	sources := []common.DeviceSource{{IP: "203.0.113.7", TLSVersion: "TLS 1.3", UserAgent: "Go-http-client/1.1", FirstSeen: at, LastSeen: at, Requests: 3}}
+	attest := &common.Attestation{
+		Certs:          []common.AttestCert{{Type: "CERT_TYPE_DEVICE_ECDH_EXCHANGE", Cert: []byte("PEM"), TPM: true, Received: at}},
+		IntegrityToken: []byte{1, 2, 3},
+		Attested:       at,
+		PCRs:           map[string]string{"sha256:0": "00ff"},
+		Keys:           []common.VaultKey{{Type: "ATTEST_VOLUME_KEY_TYPE_VSK", EncryptedKey: []byte{4, 5}, DigestSHA256: []byte{6}, Stored: at}},
+	}
+	commands := []common.AppCommand{{ID: "1", App: "a8e0f3e4-5e0f-4b4a-8c61-3f2e3f0d7d1a", Command: "restart", State: "pending", Created: at, Updated: at}}
+
+	return []deviceRecord{
+		{"quotas", quotas,
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetDeviceQuotas(u)
+				if v == nil {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				if remove {
+					return d.SetDeviceQuotas(u, nil)
+				}
+				return d.SetDeviceQuotas(u, quotas)
+			}, false},
+		{"config ack", ack,
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetConfigAck(u)
+				if v == nil {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				return d.SetConfigAck(u, ack)
+			}, true},
+		{"inventory", inv,
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetInventory(u)
+				if v == nil {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				return d.SetInventory(u, inv)
+			}, true},
+		{"log filter", filter,
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetLogFilter(u)
+				if v == nil {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				if remove {
+					return d.SetLogFilter(u, nil)
+				}
+				return d.SetLogFilter(u, filter)
+			}, false},
+		{"local profile", profile,
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetLocalProfile(u)
+				if v == nil {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				if remove {
+					return d.SetLocalProfile(u, nil)
+				}
+				return d.SetLocalProfile(u, profile)
+			}, false},
+		{"metadata", meta,
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetDeviceMetadata(u)
+				if v == nil {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				if remove {
+					return d.SetDeviceMetadata(u, nil)
+				}
+				return d.SetDeviceMetadata(u, meta)
+			}, false},
+		{"model", "X1 Gateway",
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetDeviceModel(u)
+				if v == "" {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				if remove {
+					return d.SetDeviceModel(u, "")
+				}
+				return d.SetDeviceModel(u, "X1 Gateway")
+			}, false},
+		{"app commands", commands,
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetAppCommands(u)
+				if len(v) == 0 {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				if remove {
+					return d.SetAppCommands(u, nil)
+				}
+				return d.SetAppCommands(u, commands)
+			}, false},
+		{"flags", flags,
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetDeviceFlags(u)
+				if v == nil {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				if remove {
+					return d.SetDeviceFlags(u, nil)
+				}
+				return d.SetDeviceFlags(u, flags)
+			}, false},
+		{"quarantine", q,
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetQuarantine(u)
+				if v == nil {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				if remove {
+					return d.SetQuarantine(u, nil)
+				}
+				return d.SetQuarantine(u, q)
+			}, false},
+		{"sources", sources,
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetDeviceSources(u)
+				if len(v) == 0 {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				if remove {
+					return d.SetDeviceSources(u, nil)
+				}
+				return d.SetDeviceSources(u, sources)
+			}, false},
+		{"attestation", attest,
+			func(d driver.DeviceManager, u uuid.UUID) (interface{}, error) {
+				v, err := d.GetAttestation(u)
+				if v == nil {
+					return nil, err
+				}
+				return v, err
+			},
+			func(d driver.DeviceManager, u uuid.UUID, remove bool) error {
+				if remove {
+					return d.SetAttestation(u, nil)
+				}
+				return d.SetAttestation(u, attest)
+			}, false},
+	}
+}
+
+// testDeviceRecords each record of a device is none until set, replaced when set again, removed when set to none
+// unless it is only replaced, and goes with its device. Those of a device not registered are not found
+func testDeviceRecords(t *testing.T, d driver.DeviceManager) {
+	unknown, _ := uuid.NewV4()
+	for _, rec := range deviceRecords() {
+		_, err := rec.get(d, unknown)
+		assert.IsType(t, &common.NotFoundError{}, err, rec.name)
+		assert.IsType(t, &common.NotFoundError{}, rec.set(d, unknown, false), rec.name)
+
+		u, _ := registerDevice(t, d, nil, "")
+		other, _ := registerDevice(t, d, nil, "")
+		v, err := rec.get(d, u)
+		assert.Equal(t, nil, err, rec.name)
+		assert.Nil(t, v, rec.name)
+
+		assert.Equal(t, nil, rec.set(d, u, false), rec.name)
+		assert.Equal(t, nil, rec.set(d, u, false), rec.name)
+		v, err = rec.get(d, u)
+		assert.Equal(t, nil, err, rec.name)
+		assert.Equal(t, rec.value, v, rec.name)
+		v, err = rec.get(d, other)
+		assert.Equal(t, nil, err, rec.name)
+		assert.Nil(t, v, rec.name)
+
+		if !rec.replaced {
+			assert.Equal(t, nil, rec.set(d, other, false), rec.name)
+			assert.Equal(t, nil, rec.set(d, other, true), rec.name)
+			assert.Equal(t, nil, rec.set(d, other, true), rec.name)
+			v, err = rec.get(d, other)
+			assert.Equal(t, nil, err, rec.name)
+			assert.Nil(t, v, rec.name)
+		}
+
+		assert.Equal(t, nil, d.DeviceRemove(&u), rec.name)
+		_, err = rec.get(d, u)
+		assert.IsType(t, &common.NotFoundError{}, err, rec.name)
+		// a device registered again with the same UUID starts without
+		if err := d.DeviceRegister(u, generateCert(t, u.String()), nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unable to register device again: %v", err)
+		}
+		v, err = rec.get(d, u)
+		assert.Equal(t, nil, err, rec.name)
+		assert.Nil(t, v, rec.name)
+	}
+}
+
+// testRecords each kind of record is not found until put, replaced when put again with the same key, listed by key,
+// and not found once removed; and each kind is kept apart from the others
+func testRecords(t *testing.T, d driver.DeviceManager) {
+	id, id2 := "4f2d0c8e", "9b1a7e3c"
+	for _, kind := range common.RecordKinds {
+		records, err := d.ListRecords(kind)
+		assert.Equal(t, nil, err, kind)
+		assert.Empty(t, records, kind)
+		_, err = d.GetRecord(kind, id)
+		assert.IsType(t, &common.NotFoundError{}, err, kind)
+		assert.IsType(t, &common.NotFoundError{}, d.RemoveRecord(kind, id), kind)
+
+		assert.Equal(t, nil, d.PutRecord(kind, id, []byte(`{"value":"first"}`)), kind)
+		assert.Equal(t, nil, d.PutRecord(kind, id2, []byte(`{"value":"other"}`)), kind)
+		b, err := d.GetRecord(kind, id)
+		assert.Equal(t, nil, err, kind)
+		assert.Equal(t, `{"value":"first"}`, string(b), kind)
+
+		assert.Equal(t, nil, d.PutRecord(kind, id, []byte(`{"value":"second"}`)), kind)
+		b, err = d.GetRecord(kind, id)
+		assert.Equal(t, nil, err, kind)
+		assert.Equal(t, `{"value":"second"}`, string(b), kind)
+		records, err = d.ListRecords(kind)
+		assert.Equal(t, nil, err, kind)
+		assert.Equal(t, map[string][]byte{id: []byte(`{"value":"second"}`), id2: []byte(`{"value":"other"}`)}, records, kind)
+
+		assert.Equal(t, nil, d.RemoveRecord(kind, id), kind)
+		assert.IsType(t, &common.NotFoundError{}, d.RemoveRecord(kind, id), kind)
+		_, err = d.GetRecord(kind, id)
+		assert.IsType(t, &common.NotFoundError{}, err, kind)
+		records, err = d.ListRecords(kind)
+		assert.Equal(t, nil, err, kind)
+		assert.Equal(t, map[string][]byte{id2: []byte(`{"value":"other"}`)}, records, kind)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package file_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/adam/pkg/driver/drivertest"
+	"github.com/lf-edge/adam/pkg/driver/file"
+)
+
+func TestConformance(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) driver.DeviceManager {
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatalf("error making temporary directory: %v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		d := &file.DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unable to initialize: %v", err)
+		}
+		return d
+	})
+}
@@ -4,7 +4,10 @@
 package file
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -14,8 +17,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/lf-edge/adam/pkg/driver/common"
@@ -32,30 +35,112 @@ const (
 	DeviceOnboardFilename = "onboard-certificate.pem"
 	deviceConfigFilename  = "config.json"
 	deviceSerialFilename  = "serial.txt"
+	deviceQuotasFilename  = "quotas.json"
+	deviceAckFilename     = "config-ack.json"  // config the device last reported having
+	inventoryFilename     = "inventory.json"   // current state of the device, from its info messages
+	logFilterFilename     = "log-filter.json"  // log filter overriding the global one
+	profileFilename       = "profile.json"     // local profile server state
+	metadataFilename      = "metadata.json"    // name, site, owner and tags
+	deviceModelFilename   = "model.txt"        // name of the hardware model
+	appCommandsFilename   = "commands.json"    // commands to app instances, with their state
+	deviceFlagsFilename   = "flags.json"       // flags, with the config held
+	quarantineFilename    = "quarantine.json"  // reason and time of the quarantine
+	sourcesFilename       = "sources.json"     // where the requests came from, with when and how many
+	attestationFilename   = "attestation.json" // certificates, nonce and vault keys of the attestation
 	onboardCertFilename   = "cert.pem"
 	onboardCertSerials    = "onboard-serials.txt"
+	onboardPolicyFilename = "policy.json" // soft serials and hardware models allowed
 	logDir                = "logs"
 	metricsDir            = "metrics"
 	infoDir               = "info"
 	deviceDir             = "device"
 	onboardDir            = "onboard"
 	requestsDir           = "requests"
+	pendingDir            = "pending"      // <id>.json for each device waiting for approval
+	tokensDir             = "tokens"       // <id>.json for each admin API token
+	rolloutsDir           = "rollouts"     // <id>.json for each config rollout, with its progress
+	schedulesDir          = "schedules"    // <id>.json for each scheduled config change
+	canariesDir           = "canaries"     // <id>.json for each config canary, with what its devices reported
+	alertRulesDir         = "alerts"       // <id>.json for each alert rule
+	tombstonesDir         = "deleted"      // <uuid>.json for each device deleted softly, until removed for good
+	revocationsDir        = "revoked"      // <fingerprint>.json for each revoked certificate
+	snapshotsDir          = "snapshots"    // <name>.json for each config snapshot
+	hardwareModelsDir     = "models"       // <name>.json for each hardware model
+	datastoresDir         = "datastores"   // <name>.json for each datastore of the catalog
+	imagesDir             = "images"       // <name>.json for each image of the catalog
+	deadLettersDir        = "dead-letters" // <id>.json for each message of a device that could not be parsed
+	acmeDir               = "acme"         // <name> for the ACME account key and the certificate obtained with its key
+	auditFilename         = "audit.log"    // append-only audit log of admin actions, in the root of the database
 	MB                    = common.MB
 	maxLogSizeFile        = 100 * MB
 	maxInfoSizeFile       = 100 * MB
 	maxMetricSizeFile     = 100 * MB
 	maxRequestsSizeFile   = 100 * MB
 	maxAppLogsSizeFile    = 100 * MB
+	maxFileAge            = 24 * time.Hour
 	fileSplit             = 10
+	gzSuffix              = ".gz"
+	tmpSuffix             = ".tmp"
+	jsonSuffix            = ".json" // records of each section, e.g. logs/logs.json, rotated to logs/logs.json.1.gz
+	idxSuffix             = ".idx"  // sidecar index of the records of a file by source, e.g. logs/logs.json.idx
+	tidxSuffix            = ".tidx" // sidecar index of the records of a file by the time they were written, e.g. logs/logs.json.tidx
 )
 
+// recordFile where the records of a kind are kept, a file named after the key with the extension in the directory
+type recordFile struct {
+	dir string
+	ext string
+}
+
+// recordFiles where the records of each of the common.RecordKinds are kept, in the root of the database
+var recordFiles = map[string]recordFile{
+	common.RecordPending:        {pendingDir, jsonSuffix},
+	common.RecordTokens:         {tokensDir, jsonSuffix},
+	common.RecordRollouts:       {rolloutsDir, jsonSuffix},
+	common.RecordSchedules:      {schedulesDir, jsonSuffix},
+	common.RecordCanaries:       {canariesDir, jsonSuffix},
+	common.RecordAlertRules:     {alertRulesDir, jsonSuffix},
+	common.RecordTombstones:     {tombstonesDir, jsonSuffix},
+	common.RecordRevocations:    {revocationsDir, jsonSuffix},
+	common.RecordSnapshots:      {snapshotsDir, jsonSuffix},
+	common.RecordHardwareModels: {hardwareModelsDir, jsonSuffix},
+	common.RecordDatastores:     {datastoresDir, jsonSuffix},
+	common.RecordImages:         {imagesDir, jsonSuffix},
+	common.RecordDeadLetters:    {deadLettersDir, jsonSuffix},
+	common.RecordACME:           {acmeDir, ""},
+}
+
+// ManagedFile newline-delimited records appended to a file named name in dir. The file is rotated once it grows past
+// maxSize/fileSplit, or has been written to for longer than maxAge. Rotated files are compressed as <name>.1.gz,
+// <name>.2.gz and so on, the lowest being the most recent, and only fileSplit of them are kept. If index is set, the
+// records are indexed by source in a sidecar file next to each, see sourceIndex. All records are indexed by the time
+// they were written in another, see timeIndexPath. If journal is set, each record is written to it before the file,
+// see journal
 type ManagedFile struct {
 	dir         string
-	file        *os.File
+	name        string
 	maxSize     int64
+	maxAge      time.Duration
+	index       func([]byte) string
+	journal     *journal
+	mu          sync.Mutex
+	file        *os.File
+	idx         *os.File
+	tidx        *os.File
 	currentSize int64
-	totalSize   int64
-	dirReader   *DirReader
+	// lastWritten when the last record was written, in milliseconds since the epoch, so that none is indexed before
+	lastWritten int64
+	opened      time.Time
+}
+
+// newManagedFile create a ManagedFile in dir for the records of section, e.g. logs
+func newManagedFile(dir, section string, maxSize int) *ManagedFile {
+	return &ManagedFile{
+		dir:     dir,
+		name:    section + jsonSuffix,
+		maxSize: int64(maxSize),
+		maxAge:  maxFileAge,
+	}
 }
 
 func (m *ManagedFile) Get(index int) ([]byte, error) {
@@ -63,70 +148,275 @@ func (m *ManagedFile) Get(index int) ([]byte, error) {
 }
 
 func (m *ManagedFile) Write(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.file == nil {
-		f, err := openTimestampFile(m.dir)
-		if err != nil {
-			return 0, fmt.Errorf("failed to open file: %v", err)
+		if err := m.open(); err != nil {
+			return 0, err
 		}
-		m.file = f
 	}
-	written, err := m.file.Write(b)
-	if err != nil {
-		return 0, fmt.Errorf("failed to write log: %v", err)
+	// one record per line
+	line := make([]byte, 0, len(b)+1)
+	line = append(append(line, b...), 0x0a)
+
+	// do we need to rotate first? A record is never split across files
+	tooBig := m.maxSize > 0 && m.currentSize+int64(len(line)) > m.maxSize/fileSplit
+	tooOld := m.maxAge > 0 && time.Since(m.opened) > m.maxAge
+	if m.currentSize > 0 && (tooBig || tooOld) {
+		if err := m.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if m.journal != nil {
+		if err := m.journal.append(m, journalRecord{Offset: m.currentSize, Data: line}); err != nil {
+			return 0, err
+		}
+	}
+	if err := m.indexRecord(b); err != nil {
+		return 0, err
 	}
+	if err := m.timeRecord(); err != nil {
+		return 0, err
+	}
+	written, err := m.file.Write(line)
 	m.currentSize += int64(written)
-	m.totalSize += int64(written)
+	if err != nil {
+		return written, fmt.Errorf("failed to write log: %v", err)
+	}
+	return written, nil
+}
 
-	// do we need to open a new file?
-	if m.currentSize > m.maxSize/fileSplit {
-		m.file.Close()
-		f, err := openTimestampFile(m.dir)
-		if err != nil {
-			return 0, fmt.Errorf("failed top open file: %v", err)
+// Close sync and close the current file, if open; a later Write opens it again
+func (m *ManagedFile) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return nil
+	}
+	err := m.file.Sync()
+	if cerr := m.file.Close(); err == nil {
+		err = cerr
+	}
+	m.file = nil
+	if m.idx != nil {
+		if cerr := m.idx.Close(); err == nil {
+			err = cerr
+		}
+		m.idx = nil
+	}
+	if m.tidx != nil {
+		if cerr := m.tidx.Close(); err == nil {
+			err = cerr
 		}
-		// use the new log file pointer and reset the size
-		m.file = f
-		m.currentSize = 0
+		m.tidx = nil
+	}
+	return err
+}
+
+// sync the current file, if open
+func (m *ManagedFile) sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return nil
+	}
+	return m.file.Sync()
+}
+
+// Reader read all the records, oldest first. The files are opened at once, while no record is written, so that a
+// rotation while they are read neither skips records nor reads them twice
+func (m *ManagedFile) Reader() (io.Reader, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	legacy, err := m.legacyFiles()
+	if err != nil {
+		return nil, err
+	}
+	r := &RotatedReader{LineFeed: map[string]bool{}}
+	for _, p := range legacy {
+		r.Files = append(r.Files, p)
+		r.LineFeed[p] = true
+	}
+	for i := fileSplit; i > 0; i-- {
+		r.Files = append(r.Files, m.rotatedPath(i))
+	}
+	r.Files = append(r.Files, path.Join(m.dir, m.name))
+	if err := r.Open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open the current file for appending
+func (m *ManagedFile) open() error {
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", m.dir, err)
+	}
+	p := path.Join(m.dir, m.name)
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat file %s: %v", p, err)
 	}
+	m.file = f
+	m.currentSize = fi.Size()
+	m.opened = time.Now()
+	if err := m.openIndex(); err != nil {
+		return err
+	}
+	return m.openTimeIndex()
+}
 
-	if m.totalSize > m.maxSize {
-		// get all of the files from the directory
-		fi, err := ioutil.ReadDir(m.dir)
+// rotate compress the current file into <name>.1.gz, shifting the older ones up and dropping the oldest, and start
+// a new current file
+func (m *ManagedFile) rotate() error {
+	if m.journal != nil {
+		m.file.Sync()
+	}
+	m.file.Close()
+	m.file = nil
+	if m.idx != nil {
+		m.idx.Close()
+		m.idx = nil
+	}
+	if m.tidx != nil {
+		m.tidx.Close()
+		m.tidx = nil
+	}
+	// once all rotated files are in use, the oldest goes, along with any files from before rotation
+	oldest := m.rotatedPath(fileSplit)
+	if found, _ := exists(oldest); found {
+		if err := os.Remove(oldest); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", oldest, err)
+		}
+		if err := os.Remove(indexPath(oldest)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", indexPath(oldest), err)
+		}
+		if err := os.Remove(timeIndexPath(oldest)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", timeIndexPath(oldest), err)
+		}
+		legacy, err := m.legacyFiles()
 		if err != nil {
-			return written, fmt.Errorf("could not read directory %s: %v", m.dir, err)
-		}
-		// sort the file names
-		sort.Slice(fi, func(i int, j int) bool {
-			return fi[i].Name() < fi[j].Name()
-		})
-		for _, f := range fi {
-			if m.totalSize < m.maxSize {
-				break
-			}
-			size := f.Size()
-			filename := path.Join(m.dir, f.Name())
-			if err := os.Remove(filename); err != nil {
-				return written, fmt.Errorf("failed to remove %s: %v", filename, err)
+			return err
+		}
+		for _, p := range legacy {
+			if err := os.Remove(p); err != nil {
+				return fmt.Errorf("failed to remove %s: %v", p, err)
 			}
-			m.totalSize -= size
 		}
 	}
+	for i := fileSplit - 1; i > 0; i-- {
+		if err := os.Rename(m.rotatedPath(i), m.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate %s: %v", m.rotatedPath(i), err)
+		}
+		if err := os.Rename(indexPath(m.rotatedPath(i)), indexPath(m.rotatedPath(i+1))); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate %s: %v", indexPath(m.rotatedPath(i)), err)
+		}
+		if err := os.Rename(timeIndexPath(m.rotatedPath(i)), timeIndexPath(m.rotatedPath(i+1))); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate %s: %v", timeIndexPath(m.rotatedPath(i)), err)
+		}
+	}
+	current := path.Join(m.dir, m.name)
+	if err := compressFile(current, m.rotatedPath(1)); err != nil {
+		return err
+	}
+	// the records journaled so far are in the rotated file, synced
+	if m.journal != nil {
+		if err := m.journal.append(m, journalRecord{Rotated: true}); err != nil {
+			return err
+		}
+	}
+	// the offsets of the indexes are those of the records uncompressed, so they are kept as they are
+	if err := os.Rename(indexPath(current), indexPath(m.rotatedPath(1))); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate %s: %v", indexPath(current), err)
+	}
+	if err := os.Rename(timeIndexPath(current), timeIndexPath(m.rotatedPath(1))); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate %s: %v", timeIndexPath(current), err)
+	}
+	if err := os.Remove(current); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", current, err)
+	}
+	return m.open()
+}
 
-	return written, nil
+// rotatedPath get the path of the rotated file with index i
+func (m *ManagedFile) rotatedPath(i int) string {
+	return path.Join(m.dir, fmt.Sprintf("%s.%d%s", m.name, i, gzSuffix))
 }
 
-func (m *ManagedFile) Reader() (io.Reader, error) {
-	return &DirReader{
-		Path:     m.dir,
-		LineFeed: true,
-	}, nil
+// legacyFiles get the files in the directory from before records were appended to rotated files, one or more
+// records per file, sorted by name and so by the time they were created
+func (m *ManagedFile) legacyFiles() ([]string, error) {
+	fis, err := ioutil.ReadDir(m.dir)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("could not read directory %s: %v", m.dir, err)
+	}
+	var files []string
+	for _, fi := range fis {
+		name := fi.Name()
+		// ReadDir sorts by name already
+		if !fi.Mode().IsRegular() || strings.HasPrefix(name, m.name) {
+			continue
+		}
+		files = append(files, path.Join(m.dir, name))
+	}
+	return files, nil
+}
+
+// compressFile write a gzip compressed copy of the file at src to dst. The copy only appears under dst once complete,
+// and synced
+func compressFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+	tmp := dst + tmpSuffix
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", tmp, err)
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compress %s: %v", src, err)
+	}
+	return os.Rename(tmp, dst)
 }
 
 // DeviceManager implementation of DeviceManager interface with a directory as the backing store
 type DeviceManager struct {
 	databasePath string
 	cacheTimeout int
-	lastUpdate   time.Time
+	encryptor    *common.Encryptor
+	quotas       *common.QuotaTracker
+	// journal the write-ahead journal of the telemetry of devices, nil if the manager was not initialized
+	journal *journal
+	// refresh serializes refreshing the cache, so that requests finding it expired at once load it only once
+	refresh    sync.Mutex
+	lastUpdate time.Time
+	// configs serializes writing configs, so that one swapped is not replaced between being read and written
+	configs sync.Mutex
+	// mu guards the cached maps below, which requests read while a refresh or a write replaces them
+	mu      sync.RWMutex
+	version uint64
 	// thse are for caching only
 	onboardCerts            map[string]map[string]bool
 	deviceCerts             map[string]uuid.UUID
@@ -204,12 +494,18 @@ func (d *DeviceManager) Init(s string, sizes common.MaxSizes) (bool, error) {
 		return false, fmt.Errorf("could not create database path %s: %v", s, err)
 	}
 	d.databasePath = s
+	d.quotas = common.NewQuotaTracker()
 
 	// ensure everything exists
 	err = d.initializeDB()
 	if err != nil {
 		return false, err
 	}
+	// recover what the files are missing before any is written to
+	d.journal, err = openJournal(s)
+	if err != nil {
+		return false, err
+	}
 
 	if sizes.MaxLogSize == 0 {
 		d.maxLogSize = maxLogSizeFile
@@ -245,6 +541,11 @@ func (d *DeviceManager) SetCacheTimeout(timeout int) {
 	d.cacheTimeout = timeout
 }
 
+// SetEncryptor set the encryptor used for certificates, serials and configs
+func (d *DeviceManager) SetEncryptor(e *common.Encryptor) {
+	d.encryptor = e
+}
+
 // OnboardCheck see if a particular certificate and serial combination is valid
 func (d *DeviceManager) OnboardCheck(cert *x509.Certificate, serial string) error {
 	// do not accept a nil certificate
@@ -284,12 +585,12 @@ func (d *DeviceManager) OnboardGet(cn string) (*x509.Certificate, []string, erro
 
 	// get the certificate and serials
 	certPath := path.Join(onboardDir, onboardCertFilename)
-	cert, err := ax.ReadCert(certPath)
+	cert, err := d.readCert(certPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error reading onboard certificate at %s: %v", certPath, err)
 	}
 	serialPath := path.Join(onboardDir, onboardCertSerials)
-	serial, err := ioutil.ReadFile(serialPath)
+	serial, err := d.readFile(serialPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error reading onboard serials at %s: %v", serialPath, err)
 	}
@@ -297,6 +598,48 @@ func (d *DeviceManager) OnboardGet(cn string) (*x509.Certificate, []string, erro
 	return cert, strings.Fields(string(serial)), nil
 }
 
+// OnboardPolicyGet get the policy of an onboarding certificate by Common Name, nil if it has none
+func (d *DeviceManager) OnboardPolicyGet(cn string) (*common.OnboardPolicy, error) {
+	if _, _, err := d.OnboardGet(cn); err != nil {
+		return nil, err
+	}
+	p := path.Join(d.getOnboardPath(cn), onboardPolicyFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read onboard policy %s: %v", p, err)
+	}
+	var policy common.OnboardPolicy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, fmt.Errorf("unable to decode onboard policy %s: %v", p, err)
+	}
+	return &policy, nil
+}
+
+// OnboardPolicySet set the policy of an onboarding certificate by Common Name, replacing any; nil removes it
+func (d *DeviceManager) OnboardPolicySet(cn string, policy *common.OnboardPolicy) error {
+	if _, _, err := d.OnboardGet(cn); err != nil {
+		return err
+	}
+	p := path.Join(d.getOnboardPath(cn), onboardPolicyFilename)
+	if policy == nil {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove onboard policy %s: %v", p, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("unable to encode onboard policy of %s: %v", cn, err)
+	}
+	if err := d.writeFile(p, b); err != nil {
+		return fmt.Errorf("unable to write onboard policy %s: %v", p, err)
+	}
+	return nil
+}
+
 // OnboardList list all of the known Common Names for onboard
 func (d *DeviceManager) OnboardList() ([]string, error) {
 	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
@@ -304,6 +647,8 @@ func (d *DeviceManager) OnboardList() ([]string, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
 	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	cns := make([]string, 0)
 	for certStr := range d.onboardCerts {
 		certRaw := []byte(certStr)
@@ -357,7 +702,9 @@ func (d *DeviceManager) OnboardClear() error {
 			return fmt.Errorf("unable to remove the onboard directory: %v", err)
 		}
 	}
-	d.onboardCerts = map[string]map[string]bool{}
+	d.update(func() {
+		d.onboardCerts = map[string]map[string]bool{}
+	})
 	return nil
 }
 
@@ -371,8 +718,10 @@ func (d *DeviceManager) DeviceCheckCert(cert *x509.Certificate) (*uuid.UUID, err
 	if err != nil {
 		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
 	}
-	certStr := string(cert.Raw)
-	if u, ok := d.deviceCerts[certStr]; ok {
+	d.mu.RLock()
+	u, ok := d.deviceCerts[string(cert.Raw)]
+	d.mu.RUnlock()
+	if ok {
 		return &u, nil
 	}
 	return nil, nil
@@ -390,6 +739,7 @@ func (d *DeviceManager) DeviceRemove(u *uuid.UUID) error {
 	if err != nil {
 		return fmt.Errorf("unable to remove the device directory: %v", err)
 	}
+	d.quotas.Forget(*u)
 	// refresh the cache
 	err = d.refreshCache()
 	if err != nil {
@@ -419,8 +769,13 @@ func (d *DeviceManager) DeviceClear() error {
 			return fmt.Errorf("unable to remove the device directory: %v", err)
 		}
 	}
-	d.deviceCerts = map[string]uuid.UUID{}
-	d.devices = map[uuid.UUID]common.DeviceStorage{}
+	for _, u := range d.deviceIDs() {
+		d.quotas.Forget(u)
+	}
+	d.update(func() {
+		d.deviceCerts = map[string]uuid.UUID{}
+		d.devices = map[uuid.UUID]common.DeviceStorage{}
+	})
 	return nil
 }
 
@@ -441,19 +796,19 @@ func (d *DeviceManager) DeviceGet(u *uuid.UUID) (*x509.Certificate, *x509.Certif
 	}
 	// get the certificate, onboard certificate, serial
 	certPath := path.Join(devicePath, DeviceCertFilename)
-	cert, err := ax.ReadCert(certPath)
+	cert, err := d.readCert(certPath)
 	if err != nil {
 		return nil, nil, "", fmt.Errorf("error reading device certificate at %s: %v", certPath, err)
 	}
 
 	certPath = path.Join(devicePath, DeviceOnboardFilename)
-	onboard, err := ax.ReadCert(certPath)
+	onboard, err := d.readCert(certPath)
 	// we can accept not reading the onboard cert
 	if err != nil && !os.IsNotExist(err) {
 		return nil, nil, "", fmt.Errorf("error reading onboard certificate at %s: %v", certPath, err)
 	}
 	serialPath := path.Join(devicePath, deviceSerialFilename)
-	serial, err := ioutil.ReadFile(serialPath)
+	serial, err := d.readFile(serialPath)
 	// we can accept not reading the onboard serial
 	if err != nil && !os.IsNotExist(err) {
 		return nil, nil, "", fmt.Errorf("error reading device serial at %s: %v", serialPath, err)
@@ -469,10 +824,7 @@ func (d *DeviceManager) DeviceList() ([]*uuid.UUID, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
 	}
-	ids := make([]uuid.UUID, 0, len(d.devices))
-	for u := range d.devices {
-		ids = append(ids, u)
-	}
+	ids := d.deviceIDs()
 	pids := make([]*uuid.UUID, 0, len(ids))
 	for i := range ids {
 		pids = append(pids, &ids[i])
@@ -482,11 +834,30 @@ func (d *DeviceManager) DeviceList() ([]*uuid.UUID, error) {
 
 // initDevice initialize all structures for one device
 func (d *DeviceManager) initDevice(u uuid.UUID) error {
+	dev, err := d.newDevice(u)
+	if err != nil {
+		return err
+	}
+	// save new one to cache - just the serial and onboard; the rest is on disk
+	d.update(func() {
+		if d.deviceCerts == nil {
+			d.deviceCerts = map[string]uuid.UUID{}
+		}
+		if d.devices == nil {
+			d.devices = map[uuid.UUID]common.DeviceStorage{}
+		}
+		d.devices[u] = dev
+	})
+	return nil
+}
+
+// newDevice create the filesystem tree of a device, and the structure to write its data with
+func (d *DeviceManager) newDevice(u uuid.UUID) (common.DeviceStorage, error) {
 	// create filesystem tree and subdirs for the new device
 	devicePath := d.getDevicePath(u)
 	err := os.MkdirAll(devicePath, 0755)
 	if err != nil {
-		return fmt.Errorf("error creating new device tree %s: %v", devicePath, err)
+		return common.DeviceStorage{}, fmt.Errorf("error creating new device tree %s: %v", devicePath, err)
 	}
 
 	// create the necessary directories for data uploads
@@ -494,49 +865,32 @@ func (d *DeviceManager) initDevice(u uuid.UUID) error {
 		cur := path.Join(devicePath, p)
 		err = os.MkdirAll(cur, 0755)
 		if err != nil {
-			return fmt.Errorf("error creating new device sub-path %s: %v", cur, err)
+			return common.DeviceStorage{}, fmt.Errorf("error creating new device sub-path %s: %v", cur, err)
 		}
 	}
 
-	// save new one to cache - just the serial and onboard; the rest is on disk
-	if d.deviceCerts == nil {
-		d.deviceCerts = map[string]uuid.UUID{}
-	}
-
-	if d.devices == nil {
-		d.devices = map[uuid.UUID]common.DeviceStorage{}
-	}
-	if d.maxLogSize == 0 {
-		d.maxLogSize = maxLogSizeFile
-	}
-	if d.maxInfoSize == 0 {
-		d.maxInfoSize = maxInfoSizeFile
-	}
-	if d.maxMetricSize == 0 {
-		d.maxMetricSize = maxMetricSizeFile
-	}
+	return common.DeviceStorage{
+		Logs:     d.journaled(newLogsFile(path.Join(devicePath, logDir), sizeOr(d.maxLogSize, maxLogSizeFile))),
+		Info:     d.journaled(newManagedFile(path.Join(devicePath, infoDir), infoDir, sizeOr(d.maxInfoSize, maxInfoSizeFile))),
+		Metrics:  d.journaled(newManagedFile(path.Join(devicePath, metricsDir), metricsDir, sizeOr(d.maxMetricSize, maxMetricSizeFile))),
+		Requests: newManagedFile(path.Join(devicePath, requestsDir), requestsDir, sizeOr(d.maxRequestsSize, maxRequestsSizeFile)),
+		AppLogs:  map[uuid.UUID]common.BigData{},
+	}, nil
+}
 
-	d.devices[u] = common.DeviceStorage{
-		Logs: &ManagedFile{
-			dir:     path.Join(devicePath, logDir),
-			maxSize: int64(d.maxLogSize),
-		},
-		Info: &ManagedFile{
-			dir:     path.Join(devicePath, infoDir),
-			maxSize: int64(d.maxInfoSize),
-		},
-		Metrics: &ManagedFile{
-			dir:     path.Join(devicePath, metricsDir),
-			maxSize: int64(d.maxMetricSize),
-		},
-		Requests: &ManagedFile{
-			dir:     path.Join(devicePath, requestsDir),
-			maxSize: int64(d.maxRequestsSize),
-		},
-		AppLogs: map[uuid.UUID]common.BigData{},
+// sizeOr a maximum size, or def if it is not set, as when the manager was not initialized
+func sizeOr(size, def int) int {
+	if size == 0 {
+		return def
 	}
+	return size
+}
 
-	return nil
+// journaled write the records of m through the journal of the manager. The requests of devices are not journaled,
+// being a log of requests rather than messages accepted
+func (d *DeviceManager) journaled(m *ManagedFile) *ManagedFile {
+	m.journal = d.journal
+	return m
 }
 
 // DeviceRegister register a new device cert
@@ -564,7 +918,7 @@ func (d *DeviceManager) DeviceRegister(unew uuid.UUID, cert, onboard *x509.Certi
 
 	// save the device certificate
 	certPath := path.Join(devicePath, DeviceCertFilename)
-	err = ax.WriteCert(cert.Raw, certPath, true)
+	err = d.writeCert(cert.Raw, certPath)
 	if err != nil {
 		return fmt.Errorf("error saving device certificate to %s: %v", certPath, err)
 	}
@@ -572,14 +926,14 @@ func (d *DeviceManager) DeviceRegister(unew uuid.UUID, cert, onboard *x509.Certi
 	// save the onboard certificate and serial, if provided
 	certPath = path.Join(devicePath, DeviceOnboardFilename)
 	if onboard != nil {
-		err = ax.WriteCert(onboard.Raw, certPath, true)
+		err = d.writeCert(onboard.Raw, certPath)
 		if err != nil {
 			return fmt.Errorf("error saving device onboard certificate to %s: %v", certPath, err)
 		}
 	}
 	if serial != "" {
 		serialPath := path.Join(devicePath, deviceSerialFilename)
-		err = ioutil.WriteFile(serialPath, []byte(serial), 0644)
+		err = d.writeFile(serialPath, []byte(serial))
 		if err != nil {
 			return fmt.Errorf("error saving device serial to %s: %v", serialPath, err)
 		}
@@ -591,13 +945,66 @@ func (d *DeviceManager) DeviceRegister(unew uuid.UUID, cert, onboard *x509.Certi
 	}
 
 	// save new one to cache - just the serial and onboard; the rest is on disk
-	d.deviceCerts[string(cert.Raw)] = unew
+	d.update(func() {
+		d.deviceCerts[string(cert.Raw)] = unew
+		// this already was initialized in initDevice()
+		ds := d.devices[unew]
+		ds.Cert = cert
+		ds.Serial = serial
+		ds.Onboard = onboard
+		d.devices[unew] = ds
+	})
+
+	return nil
+}
+
+// DeviceReplaceCert replace the certificate of a registered device. The new certificate is written next to the
+// old one and renamed over it, so that the device always has exactly one valid certificate on disk
+func (d *DeviceManager) DeviceReplaceCert(u uuid.UUID, cert *x509.Certificate) error {
+	if cert == nil {
+		return fmt.Errorf("invalid nil certificate")
+	}
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	err := d.refreshCache()
+	if err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	certStr := string(cert.Raw)
+	d.mu.RLock()
+	owner, ok := d.deviceCerts[certStr]
+	d.mu.RUnlock()
+	if ok {
+		if owner == u {
+			return nil
+		}
+		return &common.UsedCertError{Err: fmt.Sprintf("certificate already used by device %s", owner)}
+	}
 
-	// this already was initialized in initDevice()
-	ds := d.devices[unew]
-	ds.Serial = serial
-	ds.Onboard = onboard
+	certPath := path.Join(d.getDevicePath(u), DeviceCertFilename)
+	tmpPath := certPath + ".new"
+	if err := d.writeFileAs(tmpPath, certPath, ax.PemEncodeCert(cert.Raw)); err != nil {
+		return fmt.Errorf("error saving device certificate to %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, certPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error replacing device certificate %s: %v", certPath, err)
+	}
 
+	// update the cache
+	d.update(func() {
+		for c, owner := range d.deviceCerts {
+			if owner == u {
+				delete(d.deviceCerts, c)
+			}
+		}
+		d.deviceCerts[certStr] = u
+		dev := d.devices[u]
+		dev.Cert = cert
+		d.devices[u] = dev
+	})
 	return nil
 }
 
@@ -624,36 +1031,41 @@ func (d *DeviceManager) OnboardRegister(cert *x509.Certificate, serial []string)
 	}
 	f := path.Join(onboardPath, onboardCertFilename)
 	// fix contents!!
-	err = ax.WriteCert(cert.Raw, f, true)
+	err = d.writeCert(cert.Raw, f)
 	if err != nil {
 		return fmt.Errorf("unable to write onboard cert file %s: %v", f, err)
 	}
 	// serials file
 	f = path.Join(onboardPath, onboardCertSerials)
-	err = ioutil.WriteFile(f, []byte(strings.Join(serial, "\n")), 0644)
+	err = d.writeFile(f, []byte(strings.Join(serial, "\n")))
 	if err != nil {
 		return fmt.Errorf("unable to write onboard serials file %s: %v", f, err)
 	}
 
 	// update the cache
-	if d.onboardCerts == nil {
-		d.onboardCerts = map[string]map[string]bool{}
-	}
 	serialList := map[string]bool{}
 	for _, s := range serial {
 		serialList[s] = true
 	}
-	d.onboardCerts[certStr] = serialList
+	d.update(func() {
+		if d.onboardCerts == nil {
+			d.onboardCerts = map[string]map[string]bool{}
+		}
+		d.onboardCerts[certStr] = serialList
+	})
 
 	return nil
 }
 
 // WriteRequest record a request
 func (d *DeviceManager) WriteRequest(u uuid.UUID, b []byte) error {
-	if dev, ok := d.devices[u]; ok {
-		dev.AddRequest(b)
+	// make sure it is not nil
+	if len(b) < 1 {
 		return nil
 	}
+	if dev, ok := d.device(u); ok {
+		return dev.AddRequest(b)
+	}
 	return fmt.Errorf("device not found: %s", u)
 }
 
@@ -667,7 +1079,10 @@ func (d *DeviceManager) WriteInfo(u uuid.UUID, b []byte) error {
 	if !d.deviceExists(u) {
 		return fmt.Errorf("unregistered device UUID: %s", u)
 	}
-	dev := d.devices[u]
+	if err := d.quotas.Use(u, common.KindInfo, len(b)); err != nil {
+		return err
+	}
+	dev, _ := d.device(u)
 	return dev.AddInfo(b)
 }
 
@@ -681,20 +1096,33 @@ func (d *DeviceManager) WriteLogs(u uuid.UUID, b []byte) error {
 	if !d.deviceExists(u) {
 		return fmt.Errorf("unregistered device UUID: %s", u)
 	}
-	dev := d.devices[u]
+	if err := d.quotas.Use(u, common.KindLogs, len(b)); err != nil {
+		return err
+	}
+	dev, _ := d.device(u)
 	return dev.AddLogs(b)
 }
 
-// appExists return if an app has been created
-func (d *DeviceManager) appExists(u, instanceID uuid.UUID) bool {
-	_, err := os.Stat(d.getAppPath(u, instanceID))
-	if err != nil {
-		return false
-	}
-	if _, ok := d.devices[u]; !ok {
-		return false
-	}
-	return true
+// appLog get the logs of an app of a device, setting them up if the app has none yet. Their directory is created
+// with the first write
+func (d *DeviceManager) appLog(u, instanceID uuid.UUID) common.BigData {
+	d.mu.RLock()
+	stream, ok := d.devices[u].AppLogs[instanceID]
+	d.mu.RUnlock()
+	if ok {
+		return stream
+	}
+	stream = d.journaled(newManagedFile(d.getAppPath(u, instanceID), logDir, sizeOr(d.maxAppLogsSize, maxAppLogsSizeFile)))
+	d.update(func() {
+		if dev, ok := d.devices[u]; ok {
+			if s, ok := dev.AppLogs[instanceID]; ok {
+				stream = s
+				return
+			}
+			dev.AppLogs[instanceID] = stream
+		}
+	})
+	return stream
 }
 
 // WriteAppInstanceLogs write a message of AppInstanceLogBundle
@@ -708,14 +1136,11 @@ func (d *DeviceManager) WriteAppInstanceLogs(instanceID uuid.UUID, deviceID uuid
 	if !d.deviceExists(deviceID) {
 		return fmt.Errorf("unregistered device UUID: %s", deviceID)
 	}
-	if !d.appExists(deviceID, instanceID) {
-		d.devices[deviceID].AppLogs[instanceID] = &ManagedFile{
-			dir:     d.getAppPath(deviceID, instanceID),
-			maxSize: int64(d.maxAppLogsSize),
-		}
+	if err := d.quotas.Use(deviceID, common.KindAppLogs, len(b)); err != nil {
+		return err
 	}
-	dev := d.devices[deviceID]
-	return dev.AddAppLog(instanceID, b)
+	_, err := d.appLog(deviceID, instanceID).Write(b)
+	return err
 }
 
 // WriteMetrics write a metrics message
@@ -728,7 +1153,10 @@ func (d *DeviceManager) WriteMetrics(u uuid.UUID, b []byte) error {
 	if !d.deviceExists(u) {
 		return fmt.Errorf("unregistered device UUID: %s", u)
 	}
-	dev := d.devices[u]
+	if err := d.quotas.Use(u, common.KindMetrics, len(b)); err != nil {
+		return err
+	}
+	dev, _ := d.device(u)
 	return dev.AddMetrics(b)
 }
 
@@ -736,7 +1164,7 @@ func (d *DeviceManager) WriteMetrics(u uuid.UUID, b []byte) error {
 func (d *DeviceManager) GetConfig(u uuid.UUID) ([]byte, error) {
 	// read the config from disk
 	fullConfigPath := path.Join(d.getDevicePath(u), deviceConfigFilename)
-	b, err := ioutil.ReadFile(fullConfigPath)
+	b, err := d.readFile(fullConfigPath)
 	switch {
 	case err != nil && os.IsNotExist(err):
 		// create the base file if it does not exist
@@ -760,13 +1188,15 @@ func (d *DeviceManager) SetConfig(u uuid.UUID, b []byte) error {
 		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
 	}
 	// look up the device by uuid
-	_, ok := d.devices[u]
+	_, ok := d.device(u)
 	if !ok {
 		return fmt.Errorf("unregistered device UUID %s", u.String())
 	}
 	if len(b) < 1 {
 		return fmt.Errorf("empty configuration")
 	}
+	d.configs.Lock()
+	defer d.configs.Unlock()
 	// save the base configuration
 	err = d.writeJSONFile(u, "", deviceConfigFilename, b)
 	if err != nil {
@@ -775,8 +1205,36 @@ func (d *DeviceManager) SetConfig(u uuid.UUID, b []byte) error {
 	return nil
 }
 
+// SwapConfig set the config for a particular device, if it is still old
+func (d *DeviceManager) SwapConfig(u uuid.UUID, old, b []byte) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return fmt.Errorf("unregistered device UUID %s", u.String())
+	}
+	if len(b) < 1 {
+		return fmt.Errorf("empty configuration")
+	}
+	d.configs.Lock()
+	defer d.configs.Unlock()
+	current, err := d.GetConfig(u)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, old) {
+		return &common.ConfigConflictError{Err: fmt.Sprintf("config of %s changed", u), Current: current}
+	}
+	if err := d.writeJSONFile(u, "", deviceConfigFilename, b); err != nil {
+		return fmt.Errorf("error saving device config to %s: %v", deviceConfigFilename, err)
+	}
+	return nil
+}
+
 // refreshCache refresh cache from disk
 func (d *DeviceManager) refreshCache() error {
+	d.refresh.Lock()
+	defer d.refresh.Unlock()
 	// is it time to update the cache again?
 	now := time.Now()
 	if now.Sub(d.lastUpdate).Seconds() < float64(d.cacheTimeout) {
@@ -789,16 +1247,35 @@ func (d *DeviceManager) refreshCache() error {
 		return err
 	}
 
+	loaded, err := d.loadCache()
+	if err != nil {
+		return err
+	}
+	// mark the time we updated, unless the cache was written to while loading, in which case what was loaded may
+	// be missing that write, so it is loaded again the next time
+	if loaded {
+		d.lastUpdate = now
+	}
+	return nil
+}
+
+// loadCache load the cache from disk, keeping the files of the devices already in it, so that writes to them go
+// on through the same files. Returns whether the cache was replaced
+func (d *DeviceManager) loadCache() (bool, error) {
+	d.mu.RLock()
+	version := d.version
+	d.mu.RUnlock()
+
 	// create new vars to hold while we load
-	d.onboardCerts = make(map[string]map[string]bool)
-	d.deviceCerts = make(map[string]uuid.UUID)
-	d.devices = make(map[uuid.UUID]common.DeviceStorage)
+	onboardCerts := make(map[string]map[string]bool)
+	deviceCerts := make(map[string]uuid.UUID)
+	devices := make(map[uuid.UUID]common.DeviceStorage)
 
 	// scan the onboard path for all files which end in ".pem" and load them
 	onboardPath := path.Join(d.databasePath, onboardDir)
 	candidates, err := ioutil.ReadDir(onboardPath)
 	if err != nil {
-		return fmt.Errorf("unable to read onboarding certificates at %s: %v", onboardPath, err)
+		return false, fmt.Errorf("unable to read onboarding certificates at %s: %v", onboardPath, err)
 	}
 	// check each file to make sure it is an onboarding cert
 	for _, fi := range candidates {
@@ -815,18 +1292,18 @@ func (d *DeviceManager) refreshCache() error {
 		}
 
 		// read the file
-		b, err := ioutil.ReadFile(f)
+		b, err := d.readFile(f)
 		if err != nil {
-			return fmt.Errorf("unable to read onboard certificate file %s: %v", f, err)
+			return false, fmt.Errorf("unable to read onboard certificate file %s: %v", f, err)
 		}
 		// convert into a certificate
 		certPem, _ := pem.Decode(b)
 		cert, err := x509.ParseCertificate(certPem.Bytes)
 		if err != nil {
-			return fmt.Errorf("unable to convert data from file %s to onboard certificate: %v", f, err)
+			return false, fmt.Errorf("unable to convert data from file %s to onboard certificate: %v", f, err)
 		}
 		certStr := string(cert.Raw)
-		d.onboardCerts[certStr] = make(map[string]bool)
+		onboardCerts[certStr] = make(map[string]bool)
 
 		// get the serial list
 		f = path.Join(onboardPath, name, onboardCertSerials)
@@ -836,13 +1313,13 @@ func (d *DeviceManager) refreshCache() error {
 		if err != nil {
 			continue
 		}
-		b, err = ioutil.ReadFile(f)
+		b, err = d.readFile(f)
 		if err != nil {
-			return fmt.Errorf("unable to read onboard serial file %s: %v", f, err)
+			return false, fmt.Errorf("unable to read onboard serial file %s: %v", f, err)
 		}
 		// convert the []byte to string, split and save
 		for _, serial := range strings.Fields(string(b)) {
-			d.onboardCerts[certStr][serial] = true
+			onboardCerts[certStr][serial] = true
 		}
 	}
 
@@ -851,7 +1328,7 @@ func (d *DeviceManager) refreshCache() error {
 	devicePath := path.Join(d.databasePath, deviceDir)
 	candidates, err = ioutil.ReadDir(devicePath)
 	if err != nil {
-		return fmt.Errorf("unable to read devices at %s: %v", devicePath, err)
+		return false, fmt.Errorf("unable to read devices at %s: %v", devicePath, err)
 	}
 	// check each directory to see if it is a valid device directory
 	for _, fi := range candidates {
@@ -863,7 +1340,7 @@ func (d *DeviceManager) refreshCache() error {
 		// convert the path name to a UUID
 		u, err := uuid.FromString(name)
 		if err != nil {
-			return fmt.Errorf("unable to convert device uuid from directory name %s: %v", name, err)
+			return false, fmt.Errorf("unable to convert device uuid from directory name %s: %v", name, err)
 		}
 		devicePath := d.getDevicePath(u)
 
@@ -875,20 +1352,32 @@ func (d *DeviceManager) refreshCache() error {
 			continue
 		}
 		// read the file
-		b, err := ioutil.ReadFile(f)
+		b, err := d.readFile(f)
 		if err != nil {
-			return fmt.Errorf("unable to read device certificate file %s: %v", f, err)
+			return false, fmt.Errorf("unable to read device certificate file %s: %v", f, err)
 		}
 		// convert into a certificate
 		certPem, _ := pem.Decode(b)
 		cert, err := x509.ParseCertificate(certPem.Bytes)
 		if err != nil {
-			return fmt.Errorf("unable to convert data from file %s to device certificate: %v", f, err)
+			return false, fmt.Errorf("unable to convert data from file %s to device certificate: %v", f, err)
 		}
 		certStr := string(cert.Raw)
-		d.deviceCerts[certStr] = u
-		if err := d.initDevice(u); err != nil {
-			return fmt.Errorf("unable to initialize device structure for device %s: %v", u, err)
+		deviceCerts[certStr] = u
+		dev, ok := d.device(u)
+		if !ok {
+			if dev, err = d.newDevice(u); err != nil {
+				return false, fmt.Errorf("unable to initialize device structure for device %s: %v", u, err)
+			}
+		}
+		dev.Cert, dev.Onboard, dev.Serial = cert, nil, ""
+		devices[u] = dev
+		quotas, err := d.readQuotas(u)
+		if err != nil {
+			return false, err
+		}
+		if quotas != nil {
+			d.quotas.SetDevice(u, quotas)
 		}
 
 		// load the device onboarding certificate and serial
@@ -899,23 +1388,23 @@ func (d *DeviceManager) refreshCache() error {
 			continue
 		}
 		// read the file
-		b, err = ioutil.ReadFile(f)
+		b, err = d.readFile(f)
 		if err != nil {
-			return fmt.Errorf("unable to read device onboard certificate file %s: %v", f, err)
+			return false, fmt.Errorf("unable to read device onboard certificate file %s: %v", f, err)
 		}
 		// convert into a certificate
 		certPem, _ = pem.Decode(b)
 		cert, err = x509.ParseCertificate(certPem.Bytes)
 		if err != nil {
-			return fmt.Errorf("unable to convert data from file %s to device onboard certificate: %v", f, err)
+			return false, fmt.Errorf("unable to convert data from file %s to device onboard certificate: %v", f, err)
 		}
 		certStr = string(cert.Raw)
 		if err != nil {
-			return fmt.Errorf("unable to convert device uuid from directory name %s: %v", name, err)
+			return false, fmt.Errorf("unable to convert device uuid from directory name %s: %v", name, err)
 		}
-		devItem := d.devices[u]
+		devItem := devices[u]
 		devItem.Onboard = cert
-		d.devices[u] = devItem
+		devices[u] = devItem
 		// and the serial
 		f = path.Join(devicePath, deviceSerialFilename)
 		_, err = os.Stat(f)
@@ -924,23 +1413,29 @@ func (d *DeviceManager) refreshCache() error {
 			continue
 		}
 		// read the file
-		b, err = ioutil.ReadFile(f)
+		b, err = d.readFile(f)
 		if err != nil {
-			return fmt.Errorf("unable to read device serial file %s: %v", f, err)
+			return false, fmt.Errorf("unable to read device serial file %s: %v", f, err)
 		}
-		devItem = d.devices[u]
+		devItem = devices[u]
 		devItem.Serial = string(b)
-		d.devices[u] = devItem
+		devices[u] = devItem
 	}
 
-	// mark the time we updated
-	d.lastUpdate = now
-	return nil
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.version != version {
+		return false, nil
+	}
+	d.onboardCerts = onboardCerts
+	d.deviceCerts = deviceCerts
+	d.devices = devices
+	return true, nil
 }
 
 // initialize dirs, in case they do not exist
 func (d *DeviceManager) initializeDB() error {
-	for _, p := range []string{deviceDir, onboardDir} {
+	for _, p := range []string{deviceDir, onboardDir, pendingDir} {
 		pdir := path.Join(d.databasePath, p)
 		err := os.MkdirAll(pdir, 0755)
 		if err != nil {
@@ -965,12 +1460,6 @@ func (d *DeviceManager) getOnboardPath(cn string) string {
 	return path.Join(d.databasePath, onboardDir, cn)
 }
 
-func openTimestampFile(filename string) (*os.File, error) {
-	// open a new one
-	fullPath := path.Join(filename, time.Now().Format("2006-01-02T15:04:05.111"))
-	return os.Create(fullPath)
-}
-
 // writeProtobufToJSONFile write a protobuf to a named file in the given directory
 func (d *DeviceManager) writeProtobufToJSONFile(u uuid.UUID, dir, filename string, msg proto.Message) error {
 	b, err := util.ProtobufToBytes(msg)
@@ -989,46 +1478,144 @@ func (d *DeviceManager) writeJSONFile(u uuid.UUID, dir, filename string, b []byt
 		return fmt.Errorf("failed to open file %s: %v", fullPath, err)
 	}
 	defer f.Close()
-	if _, err := f.Write(b); err != nil {
+	v, err := d.encryptor.Encrypt(b, d.recordKey(fullPath))
+	if err != nil {
+		return fmt.Errorf("error encrypting %s: %v", fullPath, err)
+	}
+	if _, err := f.Write(v); err != nil {
 		return fmt.Errorf("error writing to file: %v", err)
 	}
 	// no need to f.Close() as it happens automatically
 	return nil
 }
 
-// deviceExists return if a device has been created
-func (d *DeviceManager) deviceExists(u uuid.UUID) bool {
-	_, err := os.Stat(d.getDevicePath(u))
+// writeFile write data to a file, encrypting it if an encryptor is set
+func (d *DeviceManager) writeFile(p string, b []byte) error {
+	return d.writeFileAs(p, p, b)
+}
+
+// writeFileAs write data to a file that is to be renamed to another, encrypting it, if an encryptor is set, as the
+// record of the other
+func (d *DeviceManager) writeFileAs(p, final string, b []byte) error {
+	v, err := d.encryptor.Encrypt(b, d.recordKey(final))
 	if err != nil {
-		return false
+		return fmt.Errorf("error encrypting %s: %v", p, err)
 	}
-	if _, ok := d.devices[u]; !ok {
-		return false
-	}
-	return true
+	return ioutil.WriteFile(p, v, 0644)
 }
 
-// checkValidOnboardSerial see if a particular certificate+serial combinaton is valid
-// does **not** check if it has been used
-func (d *DeviceManager) checkValidOnboardSerial(cert *x509.Certificate, serial string) error {
-	certStr := string(cert.Raw)
-	if c, ok := d.onboardCerts[certStr]; ok {
-		// accept the specific serial or the wildcard
-		if _, ok := c[serial]; ok {
-			return nil
-		}
-		if _, ok := c["*"]; ok {
-			return nil
-		}
-		return &common.InvalidSerialError{Err: fmt.Sprintf("unknown serial: %s", serial)}
+// recordKey the key of the record of a file its value is encrypted with, its path from the root of the database, so
+// that the database can be moved
+func (d *DeviceManager) recordKey(p string) string {
+	rel, err := filepath.Rel(d.databasePath, p)
+	if err != nil {
+		return p
 	}
-	return &common.InvalidCertError{Err: "unknown onboarding certificate"}
+	return filepath.ToSlash(rel)
 }
 
-// getOnboardSerialDevice see if a particular certificate+serial combinaton has been used and get its device uuid
-func (d *DeviceManager) getOnboardSerialDevice(cert *x509.Certificate, serial string) *uuid.UUID {
+// readFile read data from a file, decrypting it if it was encrypted. Errors from reading
+// the file are returned as is, so os.IsNotExist() works on them
+func (d *DeviceManager) readFile(p string) ([]byte, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	v, err := d.encryptor.Decrypt(b, d.recordKey(p))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting %s: %v", p, err)
+	}
+	return v, nil
+}
+
+// writeCert PEM encode a certificate and write it to a file, encrypting it if an encryptor is set. It is written next
+// to the file and renamed over it, so that loading the cache meanwhile never reads it half written
+func (d *DeviceManager) writeCert(cert []byte, p string) error {
+	tmp := p + ".new"
+	if err := d.writeFileAs(tmp, p, ax.PemEncodeCert(cert)); err != nil {
+		return fmt.Errorf("failed to write certificate to %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write certificate to %s: %v", p, err)
+	}
+	return nil
+}
+
+// readCert read a certificate written by writeCert
+func (d *DeviceManager) readCert(p string) (*x509.Certificate, error) {
+	b, err := d.readFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return ax.ParseCert(b)
+}
+
+// device get a registered device from the cache
+func (d *DeviceManager) device(u uuid.UUID) (common.DeviceStorage, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	dev, ok := d.devices[u]
+	return dev, ok
+}
+
+// deviceIDs the UUIDs of the devices in the cache
+func (d *DeviceManager) deviceIDs() []uuid.UUID {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ids := make([]uuid.UUID, 0, len(d.devices))
+	for u := range d.devices {
+		ids = append(ids, u)
+	}
+	return ids
+}
+
+// update change the cached maps with f, so that a refresh that loaded them before the change does not undo it
+func (d *DeviceManager) update(f func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.version++
+	f()
+}
+
+// deviceExists return if a device has been created
+func (d *DeviceManager) deviceExists(u uuid.UUID) bool {
+	_, err := os.Stat(d.getDevicePath(u))
+	if err != nil {
+		return false
+	}
+	if _, ok := d.device(u); !ok {
+		return false
+	}
+	return true
+}
+
+// checkValidOnboardSerial see if a particular certificate+serial combinaton is valid
+// does **not** check if it has been used
+func (d *DeviceManager) checkValidOnboardSerial(cert *x509.Certificate, serial string) error {
+	d.mu.RLock()
+	c, ok := d.onboardCerts[string(cert.Raw)]
+	d.mu.RUnlock()
+	if ok {
+		// accept the specific serial, the wildcard, or a pattern or range matching it
+		if common.MatchSerials(c, serial) {
+			return nil
+		}
+		return &common.InvalidSerialError{Err: fmt.Sprintf("unknown serial: %s", serial)}
+	}
+	return &common.InvalidCertError{Err: "unknown onboarding certificate"}
+}
+
+// getOnboardSerialDevice see if a particular certificate+serial combinaton has been used and get its device uuid
+func (d *DeviceManager) getOnboardSerialDevice(cert *x509.Certificate, serial string) *uuid.UUID {
 	certStr := string(cert.Raw)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	for uid, dev := range d.devices {
+		// devices added by an admin may have no onboarding certificate
+		if dev.Onboard == nil {
+			continue
+		}
 		dCertStr := string(dev.Onboard.Raw)
 		if dCertStr == certStr && serial == dev.Serial {
 			return &uid
@@ -1059,7 +1646,8 @@ func (d *DeviceManager) GetLogsReader(u uuid.UUID) (io.Reader, error) {
 	if !d.deviceExists(u) {
 		return nil, fmt.Errorf("unregistered device UUID: %s", u)
 	}
-	return d.devices[u].Logs.Reader()
+	dev, _ := d.device(u)
+	return dev.Logs.Reader()
 }
 
 // GetInfoReader get the info for a given uuid
@@ -1068,7 +1656,18 @@ func (d *DeviceManager) GetInfoReader(u uuid.UUID) (io.Reader, error) {
 	if !d.deviceExists(u) {
 		return nil, fmt.Errorf("unregistered device UUID: %s", u)
 	}
-	return d.devices[u].Info.Reader()
+	dev, _ := d.device(u)
+	return dev.Info.Reader()
+}
+
+// GetMetricsReader get the metrics for a given uuid
+func (d *DeviceManager) GetMetricsReader(u uuid.UUID) (io.Reader, error) {
+	// check that the device actually exists
+	if !d.deviceExists(u) {
+		return nil, fmt.Errorf("unregistered device UUID: %s", u)
+	}
+	dev, _ := d.device(u)
+	return dev.Metrics.Reader()
 }
 
 // GetRequestsReader get the requests for a given uuid
@@ -1077,5 +1676,758 @@ func (d *DeviceManager) GetRequestsReader(u uuid.UUID) (io.Reader, error) {
 	if !d.deviceExists(u) {
 		return nil, fmt.Errorf("unregistered device UUID: %s", u)
 	}
-	return d.devices[u].Requests.Reader()
+	dev, _ := d.device(u)
+	return dev.Requests.Reader()
+}
+
+// WriteAudit append a record to the audit log
+func (d *DeviceManager) WriteAudit(b []byte) error {
+	p := path.Join(d.databasePath, auditFilename)
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log %s: %v", p, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, 0x0a)); err != nil {
+		return fmt.Errorf("unable to write audit log %s: %v", p, err)
+	}
+	return nil
+}
+
+// GetAuditReader get the audit log. The caller should close it when done
+func (d *DeviceManager) GetAuditReader() (io.Reader, error) {
+	p := path.Join(d.databasePath, auditFilename)
+	f, err := os.Open(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return bytes.NewReader(nil), nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to open audit log %s: %v", p, err)
+	}
+	return f, nil
+}
+
+// SetQuotas set the quotas of devices without their own, and the period over which byte quotas are counted.
+// Stream lengths do not apply, as files are rotated by size
+func (d *DeviceManager) SetQuotas(q common.Quotas, period time.Duration) {
+	d.quotas.SetGlobal(q, period)
+}
+
+// GetDeviceQuotas get the quotas set for a device, nil if it uses the global ones
+func (d *DeviceManager) GetDeviceQuotas(u uuid.UUID) (*common.Quotas, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	return d.quotas.Device(u), nil
+}
+
+// SetDeviceQuotas set the quotas of a device, overriding the global ones; nil removes them
+func (d *DeviceManager) SetDeviceQuotas(u uuid.UUID, q *common.Quotas) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), deviceQuotasFilename)
+	if q == nil {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove device quotas %s: %v", p, err)
+		}
+	} else {
+		b, err := json.Marshal(q)
+		if err != nil {
+			return fmt.Errorf("unable to encode device quotas: %v", err)
+		}
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			return fmt.Errorf("unable to write device quotas %s: %v", p, err)
+		}
+	}
+	d.quotas.SetDevice(u, q)
+	return nil
+}
+
+// readQuotas read the quotas set for a device, nil if there are none
+func (d *DeviceManager) readQuotas(u uuid.UUID) (*common.Quotas, error) {
+	p := path.Join(d.getDevicePath(u), deviceQuotasFilename)
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read device quotas %s: %v", p, err)
+	}
+	var q common.Quotas
+	if err := json.Unmarshal(b, &q); err != nil {
+		return nil, fmt.Errorf("unable to decode device quotas %s: %v", p, err)
+	}
+	return &q, nil
+}
+
+// GetConfigAck get the config a device last reported having, nil if it has not reported any
+func (d *DeviceManager) GetConfigAck(u uuid.UUID) (*common.ConfigAck, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), deviceAckFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read config ack %s: %v", p, err)
+	}
+	var ack common.ConfigAck
+	if err := json.Unmarshal(b, &ack); err != nil {
+		return nil, fmt.Errorf("unable to decode config ack %s: %v", p, err)
+	}
+	return &ack, nil
+}
+
+// SetConfigAck record the config a device reported having
+func (d *DeviceManager) SetConfigAck(u uuid.UUID, ack *common.ConfigAck) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := json.Marshal(ack)
+	if err != nil {
+		return fmt.Errorf("unable to encode config ack of %s: %v", u, err)
+	}
+	p := path.Join(d.getDevicePath(u), deviceAckFilename)
+	if err := d.writeFile(p, b); err != nil {
+		return fmt.Errorf("unable to write config ack %s: %v", p, err)
+	}
+	return nil
+}
+
+// GetInventory get the current state of a device, from its info messages, nil if it has not sent any
+func (d *DeviceManager) GetInventory(u uuid.UUID) (*common.Inventory, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), inventoryFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read inventory %s: %v", p, err)
+	}
+	var inv common.Inventory
+	if err := json.Unmarshal(b, &inv); err != nil {
+		return nil, fmt.Errorf("unable to decode inventory %s: %v", p, err)
+	}
+	return &inv, nil
+}
+
+// SetInventory record the current state of a device
+func (d *DeviceManager) SetInventory(u uuid.UUID, inv *common.Inventory) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return fmt.Errorf("unable to encode inventory of %s: %v", u, err)
+	}
+	p := path.Join(d.getDevicePath(u), inventoryFilename)
+	if err := d.writeFile(p, b); err != nil {
+		return fmt.Errorf("unable to write inventory %s: %v", p, err)
+	}
+	return nil
+}
+
+// GetLogFilter get the filter of the logs of a device, nil if it uses the global one
+func (d *DeviceManager) GetLogFilter(u uuid.UUID) (*common.LogFilter, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), logFilterFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read log filter %s: %v", p, err)
+	}
+	var f common.LogFilter
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("unable to decode log filter %s: %v", p, err)
+	}
+	return &f, nil
+}
+
+// SetLogFilter set the filter of the logs of a device, overriding the global one; nil removes it
+func (d *DeviceManager) SetLogFilter(u uuid.UUID, f *common.LogFilter) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), logFilterFilename)
+	if f == nil {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove log filter %s: %v", p, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("unable to encode log filter of %s: %v", u, err)
+	}
+	if err := d.writeFile(p, b); err != nil {
+		return fmt.Errorf("unable to write log filter %s: %v", p, err)
+	}
+	return nil
+}
+
+// GetLocalProfile get the local profile server state of a device, nil if it has none
+func (d *DeviceManager) GetLocalProfile(u uuid.UUID) (*common.LocalProfile, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), profileFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read local profile %s: %v", p, err)
+	}
+	var lp common.LocalProfile
+	if err := json.Unmarshal(b, &lp); err != nil {
+		return nil, fmt.Errorf("unable to decode local profile %s: %v", p, err)
+	}
+	return &lp, nil
+}
+
+// SetLocalProfile set the local profile server state of a device; nil removes it
+func (d *DeviceManager) SetLocalProfile(u uuid.UUID, lp *common.LocalProfile) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), profileFilename)
+	if lp == nil {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove local profile %s: %v", p, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(lp)
+	if err != nil {
+		return fmt.Errorf("unable to encode local profile of %s: %v", u, err)
+	}
+	if err := d.writeFile(p, b); err != nil {
+		return fmt.Errorf("unable to write local profile %s: %v", p, err)
+	}
+	return nil
+}
+
+// GetDeviceMetadata get the metadata of a device, nil if none is recorded
+func (d *DeviceManager) GetDeviceMetadata(u uuid.UUID) (*common.DeviceMetadata, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), metadataFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read metadata %s: %v", p, err)
+	}
+	var md common.DeviceMetadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return nil, fmt.Errorf("unable to decode metadata %s: %v", p, err)
+	}
+	return &md, nil
+}
+
+// SetDeviceMetadata set the metadata of a device, replacing any recorded; nil removes it
+func (d *DeviceManager) SetDeviceMetadata(u uuid.UUID, md *common.DeviceMetadata) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), metadataFilename)
+	if md == nil {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove metadata %s: %v", p, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(md)
+	if err != nil {
+		return fmt.Errorf("unable to encode metadata of %s: %v", u, err)
+	}
+	if err := d.writeFile(p, b); err != nil {
+		return fmt.Errorf("unable to write metadata %s: %v", p, err)
+	}
+	return nil
+}
+
+// GetDeviceModel get the name of the hardware model of a device, empty if it has none
+func (d *DeviceManager) GetDeviceModel(u uuid.UUID) (string, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return "", fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return "", &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), deviceModelFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return "", nil
+	case err != nil:
+		return "", fmt.Errorf("unable to read hardware model %s: %v", p, err)
+	}
+	return string(b), nil
+}
+
+// SetDeviceModel set the name of the hardware model of a device; empty removes it
+func (d *DeviceManager) SetDeviceModel(u uuid.UUID, model string) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), deviceModelFilename)
+	if model == "" {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove hardware model %s: %v", p, err)
+		}
+		return nil
+	}
+	if err := d.writeFile(p, []byte(model)); err != nil {
+		return fmt.Errorf("unable to write hardware model %s: %v", p, err)
+	}
+	return nil
+}
+
+// GetAppCommands get the commands to the app instances of a device, nil if it has none
+func (d *DeviceManager) GetAppCommands(u uuid.UUID) ([]common.AppCommand, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), appCommandsFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read app commands %s: %v", p, err)
+	}
+	var commands []common.AppCommand
+	if err := json.Unmarshal(b, &commands); err != nil {
+		return nil, fmt.Errorf("unable to decode app commands %s: %v", p, err)
+	}
+	return commands, nil
+}
+
+// SetAppCommands set the commands to the app instances of a device; none removes them
+func (d *DeviceManager) SetAppCommands(u uuid.UUID, commands []common.AppCommand) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), appCommandsFilename)
+	if len(commands) == 0 {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove app commands %s: %v", p, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(commands)
+	if err != nil {
+		return fmt.Errorf("unable to encode app commands of %s: %v", u, err)
+	}
+	if err := d.writeFile(p, b); err != nil {
+		return fmt.Errorf("unable to write app commands %s: %v", p, err)
+	}
+	return nil
+}
+
+// GetDeviceFlags get the flags of a device, nil if it has none
+func (d *DeviceManager) GetDeviceFlags(u uuid.UUID) (*common.DeviceFlags, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), deviceFlagsFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read device flags %s: %v", p, err)
+	}
+	var flags common.DeviceFlags
+	if err := json.Unmarshal(b, &flags); err != nil {
+		return nil, fmt.Errorf("unable to decode device flags %s: %v", p, err)
+	}
+	return &flags, nil
+}
+
+// SetDeviceFlags set the flags of a device, replacing any; nil removes them
+func (d *DeviceManager) SetDeviceFlags(u uuid.UUID, flags *common.DeviceFlags) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), deviceFlagsFilename)
+	if flags == nil {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove device flags %s: %v", p, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(flags)
+	if err != nil {
+		return fmt.Errorf("unable to encode device flags of %s: %v", u, err)
+	}
+	if err := d.writeFile(p, b); err != nil {
+		return fmt.Errorf("unable to write device flags %s: %v", p, err)
+	}
+	return nil
+}
+
+// GetQuarantine get the quarantine of a device, nil if it is not quarantined
+func (d *DeviceManager) GetQuarantine(u uuid.UUID) (*common.Quarantine, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), quarantineFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read quarantine %s: %v", p, err)
+	}
+	var q common.Quarantine
+	if err := json.Unmarshal(b, &q); err != nil {
+		return nil, fmt.Errorf("unable to decode quarantine %s: %v", p, err)
+	}
+	return &q, nil
+}
+
+// SetQuarantine quarantine a device, replacing any quarantine; nil releases it
+func (d *DeviceManager) SetQuarantine(u uuid.UUID, q *common.Quarantine) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), quarantineFilename)
+	if q == nil {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove quarantine %s: %v", p, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		return fmt.Errorf("unable to encode quarantine of %s: %v", u, err)
+	}
+	if err := d.writeFile(p, b); err != nil {
+		return fmt.Errorf("unable to write quarantine %s: %v", p, err)
+	}
+	return nil
+}
+
+// GetDeviceSources get where the requests of a device came from, the most recently seen first, nil if none is recorded
+func (d *DeviceManager) GetDeviceSources(u uuid.UUID) ([]common.DeviceSource, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), sourcesFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read device sources %s: %v", p, err)
+	}
+	var sources []common.DeviceSource
+	if err := json.Unmarshal(b, &sources); err != nil {
+		return nil, fmt.Errorf("unable to decode device sources %s: %v", p, err)
+	}
+	return sources, nil
+}
+
+// SetDeviceSources set where the requests of a device came from, replacing those recorded; none removes them
+func (d *DeviceManager) SetDeviceSources(u uuid.UUID, sources []common.DeviceSource) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), sourcesFilename)
+	if len(sources) == 0 {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove device sources %s: %v", p, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(sources)
+	if err != nil {
+		return fmt.Errorf("unable to encode device sources of %s: %v", u, err)
+	}
+	if err := d.writeFile(p, b); err != nil {
+		return fmt.Errorf("unable to write device sources %s: %v", p, err)
+	}
+	return nil
+}
+
+// GetAttestation get the attestation of a device, nil if it has none
+func (d *DeviceManager) GetAttestation(u uuid.UUID) (*common.Attestation, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), attestationFilename)
+	b, err := d.readFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to read attestation %s: %v", p, err)
+	}
+	var a common.Attestation
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("unable to decode attestation %s: %v", p, err)
+	}
+	return &a, nil
+}
+
+// SetAttestation set the attestation of a device, replacing any; nil removes it
+func (d *DeviceManager) SetAttestation(u uuid.UUID, a *common.Attestation) error {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p := path.Join(d.getDevicePath(u), attestationFilename)
+	if a == nil {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove attestation %s: %v", p, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("unable to encode attestation of %s: %v", u, err)
+	}
+	if err := d.writeFile(p, b); err != nil {
+		return fmt.Errorf("unable to write attestation %s: %v", p, err)
+	}
+	return nil
+}
+
+// PutRecord add a record of a kind, or replace the one with the same key
+func (d *DeviceManager) PutRecord(kind, key string, b []byte) error {
+	dir, err := d.getRecordDir(kind)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to create %s directory: %v", kind, err)
+	}
+	f := d.getRecordPath(kind, key)
+	if err := d.writeFile(f, b); err != nil {
+		return fmt.Errorf("unable to write %s %s: %v", kind, f, err)
+	}
+	return nil
+}
+
+// GetRecord get a record of a kind by key
+func (d *DeviceManager) GetRecord(kind, key string) ([]byte, error) {
+	if _, err := d.getRecordDir(kind); err != nil {
+		return nil, err
+	}
+	f := d.getRecordPath(kind, key)
+	b, err := d.readFile(f)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, common.RecordNotFound(kind, key)
+	case err != nil:
+		return nil, fmt.Errorf("unable to read %s %s: %v", kind, f, err)
+	}
+	return b, nil
+}
+
+// ListRecords list the records of a kind, by key
+func (d *DeviceManager) ListRecords(kind string) (map[string][]byte, error) {
+	dir, err := d.getRecordDir(kind)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return map[string][]byte{}, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to list %s: %v", kind, err)
+	}
+	ext := recordFiles[kind].ext
+	records := make(map[string][]byte, len(fis))
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(name, ext) || strings.HasSuffix(name, ".new") {
+			continue
+		}
+		key := strings.TrimSuffix(name, ext)
+		b, err := d.readFile(path.Join(dir, name))
+		switch {
+		case err != nil && os.IsNotExist(err):
+			// removed since the directory was listed
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("unable to read %s %s: %v", kind, name, err)
+		}
+		records[key] = b
+	}
+	return records, nil
+}
+
+// RemoveRecord remove a record of a kind by key
+func (d *DeviceManager) RemoveRecord(kind, key string) error {
+	if _, err := d.getRecordDir(kind); err != nil {
+		return err
+	}
+	err := os.Remove(d.getRecordPath(kind, key))
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return common.RecordNotFound(kind, key)
+	case err != nil:
+		return fmt.Errorf("unable to remove %s %s: %v", kind, key, err)
+	}
+	return nil
+}
+
+// getRecordDir get the directory of the records of a kind
+func (d *DeviceManager) getRecordDir(kind string) (string, error) {
+	rf, ok := recordFiles[kind]
+	if !ok {
+		return "", fmt.Errorf("unknown kind of record: %s", kind)
+	}
+	return path.Join(d.databasePath, rf.dir), nil
+}
+
+// getRecordPath get the path for a record of a kind. Keys come from requests, so only the base name is used
+func (d *DeviceManager) getRecordPath(kind, key string) string {
+	rf := recordFiles[kind]
+	return path.Join(d.databasePath, rf.dir, path.Base(key)+rf.ext)
+}
+
+// CheckHealth check that the database directory is writable
+func (d *DeviceManager) CheckHealth() error {
+	f, err := ioutil.TempFile(d.databasePath, ".health")
+	if err != nil {
+		return fmt.Errorf("database directory %s not writable: %v", d.databasePath, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Close sync and close the files of the devices open for appending
+func (d *DeviceManager) Close() error {
+	var result error
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for u, s := range d.devices {
+		data := []common.BigData{s.Logs, s.Info, s.Metrics, s.Requests}
+		for _, a := range s.AppLogs {
+			data = append(data, a)
+		}
+		for _, b := range data {
+			m, ok := b.(*ManagedFile)
+			if !ok {
+				continue
+			}
+			if err := m.Close(); err != nil {
+				result = fmt.Errorf("failed to close %s of device %s: %v (previous error %v)", m.name, u, err, result)
+			}
+		}
+	}
+	// the files are synced, the journal is no longer needed
+	if d.journal != nil && result == nil {
+		result = d.journal.close()
+	}
+	return result
 }
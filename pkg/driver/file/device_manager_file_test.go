@@ -6,11 +6,15 @@ package file
 import (
 	"bytes"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -341,6 +345,66 @@ func TestDeviceManager(t *testing.T) {
 	})
 
 	// DeviceCheckCert for file is identical to Memory, since it just uses the cache, so no testing here
+	t.Run("TestOnboardPolicy", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		if _, ok := d.OnboardPolicySet("policy", &common.OnboardPolicy{}).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting policy of unknown onboard cert")
+		}
+		certB, _, err := ax.Generate("policy", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		if err := d.OnboardRegister(cert, []string{"abc"}); err != nil {
+			t.Fatalf("unexpected error registering onboard cert: %v", err)
+		}
+		if p, err := d.OnboardPolicyGet("policy"); err != nil || p != nil {
+			t.Errorf("expected no policy, got %v %v", p, err)
+		}
+		p := &common.OnboardPolicy{SoftSerials: []string{"ACME-*"}, Models: []string{"X1 Gateway"}}
+		if err := d.OnboardPolicySet("policy", p); err != nil {
+			t.Fatalf("unexpected error setting policy: %v", err)
+		}
+		got, err := d.OnboardPolicyGet("policy")
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting policy: %v", err)
+		case !reflect.DeepEqual(got, p):
+			t.Errorf("mismatched policy, actual %v expected %v", got, p)
+		}
+		if err := d.OnboardPolicySet("policy", nil); err != nil {
+			t.Fatalf("unexpected error removing policy: %v", err)
+		}
+		if p, err := d.OnboardPolicyGet("policy"); err != nil || p != nil {
+			t.Errorf("expected no policy once removed, got %v %v", p, err)
+		}
+		// the policy goes with its onboard cert
+		if err := d.OnboardPolicySet("policy", p); err != nil {
+			t.Fatalf("unexpected error setting policy: %v", err)
+		}
+		if err := d.OnboardRemove("policy"); err != nil {
+			t.Fatalf("unexpected error removing onboard cert: %v", err)
+		}
+		if err := d.OnboardRegister(cert, []string{"abc"}); err != nil {
+			t.Fatalf("unexpected error registering onboard cert: %v", err)
+		}
+		if p, err := d.OnboardPolicyGet("policy"); err != nil || p != nil {
+			t.Errorf("expected no policy once the onboard cert was removed, got %v %v", p, err)
+		}
+	})
+
 	t.Run("TestDeviceCheckCert", func(t *testing.T) {
 	})
 
@@ -492,7 +556,7 @@ func TestDeviceManager(t *testing.T) {
 		}
 	})
 
-	writeTester := func(t *testing.T, sectionName string, cmd func(int64, uuid.UUID, bool, DeviceManager) error) {
+	writeTester := func(t *testing.T, sectionName string, cmd func(int64, uuid.UUID, bool, *DeviceManager) error) {
 		u, _ := uuid.NewV4()
 		tests := []struct {
 			validMsg     bool
@@ -518,14 +582,15 @@ func TestDeviceManager(t *testing.T) {
 			if tt.deviceExists {
 				d.initDevice(u)
 			}
-			err = cmd(ts, u, tt.validMsg, d)
+			err = cmd(ts, u, tt.validMsg, &d)
 			switch {
 			case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
 				t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
 			case err == nil && tt.err == nil && tt.validMsg:
 				// check if the correct file exists
 				// only check if errors were nil, and we had a validMsg; nothing to write otherwise
-				fi, err := ioutil.ReadDir(sectionPath)
+				// the sidecar index of the logs by source is not counted
+				fi, err := filepath.Glob(path.Join(sectionPath, "*"+jsonSuffix))
 				switch {
 				case err != nil:
 					t.Errorf("missing directory: %s", sectionPath)
@@ -536,7 +601,7 @@ func TestDeviceManager(t *testing.T) {
 		}
 	}
 	t.Run("TestWriteInfo", func(t *testing.T) {
-		writeTester(t, "info", func(ts int64, u uuid.UUID, validMsg bool, d DeviceManager) error {
+		writeTester(t, "info", func(ts int64, u uuid.UUID, validMsg bool, d *DeviceManager) error {
 			var (
 				msg *info.ZInfoMsg
 				b   []byte
@@ -558,7 +623,7 @@ func TestDeviceManager(t *testing.T) {
 	})
 
 	t.Run("TestWriteLogs", func(t *testing.T) {
-		writeTester(t, "logs", func(ts int64, u uuid.UUID, validMsg bool, d DeviceManager) error {
+		writeTester(t, "logs", func(ts int64, u uuid.UUID, validMsg bool, d *DeviceManager) error {
 			var msg []byte
 			if validMsg {
 				b, err := common.FullLogEntry{}.Json()
@@ -572,7 +637,7 @@ func TestDeviceManager(t *testing.T) {
 	})
 
 	t.Run("TestWriteMetrics", func(t *testing.T) {
-		writeTester(t, "metrics", func(ts int64, u uuid.UUID, validMsg bool, d DeviceManager) error {
+		writeTester(t, "metrics", func(ts int64, u uuid.UUID, validMsg bool, d *DeviceManager) error {
 			var (
 				msg *metrics.ZMetricMsg
 				b   []byte
@@ -670,72 +735,1805 @@ func TestDeviceManager(t *testing.T) {
 		}
 	})
 
-	t.Run("TestOnboardRegister", func(t *testing.T) {
+	t.Run("TestDeviceReplaceCert", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+			cacheTimeout: 600,
+			lastUpdate:   time.Now(),
+		}
+		uids := fillDevice(&d)
+		u := *uids[0]
+		certB, _, err := ax.Generate("rekeyed", "")
+		if err != nil {
+			t.Fatalf("error generating device cert for tests: %v", err)
+		}
+		newCert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing device certificate: %v", err)
+		}
+		unknown, _ := uuid.NewV4()
+
 		tests := []struct {
-			validCert bool
-			serial    []string
-			used      bool
-			err       error
+			u    uuid.UUID
+			cert *x509.Certificate
+			err  error
 		}{
-			{false, nil, false, fmt.Errorf("empty nil certificate")},
-			{true, nil, false, nil},
-			{true, nil, true, nil},
-			{true, []string{}, false, nil},
-			{true, []string{}, true, nil},
-			{true, []string{"abc", "def"}, false, nil},
-			{true, []string{"abc", "def"}, true, nil},
+			{u, nil, fmt.Errorf("invalid nil certificate")},
+			{unknown, newCert, fmt.Errorf("device uuid not found")},
+			{u, d.devices[*uids[1]].Cert, fmt.Errorf("certificate already used by device")},
+			{u, newCert, nil},
 		}
 		for i, tt := range tests {
-			var (
-				cert    *x509.Certificate
-				certStr string
-				err     error
-			)
+			err := d.DeviceReplaceCert(tt.u, tt.cert)
+			switch {
+			case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
+				t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
+			case err == nil:
+				cert, err := d.readCert(path.Join(d.getDevicePath(tt.u), DeviceCertFilename))
+				if err != nil {
+					t.Fatalf("%d: unable to read device certificate: %v", i, err)
+				}
+				if !bytes.Equal(cert.Raw, tt.cert.Raw) {
+					t.Errorf("%d: mismatched device certificate on disk", i)
+				}
+				if found, _ := d.DeviceCheckCert(tt.cert); found == nil || *found != tt.u {
+					t.Errorf("%d: new certificate not registered to device %s", i, tt.u)
+				}
+				if len(d.deviceCerts) != len(uids) {
+					t.Errorf("%d: old certificate still registered", i)
+				}
+			}
+		}
+	})
 
-			// reset with each test
-			// make a temporary directory with which to work
-			dir, err := ioutil.TempDir("", "adam-test")
+	t.Run("TestAudit", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		r, err := d.GetAuditReader()
+		if err != nil {
+			t.Fatalf("unexpected error getting empty audit reader: %v", err)
+		}
+		if b, _ := ioutil.ReadAll(r); len(b) != 0 {
+			t.Errorf("expected empty audit log, got %s", b)
+		}
+		records := []string{`{"action":"onboard-add"}`, `{"action":"device-remove"}`}
+		for _, rec := range records {
+			if err := d.WriteAudit([]byte(rec)); err != nil {
+				t.Fatalf("unexpected error writing audit record: %v", err)
+			}
+		}
+		b, err := ioutil.ReadFile(path.Join(dir, auditFilename))
+		if err != nil {
+			t.Fatalf("unexpected error reading audit log: %v", err)
+		}
+		expected := strings.Join(records, "\n") + "\n"
+		if string(b) != expected {
+			t.Errorf("mismatched audit log, actual %s expected %s", b, expected)
+		}
+	})
+
+	t.Run("TestManagedFile", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		// a file from before rotation, read first and dropped with the oldest rotated file
+		legacy := path.Join(dir, "2021-01-01T00:00:00.000")
+		if err := ioutil.WriteFile(legacy, []byte(`{"n":-1}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// room for two records in each file
+		m := newManagedFile(dir, logDir, 20*fileSplit)
+		var records []string
+		write := func(n int) {
+			rec := fmt.Sprintf(`{"n":%d}`, n)
+			if _, err := m.Write([]byte(rec)); err != nil {
+				t.Fatalf("unexpected error writing record %d: %v", n, err)
+			}
+			records = append(records, rec)
+		}
+		read := func() string {
+			r, err := m.Reader()
 			if err != nil {
-				t.Fatal(err)
+				t.Fatalf("unexpected error getting reader: %v", err)
 			}
-			defer os.RemoveAll(dir)
-			d := DeviceManager{
-				databasePath: dir,
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error reading: %v", err)
+			}
+			return string(b)
+		}
+		for i := 0; i < 5; i++ {
+			write(i)
+		}
+		expected := `{"n":-1}` + "\n" + strings.Join(records, "\n") + "\n"
+		if actual := read(); actual != expected {
+			t.Errorf("mismatched records, actual %q expected %q", actual, expected)
+		}
+		for _, name := range []string{"logs.json", "logs.json.1.gz", "logs.json.2.gz"} {
+			if found, _ := exists(path.Join(dir, name)); !found {
+				t.Errorf("missing file %s", name)
 			}
+		}
 
-			if tt.validCert {
-				cert, _, err = ax.GenerateCertAndKey("onboard", "")
-				if err != nil {
-					t.Fatalf("%d: error generating onboard cert and key: %v", i, err)
-				}
-				certStr = string(cert.Raw)
+		// fill all the rotated files, so the oldest ones go
+		for i := 5; i < 2*(fileSplit+2); i++ {
+			write(i)
+		}
+		if found, _ := exists(legacy); found {
+			t.Errorf("legacy file not removed")
+		}
+		expected = strings.Join(records[2:], "\n") + "\n"
+		if actual := read(); actual != expected {
+			t.Errorf("mismatched records after rotation, actual %q expected %q", actual, expected)
+		}
+
+		// old files are rotated too, however small
+		m.opened = time.Now().Add(-2 * maxFileAge)
+		write(100)
+		b, err := ioutil.ReadFile(path.Join(dir, "logs.json"))
+		if err != nil {
+			t.Fatalf("unexpected error reading current file: %v", err)
+		}
+		if string(b) != `{"n":100}`+"\n" {
+			t.Errorf("file not rotated by age, current has %q", b)
+		}
+	})
+
+	t.Run("TestLogSources", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		// a file written before records were indexed is indexed once opened
+		if err := ioutil.WriteFile(path.Join(dir, logDir+jsonSuffix), []byte(`{"source":"nim","n":0}`+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// room for two records in each file
+		m := newLogsFile(dir, 40*fileSplit)
+		var zedagent []string
+		for i := 1; i < 8; i++ {
+			source := []string{"zedagent", "nim", ""}[i%3]
+			rec := fmt.Sprintf(`{"source":%q,"n":%d}`, source, i)
+			if _, err := m.Write([]byte(rec)); err != nil {
+				t.Fatalf("unexpected error writing record %d: %v", i, err)
 			}
-			if tt.used {
-				// store in cache and on disk
-				if d.onboardCerts == nil {
-					d.onboardCerts = map[string]map[string]bool{}
-				}
-				d.onboardCerts[certStr] = map[string]bool{}
+			if source == "zedagent" {
+				zedagent = append(zedagent, rec)
+			}
+		}
+		if found, _ := exists(path.Join(dir, "logs.json.1.idx")); !found {
+			t.Errorf("index not rotated with its file")
+		}
+		r, err := m.SourceReader("zedagent")
+		if err != nil {
+			t.Fatalf("unexpected error getting source reader: %v", err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		expected := strings.Join(zedagent, "\n") + "\n"
+		if string(b) != expected {
+			t.Errorf("mismatched records, actual %q expected %q", b, expected)
+		}
+		sources, err := m.Sources()
+		if err != nil {
+			t.Fatalf("unexpected error counting sources: %v", err)
+		}
+		if !reflect.DeepEqual(sources, map[string]int64{"zedagent": 2, "nim": 4}) {
+			t.Errorf("mismatched sources %v", sources)
+		}
+	})
 
-				onboardDir := path.Join(dir, "onboard")
-				err := saveOnboardCertAndSerials(onboardDir, cert, tt.serial)
-				if err != nil {
-					t.Fatalf("%d: error saving onboard directory: %v", i, err)
-				}
+	t.Run("TestRangeReader", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		// a file written before records were timed is read as written at the epoch
+		if err := ioutil.WriteFile(path.Join(dir, logDir+jsonSuffix), []byte(`{"n":0}`+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// room for two records in each file
+		m := newManagedFile(dir, logDir, 20*fileSplit)
+		since := time.Now()
+		for i := 1; i < 8; i++ {
+			if _, err := m.Write([]byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+				t.Fatalf("unexpected error writing record %d: %v", i, err)
 			}
-			err = d.OnboardRegister(cert, tt.serial)
-			switch {
-			case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
-				t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
-			case err == nil && d.onboardCerts[certStr] == nil:
-				t.Errorf("%d: onboardCerts are nil", i)
-			default:
-				err := common.CompareStringSliceMap(tt.serial, d.onboardCerts[certStr])
-				if err != nil {
-					t.Errorf("%d: mismatched serials", i)
-					t.Errorf("%v", err)
+		}
+		if found, _ := exists(path.Join(dir, "logs.json.1.tidx")); !found {
+			t.Errorf("time index not rotated with its file")
+		}
+		read := func(rng common.StreamRange) ([]string, string) {
+			r, err := m.RangeReader(rng)
+			if err != nil {
+				t.Fatalf("unexpected error getting range reader: %v", err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error reading: %v", err)
+			}
+			var ns []string
+			for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+				if line != "" {
+					ns = append(ns, strings.TrimSuffix(strings.TrimPrefix(line, `{"n":`), "}"))
 				}
 			}
+			return ns, r.LastID()
+		}
+		ns, cursor := read(common.StreamRange{First: 3})
+		if !reflect.DeepEqual(ns, []string{"0", "1", "2"}) {
+			t.Errorf("mismatched first records %v", ns)
+		}
+		ns, _ = read(common.StreamRange{After: cursor, First: 3})
+		if !reflect.DeepEqual(ns, []string{"3", "4", "5"}) {
+			t.Errorf("mismatched records after %s: %v", cursor, ns)
+		}
+		ns, cursor = read(common.StreamRange{Last: 2, Reverse: true})
+		if !reflect.DeepEqual(ns, []string{"1", "0"}) {
+			t.Errorf("mismatched last records reversed %v", ns)
+		}
+		if cursor != "0-0" {
+			t.Errorf("mismatched cursor of the untimed record %s", cursor)
+		}
+		ns, _ = read(common.StreamRange{Since: since, First: 2, Reverse: true})
+		if !reflect.DeepEqual(ns, []string{"7", "6"}) {
+			t.Errorf("mismatched newest records %v", ns)
+		}
+		ns, _ = read(common.StreamRange{Since: since})
+		if !reflect.DeepEqual(ns, []string{"1", "2", "3", "4", "5", "6", "7"}) {
+			t.Errorf("mismatched records since %v: %v", since, ns)
+		}
+		ns, _ = read(common.StreamRange{Until: since.Add(-time.Second)})
+		if !reflect.DeepEqual(ns, []string{"0"}) {
+			t.Errorf("mismatched records until before the writes %v", ns)
+		}
+		_, cursor = read(common.StreamRange{First: 4})
+		ns, _ = read(common.StreamRange{Before: cursor, Reverse: true})
+		if !reflect.DeepEqual(ns, []string{"2", "1", "0"}) {
+			t.Errorf("mismatched records before %s: %v", cursor, ns)
+		}
+	})
+
+	t.Run("TestClose", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("close", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if err := d.WriteLogs(u, []byte(`{"n":1}`)); err != nil {
+			t.Fatalf("unexpected error writing logs: %v", err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("unexpected error closing: %v", err)
+		}
+		if m := d.devices[u].Logs.(*ManagedFile); m.file != nil {
+			t.Errorf("logs file not closed")
+		}
+		// closing twice is harmless
+		if err := d.Close(); err != nil {
+			t.Errorf("unexpected error closing again: %v", err)
+		}
+		b, err := ioutil.ReadFile(path.Join(d.getDevicePath(u), logDir, logDir+jsonSuffix))
+		if err != nil {
+			t.Fatalf("unexpected error reading logs: %v", err)
+		}
+		if string(b) != `{"n":1}`+"\n" {
+			t.Errorf("mismatched logs, actual %q", b)
+		}
+	})
+
+	t.Run("TestCheckHealth", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		if err := d.CheckHealth(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if fi, _ := ioutil.ReadDir(dir); len(fi) != 0 {
+			t.Errorf("health check left %d files behind", len(fi))
+		}
+		d.databasePath = path.Join(dir, "missing")
+		if err := d.CheckHealth(); err == nil {
+			t.Errorf("expected an error for a missing directory")
+		}
+	})
+
+	t.Run("TestDeviceQuotas", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		d.SetQuotas(common.Quotas{MaxBytes: common.Limits{Default: 10}}, 0)
+		certB, _, err := ax.Generate("quotas", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+
+		if err := d.WriteLogs(u, []byte("0123456789")); err != nil {
+			t.Fatalf("unexpected error writing logs: %v", err)
+		}
+		if _, ok := d.WriteLogs(u, []byte("0")).(*common.QuotaExceededError); !ok {
+			t.Errorf("expected quota exceeded error writing logs")
+		}
+
+		q := &common.Quotas{MaxBytes: common.Limits{Kinds: map[string]int64{common.KindLogs: 100}}}
+		if err := d.SetDeviceQuotas(u, q); err != nil {
+			t.Fatalf("unexpected error setting device quotas: %v", err)
+		}
+		if err := d.WriteLogs(u, []byte("0123456789")); err != nil {
+			t.Errorf("unexpected error writing logs with device quota: %v", err)
+		}
+
+		// a new instance reads the device quotas back
+		d2 := &DeviceManager{}
+		if _, err := d2.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		got, err := d2.GetDeviceQuotas(u)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting device quotas: %v", err)
+		case got == nil || got.MaxBytes.For(common.KindLogs) != 100:
+			t.Errorf("mismatched device quotas, actual %v expected %v", got, q)
+		}
+
+		if err := d.SetDeviceQuotas(u, nil); err != nil {
+			t.Fatalf("unexpected error clearing device quotas: %v", err)
+		}
+		if _, err := os.Stat(path.Join(d.getDevicePath(u), deviceQuotasFilename)); !os.IsNotExist(err) {
+			t.Errorf("device quotas file not removed: %v", err)
+		}
+	})
+
+	t.Run("TestDeviceUsage", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		// small enough for each record to be in a file of its own
+		if _, err := d.Init(dir, common.MaxSizes{MaxLogSize: 100}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("usage", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		app, _ := uuid.NewV4()
+		if _, err := d.DeviceUsage(u); err == nil {
+			t.Errorf("expected error getting usage of unknown device")
+		} else if _, ok := err.(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error getting usage of unknown device, got %v", err)
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := d.WriteLogs(u, []byte("0123456789")); err != nil {
+				t.Fatalf("unexpected error writing logs: %v", err)
+			}
+		}
+		if err := d.WriteAppInstanceLogs(app, u, []byte("012")); err != nil {
+			t.Fatalf("unexpected error writing app logs: %v", err)
+		}
+
+		// a new instance finds the app logs on disk
+		d2 := &DeviceManager{}
+		if _, err := d2.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		usage, err := d2.DeviceUsage(u)
+		if err != nil {
+			t.Fatalf("unexpected error getting usage: %v", err)
+		}
+		logs := usage.Kinds[common.KindLogs]
+		if logs.Entries != 3 || logs.Bytes == 0 || logs.Oldest == nil || logs.Newest == nil {
+			t.Errorf("mismatched logs usage, actual %+v expected 3 entries", logs)
+		}
+		apps := usage.Kinds[common.KindAppLogs]
+		if apps.Entries != 1 || apps.Bytes != 4 {
+			t.Errorf("mismatched app logs usage, actual %+v expected 1 entry of 4 bytes", apps)
+		}
+		if info := usage.Kinds[common.KindInfo]; info.Entries != 0 || info.Oldest != nil {
+			t.Errorf("expected no info, got %+v", info)
+		}
+	})
+
+	t.Run("TestJournal", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("journal", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		for _, b := range []string{"first", "second", "third"} {
+			if err := d.WriteLogs(u, []byte(b)); err != nil {
+				t.Fatalf("unexpected error writing logs: %v", err)
+			}
+			if err := d.WriteInfo(u, []byte(b)); err != nil {
+				t.Fatalf("unexpected error writing info: %v", err)
+			}
+		}
+		const expected = "first\nsecond\nthird\n"
+		logsPath := path.Join(d.getDevicePath(u), logDir, logDir+jsonSuffix)
+		infoPath := path.Join(d.getDevicePath(u), infoDir, infoDir+jsonSuffix)
+
+		// the last write to the logs torn, the info lost, and a record of the journal torn, as when adam dies
+		if err := os.Truncate(logsPath, int64(len("first\nsecond\nth"))); err != nil {
+			t.Fatalf("unexpected error truncating logs: %v", err)
+		}
+		if err := os.Truncate(infoPath, 0); err != nil {
+			t.Fatalf("unexpected error truncating info: %v", err)
+		}
+		f, err := os.OpenFile(d.journal.segmentPath(d.journal.seq), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("unexpected error opening journal: %v", err)
+		}
+		f.Write([]byte{0, 0, 1, 0, 1, 2})
+		f.Close()
+
+		// the records the files have are not appended again
+		d2 := &DeviceManager{}
+		if _, err := d2.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		for _, p := range []string{logsPath, infoPath} {
+			b, err := ioutil.ReadFile(p)
+			switch {
+			case err != nil:
+				t.Errorf("unexpected error reading %s: %v", p, err)
+			case string(b) != expected:
+				t.Errorf("mismatched %s, actual %q expected %q", p, b, expected)
+			}
+		}
+		if err := d2.Close(); err != nil {
+			t.Fatalf("unexpected error closing: %v", err)
+		}
+		// once closed, the files are synced and the journal empty
+		seqs, err := (&journal{dir: path.Join(dir, journalDir)}).segments()
+		if err != nil || len(seqs) != 0 {
+			t.Errorf("expected no journal segments once closed, actual %v %v", seqs, err)
+		}
+	})
+
+	t.Run("TestConfigAck", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("ack", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, err := d.GetConfigAck(u); err == nil {
+			t.Errorf("expected error getting config ack of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if ack, err := d.GetConfigAck(u); err != nil || ack != nil {
+			t.Errorf("expected no config ack, got %v %v", ack, err)
+		}
+		ack := &common.ConfigAck{Hash: "abc", Config: []byte(`{"id":{}}`), Time: time.Now()}
+		if err := d.SetConfigAck(u, ack); err != nil {
+			t.Fatalf("unexpected error setting config ack: %v", err)
+		}
+
+		// a new instance reads the config ack back
+		d2 := &DeviceManager{}
+		if _, err := d2.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		got, err := d2.GetConfigAck(u)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting config ack: %v", err)
+		case got == nil || got.Hash != ack.Hash || string(got.Config) != string(ack.Config) || !got.Time.Equal(ack.Time):
+			t.Errorf("mismatched config ack, actual %v expected %v", got, ack)
+		}
+	})
+
+	t.Run("TestInventory", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("inventory", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, err := d.GetInventory(u); err == nil {
+			t.Errorf("expected error getting inventory of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if inv, err := d.GetInventory(u); err != nil || inv != nil {
+			t.Errorf("expected no inventory, got %v %v", inv, err)
+		}
+		inv := &common.Inventory{EVEVersion: "6.1.0", Apps: []common.InventoryApp{{UUID: "a0000000-0000-0000-0000-000000000000", State: "RUNNING"}}}
+		if err := d.SetInventory(u, inv); err != nil {
+			t.Fatalf("unexpected error setting inventory: %v", err)
+		}
+
+		// a new instance reads the inventory back
+		d2 := &DeviceManager{}
+		if _, err := d2.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		got, err := d2.GetInventory(u)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting inventory: %v", err)
+		case got == nil || got.EVEVersion != inv.EVEVersion || len(got.Apps) != 1 || got.Apps[0].State != inv.Apps[0].State:
+			t.Errorf("mismatched inventory, actual %v expected %v", got, inv)
+		}
+	})
+
+	t.Run("TestLogFilter", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("logfilter", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, err := d.GetLogFilter(u); err == nil {
+			t.Errorf("expected error getting log filter of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if f, err := d.GetLogFilter(u); err != nil || f != nil {
+			t.Errorf("expected no log filter, got %v %v", f, err)
+		}
+		f := &common.LogFilter{MinSeverity: "info", Sample: 10}
+		if err := d.SetLogFilter(u, f); err != nil {
+			t.Fatalf("unexpected error setting log filter: %v", err)
+		}
+
+		// a new instance reads the log filter back
+		d2 := &DeviceManager{}
+		if _, err := d2.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		got, err := d2.GetLogFilter(u)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting log filter: %v", err)
+		case got == nil || *got != *f:
+			t.Errorf("mismatched log filter, actual %v expected %v", got, f)
+		}
+		if err := d2.SetLogFilter(u, nil); err != nil {
+			t.Fatalf("unexpected error removing log filter: %v", err)
+		}
+		if f, err := d2.GetLogFilter(u); err != nil || f != nil {
+			t.Errorf("expected no log filter once removed, got %v %v", f, err)
+		}
+	})
+
+	t.Run("TestLocalProfile", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("profile", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, err := d.GetLocalProfile(u); err == nil {
+			t.Errorf("expected error getting local profile of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if p, err := d.GetLocalProfile(u); err != nil || p != nil {
+			t.Errorf("expected no local profile, got %v %v", p, err)
+		}
+		p := &common.LocalProfile{Token: "abc", Profile: "emergency", RadioSilence: true}
+		if err := d.SetLocalProfile(u, p); err != nil {
+			t.Fatalf("unexpected error setting local profile: %v", err)
+		}
+
+		// a new instance reads the local profile back
+		d2 := &DeviceManager{}
+		if _, err := d2.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		got, err := d2.GetLocalProfile(u)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting local profile: %v", err)
+		case got == nil || *got != *p:
+			t.Errorf("mismatched local profile, actual %v expected %v", got, p)
+		}
+		if err := d2.SetLocalProfile(u, nil); err != nil {
+			t.Fatalf("unexpected error removing local profile: %v", err)
+		}
+		if p, err := d2.GetLocalProfile(u); err != nil || p != nil {
+			t.Errorf("expected no local profile once removed, got %v %v", p, err)
+		}
+	})
+
+	t.Run("TestDeviceMetadata", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("metadata", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, err := d.GetDeviceMetadata(u); err == nil {
+			t.Errorf("expected error getting metadata of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if p, err := d.GetDeviceMetadata(u); err != nil || p != nil {
+			t.Errorf("expected no metadata, got %v %v", p, err)
+		}
+		p := &common.DeviceMetadata{Name: "gw-1", Site: "berlin", Owner: "ops", Tags: map[string]string{"rack": "4"}}
+		if err := d.SetDeviceMetadata(u, p); err != nil {
+			t.Fatalf("unexpected error setting metadata: %v", err)
+		}
+
+		// a new instance reads the metadata back
+		d2 := &DeviceManager{}
+		if _, err := d2.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		got, err := d2.GetDeviceMetadata(u)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting metadata: %v", err)
+		case !reflect.DeepEqual(got, p):
+			t.Errorf("mismatched metadata, actual %v expected %v", got, p)
+		}
+		if err := d2.SetDeviceMetadata(u, nil); err != nil {
+			t.Fatalf("unexpected error removing metadata: %v", err)
+		}
+		if p, err := d2.GetDeviceMetadata(u); err != nil || p != nil {
+			t.Errorf("expected no metadata once removed, got %v %v", p, err)
+		}
+	})
+
+	t.Run("TestDeviceModel", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("model", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, ok := d.SetDeviceModel(u, "x1").(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting hardware model of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if model, err := d.GetDeviceModel(u); err != nil || model != "" {
+			t.Errorf("expected no hardware model, got %q %v", model, err)
+		}
+		if err := d.SetDeviceModel(u, "x1"); err != nil {
+			t.Fatalf("unexpected error setting hardware model: %v", err)
+		}
+		if model, err := d.GetDeviceModel(u); err != nil || model != "x1" {
+			t.Errorf("mismatched hardware model, actual %q %v expected x1", model, err)
+		}
+		if err := d.SetDeviceModel(u, ""); err != nil {
+			t.Fatalf("unexpected error removing hardware model: %v", err)
+		}
+		if model, err := d.GetDeviceModel(u); err != nil || model != "" {
+			t.Errorf("expected no hardware model once removed, got %q %v", model, err)
+		}
+	})
+	t.Run("TestAppCommands", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("commands", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		commands := []common.AppCommand{{ID: "1", App: "a", Command: common.AppRestart, State: common.AppCommandQueued, Created: time.Now().UTC().Truncate(time.Second)}}
+		if _, ok := d.SetAppCommands(u, commands).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting app commands of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if got, err := d.GetAppCommands(u); err != nil || len(got) != 0 {
+			t.Errorf("expected no app commands, got %v %v", got, err)
+		}
+		if err := d.SetAppCommands(u, commands); err != nil {
+			t.Fatalf("unexpected error setting app commands: %v", err)
+		}
+		if got, err := d.GetAppCommands(u); err != nil || len(got) != 1 || got[0].ID != commands[0].ID || got[0].State != commands[0].State {
+			t.Errorf("mismatched app commands, actual %v %v expected %v", got, err, commands)
+		}
+		if err := d.SetAppCommands(u, nil); err != nil {
+			t.Fatalf("unexpected error removing app commands: %v", err)
+		}
+		if got, err := d.GetAppCommands(u); err != nil || len(got) != 0 {
+			t.Errorf("expected no app commands once removed, got %v %v", got, err)
+		}
+	})
+	t.Run("TestDeviceFlags", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("flags", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		flags := &common.DeviceFlags{Flags: []string{common.FlagHoldConfig, common.FlagReadOnly}, Held: []byte(`{"id":{"version":"2"}}`), HeldVersion: "2", Updated: time.Now().UTC().Truncate(time.Second)}
+		if _, ok := d.SetDeviceFlags(u, flags).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting flags of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if got, err := d.GetDeviceFlags(u); err != nil || got != nil {
+			t.Errorf("expected no flags, got %v %v", got, err)
+		}
+		if err := d.SetDeviceFlags(u, flags); err != nil {
+			t.Fatalf("unexpected error setting flags: %v", err)
+		}
+		if got, err := d.GetDeviceFlags(u); err != nil || !reflect.DeepEqual(got, flags) {
+			t.Errorf("mismatched flags, actual %v %v expected %v", got, err, flags)
+		}
+		if err := d.SetDeviceFlags(u, nil); err != nil {
+			t.Fatalf("unexpected error removing flags: %v", err)
+		}
+		if got, err := d.GetDeviceFlags(u); err != nil || got != nil {
+			t.Errorf("expected no flags once removed, got %v %v", got, err)
+		}
+	})
+	t.Run("TestQuarantine", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := &DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("quarantine", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		q := &common.Quarantine{Reason: "suspected compromise", Since: time.Now().UTC().Truncate(time.Second), Actor: "token:ops", Version: "2"}
+		if _, ok := d.SetQuarantine(u, q).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error quarantining unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if got, err := d.GetQuarantine(u); err != nil || got != nil {
+			t.Errorf("expected no quarantine, got %v %v", got, err)
+		}
+		if err := d.SetQuarantine(u, q); err != nil {
+			t.Fatalf("unexpected error quarantining: %v", err)
+		}
+		if got, err := d.GetQuarantine(u); err != nil || !reflect.DeepEqual(got, q) {
+			t.Errorf("mismatched quarantine, actual %v %v expected %v", got, err, q)
+		}
+		if err := d.SetQuarantine(u, nil); err != nil {
+			t.Fatalf("unexpected error releasing: %v", err)
+		}
+		if got, err := d.GetQuarantine(u); err != nil || got != nil {
+			t.Errorf("expected no quarantine once released, got %v %v", got, err)
+		}
+	})
+
+	t.Run("TestPending", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		certB, _, err := ax.Generate("device", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		p := common.NewPendingDevice(cert, cert, "abcdef")
+		if _, ok := common.PendingRemove(&d, p.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown pending device")
+		}
+		if err := common.PendingAdd(&d, p); err != nil {
+			t.Fatalf("unexpected error adding pending device: %v", err)
+		}
+		p.Attempts = 2
+		if err := common.PendingAdd(&d, p); err != nil {
+			t.Fatalf("unexpected error replacing pending device: %v", err)
+		}
+		got, err := common.PendingGet(&d, p.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting pending device: %v", err)
+		case got.Serial != "abcdef" || got.Attempts != 2:
+			t.Errorf("mismatched pending device, actual %v expected %v", got, p)
+		}
+		list, err := common.PendingList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one pending device, got %v %v", list, err)
+		}
+		if err := common.PendingRemove(&d, p.ID); err != nil {
+			t.Errorf("unexpected error removing pending device: %v", err)
+		}
+		if _, err := common.PendingGet(&d, p.ID); err == nil {
+			t.Errorf("expected error getting removed pending device")
+		}
+	})
+
+	t.Run("TestTokens", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		token, _, err := common.NewAPIToken("ci", []string{"a8e0f3e4-5e0f-4b4a-8c61-3f2e3f0d7d1a"}, true, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating token: %v", err)
+		}
+		if _, ok := common.TokenRemove(&d, token.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown token")
+		}
+		if err := common.TokenAdd(&d, token); err != nil {
+			t.Fatalf("unexpected error adding token: %v", err)
+		}
+		got, err := common.TokenGet(&d, token.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting token: %v", err)
+		case got.Hash != token.Hash || !got.ReadOnly || len(got.Devices) != 1 || got.Devices[0] != token.Devices[0]:
+			t.Errorf("mismatched token, actual %v expected %v", got, token)
+		}
+		list, err := common.TokenList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one token, got %v %v", list, err)
+		}
+		if err := common.TokenRemove(&d, token.ID); err != nil {
+			t.Errorf("unexpected error removing token: %v", err)
+		}
+		if _, err := common.TokenGet(&d, token.ID); err == nil {
+			t.Errorf("expected error getting removed token")
+		}
+	})
+
+	t.Run("TestRollouts", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		ro := common.NewRollout("4b1f8f50-6c3a-4c8e-9d2e-0d1b8f5a7c11", "dns", []string{"a8e0f3e4-5e0f-4b4a-8c61-3f2e3f0d7d1a", "c1d3f2a4-9b8e-4f0a-8d1c-2e3f4a5b6c7d"}, 50)
+		ro.Patch = []byte(`{"configItems":[]}`)
+		if _, ok := common.RolloutRemove(&d, ro.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown rollout")
+		}
+		if _, err := common.RolloutGet(&d, ro.ID); err == nil {
+			t.Errorf("expected error getting unknown rollout")
+		}
+		if err := common.RolloutSet(&d, ro); err != nil {
+			t.Fatalf("unexpected error adding rollout: %v", err)
+		}
+		// record progress, replacing the rollout
+		ro.Devices[0].Status = common.RolloutDeviceApplied
+		ro.Devices[0].Hash = "abc"
+		if err := common.RolloutSet(&d, ro); err != nil {
+			t.Fatalf("unexpected error setting rollout: %v", err)
+		}
+		got, err := common.RolloutGet(&d, ro.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting rollout: %v", err)
+		case got.Name != ro.Name || string(got.Patch) != string(ro.Patch) || len(got.Devices) != 2 ||
+			got.Devices[0].Status != common.RolloutDeviceApplied || got.Devices[0].Hash != "abc" || got.Devices[1].Wave != 1:
+			t.Errorf("mismatched rollout, actual %v expected %v", got, ro)
+		}
+		list, err := common.RolloutList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one rollout, got %v %v", list, err)
+		}
+		if err := common.RolloutRemove(&d, ro.ID); err != nil {
+			t.Errorf("unexpected error removing rollout: %v", err)
+		}
+		if _, err := common.RolloutGet(&d, ro.ID); err == nil {
+			t.Errorf("expected error getting removed rollout")
+		}
+	})
+
+	t.Run("TestAlertRules", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		rule := &common.AlertRule{
+			ID:      "6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c",
+			Name:    "cpu",
+			Serials: []string{"lab-*"},
+			Metric:  "dm.cpuMetric.total",
+			Op:      ">",
+			Value:   90,
+			Actions: []common.AlertAction{{Type: common.AlertWebhook, URL: "https://example.com/hook"}},
+		}
+		if _, ok := common.AlertRuleRemove(&d, rule.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown alert rule")
+		}
+		if err := common.AlertRuleAdd(&d, rule); err != nil {
+			t.Fatalf("unexpected error adding alert rule: %v", err)
+		}
+		got, err := common.AlertRuleGet(&d, rule.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting alert rule: %v", err)
+		case got.Metric != rule.Metric || got.Value != rule.Value || len(got.Serials) != 1 || len(got.Actions) != 1 || got.Actions[0] != rule.Actions[0]:
+			t.Errorf("mismatched alert rule, actual %v expected %v", got, rule)
+		}
+		list, err := common.AlertRuleList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one alert rule, got %v %v", list, err)
+		}
+		if err := common.AlertRuleRemove(&d, rule.ID); err != nil {
+			t.Errorf("unexpected error removing alert rule: %v", err)
+		}
+		if _, err := common.AlertRuleGet(&d, rule.ID); err == nil {
+			t.Errorf("expected error getting removed alert rule")
+		}
+	})
+	t.Run("TestSnapshots", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		snap := &common.ConfigSnapshot{
+			Name:    "golden",
+			Source:  "6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c",
+			Config:  json.RawMessage(`{"maintenanceMode":true}`),
+			Default: true,
+			Created: time.Now().UTC().Truncate(time.Second),
+		}
+		if _, ok := common.SnapshotRemove(&d, snap.Name).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown config snapshot")
+		}
+		if err := common.SnapshotAdd(&d, snap); err != nil {
+			t.Fatalf("unexpected error adding config snapshot: %v", err)
+		}
+		got, err := common.SnapshotGet(&d, snap.Name)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting config snapshot: %v", err)
+		case got.Name != snap.Name || string(got.Config) != string(snap.Config) || !got.Default || !got.Created.Equal(snap.Created):
+			t.Errorf("mismatched config snapshot, actual %v expected %v", got, snap)
+		}
+		list, err := common.SnapshotList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one config snapshot, got %v %v", list, err)
+		}
+		if err := common.SnapshotRemove(&d, snap.Name); err != nil {
+			t.Errorf("unexpected error removing config snapshot: %v", err)
+		}
+		if _, err := common.SnapshotGet(&d, snap.Name); err == nil {
+			t.Errorf("expected error getting removed config snapshot")
+		}
+	})
+	t.Run("TestHardwareModels", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		m := &common.HardwareModel{
+			Name:        "x1",
+			Description: "ACME X1",
+			Config:      json.RawMessage(`{"deviceIoList":[{"ptype":"PhyIoNetEth","phylabel":"eth0"}]}`),
+			Updated:     time.Now().UTC().Truncate(time.Second),
+		}
+		if _, ok := common.HardwareModelRemove(&d, m.Name).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown hardware model")
+		}
+		if err := common.HardwareModelAdd(&d, m); err != nil {
+			t.Fatalf("unexpected error adding hardware model: %v", err)
+		}
+		got, err := common.HardwareModelGet(&d, m.Name)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting hardware model: %v", err)
+		case got.Name != m.Name || got.Description != m.Description || string(got.Config) != string(m.Config) || !got.Updated.Equal(m.Updated):
+			t.Errorf("mismatched hardware model, actual %v expected %v", got, m)
+		}
+		list, err := common.HardwareModelList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one hardware model, got %v %v", list, err)
+		}
+		if err := common.HardwareModelRemove(&d, m.Name); err != nil {
+			t.Errorf("unexpected error removing hardware model: %v", err)
+		}
+		if _, err := common.HardwareModelGet(&d, m.Name); err == nil {
+			t.Errorf("expected error getting removed hardware model")
+		}
+	})
+	t.Run("TestDatastores", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		m := &common.Datastore{
+			Name:    "hub",
+			ID:      "2c0b4e91-8a57-4b0e-9c2e-3a3f1e0c2f11",
+			Config:  json.RawMessage(`{"dType":"DsContainerRegistry","fqdn":"docker://docker.io"}`),
+			Updated: time.Now().UTC().Truncate(time.Second),
+		}
+		if _, ok := common.DatastoreRemove(&d, m.Name).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown datastore")
+		}
+		if err := common.DatastoreAdd(&d, m); err != nil {
+			t.Fatalf("unexpected error adding datastore: %v", err)
+		}
+		got, err := common.DatastoreGet(&d, m.Name)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting datastore: %v", err)
+		case got.Name != m.Name || got.ID != m.ID || string(got.Config) != string(m.Config) || !got.Updated.Equal(m.Updated):
+			t.Errorf("mismatched datastore, actual %v expected %v", got, m)
+		}
+		list, err := common.DatastoreList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one datastore, got %v %v", list, err)
+		}
+		if err := common.DatastoreRemove(&d, m.Name); err != nil {
+			t.Errorf("unexpected error removing datastore: %v", err)
+		}
+		if _, err := common.DatastoreGet(&d, m.Name); err == nil {
+			t.Errorf("expected error getting removed datastore")
+		}
+	})
+	t.Run("TestImages", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		m := &common.Image{
+			Name:      "nginx",
+			ID:        "b5e2f0a1-7d35-4c8b-a5a9-1c6f4f3e2d22",
+			Datastore: "hub",
+			Config:    json.RawMessage(`{"URL":"library/nginx:1.21"}`),
+			Updated:   time.Now().UTC().Truncate(time.Second),
+		}
+		if _, ok := common.ImageRemove(&d, m.Name).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown image")
+		}
+		if err := common.ImageAdd(&d, m); err != nil {
+			t.Fatalf("unexpected error adding image: %v", err)
+		}
+		got, err := common.ImageGet(&d, m.Name)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting image: %v", err)
+		case got.Name != m.Name || got.ID != m.ID || got.Datastore != m.Datastore || string(got.Config) != string(m.Config) || !got.Updated.Equal(m.Updated):
+			t.Errorf("mismatched image, actual %v expected %v", got, m)
+		}
+		list, err := common.ImageList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one image, got %v %v", list, err)
+		}
+		if err := common.ImageRemove(&d, m.Name); err != nil {
+			t.Errorf("unexpected error removing image: %v", err)
+		}
+		if _, err := common.ImageGet(&d, m.Name); err == nil {
+			t.Errorf("expected error getting removed image")
+		}
+	})
+	t.Run("TestDeadLetters", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		dl := &common.DeadLetter{
+			ID:          "1f3b6c2e-7d4a-4c8e-9b5f-2a6d8e0c4f1a",
+			Received:    time.Now().UTC().Truncate(time.Second),
+			Method:      "POST",
+			Path:        "/api/v1/edgedevice/info",
+			ContentType: "application/x-proto-binary",
+			Kind:        common.KindInfo,
+			Cert:        []byte("-----BEGIN CERTIFICATE-----\n"),
+			Reason:      "proto: cannot parse invalid wire-format data",
+			Payload:     []byte{0xff, 0x01},
+		}
+		if _, ok := common.DeadLetterRemove(&d, dl.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown dead letter")
+		}
+		if err := common.DeadLetterAdd(&d, dl); err != nil {
+			t.Fatalf("unexpected error adding dead letter: %v", err)
+		}
+		got, err := common.DeadLetterGet(&d, dl.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting dead letter: %v", err)
+		case got.Reason != dl.Reason || string(got.Payload) != string(dl.Payload) || !got.Received.Equal(dl.Received):
+			t.Errorf("mismatched dead letter, actual %v expected %v", got, dl)
+		}
+		list, err := common.DeadLetterList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one dead letter, got %v %v", list, err)
+		}
+		if err := common.DeadLetterRemove(&d, dl.ID); err != nil {
+			t.Errorf("unexpected error removing dead letter: %v", err)
+		}
+		if _, err := common.DeadLetterGet(&d, dl.ID); err == nil {
+			t.Errorf("expected error getting removed dead letter")
+		}
+	})
+	t.Run("TestSchedules", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		at := time.Now().UTC().Truncate(time.Second)
+		s := common.NewScheduledChange("2e7b5c1a-9f3d-4a6e-8b2c-7d1f0e3a5b9c", "ntp", []string{"6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c"})
+		s.Patch = json.RawMessage(`{"maintenanceMode":true}`)
+		s.At = &at
+		if _, ok := common.ScheduleRemove(&d, s.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown scheduled change")
+		}
+		if err := common.ScheduleSet(&d, s); err != nil {
+			t.Fatalf("unexpected error setting scheduled change: %v", err)
+		}
+		got, err := common.ScheduleGet(&d, s.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting scheduled change: %v", err)
+		case got.Name != s.Name || string(got.Patch) != string(s.Patch) || got.At == nil || !got.At.Equal(at) || len(got.Devices) != 1:
+			t.Errorf("mismatched scheduled change, actual %v expected %v", got, s)
+		}
+		list, err := common.ScheduleList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one scheduled change, got %v %v", list, err)
+		}
+		if err := common.ScheduleRemove(&d, s.ID); err != nil {
+			t.Errorf("unexpected error removing scheduled change: %v", err)
+		}
+		if _, err := common.ScheduleGet(&d, s.ID); err == nil {
+			t.Errorf("expected error getting removed scheduled change")
+		}
+	})
+	t.Run("TestCanaries", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		c := common.NewCanary("5d2f8c1e-3a7b-4e9d-b6c0-1f4a8e2d7c3b", "ntp", []string{"6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c"}, 600)
+		c.Patch = json.RawMessage(`{"maintenanceMode":true}`)
+		c.Devices[0].Previous = json.RawMessage(`{"id":{"version":"1"}}`)
+		if _, ok := common.CanaryRemove(&d, c.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown canary")
+		}
+		if err := common.CanarySet(&d, c); err != nil {
+			t.Fatalf("unexpected error setting canary: %v", err)
+		}
+		got, err := common.CanaryGet(&d, c.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting canary: %v", err)
+		case got.Name != c.Name || string(got.Patch) != string(c.Patch) || got.SoakPeriod != c.SoakPeriod || len(got.Devices) != 1 || string(got.Devices[0].Previous) != string(c.Devices[0].Previous):
+			t.Errorf("mismatched canary, actual %v expected %v", got, c)
+		}
+		list, err := common.CanaryList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one canary, got %v %v", list, err)
+		}
+		if err := common.CanaryRemove(&d, c.ID); err != nil {
+			t.Errorf("unexpected error removing canary: %v", err)
+		}
+		if _, err := common.CanaryGet(&d, c.ID); err == nil {
+			t.Errorf("expected error getting removed canary")
+		}
+	})
+	t.Run("TestACME", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		if _, err := common.ACMEGet(&d, "account"); err == nil {
+			t.Errorf("expected not found error getting unknown acme data")
+		} else if _, ok := err.(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error getting unknown acme data, got %v", err)
+		}
+		for _, data := range []string{"first", "second"} {
+			if err := common.ACMESet(&d, "account", []byte(data)); err != nil {
+				t.Fatalf("unexpected error setting acme data: %v", err)
+			}
+			b, err := common.ACMEGet(&d, "account")
+			if err != nil || string(b) != data {
+				t.Errorf("mismatched acme data, actual %q expected %q: %v", b, data, err)
+			}
+		}
+	})
+
+	t.Run("TestTombstones", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		tombstone := &common.Tombstone{
+			UUID:    "6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c",
+			Deleted: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+			Expires: time.Date(2021, 6, 8, 0, 0, 0, 0, time.UTC),
+			Actor:   "token:abc",
+		}
+		if _, ok := common.TombstoneRemove(&d, tombstone.UUID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown tombstone")
+		}
+		if err := common.TombstoneAdd(&d, tombstone); err != nil {
+			t.Fatalf("unexpected error adding tombstone: %v", err)
+		}
+		got, err := common.TombstoneGet(&d, tombstone.UUID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting tombstone: %v", err)
+		case *got != *tombstone:
+			t.Errorf("mismatched tombstone, actual %v expected %v", got, tombstone)
+		}
+		list, err := common.TombstoneList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one tombstone, got %v %v", list, err)
+		}
+		if err := common.TombstoneRemove(&d, tombstone.UUID); err != nil {
+			t.Errorf("unexpected error removing tombstone: %v", err)
+		}
+		if _, err := common.TombstoneGet(&d, tombstone.UUID); err == nil {
+			t.Errorf("expected error getting removed tombstone")
+		}
+	})
+
+	t.Run("TestRevocations", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		revocation := &common.Revocation{
+			Fingerprint:  "9b2f4c6a8e0d1f3b5a7c9e1d3f5b7a9c2e4d6f8a0b1c3e5d7f9a2b4c6e8d0f1a",
+			Kind:         common.RevokedDevice,
+			Subject:      "dev-1",
+			SerialNumber: "1f2e3d",
+			Reason:       "stolen",
+			Revoked:      time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+			Actor:        "token:abc",
+		}
+		if _, ok := common.RevocationRemove(&d, revocation.Fingerprint).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown revocation")
+		}
+		if err := common.RevocationAdd(&d, revocation); err != nil {
+			t.Fatalf("unexpected error adding revocation: %v", err)
+		}
+		got, err := common.RevocationGet(&d, revocation.Fingerprint)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting revocation: %v", err)
+		case *got != *revocation:
+			t.Errorf("mismatched revocation, actual %v expected %v", got, revocation)
+		}
+		list, err := common.RevocationList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one revocation, got %v %v", list, err)
+		}
+		if err := common.RevocationRemove(&d, revocation.Fingerprint); err != nil {
+			t.Errorf("unexpected error removing revocation: %v", err)
+		}
+		if _, err := common.RevocationGet(&d, revocation.Fingerprint); err == nil {
+			t.Errorf("expected error getting removed revocation")
+		}
+	})
+
+	t.Run("TestOnboardRegister", func(t *testing.T) {
+		tests := []struct {
+			validCert bool
+			serial    []string
+			used      bool
+			err       error
+		}{
+			{false, nil, false, fmt.Errorf("empty nil certificate")},
+			{true, nil, false, nil},
+			{true, nil, true, nil},
+			{true, []string{}, false, nil},
+			{true, []string{}, true, nil},
+			{true, []string{"abc", "def"}, false, nil},
+			{true, []string{"abc", "def"}, true, nil},
+		}
+		for i, tt := range tests {
+			var (
+				cert    *x509.Certificate
+				certStr string
+				err     error
+			)
+
+			// reset with each test
+			// make a temporary directory with which to work
+			dir, err := ioutil.TempDir("", "adam-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			d := DeviceManager{
+				databasePath: dir,
+			}
+
+			if tt.validCert {
+				cert, _, err = ax.GenerateCertAndKey("onboard", "")
+				if err != nil {
+					t.Fatalf("%d: error generating onboard cert and key: %v", i, err)
+				}
+				certStr = string(cert.Raw)
+			}
+			if tt.used {
+				// store in cache and on disk
+				if d.onboardCerts == nil {
+					d.onboardCerts = map[string]map[string]bool{}
+				}
+				d.onboardCerts[certStr] = map[string]bool{}
+
+				onboardDir := path.Join(dir, "onboard")
+				err := saveOnboardCertAndSerials(onboardDir, cert, tt.serial)
+				if err != nil {
+					t.Fatalf("%d: error saving onboard directory: %v", i, err)
+				}
+			}
+			err = d.OnboardRegister(cert, tt.serial)
+			switch {
+			case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
+				t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
+			case err == nil && d.onboardCerts[certStr] == nil:
+				t.Errorf("%d: onboardCerts are nil", i)
+			default:
+				err := common.CompareStringSliceMap(tt.serial, d.onboardCerts[certStr])
+				if err != nil {
+					t.Errorf("%d: mismatched serials", i)
+					t.Errorf("%v", err)
+				}
+			}
+		}
+	})
+
+	t.Run("TestMigrate", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		u, _ := uuid.NewV4()
+		logsPath := path.Join(d.getDevicePath(u), logDir)
+		if err := os.MkdirAll(logsPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		// files from before rotation, one record each
+		legacy := []string{"2021-01-01T00:00:00.000", "2021-01-01T00:00:01.000"}
+		for i, name := range legacy {
+			if err := ioutil.WriteFile(path.Join(logsPath, name), []byte(fmt.Sprintf(`{"n":%d}`, i)), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m := newManagedFile(logsPath, logDir, 0)
+		read := func() string {
+			r, err := m.Reader()
+			if err != nil {
+				t.Fatalf("unexpected error getting reader: %v", err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error reading: %v", err)
+			}
+			return string(b)
+		}
+		expected := read()
+
+		from, to, err := d.Migrate()
+		if err != nil {
+			t.Fatalf("unexpected error migrating: %v", err)
+		}
+		latest := common.LatestSchema(d.migrations())
+		if from != 0 || to != latest {
+			t.Errorf("mismatched versions migrated, actual %d to %d expected 0 to %d", from, to, latest)
+		}
+		for _, name := range legacy {
+			if found, _ := exists(path.Join(logsPath, name)); found {
+				t.Errorf("legacy file %s not removed", name)
+			}
+		}
+		if actual := read(); actual != expected {
+			t.Errorf("mismatched records after migrating, actual %q expected %q", actual, expected)
+		}
+		if current, _, err := d.SchemaVersion(); err != nil || current != latest {
+			t.Errorf("mismatched schema version, actual %d expected %d: %v", current, latest, err)
+		}
+
+		// run again, nothing to do
+		if from, to, err := d.Migrate(); err != nil || from != latest || to != latest {
+			t.Errorf("expected no migration, got %d to %d: %v", from, to, err)
+		}
+		// a database a newer release upgraded is refused
+		if err := ioutil.WriteFile(path.Join(dir, schemaFilename), []byte(fmt.Sprint(latest+1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := d.Migrate(); err == nil {
+			t.Errorf("expected error migrating a newer schema version")
+		}
+	})
+
+	t.Run("TestReencrypt", func(t *testing.T) {
+		// make a temporary directory with which to work
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{
+			databasePath: dir,
+		}
+		// written before encryption was enabled
+		if err := common.ACMESet(&d, "account", []byte("key")); err != nil {
+			t.Fatalf("unexpected error setting acme data: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		quotas := path.Join(d.getDevicePath(u), deviceQuotasFilename)
+		if err := os.MkdirAll(path.Dir(quotas), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(quotas, []byte(`{}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		wrapper, err := common.NewAESKeyWrapper(bytes.Repeat([]byte{0x42}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.SetEncryptor(common.NewEncryptor(wrapper, true))
+		if _, err := common.ACMEGet(&d, "account"); err == nil {
+			t.Errorf("expected error reading a plaintext value with a strict encryptor")
+		}
+		n, err := d.Reencrypt()
+		if err != nil || n != 1 {
+			t.Fatalf("expected 1 value reencrypted, actual %d: %v", n, err)
+		}
+		if b, err := common.ACMEGet(&d, "account"); err != nil || string(b) != "key" {
+			t.Errorf("mismatched acme data, actual %q expected %q: %v", b, "key", err)
+		}
+		if b, _ := ioutil.ReadFile(quotas); string(b) != `{}` {
+			t.Errorf("expected the quotas left in plaintext, actual %q", b)
+		}
+		if n, err := d.Reencrypt(); err != nil || n != 0 {
+			t.Errorf("expected nothing to reencrypt, actual %d: %v", n, err)
+		}
+
+		// a value moved to another record does not decrypt as its value
+		b, err := ioutil.ReadFile(path.Join(dir, acmeDir, "account"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, acmeDir, "cert"), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := common.ACMEGet(&d, "cert"); err == nil {
+			t.Errorf("expected error reading a value moved from another record")
+		}
+	})
+
+	t.Run("TestConcurrency", func(t *testing.T) {
+		// run with -race; requests for different devices are handled at once, while the cache is refreshed
+		dir, err := ioutil.TempDir("", "adam-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := DeviceManager{}
+		if _, err := d.Init(dir, common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		d.SetCacheTimeout(0)
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < cap(errs); i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				certB, _, err := ax.Generate(fmt.Sprintf("concurrent-%d", i), "")
+				if err != nil {
+					errs <- err
+					return
+				}
+				cert, err := x509.ParseCertificate(certB)
+				if err != nil {
+					errs <- err
+					return
+				}
+				u, _ := uuid.NewV4()
+				if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+					errs <- fmt.Errorf("error registering device: %v", err)
+					return
+				}
+				for j := 0; j < 10; j++ {
+					if got, err := d.DeviceCheckCert(cert); err != nil || got == nil || *got != u {
+						errs <- fmt.Errorf("mismatched device for certificate, actual %v expected %v: %v", got, u, err)
+						return
+					}
+					if err := d.WriteLogs(u, []byte(`{"content":"log"}`)); err != nil {
+						errs <- fmt.Errorf("error writing logs: %v", err)
+						return
+					}
+					if _, err := d.DeviceList(); err != nil {
+						errs <- fmt.Errorf("error listing devices: %v", err)
+						return
+					}
+					if _, err := d.GetLogsReader(u); err != nil {
+						errs <- fmt.Errorf("error getting logs reader: %v", err)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+		if ids, _ := d.DeviceList(); len(ids) != cap(errs) {
+			t.Errorf("mismatched number of devices, actual %d expected %d", len(ids), cap(errs))
 		}
 	})
 }
@@ -0,0 +1,349 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	journalDir    = "journal" // <seq>.log segments of the write-ahead journal, in the root of the database
+	journalSuffix = ".log"
+	// journalCheckpoint the size of a segment past which the files written to are synced and a new segment started
+	journalCheckpoint = 16 * MB
+	// journalHeader the size of the header of a record: its length and its CRC32, both big-endian
+	journalHeader = 8
+)
+
+// journalRecord a record of the journal: the bytes appended to the current file of a ManagedFile at an offset, or
+// a mark that the file was rotated, all records before it being in the rotated file, synced
+type journalRecord struct {
+	// Path the current file, relative to the root of the database
+	Path    string `json:"path"`
+	Offset  int64  `json:"offset,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+	Rotated bool   `json:"rotated,omitempty"`
+}
+
+// journal a write-ahead journal of the telemetry of devices. Each record is appended to the journal, and synced,
+// before it is appended to its ManagedFile, so that one accepted, and acknowledged to the device, is not lost should
+// adam die before the file is synced. Once a segment grows past journalCheckpoint, a checkpoint syncs the files
+// written to and removes the segments before. On startup, recover appends to the files what they are missing
+type journal struct {
+	root string
+	dir  string
+	mu   sync.Mutex
+	seq  uint64
+	file *os.File
+	size int64
+	// dirty the files written to since the last checkpoint
+	dirty         map[*ManagedFile]bool
+	checkpointing bool
+}
+
+// openJournal open the journal of the database in root, recovering the records the files are missing first
+func openJournal(root string) (*journal, error) {
+	j := &journal{root: root, dir: path.Join(root, journalDir), dirty: map[*ManagedFile]bool{}}
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create journal %s: %v", j.dir, err)
+	}
+	recovered, err := j.recover()
+	if err != nil {
+		return nil, err
+	}
+	if recovered > 0 {
+		log.Printf("recovered %d records from journal %s", recovered, j.dir)
+	}
+	if err := j.removeSegments(j.seq); err != nil {
+		return nil, err
+	}
+	if err := j.openSegment(j.seq + 1); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// segments get the sequence numbers of the segments of the journal, oldest first
+func (j *journal) segments() ([]uint64, error) {
+	fis, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read journal %s: %v", j.dir, err)
+	}
+	var seqs []uint64
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(name, journalSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, journalSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, k int) bool { return seqs[i] < seqs[k] })
+	return seqs, nil
+}
+
+func (j *journal) segmentPath(seq uint64) string {
+	return path.Join(j.dir, fmt.Sprintf("%020d%s", seq, journalSuffix))
+}
+
+// openSegment start the segment seq, closing the current one
+func (j *journal) openSegment(seq uint64) error {
+	p := j.segmentPath(seq)
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open journal segment %s: %v", p, err)
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, j.seq, j.size = f, seq, 0
+	return nil
+}
+
+// removeSegments remove the segments up to seq
+func (j *journal) removeSegments(seq uint64) error {
+	seqs, err := j.segments()
+	if err != nil {
+		return err
+	}
+	for _, s := range seqs {
+		if s > seq {
+			break
+		}
+		if err := os.Remove(j.segmentPath(s)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove journal segment: %v", err)
+		}
+	}
+	return nil
+}
+
+// append write a record of m to the journal, synced. m.mu is held, so a checkpoint this calls for runs apart
+func (j *journal) append(m *ManagedFile, rec journalRecord) error {
+	p, err := filepath.Rel(j.root, path.Join(m.dir, m.name))
+	if err != nil {
+		return fmt.Errorf("could not journal %s: %v", m.name, err)
+	}
+	rec.Path = filepath.ToSlash(p)
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("could not journal %s: %v", p, err)
+	}
+	b := make([]byte, journalHeader, journalHeader+len(body))
+	binary.BigEndian.PutUint32(b, uint32(len(body)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(body))
+	b = append(b, body...)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// written to again once closed
+	if j.file == nil {
+		if err := j.openSegment(j.seq + 1); err != nil {
+			return err
+		}
+	}
+	if _, err := j.file.Write(b); err != nil {
+		return fmt.Errorf("could not write journal: %v", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync journal: %v", err)
+	}
+	j.size += int64(len(b))
+	j.dirty[m] = true
+	if j.size > journalCheckpoint && !j.checkpointing {
+		j.checkpointing = true
+		go func() {
+			if err := j.checkpoint(); err != nil {
+				log.Printf("journal checkpoint failed: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// checkpoint start a new segment, sync the files written to in the ones before, and remove those. The files are
+// synced without holding the journal, so that records keep being appended meanwhile
+func (j *journal) checkpoint() error {
+	j.mu.Lock()
+	last, dirty := j.seq, j.dirty
+	err := j.openSegment(last + 1)
+	if err == nil {
+		j.dirty = map[*ManagedFile]bool{}
+	}
+	j.mu.Unlock()
+	defer func() {
+		j.mu.Lock()
+		j.checkpointing = false
+		j.mu.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+	for m := range dirty {
+		if err := m.sync(); err != nil {
+			// synced with the next checkpoint, the segments being kept until then
+			j.mu.Lock()
+			for m := range dirty {
+				j.dirty[m] = true
+			}
+			j.mu.Unlock()
+			return err
+		}
+	}
+	return j.removeSegments(last)
+}
+
+// close the current segment, once the files are closed, and so synced, and remove all segments
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	j.file.Close()
+	j.file = nil
+	j.dirty = map[*ManagedFile]bool{}
+	return j.removeSegments(j.seq)
+}
+
+// recover append to the files the records of the journal they are missing, returning how many were. The records of
+// a segment are read up to the first torn or corrupt one, written when adam died
+func (j *journal) recover() (int, error) {
+	seqs, err := j.segments()
+	if err != nil {
+		return 0, err
+	}
+	records := map[string][]journalRecord{}
+	for _, seq := range seqs {
+		j.seq = seq
+		err := j.readSegment(j.segmentPath(seq), func(rec journalRecord) {
+			if rec.Rotated {
+				// the records before are in the rotated file, synced
+				delete(records, rec.Path)
+				return
+			}
+			records[rec.Path] = append(records[rec.Path], rec)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	paths := make([]string, 0, len(records))
+	for p := range records {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var recovered int
+	for _, p := range paths {
+		n, err := j.recoverFile(p, records[p])
+		if err != nil {
+			return recovered, err
+		}
+		recovered += n
+	}
+	return recovered, nil
+}
+
+// readSegment call f with each record of the segment at p, up to the first torn or corrupt one
+func (j *journal) readSegment(p string, f func(journalRecord)) error {
+	in, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("could not open journal segment %s: %v", p, err)
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+	header := make([]byte, journalHeader)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+			return nil
+		}
+		var rec journalRecord
+		if err := json.Unmarshal(body, &rec); err != nil {
+			return nil
+		}
+		f(rec)
+	}
+}
+
+// recoverFile append to the file at p, relative to the root, the records it is missing, returning how many were.
+// A record already at its offset is skipped; from one the file is missing or has partly, the file is truncated and
+// the records appended. The index of a file changed is removed, to be rebuilt when it is next opened
+func (j *journal) recoverFile(p string, records []journalRecord) (int, error) {
+	parts := strings.Split(p, "/")
+	if len(parts) < 3 || strings.Contains(p, "..") {
+		return 0, nil
+	}
+	// the device may have been removed since
+	if found, _ := exists(path.Join(j.root, parts[0], parts[1])); !found {
+		return 0, nil
+	}
+	full := path.Join(j.root, p)
+	if err := os.MkdirAll(path.Dir(full), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directory %s: %v", path.Dir(full), err)
+	}
+	f, err := os.OpenFile(full, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file %s: %v", full, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file %s: %v", full, err)
+	}
+	size := fi.Size()
+	var recovered int
+	for _, rec := range records {
+		if size >= rec.Offset+int64(len(rec.Data)) {
+			b := make([]byte, len(rec.Data))
+			if _, err := f.ReadAt(b, rec.Offset); err == nil && bytes.Equal(b, rec.Data) {
+				continue
+			}
+		}
+		if size > rec.Offset {
+			if err := f.Truncate(rec.Offset); err != nil {
+				return recovered, fmt.Errorf("failed to truncate %s: %v", full, err)
+			}
+			size = rec.Offset
+		}
+		if _, err := f.WriteAt(rec.Data, size); err != nil {
+			return recovered, fmt.Errorf("failed to recover %s: %v", full, err)
+		}
+		size += int64(len(rec.Data))
+		recovered++
+	}
+	if recovered == 0 {
+		return 0, nil
+	}
+	if err := f.Sync(); err != nil {
+		return recovered, fmt.Errorf("failed to sync %s: %v", full, err)
+	}
+	if err := os.Remove(indexPath(full)); err != nil && !os.IsNotExist(err) {
+		return recovered, fmt.Errorf("failed to remove %s: %v", indexPath(full), err)
+	}
+	return recovered, nil
+}
@@ -0,0 +1,333 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// newLogsFile create the ManagedFile of the logs of a device in dir, indexed by source
+func newLogsFile(dir string, maxSize int) *ManagedFile {
+	m := newManagedFile(dir, logDir, maxSize)
+	m.index = common.LogSource
+	return m
+}
+
+// indexPath get the path of the sidecar index of a file, e.g. logs.json.idx for logs.json, logs.json.1.idx for
+// logs.json.1.gz. The index has a line "<offset> <source>" for each record with a source, the offset being that of
+// the record in the file uncompressed
+func indexPath(p string) string {
+	return strings.TrimSuffix(p, gzSuffix) + idxSuffix
+}
+
+// openIndex open the index of the current file for appending, if records are indexed. One written before they were
+// is indexed first
+func (m *ManagedFile) openIndex() error {
+	if m.index == nil {
+		return nil
+	}
+	p := indexPath(path.Join(m.dir, m.name))
+	found, _ := exists(p)
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open index %s: %v", p, err)
+	}
+	m.idx = f
+	if found || m.currentSize == 0 {
+		return nil
+	}
+	return m.reindex()
+}
+
+// reindex index the records of the current file
+func (m *ManagedFile) reindex() error {
+	p := path.Join(m.dir, m.name)
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", p, err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if err := m.indexAt(offset, bytes.TrimRight(line, "\n")); err != nil {
+				return err
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to index %s: %v", p, err)
+		}
+	}
+}
+
+// indexRecord index a record about to be appended to the current file
+func (m *ManagedFile) indexRecord(b []byte) error {
+	if m.idx == nil {
+		return nil
+	}
+	return m.indexAt(m.currentSize, b)
+}
+
+// indexAt index a record at an offset of the current file, unless it has no source
+func (m *ManagedFile) indexAt(offset int64, b []byte) error {
+	source := m.index(b)
+	if source == "" || strings.ContainsAny(source, "\n") {
+		return nil
+	}
+	if _, err := fmt.Fprintf(m.idx, "%d %s\n", offset, source); err != nil {
+		return fmt.Errorf("failed to write index: %v", err)
+	}
+	return nil
+}
+
+// readIndex read the index of a file, the offsets of its records by source; false if it has none, as one written
+// before records were indexed
+func readIndex(p string) (map[string][]int64, bool, error) {
+	b, err := ioutil.ReadFile(indexPath(p))
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, false, nil
+	case err != nil:
+		return nil, false, fmt.Errorf("failed to read index %s: %v", indexPath(p), err)
+	}
+	offsets := map[string][]int64{}
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		offset, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		offsets[parts[1]] = append(offsets[parts[1]], offset)
+	}
+	return offsets, true, nil
+}
+
+// indexedFiles the files of the records, oldest first, but those from before records were appended to rotated
+// files, which are never indexed
+func (m *ManagedFile) indexedFiles() []string {
+	var files []string
+	for i := fileSplit; i > 0; i-- {
+		files = append(files, m.rotatedPath(i))
+	}
+	return append(files, path.Join(m.dir, m.name))
+}
+
+// legacyReader read the files from before records were appended to rotated files, one or more records per file
+func (m *ManagedFile) legacyReader() (*RotatedReader, error) {
+	legacy, err := m.legacyFiles()
+	if err != nil {
+		return nil, err
+	}
+	r := &RotatedReader{Files: legacy, LineFeed: map[string]bool{}}
+	for _, p := range legacy {
+		r.LineFeed[p] = true
+	}
+	return r, nil
+}
+
+// SourceReader read the records of one source, through the indexes of the files; those without one are scanned
+func (m *ManagedFile) SourceReader(source string) (io.Reader, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	legacy, err := m.legacyReader()
+	if err != nil {
+		return nil, err
+	}
+	readers := []io.Reader{common.NewLogSourceFilter(legacy, source)}
+	for _, p := range m.indexedFiles() {
+		offsets, indexed, err := readIndex(p)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !indexed:
+			readers = append(readers, common.NewLogSourceFilter(&RotatedReader{Files: []string{p}}, source))
+		case len(offsets[source]) > 0:
+			readers = append(readers, &indexedReader{path: p, offsets: offsets[source]})
+		}
+	}
+	return io.MultiReader(readers...), nil
+}
+
+// Sources count the records of each source, through the indexes of the files; those without one are scanned
+func (m *ManagedFile) Sources() (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := map[string]int64{}
+	count := func(r io.Reader) error {
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadBytes('\n')
+			if source := m.index(bytes.TrimRight(line, "\n")); source != "" {
+				counts[source]++
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	legacy, err := m.legacyReader()
+	if err != nil {
+		return nil, err
+	}
+	if err := count(legacy); err != nil {
+		return nil, fmt.Errorf("failed to read the records of %s: %v", m.dir, err)
+	}
+	for _, p := range m.indexedFiles() {
+		offsets, indexed, err := readIndex(p)
+		if err != nil {
+			return nil, err
+		}
+		if !indexed {
+			if err := count(&RotatedReader{Files: []string{p}}); err != nil {
+				return nil, fmt.Errorf("failed to read the records of %s: %v", p, err)
+			}
+			continue
+		}
+		for source, o := range offsets {
+			counts[source] += int64(len(o))
+		}
+	}
+	return counts, nil
+}
+
+// indexedReader reads the records at offsets of a file, decompressing it if it ends in .gz. A file removed by
+// rotation since it was indexed reads as empty
+type indexedReader struct {
+	path    string
+	offsets []int64
+	r       *bufio.Reader
+	closers []io.Closer
+	pos     int64
+	buf     bytes.Buffer
+}
+
+// Read the next chunk of the records
+func (r *indexedReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		_, line, ok, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, io.EOF
+		}
+		r.buf.Write(line)
+		r.buf.WriteByte('\n')
+	}
+	return r.buf.Read(p)
+}
+
+// next the offset of the next record and the record, without its newline; false once there are no more
+func (r *indexedReader) next() (int64, []byte, bool, error) {
+	if r.r == nil && r.offsets != nil {
+		if err := r.open(); err != nil {
+			return 0, nil, false, err
+		}
+	}
+	for len(r.offsets) > 0 && r.r != nil {
+		offset := r.offsets[0]
+		r.offsets = r.offsets[1:]
+		if offset < r.pos {
+			continue
+		}
+		skipped, err := r.r.Discard(int(offset - r.pos))
+		r.pos += int64(skipped)
+		if err != nil {
+			break
+		}
+		line, err := r.r.ReadBytes('\n')
+		r.pos += int64(len(line))
+		if err != nil {
+			r.close()
+		}
+		if len(line) > 0 {
+			return offset, bytes.TrimRight(line, "\n"), true, nil
+		}
+	}
+	r.close()
+	return 0, nil, false, nil
+}
+
+// open the file, leaving the reader empty if it no longer exists
+func (r *indexedReader) open() error {
+	f, err := os.Open(r.path)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		r.offsets = nil
+		return nil
+	case err != nil:
+		return fmt.Errorf("unable to open %s: %v", r.path, err)
+	}
+	r.closers = append(r.closers, f)
+	var in io.Reader = f
+	if strings.HasSuffix(r.path, gzSuffix) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			r.close()
+			return fmt.Errorf("unable to decompress %s: %v", r.path, err)
+		}
+		r.closers = append(r.closers, gz)
+		in = gz
+	}
+	r.r = bufio.NewReader(in)
+	return nil
+}
+
+// close the file
+func (r *indexedReader) close() {
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		r.closers[i].Close()
+	}
+	r.closers = nil
+	r.r = nil
+	r.offsets = nil
+}
+
+// GetLogSources get the sources of the logs of a device, with how many entries of each are kept
+func (d *DeviceManager) GetLogSources(u uuid.UUID) (map[string]int64, error) {
+	m, err := d.logsFile(u)
+	if err != nil {
+		return nil, err
+	}
+	return m.Sources()
+}
+
+// GetLogsSourceReader get the logs of a device from one source, oldest first
+func (d *DeviceManager) GetLogsSourceReader(u uuid.UUID, source string) (io.Reader, error) {
+	m, err := d.logsFile(u)
+	if err != nil {
+		return nil, err
+	}
+	return m.SourceReader(source)
+}
+
+// logsFile get the ManagedFile of the logs of a device
+func (d *DeviceManager) logsFile(u uuid.UUID) (*ManagedFile, error) {
+	return d.streamFile(u, func(dev common.DeviceStorage) common.BigData { return dev.Logs })
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package file
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// schemaFilename file holding the version of the layout of the database, in its root, see migrations()
+const schemaFilename = "schema-version"
+
+// migrations the changes of the layout of the database, oldest first
+func (d *DeviceManager) migrations() []common.Migration {
+	return []common.Migration{
+		{Version: 1, Description: "records of one file each appended to rotated files", Apply: d.migrateLegacyFiles},
+	}
+}
+
+// SchemaVersion get the version of the layout of the database, 0 if it predates versions, and the latest one
+func (d *DeviceManager) SchemaVersion() (int, int, error) {
+	v, err := d.schemaVersion()
+	return v, common.LatestSchema(d.migrations()), err
+}
+
+// Migrate upgrade the database to the latest version of its layout
+func (d *DeviceManager) Migrate() (int, int, error) {
+	from, err := d.schemaVersion()
+	if err != nil {
+		return from, from, err
+	}
+	to, err := common.Migrate(from, d.migrations(), func(v int) error {
+		return ioutil.WriteFile(path.Join(d.databasePath, schemaFilename), []byte(strconv.Itoa(v)), 0644)
+	})
+	return from, to, err
+}
+
+// schemaVersion read the version of the layout of the database, 0 if none is recorded
+func (d *DeviceManager) schemaVersion() (int, error) {
+	p := path.Join(d.databasePath, schemaFilename)
+	b, err := ioutil.ReadFile(p)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("unable to read schema version %s: %v", p, err)
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version in %s: %v", p, err)
+	}
+	return v, nil
+}
+
+// migrateLegacyFiles fold the files of each device from before records were appended to rotated files, one or more
+// records per file, into the oldest rotated file, so that they are rotated away with the others
+func (d *DeviceManager) migrateLegacyFiles() error {
+	fis, err := ioutil.ReadDir(path.Join(d.databasePath, deviceDir))
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("could not read directory %s: %v", deviceDir, err)
+	}
+	for _, fi := range fis {
+		u, err := uuid.FromString(fi.Name())
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		devicePath := d.getDevicePath(u)
+		files := []*ManagedFile{
+			newManagedFile(path.Join(devicePath, logDir), logDir, 0),
+			newManagedFile(path.Join(devicePath, infoDir), infoDir, 0),
+			newManagedFile(path.Join(devicePath, metricsDir), metricsDir, 0),
+			newManagedFile(path.Join(devicePath, requestsDir), requestsDir, 0),
+		}
+		apps, err := ioutil.ReadDir(devicePath)
+		if err != nil {
+			return fmt.Errorf("could not read directory %s: %v", devicePath, err)
+		}
+		for _, app := range apps {
+			if instanceID, err := uuid.FromString(app.Name()); err == nil && app.IsDir() {
+				files = append(files, newManagedFile(d.getAppPath(u, instanceID), logDir, 0))
+			}
+		}
+		for _, m := range files {
+			if err := m.foldLegacy(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// foldLegacy compress the files from before records were appended to rotated files into the oldest rotated file,
+// one record per line, and remove them. If that one is in use, they are left to be removed with it
+func (m *ManagedFile) foldLegacy() error {
+	legacy, err := m.legacyFiles()
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+	oldest := m.rotatedPath(fileSplit)
+	if found, _ := exists(oldest); found {
+		return nil
+	}
+	// read them as readers do, so that the records are the same
+	r := &RotatedReader{Files: legacy, LineFeed: map[string]bool{}}
+	for _, p := range legacy {
+		r.LineFeed[p] = true
+	}
+	folded := path.Join(m.dir, m.name+tmpSuffix)
+	f, err := os.Create(folded)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", folded, err)
+	}
+	_, err = io.Copy(f, r)
+	r.close()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = compressFile(folded, oldest)
+	}
+	os.Remove(folded)
+	if err != nil {
+		return fmt.Errorf("failed to fold the legacy files of %s: %v", m.dir, err)
+	}
+	for _, p := range legacy {
+		if err := os.Remove(p); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", p, err)
+		}
+	}
+	return nil
+}
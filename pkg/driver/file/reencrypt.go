@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+)
+
+// Reencrypt encrypt anew the files written in plaintext, or encrypted by older releases without the key of their
+// record, with the encryptor set: those of onboarding certificates, those of devices, other than their quotas and
+// streams, and the records of every kind. Returns how many were
+func (d *DeviceManager) Reencrypt() (int, error) {
+	if d.encryptor == nil {
+		return 0, nil
+	}
+	var dirs []string
+	for _, parent := range []string{onboardDir, deviceDir} {
+		fis, err := ioutil.ReadDir(path.Join(d.databasePath, parent))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("unable to list %s: %v", parent, err)
+		}
+		for _, fi := range fis {
+			if fi.IsDir() {
+				dirs = append(dirs, path.Join(d.databasePath, parent, fi.Name()))
+			}
+		}
+	}
+	for _, kind := range common.RecordKinds {
+		dirs = append(dirs, path.Join(d.databasePath, recordFiles[kind].dir))
+	}
+	n := 0
+	for _, dir := range dirs {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return n, fmt.Errorf("unable to list %s: %v", dir, err)
+		}
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() || fi.Name() == deviceQuotasFilename || strings.HasSuffix(fi.Name(), ".new") {
+				continue
+			}
+			p := path.Join(dir, fi.Name())
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return n, fmt.Errorf("unable to read %s: %v", p, err)
+			}
+			v, changed, err := d.encryptor.Reencrypt(b, d.recordKey(p))
+			if err != nil {
+				return n, fmt.Errorf("unable to reencrypt %s: %v", p, err)
+			}
+			if !changed {
+				continue
+			}
+			// renamed over it, so that it is never half written
+			if err := ioutil.WriteFile(p+".new", v, fi.Mode().Perm()); err != nil {
+				return n, fmt.Errorf("unable to write %s: %v", p, err)
+			}
+			if err := os.Rename(p+".new", p); err != nil {
+				os.Remove(p + ".new")
+				return n, fmt.Errorf("unable to replace %s: %v", p, err)
+			}
+			n++
+		}
+	}
+	return n, nil
+}
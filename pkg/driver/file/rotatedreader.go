@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// RotatedReader reads a list of files one after the other, decompressing those ending in .gz. Files are opened as
+// they are read, and those that no longer exist then are skipped, unless Open opened them all first
+type RotatedReader struct {
+	// Files paths of the files to read, oldest first
+	Files []string
+	// LineFeed files to follow with a linefeed "\n" (0x0a), for those written before records were newline-delimited
+	LineFeed map[string]bool
+	// opened the files opened by Open not read yet, by path
+	opened  map[string]*os.File
+	current io.Reader
+	closers []io.Closer
+}
+
+// Open open all the files of the list at once, so that they are read as they are now, even if rotation renames or
+// removes them while they are read. Files that do not exist are dropped from the list
+func (r *RotatedReader) Open() error {
+	var files []string
+	opened := map[string]*os.File{}
+	for _, p := range r.Files {
+		f, err := os.Open(p)
+		switch {
+		case err != nil && os.IsNotExist(err):
+			continue
+		case err != nil:
+			for _, f := range opened {
+				f.Close()
+			}
+			return fmt.Errorf("unable to open %s: %v", p, err)
+		}
+		files = append(files, p)
+		opened[p] = f
+	}
+	r.Files, r.opened = files, opened
+	return nil
+}
+
+// Read the next chunk of bytes
+func (r *RotatedReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.Files) == 0 {
+				return 0, io.EOF
+			}
+			if err := r.nextFile(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.close()
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// nextFile open the next file in the list, unless Open did. If it no longer exists, current is left empty
+func (r *RotatedReader) nextFile() error {
+	p := r.Files[0]
+	r.Files = r.Files[1:]
+	f, ok := r.opened[p]
+	if ok {
+		delete(r.opened, p)
+	} else {
+		var err error
+		f, err = os.Open(p)
+		switch {
+		case err != nil && os.IsNotExist(err):
+			return nil
+		case err != nil:
+			return fmt.Errorf("unable to open %s: %v", p, err)
+		}
+	}
+	r.closers = append(r.closers, f)
+	r.current = f
+	if strings.HasSuffix(p, gzSuffix) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			r.close()
+			return fmt.Errorf("unable to decompress %s: %v", p, err)
+		}
+		r.closers = append(r.closers, gz)
+		r.current = gz
+	}
+	if r.LineFeed[p] {
+		r.current = io.MultiReader(r.current, bytes.NewReader([]byte{0x0a}))
+	}
+	return nil
+}
+
+// close the current file
+func (r *RotatedReader) close() {
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		r.closers[i].Close()
+	}
+	r.closers = nil
+	r.current = nil
+}
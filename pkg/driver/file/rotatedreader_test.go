@@ -0,0 +1,136 @@
+package file_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/lf-edge/adam/pkg/driver/file"
+)
+
+// RotatedReader reads a list of files in order, decompressing .gz ones
+func TestRotatedReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatedreader_test")
+	if err != nil {
+		t.Fatalf("failure to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("compressed\n"))
+	w.Close()
+	files := map[string][]byte{
+		"legacy":    []byte("legacy"),
+		"a.json.gz": gz.Bytes(),
+		"a.json":    []byte("current\n"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("failure to write temporary file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		files    []string
+		lineFeed []string
+		expected string
+	}{
+		{"empty", nil, nil, ""},
+		{"plain", []string{"a.json"}, nil, "current\n"},
+		{"compressed", []string{"a.json.gz", "a.json"}, nil, "compressed\ncurrent\n"},
+		{"linefeed", []string{"legacy", "a.json"}, []string{"legacy"}, "legacy\ncurrent\n"},
+		{"missing", []string{"gone.json.gz", "a.json"}, nil, "current\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &file.RotatedReader{LineFeed: map[string]bool{}}
+			for _, f := range tt.files {
+				r.Files = append(r.Files, path.Join(dir, f))
+			}
+			for _, f := range tt.lineFeed {
+				r.LineFeed[path.Join(dir, f)] = true
+			}
+			// a small buffer so that reads span files
+			b, err := ioutil.ReadAll(&smallReader{r: r})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(b) != tt.expected {
+				t.Errorf("mismatched content, actual %q expected %q", b, tt.expected)
+			}
+		})
+	}
+}
+
+// RotatedReader opened at once reads the files as they were, even once rotation renamed or removed them
+func TestRotatedReaderOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatedreader_test")
+	if err != nil {
+		t.Fatalf("failure to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("older\n"))
+	w.Close()
+	files := map[string][]byte{
+		"a.json.1.gz": gz.Bytes(),
+		"a.json":      []byte("current\n"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("failure to write temporary file: %v", err)
+		}
+	}
+	r := &file.RotatedReader{}
+	for _, f := range []string{"a.json.2.gz", "a.json.1.gz", "a.json"} {
+		r.Files = append(r.Files, path.Join(dir, f))
+	}
+	if err := r.Open(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// rotate: the rotated file shifts up, the current one is compressed into its place and a new one started
+	if err := os.Rename(path.Join(dir, "a.json.1.gz"), path.Join(dir, "a.json.2.gz")); err != nil {
+		t.Fatalf("failure to rename temporary file: %v", err)
+	}
+	gz.Reset()
+	w = gzip.NewWriter(&gz)
+	w.Write([]byte("current\n"))
+	w.Close()
+	if err := ioutil.WriteFile(path.Join(dir, "a.json.1.gz"), gz.Bytes(), 0644); err != nil {
+		t.Fatalf("failure to write temporary file: %v", err)
+	}
+	if err := os.Remove(path.Join(dir, "a.json")); err != nil {
+		t.Fatalf("failure to remove temporary file: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "a.json"), []byte("newer\n"), 0644); err != nil {
+		t.Fatalf("failure to write temporary file: %v", err)
+	}
+
+	b, err := ioutil.ReadAll(&smallReader{r: r})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "older\ncurrent\n"; string(b) != expected {
+		t.Errorf("mismatched content, actual %q expected %q", b, expected)
+	}
+}
+
+// smallReader read at most 3 bytes at a time
+type smallReader struct {
+	r *file.RotatedReader
+}
+
+func (s *smallReader) Read(p []byte) (int, error) {
+	if len(p) > 3 {
+		p = p[:3]
+	}
+	return s.r.Read(p)
+}
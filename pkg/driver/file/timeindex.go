@@ -0,0 +1,367 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// timeIndexPath get the path of the time index of a file, e.g. logs.json.tidx for logs.json, logs.json.1.tidx for
+// logs.json.1.gz. The time index has a line "<offset> <ms>" for each record, the offset being that of the record in
+// the file uncompressed, and ms when it was written, in milliseconds since the epoch
+func timeIndexPath(p string) string {
+	return strings.TrimSuffix(p, gzSuffix) + tidxSuffix
+}
+
+// openTimeIndex open the time index of the current file for appending. One written before records were timed is
+// indexed first, its records as written at the epoch, as it is not known when they were
+func (m *ManagedFile) openTimeIndex() error {
+	p := timeIndexPath(path.Join(m.dir, m.name))
+	found, _ := exists(p)
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open time index %s: %v", p, err)
+	}
+	m.tidx = f
+	if found || m.currentSize == 0 {
+		return nil
+	}
+	offsets, err := scanOffsets(path.Join(m.dir, m.name))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(m.tidx)
+	for _, offset := range offsets {
+		fmt.Fprintf(w, "%d 0\n", offset)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write time index: %v", err)
+	}
+	return nil
+}
+
+// timeRecord index the time a record about to be appended to the current file is written, never before the record
+// before it, should the clock go back
+func (m *ManagedFile) timeRecord() error {
+	if m.tidx == nil {
+		return nil
+	}
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	if ms < m.lastWritten {
+		ms = m.lastWritten
+	}
+	m.lastWritten = ms
+	if _, err := fmt.Fprintf(m.tidx, "%d %d\n", m.currentSize, ms); err != nil {
+		return fmt.Errorf("failed to write time index: %v", err)
+	}
+	return nil
+}
+
+// recordID the ID of a record read in a range, as the entries of a stream: when it was written, and how many records
+// were written before it in the same millisecond
+type recordID struct {
+	ms, seq uint64
+}
+
+func (r recordID) before(o recordID) bool {
+	return r.ms < o.ms || r.ms == o.ms && r.seq < o.seq
+}
+
+func (r recordID) String() string {
+	return fmt.Sprintf("%d-%d", r.ms, r.seq)
+}
+
+// timedRecord a record of a file in a range, with its ID
+type timedRecord struct {
+	path   string
+	offset int64
+	id     recordID
+}
+
+// timedOffset a record of a time index
+type timedOffset struct {
+	offset int64
+	ms     uint64
+}
+
+// readTimeIndex read the time index of a file; false if it has none, as one written before records were timed
+func readTimeIndex(p string) ([]timedOffset, bool, error) {
+	b, err := ioutil.ReadFile(timeIndexPath(p))
+	switch {
+	case err != nil && os.IsNotExist(err):
+		return nil, false, nil
+	case err != nil:
+		return nil, false, fmt.Errorf("failed to read time index %s: %v", timeIndexPath(p), err)
+	}
+	var offsets []timedOffset
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		offset, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		ms, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		offsets = append(offsets, timedOffset{offset: offset, ms: ms})
+	}
+	return offsets, true, nil
+}
+
+// scanOffsets the offsets of the records of a file uncompressed, by reading it; none if it no longer exists
+func scanOffsets(p string) ([]int64, error) {
+	r := &RotatedReader{Files: []string{p}}
+	defer r.close()
+	br := bufio.NewReader(r)
+	var (
+		offsets []int64
+		offset  int64
+	)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			offsets = append(offsets, offset)
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			return offsets, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the records of %s: %v", p, err)
+		}
+	}
+}
+
+// rangeBounds the IDs a range starts at, inclusive, and ends at, exclusive, if it does
+func rangeBounds(rng common.StreamRange) (recordID, recordID, bool, error) {
+	var start, end recordID
+	var bounded bool
+	if rng.After != "" {
+		ms, seq, err := common.ParseStreamID(rng.After)
+		if err != nil {
+			return start, end, false, err
+		}
+		start = recordID{ms: ms, seq: seq + 1}
+		if seq+1 == 0 {
+			start = recordID{ms: ms + 1}
+		}
+	}
+	if !rng.Since.IsZero() {
+		if since := (recordID{ms: uint64(rng.Since.UnixNano() / int64(time.Millisecond))}); start.before(since) {
+			start = since
+		}
+	}
+	if rng.Before != "" {
+		ms, seq, err := common.ParseStreamID(rng.Before)
+		if err != nil {
+			return start, end, false, err
+		}
+		end, bounded = recordID{ms: ms, seq: seq}, true
+	}
+	if !rng.Until.IsZero() {
+		if until := (recordID{ms: uint64(rng.Until.UnixNano()/int64(time.Millisecond)) + 1}); !bounded || until.before(end) {
+			end, bounded = until, true
+		}
+	}
+	return start, end, bounded, nil
+}
+
+// RangeReader read the records in a range, through the time indexes of the files, skipping those with no record in
+// it without reading them. The records of files without one, written before records were timed, are read as written
+// at the epoch, before any other
+func (m *ManagedFile) RangeReader(rng common.StreamRange) (common.RangeReader, error) {
+	if err := rng.Validate(); err != nil {
+		return nil, err
+	}
+	start, end, bounded, err := rangeBounds(rng)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	legacy, err := m.legacyFiles()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		records []timedRecord
+		last    *recordID
+	)
+	for _, p := range append(legacy, m.indexedFiles()...) {
+		offsets, indexed, err := readTimeIndex(p)
+		if err != nil {
+			return nil, err
+		}
+		if !indexed {
+			// untimed records are all at the epoch, so only read when the range starts there
+			if start.ms > 0 {
+				continue
+			}
+			scanned, err := scanOffsets(p)
+			if err != nil {
+				return nil, err
+			}
+			offsets = make([]timedOffset, 0, len(scanned))
+			for _, offset := range scanned {
+				offsets = append(offsets, timedOffset{offset: offset})
+			}
+		}
+		for _, o := range offsets {
+			id := recordID{ms: o.ms}
+			if last != nil && o.ms == last.ms {
+				id.seq = last.seq + 1
+			}
+			last = &id
+			if id.before(start) || bounded && !id.before(end) {
+				continue
+			}
+			records = append(records, timedRecord{path: p, offset: o.offset, id: id})
+		}
+	}
+	if rng.Reverse {
+		for i, k := 0, len(records)-1; i < k; i, k = i+1, k-1 {
+			records[i], records[k] = records[k], records[i]
+		}
+	}
+	switch {
+	case rng.First > 0 && len(records) > rng.First:
+		records = records[:rng.First]
+	case rng.Last > 0 && len(records) > rng.Last:
+		records = records[len(records)-rng.Last:]
+	}
+	return &timedReader{records: records, reverse: rng.Reverse}, nil
+}
+
+// timedReader reads records of files by their offsets, in the order given, which is the order of the files, either
+// way. The records of one file are read at once, as a file compressed can only be read from its start
+type timedReader struct {
+	records []timedRecord
+	reverse bool
+	// pending the records of the file read last not yet returned, in the order returned
+	pending []timedLine
+	buf     bytes.Buffer
+	last    string
+}
+
+// timedLine a record read, without its newline
+type timedLine struct {
+	id   string
+	line []byte
+}
+
+// LastID the ID of the last record read, empty if none was
+func (t *timedReader) LastID() string {
+	return t.last
+}
+
+// Read the next chunk of the records
+func (t *timedReader) Read(p []byte) (int, error) {
+	for t.buf.Len() == 0 {
+		if len(t.pending) == 0 {
+			if len(t.records) == 0 {
+				return 0, io.EOF
+			}
+			if err := t.load(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		t.buf.Write(t.pending[0].line)
+		t.buf.WriteByte('\n')
+		t.last = t.pending[0].id
+		t.pending = t.pending[1:]
+	}
+	return t.buf.Read(p)
+}
+
+// load read the records of the next file. A file removed by rotation since its records were found reads as empty
+func (t *timedReader) load() error {
+	p := t.records[0].path
+	n := 1
+	for n < len(t.records) && t.records[n].path == p {
+		n++
+	}
+	ids := map[int64]string{}
+	offsets := make([]int64, 0, n)
+	for _, rec := range t.records[:n] {
+		ids[rec.offset] = rec.id.String()
+		offsets = append(offsets, rec.offset)
+	}
+	t.records = t.records[n:]
+	sort.Slice(offsets, func(i, k int) bool { return offsets[i] < offsets[k] })
+	r := &indexedReader{path: p, offsets: offsets}
+	for {
+		offset, line, ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		t.pending = append(t.pending, timedLine{id: ids[offset], line: line})
+	}
+	if t.reverse {
+		for i, k := 0, len(t.pending)-1; i < k; i, k = i+1, k-1 {
+			t.pending[i], t.pending[k] = t.pending[k], t.pending[i]
+		}
+	}
+	return nil
+}
+
+// streamFile get the ManagedFile of a stream of a device, e.g. its logs
+func (d *DeviceManager) streamFile(u uuid.UUID, stream func(common.DeviceStorage) common.BigData) (*ManagedFile, error) {
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("unregistered device UUID: %s", u)}
+	}
+	dev, _ := d.device(u)
+	m, ok := stream(dev).(*ManagedFile)
+	if !ok {
+		return nil, fmt.Errorf("stream of %s is not a managed file", u)
+	}
+	return m, nil
+}
+
+// GetLogsRange get the logs of a device in a range
+func (d *DeviceManager) GetLogsRange(u uuid.UUID, rng common.StreamRange) (common.RangeReader, error) {
+	m, err := d.logsFile(u)
+	if err != nil {
+		return nil, err
+	}
+	return m.RangeReader(rng)
+}
+
+// GetInfoRange get the info of a device in a range
+func (d *DeviceManager) GetInfoRange(u uuid.UUID, rng common.StreamRange) (common.RangeReader, error) {
+	m, err := d.streamFile(u, func(dev common.DeviceStorage) common.BigData { return dev.Info })
+	if err != nil {
+		return nil, err
+	}
+	return m.RangeReader(rng)
+}
+
+// GetMetricsRange get the metrics of a device in a range
+func (d *DeviceManager) GetMetricsRange(u uuid.UUID, rng common.StreamRange) (common.RangeReader, error) {
+	m, err := d.streamFile(u, func(dev common.DeviceStorage) common.BigData { return dev.Metrics })
+	if err != nil {
+		return nil, err
+	}
+	return m.RangeReader(rng)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package file
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// DeviceUsage get the bytes on disk and the records of each kind of message of a device. Records are counted by
+// reading the files, and the oldest and newest times are those the oldest and newest files were last written to
+func (d *DeviceManager) DeviceUsage(u uuid.UUID) (*common.DeviceUsage, error) {
+	// refresh certs from filesystem, if needed - includes checking if necessary based on timer
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from filesystem: %v", err)
+	}
+	if !d.deviceExists(u) {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	dev, _ := d.device(u)
+	usage := common.NewDeviceUsage(u.String())
+	for kind, stream := range map[string]common.BigData{
+		common.KindLogs:     dev.Logs,
+		common.KindInfo:     dev.Info,
+		common.KindMetrics:  dev.Metrics,
+		common.KindRequests: dev.Requests,
+	} {
+		m, ok := stream.(*ManagedFile)
+		if !ok {
+			continue
+		}
+		s, err := m.usage()
+		if err != nil {
+			return nil, err
+		}
+		usage.Add(kind, s)
+	}
+	// the logs of app instances are in a directory per instance, named after its UUID, which is only cached once
+	// written to since the cache was loaded
+	fis, err := ioutil.ReadDir(d.getDevicePath(u))
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory of device %s: %v", u, err)
+	}
+	for _, fi := range fis {
+		instanceID, err := uuid.FromString(fi.Name())
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		m, ok := d.appLog(u, instanceID).(*ManagedFile)
+		if !ok {
+			continue
+		}
+		s, err := m.usage()
+		if err != nil {
+			return nil, err
+		}
+		usage.Add(common.KindAppLogs, s)
+	}
+	return usage, nil
+}
+
+// usage the size on disk of the files of records, the records in them and when the oldest and newest files were
+// last written to
+func (m *ManagedFile) usage() (common.StreamUsage, error) {
+	u := common.StreamUsage{}
+	r, err := m.Reader()
+	if err != nil {
+		return u, err
+	}
+	rr := r.(*RotatedReader)
+	for _, p := range rr.Files {
+		fi, err := os.Stat(p)
+		switch {
+		case err != nil && os.IsNotExist(err):
+			continue
+		case err != nil:
+			return u, fmt.Errorf("failed to stat %s: %v", p, err)
+		}
+		u.Bytes += fi.Size()
+		t := fi.ModTime()
+		if u.Oldest == nil || t.Before(*u.Oldest) {
+			u.Oldest = &t
+		}
+		if u.Newest == nil || t.After(*u.Newest) {
+			u.Newest = &t
+		}
+	}
+	if u.Entries, err = countLines(rr); err != nil {
+		return u, fmt.Errorf("failed to count records in %s: %v", m.dir, err)
+	}
+	return u, nil
+}
+
+// countLines count the lines that are not empty
+func countLines(r io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var n int64
+	// whether the last byte read ends a line, or there is none yet
+	ended := true
+	for {
+		c, err := r.Read(buf)
+		for _, b := range buf[:c] {
+			switch {
+			case b == 0x0a && !ended:
+				n++
+				ended = true
+			case b != 0x0a:
+				ended = false
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	if !ended {
+		n++
+	}
+	return n, nil
+}
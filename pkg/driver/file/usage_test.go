@@ -0,0 +1,34 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package file
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCountLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		lines int64
+	}{
+		{"empty", "", 0},
+		{"one", "{}\n", 1},
+		{"no final linefeed", "{}\n{}", 2},
+		{"empty lines", "\n{}\n\n\n{}\n", 2},
+		{"long", strings.Repeat("x", 100*1024) + "\n{}\n", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := countLines(strings.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n != tt.lines {
+				t.Errorf("mismatched lines, actual %d expected %d", n, tt.lines)
+			}
+		})
+	}
+}
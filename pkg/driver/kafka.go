@@ -0,0 +1,276 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/adam/pkg/driver/kafka"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// kafkaStoreParam query parameter of the URL of the DeviceManager storing all but the telemetry
+	kafkaStoreParam = "store"
+	// kafkaPrefixParam query parameter of the prefix of the topics, <prefix>-logs, <prefix>-info and <prefix>-metrics
+	kafkaPrefixParam = "topic-prefix"
+	// kafkaGroupParam query parameter of the consumer group the readers are instances of
+	kafkaGroupParam    = "group"
+	defaultKafkaPrefix = "adam"
+	defaultKafkaGroup  = "adam-readers"
+)
+
+// kafkaManager a DeviceManager storing the logs, info and metrics of devices in Kafka topics, keyed by the UUID of the
+// device, through a Kafka REST proxy, and everything else, including the logs of apps and the requests, in the
+// DeviceManager of its store URL. It is selected with kafka://<proxy host:port>[/<path>]?store=<URL>, or kafkas:// for
+// a proxy with HTTPS. The optional interfaces of the store, e.g. StreamSeeker, are not available through it, as the
+// telemetry is not where the store has it
+type kafkaManager struct {
+	DeviceManager
+	// stores the DeviceManagers the store URL can select
+	stores      func() []DeviceManager
+	client      *kafka.Client
+	topics      map[string]string
+	databaseURL string
+	quotas      *common.QuotaTracker
+	mu          sync.Mutex
+	// quotasLoaded the devices whose own quotas were read from the store
+	quotasLoaded map[uuid.UUID]bool
+}
+
+// Name return unique representative name for this type of device manager
+func (k *kafkaManager) Name() string {
+	return "kafka"
+}
+
+// Database the proxy and the database of the store
+func (k *kafkaManager) Database() string {
+	if k.DeviceManager == nil {
+		return k.databaseURL
+	}
+	return fmt.Sprintf("%s, store %s", k.databaseURL, k.DeviceManager.Database())
+}
+
+// MaxLogSize the maximum log size of the store; logs in Kafka are kept as long as the retention of their topic
+func (k *kafkaManager) MaxLogSize() int {
+	if k.DeviceManager == nil {
+		return 0
+	}
+	return k.DeviceManager.MaxLogSize()
+}
+
+// MaxInfoSize the maximum info size of the store
+func (k *kafkaManager) MaxInfoSize() int {
+	if k.DeviceManager == nil {
+		return 0
+	}
+	return k.DeviceManager.MaxInfoSize()
+}
+
+// MaxMetricSize the maximum metric size of the store
+func (k *kafkaManager) MaxMetricSize() int {
+	if k.DeviceManager == nil {
+		return 0
+	}
+	return k.DeviceManager.MaxMetricSize()
+}
+
+// MaxRequestsSize the maximum request logs size of the store
+func (k *kafkaManager) MaxRequestsSize() int {
+	if k.DeviceManager == nil {
+		return 0
+	}
+	return k.DeviceManager.MaxRequestsSize()
+}
+
+// MaxAppLogsSize the maximum app logs size of the store
+func (k *kafkaManager) MaxAppLogsSize() int {
+	if k.DeviceManager == nil {
+		return 0
+	}
+	return k.DeviceManager.MaxAppLogsSize()
+}
+
+// Init initialize the store of the store URL, and check that the proxy answers
+func (k *kafkaManager) Init(s string, sizes common.MaxSizes) (bool, error) {
+	URL, err := url.Parse(s)
+	if err != nil || (URL.Scheme != "kafka" && URL.Scheme != "kafkas") {
+		return false, nil
+	}
+	q := URL.Query()
+	store := q.Get(kafkaStoreParam)
+	if store == "" {
+		return true, fmt.Errorf("kafka URL needs the URL of the store of devices, as %s=<URL>", kafkaStoreParam)
+	}
+	if strings.HasPrefix(store, "kafka") {
+		return true, fmt.Errorf("the store of the kafka driver cannot be kafka")
+	}
+	for _, m := range k.stores() {
+		valid, err := m.Init(store, sizes)
+		if err != nil {
+			return true, fmt.Errorf("error initializing the %s store: %v", m.Name(), err)
+		}
+		if valid {
+			k.DeviceManager = m
+			break
+		}
+	}
+	if k.DeviceManager == nil {
+		return true, fmt.Errorf("no device manager for store %s", store)
+	}
+	scheme := "http"
+	if URL.Scheme == "kafkas" {
+		scheme = "https"
+	}
+	proxy := &url.URL{Scheme: scheme, User: URL.User, Host: URL.Host, Path: URL.Path}
+	k.databaseURL = (&url.URL{Scheme: scheme, Host: URL.Host, Path: URL.Path}).String()
+	group := q.Get(kafkaGroupParam)
+	if group == "" {
+		group = defaultKafkaGroup
+	}
+	prefix := q.Get(kafkaPrefixParam)
+	if prefix == "" {
+		prefix = defaultKafkaPrefix
+	}
+	k.topics = map[string]string{}
+	for _, kind := range []string{common.KindLogs, common.KindInfo, common.KindMetrics} {
+		k.topics[kind] = prefix + "-" + kind
+	}
+	k.client = kafka.NewClient(proxy.String(), group)
+	k.quotas = common.NewQuotaTracker()
+	k.quotasLoaded = map[uuid.UUID]bool{}
+	if err := k.client.Check(); err != nil {
+		return true, fmt.Errorf("unable to reach the Kafka REST proxy at %s: %v", k.databaseURL, err)
+	}
+	return true, nil
+}
+
+// produce produce a message of a device to the topic of its kind, within the quotas of the device
+func (k *kafkaManager) produce(u uuid.UUID, kind string, b []byte) error {
+	// make sure it is not nil
+	if len(b) < 1 {
+		return nil
+	}
+	if _, _, _, err := k.DeviceManager.DeviceGet(&u); err != nil {
+		return fmt.Errorf("device not found: %s", u)
+	}
+	if err := k.loadQuotas(u); err != nil {
+		return err
+	}
+	if err := k.quotas.Use(u, kind, len(b)); err != nil {
+		return err
+	}
+	return k.client.Produce(k.topics[kind], u.String(), b)
+}
+
+// loadQuotas read the own quotas of a device from the store, the first time it sends telemetry
+func (k *kafkaManager) loadQuotas(u uuid.UUID) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.quotasLoaded[u] {
+		return nil
+	}
+	quotas, err := k.DeviceManager.GetDeviceQuotas(u)
+	if err != nil {
+		return err
+	}
+	k.quotas.SetDevice(u, quotas)
+	k.quotasLoaded[u] = true
+	return nil
+}
+
+// reader read the messages of a device of a kind, oldest first
+func (k *kafkaManager) reader(u uuid.UUID, kind string) (io.Reader, error) {
+	if _, _, _, err := k.DeviceManager.DeviceGet(&u); err != nil {
+		return nil, err
+	}
+	return k.client.Reader(k.topics[kind], u.String())
+}
+
+// WriteInfo produce an information message to the info topic
+func (k *kafkaManager) WriteInfo(u uuid.UUID, b []byte) error {
+	return k.produce(u, common.KindInfo, b)
+}
+
+// WriteLogs produce log messages to the logs topic
+func (k *kafkaManager) WriteLogs(u uuid.UUID, b []byte) error {
+	return k.produce(u, common.KindLogs, b)
+}
+
+// WriteMetrics produce a MetricMsg to the metrics topic
+func (k *kafkaManager) WriteMetrics(u uuid.UUID, b []byte) error {
+	return k.produce(u, common.KindMetrics, b)
+}
+
+// GetLogsReader read the logs of a device from the logs topic
+func (k *kafkaManager) GetLogsReader(u uuid.UUID) (io.Reader, error) {
+	return k.reader(u, common.KindLogs)
+}
+
+// GetInfoReader read the info of a device from the info topic
+func (k *kafkaManager) GetInfoReader(u uuid.UUID) (io.Reader, error) {
+	return k.reader(u, common.KindInfo)
+}
+
+// GetMetricsReader read the metrics of a device from the metrics topic
+func (k *kafkaManager) GetMetricsReader(u uuid.UUID) (io.Reader, error) {
+	return k.reader(u, common.KindMetrics)
+}
+
+// SetQuotas set the global quotas, of the store and of the telemetry produced
+func (k *kafkaManager) SetQuotas(quotas common.Quotas, period time.Duration) {
+	k.quotas.SetGlobal(quotas, period)
+	k.DeviceManager.SetQuotas(quotas, period)
+}
+
+// SetDeviceQuotas set the quotas of a device, of the store and of the telemetry produced
+func (k *kafkaManager) SetDeviceQuotas(u uuid.UUID, quotas *common.Quotas) error {
+	if err := k.DeviceManager.SetDeviceQuotas(u, quotas); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.quotas.SetDevice(u, quotas)
+	k.quotasLoaded[u] = true
+	return nil
+}
+
+// DeviceRemove remove a device from the store. Its telemetry stays in the topics until their retention drops it
+func (k *kafkaManager) DeviceRemove(u *uuid.UUID) error {
+	if err := k.DeviceManager.DeviceRemove(u); err != nil {
+		return err
+	}
+	if u != nil {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		k.quotas.Forget(*u)
+		delete(k.quotasLoaded, *u)
+	}
+	return nil
+}
+
+// CheckHealth check that the proxy answers, and the store if it can be checked
+func (k *kafkaManager) CheckHealth() error {
+	if err := k.client.Check(); err != nil {
+		return fmt.Errorf("kafka: %v", err)
+	}
+	if hc, ok := k.DeviceManager.(HealthChecker); ok {
+		return hc.CheckHealth()
+	}
+	return nil
+}
+
+// Close close the store, if it can be
+func (k *kafkaManager) Close() error {
+	if c, ok := k.DeviceManager.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
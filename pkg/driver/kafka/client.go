@@ -0,0 +1,293 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package kafka reads and writes the records of Kafka topics through a Kafka REST proxy, e.g. Confluent's, with its
+// v2 API, so that Kafka can be used without a client library
+package kafka
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// mimeBinary content type of records with base64 keys and values, as sent and fetched
+	mimeBinary = "application/vnd.kafka.binary.v2+json"
+	// mimeV2 content type of the other requests and answers of the v2 API
+	mimeV2 = "application/vnd.kafka.v2+json"
+	// requestTimeout how long a request to the proxy can take
+	requestTimeout = 30 * time.Second
+	// maxEmptyFetches how many fetches in a row can return no record before reading a partition up to its end fails,
+	// as the proxy answers with none while its consumer is still connecting
+	maxEmptyFetches = 20
+)
+
+// Client a client of a Kafka REST proxy, whose readers are instances of a consumer group
+type Client struct {
+	base  string
+	group string
+	http  *http.Client
+	mu    sync.Mutex
+	// partitions the number of partitions of each topic, as first read
+	partitions map[string]int
+}
+
+// NewClient a client of the Kafka REST proxy at a http:// or https:// URL, whose readers are in a consumer group
+func NewClient(base, group string) *Client {
+	return &Client{
+		base:       strings.TrimSuffix(base, "/"),
+		group:      group,
+		http:       &http.Client{Timeout: requestTimeout},
+		partitions: map[string]int{},
+	}
+}
+
+// record a record as produced and fetched, with base64 key and value
+type record struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Partition *int   `json:"partition,omitempty"`
+	Offset    int64  `json:"offset,omitempty"`
+}
+
+// do send a request to the proxy, decoding its answer into out if not nil
+func (c *Client) do(method, u, contentType string, body interface{}, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", contentType)
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error reading answer of %s %s: %v", method, u, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s: %s", method, u, res.Status, strings.TrimSpace(string(b)))
+	}
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("bad answer of %s %s: %v", method, u, err)
+	}
+	return nil
+}
+
+func (c *Client) topicURL(topic string, elems ...string) string {
+	return c.base + path.Join(append([]string{"/topics", url.PathEscape(topic)}, elems...)...)
+}
+
+// Check check that the proxy answers
+func (c *Client) Check() error {
+	return c.do(http.MethodGet, c.base+"/topics", mimeV2, nil, nil)
+}
+
+// Partition the partition of a topic the records of a key are produced to, and read from. Records are not left to the
+// partitioner of the proxy, so that those of a key are found in one partition without knowing how it hashes keys; the
+// number of partitions of a topic must not change once it has records
+func (c *Client) Partition(topic, key string) (int, error) {
+	c.mu.Lock()
+	n, ok := c.partitions[topic]
+	c.mu.Unlock()
+	if !ok {
+		var partitions []struct {
+			Partition int `json:"partition"`
+		}
+		if err := c.do(http.MethodGet, c.topicURL(topic, "partitions"), mimeV2, nil, &partitions); err != nil {
+			return 0, err
+		}
+		if len(partitions) == 0 {
+			return 0, fmt.Errorf("topic %s has no partitions", topic)
+		}
+		n = len(partitions)
+		c.mu.Lock()
+		c.partitions[topic] = n
+		c.mu.Unlock()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n)), nil
+}
+
+// Produce produce a record with a key to its partition of a topic
+func (c *Client) Produce(topic, key string, value []byte) error {
+	p, err := c.Partition(topic, key)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{"records": []record{{
+		Key:       base64.StdEncoding.EncodeToString([]byte(key)),
+		Value:     base64.StdEncoding.EncodeToString(value),
+		Partition: &p,
+	}}}
+	var res struct {
+		Offsets []struct {
+			Error string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := c.do(http.MethodPost, c.topicURL(topic), mimeBinary, body, &res); err != nil {
+		return err
+	}
+	for _, o := range res.Offsets {
+		if o.Error != "" {
+			return fmt.Errorf("error producing to %s: %s", topic, o.Error)
+		}
+	}
+	return nil
+}
+
+// Reader read the values of the records of a key in a topic, oldest first, one per line, up to those produced when it
+// is called. The partition of the key is read through a consumer instance of its own, which commits no offsets, and
+// is deleted once the end is reached; one left unread times out in the proxy
+func (c *Client) Reader(topic, key string) (io.Reader, error) {
+	p, err := c.Partition(topic, key)
+	if err != nil {
+		return nil, err
+	}
+	var offsets struct {
+		Beginning int64 `json:"beginning_offset"`
+		End       int64 `json:"end_offset"`
+	}
+	if err := c.do(http.MethodGet, c.topicURL(topic, "partitions", fmt.Sprint(p), "offsets"), mimeV2, nil, &offsets); err != nil {
+		return nil, err
+	}
+	r := &recordReader{client: c, key: key, next: offsets.Beginning, end: offsets.End}
+	if offsets.Beginning >= offsets.End {
+		return r, nil
+	}
+	if err := r.open(topic, p); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// recordReader reads the values of the records of a key in a partition, between two offsets
+type recordReader struct {
+	client *Client
+	key    string
+	// instance the URL of the consumer instance, empty once deleted
+	instance  string
+	next, end int64
+	buf       bytes.Buffer
+}
+
+// open create the consumer instance, assigned the partition at the offset to read from
+func (r *recordReader) open(topic string, p int) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	var created struct {
+		BaseURI string `json:"base_uri"`
+	}
+	err := r.client.do(http.MethodPost, r.client.base+path.Join("/consumers", url.PathEscape(r.client.group)), mimeV2, map[string]string{
+		"name":               "adam-" + hex.EncodeToString(id),
+		"format":             "binary",
+		"auto.offset.reset":  "earliest",
+		"auto.commit.enable": "false",
+	}, &created)
+	if err != nil {
+		return err
+	}
+	r.instance = created.BaseURI
+	partition := map[string]interface{}{"topic": topic, "partition": p}
+	if err := r.client.do(http.MethodPost, r.instance+"/assignments", mimeV2, map[string]interface{}{"partitions": []interface{}{partition}}, nil); err != nil {
+		r.close()
+		return err
+	}
+	partition["offset"] = r.next
+	if err := r.client.do(http.MethodPost, r.instance+"/positions", mimeV2, map[string]interface{}{"offsets": []interface{}{partition}}, nil); err != nil {
+		r.close()
+		return err
+	}
+	return nil
+}
+
+// close delete the consumer instance
+func (r *recordReader) close() {
+	if r.instance == "" {
+		return
+	}
+	_ = r.client.do(http.MethodDelete, r.instance, mimeV2, nil, nil)
+	r.instance = ""
+}
+
+// Close delete the consumer instance of a reader not read to its end
+func (r *recordReader) Close() error {
+	r.close()
+	return nil
+}
+
+// Read the next values, fetching records until those of the key fill the buffer, or the end is reached
+func (r *recordReader) Read(p []byte) (int, error) {
+	empty := 0
+	for r.buf.Len() == 0 {
+		if r.next >= r.end {
+			r.close()
+			return 0, io.EOF
+		}
+		var records []record
+		if err := r.client.do(http.MethodGet, r.instance+"/records", mimeBinary, nil, &records); err != nil {
+			r.close()
+			return 0, err
+		}
+		if len(records) == 0 {
+			if empty++; empty >= maxEmptyFetches {
+				r.close()
+				return 0, fmt.Errorf("no records fetched from offset %d of %d", r.next, r.end)
+			}
+			continue
+		}
+		empty = 0
+		for _, rec := range records {
+			if rec.Offset < r.next || rec.Offset >= r.end {
+				continue
+			}
+			r.next = rec.Offset + 1
+			key, err := base64.StdEncoding.DecodeString(rec.Key)
+			if err != nil || string(key) != r.key {
+				continue
+			}
+			value, err := base64.StdEncoding.DecodeString(rec.Value)
+			if err != nil {
+				r.close()
+				return 0, fmt.Errorf("bad value at offset %d: %v", rec.Offset, err)
+			}
+			r.buf.Write(bytes.TrimRight(value, "\n"))
+			r.buf.WriteByte('\n')
+		}
+		if last := records[len(records)-1].Offset; last+1 > r.next {
+			r.next = last + 1
+		}
+	}
+	return r.buf.Read(p)
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package kafka
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProxy a Kafka REST proxy keeping the records of topics of two partitions in memory, fetching two at a time
+type fakeProxy struct {
+	mu        sync.Mutex
+	url       string
+	records   map[string][2][]record
+	positions map[string]int64
+	// assigned the topic and partition assigned to each consumer instance
+	assigned map[string]assignment
+}
+
+type assignment struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+}
+
+func newFakeProxy(t *testing.T) *fakeProxy {
+	f := &fakeProxy{records: map[string][2][]record{}, positions: map[string]int64{}, assigned: map[string]assignment{}}
+	s := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(s.Close)
+	f.url = s.URL
+	return f
+}
+
+func (f *fakeProxy) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var body map[string]json.RawMessage
+	if b, _ := ioutil.ReadAll(r.Body); len(b) > 0 {
+		_ = json.Unmarshal(b, &body)
+	}
+	var out interface{}
+	switch {
+	case parts[0] == "topics" && len(parts) == 1:
+		out = []string{}
+	case parts[0] == "topics" && len(parts) == 2 && r.Method == http.MethodPost:
+		var records []record
+		_ = json.Unmarshal(body["records"], &records)
+		partitions := f.records[parts[1]]
+		for _, rec := range records {
+			rec.Offset = int64(len(partitions[*rec.Partition]))
+			partitions[*rec.Partition] = append(partitions[*rec.Partition], rec)
+		}
+		f.records[parts[1]] = partitions
+		out = map[string]interface{}{"offsets": []interface{}{map[string]interface{}{}}}
+	case parts[0] == "topics" && len(parts) == 3:
+		out = []interface{}{map[string]int{"partition": 0}, map[string]int{"partition": 1}}
+	case parts[0] == "topics" && len(parts) == 5:
+		p, _ := strconv.Atoi(parts[3])
+		out = map[string]int{"beginning_offset": 0, "end_offset": len(f.records[parts[1]][p])}
+	case parts[0] == "consumers" && len(parts) == 2:
+		var name string
+		_ = json.Unmarshal(body["name"], &name)
+		f.positions[name] = 0
+		out = map[string]string{"instance_id": name, "base_uri": f.url + "/consumers/" + parts[1] + "/instances/" + name}
+	case parts[0] == "consumers" && len(parts) == 4 && r.Method == http.MethodDelete:
+		delete(f.positions, parts[3])
+	case parts[0] == "consumers" && parts[4] == "assignments":
+		var partitions []assignment
+		_ = json.Unmarshal(body["partitions"], &partitions)
+		f.assigned[parts[3]] = partitions[0]
+	case parts[0] == "consumers" && parts[4] == "positions":
+		var offsets []struct {
+			Offset int64 `json:"offset"`
+		}
+		_ = json.Unmarshal(body["offsets"], &offsets)
+		f.positions[parts[3]] = offsets[0].Offset
+	case parts[0] == "consumers" && parts[4] == "records":
+		a := f.assigned[parts[3]]
+		records := f.records[a.Topic][a.Partition]
+		pos := f.positions[parts[3]]
+		end := pos + 2
+		if end > int64(len(records)) {
+			end = int64(len(records))
+		}
+		out = records[pos:end]
+		f.positions[parts[3]] = end
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	b, _ := json.Marshal(out)
+	w.Write(b)
+}
+
+func TestClient(t *testing.T) {
+	f := newFakeProxy(t)
+	c := NewClient(f.url, "readers")
+	assert.NoError(t, c.Check())
+
+	// an empty partition is read without a consumer
+	r, err := c.Reader("logs", "a")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Empty(t, b)
+
+	// keys of the same partition are told apart
+	keys := []string{"a"}
+	pa, _ := c.Partition("logs", "a")
+	for i := 0; len(keys) < 2; i++ {
+		if p, _ := c.Partition("logs", strconv.Itoa(i)); p == pa {
+			keys = append(keys, strconv.Itoa(i))
+		}
+	}
+	for i := 0; i < 5; i++ {
+		for _, k := range keys {
+			assert.NoError(t, c.Produce("logs", k, []byte(`{"key":"`+k+`","n":`+strconv.Itoa(i)+`}`)))
+		}
+	}
+	r, err = c.Reader("logs", "a")
+	assert.NoError(t, err)
+	b, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	expected := ""
+	for i := 0; i < 5; i++ {
+		expected += `{"key":"a","n":` + strconv.Itoa(i) + "}\n"
+	}
+	assert.Equal(t, expected, string(b))
+	assert.Empty(t, f.positions, "consumer instance not deleted")
+}
@@ -3,12 +3,17 @@ package memory
 import (
 	"fmt"
 	"io"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
 )
 
 type ByteSlice struct {
 	// we do this as a slice of byte slice, rather than a single byte slice,
 	// because we need to track breaks, so we can delete from the beginning
-	data         [][]byte
+	data [][]byte
+	// written when each of data was written
+	written      []time.Time
 	dataCache    []byte
 	currentRead  int
 	readComplete bool
@@ -26,6 +31,7 @@ func (bs ByteSlice) Get(index int) ([]byte, error) {
 func (bs *ByteSlice) Write(b []byte) (int, error) {
 	// write it to the current one
 	bs.data = append(bs.data, b[:])
+	bs.written = append(bs.written, time.Now())
 	bs.size += len(b)
 	for {
 		if bs.size <= bs.maxSize {
@@ -36,17 +42,29 @@ func (bs *ByteSlice) Write(b []byte) (int, error) {
 		}
 		bs.size -= len(bs.data[0])
 		bs.data = bs.data[1:]
+		bs.written = bs.written[1:]
 		// this will mess up the current reader, so we need to update it
 		bs.currentRead--
 	}
 	return len(b), nil
 }
 
+// usage the bytes and records held, and when the oldest and newest were written
+func (bs *ByteSlice) usage() common.StreamUsage {
+	u := common.StreamUsage{Bytes: int64(bs.size), Entries: int64(len(bs.data))}
+	if n := len(bs.written); n > 0 {
+		oldest, newest := bs.written[0], bs.written[n-1]
+		u.Oldest, u.Newest = &oldest, &newest
+	}
+	return u
+}
+
+// Reader get a reader over a snapshot of the current data
 func (bs ByteSlice) Reader() (io.Reader, error) {
-	return bs, nil
+	return &ByteSlice{data: bs.data}, nil
 }
 
-func (bs ByteSlice) Read(p []byte) (int, error) {
+func (bs *ByteSlice) Read(p []byte) (int, error) {
 	if bs.readComplete {
 		return 0, io.EOF
 	}
@@ -56,8 +74,8 @@ func (bs ByteSlice) Read(p []byte) (int, error) {
 			bs.readComplete = true
 			return 0, io.EOF
 		}
-		// include the linefeed
-		bs.dataCache = append(bs.data[bs.currentRead], 0x0a)
+		// include the linefeed, in a copy, as other readers share the record
+		bs.dataCache = append(append([]byte(nil), bs.data[bs.currentRead]...), 0x0a)
 		bs.currentRead++
 	}
 	// read the data from the msg cache
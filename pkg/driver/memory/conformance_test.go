@@ -0,0 +1,23 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/adam/pkg/driver/drivertest"
+	"github.com/lf-edge/adam/pkg/driver/memory"
+)
+
+func TestConformance(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) driver.DeviceManager {
+		d := &memory.DeviceManager{}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unable to initialize: %v", err)
+		}
+		return d
+	})
+}
@@ -4,9 +4,12 @@
 package memory
 
 import (
+	"bytes"
 	"crypto/x509"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/lf-edge/adam/pkg/driver/common"
 	uuid "github.com/satori/go.uuid"
@@ -19,13 +22,32 @@ const (
 	maxMetricSizeMemory   = 10 * MB
 	maxRequestsSizeMemory = 10 * MB
 	maxAppLogsSizeMemory  = 10 * MB
+	maxAuditSizeMemory    = 10 * MB
 )
 
 // DeviceManager implementation of DeviceManager with an ephemeral memory backing store
 type DeviceManager struct {
+	// mu guards everything below, as requests are handled concurrently
+	mu              sync.RWMutex
 	onboardCerts    map[string]map[string]bool
+	onboardPolicies map[string]common.OnboardPolicy
 	deviceCerts     map[string]uuid.UUID
 	devices         map[uuid.UUID]common.DeviceStorage
+	audit           *ByteSlice
+	quotas          *common.QuotaTracker
+	// records the records kept by key, by kind
+	records         map[string]map[string][]byte
+	acks            map[uuid.UUID]common.ConfigAck
+	inventories     map[uuid.UUID]common.Inventory
+	logFilters      map[uuid.UUID]common.LogFilter
+	localProfiles   map[uuid.UUID]common.LocalProfile
+	metadata        map[uuid.UUID]common.DeviceMetadata
+	deviceModels    map[uuid.UUID]string
+	appCommands     map[uuid.UUID][]common.AppCommand
+	deviceFlags     map[uuid.UUID]common.DeviceFlags
+	quarantines     map[uuid.UUID]common.Quarantine
+	sources         map[uuid.UUID][]common.DeviceSource
+	attestations    map[uuid.UUID]common.Attestation
 	maxLogSize      int
 	maxInfoSize     int
 	maxMetricSize   int
@@ -99,6 +121,7 @@ func (d *DeviceManager) Init(s string, sizes common.MaxSizes) (bool, error) {
 	} else {
 		d.maxAppLogsSize = sizes.MaxAppLogsSize
 	}
+	d.quotas = common.NewQuotaTracker()
 	return true, nil
 }
 
@@ -106,8 +129,14 @@ func (d *DeviceManager) Init(s string, sizes common.MaxSizes) (bool, error) {
 func (d *DeviceManager) SetCacheTimeout(timeout int) {
 }
 
+// SetEncryptor set the encryptor for data at rest, unused in memory
+func (d *DeviceManager) SetEncryptor(e *common.Encryptor) {
+}
+
 // OnboardCheck see if a particular certificate plus serial combinaton is valid
 func (d *DeviceManager) OnboardCheck(cert *x509.Certificate, serial string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	if cert == nil {
 		return fmt.Errorf("invalid nil certificate")
 	}
@@ -122,22 +151,35 @@ func (d *DeviceManager) OnboardCheck(cert *x509.Certificate, serial string) erro
 
 // OnboardRemove remove an onboard certificate based on Common Name
 func (d *DeviceManager) OnboardRemove(cn string) error {
-	cert, _, err := d.OnboardGet(cn)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cert, _, err := d.onboardGet(cn)
 	if err != nil {
 		return err
 	}
 	delete(d.onboardCerts, string(cert.Raw))
+	delete(d.onboardPolicies, cn)
 	return nil
 }
 
 // OnboardClear remove all onboarding certs
 func (d *DeviceManager) OnboardClear() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	d.onboardCerts = map[string]map[string]bool{}
+	d.onboardPolicies = nil
 	return nil
 }
 
 // OnboardGet get the onboard certificate and serials based on Common Name
 func (d *DeviceManager) OnboardGet(cn string) (*x509.Certificate, []string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.onboardGet(cn)
+}
+
+// onboardGet get the onboard certificate and serials based on Common Name, with the lock held
+func (d *DeviceManager) onboardGet(cn string) (*x509.Certificate, []string, error) {
 	if cn == "" {
 		return nil, nil, fmt.Errorf("empty cn")
 	}
@@ -158,8 +200,42 @@ func (d *DeviceManager) OnboardGet(cn string) (*x509.Certificate, []string, erro
 	return nil, nil, &common.NotFoundError{Err: fmt.Sprintf("onboard cn not found: %s", cn)}
 }
 
+// OnboardPolicyGet get the policy of an onboarding certificate by Common Name, nil if it has none
+func (d *DeviceManager) OnboardPolicyGet(cn string) (*common.OnboardPolicy, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, _, err := d.onboardGet(cn); err != nil {
+		return nil, err
+	}
+	p, ok := d.onboardPolicies[cn]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// OnboardPolicySet set the policy of an onboarding certificate by Common Name, replacing any; nil removes it
+func (d *DeviceManager) OnboardPolicySet(cn string, p *common.OnboardPolicy) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, _, err := d.onboardGet(cn); err != nil {
+		return err
+	}
+	if p == nil {
+		delete(d.onboardPolicies, cn)
+		return nil
+	}
+	if d.onboardPolicies == nil {
+		d.onboardPolicies = map[string]common.OnboardPolicy{}
+	}
+	d.onboardPolicies[cn] = *p
+	return nil
+}
+
 // OnboardList list all of the known Common Names for onboard
 func (d *DeviceManager) OnboardList() ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	cns := make([]string, 0, len(d.onboardCerts))
 	for certStr := range d.onboardCerts {
 		certRaw := []byte(certStr)
@@ -174,6 +250,13 @@ func (d *DeviceManager) OnboardList() ([]string, error) {
 
 // DeviceCheckCert see if a particular certificate is a valid registered device certificate
 func (d *DeviceManager) DeviceCheckCert(cert *x509.Certificate) (*uuid.UUID, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.deviceCheckCert(cert)
+}
+
+// deviceCheckCert see if a particular certificate is a valid registered device certificate, with the lock held
+func (d *DeviceManager) deviceCheckCert(cert *x509.Certificate) (*uuid.UUID, error) {
 	if cert == nil {
 		return nil, fmt.Errorf("invalid nil certificate")
 	}
@@ -186,7 +269,9 @@ func (d *DeviceManager) DeviceCheckCert(cert *x509.Certificate) (*uuid.UUID, err
 
 // DeviceRemove remove a device
 func (d *DeviceManager) DeviceRemove(u *uuid.UUID) error {
-	cert, _, _, err := d.DeviceGet(u)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cert, _, _, err := d.deviceGet(u)
 	if err != nil {
 		return err
 	}
@@ -194,18 +279,53 @@ func (d *DeviceManager) DeviceRemove(u *uuid.UUID) error {
 	if cert != nil {
 		delete(d.deviceCerts, string(cert.Raw))
 	}
+	d.quotas.Forget(*u)
+	delete(d.acks, *u)
+	delete(d.inventories, *u)
+	delete(d.logFilters, *u)
+	delete(d.localProfiles, *u)
+	delete(d.metadata, *u)
+	delete(d.deviceModels, *u)
+	delete(d.appCommands, *u)
+	delete(d.deviceFlags, *u)
+	delete(d.quarantines, *u)
+	delete(d.sources, *u)
+	delete(d.attestations, *u)
 	return nil
 }
 
 // DeviceClear remove all devices
 func (d *DeviceManager) DeviceClear() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for u := range d.devices {
+		d.quotas.Forget(u)
+	}
 	d.deviceCerts = make(map[string]uuid.UUID)
 	d.devices = make(map[uuid.UUID]common.DeviceStorage)
+	d.acks = nil
+	d.inventories = nil
+	d.logFilters = nil
+	d.localProfiles = nil
+	d.metadata = nil
+	d.deviceModels = nil
+	d.appCommands = nil
+	d.deviceFlags = nil
+	d.quarantines = nil
+	d.sources = nil
+	d.attestations = nil
 	return nil
 }
 
 // DeviceGet get an individual device by UUID
 func (d *DeviceManager) DeviceGet(u *uuid.UUID) (*x509.Certificate, *x509.Certificate, string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.deviceGet(u)
+}
+
+// deviceGet get an individual device by UUID, with the lock held
+func (d *DeviceManager) deviceGet(u *uuid.UUID) (*x509.Certificate, *x509.Certificate, string, error) {
 	if u == nil {
 		return nil, nil, "", fmt.Errorf("empty UUID")
 	}
@@ -217,6 +337,8 @@ func (d *DeviceManager) DeviceGet(u *uuid.UUID) (*x509.Certificate, *x509.Certif
 
 // DeviceList list all of the known UUIDs for devices
 func (d *DeviceManager) DeviceList() ([]*uuid.UUID, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	ids := make([]uuid.UUID, 0, len(d.devices))
 	for u := range d.devices {
 		ids = append(ids, u)
@@ -230,8 +352,10 @@ func (d *DeviceManager) DeviceList() ([]*uuid.UUID, error) {
 
 // DeviceRegister register a new device cert
 func (d *DeviceManager) DeviceRegister(unew uuid.UUID, cert, onboard *x509.Certificate, serial string, conf []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	// first check if it already exists - this also checks for nil cert
-	u, err := d.DeviceCheckCert(cert)
+	u, err := d.deviceCheckCert(cert)
 	if err != nil {
 		return err
 	}
@@ -240,12 +364,16 @@ func (d *DeviceManager) DeviceRegister(unew uuid.UUID, cert, onboard *x509.Certi
 		return fmt.Errorf("device already registered")
 	}
 	// register the cert for this uuid
+	if d.deviceCerts == nil {
+		d.deviceCerts = make(map[string]uuid.UUID)
+	}
 	d.deviceCerts[string(cert.Raw)] = unew
 	// create a structure for this device
 	if d.devices == nil {
 		d.devices = make(map[uuid.UUID]common.DeviceStorage)
 	}
 	d.devices[unew] = common.DeviceStorage{
+		Cert:    cert,
 		Onboard: onboard,
 		Serial:  serial,
 		Config:  conf,
@@ -258,13 +386,47 @@ func (d *DeviceManager) DeviceRegister(unew uuid.UUID, cert, onboard *x509.Certi
 		Metrics: &ByteSlice{
 			maxSize: d.maxMetricSize,
 		},
+		Requests: &ByteSlice{
+			maxSize: d.maxRequestsSize,
+		},
 		AppLogs: map[uuid.UUID]common.BigData{},
 	}
 	return nil
 }
 
+// DeviceReplaceCert replace the certificate of a registered device
+func (d *DeviceManager) DeviceReplaceCert(u uuid.UUID, cert *x509.Certificate) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cert == nil {
+		return fmt.Errorf("invalid nil certificate")
+	}
+	dev, ok := d.devices[u]
+	if !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	certStr := string(cert.Raw)
+	if owner, ok := d.deviceCerts[certStr]; ok {
+		if owner == u {
+			return nil
+		}
+		return &common.UsedCertError{Err: fmt.Sprintf("certificate already used by device %s", owner)}
+	}
+	for c, owner := range d.deviceCerts {
+		if owner == u {
+			delete(d.deviceCerts, c)
+		}
+	}
+	d.deviceCerts[certStr] = u
+	dev.Cert = cert
+	d.devices[u] = dev
+	return nil
+}
+
 // OnboardRegister register a new onboard certificate and its serials or update an existing one
 func (d *DeviceManager) OnboardRegister(cert *x509.Certificate, serial []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if cert == nil {
 		return fmt.Errorf("empty nil certificate")
 	}
@@ -283,15 +445,22 @@ func (d *DeviceManager) OnboardRegister(cert *x509.Certificate, serial []string)
 
 // WriteRequest record a request
 func (d *DeviceManager) WriteRequest(u uuid.UUID, b []byte) error {
-	if dev, ok := d.devices[u]; ok {
-		dev.AddRequest(b)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// make sure it is not nil
+	if len(b) < 1 {
 		return nil
 	}
+	if dev, ok := d.devices[u]; ok {
+		return dev.AddRequest(b)
+	}
 	return fmt.Errorf("device not found: %s", u)
 }
 
 // WriteInfo write an info message
 func (d *DeviceManager) WriteInfo(u uuid.UUID, b []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	// make sure it is not nil
 	if len(b) < 1 {
 		return nil
@@ -301,6 +470,9 @@ func (d *DeviceManager) WriteInfo(u uuid.UUID, b []byte) error {
 	if !ok {
 		return fmt.Errorf("unregistered device UUID %s", u)
 	}
+	if err := d.quotas.Use(u, common.KindInfo, len(b)); err != nil {
+		return err
+	}
 	// append the messages
 	dev.AddInfo(b)
 	d.devices[u] = dev
@@ -309,6 +481,8 @@ func (d *DeviceManager) WriteInfo(u uuid.UUID, b []byte) error {
 
 // WriteLogs write a message of logs
 func (d *DeviceManager) WriteLogs(u uuid.UUID, b []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	// make sure it is not nil
 	if len(b) < 1 {
 		return nil
@@ -319,6 +493,9 @@ func (d *DeviceManager) WriteLogs(u uuid.UUID, b []byte) error {
 	if !ok {
 		return fmt.Errorf("unregistered device UUID %s", u)
 	}
+	if err := d.quotas.Use(u, common.KindLogs, len(b)); err != nil {
+		return err
+	}
 	// append the messages
 	// each slice in dev.logs is allowed up to `memoryLogSlicePart` of the total maxSize
 	dev.AddLogs(b)
@@ -339,6 +516,8 @@ func (d *DeviceManager) appExists(u, instanceID uuid.UUID) bool {
 
 // WriteAppInstanceLogs write a message of AppInstanceLogBundle
 func (d *DeviceManager) WriteAppInstanceLogs(instanceID uuid.UUID, deviceID uuid.UUID, b []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	// make sure it is not nil
 	if len(b) < 1 {
 		return nil
@@ -347,6 +526,9 @@ func (d *DeviceManager) WriteAppInstanceLogs(instanceID uuid.UUID, deviceID uuid
 	if !ok {
 		return fmt.Errorf("unregistered device UUID %s", deviceID)
 	}
+	if err := d.quotas.Use(deviceID, common.KindAppLogs, len(b)); err != nil {
+		return err
+	}
 	if !d.appExists(deviceID, instanceID) {
 		d.devices[deviceID].AppLogs[instanceID] = &ByteSlice{
 			maxSize: d.maxAppLogsSize,
@@ -357,6 +539,8 @@ func (d *DeviceManager) WriteAppInstanceLogs(instanceID uuid.UUID, deviceID uuid
 
 // WriteMetrics write a metrics message
 func (d *DeviceManager) WriteMetrics(u uuid.UUID, b []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	// make sure it is not nil
 	if len(b) < 1 {
 		return nil
@@ -366,6 +550,9 @@ func (d *DeviceManager) WriteMetrics(u uuid.UUID, b []byte) error {
 	if !ok {
 		return fmt.Errorf("unregistered device UUID %s", u)
 	}
+	if err := d.quotas.Use(u, common.KindMetrics, len(b)); err != nil {
+		return err
+	}
 	// append the messages
 	dev.AddMetrics(b)
 	d.devices[u] = dev
@@ -374,6 +561,8 @@ func (d *DeviceManager) WriteMetrics(u uuid.UUID, b []byte) error {
 
 // GetConfig retrieve the config for a particular device
 func (d *DeviceManager) GetConfig(u uuid.UUID) ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	// look up the device by uuid
 	dev, ok := d.devices[u]
 	if !ok {
@@ -384,6 +573,8 @@ func (d *DeviceManager) GetConfig(u uuid.UUID) ([]byte, error) {
 
 // SetConfig set the config for a particular device
 func (d *DeviceManager) SetConfig(u uuid.UUID, b []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	// look up the device by uuid
 	dev, ok := d.devices[u]
 	if !ok {
@@ -393,6 +584,26 @@ func (d *DeviceManager) SetConfig(u uuid.UUID, b []byte) error {
 		return fmt.Errorf("empty configuration")
 	}
 	dev.Config = b
+	d.devices[u] = dev
+	return nil
+}
+
+// SwapConfig set the config for a particular device, if it is still old
+func (d *DeviceManager) SwapConfig(u uuid.UUID, old, b []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev, ok := d.devices[u]
+	if !ok {
+		return fmt.Errorf("unregistered device UUID %s", u.String())
+	}
+	if len(b) < 1 {
+		return fmt.Errorf("empty configuration")
+	}
+	if !bytes.Equal(dev.Config, old) {
+		return &common.ConfigConflictError{Err: fmt.Sprintf("config of %s changed", u), Current: dev.Config}
+	}
+	dev.Config = b
+	d.devices[u] = dev
 	return nil
 }
 
@@ -401,11 +612,8 @@ func (d *DeviceManager) SetConfig(u uuid.UUID, b []byte) error {
 func (d *DeviceManager) checkValidOnboardSerial(cert *x509.Certificate, serial string) error {
 	certStr := string(cert.Raw)
 	if c, ok := d.onboardCerts[certStr]; ok {
-		// accept the specific serial or the wildcard
-		if _, ok := c[serial]; ok {
-			return nil
-		}
-		if _, ok := c["*"]; ok {
+		// accept the specific serial, the wildcard, or a pattern or range matching it
+		if common.MatchSerials(c, serial) {
 			return nil
 		}
 		return &common.InvalidSerialError{Err: fmt.Sprintf("unknown serial: %s", serial)}
@@ -417,6 +625,10 @@ func (d *DeviceManager) checkValidOnboardSerial(cert *x509.Certificate, serial s
 func (d *DeviceManager) getOnboardSerialDevice(cert *x509.Certificate, serial string) *uuid.UUID {
 	certStr := string(cert.Raw)
 	for uid, dev := range d.devices {
+		// devices added by an admin may have no onboarding certificate
+		if dev.Onboard == nil {
+			continue
+		}
 		dCertStr := string(dev.Onboard.Raw)
 		if dCertStr == certStr && serial == dev.Serial {
 			return &uid
@@ -427,6 +639,8 @@ func (d *DeviceManager) getOnboardSerialDevice(cert *x509.Certificate, serial st
 
 // GetLogsReader get the logs for a given uuid
 func (d *DeviceManager) GetLogsReader(u uuid.UUID) (io.Reader, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	// look up the device by uuid
 	dev, ok := d.devices[u]
 	if !ok {
@@ -437,6 +651,8 @@ func (d *DeviceManager) GetLogsReader(u uuid.UUID) (io.Reader, error) {
 
 // GetInfoReader get the info for a given uuid
 func (d *DeviceManager) GetInfoReader(u uuid.UUID) (io.Reader, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	// look up the device by uuid
 	dev, ok := d.devices[u]
 	if !ok {
@@ -445,8 +661,22 @@ func (d *DeviceManager) GetInfoReader(u uuid.UUID) (io.Reader, error) {
 	return dev.Info.Reader()
 }
 
+// GetMetricsReader get the metrics for a given uuid
+func (d *DeviceManager) GetMetricsReader(u uuid.UUID) (io.Reader, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	// look up the device by uuid
+	dev, ok := d.devices[u]
+	if !ok {
+		return nil, fmt.Errorf("unregistered device UUID %s", u.String())
+	}
+	return dev.Metrics.Reader()
+}
+
 // GetRequestsReader get the requests for a given uuid
 func (d *DeviceManager) GetRequestsReader(u uuid.UUID) (io.Reader, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	// look up the device by uuid
 	dev, ok := d.devices[u]
 	if !ok {
@@ -454,3 +684,476 @@ func (d *DeviceManager) GetRequestsReader(u uuid.UUID) (io.Reader, error) {
 	}
 	return dev.Requests.Reader()
 }
+
+// WriteAudit append a record to the audit log
+func (d *DeviceManager) WriteAudit(b []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.audit == nil {
+		d.audit = &ByteSlice{maxSize: maxAuditSizeMemory}
+	}
+	_, err := d.audit.Write(b)
+	return err
+}
+
+// GetAuditReader get the audit log
+func (d *DeviceManager) GetAuditReader() (io.Reader, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.audit == nil {
+		return &ByteSlice{}, nil
+	}
+	return d.audit.Reader()
+}
+
+// DeviceUsage get the bytes and messages of each kind held for a device
+func (d *DeviceManager) DeviceUsage(u uuid.UUID) (*common.DeviceUsage, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	dev, ok := d.devices[u]
+	if !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	usage := common.NewDeviceUsage(u.String())
+	for kind, stream := range map[string]common.BigData{
+		common.KindLogs:     dev.Logs,
+		common.KindInfo:     dev.Info,
+		common.KindMetrics:  dev.Metrics,
+		common.KindRequests: dev.Requests,
+	} {
+		if bs, ok := stream.(*ByteSlice); ok {
+			usage.Add(kind, bs.usage())
+		}
+	}
+	for _, stream := range dev.AppLogs {
+		if bs, ok := stream.(*ByteSlice); ok {
+			usage.Add(common.KindAppLogs, bs.usage())
+		}
+	}
+	return usage, nil
+}
+
+// SetQuotas set the quotas of devices without their own, and the period over which byte quotas are counted.
+// Stream lengths do not apply, as memory is limited by size
+func (d *DeviceManager) SetQuotas(q common.Quotas, period time.Duration) {
+	d.quotas.SetGlobal(q, period)
+}
+
+// GetDeviceQuotas get the quotas set for a device, nil if it uses the global ones
+func (d *DeviceManager) GetDeviceQuotas(u uuid.UUID) (*common.Quotas, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	return d.quotas.Device(u), nil
+}
+
+// SetDeviceQuotas set the quotas of a device, overriding the global ones; nil removes them
+func (d *DeviceManager) SetDeviceQuotas(u uuid.UUID, q *common.Quotas) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	d.quotas.SetDevice(u, q)
+	return nil
+}
+
+// GetConfigAck get the config a device last reported having, nil if it has not reported any
+func (d *DeviceManager) GetConfigAck(u uuid.UUID) (*common.ConfigAck, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	ack, ok := d.acks[u]
+	if !ok {
+		return nil, nil
+	}
+	return &ack, nil
+}
+
+// SetConfigAck record the config a device reported having
+func (d *DeviceManager) SetConfigAck(u uuid.UUID, ack *common.ConfigAck) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if d.acks == nil {
+		d.acks = map[uuid.UUID]common.ConfigAck{}
+	}
+	d.acks[u] = *ack
+	return nil
+}
+
+// GetInventory get the current state of a device, from its info messages, nil if it has not sent any
+func (d *DeviceManager) GetInventory(u uuid.UUID) (*common.Inventory, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	inv, ok := d.inventories[u]
+	if !ok {
+		return nil, nil
+	}
+	return &inv, nil
+}
+
+// SetInventory record the current state of a device
+func (d *DeviceManager) SetInventory(u uuid.UUID, inv *common.Inventory) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if d.inventories == nil {
+		d.inventories = map[uuid.UUID]common.Inventory{}
+	}
+	d.inventories[u] = *inv
+	return nil
+}
+
+// GetLogFilter get the filter of the logs of a device, nil if it uses the global one
+func (d *DeviceManager) GetLogFilter(u uuid.UUID) (*common.LogFilter, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	f, ok := d.logFilters[u]
+	if !ok {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+// SetLogFilter set the filter of the logs of a device, overriding the global one; nil removes it
+func (d *DeviceManager) SetLogFilter(u uuid.UUID, f *common.LogFilter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if f == nil {
+		delete(d.logFilters, u)
+		return nil
+	}
+	if d.logFilters == nil {
+		d.logFilters = map[uuid.UUID]common.LogFilter{}
+	}
+	d.logFilters[u] = *f
+	return nil
+}
+
+// GetLocalProfile get the local profile server state of a device, nil if it has none
+func (d *DeviceManager) GetLocalProfile(u uuid.UUID) (*common.LocalProfile, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	p, ok := d.localProfiles[u]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// SetLocalProfile set the local profile server state of a device; nil removes it
+func (d *DeviceManager) SetLocalProfile(u uuid.UUID, p *common.LocalProfile) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if p == nil {
+		delete(d.localProfiles, u)
+		return nil
+	}
+	if d.localProfiles == nil {
+		d.localProfiles = map[uuid.UUID]common.LocalProfile{}
+	}
+	d.localProfiles[u] = *p
+	return nil
+}
+
+// GetDeviceMetadata get the metadata of a device, nil if none is recorded
+func (d *DeviceManager) GetDeviceMetadata(u uuid.UUID) (*common.DeviceMetadata, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	m, ok := d.metadata[u]
+	if !ok {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+// SetDeviceMetadata set the metadata of a device, replacing any recorded; nil removes it
+func (d *DeviceManager) SetDeviceMetadata(u uuid.UUID, m *common.DeviceMetadata) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if m == nil {
+		delete(d.metadata, u)
+		return nil
+	}
+	if d.metadata == nil {
+		d.metadata = map[uuid.UUID]common.DeviceMetadata{}
+	}
+	d.metadata[u] = *m
+	return nil
+}
+
+// GetDeviceModel get the name of the hardware model of a device, empty if it has none
+func (d *DeviceManager) GetDeviceModel(u uuid.UUID) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return "", &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	return d.deviceModels[u], nil
+}
+
+// SetDeviceModel set the name of the hardware model of a device; empty removes it
+func (d *DeviceManager) SetDeviceModel(u uuid.UUID, model string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if model == "" {
+		delete(d.deviceModels, u)
+		return nil
+	}
+	if d.deviceModels == nil {
+		d.deviceModels = map[uuid.UUID]string{}
+	}
+	d.deviceModels[u] = model
+	return nil
+}
+
+// GetAppCommands get the commands to the app instances of a device, nil if it has none
+func (d *DeviceManager) GetAppCommands(u uuid.UUID) ([]common.AppCommand, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	return append([]common.AppCommand(nil), d.appCommands[u]...), nil
+}
+
+// SetAppCommands set the commands to the app instances of a device; none removes them
+func (d *DeviceManager) SetAppCommands(u uuid.UUID, commands []common.AppCommand) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if len(commands) == 0 {
+		delete(d.appCommands, u)
+		return nil
+	}
+	if d.appCommands == nil {
+		d.appCommands = map[uuid.UUID][]common.AppCommand{}
+	}
+	d.appCommands[u] = append([]common.AppCommand(nil), commands...)
+	return nil
+}
+
+// GetDeviceFlags get the flags of a device, nil if it has none
+func (d *DeviceManager) GetDeviceFlags(u uuid.UUID) (*common.DeviceFlags, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	flags, ok := d.deviceFlags[u]
+	if !ok {
+		return nil, nil
+	}
+	flags.Flags = append([]string(nil), flags.Flags...)
+	return &flags, nil
+}
+
+// SetDeviceFlags set the flags of a device, replacing any; nil removes them
+func (d *DeviceManager) SetDeviceFlags(u uuid.UUID, flags *common.DeviceFlags) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if flags == nil {
+		delete(d.deviceFlags, u)
+		return nil
+	}
+	if d.deviceFlags == nil {
+		d.deviceFlags = map[uuid.UUID]common.DeviceFlags{}
+	}
+	v := *flags
+	v.Flags = append([]string(nil), flags.Flags...)
+	d.deviceFlags[u] = v
+	return nil
+}
+
+// GetQuarantine get the quarantine of a device, nil if it is not quarantined
+func (d *DeviceManager) GetQuarantine(u uuid.UUID) (*common.Quarantine, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	q, ok := d.quarantines[u]
+	if !ok {
+		return nil, nil
+	}
+	return &q, nil
+}
+
+// SetQuarantine quarantine a device, replacing any quarantine; nil releases it
+func (d *DeviceManager) SetQuarantine(u uuid.UUID, q *common.Quarantine) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if q == nil {
+		delete(d.quarantines, u)
+		return nil
+	}
+	if d.quarantines == nil {
+		d.quarantines = map[uuid.UUID]common.Quarantine{}
+	}
+	d.quarantines[u] = *q
+	return nil
+}
+
+// GetDeviceSources get where the requests of a device came from, the most recently seen first, nil if none is recorded
+func (d *DeviceManager) GetDeviceSources(u uuid.UUID) ([]common.DeviceSource, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	return append([]common.DeviceSource(nil), d.sources[u]...), nil
+}
+
+// SetDeviceSources set where the requests of a device came from, replacing those recorded; none removes them
+func (d *DeviceManager) SetDeviceSources(u uuid.UUID, sources []common.DeviceSource) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if len(sources) == 0 {
+		delete(d.sources, u)
+		return nil
+	}
+	if d.sources == nil {
+		d.sources = map[uuid.UUID][]common.DeviceSource{}
+	}
+	d.sources[u] = append([]common.DeviceSource(nil), sources...)
+	return nil
+}
+
+// GetAttestation get the attestation of a device, nil if it has none
+func (d *DeviceManager) GetAttestation(u uuid.UUID) (*common.Attestation, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.devices[u]; !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	a, ok := d.attestations[u]
+	if !ok {
+		return nil, nil
+	}
+	c := copyAttestation(&a)
+	return &c, nil
+}
+
+// SetAttestation set the attestation of a device, replacing any; nil removes it
+func (d *DeviceManager) SetAttestation(u uuid.UUID, a *common.Attestation) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[u]; !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if a == nil {
+		delete(d.attestations, u)
+		return nil
+	}
+	if d.attestations == nil {
+		d.attestations = map[uuid.UUID]common.Attestation{}
+	}
+	d.attestations[u] = copyAttestation(a)
+	return nil
+}
+
+// PutRecord add a record of a kind, or replace the one with the same key
+func (d *DeviceManager) PutRecord(kind, key string, b []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.records == nil {
+		d.records = map[string]map[string][]byte{}
+	}
+	if d.records[kind] == nil {
+		d.records[kind] = map[string][]byte{}
+	}
+	d.records[kind][key] = append([]byte(nil), b...)
+	return nil
+}
+
+// GetRecord get a record of a kind by key
+func (d *DeviceManager) GetRecord(kind, key string) ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	b, ok := d.records[kind][key]
+	if !ok {
+		return nil, common.RecordNotFound(kind, key)
+	}
+	return append([]byte(nil), b...), nil
+}
+
+// ListRecords list the records of a kind, by key
+func (d *DeviceManager) ListRecords(kind string) (map[string][]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	records := make(map[string][]byte, len(d.records[kind]))
+	for k, b := range d.records[kind] {
+		records[k] = append([]byte(nil), b...)
+	}
+	return records, nil
+}
+
+// RemoveRecord remove a record of a kind by key
+func (d *DeviceManager) RemoveRecord(kind, key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.records[kind][key]; !ok {
+		return common.RecordNotFound(kind, key)
+	}
+	delete(d.records[kind], key)
+	return nil
+}
+
+// copyAttestation copy an attestation, so that publishing a certificate or a key does not change the one stored until
+// it is set
+func copyAttestation(a *common.Attestation) common.Attestation {
+	c := *a
+	c.Certs = append([]common.AttestCert(nil), a.Certs...)
+	c.Keys = append([]common.VaultKey(nil), a.Keys...)
+	if a.PCRs != nil {
+		c.PCRs = make(map[string]string, len(a.PCRs))
+		for k, v := range a.PCRs {
+			c.PCRs[k] = v
+		}
+	}
+	return c
+}
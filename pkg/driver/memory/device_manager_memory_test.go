@@ -6,9 +6,14 @@ package memory
 import (
 	"bytes"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/lf-edge/adam/pkg/driver/common"
 	ax "github.com/lf-edge/adam/pkg/x509"
@@ -134,6 +139,43 @@ func TestDeviceManager(t *testing.T) {
 		}
 	})
 
+	t.Run("TestOnboardSerialPatterns", func(t *testing.T) {
+		certB, _, err := ax.Generate("CN=patterns", "localhost")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		dm := DeviceManager{}
+		if err := dm.OnboardRegister(cert, []string{"lab-1", "SN-2024-*", "re:^B[0-9]{3}$", "R-0100..R-0199"}); err != nil {
+			t.Fatalf("unexpected error registering onboarding certificate: %v", err)
+		}
+		tests := []struct {
+			serial string
+			valid  bool
+		}{
+			{"lab-1", true},
+			{"lab-2", false},
+			{"SN-2024-0042", true},
+			{"SN-2023-0042", false},
+			{"B123", true},
+			{"B1234", false},
+			{"R-0150", true},
+			{"R-0200", false},
+		}
+		for _, tt := range tests {
+			err := dm.OnboardCheck(cert, tt.serial)
+			switch {
+			case tt.valid && err != nil:
+				t.Errorf("%s: unexpected error: %v", tt.serial, err)
+			case !tt.valid && err == nil:
+				t.Errorf("%s: expected an error", tt.serial)
+			}
+		}
+	})
+
 	t.Run("TestOnboardRemove", func(t *testing.T) {
 		tests := []struct {
 			cn     string
@@ -250,6 +292,60 @@ func TestDeviceManager(t *testing.T) {
 		}
 	})
 
+	t.Run("TestOnboardPolicy", func(t *testing.T) {
+		d := DeviceManager{}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		if _, ok := d.OnboardPolicySet("policy", &common.OnboardPolicy{}).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting policy of unknown onboard cert")
+		}
+		certB, _, err := ax.Generate("policy", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		if err := d.OnboardRegister(cert, []string{"abc"}); err != nil {
+			t.Fatalf("unexpected error registering onboard cert: %v", err)
+		}
+		if p, err := d.OnboardPolicyGet("policy"); err != nil || p != nil {
+			t.Errorf("expected no policy, got %v %v", p, err)
+		}
+		p := &common.OnboardPolicy{SoftSerials: []string{"ACME-*"}, Models: []string{"X1 Gateway"}}
+		if err := d.OnboardPolicySet("policy", p); err != nil {
+			t.Fatalf("unexpected error setting policy: %v", err)
+		}
+		got, err := d.OnboardPolicyGet("policy")
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting policy: %v", err)
+		case !reflect.DeepEqual(got, p):
+			t.Errorf("mismatched policy, actual %v expected %v", got, p)
+		}
+		if err := d.OnboardPolicySet("policy", nil); err != nil {
+			t.Fatalf("unexpected error removing policy: %v", err)
+		}
+		if p, err := d.OnboardPolicyGet("policy"); err != nil || p != nil {
+			t.Errorf("expected no policy once removed, got %v %v", p, err)
+		}
+		// the policy goes with its onboard cert
+		if err := d.OnboardPolicySet("policy", p); err != nil {
+			t.Fatalf("unexpected error setting policy: %v", err)
+		}
+		if err := d.OnboardRemove("policy"); err != nil {
+			t.Fatalf("unexpected error removing onboard cert: %v", err)
+		}
+		if err := d.OnboardRegister(cert, []string{"abc"}); err != nil {
+			t.Fatalf("unexpected error registering onboard cert: %v", err)
+		}
+		if p, err := d.OnboardPolicyGet("policy"); err != nil || p != nil {
+			t.Errorf("expected no policy once the onboard cert was removed, got %v %v", p, err)
+		}
+	})
+
 	t.Run("TestDeviceCheckCert", func(t *testing.T) {
 		cn := "CN=abcdefg"
 		hosts := "localhost,127.0.0.1"
@@ -627,6 +723,1028 @@ func TestDeviceManager(t *testing.T) {
 		}
 	})
 
+	t.Run("TestDeviceReplaceCert", func(t *testing.T) {
+		d := DeviceManager{}
+		uids := fillDevice(&d)
+		u := *uids[0]
+		var otherCert *x509.Certificate
+		for certStr, owner := range d.deviceCerts {
+			if owner == *uids[1] {
+				otherCert, _ = x509.ParseCertificate([]byte(certStr))
+			}
+		}
+		certB, _, err := ax.Generate("rekeyed", "")
+		if err != nil {
+			t.Fatalf("error generating device cert for tests: %v", err)
+		}
+		newCert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing device certificate: %v", err)
+		}
+		unknown, _ := uuid.NewV4()
+
+		tests := []struct {
+			u    uuid.UUID
+			cert *x509.Certificate
+			err  error
+		}{
+			{u, nil, fmt.Errorf("invalid nil certificate")},
+			{unknown, newCert, fmt.Errorf("device uuid not found")},
+			{u, otherCert, fmt.Errorf("certificate already used by device")},
+			{u, newCert, nil},
+			{u, newCert, nil},
+		}
+		for i, tt := range tests {
+			err := d.DeviceReplaceCert(tt.u, tt.cert)
+			switch {
+			case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
+				t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
+			case err == nil:
+				if found, _ := d.DeviceCheckCert(tt.cert); found == nil || *found != tt.u {
+					t.Errorf("%d: new certificate not registered to device %s", i, tt.u)
+				}
+				if d.devices[tt.u].Cert != tt.cert {
+					t.Errorf("%d: mismatched device certificate stored", i)
+				}
+				count := 0
+				for _, owner := range d.deviceCerts {
+					if owner == tt.u {
+						count++
+					}
+				}
+				if count != 1 {
+					t.Errorf("%d: expected exactly one certificate for device, found %d", i, count)
+				}
+			}
+		}
+	})
+
+	t.Run("TestAudit", func(t *testing.T) {
+		d := DeviceManager{}
+		r, err := d.GetAuditReader()
+		if err != nil {
+			t.Fatalf("unexpected error getting empty audit reader: %v", err)
+		}
+		if b, _ := ioutil.ReadAll(r); len(b) != 0 {
+			t.Errorf("expected empty audit log, got %s", b)
+		}
+		records := []string{`{"action":"onboard-add"}`, `{"action":"device-remove"}`}
+		for _, rec := range records {
+			if err := d.WriteAudit([]byte(rec)); err != nil {
+				t.Fatalf("unexpected error writing audit record: %v", err)
+			}
+		}
+		r, err = d.GetAuditReader()
+		if err != nil {
+			t.Fatalf("unexpected error getting audit reader: %v", err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unexpected error reading audit log: %v", err)
+		}
+		expected := strings.Join(records, "\n") + "\n"
+		if string(b) != expected {
+			t.Errorf("mismatched audit log, actual %s expected %s", b, expected)
+		}
+	})
+
+	t.Run("TestDeviceQuotas", func(t *testing.T) {
+		d := DeviceManager{
+			deviceCerts: map[string]uuid.UUID{},
+		}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		d.SetQuotas(common.Quotas{MaxBytes: common.Limits{Default: 10}}, 0)
+		certB, _, err := ax.Generate("quotas", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+
+		if q, err := d.GetDeviceQuotas(u); err != nil || q != nil {
+			t.Errorf("expected no device quotas, got %v %v", q, err)
+		}
+		if err := d.WriteLogs(u, []byte("0123456789")); err != nil {
+			t.Fatalf("unexpected error writing logs: %v", err)
+		}
+		if _, ok := d.WriteLogs(u, []byte("0")).(*common.QuotaExceededError); !ok {
+			t.Errorf("expected quota exceeded error writing logs")
+		}
+		if err := d.WriteInfo(u, []byte("0123456789")); err != nil {
+			t.Errorf("unexpected error writing info: %v", err)
+		}
+
+		q := &common.Quotas{MaxBytes: common.Limits{Default: 100}}
+		if err := d.SetDeviceQuotas(u, q); err != nil {
+			t.Fatalf("unexpected error setting device quotas: %v", err)
+		}
+		if got, _ := d.GetDeviceQuotas(u); got != q {
+			t.Errorf("mismatched device quotas, actual %v expected %v", got, q)
+		}
+		if err := d.WriteLogs(u, []byte("0123456789")); err != nil {
+			t.Errorf("unexpected error writing logs with device quota: %v", err)
+		}
+
+		other, _ := uuid.NewV4()
+		if _, ok := d.SetDeviceQuotas(other, q).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting quotas of unknown device")
+		}
+	})
+
+	t.Run("TestDeviceUsage", func(t *testing.T) {
+		d := DeviceManager{
+			deviceCerts: map[string]uuid.UUID{},
+		}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("usage", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		app, _ := uuid.NewV4()
+		if _, err := d.DeviceUsage(u); err == nil {
+			t.Errorf("expected error getting usage of unknown device")
+		} else if _, ok := err.(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error getting usage of unknown device, got %v", err)
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		before := time.Now()
+		for _, b := range []string{"0123456789", "01234"} {
+			if err := d.WriteLogs(u, []byte(b)); err != nil {
+				t.Fatalf("unexpected error writing logs: %v", err)
+			}
+		}
+		if err := d.WriteAppInstanceLogs(app, u, []byte("012")); err != nil {
+			t.Fatalf("unexpected error writing app logs: %v", err)
+		}
+		usage, err := d.DeviceUsage(u)
+		if err != nil {
+			t.Fatalf("unexpected error getting usage: %v", err)
+		}
+		logs := usage.Kinds[common.KindLogs]
+		if logs.Bytes != 15 || logs.Entries != 2 {
+			t.Errorf("mismatched logs usage, actual %d bytes %d entries expected 15 bytes 2 entries", logs.Bytes, logs.Entries)
+		}
+		if logs.Oldest == nil || logs.Newest == nil || logs.Oldest.Before(before) || logs.Newest.Before(*logs.Oldest) {
+			t.Errorf("mismatched logs times, oldest %v newest %v written after %v", logs.Oldest, logs.Newest, before)
+		}
+		if info := usage.Kinds[common.KindInfo]; info.Entries != 0 || info.Oldest != nil {
+			t.Errorf("expected no info, got %+v", info)
+		}
+		if usage.Kinds[common.KindAppLogs].Bytes != 3 || usage.Bytes != 18 || usage.Entries != 3 {
+			t.Errorf("mismatched usage %+v", usage)
+		}
+	})
+
+	t.Run("TestConfigAck", func(t *testing.T) {
+		d := DeviceManager{
+			deviceCerts: map[string]uuid.UUID{},
+		}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("ack", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, ok := d.SetConfigAck(u, &common.ConfigAck{Hash: "abc"}).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting config ack of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if ack, err := d.GetConfigAck(u); err != nil || ack != nil {
+			t.Errorf("expected no config ack, got %v %v", ack, err)
+		}
+		ack := &common.ConfigAck{Hash: "abc", Config: []byte(`{"id":{}}`), Time: time.Now()}
+		if err := d.SetConfigAck(u, ack); err != nil {
+			t.Fatalf("unexpected error setting config ack: %v", err)
+		}
+		got, err := d.GetConfigAck(u)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting config ack: %v", err)
+		case got == nil || got.Hash != ack.Hash || string(got.Config) != string(ack.Config):
+			t.Errorf("mismatched config ack, actual %v expected %v", got, ack)
+		}
+		if err := d.DeviceRemove(&u); err != nil {
+			t.Fatalf("unexpected error removing device: %v", err)
+		}
+		if _, ok := d.acks[u]; ok {
+			t.Errorf("config ack not removed with the device")
+		}
+	})
+
+	t.Run("TestInventory", func(t *testing.T) {
+		d := DeviceManager{
+			deviceCerts: map[string]uuid.UUID{},
+		}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("inventory", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, ok := d.SetInventory(u, &common.Inventory{EVEVersion: "6.1.0"}).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting inventory of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if inv, err := d.GetInventory(u); err != nil || inv != nil {
+			t.Errorf("expected no inventory, got %v %v", inv, err)
+		}
+		inv := &common.Inventory{EVEVersion: "6.1.0", Apps: []common.InventoryApp{{UUID: "a0000000-0000-0000-0000-000000000000", State: "RUNNING"}}}
+		if err := d.SetInventory(u, inv); err != nil {
+			t.Fatalf("unexpected error setting inventory: %v", err)
+		}
+		got, err := d.GetInventory(u)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting inventory: %v", err)
+		case got == nil || got.EVEVersion != inv.EVEVersion || len(got.Apps) != 1 || got.Apps[0].State != inv.Apps[0].State:
+			t.Errorf("mismatched inventory, actual %v expected %v", got, inv)
+		}
+		if err := d.DeviceRemove(&u); err != nil {
+			t.Fatalf("unexpected error removing device: %v", err)
+		}
+		if _, ok := d.inventories[u]; ok {
+			t.Errorf("inventory not removed with the device")
+		}
+	})
+
+	t.Run("TestLogFilter", func(t *testing.T) {
+		d := DeviceManager{
+			deviceCerts: map[string]uuid.UUID{},
+		}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("logfilter", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, ok := d.SetLogFilter(u, &common.LogFilter{MinSeverity: "info"}).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting log filter of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if f, err := d.GetLogFilter(u); err != nil || f != nil {
+			t.Errorf("expected no log filter, got %v %v", f, err)
+		}
+		f := &common.LogFilter{MinSeverity: "info", Sample: 10}
+		if err := d.SetLogFilter(u, f); err != nil {
+			t.Fatalf("unexpected error setting log filter: %v", err)
+		}
+		got, err := d.GetLogFilter(u)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting log filter: %v", err)
+		case got == nil || *got != *f:
+			t.Errorf("mismatched log filter, actual %v expected %v", got, f)
+		}
+		if err := d.SetLogFilter(u, nil); err != nil {
+			t.Fatalf("unexpected error removing log filter: %v", err)
+		}
+		if f, err := d.GetLogFilter(u); err != nil || f != nil {
+			t.Errorf("expected no log filter once removed, got %v %v", f, err)
+		}
+	})
+
+	t.Run("TestLocalProfile", func(t *testing.T) {
+		d := DeviceManager{
+			deviceCerts: map[string]uuid.UUID{},
+		}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("profile", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, ok := d.SetLocalProfile(u, &common.LocalProfile{Token: "abc"}).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting local profile of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if p, err := d.GetLocalProfile(u); err != nil || p != nil {
+			t.Errorf("expected no local profile, got %v %v", p, err)
+		}
+		p := &common.LocalProfile{Token: "abc", Profile: "emergency", RadioSilence: true}
+		if err := d.SetLocalProfile(u, p); err != nil {
+			t.Fatalf("unexpected error setting local profile: %v", err)
+		}
+		got, err := d.GetLocalProfile(u)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting local profile: %v", err)
+		case got == nil || *got != *p:
+			t.Errorf("mismatched local profile, actual %v expected %v", got, p)
+		}
+		if err := d.SetLocalProfile(u, nil); err != nil {
+			t.Fatalf("unexpected error removing local profile: %v", err)
+		}
+		if p, err := d.GetLocalProfile(u); err != nil || p != nil {
+			t.Errorf("expected no local profile once removed, got %v %v", p, err)
+		}
+	})
+
+	t.Run("TestDeviceMetadata", func(t *testing.T) {
+		d := DeviceManager{
+			deviceCerts: map[string]uuid.UUID{},
+		}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("metadata", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, ok := d.SetDeviceMetadata(u, &common.DeviceMetadata{Name: "gw-1"}).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting metadata of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if p, err := d.GetDeviceMetadata(u); err != nil || p != nil {
+			t.Errorf("expected no metadata, got %v %v", p, err)
+		}
+		p := &common.DeviceMetadata{Name: "gw-1", Site: "berlin", Owner: "ops", Tags: map[string]string{"rack": "4"}}
+		if err := d.SetDeviceMetadata(u, p); err != nil {
+			t.Fatalf("unexpected error setting metadata: %v", err)
+		}
+		got, err := d.GetDeviceMetadata(u)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting metadata: %v", err)
+		case !reflect.DeepEqual(got, p):
+			t.Errorf("mismatched metadata, actual %v expected %v", got, p)
+		}
+		if err := d.SetDeviceMetadata(u, nil); err != nil {
+			t.Fatalf("unexpected error removing metadata: %v", err)
+		}
+		if p, err := d.GetDeviceMetadata(u); err != nil || p != nil {
+			t.Errorf("expected no metadata once removed, got %v %v", p, err)
+		}
+	})
+
+	t.Run("TestDeviceModel", func(t *testing.T) {
+		d := DeviceManager{
+			deviceCerts: map[string]uuid.UUID{},
+		}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("model", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		if _, ok := d.SetDeviceModel(u, "x1").(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting hardware model of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if model, err := d.GetDeviceModel(u); err != nil || model != "" {
+			t.Errorf("expected no hardware model, got %q %v", model, err)
+		}
+		if err := d.SetDeviceModel(u, "x1"); err != nil {
+			t.Fatalf("unexpected error setting hardware model: %v", err)
+		}
+		if model, err := d.GetDeviceModel(u); err != nil || model != "x1" {
+			t.Errorf("mismatched hardware model, actual %q %v expected x1", model, err)
+		}
+		if err := d.SetDeviceModel(u, ""); err != nil {
+			t.Fatalf("unexpected error removing hardware model: %v", err)
+		}
+		if model, err := d.GetDeviceModel(u); err != nil || model != "" {
+			t.Errorf("expected no hardware model once removed, got %q %v", model, err)
+		}
+	})
+	t.Run("TestAppCommands", func(t *testing.T) {
+		d := DeviceManager{
+			deviceCerts: map[string]uuid.UUID{},
+		}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("commands", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		commands := []common.AppCommand{{ID: "1", App: "a", Command: common.AppRestart, State: common.AppCommandQueued, Created: time.Now().UTC().Truncate(time.Second)}}
+		if _, ok := d.SetAppCommands(u, commands).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting app commands of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if got, err := d.GetAppCommands(u); err != nil || len(got) != 0 {
+			t.Errorf("expected no app commands, got %v %v", got, err)
+		}
+		if err := d.SetAppCommands(u, commands); err != nil {
+			t.Fatalf("unexpected error setting app commands: %v", err)
+		}
+		if got, err := d.GetAppCommands(u); err != nil || len(got) != 1 || got[0].ID != commands[0].ID || got[0].State != commands[0].State {
+			t.Errorf("mismatched app commands, actual %v %v expected %v", got, err, commands)
+		}
+		if err := d.SetAppCommands(u, nil); err != nil {
+			t.Fatalf("unexpected error removing app commands: %v", err)
+		}
+		if got, err := d.GetAppCommands(u); err != nil || len(got) != 0 {
+			t.Errorf("expected no app commands once removed, got %v %v", got, err)
+		}
+	})
+	t.Run("TestDeviceFlags", func(t *testing.T) {
+		d := DeviceManager{
+			deviceCerts: map[string]uuid.UUID{},
+		}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("flags", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		flags := &common.DeviceFlags{Flags: []string{common.FlagHoldConfig, common.FlagReadOnly}, Held: []byte(`{"id":{"version":"2"}}`), HeldVersion: "2", Updated: time.Now().UTC().Truncate(time.Second)}
+		if _, ok := d.SetDeviceFlags(u, flags).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error setting flags of unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if got, err := d.GetDeviceFlags(u); err != nil || got != nil {
+			t.Errorf("expected no flags, got %v %v", got, err)
+		}
+		if err := d.SetDeviceFlags(u, flags); err != nil {
+			t.Fatalf("unexpected error setting flags: %v", err)
+		}
+		if got, err := d.GetDeviceFlags(u); err != nil || !reflect.DeepEqual(got, flags) {
+			t.Errorf("mismatched flags, actual %v %v expected %v", got, err, flags)
+		}
+		if err := d.SetDeviceFlags(u, nil); err != nil {
+			t.Fatalf("unexpected error removing flags: %v", err)
+		}
+		if got, err := d.GetDeviceFlags(u); err != nil || got != nil {
+			t.Errorf("expected no flags once removed, got %v %v", got, err)
+		}
+	})
+	t.Run("TestQuarantine", func(t *testing.T) {
+		d := DeviceManager{
+			deviceCerts: map[string]uuid.UUID{},
+		}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		certB, _, err := ax.Generate("quarantine", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		u, _ := uuid.NewV4()
+		q := &common.Quarantine{Reason: "suspected compromise", Since: time.Now().UTC().Truncate(time.Second), Actor: "token:ops", Version: "2"}
+		if _, ok := d.SetQuarantine(u, q).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error quarantining unknown device")
+		}
+		if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+			t.Fatalf("unexpected error registering device: %v", err)
+		}
+		if got, err := d.GetQuarantine(u); err != nil || got != nil {
+			t.Errorf("expected no quarantine, got %v %v", got, err)
+		}
+		if err := d.SetQuarantine(u, q); err != nil {
+			t.Fatalf("unexpected error quarantining: %v", err)
+		}
+		if got, err := d.GetQuarantine(u); err != nil || !reflect.DeepEqual(got, q) {
+			t.Errorf("mismatched quarantine, actual %v %v expected %v", got, err, q)
+		}
+		if err := d.SetQuarantine(u, nil); err != nil {
+			t.Fatalf("unexpected error releasing: %v", err)
+		}
+		if got, err := d.GetQuarantine(u); err != nil || got != nil {
+			t.Errorf("expected no quarantine once released, got %v %v", got, err)
+		}
+	})
+
+	t.Run("TestPending", func(t *testing.T) {
+		d := DeviceManager{}
+		certB, _, err := ax.Generate("device", "")
+		if err != nil {
+			t.Fatalf("error generating cert for tests: %v", err)
+		}
+		cert, err := x509.ParseCertificate(certB)
+		if err != nil {
+			t.Fatalf("unexpected error parsing certificate: %v", err)
+		}
+		p := common.NewPendingDevice(cert, cert, "abcdef")
+		if _, ok := common.PendingRemove(&d, p.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown pending device")
+		}
+		if err := common.PendingAdd(&d, p); err != nil {
+			t.Fatalf("unexpected error adding pending device: %v", err)
+		}
+		p.Attempts = 2
+		if err := common.PendingAdd(&d, p); err != nil {
+			t.Fatalf("unexpected error replacing pending device: %v", err)
+		}
+		got, err := common.PendingGet(&d, p.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting pending device: %v", err)
+		case got.Serial != "abcdef" || got.Attempts != 2:
+			t.Errorf("mismatched pending device, actual %v expected %v", got, p)
+		}
+		list, err := common.PendingList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one pending device, got %v %v", list, err)
+		}
+		if err := common.PendingRemove(&d, p.ID); err != nil {
+			t.Errorf("unexpected error removing pending device: %v", err)
+		}
+		if _, err := common.PendingGet(&d, p.ID); err == nil {
+			t.Errorf("expected error getting removed pending device")
+		}
+	})
+
+	t.Run("TestTokens", func(t *testing.T) {
+		d := DeviceManager{}
+		token, _, err := common.NewAPIToken("ci", []string{"a8e0f3e4-5e0f-4b4a-8c61-3f2e3f0d7d1a"}, true, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating token: %v", err)
+		}
+		if _, ok := common.TokenRemove(&d, token.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown token")
+		}
+		if err := common.TokenAdd(&d, token); err != nil {
+			t.Fatalf("unexpected error adding token: %v", err)
+		}
+		got, err := common.TokenGet(&d, token.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting token: %v", err)
+		case got.Hash != token.Hash || !got.ReadOnly || len(got.Devices) != 1 || got.Devices[0] != token.Devices[0]:
+			t.Errorf("mismatched token, actual %v expected %v", got, token)
+		}
+		list, err := common.TokenList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one token, got %v %v", list, err)
+		}
+		if err := common.TokenRemove(&d, token.ID); err != nil {
+			t.Errorf("unexpected error removing token: %v", err)
+		}
+		if _, err := common.TokenGet(&d, token.ID); err == nil {
+			t.Errorf("expected error getting removed token")
+		}
+	})
+
+	t.Run("TestRollouts", func(t *testing.T) {
+		d := DeviceManager{}
+		ro := common.NewRollout("4b1f8f50-6c3a-4c8e-9d2e-0d1b8f5a7c11", "dns", []string{"a8e0f3e4-5e0f-4b4a-8c61-3f2e3f0d7d1a", "c1d3f2a4-9b8e-4f0a-8d1c-2e3f4a5b6c7d"}, 50)
+		ro.Patch = []byte(`{"configItems":[]}`)
+		if _, ok := common.RolloutRemove(&d, ro.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown rollout")
+		}
+		if _, err := common.RolloutGet(&d, ro.ID); err == nil {
+			t.Errorf("expected error getting unknown rollout")
+		}
+		if err := common.RolloutSet(&d, ro); err != nil {
+			t.Fatalf("unexpected error adding rollout: %v", err)
+		}
+		// record progress, replacing the rollout
+		ro.Devices[0].Status = common.RolloutDeviceApplied
+		ro.Devices[0].Hash = "abc"
+		if err := common.RolloutSet(&d, ro); err != nil {
+			t.Fatalf("unexpected error setting rollout: %v", err)
+		}
+		got, err := common.RolloutGet(&d, ro.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting rollout: %v", err)
+		case got.Name != ro.Name || string(got.Patch) != string(ro.Patch) || len(got.Devices) != 2 ||
+			got.Devices[0].Status != common.RolloutDeviceApplied || got.Devices[0].Hash != "abc" || got.Devices[1].Wave != 1:
+			t.Errorf("mismatched rollout, actual %v expected %v", got, ro)
+		}
+		list, err := common.RolloutList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one rollout, got %v %v", list, err)
+		}
+		if err := common.RolloutRemove(&d, ro.ID); err != nil {
+			t.Errorf("unexpected error removing rollout: %v", err)
+		}
+		if _, err := common.RolloutGet(&d, ro.ID); err == nil {
+			t.Errorf("expected error getting removed rollout")
+		}
+	})
+
+	t.Run("TestAlertRules", func(t *testing.T) {
+		d := DeviceManager{}
+		rule := &common.AlertRule{
+			ID:      "6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c",
+			Name:    "cpu",
+			Serials: []string{"lab-*"},
+			Metric:  "dm.cpuMetric.total",
+			Op:      ">",
+			Value:   90,
+			Actions: []common.AlertAction{{Type: common.AlertWebhook, URL: "https://example.com/hook"}},
+		}
+		if _, ok := common.AlertRuleRemove(&d, rule.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown alert rule")
+		}
+		if err := common.AlertRuleAdd(&d, rule); err != nil {
+			t.Fatalf("unexpected error adding alert rule: %v", err)
+		}
+		got, err := common.AlertRuleGet(&d, rule.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting alert rule: %v", err)
+		case got.Metric != rule.Metric || got.Value != rule.Value || len(got.Serials) != 1 || len(got.Actions) != 1 || got.Actions[0] != rule.Actions[0]:
+			t.Errorf("mismatched alert rule, actual %v expected %v", got, rule)
+		}
+		list, err := common.AlertRuleList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one alert rule, got %v %v", list, err)
+		}
+		if err := common.AlertRuleRemove(&d, rule.ID); err != nil {
+			t.Errorf("unexpected error removing alert rule: %v", err)
+		}
+		if _, err := common.AlertRuleGet(&d, rule.ID); err == nil {
+			t.Errorf("expected error getting removed alert rule")
+		}
+	})
+	t.Run("TestSnapshots", func(t *testing.T) {
+		d := DeviceManager{}
+		snap := &common.ConfigSnapshot{
+			Name:    "golden",
+			Source:  "6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c",
+			Config:  json.RawMessage(`{"maintenanceMode":true}`),
+			Default: true,
+			Created: time.Now().UTC().Truncate(time.Second),
+		}
+		if _, ok := common.SnapshotRemove(&d, snap.Name).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown config snapshot")
+		}
+		if err := common.SnapshotAdd(&d, snap); err != nil {
+			t.Fatalf("unexpected error adding config snapshot: %v", err)
+		}
+		got, err := common.SnapshotGet(&d, snap.Name)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting config snapshot: %v", err)
+		case got.Name != snap.Name || string(got.Config) != string(snap.Config) || !got.Default || !got.Created.Equal(snap.Created):
+			t.Errorf("mismatched config snapshot, actual %v expected %v", got, snap)
+		}
+		list, err := common.SnapshotList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one config snapshot, got %v %v", list, err)
+		}
+		if err := common.SnapshotRemove(&d, snap.Name); err != nil {
+			t.Errorf("unexpected error removing config snapshot: %v", err)
+		}
+		if _, err := common.SnapshotGet(&d, snap.Name); err == nil {
+			t.Errorf("expected error getting removed config snapshot")
+		}
+	})
+	t.Run("TestHardwareModels", func(t *testing.T) {
+		d := DeviceManager{}
+		m := &common.HardwareModel{
+			Name:        "x1",
+			Description: "ACME X1",
+			Config:      json.RawMessage(`{"deviceIoList":[{"ptype":"PhyIoNetEth","phylabel":"eth0"}]}`),
+			Updated:     time.Now().UTC().Truncate(time.Second),
+		}
+		if _, ok := common.HardwareModelRemove(&d, m.Name).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown hardware model")
+		}
+		if err := common.HardwareModelAdd(&d, m); err != nil {
+			t.Fatalf("unexpected error adding hardware model: %v", err)
+		}
+		got, err := common.HardwareModelGet(&d, m.Name)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting hardware model: %v", err)
+		case got.Name != m.Name || got.Description != m.Description || string(got.Config) != string(m.Config) || !got.Updated.Equal(m.Updated):
+			t.Errorf("mismatched hardware model, actual %v expected %v", got, m)
+		}
+		list, err := common.HardwareModelList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one hardware model, got %v %v", list, err)
+		}
+		if err := common.HardwareModelRemove(&d, m.Name); err != nil {
+			t.Errorf("unexpected error removing hardware model: %v", err)
+		}
+		if _, err := common.HardwareModelGet(&d, m.Name); err == nil {
+			t.Errorf("expected error getting removed hardware model")
+		}
+	})
+	t.Run("TestDatastores", func(t *testing.T) {
+		d := DeviceManager{}
+		m := &common.Datastore{
+			Name:    "hub",
+			ID:      "2c0b4e91-8a57-4b0e-9c2e-3a3f1e0c2f11",
+			Config:  json.RawMessage(`{"dType":"DsContainerRegistry","fqdn":"docker://docker.io"}`),
+			Updated: time.Now().UTC().Truncate(time.Second),
+		}
+		if _, ok := common.DatastoreRemove(&d, m.Name).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown datastore")
+		}
+		if err := common.DatastoreAdd(&d, m); err != nil {
+			t.Fatalf("unexpected error adding datastore: %v", err)
+		}
+		got, err := common.DatastoreGet(&d, m.Name)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting datastore: %v", err)
+		case got.Name != m.Name || got.ID != m.ID || string(got.Config) != string(m.Config) || !got.Updated.Equal(m.Updated):
+			t.Errorf("mismatched datastore, actual %v expected %v", got, m)
+		}
+		list, err := common.DatastoreList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one datastore, got %v %v", list, err)
+		}
+		if err := common.DatastoreRemove(&d, m.Name); err != nil {
+			t.Errorf("unexpected error removing datastore: %v", err)
+		}
+		if _, err := common.DatastoreGet(&d, m.Name); err == nil {
+			t.Errorf("expected error getting removed datastore")
+		}
+	})
+	t.Run("TestImages", func(t *testing.T) {
+		d := DeviceManager{}
+		m := &common.Image{
+			Name:      "nginx",
+			ID:        "b5e2f0a1-7d35-4c8b-a5a9-1c6f4f3e2d22",
+			Datastore: "hub",
+			Config:    json.RawMessage(`{"URL":"library/nginx:1.21"}`),
+			Updated:   time.Now().UTC().Truncate(time.Second),
+		}
+		if _, ok := common.ImageRemove(&d, m.Name).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown image")
+		}
+		if err := common.ImageAdd(&d, m); err != nil {
+			t.Fatalf("unexpected error adding image: %v", err)
+		}
+		got, err := common.ImageGet(&d, m.Name)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting image: %v", err)
+		case got.Name != m.Name || got.ID != m.ID || got.Datastore != m.Datastore || string(got.Config) != string(m.Config) || !got.Updated.Equal(m.Updated):
+			t.Errorf("mismatched image, actual %v expected %v", got, m)
+		}
+		list, err := common.ImageList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one image, got %v %v", list, err)
+		}
+		if err := common.ImageRemove(&d, m.Name); err != nil {
+			t.Errorf("unexpected error removing image: %v", err)
+		}
+		if _, err := common.ImageGet(&d, m.Name); err == nil {
+			t.Errorf("expected error getting removed image")
+		}
+	})
+	t.Run("TestDeadLetters", func(t *testing.T) {
+		d := DeviceManager{}
+		dl := &common.DeadLetter{
+			ID:          "1f3b6c2e-7d4a-4c8e-9b5f-2a6d8e0c4f1a",
+			Received:    time.Now().UTC().Truncate(time.Second),
+			Method:      "POST",
+			Path:        "/api/v1/edgedevice/info",
+			ContentType: "application/x-proto-binary",
+			Kind:        common.KindInfo,
+			Cert:        []byte("-----BEGIN CERTIFICATE-----\n"),
+			Reason:      "proto: cannot parse invalid wire-format data",
+			Payload:     []byte{0xff, 0x01},
+		}
+		if _, ok := common.DeadLetterRemove(&d, dl.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown dead letter")
+		}
+		if err := common.DeadLetterAdd(&d, dl); err != nil {
+			t.Fatalf("unexpected error adding dead letter: %v", err)
+		}
+		got, err := common.DeadLetterGet(&d, dl.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting dead letter: %v", err)
+		case got.Reason != dl.Reason || string(got.Payload) != string(dl.Payload) || !got.Received.Equal(dl.Received):
+			t.Errorf("mismatched dead letter, actual %v expected %v", got, dl)
+		}
+		list, err := common.DeadLetterList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one dead letter, got %v %v", list, err)
+		}
+		if err := common.DeadLetterRemove(&d, dl.ID); err != nil {
+			t.Errorf("unexpected error removing dead letter: %v", err)
+		}
+		if _, err := common.DeadLetterGet(&d, dl.ID); err == nil {
+			t.Errorf("expected error getting removed dead letter")
+		}
+	})
+	t.Run("TestSchedules", func(t *testing.T) {
+		d := DeviceManager{}
+		at := time.Now().UTC().Truncate(time.Second)
+		s := common.NewScheduledChange("2e7b5c1a-9f3d-4a6e-8b2c-7d1f0e3a5b9c", "ntp", []string{"6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c"})
+		s.Patch = json.RawMessage(`{"maintenanceMode":true}`)
+		s.At = &at
+		if _, ok := common.ScheduleRemove(&d, s.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown scheduled change")
+		}
+		if err := common.ScheduleSet(&d, s); err != nil {
+			t.Fatalf("unexpected error setting scheduled change: %v", err)
+		}
+		got, err := common.ScheduleGet(&d, s.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting scheduled change: %v", err)
+		case got.Name != s.Name || string(got.Patch) != string(s.Patch) || got.At == nil || !got.At.Equal(at) || len(got.Devices) != 1:
+			t.Errorf("mismatched scheduled change, actual %v expected %v", got, s)
+		}
+		list, err := common.ScheduleList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one scheduled change, got %v %v", list, err)
+		}
+		if err := common.ScheduleRemove(&d, s.ID); err != nil {
+			t.Errorf("unexpected error removing scheduled change: %v", err)
+		}
+		if _, err := common.ScheduleGet(&d, s.ID); err == nil {
+			t.Errorf("expected error getting removed scheduled change")
+		}
+	})
+	t.Run("TestCanaries", func(t *testing.T) {
+		d := DeviceManager{}
+		c := common.NewCanary("5d2f8c1e-3a7b-4e9d-b6c0-1f4a8e2d7c3b", "ntp", []string{"6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c"}, 600)
+		c.Patch = json.RawMessage(`{"maintenanceMode":true}`)
+		c.Devices[0].Previous = json.RawMessage(`{"id":{"version":"1"}}`)
+		if _, ok := common.CanaryRemove(&d, c.ID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown canary")
+		}
+		if err := common.CanarySet(&d, c); err != nil {
+			t.Fatalf("unexpected error setting canary: %v", err)
+		}
+		got, err := common.CanaryGet(&d, c.ID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting canary: %v", err)
+		case got.Name != c.Name || string(got.Patch) != string(c.Patch) || got.SoakPeriod != c.SoakPeriod || len(got.Devices) != 1 || string(got.Devices[0].Previous) != string(c.Devices[0].Previous):
+			t.Errorf("mismatched canary, actual %v expected %v", got, c)
+		}
+		list, err := common.CanaryList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one canary, got %v %v", list, err)
+		}
+		if err := common.CanaryRemove(&d, c.ID); err != nil {
+			t.Errorf("unexpected error removing canary: %v", err)
+		}
+		if _, err := common.CanaryGet(&d, c.ID); err == nil {
+			t.Errorf("expected error getting removed canary")
+		}
+	})
+	t.Run("TestACME", func(t *testing.T) {
+		d := DeviceManager{}
+		if _, err := common.ACMEGet(&d, "account"); err == nil {
+			t.Errorf("expected not found error getting unknown acme data")
+		} else if _, ok := err.(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error getting unknown acme data, got %v", err)
+		}
+		for _, data := range []string{"first", "second"} {
+			if err := common.ACMESet(&d, "account", []byte(data)); err != nil {
+				t.Fatalf("unexpected error setting acme data: %v", err)
+			}
+			b, err := common.ACMEGet(&d, "account")
+			if err != nil || string(b) != data {
+				t.Errorf("mismatched acme data, actual %q expected %q: %v", b, data, err)
+			}
+		}
+	})
+	t.Run("TestTombstones", func(t *testing.T) {
+		d := DeviceManager{}
+		tombstone := &common.Tombstone{
+			UUID:    "6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c",
+			Deleted: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+			Expires: time.Date(2021, 6, 8, 0, 0, 0, 0, time.UTC),
+			Actor:   "token:abc",
+		}
+		if _, ok := common.TombstoneRemove(&d, tombstone.UUID).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown tombstone")
+		}
+		if err := common.TombstoneAdd(&d, tombstone); err != nil {
+			t.Fatalf("unexpected error adding tombstone: %v", err)
+		}
+		got, err := common.TombstoneGet(&d, tombstone.UUID)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting tombstone: %v", err)
+		case *got != *tombstone:
+			t.Errorf("mismatched tombstone, actual %v expected %v", got, tombstone)
+		}
+		list, err := common.TombstoneList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one tombstone, got %v %v", list, err)
+		}
+		if err := common.TombstoneRemove(&d, tombstone.UUID); err != nil {
+			t.Errorf("unexpected error removing tombstone: %v", err)
+		}
+		if _, err := common.TombstoneGet(&d, tombstone.UUID); err == nil {
+			t.Errorf("expected error getting removed tombstone")
+		}
+	})
+
+	t.Run("TestRevocations", func(t *testing.T) {
+		d := DeviceManager{}
+		revocation := &common.Revocation{
+			Fingerprint:  "9b2f4c6a8e0d1f3b5a7c9e1d3f5b7a9c2e4d6f8a0b1c3e5d7f9a2b4c6e8d0f1a",
+			Kind:         common.RevokedDevice,
+			Subject:      "dev-1",
+			SerialNumber: "1f2e3d",
+			Reason:       "stolen",
+			Revoked:      time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+			Actor:        "token:abc",
+		}
+		if _, ok := common.RevocationRemove(&d, revocation.Fingerprint).(*common.NotFoundError); !ok {
+			t.Errorf("expected not found error removing unknown revocation")
+		}
+		if err := common.RevocationAdd(&d, revocation); err != nil {
+			t.Fatalf("unexpected error adding revocation: %v", err)
+		}
+		got, err := common.RevocationGet(&d, revocation.Fingerprint)
+		switch {
+		case err != nil:
+			t.Errorf("unexpected error getting revocation: %v", err)
+		case *got != *revocation:
+			t.Errorf("mismatched revocation, actual %v expected %v", got, revocation)
+		}
+		list, err := common.RevocationList(&d)
+		if err != nil || len(list) != 1 {
+			t.Errorf("expected one revocation, got %v %v", list, err)
+		}
+		if err := common.RevocationRemove(&d, revocation.Fingerprint); err != nil {
+			t.Errorf("unexpected error removing revocation: %v", err)
+		}
+		if _, err := common.RevocationGet(&d, revocation.Fingerprint); err == nil {
+			t.Errorf("expected error getting removed revocation")
+		}
+	})
+
 	t.Run("TestOnboardRegister", func(t *testing.T) {
 		tests := []struct {
 			validCert bool
@@ -682,4 +1800,66 @@ func TestDeviceManager(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("TestConcurrency", func(t *testing.T) {
+		// run with -race; requests for different devices are handled at once
+		d := DeviceManager{}
+		if _, err := d.Init("", common.MaxSizes{}); err != nil {
+			t.Fatalf("unexpected error initializing: %v", err)
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < cap(errs); i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				certB, _, err := ax.Generate(fmt.Sprintf("concurrent-%d", i), "")
+				if err != nil {
+					errs <- err
+					return
+				}
+				cert, err := x509.ParseCertificate(certB)
+				if err != nil {
+					errs <- err
+					return
+				}
+				u, _ := uuid.NewV4()
+				if err := d.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)); err != nil {
+					errs <- fmt.Errorf("error registering device: %v", err)
+					return
+				}
+				for j := 0; j < 10; j++ {
+					if got, err := d.DeviceCheckCert(cert); err != nil || got == nil || *got != u {
+						errs <- fmt.Errorf("mismatched device for certificate, actual %v expected %v: %v", got, u, err)
+						return
+					}
+					if err := d.WriteLogs(u, []byte(`{"content":"log"}`)); err != nil {
+						errs <- fmt.Errorf("error writing logs: %v", err)
+						return
+					}
+					if _, err := d.DeviceList(); err != nil {
+						errs <- fmt.Errorf("error listing devices: %v", err)
+						return
+					}
+					r, err := d.GetLogsReader(u)
+					if err != nil {
+						errs <- fmt.Errorf("error getting logs reader: %v", err)
+						return
+					}
+					if _, err := ioutil.ReadAll(r); err != nil {
+						errs <- fmt.Errorf("error reading logs: %v", err)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+		if ids, _ := d.DeviceList(); len(ids) != cap(errs) {
+			t.Errorf("mismatched number of devices, actual %d expected %d", len(ids), cap(errs))
+		}
+	})
 }
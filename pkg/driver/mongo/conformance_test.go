@@ -0,0 +1,18 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mongo_test
+
+import (
+	"testing"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/drivertest"
+	"github.com/lf-edge/adam/pkg/driver/mongo"
+)
+
+func TestConformance(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) driver.DeviceManager {
+		return mongo.NewTestManager(t, "")
+	})
+}
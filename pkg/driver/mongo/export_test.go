@@ -0,0 +1,7 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mongo
+
+// NewTestManager newTestManager for the tests of package mongo_test
+var NewTestManager = newTestManager
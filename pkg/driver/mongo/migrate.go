@@ -0,0 +1,71 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mongo
+
+import (
+	"fmt"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// schemaCollection collection of the document with the version of the layout of the database, see migrations()
+	schemaCollection = "schema"
+	schemaVersionID  = "schema-version"
+	versionField     = "version"
+)
+
+// migrations the changes of the layout of the database, oldest first. The first records the version of the layout
+// the driver started with, which needs no change
+func (d *DeviceManager) migrations() []common.Migration {
+	return []common.Migration{
+		{Version: 1, Description: "initial layout", Apply: func() error { return nil }},
+	}
+}
+
+// SchemaVersion get the version of the layout of the database, 0 if it predates versions, and the latest one
+func (d *DeviceManager) SchemaVersion() (int, int, error) {
+	v, err := d.schemaVersion()
+	return v, common.LatestSchema(d.migrations()), err
+}
+
+// Migrate upgrade the database to the latest version of its layout
+func (d *DeviceManager) Migrate() (int, int, error) {
+	from, err := d.schemaVersion()
+	if err != nil {
+		return from, from, err
+	}
+	to, err := common.Migrate(from, d.migrations(), d.setSchemaVersion)
+	return from, to, err
+}
+
+// schemaVersion read the version of the layout of the database, 0 if none is recorded
+func (d *DeviceManager) schemaVersion() (int, error) {
+	ctx, cancel := timeout()
+	defer cancel()
+	doc, err := d.db.Collection(schemaCollection).FindOne(ctx, bson.M{"_id": schemaVersionID}).DecodeBytes()
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("unable to read schema version: %v", err)
+	}
+	v, ok := doc.Lookup(versionField).AsInt64OK()
+	if !ok {
+		return 0, fmt.Errorf("invalid schema version %s", doc.Lookup(versionField))
+	}
+	return int(v), nil
+}
+
+// setSchemaVersion record the version of the layout of the database
+func (d *DeviceManager) setSchemaVersion(v int) error {
+	ctx, cancel := timeout()
+	defer cancel()
+	update := bson.M{"$set": bson.M{versionField: v}}
+	_, err := d.db.Collection(schemaCollection).UpdateOne(ctx, bson.M{"_id": schemaVersionID}, update, options.Update().SetUpsert(true))
+	return err
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fields of the documents of messages
+const (
+	timeField     = "time"     // when the message was received
+	deviceField   = "device"   // UUID of the device that sent it, the meta field of time series collections
+	appField      = "app"      // UUID of the app instance, for app logs
+	dataField     = "data"     // the message, a string as received, or binary if compressed
+	encodingField = "encoding" // the compression of data, if compressed
+)
+
+// ManagedStream the messages of a device, or of an app instance of a device, in a collection of one kind of message
+type ManagedStream struct {
+	collection *mongo.Collection
+	// fields identifying the messages of the stream, e.g. the device, which are set on those written
+	fields bson.D
+	// compression of the messages written, none if empty
+	compression string
+}
+
+func (m *ManagedStream) Get(index int) ([]byte, error) {
+	return nil, errors.New("unsupported")
+}
+
+func (m *ManagedStream) Write(b []byte) (int, error) {
+	doc := append(bson.D{{Key: timeField, Value: time.Now()}}, m.fields...)
+	if m.compression != "" && m.compression != common.CompressionNone && len(b) > 0 {
+		c, err := common.Compress(m.compression, b)
+		if err != nil {
+			return 0, fmt.Errorf("failed to compress message for %s: %v", m.collection.Name(), err)
+		}
+		doc = append(doc, bson.E{Key: dataField, Value: c}, bson.E{Key: encodingField, Value: m.compression})
+	} else {
+		doc = append(doc, bson.E{Key: dataField, Value: string(b)})
+	}
+	ctx, cancel := timeout()
+	defer cancel()
+	if _, err := m.collection.InsertOne(ctx, doc); err != nil {
+		return 0, fmt.Errorf("failed to insert message into %s: %v", m.collection.Name(), err)
+	}
+	return len(b), nil
+}
+
+func (m *ManagedStream) Reader() (io.Reader, error) {
+	return &StreamReader{
+		Collection: m.collection,
+		Filter:     m.fields,
+		LineFeed:   true,
+	}, nil
+}
+
+// StreamReader reads the messages of a collection matching a filter, oldest first, and returns io.EOF once it has
+// read those stored when reading started
+type StreamReader struct {
+	Collection *mongo.Collection
+	Filter     bson.D
+	LineFeed   bool
+
+	cursor *mongo.Cursor
+	done   bool
+	buf    []byte
+}
+
+func (r *StreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next load the next message into the buffer
+func (r *StreamReader) next() error {
+	// the cursor is read for as long as the reader is, so it is not bound to the timeout of a request
+	ctx := context.Background()
+	if r.cursor == nil {
+		filter := r.Filter
+		if filter == nil {
+			filter = bson.D{}
+		}
+		opts := options.Find().SetSort(bson.D{{Key: timeField, Value: 1}, {Key: "_id", Value: 1}})
+		cursor, err := r.Collection.Find(ctx, filter, opts)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", r.Collection.Name(), err)
+		}
+		r.cursor = cursor
+	}
+	if !r.cursor.Next(ctx) {
+		err := r.cursor.Err()
+		r.close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", r.Collection.Name(), err)
+		}
+		return nil
+	}
+	data, err := decodeMessage(r.cursor.Current)
+	if err != nil {
+		r.close()
+		return fmt.Errorf("invalid message in %s: %v", r.Collection.Name(), err)
+	}
+	r.buf = append(r.buf, data...)
+	if r.LineFeed && len(data) > 0 {
+		r.buf = append(r.buf, 0x0a)
+	}
+	return nil
+}
+
+func (r *StreamReader) close() {
+	r.done = true
+	if r.cursor != nil {
+		_ = r.cursor.Close(context.Background())
+	}
+}
+
+// decodeMessage the message of a document, decompressed
+func decodeMessage(doc bson.Raw) ([]byte, error) {
+	v, err := doc.LookupErr(dataField)
+	if err != nil {
+		return nil, fmt.Errorf("no %s: %v", dataField, err)
+	}
+	if s, ok := v.StringValueOK(); ok {
+		return []byte(s), nil
+	}
+	_, b, ok := v.BinaryOK()
+	if !ok {
+		return nil, fmt.Errorf("%s of type %s", dataField, v.Type)
+	}
+	encoding, _ := doc.Lookup(encodingField).StringValueOK()
+	return common.Decompress(encoding, b)
+}
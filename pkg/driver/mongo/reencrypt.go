@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mongo
+
+import (
+	"fmt"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// encryptedCollections the collections whose binary fields are encrypted, those of onboarding certificates, of
+// devices and of the records of every kind; not the streams
+func encryptedCollections() []string {
+	collections := []string{onboardCollection, devicesCollection}
+	for _, kind := range common.RecordKinds {
+		collections = append(collections, recordCollections[kind])
+	}
+	return collections
+}
+
+// Reencrypt encrypt anew the fields written in plaintext, or encrypted by older releases without the key of their
+// record, with the encryptor set. Each is replaced only if it is still the value read, so that one written meanwhile
+// is not undone. Returns how many were
+func (d *DeviceManager) Reencrypt() (int, error) {
+	if d.encryptor == nil {
+		return 0, nil
+	}
+	n := 0
+	for _, collection := range encryptedCollections() {
+		err := d.eachDocument(collection, bson.M{}, func(id string, doc bson.Raw) error {
+			elements, err := doc.Elements()
+			if err != nil {
+				return fmt.Errorf("failed to read %s of %s: %v", id, collection, err)
+			}
+			for _, e := range elements {
+				field, stored := e.Key(), e.Value()
+				_, b, ok := stored.BinaryOK()
+				if field == "_id" || !ok {
+					continue
+				}
+				v, changed, err := d.encryptor.Reencrypt(b, recordKey(collection, id, field))
+				if err != nil {
+					return fmt.Errorf("failed to reencrypt %s of %s of %s: %v", field, id, collection, err)
+				}
+				if !changed {
+					continue
+				}
+				ctx, cancel := timeout()
+				res, err := d.db.Collection(collection).UpdateOne(ctx, bson.M{"_id": id, field: stored}, bson.M{"$set": bson.M{field: v}})
+				cancel()
+				if err != nil {
+					return fmt.Errorf("failed to save %s of %s of %s: %v", field, id, collection, err)
+				}
+				// otherwise written meanwhile, by this release
+				if res.ModifiedCount > 0 {
+					n++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mongo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DeviceUsage get the bytes of the documents of each kind of message of a device, as BSON, their number and when
+// the oldest and newest were received
+func (d *DeviceManager) DeviceUsage(u uuid.UUID) (*common.DeviceUsage, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from MongoDB: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	usage := common.NewDeviceUsage(u.String())
+	for kind, collection := range map[string]string{
+		common.KindLogs:     logsCollection,
+		common.KindInfo:     infoCollection,
+		common.KindMetrics:  metricsCollection,
+		common.KindRequests: requestsCollection,
+		common.KindAppLogs:  appLogsCollection,
+	} {
+		s, err := d.collectionUsage(collection, u.String())
+		if err != nil {
+			return nil, err
+		}
+		usage.Add(kind, s)
+	}
+	return usage, nil
+}
+
+// collectionUsage the bytes and number of the documents of a device in a collection, and the times of the oldest
+// and newest
+func (d *DeviceManager) collectionUsage(collection, device string) (common.StreamUsage, error) {
+	u := common.StreamUsage{}
+	ctx, cancel := timeout()
+	defer cancel()
+	pipeline := bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: deviceField, Value: device}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "entries", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "bytes", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$bsonSize", Value: "$$ROOT"}}}}},
+			{Key: "oldest", Value: bson.D{{Key: "$min", Value: "$" + timeField}}},
+			{Key: "newest", Value: bson.D{{Key: "$max", Value: "$" + timeField}}},
+		}}},
+	}
+	cursor, err := d.db.Collection(collection).Aggregate(ctx, pipeline)
+	if err != nil {
+		return u, fmt.Errorf("failed to get usage of %s for %s: %v", collection, device, err)
+	}
+	defer cursor.Close(ctx)
+	// no documents, no group
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return u, fmt.Errorf("failed to get usage of %s for %s: %v", collection, device, err)
+		}
+		return u, nil
+	}
+	var result struct {
+		Entries int64     `bson:"entries"`
+		Bytes   int64     `bson:"bytes"`
+		Oldest  time.Time `bson:"oldest"`
+		Newest  time.Time `bson:"newest"`
+	}
+	if err := cursor.Decode(&result); err != nil {
+		return u, fmt.Errorf("invalid usage of %s for %s: %v", collection, device, err)
+	}
+	u.Entries, u.Bytes = result.Entries, result.Bytes
+	if result.Entries > 0 {
+		u.Oldest, u.Newest = &result.Oldest, &result.Newest
+	}
+	return u, nil
+}
@@ -0,0 +1,1042 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package nats
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	ax "github.com/lf-edge/adam/pkg/x509"
+	"github.com/nats-io/nats.go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+const testURL = "nats://localhost:4222?bucket=adam-test&stream=ADAMTEST&subject=adamtest"
+
+// newTestManager connect to a clean bucket and stream on a local NATS server, skipping if there is none
+func newTestManager(t *testing.T, params string) *DeviceManager {
+	nc, err := nats.Connect("nats://localhost:4222")
+	if err != nil {
+		t.Skip("you need to run 'docker run nats -js' before running the rest of the tests")
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("unable to get JetStream context: %v", err)
+	}
+	_ = js.DeleteKeyValue("adam-test")
+	_ = js.DeleteStream("ADAMTEST")
+
+	d := &DeviceManager{}
+	if _, err := d.Init(testURL+params, common.MaxSizes{}); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+	return d
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		url       string
+		ok        bool
+		database  string
+		servers   []string
+		bucket    string
+		stream    string
+		subject   string
+		replicas  int
+		consumers []string
+	}{
+		{"redis://localhost:6379", false, "", nil, "", "", "", 0, nil},
+		{"nats://localhost:1", true, "localhost:1", []string{"nats://localhost:1"}, "adam", "ADAM", "adam", 1, nil},
+		{"nats://localhost:1?server=localhost:2,localhost:3&bucket=b&stream=S&subject=s&replicas=3&consumer=a&consumer=b:logs",
+			true, "localhost:1", []string{"nats://localhost:1", "nats://localhost:2", "nats://localhost:3"}, "b", "S", "s", 3, []string{"a", "b:logs"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			d := DeviceManager{}
+			ok, err := d.Init(tt.url, common.MaxSizes{})
+			assert.Equal(t, tt.ok, ok)
+			if !ok {
+				return
+			}
+			// nothing is listening, so the connection fails after parsing
+			assert.NotEqual(t, nil, err)
+			assert.Equal(t, tt.database, d.Database())
+			assert.Equal(t, tt.servers, d.servers)
+			assert.Equal(t, tt.bucket, d.bucket)
+			assert.Equal(t, tt.stream, d.stream)
+			assert.Equal(t, tt.subject, d.subject)
+			assert.Equal(t, tt.replicas, d.replicas)
+			assert.Equal(t, tt.consumers, d.consumers)
+		})
+	}
+
+	d := DeviceManager{}
+	_, err := d.Init("nats://localhost:1?replicas=0", common.MaxSizes{})
+	assert.NotEqual(t, nil, err)
+	assert.NotEqual(t, nil, d.parseURL(&url.URL{Scheme: "nats", Host: "localhost:1", RawQuery: "compress=gzip"}))
+}
+
+func TestOnboardNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	// lets see if we can get a bogus cert
+	assert.NotEqual(t, nil, r.OnboardCheck(&x509.Certificate{}, "foo"))
+
+	cert := generateCert(t, "foo", "localhost")
+	cert2 := generateCert(t, "bar", "vax.kremlin")
+	cert3 := generateCert(t, "baz", "vax.kremlin")
+
+	assert.Equal(t, nil, r.OnboardRegister(cert2, []string{"------"}))
+	assert.Equal(t, nil, r.OnboardRegister(cert3, []string{"------"}))
+
+	assert.Equal(t, nil, r.OnboardRegister(cert, []string{"123456", "abcdef"}))
+	assert.Equal(t, nil, r.OnboardCheck(cert, "123456"))
+	assert.Equal(t, nil, r.OnboardCheck(cert, "abcdef"))
+
+	certBack, serials, err := r.OnboardGet("foo")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"123456", "abcdef"}, serials)
+	assert.Equal(t, cert, certBack)
+
+	cns, err := r.OnboardList()
+	assert.Equal(t, nil, err)
+	assert.ElementsMatch(t, []string{"foo", "bar", "baz"}, cns)
+
+	assert.Equal(t, nil, r.OnboardRemove("bar"))
+	assert.NotEqual(t, nil, r.OnboardRemove("bar"))
+	cns, err = r.OnboardList()
+	assert.Equal(t, nil, err)
+	assert.ElementsMatch(t, []string{"foo", "baz"}, cns)
+
+	assert.Equal(t, nil, r.OnboardClear())
+	cns, err = r.OnboardList()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{}, cns)
+}
+
+func TestOnboardPolicyNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	_, err := r.OnboardPolicyGet("foo")
+	assert.IsType(t, &common.NotFoundError{}, err)
+
+	cert := generateCert(t, "foo", "localhost")
+	assert.Equal(t, nil, r.OnboardRegister(cert, []string{"123456"}))
+
+	got, err := r.OnboardPolicyGet("foo")
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	p := &common.OnboardPolicy{SoftSerials: []string{"ACME-*"}, Models: []string{"X1 Gateway"}}
+	assert.Equal(t, nil, r.OnboardPolicySet("foo", p))
+	got, err = r.OnboardPolicyGet("foo")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, p, got)
+
+	assert.Equal(t, nil, r.OnboardPolicySet("foo", nil))
+	got, err = r.OnboardPolicyGet("foo")
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	// the policy goes with its onboard cert
+	assert.Equal(t, nil, r.OnboardPolicySet("foo", p))
+	assert.Equal(t, nil, r.OnboardRemove("foo"))
+	assert.Equal(t, nil, r.OnboardRegister(cert, []string{"123456"}))
+	got, err = r.OnboardPolicyGet("foo")
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+}
+
+func TestDeviceNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	// lets see if we can get a bogus cert
+	var nilUUID *uuid.UUID
+	c, err := r.DeviceCheckCert(&x509.Certificate{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nilUUID, c)
+
+	cert := generateCert(t, "foo", "localhost")
+	cert2 := generateCert(t, "bar", "vax.kremlin")
+	certNew := generateCert(t, "new", "vax.kremlin")
+	certOnboard := generateCert(t, "onboard", "vax.kremlin")
+
+	UUID1, _ := uuid.NewV4()
+	UUID2, _ := uuid.NewV4()
+	assert.Equal(t, nil, r.DeviceRegister(UUID1, cert, certOnboard, "123456", common.CreateBaseConfig(UUID1)))
+	assert.Equal(t, nil, r.DeviceRegister(UUID2, cert2, certOnboard, "------", common.CreateBaseConfig(UUID2)))
+	assert.NotEqual(t, nil, r.DeviceRegister(UUID2, cert2, certOnboard, "------", common.CreateBaseConfig(UUID2)))
+
+	UUID, err := r.DeviceCheckCert(cert)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, UUID1, *UUID)
+
+	certBack, certOnboardBack, serial, err := r.DeviceGet(UUID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "123456", serial)
+	assert.Equal(t, cert, certBack)
+	assert.Equal(t, certOnboard, certOnboardBack)
+
+	assert.Equal(t, nil, r.DeviceReplaceCert(UUID1, certNew))
+	assert.IsType(t, &common.UsedCertError{}, r.DeviceReplaceCert(UUID2, certNew))
+
+	// a new instance sees the same devices
+	r2 := &DeviceManager{}
+	if _, err := r2.Init(testURL, common.MaxSizes{}); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+	UUIDs, err := r2.DeviceList()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(UUIDs))
+	UUID, err = r2.DeviceCheckCert(certNew)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, UUID1, *UUID)
+	assert.Equal(t, "123456", r2.devices[UUID1].Serial)
+	assert.Equal(t, certOnboard, r2.devices[UUID1].Onboard)
+
+	assert.Equal(t, nil, r.DeviceRemove(&UUID2))
+	assert.IsType(t, &common.NotFoundError{}, r.DeviceRemove(&UUID2))
+	UUIDs, err = r.DeviceList()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(UUIDs))
+
+	assert.Equal(t, nil, r.DeviceClear())
+	UUIDs, err = r.DeviceList()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(UUIDs))
+}
+
+func TestConcurrencyNATS(t *testing.T) {
+	// run with -race; requests for different devices are handled at once, while the cache is refreshed
+	r := newTestManager(t, "")
+	r.SetCacheTimeout(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		cert := generateCert(t, "concurrent-"+strconv.Itoa(i), "localhost")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u, _ := uuid.NewV4()
+			app, _ := uuid.NewV4()
+			assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+			for j := 0; j < 10; j++ {
+				got, err := r.DeviceCheckCert(cert)
+				assert.Equal(t, nil, err)
+				assert.Equal(t, &u, got)
+				assert.Equal(t, nil, r.WriteLogs(u, []byte(`{"content":"log"}`)))
+				assert.Equal(t, nil, r.WriteAppInstanceLogs(app, u, []byte(`{"content":"app"}`)))
+				_, err = r.DeviceList()
+				assert.Equal(t, nil, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	UUIDs, err := r.DeviceList()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(UUIDs))
+}
+
+func TestConfigNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	cert := generateCert(t, "kgb", "vax.kremlin")
+	UUID, _ := uuid.NewV4()
+	assert.Equal(t, nil, r.DeviceRegister(UUID, cert, nil, "", common.CreateBaseConfig(UUID)))
+
+	conf, err := r.GetConfig(UUID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, common.CreateBaseConfig(UUID), conf)
+
+	assert.Equal(t, nil, r.SetConfig(UUID, []byte(`{"id":{"version":"5"}}`)))
+	conf, err = r.GetConfig(UUID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"id":{"version":"5"}}`, string(conf))
+
+	other, _ := uuid.NewV4()
+	assert.NotEqual(t, nil, r.SetConfig(other, []byte(`{}`)))
+}
+
+func TestStreamsNATS(t *testing.T) {
+	r := newTestManager(t, "&consumer=all&consumer=logs:logs")
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	app, _ := uuid.NewV4()
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+
+	// nothing written yet
+	lr, err := r.GetLogsReader(u)
+	assert.Equal(t, nil, err)
+	b, err := ioutil.ReadAll(lr)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", string(b))
+
+	assert.Equal(t, nil, r.WriteLogs(u, []byte(`{"log":1}`)))
+	assert.Equal(t, nil, r.WriteLogs(u, []byte(`{"log":2}`)))
+	assert.Equal(t, nil, r.WriteInfo(u, []byte(`{"info":1}`)))
+	assert.Equal(t, nil, r.WriteMetrics(u, []byte(`{"metric":1}`)))
+	assert.Equal(t, nil, r.WriteRequest(u, []byte(`{"request":1}`)))
+	assert.Equal(t, nil, r.WriteAppInstanceLogs(app, u, []byte(`{"app":1}`)))
+
+	lr, err = r.GetLogsReader(u)
+	assert.Equal(t, nil, err)
+	b, err = ioutil.ReadAll(lr)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "{\"log\":1}\n{\"log\":2}\n", string(b))
+
+	ir, err := r.GetInfoReader(u)
+	assert.Equal(t, nil, err)
+	b, err = ioutil.ReadAll(ir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "{\"info\":1}\n", string(b))
+
+	mr, err := r.GetMetricsReader(u)
+	assert.Equal(t, nil, err)
+	b, err = ioutil.ReadAll(mr)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "{\"metric\":1}\n", string(b))
+
+	// the built-in consumers see the messages
+	ci, err := r.js.ConsumerInfo(r.stream, "all")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(6), ci.NumPending)
+	ci, err = r.js.ConsumerInfo(r.stream, "logs")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(2), ci.NumPending)
+
+	// app logs are found again by a new instance
+	r2 := &DeviceManager{}
+	if _, err := r2.Init(testURL, common.MaxSizes{}); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+	_, err = r2.DeviceList()
+	assert.Equal(t, nil, err)
+	assert.Contains(t, r2.devices[u].AppLogs, app)
+
+	assert.Equal(t, nil, r.DeviceRemove(&u))
+	si, err := r.js.StreamInfo(r.stream)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(0), si.State.Msgs)
+}
+
+func TestCompressionNATS(t *testing.T) {
+	r := newTestManager(t, "&compress=snappy")
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+	logs := `{"content":"` + strings.Repeat("compress me ", 100) + `"}`
+	assert.Equal(t, nil, r.WriteLogs(u, []byte(logs)))
+
+	msg, err := r.js.(lastMsgGetter).GetLastMsg(r.stream, r.deviceSubject(logsSubject, u))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, common.CompressionSnappy, msg.Header.Get(encodingHeader))
+	assert.Less(t, len(msg.Data), len(logs))
+
+	// messages are decompressed on reading, whatever the compression of the manager reading them
+	r2 := &DeviceManager{}
+	if _, err := r2.Init(testURL, common.MaxSizes{}); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+	_, err = r2.DeviceList()
+	assert.Equal(t, nil, err)
+	lr, err := r2.GetLogsReader(u)
+	assert.Equal(t, nil, err)
+	b, err := ioutil.ReadAll(lr)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, logs+"\n", string(b))
+
+	assert.Equal(t, nil, r.DeviceRemove(&u))
+}
+
+func TestDeviceUsageNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	app, _ := uuid.NewV4()
+	_, err := r.DeviceUsage(u)
+	assert.IsType(t, &common.NotFoundError{}, err)
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+
+	before := time.Now().Add(-time.Second)
+	assert.Equal(t, nil, r.WriteLogs(u, []byte(`{"log":1}`)))
+	assert.Equal(t, nil, r.WriteLogs(u, []byte(`{"log":2}`)))
+	assert.Equal(t, nil, r.WriteAppInstanceLogs(app, u, []byte(`{"app":1}`)))
+
+	usage, err := r.DeviceUsage(u)
+	assert.Equal(t, nil, err)
+	logs := usage.Kinds[common.KindLogs]
+	assert.Equal(t, int64(2), logs.Entries)
+	assert.Greater(t, logs.Bytes, int64(0))
+	if assert.NotNil(t, logs.Oldest) && assert.NotNil(t, logs.Newest) {
+		assert.True(t, logs.Oldest.After(before))
+		assert.False(t, logs.Newest.Before(*logs.Oldest))
+	}
+	assert.Equal(t, int64(1), usage.Kinds[common.KindAppLogs].Entries)
+	assert.Equal(t, common.StreamUsage{}, usage.Kinds[common.KindInfo])
+	assert.Equal(t, int64(3), usage.Entries)
+
+	assert.Equal(t, nil, r.DeviceRemove(&u))
+}
+
+func TestAuditNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	records := []string{`{"action":"onboard-add"}`, `{"action":"device-remove"}`}
+	for _, rec := range records {
+		assert.Equal(t, nil, r.WriteAudit([]byte(rec)))
+	}
+	ar, err := r.GetAuditReader()
+	assert.Equal(t, nil, err)
+	b, err := ioutil.ReadAll(ar)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, strings.Join(records, "\n")+"\n", string(b))
+}
+
+func TestQuotasNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	r.SetQuotas(common.Quotas{MaxBytes: common.Limits{Default: 10}}, 0)
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+
+	assert.Equal(t, nil, r.WriteLogs(u, []byte(`{"log":1}`)))
+	assert.IsType(t, &common.QuotaExceededError{}, r.WriteLogs(u, []byte(`{"log":2}`)))
+
+	q := &common.Quotas{MaxBytes: common.Limits{Default: 100}}
+	assert.Equal(t, nil, r.SetDeviceQuotas(u, q))
+	assert.Equal(t, nil, r.WriteLogs(u, []byte(`{"log":2}`)))
+
+	// a new instance reads the device quotas back
+	r2 := &DeviceManager{}
+	if _, err := r2.Init(testURL, common.MaxSizes{}); err != nil {
+		t.Fatalf("unable to initialize: %v", err)
+	}
+	got, err := r2.GetDeviceQuotas(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, q, got)
+
+	assert.Equal(t, nil, r.SetDeviceQuotas(u, nil))
+	got, err = r.GetDeviceQuotas(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+}
+
+func TestConfigAckNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+
+	got, err := r.GetConfigAck(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	ack := &common.ConfigAck{Hash: "abc", Config: []byte(`{"id":{}}`), Time: time.Now().UTC().Round(0)}
+	assert.Equal(t, nil, r.SetConfigAck(u, ack))
+	got, err = r.GetConfigAck(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ack, got)
+
+	assert.Equal(t, nil, r.DeviceRemove(&u))
+	_, err = r.GetConfigAck(u)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestLogFilterNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+
+	got, err := r.GetLogFilter(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	f := &common.LogFilter{MinSeverity: "info", Sample: 10}
+	assert.Equal(t, nil, r.SetLogFilter(u, f))
+	got, err = r.GetLogFilter(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, f, got)
+
+	assert.Equal(t, nil, r.SetLogFilter(u, nil))
+	got, err = r.GetLogFilter(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	assert.Equal(t, nil, r.DeviceRemove(&u))
+	_, err = r.GetLogFilter(u)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestLocalProfileNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+
+	got, err := r.GetLocalProfile(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	p := &common.LocalProfile{Token: "abc", Profile: "emergency", RadioSilence: true}
+	assert.Equal(t, nil, r.SetLocalProfile(u, p))
+	got, err = r.GetLocalProfile(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, p, got)
+
+	assert.Equal(t, nil, r.SetLocalProfile(u, nil))
+	got, err = r.GetLocalProfile(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	assert.Equal(t, nil, r.DeviceRemove(&u))
+	_, err = r.GetLocalProfile(u)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestDeviceMetadataNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+
+	got, err := r.GetDeviceMetadata(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	p := &common.DeviceMetadata{Name: "gw-1", Site: "berlin", Owner: "ops", Tags: map[string]string{"rack": "4"}}
+	assert.Equal(t, nil, r.SetDeviceMetadata(u, p))
+	got, err = r.GetDeviceMetadata(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, p, got)
+
+	assert.Equal(t, nil, r.SetDeviceMetadata(u, nil))
+	got, err = r.GetDeviceMetadata(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	assert.Equal(t, nil, r.DeviceRemove(&u))
+	_, err = r.GetDeviceMetadata(u)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestPendingNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	cert := generateCert(t, "foo", "localhost")
+	p := common.NewPendingDevice(cert, cert, "abcdef")
+	assert.IsType(t, &common.NotFoundError{}, common.PendingRemove(r, p.ID))
+	assert.Equal(t, nil, common.PendingAdd(r, p))
+
+	got, err := common.PendingGet(r, p.ID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, p.Serial, got.Serial)
+	assert.Equal(t, p.Cert, got.Cert)
+
+	list, err := common.PendingList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.PendingRemove(r, p.ID))
+	_, err = common.PendingGet(r, p.ID)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestTokensNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	token, _, err := common.NewAPIToken("ci", []string{"a8e0f3e4-5e0f-4b4a-8c61-3f2e3f0d7d1a"}, true, nil)
+	assert.Equal(t, nil, err)
+	assert.IsType(t, &common.NotFoundError{}, common.TokenRemove(r, token.ID))
+	assert.Equal(t, nil, common.TokenAdd(r, token))
+
+	got, err := common.TokenGet(r, token.ID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, token.Hash, got.Hash)
+	assert.Equal(t, token.Devices, got.Devices)
+	assert.True(t, got.ReadOnly)
+
+	list, err := common.TokenList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.TokenRemove(r, token.ID))
+	_, err = common.TokenGet(r, token.ID)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestRolloutsNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	ro := common.NewRollout("4b1f8f50-6c3a-4c8e-9d2e-0d1b8f5a7c11", "dns", []string{"a8e0f3e4-5e0f-4b4a-8c61-3f2e3f0d7d1a", "c1d3f2a4-9b8e-4f0a-8d1c-2e3f4a5b6c7d"}, 50)
+	ro.Patch = []byte(`{"configItems":[]}`)
+	assert.IsType(t, &common.NotFoundError{}, common.RolloutRemove(r, ro.ID))
+	assert.Equal(t, nil, common.RolloutSet(r, ro))
+	ro.Devices[0].Status = common.RolloutDeviceApplied
+	ro.Devices[0].Hash = "abc"
+	assert.Equal(t, nil, common.RolloutSet(r, ro))
+
+	got, err := common.RolloutGet(r, ro.ID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ro.Name, got.Name)
+	assert.JSONEq(t, string(ro.Patch), string(got.Patch))
+	assert.Equal(t, ro.Devices, got.Devices)
+
+	list, err := common.RolloutList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.RolloutRemove(r, ro.ID))
+	_, err = common.RolloutGet(r, ro.ID)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestAlertRulesNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	rule := &common.AlertRule{
+		ID:      "6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c",
+		Name:    "cpu",
+		Serials: []string{"lab-*"},
+		Metric:  "dm.cpuMetric.total",
+		Op:      ">",
+		Value:   90,
+		Actions: []common.AlertAction{{Type: common.AlertWebhook, URL: "https://example.com/hook"}},
+	}
+	assert.IsType(t, &common.NotFoundError{}, common.AlertRuleRemove(r, rule.ID))
+	assert.Equal(t, nil, common.AlertRuleAdd(r, rule))
+
+	got, err := common.AlertRuleGet(r, rule.ID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, rule, got)
+
+	list, err := common.AlertRuleList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.AlertRuleRemove(r, rule.ID))
+	_, err = common.AlertRuleGet(r, rule.ID)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestSnapshotsNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	snap := &common.ConfigSnapshot{
+		Name:    "golden",
+		Source:  "6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c",
+		Config:  json.RawMessage(`{"maintenanceMode":true}`),
+		Default: true,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	assert.IsType(t, &common.NotFoundError{}, common.SnapshotRemove(r, snap.Name))
+	assert.Equal(t, nil, common.SnapshotAdd(r, snap))
+
+	got, err := common.SnapshotGet(r, snap.Name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, snap, got)
+
+	list, err := common.SnapshotList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.SnapshotRemove(r, snap.Name))
+	_, err = common.SnapshotGet(r, snap.Name)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestHardwareModelsNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	m := &common.HardwareModel{
+		Name:        "x1",
+		Description: "ACME X1",
+		Config:      json.RawMessage(`{"deviceIoList":[{"ptype":"PhyIoNetEth","phylabel":"eth0"}]}`),
+		Updated:     time.Now().UTC().Truncate(time.Second),
+	}
+	assert.IsType(t, &common.NotFoundError{}, common.HardwareModelRemove(r, m.Name))
+	assert.Equal(t, nil, common.HardwareModelAdd(r, m))
+
+	got, err := common.HardwareModelGet(r, m.Name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, m, got)
+
+	list, err := common.HardwareModelList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.HardwareModelRemove(r, m.Name))
+	_, err = common.HardwareModelGet(r, m.Name)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestDatastoresNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	m := &common.Datastore{
+		Name:    "hub",
+		ID:      "2c0b4e91-8a57-4b0e-9c2e-3a3f1e0c2f11",
+		Config:  json.RawMessage(`{"dType":"DsContainerRegistry","fqdn":"docker://docker.io"}`),
+		Updated: time.Now().UTC().Truncate(time.Second),
+	}
+	assert.IsType(t, &common.NotFoundError{}, common.DatastoreRemove(r, m.Name))
+	assert.Equal(t, nil, common.DatastoreAdd(r, m))
+
+	got, err := common.DatastoreGet(r, m.Name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, m, got)
+
+	list, err := common.DatastoreList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.DatastoreRemove(r, m.Name))
+	_, err = common.DatastoreGet(r, m.Name)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestImagesNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	m := &common.Image{
+		Name:      "nginx",
+		ID:        "b5e2f0a1-7d35-4c8b-a5a9-1c6f4f3e2d22",
+		Datastore: "hub",
+		Config:    json.RawMessage(`{"URL":"library/nginx:1.21"}`),
+		Updated:   time.Now().UTC().Truncate(time.Second),
+	}
+	assert.IsType(t, &common.NotFoundError{}, common.ImageRemove(r, m.Name))
+	assert.Equal(t, nil, common.ImageAdd(r, m))
+
+	got, err := common.ImageGet(r, m.Name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, m, got)
+
+	list, err := common.ImageList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.ImageRemove(r, m.Name))
+	_, err = common.ImageGet(r, m.Name)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestDeviceModelNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	assert.IsType(t, &common.NotFoundError{}, r.SetDeviceModel(u, "x1"))
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+
+	model, err := r.GetDeviceModel(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", model)
+
+	assert.Equal(t, nil, r.SetDeviceModel(u, "x1"))
+	model, err = r.GetDeviceModel(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "x1", model)
+
+	assert.Equal(t, nil, r.SetDeviceModel(u, ""))
+	model, err = r.GetDeviceModel(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", model)
+
+	assert.Equal(t, nil, r.SetDeviceModel(u, "x1"))
+	assert.Equal(t, nil, r.DeviceRemove(&u))
+	_, err = r.GetDeviceModel(u)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestAppCommandsNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	commands := []common.AppCommand{{ID: "1", App: "a", Command: common.AppRestart, State: common.AppCommandQueued, Created: time.Now().UTC().Truncate(time.Second)}}
+	assert.IsType(t, &common.NotFoundError{}, r.SetAppCommands(u, commands))
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+
+	got, err := r.GetAppCommands(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(got))
+
+	assert.Equal(t, nil, r.SetAppCommands(u, commands))
+	got, err = r.GetAppCommands(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, commands, got)
+
+	assert.Equal(t, nil, r.SetAppCommands(u, nil))
+	got, err = r.GetAppCommands(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(got))
+
+	assert.Equal(t, nil, r.SetAppCommands(u, commands))
+	assert.Equal(t, nil, r.DeviceRemove(&u))
+	_, err = r.GetAppCommands(u)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestDeviceFlagsNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	flags := &common.DeviceFlags{Flags: []string{common.FlagHoldConfig, common.FlagReadOnly}, Held: []byte(`{"id":{"version":"2"}}`), HeldVersion: "2", Updated: time.Now().UTC().Truncate(time.Second)}
+	assert.IsType(t, &common.NotFoundError{}, r.SetDeviceFlags(u, flags))
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+
+	got, err := r.GetDeviceFlags(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	assert.Equal(t, nil, r.SetDeviceFlags(u, flags))
+	got, err = r.GetDeviceFlags(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, flags, got)
+
+	assert.Equal(t, nil, r.SetDeviceFlags(u, nil))
+	got, err = r.GetDeviceFlags(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	assert.Equal(t, nil, r.SetDeviceFlags(u, flags))
+	assert.Equal(t, nil, r.DeviceRemove(&u))
+	_, err = r.GetDeviceFlags(u)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestQuarantineNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	cert := generateCert(t, "foo", "localhost")
+	u, _ := uuid.NewV4()
+	q := &common.Quarantine{Reason: "suspected compromise", Since: time.Now().UTC().Truncate(time.Second), Actor: "token:ops", Version: "2"}
+	assert.IsType(t, &common.NotFoundError{}, r.SetQuarantine(u, q))
+	assert.Equal(t, nil, r.DeviceRegister(u, cert, nil, "", common.CreateBaseConfig(u)))
+
+	got, err := r.GetQuarantine(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	assert.Equal(t, nil, r.SetQuarantine(u, q))
+	got, err = r.GetQuarantine(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, q, got)
+
+	assert.Equal(t, nil, r.SetQuarantine(u, nil))
+	got, err = r.GetQuarantine(u)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, got)
+
+	assert.Equal(t, nil, r.SetQuarantine(u, q))
+	assert.Equal(t, nil, r.DeviceRemove(&u))
+	_, err = r.GetQuarantine(u)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestSchedulesNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	at := time.Now().UTC().Truncate(time.Second)
+	s := common.NewScheduledChange("2e7b5c1a-9f3d-4a6e-8b2c-7d1f0e3a5b9c", "ntp", []string{"6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c"})
+	s.Patch = json.RawMessage(`{"maintenanceMode":true}`)
+	s.At = &at
+	s.Window = &common.MaintenanceWindow{Days: []string{"sat"}, Start: "02:00", Duration: 3600}
+	s.Created = s.Created.UTC().Truncate(time.Second)
+	s.Updated = s.Created
+	assert.IsType(t, &common.NotFoundError{}, common.ScheduleRemove(r, s.ID))
+	assert.Equal(t, nil, common.ScheduleSet(r, s))
+
+	got, err := common.ScheduleGet(r, s.ID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s, got)
+
+	list, err := common.ScheduleList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.ScheduleRemove(r, s.ID))
+	_, err = common.ScheduleGet(r, s.ID)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestCanariesNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	c := common.NewCanary("5d2f8c1e-3a7b-4e9d-b6c0-1f4a8e2d7c3b", "ntp", []string{"6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c"}, 600)
+	c.Patch = json.RawMessage(`{"maintenanceMode":true}`)
+	c.Devices[0].Previous = json.RawMessage(`{"id":{"version":"1"}}`)
+	c.Created = c.Created.UTC().Truncate(time.Second)
+	c.Updated = c.Created
+	assert.IsType(t, &common.NotFoundError{}, common.CanaryRemove(r, c.ID))
+	assert.Equal(t, nil, common.CanarySet(r, c))
+
+	got, err := common.CanaryGet(r, c.ID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, c, got)
+
+	list, err := common.CanaryList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.CanaryRemove(r, c.ID))
+	_, err = common.CanaryGet(r, c.ID)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestTombstonesNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	tombstone := &common.Tombstone{
+		UUID:    "6f0c3a9e-2b1d-4e7f-8a5c-9d3e1f2a4b6c",
+		Deleted: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+		Expires: time.Date(2021, 6, 8, 0, 0, 0, 0, time.UTC),
+		Actor:   "token:abc",
+	}
+	assert.IsType(t, &common.NotFoundError{}, common.TombstoneRemove(r, tombstone.UUID))
+	assert.Equal(t, nil, common.TombstoneAdd(r, tombstone))
+
+	got, err := common.TombstoneGet(r, tombstone.UUID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, tombstone, got)
+
+	list, err := common.TombstoneList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.TombstoneRemove(r, tombstone.UUID))
+	_, err = common.TombstoneGet(r, tombstone.UUID)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestRevocationsNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	revocation := &common.Revocation{
+		Fingerprint:  "9b2f4c6a8e0d1f3b5a7c9e1d3f5b7a9c2e4d6f8a0b1c3e5d7f9a2b4c6e8d0f1a",
+		Kind:         common.RevokedDevice,
+		Subject:      "dev-1",
+		SerialNumber: "1f2e3d",
+		Reason:       "stolen",
+		Revoked:      time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+		Actor:        "token:abc",
+	}
+	assert.IsType(t, &common.NotFoundError{}, common.RevocationRemove(r, revocation.Fingerprint))
+	assert.Equal(t, nil, common.RevocationAdd(r, revocation))
+
+	got, err := common.RevocationGet(r, revocation.Fingerprint)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, revocation, got)
+
+	list, err := common.RevocationList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.RevocationRemove(r, revocation.Fingerprint))
+	_, err = common.RevocationGet(r, revocation.Fingerprint)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func generateCert(t *testing.T, cn, host string) *x509.Certificate {
+	certB, _, err := ax.Generate(cn, host)
+	if err != nil {
+		t.Fatalf("error generating cert for tests: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certB)
+	if err != nil {
+		t.Fatalf("unexpected error parsing certificate: %v", err)
+	}
+	return cert
+}
+
+func TestDeadLettersNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	dl := &common.DeadLetter{
+		ID:          "1f3b6c2e-7d4a-4c8e-9b5f-2a6d8e0c4f1a",
+		Received:    time.Now().UTC().Truncate(time.Second),
+		Method:      "POST",
+		Path:        "/api/v1/edgedevice/info",
+		ContentType: "application/x-proto-binary",
+		Kind:        common.KindInfo,
+		Cert:        []byte("-----BEGIN CERTIFICATE-----\n"),
+		Reason:      "proto: cannot parse invalid wire-format data",
+		Payload:     []byte{0xff, 0x01},
+	}
+	assert.IsType(t, &common.NotFoundError{}, common.DeadLetterRemove(r, dl.ID))
+	assert.Equal(t, nil, common.DeadLetterAdd(r, dl))
+
+	got, err := common.DeadLetterGet(r, dl.ID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, dl, got)
+
+	list, err := common.DeadLetterList(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(list))
+
+	assert.Equal(t, nil, common.DeadLetterRemove(r, dl.ID))
+	_, err = common.DeadLetterGet(r, dl.ID)
+	assert.IsType(t, &common.NotFoundError{}, err)
+}
+
+func TestCheckHealthNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	assert.Equal(t, nil, r.CheckHealth())
+
+	r.conn.Close()
+	assert.NotEqual(t, nil, r.CheckHealth())
+}
+
+func TestCloseNATS(t *testing.T) {
+	r := newTestManager(t, "")
+	assert.Equal(t, nil, r.Close())
+	assert.True(t, r.conn.IsClosed())
+}
+
+func TestMigrateNATS(t *testing.T) {
+	r := newTestManager(t, "")
+
+	current, latest, err := r.SchemaVersion()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, current)
+
+	from, to, err := r.Migrate()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, from)
+	assert.Equal(t, latest, to)
+
+	// nothing to do once migrated
+	from, to, err = r.Migrate()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, latest, from)
+	assert.Equal(t, latest, to)
+
+	// a bucket a newer release upgraded is refused
+	_, err = r.kv.Put(schemaVersionKey, []byte(strconv.Itoa(latest+1)))
+	assert.Equal(t, nil, err)
+	_, _, err = r.Migrate()
+	assert.NotEqual(t, nil, err)
+}
+
+func TestACMENATS(t *testing.T) {
+	r := newTestManager(t, "")
+	_, err := common.ACMEGet(r, "account")
+	assert.IsType(t, &common.NotFoundError{}, err)
+
+	for _, data := range []string{"first", "second"} {
+		assert.Equal(t, nil, common.ACMESet(r, "account", []byte(data)))
+		b, err := common.ACMEGet(r, "account")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, data, string(b))
+	}
+}
@@ -0,0 +1,7 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package nats
+
+// NewTestManager newTestManager for the tests of package nats_test
+var NewTestManager = newTestManager
@@ -0,0 +1,58 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package nats
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/nats-io/nats.go"
+)
+
+// schemaVersionKey key of the version of the layout of the bucket and stream, see migrations()
+const schemaVersionKey = "schema-version"
+
+// migrations the changes of the layout of the bucket and stream, oldest first. The first records the version of
+// the layout the driver started with, which needs no change
+func (d *DeviceManager) migrations() []common.Migration {
+	return []common.Migration{
+		{Version: 1, Description: "initial layout", Apply: func() error { return nil }},
+	}
+}
+
+// SchemaVersion get the version of the layout of the bucket and stream, 0 if it predates versions, and the latest one
+func (d *DeviceManager) SchemaVersion() (int, int, error) {
+	v, err := d.schemaVersion()
+	return v, common.LatestSchema(d.migrations()), err
+}
+
+// Migrate upgrade the bucket and stream to the latest version of their layout
+func (d *DeviceManager) Migrate() (int, int, error) {
+	from, err := d.schemaVersion()
+	if err != nil {
+		return from, from, err
+	}
+	to, err := common.Migrate(from, d.migrations(), func(v int) error {
+		_, err := d.kv.Put(schemaVersionKey, []byte(strconv.Itoa(v)))
+		return err
+	})
+	return from, to, err
+}
+
+// schemaVersion read the version of the layout of the bucket and stream, 0 if none is recorded
+func (d *DeviceManager) schemaVersion() (int, error) {
+	entry, err := d.kv.Get(schemaVersionKey)
+	switch {
+	case err == nats.ErrKeyNotFound:
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("unable to read schema version: %v", err)
+	}
+	v, err := strconv.Atoi(string(entry.Value()))
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %v", entry.Value(), err)
+	}
+	return v, nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package nats
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/nats-io/nats.go"
+)
+
+// readTimeout how long to wait for the next message of a subject that is known to have more
+const readTimeout = 5 * time.Second
+
+// lastMsgGetter implemented by the JetStream context, but not yet part of its interface in this version of nats.go
+type lastMsgGetter interface {
+	GetLastMsg(name, subject string, opts ...nats.JSOpt) (*nats.RawStreamMsg, error)
+}
+
+// StreamReader reads all the messages of a subject in a JetStream stream, oldest first, and returns io.EOF
+// once it has caught up with the last message stored when reading started
+type StreamReader struct {
+	JS       nats.JetStreamContext
+	Stream   string
+	Subject  string
+	LineFeed bool
+
+	sub  *nats.Subscription
+	done bool
+	buf  []byte
+}
+
+func (r *StreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next load the next message into the buffer
+func (r *StreamReader) next() error {
+	if r.sub == nil {
+		// nothing at all on the subject, so do not wait for a message that will never come
+		if g, ok := r.JS.(lastMsgGetter); ok {
+			if _, err := g.GetLastMsg(r.Stream, r.Subject); err == nats.ErrMsgNotFound {
+				r.done = true
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("failed to read stream %s subject %s: %v", r.Stream, r.Subject, err)
+			}
+		}
+		sub, err := r.JS.SubscribeSync(r.Subject, nats.BindStream(r.Stream), nats.OrderedConsumer(), nats.DeliverAll())
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to stream %s subject %s: %v", r.Stream, r.Subject, err)
+		}
+		r.sub = sub
+	}
+	msg, err := r.sub.NextMsg(readTimeout)
+	if err != nil {
+		r.close()
+		return fmt.Errorf("failed to read stream %s subject %s: %v", r.Stream, r.Subject, err)
+	}
+	meta, err := msg.Metadata()
+	if err != nil {
+		r.close()
+		return fmt.Errorf("invalid message in stream %s subject %s: %v", r.Stream, r.Subject, err)
+	}
+	if meta.NumPending == 0 {
+		r.close()
+	}
+	data, err := common.Decompress(msg.Header.Get(encodingHeader), msg.Data)
+	if err != nil {
+		r.close()
+		return fmt.Errorf("invalid message in stream %s subject %s: %v", r.Stream, r.Subject, err)
+	}
+	r.buf = append(r.buf, data...)
+	if r.LineFeed && len(data) > 0 {
+		r.buf = append(r.buf, 0x0a)
+	}
+	return nil
+}
+
+func (r *StreamReader) close() {
+	r.done = true
+	if r.sub != nil {
+		_ = r.sub.Unsubscribe()
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package nats
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// reencryptAttempts how many times a value is read and replaced while it is written meanwhile
+const reencryptAttempts = 10
+
+// Reencrypt encrypt anew the values of the bucket written in plaintext, or encrypted by older releases without the
+// key of their record, with the encryptor set; all of them but the schema version. Each is replaced only if it is
+// still the revision read, so that one written meanwhile is not undone. Returns how many were
+func (d *DeviceManager) Reencrypt() (int, error) {
+	if d.encryptor == nil {
+		return 0, nil
+	}
+	keys, err := d.kv.Keys()
+	if err == nats.ErrNoKeysFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to list keys of bucket %s: %v", d.bucket, err)
+	}
+	n := 0
+	for _, k := range keys {
+		if k == schemaVersionKey {
+			continue
+		}
+		changed, err := d.reencryptValue(k)
+		if err != nil {
+			return n, err
+		}
+		if changed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// reencryptValue encrypt anew the value of a key, if it is not encrypted with the key of its record, returning
+// whether it was
+func (d *DeviceManager) reencryptValue(k string) (bool, error) {
+	for i := 0; i < reencryptAttempts; i++ {
+		entry, err := d.kv.Get(k)
+		switch {
+		case err == nats.ErrKeyNotFound:
+			// removed since the keys were listed
+			return false, nil
+		case err != nil:
+			return false, fmt.Errorf("failed to read %s: %v", k, err)
+		}
+		v, changed, err := d.encryptor.Reencrypt(entry.Value(), k)
+		if err != nil {
+			return false, fmt.Errorf("failed to reencrypt %s: %v", k, err)
+		}
+		if !changed {
+			return false, nil
+		}
+		if _, err := d.kv.Update(k, v, entry.Revision()); err == nil {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("failed to reencrypt %s: the value kept changing", k)
+}
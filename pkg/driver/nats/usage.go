@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package nats
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/nats-io/nats.go"
+	uuid "github.com/satori/go.uuid"
+)
+
+// DeviceUsage get the bytes of the messages of each kind of a device, as stored, their number and when the oldest
+// and newest were stored. The messages are gone through with their headers only, so their data is not sent
+func (d *DeviceManager) DeviceUsage(u uuid.UUID) (*common.DeviceUsage, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from NATS: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	usage := common.NewDeviceUsage(u.String())
+	for kind, subject := range map[string]string{
+		common.KindLogs:     d.deviceSubject(logsSubject, u),
+		common.KindInfo:     d.deviceSubject(infoSubject, u),
+		common.KindMetrics:  d.deviceSubject(metricsSubject, u),
+		common.KindRequests: d.deviceSubject(requestsSubject, u),
+		// those of all its app instances
+		common.KindAppLogs: d.deviceSubject(appLogsSubject, u) + ".>",
+	} {
+		s, err := d.subjectUsage(subject)
+		if err != nil {
+			return nil, err
+		}
+		usage.Add(kind, s)
+	}
+	return usage, nil
+}
+
+// subjectUsage the bytes and number of the messages of a subject, which may have wildcards, and when the oldest and
+// newest were stored
+func (d *DeviceManager) subjectUsage(subject string) (common.StreamUsage, error) {
+	u := common.StreamUsage{}
+	sub, err := d.js.SubscribeSync(subject, nats.BindStream(d.stream), nats.OrderedConsumer(), nats.DeliverAll(), nats.HeadersOnly())
+	if err != nil {
+		return u, fmt.Errorf("failed to subscribe to stream %s subject %s: %v", d.stream, subject, err)
+	}
+	defer sub.Unsubscribe()
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return u, fmt.Errorf("failed to get consumer of stream %s subject %s: %v", d.stream, subject, err)
+	}
+	// nothing at all on the subject, so do not wait for a message that will never come
+	if info.NumPending == 0 && info.Delivered.Consumer == 0 {
+		return u, nil
+	}
+	for {
+		msg, err := sub.NextMsg(readTimeout)
+		if err != nil {
+			return u, fmt.Errorf("failed to read stream %s subject %s: %v", d.stream, subject, err)
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return u, fmt.Errorf("invalid message in stream %s subject %s: %v", d.stream, subject, err)
+		}
+		size, err := strconv.ParseInt(msg.Header.Get(nats.MsgSize), 10, 64)
+		if err != nil {
+			return u, fmt.Errorf("invalid size of message in stream %s subject %s: %v", d.stream, subject, err)
+		}
+		u.Bytes += size
+		u.Entries++
+		t := meta.Timestamp
+		if u.Oldest == nil {
+			u.Oldest = &t
+		}
+		u.Newest = &t
+		if meta.NumPending == 0 {
+			return u, nil
+		}
+	}
+}
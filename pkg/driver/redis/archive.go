@@ -0,0 +1,182 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+)
+
+const (
+	// archiveParam query parameter of the database URL where to move the entries of device streams once they are
+	// older than archiveAfterParam: a directory, or s3://<bucket>[/<prefix>], e.g.
+	//   redis://localhost:6379?archive=s3://adam-archive/prod&archive-after=72h
+	archiveParam = "archive"
+	// archiveAfterParam query parameter of the database URL setting the age of the entries archived, as a duration
+	archiveAfterParam = "archive-after"
+	// defaultArchiveAfter the age of the entries archived, unless archiveAfterParam is set
+	defaultArchiveAfter = 24 * time.Hour
+	// archiveBatch the most entries in a segment, read from the stream at once
+	archiveBatch = 1000
+)
+
+// deviceStreams the prefixes of the names of the streams of devices
+var deviceStreams = []string{deviceLogsStream, deviceInfoStream, deviceMetricsStream, deviceRequestsStream, deviceAppLogsStream}
+
+// initArchive set up the cold store of the database URL, if any
+func (d *DeviceManager) initArchive(location, after string) error {
+	d.cold = nil
+	d.archiveAfter = defaultArchiveAfter
+	if after != "" {
+		v, err := time.ParseDuration(after)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("invalid %s %q, must be a positive duration, e.g. 24h", archiveAfterParam, after)
+		}
+		d.archiveAfter = v
+	}
+	if location == "" {
+		return nil
+	}
+	cold, err := common.NewColdStore(location)
+	if err != nil {
+		return err
+	}
+	d.cold = cold
+	return nil
+}
+
+// Archive move the entries of device streams older than the archive age to the cold store, in segments, removing
+// them from Redis once stored
+func (d *DeviceManager) Archive() ([]common.Archived, error) {
+	if d.cold == nil {
+		return nil, fmt.Errorf("no archive, set %s in the database URL", archiveParam)
+	}
+	// the last millisecond before the cutoff, every entry of which is old enough
+	end := strconv.FormatInt(time.Now().Add(-d.archiveAfter).UnixNano()/int64(time.Millisecond)-1, 10)
+	archived := []common.Archived{}
+	for _, prefix := range deviceStreams {
+		streams, err := d.client.Keys(prefix + "*").Result()
+		if err != nil {
+			return archived, fmt.Errorf("failed to list streams %s*: %v", prefix, err)
+		}
+		for _, s := range streams {
+			a, err := d.archiveStream(s, end)
+			if a != nil && a.Entries > 0 {
+				archived = append(archived, *a)
+			}
+			if err != nil {
+				return archived, err
+			}
+		}
+	}
+	return archived, nil
+}
+
+// archiveStream move the entries of a stream up to an ID to the cold store. Entries without an object, such as the
+// empty one creating the stream, or that cannot be decoded, are left in Redis
+func (d *DeviceManager) archiveStream(stream, end string) (*common.Archived, error) {
+	a := &common.Archived{Stream: stream, Segments: []string{}}
+	for start := "-"; ; {
+		messages, err := d.client.XRangeN(stream, start, end, archiveBatch).Result()
+		if err != nil {
+			return a, fmt.Errorf("failed to read stream %s: %v", stream, err)
+		}
+		if len(messages) == 0 {
+			return a, nil
+		}
+		var entries []common.ArchivedEntry
+		var ids []string
+		for _, m := range messages {
+			b, ok, err := streamObject(m.Values)
+			if err != nil {
+				log.Printf("not archiving entry %s of stream %s: %v", m.ID, stream, err)
+			}
+			if !ok || err != nil || len(b) == 0 {
+				continue
+			}
+			entries = append(entries, common.ArchivedEntry{ID: m.ID, Object: b})
+			ids = append(ids, m.ID)
+		}
+		if len(entries) > 0 {
+			key := common.SegmentKey(stream, entries[0].ID, entries[len(entries)-1].ID)
+			b, err := common.EncodeSegment(entries)
+			if err != nil {
+				return a, fmt.Errorf("failed to encode segment %s: %v", key, err)
+			}
+			if err := d.cold.Put(key, b); err != nil {
+				return a, fmt.Errorf("failed to archive segment %s: %v", key, err)
+			}
+			// only removed once stored, so that a failure leaves them in Redis, to be archived again
+			if err := d.client.XDel(stream, ids...).Err(); err != nil {
+				return a, fmt.Errorf("failed to remove archived entries of stream %s: %v", stream, err)
+			}
+			a.Segments = append(a.Segments, key)
+			a.Entries += len(entries)
+		}
+		if len(messages) < archiveBatch {
+			return a, nil
+		}
+		start = nextStreamID(messages[len(messages)-1].ID)
+	}
+}
+
+// nextStreamID the smallest ID after another, to range from it inclusively, as older Redis cannot exclusively
+func nextStreamID(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return id
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return id
+	}
+	return parts[0] + "-" + strconv.FormatUint(seq+1, 10)
+}
+
+// removeArchived remove the archived segments of streams, of a device removed. Failures are logged, as the device is
+// removed already
+func (d *DeviceManager) removeArchived(streams []string) {
+	if d.cold == nil {
+		return
+	}
+	for _, s := range streams {
+		keys, err := d.cold.List(s + "/")
+		if err != nil {
+			log.Printf("error listing the archive of stream %s: %v", s, err)
+			continue
+		}
+		for _, k := range keys {
+			if err := d.cold.Delete(k); err != nil {
+				log.Printf("error removing archived segment %s: %v", k, err)
+			}
+		}
+	}
+}
+
+// streamNames the names of the device streams among keys to drop
+func streamNames(keys [][]string) []string {
+	var names []string
+	for _, k := range keys {
+		for _, prefix := range deviceStreams {
+			if len(k) == 1 && strings.HasPrefix(k[0], prefix) {
+				names = append(names, k[0])
+				break
+			}
+		}
+	}
+	return names
+}
+
+// ArchiveLocation where the entries of device streams are archived, empty if they are not
+func (d *DeviceManager) ArchiveLocation() string {
+	if d.cold == nil {
+		return ""
+	}
+	return d.cold.Name()
+}
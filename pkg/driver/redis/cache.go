@@ -0,0 +1,340 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// cache state shared by a DeviceManager and the copies of it made by WithContext
+type cache struct {
+	nextReplica uint32
+	// replicaMu guards replicaChecks, whether each read replica answered when it was last pinged, by its index in
+	// replicas
+	replicaMu     sync.Mutex
+	replicaChecks []replicaCheck
+	stale         uint32
+	cacheTimeout  int
+	// refresh serializes refreshing the cache, so that requests finding it expired at once load it only once
+	refresh    sync.Mutex
+	lastUpdate time.Time
+	// mu guards the cached maps below, which requests read while a refresh or a write replaces them
+	mu      sync.RWMutex
+	version uint64
+	// these are for caching only
+	onboardCerts map[string]map[string]bool
+	deviceCerts  map[string]uuid.UUID
+	devices      map[uuid.UUID]common.DeviceStorage
+	// loaded what the cache was last loaded from, so that only what changed since is decoded again
+	loaded *loadedHashes
+}
+
+// loadedHashes the raw values of the cached hashes, as last loaded, and what was decoded from them
+type loadedHashes struct {
+	values  map[string]map[string]string
+	onboard map[string]onboardEntry
+}
+
+// onboardEntry an onboarding certificate in the cache, and its serials
+type onboardEntry struct {
+	certStr string
+	serials map[string]bool
+}
+
+// unchanged whether the field of each of the hashes has the same raw value as when last loaded
+func (l *loadedHashes) unchanged(values map[string]map[string]string, field string, hashes ...string) bool {
+	if l == nil {
+		return false
+	}
+	for _, h := range hashes {
+		if l.values[h][field] != values[h][field] {
+			return false
+		}
+	}
+	return true
+}
+
+// device get a registered device from the cache
+func (c *cache) device(u uuid.UUID) (common.DeviceStorage, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	dev, ok := c.devices[u]
+	return dev, ok
+}
+
+// deviceIDs the UUIDs of the devices in the cache
+func (c *cache) deviceIDs() []uuid.UUID {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := make([]uuid.UUID, 0, len(c.devices))
+	for u := range c.devices {
+		ids = append(ids, u)
+	}
+	return ids
+}
+
+// appLogIDs the app instances a device in the cache has logs of
+func (c *cache) appLogIDs(u uuid.UUID) []uuid.UUID {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := make([]uuid.UUID, 0, len(c.devices[u].AppLogs))
+	for id := range c.devices[u].AppLogs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// update change the cached maps with f, so that a refresh that loaded them before the change does not undo it
+func (c *cache) update(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version++
+	f()
+}
+
+// refreshCache refresh cache from disk
+func (d *DeviceManager) refreshCache() error {
+	d.refresh.Lock()
+	defer d.refresh.Unlock()
+	// is it time to update the cache again, or did what it is loaded from change?
+	now := time.Now()
+	stale := atomic.SwapUint32(&d.stale, 0) == 1
+	if !stale && now.Sub(d.lastUpdate).Seconds() < float64(d.cacheTimeout) {
+		return nil
+	}
+
+	// from the primary, not a read replica: a replica lagging behind would miss the certificates just registered or
+	// replaced, and the devices presenting them would be rejected
+	if err := d.loadCache(d.client); err != nil {
+		if stale {
+			atomic.StoreUint32(&d.stale, 1)
+		}
+		return err
+	}
+
+	// mark the time we updated
+	d.lastUpdate = now
+	return nil
+}
+
+// readCachedHashes read all the hashes the cache is loaded from, and the keys of the app log streams, in a single
+// round trip
+func readCachedHashes(c *redis.Client) (map[string]map[string]string, []string, error) {
+	var (
+		names   = append(append([]string{}, cachedHashes...), deviceQuotasHash)
+		hashes  []*redis.StringStringMapCmd
+		appLogs *redis.StringSliceCmd
+	)
+	_, err := c.Pipelined(func(p redis.Pipeliner) error {
+		for _, h := range names {
+			hashes = append(hashes, p.HGetAll(h))
+		}
+		appLogs = p.Keys(deviceAppLogsStream + "*")
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve %s: %v", strings.Join(names, ", "), err)
+	}
+	values := map[string]map[string]string{}
+	for i, h := range names {
+		values[h] = hashes[i].Val()
+	}
+	return values, appLogs.Val(), nil
+}
+
+// loadCache load the cache from the given redis client, decoding only the entries that changed since it was last
+// loaded, and keeping the devices whose certificates and serial are unchanged as they are
+func (d *DeviceManager) loadCache(c *redis.Client) error {
+	d.mu.RLock()
+	version, prev := d.version, d.loaded
+	d.mu.RUnlock()
+
+	values, appLogKeys, err := readCachedHashes(c)
+	if err != nil {
+		return err
+	}
+	loaded := &loadedHashes{values: values, onboard: map[string]onboardEntry{}}
+
+	// create new vars to hold while we load
+	onboardCerts := make(map[string]map[string]bool)
+	deviceCerts := make(map[string]uuid.UUID)
+	devices := make(map[uuid.UUID]common.DeviceStorage)
+
+	// the onboarding certs
+	oserials := values[onboardSerialsHash]
+	for cn, raw := range values[onboardCertsHash] {
+		if prev.unchanged(values, cn, onboardCertsHash, onboardSerialsHash) {
+			if e, ok := prev.onboard[cn]; ok {
+				loaded.onboard[cn] = e
+				onboardCerts[e.certStr] = e.serials
+				continue
+			}
+		}
+		certPem, err := d.decodeCert(raw, onboardCertsHash, cn)
+		if err != nil {
+			return fmt.Errorf("unable to read onboard certificate %s: %v", cn, err)
+		}
+		cert, err := x509.ParseCertificate(certPem.Bytes)
+		if err != nil {
+			return fmt.Errorf("unable to convert data from %s to onboard certificate: %v", raw, err)
+		}
+		certStr := string(cert.Raw)
+
+		s, ok := oserials[cn]
+		if !ok {
+			log.Printf("unabled to get a serial for %s: %v", cn, redis.Nil)
+			continue
+		}
+		v, err := d.encryptor.Decrypt([]byte(s), recordKey(onboardSerialsHash, cn))
+		if err != nil {
+			log.Printf("unabled to get a serial for %s: %v", cn, err)
+			continue
+		}
+		serials, err := decodeSerials(v)
+		if err != nil {
+			return fmt.Errorf("unable to unmarshal onboard serials %s: %v", v, err)
+		}
+		serialList := map[string]bool{}
+		for _, serial := range serials {
+			serialList[serial] = true
+		}
+		loaded.onboard[cn] = onboardEntry{certStr: certStr, serials: serialList}
+		onboardCerts[certStr] = serialList
+	}
+
+	// the devices, from their certs, onboarding certs and serials; any of them may be missing
+	ids := map[string]bool{}
+	for _, h := range []string{deviceCertsHash, deviceOnboardCertsHash, deviceSerialsHash} {
+		for k := range values[h] {
+			ids[k] = true
+		}
+	}
+	for k := range ids {
+		// convert the path name to a UUID
+		u, err := uuid.FromString(k)
+		if err != nil {
+			return fmt.Errorf("unable to convert device uuid from Redis hash name %s: %v", k, err)
+		}
+		if old, ok := d.device(u); ok && prev.unchanged(values, k, deviceCertsHash, deviceOnboardCertsHash, deviceSerialsHash) {
+			// the app logs are found again below
+			old.AppLogs = map[uuid.UUID]common.BigData{}
+			devices[u] = old
+			if old.Cert != nil {
+				deviceCerts[string(old.Cert.Raw)] = u
+			}
+			continue
+		}
+		dev, err := d.decodeDevice(u, values)
+		if err != nil {
+			return err
+		}
+		devices[u] = dev
+		if dev.Cert != nil {
+			deviceCerts[string(dev.Cert.Raw)] = u
+		}
+	}
+
+	// only the quotas that changed are set again, and those removed are forgotten
+	for k, b := range values[deviceQuotasHash] {
+		if prev.unchanged(values, k, deviceQuotasHash) {
+			continue
+		}
+		u, err := uuid.FromString(k)
+		if err != nil {
+			return fmt.Errorf("unable to convert device uuid from Redis hash name %s: %v", k, err)
+		}
+		var q common.Quotas
+		if err := json.Unmarshal([]byte(b), &q); err != nil {
+			return fmt.Errorf("unable to decode quotas of device %s: %v", k, err)
+		}
+		d.quotas.SetDevice(u, &q)
+	}
+	if prev != nil {
+		for k := range prev.values[deviceQuotasHash] {
+			if _, ok := values[deviceQuotasHash][k]; ok {
+				continue
+			}
+			if u, err := uuid.FromString(k); err == nil {
+				d.quotas.SetDevice(u, nil)
+			}
+		}
+	}
+
+	// the app log streams are named by the device and the app instance
+	for _, key := range appLogKeys {
+		ids := strings.SplitN(strings.TrimPrefix(key, deviceAppLogsStream), "_", 2)
+		deviceID, err := uuid.FromString(ids[0])
+		if err != nil || len(ids) != 2 {
+			return fmt.Errorf("cannot parse device app logs stream %s: %v", key, err)
+		}
+		instanceID, err := uuid.FromString(ids[1])
+		if err != nil {
+			return fmt.Errorf("cannot parse device app logs stream %v", err)
+		}
+		if dev, ok := devices[deviceID]; ok {
+			dev.AppLogs[instanceID] = d.newDeviceStream(key, deviceID, common.KindAppLogs)
+		}
+	}
+
+	// replace the existing cache, unless it was written to while loading, in which case what was loaded may be
+	// missing that write, so it is loaded again the next time
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.version != version {
+		atomic.StoreUint32(&d.stale, 1)
+		return nil
+	}
+	d.onboardCerts = onboardCerts
+	d.deviceCerts = deviceCerts
+	d.devices = devices
+	d.loaded = loaded
+	return nil
+}
+
+// decodeDevice decode a device from the raw values of its certificate, onboarding certificate and serial
+func (d *DeviceManager) decodeDevice(u uuid.UUID, values map[string]map[string]string) (common.DeviceStorage, error) {
+	k := u.String()
+	dev := d.initDevice(u, nil, "")
+	if c, ok := values[deviceCertsHash][k]; ok {
+		certPem, err := d.decodeCert(c, deviceCertsHash, k)
+		if err != nil {
+			return dev, fmt.Errorf("unable to read device certificate for %s: %v", u, err)
+		}
+		cert, err := x509.ParseCertificate(certPem.Bytes)
+		if err != nil {
+			return dev, fmt.Errorf("unable to convert data from file %s to device certificate: %v", c, err)
+		}
+		dev.Cert = cert
+	}
+	if b, ok := values[deviceOnboardCertsHash][k]; ok {
+		certPem, err := d.decodeCert(b, deviceOnboardCertsHash, k)
+		if err != nil {
+			return dev, fmt.Errorf("unable to read device onboard certificate for %s: %v", u, err)
+		}
+		cert, err := x509.ParseCertificate(certPem.Bytes)
+		if err != nil {
+			return dev, fmt.Errorf("unable to convert data from file %s to device onboard certificate: %v", b, err)
+		}
+		dev.Onboard = cert
+	}
+	if s, ok := values[deviceSerialsHash][k]; ok {
+		serial, err := d.encryptor.Decrypt([]byte(s), recordKey(deviceSerialsHash, k))
+		if err != nil {
+			return dev, fmt.Errorf("unable to read device serial for %s: %v", u, err)
+		}
+		dev.Serial = string(serial)
+	}
+	return dev, nil
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis_test
+
+import (
+	"testing"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/adam/pkg/driver/drivertest"
+	"github.com/lf-edge/adam/pkg/driver/redis"
+)
+
+func TestConformance(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) driver.DeviceManager {
+		client := goredis.NewClient(&goredis.Options{Addr: "localhost:6379"})
+		defer client.Close()
+		if client.FlushAll().Err() != nil {
+			t.Skip("you need to run 'docker run redis' before running the rest of the tests")
+		}
+		d := &redis.DeviceManager{}
+		if _, err := d.Init("redis://localhost:6379/0", common.MaxSizes{}); err != nil {
+			t.Fatalf("unable to initialize: %v", err)
+		}
+		return d
+	})
+}
@@ -4,7 +4,9 @@
 package redis
 
 import (
+	"bytes"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -13,6 +15,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -20,7 +23,6 @@ import (
 	ax "github.com/lf-edge/adam/pkg/x509"
 	uuid "github.com/satori/go.uuid"
 	"github.com/vmihailenco/msgpack/v4"
-	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -28,23 +30,66 @@ const (
 	// everything else is kept in Redis hashes with the following mapping:
 	onboardCertsHash       = "ONBOARD_CERTS"        // CN -> string (certificate PEM)
 	onboardSerialsHash     = "ONBOARD_SERIALS"      // CN -> []string (list of serial #s)
+	onboardPoliciesHash    = "ONBOARD_POLICIES"     // CN -> json (soft serials and hardware models allowed)
 	deviceSerialsHash      = "DEVICE_SERIALS"       // UUID -> string (single serial #)
 	deviceOnboardCertsHash = "DEVICE_ONBOARD_CERTS" // UUID -> string (certificate PEM)
 	deviceCertsHash        = "DEVICE_CERTS"         // UUID -> string (certificate PEM)
 	deviceConfigsHash      = "DEVICE_CONFIGS"       // UUID -> json (EVE config json representation)
+	deviceQuotasHash       = "DEVICE_QUOTAS"        // UUID -> json (quotas overriding the global ones)
+	deviceConfigAcksHash   = "DEVICE_CONFIG_ACKS"   // UUID -> json (config the device last reported having)
+	deviceInventoriesHash  = "DEVICE_INVENTORIES"   // UUID -> json (current state of the device, from its info messages)
+	deviceLogFiltersHash   = "DEVICE_LOG_FILTERS"   // UUID -> json (log filter overriding the global one)
+	deviceProfilesHash     = "DEVICE_PROFILES"      // UUID -> json (local profile server state)
+	deviceMetadataHash     = "DEVICE_METADATA"      // UUID -> json (name, site, owner and tags)
+	deviceModelsHash       = "DEVICE_MODELS"        // UUID -> string (name of the hardware model)
+	deviceAppCommandsHash  = "DEVICE_APP_COMMANDS"  // UUID -> json (commands to app instances, with their state)
+	deviceFlagsHash        = "DEVICE_FLAGS"         // UUID -> json (flags, with the config held)
+	deviceQuarantineHash   = "DEVICE_QUARANTINE"    // UUID -> json (reason and time of the quarantine)
+	deviceSourcesHash      = "DEVICE_SOURCES"       // UUID -> json (where the requests came from, with when and how many)
+	deviceAttestationsHash = "DEVICE_ATTESTATIONS"  // UUID -> json (certificates, nonce and vault keys of the attestation)
+	pendingHash            = "PENDING_DEVICES"      // ID -> json (device waiting for approval to register)
+	apiTokensHash          = "API_TOKENS"           // ID -> json (admin API token, with the hash of its secret)
+	rolloutsHash           = "ROLLOUTS"             // ID -> json (config rollout, with its progress)
+	schedulesHash          = "SCHEDULES"            // ID -> json (scheduled config change)
+	canariesHash           = "CANARIES"             // ID -> json (config canary, with what its devices reported)
+	alertRulesHash         = "ALERT_RULES"          // ID -> json (alert rule)
+	deviceTombstonesHash   = "DEVICE_TOMBSTONES"    // UUID -> json (device deleted softly, until removed for good)
+	revocationsHash        = "REVOCATIONS"          // fingerprint -> json (revoked device or onboarding certificate)
+	configSnapshotsHash    = "CONFIG_SNAPSHOTS"     // name -> json (config captured from a device)
+	hardwareModelsHash     = "HARDWARE_MODELS"      // name -> json (physical IO of a model of hardware)
+	datastoresHash         = "DATASTORES"           // name -> json (datastore of the catalog)
+	imagesHash             = "IMAGES"               // name -> json (image of the catalog)
+	deadLettersHash        = "DEAD_LETTERS"         // ID -> json (message of a device that could not be parsed)
+	acmeHash               = "ACME"                 // name -> PEM (ACME account key, certificate obtained with its key)
 
 	// Logs, info and metrics are managed by Redis streams named after device UUID as in:
 	//    LOGS_EVE_<UUID>
 	//    INFO_EVE_<UUID>
 	//    METRICS_EVE_<UUID>
-	// with each stream element having a single key pair:
-	//   "object" -> msgpack serialized object
-	// see MkStreamEntry() for details
+	// with each stream element having the fields:
+	//   "version" -> version of the entry, streamVersion
+	//   "format" -> format of the object, streamFormatJSON
+	//   "encoding" -> what the object is compressed with, if it is
+	//   "object" -> the object
+	// Version 1 only had the object, and version 2 added the encoding. Their objects are JSON, or msgpack as older
+	// releases wrote, see streamObject() for details
 	deviceLogsStream     = "LOGS_EVE_"
 	deviceInfoStream     = "INFO_EVE_"
 	deviceMetricsStream  = "METRICS_EVE_"
 	deviceRequestsStream = "REQUESTS_EVE_"
 	deviceAppLogsStream  = "APPS_EVE_"
+	auditStream          = "AUDIT" // append-only stream of admin actions
+
+	// The logs of a device are indexed by their source, e.g. zedagent, as they are written, in:
+	//    LOG_SOURCES_EVE_<UUID> -> set of the sources of the logs of the device
+	//    LOG_SOURCE_EVE_<UUID>_<source> -> list of the IDs in LOGS_EVE_<UUID> of the entries of the source, oldest first
+	deviceLogSourcesSet  = "LOG_SOURCES_EVE_"
+	deviceLogSourceIndex = "LOG_SOURCE_EVE_"
+	streamVersion        = "3"
+	streamFormatJSON     = "json" // the object as received: the protojson of an EVE message, or a JSON log entry
+
+	// swapAttempts how many times a config swap is tried while other configs change under it
+	swapAttempts = 10
 
 	MB                   = common.MB
 	maxLogSizeRedis      = 100 * MB
@@ -52,12 +97,58 @@ const (
 	maxMetricSizeRedis   = 100 * MB
 	maxRequestsSizeRedis = 100 * MB
 	maxAppLogsSizeRedis  = 100 * MB
+
+	// replicaParam query parameter of the database URL listing read replicas, comma-separated or repeated, e.g.
+	//   redis://primary:6379/0?replica=replica1:6379,replica2:6379
+	replicaParam = "replica"
+	// replicaCheckInterval how long a read replica is taken to be up, or down, after it was last pinged
+	replicaCheckInterval = 10 * time.Second
+
+	// compressParam query parameter of the database URL setting the compression of the entries of device
+	// streams, one of none, zstd and snappy, e.g. redis://localhost:6379?compress=zstd
+	compressParam = "compress"
+
+	// invalidateParam query parameter of the database URL invalidating the cache of certificates and serials as
+	// soon as they change, by another adam replica or tool, rather than only every cache timeout, as
+	// invalidateKeyspace or invalidateChannel, e.g. redis://localhost:6379?invalidate=channel
+	invalidateParam = "invalidate"
+
+	// sharedParam query parameter of the database URL telling the driver other adam replicas share the database,
+	// so that it locks the changes they could race on, and invalidates its cache on invalidateChannel unless set
+	// otherwise, e.g. redis://localhost:6379?shared=true
+	sharedParam = "shared"
 )
 
+// recordHashes the hashes the records of each of the common.RecordKinds are kept in, by key
+var recordHashes = map[string]string{
+	common.RecordPending:        pendingHash,
+	common.RecordTokens:         apiTokensHash,
+	common.RecordRollouts:       rolloutsHash,
+	common.RecordSchedules:      schedulesHash,
+	common.RecordCanaries:       canariesHash,
+	common.RecordAlertRules:     alertRulesHash,
+	common.RecordTombstones:     deviceTombstonesHash,
+	common.RecordRevocations:    revocationsHash,
+	common.RecordSnapshots:      configSnapshotsHash,
+	common.RecordHardwareModels: hardwareModelsHash,
+	common.RecordDatastores:     datastoresHash,
+	common.RecordImages:         imagesHash,
+	common.RecordDeadLetters:    deadLettersHash,
+	common.RecordACME:           acmeHash,
+}
+
 // ManagedStream stream of data interface
 type ManagedStream struct {
 	name   string
 	client *redis.Client
+	// readers pick the client to read from, if nil, client is used
+	readers func() *redis.Client
+	// maxLen get the maximum number of entries to keep, if nil or 0, the stream is not trimmed
+	maxLen func() int64
+	// compression of the entries written, none if empty
+	compression string
+	// cold where older entries are archived, read before those still in Redis; nil if they are not
+	cold common.ColdStore
 }
 
 func (m *ManagedStream) Get(index int) ([]byte, error) {
@@ -65,37 +156,92 @@ func (m *ManagedStream) Get(index int) ([]byte, error) {
 }
 
 func (m *ManagedStream) Write(b []byte) (int, error) {
+	if _, err := m.add(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// add append an entry to the stream, returning its ID
+func (m *ManagedStream) add(b []byte) (string, error) {
 	// XXX: lets see if this blocks
-	if _, err := m.client.XAdd(&redis.XAddArgs{
+	values, err := mkStreamEntry(b, m.compression)
+	if err != nil {
+		return "", fmt.Errorf("failed to compress message for stream %s: %v", m.name, err)
+	}
+	args := &redis.XAddArgs{
 		Stream: m.name,
 		ID:     "*",
-		Values: mkStreamEntry(b),
-	}).Result(); err != nil {
-		return 0, fmt.Errorf("failed to put message into a stream %s: %v", m.name, err)
+		Values: values,
 	}
-	return len(b), nil
+	if m.maxLen != nil {
+		args.MaxLenApprox = m.maxLen()
+	}
+	id, err := m.client.XAdd(args).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to put message into a stream %s: %v", m.name, err)
+	}
+	return id, nil
 }
 
 func (m *ManagedStream) Reader() (io.Reader, error) {
-	return &RedisStreamReader{
-		Client:   m.client,
+	client := m.client
+	if m.readers != nil {
+		client = m.readers()
+	}
+	reader := &RedisStreamReader{
+		Client:   client,
 		Stream:   m.name,
 		LineFeed: true,
-	}, nil
+	}
+	if m.cold == nil {
+		return reader, nil
+	}
+	// the archived entries first, then those in Redis after them, skipping any archived but not removed yet
+	archive, err := common.NewArchiveReader(m.cold, m.name+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the archive of stream %s: %v", m.name, err)
+	}
+	if last := archive.LastID(); last != "" {
+		reader.Start = nextStreamID(last)
+	}
+	return io.MultiReader(archive, reader), nil
+}
+
+// RangeReader a reader of the entries of the stream in a range. Entries are only read from Redis, not from the
+// archive, as those archived are read in full
+func (m *ManagedStream) RangeReader(rng common.StreamRange) (common.RangeReader, error) {
+	client := m.client
+	if m.readers != nil {
+		client = m.readers()
+	}
+	return newRangeReader(client, m.name, rng)
+}
+
+// Consumer a consumer of the stream as a member of a group. Groups change as they are read, so the primary is used
+func (m *ManagedStream) Consumer(group, consumer string) (*RedisStreamConsumer, error) {
+	return NewRedisStreamConsumer(m.client, m.name, group, consumer)
 }
 
 // DeviceManager implementation of DeviceManager interface with a Redis DB as the backing store
 type DeviceManager struct {
-	client       *redis.Client
-	databaseNet  string
-	databaseURL  string
-	databaseID   int
-	cacheTimeout int
-	lastUpdate   time.Time
-	// these are for caching only
-	onboardCerts map[string]map[string]bool
-	deviceCerts  map[string]uuid.UUID
-	devices      map[uuid.UUID]common.DeviceStorage
+	client      *redis.Client
+	replicas    []*redis.Client
+	databaseNet string
+	databaseURL string
+	databaseID  int
+	encryptor   *common.Encryptor
+	quotas      *common.QuotaTracker
+	compression string
+	// invalidate how the cache is invalidated as the data it is loaded from changes, empty for only on timeout
+	invalidate string
+	watcher    *changeWatcher
+	// shared whether other adam replicas share the database
+	shared bool
+	// cold where the entries of device streams older than archiveAfter are archived, nil if they are not
+	cold         common.ColdStore
+	archiveAfter time.Duration
+	*cache
 }
 
 // Name return name
@@ -136,9 +282,10 @@ func (d *DeviceManager) MaxAppLogsSize() int {
 // Init check if a URL is valid and initialize
 func (d *DeviceManager) Init(s string, sizes common.MaxSizes) (bool, error) {
 	URL, err := url.Parse(s)
-	if err != nil || URL.Scheme != "redis" {
+	if err != nil || (URL.Scheme != "redis" && URL.Scheme != srvScheme && URL.Scheme != tlsScheme && URL.Scheme != tlsSRVScheme) {
 		return false, err
 	}
+	srv := URL.Scheme == srvScheme || URL.Scheme == tlsSRVScheme
 
 	d.databaseNet = "tcp"
 
@@ -155,21 +302,151 @@ func (d *DeviceManager) Init(s string, sizes common.MaxSizes) (bool, error) {
 		d.databaseID = 0
 	}
 
-	d.client = redis.NewClient(&redis.Options{
-		Network:  d.databaseNet,
-		Addr:     d.databaseURL,
-		Password: URL.User.Username(), // yes, I know!
-		DB:       d.databaseID,
+	conn, err := parseConnOptions(URL, d.databaseID)
+	if err != nil {
+		return true, err
+	}
+	opts := conn.apply(&redis.Options{
+		Network: d.databaseNet,
+		Addr:    d.databaseURL,
 	})
+	// several servers, or servers discovered from SRV records, are failed over between on connection errors
+	if srv || strings.Contains(d.databaseURL, ",") {
+		e := newEndpoints(d.databaseURL, srv)
+		e.dialer = conn.dial
+		opts.Dialer = e.dial
+		opts.MaxRetries = failoverRetries
+		opts.MinRetryBackoff = minDialBackoff
+		opts.MaxRetryBackoff = maxDialBackoff
+	}
+	d.client = redis.NewClient(opts)
+
+	if d.compression, err = common.ParseCompression(URL.Query().Get(compressParam)); err != nil {
+		return true, err
+	}
+
+	if err := d.initArchive(URL.Query().Get(archiveParam), URL.Query().Get(archiveAfterParam)); err != nil {
+		return true, err
+	}
+
+	d.replicas = nil
+	for _, param := range URL.Query()[replicaParam] {
+		for _, addr := range strings.Split(param, ",") {
+			if addr = strings.TrimSpace(addr); addr == "" {
+				continue
+			}
+			d.replicas = append(d.replicas, redis.NewClient(conn.apply(&redis.Options{
+				Network: d.databaseNet,
+				Addr:    addr,
+			})))
+		}
+	}
+
+	d.quotas = common.NewQuotaTracker()
+	d.cache = &cache{
+		replicaChecks: make([]replicaCheck, len(d.replicas)),
+		onboardCerts:  map[string]map[string]bool{},
+		deviceCerts:   map[string]uuid.UUID{},
+		devices:       map[uuid.UUID]common.DeviceStorage{},
+	}
 
+	if d.watcher != nil {
+		d.watcher.close()
+		d.watcher = nil
+	}
+	d.shared = false
+	if v := URL.Query().Get(sharedParam); v != "" {
+		if d.shared, err = strconv.ParseBool(v); err != nil {
+			return true, fmt.Errorf("invalid %s %q: %v", sharedParam, v, err)
+		}
+	}
+	d.invalidate = URL.Query().Get(invalidateParam)
+	if d.invalidate == "" && d.shared {
+		d.invalidate = invalidateChannel
+	}
+	if d.invalidate != "" {
+		if d.watcher, err = d.watchChanges(d.invalidate); err != nil {
+			return true, err
+		}
+	}
 	return true, nil
 }
 
+// replicaCheck when a read replica was last pinged, and the error it answered with, if any
+type replicaCheck struct {
+	at  time.Time
+	err error
+}
+
+// readClient pick a read replica, round-robin, skipping any that did not respond when last pinged. Falls back to the
+// primary if no replicas are configured or none of them are reachable
+func (d *DeviceManager) readClient() *redis.Client {
+	for i := 0; i < len(d.replicas); i++ {
+		n := int(atomic.AddUint32(&d.nextReplica, 1) % uint32(len(d.replicas)))
+		if d.replicaHealth(n) == nil {
+			return d.replicas[n]
+		}
+	}
+	return d.client
+}
+
+// replicaHealth the error the read replica n answered with when last pinged, pinging it again only once
+// replicaCheckInterval passed, so that readers are not each a round trip to it. Another reader asking while it is
+// pinged gets the answer of the last ping
+func (d *DeviceManager) replicaHealth(n int) error {
+	d.replicaMu.Lock()
+	check := d.replicaChecks[n]
+	if time.Since(check.at) < replicaCheckInterval {
+		d.replicaMu.Unlock()
+		return check.err
+	}
+	d.replicaChecks[n].at = time.Now()
+	d.replicaMu.Unlock()
+
+	c := d.replicas[n]
+	err := c.Ping().Err()
+	switch {
+	case err != nil && check.err == nil:
+		log.Printf("redis read replica %s unavailable: %v", c.Options().Addr, err)
+	case err == nil && check.err != nil:
+		log.Printf("redis read replica %s available again", c.Options().Addr)
+	}
+	d.replicaMu.Lock()
+	d.replicaChecks[n] = replicaCheck{at: time.Now(), err: err}
+	d.replicaMu.Unlock()
+	return err
+}
+
+// newStream create a managed stream whose reads go to the replicas, if any
+func (d *DeviceManager) newStream(name string) *ManagedStream {
+	return &ManagedStream{
+		name:    name,
+		client:  d.client,
+		readers: d.readClient,
+	}
+}
+
+// newDeviceStream create a managed stream of a kind of messages of a device, trimmed to the device quota
+func (d *DeviceManager) newDeviceStream(name string, u uuid.UUID, kind string) *ManagedStream {
+	m := d.newStream(name)
+	m.maxLen = func() int64 {
+		return d.quotas.MaxLen(u, kind)
+	}
+	m.compression = d.compression
+	m.cold = d.cold
+	return m
+}
+
 // SetCacheTimeout set the timeout for refreshing the cache, unused in memory
 func (d *DeviceManager) SetCacheTimeout(timeout int) {
 	d.cacheTimeout = timeout
 }
 
+// SetEncryptor set the encryptor used for certificates, serials and configs
+func (d *DeviceManager) SetEncryptor(e *common.Encryptor) {
+	d.encryptor = e
+}
+
 // OnboardCheck see if a particular certificate and serial combination is valid
 func (d *DeviceManager) OnboardCheck(cert *x509.Certificate, serial string) error {
 	// do not accept a nil certificate
@@ -198,21 +475,82 @@ func (d *DeviceManager) OnboardGet(cn string) (*x509.Certificate, []string, erro
 	}
 
 	cert, err := d.readCert(onboardCertsHash, cn)
+	if err == redis.Nil {
+		return nil, nil, &common.NotFoundError{Err: fmt.Sprintf("onboard cn not found: %s", cn)}
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
-	s, err := d.client.HGet(onboardSerialsHash, cn).Result()
+	s, err := d.readValue(onboardSerialsHash, cn)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error reading onboard serials for %s: %v", cn, err)
 	}
-	var serials []string
-	if err = msgpack.Unmarshal([]byte(s), &serials); err != nil {
+	serials, err := decodeSerials(s)
+	if err != nil {
 		return nil, nil, fmt.Errorf("error decoding onboard serials for %s %v (%s)", cn, err, s)
 	}
 	return cert, serials, nil
 }
 
+// OnboardPolicyGet get the policy of an onboarding certificate by Common Name, nil if it has none
+func (d *DeviceManager) OnboardPolicyGet(cn string) (*common.OnboardPolicy, error) {
+	if err := d.checkOnboard(cn); err != nil {
+		return nil, err
+	}
+	name := common.GetOnboardCertName(cn)
+	b, err := d.readValue(onboardPoliciesHash, name)
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read onboard policy of %s: %v", cn, err)
+	}
+	var p common.OnboardPolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode onboard policy of %s: %v", cn, err)
+	}
+	return &p, nil
+}
+
+// OnboardPolicySet set the policy of an onboarding certificate by Common Name, replacing any; nil removes it
+func (d *DeviceManager) OnboardPolicySet(cn string, p *common.OnboardPolicy) error {
+	if err := d.checkOnboard(cn); err != nil {
+		return err
+	}
+	name := common.GetOnboardCertName(cn)
+	if p == nil {
+		if err := d.client.HDel(onboardPoliciesHash, name).Err(); err != nil {
+			return fmt.Errorf("failed to remove onboard policy of %s: %v", cn, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to encode onboard policy of %s: %v", cn, err)
+	}
+	if err := d.writeValue(onboardPoliciesHash, name, b); err != nil {
+		return fmt.Errorf("failed to save onboard policy of %s: %v", cn, err)
+	}
+	return nil
+}
+
+// checkOnboard check an onboarding certificate of a Common Name is registered, from the cache
+func (d *DeviceManager) checkOnboard(cn string) error {
+	name := common.GetOnboardCertName(cn)
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for certStr := range d.onboardCerts {
+		if cert, err := x509.ParseCertificate([]byte(certStr)); err == nil && common.GetOnboardCertName(cert.Subject.CommonName) == name {
+			return nil
+		}
+	}
+	return &common.NotFoundError{Err: fmt.Sprintf("onboard cn not found: %s", cn)}
+}
+
 // OnboardList list all of the known Common Names for onboard
 func (d *DeviceManager) OnboardList() ([]string, error) {
 	// refresh certs from Redis, if needed - includes checking if necessary based on timer
@@ -220,6 +558,8 @@ func (d *DeviceManager) OnboardList() ([]string, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
 	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	cns := make([]string, 0)
 	for certStr := range d.onboardCerts {
 		certRaw := []byte(certStr)
@@ -234,8 +574,16 @@ func (d *DeviceManager) OnboardList() ([]string, error) {
 
 // OnboardRemove remove an onboard certificate based on Common Name
 func (d *DeviceManager) OnboardRemove(cn string) (result error) {
+	if _, _, err := d.OnboardGet(cn); err != nil {
+		return err
+	}
 	result = d.transactionDrop([][]string{{onboardCertsHash, cn}, {onboardSerialsHash, cn}})
 	if result == nil {
+		// not every onboarding certificate has a policy, so it is not part of the drop
+		if err := d.client.HDel(onboardPoliciesHash, common.GetOnboardCertName(cn)).Err(); err != nil {
+			return fmt.Errorf("unable to remove the onboard policy of %s: %v", cn, err)
+		}
+		d.publishChange(onboardCertsHash)
 		result = d.refreshCache()
 	}
 	return
@@ -246,8 +594,14 @@ func (d *DeviceManager) OnboardClear() error {
 	if err := d.transactionDrop([][]string{{onboardCertsHash}, {onboardSerialsHash}}); err != nil {
 		return fmt.Errorf("unable to remove the onboarding certificates/serials: %v", err)
 	}
+	if err := d.client.Del(onboardPoliciesHash).Err(); err != nil {
+		return fmt.Errorf("unable to remove the onboard policies: %v", err)
+	}
+	d.publishChange(onboardCertsHash)
 
-	d.onboardCerts = map[string]map[string]bool{}
+	d.update(func() {
+		d.onboardCerts = map[string]map[string]bool{}
+	})
 	return nil
 }
 
@@ -261,8 +615,10 @@ func (d *DeviceManager) DeviceCheckCert(cert *x509.Certificate) (*uuid.UUID, err
 	if err != nil {
 		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
 	}
-	certStr := string(cert.Raw)
-	if u, ok := d.deviceCerts[certStr]; ok {
+	d.mu.RLock()
+	u, ok := d.deviceCerts[string(cert.Raw)]
+	d.mu.RUnlock()
+	if ok {
 		return &u, nil
 	}
 	return nil, nil
@@ -270,18 +626,26 @@ func (d *DeviceManager) DeviceCheckCert(cert *x509.Certificate) (*uuid.UUID, err
 
 // DeviceRemove remove a device
 func (d *DeviceManager) DeviceRemove(u *uuid.UUID) error {
+	return d.withLock("device:"+u.String(), func() error {
+		return d.deviceRemove(u)
+	})
+}
+
+// deviceRemove remove a device and all its data
+func (d *DeviceManager) deviceRemove(u *uuid.UUID) error {
+	if _, _, _, err := d.DeviceGet(u); err != nil {
+		return err
+	}
 	k := u.String()
 	streams := [][]string{
 		{deviceCertsHash, k},
 		{deviceConfigsHash, k},
-		{deviceOnboardCertsHash, k},
-		{deviceSerialsHash, k},
 		{deviceInfoStream + k},
 		{deviceLogsStream + k},
 		{deviceMetricsStream + k},
 		{deviceRequestsStream + k},
 	}
-	for appUUID := range d.devices[*u].AppLogs {
+	for _, appUUID := range d.appLogIDs(*u) {
 		streams = append(streams, []string{deviceAppLogsStream + k + "_" + appUUID.String()})
 	}
 	err := d.transactionDrop(streams)
@@ -289,6 +653,56 @@ func (d *DeviceManager) DeviceRemove(u *uuid.UUID) error {
 	if err != nil {
 		return fmt.Errorf("unable to remove the device %s %v", k, err)
 	}
+	d.removeArchived(streamNames(streams))
+	if err := d.dropLogSources(*u); err != nil {
+		return fmt.Errorf("unable to remove the device %s %v", k, err)
+	}
+	// devices added by an admin have no onboarding certificate nor serial, most devices have no quotas of their own,
+	// and may not have reported a config yet, so these are not part of the drop above
+	if err := d.client.HDel(deviceOnboardCertsHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the onboarding certificate of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceSerialsHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the serial of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceQuotasHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the quotas of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceConfigAcksHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the config ack of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceInventoriesHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the inventory of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceLogFiltersHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the log filter of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceProfilesHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the local profile of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceMetadataHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the metadata of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceModelsHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the hardware model of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceAppCommandsHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the app commands of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceFlagsHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the flags of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceQuarantineHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the quarantine of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceSourcesHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the sources of device %s %v", k, err)
+	}
+	if err := d.client.HDel(deviceAttestationsHash, k).Err(); err != nil {
+		return fmt.Errorf("unable to remove the attestation of device %s %v", k, err)
+	}
+	d.quotas.Forget(*u)
+	d.publishChange(deviceCertsHash)
 	// refresh the cache
 	err = d.refreshCache()
 	if err != nil {
@@ -305,13 +719,14 @@ func (d *DeviceManager) DeviceClear() error {
 		{deviceCertsHash},
 		{deviceOnboardCertsHash}}
 
-	for u, dev := range d.devices {
+	ids := d.deviceIDs()
+	for _, u := range ids {
 		streams = append(streams,
 			[]string{deviceMetricsStream + u.String()},
 			[]string{deviceLogsStream + u.String()},
 			[]string{deviceInfoStream + u.String()},
 			[]string{deviceRequestsStream + u.String()})
-		for appUUID := range dev.AppLogs {
+		for _, appUUID := range d.appLogIDs(u) {
 			streams = append(streams, []string{deviceAppLogsStream + u.String() + "_" + appUUID.String()})
 		}
 	}
@@ -321,9 +736,24 @@ func (d *DeviceManager) DeviceClear() error {
 	if err != nil {
 		return fmt.Errorf("unable to remove all devices %v", err)
 	}
+	d.removeArchived(streamNames(streams))
+	for _, u := range ids {
+		if err := d.dropLogSources(u); err != nil {
+			return fmt.Errorf("unable to remove all devices %v", err)
+		}
+	}
+	if err := d.client.Del(deviceQuotasHash, deviceConfigAcksHash, deviceInventoriesHash, deviceLogFiltersHash, deviceProfilesHash, deviceMetadataHash, deviceModelsHash, deviceAppCommandsHash, deviceFlagsHash, deviceQuarantineHash, deviceSourcesHash, deviceAttestationsHash).Err(); err != nil {
+		return fmt.Errorf("unable to remove the quotas, config acks, inventories, log filters and local profiles of all devices %v", err)
+	}
+	for _, u := range ids {
+		d.quotas.Forget(u)
+	}
+	d.publishChange(deviceCertsHash)
 
-	d.deviceCerts = map[string]uuid.UUID{}
-	d.devices = map[uuid.UUID]common.DeviceStorage{}
+	d.update(func() {
+		d.deviceCerts = map[string]uuid.UUID{}
+		d.devices = map[uuid.UUID]common.DeviceStorage{}
+	})
 	return nil
 }
 
@@ -335,19 +765,22 @@ func (d *DeviceManager) DeviceGet(u *uuid.UUID) (*x509.Certificate, *x509.Certif
 
 	// first lets get the device certificate
 	cert, err := d.readCert(deviceCertsHash, u.String())
+	if err == redis.Nil {
+		return nil, nil, "", &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
 	if err != nil {
 		return nil, nil, "", err
 	}
 
-	// now lets get the device onboarding certificate
+	// now lets get the device onboarding certificate, if any
 	onboard, err := d.readCert(deviceOnboardCertsHash, u.String())
-	if err != nil {
+	if err != nil && err != redis.Nil {
 		return nil, nil, "", err
 	}
 
-	serial, err := d.client.HGet(deviceSerialsHash, u.String()).Result()
+	serial, _ := d.readValue(deviceSerialsHash, u.String())
 	// somehow device serials are best effort
-	return cert, onboard, serial, nil
+	return cert, onboard, string(serial), nil
 }
 
 // DeviceList list all of the known UUIDs for devices
@@ -357,10 +790,7 @@ func (d *DeviceManager) DeviceList() ([]*uuid.UUID, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
 	}
-	ids := make([]uuid.UUID, 0, len(d.devices))
-	for u := range d.devices {
-		ids = append(ids, u)
-	}
+	ids := d.deviceIDs()
 	pids := make([]*uuid.UUID, 0, len(ids))
 	for i := range ids {
 		pids = append(pids, &ids[i])
@@ -370,6 +800,14 @@ func (d *DeviceManager) DeviceList() ([]*uuid.UUID, error) {
 
 // DeviceRegister register a new device cert
 func (d *DeviceManager) DeviceRegister(unew uuid.UUID, cert, onboard *x509.Certificate, serial string, conf []byte) error {
+	// replicas registering at once could each find the cert, or the onboard serial, unused
+	return d.withLock("register", func() error {
+		return d.deviceRegister(unew, cert, onboard, serial, conf)
+	})
+}
+
+// deviceRegister register a device, once checked that its certificate is not in use
+func (d *DeviceManager) deviceRegister(unew uuid.UUID, cert, onboard *x509.Certificate, serial string, conf []byte) error {
 	// refresh certs from Redis, if needed - includes checking if necessary based on timer
 	err := d.refreshCache()
 	if err != nil {
@@ -384,6 +822,10 @@ func (d *DeviceManager) DeviceRegister(unew uuid.UUID, cert, onboard *x509.Certi
 	if u != nil {
 		return fmt.Errorf("device already registered")
 	}
+	// the serial was checked unused before registering, but another replica may have used it since
+	if d.shared && onboard != nil && serial != "" && d.getOnboardSerialDevice(onboard, serial) != nil {
+		return &common.UsedSerialError{Err: fmt.Sprintf("serial already used for onboarding certificate: %s", serial)}
+	}
 
 	// save the device certificate
 	err = d.writeCert(cert.Raw, deviceCertsHash, unew.String(), true)
@@ -399,24 +841,26 @@ func (d *DeviceManager) DeviceRegister(unew uuid.UUID, cert, onboard *x509.Certi
 		}
 	}
 	if serial != "" {
-		if _, err = d.client.HSet(deviceSerialsHash, unew.String(), serial).Result(); err == nil {
-			_, err = d.client.Save().Result()
-		}
-		if err != nil {
+		if err = d.writeValue(deviceSerialsHash, unew.String(), []byte(serial)); err != nil {
 			return fmt.Errorf("error saving device serial for %v: %v", unew, err)
 		}
 	}
 
 	// save the base configuration
-	err = d.writeJSONMsgPack(unew, deviceConfigsHash, conf)
+	err = d.writeJSON(unew, deviceConfigsHash, conf)
 	if err != nil {
 		return fmt.Errorf("error saving device config for %v: %v", unew, err)
 	}
 
-	// save new one to cache - just the serial and onboard; the rest is on disk
-	d.deviceCerts[string(cert.Raw)] = unew
-	d.devices[unew] = d.initDevice(unew, onboard, serial)
-	ds := d.devices[unew]
+	d.publishChange(deviceCertsHash)
+
+	// save new one to cache - just the certs and serial; the rest is on disk
+	ds := d.initDevice(unew, onboard, serial)
+	ds.Cert = cert
+	d.update(func() {
+		d.deviceCerts[string(cert.Raw)] = unew
+		d.devices[unew] = ds
+	})
 
 	// create the necessary Redis streams for this device
 	for _, ms := range []common.BigData{ds.Logs, ds.Info, ds.Metrics, ds.Requests} {
@@ -428,28 +872,61 @@ func (d *DeviceManager) DeviceRegister(unew uuid.UUID, cert, onboard *x509.Certi
 	return nil
 }
 
+// DeviceReplaceCert replace the certificate of a registered device
+func (d *DeviceManager) DeviceReplaceCert(u uuid.UUID, cert *x509.Certificate) error {
+	if cert == nil {
+		return fmt.Errorf("invalid nil certificate")
+	}
+	// refresh certs from Redis, if needed - includes checking if necessary based on timer
+	err := d.refreshCache()
+	if err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	dev, ok := d.device(u)
+	if !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	certStr := string(cert.Raw)
+	d.mu.RLock()
+	owner, ok := d.deviceCerts[certStr]
+	d.mu.RUnlock()
+	if ok {
+		if owner == u {
+			return nil
+		}
+		return &common.UsedCertError{Err: fmt.Sprintf("certificate already used by device %s", owner)}
+	}
+
+	// a single HSET, so the replacement is atomic
+	if err := d.writeCert(cert.Raw, deviceCertsHash, u.String(), true); err != nil {
+		return err
+	}
+	d.publishChange(deviceCertsHash)
+
+	// update the cache
+	dev.Cert = cert
+	d.update(func() {
+		for c, owner := range d.deviceCerts {
+			if owner == u {
+				delete(d.deviceCerts, c)
+			}
+		}
+		d.deviceCerts[certStr] = u
+		d.devices[u] = dev
+	})
+	return nil
+}
+
 // initDevice initialize a device
 func (d *DeviceManager) initDevice(u uuid.UUID, onboard *x509.Certificate, serial string) common.DeviceStorage {
 	return common.DeviceStorage{
-		Onboard: onboard,
-		Serial:  serial,
-		Logs: &ManagedStream{
-			name:   deviceLogsStream + u.String(),
-			client: d.client,
-		},
-		Info: &ManagedStream{
-			name:   deviceInfoStream + u.String(),
-			client: d.client,
-		},
-		Metrics: &ManagedStream{
-			name:   deviceMetricsStream + u.String(),
-			client: d.client,
-		},
-		Requests: &ManagedStream{
-			name:   deviceRequestsStream + u.String(),
-			client: d.client,
-		},
-		AppLogs: map[uuid.UUID]common.BigData{},
+		Onboard:  onboard,
+		Serial:   serial,
+		Logs:     d.newDeviceStream(deviceLogsStream+u.String(), u, common.KindLogs),
+		Info:     d.newDeviceStream(deviceInfoStream+u.String(), u, common.KindInfo),
+		Metrics:  d.newDeviceStream(deviceMetricsStream+u.String(), u, common.KindMetrics),
+		Requests: d.newDeviceStream(deviceRequestsStream+u.String(), u, common.KindRequests),
+		AppLogs:  map[uuid.UUID]common.BigData{},
 	}
 }
 
@@ -458,44 +935,52 @@ func (d *DeviceManager) OnboardRegister(cert *x509.Certificate, serial []string)
 	if cert == nil {
 		return fmt.Errorf("empty nil certificate")
 	}
-	certStr := string(cert.Raw)
 	cn := common.GetOnboardCertName(cert.Subject.CommonName)
+	// the cert and its serials are written separately, so replicas writing them at once could mix them up
+	return d.withLock("onboard:"+cn, func() error {
+		return d.onboardRegister(cert, cn, serial)
+	})
+}
+
+// onboardRegister write an onboard cert with the Common Name cn and its serials
+func (d *DeviceManager) onboardRegister(cert *x509.Certificate, cn string, serial []string) error {
+	certStr := string(cert.Raw)
 
 	if err := d.writeCert(cert.Raw, onboardCertsHash, cn, true); err != nil {
 		return err
 	}
 
-	v, err := msgpack.Marshal(&serial)
+	v, err := json.Marshal(serial)
 	if err != nil {
 		return fmt.Errorf("failed to serialize serials %v: %v", serial, err)
 	}
 
-	if _, err = d.client.HSet(onboardSerialsHash, cn, v).Result(); err == nil {
-		_, err = d.client.Save().Result()
-	}
-	if err != nil {
+	if err = d.writeValue(onboardSerialsHash, cn, v); err != nil {
 		return fmt.Errorf("failed to save serials %v: %v", serial, err)
 	}
+	d.publishChange(onboardCertsHash)
 
 	// update the cache
-	if d.onboardCerts == nil {
-		d.onboardCerts = map[string]map[string]bool{}
-	}
 	serialList := map[string]bool{}
 	for _, s := range serial {
 		serialList[s] = true
 	}
-	d.onboardCerts[certStr] = serialList
+	d.update(func() {
+		d.onboardCerts[certStr] = serialList
+	})
 
 	return nil
 }
 
 // WriteRequest record a request
 func (d *DeviceManager) WriteRequest(u uuid.UUID, b []byte) error {
-	if dev, ok := d.devices[u]; ok {
-		dev.AddRequest(b)
+	// make sure it is not nil
+	if len(b) < 1 {
 		return nil
 	}
+	if dev, ok := d.device(u); ok {
+		return dev.AddRequest(b)
+	}
 	return fmt.Errorf("device not found: %s", u)
 }
 
@@ -506,10 +991,13 @@ func (d *DeviceManager) WriteInfo(u uuid.UUID, b []byte) error {
 		return nil
 	}
 	// check that the device actually exists
-	dev, ok := d.devices[u]
+	dev, ok := d.device(u)
 	if !ok {
 		return fmt.Errorf("device not found: %s", u)
 	}
+	if err := d.quotas.Use(u, common.KindInfo, len(b)); err != nil {
+		return err
+	}
 	return dev.AddInfo(b)
 }
 
@@ -520,22 +1008,43 @@ func (d *DeviceManager) WriteLogs(u uuid.UUID, b []byte) error {
 		return nil
 	}
 	// check that the device actually exists
-	dev, ok := d.devices[u]
+	dev, ok := d.device(u)
 	if !ok {
 		return fmt.Errorf("device not found: %s", u)
 	}
-	return dev.AddLogs(b)
-}
-
-// appExists return if an app has been created
-func (d *DeviceManager) appExists(u, instanceID uuid.UUID) bool {
-	if _, ok := d.devices[u]; !ok {
-		return false
+	if err := d.quotas.Use(u, common.KindLogs, len(b)); err != nil {
+		return err
 	}
-	if _, ok := d.devices[u].AppLogs[instanceID]; !ok {
-		return false
+	stream, ok := dev.Logs.(*ManagedStream)
+	if !ok {
+		return dev.AddLogs(b)
+	}
+	id, err := stream.add(b)
+	if err != nil {
+		return err
 	}
-	return true
+	return d.indexLog(u, stream, id, b)
+}
+
+// appLog get the logs stream of an app of a device, creating it if the app has none yet
+func (d *DeviceManager) appLog(u, instanceID uuid.UUID) common.BigData {
+	d.mu.RLock()
+	stream, ok := d.devices[u].AppLogs[instanceID]
+	d.mu.RUnlock()
+	if ok {
+		return stream
+	}
+	stream = d.newDeviceStream(fmt.Sprintf("%s%s_%s", deviceAppLogsStream, u.String(), instanceID.String()), u, common.KindAppLogs)
+	d.update(func() {
+		if dev, ok := d.devices[u]; ok {
+			if s, ok := dev.AppLogs[instanceID]; ok {
+				stream = s
+				return
+			}
+			dev.AppLogs[instanceID] = stream
+		}
+	})
+	return stream
 }
 
 // WriteAppInstanceLogs write a message of AppInstanceLogBundle
@@ -544,17 +1053,14 @@ func (d *DeviceManager) WriteAppInstanceLogs(instanceID uuid.UUID, deviceID uuid
 	if len(b) < 1 {
 		return nil
 	}
-	dev, ok := d.devices[deviceID]
-	if !ok {
+	if _, ok := d.device(deviceID); !ok {
 		return fmt.Errorf("unregistered device UUID %s", deviceID)
 	}
-	if !d.appExists(deviceID, instanceID) {
-		d.devices[deviceID].AppLogs[instanceID] = &ManagedStream{
-			name:   fmt.Sprintf("%s%s_%s", deviceAppLogsStream, deviceID.String(), instanceID.String()),
-			client: d.client,
-		}
+	if err := d.quotas.Use(deviceID, common.KindAppLogs, len(b)); err != nil {
+		return err
 	}
-	return dev.AddAppLog(instanceID, b)
+	_, err := d.appLog(deviceID, instanceID).Write(b)
+	return err
 }
 
 // WriteMetrics write a metrics message
@@ -564,29 +1070,29 @@ func (d *DeviceManager) WriteMetrics(u uuid.UUID, b []byte) error {
 		return nil
 	}
 	// check that the device actually exists
-	dev, ok := d.devices[u]
+	dev, ok := d.device(u)
 	if !ok {
 		return fmt.Errorf("device not found: %s", u)
 	}
+	if err := d.quotas.Use(u, common.KindMetrics, len(b)); err != nil {
+		return err
+	}
 	return dev.AddMetrics(b)
 }
 
 // GetConfig retrieve the config for a particular device
 func (d *DeviceManager) GetConfig(u uuid.UUID) ([]byte, error) {
 	// hold our config
-	var b []byte
-	data, err := d.client.HGet(deviceConfigsHash, u.String()).Result()
-	if err != nil {
+	b, err := d.readValue(deviceConfigsHash, u.String())
+	switch {
+	case err == redis.Nil:
 		// if config doesn't exist - create an empty one
 		b = common.CreateBaseConfig(u)
-		if _, err = d.client.HSet(deviceConfigsHash, u.String(), string(b)).Result(); err == nil {
-			_, err = d.client.Save().Result()
-		}
-		if err != nil {
+		if err = d.writeValue(deviceConfigsHash, u.String(), b); err != nil {
 			return nil, fmt.Errorf("failed to save config for %s: %v", u.String(), err)
 		}
-	} else {
-		b = []byte(data)
+	case err != nil:
+		return nil, fmt.Errorf("failed to read config for %s: %v", u.String(), err)
 	}
 
 	return b, nil
@@ -598,6 +1104,72 @@ func (d *DeviceManager) SetConfig(u uuid.UUID, b []byte) error {
 	if len(b) < 1 {
 		return fmt.Errorf("empty configuration")
 	}
+	// so that the config of a device another replica is removing is not written back after it
+	return d.withLock("device:"+u.String(), func() error {
+		return d.setConfig(u, b)
+	})
+}
+
+// SwapConfig set the config for a particular device, if it is still old. The config is compared and replaced in a
+// transaction watching the configs, retried when another config changed meanwhile, so that concurrent writers, of
+// this replica or another, cannot both replace the same one
+func (d *DeviceManager) SwapConfig(u uuid.UUID, old, b []byte) error {
+	if len(b) < 1 {
+		return fmt.Errorf("empty configuration")
+	}
+	// the lock only keeps a removal by another replica from racing the swap
+	return d.withLock("device:"+u.String(), func() error {
+		if err := d.refreshCache(); err != nil {
+			return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+		}
+		if _, ok := d.device(u); !ok {
+			return fmt.Errorf("unregistered device UUID %s", u.String())
+		}
+		// so that a device without a config yet has its base one to compare with
+		if _, err := d.GetConfig(u); err != nil {
+			return err
+		}
+		v, err := d.encryptor.Encrypt(b, recordKey(deviceConfigsHash, u.String()))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < swapAttempts; i++ {
+			var conflict error
+			err := d.client.Watch(func(tx *redis.Tx) error {
+				stored, err := tx.HGet(deviceConfigsHash, u.String()).Result()
+				if err != nil {
+					return fmt.Errorf("failed to read config for %s: %v", u.String(), err)
+				}
+				current, err := d.encryptor.Decrypt([]byte(stored), recordKey(deviceConfigsHash, u.String()))
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(current, old) {
+					conflict = &common.ConfigConflictError{Err: fmt.Sprintf("config of %s changed", u), Current: current}
+					return nil
+				}
+				_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+					pipe.HSet(deviceConfigsHash, u.String(), string(v))
+					return nil
+				})
+				return err
+			}, deviceConfigsHash)
+			switch {
+			case err == redis.TxFailedErr:
+				continue
+			case err != nil:
+				return fmt.Errorf("failed to save config for %s: %v", u.String(), err)
+			case conflict != nil:
+				return conflict
+			}
+			return d.client.Save().Err()
+		}
+		return fmt.Errorf("failed to save config for %s: the configs kept changing", u.String())
+	})
+}
+
+// setConfig write the config of a registered device
+func (d *DeviceManager) setConfig(u uuid.UUID, b []byte) error {
 
 	// refresh certs from Redis, if needed - includes checking if necessary based on timer
 	err := d.refreshCache()
@@ -605,15 +1177,12 @@ func (d *DeviceManager) SetConfig(u uuid.UUID, b []byte) error {
 		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
 	}
 	// look up the device by uuid
-	_, ok := d.devices[u]
+	_, ok := d.device(u)
 	if !ok {
 		return fmt.Errorf("unregistered device UUID %s", u.String())
 	}
 
-	if _, err = d.client.HSet(deviceConfigsHash, u.String(), string(b)).Result(); err == nil {
-		_, err = d.client.Save().Result()
-	}
-	if err != nil {
+	if err = d.writeValue(deviceConfigsHash, u.String(), b); err != nil {
 		return fmt.Errorf("failed to save config for %s: %v", u.String(), err)
 	}
 	return nil
@@ -622,211 +1191,162 @@ func (d *DeviceManager) SetConfig(u uuid.UUID, b []byte) error {
 // GetLogsReader get the logs for a given uuid
 func (d *DeviceManager) GetLogsReader(u uuid.UUID) (io.Reader, error) {
 	// check that the device actually exists
-	dev, ok := d.devices[u]
+	dev, ok := d.device(u)
 	if !ok {
 		return nil, fmt.Errorf("unregistered device UUID: %s", u)
 	}
 	return dev.Logs.Reader()
 }
 
+// GetLogsRange get the logs of a device in a range
+func (d *DeviceManager) GetLogsRange(u uuid.UUID, rng common.StreamRange) (common.RangeReader, error) {
+	dev, ok := d.device(u)
+	if !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("unregistered device UUID: %s", u)}
+	}
+	return dev.Logs.(*ManagedStream).RangeReader(rng)
+}
+
+// GetInfoRange get the info of a device in a range
+func (d *DeviceManager) GetInfoRange(u uuid.UUID, rng common.StreamRange) (common.RangeReader, error) {
+	dev, ok := d.device(u)
+	if !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("unregistered device UUID: %s", u)}
+	}
+	return dev.Info.(*ManagedStream).RangeReader(rng)
+}
+
+// GetMetricsRange get the metrics of a device in a range
+func (d *DeviceManager) GetMetricsRange(u uuid.UUID, rng common.StreamRange) (common.RangeReader, error) {
+	dev, ok := d.device(u)
+	if !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("unregistered device UUID: %s", u)}
+	}
+	return dev.Metrics.(*ManagedStream).RangeReader(rng)
+}
+
+// GetLogsConsumer get a consumer of the logs of a device, as a member of a group
+func (d *DeviceManager) GetLogsConsumer(u uuid.UUID, group, consumer string) (common.StreamConsumer, error) {
+	dev, ok := d.device(u)
+	if !ok {
+		return nil, fmt.Errorf("unregistered device UUID: %s", u)
+	}
+	return dev.Logs.(*ManagedStream).Consumer(group, consumer)
+}
+
+// GetInfoConsumer get a consumer of the info of a device, as a member of a group
+func (d *DeviceManager) GetInfoConsumer(u uuid.UUID, group, consumer string) (common.StreamConsumer, error) {
+	dev, ok := d.device(u)
+	if !ok {
+		return nil, fmt.Errorf("unregistered device UUID: %s", u)
+	}
+	return dev.Info.(*ManagedStream).Consumer(group, consumer)
+}
+
+// GetMetricsConsumer get a consumer of the metrics of a device, as a member of a group
+func (d *DeviceManager) GetMetricsConsumer(u uuid.UUID, group, consumer string) (common.StreamConsumer, error) {
+	dev, ok := d.device(u)
+	if !ok {
+		return nil, fmt.Errorf("unregistered device UUID: %s", u)
+	}
+	return dev.Metrics.(*ManagedStream).Consumer(group, consumer)
+}
+
 // GetInfoReader get the info for a given uuid
 func (d *DeviceManager) GetInfoReader(u uuid.UUID) (io.Reader, error) {
 	// check that the device actually exists
-	dev, ok := d.devices[u]
+	dev, ok := d.device(u)
 	if !ok {
 		return nil, fmt.Errorf("unregistered device UUID: %s", u)
 	}
 	return dev.Info.Reader()
 }
 
+// GetMetricsReader get the metrics for a given uuid
+func (d *DeviceManager) GetMetricsReader(u uuid.UUID) (io.Reader, error) {
+	// check that the device actually exists
+	dev, ok := d.device(u)
+	if !ok {
+		return nil, fmt.Errorf("unregistered device UUID: %s", u)
+	}
+	return dev.Metrics.Reader()
+}
+
 // GetRequestsReader get the requests for a given uuid
 func (d *DeviceManager) GetRequestsReader(u uuid.UUID) (io.Reader, error) {
 	// check that the device actually exists
-	dev, ok := d.devices[u]
+	dev, ok := d.device(u)
 	if !ok {
 		return nil, fmt.Errorf("unregistered device UUID: %s", u)
 	}
 	return dev.Requests.Reader()
 }
 
-// refreshCache refresh cache from disk
-func (d *DeviceManager) refreshCache() error {
-	// is it time to update the cache again?
-	now := time.Now()
-	if now.Sub(d.lastUpdate).Seconds() < float64(d.cacheTimeout) {
-		return nil
+// writeJSON write a JSON to a named hash in Redis
+func (d *DeviceManager) writeJSON(u uuid.UUID, hash string, b []byte) error {
+	if err := d.writeValue(hash, u.String(), b); err != nil {
+		return fmt.Errorf("can't save message for %s in %s: %v", u.String(), hash, err)
 	}
+	return nil
+}
 
-	// create new vars to hold while we load
-	onboardCerts := make(map[string]map[string]bool)
-	deviceCerts := make(map[string]uuid.UUID)
-	devices := make(map[uuid.UUID]common.DeviceStorage)
+// writeValue encrypt a value, if configured, and save it into a named hash in Redis, then save the database to disk
+func (d *DeviceManager) writeValue(hash, key string, b []byte) error {
+	if err := d.setValue(hash, key, b); err != nil {
+		return err
+	}
+	_, err := d.client.Save().Result()
+	return err
+}
 
-	// scan the onboarding certs
-	ocerts, err := d.client.HGetAll(onboardCertsHash).Result()
+// setValue encrypt a value, if configured, and set it in a named hash in Redis, leaving it to the persistence Redis is
+// configured with. For the state devices update with their requests, as saving the whole database each time would
+// block Redis
+func (d *DeviceManager) setValue(hash, key string, b []byte) error {
+	v, err := d.encryptor.Encrypt(b, recordKey(hash, key))
 	if err != nil {
-		return fmt.Errorf("failed to retrieve onboarding certificated from %s %v", onboardCertsHash, err)
+		return err
 	}
+	return d.client.HSet(hash, key, string(v)).Err()
+}
 
-	for u, c := range ocerts {
-		certPem, _ := pem.Decode([]byte(c))
-		cert, err := x509.ParseCertificate(certPem.Bytes)
-		if err != nil {
-			return fmt.Errorf("unable to convert data from %s to onboard certificate: %v", c, err)
-		}
-		certStr := string(cert.Raw)
-
-		v, err := d.client.HGet(onboardSerialsHash, u).Result()
-		if err != nil {
-			log.Printf("unabled to get a serial for %s: %v", u, err)
-			continue
-		}
-
-		onboardCerts[certStr] = make(map[string]bool)
-
-		var serials []string
-		err = msgpack.Unmarshal([]byte(v), &serials)
-		if err != nil {
-			return fmt.Errorf("unable to unmarshal onboard serials %s: %v", v, err)
-		}
-		for _, serial := range serials {
-			onboardCerts[certStr][serial] = true
-		}
-	}
-	// replace the existing onboard certificates
-	d.onboardCerts = onboardCerts
-
-	// scan the device certs
-	dcerts, err := d.client.HGetAll(deviceCertsHash).Result()
-	if err != nil {
-		return fmt.Errorf("failed to retrieve device certificates from %s %v", deviceCertsHash, err)
-	}
-
-	// check each Redis hash to see if it is valid
-	for k, c := range dcerts {
-		// convert the path name to a UUID
-		u, err := uuid.FromString(k)
-		if err != nil {
-			return fmt.Errorf("unable to convert device uuid from Redis hash name %s: %v", u, err)
-		}
-
-		// load the device certificate
-		certPem, _ := pem.Decode([]byte(c))
-		cert, err := x509.ParseCertificate(certPem.Bytes)
-		if err != nil {
-			return fmt.Errorf("unable to convert data from file %s to device certificate: %v", c, err)
-		}
-		certStr := string(cert.Raw)
-		deviceCerts[certStr] = u
-		devices[u] = d.initDevice(u, cert, "") // start with no serial, as it will be added further down
-	}
-	// replace the existing device certificates
-	d.deviceCerts = deviceCerts
-
-	// scan the device onboarding certs
-	docerts, err := d.client.HGetAll(deviceOnboardCertsHash).Result()
-	if err != nil {
-		return fmt.Errorf("failed to retrieve device certificates from %s %v", deviceCertsHash, err)
-	}
-
-	// check each Redis hash to see if it is valid
-	for k, b := range docerts {
-		// convert the path name to a UUID
-		u, err := uuid.FromString(k)
-		if err != nil {
-			return fmt.Errorf("unable to convert device uuid from Redis hash name %s: %v", u, err)
-		}
-
-		certPem, _ := pem.Decode([]byte(b))
-		cert, err := x509.ParseCertificate(certPem.Bytes)
-		if err != nil {
-			return fmt.Errorf("unable to convert data from file %s to device onboard certificate: %v", b, err)
-		}
-		if _, present := devices[u]; !present {
-			devices[u] = d.initDevice(u, nil, "") // start with a blank serial and no device cert
-		}
-		// because of the "cannot assign to struct field" golang issue
-		devItem := devices[u]
-		devItem.Onboard = cert
-		devices[u] = devItem
-	}
-
-	// scan the device onboarding certs
-	dserials, err := d.client.HGetAll(deviceSerialsHash).Result()
-	if err != nil {
-		return fmt.Errorf("failed to retrieve device certificates from %s %v", deviceCertsHash, err)
-	}
-
-	for k, s := range dserials {
-		// convert the path name to a UUID
-		u, err := uuid.FromString(k)
-		if err != nil {
-			return fmt.Errorf("unable to convert device uuid from Redis hash name %s: %v", u, err)
-		}
-		if _, present := devices[u]; !present {
-			devices[u] = d.initDevice(u, nil, s)
-		}
-		devItem := devices[u]
-		devItem.Serial = s
-		devices[u] = devItem
-	}
-
-	for deviceID, device := range devices {
-		prefix := deviceAppLogsStream + deviceID.String() + "_"
-		appLogKeys, err := d.client.Keys(prefix + "*").Result()
-		if err != nil {
-			return fmt.Errorf("failed to retrieve device app logs streams %v", err)
-		}
-		for _, el := range appLogKeys {
-			instanceID, err := uuid.FromString(strings.TrimPrefix(el, prefix))
-			if err != nil {
-				return fmt.Errorf("cannot parse device app logs stream %v", err)
-			}
-			device.AppLogs[instanceID] = &ManagedStream{
-				name:   prefix + instanceID.String(),
-				client: d.client,
-			}
-		}
-	}
-	// replace the existing device cache
-	d.devices = devices
-
-	// mark the time we updated
-	d.lastUpdate = now
-	return nil
+// recordKey the key of the record of a key of a named hash in Redis its value is encrypted with
+func recordKey(hash, key string) string {
+	return hash + "/" + key
 }
 
-// writeProtobufToJSONMsgPack write a protobuf to a named hash in Redis
-func (d *DeviceManager) writeProtobufToJSONMsgPack(u uuid.UUID, hash string, msg proto.Message) error {
-	s, err := msgpack.Marshal(&msg)
+// readValue read a value from a named hash in Redis, decrypting it if needed. Returns redis.Nil
+// if the key does not exist
+func (d *DeviceManager) readValue(hash, key string) ([]byte, error) {
+	v, err := d.client.HGet(hash, key).Result()
 	if err != nil {
-		return fmt.Errorf("can't marshal proto message %v", err)
+		return nil, err
 	}
-	return d.writeJSONMsgPack(u, hash, s)
+	return d.encryptor.Decrypt([]byte(v), recordKey(hash, key))
 }
 
-// writeJSONMsgPack write a JSON to a named hash in Redis
-func (d *DeviceManager) writeJSONMsgPack(u uuid.UUID, hash string, b []byte) error {
-	var err error
-	if _, err = d.client.HSet(hash, u.String(), string(b)).Result(); err == nil {
-		_, err = d.client.Save().Result()
-	}
+// decodeCert decrypt, if needed, and PEM decode a certificate read from the key of a named hash in Redis
+func (d *DeviceManager) decodeCert(v, hash, key string) (*pem.Block, error) {
+	b, err := d.encryptor.Decrypt([]byte(v), recordKey(hash, key))
 	if err != nil {
-		return fmt.Errorf("can't save message for %s in %s: %v", u.String(), hash, err)
+		return nil, err
 	}
-	return nil
+	certPem, _ := pem.Decode(b)
+	if certPem == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	return certPem, nil
 }
 
 // checkValidOnboardSerial see if a particular certificate+serial combinaton is valid
 // does **not** check if it has been used
 func (d *DeviceManager) checkValidOnboardSerial(cert *x509.Certificate, serial string) error {
-	certStr := string(cert.Raw)
-	if c, ok := d.onboardCerts[certStr]; ok {
-		// accept the specific serial or the wildcard
-		if _, ok := c[serial]; ok {
-			return nil
-		}
-		if _, ok := c["*"]; ok {
+	d.mu.RLock()
+	c, ok := d.onboardCerts[string(cert.Raw)]
+	d.mu.RUnlock()
+	if ok {
+		// accept the specific serial, the wildcard, or a pattern or range matching it
+		if common.MatchSerials(c, serial) {
 			return nil
 		}
 		return &common.InvalidSerialError{Err: fmt.Sprintf("unknown serial: %s", serial)}
@@ -837,7 +1357,13 @@ func (d *DeviceManager) checkValidOnboardSerial(cert *x509.Certificate, serial s
 // getOnboardSerialDevice see if a particular certificate+serial combinaton has been used and get its device uuid
 func (d *DeviceManager) getOnboardSerialDevice(cert *x509.Certificate, serial string) *uuid.UUID {
 	certStr := string(cert.Raw)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	for uid, dev := range d.devices {
+		// devices added by an admin may have no onboarding certificate
+		if dev.Onboard == nil {
+			continue
+		}
 		dCertStr := string(dev.Onboard.Raw)
 		if dCertStr == certStr && serial == dev.Serial {
 			return &uid
@@ -871,12 +1397,15 @@ func (d *DeviceManager) transactionDrop(keys [][]string) (result error) {
 }
 
 func (d *DeviceManager) readCert(hash string, key string) (*x509.Certificate, error) {
-	v, err := d.client.HGet(hash, key).Result()
+	v, err := d.readValue(hash, key)
+	if err == redis.Nil {
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error reading certificate for %s from hash %s: %v", key, hash, err)
 	}
 
-	if cert, err := ax.ParseCert([]byte(v)); err != nil {
+	if cert, err := ax.ParseCert(v); err != nil {
 		return nil, fmt.Errorf("error decoding onboard certificate for %s from hash %s: %v (%s)", key, hash, err, v)
 	} else {
 		return cert, nil
@@ -893,8 +1422,11 @@ func (d *DeviceManager) writeCert(cert []byte, hash string, uuid string, force b
 	if _, err := d.client.HGet(hash, uuid).Result(); err == nil && !force {
 		return fmt.Errorf("certificate for %s already exists in %s", uuid, hash)
 	}
-	certPem := ax.PemEncodeCert(cert)
-	if b, err := d.client.HSet(hash, uuid, certPem).Result(); err != nil || (!b && !force) {
+	certPem, err := d.encryptor.Encrypt(ax.PemEncodeCert(cert), recordKey(hash, uuid))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt certificate for %s: %v", uuid, err)
+	}
+	if b, err := d.client.HSet(hash, uuid, string(certPem)).Result(); err != nil || (!b && !force) {
 		return fmt.Errorf("failed to write certificate for %s: %v", uuid, err)
 	}
 	if _, err := d.client.Save().Result(); err != nil {
@@ -904,6 +1436,724 @@ func (d *DeviceManager) writeCert(cert []byte, hash string, uuid string, force b
 	return nil
 }
 
-func mkStreamEntry(body []byte) map[string]interface{} {
-	return map[string]interface{}{"version": "1", "object": string(body)}
+// WriteAudit append a record to the audit stream
+func (d *DeviceManager) WriteAudit(b []byte) error {
+	_, err := d.newStream(auditStream).Write(b)
+	return err
+}
+
+// GetAuditReader get the audit stream. Unlike the device streams, this reads the whole stream up front, one record per line
+func (d *DeviceManager) GetAuditReader() (io.Reader, error) {
+	messages, err := d.readClient().XRange(auditStream, "-", "+").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit stream %s: %v", auditStream, err)
+	}
+	var buf bytes.Buffer
+	for _, m := range messages {
+		o, _, err := streamObject(m.Values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entry %s of audit stream %s: %v", m.ID, auditStream, err)
+		}
+		if len(o) == 0 {
+			continue
+		}
+		buf.Write(o)
+		buf.WriteByte(0x0a)
+	}
+	return &buf, nil
+}
+
+// SetQuotas set the quotas of devices without their own, and the period over which byte quotas are counted
+func (d *DeviceManager) SetQuotas(q common.Quotas, period time.Duration) {
+	d.quotas.SetGlobal(q, period)
+}
+
+// GetDeviceQuotas get the quotas set for a device, nil if it uses the global ones
+func (d *DeviceManager) GetDeviceQuotas(u uuid.UUID) (*common.Quotas, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	return d.quotas.Device(u), nil
+}
+
+// SetDeviceQuotas set the quotas of a device, overriding the global ones; nil removes them
+func (d *DeviceManager) SetDeviceQuotas(u uuid.UUID, q *common.Quotas) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if q == nil {
+		if err := d.client.HDel(deviceQuotasHash, u.String()).Err(); err != nil {
+			return fmt.Errorf("failed to remove quotas of %s: %v", u, err)
+		}
+	} else {
+		b, err := json.Marshal(q)
+		if err != nil {
+			return fmt.Errorf("failed to encode quotas of %s: %v", u, err)
+		}
+		if err := d.client.HSet(deviceQuotasHash, u.String(), string(b)).Err(); err != nil {
+			return fmt.Errorf("failed to save quotas of %s: %v", u, err)
+		}
+	}
+	d.quotas.SetDevice(u, q)
+	return nil
+}
+
+// GetConfigAck get the config a device last reported having, nil if it has not reported any
+func (d *DeviceManager) GetConfigAck(u uuid.UUID) (*common.ConfigAck, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := d.readValue(deviceConfigAcksHash, u.String())
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read config ack of %s: %v", u, err)
+	}
+	var ack common.ConfigAck
+	if err := json.Unmarshal(b, &ack); err != nil {
+		return nil, fmt.Errorf("failed to decode config ack of %s: %v", u, err)
+	}
+	return &ack, nil
+}
+
+// SetConfigAck record the config a device reported having
+func (d *DeviceManager) SetConfigAck(u uuid.UUID, ack *common.ConfigAck) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := json.Marshal(ack)
+	if err != nil {
+		return fmt.Errorf("failed to encode config ack of %s: %v", u, err)
+	}
+	if err := d.setValue(deviceConfigAcksHash, u.String(), b); err != nil {
+		return fmt.Errorf("failed to save config ack of %s: %v", u, err)
+	}
+	return nil
+}
+
+// GetInventory get the current state of a device, from its info messages, nil if it has not sent any
+func (d *DeviceManager) GetInventory(u uuid.UUID) (*common.Inventory, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := d.readValue(deviceInventoriesHash, u.String())
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read inventory of %s: %v", u, err)
+	}
+	var inv common.Inventory
+	if err := json.Unmarshal(b, &inv); err != nil {
+		return nil, fmt.Errorf("failed to decode inventory of %s: %v", u, err)
+	}
+	return &inv, nil
+}
+
+// SetInventory record the current state of a device
+func (d *DeviceManager) SetInventory(u uuid.UUID, inv *common.Inventory) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return fmt.Errorf("failed to encode inventory of %s: %v", u, err)
+	}
+	if err := d.setValue(deviceInventoriesHash, u.String(), b); err != nil {
+		return fmt.Errorf("failed to save inventory of %s: %v", u, err)
+	}
+	return nil
+}
+
+// GetLogFilter get the filter of the logs of a device, nil if it uses the global one
+func (d *DeviceManager) GetLogFilter(u uuid.UUID) (*common.LogFilter, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := d.readValue(deviceLogFiltersHash, u.String())
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read log filter of %s: %v", u, err)
+	}
+	var f common.LogFilter
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to decode log filter of %s: %v", u, err)
+	}
+	return &f, nil
+}
+
+// SetLogFilter set the filter of the logs of a device, overriding the global one; nil removes it
+func (d *DeviceManager) SetLogFilter(u uuid.UUID, f *common.LogFilter) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if f == nil {
+		if err := d.client.HDel(deviceLogFiltersHash, u.String()).Err(); err != nil {
+			return fmt.Errorf("failed to remove log filter of %s: %v", u, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("failed to encode log filter of %s: %v", u, err)
+	}
+	if err := d.writeValue(deviceLogFiltersHash, u.String(), b); err != nil {
+		return fmt.Errorf("failed to save log filter of %s: %v", u, err)
+	}
+	return nil
+}
+
+// GetLocalProfile get the local profile server state of a device, nil if it has none
+func (d *DeviceManager) GetLocalProfile(u uuid.UUID) (*common.LocalProfile, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := d.readValue(deviceProfilesHash, u.String())
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read local profile of %s: %v", u, err)
+	}
+	var p common.LocalProfile
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode local profile of %s: %v", u, err)
+	}
+	return &p, nil
+}
+
+// SetLocalProfile set the local profile server state of a device; nil removes it
+func (d *DeviceManager) SetLocalProfile(u uuid.UUID, p *common.LocalProfile) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if p == nil {
+		if err := d.client.HDel(deviceProfilesHash, u.String()).Err(); err != nil {
+			return fmt.Errorf("failed to remove local profile of %s: %v", u, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to encode local profile of %s: %v", u, err)
+	}
+	if err := d.writeValue(deviceProfilesHash, u.String(), b); err != nil {
+		return fmt.Errorf("failed to save local profile of %s: %v", u, err)
+	}
+	return nil
+}
+
+// GetDeviceMetadata get the metadata of a device, nil if none is recorded
+func (d *DeviceManager) GetDeviceMetadata(u uuid.UUID) (*common.DeviceMetadata, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := d.readValue(deviceMetadataHash, u.String())
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read metadata of %s: %v", u, err)
+	}
+	var p common.DeviceMetadata
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata of %s: %v", u, err)
+	}
+	return &p, nil
+}
+
+// SetDeviceMetadata set the metadata of a device, replacing any recorded; nil removes it
+func (d *DeviceManager) SetDeviceMetadata(u uuid.UUID, p *common.DeviceMetadata) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if p == nil {
+		if err := d.client.HDel(deviceMetadataHash, u.String()).Err(); err != nil {
+			return fmt.Errorf("failed to remove metadata of %s: %v", u, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata of %s: %v", u, err)
+	}
+	if err := d.writeValue(deviceMetadataHash, u.String(), b); err != nil {
+		return fmt.Errorf("failed to save metadata of %s: %v", u, err)
+	}
+	return nil
+}
+
+// GetDeviceModel get the name of the hardware model of a device, empty if it has none
+func (d *DeviceManager) GetDeviceModel(u uuid.UUID) (string, error) {
+	if err := d.refreshCache(); err != nil {
+		return "", fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return "", &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := d.readValue(deviceModelsHash, u.String())
+	switch {
+	case err == redis.Nil:
+		return "", nil
+	case err != nil:
+		return "", fmt.Errorf("failed to read hardware model of %s: %v", u, err)
+	}
+	return string(b), nil
+}
+
+// SetDeviceModel set the name of the hardware model of a device; empty removes it
+func (d *DeviceManager) SetDeviceModel(u uuid.UUID, model string) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if model == "" {
+		if err := d.client.HDel(deviceModelsHash, u.String()).Err(); err != nil {
+			return fmt.Errorf("failed to remove hardware model of %s: %v", u, err)
+		}
+		return nil
+	}
+	if err := d.writeValue(deviceModelsHash, u.String(), []byte(model)); err != nil {
+		return fmt.Errorf("failed to save hardware model of %s: %v", u, err)
+	}
+	return nil
+}
+
+// GetAppCommands get the commands to the app instances of a device, nil if it has none
+func (d *DeviceManager) GetAppCommands(u uuid.UUID) ([]common.AppCommand, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := d.readValue(deviceAppCommandsHash, u.String())
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read app commands of %s: %v", u, err)
+	}
+	var commands []common.AppCommand
+	if err := json.Unmarshal(b, &commands); err != nil {
+		return nil, fmt.Errorf("failed to decode app commands of %s: %v", u, err)
+	}
+	return commands, nil
+}
+
+// SetAppCommands set the commands to the app instances of a device; none removes them
+func (d *DeviceManager) SetAppCommands(u uuid.UUID, commands []common.AppCommand) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if len(commands) == 0 {
+		if err := d.client.HDel(deviceAppCommandsHash, u.String()).Err(); err != nil {
+			return fmt.Errorf("failed to remove app commands of %s: %v", u, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(commands)
+	if err != nil {
+		return fmt.Errorf("failed to encode app commands of %s: %v", u, err)
+	}
+	if err := d.setValue(deviceAppCommandsHash, u.String(), b); err != nil {
+		return fmt.Errorf("failed to save app commands of %s: %v", u, err)
+	}
+	return nil
+}
+
+// GetDeviceFlags get the flags of a device, nil if it has none
+func (d *DeviceManager) GetDeviceFlags(u uuid.UUID) (*common.DeviceFlags, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := d.readValue(deviceFlagsHash, u.String())
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read device flags of %s: %v", u, err)
+	}
+	var flags common.DeviceFlags
+	if err := json.Unmarshal(b, &flags); err != nil {
+		return nil, fmt.Errorf("failed to decode device flags of %s: %v", u, err)
+	}
+	return &flags, nil
+}
+
+// SetDeviceFlags set the flags of a device, replacing any; nil removes them
+func (d *DeviceManager) SetDeviceFlags(u uuid.UUID, flags *common.DeviceFlags) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if flags == nil {
+		if err := d.client.HDel(deviceFlagsHash, u.String()).Err(); err != nil {
+			return fmt.Errorf("failed to remove device flags of %s: %v", u, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(flags)
+	if err != nil {
+		return fmt.Errorf("failed to encode device flags of %s: %v", u, err)
+	}
+	if err := d.writeValue(deviceFlagsHash, u.String(), b); err != nil {
+		return fmt.Errorf("failed to save device flags of %s: %v", u, err)
+	}
+	return nil
+}
+
+// GetQuarantine get the quarantine of a device, nil if it is not quarantined
+func (d *DeviceManager) GetQuarantine(u uuid.UUID) (*common.Quarantine, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := d.readValue(deviceQuarantineHash, u.String())
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read quarantine of %s: %v", u, err)
+	}
+	var q common.Quarantine
+	if err := json.Unmarshal(b, &q); err != nil {
+		return nil, fmt.Errorf("failed to decode quarantine of %s: %v", u, err)
+	}
+	return &q, nil
+}
+
+// SetQuarantine quarantine a device, replacing any quarantine; nil releases it
+func (d *DeviceManager) SetQuarantine(u uuid.UUID, q *common.Quarantine) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if q == nil {
+		if err := d.client.HDel(deviceQuarantineHash, u.String()).Err(); err != nil {
+			return fmt.Errorf("failed to remove quarantine of %s: %v", u, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		return fmt.Errorf("failed to encode quarantine of %s: %v", u, err)
+	}
+	if err := d.writeValue(deviceQuarantineHash, u.String(), b); err != nil {
+		return fmt.Errorf("failed to save quarantine of %s: %v", u, err)
+	}
+	return nil
+}
+
+// GetDeviceSources get where the requests of a device came from, the most recently seen first, nil if none is recorded
+func (d *DeviceManager) GetDeviceSources(u uuid.UUID) ([]common.DeviceSource, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := d.readValue(deviceSourcesHash, u.String())
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read sources of %s: %v", u, err)
+	}
+	var sources []common.DeviceSource
+	if err := json.Unmarshal(b, &sources); err != nil {
+		return nil, fmt.Errorf("failed to decode sources of %s: %v", u, err)
+	}
+	return sources, nil
+}
+
+// SetDeviceSources set where the requests of a device came from, replacing those recorded; none removes them
+func (d *DeviceManager) SetDeviceSources(u uuid.UUID, sources []common.DeviceSource) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if len(sources) == 0 {
+		if err := d.client.HDel(deviceSourcesHash, u.String()).Err(); err != nil {
+			return fmt.Errorf("failed to remove sources of %s: %v", u, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(sources)
+	if err != nil {
+		return fmt.Errorf("failed to encode sources of %s: %v", u, err)
+	}
+	if err := d.setValue(deviceSourcesHash, u.String(), b); err != nil {
+		return fmt.Errorf("failed to save sources of %s: %v", u, err)
+	}
+	return nil
+}
+
+// GetAttestation get the attestation of a device, nil if it has none
+func (d *DeviceManager) GetAttestation(u uuid.UUID) (*common.Attestation, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	b, err := d.readValue(deviceAttestationsHash, u.String())
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read attestation of %s: %v", u, err)
+	}
+	var a common.Attestation
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("failed to decode attestation of %s: %v", u, err)
+	}
+	return &a, nil
+}
+
+// SetAttestation set the attestation of a device, replacing any; nil removes it
+func (d *DeviceManager) SetAttestation(u uuid.UUID, a *common.Attestation) error {
+	if err := d.refreshCache(); err != nil {
+		return fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	if a == nil {
+		if err := d.client.HDel(deviceAttestationsHash, u.String()).Err(); err != nil {
+			return fmt.Errorf("failed to remove attestation of %s: %v", u, err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed to encode attestation of %s: %v", u, err)
+	}
+	if err := d.writeValue(deviceAttestationsHash, u.String(), b); err != nil {
+		return fmt.Errorf("failed to save attestation of %s: %v", u, err)
+	}
+	return nil
+}
+
+// mkStreamEntry the fields of a stream entry holding a body, compressed as given
+func mkStreamEntry(body []byte, compression string) (map[string]interface{}, error) {
+	values := map[string]interface{}{"version": streamVersion, "format": streamFormatJSON}
+	// empty bodies create streams, and are left as is so that readers can tell them apart
+	if compression == "" || compression == common.CompressionNone || len(body) == 0 {
+		values["object"] = string(body)
+		return values, nil
+	}
+	c, err := common.Compress(compression, body)
+	if err != nil {
+		return nil, err
+	}
+	values["encoding"] = compression
+	values["object"] = string(c)
+	return values, nil
+}
+
+// streamObject the object of a stream entry, decompressed, as JSON, and whether there is one. The msgpack objects
+// of entries before version 3 are converted to JSON
+func streamObject(values map[string]interface{}) ([]byte, bool, error) {
+	s, ok := values["object"].(string)
+	if !ok {
+		return nil, false, nil
+	}
+	version, _ := values["version"].(string)
+	b := []byte(s)
+	if version != "" && version != "1" {
+		encoding, _ := values["encoding"].(string)
+		var err error
+		if b, err = common.Decompress(encoding, b); err != nil {
+			return nil, true, err
+		}
+	}
+	switch version {
+	case "", "1", "2":
+		b, err := legacyObject(b)
+		return b, true, err
+	case streamVersion:
+		if format, _ := values["format"].(string); format != streamFormatJSON {
+			return nil, true, fmt.Errorf("unknown format %q of stream entry", format)
+		}
+		return b, true, nil
+	}
+	return nil, true, fmt.Errorf("unknown version %q of stream entry", version)
+}
+
+// legacyObject the object of a stream entry before version 3 as JSON: JSON objects as they are, and msgpack ones,
+// as older releases wrote, converted
+func legacyObject(b []byte) ([]byte, error) {
+	if len(b) == 0 || json.Valid(b) {
+		return b, nil
+	}
+	var data interface{}
+	if err := msgpack.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("unable to decode msgpack stream entry: %v", err)
+	}
+	return json.Marshal(data)
+}
+
+// decodeSerials decode the serials of an onboard cert, JSON, or msgpack as older releases wrote them
+func decodeSerials(b []byte) ([]string, error) {
+	var serials []string
+	if json.Valid(b) {
+		err := json.Unmarshal(b, &serials)
+		return serials, err
+	}
+	err := msgpack.Unmarshal(b, &serials)
+	return serials, err
+}
+
+// PutRecord add a record of a kind, or replace the one with the same key
+func (d *DeviceManager) PutRecord(kind, key string, b []byte) error {
+	hash, err := recordHash(kind)
+	if err != nil {
+		return err
+	}
+	if err := d.writeValue(hash, key, b); err != nil {
+		return fmt.Errorf("failed to save %s %s: %v", kind, key, err)
+	}
+	return nil
+}
+
+// GetRecord get a record of a kind by key
+func (d *DeviceManager) GetRecord(kind, key string) ([]byte, error) {
+	hash, err := recordHash(kind)
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.readValue(hash, key)
+	switch {
+	case err == redis.Nil:
+		return nil, common.RecordNotFound(kind, key)
+	case err != nil:
+		return nil, fmt.Errorf("failed to read %s %s: %v", kind, key, err)
+	}
+	return b, nil
+}
+
+// ListRecords list the records of a kind, by key
+func (d *DeviceManager) ListRecords(kind string) (map[string][]byte, error) {
+	hash, err := recordHash(kind)
+	if err != nil {
+		return nil, err
+	}
+	values, err := d.client.HGetAll(hash).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve %s from %s %v", kind, hash, err)
+	}
+	records := make(map[string][]byte, len(values))
+	for key, v := range values {
+		b, err := d.encryptor.Decrypt([]byte(v), recordKey(hash, key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s %s: %v", kind, key, err)
+		}
+		records[key] = b
+	}
+	return records, nil
+}
+
+// RemoveRecord remove a record of a kind by key
+func (d *DeviceManager) RemoveRecord(kind, key string) error {
+	hash, err := recordHash(kind)
+	if err != nil {
+		return err
+	}
+	n, err := d.client.HDel(hash, key).Result()
+	switch {
+	case err != nil:
+		return fmt.Errorf("failed to remove %s %s: %v", kind, key, err)
+	case n == 0:
+		return common.RecordNotFound(kind, key)
+	}
+	return nil
+}
+
+// recordHash the hash the records of a kind are kept in
+func recordHash(kind string) (string, error) {
+	hash, ok := recordHashes[kind]
+	if !ok {
+		return "", fmt.Errorf("unknown kind of record: %s", kind)
+	}
+	return hash, nil
+}
+
+// CheckHealth ping the primary. Read replicas are not checked, as reads fall back to the primary
+func (d *DeviceManager) CheckHealth() error {
+	if err := d.client.Ping().Err(); err != nil {
+		return fmt.Errorf("unable to ping redis at %s: %v", d.databaseURL, err)
+	}
+	return nil
+}
+
+// Close close the connections to the primary and the read replicas
+func (d *DeviceManager) Close() error {
+	var result error
+	if d.watcher != nil {
+		if err := d.watcher.close(); err != nil {
+			result = fmt.Errorf("couldn't close cache invalidation subscription: %v", err)
+		}
+	}
+	for _, c := range append([]*redis.Client{d.client}, d.replicas...) {
+		if err := c.Close(); err != nil {
+			result = fmt.Errorf("couldn't close connection to %s: %v (previous error %v)", c.Options().Addr, err, result)
+		}
+	}
+	return result
 }
@@ -0,0 +1,147 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// srvScheme scheme of the database URL discovering the redis servers from the DNS SRV records of its host, e.g.
+	//   redis+srv://_redis._tcp.example.com/0
+	srvScheme = "redis+srv"
+	// failoverRetries how many times a command failing on a network error is retried, on a new connection that
+	// fails over to the next endpoint
+	failoverRetries = 3
+	// minDialBackoff and maxDialBackoff bounds of how long to wait before dialing again once all the endpoints
+	// failed, doubling on each round that fails
+	minDialBackoff = 100 * time.Millisecond
+	maxDialBackoff = 5 * time.Second
+	dialTimeout    = 5 * time.Second
+)
+
+// endpoints the redis servers the primary client fails over between. Connections go to the current one, and on
+// failure to the next ones in order, the first that answers becoming current. Once all of them fail, dialing backs
+// off before trying them again
+type endpoints struct {
+	// addrs host:port of the servers, in order
+	addrs []string
+	// srv name whose SRV records list the servers, looked up on each round, empty for addrs
+	srv string
+
+	lock    sync.Mutex
+	current int
+	backoff time.Duration
+	retryAt time.Time
+	lastErr error
+	// lookup resolves the SRV records, net.LookupSRV but for tests
+	lookup func(service, proto, name string) (string, []*net.SRV, error)
+	// dialer opens the connections, net.DialTimeout but for tests
+	dialer func(network, address string, timeout time.Duration) (net.Conn, error)
+}
+
+// newEndpoints the endpoints of a database URL host, a comma-separated list of host:port, or the SRV name of them
+// if srv. Ports default to 6379
+func newEndpoints(host string, srv bool) *endpoints {
+	e := &endpoints{lookup: net.LookupSRV, dialer: net.DialTimeout}
+	if srv {
+		e.srv = host
+		return e
+	}
+	for _, addr := range strings.Split(host, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "6379")
+		}
+		e.addrs = append(e.addrs, addr)
+	}
+	return e
+}
+
+// resolve the servers to try, from the SRV records if any, sorted by priority and weight. If they cannot be looked
+// up, the servers of the last lookup are kept
+func (e *endpoints) resolve() ([]string, error) {
+	if e.srv == "" {
+		return e.addrs, nil
+	}
+	_, records, err := e.lookup("", "", e.srv)
+	if err != nil || len(records) == 0 {
+		if len(e.addrs) > 0 {
+			log.Printf("unable to look up redis SRV records %s, using the last ones: %v", e.srv, err)
+			return e.addrs, nil
+		}
+		return nil, fmt.Errorf("unable to look up redis SRV records %s: %v", e.srv, err)
+	}
+	addrs := make([]string, 0, len(records))
+	for _, r := range records {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+	}
+	if strings.Join(addrs, ",") != strings.Join(e.addrs, ",") {
+		e.addrs = addrs
+		e.current = 0
+	}
+	return addrs, nil
+}
+
+// dial open a connection to the current server, or else the first of the next ones that answers
+func (e *endpoints) dial() (net.Conn, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if time.Now().Before(e.retryAt) {
+		return nil, e.lastErr
+	}
+	addrs, err := e.resolve()
+	if err != nil {
+		return nil, e.fail(err)
+	}
+	errs := make([]string, 0, len(addrs))
+	for i := range addrs {
+		n := (e.current + i) % len(addrs)
+		conn, err := e.dialer("tcp", addrs[n], dialTimeout)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if n != e.current {
+			log.Printf("redis at %s unavailable, failed over to %s", addrs[e.current%len(addrs)], addrs[n])
+			e.current = n
+		}
+		e.backoff = 0
+		e.retryAt = time.Time{}
+		return conn, nil
+	}
+	return nil, e.fail(fmt.Errorf("no redis server reachable: %s", strings.Join(errs, "; ")))
+}
+
+// fail record that a round of dialing failed, backing off before the next one
+func (e *endpoints) fail(err error) error {
+	switch {
+	case e.backoff == 0:
+		e.backoff = minDialBackoff
+	case e.backoff < maxDialBackoff:
+		e.backoff *= 2
+		if e.backoff > maxDialBackoff {
+			e.backoff = maxDialBackoff
+		}
+	}
+	e.retryAt = time.Now().Add(e.backoff)
+	e.lastErr = err
+	return err
+}
+
+// String the servers, as given in the database URL
+func (e *endpoints) String() string {
+	if e.srv != "" {
+		return e.srv
+	}
+	return strings.Join(e.addrs, ",")
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+)
+
+const (
+	reasonNoDevice  = "no device certificate"
+	reasonNoOnboard = "no onboarding certificate"
+)
+
+// CollectGarbage scan all hashes and device streams for entries without a device certificate, and onboard serials
+// without an onboarding certificate. If remove is true, delete them
+func (d *DeviceManager) CollectGarbage(remove bool) ([]common.Orphan, error) {
+	devices, err := d.hashKeys(deviceCertsHash)
+	if err != nil {
+		return nil, err
+	}
+	onboards, err := d.hashKeys(onboardCertsHash)
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []common.Orphan{}
+	for hash, owners := range map[string]map[string]bool{
+		deviceSerialsHash:      devices,
+		deviceOnboardCertsHash: devices,
+		deviceConfigsHash:      devices,
+		deviceQuotasHash:       devices,
+		deviceConfigAcksHash:   devices,
+		deviceInventoriesHash:  devices,
+		deviceLogFiltersHash:   devices,
+		deviceProfilesHash:     devices,
+		deviceMetadataHash:     devices,
+		deviceModelsHash:       devices,
+		deviceAppCommandsHash:  devices,
+		deviceFlagsHash:        devices,
+		deviceQuarantineHash:   devices,
+		deviceSourcesHash:      devices,
+		deviceAttestationsHash: devices,
+		onboardSerialsHash:     onboards,
+	} {
+		fields, err := d.hashKeys(hash)
+		if err != nil {
+			return nil, err
+		}
+		reason := reasonNoDevice
+		if hash == onboardSerialsHash {
+			reason = reasonNoOnboard
+		}
+		for f := range fields {
+			if !owners[f] {
+				orphans = append(orphans, common.Orphan{Key: hash, Field: f, Reason: reason})
+			}
+		}
+	}
+
+	for _, prefix := range []string{deviceLogsStream, deviceInfoStream, deviceMetricsStream, deviceRequestsStream, deviceAppLogsStream, deviceLogSourcesSet, deviceLogSourceIndex} {
+		streams, err := d.client.Keys(prefix + "*").Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list streams %s*: %v", prefix, err)
+		}
+		for _, s := range streams {
+			u := strings.TrimPrefix(s, prefix)
+			// app logs streams are named <device UUID>_<app instance UUID>, log source indexes <device UUID>_<source>
+			if prefix == deviceAppLogsStream || prefix == deviceLogSourceIndex {
+				u = strings.SplitN(u, "_", 2)[0]
+			}
+			if !devices[u] {
+				orphans = append(orphans, common.Orphan{Key: s, Reason: reasonNoDevice})
+			}
+		}
+	}
+
+	if !remove || len(orphans) == 0 {
+		return orphans, nil
+	}
+	var result error
+	for _, o := range orphans {
+		var err error
+		if o.Field != "" {
+			err = d.client.HDel(o.Key, o.Field).Err()
+		} else {
+			err = d.client.Del(o.Key).Err()
+		}
+		if err != nil {
+			result = fmt.Errorf("couldn't drop %s %s: %v (previous error %v)", o.Key, o.Field, err, result)
+		}
+	}
+	// removed serials and onboard certs may be in the cache
+	atomic.StoreUint32(&d.stale, 1)
+	return orphans, result
+}
+
+// hashKeys get the set of keys of a hash
+func (d *DeviceManager) hashKeys(hash string) (map[string]bool, error) {
+	keys, err := d.client.HKeys(hash).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve keys of %s: %v", hash, err)
+	}
+	set := map[string]bool{}
+	for _, k := range keys {
+		set[k] = true
+	}
+	return set, nil
+}
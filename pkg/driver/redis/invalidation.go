@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// invalidateKeyspace invalidate the cache on the keyspace notifications of the hashes it is loaded from, which
+	// the server must have enabled for hashes, e.g. with notify-keyspace-events Kh
+	invalidateKeyspace = "keyspace"
+	// invalidateChannel invalidate the cache on the messages of cacheChannel, which adam publishes to as it changes
+	// the hashes the cache is loaded from, as can tools that change them
+	invalidateChannel = "channel"
+	// cacheChannel pub/sub channel of the changes to the certificates and serials, with the name of the hash changed
+	cacheChannel = "ADAM_CACHE"
+)
+
+// cachedHashes the hashes the cache of certificates and serials is loaded from
+var cachedHashes = []string{onboardCertsHash, onboardSerialsHash, deviceCertsHash, deviceOnboardCertsHash, deviceSerialsHash}
+
+// changeWatcher subscription to the changes of the hashes the cache is loaded from
+type changeWatcher struct {
+	pubsub *redis.PubSub
+	stop   chan struct{}
+}
+
+// watchChanges subscribe to the changes of the cached hashes in a way of invalidateKeyspace or invalidateChannel,
+// marking the cache stale on each of them until the watcher is stopped
+func (d *DeviceManager) watchChanges(mode string) (*changeWatcher, error) {
+	var channels []string
+	switch mode {
+	case invalidateKeyspace:
+		for _, h := range cachedHashes {
+			channels = append(channels, fmt.Sprintf("__keyspace@%d__:%s", d.databaseID, h))
+		}
+	case invalidateChannel:
+		channels = []string{cacheChannel}
+	default:
+		return nil, fmt.Errorf("unknown cache invalidation %q, must be one of %s or %s", mode, invalidateKeyspace, invalidateChannel)
+	}
+	w := &changeWatcher{pubsub: d.client.Subscribe(channels...), stop: make(chan struct{})}
+	go d.receiveChanges(w)
+	return w, nil
+}
+
+// receiveChanges mark the cache stale on each change. Changes made while the subscription is down are lost, so
+// errors and subscribing again mark it stale too
+func (d *DeviceManager) receiveChanges(w *changeWatcher) {
+	backoff := minDialBackoff
+	for {
+		msg, err := w.pubsub.Receive()
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		if err != nil {
+			atomic.StoreUint32(&d.stale, 1)
+			log.Printf("error receiving redis cache invalidations, retrying in %s: %v", backoff, err)
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxDialBackoff {
+				backoff = maxDialBackoff
+			}
+			continue
+		}
+		backoff = minDialBackoff
+		switch msg.(type) {
+		case *redis.Subscription, *redis.Message:
+			atomic.StoreUint32(&d.stale, 1)
+		}
+	}
+}
+
+// close stop watching the changes
+func (w *changeWatcher) close() error {
+	close(w.stop)
+	return w.pubsub.Close()
+}
+
+// publishChange tell the other adam replicas watching invalidateChannel that a cached hash changed
+func (d *DeviceManager) publishChange(hash string) {
+	if d.invalidate != invalidateChannel {
+		return
+	}
+	if err := d.client.Publish(cacheChannel, hash).Err(); err != nil {
+		log.Printf("error publishing change of %s to %s: %v", hash, cacheChannel, err)
+	}
+}
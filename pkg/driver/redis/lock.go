@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// lockPrefix prefix of the keys of the locks the adam replicas sharing a database take
+	lockPrefix = "ADAM_LOCK:"
+	// lockTTL how long a lock is held at most, so that a replica dying while holding it does not block the others
+	lockTTL = 10 * time.Second
+	// lockWait how long to wait for a lock held by another replica before giving up
+	lockWait = 5 * time.Second
+)
+
+// unlockScript release a lock only if it is still held with the token it was taken with, and not by another
+// replica since it expired
+var unlockScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// withLock run f holding the lock of a name across all the adam replicas sharing the database, with the cache
+// marked stale so that f sees what the others wrote. Without sharing, f is run as is
+func (d *DeviceManager) withLock(name string, f func() error) error {
+	if !d.shared {
+		return f()
+	}
+	key := lockPrefix + name
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("unable to generate token for lock %s: %v", key, err)
+	}
+	token := hex.EncodeToString(b)
+	deadline := time.Now().Add(lockWait)
+	backoff := 10 * time.Millisecond
+	for {
+		ok, err := d.client.SetNX(key, token, lockTTL).Result()
+		if err != nil {
+			return fmt.Errorf("unable to take lock %s: %v", key, err)
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for lock %s", lockWait, key)
+		}
+		time.Sleep(backoff)
+		if backoff < 200*time.Millisecond {
+			backoff *= 2
+		}
+	}
+	defer func() {
+		if err := unlockScript.Run(d.client, []string{key}, token).Err(); err != nil {
+			log.Printf("unable to release lock %s, it expires in %s: %v", key, lockTTL, err)
+		}
+	}()
+	atomic.StoreUint32(&d.stale, 1)
+	return f()
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// logSourcePage IDs of the entries of a source read from its index at a time
+const logSourcePage = 100
+
+// logSourceKey key of the index of the entries of a source in the logs of a device
+func logSourceKey(u uuid.UUID, source string) string {
+	return deviceLogSourceIndex + u.String() + "_" + source
+}
+
+// indexLog add the ID of a log entry written to the stream of the logs of a device to the index of its source,
+// trimmed to as many entries as the stream keeps. Entries without a source are not indexed
+func (d *DeviceManager) indexLog(u uuid.UUID, stream *ManagedStream, id string, b []byte) error {
+	source := common.LogSource(b)
+	if source == "" {
+		return nil
+	}
+	key := logSourceKey(u, source)
+	pipe := d.client.Pipeline()
+	pipe.SAdd(deviceLogSourcesSet+u.String(), source)
+	pipe.RPush(key, id)
+	if stream.maxLen != nil {
+		if n := stream.maxLen(); n > 0 {
+			pipe.LTrim(key, -n, -1)
+		}
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return fmt.Errorf("failed to index log entry %s of %s by source %s: %v", id, u, source, err)
+	}
+	return nil
+}
+
+// GetLogSources get the sources of the logs of a device, with how many entries of each are indexed; some of those
+// may have been trimmed from the stream since
+func (d *DeviceManager) GetLogSources(u uuid.UUID) (map[string]int64, error) {
+	if _, ok := d.device(u); !ok {
+		return nil, fmt.Errorf("unregistered device UUID: %s", u)
+	}
+	client := d.readClient()
+	sources, err := client.SMembers(deviceLogSourcesSet + u.String()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the log sources of %s: %v", u, err)
+	}
+	pipe := client.Pipeline()
+	lens := make([]*redis.IntCmd, len(sources))
+	for i, s := range sources {
+		lens[i] = pipe.LLen(logSourceKey(u, s))
+	}
+	if len(sources) > 0 {
+		if _, err := pipe.Exec(); err != nil {
+			return nil, fmt.Errorf("failed to count the entries of the log sources of %s: %v", u, err)
+		}
+	}
+	counts := map[string]int64{}
+	for i, s := range sources {
+		counts[s] = lens[i].Val()
+	}
+	return counts, nil
+}
+
+// GetLogsSourceReader get the logs of a device from one source, those archived, which are not indexed, first
+func (d *DeviceManager) GetLogsSourceReader(u uuid.UUID, source string) (io.Reader, error) {
+	dev, ok := d.device(u)
+	if !ok {
+		return nil, fmt.Errorf("unregistered device UUID: %s", u)
+	}
+	stream, ok := dev.Logs.(*ManagedStream)
+	if !ok {
+		return nil, fmt.Errorf("logs of %s are not a stream", u)
+	}
+	reader := &logSourceReader{client: d.readClient(), stream: stream.name, index: logSourceKey(u, source)}
+	if stream.cold == nil {
+		return reader, nil
+	}
+	archive, err := common.NewArchiveReader(stream.cold, stream.name+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the archive of stream %s: %v", stream.name, err)
+	}
+	reader.after = archive.LastID()
+	return io.MultiReader(common.NewLogSourceFilter(archive, source), reader), nil
+}
+
+// dropLogSources remove the indexes of the logs of a device by source
+func (d *DeviceManager) dropLogSources(u uuid.UUID) error {
+	set := deviceLogSourcesSet + u.String()
+	sources, err := d.client.SMembers(set).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read the log sources of %s: %v", u, err)
+	}
+	keys := []string{set}
+	for _, s := range sources {
+		keys = append(keys, logSourceKey(u, s))
+	}
+	if err := d.client.Del(keys...).Err(); err != nil {
+		return fmt.Errorf("failed to remove the log sources of %s: %v", u, err)
+	}
+	return nil
+}
+
+// logSourceReader reads the entries of a stream listed in an index, newline-delimited, skipping those trimmed from
+// the stream since
+type logSourceReader struct {
+	client *redis.Client
+	stream string
+	index  string
+	// after the ID of the last entry archived, those not after it are read from the archive
+	after string
+	next  int64
+	buf   bytes.Buffer
+	done  bool
+}
+
+// Read the next chunk of the entries, io.EOF once all entries are read
+func (r *logSourceReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 && !r.done {
+		if err := r.page(); err != nil {
+			return 0, err
+		}
+	}
+	if r.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.buf.Read(p)
+}
+
+// page read the entries of the next page of IDs of the index
+func (r *logSourceReader) page() error {
+	ids, err := r.client.LRange(r.index, r.next, r.next+logSourcePage-1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read index %s: %v", r.index, err)
+	}
+	r.next += int64(len(ids))
+	if len(ids) < logSourcePage {
+		r.done = true
+	}
+	pipe := r.client.Pipeline()
+	var cmds []*redis.XMessageSliceCmd
+	for _, id := range ids {
+		if r.after != "" && !streamIDAfter(id, r.after) {
+			continue
+		}
+		cmds = append(cmds, pipe.XRange(r.stream, id, id))
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to read the entries of index %s from stream %s: %v", r.index, r.stream, err)
+	}
+	for _, cmd := range cmds {
+		for _, msg := range cmd.Val() {
+			b, ok, err := streamObject(msg.Values)
+			if !ok || err != nil {
+				return fmt.Errorf("failed to read entry %s of stream %s", msg.ID, r.stream)
+			}
+			r.buf.Write(b)
+			r.buf.WriteByte('\n')
+		}
+	}
+	return nil
+}
+
+// streamIDAfter whether the stream ID a, <milliseconds>-<sequence>, is after b
+func streamIDAfter(a, b string) bool {
+	ams, aseq := splitStreamID(a)
+	bms, bseq := splitStreamID(b)
+	return ams > bms || (ams == bms && aseq > bseq)
+}
+
+func splitStreamID(id string) (uint64, uint64) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, _ := strconv.ParseUint(parts[0], 10, 64)
+	var seq uint64
+	if len(parts) == 2 {
+		seq, _ = strconv.ParseUint(parts[1], 10, 64)
+	}
+	return ms, seq
+}
+
+// migrateLogSources index the logs written before they were indexed by source, replacing any index. The cache may
+// not be loaded yet, so the devices are those with a certificate
+func (d *DeviceManager) migrateLogSources() error {
+	devices, err := d.hashKeys(deviceCertsHash)
+	if err != nil {
+		return err
+	}
+	for k := range devices {
+		u, err := uuid.FromString(k)
+		if err != nil {
+			continue
+		}
+		if err := d.dropLogSources(u); err != nil {
+			return err
+		}
+		stream := d.newDeviceStream(deviceLogsStream+k, u, common.KindLogs)
+		start := "-"
+		for {
+			msgs, err := d.client.XRangeN(stream.name, start, "+", logSourcePage).Result()
+			if err != nil {
+				return fmt.Errorf("failed to read stream %s: %v", stream.name, err)
+			}
+			for _, msg := range msgs {
+				b, ok, err := streamObject(msg.Values)
+				if !ok || err != nil {
+					continue
+				}
+				if err := d.indexLog(u, stream, msg.ID, b); err != nil {
+					return err
+				}
+			}
+			if len(msgs) < logSourcePage {
+				break
+			}
+			start = nextStreamID(msgs[len(msgs)-1].ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis"
+	"github.com/lf-edge/adam/pkg/driver/common"
+)
+
+// schemaVersionKey key of the version of the layout of the database, see migrations()
+const schemaVersionKey = "SCHEMA_VERSION"
+
+// migrations the changes of the layout of the database, oldest first
+func (d *DeviceManager) migrations() []common.Migration {
+	return []common.Migration{
+		{Version: 1, Description: "onboard serials as JSON instead of msgpack", Apply: d.migrateSerials},
+		{Version: 2, Description: "logs of devices indexed by source", Apply: d.migrateLogSources},
+	}
+}
+
+// SchemaVersion get the version of the layout of the database, 0 if it predates versions, and the latest one
+func (d *DeviceManager) SchemaVersion() (int, int, error) {
+	v, err := d.schemaVersion()
+	return v, common.LatestSchema(d.migrations()), err
+}
+
+// Migrate upgrade the database to the latest version of its layout. Replicas sharing the database migrate it one at
+// a time, so only the first to start applies the migrations
+func (d *DeviceManager) Migrate() (int, int, error) {
+	var from, to int
+	err := d.withLock("schema", func() error {
+		var err error
+		if from, err = d.schemaVersion(); err != nil {
+			return err
+		}
+		to, err = common.Migrate(from, d.migrations(), func(v int) error {
+			return d.client.Set(schemaVersionKey, strconv.Itoa(v), 0).Err()
+		})
+		return err
+	})
+	return from, to, err
+}
+
+// schemaVersion read the version of the layout of the database, 0 if none is recorded
+func (d *DeviceManager) schemaVersion() (int, error) {
+	s, err := d.client.Get(schemaVersionKey).Result()
+	switch {
+	case err == redis.Nil:
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("unable to read schema version: %v", err)
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %v", s, err)
+	}
+	return v, nil
+}
+
+// migrateSerials rewrite the serials of onboard certs that older releases wrote as msgpack as JSON
+func (d *DeviceManager) migrateSerials() error {
+	cns, err := d.hashKeys(onboardSerialsHash)
+	if err != nil {
+		return err
+	}
+	for cn := range cns {
+		b, err := d.readValue(onboardSerialsHash, cn)
+		switch {
+		case err == redis.Nil:
+			continue
+		case err != nil:
+			return fmt.Errorf("unable to read onboard serials of %s: %v", cn, err)
+		case json.Valid(b):
+			continue
+		}
+		serials, err := decodeSerials(b)
+		if err != nil {
+			return fmt.Errorf("unable to decode onboard serials of %s: %v", cn, err)
+		}
+		if b, err = json.Marshal(serials); err != nil {
+			return fmt.Errorf("unable to encode onboard serials of %s: %v", cn, err)
+		}
+		if err := d.writeValue(onboardSerialsHash, cn, b); err != nil {
+			return fmt.Errorf("unable to save onboard serials of %s: %v", cn, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/lf-edge/adam/pkg/driver/common"
+)
+
+// RedisStreamConsumer reads the entries of a Redis stream as a member of a consumer group, with XREADGROUP, so that
+// each entry goes to one member, and is read again until acknowledged with XACK
+type RedisStreamConsumer struct {
+	// Redis client handle; reading as a group changes the group, so this must be the primary
+	Client *redis.Client
+	// Name of a stream
+	Stream string
+	// Group name of the consumer group, created from the start of the stream on first use
+	Group string
+	// Consumer name of the member of the group
+	Consumer string
+
+	// pendingDone whether the entries read before but not acknowledged were all read again
+	pendingDone bool
+}
+
+// NewRedisStreamConsumer create a consumer of a stream, creating the group, from the start of the stream, if it
+// does not exist yet
+func NewRedisStreamConsumer(client *redis.Client, stream, group, consumer string) (*RedisStreamConsumer, error) {
+	if group == "" || consumer == "" {
+		return nil, fmt.Errorf("group and consumer names required")
+	}
+	err := client.XGroupCreateMkStream(stream, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, fmt.Errorf("failed to create consumer group %s of stream %s: %v", group, stream, err)
+	}
+	return &RedisStreamConsumer{
+		Client:   client,
+		Stream:   stream,
+		Group:    group,
+		Consumer: consumer,
+	}, nil
+}
+
+// Read read up to count entries, first those read before by the consumer but not acknowledged, then new ones,
+// waiting up to wait for them
+func (c *RedisStreamConsumer) Read(count int, wait time.Duration) ([]common.StreamEntry, error) {
+	if !c.pendingDone {
+		entries, err := c.read("0", count, -1)
+		if err != nil || len(entries) > 0 {
+			return entries, err
+		}
+		c.pendingDone = true
+	}
+	if wait <= 0 {
+		// BLOCK 0 waits forever
+		wait = -1
+	}
+	return c.read(">", count, wait)
+}
+
+// read read from an ID, 0 for the pending entries of the consumer or > for new ones. Entries with nothing to
+// process are acknowledged and skipped, reading more in their place
+func (c *RedisStreamConsumer) read(id string, count int, block time.Duration) ([]common.StreamEntry, error) {
+	entries := []common.StreamEntry{}
+	for {
+		n := count
+		if n > 0 {
+			n -= len(entries)
+		}
+		streams, err := c.Client.XReadGroup(&redis.XReadGroupArgs{
+			Group:    c.Group,
+			Consumer: c.Consumer,
+			Streams:  []string{c.Stream, id},
+			Count:    int64(n),
+			Block:    block,
+		}).Result()
+		switch {
+		case err == redis.Nil:
+			return entries, nil
+		case err != nil:
+			return nil, fmt.Errorf("failed to read stream %s as %s of group %s: %v", c.Stream, c.Consumer, c.Group, err)
+		}
+		var skipped []string
+		for _, s := range streams {
+			for _, m := range s.Messages {
+				if id != ">" {
+					// pending entries stay pending until acknowledged, so read on from the last one
+					id = m.ID
+				}
+				// the objects are stored as received, in JSON. Entries without one were trimmed from the stream
+				// since they were read, and empty ones mark the creation of the stream, so there is nothing to process
+				o, _, err := streamObject(m.Values)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read entry %s of stream %s: %v", m.ID, c.Stream, err)
+				}
+				if len(o) == 0 {
+					skipped = append(skipped, m.ID)
+					continue
+				}
+				entries = append(entries, common.StreamEntry{ID: m.ID, Data: o})
+			}
+		}
+		if len(skipped) == 0 {
+			return entries, nil
+		}
+		if err := c.Ack(skipped...); err != nil {
+			return nil, err
+		}
+		if count > 0 && len(entries) >= count {
+			return entries, nil
+		}
+		if len(entries) > 0 {
+			// do not wait for more once there is something to return
+			block = -1
+		}
+	}
+}
+
+// Ack acknowledge entries, so that they are not read again
+func (c *RedisStreamConsumer) Ack(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := c.Client.XAck(c.Stream, c.Group, ids...).Err(); err != nil {
+		return fmt.Errorf("failed to acknowledge entries of stream %s for group %s: %v", c.Stream, c.Group, err)
+	}
+	return nil
+}
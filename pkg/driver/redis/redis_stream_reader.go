@@ -4,15 +4,22 @@
 package redis
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
-	"github.com/vmihailenco/msgpack/v4"
+	"github.com/lf-edge/adam/pkg/driver/common"
 )
 
-// RedisStreamReader reads msgpack messages from Redis streams and turns then into JSON strings
+// streamReadPage the most entries read from a stream at once
+const streamReadPage = 100
+
+// RedisStreamReader reads messages from Redis streams as JSON strings, all of them oldest first, or those between two
+// IDs, the first or last of them, newest first if asked for. It can be read from concurrently
 type RedisStreamReader struct {
 	// Redis client handle
 	Client *redis.Client
@@ -20,16 +27,42 @@ type RedisStreamReader struct {
 	Stream string
 	// LineFeed whether to put a linefeed "\n" (0x0a) after each file
 	LineFeed bool
+	// Start the ID of the oldest entry to read, inclusive; empty for the oldest of the stream
+	Start string
+	// End the ID of the newest entry to read, inclusive; empty for the newest of the stream
+	End string
+	// Count the most entries to read, 0 for all of them
+	Count int
+	// FromEnd whether the entries counted are the last in the order read rather than the first
+	FromEnd bool
+	// Reverse whether to read the newest entries first
+	Reverse bool
 
+	mu sync.Mutex
 	// unconsumed data from the last message from the previous read
 	data []byte
-	// offset
-	offset string
+	// page the entries read from the stream but not yet returned
+	page []redis.XMessage
+	// cursor the ID to read the next page from, inclusive, in the order read; empty before the first read
+	cursor string
+	// done whether all entries were read from the stream
+	done bool
+	// read the number of entries returned
+	read int
+	// last the ID of the last entry returned
+	last string
 	// if set to true, next Read should return a linefeed character
 	nextLF bool
 }
 
-// Read the next chunk of bytes (do we ever return EOF?)
+// LastID the ID of the last entry read, empty if none was
+func (d *RedisStreamReader) LastID() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.last
+}
+
+// Read the next chunk of bytes, io.EOF once all messages are read
 func (d *RedisStreamReader) Read(p []byte) (n int, err error) {
 	if d.Client == nil || d.Stream == "" {
 		return 0, errors.New("redis connection and name of the stream required")
@@ -39,6 +72,8 @@ func (d *RedisStreamReader) Read(p []byte) (n int, err error) {
 	if len(p) == 0 {
 		return 0, errors.New("must have at least one byte in slice to write")
 	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	// do we send a linefeed?
 	if d.nextLF {
 		p[0] = 0x0a
@@ -46,56 +81,239 @@ func (d *RedisStreamReader) Read(p []byte) (n int, err error) {
 		return 1, nil
 	}
 
-	// lets see if we need to get some more messages from the stream first
-	if len(d.data) == 0 {
-		if d.offset == "" {
-			d.offset = "0"
+	// lets see if we need to get some more messages from the stream first, skipping the empty one creating it
+	for len(d.data) == 0 {
+		if d.Count > 0 && d.read >= d.Count {
+			return 0, io.EOF
 		}
-
-		records, err := d.Client.XRead(&redis.XReadArgs{
-			Streams: []string{d.Stream, d.offset},
-			Block:   time.Millisecond, // do a non-blocking read
-			Count:   1,
-		}).Result()
-		// it is weird that the library would return "redis: nil" for a non-blocking read
-		if (err != nil && err.Error() != "redis: nil") || len(records) > 1 {
+		msg, err := d.next()
+		if err != nil {
+			return 0, err
+		}
+		s, ok, err := streamObject(msg.Values)
+		if !ok || err != nil {
 			return 0, errors.New("failed to read from stream")
 		}
-		if records == nil || len(records[0].Messages) == 0 {
-			return 0, nil
-		} else {
-			d.offset = records[0].Messages[0].ID
-			s, ok := records[0].Messages[0].Values["object"].(string)
-			if !ok {
-				return 0, errors.New("failed to read from stream")
-			}
-
-			// maybe there's a clever way to go straight from msgpack -> JSON?
-			var data interface{}
-			err = msgpack.Unmarshal([]byte(s), &data)
-			if err != nil {
-				return 0, errors.New("failed to read from stream")
-			}
-			res, err := json.Marshal(data)
-			if err != nil {
-				return 0, errors.New("failed to read from stream")
-			}
-
-			d.data = res
+		if len(s) == 0 {
+			continue
 		}
+		d.data = s
+		d.read++
+		d.last = msg.ID
 	}
 
 	// transfer the data
-	consumed := 0
-	if len(d.data) > 0 {
-		consumed = copy(p, d.data)
-		d.data = d.data[consumed:]
-	}
+	consumed := copy(p, d.data)
+	d.data = d.data[consumed:]
 
 	// indicate that the next read should include a linefeed
-	if d.LineFeed {
+	if d.LineFeed && len(d.data) == 0 {
 		d.nextLF = true
 	}
 
 	return consumed, nil
 }
+
+// next the next entry of the stream in the range, in the order read, io.EOF once there are no more
+func (d *RedisStreamReader) next() (redis.XMessage, error) {
+	if d.cursor == "" && !d.done {
+		if err := d.seek(); err != nil {
+			return redis.XMessage{}, err
+		}
+	}
+	for len(d.page) == 0 {
+		if d.done {
+			return redis.XMessage{}, io.EOF
+		}
+		page, err := d.readPage(d.cursor)
+		if err != nil {
+			return redis.XMessage{}, err
+		}
+		d.page = page
+		if len(page) < streamReadPage {
+			d.done = true
+		} else if d.cursor = d.after(page[len(page)-1].ID); d.cursor == "" {
+			d.done = true
+		}
+	}
+	msg := d.page[0]
+	d.page = d.page[1:]
+	return msg, nil
+}
+
+// seek set where to start reading. The last entries counted are found by reading the range the other way, the ID of
+// the last of them bounding the range, so that they are read in order without keeping them all in memory
+func (d *RedisStreamReader) seek() error {
+	if d.Count > 0 && d.FromEnd {
+		if err := d.seekFromEnd(); err != nil {
+			return err
+		}
+	}
+	d.cursor = d.Start
+	if d.Reverse {
+		d.cursor = d.End
+	}
+	if d.cursor == "" {
+		d.cursor = "-"
+		if d.Reverse {
+			d.cursor = "+"
+		}
+	}
+	return nil
+}
+
+// seekFromEnd bound the range to the last entries counted
+func (d *RedisStreamReader) seekFromEnd() error {
+	// the same range read the other way
+	other := &RedisStreamReader{Client: d.Client, Stream: d.Stream, Start: d.Start, End: d.End, Count: d.Count, Reverse: !d.Reverse}
+	var bound string
+	for other.Count == 0 || other.read < other.Count {
+		msg, err := other.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if s, ok, _ := streamObject(msg.Values); ok && len(s) == 0 {
+			continue
+		}
+		bound = msg.ID
+		other.read++
+	}
+	if bound == "" {
+		d.done = true
+		return nil
+	}
+	if d.Reverse {
+		d.End = bound
+	} else {
+		d.Start = bound
+	}
+	// all the entries up to the bound are the ones counted
+	d.Count, d.FromEnd = 0, false
+	return nil
+}
+
+// readPage read a page of entries from an ID, inclusive, in the order read
+func (d *RedisStreamReader) readPage(from string) ([]redis.XMessage, error) {
+	var (
+		page []redis.XMessage
+		err  error
+	)
+	if d.Reverse {
+		end := d.Start
+		if end == "" {
+			end = "-"
+		}
+		page, err = d.Client.XRevRangeN(d.Stream, from, end, streamReadPage).Result()
+	} else {
+		end := d.End
+		if end == "" {
+			end = "+"
+		}
+		page, err = d.Client.XRangeN(d.Stream, from, end, streamReadPage).Result()
+	}
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read from stream %s: %v", d.Stream, err)
+	}
+	return page, nil
+}
+
+// after the ID to read from after an entry in the order read, empty if there is none
+func (d *RedisStreamReader) after(id string) string {
+	if d.Reverse {
+		return prevStreamID(id)
+	}
+	return nextStreamID(id)
+}
+
+// prevStreamID the largest ID before another, to range up to it inclusively, empty if there is none
+func prevStreamID(id string) string {
+	ms, seq, err := common.ParseStreamID(id)
+	switch {
+	case err != nil:
+		return id
+	case seq > 0:
+		return fmt.Sprintf("%d-%d", ms, seq-1)
+	case ms > 0:
+		return fmt.Sprintf("%d-%d", ms-1, uint64(math.MaxUint64))
+	}
+	return ""
+}
+
+// timeStreamID the ID of the first or the last entry that can be written at a time
+func timeStreamID(t time.Time, last bool) string {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	if last {
+		return fmt.Sprintf("%d-%d", ms, uint64(math.MaxUint64))
+	}
+	return fmt.Sprintf("%d-0", ms)
+}
+
+// compareStreamIDs -1, 0 or 1 as a is before, the same as or after b
+func compareStreamIDs(a, b string) int {
+	ams, aseq, _ := common.ParseStreamID(a)
+	bms, bseq, _ := common.ParseStreamID(b)
+	switch {
+	case ams < bms || ams == bms && aseq < bseq:
+		return -1
+	case ams == bms && aseq == bseq:
+		return 0
+	}
+	return 1
+}
+
+// newRangeReader a reader of the entries of a stream in a range
+func newRangeReader(client *redis.Client, stream string, rng common.StreamRange) (*RedisStreamReader, error) {
+	if err := rng.Validate(); err != nil {
+		return nil, err
+	}
+	r := &RedisStreamReader{Client: client, Stream: stream, LineFeed: true, Reverse: rng.Reverse}
+	var starts, ends []string
+	if rng.After != "" {
+		ms, seq, err := common.ParseStreamID(rng.After)
+		if err != nil {
+			return nil, err
+		}
+		starts = append(starts, nextStreamID(fmt.Sprintf("%d-%d", ms, seq)))
+	}
+	if !rng.Since.IsZero() {
+		starts = append(starts, timeStreamID(rng.Since, false))
+	}
+	if rng.Before != "" {
+		if _, _, err := common.ParseStreamID(rng.Before); err != nil {
+			return nil, err
+		}
+		end := prevStreamID(rng.Before)
+		if end == "" {
+			// nothing is before the first ID
+			r.done = true
+			return r, nil
+		}
+		ends = append(ends, end)
+	}
+	if !rng.Until.IsZero() {
+		ends = append(ends, timeStreamID(rng.Until, true))
+	}
+	for _, s := range starts {
+		if r.Start == "" || compareStreamIDs(s, r.Start) > 0 {
+			r.Start = s
+		}
+	}
+	for _, e := range ends {
+		if r.End == "" || compareStreamIDs(e, r.End) < 0 {
+			r.End = e
+		}
+	}
+	if r.Start != "" && r.End != "" && compareStreamIDs(r.Start, r.End) > 0 {
+		r.done = true
+	}
+	switch {
+	case rng.First > 0:
+		r.Count = rng.First
+	case rng.Last > 0:
+		r.Count, r.FromEnd = rng.Last, true
+	}
+	return r, nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"fmt"
+
+	"github.com/go-redis/redis"
+	"github.com/lf-edge/adam/pkg/driver/common"
+)
+
+// encryptedHashes the hashes whose values are encrypted, those of devices but for their quotas, and those of the
+// records of every kind
+func encryptedHashes() []string {
+	hashes := []string{
+		onboardCertsHash, onboardSerialsHash, onboardPoliciesHash, deviceSerialsHash, deviceOnboardCertsHash,
+		deviceCertsHash, deviceConfigsHash, deviceConfigAcksHash, deviceInventoriesHash, deviceLogFiltersHash,
+		deviceProfilesHash, deviceMetadataHash, deviceModelsHash, deviceAppCommandsHash, deviceFlagsHash,
+		deviceQuarantineHash, deviceSourcesHash, deviceAttestationsHash,
+	}
+	for _, kind := range common.RecordKinds {
+		hashes = append(hashes, recordHashes[kind])
+	}
+	return hashes
+}
+
+// Reencrypt encrypt anew the values written in plaintext, or encrypted by older releases without the key of their
+// record, with the encryptor set. Each is replaced in a transaction, so that one written meanwhile is not undone.
+// Returns how many were
+func (d *DeviceManager) Reencrypt() (int, error) {
+	if d.encryptor == nil {
+		return 0, nil
+	}
+	n := 0
+	for _, hash := range encryptedHashes() {
+		keys, err := d.client.HKeys(hash).Result()
+		if err != nil {
+			return n, fmt.Errorf("failed to list %s: %v", hash, err)
+		}
+		for _, key := range keys {
+			changed, err := d.reencryptValue(hash, key)
+			if err != nil {
+				return n, err
+			}
+			if changed {
+				n++
+			}
+		}
+	}
+	if n > 0 {
+		if err := d.client.Save().Err(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// reencryptValue encrypt anew the value of a key of a hash, if it is not encrypted with the key of its record,
+// returning whether it was
+func (d *DeviceManager) reencryptValue(hash, key string) (bool, error) {
+	for i := 0; i < swapAttempts; i++ {
+		changed := false
+		err := d.client.Watch(func(tx *redis.Tx) error {
+			v, err := tx.HGet(hash, key).Result()
+			if err == redis.Nil {
+				// removed since the keys were listed
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			b, reencrypted, err := d.encryptor.Reencrypt([]byte(v), recordKey(hash, key))
+			if err != nil || !reencrypted {
+				return err
+			}
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.HSet(hash, key, string(b))
+				return nil
+			})
+			changed = err == nil
+			return err
+		}, hash)
+		switch {
+		case err == redis.TxFailedErr:
+			continue
+		case err != nil:
+			return false, fmt.Errorf("failed to reencrypt %s of %s: %v", key, hash, err)
+		}
+		return changed, nil
+	}
+	return false, fmt.Errorf("failed to reencrypt %s of %s: the values kept changing", key, hash)
+}
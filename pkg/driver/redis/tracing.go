@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"context"
+
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName name of the tracer with the spans of redis commands
+const tracerName = "github.com/lf-edge/adam/pkg/driver/redis"
+
+// WithContext return a copy of the DeviceManager, sharing its cache, that runs each redis command as a span under
+// the one in ctx
+func (d *DeviceManager) WithContext(ctx context.Context) *DeviceManager {
+	c := *d
+	c.client = traceClient(ctx, d.client)
+	c.replicas = make([]*redis.Client, 0, len(d.replicas))
+	for _, r := range d.replicas {
+		c.replicas = append(c.replicas, traceClient(ctx, r))
+	}
+	return &c
+}
+
+// traceClient clone a client so that each command or pipeline it runs is a span under the one in ctx
+func traceClient(ctx context.Context, client *redis.Client) *redis.Client {
+	tracer := otel.Tracer(tracerName)
+	attrs := []attribute.KeyValue{semconv.DBSystemRedis, semconv.NetPeerNameKey.String(client.Options().Addr)}
+	c := client.WithContext(ctx)
+	c.WrapProcess(func(process func(redis.Cmder) error) func(redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			_, span := tracer.Start(ctx, "redis."+cmd.Name(), trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attrs...), trace.WithAttributes(semconv.DBOperationKey.String(cmd.Name())))
+			err := process(cmd)
+			endSpan(span, err)
+			return err
+		}
+	})
+	c.WrapProcessPipeline(func(process func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			_, span := tracer.Start(ctx, "redis.pipeline", trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attrs...), trace.WithAttributes(attribute.Int("db.redis.commands", len(cmds))))
+			err := process(cmds)
+			endSpan(span, err)
+			return err
+		}
+	})
+	return c
+}
+
+// endSpan end the span of a command, recording its error; a missing key is not one
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != redis.Nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
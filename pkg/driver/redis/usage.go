@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// DeviceUsage get the memory used by the streams of each kind of message of a device, as MEMORY USAGE reports it,
+// the number of their entries, and when their first and last entries were added
+func (d *DeviceManager) DeviceUsage(u uuid.UUID) (*common.DeviceUsage, error) {
+	if err := d.refreshCache(); err != nil {
+		return nil, fmt.Errorf("unable to refresh certs from Redis: %v", err)
+	}
+	if _, ok := d.device(u); !ok {
+		return nil, &common.NotFoundError{Err: fmt.Sprintf("device uuid not found: %s", u.String())}
+	}
+	k := u.String()
+	// app logs streams are found by name, to count those of app instances not in the cache too
+	apps, err := d.client.Keys(deviceAppLogsStream + k + "_*").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list streams %s%s_*: %v", deviceAppLogsStream, k, err)
+	}
+	streams := map[string]string{
+		deviceLogsStream + k:     common.KindLogs,
+		deviceInfoStream + k:     common.KindInfo,
+		deviceMetricsStream + k:  common.KindMetrics,
+		deviceRequestsStream + k: common.KindRequests,
+	}
+	for _, s := range apps {
+		streams[s] = common.KindAppLogs
+	}
+	usage := common.NewDeviceUsage(k)
+	client := d.readClient()
+	for stream, kind := range streams {
+		s, err := streamUsage(client, stream)
+		if err != nil {
+			return nil, err
+		}
+		usage.Add(kind, s)
+	}
+	return usage, nil
+}
+
+// streamUsage the memory used by a stream, its length and when its first and last entries were added, from their IDs
+func streamUsage(client *redis.Client, stream string) (common.StreamUsage, error) {
+	u := common.StreamUsage{}
+	n, err := client.XLen(stream).Result()
+	if err != nil {
+		return u, fmt.Errorf("failed to get length of stream %s: %v", stream, err)
+	}
+	if n == 0 {
+		return u, nil
+	}
+	u.Entries = n
+	if u.Bytes, err = client.MemoryUsage(stream).Result(); err != nil && err != redis.Nil {
+		return u, fmt.Errorf("failed to get memory usage of stream %s: %v", stream, err)
+	}
+	// the empty entry creating the stream is not a message, so it is not counted, unless trimmed already
+	first, err := client.XRangeN(stream, "-", "+", 2).Result()
+	if err != nil {
+		return u, fmt.Errorf("failed to read first entry of stream %s: %v", stream, err)
+	}
+	if len(first) > 0 && first[0].Values["object"] == "" {
+		u.Entries--
+		first = first[1:]
+	}
+	if len(first) == 0 {
+		return u, nil
+	}
+	last, err := client.XRevRangeN(stream, "+", "-", 1).Result()
+	if err != nil {
+		return u, fmt.Errorf("failed to read last entry of stream %s: %v", stream, err)
+	}
+	u.Oldest = entryTime(first[0].ID)
+	if len(last) > 0 {
+		u.Newest = entryTime(last[0].ID)
+	}
+	return u, nil
+}
+
+// entryTime when an entry was added, from the milliseconds of its ID, <ms>-<seq>. nil if the ID has none
+func entryTime(id string) *time.Time {
+	ms, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return nil
+	}
+	t := time.Unix(0, ms*int64(time.Millisecond))
+	return &t
+}
@@ -0,0 +1,761 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	ax "github.com/lf-edge/adam/pkg/x509"
+	uuid "github.com/satori/go.uuid"
+)
+
+// A state snapshot is a tar.gz of JSON files, with a directory per onboarding certificate, named as the driver names
+// it, and per device, named by its UUID, a file per collection, and the manifest last, with the SHA-256 of every
+// other file
+const (
+	// StateVersion the version of the layout of state snapshots written
+	StateVersion      = 1
+	stateManifest     = "manifest.json"
+	stateOnboardDir   = "onboard"
+	stateDeviceDir    = "device"
+	stateCert         = "cert.pem"
+	stateSerials      = "serials.json"
+	statePolicy       = "policy.json"
+	stateOnboardCert  = "onboard.pem"
+	stateSerial       = "serial.json"
+	stateConfig       = "config.json"
+	stateAudit        = "audit.jsonl"
+	stateTelemetryExt = ".jsonl"
+)
+
+// StateManifest what a state snapshot holds, with the SHA-256 of each of its files, by path
+type StateManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Driver the name of the driver the snapshot was taken from; it restores into any
+	Driver string `json:"driver"`
+	// Telemetry whether the logs, info, metrics and requests of devices, and the audit log, are in the snapshot
+	Telemetry bool              `json:"telemetry"`
+	Onboard   int               `json:"onboard"`
+	Devices   int               `json:"devices"`
+	Files     map[string]string `json:"files"`
+}
+
+// stateCollection the records of a kind of a DeviceManager, held in a state snapshot as a file of a JSON list,
+// <kind>.json, in the order of their keys
+type stateCollection struct {
+	kind string
+	// key the JSON field of the records that they are kept by
+	key string
+}
+
+var stateCollections = []stateCollection{
+	{common.RecordPending, "id"},
+	{common.RecordTokens, "id"},
+	{common.RecordRollouts, "id"},
+	{common.RecordSchedules, "id"},
+	{common.RecordCanaries, "id"},
+	{common.RecordAlertRules, "id"},
+	{common.RecordTombstones, "uuid"},
+	{common.RecordRevocations, "fingerprint"},
+	{common.RecordSnapshots, "name"},
+	{common.RecordHardwareModels, "name"},
+	{common.RecordDatastores, "name"},
+	{common.RecordImages, "name"},
+	{common.RecordDeadLetters, "id"},
+}
+
+// file the file of the collection in a state snapshot
+func (c stateCollection) file() string {
+	return c.kind + ".json"
+}
+
+// list the records of the collection, in the order of their keys
+func (c stateCollection) list(m DeviceManager) ([]json.RawMessage, error) {
+	records, err := m.ListRecords(c.kind)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := make([]json.RawMessage, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, records[k])
+	}
+	return items, nil
+}
+
+// add add the records of a JSON list, each by the value of its key field, returning how many there were
+func (c stateCollection) add(m DeviceManager, b []byte) (int, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(b, &items); err != nil {
+		return 0, err
+	}
+	for i, item := range items {
+		var keyed map[string]interface{}
+		if err := json.Unmarshal(item, &keyed); err != nil {
+			return 0, err
+		}
+		k, _ := keyed[c.key].(string)
+		if k == "" {
+			return 0, fmt.Errorf("item %d has no %s", i, c.key)
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, item); err != nil {
+			return 0, err
+		}
+		if err := m.PutRecord(c.kind, k, compact.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return len(items), nil
+}
+
+// stateDeviceItem what a DeviceManager holds of a device besides its registration, as a JSON file in its directory
+type stateDeviceItem struct {
+	file string
+	get  func(m DeviceManager, u uuid.UUID) (interface{}, error)
+	set  func(m DeviceManager, u uuid.UUID, b []byte) error
+}
+
+var stateDeviceItems = []stateDeviceItem{
+	{"quotas.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetDeviceQuotas(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v common.Quotas
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetDeviceQuotas(u, &v)
+		}},
+	{"config-ack.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetConfigAck(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v common.ConfigAck
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetConfigAck(u, &v)
+		}},
+	{"inventory.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetInventory(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v common.Inventory
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetInventory(u, &v)
+		}},
+	{"log-filter.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetLogFilter(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v common.LogFilter
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetLogFilter(u, &v)
+		}},
+	{"local-profile.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetLocalProfile(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v common.LocalProfile
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetLocalProfile(u, &v)
+		}},
+	{"metadata.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetDeviceMetadata(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v common.DeviceMetadata
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetDeviceMetadata(u, &v)
+		}},
+	{"model.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetDeviceModel(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v string
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetDeviceModel(u, v)
+		}},
+	{"app-commands.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetAppCommands(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v []common.AppCommand
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetAppCommands(u, v)
+		}},
+	{"flags.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetDeviceFlags(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v common.DeviceFlags
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetDeviceFlags(u, &v)
+		}},
+	{"quarantine.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetQuarantine(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v common.Quarantine
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetQuarantine(u, &v)
+		}},
+	{"sources.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetDeviceSources(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v []common.DeviceSource
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetDeviceSources(u, v)
+		}},
+	{"attestation.json",
+		func(m DeviceManager, u uuid.UUID) (interface{}, error) { return m.GetAttestation(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error {
+			var v common.Attestation
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			return m.SetAttestation(u, &v)
+		}},
+}
+
+// stateStream a stream of the messages of a device, held in a state snapshot with telemetry as JSON lines
+type stateStream struct {
+	name  string
+	read  func(m DeviceManager, u uuid.UUID) (io.Reader, error)
+	write func(m DeviceManager, u uuid.UUID, b []byte) error
+}
+
+var stateStreams = []stateStream{
+	{common.KindLogs,
+		func(m DeviceManager, u uuid.UUID) (io.Reader, error) { return m.GetLogsReader(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error { return m.WriteLogs(u, b) }},
+	{common.KindInfo,
+		func(m DeviceManager, u uuid.UUID) (io.Reader, error) { return m.GetInfoReader(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error { return m.WriteInfo(u, b) }},
+	{common.KindMetrics,
+		func(m DeviceManager, u uuid.UUID) (io.Reader, error) { return m.GetMetricsReader(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error { return m.WriteMetrics(u, b) }},
+	{common.KindRequests,
+		func(m DeviceManager, u uuid.UUID) (io.Reader, error) { return m.GetRequestsReader(u) },
+		func(m DeviceManager, u uuid.UUID, b []byte) error { return m.WriteRequest(u, b) }},
+}
+
+// stateWriter writes the files of a state snapshot, keeping their SHA-256 for the manifest
+type stateWriter struct {
+	tw       *tar.Writer
+	manifest *StateManifest
+}
+
+func (s *stateWriter) write(name string, b []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), ModTime: s.manifest.Created, Typeflag: tar.TypeReg}
+	if err := s.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("error writing %s: %v", name, err)
+	}
+	if _, err := s.tw.Write(b); err != nil {
+		return fmt.Errorf("error writing %s: %v", name, err)
+	}
+	if name != stateManifest {
+		hash := sha256.Sum256(b)
+		s.manifest.Files[name] = hex.EncodeToString(hash[:])
+	}
+	return nil
+}
+
+// writeJSON write a value as JSON, unless it is nil or empty
+func (s *stateWriter) writeJSON(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", name, err)
+	}
+	switch string(b) {
+	case "null", "[]", "{}", `""`:
+		return nil
+	}
+	return s.write(name, b)
+}
+
+// WriteState write a snapshot of the state of a DeviceManager as a tar.gz: its onboarding certificates with their
+// serials and policies, its devices with their certificates, configs and everything else kept of them, and its
+// collections, and, with telemetry, the logs, info, metrics and requests of devices and the audit log. The logs of
+// app instances and the ACME certificates of the server are not in it
+func WriteState(m DeviceManager, w io.Writer, telemetry bool) (*StateManifest, error) {
+	manifest := &StateManifest{
+		Version:   StateVersion,
+		Created:   time.Now().UTC(),
+		Driver:    m.Name(),
+		Telemetry: telemetry,
+		Files:     map[string]string{},
+	}
+	gz := gzip.NewWriter(w)
+	s := &stateWriter{tw: tar.NewWriter(gz), manifest: manifest}
+
+	cns, err := m.OnboardList()
+	if err != nil {
+		return nil, fmt.Errorf("error listing onboarding certificates: %v", err)
+	}
+	sort.Strings(cns)
+	for _, cn := range cns {
+		name := common.GetOnboardCertName(cn)
+		cert, serials, err := m.OnboardGet(name)
+		if _, isNotFound := err.(*common.NotFoundError); isNotFound && name != cn {
+			// the memory driver looks them up by their CN as it is
+			cert, serials, err = m.OnboardGet(cn)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting onboarding certificate %s: %v", cn, err)
+		}
+		dir := path.Join(stateOnboardDir, name)
+		if err := s.write(path.Join(dir, stateCert), ax.PemEncodeCert(cert.Raw)); err != nil {
+			return nil, err
+		}
+		if err := s.writeJSON(path.Join(dir, stateSerials), serials); err != nil {
+			return nil, err
+		}
+		policy, err := m.OnboardPolicyGet(cert.Subject.CommonName)
+		if err != nil {
+			return nil, fmt.Errorf("error getting policy of onboarding certificate %s: %v", cn, err)
+		}
+		if policy != nil {
+			if err := s.writeJSON(path.Join(dir, statePolicy), policy); err != nil {
+				return nil, err
+			}
+		}
+		manifest.Onboard++
+	}
+
+	uids, err := m.DeviceList()
+	if err != nil {
+		return nil, fmt.Errorf("error listing devices: %v", err)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i].String() < uids[j].String() })
+	for _, u := range uids {
+		cert, onboard, serial, err := m.DeviceGet(u)
+		if _, isNotFound := err.(*common.NotFoundError); isNotFound {
+			// removed since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting device %s: %v", u, err)
+		}
+		dir := path.Join(stateDeviceDir, u.String())
+		if err := s.write(path.Join(dir, stateCert), ax.PemEncodeCert(cert.Raw)); err != nil {
+			return nil, err
+		}
+		if onboard != nil {
+			if err := s.write(path.Join(dir, stateOnboardCert), ax.PemEncodeCert(onboard.Raw)); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.writeJSON(path.Join(dir, stateSerial), serial); err != nil {
+			return nil, err
+		}
+		conf, err := m.GetConfig(*u)
+		if err != nil {
+			return nil, fmt.Errorf("error getting config of device %s: %v", u, err)
+		}
+		if err := s.write(path.Join(dir, stateConfig), conf); err != nil {
+			return nil, err
+		}
+		for _, item := range stateDeviceItems {
+			v, err := item.get(m, *u)
+			if _, isNotFound := err.(*common.NotFoundError); err != nil && !isNotFound {
+				return nil, fmt.Errorf("error getting %s of device %s: %v", strings.TrimSuffix(item.file, ".json"), u, err)
+			}
+			if err == nil {
+				if err := s.writeJSON(path.Join(dir, item.file), v); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if telemetry {
+			for _, stream := range stateStreams {
+				r, err := stream.read(m, *u)
+				if err != nil {
+					return nil, fmt.Errorf("error reading %s of device %s: %v", stream.name, u, err)
+				}
+				b, err := ioutil.ReadAll(r)
+				if err != nil {
+					return nil, fmt.Errorf("error reading %s of device %s: %v", stream.name, u, err)
+				}
+				if len(b) > 0 {
+					if err := s.write(path.Join(dir, stream.name+stateTelemetryExt), b); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		manifest.Devices++
+	}
+
+	for _, c := range stateCollections {
+		items, err := c.list(m)
+		if err != nil {
+			return nil, fmt.Errorf("error listing %s: %v", c.kind, err)
+		}
+		if err := s.writeJSON(c.file(), items); err != nil {
+			return nil, err
+		}
+	}
+	if telemetry {
+		r, err := m.GetAuditReader()
+		if err != nil {
+			return nil, fmt.Errorf("error reading audit log: %v", err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("error reading audit log: %v", err)
+		}
+		if len(b) > 0 {
+			if err := s.write(stateAudit, b); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding manifest: %v", err)
+	}
+	if err := s.write(stateManifest, b); err != nil {
+		return nil, err
+	}
+	if err := s.tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// readState call a function with each file of a state snapshot, in order
+func readState(r io.Reader, f func(name string, b []byte) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("not a tar.gz: %v", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading snapshot: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", hdr.Name, err)
+		}
+		if err := f(path.Clean(strings.TrimPrefix(hdr.Name, "./")), b); err != nil {
+			return err
+		}
+	}
+}
+
+// VerifyState check a state snapshot against its manifest: every file in it must be in the manifest, with the same
+// SHA-256, and every file of the manifest in it, returning the manifest
+func VerifyState(r io.Reader) (*StateManifest, error) {
+	hashes := map[string]string{}
+	var manifest *StateManifest
+	err := readState(r, func(name string, b []byte) error {
+		if name == stateManifest {
+			manifest = &StateManifest{}
+			if err := json.Unmarshal(b, manifest); err != nil {
+				return fmt.Errorf("bad manifest: %v", err)
+			}
+			return nil
+		}
+		if _, ok := hashes[name]; ok {
+			return fmt.Errorf("%s is in the snapshot twice", name)
+		}
+		hash := sha256.Sum256(b)
+		hashes[name] = hex.EncodeToString(hash[:])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("no %s, the snapshot is incomplete", stateManifest)
+	}
+	if manifest.Version > StateVersion {
+		return nil, fmt.Errorf("snapshot of version %d, newer than the latest known, %d", manifest.Version, StateVersion)
+	}
+	for name, hash := range hashes {
+		expected, ok := manifest.Files[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is not in the manifest", name)
+		}
+		if hash != expected {
+			return nil, fmt.Errorf("checksum mismatch of %s: %s, expected %s", name, hash, expected)
+		}
+	}
+	for name := range manifest.Files {
+		if _, ok := hashes[name]; !ok {
+			return nil, fmt.Errorf("%s of the manifest is missing", name)
+		}
+	}
+	return manifest, nil
+}
+
+// stateDevice a device of a state snapshot, registered once all its files are read
+type stateDevice struct {
+	cert    *x509.Certificate
+	onboard *x509.Certificate
+	serial  string
+	config  []byte
+	items   map[string][]byte
+	streams map[string][]byte
+}
+
+// stateOnboard an onboarding certificate of a state snapshot
+type stateOnboard struct {
+	cert    *x509.Certificate
+	serials []string
+	policy  *common.OnboardPolicy
+}
+
+// RestoreState restore a state snapshot written by WriteState into a DeviceManager, after verifying it. Unless
+// replace is set, the DeviceManager must have no onboarding certificates or devices; with it, they are cleared
+// first, along with the items of its collections
+func RestoreState(m DeviceManager, r io.ReadSeeker, replace bool) (*StateManifest, error) {
+	manifest, err := VerifyState(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("error rereading snapshot: %v", err)
+	}
+	onboards := map[string]*stateOnboard{}
+	devices := map[uuid.UUID]*stateDevice{}
+	collections := map[string][]byte{}
+	var audit []byte
+	err = readState(r, func(name string, b []byte) error {
+		parts := strings.Split(name, "/")
+		switch {
+		case name == stateManifest:
+		case len(parts) == 1 && name == stateAudit:
+			audit = b
+		case len(parts) == 1:
+			collections[name] = b
+		case len(parts) == 3 && parts[0] == stateOnboardDir:
+			o, ok := onboards[parts[1]]
+			if !ok {
+				o = &stateOnboard{}
+				onboards[parts[1]] = o
+			}
+			var err error
+			switch parts[2] {
+			case stateCert:
+				o.cert, err = ax.ParseCert(b)
+			case stateSerials:
+				err = json.Unmarshal(b, &o.serials)
+			case statePolicy:
+				o.policy = &common.OnboardPolicy{}
+				err = json.Unmarshal(b, o.policy)
+			default:
+				return fmt.Errorf("unexpected file %s", name)
+			}
+			if err != nil {
+				return fmt.Errorf("bad %s: %v", name, err)
+			}
+		case len(parts) == 3 && parts[0] == stateDeviceDir:
+			u, err := uuid.FromString(parts[1])
+			if err != nil {
+				return fmt.Errorf("bad device UUID in %s: %v", name, err)
+			}
+			d, ok := devices[u]
+			if !ok {
+				d = &stateDevice{items: map[string][]byte{}, streams: map[string][]byte{}}
+				devices[u] = d
+			}
+			switch {
+			case parts[2] == stateCert:
+				d.cert, err = ax.ParseCert(b)
+			case parts[2] == stateOnboardCert:
+				d.onboard, err = ax.ParseCert(b)
+			case parts[2] == stateSerial:
+				err = json.Unmarshal(b, &d.serial)
+			case parts[2] == stateConfig:
+				d.config = b
+			case strings.HasSuffix(parts[2], stateTelemetryExt):
+				d.streams[strings.TrimSuffix(parts[2], stateTelemetryExt)] = b
+			default:
+				d.items[parts[2]] = b
+			}
+			if err != nil {
+				return fmt.Errorf("bad %s: %v", name, err)
+			}
+		default:
+			return fmt.Errorf("unexpected file %s", name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, o := range onboards {
+		if o.cert == nil {
+			return nil, fmt.Errorf("onboarding certificate %s has no %s", name, stateCert)
+		}
+	}
+	for u, d := range devices {
+		if d.cert == nil {
+			return nil, fmt.Errorf("device %s has no %s", u, stateCert)
+		}
+		if d.config == nil {
+			return nil, fmt.Errorf("device %s has no %s", u, stateConfig)
+		}
+	}
+
+	if replace {
+		if err := clearState(m); err != nil {
+			return nil, err
+		}
+	} else {
+		cns, err := m.OnboardList()
+		if err != nil {
+			return nil, fmt.Errorf("error listing onboarding certificates: %v", err)
+		}
+		uids, err := m.DeviceList()
+		if err != nil {
+			return nil, fmt.Errorf("error listing devices: %v", err)
+		}
+		if len(cns) > 0 || len(uids) > 0 {
+			return nil, &StateNotEmptyError{Onboard: len(cns), Devices: len(uids)}
+		}
+	}
+
+	for name, o := range onboards {
+		if err := m.OnboardRegister(o.cert, o.serials); err != nil {
+			return nil, fmt.Errorf("error registering onboarding certificate %s: %v", name, err)
+		}
+		if o.policy != nil {
+			if err := m.OnboardPolicySet(o.cert.Subject.CommonName, o.policy); err != nil {
+				return nil, fmt.Errorf("error setting policy of onboarding certificate %s: %v", name, err)
+			}
+		}
+	}
+	for u, d := range devices {
+		if err := m.DeviceRegister(u, d.cert, d.onboard, d.serial, d.config); err != nil {
+			return nil, fmt.Errorf("error registering device %s: %v", u, err)
+		}
+		for _, stream := range stateStreams {
+			if err := eachLine(d.streams[stream.name], func(b []byte) error { return stream.write(m, u, b) }); err != nil {
+				return nil, fmt.Errorf("error restoring %s of device %s: %v", stream.name, u, err)
+			}
+		}
+		// after the telemetry, so that the quotas of the device do not hold it back
+		for _, item := range stateDeviceItems {
+			b, ok := d.items[item.file]
+			if !ok {
+				continue
+			}
+			if err := item.set(m, u, b); err != nil {
+				return nil, fmt.Errorf("error restoring %s of device %s: %v", strings.TrimSuffix(item.file, ".json"), u, err)
+			}
+		}
+	}
+	for _, c := range stateCollections {
+		b, ok := collections[c.file()]
+		if !ok {
+			continue
+		}
+		if _, err := c.add(m, b); err != nil {
+			return nil, fmt.Errorf("error restoring %s: %v", c.kind, err)
+		}
+	}
+	if err := eachLine(audit, m.WriteAudit); err != nil {
+		return nil, fmt.Errorf("error restoring audit log: %v", err)
+	}
+	return manifest, nil
+}
+
+// StateNotEmptyError a state snapshot being restored without replacing into a DeviceManager that has onboarding
+// certificates or devices
+type StateNotEmptyError struct {
+	Onboard int
+	Devices int
+}
+
+func (e *StateNotEmptyError) Error() string {
+	return fmt.Sprintf("the database has %d onboarding certificates and %d devices; restore into an empty one, or replace them", e.Onboard, e.Devices)
+}
+
+// clearState remove the onboarding certificates, devices and items of the collections of a DeviceManager
+func clearState(m DeviceManager) error {
+	if err := m.DeviceClear(); err != nil {
+		return fmt.Errorf("error clearing devices: %v", err)
+	}
+	if err := m.OnboardClear(); err != nil {
+		return fmt.Errorf("error clearing onboarding certificates: %v", err)
+	}
+	for _, c := range stateCollections {
+		records, err := m.ListRecords(c.kind)
+		if err != nil {
+			return fmt.Errorf("error listing %s: %v", c.kind, err)
+		}
+		for k := range records {
+			if err := m.RemoveRecord(c.kind, k); err != nil {
+				if _, isNotFound := err.(*common.NotFoundError); !isNotFound {
+					return fmt.Errorf("error removing %s of %s: %v", k, c.kind, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// eachLine call a function with each non-empty line of b, without its newline
+func eachLine(b []byte, f func([]byte) error) error {
+	r := bufio.NewReader(bytes.NewReader(b))
+	for {
+		line, err := r.ReadBytes('\n')
+		if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 {
+			if ferr := f(line); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/adam/pkg/driver/file"
+	"github.com/lf-edge/adam/pkg/driver/memory"
+	ax "github.com/lf-edge/adam/pkg/x509"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func stateCert(t *testing.T, cn string) *x509.Certificate {
+	certB, _, err := ax.Generate(cn, "")
+	if err != nil {
+		t.Fatalf("error generating cert for tests: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certB)
+	if err != nil {
+		t.Fatalf("unexpected error parsing certificate: %v", err)
+	}
+	return cert
+}
+
+// TestState a snapshot of the memory driver restored into the file driver
+func TestState(t *testing.T) {
+	src := &memory.DeviceManager{}
+	_, err := src.Init("", common.MaxSizes{})
+	assert.Equal(t, nil, err)
+	onboard := stateCert(t, "onboard")
+	assert.Equal(t, nil, src.OnboardRegister(onboard, []string{"lab-*"}))
+	assert.Equal(t, nil, src.OnboardPolicySet("onboard", &common.OnboardPolicy{}))
+	u, _ := uuid.NewV4()
+	cert := stateCert(t, u.String())
+	assert.Equal(t, nil, src.DeviceRegister(u, cert, onboard, "lab-1", common.CreateBaseConfig(u)))
+	assert.Equal(t, nil, src.SetDeviceMetadata(u, &common.DeviceMetadata{Name: "first", Tags: map[string]string{"site": "lab"}}))
+	assert.Equal(t, nil, src.SetDeviceModel(u, "x1"))
+	assert.Equal(t, nil, src.WriteLogs(u, []byte(`{"content":"a"}`)))
+	assert.Equal(t, nil, src.WriteLogs(u, []byte(`{"content":"b"}`)))
+	assert.Equal(t, nil, src.WriteAudit([]byte(`{"action":"device-add"}`)))
+	assert.Equal(t, nil, common.TokenAdd(src, &common.APIToken{ID: "t1", Hash: "abc"}))
+
+	var buf bytes.Buffer
+	manifest, err := driver.WriteState(src, &buf, true)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, manifest.Onboard)
+	assert.Equal(t, 1, manifest.Devices)
+	verified, err := driver.VerifyState(bytes.NewReader(buf.Bytes()))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, manifest.Files, verified.Files)
+
+	dir, err := ioutil.TempDir("", "adam-state-test")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dst := &file.DeviceManager{}
+	_, err = dst.Init(dir, common.MaxSizes{})
+	assert.Equal(t, nil, err)
+	_, err = driver.RestoreState(dst, bytes.NewReader(buf.Bytes()), false)
+	assert.Equal(t, nil, err)
+
+	gotCert, gotOnboard, serial, err := dst.DeviceGet(&u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, cert.Raw, gotCert.Raw)
+	assert.Equal(t, onboard.Raw, gotOnboard.Raw)
+	assert.Equal(t, "lab-1", serial)
+	_, serials, err := dst.OnboardGet("onboard")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"lab-*"}, serials)
+	md, err := dst.GetDeviceMetadata(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "lab", md.Tags["site"])
+	model, err := dst.GetDeviceModel(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "x1", model)
+	r, err := dst.GetLogsReader(u)
+	assert.Equal(t, nil, err)
+	logs, err := ioutil.ReadAll(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "{\"content\":\"a\"}\n{\"content\":\"b\"}\n", string(logs))
+	token, err := common.TokenGet(dst, "t1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "abc", token.Hash)
+
+	// not into a database with devices, unless replacing them
+	_, err = driver.RestoreState(dst, bytes.NewReader(buf.Bytes()), false)
+	_, ok := err.(*driver.StateNotEmptyError)
+	assert.True(t, ok, "expected the database not to be empty, got %v", err)
+	_, err = driver.RestoreState(dst, bytes.NewReader(buf.Bytes()), true)
+	assert.Equal(t, nil, err)
+	uids, err := dst.DeviceList()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(uids))
+}
+
+func TestVerifyState(t *testing.T) {
+	src := &memory.DeviceManager{}
+	src.Init("", common.MaxSizes{})
+	u, _ := uuid.NewV4()
+	assert.Equal(t, nil, src.DeviceRegister(u, stateCert(t, u.String()), nil, "", common.CreateBaseConfig(u)))
+	var buf bytes.Buffer
+	_, err := driver.WriteState(src, &buf, false)
+	assert.Equal(t, nil, err)
+
+	// rewrite the snapshot, changing or dropping a file
+	rewrite := func(change func(name string, b []byte) ([]byte, bool)) []byte {
+		gz, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+		assert.Equal(t, nil, err)
+		tr := tar.NewReader(gz)
+		var out bytes.Buffer
+		ogz := gzip.NewWriter(&out)
+		tw := tar.NewWriter(ogz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.Equal(t, nil, err)
+			b, _ := ioutil.ReadAll(tr)
+			b, keep := change(hdr.Name, b)
+			if !keep {
+				continue
+			}
+			hdr.Size = int64(len(b))
+			tw.WriteHeader(hdr)
+			tw.Write(b)
+		}
+		tw.Close()
+		ogz.Close()
+		return out.Bytes()
+	}
+	config := "device/" + u.String() + "/config.json"
+	tests := []struct {
+		name   string
+		change func(name string, b []byte) ([]byte, bool)
+	}{
+		{"changed file", func(name string, b []byte) ([]byte, bool) {
+			if name == config {
+				return append(b, ' '), true
+			}
+			return b, true
+		}},
+		{"missing file", func(name string, b []byte) ([]byte, bool) { return b, name != config }},
+		{"missing manifest", func(name string, b []byte) ([]byte, bool) { return b, name != "manifest.json" }},
+	}
+	for _, tt := range tests {
+		if _, err := driver.VerifyState(bytes.NewReader(rewrite(tt.change))); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if _, err := driver.VerifyState(bytes.NewReader([]byte("not a snapshot"))); err == nil {
+		t.Errorf("expected an error verifying garbage")
+	}
+}
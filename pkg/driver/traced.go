@@ -0,0 +1,467 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package driver
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/adam/pkg/driver/redis"
+	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName name of the tracer with the spans of DeviceManager operations and the backing store calls they make
+const TracerName = "github.com/lf-edge/adam/pkg/driver"
+
+// tracedManager a DeviceManager with a span for each of its operations, under the one of a request. Settings and
+// limits are passed through as they are
+type tracedManager struct {
+	DeviceManager
+	ctx context.Context
+}
+
+// Traced wrap a DeviceManager so that each of its operations is a span under the one in ctx
+func Traced(ctx context.Context, m DeviceManager) DeviceManager {
+	return &tracedManager{DeviceManager: m, ctx: ctx}
+}
+
+// start start the span for an operation, returning the DeviceManager to run it with
+func (t *tracedManager) start(op string, attrs ...attribute.KeyValue) (DeviceManager, trace.Span) {
+	attrs = append(attrs, attribute.String("adam.driver", t.DeviceManager.Name()))
+	ctx, span := otel.Tracer(TracerName).Start(t.ctx, "DeviceManager."+op, trace.WithAttributes(attrs...))
+	// redis calls are spans of their own, under that of the operation
+	if r, ok := t.DeviceManager.(*redis.DeviceManager); ok {
+		return r.WithContext(ctx), span
+	}
+	return t.DeviceManager, span
+}
+
+// end end the span of an operation, recording its error, if any
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func deviceAttr(u uuid.UUID) attribute.KeyValue {
+	return attribute.String("adam.device", u.String())
+}
+
+func certAttr(cert *x509.Certificate) attribute.KeyValue {
+	return attribute.String("adam.cert.cn", cert.Subject.CommonName)
+}
+
+func recordAttrs(kind, key string) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("adam.record.kind", kind), attribute.String("adam.record.key", key)}
+}
+
+func (t *tracedManager) OnboardCheck(cert *x509.Certificate, serial string) error {
+	m, span := t.start("OnboardCheck", certAttr(cert))
+	err := m.OnboardCheck(cert, serial)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) OnboardRemove(cn string) error {
+	m, span := t.start("OnboardRemove", attribute.String("adam.cert.cn", cn))
+	err := m.OnboardRemove(cn)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) OnboardClear() error {
+	m, span := t.start("OnboardClear")
+	err := m.OnboardClear()
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) OnboardGet(cn string) (*x509.Certificate, []string, error) {
+	m, span := t.start("OnboardGet", attribute.String("adam.cert.cn", cn))
+	cert, serials, err := m.OnboardGet(cn)
+	end(span, err)
+	return cert, serials, err
+}
+
+func (t *tracedManager) OnboardList() ([]string, error) {
+	m, span := t.start("OnboardList")
+	cns, err := m.OnboardList()
+	end(span, err)
+	return cns, err
+}
+
+func (t *tracedManager) OnboardRegister(cert *x509.Certificate, serials []string) error {
+	m, span := t.start("OnboardRegister", certAttr(cert))
+	err := m.OnboardRegister(cert, serials)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) OnboardPolicyGet(cn string) (*common.OnboardPolicy, error) {
+	m, span := t.start("OnboardPolicyGet", attribute.String("adam.cert.cn", cn))
+	p, err := m.OnboardPolicyGet(cn)
+	end(span, err)
+	return p, err
+}
+
+func (t *tracedManager) OnboardPolicySet(cn string, p *common.OnboardPolicy) error {
+	m, span := t.start("OnboardPolicySet", attribute.String("adam.cert.cn", cn))
+	err := m.OnboardPolicySet(cn, p)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) DeviceCheckCert(cert *x509.Certificate) (*uuid.UUID, error) {
+	m, span := t.start("DeviceCheckCert", certAttr(cert))
+	u, err := m.DeviceCheckCert(cert)
+	if u != nil {
+		span.SetAttributes(deviceAttr(*u))
+	}
+	end(span, err)
+	return u, err
+}
+
+func (t *tracedManager) DeviceRemove(u *uuid.UUID) error {
+	m, span := t.start("DeviceRemove", deviceAttr(*u))
+	err := m.DeviceRemove(u)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) DeviceClear() error {
+	m, span := t.start("DeviceClear")
+	err := m.DeviceClear()
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) DeviceGet(u *uuid.UUID) (*x509.Certificate, *x509.Certificate, string, error) {
+	m, span := t.start("DeviceGet", deviceAttr(*u))
+	cert, onboard, serial, err := m.DeviceGet(u)
+	end(span, err)
+	return cert, onboard, serial, err
+}
+
+func (t *tracedManager) DeviceList() ([]*uuid.UUID, error) {
+	m, span := t.start("DeviceList")
+	ids, err := m.DeviceList()
+	end(span, err)
+	return ids, err
+}
+
+func (t *tracedManager) DeviceRegister(u uuid.UUID, cert, onboard *x509.Certificate, serial string, conf []byte) error {
+	m, span := t.start("DeviceRegister", deviceAttr(u))
+	err := m.DeviceRegister(u, cert, onboard, serial, conf)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) DeviceReplaceCert(u uuid.UUID, cert *x509.Certificate) error {
+	m, span := t.start("DeviceReplaceCert", deviceAttr(u))
+	err := m.DeviceReplaceCert(u, cert)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) WriteInfo(u uuid.UUID, b []byte) error {
+	m, span := t.start("WriteInfo", deviceAttr(u))
+	err := m.WriteInfo(u, b)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) WriteLogs(u uuid.UUID, b []byte) error {
+	m, span := t.start("WriteLogs", deviceAttr(u))
+	err := m.WriteLogs(u, b)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) WriteAppInstanceLogs(instanceID uuid.UUID, deviceID uuid.UUID, b []byte) error {
+	m, span := t.start("WriteAppInstanceLogs", deviceAttr(deviceID), attribute.String("adam.app", instanceID.String()))
+	err := m.WriteAppInstanceLogs(instanceID, deviceID, b)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) WriteMetrics(u uuid.UUID, b []byte) error {
+	m, span := t.start("WriteMetrics", deviceAttr(u))
+	err := m.WriteMetrics(u, b)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) WriteRequest(u uuid.UUID, b []byte) error {
+	m, span := t.start("WriteRequest", deviceAttr(u))
+	err := m.WriteRequest(u, b)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetConfig(u uuid.UUID) ([]byte, error) {
+	m, span := t.start("GetConfig", deviceAttr(u))
+	b, err := m.GetConfig(u)
+	end(span, err)
+	return b, err
+}
+
+func (t *tracedManager) SetConfig(u uuid.UUID, b []byte) error {
+	m, span := t.start("SetConfig", deviceAttr(u))
+	err := m.SetConfig(u, b)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) SwapConfig(u uuid.UUID, old, b []byte) error {
+	m, span := t.start("SwapConfig", deviceAttr(u))
+	err := m.SwapConfig(u, old, b)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetLogsReader(u uuid.UUID) (io.Reader, error) {
+	m, span := t.start("GetLogsReader", deviceAttr(u))
+	r, err := m.GetLogsReader(u)
+	end(span, err)
+	return r, err
+}
+
+func (t *tracedManager) GetInfoReader(u uuid.UUID) (io.Reader, error) {
+	m, span := t.start("GetInfoReader", deviceAttr(u))
+	r, err := m.GetInfoReader(u)
+	end(span, err)
+	return r, err
+}
+
+func (t *tracedManager) GetMetricsReader(u uuid.UUID) (io.Reader, error) {
+	m, span := t.start("GetMetricsReader", deviceAttr(u))
+	r, err := m.GetMetricsReader(u)
+	end(span, err)
+	return r, err
+}
+
+func (t *tracedManager) GetRequestsReader(u uuid.UUID) (io.Reader, error) {
+	m, span := t.start("GetRequestsReader", deviceAttr(u))
+	r, err := m.GetRequestsReader(u)
+	end(span, err)
+	return r, err
+}
+
+func (t *tracedManager) WriteAudit(b []byte) error {
+	m, span := t.start("WriteAudit")
+	err := m.WriteAudit(b)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetAuditReader() (io.Reader, error) {
+	m, span := t.start("GetAuditReader")
+	r, err := m.GetAuditReader()
+	end(span, err)
+	return r, err
+}
+
+func (t *tracedManager) GetDeviceQuotas(u uuid.UUID) (*common.Quotas, error) {
+	m, span := t.start("GetDeviceQuotas", deviceAttr(u))
+	q, err := m.GetDeviceQuotas(u)
+	end(span, err)
+	return q, err
+}
+
+func (t *tracedManager) SetDeviceQuotas(u uuid.UUID, q *common.Quotas) error {
+	m, span := t.start("SetDeviceQuotas", deviceAttr(u))
+	err := m.SetDeviceQuotas(u, q)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetConfigAck(u uuid.UUID) (*common.ConfigAck, error) {
+	m, span := t.start("GetConfigAck", deviceAttr(u))
+	ack, err := m.GetConfigAck(u)
+	end(span, err)
+	return ack, err
+}
+
+func (t *tracedManager) SetConfigAck(u uuid.UUID, ack *common.ConfigAck) error {
+	m, span := t.start("SetConfigAck", deviceAttr(u))
+	err := m.SetConfigAck(u, ack)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetInventory(u uuid.UUID) (*common.Inventory, error) {
+	m, span := t.start("GetInventory", deviceAttr(u))
+	inv, err := m.GetInventory(u)
+	end(span, err)
+	return inv, err
+}
+
+func (t *tracedManager) SetInventory(u uuid.UUID, inv *common.Inventory) error {
+	m, span := t.start("SetInventory", deviceAttr(u))
+	err := m.SetInventory(u, inv)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetLogFilter(u uuid.UUID) (*common.LogFilter, error) {
+	m, span := t.start("GetLogFilter", deviceAttr(u))
+	f, err := m.GetLogFilter(u)
+	end(span, err)
+	return f, err
+}
+
+func (t *tracedManager) SetLogFilter(u uuid.UUID, f *common.LogFilter) error {
+	m, span := t.start("SetLogFilter", deviceAttr(u))
+	err := m.SetLogFilter(u, f)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetLocalProfile(u uuid.UUID) (*common.LocalProfile, error) {
+	m, span := t.start("GetLocalProfile", deviceAttr(u))
+	p, err := m.GetLocalProfile(u)
+	end(span, err)
+	return p, err
+}
+
+func (t *tracedManager) SetLocalProfile(u uuid.UUID, p *common.LocalProfile) error {
+	m, span := t.start("SetLocalProfile", deviceAttr(u))
+	err := m.SetLocalProfile(u, p)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetDeviceMetadata(u uuid.UUID) (*common.DeviceMetadata, error) {
+	m, span := t.start("GetDeviceMetadata", deviceAttr(u))
+	p, err := m.GetDeviceMetadata(u)
+	end(span, err)
+	return p, err
+}
+
+func (t *tracedManager) SetDeviceMetadata(u uuid.UUID, p *common.DeviceMetadata) error {
+	m, span := t.start("SetDeviceMetadata", deviceAttr(u))
+	err := m.SetDeviceMetadata(u, p)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetDeviceModel(u uuid.UUID) (string, error) {
+	m, span := t.start("GetDeviceModel", deviceAttr(u))
+	model, err := m.GetDeviceModel(u)
+	end(span, err)
+	return model, err
+}
+
+func (t *tracedManager) SetDeviceModel(u uuid.UUID, model string) error {
+	m, span := t.start("SetDeviceModel", deviceAttr(u), attribute.String("adam.hardware_model", model))
+	err := m.SetDeviceModel(u, model)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetAppCommands(u uuid.UUID) ([]common.AppCommand, error) {
+	m, span := t.start("GetAppCommands", deviceAttr(u))
+	commands, err := m.GetAppCommands(u)
+	end(span, err)
+	return commands, err
+}
+
+func (t *tracedManager) SetAppCommands(u uuid.UUID, commands []common.AppCommand) error {
+	m, span := t.start("SetAppCommands", deviceAttr(u))
+	err := m.SetAppCommands(u, commands)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetDeviceFlags(u uuid.UUID) (*common.DeviceFlags, error) {
+	m, span := t.start("GetDeviceFlags", deviceAttr(u))
+	flags, err := m.GetDeviceFlags(u)
+	end(span, err)
+	return flags, err
+}
+
+func (t *tracedManager) SetDeviceFlags(u uuid.UUID, flags *common.DeviceFlags) error {
+	m, span := t.start("SetDeviceFlags", deviceAttr(u))
+	err := m.SetDeviceFlags(u, flags)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetQuarantine(u uuid.UUID) (*common.Quarantine, error) {
+	m, span := t.start("GetQuarantine", deviceAttr(u))
+	q, err := m.GetQuarantine(u)
+	end(span, err)
+	return q, err
+}
+
+func (t *tracedManager) SetQuarantine(u uuid.UUID, q *common.Quarantine) error {
+	m, span := t.start("SetQuarantine", deviceAttr(u))
+	err := m.SetQuarantine(u, q)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetDeviceSources(u uuid.UUID) ([]common.DeviceSource, error) {
+	m, span := t.start("GetDeviceSources", deviceAttr(u))
+	sources, err := m.GetDeviceSources(u)
+	end(span, err)
+	return sources, err
+}
+
+func (t *tracedManager) SetDeviceSources(u uuid.UUID, sources []common.DeviceSource) error {
+	m, span := t.start("SetDeviceSources", deviceAttr(u))
+	err := m.SetDeviceSources(u, sources)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetAttestation(u uuid.UUID) (*common.Attestation, error) {
+	m, span := t.start("GetAttestation", deviceAttr(u))
+	a, err := m.GetAttestation(u)
+	end(span, err)
+	return a, err
+}
+
+func (t *tracedManager) SetAttestation(u uuid.UUID, a *common.Attestation) error {
+	m, span := t.start("SetAttestation", deviceAttr(u))
+	err := m.SetAttestation(u, a)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) PutRecord(kind, key string, b []byte) error {
+	m, span := t.start("PutRecord", recordAttrs(kind, key)...)
+	err := m.PutRecord(kind, key, b)
+	end(span, err)
+	return err
+}
+
+func (t *tracedManager) GetRecord(kind, key string) ([]byte, error) {
+	m, span := t.start("GetRecord", recordAttrs(kind, key)...)
+	b, err := m.GetRecord(kind, key)
+	end(span, err)
+	return b, err
+}
+
+func (t *tracedManager) ListRecords(kind string) (map[string][]byte, error) {
+	m, span := t.start("ListRecords", attribute.String("adam.record.kind", kind))
+	records, err := m.ListRecords(kind)
+	end(span, err)
+	return records, err
+}
+
+func (t *tracedManager) RemoveRecord(kind, key string) error {
+	m, span := t.start("RemoveRecord", recordAttrs(kind, key)...)
+	err := m.RemoveRecord(kind, key)
+	end(span, err)
+	return err
+}
@@ -0,0 +1,47 @@
+package driver_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/adam/pkg/driver/memory"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraced(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+
+	mgr := &memory.DeviceManager{}
+	_, err := mgr.Init("", common.MaxSizes{})
+	assert.Equal(t, nil, err)
+	// spans are made with the global tracer provider
+	otel.SetTracerProvider(tp)
+
+	m := driver.Traced(ctx, mgr)
+	assert.Equal(t, "memory", m.Name())
+	u, _ := uuid.NewV4()
+	_, err = m.GetConfig(u)
+	assert.NotEqual(t, nil, err)
+	_, err = m.DeviceList()
+	assert.Equal(t, nil, err)
+	parent.End()
+
+	spans := recorder.Ended()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, "DeviceManager.GetConfig", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "DeviceManager.DeviceList", spans[1].Name())
+	assert.Equal(t, codes.Unset, spans[1].Status().Code)
+	for _, s := range spans[:2] {
+		assert.Equal(t, parent.SpanContext().SpanID(), s.Parent().SpanID())
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package logging leveled, structured logs of the modules of adam, written as text or JSON lines, with the level of
+// each module adjustable while running
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level how severe a message is; a module logs the messages at its level or above
+type Level int
+
+// levels of messages, from the least severe
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// formats of the logs
+const (
+	// FormatText one line per message, as time, level, module, message and key=value fields
+	FormatText = "text"
+	// FormatJSON one JSON object per message, with time, level, module and msg keys and one key per field
+	FormatJSON = "json"
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// ParseLevel the level of a name: debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, must be one of debug, info, warn or error", s)
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return strconv.Itoa(int(l))
+}
+
+// MarshalText the name of the level, as in JSON
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText the level of a name, as in JSON
+func (l *Level) UnmarshalText(b []byte) error {
+	level, err := ParseLevel(string(b))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// config where and how messages are written, and the levels of modules
+type config struct {
+	lock   sync.RWMutex
+	out    io.Writer
+	format string
+	level  Level
+	levels map[string]Level
+	now    func() time.Time
+}
+
+var std = &config{
+	out:    os.Stderr,
+	format: FormatText,
+	level:  LevelInfo,
+	levels: map[string]Level{},
+	now:    time.Now,
+}
+
+// SetOutput where to write messages; os.Stderr unless set
+func SetOutput(w io.Writer) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	std.out = w
+}
+
+// SetFormat write messages as FormatText or FormatJSON
+func SetFormat(format string) error {
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("unknown log format %q, must be %s or %s", format, FormatText, FormatJSON)
+	}
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	std.format = format
+	return nil
+}
+
+// SetLevel the level of the modules without one of their own
+func SetLevel(level Level) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	std.level = level
+}
+
+// SetModuleLevel the level of a module, instead of that of all modules
+func SetModuleLevel(module string, level Level) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	std.levels[module] = level
+}
+
+// ResetModuleLevel have a module log at the level of all modules again
+func ResetModuleLevel(module string) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	delete(std.levels, module)
+}
+
+// Levels the level of all modules, and that of the modules with their own
+func Levels() (Level, map[string]Level) {
+	std.lock.RLock()
+	defer std.lock.RUnlock()
+	levels := make(map[string]Level, len(std.levels))
+	for module, level := range std.levels {
+		levels[module] = level
+	}
+	return std.level, levels
+}
+
+// ParseModuleLevel parse a level of a module from <module>=<level>
+func ParseModuleLevel(s string) (string, Level, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", LevelInfo, fmt.Errorf("bad module level %q, must be <module>=<level>", s)
+	}
+	level, err := ParseLevel(parts[1])
+	return parts[0], level, err
+}
+
+// Logger writes the messages of a module, with the fields it was given
+type Logger struct {
+	module string
+	fields []field
+}
+
+// field a key and value of a message
+type field struct {
+	key   string
+	value interface{}
+}
+
+// New a logger for a module, e.g. the name of a package
+func New(module string) *Logger {
+	return &Logger{module: module}
+}
+
+// With a logger adding fields to each message, as key and value pairs
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+len(kv)/2+1)
+	copy(fields, l.fields)
+	return &Logger{module: l.module, fields: appendFields(fields, kv)}
+}
+
+// Enabled whether the module of the logger writes messages of a level
+func (l *Logger) Enabled(level Level) bool {
+	std.lock.RLock()
+	defer std.lock.RUnlock()
+	return std.enabled(l.module, level)
+}
+
+// Log write a message of a level, with fields as key and value pairs, if the module logs that level
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	if !std.enabled(l.module, level) {
+		return
+	}
+	fields := appendFields(append([]field{}, l.fields...), kv)
+	std.out.Write(std.encode(level, l.module, msg, fields))
+}
+
+// Always write a message of a level whatever the level of the module, for those asked for one by one, e.g. of a
+// device being debugged
+func (l *Logger) Always(level Level, msg string, kv ...interface{}) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	fields := appendFields(append([]field{}, l.fields...), kv)
+	std.out.Write(std.encode(level, l.module, msg, fields))
+}
+
+// Debugf log a formatted message at LevelDebug
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args)
+}
+
+// Infof log a formatted message at LevelInfo
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args)
+}
+
+// Warnf log a formatted message at LevelWarn
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args)
+}
+
+// Errorf log a formatted message at LevelError
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args)
+}
+
+func (l *Logger) logf(level Level, format string, args []interface{}) {
+	// formatting costs, skip it for the messages not written
+	if !l.Enabled(level) {
+		return
+	}
+	l.Log(level, fmt.Sprintf(format, args...))
+}
+
+// appendFields add key and value pairs to fields; a key without value gets an empty one
+func appendFields(fields []field, kv []interface{}) []field {
+	for i := 0; i < len(kv); i += 2 {
+		f := field{key: fmt.Sprint(kv[i])}
+		if i+1 < len(kv) {
+			f.value = kv[i+1]
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// enabled whether a module writes messages of a level; the lock is to be held
+func (c *config) enabled(module string, level Level) bool {
+	min, ok := c.levels[module]
+	if !ok {
+		min = c.level
+	}
+	return level >= min
+}
+
+// encode a message as a line in the format; the lock is to be held
+func (c *config) encode(level Level, module, msg string, fields []field) []byte {
+	ts := c.now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	msg = strings.TrimRight(msg, "\n")
+	if c.format == FormatJSON {
+		keys := []string{"time", "level", "module", "msg"}
+		values := map[string]interface{}{"time": ts, "level": level.String(), "module": module, "msg": msg}
+		for _, f := range fields {
+			if _, ok := values[f.key]; !ok {
+				keys = append(keys, f.key)
+			}
+			values[f.key] = jsonValue(f.value)
+		}
+		var b strings.Builder
+		b.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			kb, _ := json.Marshal(k)
+			vb, err := json.Marshal(values[k])
+			if err != nil {
+				vb, _ = json.Marshal(fmt.Sprint(values[k]))
+			}
+			b.Write(kb)
+			b.WriteByte(':')
+			b.Write(vb)
+		}
+		b.WriteString("}\n")
+		return []byte(b.String())
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s: %s", ts, strings.ToUpper(level.String()), module, msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%s", f.key, textValue(f.value))
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// jsonValue a value as it is to be encoded in JSON: errors and Stringers as their text
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
+
+// textValue a value as text, quoted if it has spaces, quotes or equal signs
+func textValue(v interface{}) string {
+	s := fmt.Sprint(jsonValue(v))
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// sortedModules the modules of levels, sorted
+func sortedModules(levels map[string]Level) []string {
+	modules := make([]string, 0, len(levels))
+	for module := range levels {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+	return modules
+}
+
+// FormatLevels the level of all modules and those of modules with their own, as
+// <level>[,<module>=<level>...]
+func FormatLevels(level Level, levels map[string]Level) string {
+	parts := []string{level.String()}
+	for _, module := range sortedModules(levels) {
+		parts = append(parts, module+"="+levels[module].String())
+	}
+	return strings.Join(parts, ",")
+}
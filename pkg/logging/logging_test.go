@@ -0,0 +1,154 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capture write the messages to a buffer, in a format, for the duration of a test
+func capture(t *testing.T, format string) *bytes.Buffer {
+	var buf bytes.Buffer
+	out, f, level, levels, now := std.out, std.format, std.level, std.levels, std.now
+	std.out, std.format, std.level, std.levels = &buf, format, LevelInfo, map[string]Level{}
+	std.now = func() time.Time { return time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC) }
+	t.Cleanup(func() {
+		std.out, std.format, std.level, std.levels, std.now = out, f, level, levels, now
+	})
+	return &buf
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name   string
+		expect Level
+		err    bool
+	}{
+		{"debug", LevelDebug, false},
+		{"INFO", LevelInfo, false},
+		{"warn", LevelWarn, false},
+		{"warning", LevelWarn, false},
+		{"error", LevelError, false},
+		{"verbose", LevelInfo, true},
+	}
+	for _, tt := range tests {
+		level, err := ParseLevel(tt.name)
+		if (err != nil) != tt.err || level != tt.expect {
+			t.Errorf("%s: expected %v (error %v), got %v (%v)", tt.name, tt.expect, tt.err, level, err)
+		}
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	buf := capture(t, FormatText)
+	server, driver := New("server"), New("redis")
+	SetModuleLevel("redis", LevelWarn)
+	tests := []struct {
+		logger  *Logger
+		level   Level
+		written bool
+	}{
+		{server, LevelDebug, false},
+		{server, LevelInfo, true},
+		{driver, LevelInfo, false},
+		{driver, LevelWarn, true},
+		{driver, LevelError, true},
+	}
+	for i, tt := range tests {
+		buf.Reset()
+		tt.logger.Log(tt.level, "message")
+		if written := buf.Len() > 0; written != tt.written {
+			t.Errorf("%d: expected written %v for %s at %s, got %q", i, tt.written, tt.logger.module, tt.level, buf.String())
+		}
+	}
+	ResetModuleLevel("redis")
+	buf.Reset()
+	driver.Infof("again")
+	if buf.Len() == 0 {
+		t.Errorf("expected message once the level of the module is reset")
+	}
+}
+
+func TestLoggerAlways(t *testing.T) {
+	buf := capture(t, FormatText)
+	SetModuleLevel("http", LevelError)
+	defer ResetModuleLevel("http")
+	New("http").Always(LevelDebug, "request")
+	if !strings.Contains(buf.String(), "DEBUG http: request") {
+		t.Errorf("expected the message whatever the level of the module, got %q", buf.String())
+	}
+}
+
+func TestLoggerFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		expect string
+	}{
+		{FormatText, `2021-05-01T10:00:00.000Z INFO  server: request done device=abc latency=1.5ms path="/a b"` + "\n"},
+		{FormatJSON, `{"time":"2021-05-01T10:00:00.000Z","level":"info","module":"server","msg":"request done","device":"abc","latency":"1.5ms","path":"/a b"}` + "\n"},
+	}
+	for _, tt := range tests {
+		buf := capture(t, tt.format)
+		New("server").With("device", "abc").Log(LevelInfo, "request done", "latency", 1500*time.Microsecond, "path", "/a b")
+		if buf.String() != tt.expect {
+			t.Errorf("%s: expected %s, got %s", tt.format, tt.expect, buf.String())
+		}
+	}
+}
+
+func TestRedirectStd(t *testing.T) {
+	buf := capture(t, FormatJSON)
+	flags, prefix, out := log.Flags(), log.Prefix(), log.Writer()
+	defer func() {
+		log.SetFlags(flags)
+		log.SetPrefix(prefix)
+		log.SetOutput(out)
+	}()
+	RedirectStd()
+	tests := []struct {
+		msg    string
+		expect Level
+	}{
+		{"starting", LevelInfo},
+		{"error saving config: boom", LevelError},
+		{"unable to reach device", LevelError},
+		{"warning: cache disabled", LevelWarn},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		log.Printf("%s", tt.msg)
+		var m map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+			t.Fatalf("%s: bad JSON %q: %v", tt.msg, buf.String(), err)
+		}
+		if m["level"] != tt.expect.String() || m["module"] != "logging" || m["msg"] != tt.msg {
+			t.Errorf("%s: mismatched message %v", tt.msg, m)
+		}
+	}
+}
+
+func TestFuncPackage(t *testing.T) {
+	tests := []struct {
+		name   string
+		expect string
+	}{
+		{"github.com/lf-edge/adam/pkg/server.(*apiHandler).info", "github.com/lf-edge/adam/pkg/server"},
+		{"github.com/lf-edge/adam/pkg/driver/redis.DeviceManager.GetConfig", "github.com/lf-edge/adam/pkg/driver/redis"},
+		{"log.Printf", "log"},
+		{"main.main", "main"},
+	}
+	for _, tt := range tests {
+		if p := funcPackage(tt.name); p != tt.expect {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expect, p)
+		}
+	}
+	if s := FormatLevels(LevelInfo, map[string]Level{"redis": LevelWarn, "http": LevelDebug}); !strings.HasPrefix(s, "info,http=debug") {
+		t.Errorf("mismatched levels %s", s)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package logging
+
+import (
+	"log"
+	"runtime"
+	"strings"
+)
+
+// errorPrefixes how the messages of the log package that report errors start
+var errorPrefixes = []string{"error", "unable", "failed", "cannot", "could not", "invalid"}
+
+// stdWriter writes the messages of the log package as those of the module of the package calling it
+type stdWriter struct{}
+
+// RedirectStd write the messages of the log package through the loggers, each as a message of the module of the
+// package it comes from, e.g. server for pkg/server, at LevelError if it reports an error, LevelWarn for a warning
+// and LevelInfo otherwise
+func RedirectStd() {
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(stdWriter{})
+}
+
+func (stdWriter) Write(b []byte) (int, error) {
+	// the startup summary indents its lines with tabs
+	msg := strings.TrimSpace(string(b))
+	New(callerModule()).Log(stdLevel(msg), msg)
+	return len(b), nil
+}
+
+// stdLevel the level of a message of the log package, from how it starts
+func stdLevel(msg string) Level {
+	lower := strings.ToLower(msg)
+	for _, prefix := range errorPrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return LevelError
+		}
+	}
+	if strings.HasPrefix(lower, "warn") {
+		return LevelWarn
+	}
+	return LevelInfo
+}
+
+// callerModule the module of the first caller outside of the log package: the last element of the path of its
+// package
+func callerModule() string {
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		pkg := funcPackage(frame.Function)
+		if pkg != "log" && !strings.HasPrefix(pkg, "log/") && pkg != "" {
+			return pkg[strings.LastIndex(pkg, "/")+1:]
+		}
+		if !more {
+			return "adam"
+		}
+	}
+}
+
+// funcPackage the path of the package of a function named as by runtime.Frame, e.g. github.com/lf-edge/adam/pkg/server
+// for github.com/lf-edge/adam/pkg/server.(*apiHandler).info
+func funcPackage(name string) string {
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return name
+	}
+	return name[:slash+1+dot]
+}
@@ -0,0 +1,383 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	ax "github.com/lf-edge/adam/pkg/x509"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// ACMEHTTP01 challenge answered over plain HTTP, on port 80 of each domain
+	ACMEHTTP01 = "http-01"
+	// ACMEDNS01 challenge answered with a TXT record of each domain, published by a hook
+	ACMEDNS01 = "dns-01"
+	// DefaultACMERenewBefore how long before it expires the certificate is renewed, by default
+	DefaultACMERenewBefore = 30 * 24 * time.Hour
+	// DefaultACMEHTTPAddress address listened on for http-01 challenges, by default
+	DefaultACMEHTTPAddress = ":80"
+
+	// names of the ACME data kept in the device manager
+	acmeAccountName = "account"
+	acmeCertName    = "cert"
+	// how often to check whether the certificate is due for renewal, or was renewed by another replica
+	acmeCheckInterval = 12 * time.Hour
+	// how long obtaining a certificate can take, challenges included
+	acmeTimeout = 10 * time.Minute
+)
+
+// ACME obtains the server certificate from an ACME CA, e.g. Let's Encrypt, and renews it before it expires. The
+// account key and the certificate, with its key, are kept in the device manager, so that they survive restarts and
+// are shared by replicas
+type ACME struct {
+	// Domains names the certificate is for, the first being its common name
+	Domains []string
+	// Email contact of the ACME account; empty means none
+	Email string
+	// DirectoryURL directory of the ACME CA; empty means Let's Encrypt
+	DirectoryURL string
+	// Challenge how control of the domains is proven, ACMEHTTP01 or ACMEDNS01
+	Challenge string
+	// HTTPAddress address to listen on for http-01 challenges while obtaining a certificate; empty means
+	// DefaultACMEHTTPAddress
+	HTTPAddress string
+	// DNSHook command run to publish the TXT record of dns-01 challenges, with the arguments present, the name of the
+	// record and its value, then to remove it, with cleanup instead of present
+	DNSHook string
+	// RenewBefore how long before it expires the certificate is renewed; 0 means DefaultACMERenewBefore
+	RenewBefore time.Duration
+	// Manager where the account key and the certificate are kept
+	Manager driver.DeviceManager
+
+	// serializes obtaining certificates
+	mu sync.Mutex
+	// http-01 responses, by token, while obtaining a certificate
+	tokens sync.Map
+}
+
+// Validate check the settings, before any certificate is obtained
+func (a *ACME) Validate() error {
+	if len(a.Domains) == 0 {
+		return errors.New("at least one domain is required")
+	}
+	switch a.Challenge {
+	case ACMEHTTP01:
+	case ACMEDNS01:
+		if a.DNSHook == "" {
+			return errors.New("the dns-01 challenge requires a DNS hook")
+		}
+	default:
+		return fmt.Errorf("unknown challenge %s, must be %s or %s", a.Challenge, ACMEHTTP01, ACMEDNS01)
+	}
+	return nil
+}
+
+// Certificate get the certificate kept in the device manager, obtaining a new one if there is none, it is due for
+// renewal or it does not cover the domains
+func (a *ACME) Certificate() (tls.Certificate, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cert, err := a.stored()
+	if err == nil && !a.due(cert, time.Now()) {
+		return cert, nil
+	}
+	if err != nil {
+		if _, ok := err.(*common.NotFoundError); !ok {
+			log.Printf("obtaining a new certificate, unable to use the one stored: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+	return a.obtain(ctx)
+}
+
+// run check the certificate every acmeCheckInterval, renewing it when due, and serve it once it changes, whether
+// renewed here or by another replica, until done is closed
+func (a *ACME) run(certs *certStore, done <-chan struct{}) {
+	ticker := time.NewTicker(acmeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.reload(certs)
+		case <-done:
+			return
+		}
+	}
+}
+
+// reload get the certificate, renewing it when due, and serve it if it changed. The current one is kept on errors
+func (a *ACME) reload(certs *certStore) {
+	cert, err := a.Certificate()
+	if err != nil {
+		log.Printf("keeping the current server certificate, unable to renew it: %v", err)
+		return
+	}
+	if current := certs.certificates(); len(current) > 0 && bytes.Equal(current[0].Raw, cert.Certificate[0]) {
+		return
+	}
+	if err := certs.set(cert); err != nil {
+		log.Printf("keeping the current server certificate: %v", err)
+		return
+	}
+	leaf := certs.certificates()[0]
+	log.Printf("renewed server certificate %s, valid until %s", leaf.Subject.CommonName, leaf.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// stored get the certificate kept in the device manager
+func (a *ACME) stored() (tls.Certificate, error) {
+	b, err := common.ACMEGet(a.Manager, acmeCertName)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	// the chain and its key are kept together
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return cert, fmt.Errorf("invalid stored certificate: %v", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return cert, fmt.Errorf("invalid stored certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// due whether a certificate is to be replaced at a time, as it expires within RenewBefore or does not cover all
+// the domains
+func (a *ACME) due(cert tls.Certificate, now time.Time) bool {
+	renewBefore := a.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = DefaultACMERenewBefore
+	}
+	if now.Add(renewBefore).After(cert.Leaf.NotAfter) {
+		return true
+	}
+	for _, d := range a.Domains {
+		if err := cert.Leaf.VerifyHostname(d); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// obtain order a certificate for the domains, answer its challenges and keep it in the device manager
+func (a *ACME) obtain(ctx context.Context) (tls.Certificate, error) {
+	var cert tls.Certificate
+	client, err := a.client(ctx)
+	if err != nil {
+		return cert, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(a.Domains...))
+	if err != nil {
+		return cert, fmt.Errorf("unable to order a certificate for %s: %v", strings.Join(a.Domains, ","), err)
+	}
+	if a.Challenge == ACMEHTTP01 {
+		stop, err := a.serveHTTP01()
+		if err != nil {
+			return cert, err
+		}
+		defer stop()
+	}
+	for _, u := range order.AuthzURLs {
+		if err := a.authorize(ctx, client, u); err != nil {
+			return cert, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return cert, fmt.Errorf("order of a certificate for %s failed: %v", strings.Join(a.Domains, ","), err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return cert, fmt.Errorf("unable to generate certificate key: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: a.Domains[0]},
+		DNSNames: a.Domains,
+	}, key)
+	if err != nil {
+		return cert, fmt.Errorf("unable to create certificate request: %v", err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return cert, fmt.Errorf("unable to get certificate for %s: %v", strings.Join(a.Domains, ","), err)
+	}
+
+	var b []byte
+	for _, der := range chain {
+		b = append(b, ax.PemEncodeCert(der)...)
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return cert, err
+	}
+	b = append(b, keyPEM...)
+	if err := common.ACMESet(a.Manager, acmeCertName, b); err != nil {
+		return cert, fmt.Errorf("unable to save certificate: %v", err)
+	}
+	cert, err = tls.X509KeyPair(b, b)
+	if err != nil {
+		return cert, fmt.Errorf("invalid certificate obtained: %v", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
+
+// client get an ACME client with the account kept in the device manager, creating and registering the account the
+// first time
+func (a *ACME) client(ctx context.Context) (*acme.Client, error) {
+	var key crypto.Signer
+	b, err := common.ACMEGet(a.Manager, acmeAccountName)
+	switch err.(type) {
+	case nil:
+		if key, err = ax.ParseKey(b); err != nil {
+			return nil, fmt.Errorf("invalid stored ACME account key: %v", err)
+		}
+	case *common.NotFoundError:
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate ACME account key: %v", err)
+		}
+		if b, err = encodeECKey(ecKey); err != nil {
+			return nil, err
+		}
+		if err := common.ACMESet(a.Manager, acmeAccountName, b); err != nil {
+			return nil, fmt.Errorf("unable to save ACME account key: %v", err)
+		}
+		key = ecKey
+	default:
+		return nil, fmt.Errorf("unable to read ACME account key: %v", err)
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: a.DirectoryURL}
+	account := &acme.Account{}
+	if a.Email != "" {
+		account.Contact = []string{"mailto:" + a.Email}
+	}
+	// registering is idempotent, the account of a key is found again
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("unable to register ACME account: %v", err)
+	}
+	return client, nil
+}
+
+// authorize answer the challenge of an authorization of the order, unless it is valid already
+func (a *ACME) authorize(ctx context.Context, client *acme.Client, u string) error {
+	authz, err := client.GetAuthorization(ctx, u)
+	if err != nil {
+		return fmt.Errorf("unable to get authorization %s: %v", u, err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == a.Challenge {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no %s challenge offered for %s", a.Challenge, authz.Identifier.Value)
+	}
+
+	switch a.Challenge {
+	case ACMEHTTP01:
+		response, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return fmt.Errorf("unable to answer challenge for %s: %v", authz.Identifier.Value, err)
+		}
+		a.tokens.Store(chal.Token, response)
+		defer a.tokens.Delete(chal.Token)
+	case ACMEDNS01:
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return fmt.Errorf("unable to answer challenge for %s: %v", authz.Identifier.Value, err)
+		}
+		// wildcards are validated with the record of the domain they are under
+		name := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+		if err := a.runDNSHook(ctx, "present", name, value); err != nil {
+			return err
+		}
+		defer func() {
+			if err := a.runDNSHook(ctx, "cleanup", name, value); err != nil {
+				log.Printf("unable to remove challenge record: %v", err)
+			}
+		}()
+	}
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("unable to accept challenge for %s: %v", authz.Identifier.Value, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization for %s failed: %v", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// serveHTTP01 listen on HTTPAddress for http-01 challenges, until the returned function is called
+func (a *ACME) serveHTTP01() (func(), error) {
+	addr := a.HTTPAddress
+	if addr == "" {
+		addr = DefaultACMEHTTPAddress
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s for http-01 challenges: %v", addr, err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(a.answerHTTP01)}
+	go srv.Serve(l)
+	return func() { srv.Close() }, nil
+}
+
+// answerHTTP01 answer the request of the CA for the response to an http-01 challenge
+func (a *ACME) answerHTTP01(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+	response, ok := a.tokens.Load(token)
+	if !ok || token == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response.(string)))
+}
+
+// runDNSHook run the DNS hook to present or clean up the TXT record of a dns-01 challenge
+func (a *ACME) runDNSHook(ctx context.Context, action, name, value string) error {
+	out, err := exec.CommandContext(ctx, a.DNSHook, action, name, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("dns hook %s %s %s failed: %v: %s", a.DNSHook, action, name, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// encodeECKey PEM encode an EC private key
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
@@ -4,15 +4,20 @@
 package server
 
 import (
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lf-edge/adam/pkg/driver"
@@ -32,7 +37,67 @@ type adminHandler struct {
 	manager         driver.DeviceManager
 	logChannel      chan []byte
 	infoChannel     chan []byte
+	metricsChannel  chan []byte
 	requestsChannel chan []byte
+	// quotas global quotas, that the device ones override
+	quotas common.Quotas
+	// done closed when the server shuts down, to end streams
+	done <-chan struct{}
+	// requireAuth whether requests need an API token or a client certificate signed by one of adminCAs
+	requireAuth bool
+	// adminCAs CAs whose client certificates have full access, nil if there are none
+	adminCAs *x509.CertPool
+	// policy the access policy limiting the identities it has rules for, nil if there is none
+	policy *policyStore
+	// rolloutLock serializes changes to rollouts, between requests and advancing them in the background
+	rolloutLock sync.Mutex
+	// scheduleLock serializes changes to scheduled changes, between requests and applying them in the background
+	scheduleLock sync.Mutex
+	// alerts the alerter whose rules change, and whose firing alerts are listed
+	alerts *alerter
+	// retention how long devices deleted softly are kept, unless a request sets it
+	retention time.Duration
+	// filters the log filters, whose global one the device ones override, and their counts of dropped entries
+	filters *logFilters
+	// loki the exporter of logs to Loki, for its counts, nil if there is none
+	loki *lokiExporter
+	// syslog the exporter of logs to a syslog server, for its counts, nil if there is none
+	syslog *syslogExporter
+	// metricsExport the exporter of metrics as time series, for its counts, nil if there is none
+	metricsExport *metricsExporter
+	// stats the counters of the requests of devices, per endpoint and per device
+	stats *ingestStats
+	// devices the handler of the device API, to replay dead letters to
+	devices http.Handler
+	// replays the replays of the stored messages of devices to sinks
+	replays *replayer
+	// commands the commands to the app instances of devices
+	commands *appCommander
+	// shedder the budgets of the endpoints of the device API, for its counts, nil if there are none
+	shedder *shedder
+	// backpressure slows devices down through their config while ingest is overloaded, nil if it does not
+	backpressure *backpressure
+	// faults the faults injected into the requests of devices, nil unless fault injection is enabled
+	faults *faultInjector
+	// quiesce holds the requests changing state while a state snapshot is taken or restored
+	quiesce *quiescer
+	// openapi the OpenAPI document of the routes of the admin API, as JSON
+	openapi []byte
+	// issuer the DeviceCA, to sign the CRL of the revoked certificates it issued with, nil if there is none
+	issuer *deviceIssuer
+	// deviceCAs the CA bundles trusted for the certificates of devices, for the metrics of their use, nil if none
+	deviceCAs *deviceCAs
+	// federation the link of this secondary to its primary, for its status, nil if it has none
+	federation *federation
+	// baseConfig the base config template devices start with, nil for the minimal one, see initialConfig
+	baseConfig []byte
+	// opsLock serializes reboots and EVE updates, between checking their confirmation token and changing the config
+	opsLock sync.Mutex
+	// requireIfMatch whether setting a config needs an If-Match with its ETag
+	requireIfMatch bool
+	// limits the device limits and telemetry quotas of the policies of onboarding certificates, shared with the
+	// device API
+	limits *onboardLimits
 }
 
 // OnboardCert encoding for sending an onboard cert and serials via json
@@ -55,37 +120,59 @@ type DeviceCert struct {
 	Cert    []byte
 	Onboard []byte
 	Serial  string
+	// Deleted the tombstone of the device, if it was deleted softly
+	Deleted *common.Tombstone `json:",omitempty"`
+	// Metadata the name, site, owner and tags of the device, if any are recorded
+	Metadata *common.DeviceMetadata `json:",omitempty"`
+	// Quarantine the quarantine of the device, with its reason, if it is quarantined
+	Quarantine *common.Quarantine `json:",omitempty"`
+	// Sources where the requests of the device came from, the most recently seen first
+	Sources []common.DeviceSource `json:",omitempty"`
 }
 
 func (h *adminHandler) onboardAdd(w http.ResponseWriter, r *http.Request) {
 	// extract certificate and serials from request body
 	contentType := r.Header.Get(contentType)
 	if contentType != mimeJSON {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
 	decoder := json.NewDecoder(r.Body)
 	var t OnboardCert
 	err := decoder.Decode(&t)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
 
 	serials := strings.Split(t.Serial, ",")
+	for _, serial := range serials {
+		if err := common.ValidateSerialPattern(serial); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 	cert, err := ax.ParseCert(t.Cert)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
 	}
-	err = h.manager.OnboardRegister(cert, serials)
+	cn := common.GetOnboardCertName(cert.Subject.CommonName)
+	var before interface{}
+	if _, existing, err := h.managerFor(r).OnboardGet(cn); err == nil {
+		before = map[string]interface{}{"serials": existing}
+	}
+	err = h.managerFor(r).OnboardRegister(cert, serials)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
+	h.audit(r, auditOnboardAdd, cn, before, map[string]interface{}{"serials": serials})
 	w.WriteHeader(http.StatusCreated)
 }
 
 func (h *adminHandler) onboardList(w http.ResponseWriter, r *http.Request) {
-	cns, err := h.manager.OnboardList()
+	cns, err := h.managerFor(r).OnboardList()
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
 	w.WriteHeader(http.StatusOK)
 	body := strings.Join(cns, "\n")
@@ -95,13 +182,13 @@ func (h *adminHandler) onboardList(w http.ResponseWriter, r *http.Request) {
 
 func (h *adminHandler) onboardGet(w http.ResponseWriter, r *http.Request) {
 	cn := mux.Vars(r)["cn"]
-	cert, serials, err := h.manager.OnboardGet(cn)
+	cert, serials, err := h.managerFor(r).OnboardGet(cn)
 	_, isNotFound := err.(*common.NotFoundError)
 	switch {
 	case err != nil && isNotFound:
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	case err != nil:
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	default:
 		w.WriteHeader(http.StatusOK)
 		body, err := json.Marshal(OnboardCert{
@@ -109,7 +196,7 @@ func (h *adminHandler) onboardGet(w http.ResponseWriter, r *http.Request) {
 			Serial: strings.Join(serials, ","),
 		})
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
 		w.Write([]byte(body))
 	}
@@ -117,30 +204,38 @@ func (h *adminHandler) onboardGet(w http.ResponseWriter, r *http.Request) {
 
 func (h *adminHandler) onboardRemove(w http.ResponseWriter, r *http.Request) {
 	cn := mux.Vars(r)["cn"]
-	err := h.manager.OnboardRemove(cn)
+	var before interface{}
+	if _, serials, err := h.managerFor(r).OnboardGet(cn); err == nil {
+		before = map[string]interface{}{"serials": serials}
+	}
+	err := h.managerFor(r).OnboardRemove(cn)
 	_, isNotFound := err.(*common.NotFoundError)
 	switch {
 	case err != nil && isNotFound:
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	case err != nil:
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	default:
+		h.audit(r, auditOnboardRemove, cn, before, nil)
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
 func (h *adminHandler) onboardClear(w http.ResponseWriter, r *http.Request) {
-	err := h.manager.OnboardClear()
+	cns, _ := h.managerFor(r).OnboardList()
+	err := h.managerFor(r).OnboardClear()
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
+	h.audit(r, auditOnboardClear, "", map[string]interface{}{"onboard": cns}, nil)
 }
 
 func (h *adminHandler) deviceAdd(w http.ResponseWriter, r *http.Request) {
 	// extract certificate and serials from request body
 	contentType := r.Header.Get(contentType)
 	if contentType != mimeTextPlain {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -151,66 +246,137 @@ func (h *adminHandler) deviceAdd(w http.ResponseWriter, r *http.Request) {
 	)
 	err := decoder.Decode(&t)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
 
 	cert, err = ax.ParseCert(t.Cert)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("bad device cert: %v", err), http.StatusBadRequest)
+		httpError(w, fmt.Sprintf("bad device cert: %v", err), http.StatusBadRequest)
 	}
 	if t.Onboard != nil && len(t.Onboard) > 0 {
 		onboard, err = ax.ParseCert(t.Onboard)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("bad onboard cert: %v", err), http.StatusBadRequest)
+			httpError(w, fmt.Sprintf("bad onboard cert: %v", err), http.StatusBadRequest)
 		}
 	}
 	// generate a new uuid
 	unew, err := uuid.NewV4()
 	if err != nil {
 		log.Printf("error generating a new device UUID: %v", err)
-		http.Error(w, fmt.Sprintf("error generating a new device UUID: %v", err), http.StatusBadRequest)
+		httpError(w, fmt.Sprintf("error generating a new device UUID: %v", err), http.StatusBadRequest)
 		return
 	}
-	if err := h.manager.DeviceRegister(unew, cert, onboard, t.Serial, common.CreateBaseConfig(unew)); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if err := h.managerFor(r).DeviceRegister(unew, cert, onboard, t.Serial, initialConfig(h.managerFor(r), unew, onboard, h.baseConfig)); err != nil {
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
+	h.audit(r, auditDeviceAdd, unew.String(), nil, deviceSummary(cert, onboard, t.Serial))
 	w.WriteHeader(http.StatusCreated)
 }
 
 func (h *adminHandler) deviceList(w http.ResponseWriter, r *http.Request) {
-	uids, err := h.manager.DeviceList()
+	uids, err := h.managerFor(r).DeviceList()
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
-	// convert the UUIDs
+	// with deleted=true, only the devices deleted softly are listed
+	var deleted map[string]bool
+	if d, _ := strconv.ParseBool(r.URL.Query().Get("deleted")); d {
+		tombstones, err := common.TombstoneList(h.managerFor(r))
+		if err != nil {
+			log.Printf("error listing tombstones: %v", err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		deleted = map[string]bool{}
+		for _, ts := range tombstones {
+			deleted[ts.UUID] = true
+		}
+	}
+	// with quarantined=true, only the devices quarantined are listed
+	quarantined, _ := strconv.ParseBool(r.URL.Query().Get("quarantined"))
+	// with format=json, the devices are listed with their metadata, which has their identity
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" {
+		httpError(w, fmt.Sprintf("unknown format %q, must be json", format), http.StatusBadRequest)
+		return
+	}
+	// convert the UUIDs, keeping only those the API token and the access policy, if any, allow, and whose metadata
+	// matches the tags asked for, if any
+	tags := r.URL.Query()["tag"]
 	ids := make([]string, 0, len(uids))
 	for _, i := range uids {
-		if i != nil {
+		if i != nil && h.allowsDevice(r, *i) && (deleted == nil || deleted[i.String()]) && h.matchTags(r, *i, tags) && (!quarantined || h.isQuarantined(r, *i)) {
 			ids = append(ids, i.String())
 		}
 	}
+	if format == "json" {
+		h.writeDeviceList(w, r, ids)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	body := strings.Join(ids, "\n")
 	w.Header().Add(contentType, mimeTextPlain)
 	w.Write([]byte(body))
 }
 
+// DeviceListEntry a device as listed with format=json, with its metadata if any is recorded
+type DeviceListEntry struct {
+	UUID     string                 `json:"uuid"`
+	Metadata *common.DeviceMetadata `json:"metadata,omitempty"`
+}
+
+// writeDeviceList answer the devices listed with their metadata, sorted by UUID. A device whose metadata cannot be
+// read is listed without it
+func (h *adminHandler) writeDeviceList(w http.ResponseWriter, r *http.Request, ids []string) {
+	sort.Strings(ids)
+	entries := make([]DeviceListEntry, 0, len(ids))
+	for _, id := range ids {
+		entry := DeviceListEntry{UUID: id}
+		md, err := h.managerFor(r).GetDeviceMetadata(uuid.FromStringOrNil(id))
+		if err != nil {
+			log.Printf("error getting metadata of %s: %v", id, err)
+		}
+		entry.Metadata = md
+		entries = append(entries, entry)
+	}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		log.Printf("error converting devices to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// isQuarantined whether a device is quarantined. A device whose quarantine cannot be read is not
+func (h *adminHandler) isQuarantined(r *http.Request, u uuid.UUID) bool {
+	q, err := h.managerFor(r).GetQuarantine(u)
+	if err != nil {
+		log.Printf("error getting quarantine of %s: %v", u, err)
+		return false
+	}
+	return q != nil
+}
+
 func (h *adminHandler) deviceGet(w http.ResponseWriter, r *http.Request) {
 	u := mux.Vars(r)["uuid"]
 	uid, err := uuid.FromString(u)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	deviceCert, onboardCert, serial, err := h.manager.DeviceGet(&uid)
+	deviceCert, onboardCert, serial, err := h.managerFor(r).DeviceGet(&uid)
 	_, isNotFound := err.(*common.NotFoundError)
 	switch {
 	case err != nil && isNotFound:
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	case err != nil:
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	case deviceCert == nil:
-		http.Error(w, "found device information, but cert was empty", http.StatusInternalServerError)
+		httpError(w, "found device information, but cert was empty", http.StatusInternalServerError)
 	default:
 		dc := DeviceCert{
 			Cert:   ax.PemEncodeCert(deviceCert.Raw),
@@ -219,9 +385,21 @@ func (h *adminHandler) deviceGet(w http.ResponseWriter, r *http.Request) {
 		if onboardCert != nil {
 			dc.Onboard = ax.PemEncodeCert(onboardCert.Raw)
 		}
+		if ts, err := common.TombstoneGet(h.managerFor(r), u); err == nil {
+			dc.Deleted = ts
+		}
+		if md, err := h.managerFor(r).GetDeviceMetadata(uid); err == nil {
+			dc.Metadata = md
+		}
+		if q, err := h.managerFor(r).GetQuarantine(uid); err == nil {
+			dc.Quarantine = q
+		}
+		if sources, err := h.managerFor(r).GetDeviceSources(uid); err == nil {
+			dc.Sources = sources
+		}
 		body, err := json.Marshal(dc)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(body))
@@ -232,64 +410,140 @@ func (h *adminHandler) deviceRemove(w http.ResponseWriter, r *http.Request) {
 	u := mux.Vars(r)["uuid"]
 	uid, err := uuid.FromString(u)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	err = h.manager.DeviceRemove(&uid)
+	var before interface{}
+	if cert, onboard, serial, err := h.managerFor(r).DeviceGet(&uid); err == nil {
+		before = deviceSummary(cert, onboard, serial)
+	}
+	if soft, _ := strconv.ParseBool(r.URL.Query().Get("soft")); soft {
+		h.deviceSoftRemove(w, r, uid, before)
+		return
+	}
+	err = h.managerFor(r).DeviceRemove(&uid)
 	_, isNotFound := err.(*common.NotFoundError)
 	switch {
 	case err != nil && isNotFound:
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	case err != nil:
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	default:
+		// a device deleted softly before is gone for good now
+		if err := common.TombstoneRemove(h.managerFor(r), u); err != nil {
+			if _, ok := err.(*common.NotFoundError); !ok {
+				log.Printf("error removing tombstone of device %s: %v", u, err)
+			}
+		}
+		h.audit(r, auditDeviceRemove, u, before, nil)
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
 func (h *adminHandler) deviceClear(w http.ResponseWriter, r *http.Request) {
-	err := h.manager.DeviceClear()
+	uids, _ := h.managerFor(r).DeviceList()
+	err := h.managerFor(r).DeviceClear()
+	if err != nil {
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	tombstones, err := common.TombstoneList(h.managerFor(r))
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("error listing tombstones: %v", err)
+	}
+	for _, ts := range tombstones {
+		if err := common.TombstoneRemove(h.managerFor(r), ts.UUID); err != nil {
+			log.Printf("error removing tombstone of device %s: %v", ts.UUID, err)
+		}
+	}
+	ids := make([]string, 0, len(uids))
+	for _, i := range uids {
+		if i != nil {
+			ids = append(ids, i.String())
+		}
 	}
+	h.audit(r, auditDeviceClear, "", map[string]interface{}{"devices": ids}, nil)
 }
 
 func (h *adminHandler) deviceConfigGet(w http.ResponseWriter, r *http.Request) {
 	u := mux.Vars(r)["uuid"]
 	uid, err := uuid.FromString(u)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	deviceConfig, err := h.manager.GetConfig(uid)
+	var deviceConfig []byte
+	// the stored config, unless asked for the one served, with the hardware model of the device merged in
+	if merged, _ := strconv.ParseBool(r.URL.Query().Get("merged")); merged {
+		_, deviceConfig, err = servedConfig(h.managerFor(r), uid)
+	} else {
+		deviceConfig, err = h.managerFor(r).GetConfig(uid)
+	}
 	_, isNotFound := err.(*common.NotFoundError)
 	switch {
 	case err != nil && isNotFound:
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	case err != nil:
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	case deviceConfig == nil:
-		http.Error(w, "found device information, but cert was empty", http.StatusInternalServerError)
+		httpError(w, "found device information, but cert was empty", http.StatusInternalServerError)
 	default:
+		// the ETag of the stored config is what an If-Match setting it compares with, so the merged one has none
+		if merged, _ := strconv.ParseBool(r.URL.Query().Get("merged")); !merged {
+			w.Header().Set("ETag", configETag(deviceConfig))
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write(deviceConfig)
 	}
 }
 
+// configETag the ETag of a stored config, the SHA-256 of its JSON
+func configETag(b []byte) string {
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// matchesETag whether an If-Match header matches an ETag, as * or as one of its comma-separated ETags
+func matchesETag(ifMatch, etag string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// validateConfig get the problems with a config, if any
+func validateConfig(conf *config.EdgeDevConfig) []string {
+	err := common.ValidateConfig(conf)
+	if verr, ok := err.(*common.ConfigValidationError); ok {
+		return verr.Problems
+	}
+	return nil
+}
+
 func (h *adminHandler) deviceConfigSet(w http.ResponseWriter, r *http.Request) {
 	u := mux.Vars(r)["uuid"]
 	uid, err := uuid.FromString(u)
 	if err != nil {
-		http.Error(w, "bad UUID", http.StatusBadRequest)
+		httpError(w, "bad UUID", http.StatusBadRequest)
 	}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+	}
+	// datastores and images of the catalog referenced by name
+	body, err = common.ResolveRefs(body, h.managerFor(r))
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad references: %v", err), http.StatusBadRequest)
+		return
 	}
 	var deviceConfig config.EdgeDevConfig
-	err = json.Unmarshal(body, &deviceConfig)
+	// protojson, as resolved references and configs read from Adam have enums by name
+	err = protojson.Unmarshal(body, &deviceConfig)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to marshal json message into protobuf: %v", err), http.StatusBadRequest)
+		httpError(w, fmt.Sprintf("failed to marshal json message into protobuf: %v", err), http.StatusBadRequest)
+		return
 	}
 	// before setting the config, set any necessary defaults
 	// check for UUID and/or version mismatch
@@ -297,22 +551,31 @@ func (h *adminHandler) deviceConfigSet(w http.ResponseWriter, r *http.Request) {
 		existingId     *config.UUIDandVersion
 		existingConfig config.EdgeDevConfig
 	)
-	existingConfigB, err := h.manager.GetConfig(uid)
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" && h.requireIfMatch {
+		writeError(w, http.StatusPreconditionRequired, ErrIfMatchRequired, "setting a config needs an If-Match with the ETag of the config it replaces", nil)
+		return
+	}
+	existingConfigB, err := h.managerFor(r).GetConfig(uid)
 	_, isNotFound := err.(*common.NotFoundError)
 	switch {
 	case err != nil && isNotFound:
-		http.Error(w, fmt.Sprintf("device not found %s", u), http.StatusNotFound)
+		httpError(w, fmt.Sprintf("device not found %s", u), http.StatusNotFound)
 		return
 	case err != nil:
-		http.Error(w, fmt.Sprintf("error retrieving existing config for device %s: %v", u, err), http.StatusBadRequest)
+		httpError(w, fmt.Sprintf("error retrieving existing config for device %s: %v", u, err), http.StatusBadRequest)
 		return
 	case len(existingConfigB) == 0:
-		http.Error(w, "found device information, but had no config", http.StatusInternalServerError)
+		httpError(w, "found device information, but had no config", http.StatusInternalServerError)
+		return
+	}
+	if etag := configETag(existingConfigB); ifMatch != "" && !matchesETag(ifMatch, etag) {
+		writeError(w, http.StatusConflict, ErrConfigConflict, fmt.Sprintf("config of device %s changed since it was read", u), map[string]string{"etag": etag})
 		return
 	}
 	// convert it to protobuf so we can work with it
 	if err := protojson.Unmarshal(existingConfigB, &existingConfig); err != nil {
-		http.Error(w, fmt.Sprintf("error processing existing config: %v", err), http.StatusInternalServerError)
+		httpError(w, fmt.Sprintf("error processing existing config: %v", err), http.StatusInternalServerError)
 		return
 	}
 	existingId = existingConfig.Id
@@ -324,7 +587,7 @@ func (h *adminHandler) deviceConfigSet(w http.ResponseWriter, r *http.Request) {
 	}
 	if deviceConfig.Id == nil {
 		if versionError != nil {
-			http.Error(w, fmt.Sprintf("cannot automatically non-number bump version %s", existingId.Version), http.StatusBadRequest)
+			httpError(w, fmt.Sprintf("cannot automatically non-number bump version %s", existingId.Version), http.StatusBadRequest)
 			return
 		}
 		deviceConfig.Id = &config.UUIDandVersion{
@@ -337,51 +600,122 @@ func (h *adminHandler) deviceConfigSet(w http.ResponseWriter, r *http.Request) {
 		}
 		if deviceConfig.Id.Version == "" {
 			if versionError != nil {
-				http.Error(w, fmt.Sprintf("cannot automatically non-number bump version %s", existingId.Version), http.StatusBadRequest)
+				httpError(w, fmt.Sprintf("cannot automatically non-number bump version %s", existingId.Version), http.StatusBadRequest)
 				return
 			}
 			deviceConfig.Id.Version = strconv.Itoa(newVersion)
 		}
 		if deviceConfig.Id.Uuid != u {
-			http.Error(w, fmt.Sprintf("mismatched UUID, setting %s for device %s", deviceConfig.Id.Uuid, u), http.StatusBadRequest)
+			httpError(w, fmt.Sprintf("mismatched UUID, setting %s for device %s", deviceConfig.Id.Uuid, u), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// EVE rejects configs whose objects refer to ones that do not exist, so only store valid ones, unless forced
+	problems := validateConfig(&deviceConfig)
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	if len(problems) > 0 {
+		if !force {
+			writeError(w, http.StatusBadRequest, ErrInvalidConfig, fmt.Sprintf("invalid config, set force=true to store it anyway:\n- %s", strings.Join(problems, "\n- ")), map[string][]string{"problems": problems})
 			return
 		}
+		log.Printf("storing invalid config for device %s, forced: %s", u, strings.Join(problems, "; "))
 	}
 
 	b, err := protojson.Marshal(&deviceConfig)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error processing device config: %v", err), http.StatusBadRequest)
+		httpError(w, fmt.Sprintf("error processing device config: %v", err), http.StatusBadRequest)
+		return
+	}
+	switch err := checkWritable(h.managerFor(r), uid).(type) {
+	case nil:
+	case *errDeviceReadOnly:
+		writeError(w, http.StatusForbidden, ErrDeviceReadOnly, err.Error(), nil)
+		return
+	default:
+		log.Printf("error getting flags of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	err = h.manager.SetConfig(uid, b)
+	// only replacing the config read, so that two requests with the same If-Match, from this server or another
+	// sharing the database, cannot both replace it
+	err = h.managerFor(r).SwapConfig(uid, existingConfigB, b)
 	_, isNotFound = err.(*common.NotFoundError)
+	conflict, isConflict := err.(*common.ConfigConflictError)
 	switch {
+	case isConflict:
+		etag := configETag(conflict.Current)
+		writeError(w, http.StatusConflict, ErrConfigConflict, fmt.Sprintf("config of device %s changed since it was read", u), map[string]string{"etag": etag})
 	case err != nil && isNotFound:
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	case err != nil:
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	default:
+		after := configSummary(b)
+		if len(problems) > 0 {
+			after["forced"] = problems
+		}
+		h.audit(r, auditConfigSet, u, configSummary(existingConfigB), after)
+		w.Header().Set("ETag", configETag(b))
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
 func (h *adminHandler) deviceLogsGet(w http.ResponseWriter, r *http.Request) {
-	h.deviceDataGet(w, r, h.logChannel, h.manager.GetLogsReader)
+	source := r.URL.Query().Get("source")
+	if rng, ok := h.streamRange(w, r); !ok {
+		return
+	} else if rng != nil {
+		if source != "" {
+			httpError(w, "a range of the logs cannot be read by source", http.StatusBadRequest)
+			return
+		}
+		h.deviceRangeGet(w, r, *rng, driver.StreamSeeker.GetLogsRange, h.managerFor(r).GetLogsReader)
+		return
+	}
+	if source == "" {
+		h.deviceDataGet(w, r, h.logChannel, nil, h.managerFor(r).GetLogsReader)
+		return
+	}
+	keep := func(b []byte) bool {
+		return common.LogSource(b) == source
+	}
+	h.deviceDataGet(w, r, h.logChannel, keep, func(u uuid.UUID) (io.Reader, error) {
+		return h.logsSourceReader(r, u, source)
+	})
 }
 
 func (h *adminHandler) deviceInfoGet(w http.ResponseWriter, r *http.Request) {
-	h.deviceDataGet(w, r, h.infoChannel, h.manager.GetInfoReader)
+	if rng, ok := h.streamRange(w, r); !ok {
+		return
+	} else if rng != nil {
+		h.deviceRangeGet(w, r, *rng, driver.StreamSeeker.GetInfoRange, h.managerFor(r).GetInfoReader)
+		return
+	}
+	h.deviceDataGet(w, r, h.infoChannel, nil, h.managerFor(r).GetInfoReader)
+}
+
+func (h *adminHandler) deviceMetricsGet(w http.ResponseWriter, r *http.Request) {
+	if rng, ok := h.streamRange(w, r); !ok {
+		return
+	} else if rng != nil {
+		h.deviceRangeGet(w, r, *rng, driver.StreamSeeker.GetMetricsRange, h.managerFor(r).GetMetricsReader)
+		return
+	}
+	h.deviceDataGet(w, r, h.metricsChannel, nil, h.managerFor(r).GetMetricsReader)
 }
 
 func (h *adminHandler) deviceRequestsGet(w http.ResponseWriter, r *http.Request) {
-	h.deviceDataGet(w, r, h.requestsChannel, h.manager.GetRequestsReader)
+	h.deviceDataGet(w, r, h.requestsChannel, nil, h.managerFor(r).GetRequestsReader)
 }
 
-func (h *adminHandler) deviceDataGet(w http.ResponseWriter, r *http.Request, c <-chan []byte, readerFunc func(u uuid.UUID) (io.Reader, error)) {
+// deviceDataGet write the entries of a device readerFunc reads, or stream those received on c that keep, if set,
+// accepts
+func (h *adminHandler) deviceDataGet(w http.ResponseWriter, r *http.Request, c <-chan []byte, keep func([]byte) bool, readerFunc func(u uuid.UUID) (io.Reader, error)) {
 	u := mux.Vars(r)["uuid"]
 	uid, err := uuid.FromString(u)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	watch := r.Header.Get(StreamHeader)
@@ -406,11 +740,17 @@ func (h *adminHandler) deviceDataGet(w http.ResponseWriter, r *http.Request, c <
 		for {
 			select {
 			case b := <-c:
+				if keep != nil && !keep(b) {
+					continue
+				}
 				w.Write(append(b, 0x0a))
 				flusher.Flush()
 			case <-cn.CloseNotify():
 				// client stopped listening
 				return
+			case <-h.done:
+				// server shutting down
+				return
 			}
 		}
 	} else {
@@ -418,17 +758,17 @@ func (h *adminHandler) deviceDataGet(w http.ResponseWriter, r *http.Request, c <
 		_, isNotFound := err.(*common.NotFoundError)
 		switch {
 		case err != nil && isNotFound:
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		case err != nil:
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		case reader == nil:
-			http.Error(w, "found device information, but logs were empty", http.StatusInternalServerError)
+			httpError(w, "found device information, but logs were empty", http.StatusInternalServerError)
 		default:
 			w.WriteHeader(http.StatusOK)
 			w.Header().Set("Content-type", "application/json")
 			_, err = io.Copy(w, reader)
 			if err != nil && err != io.EOF {
-				http.Error(w, fmt.Sprintf("error reading logs: %v", err), http.StatusInternalServerError)
+				httpError(w, fmt.Sprintf("error reading logs: %v", err), http.StatusInternalServerError)
 			}
 		}
 	}
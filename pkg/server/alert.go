@@ -0,0 +1,393 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// states of alerts
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+
+	// alertRulesRefresh how long the rules are cached for, so that rules changed by another server sharing the
+	// database are picked up
+	alertRulesRefresh = 30 * time.Second
+	// alertQueueSize how many alerts can wait to be sent before new ones are dropped
+	alertQueueSize = 100
+	// alertSendTimeout how long sending an alert to a webhook or an MQTT broker can take
+	alertSendTimeout = 10 * time.Second
+)
+
+// Alert a rule that started or stopped holding for a device, or an app instance on it
+type Alert struct {
+	Rule string `json:"rule"`
+	Name string `json:"name,omitempty"`
+	// Device UUID of the device
+	Device string `json:"device"`
+	// App UUID of the app instance, for app state rules
+	App     string `json:"app,omitempty"`
+	AppName string `json:"app-name,omitempty"`
+	// State firing when the rule starts holding, resolved when it stops
+	State string `json:"state"`
+	// Value the value of the metric that breached the rule, for metric rules
+	Value   *float64  `json:"value,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// alertDelivery an alert to send, with where to
+type alertDelivery struct {
+	alert   Alert
+	actions []common.AlertAction
+}
+
+// alerter evaluate the alert rules on the metrics and info devices send, and send alerts when rules start and stop
+// holding. Which rules hold is only kept in memory, so a rule still holding after a restart fires again
+type alerter struct {
+	manager driver.DeviceManager
+	lock    sync.Mutex
+	rules   []*common.AlertRule
+	loaded  time.Time
+	// firing alerts by rule, device and, for app state rules, app instance
+	firing map[string]Alert
+	queue  chan alertDelivery
+	client *http.Client
+}
+
+func newAlerter(m driver.DeviceManager) *alerter {
+	return &alerter{
+		manager: m,
+		firing:  map[string]Alert{},
+		queue:   make(chan alertDelivery, alertQueueSize),
+		client:  &http.Client{Timeout: alertSendTimeout},
+	}
+}
+
+// invalidate make the next evaluation reload the rules, after they changed
+func (a *alerter) invalidate() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.loaded = time.Time{}
+}
+
+// forget drop the firing alerts of a removed rule, without resolving them
+func (a *alerter) forget(rule string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for k := range a.firing {
+		if strings.HasPrefix(k, rule+"/") {
+			delete(a.firing, k)
+		}
+	}
+	a.loaded = time.Time{}
+}
+
+// loadRules the current rules, reloading them if stale. Must be called with the lock held
+func (a *alerter) loadRules() []*common.AlertRule {
+	if time.Since(a.loaded) < alertRulesRefresh {
+		return a.rules
+	}
+	rules, err := common.AlertRuleList(a.manager)
+	if err != nil {
+		// keep evaluating the rules we have
+		log.Printf("error listing alert rules: %v", err)
+		return a.rules
+	}
+	a.rules = rules
+	a.loaded = time.Now()
+	return a.rules
+}
+
+// serialFunc look up the serial of a device at most once, only if a rule needs it
+func (a *alerter) serialFunc(u uuid.UUID) func() string {
+	var (
+		serial string
+		done   bool
+	)
+	return func() string {
+		if !done {
+			done = true
+			if _, _, s, err := a.manager.DeviceGet(&u); err == nil {
+				serial = s
+			}
+		}
+		return serial
+	}
+}
+
+// evaluateMetrics evaluate the metric rules on a metrics message of a device, in JSON
+func (a *alerter) evaluateMetrics(u uuid.UUID, b []byte) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var metrics interface{}
+	serial := a.serialFunc(u)
+	for _, rule := range a.loadRules() {
+		if rule.Metric == "" || !rule.AppliesTo(u.String(), serial) {
+			continue
+		}
+		if metrics == nil {
+			if err := json.Unmarshal(b, &metrics); err != nil {
+				log.Printf("error decoding metrics of %s for alerts: %v", u, err)
+				return
+			}
+		}
+		breached, v := rule.Breached(metrics)
+		alert := Alert{Rule: rule.ID, Name: rule.Name, Device: u.String(), Time: time.Now()}
+		if breached {
+			alert.Value = &v
+			alert.Message = fmt.Sprintf("%s on device %s is %v, %s %v", rule.Metric, u, v, rule.Op, rule.Value)
+		} else {
+			alert.Message = fmt.Sprintf("%s on device %s is no longer %s %v", rule.Metric, u, rule.Op, rule.Value)
+		}
+		a.transition(rule, alert, breached)
+	}
+}
+
+// evaluateApps evaluate the app state rules on the app instances of a device, before and after its inventory changed
+func (a *alerter) evaluateApps(u uuid.UUID, before, after []common.InventoryApp) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	serial := a.serialFunc(u)
+	current := map[string]bool{}
+	for _, app := range after {
+		current[app.UUID] = true
+	}
+	for _, rule := range a.loadRules() {
+		if rule.AppState == "" || !rule.AppliesTo(u.String(), serial) {
+			continue
+		}
+		for _, app := range after {
+			if !rule.AppliesToApp(app.Name) {
+				continue
+			}
+			alert := Alert{Rule: rule.ID, Name: rule.Name, Device: u.String(), App: app.UUID, AppName: app.Name, Time: time.Now()}
+			holds := app.State == rule.AppState
+			if holds {
+				alert.Message = fmt.Sprintf("app %s (%s) on device %s is %s", app.Name, app.UUID, u, app.State)
+			} else {
+				alert.Message = fmt.Sprintf("app %s (%s) on device %s is no longer %s, but %s", app.Name, app.UUID, u, rule.AppState, app.State)
+			}
+			a.transition(rule, alert, holds)
+		}
+		// removed app instances no longer are in any state
+		for _, app := range before {
+			if current[app.UUID] {
+				continue
+			}
+			alert := Alert{Rule: rule.ID, Name: rule.Name, Device: u.String(), App: app.UUID, AppName: app.Name, Time: time.Now()}
+			alert.Message = fmt.Sprintf("app %s (%s) on device %s was removed", app.Name, app.UUID, u)
+			a.transition(rule, alert, false)
+		}
+	}
+}
+
+// transition queue an alert if the rule started or stopped holding for its device and app. Must be called with
+// the lock held
+func (a *alerter) transition(rule *common.AlertRule, alert Alert, holds bool) {
+	k := strings.Join([]string{alert.Rule, alert.Device, alert.App}, "/")
+	_, firing := a.firing[k]
+	switch {
+	case holds && !firing:
+		alert.State = AlertFiring
+		a.firing[k] = alert
+	case !holds && firing:
+		alert.State = AlertResolved
+		delete(a.firing, k)
+	default:
+		return
+	}
+	select {
+	case a.queue <- alertDelivery{alert: alert, actions: rule.Actions}:
+	default:
+		log.Printf("alert queue full, dropping %s alert for rule %s on %s", alert.State, alert.Rule, alert.Device)
+	}
+}
+
+// firingAlerts the alerts firing, oldest first
+func (a *alerter) firingAlerts() []Alert {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	alerts := make([]Alert, 0, len(a.firing))
+	for _, alert := range a.firing {
+		alerts = append(alerts, alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Time.Before(alerts[j].Time) })
+	return alerts
+}
+
+// send send the queued alerts, until done is closed
+func (a *alerter) send(done <-chan struct{}) {
+	for {
+		var d alertDelivery
+		select {
+		case d = <-a.queue:
+		case <-done:
+			return
+		}
+		b, err := json.Marshal(d.alert)
+		if err != nil {
+			log.Printf("error converting alert to json: %v", err)
+			continue
+		}
+		for _, action := range d.actions {
+			if err := a.sendAlert(action, &d.alert, b); err != nil {
+				log.Printf("error sending %s alert for rule %s to %s: %v", d.alert.State, d.alert.Rule, action.Type, err)
+			}
+		}
+	}
+}
+
+func (a *alerter) sendAlert(action common.AlertAction, alert *Alert, b []byte) error {
+	switch action.Type {
+	case common.AlertLog:
+		log.Printf("alert %s: %s", alert.State, alert.Message)
+	case common.AlertWebhook:
+		res, err := a.client.Post(action.URL, mimeJSON, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("webhook returned %s", res.Status)
+		}
+	case common.AlertMQTT:
+		return publishMQTT(action.URL, action.Topic, b, alertSendTimeout)
+	}
+	return nil
+}
+
+func (h *adminHandler) alertList(w http.ResponseWriter, r *http.Request) {
+	h.writeAlert(w, http.StatusOK, h.alerts.firingAlerts())
+}
+
+func (h *adminHandler) alertRuleList(w http.ResponseWriter, r *http.Request) {
+	rules, err := common.AlertRuleList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing alert rules: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Created.Before(rules[j].Created) })
+	h.writeAlert(w, http.StatusOK, rules)
+}
+
+func (h *adminHandler) alertRuleGet(w http.ResponseWriter, r *http.Request) {
+	rule, ok := h.getAlertRule(w, r)
+	if !ok {
+		return
+	}
+	h.writeAlert(w, http.StatusOK, rule)
+}
+
+func (h *adminHandler) alertRuleAdd(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var rule common.AlertRule
+	if err := json.Unmarshal(body, &rule); err != nil {
+		httpError(w, fmt.Sprintf("bad alert rule: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := rule.Validate(); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		log.Printf("error generating alert rule ID: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	rule.ID = id.String()
+	rule.Created = time.Now()
+	for i, d := range rule.Devices {
+		rule.Devices[i] = strings.ToLower(d)
+	}
+	if err := common.AlertRuleAdd(h.managerFor(r), &rule); err != nil {
+		log.Printf("error saving alert rule: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.alerts.invalidate()
+	h.audit(r, auditAlertAdd, rule.ID, nil, alertRuleSummary(&rule))
+	h.writeAlert(w, http.StatusCreated, &rule)
+}
+
+// alertRuleRemove remove a rule. Its firing alerts are dropped, without sending them as resolved
+func (h *adminHandler) alertRuleRemove(w http.ResponseWriter, r *http.Request) {
+	rule, ok := h.getAlertRule(w, r)
+	if !ok {
+		return
+	}
+	if err := common.AlertRuleRemove(h.managerFor(r), rule.ID); err != nil {
+		log.Printf("error removing alert rule: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.alerts.forget(rule.ID)
+	h.audit(r, auditAlertRemove, rule.ID, alertRuleSummary(rule), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// alertRuleSummary summary of a rule for the audit log, without where its alerts go, as URLs can have credentials
+func alertRuleSummary(rule *common.AlertRule) map[string]interface{} {
+	s := map[string]interface{}{"name": rule.Name, "actions": len(rule.Actions)}
+	if rule.Metric != "" {
+		s["condition"] = fmt.Sprintf("%s %s %v", rule.Metric, rule.Op, rule.Value)
+	} else {
+		s["condition"] = "app-state " + rule.AppState
+	}
+	return s
+}
+
+// getAlertRule get the alert rule a request is for, writing the error response if there is none
+func (h *adminHandler) getAlertRule(w http.ResponseWriter, r *http.Request) (*common.AlertRule, bool) {
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	}
+	rule, err := common.AlertRuleGet(h.managerFor(r), id.String())
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		log.Printf("error getting alert rule %s: %v", id, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	return rule, true
+}
+
+func (h *adminHandler) writeAlert(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting alerts to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -4,13 +4,10 @@
 package server
 
 import (
-	"bufio"
 	"compress/gzip"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -22,6 +19,7 @@ import (
 	"github.com/lf-edge/adam/pkg/driver"
 	"github.com/lf-edge/adam/pkg/driver/common"
 	"github.com/lf-edge/eve/api/go/config"
+	eveuuid "github.com/lf-edge/eve/api/go/eveuuid"
 	"github.com/lf-edge/eve/api/go/info"
 	"github.com/lf-edge/eve/api/go/logs"
 	"github.com/lf-edge/eve/api/go/metrics"
@@ -38,12 +36,88 @@ type ApiRequest struct {
 	Forwarded string    `json:"forwarded,omitempty"`
 	Method    string    `json:"method"`
 	URL       string    `json:"url"`
+	// TLSVersion the version of TLS the request came with, empty without TLS
+	TLSVersion string `json:"tls-version,omitempty"`
+	UserAgent  string `json:"user-agent,omitempty"`
+}
+
+// CertRotation audit record of a device certificate rotation, saved with the requests of the device
+type CertRotation struct {
+	ApiRequest
+	Event   string `json:"event"`
+	OldCert string `json:"old-cert-sha256"`
+	NewCert string `json:"new-cert-sha256"`
 }
 
 type apiHandler struct {
-	manager     driver.DeviceManager
-	logChannel  chan []byte
-	infoChannel chan []byte
+	manager        driver.DeviceManager
+	logChannel     chan []byte
+	infoChannel    chan []byte
+	metricsChannel chan []byte
+	// approval rules for onboarding devices, nil if they are registered without approval
+	approval *OnboardApproval
+	// inventoryLocks serializes the updates to the inventory of each device
+	inventoryLocks deviceLocks
+	// alerts evaluates the alert rules on the metrics and info received
+	alerts *alerter
+	// filters drops log entries below the severity of the filter of their device
+	filters *logFilters
+	// loki forwards the log entries kept to Loki, nil if they are not
+	loki *lokiExporter
+	// syslog forwards the log entries kept to a syslog server, nil if they are not
+	syslog *syslogExporter
+	// metricsExport pushes the metrics stored as time series, nil if they are not
+	metricsExport *metricsExporter
+	// bodyLimits limits of the size of the bodies of requests, per kind of message
+	bodyLimits common.Limits
+	// parts the log bundles being sent in parts
+	parts *bundleParts
+	// deadLettersAdded dead letters added since their number was last checked
+	deadLettersAdded int32
+	// retention how long devices deleted for reporting a hardware model their onboarding certificate does not
+	// allow are kept
+	retention time.Duration
+	// commands the commands to the app instances of devices, followed from the info messages about them
+	commands *appCommander
+	// issuer signs the certificate signing requests devices register with, nil if they must send certificates
+	issuer *deviceIssuer
+	// backpressure slows devices down through their config while ingest is overloaded, nil if it does not
+	backpressure *backpressure
+	// onboardHook decides on the registrations of devices from outside Adam, nil if there is none
+	onboardHook OnboardHook
+	// deviceCAs the CA bundles one of which must have signed the certificates of devices, nil if there are none
+	deviceCAs *deviceCAs
+	// baseConfig the base config template devices start with, nil for the minimal one, see initialConfig
+	baseConfig []byte
+	// limits the device limits and telemetry quotas of the policies of onboarding certificates
+	limits *onboardLimits
+	// certs the server certificate, whose key signs the messages of the v2 API
+	certs *certStore
+	// proxies the TLS-terminating proxies in front of the device API, whose X-Forwarded-For is believed; nil if none
+	proxies *certProxies
+	// sources records where the requests of each device come from
+	sources *deviceSources
+	// rekeyNonces the nonces devices sign with the key of the certificate they rotate to
+	rekeyNonces *rekeyNonces
+}
+
+// deviceConfig the config served to a device, with the config items of the backpressure while it is engaged
+func (h *apiHandler) deviceConfig(r *http.Request, u uuid.UUID) (*config.EdgeDevConfig, []byte, error) {
+	msg, conf, err := servedConfig(h.managerFor(r), u)
+	if err != nil || h.backpressure == nil {
+		return msg, conf, err
+	}
+	return h.backpressure.apply(h.managerFor(r), u, msg, conf)
+}
+
+// writeFailed report that a message from a device could not be stored, with 429 Too Many Requests if the
+// device exceeded its quota
+func writeFailed(w http.ResponseWriter, err error) {
+	if _, ok := err.(*common.QuotaExceededError); ok {
+		writeError(w, http.StatusTooManyRequests, ErrQuotaExceeded, err.Error(), nil)
+		return
+	}
+	httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
 // GetUser godoc
@@ -59,12 +133,14 @@ func (h *apiHandler) recordClient(u *uuid.UUID, r *http.Request) {
 		return
 	}
 	req := ApiRequest{
-		Timestamp: time.Now(),
-		UUID:      *u,
-		ClientIP:  r.RemoteAddr,
-		Forwarded: r.Header.Get("X-Forwarded-For"),
-		Method:    r.Method,
-		URL:       r.URL.String(),
+		Timestamp:  time.Now(),
+		UUID:       *u,
+		ClientIP:   r.RemoteAddr,
+		Forwarded:  h.proxies.forwardedFor(r),
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		TLSVersion: tlsVersion(r),
+		UserAgent:  r.UserAgent(),
 	}
 	b, err := json.Marshal(req)
 	if err != nil {
@@ -72,24 +148,52 @@ func (h *apiHandler) recordClient(u *uuid.UUID, r *http.Request) {
 		return
 	}
 
-	h.manager.WriteRequest(*u, b)
+	h.managerFor(r).WriteRequest(*u, b)
 }
 
 func (h *apiHandler) checkCertAndRecord(w http.ResponseWriter, r *http.Request) *uuid.UUID {
 	// only uses the device cert
 	cert := getClientCert(r)
-	u, err := h.manager.DeviceCheckCert(cert)
+	if h.revoked(w, r, cert) {
+		return nil
+	}
+	ca, ok := h.verifyDevice(w, r)
+	if !ok {
+		return nil
+	}
+	u, err := h.managerFor(r).DeviceCheckCert(cert)
 	if err != nil {
 		log.Printf("error checking device cert: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return nil
 	}
 	if u == nil {
 		log.Printf("unknown device cert")
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, ErrUnregisteredDevice, "device certificate not registered", nil)
+		return nil
+	}
+	setStatsDevice(r, *u)
+	setLogDevice(r, *u)
+	if ca != "" {
+		h.deviceCAs.record(*u, ca)
+	}
+	// devices deleted softly are refused until restored, without recording anything more for them
+	ts, err := common.TombstoneGet(h.managerFor(r), u.String())
+	if _, isNotFound := err.(*common.NotFoundError); err != nil && !isNotFound {
+		log.Printf("error checking whether device %s is deleted: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return nil
 	}
+	if ts != nil {
+		log.Printf("refused deleted device %s", u)
+		writeError(w, http.StatusGone, ErrDeviceDeleted, fmt.Sprintf("device %s was deleted on %s", u, ts.Deleted.Format(time.RFC3339)), map[string]interface{}{"uuid": u.String(), "deleted": ts.Deleted})
+		return nil
+	}
+	if verboseDebug(h.managerFor(r), *u) {
+		setLogVerbose(r)
+	}
 	h.recordClient(u, r)
+	h.sources.record(*u, requestSource(r, h.proxies), time.Now())
 	return u
 }
 
@@ -98,70 +202,181 @@ func (h *apiHandler) register(w http.ResponseWriter, r *http.Request) {
 	//  - get the serial
 	//  - get the device cert
 	onboardCert := getClientCert(r)
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("error reading request body: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	b := h.readBody(w, r, common.KindRequests)
+	if b == nil {
 		return
 	}
 	msg := &register.ZRegisterMsg{}
 	if err := proto.Unmarshal(b, msg); err != nil {
 		log.Printf("Failed to parse register message: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 	serial := msg.Serial
-	err = h.manager.OnboardCheck(onboardCert, serial)
+	if h.revoked(w, r, onboardCert) {
+		return
+	}
+	err := h.managerFor(r).OnboardCheck(onboardCert, serial)
 	if err != nil {
 		_, invalidCert := err.(*common.InvalidCertError)
 		_, invalidSerial := err.(*common.InvalidSerialError)
 		_, usedSerial := err.(*common.UsedSerialError)
+		if usedSerial && h.reissued(w, r, onboardCert, serial, msg.PemCert) {
+			return
+		}
 		switch {
-		case invalidCert, invalidSerial:
+		case invalidCert:
+			log.Printf("failed authentication %v", err)
+			writeError(w, http.StatusUnauthorized, ErrInvalidCert, err.Error(), nil)
+		case invalidSerial:
 			log.Printf("failed authentication %v", err)
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, ErrInvalidSerial, err.Error(), map[string]string{"serial": serial})
 		case usedSerial:
 			log.Printf("used serial %v", err)
-			http.Error(w, err.Error(), http.StatusConflict)
+			writeError(w, http.StatusConflict, ErrUsedSerial, err.Error(), map[string]string{"serial": serial})
 		default:
 			log.Printf("Error checking onboard cert and serial: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
 		return
 	}
+	if !h.checkSoftSerial(w, r, onboardCert, msg.SoftSerial) {
+		return
+	}
 	// the passed cert is base64 encoded PEM. So we need to base64 decode it, and then extract the DER bytes
-	// register the new device cert
+	// register the new device cert, or the one issued for the certificate signing request passed instead
 	certPemBytes, err := base64.StdEncoding.DecodeString(string(msg.PemCert))
 	if err != nil {
 		log.Printf("error base64-decoding device certficate from registration: %v", err)
-		http.Error(w, "error base64-decoding device certificate", http.StatusBadRequest)
+		httpError(w, "error base64-decoding device certificate", http.StatusBadRequest)
 		return
 	}
-
-	certDer, _ := pem.Decode(certPemBytes)
-	deviceCert, err := x509.ParseCertificate(certDer.Bytes)
-	if err != nil {
-		log.Printf("unable to convert device cert data from message to x509 certificate: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	deviceCert, issued := h.deviceCertFrom(w, r, certPemBytes)
+	if deviceCert == nil || h.revoked(w, r, deviceCert) {
+		return
+	}
+	decision, ok := h.onboardDecision(w, r, deviceCert, onboardCert, serial, msg.SoftSerial)
+	if !ok {
+		return
+	}
+	if decision.Action == OnboardPending || (decision.Action != OnboardAllow && h.approval != nil && !h.approval.autoApproved(serial, onboardCert.Subject.CommonName)) {
+		h.addPending(w, r, deviceCert, onboardCert, serial)
+		return
+	}
+	h.limits.registerLock.Lock()
+	defer h.limits.registerLock.Unlock()
+	if err := h.limits.checkDevices(h.managerFor(r), onboardCert); err != nil {
+		registerFailed(w, err)
 		return
 	}
 	// generate a new uuid
 	unew, err := uuid.NewV4()
 	if err != nil {
 		log.Printf("error generating a new device UUID: %v", err)
-		http.Error(w, fmt.Sprintf("error generating a new device UUID: %v", err), http.StatusBadRequest)
+		httpError(w, fmt.Sprintf("error generating a new device UUID: %v", err), http.StatusBadRequest)
+		return
+	}
+	conf, err := decision.config(h.managerFor(r), unew, onboardCert, h.baseConfig)
+	if err != nil {
+		log.Printf("error getting the config of the onboarding hook for new device: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 	// we do not keep the uuid or send it back; perhaps a future version of the API will support it
-	if err := h.manager.DeviceRegister(unew, deviceCert, onboardCert, serial, common.CreateBaseConfig(unew)); err != nil {
+	if err := h.managerFor(r).DeviceRegister(unew, deviceCert, onboardCert, serial, conf); err != nil {
 		log.Printf("error registering new device: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if decision.Metadata != nil {
+		if err := h.managerFor(r).SetDeviceMetadata(unew, decision.Metadata); err != nil {
+			log.Printf("error setting the metadata of the onboarding hook for %s: %v", unew, err)
+		}
+	}
+	// send back a 201, with the certificate if it was issued here
+	if issued {
+		h.writeIssued(w, http.StatusCreated, deviceCert)
 		return
 	}
-	// send back a 201
 	w.WriteHeader(http.StatusCreated)
 }
 
+// rekey replace the certificate of a device. The request must be made using the current device certificate,
+// and contains the new one in the same format as registration: a ZRegisterMsg with a base64 encoded PEM certificate,
+// or certificate signing request. A certificate must come with the signature, by its key, of the nonce the device was
+// given by rekeyNonce, as a certificate signing request is signed by its key already
+func (h *apiHandler) rekey(w http.ResponseWriter, r *http.Request) {
+	u := h.checkCertAndRecord(w, r)
+	if u == nil {
+		return
+	}
+	oldCert := getClientCert(r)
+	b := h.readBody(w, r, common.KindRequests)
+	if b == nil {
+		return
+	}
+	msg := &register.ZRegisterMsg{}
+	if err := proto.Unmarshal(b, msg); err != nil {
+		log.Printf("Failed to parse rekey message: %v", err)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	certPemBytes, err := base64.StdEncoding.DecodeString(string(msg.PemCert))
+	if err != nil {
+		log.Printf("error base64-decoding device certficate from rekey: %v", err)
+		httpError(w, "error base64-decoding device certificate", http.StatusBadRequest)
+		return
+	}
+	newCert, issued := h.deviceCertFrom(w, r, certPemBytes)
+	if newCert == nil || (!issued && !h.rekeyProven(w, r, *u, newCert)) || h.revoked(w, r, newCert) {
+		return
+	}
+	if now := time.Now(); now.Before(newCert.NotBefore) || now.After(newCert.NotAfter) {
+		log.Printf("new device certificate for %s is not currently valid", u)
+		httpError(w, "device certificate is not currently valid", http.StatusBadRequest)
+		return
+	}
+	if err := h.managerFor(r).DeviceReplaceCert(*u, newCert); err != nil {
+		switch err.(type) {
+		case *common.UsedCertError:
+			log.Printf("used device cert %v", err)
+			writeError(w, http.StatusConflict, ErrUsedCert, err.Error(), nil)
+		default:
+			log.Printf("error replacing device cert: %v", err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	oldSum := sha256.Sum256(oldCert.Raw)
+	newSum := sha256.Sum256(newCert.Raw)
+	record := CertRotation{
+		ApiRequest: ApiRequest{
+			Timestamp:  time.Now(),
+			UUID:       *u,
+			ClientIP:   r.RemoteAddr,
+			Forwarded:  h.proxies.forwardedFor(r),
+			Method:     r.Method,
+			URL:        r.URL.String(),
+			TLSVersion: tlsVersion(r),
+			UserAgent:  r.UserAgent(),
+		},
+		Event:   "cert-rotation",
+		OldCert: fmt.Sprintf("%x", oldSum),
+		NewCert: fmt.Sprintf("%x", newSum),
+	}
+	log.Printf("rotated device certificate for %s from %s to %s", u, record.OldCert, record.NewCert)
+	if b, err := json.Marshal(record); err != nil {
+		log.Printf("error saving certificate rotation record: %v", err)
+	} else if err := h.managerFor(r).WriteRequest(*u, b); err != nil {
+		log.Printf("error saving certificate rotation record: %v", err)
+	}
+	if issued {
+		h.writeIssued(w, http.StatusOK, newCert)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func (h *apiHandler) probe(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%s requested probe", r.RemoteAddr)
 	w.WriteHeader(http.StatusOK)
@@ -175,51 +390,65 @@ func (h *apiHandler) ping(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *apiHandler) configPost(w http.ResponseWriter, r *http.Request) {
+// deviceUUID confirm the identity of a device on the v2 API, returning the UUID it is registered with, and the
+// manufacturer and product name it last reported, if any
+func (h *apiHandler) deviceUUID(w http.ResponseWriter, r *http.Request) {
 	u := h.checkCertAndRecord(w, r)
 	if u == nil {
 		return
 	}
-	conf, err := h.manager.GetConfig(*u)
-	if err != nil {
-		log.Printf("error getting device config: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if !h.readAuthContainer(w, r, &eveuuid.UuidRequest{}) {
 		return
 	}
+	response := &eveuuid.UuidResponse{Uuid: u.String()}
+	inv, err := h.managerFor(r).GetInventory(*u)
+	switch {
+	case err != nil:
+		log.Printf("error getting inventory of %s: %v", u, err)
+	case inv != nil && inv.Hardware != nil:
+		response.Manufacturer = inv.Hardware.Manufacturer
+		response.ProductName = inv.Hardware.ProductName
+	}
+	h.writeAuthContainer(w, r, response)
+}
 
-	// convert config into a protobuf
-	var msg config.EdgeDevConfig
-	if err := protojson.Unmarshal(conf, &msg); err != nil {
-		log.Printf("error reading device config: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+func (h *apiHandler) configPost(w http.ResponseWriter, r *http.Request) {
+	u := h.checkCertAndRecord(w, r)
+	if u == nil {
+		return
+	}
+	msg, conf, err := h.deviceConfig(r, *u)
+	if err != nil {
+		log.Printf("error getting device config: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 	response := &config.ConfigResponse{}
 
-	hash := sha256.New()
-	common.ComputeConfigElementSha(hash, &msg)
-	configHash := hash.Sum(nil)
-
-	response.Config = &msg
-	response.ConfigHash = base64.URLEncoding.EncodeToString(configHash)
+	response.Config = msg
+	response.ConfigHash = configHash(msg)
 
 	configRequest, err := getClientConfigRequest(r)
+	if _, ok := err.(*UnsupportedMediaError); ok {
+		parseFailed(w, err)
+		return
+	}
 	if err != nil {
 		log.Printf("error getting config request: %v", err)
 	} else {
+		h.recordConfigAck(r, *u, configRequest.ConfigHash, response.ConfigHash, conf)
+		if staleConfig(r) {
+			response.ConfigHash = staleConfigHash(configRequest.ConfigHash, response.ConfigHash)
+			writeMessage(w, r, response)
+			return
+		}
 		//compare received config hash with current
 		if strings.Compare(configRequest.ConfigHash, response.ConfigHash) == 0 {
 			w.WriteHeader(http.StatusNotModified)
 			return
 		}
 	}
-	out, err := proto.Marshal(response)
-	if err != nil {
-		log.Printf("error converting config to byte message: %v", err)
-	}
-	w.Header().Add(contentType, mimeProto)
-	w.WriteHeader(http.StatusOK)
-	w.Write(out)
+	writeMessage(w, r, response)
 }
 
 func (h *apiHandler) config(w http.ResponseWriter, r *http.Request) {
@@ -227,15 +456,20 @@ func (h *apiHandler) config(w http.ResponseWriter, r *http.Request) {
 	if u == nil {
 		return
 	}
-	config, err := h.manager.GetConfig(*u)
+	msg, conf, err := h.deviceConfig(r, *u)
 	if err != nil {
 		log.Printf("error getting device config: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Add(contentType, mimeProto)
-	w.WriteHeader(http.StatusOK)
-	w.Write(config)
+	// the config is stored as JSON, so send it as is if that is what the device wants
+	if responseType(r) == mimeJSON {
+		w.Header().Add(contentType, mimeJSON)
+		w.WriteHeader(http.StatusOK)
+		w.Write(conf)
+		return
+	}
+	writeMessage(w, r, msg)
 }
 
 func (h *apiHandler) info(w http.ResponseWriter, r *http.Request) {
@@ -243,34 +477,45 @@ func (h *apiHandler) info(w http.ResponseWriter, r *http.Request) {
 	if u == nil {
 		return
 	}
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil || len(b) == 0 {
-		log.Printf("error reading request body: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	b := h.readBody(w, r, common.KindInfo)
+	if b == nil {
+		return
+	}
+	if len(b) == 0 {
+		log.Printf("error reading request body: empty info message")
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 	msg := &info.ZInfoMsg{}
-	if err := proto.Unmarshal(b, msg); err != nil {
+	if err := unmarshalBody(r, b, msg); err != nil {
 		log.Printf("Failed to parse info message: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		h.rejectMessage(w, r, *u, common.KindInfo, b, err)
+		return
+	}
+	if !h.checkModel(w, r, *u, msg) {
 		return
 	}
-	var entryBytes []byte
-	if entryBytes, err = protojson.Marshal(msg); err != nil {
+	entryBytes, err := protojson.Marshal(msg)
+	if err != nil {
 		log.Printf("Failed to marshal info message: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 	select {
 	case h.infoChannel <- entryBytes:
 	default:
 	}
-	err = h.manager.WriteInfo(*u, entryBytes)
+	err = h.limits.use(h.managerFor(r), *u, len(entryBytes))
+	if err == nil {
+		err = h.managerFor(r).WriteInfo(*u, entryBytes)
+	}
 	if err != nil {
 		log.Printf("Failed to write info message: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeFailed(w, err)
 		return
 	}
+	h.updateInventory(r, *u, msg)
+	h.commands.observe(h.managerFor(r), *u, msg)
 	// send back a 201
 	w.WriteHeader(http.StatusCreated)
 }
@@ -280,30 +525,37 @@ func (h *apiHandler) metrics(w http.ResponseWriter, r *http.Request) {
 	if u == nil {
 		return
 	}
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("error reading request body: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	b := h.readBody(w, r, common.KindMetrics)
+	if b == nil {
 		return
 	}
 	msg := &metrics.ZMetricMsg{}
-	if err := proto.Unmarshal(b, msg); err != nil {
+	if err := unmarshalBody(r, b, msg); err != nil {
 		log.Printf("Failed to parse metrics message: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		h.rejectMessage(w, r, *u, common.KindMetrics, b, err)
 		return
 	}
-	var entryBytes []byte
-	if entryBytes, err = protojson.Marshal(msg); err != nil {
+	entryBytes, err := protojson.Marshal(msg)
+	if err != nil {
 		log.Printf("Failed to marshal metrics message: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	err = h.manager.WriteMetrics(*u, entryBytes)
+	select {
+	case h.metricsChannel <- entryBytes:
+	default:
+	}
+	err = h.limits.use(h.managerFor(r), *u, len(entryBytes))
+	if err == nil {
+		err = h.managerFor(r).WriteMetrics(*u, entryBytes)
+	}
 	if err != nil {
 		log.Printf("Failed to write metrics message: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeFailed(w, err)
 		return
 	}
+	h.alerts.evaluateMetrics(*u, entryBytes)
+	h.metricsExport.push(*u, msg)
 	// send back a 201
 	w.WriteHeader(http.StatusCreated)
 }
@@ -313,42 +565,54 @@ func (h *apiHandler) logs(w http.ResponseWriter, r *http.Request) {
 	if u == nil {
 		return
 	}
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil || len(b) == 0 {
-		log.Printf("error reading request body: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	b := h.readLogBody(w, r, *u, common.KindLogs)
+	if b == nil {
+		return
+	}
+	if len(b) == 0 {
+		log.Printf("error reading request body: empty log bundle")
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 	msg := &logs.LogBundle{}
-	if err := proto.Unmarshal(b, msg); err != nil {
+	if err := unmarshalBody(r, b, msg); err != nil {
 		log.Printf("Failed to parse logbundle message: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		h.rejectMessage(w, r, *u, common.KindLogs, b, err)
 		return
 	}
 	eveVersion := msg.GetEveVersion()
 	image := msg.GetImage()
+	filter := h.logFilter(r, *u)
 	for _, entry := range msg.GetLog() {
+		if !h.filters.keep(*u, filter, entry.GetSeverity()) {
+			continue
+		}
 		entry := &common.FullLogEntry{
 			LogEntry:   entry,
 			Image:      image,
 			EveVersion: eveVersion,
 		}
-		var entryBytes []byte
-		if entryBytes, err = entry.Json(); err != nil {
+		entryBytes, err := entry.Json()
+		if err != nil {
 			log.Printf("Failed to marshal FullLogEntry message: %v", err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 		select {
 		case h.logChannel <- entryBytes:
 		default:
 		}
-		err = h.manager.WriteLogs(*u, entryBytes)
+		err = h.limits.use(h.managerFor(r), *u, len(entryBytes))
+		if err == nil {
+			err = h.managerFor(r).WriteLogs(*u, entryBytes)
+		}
 		if err != nil {
 			log.Printf("Failed to write log message: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			writeFailed(w, err)
 			return
 		}
+		h.loki.push(*u, "", entry.LogEntry)
+		h.syslog.push(*u, "", entry.LogEntry)
 	}
 
 	// send back a 201
@@ -360,47 +624,75 @@ func (h *apiHandler) newLogs(w http.ResponseWriter, r *http.Request) {
 	if u == nil {
 		return
 	}
-	gr, err := gzip.NewReader(r.Body)
+	body := h.streamLogBody(w, r, *u, common.KindLogs)
+	if body == nil {
+		return
+	}
+	head := &headReader{r: body}
+	gr, err := gzip.NewReader(head)
+	if err == errBodyTooLarge {
+		h.streamFailed(w, r, common.KindLogs, err)
+		return
+	}
 	if err != nil {
 		log.Printf("error gzip.NewReader: %v", err)
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		b, truncated := head.rest()
+		h.deadLetter(r, *u, common.KindLogs, b, truncated, err)
+		httpError(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 	msg := &logs.LogBundle{}
 	if err := json.Unmarshal([]byte(gr.Comment), msg); err != nil {
 		log.Printf("Failed to parse logbundle from Comment: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		b, truncated := head.rest()
+		h.deadLetter(r, *u, common.KindLogs, b, truncated, err)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	scanner := bufio.NewScanner(gr)
+	head.stop()
+	filter := h.logFilter(r, *u)
+	scanner := newEntryScanner(gr)
 	for scanner.Scan() {
 		le := &logs.LogEntry{}
 		if err := json.Unmarshal(scanner.Bytes(), le); err != nil {
 			log.Printf("Failed to parse logentry message: %v", err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			h.deadLetter(r, *u, common.KindLogs, gzipEntry(gr.Comment, scanner.Bytes()), false, err)
+			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
+		if !h.filters.keep(*u, filter, le.GetSeverity()) {
+			continue
+		}
 		entry := &common.FullLogEntry{
 			LogEntry:   le,
 			Image:      msg.GetImage(),
 			EveVersion: msg.GetEveVersion(),
 		}
-		var entryBytes []byte
-		if entryBytes, err = entry.Json(); err != nil {
+		entryBytes, err := entry.Json()
+		if err != nil {
 			log.Printf("Failed to marshal FullLogEntry message: %v", err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 		select {
 		case h.logChannel <- entryBytes:
 		default:
 		}
-		err = h.manager.WriteLogs(*u, entryBytes)
+		err = h.limits.use(h.managerFor(r), *u, len(entryBytes))
+		if err == nil {
+			err = h.managerFor(r).WriteLogs(*u, entryBytes)
+		}
 		if err != nil {
 			log.Printf("Failed to write logbundle message: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			writeFailed(w, err)
 			return
 		}
+		h.loki.push(*u, "", le)
+		h.syslog.push(*u, "", le)
+	}
+	if err := scanner.Err(); err != nil {
+		h.streamFailed(w, r, common.KindLogs, err)
+		return
 	}
 	w.WriteHeader(http.StatusCreated)
 }
@@ -412,38 +704,118 @@ func (h *apiHandler) appLogs(w http.ResponseWriter, r *http.Request) {
 	}
 	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		b, truncated := readDeadLetterBody(r.Body)
+		h.deadLetter(r, *u, common.KindAppLogs, b, truncated, err)
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mt, err := bodyType(r)
+	if err != nil {
+		log.Printf("Failed to parse appinstancelogbundle message: %v", err)
+		parseFailed(w, err)
 		return
 	}
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil || len(b) == 0 {
-		log.Printf("error reading request body: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	// a protobuf bundle is read an entry at a time, a JSON one can only be parsed whole
+	if mt == mimeProto {
+		h.streamAppLogs(w, r, *u, uid)
+		return
+	}
+	b := h.readLogBody(w, r, *u, common.KindAppLogs)
+	if b == nil {
+		return
+	}
+	if len(b) == 0 {
+		log.Printf("error reading request body: empty app instance log bundle")
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 	msg := &logs.AppInstanceLogBundle{}
-	if err := proto.Unmarshal(b, msg); err != nil {
+	if err := unmarshalBody(r, b, msg); err != nil {
 		log.Printf("Failed to parse appinstancelogbundle message: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		h.rejectMessage(w, r, *u, common.KindAppLogs, b, err)
 		return
 	}
+	filter := h.logFilter(r, *u)
 	for _, le := range msg.Log {
+		if !h.filters.keep(*u, filter, le.GetSeverity()) {
+			continue
+		}
 		var b []byte
 		if b, err = protojson.Marshal(le); err != nil {
 			log.Printf("Failed to marshal LogEntry message: %v", err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		select {
+		case h.logChannel <- b:
+		default:
+		}
+		err = h.limits.use(h.managerFor(r), *u, len(b))
+		if err == nil {
+			err = h.managerFor(r).WriteAppInstanceLogs(uid, *u, b)
+		}
+		if err != nil {
+			log.Printf("Failed to write appinstancelogbundle message: %v", err)
+			writeFailed(w, err)
+			return
+		}
+		h.loki.push(*u, uid.String(), le)
+		h.syslog.push(*u, uid.String(), le)
+	}
+	// send back a 201
+	w.WriteHeader(http.StatusCreated)
+}
+
+// streamAppLogs store the entries of a protobuf app instance log bundle as they are read, one at a time
+func (h *apiHandler) streamAppLogs(w http.ResponseWriter, r *http.Request, u, uid uuid.UUID) {
+	if r.ContentLength == 0 {
+		log.Printf("error reading request body: empty app instance log bundle")
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	body := h.streamLogBody(w, r, u, common.KindAppLogs)
+	if body == nil {
+		return
+	}
+	filter := h.logFilter(r, u)
+	// the log entries of an AppInstanceLogBundle are its field 1
+	scanner := newProtoEntryScanner(body, 1)
+	for scanner.Scan() {
+		le := &logs.LogEntry{}
+		if err := proto.Unmarshal(scanner.Bytes(), le); err != nil {
+			log.Printf("Failed to parse logentry message: %v", err)
+			h.deadLetter(r, u, common.KindAppLogs, protoEntry(1, scanner.Bytes()), false, err)
+			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !h.filters.keep(u, filter, le.GetSeverity()) {
+			continue
+		}
+		b, err := protojson.Marshal(le)
+		if err != nil {
+			log.Printf("Failed to marshal LogEntry message: %v", err)
+			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 		select {
 		case h.logChannel <- b:
 		default:
 		}
-		err = h.manager.WriteAppInstanceLogs(uid, *u, b)
+		err = h.limits.use(h.managerFor(r), u, len(b))
+		if err == nil {
+			err = h.managerFor(r).WriteAppInstanceLogs(uid, u, b)
+		}
 		if err != nil {
 			log.Printf("Failed to write appinstancelogbundle message: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			writeFailed(w, err)
 			return
 		}
+		h.loki.push(u, uid.String(), le)
+		h.syslog.push(u, uid.String(), le)
+	}
+	if err := scanner.Err(); err != nil {
+		h.streamFailed(w, r, common.KindAppLogs, err)
+		return
 	}
 	// send back a 201
 	w.WriteHeader(http.StatusCreated)
@@ -456,39 +828,67 @@ func (h *apiHandler) newAppLogs(w http.ResponseWriter, r *http.Request) {
 	}
 	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		b, truncated := readDeadLetterBody(r.Body)
+		h.deadLetter(r, *u, common.KindAppLogs, b, truncated, err)
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body := h.streamLogBody(w, r, *u, common.KindAppLogs)
+	if body == nil {
+		return
+	}
+	head := &headReader{r: body}
+	gr, err := gzip.NewReader(head)
+	if err == errBodyTooLarge {
+		h.streamFailed(w, r, common.KindAppLogs, err)
 		return
 	}
-	gr, err := gzip.NewReader(r.Body)
 	if err != nil {
 		log.Printf("error gzip.NewReader: %v", err)
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		b, truncated := head.rest()
+		h.deadLetter(r, *u, common.KindAppLogs, b, truncated, err)
+		httpError(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
-	scanner := bufio.NewScanner(gr)
+	head.stop()
+	filter := h.logFilter(r, *u)
+	scanner := newEntryScanner(gr)
 	for scanner.Scan() {
 		le := &logs.LogEntry{}
 		if err := json.Unmarshal(scanner.Bytes(), le); err != nil {
 			log.Printf("Failed to parse logentry message: %v", err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			h.deadLetter(r, *u, common.KindAppLogs, gzipEntry(gr.Comment, scanner.Bytes()), false, err)
+			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
+		if !h.filters.keep(*u, filter, le.GetSeverity()) {
+			continue
+		}
 		var b []byte
 		if b, err = protojson.Marshal(le); err != nil {
 			log.Printf("Failed to marshal LogEntry message: %v", err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 		select {
 		case h.logChannel <- b:
 		default:
 		}
-		err = h.manager.WriteAppInstanceLogs(uid, *u, b)
+		err = h.limits.use(h.managerFor(r), *u, len(b))
+		if err == nil {
+			err = h.managerFor(r).WriteAppInstanceLogs(uid, *u, b)
+		}
 		if err != nil {
 			log.Printf("Failed to write appinstancelogbundle message: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			writeFailed(w, err)
 			return
 		}
+		h.loki.push(*u, uid.String(), le)
+		h.syslog.push(*u, uid.String(), le)
+	}
+	if err := scanner.Err(); err != nil {
+		h.streamFailed(w, r, common.KindAppLogs, err)
+		return
 	}
 	// send back a 201
 	w.WriteHeader(http.StatusCreated)
@@ -502,7 +902,7 @@ func getClientConfigRequest(r *http.Request) (*config.ConfigRequest, error) {
 		return nil, err
 	}
 	configRequest := &config.ConfigRequest{}
-	err = proto.Unmarshal(body, configRequest)
+	err = unmarshalBody(r, body, configRequest)
 	if err != nil {
 		log.Printf("Unmarshalling failed: %v", err)
 		return nil, err
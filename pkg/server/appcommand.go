@@ -0,0 +1,356 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/config"
+	"github.com/lf-edge/eve/api/go/info"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// maxFinishedAppCommands how many done or failed commands are kept per device, the oldest going first
+const maxFinishedAppCommands = 50
+
+// AppCommandRequest a command to queue for an app instance of a device
+type AppCommandRequest struct {
+	// App UUID or display name of the app instance, in the config of the device
+	App string `json:"app"`
+	// Command restart or purge
+	Command string `json:"command"`
+}
+
+// appCommander the commands to the app instances of devices, sent through their config as the ones before them on the
+// same app instance finish
+type appCommander struct {
+	// lock serializes changes to the commands of devices, between admin requests and the info messages of devices
+	lock sync.Mutex
+}
+
+// add queue a command to an app instance of a device, sending it right away unless another one of the app instance is
+// being acted on
+func (c *appCommander) add(m driver.DeviceManager, u uuid.UUID, req AppCommandRequest) (*common.AppCommand, error) {
+	if err := common.ValidateAppCommand(req.Command); err != nil {
+		return nil, err
+	}
+	if err := checkWritable(m, u); err != nil {
+		return nil, err
+	}
+	b, err := m.GetConfig(u)
+	if err != nil {
+		return nil, err
+	}
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("error processing existing config: %v", err)
+	}
+	app := findApp(&conf, req.App)
+	if app == nil {
+		return nil, fmt.Errorf("no app instance %s in the config of the device", req.App)
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, fmt.Errorf("error generating command ID: %v", err)
+	}
+	now := time.Now()
+	cmd := common.AppCommand{
+		ID:      id.String(),
+		App:     app.GetUuidandversion().GetUuid(),
+		Command: req.Command,
+		State:   common.AppCommandQueued,
+		Created: now,
+		Updated: now,
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	commands, err := m.GetAppCommands(u)
+	if err != nil {
+		return nil, err
+	}
+	commands = pruneAppCommands(append(commands, cmd))
+	c.deliver(m, u, commands, now)
+	if err := m.SetAppCommands(u, commands); err != nil {
+		return nil, fmt.Errorf("error saving commands: %v", err)
+	}
+	for i := range commands {
+		if commands[i].ID == cmd.ID {
+			return &commands[i], nil
+		}
+	}
+	return &cmd, nil
+}
+
+// remove remove a command of a device that is not being acted on, returning it, nil if there is no such command, with
+// an error if it was sent and has not finished
+func (c *appCommander) remove(m driver.DeviceManager, u uuid.UUID, id string) (*common.AppCommand, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	commands, err := m.GetAppCommands(u)
+	if err != nil {
+		return nil, err
+	}
+	for i, cmd := range commands {
+		if cmd.ID != id {
+			continue
+		}
+		if cmd.State == common.AppCommandSent || cmd.State == common.AppCommandInProgress {
+			return &cmd, fmt.Errorf("command %s is %s, it can be removed once it finishes", id, cmd.State)
+		}
+		if err := m.SetAppCommands(u, append(commands[:i:i], commands[i+1:]...)); err != nil {
+			return nil, fmt.Errorf("error saving commands: %v", err)
+		}
+		return &cmd, nil
+	}
+	return nil, nil
+}
+
+// observe follow the sent commands of a device from an info message about one of its app instances, sending the next
+// queued command of the app instance once the one before it finishes. Failures are logged, the message is stored
+// already
+func (c *appCommander) observe(m driver.DeviceManager, u uuid.UUID, msg *info.ZInfoMsg) {
+	a := msg.GetAinfo()
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	at := now
+	if ts := msg.GetAtTimeStamp(); ts != nil {
+		at = ts.AsTime()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	commands, err := m.GetAppCommands(u)
+	if err != nil {
+		log.Printf("error getting the app commands of %s: %v", u, err)
+		return
+	}
+	changed := false
+	for i := range commands {
+		if strings.EqualFold(commands[i].App, a.GetAppID()) && commands[i].Observe(a, at) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	c.deliver(m, u, commands, now)
+	if err := m.SetAppCommands(u, pruneAppCommands(commands)); err != nil {
+		log.Printf("error saving the app commands of %s: %v", u, err)
+	}
+}
+
+// deliver send the first queued command of each app instance of a device that has no command being acted on, one
+// config change each. Commands that cannot be sent fail, with why
+func (c *appCommander) deliver(m driver.DeviceManager, u uuid.UUID, commands []common.AppCommand, now time.Time) {
+	busy := map[string]bool{}
+	for _, cmd := range commands {
+		if cmd.State == common.AppCommandSent || cmd.State == common.AppCommandInProgress {
+			busy[cmd.App] = true
+		}
+	}
+	for i := range commands {
+		cmd := &commands[i]
+		if cmd.State != common.AppCommandQueued || busy[cmd.App] {
+			continue
+		}
+		if err := sendAppCommand(m, u, cmd, now); err != nil {
+			cmd.State = common.AppCommandFailed
+			cmd.Error = err.Error()
+			cmd.Sent = nil
+			cmd.Updated = now
+			continue
+		}
+		busy[cmd.App] = true
+	}
+}
+
+// sendAppCommand bump the counter of a command in the config of its app instance, and set the config
+func sendAppCommand(m driver.DeviceManager, u uuid.UUID, cmd *common.AppCommand, now time.Time) error {
+	b, err := m.GetConfig(u)
+	if err != nil {
+		return fmt.Errorf("error retrieving existing config: %v", err)
+	}
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal(b, &conf); err != nil {
+		return fmt.Errorf("error processing existing config: %v", err)
+	}
+	app := findApp(&conf, cmd.App)
+	if app == nil {
+		return fmt.Errorf("app instance %s not in the config of the device", cmd.App)
+	}
+	cmd.Apply(app, now)
+	if b, err = protojson.Marshal(&conf); err != nil {
+		return fmt.Errorf("error processing device config: %v", err)
+	}
+	if _, err := applyChange(m, nil, b, "app-command:"+cmd.ID, u.String()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// findApp the app instance of a config with a UUID or display name, nil if there is none
+func findApp(conf *config.EdgeDevConfig, app string) *config.AppInstanceConfig {
+	for _, a := range conf.GetApps() {
+		if strings.EqualFold(a.GetUuidandversion().GetUuid(), app) {
+			return a
+		}
+	}
+	for _, a := range conf.GetApps() {
+		if a.GetDisplayname() == app {
+			return a
+		}
+	}
+	return nil
+}
+
+// pruneAppCommands drop the oldest finished commands beyond maxFinishedAppCommands
+func pruneAppCommands(commands []common.AppCommand) []common.AppCommand {
+	finished := 0
+	for _, cmd := range commands {
+		if cmd.Finished() {
+			finished++
+		}
+	}
+	pruned := commands[:0]
+	for _, cmd := range commands {
+		if cmd.Finished() && finished > maxFinishedAppCommands {
+			finished--
+			continue
+		}
+		pruned = append(pruned, cmd)
+	}
+	return pruned
+}
+
+func (h *adminHandler) appCommandList(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	commands, err := h.managerFor(r).GetAppCommands(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting app commands of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if commands == nil {
+		commands = []common.AppCommand{}
+	}
+	h.writeAppCommand(w, http.StatusOK, commands)
+}
+
+func (h *adminHandler) appCommandGet(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	commands, err := h.managerFor(r).GetAppCommands(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting app commands of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	for _, cmd := range commands {
+		if cmd.ID == id {
+			h.writeAppCommand(w, http.StatusOK, cmd)
+			return
+		}
+	}
+	httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+}
+
+func (h *adminHandler) appCommandAdd(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req AppCommandRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad app command: %v", err), http.StatusBadRequest)
+		return
+	}
+	cmd, err := h.commands.add(h.managerFor(r), uid, req)
+	_, isNotFound := err.(*common.NotFoundError)
+	_, isReadOnly := err.(*errDeviceReadOnly)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil && isReadOnly:
+		writeError(w, http.StatusForbidden, ErrDeviceReadOnly, err.Error(), nil)
+		return
+	case err != nil:
+		httpError(w, fmt.Sprintf("bad app command: %v", err), http.StatusBadRequest)
+		return
+	}
+	h.audit(r, auditAppCommandAdd, uid.String(), nil, cmd)
+	h.writeAppCommand(w, http.StatusCreated, cmd)
+}
+
+func (h *adminHandler) appCommandRemove(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	cmd, err := h.commands.remove(h.managerFor(r), uid, mux.Vars(r)["id"])
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound, err == nil && cmd == nil:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case err != nil && cmd != nil:
+		httpError(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		log.Printf("error removing app command of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		h.audit(r, auditAppCommandRemove, uid.String(), cmd, nil)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (h *adminHandler) writeAppCommand(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting app command to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+)
+
+// archiver the Archiver of a DeviceManager, if it supports archiving and has somewhere to archive to
+func archiver(m driver.DeviceManager) (driver.Archiver, bool) {
+	a, ok := m.(driver.Archiver)
+	if !ok || a.ArchiveLocation() == "" {
+		return nil, false
+	}
+	return a, true
+}
+
+// archiveRun move the older entries of device streams to the archive now
+func (h *adminHandler) archiveRun(w http.ResponseWriter, r *http.Request) {
+	a, ok := archiver(h.manager)
+	if !ok {
+		httpError(w, "archiving not supported by the "+h.manager.Name()+" driver, or no archive set in its database URL", http.StatusNotImplemented)
+		return
+	}
+	archived, err := a.Archive()
+	if len(archived) > 0 {
+		var entries int
+		for _, s := range archived {
+			entries += s.Entries
+		}
+		h.audit(r, auditArchive, a.ArchiveLocation(), nil, map[string]interface{}{"streams": len(archived), "entries": entries})
+	}
+	if err != nil {
+		log.Printf("error archiving: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(archived)
+	if err != nil {
+		log.Printf("error converting archived streams to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// archive move the older entries of device streams to the archive every interval, until done is closed
+func archive(a driver.Archiver, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		archived, err := a.Archive()
+		for _, s := range archived {
+			log.Printf("archived %d entries of %s to %s", s.Entries, s.Stream, a.ArchiveLocation())
+		}
+		if err != nil {
+			log.Printf("error archiving: %v", err)
+		}
+	}
+}
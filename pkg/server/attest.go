@@ -0,0 +1,264 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/attest"
+	"github.com/lf-edge/eve/api/go/certs"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+// attestNonceSize the size of the nonces devices quote, and of the integrity tokens they store their keys with
+const attestNonceSize = 32
+
+// DeviceAttestation the attestation of a device, as shown to admins: its certificates, when it last attested, and the
+// types and digests of the keys it escrowed, without the keys themselves
+type DeviceAttestation struct {
+	Attested    bool                `json:"attested"`
+	Attestation *common.Attestation `json:"attestation,omitempty"`
+}
+
+// attest the attestation of a device with a TPM, in the order EVE goes through it: it publishes its certificates,
+// asks for a nonce, quotes its PCRs with it, and is then given an integrity token, and the keys of its volume vaults
+// it escrowed before, to unlock its encrypted storage. It escrows its keys again with the token.
+// The quote is checked to include the nonce, and for a restricted signing certificate to verify it with, but neither
+// its signature nor the values of the PCRs are verified: any device that quotes its nonce attests
+func (h *apiHandler) attest(w http.ResponseWriter, r *http.Request) {
+	u := h.checkCertAndRecord(w, r)
+	if u == nil {
+		return
+	}
+	b := h.readBody(w, r, common.KindRequests)
+	if b == nil {
+		return
+	}
+	msg := &attest.ZAttestReq{}
+	if err := unmarshalBody(r, b, msg); err != nil {
+		log.Printf("Failed to parse attest request: %v", err)
+		parseFailed(w, err)
+		return
+	}
+	m := h.managerFor(r)
+	a, err := m.GetAttestation(*u)
+	if err != nil {
+		log.Printf("error getting attestation of %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		a = &common.Attestation{}
+	}
+	var response *attest.ZAttestResponse
+	switch msg.ReqType {
+	case attest.ZAttestReqType_ATTEST_REQ_CERT:
+		response = attestCerts(a, msg.Certs)
+	case attest.ZAttestReqType_ATTEST_REQ_NONCE:
+		response, err = attestNonce(a)
+	case attest.ZAttestReqType_ATTEST_REQ_QUOTE:
+		response, err = attestQuote(a, msg.Quote)
+	case attest.ZAttestReqType_Z_ATTEST_REQ_TYPE_STORE_KEYS:
+		response = attestStoreKeys(a, msg.StorageKeys)
+	default:
+		httpError(w, fmt.Sprintf("unsupported attest request type %s", msg.ReqType), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("error attesting %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := m.SetAttestation(*u, a); err != nil {
+		log.Printf("error saving attestation of %s: %v", u, err)
+		writeFailed(w, err)
+		return
+	}
+	writeMessage(w, r, response)
+}
+
+// attestCerts keep the certificates a device published, replacing those of the same types
+func attestCerts(a *common.Attestation, zcerts []*certs.ZCert) *attest.ZAttestResponse {
+	now := time.Now().UTC()
+	for _, c := range zcerts {
+		a.SetCert(common.AttestCert{Type: c.GetType().String(), Cert: c.GetCert(), TPM: c.GetAttributes().GetIsTpm(), Received: now})
+	}
+	return &attest.ZAttestResponse{RespType: attest.ZAttestRespType_ATTEST_RESP_CERT}
+}
+
+// attestNonce give a device a new nonce to quote, replacing any it was given before
+func attestNonce(a *common.Attestation) (*attest.ZAttestResponse, error) {
+	nonce, err := attestRandom()
+	if err != nil {
+		return nil, err
+	}
+	a.Nonce = nonce
+	return &attest.ZAttestResponse{
+		RespType: attest.ZAttestRespType_ATTEST_RESP_NONCE,
+		Nonce:    &attest.ZAttestNonceResp{Nonce: nonce},
+	}, nil
+}
+
+// attestQuote check the quote of a device, and if it attests, give it a new integrity token and the keys it escrowed.
+// The nonce is used up either way
+func attestQuote(a *common.Attestation, quote *attest.ZAttestQuote) (*attest.ZAttestResponse, error) {
+	response := &attest.ZAttestResponse{RespType: attest.ZAttestRespType_ATTEST_RESP_QUOTE_RESP, QuoteResp: &attest.ZAttestQuoteResp{}}
+	nonce := a.Nonce
+	a.Nonce = nil
+	switch {
+	case len(nonce) == 0 || !bytes.Contains(quote.GetAttestData(), nonce):
+		response.QuoteResp.Response = attest.ZAttestResponseCode_Z_ATTEST_RESPONSE_CODE_NONCE_MISMATCH
+		return response, nil
+	case a.Cert(certs.ZCertType_CERT_TYPE_DEVICE_RESTRICTED_SIGNING.String()) == nil:
+		response.QuoteResp.Response = attest.ZAttestResponseCode_Z_ATTEST_RESPONSE_CODE_NO_CERT_FOUND
+		return response, nil
+	}
+	token, err := attestRandom()
+	if err != nil {
+		return nil, err
+	}
+	a.IntegrityToken = token
+	a.Attested = time.Now().UTC()
+	a.PCRs = map[string]string{}
+	for _, pcr := range quote.GetPcrValues() {
+		algo := strings.ToLower(strings.TrimPrefix(pcr.GetHashAlgo().String(), "TPM_HASH_ALGO_"))
+		a.PCRs[fmt.Sprintf("%s:%d", algo, pcr.GetIndex())] = hex.EncodeToString(pcr.GetValue())
+	}
+	response.QuoteResp.Response = attest.ZAttestResponseCode_Z_ATTEST_RESPONSE_CODE_SUCCESS
+	response.QuoteResp.IntegrityToken = token
+	for _, k := range a.Keys {
+		response.QuoteResp.Keys = append(response.QuoteResp.Keys, &attest.AttestVolumeKey{
+			KeyType: attest.AttestVolumeKeyType(attest.AttestVolumeKeyType_value[k.Type]),
+			Key:     k.EncryptedKey,
+		})
+	}
+	return response, nil
+}
+
+// attestStoreKeys escrow the encrypted keys of the volume vaults of a device, replacing those it escrowed before, if
+// it presents the integrity token of its last attestation
+func attestStoreKeys(a *common.Attestation, storage *attest.AttestStorageKeys) *attest.ZAttestResponse {
+	response := &attest.ZAttestResponse{RespType: attest.ZAttestRespType_Z_ATTEST_RESP_TYPE_STORE_KEYS, StorageKeysResp: &attest.AttestStorageKeysResp{}}
+	if len(a.IntegrityToken) == 0 || !bytes.Equal(storage.GetIntegrityToken(), a.IntegrityToken) {
+		response.StorageKeysResp.Response = attest.AttestStorageKeysResponseCode_ATTEST_STORAGE_KEYS_RESPONSE_CODE_ITOKEN_MISMATCH
+		return response
+	}
+	now := time.Now().UTC()
+	a.Keys = nil
+	for _, k := range storage.GetKeys() {
+		key := common.VaultKey{Type: k.GetKeyType().String(), EncryptedKey: k.GetKey(), Stored: now}
+		// EVE sends the key encrypted with its digest, which is kept to tell the keys apart without them
+		data := &attest.AttestVolumeKeyData{}
+		if err := proto.Unmarshal(k.GetKey(), data); err == nil {
+			key.DigestSHA256 = data.GetDigestSha256()
+		}
+		a.Keys = append(a.Keys, key)
+	}
+	response.StorageKeysResp.Response = attest.AttestStorageKeysResponseCode_ATTEST_STORAGE_KEYS_RESPONSE_CODE_SUCCESS
+	return response
+}
+
+// attestRandom a random nonce or integrity token
+func attestRandom() ([]byte, error) {
+	b := make([]byte, attestNonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("error generating random bytes: %v", err)
+	}
+	return b, nil
+}
+
+func (h *adminHandler) deviceAttestationGet(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a, ok := h.deviceAttestation(w, h.managerFor(r), uid)
+	if !ok {
+		return
+	}
+	writeDeviceAttestation(w, a)
+}
+
+// deviceAttestationRemove reset the attestation of a device, e.g. once its TPM was cleared, removing its certificates
+// and the keys it escrowed, which it cannot decrypt any more then
+func (h *adminHandler) deviceAttestationRemove(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	m := h.managerFor(r)
+	before, ok := h.deviceAttestation(w, m, uid)
+	if !ok {
+		return
+	}
+	if before == nil {
+		writeDeviceAttestation(w, nil)
+		return
+	}
+	if err := m.SetAttestation(uid, nil); err != nil {
+		log.Printf("error resetting attestation of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditAttestReset, uid.String(), redactAttestation(before), nil)
+	log.Printf("attestation of device %s reset", uid)
+	writeDeviceAttestation(w, nil)
+}
+
+// deviceAttestation the attestation of a device, and whether it was found, the error having been answered if not
+func (h *adminHandler) deviceAttestation(w http.ResponseWriter, m driver.DeviceManager, uid uuid.UUID) (*common.Attestation, bool) {
+	a, err := m.GetAttestation(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		log.Printf("error getting attestation of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	return a, true
+}
+
+// redactAttestation a copy of an attestation without the keys escrowed, nor the nonce and token they are given with
+func redactAttestation(a *common.Attestation) *common.Attestation {
+	if a == nil {
+		return nil
+	}
+	redacted := *a
+	redacted.Nonce, redacted.IntegrityToken = nil, nil
+	redacted.Keys = make([]common.VaultKey, len(a.Keys))
+	for i, k := range a.Keys {
+		k.EncryptedKey = nil
+		redacted.Keys[i] = k
+	}
+	return &redacted
+}
+
+func writeDeviceAttestation(w http.ResponseWriter, a *common.Attestation) {
+	body, err := json.Marshal(DeviceAttestation{Attested: a != nil && !a.Attested.IsZero(), Attestation: redactAttestation(a)})
+	if err != nil {
+		log.Printf("error converting attestation to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
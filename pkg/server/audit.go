@@ -0,0 +1,250 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/eve/api/go/config"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	auditOnboardAdd       = "onboard-add"
+	auditOnboardGenerate  = "onboard-generate"
+	auditOnboardRemove    = "onboard-remove"
+	auditOnboardClear     = "onboard-clear"
+	auditOnboardPolicySet = "onboard-policy-set"
+	auditDeviceAdd        = "device-add"
+	auditDeviceRemove     = "device-remove"
+	auditDeviceClear      = "device-clear"
+	auditDeviceRestore    = "device-restore"
+	auditCertRevoke       = "cert-revoke"
+	auditCertUnrevoke     = "cert-unrevoke"
+	auditConfigSet        = "config-set"
+	auditQuotaSet         = "quota-set"
+	auditLogFilterSet     = "log-filter-set"
+	auditLogLevelSet      = "log-level-set"
+	auditProfileSet       = "local-profile-set"
+	auditMetadataSet      = "metadata-set"
+	auditDeviceModelSet   = "device-model-set"
+	auditAppCommandAdd    = "app-command-add"
+	auditAppCommandRemove = "app-command-remove"
+	auditDeviceReboot     = "device-reboot"
+	auditBaseOSUpdate     = "baseos-update"
+	auditPendingApprove   = "pending-approve"
+	auditPendingReject    = "pending-reject"
+	auditTokenAdd         = "token-add"
+	auditTokenRemove      = "token-remove"
+	auditRolloutCreate    = "rollout-create"
+	auditRolloutPause     = "rollout-pause"
+	auditRolloutResume    = "rollout-resume"
+	auditRolloutRemove    = "rollout-remove"
+	auditScheduleAdd      = "schedule-add"
+	auditScheduleRemove   = "schedule-remove"
+	auditCanaryCreate     = "canary-create"
+	auditCanaryRevert     = "canary-revert"
+	auditCanaryRemove     = "canary-remove"
+	auditAlertAdd         = "alert-rule-add"
+	auditAlertRemove      = "alert-rule-remove"
+	auditSnapshotAdd      = "snapshot-add"
+	auditSnapshotRemove   = "snapshot-remove"
+	auditModelAdd         = "hardware-model-add"
+	auditModelRemove      = "hardware-model-remove"
+	auditDatastoreAdd     = "datastore-add"
+	auditDatastoreRemove  = "datastore-remove"
+	auditImageAdd         = "image-add"
+	auditImageRemove      = "image-remove"
+	auditDeadLetterReplay = "dead-letter-replay"
+	auditDeadLetterRemove = "dead-letter-remove"
+	auditReplayStart      = "replay-start"
+	auditReplayCancel     = "replay-cancel"
+	auditFaultAdd         = "fault-add"
+	auditFaultRemove      = "fault-remove"
+	auditGC               = "gc"
+	auditArchive          = "archive"
+	auditStateRestore     = "state-restore"
+	auditFlagSet          = "device-flag-set"
+	auditFlagRemove       = "device-flag-remove"
+	auditQuarantine       = "device-quarantine"
+	auditRelease          = "device-release"
+	auditAttestReset      = "device-attestation-reset"
+)
+
+// AuditRecord record of a single admin mutation
+type AuditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Actor who made the change, e.g. "token:<ID>" for an API token, "cert:<CN>" for a client certificate,
+	// "rollout:<ID>" for a config rollout, "schedule:<ID>" for a scheduled config change, "canary:<ID>" for a config
+	// canary, "app-command:<ID>" for a command to an app instance or "socket" for a request on the admin socket
+	Actor    string `json:"actor"`
+	ClientIP string `json:"client-ip"`
+	Action   string `json:"action"`
+	// Target what was changed, e.g. the device UUID or onboard CN, empty for clear operations
+	Target string `json:"target,omitempty"`
+	// Before and After summaries of the state of the target
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// auditFilter filter for reading the audit log, empty fields match everything
+type auditFilter struct {
+	action string
+	actor  string
+	target string
+	since  time.Time
+	until  time.Time
+}
+
+func (f auditFilter) match(a *AuditRecord) bool {
+	switch {
+	case f.action != "" && f.action != a.Action:
+		return false
+	case f.actor != "" && f.actor != a.Actor:
+		return false
+	case f.target != "" && f.target != a.Target:
+		return false
+	case !f.since.IsZero() && a.Timestamp.Before(f.since):
+		return false
+	case !f.until.IsZero() && a.Timestamp.After(f.until):
+		return false
+	}
+	return true
+}
+
+// auditActor identify who made an admin request. A client certificate only identifies it once authenticate verified
+// it against the admin CAs, as anyone can present a self-signed one with any CN
+func auditActor(r *http.Request) string {
+	if t := requestToken(r); t != nil {
+		return "token:" + t.ID
+	}
+	if c := requestAdminCert(r); c != nil {
+		return "cert:" + c.Subject.CommonName
+	}
+	if fromSocket(r) {
+		return "socket"
+	}
+	return "anonymous"
+}
+
+// audit record an admin mutation. Failures are logged, but do not fail the request, as the change is already made
+func (h *adminHandler) audit(r *http.Request, action, target string, before, after interface{}) {
+	writeAudit(h.managerFor(r), AuditRecord{
+		Timestamp: time.Now(),
+		Actor:     auditActor(r),
+		ClientIP:  r.RemoteAddr,
+		Action:    action,
+		Target:    target,
+		Before:    before,
+		After:     after,
+	})
+}
+
+// writeAudit save an audit record, logging failures
+func writeAudit(m driver.DeviceManager, record AuditRecord) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("error encoding audit record: %v", err)
+		return
+	}
+	if err := m.WriteAudit(b); err != nil {
+		log.Printf("error saving audit record for %s %s: %v", record.Action, record.Target, err)
+	}
+}
+
+// parseAuditFilter get the audit filter from the query parameters
+func parseAuditFilter(r *http.Request) (auditFilter, error) {
+	q := r.URL.Query()
+	f := auditFilter{
+		action: q.Get("action"),
+		actor:  q.Get("actor"),
+		target: q.Get("target"),
+	}
+	var err error
+	if s := q.Get("since"); s != "" {
+		if f.since, err = time.Parse(time.RFC3339, s); err != nil {
+			return f, fmt.Errorf("invalid since %s: %v", s, err)
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if f.until, err = time.Parse(time.RFC3339, s); err != nil {
+			return f, fmt.Errorf("invalid until %s: %v", s, err)
+		}
+	}
+	return f, nil
+}
+
+func (h *adminHandler) auditGet(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reader, err := h.managerFor(r).GetAuditReader()
+	if err != nil {
+		log.Printf("error reading audit log: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	// records are concatenated JSON objects, possibly separated by whitespace
+	decoder := json.NewDecoder(reader)
+	encoder := json.NewEncoder(w)
+	for {
+		var record AuditRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("error decoding audit log: %v", err)
+			return
+		}
+		if !filter.match(&record) {
+			continue
+		}
+		if err := encoder.Encode(record); err != nil {
+			return
+		}
+	}
+}
+
+// deviceSummary summary of a device for the audit log, without the certificates themselves
+func deviceSummary(cert, onboard *x509.Certificate, serial string) map[string]interface{} {
+	summary := map[string]interface{}{}
+	if cert != nil {
+		summary["cert-sha256"] = fmt.Sprintf("%x", sha256.Sum256(cert.Raw))
+	}
+	if onboard != nil {
+		summary["onboard"] = onboard.Subject.CommonName
+	}
+	if serial != "" {
+		summary["serial"] = serial
+	}
+	return summary
+}
+
+// configSummary summary of a device config for the audit log
+func configSummary(b []byte) map[string]interface{} {
+	summary := map[string]interface{}{
+		"sha256": fmt.Sprintf("%x", sha256.Sum256(b)),
+	}
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal(b, &conf); err == nil && conf.Id != nil {
+		summary["version"] = conf.Id.Version
+	}
+	return summary
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	ax "github.com/lf-edge/adam/pkg/x509"
+	"github.com/lf-edge/eve/api/go/auth"
+	"github.com/lf-edge/eve/api/go/certs"
+	"github.com/lf-edge/eve/api/go/evecommon"
+	"google.golang.org/protobuf/proto"
+)
+
+// signer the key of the server certificate, which signs the messages of the v2 API, and the certificate itself
+func (c *certStore) signer() (crypto.Signer, []byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil || len(c.cert.Certificate) == 0 {
+		return nil, nil, errors.New("no server certificate")
+	}
+	signer, ok := c.cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("server key of type %T cannot sign", c.cert.PrivateKey)
+	}
+	return signer, c.cert.Certificate[0], nil
+}
+
+// readAuthContainer read the AuthContainer a device on the v2 API wraps its request in, verified to be signed by
+// the key of its device certificate, and unmarshal its payload into msg. Answers the error and returns false if
+// it is not
+func (h *apiHandler) readAuthContainer(w http.ResponseWriter, r *http.Request, msg proto.Message) bool {
+	b := h.readBody(w, r, common.KindRequests)
+	if b == nil {
+		return false
+	}
+	var container auth.AuthContainer
+	if err := unmarshalBody(r, b, &container); err != nil {
+		log.Printf("Failed to parse auth container: %v", err)
+		parseFailed(w, err)
+		return false
+	}
+	payload, err := ax.VerifyAuthContainer(&container, getClientCert(r))
+	if err != nil {
+		log.Printf("invalid auth container: %v", err)
+		writeError(w, http.StatusUnauthorized, ErrInvalidAuth, fmt.Sprintf("invalid auth container: %v", err), nil)
+		return false
+	}
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		log.Printf("Failed to parse auth container payload: %v", err)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeAuthContainer answer a device on the v2 API with msg wrapped in an AuthContainer signed by the key of the
+// server certificate, which devices get from /certs
+func (h *apiHandler) writeAuthContainer(w http.ResponseWriter, r *http.Request, msg proto.Message) {
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		log.Printf("error marshaling %T: %v", msg, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	signer, cert, err := h.certs.signer()
+	if err == nil {
+		var container *auth.AuthContainer
+		if container, err = ax.SignAuthContainer(payload, signer, cert); err == nil {
+			writeMessage(w, r, container)
+			return
+		}
+	}
+	log.Printf("error signing %T: %v", msg, err)
+	httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// controllerCerts the certificates of the controller: the server certificate, whose key signs the messages of the
+// v2 API, and its intermediates. Not limited to registered devices, as devices get them before registering
+func (h *apiHandler) controllerCerts(w http.ResponseWriter, r *http.Request) {
+	msg := &certs.ZControllerCert{}
+	for i, c := range h.certs.certificates() {
+		t := certs.ZCertType_CERT_TYPE_CONTROLLER_INTERMEDIATE
+		if i == 0 {
+			t = certs.ZCertType_CERT_TYPE_CONTROLLER_SIGNING
+		}
+		msg.Certs = append(msg.Certs, &certs.ZCert{
+			HashAlgo: evecommon.HashAlgorithm_HASH_ALGORITHM_SHA256_32BYTES,
+			CertHash: ax.CertHash(c.Raw),
+			Type:     t,
+			Cert:     ax.PemEncodeCert(c.Raw),
+		})
+	}
+	h.writeAuthContainer(w, r, msg)
+}
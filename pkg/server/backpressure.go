@@ -0,0 +1,289 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/eve/api/go/config"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// DefaultBackpressureInterval how often the load of ingest is checked, if the backpressure does not set it
+	DefaultBackpressureInterval = 30 * time.Second
+	// DefaultBackpressureRecover how many checks in a row ingest must be under the thresholds before the backpressure
+	// is released, if it does not set it
+	DefaultBackpressureRecover = 4
+)
+
+// Backpressure slowing devices down while ingest is overloaded, by serving them config items that make them send
+// less often, e.g. timer.metric.interval, and serving them their own again once the load subsides
+type Backpressure struct {
+	// Items config items served in place of those of the configs of the devices while engaged, by key. A numeric
+	// item of a config larger than that of the backpressure is kept, so that no device is made to send more often
+	Items map[string]string
+	// Tags the tags, as for DeviceMetadata.Match, of the devices slowed down; empty means the whole fleet
+	Tags []string
+	// Rate ingest requests per second, posting info, metrics or logs, at or past which ingest is overloaded; 0 means
+	// not to look at the rate
+	Rate float64
+	// Shed requests shed or timed out under the EndpointBudgets between two checks at or past which ingest is
+	// overloaded; 0 means not to look at them
+	Shed uint64
+	// Interval how often the load is checked; 0 means DefaultBackpressureInterval
+	Interval time.Duration
+	// Recover how many checks in a row ingest must be under the thresholds before the backpressure is released; 0
+	// means DefaultBackpressureRecover
+	Recover int
+}
+
+// ParseBackpressure parse the items of a backpressure, as <key>=<value>, and when it is engaged, from
+// [rate=<requests per second>][,shed=<requests>][,interval=<duration>][,recover=<checks>]
+func ParseBackpressure(items []string, spec string) (*Backpressure, error) {
+	b := &Backpressure{Items: map[string]string{}}
+	for _, item := range items {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("bad config item %q, must be <key>=<value>", item)
+		}
+		b.Items[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if len(b.Items) == 0 {
+		return nil, fmt.Errorf("no config items to serve while overloaded")
+	}
+	for _, part := range strings.Split(spec, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad backpressure option %q, must be key=value", part)
+		}
+		var err error
+		switch kv[0] {
+		case "rate":
+			b.Rate, err = strconv.ParseFloat(kv[1], 64)
+			if err == nil && b.Rate < 0 {
+				err = fmt.Errorf("must be at least 0")
+			}
+		case "shed":
+			b.Shed, err = strconv.ParseUint(kv[1], 10, 64)
+		case "interval":
+			b.Interval, err = time.ParseDuration(kv[1])
+			if err == nil && b.Interval < 0 {
+				err = fmt.Errorf("must be at least 0")
+			}
+		case "recover":
+			b.Recover, err = strconv.Atoi(kv[1])
+			if err == nil && b.Recover < 0 {
+				err = fmt.Errorf("must be at least 0")
+			}
+		default:
+			return nil, fmt.Errorf("unknown backpressure option %q, must be rate, shed, interval or recover", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad backpressure %s %q: %v", kv[0], kv[1], err)
+		}
+	}
+	if b.Rate == 0 && b.Shed == 0 {
+		return nil, fmt.Errorf("backpressure without a rate or shed threshold")
+	}
+	return b, nil
+}
+
+// BackpressureStatus whether the backpressure is engaged, with the load of ingest at the last check
+type BackpressureStatus struct {
+	Engaged bool `json:"engaged"`
+	// Since when the backpressure was last engaged or released, unset if it never was
+	Since *time.Time `json:"since,omitempty"`
+	// Rate ingest requests per second between the last two checks
+	Rate float64 `json:"rate"`
+	// Shed requests shed or timed out between the last two checks
+	Shed uint64 `json:"shed"`
+	// Calm checks in a row under the thresholds while engaged
+	Calm  int               `json:"calm"`
+	Items map[string]string `json:"items"`
+	Tags  []string          `json:"tags"`
+}
+
+// backpressure engages and releases a Backpressure from the load of ingest, and applies it to the configs served
+type backpressure struct {
+	Backpressure
+	stats *ingestStats
+	// shed the budgets of the endpoints of the device API, whose requests shed count as load, nil if there are none
+	shed *shedder
+	lock sync.Mutex
+	// ingested and shedTotal the totals at the last check, to count those since
+	ingested  uint64
+	shedTotal uint64
+	checked   time.Time
+	status    BackpressureStatus
+}
+
+func newBackpressure(b Backpressure, stats *ingestStats, shed *shedder) *backpressure {
+	if b.Interval <= 0 {
+		b.Interval = DefaultBackpressureInterval
+	}
+	if b.Recover <= 0 {
+		b.Recover = DefaultBackpressureRecover
+	}
+	if b.Tags == nil {
+		b.Tags = []string{}
+	}
+	p := &backpressure{Backpressure: b, stats: stats, shed: shed, checked: time.Now()}
+	p.ingested, p.shedTotal = p.totals()
+	return p
+}
+
+// totals the ingest requests, and those shed or timed out, since the server started
+func (p *backpressure) totals() (uint64, uint64) {
+	var ingested, shed uint64
+	for endpoint, n := range p.stats.totals() {
+		if _, ok := ingestKinds[strings.TrimPrefix(endpoint, http.MethodPost+" ")]; ok {
+			ingested += n
+		}
+	}
+	if p.shed != nil {
+		counts, timedOut := p.shed.counts()
+		for _, n := range counts {
+			shed += n
+		}
+		for _, n := range timedOut {
+			shed += n
+		}
+	}
+	return ingested, shed
+}
+
+// check measure the load since the last check, engaging the backpressure if it is past a threshold, or releasing
+// it once it has been under them for Recover checks in a row
+func (p *backpressure) check(now time.Time) {
+	ingested, shed := p.totals()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	elapsed := now.Sub(p.checked).Seconds()
+	p.status.Rate, p.status.Shed = 0, shed-p.shedTotal
+	if elapsed > 0 {
+		p.status.Rate = float64(ingested-p.ingested) / elapsed
+	}
+	p.ingested, p.shedTotal, p.checked = ingested, shed, now
+	overloaded := (p.Rate > 0 && p.status.Rate >= p.Rate) || (p.Shed > 0 && p.status.Shed >= p.Shed)
+	switch {
+	case overloaded && !p.status.Engaged:
+		p.status.Engaged, p.status.Since = true, &now
+		log.Printf("ingest overloaded, %.1f requests/s and %d shed, serving devices backpressure config items %v", p.status.Rate, p.status.Shed, p.Items)
+	case overloaded:
+		p.status.Calm = 0
+	case p.status.Engaged:
+		p.status.Calm++
+		if p.status.Calm >= p.Recover {
+			p.status.Engaged, p.status.Since, p.status.Calm = false, &now, 0
+			log.Printf("ingest load subsided, %.1f requests/s and %d shed, serving devices their own config items again", p.status.Rate, p.status.Shed)
+		}
+	}
+}
+
+// run check the load every Interval, until done is closed
+func (p *backpressure) run(done <-chan struct{}) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.check(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *backpressure) engaged() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.status.Engaged
+}
+
+// apply the config items of the backpressure to the config served to a device, while it is engaged and the device
+// is one of those slowed down, returning the config as it is otherwise
+func (p *backpressure) apply(m driver.DeviceManager, u uuid.UUID, msg *config.EdgeDevConfig, b []byte) (*config.EdgeDevConfig, []byte, error) {
+	if !p.engaged() {
+		return msg, b, nil
+	}
+	if len(p.Tags) > 0 {
+		md, err := m.GetDeviceMetadata(u)
+		if err != nil {
+			log.Printf("error getting metadata of %s for backpressure: %v", u, err)
+			return msg, b, nil
+		}
+		if !md.Match(p.Tags) {
+			return msg, b, nil
+		}
+	}
+	set := map[string]bool{}
+	for _, item := range msg.ConfigItems {
+		if value, ok := p.Items[item.Key]; ok {
+			set[item.Key] = true
+			if !numericallyLarger(item.Value, value) {
+				item.Value = value
+			}
+		}
+	}
+	keys := make([]string, 0, len(p.Items))
+	for k := range p.Items {
+		if !set[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		msg.ConfigItems = append(msg.ConfigItems, &config.ConfigItem{Key: k, Value: p.Items[k]})
+	}
+	b, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error encoding device config: %v", err)
+	}
+	return msg, b, nil
+}
+
+// numericallyLarger whether a value is a number larger than another
+func numericallyLarger(a, b string) bool {
+	fa, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return false
+	}
+	fb, err := strconv.ParseFloat(b, 64)
+	return err == nil && fa > fb
+}
+
+func (p *backpressure) snapshot() BackpressureStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status := p.status
+	status.Items, status.Tags = p.Items, p.Tags
+	return status
+}
+
+// backpressureGet report whether the backpressure is engaged, with the load of ingest at the last check
+func (h *adminHandler) backpressureGet(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(h.backpressure.snapshot())
+	if err != nil {
+		log.Printf("error converting backpressure to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/config"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// LoadBaseConfig read the base config template at p, the JSON of an EdgeDevConfig newly registered devices start
+// with in place of the minimal one, checking it is one EVE would accept. Its UUID and version are set for each device
+func LoadBaseConfig(p string) ([]byte, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read base config %s: %v", p, err)
+	}
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("invalid base config %s: %v", p, err)
+	}
+	if problems := validateConfig(&conf); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid base config %s:\n- %s", p, strings.Join(problems, "\n- "))
+	}
+	return b, nil
+}
+
+// initialConfig the config of a newly registered device: that of the config snapshot the policy of its onboarding
+// certificate names, if any, else that of the default snapshot if there is one, else the base config template, if
+// any, else the minimal base config. A snapshot that cannot be read is skipped for the next one
+func initialConfig(m driver.DeviceManager, u uuid.UUID, onboard *x509.Certificate, base []byte) []byte {
+	if onboard != nil {
+		policy, err := m.OnboardPolicyGet(onboard.Subject.CommonName)
+		_, isNotFound := err.(*common.NotFoundError)
+		switch {
+		case err != nil && !isNotFound:
+			log.Printf("error getting policy of onboarding certificate %s, device %s starts with the default config: %v", onboard.Subject.CommonName, u, err)
+		case policy != nil && policy.Snapshot != "":
+			s, err := common.SnapshotGet(m, policy.Snapshot)
+			if err == nil {
+				var b []byte
+				if b, err = deviceConfig(s.Config, u); err == nil {
+					return b
+				}
+			}
+			log.Printf("error getting config snapshot %s of onboarding certificate %s, device %s starts with the default config: %v", policy.Snapshot, onboard.Subject.CommonName, u, err)
+		}
+	}
+	snapshots, err := common.SnapshotList(m)
+	if err != nil {
+		log.Printf("error listing config snapshots, device %s starts with the base config: %v", u, err)
+		return baseConfig(u, base)
+	}
+	for _, s := range snapshots {
+		if !s.Default {
+			continue
+		}
+		b, err := deviceConfig(s.Config, u)
+		if err != nil {
+			log.Printf("error reading default config snapshot %s, device %s starts with the base config: %v", s.Name, u, err)
+			return baseConfig(u, base)
+		}
+		return b
+	}
+	return baseConfig(u, base)
+}
+
+// baseConfig the base config of a device: the template, if any, else the minimal one of common.CreateBaseConfig
+func baseConfig(u uuid.UUID, template []byte) []byte {
+	if template == nil {
+		return common.CreateBaseConfig(u)
+	}
+	b, err := deviceConfig(template, u)
+	if err != nil {
+		log.Printf("error reading base config, device %s starts with the minimal one: %v", u, err)
+		return common.CreateBaseConfig(u)
+	}
+	return b
+}
+
+// deviceConfig the config of a device from a template, the JSON of an EdgeDevConfig, with the UUID of the device
+// and the initial version
+func deviceConfig(template []byte, u uuid.UUID) ([]byte, error) {
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal(template, &conf); err != nil {
+		return nil, fmt.Errorf("error reading config: %v", err)
+	}
+	conf.Id = &config.UUIDandVersion{Uuid: u.String(), Version: "4"}
+	b, err := protojson.Marshal(&conf)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding config: %v", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,328 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// DefaultMaxBodySize the limit of the size of the bodies of the requests of devices, if none is set
+	DefaultMaxBodySize = 16 * 1024 * 1024
+	// partHeader header of a request carrying a part of a log bundle too large for one request, as <part>/<parts>,
+	// counting from 1, e.g. 2/3
+	partHeader = "X-Adam-Part"
+	// bundleHeader header of a request carrying a part of a log bundle, naming the bundle, unique per device until
+	// all of its parts are sent
+	bundleHeader = "X-Adam-Bundle"
+	// maxBundleParts how many parts a log bundle can be sent in at most
+	maxBundleParts = 64
+	// maxDeviceBundles how many log bundles of a device can wait for their other parts at once; a new one drops the
+	// one that waited the longest
+	maxDeviceBundles = 4
+	// bundleTTL how long the parts of a log bundle wait for the others before they are dropped
+	bundleTTL = 10 * time.Minute
+	// maxEntrySize longest log entry of a gzipped log bundle, one JSON entry per line
+	maxEntrySize = 1024 * 1024
+	// maxDecodedAdminBody limit of the size of the body of an admin request once decompressed: admin requests have
+	// no limit of their own, but a small compressed body can decompress to a huge one
+	maxDecodedAdminBody = 1024 * 1024 * 1024
+	contentEncoding     = "Content-Encoding"
+)
+
+// decodeBody a middleware decompressing the body of a request sent with a Content-Encoding of gzip or deflate, or
+// both in turn, as it is read, so that handlers read it as if it was sent as is. The body is never decompressed
+// whole up front: the handlers of devices read it within the limits of its kind of message, and past limit, if over
+// 0, reading it fails with errBodyTooLarge. A body in any other encoding is answered 415 Unsupported Media Type
+func decodeBody(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var encodings []string
+			for _, v := range r.Header.Values(contentEncoding) {
+				for _, e := range strings.Split(v, ",") {
+					if e = strings.ToLower(strings.TrimSpace(e)); e != "" && e != "identity" {
+						encodings = append(encodings, e)
+					}
+				}
+			}
+			if len(encodings) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			body := io.Reader(r.Body)
+			// the last encoding applied is the first undone
+			for i := len(encodings) - 1; i >= 0; i-- {
+				var err error
+				switch encodings[i] {
+				case "gzip", "x-gzip":
+					body, err = gzip.NewReader(body)
+				case "deflate":
+					body, err = newDeflateReader(body)
+				default:
+					httpError(w, fmt.Sprintf("unsupported content encoding %s", encodings[i]), http.StatusUnsupportedMediaType)
+					return
+				}
+				if err != nil {
+					httpError(w, fmt.Sprintf("bad %s body: %v", encodings[i], err), http.StatusBadRequest)
+					return
+				}
+			}
+			if limit > 0 {
+				body = &limitedBody{r: body, remaining: limit}
+			}
+			r.Body = decodedBody{Reader: body, Closer: r.Body}
+			r.Header.Del(contentEncoding)
+			r.ContentLength = -1
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// decodedBody a request body decompressed as it is read, closing the body it was sent as
+type decodedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// newDeflateReader a reader of a deflate body: zlib, as HTTP has it, or raw deflate, as some clients send it
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// a zlib header names the deflate method, and is a multiple of 31
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// readBody read the body of a request of a device, answering 413 Request Entity Too Large if it is over the limit
+// of its kind of message, or 400 if it cannot be read. nil if the request was answered
+func (h *apiHandler) readBody(w http.ResponseWriter, r *http.Request, kind string) []byte {
+	limit := h.bodyLimits.For(kind)
+	body := io.Reader(r.Body)
+	if limit > 0 {
+		if r.ContentLength > limit {
+			bodyTooLarge(w, r, limit)
+			return nil
+		}
+		// a body with no or a wrong length is read one byte past the limit, to tell it is over
+		body = io.LimitReader(r.Body, limit+1)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		log.Printf("error reading request body: %v", err)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil
+	}
+	if limit > 0 && int64(len(b)) > limit {
+		bodyTooLarge(w, r, limit)
+		return nil
+	}
+	return b
+}
+
+// readLogBody read the body of a request of a device sending a log bundle, as readBody. A bundle sent in parts, with
+// partHeader and bundleHeader, is returned once all of its parts are received, in any order; until then each part
+// is answered 202 Accepted, and nil is returned
+func (h *apiHandler) readLogBody(w http.ResponseWriter, r *http.Request, u uuid.UUID, kind string) []byte {
+	b := h.readBody(w, r, kind)
+	spec := r.Header.Get(partHeader)
+	if b == nil || spec == "" {
+		return b
+	}
+	part, parts, err := parsePart(spec)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	id := r.Header.Get(bundleHeader)
+	if id == "" {
+		httpError(w, fmt.Sprintf("missing %s header with %s", bundleHeader, partHeader), http.StatusBadRequest)
+		return nil
+	}
+	whole, err := h.parts.add(bundleKey{device: u, path: r.URL.Path, id: id}, part, parts, b)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if whole == nil {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	return whole
+}
+
+// newEntryScanner a scanner of the JSON lines of the entries of a gzipped log bundle. If reading the bundle fails,
+// the line it was cut in is not returned as an entry, and the scanner fails with the error instead
+func newEntryScanner(r io.Reader) *bufio.Scanner {
+	er := &errReader{r: r}
+	scanner := bufio.NewScanner(er)
+	scanner.Buffer(make([]byte, 64*1024), maxEntrySize)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && er.err != nil && bytes.IndexByte(data, '\n') < 0 {
+			return 0, nil, nil
+		}
+		return bufio.ScanLines(data, atEOF)
+	})
+	return scanner
+}
+
+// errReader a reader keeping the error other than io.EOF it failed with, if any
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+// scanFailed answer a log bundle whose entries could not all be read, with 413 Request Entity Too Large if
+// one is over maxEntrySize. The entries before it are kept
+func scanFailed(w http.ResponseWriter, err error) {
+	log.Printf("error reading log entries: %v", err)
+	if err == bufio.ErrTooLong {
+		writeError(w, http.StatusRequestEntityTooLarge, ErrEntryTooLarge, fmt.Sprintf("log entry over the limit of %d bytes", maxEntrySize), map[string]int{"limit": maxEntrySize})
+		return
+	}
+	httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+}
+
+// bodyTooLarge answer a request whose body is over the limit with 413 Request Entity Too Large
+func bodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	log.Printf("%s %s: request body over the limit of %d bytes", r.Method, r.URL.Path, limit)
+	writeError(w, http.StatusRequestEntityTooLarge, ErrBodyTooLarge, fmt.Sprintf("request body over the limit of %d bytes", limit), map[string]int64{"limit": limit})
+}
+
+// parsePart parse the part of a log bundle a request carries, as <part>/<parts>
+func parsePart(spec string) (int, int, error) {
+	i := strings.Index(spec, "/")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("bad %s %q: must be <part>/<parts>", partHeader, spec)
+	}
+	part, err1 := strconv.Atoi(spec[:i])
+	parts, err2 := strconv.Atoi(spec[i+1:])
+	switch {
+	case err1 != nil || err2 != nil:
+		return 0, 0, fmt.Errorf("bad %s %q: must be <part>/<parts>", partHeader, spec)
+	case parts < 1 || parts > maxBundleParts:
+		return 0, 0, fmt.Errorf("bad %s %q: a bundle is sent in 1 to %d parts", partHeader, spec, maxBundleParts)
+	case part < 1 || part > parts:
+		return 0, 0, fmt.Errorf("bad %s %q: the part must be from 1 to %d", partHeader, spec, parts)
+	}
+	return part, parts, nil
+}
+
+// bundleKey the log bundle a part is of: the device sending it, the path it is sent to and its name
+type bundleKey struct {
+	device uuid.UUID
+	path   string
+	id     string
+}
+
+// bundle the parts of a log bundle received so far
+type bundle struct {
+	parts    [][]byte
+	received int
+	started  time.Time
+}
+
+// bundleParts the log bundles whose parts are being received, in memory, as the parts of a bundle are sent one
+// right after the other
+type bundleParts struct {
+	lock    sync.Mutex
+	bundles map[bundleKey]*bundle
+}
+
+// newBundleParts no bundles being received
+func newBundleParts() *bundleParts {
+	return &bundleParts{bundles: map[bundleKey]*bundle{}}
+}
+
+// add keep a part of a bundle, returning the whole bundle once all of its parts are kept, nil until then. A part
+// sent again replaces the one kept
+func (p *bundleParts) add(key bundleKey, part, parts int, b []byte) ([]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	p.expire(now)
+	bd, ok := p.bundles[key]
+	switch {
+	case !ok:
+		p.makeRoom(key.device)
+		bd = &bundle{parts: make([][]byte, parts), started: now}
+		p.bundles[key] = bd
+	case len(bd.parts) != parts:
+		return nil, fmt.Errorf("bundle %s sent in %d parts, not %d", key.id, len(bd.parts), parts)
+	}
+	if bd.parts[part-1] == nil {
+		bd.received++
+	}
+	bd.parts[part-1] = b
+	if bd.received < parts {
+		return nil, nil
+	}
+	delete(p.bundles, key)
+	var size int
+	for _, b := range bd.parts {
+		size += len(b)
+	}
+	whole := make([]byte, 0, size)
+	for _, b := range bd.parts {
+		whole = append(whole, b...)
+	}
+	return whole, nil
+}
+
+// expire drop the bundles that waited bundleTTL for their other parts
+func (p *bundleParts) expire(now time.Time) {
+	for k, bd := range p.bundles {
+		if now.Sub(bd.started) > bundleTTL {
+			log.Printf("dropping %d of %d parts of log bundle %s of %s, the others did not come in time", bd.received, len(bd.parts), k.id, k.device)
+			delete(p.bundles, k)
+		}
+	}
+}
+
+// makeRoom drop the bundle of a device that waited the longest if it has maxDeviceBundles of them, to start another
+func (p *bundleParts) makeRoom(device uuid.UUID) {
+	var (
+		oldest bundleKey
+		count  int
+	)
+	for k, bd := range p.bundles {
+		if k.device != device {
+			continue
+		}
+		if count == 0 || bd.started.Before(p.bundles[oldest].started) {
+			oldest = k
+		}
+		count++
+	}
+	if count >= maxDeviceBundles {
+		log.Printf("dropping log bundle %s of %s, it has %d other bundles waiting for their parts", oldest.id, device, count-1)
+		delete(p.bundles, oldest)
+	}
+}
@@ -0,0 +1,396 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/config"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// defaultCanarySoakPeriod soak period of the canaries created without one
+const defaultCanarySoakPeriod = 1800
+
+// CanaryRequest a config canary to create. The canaries are the devices in Devices and those with a serial matching one
+// of Serials
+type CanaryRequest struct {
+	Name string `json:"name,omitempty"`
+	// Devices UUIDs of the canary devices
+	Devices []string `json:"devices,omitempty"`
+	// Serials patterns, as for path.Match, of the serials of the canary devices
+	Serials []string `json:"serials,omitempty"`
+	// Patch JSON merge patch to apply to the config of each canary, exclusive with Template
+	Patch json.RawMessage `json:"patch,omitempty"`
+	// Template config to set on each canary, exclusive with Patch
+	Template json.RawMessage `json:"template,omitempty"`
+	// SoakPeriod seconds to watch the canaries for; 0 means 1800
+	SoakPeriod int `json:"soak-period,omitempty"`
+	// MaxReboots number of times a canary can reboot during the soak period
+	MaxReboots int `json:"max-reboots,omitempty"`
+}
+
+// canarySummary summary of a canary for the audit log, without the change and the state of each device
+func canarySummary(c *common.Canary) map[string]interface{} {
+	return map[string]interface{}{"name": c.Name, "state": c.State, "devices": len(c.Devices), "regressions": c.Regressions()}
+}
+
+// startCanary apply the change of a new canary to its devices, keeping their previous config and boot time
+func startCanary(m driver.DeviceManager, c *common.Canary) {
+	for i := range c.Devices {
+		d := &c.Devices[i]
+		uid, err := uuid.FromString(d.UUID)
+		if err != nil {
+			d.Status = common.CanaryDeviceRegressed
+			d.Error = fmt.Sprintf("bad UUID %s: %v", d.UUID, err)
+			continue
+		}
+		previous, err := m.GetConfig(uid)
+		if err != nil {
+			d.Status = common.CanaryDeviceRegressed
+			d.Error = fmt.Sprintf("error retrieving existing config: %v", err)
+			continue
+		}
+		if inv, err := m.GetInventory(uid); err == nil && inv != nil && inv.Hardware != nil {
+			d.BootTime = inv.Hardware.BootTime
+		}
+		hash, err := applyChange(m, c.Patch, c.Template, "canary:"+c.ID, d.UUID)
+		if err != nil {
+			d.Status = common.CanaryDeviceRegressed
+			d.Error = err.Error()
+			continue
+		}
+		d.Hash = hash
+		d.Previous = previous
+	}
+}
+
+// observeCanary what a canary device reported since the change was applied: whether it acknowledged it, its boot
+// time, and the errors of its app instances
+func observeCanary(m driver.DeviceManager, c *common.Canary, d *common.CanaryDevice) (common.CanaryObservation, error) {
+	var o common.CanaryObservation
+	ok, err := acknowledged(m, d.UUID, d.Hash)
+	if err != nil {
+		return o, err
+	}
+	o.Acknowledged = ok
+	uid, err := uuid.FromString(d.UUID)
+	if err != nil {
+		return o, fmt.Errorf("bad UUID %s: %v", d.UUID, err)
+	}
+	inv, err := m.GetInventory(uid)
+	if _, isNotFound := err.(*common.NotFoundError); isNotFound {
+		return o, nil
+	}
+	if err != nil {
+		return o, err
+	}
+	if inv == nil {
+		return o, nil
+	}
+	if inv.Hardware != nil {
+		o.BootTime = inv.Hardware.BootTime
+	}
+	for _, app := range inv.Apps {
+		if app.Updated.Before(c.Created) {
+			continue
+		}
+		if len(app.Errors) > 0 {
+			o.Errors = append(o.Errors, fmt.Sprintf("app %s: %s", app.Name, strings.Join(app.Errors, ", ")))
+		}
+	}
+	return o, nil
+}
+
+// revertCanary set the previous config back on a canary device, with a new version so that it picks it up
+func revertCanary(m driver.DeviceManager, c *common.Canary, d *common.CanaryDevice) error {
+	// the change was never applied to it
+	if len(d.Previous) == 0 {
+		return nil
+	}
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal(d.Previous, &conf); err != nil {
+		return fmt.Errorf("error processing previous config: %v", err)
+	}
+	if conf.Id != nil {
+		conf.Id.Version = ""
+	}
+	b, err := protojson.Marshal(&conf)
+	if err != nil {
+		return fmt.Errorf("error processing previous config: %v", err)
+	}
+	_, err = applyChange(m, nil, b, "canary:"+c.ID, d.UUID)
+	return err
+}
+
+// advanceCanary advance a soaking canary, reverting it if a device regressed, and saving its state
+func advanceCanary(m driver.DeviceManager, c *common.Canary, now time.Time) error {
+	devices := map[string]*common.CanaryDevice{}
+	for i := range c.Devices {
+		devices[c.Devices[i].UUID] = &c.Devices[i]
+	}
+	observe := func(u string) (common.CanaryObservation, error) {
+		return observeCanary(m, c, devices[u])
+	}
+	revert := func(d *common.CanaryDevice) error {
+		return revertCanary(m, c, d)
+	}
+	changed, err := c.Advance(now, observe, revert)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	switch c.State {
+	case common.CanaryReverted:
+		log.Printf("canary %s reverted: %s", c.ID, c.Reason)
+	case common.CanaryPassed:
+		log.Printf("canary %s passed", c.ID)
+	}
+	return common.CanarySet(m, c)
+}
+
+// advanceCanaries advance the soaking canaries every interval, until done is closed
+func (h *adminHandler) advanceCanaries(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		h.rolloutLock.Lock()
+		canaries, err := common.CanaryList(h.manager)
+		if err != nil {
+			log.Printf("error listing canaries: %v", err)
+		}
+		for _, c := range canaries {
+			if c.State != common.CanarySoaking {
+				continue
+			}
+			if err := advanceCanary(h.manager, c, time.Now()); err != nil {
+				log.Printf("error advancing canary %s: %v", c.ID, err)
+			}
+		}
+		h.rolloutLock.Unlock()
+	}
+}
+
+// checkCanaryRequest check the change and the devices of a canary request, setting the defaults
+func checkCanaryRequest(c common.RecordStore, req *CanaryRequest) error {
+	if err := checkChange(c, req.Patch, req.Template); err != nil {
+		return err
+	}
+	if len(req.Devices) == 0 && len(req.Serials) == 0 {
+		return fmt.Errorf("a canary needs devices or serials")
+	}
+	if req.SoakPeriod == 0 {
+		req.SoakPeriod = defaultCanarySoakPeriod
+	}
+	switch {
+	case req.SoakPeriod < 0:
+		return fmt.Errorf("negative soak period %d", req.SoakPeriod)
+	case req.MaxReboots < 0:
+		return fmt.Errorf("negative max reboots %d", req.MaxReboots)
+	}
+	return nil
+}
+
+func (h *adminHandler) canaryList(w http.ResponseWriter, r *http.Request) {
+	canaries, err := common.CanaryList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing canaries: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(canaries, func(i, j int) bool { return canaries[i].Created.Before(canaries[j].Created) })
+	h.writeCanary(w, http.StatusOK, canaries)
+}
+
+func (h *adminHandler) canaryGet(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.getCanary(w, r)
+	if !ok {
+		return
+	}
+	h.writeCanary(w, http.StatusOK, c)
+}
+
+// canaryCreate create a canary, applying its change to the canary devices
+func (h *adminHandler) canaryCreate(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req CanaryRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad canary request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := checkCanaryRequest(h.managerFor(r), &req); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	devices, err := selectDevices(h.managerFor(r), req.Devices, req.Serials)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(devices) == 0 {
+		httpError(w, "no canary devices", http.StatusBadRequest)
+		return
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		log.Printf("error generating canary ID: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	c := common.NewCanary(id.String(), req.Name, devices, req.SoakPeriod)
+	c.Patch = req.Patch
+	c.Template = req.Template
+	c.MaxReboots = req.MaxReboots
+
+	h.rolloutLock.Lock()
+	defer h.rolloutLock.Unlock()
+	startCanary(h.managerFor(r), c)
+	if err := common.CanarySet(h.managerFor(r), c); err != nil {
+		log.Printf("error saving canary: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditCanaryCreate, c.ID, nil, canarySummary(c))
+	if err := advanceCanary(h.managerFor(r), c, time.Now()); err != nil {
+		log.Printf("error advancing canary %s: %v", c.ID, err)
+	}
+	h.writeCanary(w, http.StatusCreated, c)
+}
+
+// canaryRevert revert a canary by hand, setting the previous config back on its devices
+func (h *adminHandler) canaryRevert(w http.ResponseWriter, r *http.Request) {
+	h.rolloutLock.Lock()
+	defer h.rolloutLock.Unlock()
+	c, ok := h.getCanary(w, r)
+	if !ok {
+		return
+	}
+	if c.State == common.CanaryReverted {
+		httpError(w, fmt.Sprintf("canary %s is already reverted", c.ID), http.StatusConflict)
+		return
+	}
+	before := canarySummary(c)
+	m := h.managerFor(r)
+	c.Revert(time.Now(), "reverted by hand", func(d *common.CanaryDevice) error {
+		return revertCanary(m, c, d)
+	})
+	if err := common.CanarySet(m, c); err != nil {
+		log.Printf("error saving canary: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditCanaryRevert, c.ID, before, canarySummary(c))
+	h.writeCanary(w, http.StatusOK, c)
+}
+
+// canaryPromote roll the change of a canary that passed out to the fleet. The request is that of a rollout, without
+// the change
+func (h *adminHandler) canaryPromote(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.getCanary(w, r)
+	if !ok {
+		return
+	}
+	if c.State != common.CanaryPassed {
+		httpError(w, fmt.Sprintf("canary %s is %s, only one that passed can be promoted", c.ID, c.State), http.StatusConflict)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req RolloutRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			httpError(w, fmt.Sprintf("bad rollout request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.Patch) > 0 || len(req.Template) > 0 {
+		httpError(w, "the change of a canary rollout is that of the canary, it cannot have a patch or a template", http.StatusBadRequest)
+		return
+	}
+	req.Patch = c.Patch
+	req.Template = c.Template
+	if req.Name == "" {
+		req.Name = "canary " + c.Name
+	}
+	if err := checkRolloutRequest(h.managerFor(r), &req); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.createRollout(w, r, &req)
+}
+
+// canaryRemove remove a canary. The configs of its devices stay as they are
+func (h *adminHandler) canaryRemove(w http.ResponseWriter, r *http.Request) {
+	h.rolloutLock.Lock()
+	defer h.rolloutLock.Unlock()
+	c, ok := h.getCanary(w, r)
+	if !ok {
+		return
+	}
+	if err := common.CanaryRemove(h.managerFor(r), c.ID); err != nil {
+		log.Printf("error removing canary: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditCanaryRemove, c.ID, canarySummary(c), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getCanary get the canary a request is for, writing the error response if there is none
+func (h *adminHandler) getCanary(w http.ResponseWriter, r *http.Request) (*common.Canary, bool) {
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	}
+	c, err := common.CanaryGet(h.managerFor(r), id.String())
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		log.Printf("error getting canary %s: %v", id, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	return c, true
+}
+
+func (h *adminHandler) writeCanary(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting canary to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
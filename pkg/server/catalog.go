@@ -0,0 +1,282 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// DatastoreRequest a datastore to add to the catalog, named by the path
+type DatastoreRequest struct {
+	// Config the datastore as in a config, whose id is ignored
+	Config json.RawMessage `json:"config"`
+}
+
+// ImageRequest an image to add to the catalog, named by the path
+type ImageRequest struct {
+	// Datastore name of the datastore of the catalog the image is in
+	Datastore string `json:"datastore"`
+	// Config the image as a content tree in a config, whose uuid and dsId are ignored
+	Config json.RawMessage `json:"config"`
+}
+
+// datastoreSummary summary of a datastore for the audit log, without the config, which may have credentials
+func datastoreSummary(ds *common.Datastore) map[string]interface{} {
+	return map[string]interface{}{"name": ds.Name, "id": ds.ID}
+}
+
+// imageSummary summary of an image for the audit log, without the config
+func imageSummary(image *common.Image) map[string]interface{} {
+	return map[string]interface{}{"name": image.Name, "id": image.ID, "datastore": image.Datastore}
+}
+
+// catalogID the UUID of a datastore or image being set: the one it had, so that configs referencing it by name keep
+// the same UUID on every device, or a new one
+func catalogID(existing string) (string, error) {
+	if existing != "" {
+		return existing, nil
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+func (h *adminHandler) datastoreList(w http.ResponseWriter, r *http.Request) {
+	datastores, err := common.DatastoreList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing datastores: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(datastores, func(i, j int) bool { return datastores[i].Name < datastores[j].Name })
+	h.writeCatalog(w, http.StatusOK, datastores)
+}
+
+func (h *adminHandler) datastoreGet(w http.ResponseWriter, r *http.Request) {
+	ds, ok := h.getDatastore(w, r)
+	if !ok {
+		return
+	}
+	h.writeCatalog(w, http.StatusOK, ds)
+}
+
+// datastoreSet add a datastore to the catalog, replacing the one of the same name, whose UUID it keeps
+func (h *adminHandler) datastoreSet(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req DatastoreRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad datastore: %v", err), http.StatusBadRequest)
+		return
+	}
+	m := h.managerFor(r)
+	name := mux.Vars(r)["name"]
+	var (
+		before   interface{}
+		existing string
+	)
+	if old, err := common.DatastoreGet(m, name); err == nil {
+		before = datastoreSummary(old)
+		existing = old.ID
+	}
+	id, err := catalogID(existing)
+	if err != nil {
+		log.Printf("error generating datastore ID: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	ds, err := common.NewDatastore(name, id, req.Config)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad datastore: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := common.DatastoreAdd(m, ds); err != nil {
+		log.Printf("error saving datastore: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditDatastoreAdd, ds.Name, before, datastoreSummary(ds))
+	h.writeCatalog(w, http.StatusOK, ds)
+}
+
+// datastoreRemove remove a datastore from the catalog, unless an image is still in it
+func (h *adminHandler) datastoreRemove(w http.ResponseWriter, r *http.Request) {
+	ds, ok := h.getDatastore(w, r)
+	if !ok {
+		return
+	}
+	m := h.managerFor(r)
+	all, err := common.ImageList(m)
+	if err != nil {
+		log.Printf("error listing images: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	images := []string{}
+	for _, image := range all {
+		if image.Datastore == ds.Name {
+			images = append(images, image.Name)
+		}
+	}
+	if len(images) > 0 {
+		sort.Strings(images)
+		writeError(w, http.StatusConflict, ErrDatastoreInUse, fmt.Sprintf("datastore %s has %d images", ds.Name, len(images)), map[string]interface{}{"images": images})
+		return
+	}
+	if err := common.DatastoreRemove(m, ds.Name); err != nil {
+		log.Printf("error removing datastore: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditDatastoreRemove, ds.Name, datastoreSummary(ds), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getDatastore get the datastore a request is for, writing the error response if there is none
+func (h *adminHandler) getDatastore(w http.ResponseWriter, r *http.Request) (*common.Datastore, bool) {
+	name := mux.Vars(r)["name"]
+	ds, err := common.DatastoreGet(h.managerFor(r), name)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		log.Printf("error getting datastore %s: %v", name, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	return ds, true
+}
+
+func (h *adminHandler) imageList(w http.ResponseWriter, r *http.Request) {
+	images, err := common.ImageList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing images: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	h.writeCatalog(w, http.StatusOK, images)
+}
+
+func (h *adminHandler) imageGet(w http.ResponseWriter, r *http.Request) {
+	image, ok := h.getImage(w, r)
+	if !ok {
+		return
+	}
+	h.writeCatalog(w, http.StatusOK, image)
+}
+
+// imageSet add an image to the catalog, replacing the one of the same name, whose UUID it keeps. Its datastore must be
+// in the catalog
+func (h *adminHandler) imageSet(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req ImageRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad image: %v", err), http.StatusBadRequest)
+		return
+	}
+	m := h.managerFor(r)
+	name := mux.Vars(r)["name"]
+	var (
+		before   interface{}
+		existing string
+	)
+	if old, err := common.ImageGet(m, name); err == nil {
+		before = imageSummary(old)
+		existing = old.ID
+	}
+	id, err := catalogID(existing)
+	if err != nil {
+		log.Printf("error generating image ID: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	image, err := common.NewImage(name, id, req.Datastore, req.Config)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad image: %v", err), http.StatusBadRequest)
+		return
+	}
+	_, err = common.DatastoreGet(m, image.Datastore)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, fmt.Sprintf("unknown datastore %s", image.Datastore), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("error getting datastore %s: %v", image.Datastore, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := common.ImageAdd(m, image); err != nil {
+		log.Printf("error saving image: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditImageAdd, image.Name, before, imageSummary(image))
+	h.writeCatalog(w, http.StatusOK, image)
+}
+
+// imageRemove remove an image from the catalog. Configs it was resolved into keep it
+func (h *adminHandler) imageRemove(w http.ResponseWriter, r *http.Request) {
+	image, ok := h.getImage(w, r)
+	if !ok {
+		return
+	}
+	if err := common.ImageRemove(h.managerFor(r), image.Name); err != nil {
+		log.Printf("error removing image: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditImageRemove, image.Name, imageSummary(image), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getImage get the image a request is for, writing the error response if there is none
+func (h *adminHandler) getImage(w http.ResponseWriter, r *http.Request) (*common.Image, bool) {
+	name := mux.Vars(r)["name"]
+	image, err := common.ImageGet(h.managerFor(r), name)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		log.Printf("error getting image %s: %v", name, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	return image, true
+}
+
+func (h *adminHandler) writeCatalog(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting catalog to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
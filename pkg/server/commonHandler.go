@@ -4,8 +4,9 @@
 package server
 
 const (
-	contentType   = "Content-Type"
-	mimeProto     = "application/x-proto-binary"
-	mimeTextPlain = "text/plain"
-	mimeJSON      = "application/json"
+	contentType     = "Content-Type"
+	mimeProto       = "application/x-proto-binary"
+	mimeTextPlain   = "text/plain"
+	mimeJSON        = "application/json"
+	mimeOctetStream = "application/octet-stream"
 )
@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/netutil"
+)
+
+const (
+	// DefaultIdleTimeout how long a connection is kept open between requests, if the server does not set it: longer
+	// than the minute between the config polls of devices by default, so that they keep their connection, and skip
+	// the TLS handshake, from one poll to the next
+	DefaultIdleTimeout = 2 * time.Minute
+	// DefaultHTTP2MaxStreams how many requests an HTTP/2 connection can have in flight at once, if the server does not
+	// set it, as golang.org/x/net/http2 has it
+	DefaultHTTP2MaxStreams = 250
+)
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout <= 0 {
+		return DefaultIdleTimeout
+	}
+	return s.IdleTimeout
+}
+
+func (s *Server) http2MaxStreams() uint32 {
+	if s.HTTP2MaxStreams == 0 {
+		return DefaultHTTP2MaxStreams
+	}
+	return s.HTTP2MaxStreams
+}
+
+// tuneConnections set how long the connections of a server are kept open, and whether, and with how many streams,
+// they can be HTTP/2
+func (s *Server) tuneConnections(server *http.Server) error {
+	server.IdleTimeout = s.idleTimeout()
+	if s.DisableHTTP2 {
+		// net/http enables HTTP/2 on its own unless TLSNextProto is set
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil
+	}
+	return http2.ConfigureServer(server, &http2.Server{MaxConcurrentStreams: s.http2MaxStreams(), IdleTimeout: s.idleTimeout()})
+}
+
+// limitConnections limit the connections a listener has open at once to MaxConnections, if set
+func (s *Server) limitConnections(ln net.Listener) net.Listener {
+	if s.MaxConnections <= 0 {
+		return ln
+	}
+	return netutil.LimitListener(ln, s.MaxConnections)
+}
+
+// connectionsSummary the protocols of the connections and how they are kept open and limited, as logged on start
+func (s *Server) connectionsSummary() string {
+	summary := "HTTP/1.1"
+	if !s.DisableHTTP2 {
+		summary = fmt.Sprintf("HTTP/2 with up to %d streams each, or HTTP/1.1", s.http2MaxStreams())
+	}
+	summary += fmt.Sprintf(", idle timeout %s", s.idleTimeout())
+	if s.MaxConnections > 0 {
+		summary += fmt.Sprintf(", up to %d per listener", s.MaxConnections)
+	}
+	return summary
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// defaultConsumerCount entries returned by a read of a consumer group when no count is given
+	defaultConsumerCount = 100
+	// maxConsumerWait the longest a read of a consumer group waits for new entries
+	maxConsumerWait = time.Minute
+)
+
+// deviceGroupRead read the entries of a consumer group of a device stream, the ones pending for the consumer first
+func (h *adminHandler) deviceGroupRead(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.groupConsumer(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	count := defaultConsumerCount
+	if v := q.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			httpError(w, "count must be a positive number", http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+	var wait time.Duration
+	if v := q.Get("wait"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			httpError(w, "wait must be a number of seconds", http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(n) * time.Second
+		if wait > maxConsumerWait {
+			wait = maxConsumerWait
+		}
+	}
+	entries, err := c.Read(count, wait)
+	if err != nil {
+		log.Printf("error reading consumer group: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		log.Printf("error converting stream entries to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// deviceGroupAck acknowledge entries of a consumer group of a device stream, given as a JSON list of their IDs
+func (h *adminHandler) deviceGroupAck(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.groupConsumer(w, r)
+	if !ok {
+		return
+	}
+	var ids []string
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		httpError(w, "body must be a JSON list of entry IDs: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(ids) > 0 {
+		if err := c.Ack(ids...); err != nil {
+			log.Printf("error acknowledging consumer group entries: %v", err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// groupConsumer the consumer of a request, writing the error and returning false if there is none
+func (h *adminHandler) groupConsumer(w http.ResponseWriter, r *http.Request) (common.StreamConsumer, bool) {
+	gc, ok := h.manager.(driver.GroupConsumer)
+	if !ok {
+		httpError(w, "consumer groups not supported by the "+h.manager.Name()+" driver", http.StatusNotImplemented)
+		return nil, false
+	}
+	vars := mux.Vars(r)
+	u, err := uuid.FromString(vars["uuid"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	consumer := r.URL.Query().Get("consumer")
+	if consumer == "" {
+		httpError(w, "a consumer name is required", http.StatusBadRequest)
+		return nil, false
+	}
+	if _, _, _, err := h.manager.DeviceGet(&u); err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	var c common.StreamConsumer
+	switch vars["kind"] {
+	case "logs":
+		c, err = gc.GetLogsConsumer(u, vars["group"], consumer)
+	case "info":
+		c, err = gc.GetInfoConsumer(u, vars["group"], consumer)
+	case "metrics":
+		c, err = gc.GetMetricsConsumer(u, vars["group"], consumer)
+	}
+	if err != nil {
+		log.Printf("error getting consumer %s of group %s for device %s: %v", consumer, vars["group"], u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	return c, true
+}
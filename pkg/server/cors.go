@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// methods and headers browsers may use in cross-origin requests to the admin API
+	corsMethods = "GET, POST, PUT, PATCH, DELETE"
+	corsHeaders = "Authorization, Content-Type, If-Match"
+	// headers of responses browsers let cross-origin UIs read, besides the basic ones
+	corsExposed = "ETag"
+	// how long, in seconds, browsers may cache the answer to a preflight request
+	corsMaxAge = "600"
+)
+
+// corsPolicy the origins of the browser-based UIs allowed to call the admin API
+type corsPolicy struct {
+	origins map[string]bool
+	any     bool
+}
+
+// parseCORSOrigins parse the allowed origins, as scheme://host[:port], or * for any
+func parseCORSOrigins(origins []string) (*corsPolicy, error) {
+	c := &corsPolicy{origins: map[string]bool{}}
+	for _, o := range origins {
+		o = strings.TrimSpace(o)
+		if o == "*" {
+			c.any = true
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid CORS origin %s: must be * or http[s]://host[:port]", o)
+		}
+		c.origins[u.Scheme+"://"+strings.ToLower(u.Host)] = true
+	}
+	return c, nil
+}
+
+// allows whether requests from an origin are allowed
+func (c *corsPolicy) allows(origin string) bool {
+	return origin != "" && (c.any || c.origins[strings.ToLower(origin)])
+}
+
+// handle add the CORS headers to the responses to allowed origins, and answer their preflight requests, before they
+// are routed, as preflight requests carry no credentials and match no route
+func (c *corsPolicy) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if !c.allows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", corsExposed)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,329 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// maxDeadLetterPayload most bytes of a message kept as a dead letter; a larger one is truncated, and cannot be
+	// replayed
+	maxDeadLetterPayload = 256 * 1024
+	// maxDeadLetters how many dead letters are kept; past it, the oldest are removed
+	maxDeadLetters = 500
+	// deadLetterTrimEvery how many dead letters are added between checks of how many there are
+	deadLetterTrimEvery = 50
+)
+
+// replayKey key of the replayState of a request replaying a dead letter, in its context
+type replayKey struct{}
+
+// replayState why a replayed dead letter could not be parsed again, if it could not
+type replayState struct {
+	reason string
+}
+
+// rejectMessage answer a message of a device that could not be parsed as parseFailed does, keeping it as a dead
+// letter unless its format is not supported at all
+func (h *apiHandler) rejectMessage(w http.ResponseWriter, r *http.Request, u uuid.UUID, kind string, b []byte, err error) {
+	if _, ok := err.(*UnsupportedMediaError); !ok {
+		h.deadLetter(r, u, kind, b, false, err)
+	}
+	parseFailed(w, err)
+}
+
+// deadLetter keep a message of a device that could not be parsed, with the certificate it was sent with and why it
+// failed, to be looked at and replayed once the cause is fixed. Only the start of a payload over
+// maxDeadLetterPayload is kept; truncated tells whether there was more than the payload given already. A message
+// being replayed is not kept again, its replayState gets the reason instead
+func (h *apiHandler) deadLetter(r *http.Request, u uuid.UUID, kind string, payload []byte, truncated bool, reason error) {
+	if rs, ok := r.Context().Value(replayKey{}).(*replayState); ok {
+		rs.reason = reason.Error()
+		return
+	}
+	if len(payload) == 0 {
+		return
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		log.Printf("error generating dead letter ID: %v", err)
+		return
+	}
+	dl := &common.DeadLetter{
+		ID:          id.String(),
+		Received:    time.Now().UTC(),
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		ContentType: r.Header.Get(contentType),
+		Kind:        kind,
+		Device:      u.String(),
+		Cert:        pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: getClientCert(r).Raw}),
+		Reason:      reason.Error(),
+		Payload:     payload,
+		Size:        int64(len(payload)),
+		Truncated:   truncated,
+	}
+	if len(payload) > maxDeadLetterPayload {
+		dl.Payload, dl.Truncated = payload[:maxDeadLetterPayload], true
+	}
+	m := h.managerFor(r)
+	if err := common.DeadLetterAdd(m, dl); err != nil {
+		log.Printf("error keeping message of %s to %s as a dead letter: %v", u, r.URL.Path, err)
+		return
+	}
+	log.Printf("kept message of %s to %s as dead letter %s: %v", u, r.URL.Path, dl.ID, reason)
+	if atomic.AddInt32(&h.deadLettersAdded, 1) >= deadLetterTrimEvery {
+		atomic.StoreInt32(&h.deadLettersAdded, 0)
+		trimDeadLetters(m)
+	}
+}
+
+// trimDeadLetters remove the oldest dead letters past maxDeadLetters
+func trimDeadLetters(m driver.DeviceManager) {
+	deadLetters, err := common.DeadLetterList(m)
+	if err != nil {
+		log.Printf("error listing dead letters: %v", err)
+		return
+	}
+	if len(deadLetters) <= maxDeadLetters {
+		return
+	}
+	sortDeadLetters(deadLetters)
+	for _, dl := range deadLetters[:len(deadLetters)-maxDeadLetters] {
+		if err := common.DeadLetterRemove(m, dl.ID); err != nil {
+			if _, ok := err.(*common.NotFoundError); !ok {
+				log.Printf("error removing dead letter %s: %v", dl.ID, err)
+			}
+		}
+	}
+}
+
+// sortDeadLetters sort dead letters from the oldest received
+func sortDeadLetters(deadLetters []*common.DeadLetter) {
+	sort.Slice(deadLetters, func(i, j int) bool {
+		if !deadLetters[i].Received.Equal(deadLetters[j].Received) {
+			return deadLetters[i].Received.Before(deadLetters[j].Received)
+		}
+		return deadLetters[i].ID < deadLetters[j].ID
+	})
+}
+
+// readDeadLetterBody read what is left of a request body, up to maxDeadLetterPayload, to keep it as a dead letter,
+// and whether there was more
+func readDeadLetterBody(r io.Reader) ([]byte, bool) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxDeadLetterPayload+1))
+	if err != nil {
+		return b, true
+	}
+	return b, len(b) > maxDeadLetterPayload
+}
+
+// headReader a reader keeping what is read from it, up to maxDeadLetterPayload, until stopped, e.g. once the header
+// of a gzipped log bundle is parsed, so that a bundle whose header cannot be parsed can be kept as a dead letter
+type headReader struct {
+	r       io.Reader
+	head    []byte
+	stopped bool
+}
+
+func (h *headReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	if !h.stopped && len(h.head) < maxDeadLetterPayload {
+		k := n
+		if k > maxDeadLetterPayload-len(h.head) {
+			k = maxDeadLetterPayload - len(h.head)
+		}
+		h.head = append(h.head, p[:k]...)
+	}
+	return n, err
+}
+
+// stop stop keeping what is read
+func (h *headReader) stop() {
+	h.stopped, h.head = true, nil
+}
+
+// rest what was read so far, and what is left to read, up to maxDeadLetterPayload, and whether there was more
+func (h *headReader) rest() ([]byte, bool) {
+	return readDeadLetterBody(io.MultiReader(bytes.NewReader(h.head), h.r))
+}
+
+// gzipEntry a gzipped log bundle of a single entry, with the comment of the bundle it was sent in, to keep an entry
+// that could not be parsed as a dead letter without the entries before it, which were stored already
+func gzipEntry(comment string, entry []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Comment = comment
+	gw.Write(entry)
+	gw.Write([]byte{'\n'})
+	gw.Close()
+	return buf.Bytes()
+}
+
+// protoEntry a protobuf message of a single entry of its repeated message field, as gzipEntry
+func protoEntry(field protowire.Number, entry []byte) []byte {
+	b := protowire.AppendTag(nil, field, protowire.BytesType)
+	return protowire.AppendBytes(b, entry)
+}
+
+// deadLetterList list the dead letters, from the oldest, without their payloads and certificates, of the device
+// given with ?device= if any
+func (h *adminHandler) deadLetterList(w http.ResponseWriter, r *http.Request) {
+	deadLetters, err := common.DeadLetterList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing dead letters: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	device := r.URL.Query().Get("device")
+	list := make([]*common.DeadLetter, 0, len(deadLetters))
+	for _, dl := range deadLetters {
+		if device != "" && dl.Device != device {
+			continue
+		}
+		dl.Payload, dl.Cert = nil, nil
+		list = append(list, dl)
+	}
+	sortDeadLetters(list)
+	h.writeDeadLetter(w, http.StatusOK, list)
+}
+
+func (h *adminHandler) deadLetterGet(w http.ResponseWriter, r *http.Request) {
+	dl, ok := h.getDeadLetter(w, r)
+	if !ok {
+		return
+	}
+	h.writeDeadLetter(w, http.StatusOK, dl)
+}
+
+func (h *adminHandler) deadLetterRemove(w http.ResponseWriter, r *http.Request) {
+	dl, ok := h.getDeadLetter(w, r)
+	if !ok {
+		return
+	}
+	if err := common.DeadLetterRemove(h.managerFor(r), dl.ID); err != nil {
+		log.Printf("error removing dead letter %s: %v", dl.ID, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditDeadLetterRemove, dl.ID, deadLetterSummary(dl), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// deadLetterReplay send a dead letter again to the endpoint it was sent to, as the device that sent it, e.g. once
+// the server parses it. It is removed if it is stored this time; otherwise it is kept with the reason it failed
+// again, and answered 409 Conflict with the answer to the replay in the details
+func (h *adminHandler) deadLetterReplay(w http.ResponseWriter, r *http.Request) {
+	dl, ok := h.getDeadLetter(w, r)
+	if !ok {
+		return
+	}
+	if dl.Truncated {
+		httpError(w, fmt.Sprintf("dead letter %s was truncated, it cannot be replayed", dl.ID), http.StatusConflict)
+		return
+	}
+	block, _ := pem.Decode(dl.Cert)
+	if block == nil {
+		httpError(w, fmt.Sprintf("dead letter %s has no certificate", dl.ID), http.StatusConflict)
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad certificate of dead letter %s: %v", dl.ID, err), http.StatusConflict)
+		return
+	}
+	rs := &replayState{}
+	req, err := http.NewRequestWithContext(context.WithValue(r.Context(), replayKey{}, rs), dl.Method, dl.Path, bytes.NewReader(dl.Payload))
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad request of dead letter %s: %v", dl.ID, err), http.StatusConflict)
+		return
+	}
+	if dl.ContentType != "" {
+		req.Header.Set(contentType, dl.ContentType)
+	}
+	req.RemoteAddr = r.RemoteAddr
+	req.TLS = &tls.ConnectionState{HandshakeComplete: true, PeerCertificates: []*x509.Certificate{cert}}
+	rec := httptest.NewRecorder()
+	h.devices.ServeHTTP(rec, req)
+
+	m := h.managerFor(r)
+	if rec.Code >= 200 && rec.Code < 300 {
+		if err := common.DeadLetterRemove(m, dl.ID); err != nil {
+			log.Printf("error removing replayed dead letter %s: %v", dl.ID, err)
+		}
+		h.audit(r, auditDeadLetterReplay, dl.ID, deadLetterSummary(dl), map[string]interface{}{"status": rec.Code})
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	dl.Replays++
+	if rs.reason != "" {
+		dl.Reason = rs.reason
+	}
+	if err := common.DeadLetterAdd(m, dl); err != nil {
+		log.Printf("error updating dead letter %s: %v", dl.ID, err)
+	}
+	h.audit(r, auditDeadLetterReplay, dl.ID, deadLetterSummary(dl), map[string]interface{}{"status": rec.Code})
+	details := map[string]interface{}{"status": rec.Code, "reason": dl.Reason}
+	var er ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &er); err == nil {
+		details["response"] = er
+	}
+	writeError(w, http.StatusConflict, ErrReplayFailed, fmt.Sprintf("replay of dead letter %s answered %d", dl.ID, rec.Code), details)
+}
+
+// getDeadLetter get the dead letter a request is for, writing the error response if there is none
+func (h *adminHandler) getDeadLetter(w http.ResponseWriter, r *http.Request) (*common.DeadLetter, bool) {
+	id := mux.Vars(r)["id"]
+	dl, err := common.DeadLetterGet(h.managerFor(r), id)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		log.Printf("error getting dead letter %s: %v", id, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	return dl, true
+}
+
+// deadLetterSummary summary of a dead letter for the audit log, without the payload
+func deadLetterSummary(dl *common.DeadLetter) map[string]interface{} {
+	return map[string]interface{}{"device": dl.Device, "path": dl.Path, "reason": dl.Reason, "replays": dl.Replays}
+}
+
+func (h *adminHandler) writeDeadLetter(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting dead letter to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
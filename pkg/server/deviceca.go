@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// DeviceCABundle a named file of PEM CA certificates, one of which must have signed the certificates of devices
+type DeviceCABundle struct {
+	Name string
+	Path string
+}
+
+// ParseDeviceCABundle parse a bundle from <name>=<path>
+func ParseDeviceCABundle(spec string) (DeviceCABundle, error) {
+	kv := strings.SplitN(spec, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return DeviceCABundle{}, fmt.Errorf("bad device CA bundle %q, must be <name>=<path>", spec)
+	}
+	return DeviceCABundle{Name: kv[0], Path: kv[1]}, nil
+}
+
+// deviceCAsKey marks the context of a request with the names of the device CA bundles of the listener it came in on
+type deviceCAsKey struct{}
+
+// withDeviceCAs the context of a request, limited to the device CA bundles with the names given
+func withDeviceCAs(r *http.Request, names []string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), deviceCAsKey{}, names))
+}
+
+// deviceCAs the CA bundles trusted for the certificates of devices, reloaded on SIGHUP, with the bundle each device
+// last authenticated against, so that a CA is retired once no device uses it
+type deviceCAs struct {
+	specs []DeviceCABundle
+	mu    sync.RWMutex
+	pools map[string]*x509.CertPool
+	// auths the certificates verified against each bundle
+	auths map[string]uint64
+	// devices the bundle each device last authenticated against
+	devices map[uuid.UUID]string
+}
+
+// loadDeviceCAs load the device CA bundles; nil if there are none, so that devices are not verified against any
+func loadDeviceCAs(specs []DeviceCABundle) (*deviceCAs, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	c := &deviceCAs{specs: specs, auths: map[string]uint64{}, devices: map[uuid.UUID]string{}}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load read the files of the bundles, replacing those loaded only if all can be read
+func (c *deviceCAs) load() error {
+	pools := map[string]*x509.CertPool{}
+	for _, b := range c.specs {
+		if _, ok := pools[b.Name]; ok {
+			return fmt.Errorf("device CA bundle %s given twice", b.Name)
+		}
+		pool, err := loadCAs("device", b.Path)
+		if err != nil {
+			return err
+		}
+		pools[b.Name] = pool
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pools = pools
+	return nil
+}
+
+// reload load the bundles again, keeping those loaded if they cannot be
+func (c *deviceCAs) reload() {
+	if c == nil {
+		return
+	}
+	if err := c.load(); err != nil {
+		log.Printf("error reloading device CA bundles, keeping the current ones: %v", err)
+		return
+	}
+	log.Printf("reloaded %d device CA bundles", len(c.specs))
+}
+
+// has whether there is a bundle with a name
+func (c *deviceCAs) has(name string) bool {
+	for _, b := range c.specs {
+		if b.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// verify check that the client certificate of a request is signed by a CA of one of the bundles of the listener it
+// came in on, all of them if it has none, tried in the order they were given. Returns the name of the bundle
+func (c *deviceCAs) verify(r *http.Request) (string, error) {
+	names, _ := r.Context().Value(deviceCAsKey{}).([]string)
+	if len(names) == 0 {
+		for _, b := range c.specs {
+			names = append(names, b.Name)
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	cert := r.TLS.PeerCertificates[0]
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var errs []string
+	for _, name := range names {
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:         c.pools[name],
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err == nil {
+			return name, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+	}
+	return "", fmt.Errorf("device certificate %s not signed by a trusted CA (%s)", cert.Subject.CommonName, strings.Join(errs, "; "))
+}
+
+// record count the authentication of a device against a bundle
+func (c *deviceCAs) record(u uuid.UUID, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.auths[name]++
+	c.devices[u] = name
+}
+
+// counts the authentications against each bundle, and the devices that last authenticated against each, with every
+// bundle, so that one no device uses shows as 0
+func (c *deviceCAs) counts() (map[string]uint64, map[string]uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	auths, devices := map[string]uint64{}, map[string]uint64{}
+	for _, b := range c.specs {
+		auths[b.Name] = c.auths[b.Name]
+		devices[b.Name] = 0
+	}
+	for _, name := range c.devices {
+		devices[name]++
+	}
+	return auths, devices
+}
+
+// verifyDevice check the certificate of a device of a request against the device CA bundles, if there are any,
+// answering 401 if it is not signed by one of them. Returns the name of the bundle, empty if there are none
+func (h *apiHandler) verifyDevice(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if h.deviceCAs == nil {
+		return "", true
+	}
+	name, err := h.deviceCAs.verify(r)
+	if err != nil {
+		log.Printf("refused device: %v", err)
+		writeError(w, http.StatusUnauthorized, ErrUntrustedDeviceCA, "device certificate not signed by a trusted CA", nil)
+		return "", false
+	}
+	return name, true
+}
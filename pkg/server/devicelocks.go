@@ -0,0 +1,48 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// deviceLocks a mutex per device, so that the updates of one device are serialized without holding up those of the
+// others. A mutex is only kept while it is held or waited for
+type deviceLocks struct {
+	mu    sync.Mutex
+	locks map[uuid.UUID]*deviceLock
+}
+
+type deviceLock struct {
+	sync.Mutex
+	// refs the number of holders and waiters of the mutex
+	refs int
+}
+
+// lock lock the mutex of a device, returning the function that unlocks it
+func (l *deviceLocks) lock(u uuid.UUID) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[uuid.UUID]*deviceLock{}
+	}
+	dl, ok := l.locks[u]
+	if !ok {
+		dl = &deviceLock{}
+		l.locks[u] = dl
+	}
+	dl.refs++
+	l.mu.Unlock()
+
+	dl.Lock()
+	return func() {
+		dl.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if dl.refs--; dl.refs == 0 {
+			delete(l.locks, u)
+		}
+	}
+}
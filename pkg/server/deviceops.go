@@ -0,0 +1,313 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/config"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// RebootRequest a reboot of a device
+type RebootRequest struct {
+	// Confirm the confirmation token of the reboot status of the device, refused if the config changed since
+	Confirm string `json:"confirm"`
+}
+
+// RebootStatus the reboot command in the config of a device, and what the device reported of it
+type RebootStatus struct {
+	// State none, pending, in-progress or done
+	State string `json:"state"`
+	// Counter the counter of the reboot command in the config, 0 if it has none
+	Counter uint32 `json:"counter,omitempty"`
+	// Reported the counter of the last reboot command the device acted on
+	Reported         uint32     `json:"reported,omitempty"`
+	LastReboot       *time.Time `json:"last-reboot,omitempty"`
+	LastRebootReason string     `json:"last-reboot-reason,omitempty"`
+	// Confirm the confirmation token to reboot the device with, as long as its config does not change
+	Confirm string `json:"confirm"`
+}
+
+// BaseOSRequest an update of the EVE version of a device
+type BaseOSRequest struct {
+	// Version EVE version to update to, e.g. 6.1.0-kvm-amd64
+	Version string `json:"version"`
+	// Image name of the image of the catalog with the EVE version, or UUID of a volume or content tree in the config
+	Image string `json:"image"`
+	// CurrentVersion EVE version the device must be running, as in its inventory, for the update to be set
+	CurrentVersion string `json:"current-version"`
+	// Confirm the confirmation token of the base OS status of the device, refused if the config changed since
+	Confirm string `json:"confirm"`
+}
+
+// BaseOSStatus the EVE version in the config of a device, and what the device reported of it
+type BaseOSStatus struct {
+	// State none, pending, in-progress, done or failed
+	State string `json:"state"`
+	// Version EVE version in the config, empty if it has none
+	Version string `json:"version,omitempty"`
+	// Current EVE version the device is running
+	Current string `json:"current,omitempty"`
+	// Image the image of Version in a partition of the device, once the device reported it
+	Image *common.InventoryImage `json:"image,omitempty"`
+	// Confirm the confirmation token to update the device with, as long as its config does not change
+	Confirm string `json:"confirm"`
+}
+
+// deviceOpsState the config of a device, its confirmation token and its inventory, empty if it has none
+func deviceOpsState(m driver.DeviceManager, u uuid.UUID) (*config.EdgeDevConfig, string, *common.Inventory, error) {
+	b, err := m.GetConfig(u)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal(b, &conf); err != nil {
+		return nil, "", nil, fmt.Errorf("error processing existing config: %v", err)
+	}
+	inv, err := m.GetInventory(u)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if inv == nil {
+		inv = &common.Inventory{}
+	}
+	return &conf, configHash(&conf), inv, nil
+}
+
+// rebootStatus the reboot status of a device from its config and inventory
+func rebootStatus(conf *config.EdgeDevConfig, confirm string, inv *common.Inventory) RebootStatus {
+	counter := conf.GetReboot().GetCounter()
+	return RebootStatus{
+		State:            inv.RebootState(counter),
+		Counter:          counter,
+		Reported:         inv.RebootCounter,
+		LastReboot:       inv.LastReboot,
+		LastRebootReason: inv.LastRebootReason,
+		Confirm:          confirm,
+	}
+}
+
+// baseOSStatus the base OS status of a device from its config and inventory
+func baseOSStatus(conf *config.EdgeDevConfig, confirm string, inv *common.Inventory) BaseOSStatus {
+	var version string
+	for _, b := range conf.GetBase() {
+		if b.GetActivate() {
+			version = b.GetBaseOSVersion()
+		}
+	}
+	state, image := inv.BaseOSState(version)
+	return BaseOSStatus{State: state, Version: version, Current: inv.EVEVersion, Image: image, Confirm: confirm}
+}
+
+// readDeviceOpsState read the state of the device of a request, answering with an error if it cannot
+func (h *adminHandler) readDeviceOpsState(w http.ResponseWriter, r *http.Request) (uuid.UUID, *config.EdgeDevConfig, string, *common.Inventory, bool) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return uid, nil, "", nil, false
+	}
+	conf, confirm, inv, err := deviceOpsState(h.managerFor(r), uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return uid, nil, "", nil, false
+	case err != nil:
+		log.Printf("error getting config and inventory of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return uid, nil, "", nil, false
+	}
+	return uid, conf, confirm, inv, true
+}
+
+func (h *adminHandler) deviceRebootGet(w http.ResponseWriter, r *http.Request) {
+	_, conf, confirm, inv, ok := h.readDeviceOpsState(w, r)
+	if !ok {
+		return
+	}
+	h.writeDeviceOps(w, rebootStatus(conf, confirm, inv))
+}
+
+func (h *adminHandler) deviceReboot(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req RebootRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad reboot: %v", err), http.StatusBadRequest)
+		return
+	}
+	// the confirmation token is checked against the config the change is made to
+	h.opsLock.Lock()
+	defer h.opsLock.Unlock()
+	uid, conf, confirm, inv, ok := h.readDeviceOpsState(w, r)
+	if !ok {
+		return
+	}
+	if req.Confirm != confirm {
+		writeError(w, http.StatusConflict, ErrConfirmMismatch, "bad confirmation token, or the config of the device changed since it was issued; get the reboot status for a new one", nil)
+		return
+	}
+	before := rebootStatus(conf, confirm, inv)
+	if conf.Reboot == nil {
+		conf.Reboot = &config.DeviceOpsCmd{}
+	}
+	conf.Reboot.Counter++
+	conf.Reboot.DesiredState = true
+	conf.Reboot.OpsTime = time.Now().UTC().Format(time.RFC3339)
+	if !h.applyDeviceOp(w, r, uid, conf, "") {
+		return
+	}
+	h.audit(r, auditDeviceReboot, uid.String(), map[string]interface{}{"counter": before.Counter}, map[string]interface{}{"counter": conf.Reboot.Counter})
+	if _, conf, confirm, inv, ok = h.readDeviceOpsState(w, r); ok {
+		h.writeDeviceOps(w, rebootStatus(conf, confirm, inv))
+	}
+}
+
+func (h *adminHandler) deviceBaseOSGet(w http.ResponseWriter, r *http.Request) {
+	_, conf, confirm, inv, ok := h.readDeviceOpsState(w, r)
+	if !ok {
+		return
+	}
+	h.writeDeviceOps(w, baseOSStatus(conf, confirm, inv))
+}
+
+func (h *adminHandler) deviceBaseOS(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req BaseOSRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad base OS update: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Version == "" || req.Image == "" {
+		httpError(w, "bad base OS update: version and image are required", http.StatusBadRequest)
+		return
+	}
+	// the confirmation token and the current version are checked against the config the change is made to
+	h.opsLock.Lock()
+	defer h.opsLock.Unlock()
+	uid, conf, confirm, inv, ok := h.readDeviceOpsState(w, r)
+	if !ok {
+		return
+	}
+	if req.Confirm != confirm {
+		writeError(w, http.StatusConflict, ErrConfirmMismatch, "bad confirmation token, or the config of the device changed since it was issued; get the base OS status for a new one", nil)
+		return
+	}
+	if req.CurrentVersion != inv.EVEVersion {
+		writeError(w, http.StatusConflict, ErrVersionMismatch, fmt.Sprintf("device runs EVE version %q, not %q", inv.EVEVersion, req.CurrentVersion), map[string]string{"current": inv.EVEVersion})
+		return
+	}
+	if req.Version == inv.EVEVersion {
+		httpError(w, fmt.Sprintf("bad base OS update: device runs EVE version %s already", req.Version), http.StatusBadRequest)
+		return
+	}
+	before := baseOSStatus(conf, confirm, inv)
+
+	// an image of the catalog is referenced in contentInfo, for its datastore to be added with it
+	tree := req.Image
+	var ref string
+	if _, err := uuid.FromString(req.Image); err != nil {
+		image, err := common.ImageGet(h.managerFor(r), req.Image)
+		_, isNotFound := err.(*common.NotFoundError)
+		switch {
+		case err != nil && isNotFound:
+			httpError(w, fmt.Sprintf("bad base OS update: unknown image %s", req.Image), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("error getting image %s: %v", req.Image, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		tree = image.ID
+		ref = req.Image
+		for _, c := range conf.GetContentInfo() {
+			if c.GetUuid() == tree {
+				ref = ""
+			}
+		}
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		log.Printf("error generating base OS UUID: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	conf.Base = []*config.BaseOSConfig{{
+		Uuidandversion: &config.UUIDandVersion{Uuid: id.String(), Version: "1"},
+		Activate:       true,
+		BaseOSVersion:  req.Version,
+		VolumeID:       tree,
+	}}
+	if !h.applyDeviceOp(w, r, uid, conf, ref) {
+		return
+	}
+	h.audit(r, auditBaseOSUpdate, uid.String(), map[string]interface{}{"version": before.Version, "current": inv.EVEVersion}, map[string]interface{}{"version": req.Version, "image": req.Image})
+	if _, conf, confirm, inv, ok = h.readDeviceOpsState(w, r); ok {
+		h.writeDeviceOps(w, baseOSStatus(conf, confirm, inv))
+	}
+}
+
+// applyDeviceOp set a changed config of a device, with a reference to an image of the catalog added to its
+// contentInfo unless ref is empty, answering with an error if it cannot
+func (h *adminHandler) applyDeviceOp(w http.ResponseWriter, r *http.Request, uid uuid.UUID, conf *config.EdgeDevConfig, ref string) bool {
+	b, err := protojson.Marshal(conf)
+	if err != nil {
+		log.Printf("error processing device config: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if ref != "" {
+		var template map[string]interface{}
+		if err := json.Unmarshal(b, &template); err != nil {
+			log.Printf("error processing device config: %v", err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return false
+		}
+		contentInfo, _ := template["contentInfo"].([]interface{})
+		template["contentInfo"] = append(contentInfo, map[string]interface{}{"$ref": ref})
+		if b, err = json.Marshal(template); err != nil {
+			log.Printf("error processing device config: %v", err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return false
+		}
+	}
+	if _, err := applyChange(h.managerFor(r), nil, b, auditActor(r), uid.String()); err != nil {
+		if _, ok := err.(*errDeviceReadOnly); ok {
+			writeError(w, http.StatusForbidden, ErrDeviceReadOnly, err.Error(), nil)
+			return false
+		}
+		writeError(w, http.StatusBadRequest, ErrInvalidConfig, err.Error(), nil)
+		return false
+	}
+	return true
+}
+
+func (h *adminHandler) writeDeviceOps(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting status to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
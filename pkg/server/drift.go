@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/config"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// lines of context around each change in a config diff
+const diffContext = 3
+
+// ConfigDrift how the config of a device differs from the one it last reported having
+type ConfigDrift struct {
+	// UpToDate whether the device reported having the current config
+	UpToDate bool `json:"up-to-date"`
+	// Hash and Version of the current config
+	Hash    string `json:"hash"`
+	Version string `json:"version,omitempty"`
+	// Pending hash of the config the device has yet to get, empty if it is up to date
+	Pending string `json:"pending,omitempty"`
+	// Acknowledged hash the device last reported, empty if it has not reported any
+	Acknowledged        string     `json:"acknowledged,omitempty"`
+	AcknowledgedVersion string     `json:"acknowledged-version,omitempty"`
+	AcknowledgedAt      *time.Time `json:"acknowledged-at,omitempty"`
+	// Diff from the acknowledged config to the current one, empty if up to date or the acknowledged config is unknown
+	Diff string `json:"diff,omitempty"`
+}
+
+// configHash the hash of a config, as sent to devices in a ConfigResponse
+func configHash(conf *config.EdgeDevConfig) string {
+	hash := sha256.New()
+	common.ComputeConfigElementSha(hash, conf)
+	return base64.URLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// recordConfigAck record the config hash a device reported having, with the config itself if it is the current one.
+// Nothing is written unless the hash changed
+func (h *apiHandler) recordConfigAck(r *http.Request, u uuid.UUID, reported, current string, conf []byte) {
+	// a device that never got a config reports none
+	if reported == "" {
+		return
+	}
+	old, err := h.managerFor(r).GetConfigAck(u)
+	if err != nil {
+		log.Printf("error getting config ack of %s: %v", u, err)
+		return
+	}
+	if old != nil && old.Hash == reported {
+		return
+	}
+	ack := &common.ConfigAck{Hash: reported, Time: time.Now()}
+	if reported == current {
+		ack.Config = conf
+	}
+	if err := h.managerFor(r).SetConfigAck(u, ack); err != nil {
+		log.Printf("error saving config ack of %s: %v", u, err)
+	}
+}
+
+func (h *adminHandler) deviceConfigDrift(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the config the device is served, with its hardware model, is what it acknowledges
+	current, _, err := servedConfig(h.managerFor(r), uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting device config: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	ack, err := h.managerFor(r).GetConfigAck(uid)
+	if err != nil {
+		log.Printf("error getting config ack of %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	drift := ConfigDrift{
+		Hash:    configHash(current),
+		Version: current.GetId().GetVersion(),
+	}
+	if ack != nil {
+		drift.Acknowledged = ack.Hash
+		drift.AcknowledgedAt = &ack.Time
+	}
+	drift.UpToDate = drift.Acknowledged == drift.Hash
+	if !drift.UpToDate {
+		drift.Pending = drift.Hash
+	}
+	if ack != nil && len(ack.Config) > 0 {
+		var acked config.EdgeDevConfig
+		if err := protojson.Unmarshal(ack.Config, &acked); err != nil {
+			log.Printf("error reading acknowledged config of %s: %v", u, err)
+		} else {
+			drift.AcknowledgedVersion = acked.GetId().GetVersion()
+			if !drift.UpToDate {
+				// indented, so that the diff is by field rather than of one long line
+				pretty := protojson.MarshalOptions{Multiline: true, Indent: "  "}
+				drift.Diff = common.DiffLines(pretty.Format(&acked), pretty.Format(current), diffContext)
+			}
+		}
+	}
+
+	body, err := json.Marshal(drift)
+	if err != nil {
+		log.Printf("error converting config drift to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// egressBatchSize how many items are pushed at most at once
+	egressBatchSize = 1000
+	// egressBatchWait how long an item waits for others to be pushed with
+	egressBatchWait = time.Second
+	// egressQueueSize how many items can wait to be pushed before new ones are dropped, so that a slow or unreachable
+	// service does not hold devices up
+	egressQueueSize = 10000
+	// egressPushTimeout how long a push can take
+	egressPushTimeout = 10 * time.Second
+	// egressMinBackoff and egressMaxBackoff bounds of how long to wait before pushing a batch again, doubling on each
+	// failure
+	egressMinBackoff = 500 * time.Millisecond
+	egressMaxBackoff = 30 * time.Second
+)
+
+// egress push items to an external service in batches, in the background. When the service is slow or
+// unreachable, items queue up to egressQueueSize, then new ones are dropped until it catches up
+type egress struct {
+	// service and items what is pushed where, for the logs, e.g. Loki and log entries
+	service string
+	items   string
+	client  *http.Client
+	queue   chan interface{}
+	// send push a batch, returning whether to retry it if it failed
+	send func(batch []interface{}) (bool, error)
+	// counts of the items pushed, dropped as the queue was full, and dropped as the service refused them
+	sent, full, rejected uint64
+}
+
+// newEgress an egress of items to a service, pushed in batches with send
+func newEgress(service, items string, send func(batch []interface{}) (bool, error)) *egress {
+	return &egress{
+		service: service,
+		items:   items,
+		client:  &http.Client{Timeout: egressPushTimeout},
+		queue:   make(chan interface{}, egressQueueSize),
+		send:    send,
+	}
+}
+
+// add queue an item, dropping it if the queue is full
+func (e *egress) add(item interface{}) {
+	select {
+	case e.queue <- item:
+	default:
+		atomic.AddUint64(&e.full, 1)
+	}
+}
+
+// run push the queued items, once egressBatchSize of them are waiting or the oldest waited egressBatchWait, until
+// done is closed. What is waiting then is pushed once more, without retrying
+func (e *egress) run(done <-chan struct{}) {
+	batch := make([]interface{}, 0, egressBatchSize)
+	var wait <-chan time.Time
+	for {
+		select {
+		case item := <-e.queue:
+			batch = append(batch, item)
+			if len(batch) == 1 {
+				wait = time.After(egressBatchWait)
+			}
+			if len(batch) < egressBatchSize {
+				continue
+			}
+		case <-wait:
+		case <-done:
+			if len(batch) > 0 {
+				if _, err := e.send(batch); err != nil {
+					log.Printf("error pushing %d %s to %s on shutdown, dropping them: %v", len(batch), e.items, e.service, err)
+				} else {
+					atomic.AddUint64(&e.sent, uint64(len(batch)))
+				}
+			}
+			return
+		}
+		e.flush(batch, done)
+		batch = batch[:0]
+		wait = nil
+	}
+}
+
+// flush push a batch, retrying with backoff while the service is unreachable or overloaded, as the queue takes the
+// items coming in meanwhile. A batch the service refuses is dropped
+func (e *egress) flush(batch []interface{}, done <-chan struct{}) {
+	backoff := egressMinBackoff
+	for {
+		retry, err := e.send(batch)
+		if err == nil {
+			atomic.AddUint64(&e.sent, uint64(len(batch)))
+			return
+		}
+		if !retry {
+			atomic.AddUint64(&e.rejected, uint64(len(batch)))
+			log.Printf("%s refused %d %s, dropping them: %v", e.service, len(batch), e.items, err)
+			return
+		}
+		log.Printf("error pushing %d %s to %s, retrying in %s: %v", len(batch), e.items, e.service, backoff, err)
+		select {
+		case <-done:
+			log.Printf("dropping %d %s not pushed to %s on shutdown", len(batch), e.items, e.service)
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > egressMaxBackoff {
+			backoff = egressMaxBackoff
+		}
+	}
+}
+
+// post do a push request, returning whether to retry it if it failed: on network errors, when the service is
+// overloaded, and on its errors
+func (e *egress) post(req *http.Request) (bool, error) {
+	res, err := e.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return true, fmt.Errorf("push returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	default:
+		return false, fmt.Errorf("push returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+}
+
+// counts the counts of the items pushed and dropped, by result, for the metrics
+func (e *egress) counts() map[string]uint64 {
+	return map[string]uint64{
+		"sent":       atomic.LoadUint64(&e.sent),
+		"queue-full": atomic.LoadUint64(&e.full),
+		"rejected":   atomic.LoadUint64(&e.rejected),
+	}
+}
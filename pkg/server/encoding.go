@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	accept = "Accept"
+	// other names devices and tools use for protobuf bodies
+	mimeProtobuf  = "application/protobuf"
+	mimeXProtobuf = "application/x-protobuf"
+)
+
+// UnsupportedMediaError a request body in a format other than protobuf or JSON
+type UnsupportedMediaError struct {
+	mediaType string
+}
+
+func (e *UnsupportedMediaError) Error() string {
+	return fmt.Sprintf("unsupported media type %s", e.mediaType)
+}
+
+// bodyType the format of the body of a request, mimeProto or mimeJSON. A body without a Content-Type is protobuf,
+// as sent by older devices
+func bodyType(r *http.Request) (string, error) {
+	ct := r.Header.Get(contentType)
+	if ct == "" {
+		return mimeProto, nil
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", &UnsupportedMediaError{mediaType: ct}
+	}
+	switch mt {
+	case mimeProto, mimeProtobuf, mimeXProtobuf:
+		return mimeProto, nil
+	case mimeJSON:
+		return mimeJSON, nil
+	default:
+		return "", &UnsupportedMediaError{mediaType: mt}
+	}
+}
+
+// unmarshalBody parse the body of a request into msg, as protobuf or JSON according to its Content-Type
+func unmarshalBody(r *http.Request, b []byte, msg proto.Message) error {
+	mt, err := bodyType(r)
+	if err != nil {
+		return err
+	}
+	if mt == mimeJSON {
+		return protojson.Unmarshal(b, msg)
+	}
+	return proto.Unmarshal(b, msg)
+}
+
+// parseFailed report that the body of a request could not be parsed, with 415 Unsupported Media Type if it is
+// neither protobuf nor JSON
+func parseFailed(w http.ResponseWriter, err error) {
+	if _, ok := err.(*UnsupportedMediaError); ok {
+		httpError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+}
+
+// responseType the format to answer a request with, per its Accept header: protobuf unless JSON is preferred.
+// Empty if the client accepts neither
+func responseType(r *http.Request) string {
+	header := r.Header.Get(accept)
+	if header == "" {
+		return mimeProto
+	}
+	// a media type given explicitly takes precedence over the wildcards that match it
+	var protoQ, jsonQ, anyQ float64 = -1, -1, -1
+	for _, part := range strings.Split(header, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mt {
+		case mimeProto, mimeProtobuf, mimeXProtobuf:
+			if q > protoQ {
+				protoQ = q
+			}
+		case mimeJSON:
+			jsonQ = q
+		case "application/*", "*/*":
+			if q > anyQ {
+				anyQ = q
+			}
+		}
+	}
+	if protoQ < 0 {
+		protoQ = anyQ
+	}
+	if jsonQ < 0 {
+		jsonQ = anyQ
+	}
+	switch {
+	case protoQ > 0 && protoQ >= jsonQ:
+		return mimeProto
+	case jsonQ > 0:
+		return mimeJSON
+	default:
+		return ""
+	}
+}
+
+// writeMessage send msg back in the format asked for by the request, with 406 Not Acceptable if it is
+// neither protobuf nor JSON
+func writeMessage(w http.ResponseWriter, r *http.Request, msg proto.Message) {
+	mt := responseType(r)
+	var (
+		out []byte
+		err error
+	)
+	switch mt {
+	case mimeProto:
+		out, err = proto.Marshal(msg)
+	case mimeJSON:
+		out, err = protojson.Marshal(msg)
+	default:
+		httpError(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+		return
+	}
+	if err != nil {
+		httpError(w, fmt.Sprintf("error converting message: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add(contentType, mt)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
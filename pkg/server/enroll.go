@@ -0,0 +1,203 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	ax "github.com/lf-edge/adam/pkg/x509"
+)
+
+const (
+	// DefaultDeviceCertValidity how long the device certificates issued by the DeviceCA are valid, by default
+	DefaultDeviceCertValidity = 10 * 365 * 24 * time.Hour
+
+	mimePEM = "application/x-pem-file"
+)
+
+// DeviceCA the CA the server signs the certificates of devices with, for the devices that register, or rekey, with
+// a certificate signing request instead of a self-signed certificate
+type DeviceCA struct {
+	// CertPath path to the PEM certificate of the CA
+	CertPath string
+	// KeyPath the key of the CA, from the KeyProvider of the server
+	KeyPath string
+	// Validity how long the certificates issued are valid, never past the CA; 0 means DefaultDeviceCertValidity
+	Validity time.Duration
+	// RequireCSR whether devices must register with a certificate signing request, their self-signed certificates
+	// being refused
+	RequireCSR bool
+}
+
+// deviceIssuer signs the certificate signing requests of devices with the DeviceCA
+type deviceIssuer struct {
+	conf   DeviceCA
+	ca     *x509.Certificate
+	signer crypto.Signer
+}
+
+func newDeviceIssuer(conf DeviceCA, provider ax.KeyProvider) (*deviceIssuer, error) {
+	ca, err := ax.ReadCert(conf.CertPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read device CA certificate %s: %v", conf.CertPath, err)
+	}
+	signer, err := provider.Signer(conf.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get device CA key %s from %s: %v", conf.KeyPath, provider.Name(), err)
+	}
+	if !samePublicKey(ca.PublicKey, signer.Public()) {
+		return nil, fmt.Errorf("device CA key %s is not the key of the certificate %s", conf.KeyPath, conf.CertPath)
+	}
+	if conf.Validity <= 0 {
+		conf.Validity = DefaultDeviceCertValidity
+	}
+	return &deviceIssuer{conf: conf, ca: ca, signer: signer}, nil
+}
+
+// issue sign the certificate of a device for a certificate signing request
+func (d *deviceIssuer) issue(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	der, err := ax.SignCSR(csr, d.ca, d.signer, d.conf.Validity)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// samePublicKey whether two public keys are the same, whatever their type
+func samePublicKey(a, b crypto.PublicKey) bool {
+	ab, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bb, err := x509.MarshalPKIXPublicKey(b)
+	return err == nil && bytes.Equal(ab, bb)
+}
+
+// deviceCertFrom the certificate of a device, from the PEM sent to register or rekey with: a certificate, or
+// a certificate signing request, for which the certificate is issued with the DeviceCA, unless it was already.
+// Answers the request and returns nil if it is neither, or not allowed; issued is whether the certificate was
+// signed by the DeviceCA, and so must be sent back to the device
+func (h *apiHandler) deviceCertFrom(w http.ResponseWriter, r *http.Request, b []byte) (cert *x509.Certificate, issued bool) {
+	if !ax.IsCSR(b) {
+		if h.issuer != nil && h.issuer.conf.RequireCSR {
+			writeError(w, http.StatusBadRequest, ErrCSRRequired, "a certificate signing request is required, not a certificate", nil)
+			return nil, false
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			log.Printf("no PEM data found in device certificate")
+			httpError(w, "invalid device certificate", http.StatusBadRequest)
+			return nil, false
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Printf("unable to convert device cert data from message to x509 certificate: %v", err)
+			httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return nil, false
+		}
+		return cert, false
+	}
+	if h.issuer == nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidCSR, "certificate signing requests are not signed by this server, send a certificate", nil)
+		return nil, false
+	}
+	csr, err := ax.ParseCSR(b)
+	if err != nil {
+		log.Printf("bad device certificate signing request: %v", err)
+		writeError(w, http.StatusBadRequest, ErrInvalidCSR, err.Error(), nil)
+		return nil, false
+	}
+	if cert := h.issuedFor(h.managerFor(r), csr); cert != nil {
+		return cert, true
+	}
+	cert, err = h.issuer.issue(csr)
+	if err != nil {
+		log.Printf("error issuing device certificate for %s: %v", csr.Subject.CommonName, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	log.Printf("issued device certificate %s for %s", cert.SerialNumber.Text(16), cert.Subject.CommonName)
+	return cert, true
+}
+
+// issuedFor the certificate issued already for the key of a certificate signing request to a device pending
+// approval, so that the retries of the device are the same pending device; nil if none
+func (h *apiHandler) issuedFor(m driver.DeviceManager, csr *x509.CertificateRequest) *x509.Certificate {
+	if h.approval == nil {
+		return nil
+	}
+	pending, err := common.PendingList(m)
+	if err != nil {
+		log.Printf("error listing pending devices: %v", err)
+		return nil
+	}
+	for _, p := range pending {
+		cert, _, err := p.Certificates()
+		if err == nil && samePublicKey(cert.PublicKey, csr.PublicKey) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// registeredFor the certificate of the device registered with an onboarding certificate and serial, if it is
+// for the key of a certificate signing request, so that a device that did not get its certificate when it was
+// issued can get it again; nil if none. Looks through every device, as it is only for devices retrying
+func (h *apiHandler) registeredFor(m driver.DeviceManager, onboard *x509.Certificate, serial string, csr *x509.CertificateRequest) *x509.Certificate {
+	ids, err := m.DeviceList()
+	if err != nil {
+		log.Printf("error listing devices: %v", err)
+		return nil
+	}
+	for _, u := range ids {
+		cert, onb, devSerial, err := m.DeviceGet(u)
+		if err != nil || cert == nil || onb == nil || devSerial != serial || !bytes.Equal(onb.Raw, onboard.Raw) {
+			continue
+		}
+		if samePublicKey(cert.PublicKey, csr.PublicKey) && cert.CheckSignatureFrom(h.issuer.ca) == nil {
+			return cert
+		}
+	}
+	return nil
+}
+
+// writeIssued send a device the certificate issued for it, followed by that of the DeviceCA
+func (h *apiHandler) writeIssued(w http.ResponseWriter, status int, cert *x509.Certificate) {
+	body := append(ax.PemEncodeCert(cert.Raw), ax.PemEncodeCert(h.issuer.ca.Raw)...)
+	w.Header().Set(contentType, mimePEM)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// reissued answer a device registered already that retries registering with the certificate signing request it
+// was registered with, e.g. after being approved, with the certificate issued for it; false if it is not one
+func (h *apiHandler) reissued(w http.ResponseWriter, r *http.Request, onboard *x509.Certificate, serial string, pemCert []byte) bool {
+	if h.issuer == nil {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(string(pemCert))
+	if err != nil || !ax.IsCSR(b) {
+		return false
+	}
+	csr, err := ax.ParseCSR(b)
+	if err != nil {
+		return false
+	}
+	cert := h.registeredFor(h.managerFor(r), onboard, serial, csr)
+	if cert == nil {
+		return false
+	}
+	h.writeIssued(w, http.StatusOK, cert)
+	return true
+}
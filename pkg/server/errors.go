@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// codes of the errors the server answers with, stable so clients can branch on them rather than on messages
+const (
+	// generic codes, one per status, for errors without a more specific one
+	ErrBadRequest           = "bad-request"
+	ErrUnauthorized         = "unauthorized"
+	ErrForbidden            = "forbidden"
+	ErrNotFound             = "not-found"
+	ErrMethodNotAllowed     = "method-not-allowed"
+	ErrConflict             = "conflict"
+	ErrGone                 = "gone"
+	ErrPayloadTooLarge      = "payload-too-large"
+	ErrUnsupportedMediaType = "unsupported-media-type"
+	ErrNotAcceptable        = "not-acceptable"
+	ErrTooManyRequests      = "too-many-requests"
+	ErrInternal             = "internal"
+	ErrNotImplemented       = "not-implemented"
+	ErrServiceUnavailable   = "service-unavailable"
+
+	// ErrInvalidCert onboarding certificate not registered, or not valid
+	ErrInvalidCert = "invalid-cert"
+	// ErrInvalidSerial serial not allowed for the onboarding certificate
+	ErrInvalidSerial = "invalid-serial"
+	// ErrInvalidSoftSerial soft serial not allowed by the policy of the onboarding certificate
+	ErrInvalidSoftSerial = "invalid-soft-serial"
+	// ErrModelNotAllowed hardware model not allowed by the policy of the onboarding certificate
+	ErrModelNotAllowed = "model-not-allowed"
+	// ErrOnboardRejected registration rejected by the onboarding hook
+	ErrOnboardRejected = "onboard-rejected"
+	// ErrUsedSerial serial already onboarded with the onboarding certificate
+	ErrUsedSerial = "used-serial"
+	// ErrCSRRequired device certificate sent to register with while the server requires a certificate signing request
+	ErrCSRRequired = "csr-required"
+	// ErrInvalidCSR certificate signing request not valid, or sent to a server without a DeviceCA to sign it
+	ErrInvalidCSR = "invalid-csr"
+	// ErrUsedCert device certificate already used by another device
+	ErrUsedCert = "used-cert"
+	// ErrInvalidProof device certificate rotated to without the signature of the rekey nonce by its key
+	ErrInvalidProof = "invalid-proof"
+	// ErrUnregisteredDevice client certificate of no registered device
+	ErrUnregisteredDevice = "unregistered-device"
+	// ErrDeviceDeleted device deleted softly, refused until restored
+	ErrDeviceDeleted = "device-deleted"
+	// ErrCertRevoked device or onboarding certificate revoked
+	ErrCertRevoked = "cert-revoked"
+	// ErrQuotaExceeded device over its quota of a kind of message
+	ErrQuotaExceeded = "quota-exceeded"
+	// ErrBodyTooLarge request body over the limit for its kind of message
+	ErrBodyTooLarge = "body-too-large"
+	// ErrEntryTooLarge log entry over the limit of a single entry
+	ErrEntryTooLarge = "entry-too-large"
+	// ErrInvalidConfig config EVE would reject
+	ErrInvalidConfig = "invalid-config"
+	// ErrTLSRequired request without TLS or without a client certificate
+	ErrTLSRequired = "tls-required"
+	// ErrUntrustedProxy request of a client certificate proxy without a client certificate of its own signed by its CA
+	ErrUntrustedProxy = "untrusted-proxy"
+	// ErrUntrustedDeviceCA device certificate not signed by a CA of the device CA bundles of the listener
+	ErrUntrustedDeviceCA = "untrusted-device-ca"
+	// ErrInvalidToken admin API token unknown, expired or with a bad secret
+	ErrInvalidToken = "invalid-token"
+	// ErrReplayFailed dead letter replayed and answered with an error again
+	ErrReplayFailed = "replay-failed"
+	// ErrModelInUse hardware model still the model of devices
+	ErrModelInUse = "model-in-use"
+	// ErrDatastoreInUse datastore of the catalog still the datastore of images
+	ErrDatastoreInUse = "datastore-in-use"
+	// ErrConfirmMismatch confirmation token of a reboot or EVE update wrong, or issued for a config since changed
+	ErrConfirmMismatch = "confirm-mismatch"
+	// ErrVersionMismatch device not running the EVE version an update expects it to
+	ErrVersionMismatch = "version-mismatch"
+	// ErrFaultInjected error answered by a fault injection rule, not by a failure
+	ErrFaultInjected = "fault-injected"
+	// ErrOverloaded device API request shed, past the concurrency or the timeout of the budget of its endpoint
+	ErrOverloaded = "overloaded"
+	// ErrBadSnapshot state snapshot damaged, not matching the checksums of its manifest, or of an unknown version
+	ErrBadSnapshot = "bad-snapshot"
+	// ErrDeviceReadOnly config of a device with the read-only flag set
+	ErrDeviceReadOnly = "device-read-only"
+	// ErrDeviceLimit registering with an onboarding certificate with as many devices as its policy allows
+	ErrDeviceLimit = "device-limit"
+	// ErrConfigConflict config set with an If-Match not matching the ETag of the config stored, changed since read
+	ErrConfigConflict = "config-conflict"
+	// ErrIfMatchRequired config set without an If-Match, by a server requiring one
+	ErrIfMatchRequired = "if-match-required"
+	// ErrInvalidAuth v2 API request whose AuthContainer is not signed by the key of the device certificate
+	ErrInvalidAuth = "invalid-auth"
+)
+
+// ErrorResponse body of every error the server answers with
+type ErrorResponse struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// statusCodes generic code of each status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusMethodNotAllowed:      ErrMethodNotAllowed,
+	http.StatusConflict:              ErrConflict,
+	http.StatusGone:                  ErrGone,
+	http.StatusRequestEntityTooLarge: ErrPayloadTooLarge,
+	http.StatusUnsupportedMediaType:  ErrUnsupportedMediaType,
+	http.StatusNotAcceptable:         ErrNotAcceptable,
+	http.StatusTooManyRequests:       ErrTooManyRequests,
+	http.StatusInternalServerError:   ErrInternal,
+	http.StatusNotImplemented:        ErrNotImplemented,
+	http.StatusServiceUnavailable:    ErrServiceUnavailable,
+}
+
+// statusCode generic code of a status, the internal one for 5xx without one and the bad request one otherwise
+func statusCode(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return ErrInternal
+	}
+	return ErrBadRequest
+}
+
+// httpError answer a request with an error, as http.Error does, with the generic code of the status
+func httpError(w http.ResponseWriter, message string, status int) {
+	writeError(w, status, statusCode(status), message, nil)
+}
+
+// writeError answer a request with an error, as an ErrorResponse, with details if not nil
+func writeError(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	b, err := json.Marshal(ErrorResponse{Code: code, Message: message, Details: details})
+	if err != nil {
+		b, _ = json.Marshal(ErrorResponse{Code: code, Message: message})
+	}
+	h := w.Header()
+	// set by handlers for the body they would have answered with
+	h.Del("Content-Length")
+	h.Set(contentType, mimeJSON)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
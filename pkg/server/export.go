@@ -0,0 +1,327 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	ax "github.com/lf-edge/adam/pkg/x509"
+	uuid "github.com/satori/go.uuid"
+)
+
+// The certificates archive has a directory per onboarding certificate, named by its CN, and per device, named by its
+// UUID. No private key is in it, adam has none
+const (
+	exportOnboardDir     = "onboard"
+	exportDeviceDir      = "device"
+	exportCertFile       = "cert.pem"
+	exportSerialsFile    = "serials.txt" // onboarding serials or patterns, one per line
+	exportDeviceOnboard  = "onboard.pem" // the onboarding certificate of a device, if it onboarded with one
+	exportDeviceSerial   = "serial.txt"
+	mimeGzip             = "application/gzip"
+	maxExportEntrySize   = 1024 * 1024
+	exportFilenameLayout = "20060102-150405"
+)
+
+// CertsImportResult what an import of a certificates archive registered, and what was left as it was
+type CertsImportResult struct {
+	// Onboard the CNs of the onboarding certificates registered, replacing the serials of those that existed
+	Onboard []string `json:"onboard"`
+	// Devices the UUIDs of the devices registered
+	Devices []string `json:"devices"`
+	// Skipped the devices that were not registered, by UUID, with why
+	Skipped map[string]string `json:"skipped,omitempty"`
+}
+
+// exportedOnboard an onboarding certificate in a certificates archive, with its serials
+type exportedOnboard struct {
+	cert    *x509.Certificate
+	serials []string
+}
+
+// exportedDevice a device in a certificates archive
+type exportedDevice struct {
+	cert    *x509.Certificate
+	onboard *x509.Certificate
+	serial  string
+}
+
+// certsExport stream a tar.gz of all onboarding certificates with their serials, and of all device certificates with
+// the onboarding certificate and serial they registered with, to back up the identities apart from the storage
+func (h *adminHandler) certsExport(w http.ResponseWriter, r *http.Request) {
+	m := h.managerFor(r)
+	// everything is read before the response starts, so that a failure is still answered with an error
+	files := map[string][]byte{}
+	cns, err := m.OnboardList()
+	if err != nil {
+		log.Printf("error listing onboarding certificates: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	for _, cn := range cns {
+		name := common.GetOnboardCertName(cn)
+		cert, serials, err := m.OnboardGet(name)
+		if _, isNotFound := err.(*common.NotFoundError); isNotFound && name != cn {
+			// the memory driver looks them up by their CN as it is
+			cert, serials, err = m.OnboardGet(cn)
+		}
+		if err != nil {
+			log.Printf("error getting onboarding certificate %s: %v", cn, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		dir := path.Join(exportOnboardDir, name)
+		files[path.Join(dir, exportCertFile)] = ax.PemEncodeCert(cert.Raw)
+		files[path.Join(dir, exportSerialsFile)] = []byte(strings.Join(serials, "\n") + "\n")
+	}
+	uids, err := m.DeviceList()
+	if err != nil {
+		log.Printf("error listing devices: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	for _, u := range uids {
+		cert, onboard, serial, err := m.DeviceGet(u)
+		if _, isNotFound := err.(*common.NotFoundError); isNotFound {
+			// removed since it was listed
+			continue
+		}
+		if err != nil {
+			log.Printf("error getting device %s: %v", u, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		dir := path.Join(exportDeviceDir, u.String())
+		files[path.Join(dir, exportCertFile)] = ax.PemEncodeCert(cert.Raw)
+		if onboard != nil {
+			files[path.Join(dir, exportDeviceOnboard)] = ax.PemEncodeCert(onboard.Raw)
+		}
+		if serial != "" {
+			files[path.Join(dir, exportDeviceSerial)] = []byte(serial + "\n")
+		}
+	}
+
+	now := time.Now()
+	w.Header().Set(contentType, mimeGzip)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="adam-certs-%s.tar.gz"`, now.UTC().Format(exportFilenameLayout)))
+	w.WriteHeader(http.StatusOK)
+	if err := writeCertsArchive(w, files, now); err != nil {
+		log.Printf("error writing certificates archive: %v", err)
+	}
+}
+
+// writeCertsArchive write files, by path, as a tar.gz, in the order of their paths
+func writeCertsArchive(w io.Writer, files map[string][]byte, modTime time.Time) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		b := files[name]
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), ModTime: modTime, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("error writing %s: %v", name, err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			return fmt.Errorf("error writing %s: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readCertsArchive read the onboarding certificates, by CN, and the devices, by UUID, of a certificates archive
+func readCertsArchive(r io.Reader) (map[string]*exportedOnboard, map[uuid.UUID]*exportedDevice, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a tar.gz: %v", err)
+	}
+	defer gz.Close()
+	onboards := map[string]*exportedOnboard{}
+	devices := map[uuid.UUID]*exportedDevice{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		parts := strings.Split(path.Clean(strings.TrimPrefix(hdr.Name, "./")), "/")
+		if len(parts) != 3 {
+			return nil, nil, fmt.Errorf("unexpected file %s", hdr.Name)
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(tr, maxExportEntrySize+1))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading %s: %v", hdr.Name, err)
+		}
+		if len(b) > maxExportEntrySize {
+			return nil, nil, fmt.Errorf("%s is over %d bytes", hdr.Name, maxExportEntrySize)
+		}
+		switch parts[0] {
+		case exportOnboardDir:
+			o, ok := onboards[parts[1]]
+			if !ok {
+				o = &exportedOnboard{}
+				onboards[parts[1]] = o
+			}
+			switch parts[2] {
+			case exportCertFile:
+				if o.cert, err = ax.ParseCert(b); err != nil {
+					return nil, nil, fmt.Errorf("bad onboarding certificate %s: %v", hdr.Name, err)
+				}
+			case exportSerialsFile:
+				o.serials = splitLines(b)
+			default:
+				return nil, nil, fmt.Errorf("unexpected file %s", hdr.Name)
+			}
+		case exportDeviceDir:
+			u, err := uuid.FromString(parts[1])
+			if err != nil {
+				return nil, nil, fmt.Errorf("bad device UUID in %s: %v", hdr.Name, err)
+			}
+			d, ok := devices[u]
+			if !ok {
+				d = &exportedDevice{}
+				devices[u] = d
+			}
+			switch parts[2] {
+			case exportCertFile:
+				if d.cert, err = ax.ParseCert(b); err != nil {
+					return nil, nil, fmt.Errorf("bad device certificate %s: %v", hdr.Name, err)
+				}
+			case exportDeviceOnboard:
+				if d.onboard, err = ax.ParseCert(b); err != nil {
+					return nil, nil, fmt.Errorf("bad device onboarding certificate %s: %v", hdr.Name, err)
+				}
+			case exportDeviceSerial:
+				d.serial = strings.TrimSpace(string(b))
+			default:
+				return nil, nil, fmt.Errorf("unexpected file %s", hdr.Name)
+			}
+		default:
+			return nil, nil, fmt.Errorf("unexpected file %s", hdr.Name)
+		}
+	}
+	for cn, o := range onboards {
+		if o.cert == nil {
+			return nil, nil, fmt.Errorf("onboarding certificate %s has no %s", cn, exportCertFile)
+		}
+		for _, serial := range o.serials {
+			if err := common.ValidateSerialPattern(serial); err != nil {
+				return nil, nil, fmt.Errorf("onboarding certificate %s: %v", cn, err)
+			}
+		}
+	}
+	for u, d := range devices {
+		if d.cert == nil {
+			return nil, nil, fmt.Errorf("device %s has no %s", u, exportCertFile)
+		}
+	}
+	return onboards, devices, nil
+}
+
+// splitLines the non-blank lines of b, trimmed
+func splitLines(b []byte) []string {
+	var lines []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// certsImport register the onboarding certificates and devices of a certificates archive, as exported. Onboarding
+// certificates get the serials of the archive; devices are registered with the UUID they had, unless one is already
+// registered with that UUID or certificate. The archive is read in full before anything is registered, so a bad
+// one changes nothing
+func (h *adminHandler) certsImport(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	onboards, devices, err := readCertsArchive(bytes.NewReader(body))
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad certificates archive: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	m := h.managerFor(r)
+	result := CertsImportResult{Onboard: []string{}, Devices: []string{}, Skipped: map[string]string{}}
+	for _, o := range onboards {
+		cn := common.GetOnboardCertName(o.cert.Subject.CommonName)
+		var before interface{}
+		if _, existing, err := m.OnboardGet(cn); err == nil {
+			before = map[string]interface{}{"serials": existing}
+		}
+		if err := m.OnboardRegister(o.cert, o.serials); err != nil {
+			log.Printf("error registering onboarding certificate %s: %v", cn, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		h.audit(r, auditOnboardAdd, cn, before, map[string]interface{}{"serials": o.serials})
+		result.Onboard = append(result.Onboard, cn)
+	}
+	for u, d := range devices {
+		u := u
+		if _, _, _, err := m.DeviceGet(&u); err == nil {
+			result.Skipped[u.String()] = "already registered"
+			continue
+		}
+		owner, err := m.DeviceCheckCert(d.cert)
+		if err != nil {
+			log.Printf("error checking certificate of device %s: %v", u, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if owner != nil {
+			result.Skipped[u.String()] = fmt.Sprintf("certificate already used by device %s", owner)
+			continue
+		}
+		if err := m.DeviceRegister(u, d.cert, d.onboard, d.serial, initialConfig(m, u, d.onboard, h.baseConfig)); err != nil {
+			log.Printf("error registering device %s: %v", u, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		h.audit(r, auditDeviceAdd, u.String(), nil, deviceSummary(d.cert, d.onboard, d.serial))
+		result.Devices = append(result.Devices, u.String())
+	}
+	sort.Strings(result.Onboard)
+	sort.Strings(result.Devices)
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("error converting certificates import result to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,384 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/eve/api/go/config"
+	uuid "github.com/satori/go.uuid"
+)
+
+// faults injected into the requests of devices
+const (
+	// FaultError answer with an error status instead of handling the request
+	FaultError = "error"
+	// FaultDelay handle the request after a delay
+	FaultDelay = "delay"
+	// FaultTruncate send only the start of the body of the response, closing the connection before the rest
+	FaultTruncate = "truncate"
+	// FaultStaleConfig send the config with a hash other than its own, that of the config the device has
+	FaultStaleConfig = "stale-config"
+)
+
+// maxFaultDelay the longest delay a fault can add to a request
+const maxFaultDelay = 10 * time.Minute
+
+// FaultRule a fault to inject into the requests of devices that match it, to exercise the handling of a failing
+// controller by EVE
+type FaultRule struct {
+	ID string `json:"id"`
+	// Kind one of error, delay, truncate and stale-config
+	Kind string `json:"kind"`
+	// Endpoints the endpoints of the device API whose requests get the fault, as paths or route templates, e.g.
+	// /api/v1/edgedevice/config or /api/v1/edgedevice/apps/instances/id/{uuid}/logs; all of them if empty
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Devices UUIDs of the devices whose requests get the fault; all of them if empty
+	Devices []string `json:"devices,omitempty"`
+	// Percent of the matching requests that get the fault, chosen at random; 100 if not set
+	Percent float64 `json:"percent,omitempty"`
+	// Status of the error answered, for error; 503 if not set
+	Status int `json:"status,omitempty"`
+	// DelayMs how long to delay the requests by, for delay
+	DelayMs int64 `json:"delay-ms,omitempty"`
+	// TruncateBytes how many bytes of the body to send, for truncate; half of it if not set
+	TruncateBytes int `json:"truncate-bytes,omitempty"`
+	// Limit after how many faults the rule stops injecting; never if not set
+	Limit uint64 `json:"limit,omitempty"`
+	// Injected how many faults the rule injected
+	Injected uint64    `json:"injected"`
+	Created  time.Time `json:"created"`
+}
+
+// Validate check that a fault rule is complete and consistent, setting the defaults of the fields not set
+func (f *FaultRule) Validate() error {
+	switch f.Kind {
+	case FaultError:
+		if f.Status == 0 {
+			f.Status = http.StatusServiceUnavailable
+		}
+		if f.Status < 400 || f.Status > 599 {
+			return fmt.Errorf("bad status %d, must be between 400 and 599", f.Status)
+		}
+	case FaultDelay:
+		if f.DelayMs <= 0 || time.Duration(f.DelayMs)*time.Millisecond > maxFaultDelay {
+			return fmt.Errorf("bad delay-ms %d, must be more than 0 and at most %d", f.DelayMs, maxFaultDelay.Milliseconds())
+		}
+	case FaultTruncate:
+		if f.TruncateBytes < 0 {
+			return fmt.Errorf("bad truncate-bytes %d, must be at least 0", f.TruncateBytes)
+		}
+	case FaultStaleConfig:
+	default:
+		return fmt.Errorf("unknown fault kind %q, must be one of %s, %s, %s and %s", f.Kind, FaultError, FaultDelay, FaultTruncate, FaultStaleConfig)
+	}
+	if f.Percent == 0 {
+		f.Percent = 100
+	}
+	if f.Percent < 0 || f.Percent > 100 {
+		return fmt.Errorf("bad percent %v, must be more than 0 and at most 100", f.Percent)
+	}
+	for i, d := range f.Devices {
+		u, err := uuid.FromString(d)
+		if err != nil {
+			return fmt.Errorf("bad device UUID %q: %v", d, err)
+		}
+		f.Devices[i] = u.String()
+	}
+	for _, e := range f.Endpoints {
+		if !strings.HasPrefix(e, "/api/") {
+			return fmt.Errorf("bad endpoint %q, must be a path of the device API, under /api/", e)
+		}
+	}
+	return nil
+}
+
+// matches whether a request to a path, with the template of its route, from a device, nil if unknown, is one the
+// rule injects faults into
+func (f *FaultRule) matches(p, tpl string, device *uuid.UUID) bool {
+	if f.Limit > 0 && f.Injected >= f.Limit {
+		return false
+	}
+	if len(f.Endpoints) > 0 {
+		found := false
+		for _, e := range f.Endpoints {
+			if e == p || e == tpl {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Devices) > 0 {
+		if device == nil {
+			return false
+		}
+		found := false
+		for _, d := range f.Devices {
+			if d == device.String() {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// faultInjector the fault rules in effect, kept in memory until the server stops
+type faultInjector struct {
+	lock    sync.Mutex
+	manager driver.DeviceManager
+	rules   map[string]*FaultRule
+	rand    *rand.Rand
+}
+
+func newFaultInjector(m driver.DeviceManager) *faultInjector {
+	return &faultInjector{
+		manager: m,
+		rules:   map[string]*FaultRule{},
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// add add a fault rule, once valid, returning it
+func (f *faultInjector) add(rule FaultRule) (*FaultRule, error) {
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, fmt.Errorf("error generating fault rule ID: %v", err)
+	}
+	rule.ID = id.String()
+	rule.Injected = 0
+	rule.Created = time.Now().UTC()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rules[rule.ID] = &rule
+	r := rule
+	return &r, nil
+}
+
+// remove remove a fault rule, returning it, false if there is none with the ID
+func (f *faultInjector) remove(id string) (FaultRule, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	rule, ok := f.rules[id]
+	if !ok {
+		return FaultRule{}, false
+	}
+	delete(f.rules, id)
+	return *rule, true
+}
+
+// list the fault rules, the oldest first
+func (f *faultInjector) list() []FaultRule {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	rules := make([]FaultRule, 0, len(f.rules))
+	for _, rule := range f.rules {
+		rules = append(rules, *rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Created.Before(rules[j].Created)
+	})
+	return rules
+}
+
+// pick the fault to inject into a request, if any: that of the oldest rule matching it that draws it, counted as
+// injected
+func (f *faultInjector) pick(p, tpl string, device *uuid.UUID) *FaultRule {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var rules []*FaultRule
+	for _, rule := range f.rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Created.Before(rules[j].Created)
+	})
+	for _, rule := range rules {
+		if !rule.matches(p, tpl, device) || f.rand.Float64()*100 >= rule.Percent {
+			continue
+		}
+		rule.Injected++
+		injected := *rule
+		return &injected
+	}
+	return nil
+}
+
+// needsDevice whether a rule is for some devices only, so that the device of each request is to be known
+func (f *faultInjector) needsDevice() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, rule := range f.rules {
+		if len(rule.Devices) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// staleConfigKey key in the context of a request of whether to send the config with a stale hash
+type staleConfigKey struct{}
+
+// staleConfig whether to send the config of a request with a stale hash, per a FaultStaleConfig rule
+func staleConfig(r *http.Request) bool {
+	ok, _ := r.Context().Value(staleConfigKey{}).(bool)
+	return ok
+}
+
+// staleConfigHash a hash other than that of the config served, current: the one the device sent, or that of an empty
+// config if the device sent none or the current one
+func staleConfigHash(sent, current string) string {
+	if sent != "" && sent != current {
+		return sent
+	}
+	return configHash(&config.EdgeDevConfig{})
+}
+
+// inject inject the faults of the rules into the requests of devices that match them, once their cert is checked
+func (f *faultInjector) inject(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tpl := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if t, err := route.GetPathTemplate(); err == nil {
+				tpl = t
+			}
+		}
+		var device *uuid.UUID
+		if f.needsDevice() {
+			u, err := traced(r, f.manager).DeviceCheckCert(getClientCert(r))
+			if err != nil {
+				log.Printf("error checking device cert for faults: %v", err)
+			}
+			device = u
+		}
+		rule := f.pick(r.URL.Path, tpl, device)
+		if rule == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Printf("injecting %s fault of rule %s into %s %s", rule.Kind, rule.ID, r.Method, r.URL.Path)
+		switch rule.Kind {
+		case FaultError:
+			writeError(w, rule.Status, ErrFaultInjected, fmt.Sprintf("fault injected by rule %s", rule.ID), nil)
+		case FaultDelay:
+			select {
+			case <-time.After(time.Duration(rule.DelayMs) * time.Millisecond):
+				next.ServeHTTP(w, r)
+			case <-r.Context().Done():
+			}
+		case FaultTruncate:
+			t := &truncatingWriter{ResponseWriter: w}
+			next.ServeHTTP(t, r)
+			t.finish(rule.TruncateBytes)
+		case FaultStaleConfig:
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), staleConfigKey{}, true)))
+		}
+	})
+}
+
+// truncatingWriter a ResponseWriter keeping the response, to send only the start of its body
+type truncatingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (t *truncatingWriter) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+	}
+}
+
+func (t *truncatingWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	return t.body.Write(b)
+}
+
+// finish send the response with the length of its whole body, but only n bytes of it, half if n is 0, so that the
+// connection is closed before the rest
+func (t *truncatingWriter) finish(n int) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	b := t.body.Bytes()
+	if len(b) == 0 {
+		t.ResponseWriter.WriteHeader(t.status)
+		return
+	}
+	if n <= 0 || n >= len(b) {
+		n = len(b) / 2
+	}
+	t.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	t.ResponseWriter.WriteHeader(t.status)
+	t.ResponseWriter.Write(b[:n])
+}
+
+func (h *adminHandler) faultList(w http.ResponseWriter, r *http.Request) {
+	h.writeFault(w, http.StatusOK, h.faults.list())
+}
+
+func (h *adminHandler) faultAdd(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var rule FaultRule
+	if err := json.Unmarshal(body, &rule); err != nil {
+		httpError(w, fmt.Sprintf("bad fault rule: %v", err), http.StatusBadRequest)
+		return
+	}
+	added, err := h.faults.add(rule)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad fault rule: %v", err), http.StatusBadRequest)
+		return
+	}
+	h.audit(r, auditFaultAdd, added.ID, nil, added)
+	h.writeFault(w, http.StatusCreated, added)
+}
+
+func (h *adminHandler) faultRemove(w http.ResponseWriter, r *http.Request) {
+	rule, ok := h.faults.remove(mux.Vars(r)["id"])
+	if !ok {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	h.audit(r, auditFaultRemove, rule.ID, rule, nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *adminHandler) writeFault(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting fault rule to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
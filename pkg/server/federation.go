@@ -0,0 +1,695 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	ax "github.com/lf-edge/adam/pkg/x509"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// federationSyncPath and federationTelemetryPath the admin endpoints of a primary its secondaries call
+	federationSyncPath      = "/admin/federation/sync"
+	federationTelemetryPath = "/admin/federation/telemetry"
+	// DefaultSyncInterval how often a secondary syncs from its primary, unless set
+	DefaultSyncInterval = time.Minute
+	// federationSyncTimeout how long a sync from the primary can take
+	federationSyncTimeout = 2 * time.Minute
+	// maxForwardedPayload most bytes of a message of a device forwarded to the primary; a larger one is only kept
+	// by the secondary
+	maxForwardedPayload = 1024 * 1024
+	// federationActor actor of the audit records of what a secondary changes as it syncs from its primary
+	federationActor = "federation"
+)
+
+// forwardedPath the paths of the device API whose messages a secondary forwards to its primary: the telemetry of
+// devices. Registrations and config requests are answered by the secondary alone
+var forwardedPath = regexp.MustCompile(`^/api/v1/edgedevice/(info|metrics|logs|newlogs|apps/instances/id/[^/]+/logs|apps/instanceid/id/[^/]+/newlogs)$`)
+
+// FederationSync what a secondary syncs from its primary: the onboarding certificates and the devices, with the
+// config each is served
+type FederationSync struct {
+	Onboard []FederationOnboard `json:"onboard"`
+	Devices []FederationDevice  `json:"devices"`
+}
+
+// FederationOnboard an onboarding certificate synced to secondaries, with its serials and policy
+type FederationOnboard struct {
+	// Cert the certificate, PEM-encoded
+	Cert    []byte                `json:"cert"`
+	Serials []string              `json:"serials"`
+	Policy  *common.OnboardPolicy `json:"policy,omitempty"`
+}
+
+// FederationDevice a device synced to secondaries
+type FederationDevice struct {
+	UUID string `json:"uuid"`
+	// Cert and Onboard the certificate of the device and the onboarding certificate it registered with if any,
+	// PEM-encoded
+	Cert    []byte `json:"cert"`
+	Onboard []byte `json:"onboard,omitempty"`
+	Serial  string `json:"serial,omitempty"`
+	// Config the config the device is served by the primary, with its held config, hardware model or quarantine
+	Config json.RawMessage `json:"config"`
+}
+
+// FederationMessage a message of a device a secondary stored, forwarded to its primary to be stored there too
+type FederationMessage struct {
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	ContentType string `json:"content-type,omitempty"`
+	// Cert the certificate the device sent the message with, PEM-encoded
+	Cert    []byte `json:"cert"`
+	Payload []byte `json:"payload"`
+}
+
+// FederationTelemetry a batch of messages of devices a secondary forwards to its primary
+type FederationTelemetry struct {
+	Messages []FederationMessage `json:"messages"`
+}
+
+// FederationResult how many of the messages forwarded by a secondary its primary stored
+type FederationResult struct {
+	Accepted int `json:"accepted"`
+	Failed   int `json:"failed"`
+}
+
+// FederationStatus the state of the sync of a secondary from its primary
+type FederationStatus struct {
+	// Upstream URL of the primary
+	Upstream string `json:"upstream"`
+	// LastAttempt and LastSync when the secondary last tried to sync, and last synced without error
+	LastAttempt *time.Time `json:"last-attempt,omitempty"`
+	LastSync    *time.Time `json:"last-sync,omitempty"`
+	LastError   string     `json:"last-error,omitempty"`
+	// Onboard and Devices how many onboarding certificates and devices the last sync had
+	Onboard int `json:"onboard"`
+	Devices int `json:"devices"`
+	// Messages counts of the messages of devices forwarded to the primary, by result
+	Messages map[string]uint64 `json:"messages"`
+}
+
+// federation the link of a secondary to its primary: it syncs the onboarding certificates and devices of the
+// primary, with their configs, every interval, and forwards the telemetry of devices to it, in batches, in the
+// background
+type federation struct {
+	*egress
+	manager  driver.DeviceManager
+	url      string
+	token    string
+	interval time.Duration
+	client   *http.Client
+
+	lock   sync.Mutex
+	status FederationStatus
+	// etag the ETag of the last sync applied, to skip those that did not change
+	etag string
+	// onboard and devices what the last sync had, by name of onboarding certificate and by UUID, to remove what
+	// the primary no longer has. What the secondary had before it started syncing is kept
+	onboard map[string]string
+	devices map[uuid.UUID]bool
+}
+
+// newFederation the link to the primary at a http:// or https:// URL, authenticated with an API token of the
+// primary, and trusting the CA certificates in a PEM file for its server certificate if not empty
+func newFederation(m driver.DeviceManager, rawURL, token, caPath string, interval time.Duration) (*federation, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad upstream URL %s: %v", rawURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("bad upstream URL %s: must be http:// or https://host[:port]", rawURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caPath != "" {
+		pool, err := loadCAs("upstream", caPath)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+	f := &federation{
+		manager:  m,
+		url:      strings.TrimSuffix(u.String(), "/"),
+		token:    token,
+		interval: interval,
+		client:   &http.Client{Timeout: federationSyncTimeout, Transport: transport},
+		status:   FederationStatus{Upstream: u.Redacted()},
+		onboard:  map[string]string{},
+		devices:  map[uuid.UUID]bool{},
+	}
+	f.egress = newEgress("upstream Adam", "device messages", f.send)
+	f.egress.client = &http.Client{Timeout: egressPushTimeout, Transport: transport}
+	return f, nil
+}
+
+// forward queue the messages of devices to forwardedPath to be forwarded to the primary, once the secondary
+// stored them. A message larger than maxForwardedPayload is not forwarded. It does nothing without a federation
+func (f *federation) forward(next http.Handler) http.Handler {
+	if f == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !forwardedPath.MatchString(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		payload := &cappedBuffer{max: maxForwardedPayload}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, payload), r.Body}
+		rec := &logRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status != 0 && (rec.status < 200 || rec.status > 299) {
+			return
+		}
+		if payload.truncated {
+			log.Printf("not forwarding message to %s of more than %d bytes upstream", r.URL.Path, maxForwardedPayload)
+			return
+		}
+		f.add(FederationMessage{
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			ContentType: r.Header.Get(contentType),
+			Cert:        ax.PemEncodeCert(getClientCert(r).Raw),
+			Payload:     payload.Bytes(),
+		})
+	})
+}
+
+// cappedBuffer a buffer of up to max bytes, that drops what is written past them, remembering it did
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(b []byte) (int, error) {
+	if c.truncated || c.Len()+len(b) > c.max {
+		c.truncated = true
+		return len(b), nil
+	}
+	return c.Buffer.Write(b)
+}
+
+// send forward a batch of messages to the primary, gzipped, returning whether to retry it if it failed
+func (f *federation) send(batch []interface{}) (bool, error) {
+	t := FederationTelemetry{Messages: make([]FederationMessage, 0, len(batch))}
+	for _, m := range batch {
+		t.Messages = append(t.Messages, m.(FederationMessage))
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(t); err != nil {
+		return false, fmt.Errorf("unable to encode device messages: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return false, fmt.Errorf("unable to compress device messages: %v", err)
+	}
+	req, err := http.NewRequest("POST", f.url+federationTelemetryPath, &buf)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(contentType, mimeJSON)
+	req.Header.Set("Content-Encoding", "gzip")
+	f.authorize(req)
+	return f.post(req)
+}
+
+// authorize set the API token of the primary on a request to it, if there is one
+func (f *federation) authorize(req *http.Request) {
+	if f.token != "" {
+		req.Header.Set(authorizationHeader, bearerScheme+f.token)
+	}
+}
+
+// follow sync from the primary every interval, until done is closed
+func (f *federation) follow(done <-chan struct{}) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now().UTC()
+		err := f.pull()
+		f.lock.Lock()
+		f.status.LastAttempt = &start
+		if err != nil {
+			f.status.LastError = err.Error()
+			log.Printf("error syncing from upstream %s: %v", f.status.Upstream, err)
+		} else {
+			f.status.LastSync, f.status.LastError = &start, ""
+		}
+		f.lock.Unlock()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pull get what the primary has and apply it, unless it did not change since the last sync
+func (f *federation) pull() error {
+	req, err := http.NewRequest("GET", f.url+federationSyncPath, nil)
+	if err != nil {
+		return err
+	}
+	f.authorize(req)
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("sync returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	var s FederationSync
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		return fmt.Errorf("bad sync: %v", err)
+	}
+	if err := f.apply(&s); err != nil {
+		// synced again in full next time
+		f.etag = ""
+		return err
+	}
+	f.etag = res.Header.Get("ETag")
+	return nil
+}
+
+// apply make the onboarding certificates and devices of the secondary those of a sync, removing those the primary
+// had at the last sync but no longer has. What fails is logged, and the first error returned once the rest is done
+func (f *federation) apply(s *FederationSync) error {
+	m := f.manager
+	var first error
+	fail := func(err error) {
+		log.Printf("error syncing from upstream: %v", err)
+		if first == nil {
+			first = err
+		}
+	}
+
+	onboard := map[string]string{}
+	for _, o := range s.Onboard {
+		cert, err := parsePEMCert(o.Cert)
+		if err != nil {
+			fail(fmt.Errorf("bad onboarding certificate: %v", err))
+			continue
+		}
+		cn := cert.Subject.CommonName
+		name := common.GetOnboardCertName(cn)
+		onboard[name] = cn
+		existing, serials, err := getOnboard(m, cn)
+		if _, isNotFound := err.(*common.NotFoundError); err != nil && !isNotFound {
+			fail(fmt.Errorf("error getting onboarding certificate %s: %v", name, err))
+			continue
+		}
+		if existing == nil || !existing.Equal(cert) || !sameStrings(serials, o.Serials) {
+			if err := m.OnboardRegister(cert, o.Serials); err != nil {
+				fail(fmt.Errorf("error registering onboarding certificate %s: %v", name, err))
+				continue
+			}
+			f.audit(auditOnboardAdd, name, nil, map[string]interface{}{"serials": o.Serials})
+		}
+		policy, err := m.OnboardPolicyGet(name)
+		if err != nil {
+			fail(fmt.Errorf("error getting policy of onboarding certificate %s: %v", name, err))
+			continue
+		}
+		if !reflect.DeepEqual(policy, o.Policy) {
+			if err := m.OnboardPolicySet(name, o.Policy); err != nil {
+				fail(fmt.Errorf("error setting policy of onboarding certificate %s: %v", name, err))
+				continue
+			}
+			f.audit(auditOnboardPolicySet, name, policy, o.Policy)
+		}
+	}
+
+	devices := map[uuid.UUID]bool{}
+	for _, d := range s.Devices {
+		u, err := uuid.FromString(d.UUID)
+		if err != nil {
+			fail(fmt.Errorf("bad device UUID %s: %v", d.UUID, err))
+			continue
+		}
+		devices[u] = true
+		if err := f.applyDevice(u, d); err != nil {
+			fail(err)
+		}
+	}
+
+	for name, cn := range f.onboard {
+		if _, ok := onboard[name]; ok {
+			continue
+		}
+		err := m.OnboardRemove(name)
+		if _, isNotFound := err.(*common.NotFoundError); isNotFound && name != cn {
+			// the memory driver keeps them by their CN as it is
+			err = m.OnboardRemove(cn)
+		}
+		if _, isNotFound := err.(*common.NotFoundError); err != nil && !isNotFound {
+			fail(fmt.Errorf("error removing onboarding certificate %s: %v", name, err))
+			onboard[name] = cn
+			continue
+		}
+		f.audit(auditOnboardRemove, name, nil, nil)
+	}
+	for u := range f.devices {
+		if devices[u] {
+			continue
+		}
+		u := u
+		err := m.DeviceRemove(&u)
+		if _, isNotFound := err.(*common.NotFoundError); err != nil && !isNotFound {
+			fail(fmt.Errorf("error removing device %s: %v", u, err))
+			devices[u] = true
+			continue
+		}
+		f.audit(auditDeviceRemove, u.String(), nil, nil)
+	}
+
+	f.lock.Lock()
+	f.onboard, f.devices = onboard, devices
+	f.status.Onboard, f.status.Devices = len(s.Onboard), len(s.Devices)
+	f.lock.Unlock()
+	return first
+}
+
+// applyDevice register a device of a sync, or update its certificate and config
+func (f *federation) applyDevice(u uuid.UUID, d FederationDevice) error {
+	m := f.manager
+	cert, err := parsePEMCert(d.Cert)
+	if err != nil {
+		return fmt.Errorf("bad certificate of device %s: %v", u, err)
+	}
+	var onboard *x509.Certificate
+	if len(d.Onboard) > 0 {
+		if onboard, err = parsePEMCert(d.Onboard); err != nil {
+			return fmt.Errorf("bad onboarding certificate of device %s: %v", u, err)
+		}
+	}
+	existing, _, _, err := m.DeviceGet(&u)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		if err := m.DeviceRegister(u, cert, onboard, d.Serial, d.Config); err != nil {
+			return fmt.Errorf("error registering device %s: %v", u, err)
+		}
+		f.audit(auditDeviceAdd, u.String(), nil, deviceSummary(cert, onboard, d.Serial))
+		return nil
+	case err != nil:
+		return fmt.Errorf("error getting device %s: %v", u, err)
+	}
+	if !existing.Equal(cert) {
+		if err := m.DeviceReplaceCert(u, cert); err != nil {
+			return fmt.Errorf("error replacing certificate of device %s: %v", u, err)
+		}
+		log.Printf("replaced certificate of device %s from upstream", u)
+	}
+	conf, err := m.GetConfig(u)
+	if err != nil {
+		return fmt.Errorf("error getting config of device %s: %v", u, err)
+	}
+	if !bytes.Equal(conf, d.Config) {
+		if err := m.SwapConfig(u, conf, d.Config); err != nil {
+			return fmt.Errorf("error setting config of device %s: %v", u, err)
+		}
+		f.audit(auditConfigSet, u.String(), nil, nil)
+	}
+	return nil
+}
+
+// audit record a change of a sync in the audit log
+func (f *federation) audit(action, target string, before, after interface{}) {
+	writeAudit(f.manager, AuditRecord{
+		Timestamp: time.Now(),
+		Actor:     federationActor,
+		Action:    action,
+		Target:    target,
+		Before:    before,
+		After:     after,
+	})
+}
+
+// state the state of the sync, for the admin API
+func (f *federation) state() FederationStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	s := f.status
+	s.Messages = f.counts()
+	return s
+}
+
+// getOnboard get an onboarding certificate and its serials by CN, as OnboardGet does
+func getOnboard(m driver.DeviceManager, cn string) (*x509.Certificate, []string, error) {
+	name := common.GetOnboardCertName(cn)
+	cert, serials, err := m.OnboardGet(name)
+	if _, isNotFound := err.(*common.NotFoundError); isNotFound && name != cn {
+		// the memory driver looks them up by their CN as it is
+		cert, serials, err = m.OnboardGet(cn)
+	}
+	return cert, serials, err
+}
+
+// sameStrings whether two lists have the same strings in the same order, nil being empty
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePEMCert parse a PEM-encoded certificate
+func parsePEMCert(b []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// federationSync serve the onboarding certificates and devices to a secondary, with the config each device is
+// served. An API token limited to devices gets those devices only, and no onboarding certificates. The response
+// has an ETag, and is not sent again to a secondary that has it already
+func (h *adminHandler) federationSync(w http.ResponseWriter, r *http.Request) {
+	m := h.managerFor(r)
+	s := FederationSync{Onboard: []FederationOnboard{}, Devices: []FederationDevice{}}
+	token := requestToken(r)
+	limited := token != nil && len(token.Devices) > 0
+	if !limited {
+		cns, err := m.OnboardList()
+		if err != nil {
+			log.Printf("error listing onboarding certificates: %v", err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		sort.Strings(cns)
+		for _, cn := range cns {
+			cert, serials, err := getOnboard(m, cn)
+			if err == nil {
+				var policy *common.OnboardPolicy
+				if policy, err = m.OnboardPolicyGet(common.GetOnboardCertName(cn)); err == nil {
+					s.Onboard = append(s.Onboard, FederationOnboard{Cert: ax.PemEncodeCert(cert.Raw), Serials: serials, Policy: policy})
+					continue
+				}
+			}
+			if _, isNotFound := err.(*common.NotFoundError); isNotFound {
+				// removed since it was listed
+				continue
+			}
+			log.Printf("error getting onboarding certificate %s: %v", cn, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	uids, err := m.DeviceList()
+	if err != nil {
+		log.Printf("error listing devices: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// the devices deleted softly are deleted for the secondaries
+	tombstones, err := common.TombstoneList(m)
+	if err != nil {
+		log.Printf("error listing tombstones: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	deleted := map[string]bool{}
+	for _, ts := range tombstones {
+		deleted[ts.UUID] = true
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i].String() < uids[j].String() })
+	for _, u := range uids {
+		if u == nil || deleted[u.String()] || (token != nil && !token.AllowsDevice(u.String())) {
+			continue
+		}
+		cert, onboard, serial, err := m.DeviceGet(u)
+		var b []byte
+		if err == nil {
+			_, b, err = servedConfig(m, *u)
+		}
+		if _, isNotFound := err.(*common.NotFoundError); isNotFound {
+			// removed since it was listed
+			continue
+		}
+		if err != nil {
+			log.Printf("error getting device %s: %v", u, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		d := FederationDevice{UUID: u.String(), Cert: ax.PemEncodeCert(cert.Raw), Serial: serial, Config: b}
+		if onboard != nil {
+			d.Onboard = ax.PemEncodeCert(onboard.Raw)
+		}
+		s.Devices = append(s.Devices, d)
+	}
+
+	body, err := json.Marshal(s)
+	if err != nil {
+		log.Printf("error converting sync to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+	gz := gzip.NewWriter(w)
+	gz.Write(body)
+	if err := gz.Close(); err != nil {
+		log.Printf("error writing sync: %v", err)
+	}
+}
+
+// federationTelemetry store the messages of devices forwarded by a secondary, sending each to the endpoint of the
+// device API it was sent to, with the certificate it was sent with, as a dead letter is replayed. Only the
+// telemetry of devices is taken, and with an API token limited to devices, only that of those devices. The batch
+// is sent gzipped, and decompressed by decodeBody
+func (h *adminHandler) federationTelemetry(w http.ResponseWriter, r *http.Request) {
+	var t FederationTelemetry
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		httpError(w, fmt.Sprintf("bad device messages: %v", err), http.StatusBadRequest)
+		return
+	}
+	m := h.managerFor(r)
+	token := requestToken(r)
+	var result FederationResult
+	for _, msg := range t.Messages {
+		if err := h.storeForwarded(r, m, token, msg); err != nil {
+			log.Printf("error storing message to %s forwarded from %s: %v", msg.Path, r.RemoteAddr, err)
+			result.Failed++
+			continue
+		}
+		result.Accepted++
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("error converting telemetry result to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// storeForwarded send a message forwarded by a secondary to the device API
+func (h *adminHandler) storeForwarded(r *http.Request, m driver.DeviceManager, token *common.APIToken, msg FederationMessage) error {
+	if msg.Method != http.MethodPost || !forwardedPath.MatchString(msg.Path) {
+		return fmt.Errorf("%s %s is not telemetry", msg.Method, msg.Path)
+	}
+	cert, err := parsePEMCert(msg.Cert)
+	if err != nil {
+		return fmt.Errorf("bad certificate: %v", err)
+	}
+	if token != nil && len(token.Devices) > 0 {
+		u, err := m.DeviceCheckCert(cert)
+		if err != nil {
+			return err
+		}
+		if u == nil || !token.AllowsDevice(u.String()) {
+			return fmt.Errorf("API token %s does not allow the device of certificate %s", token.ID, cert.Subject.CommonName)
+		}
+	}
+	req, err := http.NewRequestWithContext(r.Context(), msg.Method, msg.Path, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return err
+	}
+	if msg.ContentType != "" {
+		req.Header.Set(contentType, msg.ContentType)
+	}
+	req.RemoteAddr = r.RemoteAddr
+	req.TLS = &tls.ConnectionState{HandshakeComplete: true, PeerCertificates: []*x509.Certificate{cert}}
+	rec := httptest.NewRecorder()
+	h.devices.ServeHTTP(rec, req)
+	if rec.Code < 200 || rec.Code > 299 {
+		return fmt.Errorf("answered %d: %s", rec.Code, strings.TrimSpace(rec.Body.String()))
+	}
+	return nil
+}
+
+// federationStatus the state of the sync of this secondary from its primary
+func (h *adminHandler) federationStatus(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(h.federation.state())
+	if err != nil {
+		log.Printf("error converting federation status to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
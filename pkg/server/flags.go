@@ -0,0 +1,194 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/config"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// heldConfig the config held for a device with hold-config, nil if it has none held
+func heldConfig(m driver.DeviceManager, u uuid.UUID) (*config.EdgeDevConfig, []byte, error) {
+	flags, err := m.GetDeviceFlags(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !flags.Has(common.FlagHoldConfig) || len(flags.Held) == 0 {
+		return nil, nil, nil
+	}
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal(flags.Held, &conf); err != nil {
+		return nil, nil, fmt.Errorf("error reading held config: %v", err)
+	}
+	return &conf, flags.Held, nil
+}
+
+// errDeviceReadOnly the config of a device with read-only cannot change
+type errDeviceReadOnly struct {
+	device uuid.UUID
+}
+
+func (e *errDeviceReadOnly) Error() string {
+	return fmt.Sprintf("device %s is read-only, clear its %s flag to change its config", e.device, common.FlagReadOnly)
+}
+
+// checkWritable check that the config of a device can change, returning an *errDeviceReadOnly if it has read-only
+func checkWritable(m driver.DeviceManager, u uuid.UUID) error {
+	flags, err := m.GetDeviceFlags(u)
+	if err != nil {
+		return err
+	}
+	if flags.Has(common.FlagReadOnly) {
+		return &errDeviceReadOnly{device: u}
+	}
+	return nil
+}
+
+// verboseDebug whether the requests of a device are to be logged in detail, as it has verbose-debug. A device whose
+// flags cannot be read is not
+func verboseDebug(m driver.DeviceManager, u uuid.UUID) bool {
+	flags, err := m.GetDeviceFlags(u)
+	if err != nil {
+		log.Printf("error getting flags of %s: %v", u, err)
+		return false
+	}
+	return flags.Has(common.FlagVerboseDebug)
+}
+
+// debugHeaders the headers of a request or response for the log of a device with verbose-debug, sorted, without
+// the credentials of admin requests
+func debugHeaders(header http.Header) string {
+	var headers []string
+	for k, v := range header {
+		switch k {
+		case "Authorization", "Cookie":
+			continue
+		}
+		headers = append(headers, k+": "+strings.Join(v, ", "))
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, "; ")
+}
+
+func (h *adminHandler) deviceFlagsGet(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flags, err := h.managerFor(r).GetDeviceFlags(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting flags of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	case flags == nil:
+		flags = &common.DeviceFlags{Flags: []string{}}
+	}
+	h.writeDeviceFlags(w, flags)
+}
+
+// deviceFlagSet set a flag of a device. Setting hold-config holds the config the device is served at that time
+func (h *adminHandler) deviceFlagSet(w http.ResponseWriter, r *http.Request) {
+	h.changeDeviceFlag(w, r, true)
+}
+
+// deviceFlagRemove clear a flag of a device. Clearing hold-config serves the device its config again
+func (h *adminHandler) deviceFlagRemove(w http.ResponseWriter, r *http.Request) {
+	h.changeDeviceFlag(w, r, false)
+}
+
+func (h *adminHandler) changeDeviceFlag(w http.ResponseWriter, r *http.Request, set bool) {
+	vars := mux.Vars(r)
+	uid, err := uuid.FromString(vars["uuid"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flag := vars["flag"]
+	if err := common.ValidateDeviceFlag(flag); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m := h.managerFor(r)
+	flags, err := m.GetDeviceFlags(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting flags of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	case flags == nil:
+		flags = &common.DeviceFlags{Flags: []string{}}
+	}
+	before := append([]string{}, flags.Flags...)
+
+	var changed bool
+	if set {
+		if changed = flags.Set(flag); changed && flag == common.FlagHoldConfig {
+			// a quarantined device is held at its own config, not the one of its quarantine
+			conf, b, err := ownConfig(m, uid)
+			if err != nil {
+				log.Printf("error getting the config of %s to hold: %v", uid, err)
+				httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			flags.Held, flags.HeldVersion = b, conf.GetId().GetVersion()
+		}
+	} else {
+		changed = flags.Unset(flag)
+	}
+	if !changed {
+		h.writeDeviceFlags(w, flags)
+		return
+	}
+	flags.Updated = time.Now().UTC()
+	stored := flags
+	if len(flags.Flags) == 0 {
+		stored = nil
+	}
+	if err := m.SetDeviceFlags(uid, stored); err != nil {
+		log.Printf("error setting flags of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	action := auditFlagRemove
+	if set {
+		action = auditFlagSet
+	}
+	h.audit(r, action, uid.String(), map[string]interface{}{"flags": before}, map[string]interface{}{"flags": flags.Flags, "held-version": flags.HeldVersion})
+	log.Printf("device %s flags: %s", uid, strings.Join(flags.Flags, ","))
+	h.writeDeviceFlags(w, flags)
+}
+
+func (h *adminHandler) writeDeviceFlags(w http.ResponseWriter, flags *common.DeviceFlags) {
+	body, err := json.Marshal(flags)
+	if err != nil {
+		log.Printf("error converting flags to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+)
+
+// gcGet report orphaned data, without removing it
+func (h *adminHandler) gcGet(w http.ResponseWriter, r *http.Request) {
+	h.gc(w, r, false)
+}
+
+// gcRun remove orphaned data
+func (h *adminHandler) gcRun(w http.ResponseWriter, r *http.Request) {
+	h.gc(w, r, true)
+}
+
+func (h *adminHandler) gc(w http.ResponseWriter, r *http.Request, remove bool) {
+	gc, ok := h.manager.(driver.GarbageCollector)
+	if !ok {
+		httpError(w, "garbage collection not supported by the "+h.manager.Name()+" driver", http.StatusNotImplemented)
+		return
+	}
+	orphans, err := gc.CollectGarbage(remove)
+	if err != nil {
+		log.Printf("error collecting garbage: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if remove && len(orphans) > 0 {
+		h.audit(r, auditGC, "", nil, map[string]interface{}{"removed": orphans})
+	}
+	body, err := json.Marshal(orphans)
+	if err != nil {
+		log.Printf("error converting orphans to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// collectGarbage look for orphaned data every interval, removing it if remove is true, until done is closed
+func collectGarbage(gc driver.GarbageCollector, interval time.Duration, remove bool, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		orphans, err := gc.CollectGarbage(remove)
+		if err != nil {
+			log.Printf("error collecting garbage: %v", err)
+			continue
+		}
+		for _, o := range orphans {
+			if remove {
+				log.Printf("removed orphan %s %s: %s", o.Key, o.Field, o.Reason)
+			} else {
+				log.Printf("found orphan %s %s: %s", o.Key, o.Field, o.Reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// grafanaPath the prefix of the endpoints of the Grafana JSON datasource, which only read, though Grafana POSTs
+// its queries
+const grafanaPath = "/admin/grafana"
+
+// grafanaMetricNames the metrics metricSamples yields, that the datasource can query
+var grafanaMetricNames = []string{
+	"eve_app_cpu_seconds_total",
+	"eve_app_memory_available_mb",
+	"eve_app_memory_used_mb",
+	"eve_app_network_rx_bytes_total",
+	"eve_app_network_tx_bytes_total",
+	"eve_device_cpu_seconds_total",
+	"eve_device_disk_free_mb",
+	"eve_device_disk_read_mb_total",
+	"eve_device_disk_total_mb",
+	"eve_device_disk_used_mb",
+	"eve_device_disk_write_mb_total",
+	"eve_device_memory_available_mb",
+	"eve_device_memory_used_mb",
+	"eve_device_network_rx_bytes_total",
+	"eve_device_network_tx_bytes_total",
+	"eve_device_uptime_seconds",
+}
+
+// isRead whether a request only reads: a GET or HEAD, or a request of the Grafana datasource
+func isRead(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead || r.URL.Path == grafanaPath || strings.HasPrefix(r.URL.Path, grafanaPath+"/")
+}
+
+// GrafanaList a list of values, as a JSON array or a string, which may be a comma-separated list in braces, as
+// Grafana interpolates a variable with several values
+type GrafanaList []string
+
+// UnmarshalJSON read a list from an array or a string
+func (l *GrafanaList) UnmarshalJSON(b []byte) error {
+	var values []string
+	if err := json.Unmarshal(b, &values); err == nil {
+		*l = values
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("must be a string or an array of strings")
+	}
+	*l = nil
+	for _, v := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// GrafanaPayload the payload of a query or a variable: the devices to query, and the tags the devices listed as a
+// variable must have, as with ?tag= when listing devices
+type GrafanaPayload struct {
+	Device GrafanaList `json:"device,omitempty"`
+	Tag    GrafanaList `json:"tag,omitempty"`
+}
+
+// GrafanaRange the time range of a query, both included, either zero for no limit
+type GrafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// GrafanaTarget a metric to query, by its name, or its name and its labels as in a metrics export, e.g.
+// eve_device_disk_used_mb{disk=sda,mount=/persist}
+type GrafanaTarget struct {
+	RefID   string         `json:"refId,omitempty"`
+	Target  string         `json:"target"`
+	Hide    bool           `json:"hide,omitempty"`
+	Payload GrafanaPayload `json:"payload"`
+}
+
+// GrafanaQuery a query of the datasource, of metrics of devices over a time range
+type GrafanaQuery struct {
+	Range GrafanaRange `json:"range"`
+	// MaxDataPoints how many points a series can have at most, others being dropped evenly, 0 for no limit
+	MaxDataPoints int             `json:"maxDataPoints,omitempty"`
+	Targets       []GrafanaTarget `json:"targets"`
+}
+
+// GrafanaSeries a time series answering a query, with the points as [value, time in milliseconds]
+type GrafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// GrafanaMetric a metric the datasource can query, with the payload a query of it takes
+type GrafanaMetric struct {
+	Label    string                 `json:"label"`
+	Value    string                 `json:"value"`
+	Payloads []GrafanaMetricPayload `json:"payloads,omitempty"`
+}
+
+// GrafanaMetricPayload a field of the payload of a query, as the query editor of Grafana shows it
+type GrafanaMetricPayload struct {
+	Label string `json:"label"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+}
+
+// GrafanaOptionsRequest a request for the options of a field of the payload of a query
+type GrafanaOptionsRequest struct {
+	Metric  string         `json:"metric"`
+	Name    string         `json:"name"`
+	Payload GrafanaPayload `json:"payload"`
+}
+
+// GrafanaOption an option of a field of the payload of a query
+type GrafanaOption struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// GrafanaVariableRequest a request for the values of a variable
+type GrafanaVariableRequest struct {
+	Payload GrafanaPayload `json:"payload"`
+	Range   *GrafanaRange  `json:"range,omitempty"`
+}
+
+// GrafanaVariable a value of a variable: a device, by its name in its metadata, or its UUID if it has none
+type GrafanaVariable struct {
+	Text  string `json:"__text"`
+	Value string `json:"__value"`
+}
+
+// grafanaHealth answer the test of the datasource by Grafana
+func (h *adminHandler) grafanaHealth(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// grafanaMetrics list the metrics the datasource can query, each with the devices as the payload of its queries
+func (h *adminHandler) grafanaMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := make([]GrafanaMetric, 0, len(grafanaMetricNames))
+	for _, m := range grafanaMetricNames {
+		metrics = append(metrics, GrafanaMetric{Label: m, Value: m, Payloads: []GrafanaMetricPayload{{Label: "Device", Name: "device", Type: "multi-select"}}})
+	}
+	h.writeGrafana(w, metrics)
+}
+
+// grafanaPayloadOptions list the devices a query can select
+func (h *adminHandler) grafanaPayloadOptions(w http.ResponseWriter, r *http.Request) {
+	var req GrafanaOptionsRequest
+	if !readGrafanaRequest(w, r, &req) {
+		return
+	}
+	options := []GrafanaOption{}
+	if req.Name == "device" {
+		devices, err := h.grafanaDevices(r, nil)
+		if err != nil {
+			log.Printf("error listing devices: %v", err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		for _, d := range devices {
+			options = append(options, GrafanaOption{Label: d.Text, Value: d.Value})
+		}
+	}
+	h.writeGrafana(w, options)
+}
+
+// grafanaVariable list the devices as the values of a variable, those with tags if the payload has any
+func (h *adminHandler) grafanaVariable(w http.ResponseWriter, r *http.Request) {
+	var req GrafanaVariableRequest
+	if !readGrafanaRequest(w, r, &req) {
+		return
+	}
+	devices, err := h.grafanaDevices(r, req.Payload.Tag)
+	if err != nil {
+		log.Printf("error listing devices: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.writeGrafana(w, devices)
+}
+
+// grafanaDevices the devices the API token and the access policy of a request allow, with tags if any, sorted by
+// name, then UUID
+func (h *adminHandler) grafanaDevices(r *http.Request, tags []string) ([]GrafanaVariable, error) {
+	uids, err := h.managerFor(r).DeviceList()
+	if err != nil {
+		return nil, err
+	}
+	devices := []GrafanaVariable{}
+	for _, u := range uids {
+		if u == nil || !h.allowsDevice(r, *u) || !h.matchTags(r, *u, tags) {
+			continue
+		}
+		devices = append(devices, GrafanaVariable{Text: h.grafanaName(r, *u), Value: u.String()})
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Text != devices[j].Text {
+			return devices[i].Text < devices[j].Text
+		}
+		return devices[i].Value < devices[j].Value
+	})
+	return devices, nil
+}
+
+// grafanaName the name of a device in its metadata, or its UUID if it has none
+func (h *adminHandler) grafanaName(r *http.Request, u uuid.UUID) string {
+	md, err := h.managerFor(r).GetDeviceMetadata(u)
+	if err != nil {
+		log.Printf("error getting metadata of %s: %v", u, err)
+	}
+	if md != nil && md.Name != "" {
+		return md.Name
+	}
+	return u.String()
+}
+
+// grafanaQuery answer the series of the metrics of devices in a time range, a series per metric and labels, and per
+// device when a target has several. A target whose metric is not in a message has no point for it
+func (h *adminHandler) grafanaQuery(w http.ResponseWriter, r *http.Request) {
+	var q GrafanaQuery
+	if !readGrafanaRequest(w, r, &q) {
+		return
+	}
+	in := metricsRange{from: q.Range.From, to: q.Range.To}
+	if !in.from.IsZero() && !in.to.IsZero() && in.to.Before(in.from) {
+		httpError(w, fmt.Sprintf("range to %s is before from %s", in.to.Format(time.RFC3339), in.from.Format(time.RFC3339)), http.StatusBadRequest)
+		return
+	}
+	results := []GrafanaSeries{}
+	for _, t := range q.Targets {
+		if t.Hide || t.Target == "" {
+			continue
+		}
+		if len(t.Payload.Device) == 0 {
+			httpError(w, fmt.Sprintf("target %s has no device in its payload", t.Target), http.StatusBadRequest)
+			return
+		}
+		var series []GrafanaSeries
+		for _, d := range t.Payload.Device {
+			u, err := uuid.FromString(d)
+			if err != nil {
+				httpError(w, fmt.Sprintf("bad device %s: %v", d, err), http.StatusBadRequest)
+				return
+			}
+			if _, _, _, err := h.managerFor(r).DeviceGet(&u); err != nil || !h.allowsDevice(r, u) {
+				httpError(w, fmt.Sprintf("device %s not found", u), http.StatusNotFound)
+				return
+			}
+			prefix := ""
+			if len(t.Payload.Device) > 1 {
+				prefix = h.grafanaName(r, u) + " "
+			}
+			points := map[string][][2]float64{}
+			err = h.readMetricsRange(r, u, in, func(at time.Time, values map[string]float64) error {
+				ms := float64(at.UnixNano() / int64(time.Millisecond))
+				for c, v := range values {
+					if c == t.Target || strings.SplitN(c, "{", 2)[0] == t.Target {
+						points[c] = append(points[c], [2]float64{v, ms})
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.Printf("error reading the metrics of %s: %v", u, err)
+				httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			for c, p := range points {
+				series = append(series, GrafanaSeries{Target: prefix + c, Datapoints: thinPoints(p, q.MaxDataPoints)})
+			}
+		}
+		sort.Slice(series, func(i, j int) bool { return series[i].Target < series[j].Target })
+		results = append(results, series...)
+	}
+	h.writeGrafana(w, results)
+}
+
+// thinPoints keep at most max points of a series, evenly, always the last one, all of them if max is 0
+func thinPoints(points [][2]float64, max int) [][2]float64 {
+	if max <= 0 || len(points) <= max {
+		return points
+	}
+	step := (len(points) + max - 1) / max
+	thinned := make([][2]float64, 0, max)
+	for i := (len(points) - 1) % step; i < len(points); i += step {
+		thinned = append(thinned, points[i])
+	}
+	return thinned
+}
+
+func (h *adminHandler) writeGrafana(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting grafana answer to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// readGrafanaRequest read the JSON body of a request of the datasource into v, an empty body leaving it as is,
+// answering with an error if it cannot
+func readGrafanaRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return false
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return true
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		httpError(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+)
+
+const (
+	healthOK     = "ok"
+	healthFailed = "failed"
+	// healthSkipped a check the driver does not support
+	healthSkipped = "skipped"
+)
+
+// HealthCheck result of one readiness check
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Health result of a health or readiness probe
+type Health struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+type healthHandler struct {
+	manager driver.DeviceManager
+	// certs the server certificate being served
+	certs *certStore
+}
+
+// healthz report the server is up, without checking anything it depends on
+func (h *healthHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, Health{Status: healthOK})
+}
+
+// readyz check the backing store and the server certificates, with 503 Service Unavailable if any check fails
+func (h *healthHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	health := Health{Status: healthOK}
+	storage := HealthCheck{Name: "storage", Status: healthOK}
+	if hc, ok := h.manager.(driver.HealthChecker); ok {
+		if err := hc.CheckHealth(); err != nil {
+			storage.Status = healthFailed
+			storage.Error = err.Error()
+		}
+	} else {
+		storage.Status = healthSkipped
+	}
+	certs := HealthCheck{Name: "server-certificate", Status: healthOK}
+	if err := checkValidity(h.certs.certificates(), time.Now()); err != nil {
+		certs.Status = healthFailed
+		certs.Error = err.Error()
+	}
+	health.Checks = []HealthCheck{storage, certs}
+	for _, c := range health.Checks {
+		if c.Status == healthFailed {
+			health.Status = healthFailed
+		}
+	}
+	writeHealth(w, health)
+}
+
+// checkValidity check that each certificate in a chain is valid at a point in time
+func checkValidity(certs []*x509.Certificate, now time.Time) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("no server certificate loaded")
+	}
+	for _, c := range certs {
+		switch {
+		case now.Before(c.NotBefore):
+			return fmt.Errorf("certificate %s not valid before %s", c.Subject.CommonName, c.NotBefore.UTC().Format(time.RFC3339))
+		case now.After(c.NotAfter):
+			return fmt.Errorf("certificate %s expired at %s", c.Subject.CommonName, c.NotAfter.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func writeHealth(w http.ResponseWriter, health Health) {
+	body, err := json.Marshal(health)
+	if err != nil {
+		log.Printf("error converting health to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if health.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/config"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// HardwareModelRequest a hardware model to add to the catalog, named by the path
+type HardwareModelRequest struct {
+	Description string `json:"description,omitempty"`
+	// Config the deviceIoList, systemAdapterList, manufacturer and productName of the model, as in a config
+	Config json.RawMessage `json:"config"`
+}
+
+// DeviceModel the hardware model of a device, empty if it has none
+type DeviceModel struct {
+	Model string `json:"model"`
+}
+
+// hardwareModelSummary summary of a hardware model for the audit log, without the config
+func hardwareModelSummary(m *common.HardwareModel) map[string]interface{} {
+	return map[string]interface{}{"name": m.Name, "description": m.Description}
+}
+
+// mergeModel merge the hardware model of a device, if it has one, into its config. A model that cannot be found or
+// read is logged and skipped, so that the device still gets the rest of its config. Whether a model was merged
+func mergeModel(m driver.DeviceManager, u uuid.UUID, conf *config.EdgeDevConfig) bool {
+	name, err := m.GetDeviceModel(u)
+	if err != nil {
+		log.Printf("error getting hardware model of %s, serving its config as is: %v", u, err)
+		return false
+	}
+	if name == "" {
+		return false
+	}
+	model, err := common.HardwareModelGet(m, name)
+	if err != nil {
+		log.Printf("error getting hardware model %s of %s, serving its config as is: %v", name, u, err)
+		return false
+	}
+	if err := model.Merge(conf); err != nil {
+		log.Printf("error merging hardware model %s into the config of %s, serving it as is: %v", name, u, err)
+		return false
+	}
+	return true
+}
+
+// servedConfig the config served to a device: the stored one, with its hardware model merged in, or the one held
+// with hold-config, stripped down to what a quarantined device is served if it is quarantined. The stored JSON is
+// returned as is when the device has no model
+func servedConfig(m driver.DeviceManager, u uuid.UUID) (*config.EdgeDevConfig, []byte, error) {
+	conf, b, err := ownConfig(m, u)
+	if err != nil {
+		return nil, nil, err
+	}
+	q, err := m.GetQuarantine(u)
+	if err != nil || q == nil {
+		return conf, b, err
+	}
+	conf = common.QuarantineConfig(conf)
+	if b, err = protojson.Marshal(conf); err != nil {
+		return nil, nil, fmt.Errorf("error encoding quarantine config: %v", err)
+	}
+	return conf, b, nil
+}
+
+// ownConfig the config a device is served when it is not quarantined
+func ownConfig(m driver.DeviceManager, u uuid.UUID) (*config.EdgeDevConfig, []byte, error) {
+	b, err := m.GetConfig(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	if held, heldB, err := heldConfig(m, u); err != nil || held != nil {
+		return held, heldB, err
+	}
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal(b, &conf); err != nil {
+		return nil, nil, fmt.Errorf("error reading device config: %v", err)
+	}
+	if !mergeModel(m, u, &conf) {
+		return &conf, b, nil
+	}
+	b, err = protojson.Marshal(&conf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error encoding device config: %v", err)
+	}
+	return &conf, b, nil
+}
+
+func (h *adminHandler) hardwareModelList(w http.ResponseWriter, r *http.Request) {
+	models, err := common.HardwareModelList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing hardware models: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+	h.writeHardwareModel(w, http.StatusOK, models)
+}
+
+func (h *adminHandler) hardwareModelGet(w http.ResponseWriter, r *http.Request) {
+	model, ok := h.getHardwareModel(w, r)
+	if !ok {
+		return
+	}
+	h.writeHardwareModel(w, http.StatusOK, model)
+}
+
+// hardwareModelSet add a hardware model to the catalog, replacing the one of the same name. The configs served to the
+// devices of the model change with it
+func (h *adminHandler) hardwareModelSet(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req HardwareModelRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad hardware model: %v", err), http.StatusBadRequest)
+		return
+	}
+	model, err := common.NewHardwareModel(mux.Vars(r)["name"], req.Description, req.Config)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad hardware model: %v", err), http.StatusBadRequest)
+		return
+	}
+	var before interface{}
+	if old, err := common.HardwareModelGet(h.managerFor(r), model.Name); err == nil {
+		before = hardwareModelSummary(old)
+	}
+	if err := common.HardwareModelAdd(h.managerFor(r), model); err != nil {
+		log.Printf("error saving hardware model: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditModelAdd, model.Name, before, hardwareModelSummary(model))
+	h.writeHardwareModel(w, http.StatusOK, model)
+}
+
+// hardwareModelRemove remove a hardware model from the catalog, unless a device still has it
+func (h *adminHandler) hardwareModelRemove(w http.ResponseWriter, r *http.Request) {
+	model, ok := h.getHardwareModel(w, r)
+	if !ok {
+		return
+	}
+	m := h.managerFor(r)
+	uids, err := m.DeviceList()
+	if err != nil {
+		log.Printf("error listing devices: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	devices := []string{}
+	for _, u := range uids {
+		if u == nil {
+			continue
+		}
+		if name, err := m.GetDeviceModel(*u); err == nil && name == model.Name {
+			devices = append(devices, u.String())
+		}
+	}
+	if len(devices) > 0 {
+		writeError(w, http.StatusConflict, ErrModelInUse, fmt.Sprintf("hardware model %s is the model of %d devices", model.Name, len(devices)), map[string]interface{}{"devices": devices})
+		return
+	}
+	if err := common.HardwareModelRemove(m, model.Name); err != nil {
+		log.Printf("error removing hardware model: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditModelRemove, model.Name, hardwareModelSummary(model), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getHardwareModel get the hardware model a request is for, writing the error response if there is none
+func (h *adminHandler) getHardwareModel(w http.ResponseWriter, r *http.Request) (*common.HardwareModel, bool) {
+	name := mux.Vars(r)["name"]
+	model, err := common.HardwareModelGet(h.managerFor(r), name)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		log.Printf("error getting hardware model %s: %v", name, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	return model, true
+}
+
+func (h *adminHandler) writeHardwareModel(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting hardware model to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (h *adminHandler) deviceModelGet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	model, err := h.managerFor(r).GetDeviceModel(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting hardware model of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(DeviceModel{Model: model})
+	if err != nil {
+		log.Printf("error converting hardware model to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (h *adminHandler) deviceModelSet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var dm DeviceModel
+	if err := json.Unmarshal(body, &dm); err != nil {
+		httpError(w, fmt.Sprintf("bad hardware model: %v", err), http.StatusBadRequest)
+		return
+	}
+	if dm.Model == "" {
+		httpError(w, "bad hardware model: empty name", http.StatusBadRequest)
+		return
+	}
+	_, err = common.HardwareModelGet(h.managerFor(r), dm.Model)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, fmt.Sprintf("unknown hardware model %s", dm.Model), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("error getting hardware model %s: %v", dm.Model, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.setDeviceModel(w, r, uid, dm.Model)
+}
+
+func (h *adminHandler) deviceModelRemove(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	h.setDeviceModel(w, r, uid, "")
+}
+
+func (h *adminHandler) setDeviceModel(w http.ResponseWriter, r *http.Request, uid uuid.UUID, model string) {
+	var before, after interface{}
+	if old, err := h.managerFor(r).GetDeviceModel(uid); err == nil && old != "" {
+		before = DeviceModel{Model: old}
+	}
+	if model != "" {
+		after = DeviceModel{Model: model}
+	}
+	err := h.managerFor(r).SetDeviceModel(uid, model)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case err != nil:
+		log.Printf("error setting hardware model of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		h.audit(r, auditDeviceModelSet, uid.String(), before, after)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/info"
+	uuid "github.com/satori/go.uuid"
+)
+
+// updateInventory update the inventory of a device with an info message it sent. Failures are logged, but do not fail
+// the request, as the message itself is already stored
+func (h *apiHandler) updateInventory(r *http.Request, u uuid.UUID, msg *info.ZInfoMsg) {
+	// a device can have several messages in flight, each updating part of the same inventory
+	defer h.inventoryLocks.lock(u)()
+	inv, err := h.managerFor(r).GetInventory(u)
+	if err != nil {
+		log.Printf("error getting inventory of %s: %v", u, err)
+		return
+	}
+	if inv == nil {
+		inv = &common.Inventory{}
+	}
+	apps := append([]common.InventoryApp(nil), inv.Apps...)
+	if !inv.Update(msg, time.Now()) {
+		return
+	}
+	if err := h.managerFor(r).SetInventory(u, inv); err != nil {
+		log.Printf("error saving inventory of %s: %v", u, err)
+	}
+	if msg.GetAinfo() != nil {
+		h.alerts.evaluateApps(u, apps, inv.Apps)
+	}
+	if d := msg.GetDinfo(); d != nil {
+		h.updateIdentity(r, u, common.NewDeviceIdentity(d, *inv.DeviceUpdated))
+	}
+}
+
+// updateIdentity record the identity of a device in its metadata, from the device info it sent, so that it is
+// recorded from the first one, and again whenever it changes. The rest of the metadata is kept as it is
+func (h *apiHandler) updateIdentity(r *http.Request, u uuid.UUID, id *common.DeviceIdentity) {
+	m := h.managerFor(r)
+	md, err := m.GetDeviceMetadata(u)
+	if err != nil {
+		log.Printf("error getting metadata of %s: %v", u, err)
+		return
+	}
+	if md == nil {
+		md = &common.DeviceMetadata{}
+	}
+	if md.Identity.Same(id) {
+		return
+	}
+	md.Identity = id
+	if err := m.SetDeviceMetadata(u, md); err != nil {
+		log.Printf("error saving identity of %s: %v", u, err)
+	}
+}
+
+func (h *adminHandler) deviceInventoryGet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inv, err := h.managerFor(r).GetInventory(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting inventory of %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// a device that sent no info yet has an empty inventory
+	if inv == nil {
+		inv = &common.Inventory{}
+	}
+	body, err := json.Marshal(inv)
+	if err != nil {
+		log.Printf("error converting inventory to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// InventoryMatch a device whose inventory matches a search, with the values of the fields that matched, by field
+type InventoryMatch struct {
+	UUID    string              `json:"uuid"`
+	Matched map[string][]string `json:"matched"`
+}
+
+// inventorySearch find the devices whose inventory matches all the conditions of a request, as
+// ?where=eve-version<9.0&where=apps[name=web].state==ERROR, among those the API token, if any, allows, and whose
+// metadata matches the tags asked for, if any. A device that sent no info yet is searched with an empty inventory
+func (h *adminHandler) inventorySearch(w http.ResponseWriter, r *http.Request) {
+	var conditions []*common.InventoryCondition
+	for _, s := range r.URL.Query()["where"] {
+		c, err := common.ParseInventoryCondition(s)
+		if err != nil {
+			httpError(w, fmt.Sprintf("bad condition %q: %v", s, err), http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, c)
+	}
+	if len(conditions) == 0 {
+		httpError(w, "at least one where condition is required", http.StatusBadRequest)
+		return
+	}
+	uids, err := h.managerFor(r).DeviceList()
+	if err != nil {
+		log.Printf("error listing devices: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	tags := r.URL.Query()["tag"]
+	matches := []InventoryMatch{}
+	for _, u := range uids {
+		if u == nil || !h.allowsDevice(r, *u) || !h.matchTags(r, *u, tags) {
+			continue
+		}
+		inv, err := h.managerFor(r).GetInventory(*u)
+		if _, isNotFound := err.(*common.NotFoundError); err != nil && !isNotFound {
+			log.Printf("error getting inventory of %s: %v", u, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if inv == nil {
+			inv = &common.Inventory{}
+		}
+		if matched, ok := inv.Search(conditions); ok {
+			matches = append(matches, InventoryMatch{UUID: u.String(), Matched: matched})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].UUID < matches[j].UUID })
+	body, err := json.Marshal(matches)
+	if err != nil {
+		log.Printf("error converting inventory matches to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
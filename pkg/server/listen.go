@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// APIs a listener can serve
+const (
+	// ListenDevice the API of devices, at /api, without the admin API
+	ListenDevice = "device"
+	// ListenAdmin the admin API, at /admin, with the UI, without the API of devices
+	ListenAdmin = "admin"
+)
+
+// Listener an address to serve on instead of Address and Port, with the APIs it serves and its own server certificate
+type Listener struct {
+	// Addr host:port to listen on. An IPv4 address listens on IPv4 only and an IPv6 one on IPv6 only, so that
+	// 0.0.0.0:8080 and [::]:8080 can be bound together; a host name or no host, as in :8080, listens on both
+	Addr string
+	// API ListenDevice or ListenAdmin to serve only that API; empty means both
+	API string
+	// CertPath and KeyPath the server certificate of the listener and its key, from the KeyProvider of the server;
+	// empty means the server certificate of the server
+	CertPath string
+	KeyPath  string
+	// CAs names of the device CA bundles one of which must have signed the certificates of devices on the listener;
+	// empty means any of those of the server
+	CAs []string
+}
+
+// listening a server and the network it listens on
+type listening struct {
+	server  *http.Server
+	network string
+}
+
+// ParseListener parse a listener from <host:port>[,api=device|admin][,cert=<path>,key=<path>][,ca=<name>...]
+func ParseListener(spec string) (Listener, error) {
+	parts := strings.Split(spec, ",")
+	l := Listener{Addr: parts[0]}
+	if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+		return l, fmt.Errorf("bad listen address %q: %v", l.Addr, err)
+	}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return l, fmt.Errorf("bad listener option %q, must be key=value", part)
+		}
+		switch kv[0] {
+		case "api":
+			l.API = kv[1]
+		case "cert":
+			l.CertPath = kv[1]
+		case "key":
+			l.KeyPath = kv[1]
+		case "ca":
+			l.CAs = append(l.CAs, kv[1])
+		default:
+			return l, fmt.Errorf("unknown listener option %q, must be api, cert, key or ca", kv[0])
+		}
+	}
+	if l.API != "" && l.API != ListenDevice && l.API != ListenAdmin {
+		return l, fmt.Errorf("unknown listener api %q, must be %s or %s", l.API, ListenDevice, ListenAdmin)
+	}
+	if (l.CertPath == "") != (l.KeyPath == "") {
+		return l, fmt.Errorf("listener %s needs both cert and key, or neither", l.Addr)
+	}
+	return l, nil
+}
+
+// network the network to listen on an address with: that of the family of an IP address, so that both families can
+// be bound on the same port, or both families otherwise
+func (l Listener) network() string {
+	host, _, err := net.SplitHostPort(l.Addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// handler serve only the API of the listener, if it has one, from the handler of both, with the device CA bundles
+// of the listener
+func (l Listener) handler(front http.Handler) http.Handler {
+	if l.API == "" && len(l.CAs) == 0 {
+		return front
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin := r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/")
+		device := strings.HasPrefix(r.URL.Path, "/api/")
+		if (l.API == ListenDevice && admin) || (l.API == ListenAdmin && device) {
+			notFound(w, r)
+			return
+		}
+		if len(l.CAs) > 0 {
+			r = withDeviceCAs(r, l.CAs)
+		}
+		front.ServeHTTP(w, r)
+	})
+}
+
+// tlsConfig the TLS config of a server certificate, read for each new connection so that it can be reloaded
+func tlsConfig(certs *certStore) *tls.Config {
+	return &tls.Config{
+		GetCertificate: certs.getCertificate,
+		ClientAuth:     tls.RequestClientCert,
+		ClientCAs:      nil,
+	}
+}
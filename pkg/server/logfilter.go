@@ -0,0 +1,178 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// DeviceLogFilter log filter of a device, as set for it and as applied, with the entries it dropped
+type DeviceLogFilter struct {
+	// Device filter set for this device, nil if it uses the global one
+	Device *common.LogFilter `json:"device"`
+	// Effective filter that applies to the device
+	Effective common.LogFilter `json:"effective"`
+	// Dropped how many log entries of the device were dropped since the server started
+	Dropped uint64 `json:"dropped"`
+}
+
+// logFilters filters the log entries devices send, before they are stored, counting those dropped
+type logFilters struct {
+	// global filter of the devices without one of their own
+	global common.LogFilter
+	lock   sync.Mutex
+	// below entries below the severity of the filter seen per device, to keep one of every Sample of them
+	below map[uuid.UUID]uint64
+	// dropped entries dropped per device
+	dropped map[uuid.UUID]uint64
+}
+
+func newLogFilters(global common.LogFilter) *logFilters {
+	return &logFilters{
+		global:  global,
+		below:   map[uuid.UUID]uint64{},
+		dropped: map[uuid.UUID]uint64{},
+	}
+}
+
+// effective the filter that applies to a device, the one set for it or else the global one
+func (f *logFilters) effective(device *common.LogFilter) common.LogFilter {
+	if device != nil {
+		return *device
+	}
+	return f.global
+}
+
+// keep whether to store an entry of a device with a severity, counting it if it is dropped. Of the entries below
+// the minimum severity, the first of every Sample is kept
+func (f *logFilters) keep(u uuid.UUID, filter common.LogFilter, severity string) bool {
+	if !filter.Below(severity) {
+		return true
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n := f.below[u]
+	f.below[u] = n + 1
+	if filter.Sample > 0 && n%uint64(filter.Sample) == 0 {
+		return true
+	}
+	f.dropped[u]++
+	return false
+}
+
+// droppedCounts the entries dropped so far, per device
+func (f *logFilters) droppedCounts() map[uuid.UUID]uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	counts := make(map[uuid.UUID]uint64, len(f.dropped))
+	for u, n := range f.dropped {
+		counts[u] = n
+	}
+	return counts
+}
+
+// logFilter the filter that applies to the logs of a device. If the one of the device cannot be read, the global
+// one applies, rather than refusing the logs
+func (h *apiHandler) logFilter(r *http.Request, u uuid.UUID) common.LogFilter {
+	device, err := h.managerFor(r).GetLogFilter(u)
+	if err != nil {
+		log.Printf("error getting log filter of %s, using the global one: %v", u, err)
+	}
+	return h.filters.effective(device)
+}
+
+func (h *adminHandler) deviceLogFilterGet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := h.managerFor(r).GetLogFilter(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting log filter of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(DeviceLogFilter{Device: f, Effective: h.filters.effective(f), Dropped: h.filters.droppedCounts()[uid]})
+	if err != nil {
+		log.Printf("error converting log filter to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (h *adminHandler) deviceLogFilterSet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var f common.LogFilter
+	if err := json.Unmarshal(body, &f); err != nil {
+		httpError(w, fmt.Sprintf("bad log filter: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := f.Validate(); err != nil {
+		httpError(w, fmt.Sprintf("bad log filter: %v", err), http.StatusBadRequest)
+		return
+	}
+	h.setDeviceLogFilter(w, r, uid, &f)
+}
+
+func (h *adminHandler) deviceLogFilterRemove(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	h.setDeviceLogFilter(w, r, uid, nil)
+}
+
+func (h *adminHandler) setDeviceLogFilter(w http.ResponseWriter, r *http.Request, uid uuid.UUID, f *common.LogFilter) {
+	// keep the audit record free of typed nils, that would show as null
+	var before, after interface{}
+	if old, err := h.managerFor(r).GetLogFilter(uid); err == nil && old != nil {
+		before = old
+	}
+	if f != nil {
+		after = f
+	}
+	err := h.managerFor(r).SetLogFilter(uid, f)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case err != nil:
+		log.Printf("error setting log filter of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		h.audit(r, auditLogFilterSet, uid.String(), before, after)
+		w.WriteHeader(http.StatusOK)
+	}
+}
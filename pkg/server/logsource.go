@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// logsSourceReader read the logs of a device from one source, through the index of the driver if it has one,
+// filtering all the logs of the device otherwise
+func (h *adminHandler) logsSourceReader(r *http.Request, u uuid.UUID, source string) (io.Reader, error) {
+	if indexer, ok := h.manager.(driver.LogSourceIndexer); ok {
+		return indexer.GetLogsSourceReader(u, source)
+	}
+	reader, err := h.managerFor(r).GetLogsReader(u)
+	if err != nil || reader == nil {
+		return reader, err
+	}
+	return common.NewLogSourceFilter(reader, source), nil
+}
+
+// logSources count the logs of a device of each source, through the index of the driver if it has one, reading all
+// the logs of the device otherwise
+func (h *adminHandler) logSources(r *http.Request, u uuid.UUID) (map[string]int64, error) {
+	if indexer, ok := h.manager.(driver.LogSourceIndexer); ok {
+		return indexer.GetLogSources(u)
+	}
+	reader, err := h.managerFor(r).GetLogsReader(u)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	if reader == nil {
+		return counts, nil
+	}
+	br := bufio.NewReader(reader)
+	for {
+		line, err := br.ReadBytes('\n')
+		if source := common.LogSource(bytes.TrimRight(line, "\n")); source != "" {
+			counts[source]++
+		}
+		if err == io.EOF {
+			return counts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// deviceLogSources report the sources of the logs of a device, with how many entries of each are kept
+func (h *adminHandler) deviceLogSources(w http.ResponseWriter, r *http.Request) {
+	u, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, _, _, err := h.managerFor(r).DeviceGet(&u); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	sources, err := h.logSources(r, u)
+	if err != nil {
+		log.Printf("error getting the log sources of %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(sources)
+	if err != nil {
+		log.Printf("error converting log sources to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
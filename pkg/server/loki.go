@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/logs"
+	uuid "github.com/satori/go.uuid"
+)
+
+// lokiPushPath path of the Loki push API, used when the Loki URL has no path
+const lokiPushPath = "/loki/api/v1/push"
+
+// lokiLabels the labels of the stream of an entry; the app instance is empty for the logs of the device
+type lokiLabels struct {
+	device   string
+	app      string
+	severity string
+	source   string
+}
+
+// lokiEntry a log entry to push, with the labels of its stream
+type lokiEntry struct {
+	labels lokiLabels
+	time   time.Time
+	line   string
+}
+
+// lokiStream a stream of the Loki push API: entries with the same labels
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	// Values pairs of the time, in nanoseconds since the epoch, and the line of the entries
+	Values [][2]string `json:"values"`
+}
+
+// lokiExporter forward the logs of devices and their app instances to Grafana Loki, in batches, in the background.
+// Entries are labelled with the device, the app instance for app logs, the severity and the source
+type lokiExporter struct {
+	*egress
+	url    string
+	user   *url.Userinfo
+	tenant string
+}
+
+// newLokiExporter an exporter to the Loki at a http:// or https:// URL, with the user and password in it if any, and
+// the tenant to send as X-Scope-OrgID if not empty. The path of the URL defaults to that of the push API
+func newLokiExporter(rawURL, tenant string) (*lokiExporter, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad Loki URL %s: %v", rawURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("bad Loki URL %s: must be http:// or https://host[:port][/path]", rawURL)
+	}
+	l := &lokiExporter{user: u.User, tenant: tenant}
+	l.egress = newEgress("Loki", "log entries", l.send)
+	u.User = nil
+	if u.Path == "" || u.Path == "/" {
+		u.Path = lokiPushPath
+	}
+	l.url = u.String()
+	return l, nil
+}
+
+// push queue a log entry of a device, or of one of its app instances if app is not empty, dropping it if the queue
+// is full. It does nothing without an exporter
+func (l *lokiExporter) push(device uuid.UUID, app string, entry *logs.LogEntry) {
+	if l == nil {
+		return
+	}
+	e := lokiEntry{
+		labels: lokiLabels{
+			device:   device.String(),
+			app:      app,
+			severity: strings.ToLower(entry.GetSeverity()),
+			source:   entry.GetSource(),
+		},
+		time: time.Now(),
+		line: entry.GetContent(),
+	}
+	if ts := entry.GetTimestamp(); ts != nil {
+		e.time = ts.AsTime()
+	}
+	l.add(e)
+}
+
+// send push a batch, grouped in streams by labels, returning whether to retry it if it failed
+func (l *lokiExporter) send(batch []interface{}) (bool, error) {
+	entries := make([]lokiEntry, 0, len(batch))
+	for _, e := range batch {
+		entries = append(entries, e.(lokiEntry))
+	}
+	b, err := json.Marshal(map[string][]*lokiStream{"streams": lokiStreams(entries)})
+	if err != nil {
+		return false, fmt.Errorf("unable to encode log entries: %v", err)
+	}
+	req, err := http.NewRequest("POST", l.url, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(contentType, mimeJSON)
+	if l.user != nil {
+		password, _ := l.user.Password()
+		req.SetBasicAuth(l.user.Username(), password)
+	}
+	if l.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", l.tenant)
+	}
+	return l.post(req)
+}
+
+// lokiStreams group entries in streams by labels, in the order of their first entry, each stream in time order
+func lokiStreams(batch []lokiEntry) []*lokiStream {
+	var keys []lokiLabels
+	entries := map[lokiLabels][]lokiEntry{}
+	for _, e := range batch {
+		if _, ok := entries[e.labels]; !ok {
+			keys = append(keys, e.labels)
+		}
+		entries[e.labels] = append(entries[e.labels], e)
+	}
+	streams := make([]*lokiStream, 0, len(keys))
+	for _, k := range keys {
+		s := &lokiStream{Stream: map[string]string{"device": k.device}}
+		for name, v := range map[string]string{"app": k.app, "severity": k.severity, "source": k.source} {
+			if v != "" {
+				s.Stream[name] = v
+			}
+		}
+		es := entries[k]
+		sort.SliceStable(es, func(i, j int) bool { return es[i].time.Before(es[j].time) })
+		for _, e := range es {
+			s.Values = append(s.Values, [2]string{strconv.FormatInt(e.time.UnixNano(), 10), e.line})
+		}
+		streams = append(streams, s)
+	}
+	return streams
+}
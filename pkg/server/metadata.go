@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// matchTags whether the metadata of a device matches the tag filters of a request, as ?tag=site:berlin&tag=rack,
+// all of which must match. A device whose metadata cannot be read matches no filters
+func (h *adminHandler) matchTags(r *http.Request, u uuid.UUID, tags []string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	md, err := h.managerFor(r).GetDeviceMetadata(u)
+	if err != nil {
+		log.Printf("error getting metadata of %s: %v", u, err)
+		return false
+	}
+	return md.Match(tags)
+}
+
+func (h *adminHandler) deviceMetadataGet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	md, err := h.managerFor(r).GetDeviceMetadata(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting metadata of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	case md == nil:
+		md = &common.DeviceMetadata{}
+	}
+	body, err := json.Marshal(md)
+	if err != nil {
+		log.Printf("error converting metadata to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (h *adminHandler) deviceMetadataSet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var md common.DeviceMetadata
+	if err := json.Unmarshal(body, &md); err != nil {
+		httpError(w, fmt.Sprintf("bad metadata: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := md.Validate(); err != nil {
+		httpError(w, fmt.Sprintf("bad metadata: %v", err), http.StatusBadRequest)
+		return
+	}
+	h.setDeviceMetadata(w, r, uid, &md)
+}
+
+func (h *adminHandler) deviceMetadataRemove(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	h.setDeviceMetadata(w, r, uid, nil)
+}
+
+// setDeviceMetadata replace the metadata of a device, or clear it if md is nil. Its identity is recorded by adam
+// from the device info, so it is kept as it is, whatever the request has
+func (h *adminHandler) setDeviceMetadata(w http.ResponseWriter, r *http.Request, uid uuid.UUID, md *common.DeviceMetadata) {
+	// keep the audit record free of typed nils, that would show as null
+	var before, after interface{}
+	var identity *common.DeviceIdentity
+	if old, err := h.managerFor(r).GetDeviceMetadata(uid); err == nil && old != nil {
+		before = old
+		identity = old.Identity
+	}
+	switch {
+	case md != nil:
+		md.Identity = identity
+	case identity != nil:
+		md = &common.DeviceMetadata{Identity: identity}
+	}
+	if md != nil {
+		after = md
+	}
+	err := h.managerFor(r).SetDeviceMetadata(uid, md)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case err != nil:
+		log.Printf("error setting metadata of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		h.audit(r, auditMetadataSet, uid.String(), before, after)
+		w.WriteHeader(http.StatusOK)
+	}
+}
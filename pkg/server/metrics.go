@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// mimePrometheus content type of the Prometheus text exposition format
+const mimePrometheus = "text/plain; version=0.0.4"
+
+// metrics serve the counters of the server in the Prometheus text format, for scraping
+func (h *adminHandler) metrics(w http.ResponseWriter, r *http.Request) {
+	dropped := map[string]uint64{}
+	for u, n := range h.filters.droppedCounts() {
+		dropped[u.String()] = n
+	}
+	w.Header().Set(contentType, mimePrometheus)
+	w.WriteHeader(http.StatusOK)
+	writeCounter(w, "adam_log_entries_dropped_total", "Log entries dropped by the log filter of their device, before being stored.", "device", dropped)
+	writeCounter(w, "adam_device_requests_total", "Requests of devices to the device API, by method and route.", "endpoint", h.stats.totals())
+	if h.shedder != nil {
+		shed, timedOut := h.shedder.counts()
+		writeCounter(w, "adam_device_requests_shed_total", "Requests of devices shed as the budget of their endpoint had too many in flight, by method and route.", "endpoint", shed)
+		writeCounter(w, "adam_device_requests_timed_out_total", "Requests of devices answered 503 as they were not handled within the timeout of the budget of their endpoint, by method and route.", "endpoint", timedOut)
+		writeGauge(w, "adam_device_requests_in_flight", "Requests of devices being handled under each budget with a concurrency, by budget.", "budget", h.shedder.inFlight())
+	}
+	if h.loki != nil {
+		writeCounter(w, "adam_loki_entries_total", "Log entries forwarded to Loki, by whether they were sent or dropped as the queue was full or Loki refused them.", "result", h.loki.counts())
+	}
+	if h.syslog != nil {
+		writeCounter(w, "adam_syslog_entries_total", "Log entries forwarded to syslog, by whether they were sent or dropped as the queue was full.", "result", h.syslog.counts())
+	}
+	if h.deviceCAs != nil {
+		auths, devices := h.deviceCAs.counts()
+		writeCounter(w, "adam_device_ca_authentications_total", "Device certificates verified against each device CA bundle.", "ca", auths)
+		writeGauge(w, "adam_device_ca_devices", "Devices whose certificate was last verified against each device CA bundle, since the server started.", "ca", devices)
+	}
+	if h.metricsExport != nil {
+		writeCounter(w, "adam_metrics_export_samples_total", "Samples of the metrics of devices pushed as time series, by whether they were sent or dropped as the queue was full or the endpoint refused them.", "result", h.metricsExport.counts())
+	}
+	if h.federation != nil {
+		writeCounter(w, "adam_federation_messages_total", "Messages of devices forwarded to the primary, by whether they were sent or dropped as the queue was full or the primary refused them.", "result", h.federation.counts())
+	}
+}
+
+// writeGauge write a gauge with one label, a sample per value of the label, sorted so that the output is stable
+func writeGauge(w io.Writer, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	writeSamples(w, name, label, values)
+}
+
+// writeCounter write a counter with one label, a sample per value of the label, sorted so that the output is stable
+func writeCounter(w io.Writer, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	writeSamples(w, name, label, values)
+}
+
+// writeSamples write a sample per value of a label, sorted
+func writeSamples(w io.Writer, name, label string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
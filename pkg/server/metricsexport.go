@@ -0,0 +1,253 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/lf-edge/eve/api/go/metrics"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// exportInflux export the metrics to InfluxDB, in its line protocol
+	exportInflux = "influx"
+	// exportPrometheus export the metrics to a Prometheus remote-write endpoint
+	exportPrometheus = "prometheus"
+	// remoteWriteVersion the version of the Prometheus remote-write protocol pushed
+	remoteWriteVersion = "0.1.0"
+)
+
+// field numbers of the messages of the Prometheus remote-write protocol, in prompb of Prometheus. Prometheus is not
+// a module adam builds with, so its few fields are encoded by hand
+const (
+	// WriteRequest
+	wrTimeseries = 1
+	// TimeSeries
+	tsLabels  = 1
+	tsSamples = 2
+	// Label
+	lName  = 1
+	lValue = 2
+	// Sample
+	sValue     = 1
+	sTimestamp = 2
+)
+
+// metricLabel a label of a sample
+type metricLabel struct {
+	name  string
+	value string
+}
+
+// metricSample a value of a metric of a device at a time, with its labels sorted by name
+type metricSample struct {
+	name   string
+	labels []metricLabel
+	value  float64
+	time   time.Time
+}
+
+// metricsExporter push the metrics of devices and their app instances to InfluxDB or a Prometheus remote-write
+// endpoint, as time series of their CPU, memory, disk and network use, in batches, in the background
+type metricsExporter struct {
+	*egress
+	format string
+	url    string
+	user   *url.Userinfo
+	token  string
+}
+
+// newMetricsExporter an exporter in a format, exportInflux if empty or exportPrometheus, to a http:// or https://
+// URL, with the user and password in it if any, or else the token to authorize with. The URL is pushed to as it is,
+// e.g. the write API of InfluxDB with its org and bucket, or db, in the query
+func newMetricsExporter(format, rawURL, token string) (*metricsExporter, error) {
+	if format == "" {
+		format = exportInflux
+	}
+	if format != exportInflux && format != exportPrometheus {
+		return nil, fmt.Errorf("unknown metrics export format %q, must be one of %s or %s", format, exportInflux, exportPrometheus)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad metrics export URL %s: %v", rawURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("bad metrics export URL %s: must be http:// or https://host[:port][/path]", rawURL)
+	}
+	m := &metricsExporter{format: format, user: u.User, token: token}
+	service := "InfluxDB"
+	if format == exportPrometheus {
+		service = "Prometheus"
+	}
+	m.egress = newEgress(service, "samples", m.send)
+	u.User = nil
+	m.url = u.String()
+	return m, nil
+}
+
+// push queue the samples of a metrics message of a device, dropping those that do not fit in the queue. It does
+// nothing without an exporter
+func (m *metricsExporter) push(device uuid.UUID, msg *metrics.ZMetricMsg) {
+	if m == nil {
+		return
+	}
+	for _, s := range metricSamples(device, msg) {
+		m.add(s)
+	}
+}
+
+// send push a batch, in time order, returning whether to retry it if it failed
+func (m *metricsExporter) send(batch []interface{}) (bool, error) {
+	samples := make([]metricSample, 0, len(batch))
+	for _, s := range batch {
+		samples = append(samples, s.(metricSample))
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].time.Before(samples[j].time) })
+	var (
+		body []byte
+		req  *http.Request
+		err  error
+	)
+	if m.format == exportPrometheus {
+		body = snappy.Encode(nil, remoteWriteRequest(samples))
+	} else {
+		body = influxLines(samples)
+	}
+	if req, err = http.NewRequest("POST", m.url, bytes.NewReader(body)); err != nil {
+		return false, err
+	}
+	if m.format == exportPrometheus {
+		req.Header.Set(contentType, "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion)
+	} else {
+		req.Header.Set(contentType, "text/plain; charset=utf-8")
+	}
+	switch {
+	case m.token != "" && m.format == exportPrometheus:
+		req.Header.Set("Authorization", "Bearer "+m.token)
+	case m.token != "":
+		req.Header.Set("Authorization", "Token "+m.token)
+	case m.user != nil:
+		password, _ := m.user.Password()
+		req.SetBasicAuth(m.user.Username(), password)
+	}
+	return m.post(req)
+}
+
+// metricSamples the samples of a metrics message of a device: its CPU seconds and uptime, its memory use, the use
+// of each of its disks, what each of its interfaces received and sent, and the CPU and memory use of each of its
+// app instances. All are labelled with the device, at the time of the message
+func metricSamples(device uuid.UUID, msg *metrics.ZMetricMsg) []metricSample {
+	at := time.Now()
+	if msg.AtTimeStamp != nil {
+		at = msg.AtTimeStamp.AsTime()
+	}
+	var samples []metricSample
+	add := func(name string, value float64, labels ...string) {
+		s := metricSample{name: name, value: value, time: at, labels: []metricLabel{{"device", device.String()}}}
+		for i := 0; i+1 < len(labels); i += 2 {
+			if labels[i+1] != "" {
+				s.labels = append(s.labels, metricLabel{labels[i], labels[i+1]})
+			}
+		}
+		sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+		samples = append(samples, s)
+	}
+	dm := msg.GetDm()
+	if c := dm.GetCpuMetric(); c != nil {
+		add("eve_device_cpu_seconds_total", float64(c.Total))
+		if c.UpTime != nil {
+			add("eve_device_uptime_seconds", at.Sub(c.UpTime.AsTime()).Seconds())
+		}
+	}
+	if mem := dm.GetMemory(); mem != nil {
+		add("eve_device_memory_used_mb", float64(mem.UsedMem))
+		add("eve_device_memory_available_mb", float64(mem.AvailMem))
+	}
+	for _, d := range dm.GetDisk() {
+		add("eve_device_disk_read_mb_total", float64(d.ReadBytes), "disk", d.Disk, "mount", d.MountPath)
+		add("eve_device_disk_write_mb_total", float64(d.WriteBytes), "disk", d.Disk, "mount", d.MountPath)
+		if d.MountPath != "" {
+			add("eve_device_disk_used_mb", float64(d.Used), "disk", d.Disk, "mount", d.MountPath)
+			add("eve_device_disk_free_mb", float64(d.Free), "disk", d.Disk, "mount", d.MountPath)
+			add("eve_device_disk_total_mb", float64(d.Total), "disk", d.Disk, "mount", d.MountPath)
+		}
+	}
+	for _, n := range dm.GetNetwork() {
+		add("eve_device_network_rx_bytes_total", float64(n.RxBytes), "interface", n.IName)
+		add("eve_device_network_tx_bytes_total", float64(n.TxBytes), "interface", n.IName)
+	}
+	for _, am := range msg.GetAm() {
+		if c := am.GetCpu(); c != nil {
+			add("eve_app_cpu_seconds_total", float64(c.Total), "app", am.AppID, "app_name", am.AppName)
+		}
+		if mem := am.GetMemory(); mem != nil {
+			add("eve_app_memory_used_mb", float64(mem.UsedMem), "app", am.AppID, "app_name", am.AppName)
+			add("eve_app_memory_available_mb", float64(mem.AvailMem), "app", am.AppID, "app_name", am.AppName)
+		}
+		for _, n := range am.GetNetwork() {
+			add("eve_app_network_rx_bytes_total", float64(n.RxBytes), "app", am.AppID, "app_name", am.AppName, "interface", n.IName)
+			add("eve_app_network_tx_bytes_total", float64(n.TxBytes), "app", am.AppID, "app_name", am.AppName, "interface", n.IName)
+		}
+	}
+	return samples
+}
+
+// influxEscape escape the commas, equals signs and spaces of a measurement, tag key or tag value of the InfluxDB
+// line protocol
+var influxEscape = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxLines the samples in the InfluxDB line protocol, one line per sample: the metric as measurement, the labels
+// as tags, the value as the value field, and the time in nanoseconds
+func influxLines(samples []metricSample) []byte {
+	var b bytes.Buffer
+	for _, s := range samples {
+		b.WriteString(influxEscape.Replace(s.name))
+		for _, l := range s.labels {
+			fmt.Fprintf(&b, ",%s=%s", influxEscape.Replace(l.name), influxEscape.Replace(l.value))
+		}
+		fmt.Fprintf(&b, " value=%s %d\n", strconv.FormatFloat(s.value, 'g', -1, 64), s.time.UnixNano())
+	}
+	return b.Bytes()
+}
+
+// remoteWriteRequest the samples as a WriteRequest of the Prometheus remote-write protocol, one time series per
+// sample, with the metric as its __name__ label, before it is compressed
+func remoteWriteRequest(samples []metricSample) []byte {
+	var out []byte
+	for _, s := range samples {
+		var ts []byte
+		for _, l := range append([]metricLabel{{"__name__", s.name}}, s.labels...) {
+			var lb []byte
+			lb = protowire.AppendTag(lb, lName, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, lValue, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			ts = protowire.AppendTag(ts, tsLabels, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, lb)
+		}
+		var sb []byte
+		sb = protowire.AppendTag(sb, sValue, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.value))
+		sb = protowire.AppendTag(sb, sTimestamp, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.time.UnixNano()/int64(time.Millisecond)))
+		ts = protowire.AppendTag(ts, tsSamples, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sb)
+		out = protowire.AppendTag(out, wrTimeseries, protowire.BytesType)
+		out = protowire.AppendBytes(out, ts)
+	}
+	return out
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/metrics"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// metricsCSV and metricsParquet the formats metrics are exported in
+	metricsCSV     = "csv"
+	metricsParquet = "parquet"
+
+	mimeCSV     = "text/csv"
+	mimeParquet = "application/vnd.apache.parquet"
+
+	// metricsTimeColumn the column of the time of each message of an export
+	metricsTimeColumn = "time"
+)
+
+// metricsRange the metrics messages of a device at or after from and at or before to, either zero for no limit
+type metricsRange struct {
+	from, to time.Time
+}
+
+func (m metricsRange) has(at time.Time) bool {
+	return (m.from.IsZero() || !at.Before(m.from)) && (m.to.IsZero() || !at.After(m.to))
+}
+
+// parseMetricsRange get the range of an export from the from and to query parameters
+func parseMetricsRange(r *http.Request) (metricsRange, error) {
+	q := r.URL.Query()
+	var m metricsRange
+	var err error
+	if s := q.Get("from"); s != "" {
+		if m.from, err = time.Parse(time.RFC3339, s); err != nil {
+			return m, fmt.Errorf("invalid from %s: %v", s, err)
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if m.to, err = time.Parse(time.RFC3339, s); err != nil {
+			return m, fmt.Errorf("invalid to %s: %v", s, err)
+		}
+	}
+	if !m.from.IsZero() && !m.to.IsZero() && m.to.Before(m.from) {
+		return m, fmt.Errorf("to %s is before from %s", m.to.Format(time.RFC3339), m.from.Format(time.RFC3339))
+	}
+	return m, nil
+}
+
+// metricsColumn the name of the column of a sample: the metric with its labels but the device, which all share,
+// e.g. eve_device_disk_used_mb{disk=sda,mount=/persist}
+func metricsColumn(s metricSample) string {
+	var labels []string
+	for _, l := range s.labels {
+		if l.name != "device" {
+			labels = append(labels, l.name+"="+l.value)
+		}
+	}
+	if len(labels) == 0 {
+		return s.name
+	}
+	return s.name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// eachMetrics call f with the time and the values by column of each metrics message of a device in a range, read
+// one at a time, skipping those that cannot be read
+func eachMetrics(reader io.Reader, u uuid.UUID, in metricsRange, f func(time.Time, map[string]float64) error) error {
+	// entries are concatenated JSON objects, possibly separated by whitespace
+	decoder := json.NewDecoder(reader)
+	unmarshal := protojson.UnmarshalOptions{DiscardUnknown: true}
+	for {
+		var entry json.RawMessage
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msg := &metrics.ZMetricMsg{}
+		if err := unmarshal.Unmarshal(entry, msg); err != nil || msg.AtTimeStamp == nil {
+			continue
+		}
+		at := msg.AtTimeStamp.AsTime()
+		if !in.has(at) {
+			continue
+		}
+		values := map[string]float64{}
+		for _, s := range metricSamples(u, msg) {
+			values[metricsColumn(s)] = s.value
+		}
+		if err := f(at, values); err != nil {
+			return err
+		}
+	}
+}
+
+// readMetricsRange read the metrics messages of a device in a range, calling f for each, closing the reader after
+func (h *adminHandler) readMetricsRange(r *http.Request, u uuid.UUID, in metricsRange, f func(time.Time, map[string]float64) error) error {
+	reader, err := h.managerFor(r).GetMetricsReader(u)
+	if err != nil || reader == nil {
+		return err
+	}
+	if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
+	}
+	return eachMetrics(reader, u, in, f)
+}
+
+// deviceMetricsExport export the metrics of a device in a time range as CSV or Parquet, a row per message and a
+// column per metric and labels. The metrics are read twice, first for the columns, then for the rows, which are
+// written as they are read, so that a long range is never held in memory
+func (h *adminHandler) deviceMetricsExport(w http.ResponseWriter, r *http.Request) {
+	u, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = metricsCSV
+	case metricsCSV, metricsParquet:
+	default:
+		httpError(w, fmt.Sprintf("unknown format %q, must be %s or %s", format, metricsCSV, metricsParquet), http.StatusBadRequest)
+		return
+	}
+	in, err := parseMetricsRange(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, _, _, err := h.managerFor(r).DeviceGet(&u); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	seen := map[string]bool{}
+	err = h.readMetricsRange(r, u, in, func(_ time.Time, values map[string]float64) error {
+		for c := range values {
+			seen[c] = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("error reading the metrics of %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	columns := make([]string, 0, len(seen))
+	for c := range seen {
+		columns = append(columns, c)
+	}
+	sort.Strings(columns)
+
+	// messages that come in between the reads are in the rows if they are in the range, but their new columns, if
+	// any, are not
+	var write func(time.Time, map[string]float64) error
+	var finish func() error
+	if format == metricsParquet {
+		w.Header().Set(contentType, mimeParquet)
+		pw, err := common.NewParquetWriter(w, metricsTimeColumn, columns)
+		if err != nil {
+			log.Printf("error exporting the metrics of %s: %v", u, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		write, finish = pw.Write, pw.Close
+	} else {
+		w.Header().Set(contentType, mimeCSV)
+		cw := csv.NewWriter(w)
+		cw.Write(append([]string{metricsTimeColumn}, columns...))
+		row := make([]string, len(columns)+1)
+		write = func(at time.Time, values map[string]float64) error {
+			row[0] = at.UTC().Format(time.RFC3339Nano)
+			for i, c := range columns {
+				row[i+1] = ""
+				if v, ok := values[c]; ok {
+					row[i+1] = strconv.FormatFloat(v, 'g', -1, 64)
+				}
+			}
+			return cw.Write(row)
+		}
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	}
+	// the response has started, so a failure can only cut it short
+	if err := h.readMetricsRange(r, u, in, write); err != nil {
+		log.Printf("error exporting the metrics of %s: %v", u, err)
+		return
+	}
+	if err := finish(); err != nil {
+		log.Printf("error exporting the metrics of %s: %v", u, err)
+	}
+}
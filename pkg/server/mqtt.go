@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types, in the high nibble of the first byte
+const (
+	mqttConnect    = 0x10
+	mqttConnAck    = 0x20
+	mqttPublish    = 0x30
+	mqttDisconnect = 0xe0
+)
+
+// publishMQTT publish a message, at most once, to a topic of the MQTT broker at a mqtt:// or mqtts:// URL, with the
+// user and password in it if any. It connects for each message, as alerts are rare enough not to keep a connection
+func publishMQTT(rawURL, topic string, payload []byte, timeout time.Duration) error {
+	c, err := dialMQTT(rawURL, timeout)
+	if err != nil {
+		return err
+	}
+	if err := c.publish(topic, payload); err != nil {
+		c.conn.Close()
+		return err
+	}
+	return c.close()
+}
+
+// mqttConn a connection to an MQTT broker, to publish many messages on
+type mqttConn struct {
+	conn    net.Conn
+	host    string
+	timeout time.Duration
+}
+
+// dialMQTT connect to the MQTT broker at a mqtt:// or mqtts:// URL, with the user and password in it if any. Each
+// operation on the connection can take up to timeout
+func dialMQTT(rawURL string, timeout time.Duration) (*mqttConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad MQTT URL %s: %v", rawURL, err)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if u.Scheme == "mqtts" {
+			port = "8883"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if u.Scheme == "mqtts" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to MQTT broker %s: %v", host, err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := conn.Write(mqttConnectPacket(u.User)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to send MQTT connect to %s: %v", host, err)
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to read MQTT connect acknowledgement from %s: %v", host, err)
+	}
+	switch {
+	case ack[0] != mqttConnAck || ack[1] != 2:
+		conn.Close()
+		return nil, fmt.Errorf("unexpected MQTT packet %x from %s, expected a connect acknowledgement", ack, host)
+	case ack[3] != 0:
+		conn.Close()
+		return nil, fmt.Errorf("MQTT broker %s refused the connection with code %d", host, ack[3])
+	}
+	return &mqttConn{conn: conn, host: host, timeout: timeout}, nil
+}
+
+// publish publish a message, at most once, to a topic
+func (c *mqttConn) publish(topic string, payload []byte) error {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	writeMQTTString(&body, []byte(topic))
+	body.Write(payload)
+	if _, err := c.conn.Write(mqttPacket(mqttPublish, body.Bytes())); err != nil {
+		return fmt.Errorf("unable to publish to MQTT broker %s: %v", c.host, err)
+	}
+	return nil
+}
+
+// close disconnect from the broker
+func (c *mqttConn) close() error {
+	defer c.conn.Close()
+	if _, err := c.conn.Write([]byte{mqttDisconnect, 0}); err != nil {
+		return fmt.Errorf("unable to disconnect from MQTT broker %s: %v", c.host, err)
+	}
+	return nil
+}
+
+// mqttConnectPacket a CONNECT packet for a clean session, with a random client ID
+func mqttConnectPacket(user *url.Userinfo) []byte {
+	id := make([]byte, 8)
+	rand.Read(id)
+	var body bytes.Buffer
+	writeMQTTString(&body, []byte("MQTT"))
+	body.WriteByte(4) // protocol level of 3.1.1
+	flags := byte(0x02)
+	password, hasPassword := user.Password()
+	if user != nil && user.Username() != "" {
+		flags |= 0x80
+		if hasPassword {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	body.Write([]byte{0, 30}) // keep alive, in seconds
+	writeMQTTString(&body, []byte("adam-"+hex.EncodeToString(id)))
+	if flags&0x80 != 0 {
+		writeMQTTString(&body, []byte(user.Username()))
+	}
+	if flags&0x40 != 0 {
+		writeMQTTString(&body, []byte(password))
+	}
+	return mqttPacket(mqttConnect, body.Bytes())
+}
+
+// mqttPacket a packet of a type with its body, after the remaining length, which is 7 bits per byte, least
+// significant first
+func mqttPacket(kind byte, body []byte) []byte {
+	p := []byte{kind}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		p = append(p, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+func writeMQTTString(w *bytes.Buffer, s []byte) {
+	w.Write([]byte{byte(len(s) >> 8), byte(len(s))})
+	w.Write(s)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/lf-edge/adam/pkg/driver/common"
+	ax "github.com/lf-edge/adam/pkg/x509"
+)
+
+// OnboardGenerateRequest an onboarding certificate for the server to generate and register
+type OnboardGenerateRequest struct {
+	// CN common name of the certificate, which must not be that of one registered already
+	CN string `json:"cn"`
+	// Serial the serials to register the certificate with, comma-separated, as in OnboardCert
+	Serial string `json:"serial"`
+}
+
+// OnboardBundle an onboarding certificate generated by the server, with its key, both PEM encoded. The key is not
+// kept, so the bundle is only returned when generated
+type OnboardBundle struct {
+	CN     string `json:"cn"`
+	Serial string `json:"serial"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+}
+
+func (h *adminHandler) onboardGenerate(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req OnboardGenerateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad onboard request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.CN) == "" {
+		httpError(w, "bad onboard request: cn is required", http.StatusBadRequest)
+		return
+	}
+	serials := strings.Split(req.Serial, ",")
+	for _, serial := range serials {
+		if err := common.ValidateSerialPattern(serial); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	cn := common.GetOnboardCertName(req.CN)
+	// the key of an existing certificate is not known, so it is not replaced
+	_, _, err = h.managerFor(r).OnboardGet(cn)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err == nil:
+		httpError(w, fmt.Sprintf("onboarding certificate %s exists already", cn), http.StatusConflict)
+		return
+	case !isNotFound:
+		log.Printf("error checking onboarding certificate %s: %v", cn, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	cert, key, err := ax.GenerateCertAndKey(req.CN, "")
+	if err != nil {
+		log.Printf("error generating onboarding certificate %s: %v", cn, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := h.managerFor(r).OnboardRegister(cert, serials); err != nil {
+		log.Printf("error registering onboarding certificate %s: %v", cn, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditOnboardGenerate, cn, nil, map[string]interface{}{"serials": serials})
+	out, err := json.Marshal(OnboardBundle{
+		CN:     cn,
+		Serial: strings.Join(serials, ","),
+		Cert:   string(ax.PemEncodeCert(cert.Raw)),
+		Key:    string(ax.PemEncodeKey(key)),
+	})
+	if err != nil {
+		log.Printf("error converting onboard bundle to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// the key is in the body, which is not to be kept anywhere on the way
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(out)
+}
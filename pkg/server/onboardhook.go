@@ -0,0 +1,214 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/config"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// actions of an OnboardDecision
+	OnboardAllow   = "allow"
+	OnboardReject  = "reject"
+	OnboardPending = "pending"
+
+	// DefaultOnboardHookTimeout how long the webhook of an onboarding hook can take to decide, if it does not set it
+	DefaultOnboardHookTimeout = 10 * time.Second
+	// onboardHookSignature header of the HMAC-SHA256 of the body sent to the webhook, with its secret
+	onboardHookSignature = "X-Adam-Signature"
+)
+
+// OnboardHook decides on the registrations of devices from outside Adam, e.g. from an asset database or an ERP, to
+// approve, reject or enrich them. It is called once the onboarding certificate, serial and soft serial are checked,
+// and before OnboardApproval. An error is answered 503, for the device to try again later
+type OnboardHook interface {
+	Onboard(ctx context.Context, req OnboardHookRequest) (*OnboardDecision, error)
+}
+
+// OnboardHookRequest a device registering, as the OnboardHook sees it
+type OnboardHookRequest struct {
+	Serial     string `json:"serial"`
+	SoftSerial string `json:"soft-serial,omitempty"`
+	OnboardCN  string `json:"onboard-cn"`
+	// OnboardCert and DeviceCert the certificates, in PEM, of the onboarding certificate and of the device; that of
+	// the device is the one issued by the DeviceCA when it registers with a certificate signing request
+	OnboardCert string `json:"onboard-cert"`
+	DeviceCert  string `json:"device-cert"`
+	// DeviceFingerprint the SHA-256 of the device certificate, as revocations name it
+	DeviceFingerprint string `json:"device-fingerprint"`
+	ClientIP          string `json:"client-ip"`
+}
+
+// OnboardDecision what an OnboardHook decided for a device registering. A nil decision, or one without an action,
+// leaves the device to OnboardApproval as without a hook, the rest of the decision still applying if it is registered
+type OnboardDecision struct {
+	// Action OnboardAllow to register the device, without OnboardApproval, OnboardReject to refuse it, OnboardPending
+	// to make it wait for an admin to approve it, or empty
+	Action string `json:"action,omitempty"`
+	// Reason why the device is rejected, sent back to it and logged
+	Reason string `json:"reason,omitempty"`
+	// Metadata the metadata to register the device with, e.g. its site or the tags of its group
+	Metadata *common.DeviceMetadata `json:"metadata,omitempty"`
+	// Snapshot name of the config snapshot the device starts with, instead of the default one
+	Snapshot string `json:"snapshot,omitempty"`
+	// Config the config the device starts with, as the JSON of an EdgeDevConfig, instead of a snapshot; its UUID
+	// and version are set by Adam
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// validate check the action, metadata and config of a decision
+func (d *OnboardDecision) validate() error {
+	switch d.Action {
+	case "", OnboardAllow, OnboardReject, OnboardPending:
+	default:
+		return fmt.Errorf("unknown action %q, must be %s, %s, %s or empty", d.Action, OnboardAllow, OnboardReject, OnboardPending)
+	}
+	if d.Metadata != nil {
+		if err := d.Metadata.Validate(); err != nil {
+			return fmt.Errorf("invalid metadata: %v", err)
+		}
+	}
+	if d.Snapshot != "" && len(d.Config) > 0 {
+		return fmt.Errorf("both a snapshot and a config")
+	}
+	if len(d.Config) > 0 {
+		if err := protojson.Unmarshal(d.Config, &config.EdgeDevConfig{}); err != nil {
+			return fmt.Errorf("invalid config: %v", err)
+		}
+	}
+	return nil
+}
+
+// config the config a device registered per the decision starts with, the initial one if it sets none
+func (d *OnboardDecision) config(m driver.DeviceManager, u uuid.UUID, onboard *x509.Certificate, base []byte) ([]byte, error) {
+	switch {
+	case len(d.Config) > 0:
+		return deviceConfig(d.Config, u)
+	case d.Snapshot != "":
+		s, err := common.SnapshotGet(m, d.Snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("error getting config snapshot %s: %v", d.Snapshot, err)
+		}
+		return deviceConfig(s.Config, u)
+	default:
+		return initialConfig(m, u, onboard, base), nil
+	}
+}
+
+// onboardWebhook an OnboardHook posting the OnboardHookRequest as JSON to a URL, which answers 200 with the
+// OnboardDecision as JSON, or 204 to leave the device to OnboardApproval
+type onboardWebhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewOnboardWebhook an OnboardHook calling a webhook, with the HMAC-SHA256 of each body with the secret in
+// X-Adam-Signature, as sha256=<hex>, unless the secret is empty. A timeout of 0 means DefaultOnboardHookTimeout
+func NewOnboardWebhook(u, secret string, timeout time.Duration) (OnboardHook, error) {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("bad onboarding hook URL %q, must be http or https", u)
+	}
+	if timeout <= 0 {
+		timeout = DefaultOnboardHookTimeout
+	}
+	return &onboardWebhook{url: u, secret: []byte(secret), client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (o *onboardWebhook) String() string {
+	return o.url
+}
+
+func (o *onboardWebhook) Onboard(ctx context.Context, req OnboardHookRequest) (*OnboardDecision, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding onboarding hook request: %v", err)
+	}
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create onboarding hook request: %v", err)
+	}
+	hr.Header.Set(contentType, mimeJSON)
+	if len(o.secret) > 0 {
+		mac := hmac.New(sha256.New, o.secret)
+		mac.Write(b)
+		hr.Header.Set(onboardHookSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := o.client.Do(hr)
+	if err != nil {
+		return nil, fmt.Errorf("error calling onboarding hook: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading onboarding hook response: %v", err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("onboarding hook returned %s %s", res.Status, bytes.TrimSpace(body))
+	}
+	var d OnboardDecision
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, fmt.Errorf("bad onboarding hook decision: %v", err)
+	}
+	return &d, nil
+}
+
+// onboardDecision ask the hook to decide on a device registering, answering the request if it rejects the device
+// or fails. An empty decision without a hook. false if the request was answered
+func (h *apiHandler) onboardDecision(w http.ResponseWriter, r *http.Request, cert, onboard *x509.Certificate, serial, softSerial string) (*OnboardDecision, bool) {
+	if h.onboardHook == nil {
+		return &OnboardDecision{}, true
+	}
+	req := OnboardHookRequest{
+		Serial:            serial,
+		SoftSerial:        softSerial,
+		OnboardCN:         onboard.Subject.CommonName,
+		OnboardCert:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: onboard.Raw})),
+		DeviceCert:        string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		DeviceFingerprint: common.CertFingerprint(cert),
+		ClientIP:          r.RemoteAddr,
+	}
+	d, err := h.onboardHook.Onboard(r.Context(), req)
+	if err == nil && d != nil {
+		err = d.validate()
+	}
+	if err != nil {
+		log.Printf("error deciding on device with serial %s onboarded with %s: %v", serial, req.OnboardCN, err)
+		writeError(w, http.StatusServiceUnavailable, ErrServiceUnavailable, "onboarding hook unavailable", nil)
+		return nil, false
+	}
+	if d == nil {
+		return &OnboardDecision{}, true
+	}
+	if d.Action == OnboardReject {
+		log.Printf("device with serial %s onboarded with %s rejected by onboarding hook: %s", serial, req.OnboardCN, d.Reason)
+		writeError(w, http.StatusForbidden, ErrOnboardRejected, fmt.Sprintf("registration rejected: %s", d.Reason), map[string]string{"reason": d.Reason})
+		return nil, false
+	}
+	return d, true
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// onboardQuotaRefresh how long the telemetry quota of an onboarding certificate is used before its policy is read
+// again, so that a change made through another server is picked up
+const onboardQuotaRefresh = time.Minute
+
+// errDeviceLimit an onboarding certificate with as many devices registered as its policy allows
+type errDeviceLimit struct {
+	cn  string
+	max int
+}
+
+func (e *errDeviceLimit) Error() string {
+	return fmt.Sprintf("onboarding certificate %s has its maximum of %d devices registered", e.cn, e.max)
+}
+
+// onboardLimits the limits the policies of onboarding certificates set on the devices registered with them: how many
+// may register, checked as one does, and how much telemetry they send together, counted as it is stored. The usage
+// is counted by each server on its own, and starts again when it restarts
+type onboardLimits struct {
+	period time.Duration
+	// registerLock serializes counting the devices of a certificate and registering one more
+	registerLock sync.Mutex
+	mu           sync.Mutex
+	// certs the common name of the onboarding certificate of each device that sent telemetry, empty for none
+	certs map[uuid.UUID]string
+	// quotas the telemetry quota of each certificate, as last read from its policy
+	quotas map[string]onboardQuota
+	usage  map[string]*telemetryWindow
+}
+
+type onboardQuota struct {
+	quota int64
+	read  time.Time
+}
+
+// telemetryWindow the bytes of telemetry the devices of a certificate sent since the start of the current period
+type telemetryWindow struct {
+	start time.Time
+	bytes int64
+}
+
+func newOnboardLimits(period time.Duration) *onboardLimits {
+	if period == 0 {
+		period = common.DefaultQuotaPeriod
+	}
+	return &onboardLimits{
+		period: period,
+		certs:  map[uuid.UUID]string{},
+		quotas: map[string]onboardQuota{},
+		usage:  map[string]*telemetryWindow{},
+	}
+}
+
+// checkDevices check that the policy of an onboarding certificate lets one more device register with it, returning
+// an *errDeviceLimit if not. The caller holds registerLock until the device is registered
+func (l *onboardLimits) checkDevices(m driver.DeviceManager, onboard *x509.Certificate) error {
+	cn := onboard.Subject.CommonName
+	policy, err := m.OnboardPolicyGet(cn)
+	if _, isNotFound := err.(*common.NotFoundError); err != nil && !isNotFound {
+		return fmt.Errorf("error getting policy of onboarding certificate %s: %v", cn, err)
+	}
+	if policy == nil || policy.MaxDevices == nil {
+		return nil
+	}
+	devices, err := onboardDevices(m, onboard)
+	if err != nil {
+		return err
+	}
+	if !policy.AllowsDevices(len(devices)) {
+		return &errDeviceLimit{cn: cn, max: *policy.MaxDevices}
+	}
+	return nil
+}
+
+// registerFailed answer a registration refused by checkDevices, or that it failed
+func registerFailed(w http.ResponseWriter, err error) {
+	if limit, ok := err.(*errDeviceLimit); ok {
+		log.Printf("refused device: %v", err)
+		writeError(w, http.StatusForbidden, ErrDeviceLimit, err.Error(), map[string]int{"max-devices": limit.max})
+		return
+	}
+	log.Printf("error checking the device limit: %v", err)
+	httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// quota the common name of the onboarding certificate of a device, and the telemetry quota of its policy, 0 for none
+func (l *onboardLimits) quota(m driver.DeviceManager, u uuid.UUID) (string, int64, error) {
+	l.mu.Lock()
+	cn, ok := l.certs[u]
+	l.mu.Unlock()
+	if !ok {
+		_, onboard, _, err := m.DeviceGet(&u)
+		if err != nil {
+			return "", 0, err
+		}
+		if onboard != nil {
+			cn = onboard.Subject.CommonName
+		}
+		l.mu.Lock()
+		l.certs[u] = cn
+		l.mu.Unlock()
+	}
+	if cn == "" {
+		return "", 0, nil
+	}
+	l.mu.Lock()
+	q, ok := l.quotas[cn]
+	l.mu.Unlock()
+	if ok && time.Since(q.read) < onboardQuotaRefresh {
+		return cn, q.quota, nil
+	}
+	policy, err := m.OnboardPolicyGet(cn)
+	if _, isNotFound := err.(*common.NotFoundError); err != nil && !isNotFound {
+		return "", 0, err
+	}
+	q = onboardQuota{read: time.Now()}
+	if policy != nil {
+		q.quota = policy.TelemetryQuota
+	}
+	l.mu.Lock()
+	l.quotas[cn] = q
+	l.mu.Unlock()
+	return cn, q.quota, nil
+}
+
+// use count n bytes of telemetry of a device against the quota of its onboarding certificate, returning a
+// QuotaExceededError, without counting them, if that would exceed it. Telemetry is not limited when the quota
+// cannot be read
+func (l *onboardLimits) use(m driver.DeviceManager, u uuid.UUID, n int) error {
+	cn, quota, err := l.quota(m, u)
+	if err != nil {
+		log.Printf("error getting the telemetry quota of %s: %v", u, err)
+		return nil
+	}
+	if quota == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	usage, ok := l.usage[cn]
+	if !ok || now.Sub(usage.start) >= l.period {
+		usage = &telemetryWindow{start: now}
+		l.usage[cn] = usage
+	}
+	if usage.bytes+int64(n) > quota {
+		return &common.QuotaExceededError{Err: fmt.Sprintf("devices of onboarding certificate %s exceeded their telemetry quota of %d bytes per %s, %d bytes used, retry after %s",
+			cn, quota, l.period, usage.bytes, usage.start.Add(l.period).Format(time.RFC3339))}
+	}
+	usage.bytes += int64(n)
+	return nil
+}
+
+// telemetry the telemetry the devices of a certificate sent in the current period, nil if its policy has no quota
+func (l *onboardLimits) telemetry(cn string, policy *common.OnboardPolicy) *common.TelemetryUsage {
+	if policy == nil || policy.TelemetryQuota == 0 {
+		return nil
+	}
+	t := &common.TelemetryUsage{Quota: policy.TelemetryQuota}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if usage, ok := l.usage[cn]; ok && time.Since(usage.start) < l.period {
+		since, reset := usage.start, usage.start.Add(l.period)
+		t.Used, t.Since, t.Reset = usage.bytes, &since, &reset
+	}
+	return t
+}
+
+// forget drop the telemetry quota read for a certificate, once its policy changed
+func (l *onboardLimits) forget(cn string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.quotas, cn)
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/info"
+	uuid "github.com/satori/go.uuid"
+)
+
+// onboardPolicyActor actor of the audit records of devices deleted for reporting a hardware model their onboarding
+// certificate does not allow
+const onboardPolicyActor = "onboard-policy"
+
+// onboardPolicy the policy of the onboarding certificate a device registers or registered with, nil if it has none
+// or the certificate is no longer registered
+func (h *apiHandler) onboardPolicy(r *http.Request, onboard *x509.Certificate) (*common.OnboardPolicy, error) {
+	policy, err := h.managerFor(r).OnboardPolicyGet(onboard.Subject.CommonName)
+	if _, isNotFound := err.(*common.NotFoundError); isNotFound {
+		return nil, nil
+	}
+	return policy, err
+}
+
+// checkSoftSerial refuse a device registering with a soft serial the policy of its onboarding certificate does not
+// allow. false if the request was answered
+func (h *apiHandler) checkSoftSerial(w http.ResponseWriter, r *http.Request, onboard *x509.Certificate, softSerial string) bool {
+	policy, err := h.onboardPolicy(r, onboard)
+	if err != nil {
+		log.Printf("error getting policy of onboarding certificate %s: %v", onboard.Subject.CommonName, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if policy.AllowsSoftSerial(softSerial) {
+		return true
+	}
+	log.Printf("failed authentication: soft serial %q not allowed for onboarding certificate %s", softSerial, onboard.Subject.CommonName)
+	writeError(w, http.StatusUnauthorized, ErrInvalidSoftSerial, fmt.Sprintf("soft serial not allowed for onboarding certificate: %s", softSerial), map[string]string{"soft-serial": softSerial})
+	return false
+}
+
+// checkModel refuse a device reporting a hardware model the policy of its onboarding certificate does not allow,
+// deleting it softly so that it is refused from then on, unless restored. Only the info carrying the hardware of the
+// device is checked, and devices registered without an onboarding certificate are not. false if the request was
+// answered
+func (h *apiHandler) checkModel(w http.ResponseWriter, r *http.Request, u uuid.UUID, msg *info.ZInfoMsg) bool {
+	minfo := msg.GetDinfo().GetMinfo()
+	if minfo == nil {
+		return true
+	}
+	_, onboard, _, err := h.managerFor(r).DeviceGet(&u)
+	if err != nil {
+		log.Printf("error getting onboarding certificate of %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if onboard == nil {
+		return true
+	}
+	policy, err := h.onboardPolicy(r, onboard)
+	if err != nil {
+		log.Printf("error getting policy of onboarding certificate %s: %v", onboard.Subject.CommonName, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	model := minfo.GetProductName()
+	if policy.AllowsModel(model) {
+		return true
+	}
+	now := time.Now().UTC()
+	ts := &common.Tombstone{
+		UUID:    u.String(),
+		Deleted: now,
+		Expires: now.Add(h.retention),
+		Actor:   onboardPolicyActor,
+	}
+	if err := common.TombstoneAdd(h.managerFor(r), ts); err != nil {
+		log.Printf("error deleting device %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	writeAudit(h.managerFor(r), AuditRecord{
+		Timestamp: time.Now(),
+		Actor:     onboardPolicyActor,
+		ClientIP:  r.RemoteAddr,
+		Action:    auditDeviceRemove,
+		Target:    u.String(),
+		After:     map[string]interface{}{"soft": true, "expires": ts.Expires, "model": model},
+	})
+	log.Printf("refused device %s: model %q not allowed for onboarding certificate %s", u, model, onboard.Subject.CommonName)
+	writeError(w, http.StatusForbidden, ErrModelNotAllowed, fmt.Sprintf("hardware model not allowed for onboarding certificate: %s", model), map[string]string{"model": model})
+	return false
+}
+
+func (h *adminHandler) onboardPolicyGet(w http.ResponseWriter, r *http.Request) {
+	cn := mux.Vars(r)["cn"]
+	policy, err := h.managerFor(r).OnboardPolicyGet(cn)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting policy of onboarding certificate %s: %v", cn, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	case policy == nil:
+		policy = &common.OnboardPolicy{}
+	}
+	body, err := json.Marshal(policy)
+	if err != nil {
+		log.Printf("error converting onboard policy to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (h *adminHandler) onboardPolicySet(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var policy common.OnboardPolicy
+	if err := json.Unmarshal(body, &policy); err != nil {
+		httpError(w, fmt.Sprintf("bad onboard policy: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := policy.Validate(); err != nil {
+		httpError(w, fmt.Sprintf("bad onboard policy: %v", err), http.StatusBadRequest)
+		return
+	}
+	if policy.Snapshot != "" {
+		_, err := common.SnapshotGet(h.managerFor(r), policy.Snapshot)
+		_, isNotFound := err.(*common.NotFoundError)
+		switch {
+		case err != nil && isNotFound:
+			httpError(w, fmt.Sprintf("bad onboard policy: no config snapshot %s", policy.Snapshot), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("error getting config snapshot %s: %v", policy.Snapshot, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	h.setOnboardPolicy(w, r, mux.Vars(r)["cn"], &policy)
+}
+
+func (h *adminHandler) onboardPolicyRemove(w http.ResponseWriter, r *http.Request) {
+	h.setOnboardPolicy(w, r, mux.Vars(r)["cn"], nil)
+}
+
+func (h *adminHandler) setOnboardPolicy(w http.ResponseWriter, r *http.Request, cn string, policy *common.OnboardPolicy) {
+	// keep the audit record free of typed nils, that would show as null
+	var before, after interface{}
+	if old, err := h.managerFor(r).OnboardPolicyGet(cn); err == nil && old != nil {
+		before = old
+	}
+	if policy != nil {
+		after = policy
+	}
+	err := h.managerFor(r).OnboardPolicySet(cn, policy)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case err != nil:
+		log.Printf("error setting policy of onboarding certificate %s: %v", cn, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		h.limits.forget(cn)
+		h.audit(r, auditOnboardPolicySet, cn, before, after)
+		w.WriteHeader(http.StatusOK)
+	}
+}
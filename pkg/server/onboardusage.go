@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+)
+
+// onboardUsage report how many of the serials of an onboarding certificate devices used, by which, and how many are
+// left. The devices are those registered with the certificate, as the serials checked when a device registers. With
+// the limits of its policy, it reports how many more devices may register, and the telemetry they sent
+func (h *adminHandler) onboardUsage(w http.ResponseWriter, r *http.Request) {
+	cn := mux.Vars(r)["cn"]
+	m := h.managerFor(r)
+	cert, serials, err := m.OnboardGet(cn)
+	if _, isNotFound := err.(*common.NotFoundError); isNotFound {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error getting onboarding certificate %s: %v", cn, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	devices, err := onboardDevices(m, cert)
+	if err != nil {
+		log.Print(err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	policy, err := m.OnboardPolicyGet(cn)
+	if err != nil {
+		log.Printf("error getting policy of onboarding certificate %s: %v", cn, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	usage := common.NewOnboardUsage(cn, serials, devices)
+	usage.Limit(policy)
+	usage.Telemetry = h.limits.telemetry(cn, policy)
+	body, err := json.Marshal(usage)
+	if err != nil {
+		log.Printf("error converting onboarding usage to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// onboardDevices the devices registered with an onboarding certificate, those deleted softly included
+func onboardDevices(m driver.DeviceManager, cert *x509.Certificate) ([]common.SerialDevice, error) {
+	uids, err := m.DeviceList()
+	if err != nil {
+		return nil, fmt.Errorf("error listing devices: %v", err)
+	}
+	tombstones, err := common.TombstoneList(m)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tombstones: %v", err)
+	}
+	deleted := map[string]bool{}
+	for _, t := range tombstones {
+		deleted[t.UUID] = true
+	}
+	var devices []common.SerialDevice
+	for _, u := range uids {
+		if u == nil {
+			continue
+		}
+		_, onboard, serial, err := m.DeviceGet(u)
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+		if onboard == nil || !bytes.Equal(onboard.Raw, cert.Raw) {
+			continue
+		}
+		devices = append(devices, common.SerialDevice{Serial: serial, UUID: u.String(), Deleted: deleted[u.String()]})
+	}
+	return devices, nil
+}
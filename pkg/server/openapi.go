@@ -0,0 +1,534 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/config"
+	"google.golang.org/protobuf/proto"
+)
+
+// openAPIVersion version of the admin API in its OpenAPI document
+const openAPIVersion = "1.0.0"
+
+// AdminOperation an operation of the admin API, as its OpenAPI document and the generated client describe it
+type AdminOperation struct {
+	// ID operationId of the operation, the name of its handler
+	ID     string
+	Method string
+	// Path the path of the operation, with its parameters in braces, e.g. /admin/device/{uuid}
+	Path    string
+	Summary string
+	// Params the parameters of the path, in order, with the values of those that can only have some in Enums
+	Params []string
+	Enums  map[string][]string
+	// Query the names of the query parameters
+	Query []string
+	// Request a value of the type of the body of the request, as JSON unless RequestType is set, nil if it has none,
+	// or if its body is not JSON, of RequestType
+	Request     interface{}
+	RequestType string
+	// Response a value of the type of the body of the response, as JSON unless ResponseType is set, nil if it has
+	// none, or if its body is not JSON, of ResponseType
+	Response     interface{}
+	ResponseType string
+	// Stream whether the response is streamed, one JSON of Response per line unless ResponseType is set; with
+	// Follow, X-Stream keeps it open for the new entries
+	Stream bool
+	Follow bool
+	// Status the status of a success, 200 unless set
+	Status int
+}
+
+// adminOperations the operations of the admin API, by the name of their handler, that routes registers them with;
+// a route without one is left out of the OpenAPI document, and fails the generation of the client
+var adminOperations = map[string]AdminOperation{
+	"openAPI": {Summary: "get the OpenAPI document of the admin API", Response: map[string]interface{}{}},
+
+	"onboardList":         {Summary: "list the common names of all onboarding certificates, one per line", ResponseType: mimeTextPlain},
+	"onboardGet":          {Summary: "get a specific onboarding certificate", Response: (*OnboardCert)(nil)},
+	"onboardAdd":          {Summary: "upload a new onboarding certificate", Request: (*OnboardCert)(nil), Status: http.StatusCreated},
+	"onboardGenerate":     {Summary: "generate a new onboarding certificate and key, and register it", Request: (*OnboardGenerateRequest)(nil), Response: (*OnboardBundle)(nil), Status: http.StatusCreated},
+	"onboardClear":        {Summary: "clear all onboarding certificates"},
+	"onboardRemove":       {Summary: "delete a specific onboarding certificate"},
+	"onboardPolicyGet":    {Summary: "get the soft serials and hardware models an onboarding certificate allows, the config snapshot its devices start with, and its limits", Response: (*common.OnboardPolicy)(nil)},
+	"onboardPolicySet":    {Summary: "set the policy of an onboarding certificate", Request: (*common.OnboardPolicy)(nil)},
+	"onboardPolicyRemove": {Summary: "clear the policy of an onboarding certificate, allowing any soft serial and model"},
+	"onboardUsage":        {Summary: "get how many of the serials of an onboarding certificate devices used, by which, and how many are left, with the usage of its limits", Response: (*common.OnboardUsage)(nil)},
+
+	"deviceList":         {Summary: "list the UUIDs of all devices, one per line, or with their metadata and identity as JSON with format=json, of those deleted softly, quarantined or with tags if asked for", Query: []string{"deleted", "quarantined", "tag", "format"}, ResponseType: mimeTextPlain},
+	"deviceGet":          {Summary: "get details of one device", Response: (*DeviceCert)(nil)},
+	"deviceAdd":          {Summary: "create a new device", Request: (*DeviceCert)(nil), RequestType: mimeTextPlain, Status: http.StatusCreated},
+	"deviceClear":        {Summary: "delete all devices"},
+	"deviceRemove":       {Summary: "delete one specific device, or delete it softly, with a retention in seconds other than the default", Query: []string{"soft", "retention"}},
+	"deviceRestore":      {Summary: "restore one device deleted softly"},
+	"deviceConfigGet":    {Summary: "get config for one device, with its ETag, or the one served to it, with its hardware model merged in", Query: []string{"merged"}, Response: (*config.EdgeDevConfig)(nil)},
+	"deviceConfigSet":    {Summary: "update config for one device, once validated unless forced, and only if its ETag matches an If-Match", Query: []string{"force"}, Request: (*config.EdgeDevConfig)(nil)},
+	"deviceConfigDrift":  {Summary: "compare the config of one device with the one it last acknowledged", Response: (*ConfigDrift)(nil)},
+	"deviceLogsGet":      {Summary: "get all known logs for one device, or stream all new logs, of one source or in a range if asked for", Query: []string{"source", "after", "before", "since", "until", "first", "last", "reverse"}, Stream: true, Follow: true},
+	"deviceLogSources":   {Summary: "count the known logs of one device by source", Response: map[string]int64(nil)},
+	"deviceInfoGet":      {Summary: "get all known info messages for one device, or those in a range, or stream all new info", Query: []string{"after", "before", "since", "until", "first", "last", "reverse"}, Stream: true, Follow: true},
+	"deviceMetricsGet":   {Summary: "get all known metrics messages for one device, or those in a range, or stream all new metrics", Query: []string{"after", "before", "since", "until", "first", "last", "reverse"}, Stream: true, Follow: true},
+	"deviceRequestsGet":  {Summary: "get all known requests of one device, or stream all new requests", Stream: true, Follow: true},
+	"deviceGroupRead":    {Summary: "read new entries of one device stream as a member of a consumer group", Query: []string{"consumer", "count", "wait"}, Response: []common.StreamEntry(nil)},
+	"deviceGroupAck":     {Summary: "acknowledge entries read from a consumer group, by their IDs", Query: []string{"consumer"}, Request: []string(nil)},
+	"deviceInventoryGet": {Summary: "get the current state of one device, from its info messages", Response: (*common.Inventory)(nil)},
+	"inventorySearch":    {Summary: "find the devices whose inventory matches conditions, with the values matched", Query: []string{"where", "tag"}, Response: []InventoryMatch(nil)},
+	"deviceTwinGet":      {Summary: "get the config of one device and the state it last reported as one document, with whether each section is in sync", Response: (*common.Twin)(nil)},
+
+	"deviceQuotasGet":          {Summary: "get the quotas set for one device, and those that apply to it", Response: (*DeviceQuotas)(nil)},
+	"deviceQuotasSet":          {Summary: "set the quotas of one device, overriding the global ones", Request: (*common.Quotas)(nil)},
+	"deviceQuotasRemove":       {Summary: "clear the quotas of one device, so the global ones apply"},
+	"deviceLogFilterGet":       {Summary: "get the log filter of one device, with the entries it dropped", Response: (*DeviceLogFilter)(nil)},
+	"deviceLogFilterSet":       {Summary: "set the log filter of one device, overriding the global one", Request: (*common.LogFilter)(nil)},
+	"deviceLogFilterRemove":    {Summary: "clear the log filter of one device, so the global one applies"},
+	"deviceLocalProfileGet":    {Summary: "get the local profile server state of one device", Response: (*common.LocalProfile)(nil)},
+	"deviceLocalProfileSet":    {Summary: "set the local profile server state of one device", Request: (*common.LocalProfile)(nil)},
+	"deviceLocalProfileRemove": {Summary: "clear the local profile server state of one device, so adam no longer serves it"},
+	"deviceMetadataGet":        {Summary: "get the name, site, owner and tags of one device, with its identity from its device info", Response: (*common.DeviceMetadata)(nil)},
+	"deviceMetadataSet":        {Summary: "set the name, site, owner and tags of one device, replacing those recorded but its identity", Request: (*common.DeviceMetadata)(nil)},
+	"deviceMetadataRemove":     {Summary: "clear the name, site, owner and tags of one device"},
+	"deviceModelGet":           {Summary: "get the hardware model of one device", Response: (*DeviceModel)(nil)},
+	"deviceModelSet":           {Summary: "set the hardware model of one device, from the catalog", Request: (*DeviceModel)(nil)},
+	"deviceModelRemove":        {Summary: "clear the hardware model of one device, so it is served its config alone"},
+	"deviceFlagsGet":           {Summary: "get the flags set on one device, with the config it is held at", Response: (*common.DeviceFlags)(nil)},
+	"deviceFlagSet":            {Summary: "set a flag on one device: hold-config, read-only or verbose-debug", Response: (*common.DeviceFlags)(nil)},
+	"deviceFlagRemove":         {Summary: "clear a flag of one device", Response: (*common.DeviceFlags)(nil)},
+	"deviceQuarantineGet":      {Summary: "get whether one device is quarantined, with the reason", Response: (*DeviceQuarantine)(nil)},
+	"deviceQuarantineSet":      {Summary: "quarantine one device, serving it a minimal config until released, or change the reason", Request: (*QuarantineRequest)(nil), Response: (*DeviceQuarantine)(nil)},
+	"deviceQuarantineRemove":   {Summary: "release one device from quarantine, so it is served its own config again", Response: (*DeviceQuarantine)(nil)},
+	"deviceAttestationGet":     {Summary: "get the attestation of one device, with its certificates and the digests of the keys it escrowed", Response: (*DeviceAttestation)(nil)},
+	"deviceAttestationRemove":  {Summary: "reset the attestation of one device, removing its certificates and the keys it escrowed", Response: (*DeviceAttestation)(nil)},
+
+	"appCommandList":   {Summary: "list the commands to the app instances of one device", Response: []common.AppCommand(nil)},
+	"appCommandAdd":    {Summary: "queue a restart or purge of an app instance of one device, returning the command", Request: (*AppCommandRequest)(nil), Response: (*common.AppCommand)(nil), Status: http.StatusCreated},
+	"appCommandGet":    {Summary: "get one command to an app instance of one device", Response: (*common.AppCommand)(nil)},
+	"appCommandRemove": {Summary: "remove a queued or finished command to an app instance of one device"},
+	"deviceRebootGet":  {Summary: "get the status of the reboot of one device, with a confirmation token", Response: (*RebootStatus)(nil)},
+	"deviceReboot":     {Summary: "reboot one device, returning the status of the reboot", Request: (*RebootRequest)(nil), Response: (*RebootStatus)(nil)},
+	"deviceBaseOSGet":  {Summary: "get the status of the EVE update of one device, with a confirmation token", Response: (*BaseOSStatus)(nil)},
+	"deviceBaseOS":     {Summary: "update the EVE version of one device, returning the status of the update", Request: (*BaseOSRequest)(nil), Response: (*BaseOSStatus)(nil)},
+	"deviceUsageGet":   {Summary: "get the storage used by each kind of message of one device", Response: (*common.DeviceUsage)(nil)},
+	"deviceStatsGet":   {Summary: "get the requests of one device since the server started", Response: (*DeviceStats)(nil)},
+	"deviceReplay":     {Summary: "start replaying the stored messages of a device to a sink, returning the replay", Request: (*ReplayRequest)(nil), Response: (*Replay)(nil), Status: http.StatusAccepted},
+
+	"revocationList":   {Summary: "list revoked device and onboarding certificates", Response: []*common.Revocation(nil)},
+	"revocationCRL":    {Summary: "get a CRL of the revoked certificates issued by the device CA", ResponseType: mimePEM},
+	"revocationGet":    {Summary: "get the revocation of one certificate", Response: (*common.Revocation)(nil)},
+	"revocationAdd":    {Summary: "revoke a certificate", Request: (*RevocationRequest)(nil), Response: (*common.Revocation)(nil), Status: http.StatusCreated},
+	"revocationRemove": {Summary: "remove the revocation of a certificate, so that it is accepted again"},
+
+	"pendingList":    {Summary: "list devices waiting for approval to onboard", Response: []*common.PendingDevice(nil)},
+	"pendingGet":     {Summary: "get one device waiting for approval", Response: (*common.PendingDevice)(nil)},
+	"pendingApprove": {Summary: "approve and register one waiting device, returning its new UUID", ResponseType: mimeTextPlain, Status: http.StatusCreated},
+	"pendingReject":  {Summary: "reject one waiting device"},
+
+	"auditGet":   {Summary: "get the audit log of admin actions, of an action, actor or target, or between two times in RFC 3339", Query: []string{"action", "actor", "target", "since", "until"}, Response: (*AuditRecord)(nil), Stream: true},
+	"usageList":  {Summary: "get the storage used by every device, those using the most first", Query: []string{"kind", "limit"}, Response: []*common.DeviceUsage(nil)},
+	"statsList":  {Summary: "get the requests of every device and to every endpoint of the device API since the server started", Response: (*Stats)(nil)},
+	"gcGet":      {Summary: "list data left behind without a matching device or onboarding certificate", Response: []common.Orphan(nil)},
+	"gcRun":      {Summary: "remove data left behind without a matching device or onboarding certificate", Response: []common.Orphan(nil)},
+	"archiveRun": {Summary: "archive the entries of device streams older than the archive-after of the database URL now", Response: []common.Archived(nil)},
+
+	"tokenList":   {Summary: "list admin API tokens, without their secrets", Response: []*common.APIToken(nil)},
+	"tokenAdd":    {Summary: "create an admin API token, returning it", Request: (*TokenRequest)(nil), Response: (*TokenResponse)(nil), Status: http.StatusCreated},
+	"tokenRemove": {Summary: "remove an admin API token"},
+
+	"rolloutList":   {Summary: "list config rollouts, with their progress", Response: []*common.Rollout(nil)},
+	"rolloutCreate": {Summary: "create a config rollout, applying its first wave", Request: (*RolloutRequest)(nil), Response: (*common.Rollout)(nil), Status: http.StatusCreated},
+	"rolloutGet":    {Summary: "get one config rollout, with the progress on each device", Response: (*common.Rollout)(nil)},
+	"rolloutPause":  {Summary: "pause a running config rollout", Response: (*common.Rollout)(nil)},
+	"rolloutResume": {Summary: "resume a paused config rollout", Response: (*common.Rollout)(nil)},
+	"rolloutRemove": {Summary: "remove a config rollout, stopping it"},
+	"canaryList":    {Summary: "list config canaries, with their state", Response: []*common.Canary(nil)},
+	"canaryCreate":  {Summary: "create a config canary, applying its change to the canary devices", Request: (*CanaryRequest)(nil), Response: (*common.Canary)(nil), Status: http.StatusCreated},
+	"canaryGet":     {Summary: "get one config canary, with the state of each canary device", Response: (*common.Canary)(nil)},
+	"canaryRevert":  {Summary: "revert a config canary, setting the previous config back on its devices", Response: (*common.Canary)(nil)},
+	"canaryPromote": {Summary: "roll the change of a config canary that passed out to devices, as a config rollout, returning the rollout", Request: (*RolloutRequest)(nil), Response: (*common.Rollout)(nil), Status: http.StatusCreated},
+	"canaryRemove":  {Summary: "remove a config canary"},
+
+	"scheduleList":   {Summary: "list pending scheduled config changes, or all of them", Query: []string{"all"}, Response: []*common.ScheduledChange(nil)},
+	"scheduleAdd":    {Summary: "schedule a config change, returning it", Request: (*ScheduleRequest)(nil), Response: (*common.ScheduledChange)(nil), Status: http.StatusCreated},
+	"scheduleGet":    {Summary: "get one scheduled config change, with the outcome on each device once applied", Response: (*common.ScheduledChange)(nil)},
+	"scheduleRemove": {Summary: "remove a scheduled config change, cancelling it if pending"},
+
+	"alertList":       {Summary: "list firing alerts", Response: []Alert(nil)},
+	"alertRuleList":   {Summary: "list alert rules", Response: []*common.AlertRule(nil)},
+	"alertRuleAdd":    {Summary: "add an alert rule, returning it", Request: (*common.AlertRule)(nil), Response: (*common.AlertRule)(nil), Status: http.StatusCreated},
+	"alertRuleGet":    {Summary: "get one alert rule", Response: (*common.AlertRule)(nil)},
+	"alertRuleRemove": {Summary: "remove an alert rule"},
+
+	"snapshotList":        {Summary: "list config snapshots", Response: []*common.ConfigSnapshot(nil)},
+	"snapshotCapture":     {Summary: "capture the config of a device as a snapshot, returning it", Request: (*SnapshotRequest)(nil), Response: (*common.ConfigSnapshot)(nil), Status: http.StatusCreated},
+	"snapshotGet":         {Summary: "get one config snapshot", Response: (*common.ConfigSnapshot)(nil)},
+	"snapshotApply":       {Summary: "apply a config snapshot to devices, as a config rollout, returning the rollout", Request: (*RolloutRequest)(nil), Response: (*common.Rollout)(nil), Status: http.StatusCreated},
+	"snapshotRemove":      {Summary: "remove a config snapshot"},
+	"hardwareModelList":   {Summary: "list the catalog of hardware models", Response: []*common.HardwareModel(nil)},
+	"hardwareModelGet":    {Summary: "get one hardware model", Response: (*common.HardwareModel)(nil)},
+	"hardwareModelSet":    {Summary: "add a hardware model, or replace the one of the same name, returning it", Request: (*HardwareModelRequest)(nil), Response: (*common.HardwareModel)(nil)},
+	"hardwareModelRemove": {Summary: "remove a hardware model no device has"},
+	"datastoreList":       {Summary: "list the datastores of the catalog", Response: []*common.Datastore(nil)},
+	"datastoreGet":        {Summary: "get one datastore", Response: (*common.Datastore)(nil)},
+	"datastoreSet":        {Summary: "add a datastore, or replace the one of the same name keeping its UUID, returning it", Request: (*DatastoreRequest)(nil), Response: (*common.Datastore)(nil)},
+	"datastoreRemove":     {Summary: "remove a datastore no image is in"},
+	"imageList":           {Summary: "list the images of the catalog", Response: []*common.Image(nil)},
+	"imageGet":            {Summary: "get one image", Response: (*common.Image)(nil)},
+	"imageSet":            {Summary: "add an image, or replace the one of the same name keeping its UUID, returning it", Request: (*ImageRequest)(nil), Response: (*common.Image)(nil)},
+	"imageRemove":         {Summary: "remove an image"},
+
+	"replayList":       {Summary: "list the replays since the server started", Response: []*Replay(nil)},
+	"replayGet":        {Summary: "get one replay, with how many messages it sent", Response: (*Replay)(nil)},
+	"replayCancel":     {Summary: "cancel a running replay, or forget a finished one"},
+	"deadLetterList":   {Summary: "list the messages of devices that could not be parsed, without their payloads, of one device if asked for", Query: []string{"device"}, Response: []*common.DeadLetter(nil)},
+	"deadLetterGet":    {Summary: "get one dead letter, with its payload and certificate", Response: (*common.DeadLetter)(nil)},
+	"deadLetterReplay": {Summary: "send a dead letter again to the endpoint it was sent to, removing it if it is stored this time"},
+	"deadLetterRemove": {Summary: "remove a dead letter"},
+
+	"metrics":         {Summary: "counters of the server in the Prometheus text format", ResponseType: mimePrometheus},
+	"logLevelsGet":    {Summary: "get the log levels of the modules of the server", Response: (*LogLevels)(nil)},
+	"logLevelsSet":    {Summary: "change the log levels of the modules of the server, returning them", Request: (*LogLevelsRequest)(nil), Response: (*LogLevels)(nil)},
+	"backpressureGet": {Summary: "whether the backpressure config items are served to devices, with the load of ingest at the last check", Response: (*BackpressureStatus)(nil)},
+	"faultList":       {Summary: "list the fault injection rules, with how many faults each injected", Response: []FaultRule(nil)},
+	"faultAdd":        {Summary: "add a fault injection rule, returning it", Request: (*FaultRule)(nil), Response: (*FaultRule)(nil), Status: http.StatusCreated},
+	"faultRemove":     {Summary: "remove a fault injection rule"},
+
+	"federationSync":      {Summary: "get the onboarding certificates and devices, with the config each is served, for a secondary to sync", Response: (*FederationSync)(nil)},
+	"federationTelemetry": {Summary: "store the telemetry of devices forwarded by a secondary", Request: (*FederationTelemetry)(nil), Response: (*FederationResult)(nil)},
+	"federationStatus":    {Summary: "get the state of the sync of this secondary from its primary", Response: (*FederationStatus)(nil)},
+	"certsExport":         {Summary: "export all onboarding and device certificates, with their serials, as a tar.gz", ResponseType: mimeGzip, Stream: true},
+	"certsImport":         {Summary: "import an export of onboarding and device certificates", RequestType: mimeGzip, Response: (*CertsImportResult)(nil)},
+	"stateExport":         {Summary: "a snapshot of the whole state of the server as a tar.gz, with the telemetry of devices if asked for", Query: []string{"telemetry"}, ResponseType: mimeGzip, Stream: true},
+	"stateImport":         {Summary: "restore a state snapshot, returning its manifest, replacing the state there is if asked for", Query: []string{"replace"}, RequestType: mimeGzip, Response: (*driver.StateManifest)(nil)},
+	"deviceMetricsExport": {Summary: "export the metrics of one device in a time range as CSV, or Parquet if asked for, a column per metric", Query: []string{"format", "from", "to"}, ResponseType: mimeCSV, Stream: true},
+
+	"grafanaHealth":         {Summary: "check that the Grafana JSON datasource answers"},
+	"grafanaMetrics":        {Summary: "list the metrics the Grafana JSON datasource can query", Response: []GrafanaMetric(nil)},
+	"grafanaPayloadOptions": {Summary: "list the devices a query of the Grafana JSON datasource can select", Request: (*GrafanaOptionsRequest)(nil), Response: []GrafanaOption(nil)},
+	"grafanaVariable":       {Summary: "list the devices, or those with tags, as the values of a Grafana variable", Request: (*GrafanaVariableRequest)(nil), Response: []GrafanaVariable(nil)},
+	"grafanaQuery":          {Summary: "get the series of metrics of devices in a time range, as the Grafana JSON datasource queries them", Request: (*GrafanaQuery)(nil), Response: []GrafanaSeries(nil)},
+}
+
+// pathParam a parameter of a route, with the pattern it must match if any
+var pathParam = regexp.MustCompile(`\{(\w+)(?::([^}]*))?\}`)
+
+// AdminOperations the operations of the admin API, with all its optional routes. An error if a route has no operation
+func AdminOperations() ([]AdminOperation, error) {
+	r := mux.NewRouter()
+	h := &adminHandler{backpressure: &backpressure{}, faults: &faultInjector{}, federation: &federation{}}
+	h.routes(r.PathPrefix("/admin").Subrouter())
+	ops, missing, err := walkOperations(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("routes without an operation: %s", strings.Join(missing, ", "))
+	}
+	return ops, nil
+}
+
+// walkOperations the operations of the routes of a router, in the order they are registered, and the routes
+// without one
+func walkOperations(r *mux.Router) ([]AdminOperation, []string, error) {
+	var (
+		ops     []AdminOperation
+		missing []string
+	)
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		handler := route.GetHandler()
+		if handler == nil {
+			return nil
+		}
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		name := handlerName(handler)
+		op, ok := adminOperations[name]
+		if !ok {
+			missing = append(missing, fmt.Sprintf("%s %s (%s)", strings.Join(methods, ","), tpl, name))
+			return nil
+		}
+		op.ID = name
+		op.Path = pathParam.ReplaceAllStringFunc(tpl, func(p string) string {
+			m := pathParam.FindStringSubmatch(p)
+			op.Params = append(op.Params, m[1])
+			if m[2] != "" {
+				if op.Enums == nil {
+					op.Enums = map[string][]string{}
+				}
+				op.Enums[m[1]] = strings.Split(m[2], "|")
+			}
+			return "{" + m[1] + "}"
+		})
+		if op.Status == 0 {
+			op.Status = http.StatusOK
+		}
+		for _, method := range methods {
+			op.Method = method
+			ops = append(ops, op)
+		}
+		return nil
+	})
+	return ops, missing, err
+}
+
+// handlerName the name of the method of the adminHandler a route is handled by
+func handlerName(handler http.Handler) string {
+	name := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+	name = strings.TrimSuffix(name, "-fm")
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// openAPISpec the OpenAPI document of operations of the admin API, as JSON
+func openAPISpec(ops []AdminOperation) ([]byte, error) {
+	s := &openAPISchemas{components: map[string]interface{}{}, names: map[reflect.Type]string{}}
+	errorRef := s.schema(reflect.TypeOf(ErrorResponse{}))
+	paths := map[string]map[string]interface{}{}
+	for _, op := range ops {
+		var params []interface{}
+		for _, p := range op.Params {
+			schema := map[string]interface{}{"type": "string"}
+			if enum, ok := op.Enums[p]; ok {
+				schema["enum"] = enum
+			}
+			params = append(params, map[string]interface{}{"name": p, "in": "path", "required": true, "schema": schema})
+		}
+		for _, q := range op.Query {
+			params = append(params, map[string]interface{}{"name": q, "in": "query", "schema": map[string]interface{}{"type": "string"}})
+		}
+		if op.Follow {
+			params = append(params, map[string]interface{}{
+				"name": StreamHeader, "in": "header", "description": "set to " + StreamValue + " to stream the new entries instead",
+				"schema": map[string]interface{}{"type": "string", "enum": []string{StreamValue}},
+			})
+		}
+		success := map[string]interface{}{"description": http.StatusText(op.Status)}
+		if content := s.content(op.Response, op.ResponseType, op.Stream); content != nil {
+			success["content"] = content
+			if op.Stream && op.ResponseType == "" {
+				success["description"] = "one JSON per line"
+			}
+		}
+		o := map[string]interface{}{
+			"operationId": op.ID,
+			"summary":     op.Summary,
+			"responses": map[string]interface{}{
+				strconv.Itoa(op.Status): success,
+				"default": map[string]interface{}{
+					"description": "error",
+					"content":     map[string]interface{}{mimeJSON: map[string]interface{}{"schema": errorRef}},
+				},
+			},
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+		if content := s.content(op.Request, op.RequestType, false); content != nil {
+			o["requestBody"] = map[string]interface{}{"required": true, "content": content}
+		}
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]interface{}{}
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = o
+	}
+	return json.MarshalIndent(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Adam admin API",
+			"description": "Manage the onboarding certificates, devices and configs of a running Adam server",
+			"version":     openAPIVersion,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": s.components,
+			"securitySchemes": map[string]interface{}{
+				"token": map[string]interface{}{"type": "http", "scheme": "bearer", "description": "an admin API token, unless a client certificate signed by an admin CA is used"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"token": []string{}}, map[string]interface{}{}},
+	}, "", "  ")
+}
+
+// openAPISchemas the schemas of the Go types of the bodies of the admin API, with those of the named structs in
+// components
+type openAPISchemas struct {
+	components map[string]interface{}
+	names      map[reflect.Type]string
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	protoType      = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	jsonType       = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textType       = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// content the content of a body, of a value of its type, or not JSON, of a MIME type; nil if it has none
+func (s *openAPISchemas) content(v interface{}, mime string, stream bool) map[string]interface{} {
+	var schema map[string]interface{}
+	switch {
+	case v != nil:
+		schema = s.schema(reflect.TypeOf(v))
+	case mime != "":
+		schema = map[string]interface{}{"type": "string", "format": "binary"}
+		if strings.HasPrefix(mime, "text/") || mime == mimePEM {
+			schema = map[string]interface{}{"type": "string"}
+		}
+	case stream:
+		schema = map[string]interface{}{}
+	default:
+		return nil
+	}
+	if mime == "" {
+		mime = mimeJSON
+	}
+	return map[string]interface{}{mime: map[string]interface{}{"schema": schema}}
+}
+
+// schema the schema of the JSON of a Go type, a reference to that in components of a named struct
+func (s *openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return map[string]interface{}{"type": "integer", "format": "int64", "description": "nanoseconds"}
+	case reflect.PtrTo(t).Implements(protoType):
+		m := reflect.New(t).Interface().(proto.Message)
+		return map[string]interface{}{"type": "object", "description": fmt.Sprintf("%s, as protobuf JSON", m.ProtoReflect().Descriptor().FullName())}
+	case t.Implements(jsonType) || reflect.PtrTo(t).Implements(jsonType):
+		return map[string]interface{}{}
+	case t.Implements(textType) || reflect.PtrTo(t).Implements(textType):
+		return map[string]interface{}{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name, ok := s.names[t]
+		if !ok {
+			name = s.componentName(t)
+			// named before its fields, for the types referring to themselves
+			s.names[t] = name
+			s.components[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// componentName the name in components of a named struct, qualified by its package if another has its name
+func (s *openAPISchemas) componentName(t reflect.Type) string {
+	taken := map[string]bool{}
+	for _, n := range s.names {
+		taken[n] = true
+	}
+	name := t.Name()
+	if taken[name] {
+		pkg := t.String()[:strings.Index(t.String(), ".")]
+		name = strings.Title(pkg) + name
+	}
+	return name
+}
+
+// object the schema of a struct, with the fields of those it embeds
+func (s *openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	s.fields(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (s *openAPISchemas) fields(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		ft := f.Type
+		if f.Anonymous && name == "" {
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				s.fields(ft, props)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = s.schema(f.Type)
+	}
+}
+
+// openAPI serve the OpenAPI document of the admin API, of the routes the server has
+func (h *adminHandler) openAPI(w http.ResponseWriter, r *http.Request) {
+	if h.openapi == nil {
+		httpError(w, "no OpenAPI document", http.StatusNotFound)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(h.openapi)
+}
+
+// describeRoutes build the OpenAPI document of the routes of the admin API, logging those without an operation
+func (h *adminHandler) describeRoutes(ad *mux.Router) {
+	ops, missing, err := walkOperations(ad)
+	if err != nil {
+		log.Printf("error walking admin routes: %v", err)
+		return
+	}
+	for _, m := range missing {
+		log.Printf("admin route %s has no operation, left out of the OpenAPI document", m)
+	}
+	if h.openapi, err = openAPISpec(ops); err != nil {
+		log.Printf("error building the OpenAPI document: %v", err)
+	}
+}
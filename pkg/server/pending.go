@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// OnboardApproval rules for devices that onboard while approval is required. Devices matching none of the
+// patterns wait in the pending queue for an admin
+type OnboardApproval struct {
+	// Serials patterns, as in path.Match, of the serials to approve automatically
+	Serials []string
+	// CNs patterns, as in path.Match, of the common names of the onboarding certificates to approve automatically
+	CNs []string
+}
+
+// autoApproved check if a device onboarding with a serial and onboarding certificate is approved without an admin
+func (a *OnboardApproval) autoApproved(serial, cn string) bool {
+	for _, p := range a.Serials {
+		if ok, _ := path.Match(p, serial); ok {
+			return true
+		}
+	}
+	for _, p := range a.CNs {
+		if ok, _ := path.Match(p, cn); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// addPending put a device that passed the onboarding checks in the pending queue, or count another attempt
+// if it is already there
+func (h *apiHandler) addPending(w http.ResponseWriter, r *http.Request, cert, onboard *x509.Certificate, serial string) {
+	p := common.NewPendingDevice(cert, onboard, serial)
+	p.ClientIP = r.RemoteAddr
+	if old, err := common.PendingGet(h.managerFor(r), p.ID); err == nil {
+		p.FirstSeen = old.FirstSeen
+		p.Attempts = old.Attempts + 1
+	}
+	if err := common.PendingAdd(h.managerFor(r), p); err != nil {
+		log.Printf("error adding pending device: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("device %s with serial %s onboarded with %s, pending approval", p.ID, serial, p.OnboardCN)
+	// EVE retries until it gets a 201, by when an admin may have approved it
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *adminHandler) pendingList(w http.ResponseWriter, r *http.Request) {
+	pending, err := common.PendingList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing pending devices: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(pending)
+	if err != nil {
+		log.Printf("error converting pending devices to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (h *adminHandler) pendingGet(w http.ResponseWriter, r *http.Request) {
+	p, err := common.PendingGet(h.managerFor(r), mux.Vars(r)["id"])
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting pending device: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("error converting pending device to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// pendingApprove register a pending device, issuing its UUID and config. The onboarding certificate and serial
+// are checked again, as they may have changed while the device was waiting
+func (h *adminHandler) pendingApprove(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	p, err := common.PendingGet(h.managerFor(r), id)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting pending device: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	cert, onboard, err := p.Certificates()
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad certificates of pending device: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := h.managerFor(r).OnboardCheck(onboard, p.Serial); err != nil {
+		httpError(w, fmt.Sprintf("pending device no longer valid to onboard: %v", err), http.StatusConflict)
+		return
+	}
+	h.limits.registerLock.Lock()
+	defer h.limits.registerLock.Unlock()
+	if err := h.limits.checkDevices(h.managerFor(r), onboard); err != nil {
+		registerFailed(w, err)
+		return
+	}
+	unew, err := uuid.NewV4()
+	if err != nil {
+		log.Printf("error generating a new device UUID: %v", err)
+		httpError(w, fmt.Sprintf("error generating a new device UUID: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := h.managerFor(r).DeviceRegister(unew, cert, onboard, p.Serial, initialConfig(h.managerFor(r), unew, onboard, h.baseConfig)); err != nil {
+		log.Printf("error registering approved device: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := common.PendingRemove(h.managerFor(r), id); err != nil {
+		log.Printf("error removing approved device %s from pending: %v", id, err)
+	}
+	h.audit(r, auditPendingApprove, unew.String(), map[string]interface{}{"pending": id}, deviceSummary(cert, onboard, p.Serial))
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(unew.String()))
+}
+
+// pendingReject remove a pending device. If it tries to onboard again, it is back in the queue
+func (h *adminHandler) pendingReject(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var before interface{}
+	if p, err := common.PendingGet(h.managerFor(r), id); err == nil {
+		before = map[string]interface{}{"serial": p.Serial, "onboard": p.OnboardCN}
+	}
+	err := common.PendingRemove(h.managerFor(r), id)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case err != nil:
+		log.Printf("error removing pending device: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		h.audit(r, auditPendingReject, id, before, nil)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// policyRead the operations of a rule allowing all those that only read, with GET, or the Grafana datasource
+const policyRead = "read"
+
+// AccessPolicy which admin operations the identities of admin requests may call, on which devices. An identity no
+// rule matches keeps the access its token or certificate gives it; one that some match is limited to what they allow
+type AccessPolicy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule what the identities of a rule may call
+type PolicyRule struct {
+	Name string `json:"name,omitempty"`
+	// Identities who the rule applies to, as in the audit log: cert:<common name> for a client certificate,
+	// token:<id> for an API token, socket or anonymous, where * matches any characters, e.g. cert:support-*
+	Identities []string `json:"identities"`
+	// Operations the operations allowed, by their operationId in the OpenAPI document, e.g. deviceConfigGet, where *
+	// matches any characters, read for all those with GET, or * for all
+	Operations []string `json:"operations"`
+	// Devices UUIDs of the devices the rule is limited to; with Tags, a device of either is allowed
+	Devices []string `json:"devices,omitempty"`
+	// Tags tag filters of the devices the rule is limited to, as for listing devices, a device matching all of them
+	Tags []string `json:"tags,omitempty"`
+}
+
+// parseAccessPolicy parse an access policy, in YAML or JSON, and check that its rules are valid
+func parseAccessPolicy(b []byte) (*AccessPolicy, error) {
+	// YAML is converted to JSON, of which it is a superset, so that both share the names of the fields
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+	j, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	var p AccessPolicy
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("%d", i)
+		}
+		if len(rule.Identities) == 0 {
+			return nil, fmt.Errorf("rule %s has no identities", name)
+		}
+		if len(rule.Operations) == 0 {
+			return nil, fmt.Errorf("rule %s has no operations", name)
+		}
+		for _, pattern := range append(append([]string{}, rule.Identities...), rule.Operations...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %s has a bad pattern %q: %v", name, pattern, err)
+			}
+		}
+		for _, op := range rule.Operations {
+			if _, ok := adminOperations[op]; !ok && op != policyRead && !strings.Contains(op, "*") {
+				return nil, fmt.Errorf("rule %s has an unknown operation %s", name, op)
+			}
+		}
+		for k, d := range rule.Devices {
+			u, err := uuid.FromString(d)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s has a bad device UUID %s: %v", name, d, err)
+			}
+			rule.Devices[k] = u.String()
+		}
+	}
+	return &p, nil
+}
+
+// matchesIdentity whether the rule applies to an identity
+func (p *PolicyRule) matchesIdentity(identity string) bool {
+	for _, pattern := range p.Identities {
+		if ok, _ := path.Match(pattern, identity); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsOperation whether the rule allows an operation, by the name of its handler, and whether the request only reads
+func (p *PolicyRule) allowsOperation(op string, read bool) bool {
+	for _, pattern := range p.Operations {
+		if pattern == policyRead {
+			if read {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, op); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// scoped whether the rule is limited to some devices
+func (p *PolicyRule) scoped() bool {
+	return len(p.Devices) > 0 || len(p.Tags) > 0
+}
+
+// policyStore the access policy enforced, replaced when reloaded
+type policyStore struct {
+	mu     sync.RWMutex
+	path   string
+	policy *AccessPolicy
+}
+
+// loadAccessPolicy load the access policy of a path
+func loadAccessPolicy(p string) (*policyStore, error) {
+	s := &policyStore{path: p}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load read the policy file again, keeping the current policy if it is not valid
+func (s *policyStore) load() error {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("error reading access policy %s: %v", s.path, err)
+	}
+	policy, err := parseAccessPolicy(b)
+	if err != nil {
+		return fmt.Errorf("error loading access policy %s: %v", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = policy
+	return nil
+}
+
+// reload load the policy file again, logging failures
+func (s *policyStore) reload() {
+	if err := s.load(); err != nil {
+		log.Printf("keeping the current access policy: %v", err)
+		return
+	}
+	log.Printf("reloaded access policy %s", s.path)
+}
+
+// rules the rules that apply to an identity
+func (s *policyStore) rules(identity string) []PolicyRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var rules []PolicyRule
+	for _, rule := range s.policy.Rules {
+		if rule.matchesIdentity(identity) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// policyKey key of the rules limiting the devices of a request, in its context
+type policyKey struct{}
+
+// requestPolicy the rules whose devices a request is limited to, nil if it is not
+func requestPolicy(r *http.Request) []PolicyRule {
+	rules, _ := r.Context().Value(policyKey{}).([]PolicyRule)
+	return rules
+}
+
+// enforcePolicy check that the access policy allows an admin request, if any rule applies to who made it. It runs
+// after authenticate, which identifies the token. Listing and searching devices with rules limited to devices only
+// return theirs
+func (h *adminHandler) enforcePolicy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.policy == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		identity := auditActor(r)
+		rules := h.policy.rules(identity)
+		if len(rules) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			httpError(w, fmt.Sprintf("access policy does not allow %s", identity), http.StatusForbidden)
+			return
+		}
+		op := handlerName(route.GetHandler())
+		var allowed []PolicyRule
+		for _, rule := range rules {
+			if rule.allowsOperation(op, isRead(r)) {
+				allowed = append(allowed, rule)
+			}
+		}
+		if len(allowed) == 0 {
+			log.Printf("access policy rejected %s %s by %s", r.Method, r.URL.Path, identity)
+			httpError(w, fmt.Sprintf("access policy does not allow %s to %s", identity, op), http.StatusForbidden)
+			return
+		}
+		for _, rule := range allowed {
+			if !rule.scoped() {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if u, ok := mux.Vars(r)["uuid"]; ok {
+			uid, err := uuid.FromString(u)
+			if err == nil && h.policyAllows(r, allowed, uid) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			log.Printf("access policy rejected %s %s by %s", r.Method, r.URL.Path, identity)
+			httpError(w, fmt.Sprintf("access policy does not allow %s device %s", identity, u), http.StatusForbidden)
+			return
+		}
+		if tpl, err := route.GetPathTemplate(); err == nil && ((tpl == "/admin/device" || tpl == "/admin/inventory") && r.Method == http.MethodGet || strings.HasPrefix(tpl, grafanaPath)) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), policyKey{}, allowed)))
+			return
+		}
+		httpError(w, fmt.Sprintf("access policy limits %s to devices", identity), http.StatusForbidden)
+	})
+}
+
+// policyAllows whether any of the rules allows a device
+func (h *adminHandler) policyAllows(r *http.Request, rules []PolicyRule, u uuid.UUID) bool {
+	for _, rule := range rules {
+		for _, d := range rule.Devices {
+			if d == u.String() {
+				return true
+			}
+		}
+		if len(rule.Tags) > 0 && h.matchTags(r, u, rule.Tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsDevice whether the API token and the access policy of a request allow a device, for the devices listed
+func (h *adminHandler) allowsDevice(r *http.Request, u uuid.UUID) bool {
+	if token := requestToken(r); token != nil && !token.AllowsDevice(u.String()) {
+		return false
+	}
+	if rules := requestPolicy(r); rules != nil && !h.policyAllows(r, rules, u) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field numbers of the messages of the EVE local profile server API, in api/proto/profile of EVE. The API is not
+// in the EVE API module adam builds with, so its few fields are encoded by hand
+const (
+	// LocalProfile
+	lpLocalProfile = 1
+	lpServerToken  = 2
+	// RadioStatus
+	rsRadioSilence = 1
+	rsConfigError  = 2
+	// RadioConfig
+	rcServerToken  = 1
+	rcRadioSilence = 2
+)
+
+// maxProfileBody limit of the size of the body of a request to the local profile server, and of a local profile set
+// through the admin API: radio statuses, app infos and local profiles are small, and the server is plain HTTP
+const maxProfileBody = 64 * 1024
+
+// profileHandler serves the local profile server API to devices, over plain HTTP as EVE expects of a server on its
+// network. The requests do not say which device they come from, so each device has its own path, /{uuid}, that its
+// config points it to, and authenticates with the server token of its local profile, as a bearer token
+type profileHandler struct {
+	manager driver.DeviceManager
+}
+
+// localProfile the local profile state of the device of a request, nil with a 404 if it has none, or a 401 if the
+// request does not carry its server token, as the Authorization bearer token
+func (h *profileHandler) localProfile(w http.ResponseWriter, r *http.Request) (uuid.UUID, *common.LocalProfile) {
+	u, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return u, nil
+	}
+	lp, err := h.managerFor(r).GetLocalProfile(u)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && !isNotFound:
+		log.Printf("error getting local profile of %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return u, nil
+	case lp == nil:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return u, nil
+	case !profileTokenValid(r, lp.Token):
+		log.Printf("rejected local profile request of %s from %s: no valid server token", u, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="adam"`)
+		httpError(w, "server token required", http.StatusUnauthorized)
+		return u, nil
+	}
+	return u, lp
+}
+
+// profileTokenValid whether a request carries the server token of a local profile as its bearer token
+func profileTokenValid(r *http.Request, token string) bool {
+	header := r.Header.Get(authorizationHeader)
+	if token == "" || len(header) < len(bearerScheme) || !strings.EqualFold(header[:len(bearerScheme)], bearerScheme) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(header[len(bearerScheme):])), []byte(token)) == 1
+}
+
+// readProfileBody the body of a request to the local profile server, or of a local profile set, answered 413
+// Request Entity Too Large past maxProfileBody. nil if the request was answered
+func readProfileBody(w http.ResponseWriter, r *http.Request) []byte {
+	if r.ContentLength > maxProfileBody {
+		bodyTooLarge(w, r, maxProfileBody)
+		return nil
+	}
+	b, err := ioutil.ReadAll(&limitedBody{r: r.Body, remaining: maxProfileBody})
+	switch {
+	case err == errBodyTooLarge:
+		bodyTooLarge(w, r, maxProfileBody)
+		return nil
+	case err != nil:
+		log.Printf("error reading request body: %v", err)
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil
+	}
+	return b
+}
+
+// profile the local profile of the device, 404 if it is to use the global one of its config
+func (h *profileHandler) profile(w http.ResponseWriter, r *http.Request) {
+	_, lp := h.localProfile(w, r)
+	if lp == nil {
+		return
+	}
+	if lp.Profile == "" {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	var b []byte
+	b = protowire.AppendTag(b, lpLocalProfile, protowire.BytesType)
+	b = protowire.AppendString(b, lp.Profile)
+	b = protowire.AppendTag(b, lpServerToken, protowire.BytesType)
+	b = protowire.AppendString(b, lp.Token)
+	w.Header().Set(contentType, mimeProto)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// radio record the status of the radios of the device, and send back whether they are to be silenced
+func (h *profileHandler) radio(w http.ResponseWriter, r *http.Request) {
+	u, lp := h.localProfile(w, r)
+	if lp == nil {
+		return
+	}
+	b := readProfileBody(w, r)
+	if b == nil {
+		return
+	}
+	status, err := parseRadioStatus(b)
+	if err != nil {
+		log.Printf("Failed to parse radio status: %v", err)
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status.Time = time.Now()
+	lp.Radio = status
+	if err := h.managerFor(r).SetLocalProfile(u, lp); err != nil {
+		log.Printf("error saving radio status of %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var out []byte
+	out = protowire.AppendTag(out, rcServerToken, protowire.BytesType)
+	out = protowire.AppendString(out, lp.Token)
+	out = protowire.AppendTag(out, rcRadioSilence, protowire.VarintType)
+	out = protowire.AppendVarint(out, protowire.EncodeBool(lp.RadioSilence))
+	w.Header().Set(contentType, mimeProto)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// appInfo accept the info of the apps of the device. There are no app commands to send back
+func (h *profileHandler) appInfo(w http.ResponseWriter, r *http.Request) {
+	if _, lp := h.localProfile(w, r); lp == nil {
+		return
+	}
+	if b := readProfileBody(w, r); b == nil {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseRadioStatus the fields of a RadioStatus adam keeps, skipping the status of the cellular modems
+func parseRadioStatus(b []byte) (*common.RadioStatus, error) {
+	status := &common.RadioStatus{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("bad radio status: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch {
+		case num == rsRadioSilence && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("bad radio silence: %v", protowire.ParseError(n))
+			}
+			status.Silence = protowire.DecodeBool(v)
+			b = b[n:]
+		case num == rsConfigError && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return nil, fmt.Errorf("bad config error: %v", protowire.ParseError(n))
+			}
+			status.ConfigError = v
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("bad radio status field %d: %v", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return status, nil
+}
+
+// serveLocalProfiles serve the local profile server API until done is closed
+func serveLocalProfiles(server *http.Server, done <-chan struct{}) {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		log.Fatalf("local profile server: %v", err)
+	case <-done:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down local profile server: %v", err)
+	}
+}
+
+func (h *adminHandler) deviceLocalProfileGet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lp, err := h.managerFor(r).GetLocalProfile(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting local profile of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	case lp == nil:
+		httpError(w, "no local profile", http.StatusNotFound)
+		return
+	}
+	body, err := json.Marshal(lp)
+	if err != nil {
+		log.Printf("error converting local profile to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (h *adminHandler) deviceLocalProfileSet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	body := readProfileBody(w, r)
+	if body == nil {
+		return
+	}
+	var lp common.LocalProfile
+	if err := json.Unmarshal(body, &lp); err != nil {
+		httpError(w, fmt.Sprintf("bad local profile: %v", err), http.StatusBadRequest)
+		return
+	}
+	if lp.Token == "" {
+		httpError(w, "bad local profile: the token is required, as devices ignore a server without one", http.StatusBadRequest)
+		return
+	}
+	h.setDeviceLocalProfile(w, r, uid, &lp)
+}
+
+func (h *adminHandler) deviceLocalProfileRemove(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	h.setDeviceLocalProfile(w, r, uid, nil)
+}
+
+func (h *adminHandler) setDeviceLocalProfile(w http.ResponseWriter, r *http.Request, uid uuid.UUID, lp *common.LocalProfile) {
+	// keep the audit record free of typed nils, that would show as null
+	var before, after interface{}
+	if old, err := h.managerFor(r).GetLocalProfile(uid); err == nil && old != nil {
+		before = old
+		// the radio status is reported by the device, not set
+		if lp != nil {
+			lp.Radio = old.Radio
+		}
+	}
+	if lp != nil {
+		after = lp
+	}
+	err := h.managerFor(r).SetLocalProfile(uid, lp)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case err != nil:
+		log.Printf("error setting local profile of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		h.audit(r, auditProfileSet, uid.String(), before, after)
+		w.WriteHeader(http.StatusOK)
+	}
+}
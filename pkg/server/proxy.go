@@ -0,0 +1,258 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	forwardedForHeader   = "X-Forwarded-For"
+	forwardedProtoHeader = "X-Forwarded-Proto"
+	forwardedHostHeader  = "X-Forwarded-Host"
+)
+
+// trustedProxies the networks of the reverse proxies whose X-Forwarded-* headers are believed
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parse the networks of trusted proxies, as CIDRs or single IP addresses
+func parseTrustedProxies(cidrs []string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %s: not an IP address or CIDR", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %v", c, err)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+// trusts whether an address, with or without a port, is that of a trusted proxy
+func (p trustedProxies) trusts(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range p {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr the address of the client a request was forwarded for: the last address in X-Forwarded-For that is not
+// a trusted proxy, as those before it could be made up by the client. The remote address if it is not a trusted proxy
+func (p trustedProxies) clientAddr(r *http.Request) string {
+	if !p.trusts(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+	var hops []string
+	for _, h := range r.Header.Values(forwardedForHeader) {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	client := r.RemoteAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		client = hop
+		if !p.trusts(hop) {
+			break
+		}
+	}
+	return client
+}
+
+// forwarded apply the X-Forwarded-* headers of requests from trusted proxies, so that handlers see the address of
+// the client in RemoteAddr, and the scheme and host it used in URL and Host
+func (p trustedProxies) forwarded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(p) == 0 || !p.trusts(r.RemoteAddr) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(r.Context())
+		u := *r.URL
+		r.URL = &u
+		r.RemoteAddr = p.clientAddr(r)
+		switch proto := strings.ToLower(strings.TrimSpace(r.Header.Get(forwardedProtoHeader))); proto {
+		case "http", "https":
+			r.URL.Scheme = proto
+		}
+		if host := strings.TrimSpace(r.Header.Get(forwardedHostHeader)); host != "" {
+			r.Host = host
+			r.URL.Host = host
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminFront put the handling of trusted proxies and CORS in front of the admin API of a router, leaving the other
+// requests, e.g. those of devices, as they are
+func adminFront(router http.Handler, proxies trustedProxies, cors *corsPolicy) http.Handler {
+	admin := proxies.forwarded(router)
+	if cors != nil {
+		admin = cors.handle(admin)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/") {
+			admin.ServeHTTP(w, r)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+// certProxies the TLS-terminating proxies in front of the device API, e.g. nginx or HAProxy, that pass the client
+// certificate of each device in a header
+type certProxies struct {
+	// header the header with the client certificate, e.g. X-SSL-Client-Cert
+	header string
+	// proxies the networks the proxies connect from
+	proxies trustedProxies
+	// cas the CAs one of which must have signed the client certificate of the proxies, nil if they need none
+	cas *x509.CertPool
+}
+
+// verifyProxy check that a request from the network of the proxies comes from one with a client certificate signed
+// by one of the CAs of the proxies, if they have any
+func (p *certProxies) verifyProxy(r *http.Request) error {
+	if p.cas == nil {
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return fmt.Errorf("proxy %s sent no client certificate", r.RemoteAddr)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	cert := r.TLS.PeerCertificates[0]
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         p.cas,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("client certificate %s of proxy %s not valid: %v", cert.Subject.CommonName, r.RemoteAddr, err)
+	}
+	return nil
+}
+
+// passCert replace the client certificate of the requests of the proxies with the one in the header, so that the
+// handlers see the device certificate the proxy was sent, as if the device had connected to Adam. A request of the
+// proxies without the header has no client certificate. Requests from elsewhere keep their own, the header ignored, so
+// that a device cannot claim the certificate of another
+func (p *certProxies) passCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p == nil || !p.proxies.trusts(r.RemoteAddr) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := p.verifyProxy(r); err != nil {
+			log.Printf("refusing device request: %v", err)
+			writeError(w, http.StatusUnauthorized, ErrUntrustedProxy, "proxy not trusted to pass client certificates", nil)
+			return
+		}
+		state := tls.ConnectionState{HandshakeComplete: true}
+		if r.TLS != nil {
+			state = *r.TLS
+		}
+		state.PeerCertificates, state.VerifiedChains = nil, nil
+		if v := r.Header.Get(p.header); v != "" {
+			cert, err := parseHeaderCert(v)
+			if err != nil {
+				log.Printf("bad client certificate in %s from proxy %s: %v", p.header, r.RemoteAddr, err)
+				httpError(w, fmt.Sprintf("bad client certificate in %s: %v", p.header, err), http.StatusBadRequest)
+				return
+			}
+			state.PeerCertificates = []*x509.Certificate{cert}
+		}
+		r = r.WithContext(r.Context())
+		r.TLS = &state
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedFor the X-Forwarded-For header of a request from one of the proxies; empty for the requests from elsewhere,
+// as devices could make it up
+func (p *certProxies) forwardedFor(r *http.Request) string {
+	if p == nil || !p.proxies.trusts(r.RemoteAddr) {
+		return ""
+	}
+	return r.Header.Get(forwardedForHeader)
+}
+
+// parseHeaderCert parse a client certificate passed in a header: PEM, URL-encoded as nginx $ssl_client_escaped_cert
+// or not, or base64 DER as HAProxy ssl_c_der or Traefik send it, the first of a comma-separated chain
+func parseHeaderCert(v string) (*x509.Certificate, error) {
+	v = strings.TrimSpace(v)
+	if strings.Contains(v, "%") {
+		unescaped, err := url.PathUnescape(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad URL encoding: %v", err)
+		}
+		v = unescaped
+	}
+	if strings.HasPrefix(v, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(v))
+		if block == nil {
+			return nil, fmt.Errorf("bad PEM")
+		}
+		return x509.ParseCertificate(block.Bytes)
+	}
+	v = strings.TrimSpace(strings.Split(v, ",")[0])
+	der, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("neither PEM nor base64 DER: %v", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// serveCertProxies serve the plain HTTP requests of the proxies until done is closed
+func serveCertProxies(server *http.Server, done <-chan struct{}) {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		log.Fatalf("device API for proxies: %v", err)
+	case <-done:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down device API for proxies: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// QuarantineRequest a request to quarantine a device
+type QuarantineRequest struct {
+	// Reason why the device is quarantined, required
+	Reason string `json:"reason"`
+}
+
+// DeviceQuarantine whether a device is quarantined, with its quarantine if it is
+type DeviceQuarantine struct {
+	Quarantined bool               `json:"quarantined"`
+	Quarantine  *common.Quarantine `json:"quarantine,omitempty"`
+}
+
+func (h *adminHandler) deviceQuarantineGet(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q, err := h.managerFor(r).GetQuarantine(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting quarantine of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.writeDeviceQuarantine(w, q)
+}
+
+// deviceQuarantineSet quarantine a device, or change the reason of its quarantine if it is quarantined already
+func (h *adminHandler) deviceQuarantineSet(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req QuarantineRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad quarantine: %v", err), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		httpError(w, "bad quarantine: a reason is required", http.StatusBadRequest)
+		return
+	}
+	m := h.managerFor(r)
+	before, err := m.GetQuarantine(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting quarantine of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	q := &common.Quarantine{Reason: req.Reason, Since: time.Now().UTC(), Actor: auditActor(r)}
+	if before != nil {
+		// a quarantine under way keeps when it started and the config the device had
+		q.Since, q.Version = before.Since, before.Version
+	} else {
+		conf, _, err := ownConfig(m, uid)
+		if err != nil {
+			log.Printf("error getting the config of %s to quarantine: %v", uid, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		q.Version = conf.GetId().GetVersion()
+	}
+	if err := m.SetQuarantine(uid, q); err != nil {
+		log.Printf("error quarantining %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// keep the audit record free of typed nils, that would show as null
+	var old interface{}
+	if before != nil {
+		old = before
+	}
+	h.audit(r, auditQuarantine, uid.String(), old, q)
+	log.Printf("device %s quarantined: %s", uid, q.Reason)
+	h.writeDeviceQuarantine(w, q)
+}
+
+// deviceQuarantineRemove release a device from its quarantine, so that it is served its own config again
+func (h *adminHandler) deviceQuarantineRemove(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	m := h.managerFor(r)
+	before, err := m.GetQuarantine(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting quarantine of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	case before == nil:
+		h.writeDeviceQuarantine(w, nil)
+		return
+	}
+	if err := m.SetQuarantine(uid, nil); err != nil {
+		log.Printf("error releasing %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditRelease, uid.String(), before, nil)
+	log.Printf("device %s released from quarantine", uid)
+	h.writeDeviceQuarantine(w, nil)
+}
+
+func (h *adminHandler) writeDeviceQuarantine(w http.ResponseWriter, q *common.Quarantine) {
+	body, err := json.Marshal(DeviceQuarantine{Quarantined: q != nil, Quarantine: q})
+	if err != nil {
+		log.Printf("error converting quarantine to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// DeviceQuotas quotas of a device, as set for it and as applied after merging with the global ones
+type DeviceQuotas struct {
+	// Device quotas set for this device, nil if it uses the global ones
+	Device *common.Quotas `json:"device"`
+	// Effective quotas that apply to the device
+	Effective common.Quotas `json:"effective"`
+}
+
+func (h *adminHandler) deviceQuotasGet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q, err := h.managerFor(r).GetDeviceQuotas(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		httpError(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	body, err := json.Marshal(DeviceQuotas{Device: q, Effective: h.quotas.Override(q)})
+	if err != nil {
+		log.Printf("error converting quotas to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (h *adminHandler) deviceQuotasSet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var q common.Quotas
+	if err := json.Unmarshal(body, &q); err != nil {
+		httpError(w, fmt.Sprintf("bad quotas: %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, l := range []common.Limits{q.MaxLen, q.MaxBytes} {
+		if err := l.Validate(); err != nil {
+			httpError(w, fmt.Sprintf("bad quotas: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	h.setDeviceQuotas(w, r, uid, &q)
+}
+
+func (h *adminHandler) deviceQuotasRemove(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, "bad UUID", http.StatusBadRequest)
+		return
+	}
+	h.setDeviceQuotas(w, r, uid, nil)
+}
+
+func (h *adminHandler) setDeviceQuotas(w http.ResponseWriter, r *http.Request, uid uuid.UUID, q *common.Quotas) {
+	// keep the audit record free of typed nils, that would show as null
+	var before, after interface{}
+	if old, err := h.managerFor(r).GetDeviceQuotas(uid); err == nil && old != nil {
+		before = old
+	}
+	if q != nil {
+		after = q
+	}
+	err := h.managerFor(r).SetDeviceQuotas(uid, q)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case err != nil:
+		log.Printf("error setting quotas of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		h.audit(r, auditQuotaSet, uid.String(), before, after)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	ax "github.com/lf-edge/adam/pkg/x509"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// rekeyNonceSize the size of the nonces devices sign with the key of the certificate they rotate to
+	rekeyNonceSize = 32
+	// rekeyNonceTTL how long a device has to rotate its certificate with the nonce it was given
+	rekeyNonceTTL = 5 * time.Minute
+	// rekeySignatureHeader header of the signature of the nonce of a device with the key of its new certificate,
+	// base64-encoded
+	rekeySignatureHeader = "X-Rekey-Signature"
+)
+
+// rekeyNonce a nonce given to a device, until when it can rotate its certificate with it
+type rekeyNonce struct {
+	nonce   []byte
+	expires time.Time
+}
+
+// rekeyNonces the nonces given to devices to prove they hold the key of the certificate they rotate to, kept in
+// memory until used or expired. A device has at most one, the last it asked for
+type rekeyNonces struct {
+	mu     sync.Mutex
+	nonces map[uuid.UUID]rekeyNonce
+}
+
+func newRekeyNonces() *rekeyNonces {
+	return &rekeyNonces{nonces: map[uuid.UUID]rekeyNonce{}}
+}
+
+// issue give a device a new nonce, replacing any it was given before, and forgetting those expired
+func (n *rekeyNonces) issue(u uuid.UUID, now time.Time) ([]byte, error) {
+	nonce := make([]byte, rekeyNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for k, v := range n.nonces {
+		if now.After(v.expires) {
+			delete(n.nonces, k)
+		}
+	}
+	n.nonces[u] = rekeyNonce{nonce: nonce, expires: now.Add(rekeyNonceTTL)}
+	return nonce, nil
+}
+
+// take the nonce of a device, used up either way; nil if it has none, or it expired
+func (n *rekeyNonces) take(u uuid.UUID, now time.Time) []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	v, ok := n.nonces[u]
+	delete(n.nonces, u)
+	if !ok || now.After(v.expires) {
+		return nil
+	}
+	return v.nonce
+}
+
+// rekeyNonce give a device the nonce to sign with the key of the certificate it rotates to
+func (h *apiHandler) rekeyNonce(w http.ResponseWriter, r *http.Request) {
+	u := h.checkCertAndRecord(w, r)
+	if u == nil {
+		return
+	}
+	nonce, err := h.rekeyNonces.issue(*u, time.Now())
+	if err != nil {
+		log.Printf("error generating rekey nonce: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeOctetStream)
+	w.WriteHeader(http.StatusOK)
+	w.Write(nonce)
+}
+
+// rekeyProven whether a device proved it holds the key of the certificate it rotates to, signing the nonce it was
+// given with it. Answers the request and returns false if it did not
+func (h *apiHandler) rekeyProven(w http.ResponseWriter, r *http.Request, u uuid.UUID, cert *x509.Certificate) bool {
+	nonce := h.rekeyNonces.take(u, time.Now())
+	if nonce == nil {
+		writeError(w, http.StatusUnauthorized, ErrInvalidProof, "no rekey nonce, or it expired: GET one first", nil)
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Header.Get(rekeySignatureHeader))
+	if err != nil || len(sig) == 0 {
+		writeError(w, http.StatusUnauthorized, ErrInvalidProof, fmt.Sprintf("the signature of the rekey nonce is required, base64-encoded in %s", rekeySignatureHeader), nil)
+		return false
+	}
+	if err := ax.VerifySignature(nonce, sig, cert); err != nil {
+		log.Printf("invalid rekey signature from %s: %v", u, err)
+		writeError(w, http.StatusUnauthorized, ErrInvalidProof, fmt.Sprintf("the rekey nonce is not signed by the key of the new certificate: %v", err), nil)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certStore the server certificate being served, replaced when reloaded. Connections already open keep the one
+// they were made with
+type certStore struct {
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	chain []*x509.Certificate
+}
+
+// set replace the certificate served
+func (c *certStore) set(cert tls.Certificate) error {
+	var chain []*x509.Certificate
+	for _, b := range cert.Certificate {
+		parsed, err := x509.ParseCertificate(b)
+		if err != nil {
+			return fmt.Errorf("unable to parse server certificate: %v", err)
+		}
+		chain = append(chain, parsed)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.chain = chain
+	return nil
+}
+
+// getCertificate the certificate for a new connection, as in tls.Config
+func (c *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// certificates the chain of the certificate served
+func (c *certStore) certificates() []*x509.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.chain
+}
+
+// reloadOnHangup reload the server certificate and key on each SIGHUP, with those of listeners having their own and
+// the device CA bundles and the access policy, if any, until done is closed. With ACME, the one kept in the device
+// manager is reloaded, renewing it if due
+func (s *Server) reloadOnHangup(certs *certStore, listeners map[*certStore]Listener, cas *deviceCAs, policy *policyStore, done <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			if s.ACME != nil {
+				s.ACME.reload(certs)
+			} else {
+				s.reloadCertificate(certs, s.CertPath, s.KeyPath)
+			}
+			for c, l := range listeners {
+				s.reloadCertificate(c, l.CertPath, l.KeyPath)
+			}
+			cas.reload()
+			if policy != nil {
+				policy.reload()
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// reloadCertificate load a server certificate and key again, keeping the current ones if they cannot be loaded
+func (s *Server) reloadCertificate(certs *certStore, certPath, keyPath string) {
+	cert, err := s.loadCertificatePair(certPath, keyPath)
+	if err == nil {
+		err = certs.set(cert)
+	}
+	if err != nil {
+		log.Printf("keeping the current server certificate %s, unable to reload it: %v", certPath, err)
+		return
+	}
+	leaf := certs.certificates()[0]
+	log.Printf("reloaded server certificate %s, valid until %s", leaf.Subject.CommonName, leaf.NotAfter.UTC().Format(time.RFC3339))
+}
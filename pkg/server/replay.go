@@ -0,0 +1,579 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// sinks replays send the stored messages of devices to
+const (
+	// SinkWebhook POST batches of entries, as a JSON array
+	SinkWebhook = "webhook"
+	// SinkMQTT publish each entry to an MQTT topic
+	SinkMQTT = "mqtt"
+	// SinkKafka produce batches of entries to a Kafka topic through a Kafka REST proxy, e.g. Confluent's, with its v2
+	// API
+	SinkKafka = "kafka"
+)
+
+// states of a replay
+const (
+	ReplayRunning   = "running"
+	ReplayDone      = "done"
+	ReplayFailed    = "failed"
+	ReplayCancelled = "cancelled"
+)
+
+const (
+	// replayBatchSize how many entries are sent at once to a webhook or Kafka
+	replayBatchSize = 500
+	// replayRetries how many times a batch is sent again before the replay fails
+	replayRetries = 5
+	// maxRunningReplays how many replays can run at once
+	maxRunningReplays = 4
+	// maxReplays how many replays are kept, finished ones being forgotten from the oldest past it
+	maxReplays = 100
+	// mimeKafkaJSON content type of the records of the Kafka REST proxy v2 API, with JSON values
+	mimeKafkaJSON = "application/vnd.kafka.json.v2+json"
+)
+
+// replayKinds kinds of messages that can be replayed
+var replayKinds = []string{common.KindLogs, common.KindInfo, common.KindMetrics}
+
+// ReplaySink where a replay sends the entries to
+type ReplaySink struct {
+	// Type one of webhook, mqtt and kafka
+	Type string `json:"type"`
+	// URL of the webhook, of the MQTT broker, as mqtt://[user:password@]host[:port], or mqtts:// for TLS, or of the
+	// Kafka REST proxy
+	URL string `json:"url"`
+	// Topic MQTT or Kafka topic to send to
+	Topic string `json:"topic,omitempty"`
+}
+
+// ReplayRequest a replay of the stored messages of a device to start
+type ReplayRequest struct {
+	// Kinds the kinds of messages to replay, of logs, info and metrics; all of them if empty
+	Kinds []string `json:"kinds,omitempty"`
+	// Since and Until the range of time of the messages to replay, per their timestamps, both included; the whole
+	// history if not set
+	Since *time.Time `json:"since,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+	Sink  ReplaySink `json:"sink"`
+}
+
+// Replay a replay of the stored messages of a device, running in the background, kept in memory until the server
+// stops
+type Replay struct {
+	ID     string `json:"id"`
+	Device string `json:"device"`
+	ReplayRequest
+	State    string     `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Sent entries sent, per kind of message
+	Sent map[string]int64 `json:"sent"`
+	// Skipped entries out of the range of time, or without a timestamp when there is one
+	Skipped int64 `json:"skipped"`
+	// Error why the replay failed
+	Error string `json:"error,omitempty"`
+}
+
+// ReplayEntry an entry as a replay sends it
+type ReplayEntry struct {
+	Device string          `json:"device"`
+	Kind   string          `json:"kind"`
+	Entry  json.RawMessage `json:"entry"`
+}
+
+// Validate check that a replay request is complete and consistent, setting all the kinds if there are none
+func (r *ReplayRequest) Validate() error {
+	if len(r.Kinds) == 0 {
+		r.Kinds = replayKinds
+	}
+	for _, k := range r.Kinds {
+		if !containsKind(replayKinds, k) {
+			return fmt.Errorf("unknown kind %q, must be one of %s", k, strings.Join(replayKinds, ", "))
+		}
+	}
+	if r.Since != nil && r.Until != nil && r.Until.Before(*r.Since) {
+		return fmt.Errorf("until %s is before since %s", r.Until.Format(time.RFC3339), r.Since.Format(time.RFC3339))
+	}
+	s := r.Sink
+	u, err := url.Parse(s.URL)
+	switch s.Type {
+	case SinkWebhook, SinkKafka:
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("bad %s URL %q, must be http or https", s.Type, s.URL)
+		}
+		if s.Type == SinkKafka && (s.Topic == "" || strings.Contains(s.Topic, "/")) {
+			return fmt.Errorf("bad Kafka topic %q, must be set and without /", s.Topic)
+		}
+	case SinkMQTT:
+		if err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Host == "" {
+			return fmt.Errorf("bad MQTT URL %q, must be mqtt://host[:port] or mqtts://host[:port]", s.URL)
+		}
+		if s.Topic == "" || strings.ContainsAny(s.Topic, "+#") {
+			return fmt.Errorf("bad MQTT topic %q, must be set and without wildcards", s.Topic)
+		}
+	default:
+		return fmt.Errorf("unknown sink type %q, must be one of webhook, mqtt and kafka", s.Type)
+	}
+	return nil
+}
+
+func containsKind(kinds []string, kind string) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// replayer the replays started since the server started, in memory
+type replayer struct {
+	lock    sync.Mutex
+	replays map[string]*replayJob
+	client  *http.Client
+}
+
+// replayJob a replay and how to cancel it
+type replayJob struct {
+	replay Replay
+	cancel chan struct{}
+}
+
+func newReplayer() *replayer {
+	return &replayer{
+		replays: map[string]*replayJob{},
+		client:  &http.Client{Timeout: egressPushTimeout},
+	}
+}
+
+// start start a replay of the messages of a device, unless maxRunningReplays are running already
+func (p *replayer) start(m driver.DeviceManager, u uuid.UUID, req ReplayRequest, done <-chan struct{}) (*Replay, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, fmt.Errorf("error generating replay ID: %v", err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	running := 0
+	for _, j := range p.replays {
+		if j.replay.State == ReplayRunning {
+			running++
+		}
+	}
+	if running >= maxRunningReplays {
+		return nil, nil
+	}
+	j := &replayJob{
+		replay: Replay{
+			ID:            id.String(),
+			Device:        u.String(),
+			ReplayRequest: req,
+			State:         ReplayRunning,
+			Started:       time.Now().UTC(),
+			Sent:          map[string]int64{},
+		},
+		cancel: make(chan struct{}),
+	}
+	p.replays[j.replay.ID] = j
+	p.forget()
+	go p.run(m, u, j, done)
+	r := p.copy(j)
+	return &r, nil
+}
+
+// forget forget the replays finished the longest ago past maxReplays
+func (p *replayer) forget() {
+	var finished []*replayJob
+	for _, j := range p.replays {
+		if j.replay.Finished != nil {
+			finished = append(finished, j)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].replay.Finished.Before(*finished[j].replay.Finished) })
+	excess := len(p.replays) - maxReplays
+	for i := 0; i < excess && i < len(finished); i++ {
+		delete(p.replays, finished[i].replay.ID)
+	}
+}
+
+// run send the entries of each kind of a replay, one kind after the other, until they are all sent, sending a
+// batch fails replayRetries times, or it is cancelled or the server shuts down
+func (p *replayer) run(m driver.DeviceManager, u uuid.UUID, j *replayJob, done <-chan struct{}) {
+	state, err := ReplayDone, p.send(m, u, j, done)
+	switch {
+	case err == errReplayCancelled:
+		state, err = ReplayCancelled, nil
+	case err != nil:
+		state = ReplayFailed
+		log.Printf("replay %s of %s to %s failed: %v", j.replay.ID, u, j.replay.Sink.Type, err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now().UTC()
+	j.replay.State, j.replay.Finished = state, &now
+	if err != nil {
+		j.replay.Error = err.Error()
+	}
+}
+
+// errReplayCancelled a replay stopped as it was cancelled, or the server shut down
+var errReplayCancelled = fmt.Errorf("replay cancelled")
+
+func (p *replayer) send(m driver.DeviceManager, u uuid.UUID, j *replayJob, done <-chan struct{}) error {
+	sink := j.replay.Sink
+	var mqtt *mqttConn
+	if sink.Type == SinkMQTT {
+		var err error
+		if mqtt, err = dialMQTT(sink.URL, egressPushTimeout); err != nil {
+			return err
+		}
+		defer mqtt.close()
+	}
+	for _, kind := range j.replay.Kinds {
+		var reader io.Reader
+		var err error
+		switch kind {
+		case common.KindLogs:
+			reader, err = m.GetLogsReader(u)
+		case common.KindInfo:
+			reader, err = m.GetInfoReader(u)
+		case common.KindMetrics:
+			reader, err = m.GetMetricsReader(u)
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", kind, err)
+		}
+		if reader == nil {
+			continue
+		}
+		err = p.sendKind(u, j, kind, reader, mqtt, done)
+		if c, ok := reader.(io.Closer); ok {
+			c.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendKind send the entries of a kind, read from reader, in batches
+func (p *replayer) sendKind(u uuid.UUID, j *replayJob, kind string, reader io.Reader, mqtt *mqttConn, done <-chan struct{}) error {
+	since, until := j.replay.Since, j.replay.Until
+	batch := make([]ReplayEntry, 0, replayBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := p.sendBatch(j, batch, mqtt, done); err != nil {
+			return err
+		}
+		p.lock.Lock()
+		j.replay.Sent[kind] += int64(len(batch))
+		p.lock.Unlock()
+		batch = batch[:0]
+		return nil
+	}
+	// entries are concatenated JSON objects, possibly separated by whitespace
+	decoder := json.NewDecoder(reader)
+	for {
+		var entry json.RawMessage
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", kind, err)
+		}
+		if since != nil || until != nil {
+			t, ok := replayEntryTime(entry)
+			if !ok || (since != nil && t.Before(*since)) || (until != nil && t.After(*until)) {
+				p.lock.Lock()
+				j.replay.Skipped++
+				p.lock.Unlock()
+				continue
+			}
+		}
+		batch = append(batch, ReplayEntry{Device: u.String(), Kind: kind, Entry: entry})
+		if len(batch) >= replayBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// replayEntryTime when an entry was made, from its timestamp: timestamp for log entries, atTimeStamp for info and
+// metrics
+func replayEntryTime(entry []byte) (time.Time, bool) {
+	var ts struct {
+		Timestamp   string `json:"timestamp"`
+		AtTimeStamp string `json:"atTimeStamp"`
+	}
+	if err := json.Unmarshal(entry, &ts); err != nil {
+		return time.Time{}, false
+	}
+	s := ts.Timestamp
+	if s == "" {
+		s = ts.AtTimeStamp
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
+
+// sendBatch send a batch of entries to the sink, again after a backoff if it fails, up to replayRetries times
+func (p *replayer) sendBatch(j *replayJob, batch []ReplayEntry, mqtt *mqttConn, done <-chan struct{}) error {
+	backoff := egressMinBackoff
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-j.cancel:
+			return errReplayCancelled
+		case <-done:
+			return errReplayCancelled
+		default:
+		}
+		err := p.sendOnce(j.replay.Sink, batch, mqtt)
+		if err == nil {
+			return nil
+		}
+		// an MQTT connection that failed is not used again, so the replay fails at once
+		if mqtt != nil || attempt >= replayRetries {
+			return err
+		}
+		log.Printf("error sending batch of replay %s, retrying in %v: %v", j.replay.ID, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-j.cancel:
+			return errReplayCancelled
+		case <-done:
+			return errReplayCancelled
+		}
+		if backoff *= 2; backoff > egressMaxBackoff {
+			backoff = egressMaxBackoff
+		}
+	}
+}
+
+func (p *replayer) sendOnce(sink ReplaySink, batch []ReplayEntry, mqtt *mqttConn) error {
+	switch sink.Type {
+	case SinkMQTT:
+		for _, e := range batch {
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := mqtt.publish(sink.Topic, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	case SinkKafka:
+		type record struct {
+			Key   string      `json:"key"`
+			Value ReplayEntry `json:"value"`
+		}
+		records := make([]record, len(batch))
+		for i, e := range batch {
+			records[i] = record{Key: e.Device, Value: e}
+		}
+		b, err := json.Marshal(map[string]interface{}{"records": records})
+		if err != nil {
+			return err
+		}
+		return p.post(strings.TrimSuffix(sink.URL, "/")+path.Join("/topics", url.PathEscape(sink.Topic)), mimeKafkaJSON, b)
+	default:
+		b, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		return p.post(sink.URL, mimeJSON, b)
+	}
+}
+
+func (p *replayer) post(u, ct string, b []byte) error {
+	res, err := p.client.Post(u, ct, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", u, res.Status)
+	}
+	return nil
+}
+
+// cancel stop a running replay, or forget a finished one. false if there is none with the ID
+func (p *replayer) cancel(id string) (*Replay, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	j, ok := p.replays[id]
+	if !ok {
+		return nil, false
+	}
+	if j.replay.State == ReplayRunning {
+		select {
+		case <-j.cancel:
+		default:
+			close(j.cancel)
+		}
+	} else {
+		delete(p.replays, id)
+	}
+	r := p.copy(j)
+	return &r, true
+}
+
+// get a replay by ID
+func (p *replayer) get(id string) (*Replay, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	j, ok := p.replays[id]
+	if !ok {
+		return nil, false
+	}
+	r := p.copy(j)
+	return &r, true
+}
+
+// list the replays, from the oldest started
+func (p *replayer) list() []*Replay {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	replays := make([]*Replay, 0, len(p.replays))
+	for _, j := range p.replays {
+		r := p.copy(j)
+		replays = append(replays, &r)
+	}
+	sort.Slice(replays, func(i, j int) bool { return replays[i].Started.Before(replays[j].Started) })
+	return replays
+}
+
+// copy a copy of a replay, that does not change as it runs, without the password in the URL of its sink
+func (p *replayer) copy(j *replayJob) Replay {
+	r := j.replay
+	if u, err := url.Parse(r.Sink.URL); err == nil {
+		r.Sink.URL = u.Redacted()
+	}
+	r.Sent = make(map[string]int64, len(j.replay.Sent))
+	for k, n := range j.replay.Sent {
+		r.Sent[k] = n
+	}
+	return r
+}
+
+// replaySummary summary of a replay for the audit log
+func replaySummary(r *Replay) map[string]interface{} {
+	return map[string]interface{}{"device": r.Device, "kinds": r.Kinds, "sink": r.Sink.Type, "url": r.Sink.URL, "topic": r.Sink.Topic}
+}
+
+// deviceReplay start replaying the stored messages of a device to a sink, answering 202 Accepted with the replay
+func (h *adminHandler) deviceReplay(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req ReplayRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad replay request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		httpError(w, fmt.Sprintf("bad replay request: %v", err), http.StatusBadRequest)
+		return
+	}
+	m := h.managerFor(r)
+	_, _, _, err = m.DeviceGet(&uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, fmt.Sprintf("unknown device %s", uid), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting device %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// the replay outlives the request, so it does not use its traced manager
+	replay, err := h.replays.start(h.manager, uid, req, h.done)
+	switch {
+	case err != nil:
+		log.Printf("error starting replay of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	case replay == nil:
+		httpError(w, fmt.Sprintf("%d replays are running already, try again once one is finished", maxRunningReplays), http.StatusTooManyRequests)
+		return
+	}
+	h.audit(r, auditReplayStart, replay.ID, nil, replaySummary(replay))
+	h.writeReplay(w, http.StatusAccepted, replay)
+}
+
+func (h *adminHandler) replayList(w http.ResponseWriter, r *http.Request) {
+	h.writeReplay(w, http.StatusOK, h.replays.list())
+}
+
+func (h *adminHandler) replayGet(w http.ResponseWriter, r *http.Request) {
+	replay, ok := h.replays.get(mux.Vars(r)["id"])
+	if !ok {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	h.writeReplay(w, http.StatusOK, replay)
+}
+
+// replayCancel cancel a running replay, which stops after the batch it is sending, or forget a finished one
+func (h *adminHandler) replayCancel(w http.ResponseWriter, r *http.Request) {
+	replay, ok := h.replays.cancel(mux.Vars(r)["id"])
+	if !ok {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if replay.State == ReplayRunning {
+		h.audit(r, auditReplayCancel, replay.ID, replaySummary(replay), nil)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *adminHandler) writeReplay(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting replay to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/logging"
+	uuid "github.com/satori/go.uuid"
+)
+
+// requestLogger the logger of the requests served, one message per request once answered
+var requestLogger = logging.New("http")
+
+// LogLevels the level of all modules of the server, and those of the modules with their own, e.g. server, http for
+// the requests served, or the name of a driver
+type LogLevels struct {
+	Default logging.Level            `json:"default"`
+	Modules map[string]logging.Level `json:"modules"`
+}
+
+// LogLevelsRequest a change of log levels: Default if set, and Modules, a module with an empty level logging at the
+// default level again
+type LogLevelsRequest struct {
+	Default string            `json:"default,omitempty"`
+	Modules map[string]string `json:"modules,omitempty"`
+}
+
+// requestLogKey key of the requestLog of a request, in its context
+type requestLogKey struct{}
+
+// requestLog what is learnt of a request while it is handled, for its message: the device it is from, once its cert
+// is checked, and whether the device has verbose-debug
+type requestLog struct {
+	device  *uuid.UUID
+	verbose bool
+}
+
+// setLogDevice record the device a request is from, for its message
+func setLogDevice(r *http.Request, u uuid.UUID) {
+	if rl, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		rl.device = &u
+	}
+}
+
+// setLogVerbose log a request in detail, whatever the log level, as its device has verbose-debug
+func setLogVerbose(r *http.Request) {
+	if rl, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		rl.verbose = true
+	}
+}
+
+// logRecorder a ResponseWriter keeping the status answered and the bytes written, streams still flushing
+type logRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (l *logRecorder) WriteHeader(status int) {
+	if l.status == 0 {
+		l.status = status
+	}
+	l.ResponseWriter.WriteHeader(status)
+}
+
+func (l *logRecorder) Write(b []byte) (int, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	n, err := l.ResponseWriter.Write(b)
+	l.bytes += n
+	return n, err
+}
+
+func (l *logRecorder) Flush() {
+	if f, ok := l.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (l *logRecorder) CloseNotify() <-chan bool {
+	if cn, ok := l.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// logRequests log each request once answered, with its method, path, status, latency and device, at LevelError for
+// 5xx, LevelWarn for 4xx and LevelInfo otherwise
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rl := &requestLog{}
+		rec := &logRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := logging.LevelInfo
+		switch {
+		case status >= 500:
+			level = logging.LevelError
+		case status >= 400:
+			level = logging.LevelWarn
+		}
+		fields := []interface{}{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"bytes", rec.bytes,
+			"remote", r.RemoteAddr,
+		}
+		if rl.device != nil {
+			fields = append(fields, "device", rl.device.String())
+		}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			fields = append(fields, "client", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+		requestLogger.Log(level, fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, status), fields...)
+		if rl.verbose {
+			fields = append(fields,
+				"query", r.URL.RawQuery,
+				"proto", r.Proto,
+				"request_bytes", r.ContentLength,
+				"request_headers", debugHeaders(r.Header),
+				"response_headers", debugHeaders(rec.Header()),
+			)
+			requestLogger.Always(logging.LevelDebug, fmt.Sprintf("device debug: %s %s %d", r.Method, r.URL.Path, status), fields...)
+		}
+	})
+}
+
+// currentLogLevels the log levels in effect
+func currentLogLevels() LogLevels {
+	level, levels := logging.Levels()
+	return LogLevels{Default: level, Modules: levels}
+}
+
+func (h *adminHandler) logLevelsGet(w http.ResponseWriter, r *http.Request) {
+	h.writeLogLevels(w, currentLogLevels())
+}
+
+func (h *adminHandler) logLevelsSet(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req LogLevelsRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad log levels: %v", err), http.StatusBadRequest)
+		return
+	}
+	// check all the levels before changing any
+	var level logging.Level
+	if req.Default != "" {
+		if level, err = logging.ParseLevel(req.Default); err != nil {
+			httpError(w, fmt.Sprintf("bad log levels: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	levels := map[string]logging.Level{}
+	for module, l := range req.Modules {
+		if l == "" {
+			continue
+		}
+		if levels[module], err = logging.ParseLevel(l); err != nil {
+			httpError(w, fmt.Sprintf("bad log level of %s: %v", module, err), http.StatusBadRequest)
+			return
+		}
+	}
+	before := currentLogLevels()
+	if req.Default != "" {
+		logging.SetLevel(level)
+	}
+	for module, l := range req.Modules {
+		if l == "" {
+			logging.ResetModuleLevel(module)
+		} else {
+			logging.SetModuleLevel(module, levels[module])
+		}
+	}
+	after := currentLogLevels()
+	log.Printf("log levels set to %s", logging.FormatLevels(after.Default, after.Modules))
+	h.audit(r, auditLogLevelSet, "", before, after)
+	h.writeLogLevels(w, after)
+}
+
+func (h *adminHandler) writeLogLevels(w http.ResponseWriter, levels LogLevels) {
+	body, err := json.Marshal(levels)
+	if err != nil {
+		log.Printf("error converting log levels to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// crlValidity how long a CRL is valid for, its next update, after which relying parties should get it again
+const crlValidity = 7 * 24 * time.Hour
+
+// RevocationRequest a certificate to revoke, by exactly one of its fingerprint, the device it is the certificate of,
+// or the common name of the onboarding certificate
+type RevocationRequest struct {
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Device      string `json:"device,omitempty"`
+	Onboard     string `json:"onboard,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// revoked whether a certificate a request was made with is revoked, answering it if so
+func (h *apiHandler) revoked(w http.ResponseWriter, r *http.Request, cert *x509.Certificate) bool {
+	fingerprint := common.CertFingerprint(cert)
+	rev, err := common.RevocationGet(h.managerFor(r), fingerprint)
+	if _, isNotFound := err.(*common.NotFoundError); err != nil && !isNotFound {
+		log.Printf("error checking whether certificate %s is revoked: %v", fingerprint, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return true
+	}
+	if rev == nil {
+		return false
+	}
+	log.Printf("refused revoked certificate %s of %s", fingerprint, cert.Subject.CommonName)
+	writeError(w, http.StatusForbidden, ErrCertRevoked, fmt.Sprintf("certificate %s was revoked on %s", fingerprint, rev.Revoked.Format(time.RFC3339)), map[string]interface{}{"fingerprint": fingerprint, "revoked": rev.Revoked})
+	return true
+}
+
+func (h *adminHandler) revocationList(w http.ResponseWriter, r *http.Request) {
+	list, err := common.RevocationList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing revocations: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Revoked.Before(list[j].Revoked) })
+	writeRevocation(w, http.StatusOK, list)
+}
+
+func (h *adminHandler) revocationGet(w http.ResponseWriter, r *http.Request) {
+	fingerprint, err := common.ValidateFingerprint(mux.Vars(r)["fingerprint"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rev, err := common.RevocationGet(h.managerFor(r), fingerprint)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, "certificate is not revoked", http.StatusNotFound)
+	case err != nil:
+		log.Printf("error getting revocation %s: %v", fingerprint, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		writeRevocation(w, http.StatusOK, rev)
+	}
+}
+
+// revocationAdd revoke a certificate, found by the device or onboarding certificate it is, if not by fingerprint
+// alone, so that it is listed with what it is, and with its serial number, for the CRL
+func (h *adminHandler) revocationAdd(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req RevocationRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad revocation: %v", err), http.StatusBadRequest)
+		return
+	}
+	var given int
+	for _, v := range []string{req.Fingerprint, req.Device, req.Onboard} {
+		if v != "" {
+			given++
+		}
+	}
+	if given != 1 {
+		httpError(w, "bad revocation: exactly one of fingerprint, device and onboard is required", http.StatusBadRequest)
+		return
+	}
+	var rev *common.Revocation
+	switch {
+	case req.Device != "":
+		u, err := uuid.FromString(req.Device)
+		if err != nil {
+			httpError(w, fmt.Sprintf("bad device: %v", err), http.StatusBadRequest)
+			return
+		}
+		cert, _, _, err := h.managerFor(r).DeviceGet(&u)
+		if _, isNotFound := err.(*common.NotFoundError); isNotFound || (err == nil && cert == nil) {
+			httpError(w, fmt.Sprintf("device %s not found", u), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("error getting device %s: %v", u, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		rev = common.NewRevocation(cert, common.RevokedDevice, req.Reason)
+	case req.Onboard != "":
+		cn := common.GetOnboardCertName(req.Onboard)
+		cert, _, err := h.managerFor(r).OnboardGet(cn)
+		if _, isNotFound := err.(*common.NotFoundError); isNotFound {
+			httpError(w, fmt.Sprintf("onboarding certificate %s not found", cn), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("error getting onboarding certificate %s: %v", cn, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		rev = common.NewRevocation(cert, common.RevokedOnboard, req.Reason)
+	default:
+		fingerprint, err := common.ValidateFingerprint(req.Fingerprint)
+		if err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rev = &common.Revocation{Fingerprint: fingerprint, Reason: req.Reason, Revoked: time.Now()}
+	}
+	rev.Revoked = rev.Revoked.UTC()
+	rev.Actor = auditActor(r)
+	if err := common.RevocationAdd(h.managerFor(r), rev); err != nil {
+		log.Printf("error revoking certificate %s: %v", rev.Fingerprint, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditCertRevoke, rev.Fingerprint, nil, map[string]interface{}{"kind": rev.Kind, "subject": rev.Subject, "reason": rev.Reason})
+	writeRevocation(w, http.StatusCreated, rev)
+}
+
+func (h *adminHandler) revocationRemove(w http.ResponseWriter, r *http.Request) {
+	fingerprint, err := common.ValidateFingerprint(mux.Vars(r)["fingerprint"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var before interface{}
+	if rev, err := common.RevocationGet(h.managerFor(r), fingerprint); err == nil {
+		before = map[string]interface{}{"kind": rev.Kind, "subject": rev.Subject, "reason": rev.Reason}
+	}
+	err = common.RevocationRemove(h.managerFor(r), fingerprint)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, "certificate is not revoked", http.StatusNotFound)
+	case err != nil:
+		log.Printf("error removing revocation %s: %v", fingerprint, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		h.audit(r, auditCertUnrevoke, fingerprint, before, nil)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// revocationCRL the revoked certificates issued by the DeviceCA, as a PEM CRL signed by it. Others, e.g. self-signed
+// device certificates, have no issuer to sign a CRL for them, so are only refused by the server
+func (h *adminHandler) revocationCRL(w http.ResponseWriter, r *http.Request) {
+	if h.issuer == nil {
+		httpError(w, "no device CA to sign a CRL with", http.StatusNotFound)
+		return
+	}
+	ca := h.issuer.ca
+	if ca.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		httpError(w, "device CA certificate lacks the cRLSign key usage, so cannot sign a CRL", http.StatusConflict)
+		return
+	}
+	list, err := common.RevocationList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing revocations: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var revoked []pkix.RevokedCertificate
+	for _, rev := range list {
+		if rev.SerialNumber == "" || rev.Issuer != ca.Subject.CommonName {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(rev.SerialNumber, 16)
+		if !ok {
+			continue
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: rev.Revoked})
+	}
+	sort.Slice(revoked, func(i, j int) bool { return revoked[i].RevocationTime.Before(revoked[j].RevocationTime) })
+	now := time.Now().UTC()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificates: revoked,
+		// increasing with each CRL issued, as required
+		Number:     big.NewInt(now.UnixNano()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(crlValidity),
+	}, ca, h.issuer.signer)
+	if err != nil {
+		log.Printf("error creating CRL: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimePEM)
+	w.WriteHeader(http.StatusOK)
+	w.Write(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}))
+}
+
+func writeRevocation(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting revocation to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,487 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/eve/api/go/config"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// DefaultRolloutInterval how often running rollouts are advanced, unless set otherwise
+	DefaultRolloutInterval = 10 * time.Second
+	// defaults for the rollouts created without them
+	defaultRolloutWaveSize    = 10
+	defaultRolloutWaveTimeout = 600
+)
+
+// RolloutRequest a config rollout to create. The devices are those in Devices and those with a serial matching one
+// of Serials, or every device if both are empty
+type RolloutRequest struct {
+	Name string `json:"name,omitempty"`
+	// Devices UUIDs of devices to roll the change out to
+	Devices []string `json:"devices,omitempty"`
+	// Serials patterns, as for path.Match, of the serials of devices to roll the change out to
+	Serials []string `json:"serials,omitempty"`
+	// Patch JSON merge patch to apply to the config of each device, exclusive with Template
+	Patch json.RawMessage `json:"patch,omitempty"`
+	// Template config to set on each device, exclusive with Patch
+	Template json.RawMessage `json:"template,omitempty"`
+	// WaveSize percentage of the devices in each wave; 0 means 10
+	WaveSize int `json:"wave-size,omitempty"`
+	// WaveTimeout seconds each device has to acknowledge the change; 0 means 600
+	WaveTimeout int `json:"wave-timeout,omitempty"`
+	// MaxFailures number of devices that can fail before the rollout halts
+	MaxFailures int `json:"max-failures,omitempty"`
+}
+
+// rolloutSummary summary of a rollout for the audit log, without the change and the progress of each device
+func rolloutSummary(ro *common.Rollout) map[string]interface{} {
+	return map[string]interface{}{"name": ro.Name, "state": ro.State, "devices": len(ro.Devices), "failures": ro.Failures()}
+}
+
+// changeAttempts how many times a change is applied to the config of a device that keeps changing in between, e.g. by
+// an operator, before it fails
+const changeAttempts = 3
+
+// applyChange apply a change, either a patch or a template, to the config of a device on behalf of actor, returning the
+// hash of the new config as served. The version is bumped unless the change sets a new one, and invalid configs are not
+// stored. A config that changed since it was read is not overwritten, the change being applied to the new one instead
+func applyChange(m driver.DeviceManager, patch, template json.RawMessage, actor, u string) (string, error) {
+	for attempt := 1; ; attempt++ {
+		hash, err := applyChangeOnce(m, patch, template, actor, u)
+		if _, conflict := err.(*common.ConfigConflictError); !conflict || attempt == changeAttempts {
+			return hash, err
+		}
+	}
+}
+
+// applyChangeOnce apply a change to the config of a device as read, failing with a *common.ConfigConflictError if it
+// changed before the new one is stored
+func applyChangeOnce(m driver.DeviceManager, patch, template json.RawMessage, actor, u string) (string, error) {
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		return "", fmt.Errorf("bad UUID %s: %v", u, err)
+	}
+	if err := checkWritable(m, uid); err != nil {
+		return "", err
+	}
+	existingB, err := m.GetConfig(uid)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving existing config: %v", err)
+	}
+	var existing config.EdgeDevConfig
+	if err := protojson.Unmarshal(existingB, &existing); err != nil {
+		return "", fmt.Errorf("error processing existing config: %v", err)
+	}
+	b := []byte(template)
+	if len(patch) > 0 {
+		if b, err = common.MergePatch(existingB, patch); err != nil {
+			return "", fmt.Errorf("error patching config: %v", err)
+		}
+	}
+	if b, err = common.ResolveRefs(b, m); err != nil {
+		return "", fmt.Errorf("error resolving references: %v", err)
+	}
+	var conf config.EdgeDevConfig
+	if err := protojson.Unmarshal(b, &conf); err != nil {
+		return "", fmt.Errorf("failed to convert config to protobuf: %v", err)
+	}
+	if conf.Id == nil {
+		conf.Id = &config.UUIDandVersion{}
+	}
+	// a template is for every device, so it cannot carry their UUIDs
+	if len(template) > 0 || conf.Id.Uuid == "" {
+		conf.Id.Uuid = u
+	}
+	if conf.Id.Uuid != u {
+		return "", fmt.Errorf("mismatched UUID, setting %s for device %s", conf.Id.Uuid, u)
+	}
+	if conf.Id.Version == "" || conf.Id.Version == existing.GetId().GetVersion() {
+		version, err := strconv.Atoi(existing.GetId().GetVersion())
+		if err != nil {
+			return "", fmt.Errorf("cannot automatically non-number bump version %s", existing.GetId().GetVersion())
+		}
+		conf.Id.Version = strconv.Itoa(version + 1)
+	}
+	if problems := validateConfig(&conf); len(problems) > 0 {
+		return "", fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	b, err = protojson.Marshal(&conf)
+	if err != nil {
+		return "", fmt.Errorf("error processing device config: %v", err)
+	}
+	switch err := m.SwapConfig(uid, existingB, b).(type) {
+	case nil:
+	case *common.ConfigConflictError:
+		return "", err
+	default:
+		return "", fmt.Errorf("error saving config: %v", err)
+	}
+	writeAudit(m, AuditRecord{
+		Timestamp: time.Now(),
+		Actor:     actor,
+		Action:    auditConfigSet,
+		Target:    u,
+		Before:    configSummary(existingB),
+		After:     configSummary(b),
+	})
+	// the device acknowledges the config it is served, with its hardware model
+	mergeModel(m, uid, &conf)
+	return configHash(&conf), nil
+}
+
+// acknowledged whether a device acknowledged a change, by requesting its config reporting the hash of the new one
+func acknowledged(m driver.DeviceManager, u, hash string) (bool, error) {
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		return false, fmt.Errorf("bad UUID %s: %v", u, err)
+	}
+	ack, err := m.GetConfigAck(uid)
+	// a device removed since can never acknowledge, so it fails once it times out
+	if _, isNotFound := err.(*common.NotFoundError); isNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return ack != nil && ack.Hash == hash, nil
+}
+
+// advanceRollout advance a rollout, saving its progress
+func advanceRollout(m driver.DeviceManager, ro *common.Rollout, now time.Time) error {
+	ack := func(u, hash string) (bool, error) {
+		return acknowledged(m, u, hash)
+	}
+	apply := func(u string) (string, error) {
+		return applyChange(m, ro.Patch, ro.Template, "rollout:"+ro.ID, u)
+	}
+	changed, err := ro.Advance(now, ack, apply)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	switch ro.State {
+	case common.RolloutHalted:
+		log.Printf("rollout %s halted: %s", ro.ID, ro.Reason)
+	case common.RolloutCompleted:
+		log.Printf("rollout %s completed, %d devices failed", ro.ID, ro.Failures())
+	}
+	return common.RolloutSet(m, ro)
+}
+
+// advanceRollouts advance the running rollouts every interval, until done is closed
+func (h *adminHandler) advanceRollouts(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		h.rolloutLock.Lock()
+		rollouts, err := common.RolloutList(h.manager)
+		if err != nil {
+			log.Printf("error listing rollouts: %v", err)
+		}
+		for _, ro := range rollouts {
+			if ro.State != common.RolloutRunning {
+				continue
+			}
+			if err := advanceRollout(h.manager, ro, time.Now()); err != nil {
+				log.Printf("error advancing rollout %s: %v", ro.ID, err)
+			}
+		}
+		h.rolloutLock.Unlock()
+	}
+}
+
+// selectDevices the sorted UUIDs of the devices given, and of those with a serial matching one of the patterns, or of
+// every device if there are neither
+func selectDevices(m driver.DeviceManager, devices, serials []string) ([]string, error) {
+	selected := map[string]bool{}
+	for _, d := range devices {
+		u, err := uuid.FromString(d)
+		if err != nil {
+			return nil, fmt.Errorf("bad device UUID %s: %v", d, err)
+		}
+		if _, _, _, err := m.DeviceGet(&u); err != nil {
+			return nil, fmt.Errorf("unknown device %s: %v", d, err)
+		}
+		selected[u.String()] = true
+	}
+	if len(serials) > 0 || len(devices) == 0 {
+		for _, pattern := range serials {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("bad serial pattern %s: %v", pattern, err)
+			}
+		}
+		uids, err := m.DeviceList()
+		if err != nil {
+			return nil, fmt.Errorf("error listing devices: %v", err)
+		}
+		for _, u := range uids {
+			if u == nil {
+				continue
+			}
+			matches := len(serials) == 0
+			if !matches {
+				_, _, serial, err := m.DeviceGet(u)
+				if err != nil {
+					return nil, fmt.Errorf("error getting device %s: %v", u, err)
+				}
+				for _, pattern := range serials {
+					if ok, _ := path.Match(pattern, serial); ok {
+						matches = true
+						break
+					}
+				}
+			}
+			if matches {
+				selected[u.String()] = true
+			}
+		}
+	}
+	list := make([]string, 0, len(selected))
+	for u := range selected {
+		list = append(list, u)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// parseRolloutRequest read and check a rollout request, setting the defaults
+func parseRolloutRequest(c common.RecordStore, r *http.Request) (*RolloutRequest, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading request body: %v", err)
+	}
+	var req RolloutRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("bad rollout request: %v", err)
+	}
+	if err := checkRolloutRequest(c, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// checkChange check a config change is either a patch or a template, whose references are in the catalog
+func checkChange(c common.RecordStore, patch, template json.RawMessage) error {
+	switch {
+	case (len(patch) == 0) == (len(template) == 0):
+		return fmt.Errorf("a change needs either a patch or a template")
+	case len(patch) > 0:
+		var p map[string]interface{}
+		if err := json.Unmarshal(patch, &p); err != nil {
+			return fmt.Errorf("patch is not a JSON object: %v", err)
+		}
+		if _, err := common.ResolveRefs(patch, c); err != nil {
+			return fmt.Errorf("invalid patch: %v", err)
+		}
+	default:
+		b, err := common.ResolveRefs(template, c)
+		if err != nil {
+			return fmt.Errorf("invalid template: %v", err)
+		}
+		var conf config.EdgeDevConfig
+		if err := protojson.Unmarshal(b, &conf); err != nil {
+			return fmt.Errorf("invalid template: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkRolloutRequest check the change and the waves of a rollout request, setting the defaults
+func checkRolloutRequest(c common.RecordStore, req *RolloutRequest) error {
+	if err := checkChange(c, req.Patch, req.Template); err != nil {
+		return err
+	}
+	if req.WaveSize == 0 {
+		req.WaveSize = defaultRolloutWaveSize
+	}
+	if req.WaveTimeout == 0 {
+		req.WaveTimeout = defaultRolloutWaveTimeout
+	}
+	switch {
+	case req.WaveSize < 1 || req.WaveSize > 100:
+		return fmt.Errorf("wave size %d is not a percentage between 1 and 100", req.WaveSize)
+	case req.WaveTimeout < 0:
+		return fmt.Errorf("negative wave timeout %d", req.WaveTimeout)
+	case req.MaxFailures < 0:
+		return fmt.Errorf("negative max failures %d", req.MaxFailures)
+	}
+	return nil
+}
+
+func (h *adminHandler) rolloutList(w http.ResponseWriter, r *http.Request) {
+	rollouts, err := common.RolloutList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing rollouts: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(rollouts, func(i, j int) bool { return rollouts[i].Created.Before(rollouts[j].Created) })
+	h.writeRollout(w, http.StatusOK, rollouts)
+}
+
+func (h *adminHandler) rolloutGet(w http.ResponseWriter, r *http.Request) {
+	ro, ok := h.getRollout(w, r)
+	if !ok {
+		return
+	}
+	h.writeRollout(w, http.StatusOK, ro)
+}
+
+// rolloutCreate create a rollout, applying its first wave
+func (h *adminHandler) rolloutCreate(w http.ResponseWriter, r *http.Request) {
+	req, err := parseRolloutRequest(h.managerFor(r), r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.createRollout(w, r, req)
+}
+
+// createRollout create the rollout of a checked request, applying its first wave
+func (h *adminHandler) createRollout(w http.ResponseWriter, r *http.Request, req *RolloutRequest) {
+	devices, err := selectDevices(h.managerFor(r), req.Devices, req.Serials)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(devices) == 0 {
+		httpError(w, "no devices to roll the change out to", http.StatusBadRequest)
+		return
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		log.Printf("error generating rollout ID: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	ro := common.NewRollout(id.String(), req.Name, devices, req.WaveSize)
+	ro.Patch = req.Patch
+	ro.Template = req.Template
+	ro.WaveTimeout = req.WaveTimeout
+	ro.MaxFailures = req.MaxFailures
+
+	h.rolloutLock.Lock()
+	defer h.rolloutLock.Unlock()
+	if err := common.RolloutSet(h.managerFor(r), ro); err != nil {
+		log.Printf("error saving rollout: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditRolloutCreate, ro.ID, nil, rolloutSummary(ro))
+	if err := advanceRollout(h.managerFor(r), ro, time.Now()); err != nil {
+		log.Printf("error advancing rollout %s: %v", ro.ID, err)
+	}
+	h.writeRollout(w, http.StatusCreated, ro)
+}
+
+// rolloutPause pause a running rollout, leaving the devices of the current wave as they are
+func (h *adminHandler) rolloutPause(w http.ResponseWriter, r *http.Request) {
+	h.setRolloutState(w, r, common.RolloutRunning, common.RolloutPaused, auditRolloutPause)
+}
+
+// rolloutResume resume a paused rollout. Devices of the current wave still have to acknowledge the change within the
+// wave timeout of it being applied, pause included
+func (h *adminHandler) rolloutResume(w http.ResponseWriter, r *http.Request) {
+	h.setRolloutState(w, r, common.RolloutPaused, common.RolloutRunning, auditRolloutResume)
+}
+
+func (h *adminHandler) setRolloutState(w http.ResponseWriter, r *http.Request, from, to, action string) {
+	h.rolloutLock.Lock()
+	defer h.rolloutLock.Unlock()
+	ro, ok := h.getRollout(w, r)
+	if !ok {
+		return
+	}
+	if ro.State != from {
+		httpError(w, fmt.Sprintf("rollout %s is %s, not %s", ro.ID, ro.State, from), http.StatusConflict)
+		return
+	}
+	before := rolloutSummary(ro)
+	ro.State = to
+	ro.Updated = time.Now()
+	if err := common.RolloutSet(h.managerFor(r), ro); err != nil {
+		log.Printf("error saving rollout: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, action, ro.ID, before, rolloutSummary(ro))
+	if err := advanceRollout(h.managerFor(r), ro, time.Now()); err != nil {
+		log.Printf("error advancing rollout %s: %v", ro.ID, err)
+	}
+	h.writeRollout(w, http.StatusOK, ro)
+}
+
+// rolloutRemove remove a rollout, stopping it. The configs already changed stay as they are
+func (h *adminHandler) rolloutRemove(w http.ResponseWriter, r *http.Request) {
+	h.rolloutLock.Lock()
+	defer h.rolloutLock.Unlock()
+	ro, ok := h.getRollout(w, r)
+	if !ok {
+		return
+	}
+	if err := common.RolloutRemove(h.managerFor(r), ro.ID); err != nil {
+		log.Printf("error removing rollout: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditRolloutRemove, ro.ID, rolloutSummary(ro), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getRollout get the rollout a request is for, writing the error response if there is none
+func (h *adminHandler) getRollout(w http.ResponseWriter, r *http.Request) (*common.Rollout, bool) {
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	}
+	ro, err := common.RolloutGet(h.managerFor(r), id.String())
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		log.Printf("error getting rollout %s: %v", id, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	return ro, true
+}
+
+func (h *adminHandler) writeRollout(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting rollout to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
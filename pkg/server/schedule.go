@@ -0,0 +1,228 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// DefaultScheduleInterval how often pending scheduled changes are checked for being due, unless set otherwise
+const DefaultScheduleInterval = 30 * time.Second
+
+// ScheduleRequest a config change to schedule for a time, a maintenance window, or the first time the window is open
+// from a time. The devices are those in Devices and those with a serial matching one of Serials, or every device if
+// both are empty
+type ScheduleRequest struct {
+	Name string `json:"name,omitempty"`
+	// Devices UUIDs of devices to apply the change to
+	Devices []string `json:"devices,omitempty"`
+	// Serials patterns, as for path.Match, of the serials of devices to apply the change to
+	Serials []string `json:"serials,omitempty"`
+	// Patch JSON merge patch to apply to the config of each device, exclusive with Template
+	Patch json.RawMessage `json:"patch,omitempty"`
+	// Template config to set on each device, exclusive with Patch
+	Template json.RawMessage `json:"template,omitempty"`
+	// At the earliest time to apply the change
+	At *time.Time `json:"at,omitempty"`
+	// Window the maintenance window to apply the change in
+	Window *common.MaintenanceWindow `json:"window,omitempty"`
+}
+
+// scheduleSummary summary of a scheduled change for the audit log, without the change and the outcome on each device
+func scheduleSummary(s *common.ScheduledChange) map[string]interface{} {
+	return map[string]interface{}{"name": s.Name, "state": s.State, "devices": len(s.Devices), "failures": s.Failures()}
+}
+
+// applySchedule apply a scheduled change if it is due, saving the outcome
+func applySchedule(m driver.DeviceManager, s *common.ScheduledChange, now time.Time) error {
+	apply := func(u string) (string, error) {
+		return applyChange(m, s.Patch, s.Template, "schedule:"+s.ID, u)
+	}
+	if !s.Apply(now, apply) {
+		return nil
+	}
+	log.Printf("scheduled change %s applied, %d devices failed", s.ID, s.Failures())
+	return common.ScheduleSet(m, s)
+}
+
+// applySchedules apply the scheduled changes that are due every interval, until done is closed
+func (h *adminHandler) applySchedules(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		h.scheduleLock.Lock()
+		schedules, err := common.ScheduleList(h.manager)
+		if err != nil {
+			log.Printf("error listing scheduled changes: %v", err)
+		}
+		for _, s := range schedules {
+			if err := applySchedule(h.manager, s, time.Now()); err != nil {
+				log.Printf("error applying scheduled change %s: %v", s.ID, err)
+			}
+		}
+		h.scheduleLock.Unlock()
+	}
+}
+
+// checkScheduleRequest check the change and the time of a schedule request
+func checkScheduleRequest(c common.RecordStore, req *ScheduleRequest) error {
+	if err := checkChange(c, req.Patch, req.Template); err != nil {
+		return err
+	}
+	if req.At == nil && req.Window == nil {
+		return fmt.Errorf("a scheduled change needs a time, a maintenance window or both")
+	}
+	if req.Window != nil {
+		if err := req.Window.Validate(); err != nil {
+			return fmt.Errorf("bad maintenance window: %v", err)
+		}
+	}
+	return nil
+}
+
+func (h *adminHandler) scheduleList(w http.ResponseWriter, r *http.Request) {
+	schedules, err := common.ScheduleList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing scheduled changes: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// the pending ones only, unless all are asked for
+	if r.URL.Query().Get("all") == "" {
+		pending := schedules[:0]
+		for _, s := range schedules {
+			if s.State == common.SchedulePending {
+				pending = append(pending, s)
+			}
+		}
+		schedules = pending
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Created.Before(schedules[j].Created) })
+	h.writeSchedule(w, http.StatusOK, schedules)
+}
+
+func (h *adminHandler) scheduleGet(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.getSchedule(w, r)
+	if !ok {
+		return
+	}
+	h.writeSchedule(w, http.StatusOK, s)
+}
+
+// scheduleAdd schedule a config change, applying it at once if it is already due
+func (h *adminHandler) scheduleAdd(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req ScheduleRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad schedule request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := checkScheduleRequest(h.managerFor(r), &req); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	devices, err := selectDevices(h.managerFor(r), req.Devices, req.Serials)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(devices) == 0 {
+		httpError(w, "no devices to apply the change to", http.StatusBadRequest)
+		return
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		log.Printf("error generating scheduled change ID: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	s := common.NewScheduledChange(id.String(), req.Name, devices)
+	s.Patch = req.Patch
+	s.Template = req.Template
+	s.At = req.At
+	s.Window = req.Window
+
+	h.scheduleLock.Lock()
+	defer h.scheduleLock.Unlock()
+	if err := common.ScheduleSet(h.managerFor(r), s); err != nil {
+		log.Printf("error saving scheduled change: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditScheduleAdd, s.ID, nil, scheduleSummary(s))
+	if err := applySchedule(h.managerFor(r), s, time.Now()); err != nil {
+		log.Printf("error applying scheduled change %s: %v", s.ID, err)
+	}
+	h.writeSchedule(w, http.StatusCreated, s)
+}
+
+// scheduleRemove remove a scheduled change, cancelling it if pending. The configs of one applied stay as they are
+func (h *adminHandler) scheduleRemove(w http.ResponseWriter, r *http.Request) {
+	h.scheduleLock.Lock()
+	defer h.scheduleLock.Unlock()
+	s, ok := h.getSchedule(w, r)
+	if !ok {
+		return
+	}
+	if err := common.ScheduleRemove(h.managerFor(r), s.ID); err != nil {
+		log.Printf("error removing scheduled change: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditScheduleRemove, s.ID, scheduleSummary(s), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getSchedule get the scheduled change a request is for, writing the error response if there is none
+func (h *adminHandler) getSchedule(w http.ResponseWriter, r *http.Request) (*common.ScheduledChange, bool) {
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	}
+	s, err := common.ScheduleGet(h.managerFor(r), id.String())
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		log.Printf("error getting scheduled change %s: %v", id, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	return s, true
+}
+
+func (h *adminHandler) writeSchedule(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting scheduled change to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
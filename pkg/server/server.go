@@ -5,43 +5,227 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	"github.com/lf-edge/adam/pkg/logging"
+	ax "github.com/lf-edge/adam/pkg/x509"
 	"github.com/lf-edge/adam/web"
 )
 
 // Server an adam server
 type Server struct {
-	Port          string
-	Address       string
-	CertPath      string
-	KeyPath       string
+	Port     string
+	Address  string
+	CertPath string
+	KeyPath  string
+	// KeyProvider where to get the server key named by KeyPath. If nil, KeyPath is a PEM file
+	KeyProvider ax.KeyProvider
+	// Listeners addresses to serve on instead of Address and Port, e.g. for IPv6 or dual-stack networks, each with
+	// the APIs it serves and its server certificate; empty means Address and Port
+	Listeners []Listener
+	// IdleTimeout how long a connection is kept open between requests, with HTTP/1.1 keep-alive and HTTP/2 alike; 0
+	// means DefaultIdleTimeout
+	IdleTimeout time.Duration
+	// DisableHTTP2 whether to serve HTTP/1.1 only, rather than HTTP/2 to the clients that offer it
+	DisableHTTP2 bool
+	// HTTP2MaxStreams how many requests an HTTP/2 connection can have in flight at once; 0 means
+	// DefaultHTTP2MaxStreams
+	HTTP2MaxStreams uint32
+	// MaxConnections how many connections each listener has open at most, others waiting to be accepted until one
+	// closes; 0 means no limit
+	MaxConnections int
+	// ACME where to obtain and renew the server certificate from, instead of CertPath and KeyPath; nil means to use
+	// those
+	ACME          *ACME
 	DeviceManager driver.DeviceManager
 	CertRefresh   int
+	// GCInterval how often, in seconds, to look for orphaned data, if the driver supports it; 0 means never
+	GCInterval int
+	// GCRemove whether to remove the orphaned data found every GCInterval, or only log it
+	GCRemove bool
+	// ArchiveInterval how often, in seconds, to archive the older entries of device streams, if the driver has an
+	// archive; 0 means only when asked to
+	ArchiveInterval int
+	// Quotas limits on the data of devices without quotas of their own
+	Quotas common.Quotas
+	// QuotaPeriod period over which the byte quotas are counted
+	QuotaPeriod time.Duration
+	// MaxBodySize limits of the size of the bodies of the requests of devices, per kind of message, requests for
+	// registering and the others; bodies over them are answered 413
+	MaxBodySize common.Limits
+	// LogFilter filter of the logs of devices without a filter of their own
+	LogFilter common.LogFilter
+	// OnboardApproval rules for onboarding devices; if nil, devices are registered without approval
+	OnboardApproval *OnboardApproval
+	// DeviceCA CA to sign the certificates of devices registering with a certificate signing request; if nil,
+	// devices must register with self-signed certificates
+	DeviceCA *DeviceCA
+	// DeviceCABundles CA bundles one of which must have signed the certificates of devices, e.g. the old and new
+	// roots while rotating them, selected per listener; empty means device certificates are only matched against
+	// those registered
+	DeviceCABundles []DeviceCABundle
 	// WebDir path to webfiles to serve. If empty, use embedded
 	WebDir string
+	// Tracing whether to trace requests and the driver calls they make, with the global tracer provider
+	Tracing bool
+	// ShutdownTimeout how long shutting down can take, from waiting for the requests in flight to closing the device
+	// manager; 0 means DefaultShutdownTimeout
+	ShutdownTimeout time.Duration
+	// ShutdownHooks called last on shutdown, within ShutdownTimeout, e.g. to flush traces
+	ShutdownHooks []func(context.Context) error
+	// AdminAuth whether the admin API requires an API token, or a client certificate signed by one in AdminCA
+	AdminAuth bool
+	// AdminCA path to the PEM certificates of the CAs whose client certificates have full access to the admin API
+	AdminCA string
+	// AdminPolicy path to a YAML or JSON access policy limiting the admin operations and devices of the identities
+	// it has rules for, reloaded on SIGHUP; empty means none
+	AdminPolicy string
+	// RequireIfMatch whether setting the config of a device through the admin API needs an If-Match with the ETag of
+	// the config it replaces, rather than only checking one if sent
+	RequireIfMatch bool
+	// TrustedProxies CIDRs or IP addresses of the reverse proxies in front of the admin API, whose X-Forwarded-For,
+	// X-Forwarded-Proto and X-Forwarded-Host headers are believed, e.g. for the client IP of audit records
+	TrustedProxies []string
+	// AdminSocket path of a Unix socket to serve the admin API on too, in plain HTTP, for local tools; requests on it
+	// need no API token, access being that to the socket file. SystemdSocket takes the socket systemd passes, as with
+	// socket activation; empty means none
+	AdminSocket string
+	// AdminSocketMode permissions of the AdminSocket file; 0 means DefaultAdminSocketMode
+	AdminSocketMode os.FileMode
+	// CORSOrigins origins of the browser-based UIs allowed to call the admin API, as http[s]://host[:port], or * for
+	// any; empty means none
+	CORSOrigins []string
+	// CertHeader header in which TLS-terminating proxies in front of the device API, e.g. nginx or HAProxy, pass
+	// the client certificate of the device, e.g. X-SSL-Client-Cert; empty means devices connect with TLS to Adam itself
+	CertHeader string
+	// CertProxies CIDRs or IP addresses of the proxies whose CertHeader is believed
+	CertProxies []string
+	// CertProxyCA path to the PEM certificates of the CAs one of which must have signed the client certificate
+	// the proxies connect to Adam with; empty means they need none
+	CertProxyCA string
+	// CertProxyPort port of a plain HTTP listener of the device API, for the proxies to forward requests to
+	// without TLS; empty means none
+	CertProxyPort string
+	// RolloutInterval how often to advance running config rollouts; 0 means DefaultRolloutInterval
+	RolloutInterval time.Duration
+	// ScheduleInterval how often to check whether pending scheduled config changes are due; 0 means
+	// DefaultScheduleInterval
+	ScheduleInterval time.Duration
+	// DeviceRetention how long devices deleted softly are kept before they are removed for good; 0 means
+	// DefaultDeviceRetention
+	DeviceRetention time.Duration
+	// EndpointBudgets how many requests to the endpoints of the device API are handled at once, and for how long,
+	// those past them being answered 503 with a Retry-After; empty means no limits
+	EndpointBudgets []EndpointBudget
+	// ShedRetryAfter how long the devices whose requests are shed are told to wait; 0 means DefaultShedRetryAfter
+	ShedRetryAfter time.Duration
+	// FaultInjection whether faults can be injected into the requests of devices, with rules set through the admin
+	// API, to test how EVE handles a failing controller
+	FaultInjection bool
+	// LocalProfilePort port of the plain HTTP listener serving the local profile server API to devices, at /{uuid};
+	// empty means none
+	LocalProfilePort string
+	// LokiURL URL of the Grafana Loki to forward the logs of devices to; empty means not to forward them
+	LokiURL string
+	// LokiTenant tenant of the logs forwarded to Loki, sent as X-Scope-OrgID; empty means none
+	LokiTenant string
+	// SyslogURL URL of the syslog server to forward the logs of devices to, as udp://, tcp:// or tls://host[:port];
+	// empty means not to forward them
+	SyslogURL string
+	// SyslogCA path to the PEM certificates of the CAs to trust for the certificate of a tls:// syslog server; empty
+	// means those of the system
+	SyslogCA string
+	// MetricsURL URL to push the metrics of devices to as time series; empty means not to push them
+	MetricsURL string
+	// MetricsFormat how the metrics are pushed to MetricsURL, influx for the InfluxDB line protocol, the default, or
+	// prometheus for Prometheus remote-write
+	MetricsFormat string
+	// MetricsToken token to authorize the pushes of metrics with; empty means none
+	MetricsToken string
+	// UpstreamURL URL of the primary Adam this one is a secondary of, syncing its onboarding certificates and devices
+	// and forwarding the telemetry of devices to it; empty means none
+	UpstreamURL string
+	// UpstreamToken API token of the primary to sync and forward with; empty means none
+	UpstreamToken string
+	// UpstreamCA path to the PEM certificates of the CAs to trust for the server certificate of the primary; empty
+	// means those of the system
+	UpstreamCA string
+	// SyncInterval how often to sync from the primary; 0 means DefaultSyncInterval
+	SyncInterval time.Duration
+	// Backpressure config items to serve devices while ingest is overloaded, to slow them down; nil means none
+	Backpressure *Backpressure
+	// OnboardHook decides on the registrations of devices from outside Adam, e.g. with NewOnboardWebhook; nil means
+	// none
+	OnboardHook OnboardHook
+	// BaseConfig the JSON of the EdgeDevConfig devices start with when neither a config snapshot nor the onboarding
+	// hook sets one, e.g. read with LoadBaseConfig; nil means the minimal one
+	BaseConfig []byte
 }
 
-// Start start the server
+// Start start the server, returning once it has shut down on SIGINT or SIGTERM
 func (s *Server) Start() {
-	// ensure the server cert and key exist
-	_, err := os.Stat(s.CertPath)
-	if err != nil {
-		log.Fatalf("server cert %s does not exist", s.CertPath)
+	var (
+		serverCert tls.Certificate
+		err        error
+	)
+	if s.KeyProvider == nil {
+		s.KeyProvider = &ax.FileKeyProvider{}
+	}
+	if s.ACME != nil {
+		if serverCert, err = s.ACME.Certificate(); err != nil {
+			log.Fatalf("unable to obtain server certificate with ACME: %v", err)
+		}
+	} else {
+		// ensure the server cert and key exist
+		if _, err = os.Stat(s.CertPath); err != nil {
+			log.Fatalf("server cert %s does not exist", s.CertPath)
+		}
+		if s.KeyProvider.Name() == "file" {
+			if _, err = os.Stat(s.KeyPath); err != nil {
+				log.Fatalf("server key %s does not exist", s.KeyPath)
+			}
+		}
+		if serverCert, err = s.loadCertificate(); err != nil {
+			log.Fatalf("unable to load server certificate: %v", err)
+		}
 	}
-	_, err = os.Stat(s.KeyPath)
+	var issuer *deviceIssuer
+	if s.DeviceCA != nil {
+		if issuer, err = newDeviceIssuer(*s.DeviceCA, s.KeyProvider); err != nil {
+			log.Fatalf("unable to load device CA: %v", err)
+		}
+	}
+	certs := &certStore{}
+	if err := certs.set(serverCert); err != nil {
+		log.Fatal(err)
+	}
+	cas, err := loadDeviceCAs(s.DeviceCABundles)
 	if err != nil {
-		log.Fatalf("server key %s does not exist", s.KeyPath)
+		log.Fatalf("unable to load device CA bundles: %v", err)
+	}
+	for _, l := range s.Listeners {
+		for _, name := range l.CAs {
+			if cas == nil || !cas.has(name) {
+				log.Fatalf("listener %s has unknown device CA bundle %s", l.Addr, name)
+			}
+		}
 	}
 
 	if s.DeviceManager == nil {
@@ -50,30 +234,251 @@ func (s *Server) Start() {
 
 	// save the device manager settings
 	s.DeviceManager.SetCacheTimeout(s.CertRefresh)
+	s.DeviceManager.SetQuotas(s.Quotas, s.QuotaPeriod)
+
+	// upgrade the storage to the layout of this release, before anything reads it
+	if m, ok := s.DeviceManager.(driver.Migrator); ok {
+		from, to, err := m.Migrate()
+		if err != nil {
+			log.Fatalf("error migrating the storage of the %s driver: %v", s.DeviceManager.Name(), err)
+		}
+		if from != to {
+			log.Printf("migrated the storage of the %s driver from schema version %d to %d", s.DeviceManager.Name(), from, to)
+		}
+	}
+
+	// closed on shutdown, to stop streams and background work
+	done := make(chan struct{})
+	var background sync.WaitGroup
+
+	// renews the certificate obtained with ACME in the background
+	if s.ACME != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			s.ACME.run(certs, done)
+		}()
+	}
+
+	if s.GCInterval > 0 {
+		if gc, ok := s.DeviceManager.(driver.GarbageCollector); ok {
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				collectGarbage(gc, time.Duration(s.GCInterval)*time.Second, s.GCRemove, done)
+			}()
+		} else {
+			log.Printf("garbage collection not supported by the %s driver", s.DeviceManager.Name())
+		}
+	}
+
+	if a, ok := archiver(s.DeviceManager); ok {
+		log.Printf("archiving older entries of device streams to %s", a.ArchiveLocation())
+		if s.ArchiveInterval > 0 {
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				archive(a, time.Duration(s.ArchiveInterval)*time.Second, done)
+			}()
+		}
+	}
 
 	router := mux.NewRouter()
 	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	if s.Tracing {
+		router.Use(traceRequest)
+	}
 
 	sh := http.StripPrefix("/swaggerui/", http.FileServer(http.Dir("/swaggerui/")))
 	router.PathPrefix("/swaggerui/").Handler(sh)
 
-	// to pass logs and info around
+	// to pass logs, info and metrics around
 	logChannel := make(chan []byte)
 	infoChannel := make(chan []byte)
+	metricsChannel := make(chan []byte)
+
+	// evaluates the alert rules on what devices send, and sends the alerts in the background
+	alerts := newAlerter(s.DeviceManager)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		alerts.send(done)
+	}()
+
+	// sends the commands to the app instances of devices through their config, following them from info messages
+	commands := &appCommander{}
+
+	// drops the log entries below the severity of the filter of their device, before they are stored
+	filters := newLogFilters(s.LogFilter)
+
+	// counts the requests of devices, per endpoint and per device, for the admin API
+	stats := newIngestStats()
+
+	// saves where the requests of each device come from with the device, in the background
+	sources := newDeviceSources(s.DeviceManager)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		sources.run(done)
+	}()
+
+	// forwards the log entries kept to Loki in the background
+	var loki *lokiExporter
+	if s.LokiURL != "" {
+		if loki, err = newLokiExporter(s.LokiURL, s.LokiTenant); err != nil {
+			log.Fatal(err)
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			loki.run(done)
+		}()
+	}
+
+	// forwards the log entries kept to a syslog server in the background
+	var syslog *syslogExporter
+	if s.SyslogURL != "" {
+		if syslog, err = newSyslogExporter(s.SyslogURL, s.SyslogCA); err != nil {
+			log.Fatal(err)
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			syslog.run(done)
+		}()
+	}
+
+	// pushes the metrics of devices as time series in the background
+	var metricsExport *metricsExporter
+	if s.MetricsURL != "" {
+		if metricsExport, err = newMetricsExporter(s.MetricsFormat, s.MetricsURL, s.MetricsToken); err != nil {
+			log.Fatal(err)
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			metricsExport.run(done)
+		}()
+	}
+
+	// syncs from the primary, and forwards the telemetry of devices to it, in the background
+	var upstream *federation
+	if s.UpstreamURL != "" {
+		if upstream, err = newFederation(s.DeviceManager, s.UpstreamURL, s.UpstreamToken, s.UpstreamCA, s.SyncInterval); err != nil {
+			log.Fatal(err)
+		}
+		background.Add(2)
+		go func() {
+			defer background.Done()
+			upstream.run(done)
+		}()
+		go func() {
+			defer background.Done()
+			upstream.follow(done)
+		}()
+	}
+
+	retention := s.DeviceRetention
+	if retention <= 0 {
+		retention = DefaultDeviceRetention
+	}
+
+	// the limits of onboarding certificates, checked by the device API and reported by the admin API
+	limits := newOnboardLimits(s.QuotaPeriod)
 
 	// edgedevice endpoint - fully compliant with EVE open API
 	api := &apiHandler{
-		manager:     s.DeviceManager,
-		logChannel:  logChannel,
-		infoChannel: infoChannel,
+		manager:        s.DeviceManager,
+		logChannel:     logChannel,
+		infoChannel:    infoChannel,
+		metricsChannel: metricsChannel,
+		approval:       s.OnboardApproval,
+		alerts:         alerts,
+		filters:        filters,
+		loki:           loki,
+		syslog:         syslog,
+		metricsExport:  metricsExport,
+		bodyLimits:     s.MaxBodySize,
+		parts:          newBundleParts(),
+		retention:      retention,
+		commands:       commands,
+		issuer:         issuer,
+		onboardHook:    s.OnboardHook,
+		deviceCAs:      cas,
+		baseConfig:     s.BaseConfig,
+		limits:         limits,
+		certs:          certs,
+		sources:        sources,
+		rekeyNonces:    newRekeyNonces(),
 	}
 
 	router.HandleFunc("/probe", api.probe).Methods("GET")
 
+	// health and readiness probes, for orchestrators; the admin API is on the same port
+	health := &healthHandler{manager: s.DeviceManager, certs: certs}
+	router.HandleFunc("/healthz", health.healthz).Methods("GET")
+	router.HandleFunc("/readyz", health.readyz).Methods("GET")
+
+	// proxies that terminate the TLS of devices and pass their client certificate in a header
+	var passthrough *certProxies
+	if s.CertHeader != "" {
+		if len(s.CertProxies) == 0 {
+			log.Fatalf("client certificate header %s without proxies to believe it from", s.CertHeader)
+		}
+		passthrough = &certProxies{header: s.CertHeader}
+		if passthrough.proxies, err = parseTrustedProxies(s.CertProxies); err != nil {
+			log.Fatal(err)
+		}
+		if s.CertProxyCA != "" {
+			if passthrough.cas, err = loadCAs("proxy", s.CertProxyCA); err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else if len(s.CertProxies) > 0 || s.CertProxyPort != "" {
+		log.Fatalf("client certificate proxies without a header to pass the certificates in")
+	}
+	api.proxies = passthrough
+
+	// requests are shed and faults injected after the stats, so that those count them
+	var shed *shedder
+	if len(s.EndpointBudgets) > 0 {
+		shed = newShedder(s.EndpointBudgets, s.ShedRetryAfter)
+	}
+	// slows devices down through their config while the requests counted, or those shed, are past its thresholds
+	var pressure *backpressure
+	if s.Backpressure != nil {
+		pressure = newBackpressure(*s.Backpressure, stats, shed)
+		api.backpressure = pressure
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			pressure.run(done)
+		}()
+	}
+	var faults *faultInjector
+	if s.FaultInjection {
+		faults = newFaultInjector(s.DeviceManager)
+	}
+	// holds the requests changing state while a state snapshot is taken or restored
+	quiesce := &quiescer{}
+
 	ed := router.PathPrefix("/api/v1/edgedevice").Subrouter()
+	ed.Use(passthrough.passCert)
 	ed.Use(ensureMTLS)
-	ed.Use(logRequest)
+	ed.Use(stats.observe)
+	if shed != nil {
+		ed.Use(shed.limit)
+	}
+	if faults != nil {
+		ed.Use(faults.inject)
+	}
+	ed.Use(quiesce.holdAll)
+	ed.Use(decodeBody(0))
+	ed.Use(upstream.forward)
 	ed.HandleFunc("/register", api.register).Methods("POST")
+	ed.HandleFunc("/rekey", api.rekeyNonce).Methods("GET")
+	ed.HandleFunc("/rekey", api.rekey).Methods("POST")
 	ed.HandleFunc("/ping", api.ping).Methods("GET")
 	ed.HandleFunc("/config", api.config).Methods("GET")
 	ed.HandleFunc("/config", api.configPost).Methods("POST")
@@ -83,45 +488,137 @@ func (s *Server) Start() {
 	ed.HandleFunc("/newlogs", api.newLogs).Methods("POST")
 	ed.HandleFunc("/apps/instances/id/{uuid}/logs", api.appLogs).Methods("POST")
 	ed.HandleFunc("/apps/instanceid/id/{uuid}/newlogs", api.newAppLogs).Methods("POST")
+	ed.HandleFunc("/attest", api.attest).Methods("POST")
+
+	// edgedevice v2 endpoint, authenticated by the device certificate as v1
+	ed2 := router.PathPrefix("/api/v2/edgedevice").Subrouter()
+	ed2.Use(passthrough.passCert)
+	ed2.Use(ensureMTLS)
+	ed2.Use(stats.observe)
+	if shed != nil {
+		ed2.Use(shed.limit)
+	}
+	if faults != nil {
+		ed2.Use(faults.inject)
+	}
+	ed2.Use(quiesce.holdAll)
+	ed2.Use(decodeBody(0))
+	ed2.HandleFunc("/certs", api.controllerCerts).Methods("GET")
+	ed2.HandleFunc("/uuid", api.deviceUUID).Methods("POST")
 
 	// admin endpoint - custom, used to manage adam
 	admin := &adminHandler{
-		manager:     s.DeviceManager,
-		logChannel:  logChannel,
-		infoChannel: infoChannel,
+		manager:        s.DeviceManager,
+		logChannel:     logChannel,
+		infoChannel:    infoChannel,
+		metricsChannel: metricsChannel,
+		quotas:         s.Quotas,
+		done:           done,
+		requireAuth:    s.AdminAuth,
+		alerts:         alerts,
+		retention:      retention,
+		filters:        filters,
+		loki:           loki,
+		syslog:         syslog,
+		metricsExport:  metricsExport,
+		stats:          stats,
+		devices:        router,
+		replays:        newReplayer(),
+		shedder:        shed,
+		faults:         faults,
+		backpressure:   pressure,
+		quiesce:        quiesce,
+		commands:       commands,
+		issuer:         issuer,
+		deviceCAs:      cas,
+		federation:     upstream,
+		baseConfig:     s.BaseConfig,
+		requireIfMatch: s.RequireIfMatch,
+		limits:         limits,
+	}
+	if s.AdminCA != "" {
+		if admin.adminCAs, err = loadAdminCAs(s.AdminCA); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if s.AdminPolicy != "" {
+		// rules only restrict the identities they match, so any client without one would have full access
+		if !s.AdminAuth {
+			log.Fatalf("admin access policy %s needs admin authentication to be required", s.AdminPolicy)
+		}
+		if admin.policy, err = loadAccessPolicy(s.AdminPolicy); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if s.AdminAuth && admin.adminCAs == nil && s.AdminSocket == "" {
+		// without a CA or the socket, the only way in is a token, which cannot be created once the server requires one
+		tokens, err := common.TokenList(s.DeviceManager)
+		if err != nil {
+			log.Fatalf("unable to list API tokens: %v", err)
+		}
+		if len(tokens) == 0 {
+			log.Fatalf("admin auth without an admin CA or socket needs an API token; create one with the server running without admin auth first")
+		}
+	}
+
+	rolloutInterval := s.RolloutInterval
+	if rolloutInterval <= 0 {
+		rolloutInterval = DefaultRolloutInterval
 	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		admin.advanceRollouts(rolloutInterval, done)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		admin.advanceCanaries(rolloutInterval, done)
+	}()
+	scheduleInterval := s.ScheduleInterval
+	if scheduleInterval <= 0 {
+		scheduleInterval = DefaultScheduleInterval
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		admin.applySchedules(scheduleInterval, done)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		admin.purgeDeleted(purgeInterval, done)
+	}()
 
 	ad := router.PathPrefix("/admin").Subrouter()
-	// swagger:operation GET /onboard onboard
-	//
-	//
-	// Onboards EVE
-	//
-	// The EVE should connect first
-	//
-	// ---
-	// produces:
-	// - application/json
-	// tags:
-	// - admin
-	// responses:
-	//   '200':
-	//     description: successful operation
-	ad.HandleFunc("/onboard", admin.onboardList).Methods("GET")
-	ad.HandleFunc("/onboard/{cn}", admin.onboardGet).Methods("GET")
-	ad.HandleFunc("/onboard", admin.onboardAdd).Methods("POST")
-	ad.HandleFunc("/onboard", admin.onboardClear).Methods("DELETE")
-	ad.HandleFunc("/onboard/{cn}", admin.onboardRemove).Methods("DELETE")
-	ad.HandleFunc("/device", admin.deviceList).Methods("GET")
-	ad.HandleFunc("/device/{uuid}", admin.deviceGet).Methods("GET")
-	ad.HandleFunc("/device/{uuid}/config", admin.deviceConfigGet).Methods("GET")
-	ad.HandleFunc("/device/{uuid}/config", admin.deviceConfigSet).Methods("PUT")
-	ad.HandleFunc("/device/{uuid}/logs", admin.deviceLogsGet).Methods("GET")
-	ad.HandleFunc("/device/{uuid}/info", admin.deviceInfoGet).Methods("GET")
-	ad.HandleFunc("/device/{uuid}/requests", admin.deviceRequestsGet).Methods("GET")
-	ad.HandleFunc("/device", admin.deviceAdd).Methods("POST")
-	ad.HandleFunc("/device", admin.deviceClear).Methods("DELETE")
-	ad.HandleFunc("/device/{uuid}", admin.deviceRemove).Methods("DELETE")
+	ad.Use(admin.authenticate)
+	ad.Use(admin.enforcePolicy)
+	ad.Use(quiesce.hold)
+	ad.Use(decodeBody(maxDecodedAdminBody))
+	admin.routes(ad)
+	admin.describeRoutes(ad)
+
+	// local profile server endpoint - EVE open API, on its own plain HTTP port, as devices expect
+	if s.LocalProfilePort != "" {
+		profiles := &profileHandler{manager: s.DeviceManager}
+		lps := mux.NewRouter()
+		if s.Tracing {
+			lps.Use(traceRequest)
+		}
+		lp := lps.PathPrefix("/{uuid}/api/v1").Subrouter()
+		lp.HandleFunc("/local_profile", profiles.profile).Methods("GET")
+		lp.HandleFunc("/radio", profiles.radio).Methods("POST")
+		lp.HandleFunc("/appinfo", profiles.appInfo).Methods("POST")
+		lpsServer := &http.Server{
+			Handler: logRequests(lps),
+			Addr:    net.JoinHostPort(s.Address, s.LocalProfilePort),
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			serveLocalProfiles(lpsServer, done)
+		}()
+	}
 
 	var (
 		//index  []byte
@@ -142,13 +639,13 @@ func (s *Server) Start() {
 		filename := "index.html"
 		f, err := httpFS.Open(indexFilename)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
 		defer f.Close()
 		content, err := ioutil.ReadAll(f)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
 		http.ServeContent(w, r, filename, time.Now(), bytes.NewReader(content))
@@ -158,23 +655,228 @@ func (s *Server) Start() {
 	router.HandleFunc("/index.html", indexHandler).Methods("GET")
 	router.PathPrefix("/static/").Handler(http.StripPrefix(stripPrefix, http.FileServer(http.FS(httpFS))))
 
-	tlsConfig := &tls.Config{
-		ClientAuth: tls.RequestClientCert,
-		ClientCAs:  nil,
+	// listeners with their own server certificate, reloaded with that of the server
+	listenerCerts := map[*certStore]Listener{}
+	for _, l := range s.Listeners {
+		if l.CertPath == "" {
+			continue
+		}
+		cert, err := s.loadCertificatePair(l.CertPath, l.KeyPath)
+		if err != nil {
+			log.Fatalf("unable to load server certificate of listener %s: %v", l.Addr, err)
+		}
+		store := &certStore{}
+		if err := store.set(cert); err != nil {
+			log.Fatal(err)
+		}
+		listenerCerts[store] = l
 	}
+	go s.reloadOnHangup(certs, listenerCerts, cas, admin.policy, done)
 
-	server := &http.Server{
-		Handler:   router,
-		Addr:      fmt.Sprintf("%s:%s", s.Address, s.Port),
-		TLSConfig: tlsConfig,
+	proxies, err := parseTrustedProxies(s.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var cors *corsPolicy
+	if len(s.CORSOrigins) > 0 {
+		if cors, err = parseCORSOrigins(s.CORSOrigins); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// each request is logged once answered, whichever listener it came in on
+	logged := logRequests(router)
+	front := adminFront(logged, proxies, cors)
+	var servers []listening
+	if len(s.Listeners) == 0 {
+		servers = append(servers, listening{
+			server: &http.Server{
+				Handler:   front,
+				Addr:      net.JoinHostPort(s.Address, s.Port),
+				TLSConfig: tlsConfig(certs),
+			},
+			network: "tcp",
+		})
+	}
+	for _, l := range s.Listeners {
+		store := certs
+		for c, lc := range listenerCerts {
+			if lc.Addr == l.Addr {
+				store = c
+			}
+		}
+		servers = append(servers, listening{
+			server: &http.Server{
+				Handler:   l.handler(front),
+				Addr:      l.Addr,
+				TLSConfig: tlsConfig(store),
+			},
+			network: l.network(),
+		})
+	}
+	for _, l := range servers {
+		if err := s.tuneConnections(l.server); err != nil {
+			log.Fatalf("unable to configure HTTP/2: %v", err)
+		}
+	}
+	// the admin API on a Unix socket, for local tools
+	if s.AdminSocket != "" {
+		l, err := listenAdminSocket(s.AdminSocket, s.AdminSocketMode)
+		if err != nil {
+			log.Fatal(err)
+		}
+		socketServer := &http.Server{Handler: logRequests(socketHandler(router))}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			serveAdminSocket(socketServer, l, done)
+		}()
+	}
+	// the device API in plain HTTP, for proxies that do not connect with TLS; the admin API stays on TLS
+	if s.CertProxyPort != "" {
+		proxyServer := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasPrefix(r.URL.Path, "/api/") {
+					notFound(w, r)
+					return
+				}
+				logged.ServeHTTP(w, r)
+			}),
+			Addr: net.JoinHostPort(s.Address, s.CertProxyPort),
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			serveCertProxies(proxyServer, done)
+		}()
 	}
 	log.Println("Starting adam:")
-	log.Printf("\tURL: https://%s:%s\n", s.Address, s.Port)
+	if len(s.Listeners) == 0 {
+		log.Printf("\tURL: https://%s\n", net.JoinHostPort(s.Address, s.Port))
+	}
+	for _, l := range s.Listeners {
+		api, cert := "all APIs", "server cert"
+		if l.API != "" {
+			api = l.API + " API"
+		}
+		if l.CertPath != "" {
+			cert = l.CertPath
+		}
+		if len(l.CAs) > 0 {
+			cert += ", device CAs " + strings.Join(l.CAs, ",")
+		}
+		log.Printf("\tURL: https://%s (%s, %s, %s)\n", l.Addr, l.network(), api, cert)
+	}
 	log.Printf("\tstorage: %s\n", s.DeviceManager.Name())
 	log.Printf("\tdatabase: %s\n", s.DeviceManager.Database())
-	log.Printf("\tserver cert: %s\n", s.CertPath)
-	log.Printf("\tserver key: %s\n", s.KeyPath)
-	log.Fatal(server.ListenAndServeTLS(s.CertPath, s.KeyPath))
+	log.Printf("\tconnections: %s\n", s.connectionsSummary())
+	log.Printf("\tlog levels: %s\n", logging.FormatLevels(logging.Levels()))
+	if m, ok := s.DeviceManager.(driver.Migrator); ok {
+		if current, _, err := m.SchemaVersion(); err == nil {
+			log.Printf("\tschema version: %d\n", current)
+		}
+	}
+	if s.ACME != nil {
+		log.Printf("\tserver cert: %s (acme %s)\n", strings.Join(s.ACME.Domains, ","), s.ACME.Challenge)
+	} else {
+		log.Printf("\tserver cert: %s\n", s.CertPath)
+		log.Printf("\tserver key: %s (%s)\n", s.KeyPath, s.KeyProvider.Name())
+	}
+	if issuer != nil {
+		csr := "certificate signing requests or certificates"
+		if issuer.conf.RequireCSR {
+			csr = "certificate signing requests only"
+		}
+		log.Printf("\tdevice CA: %s, for %s, issuing certificates valid for %d days\n", s.DeviceCA.CertPath, csr, int(issuer.conf.Validity.Hours()/24))
+	}
+	for _, b := range s.DeviceCABundles {
+		log.Printf("\tdevice CA bundle %s: %s\n", b.Name, b.Path)
+	}
+	if s.LocalProfilePort != "" {
+		log.Printf("\tlocal profile server: http://%s/{uuid}\n", net.JoinHostPort(s.Address, s.LocalProfilePort))
+	}
+	if loki != nil {
+		log.Printf("\tloki: %s\n", loki.url)
+	}
+	if syslog != nil {
+		log.Printf("\tsyslog: %s\n", syslog.url)
+	}
+	if metricsExport != nil {
+		log.Printf("\tmetrics export: %s (%s)\n", metricsExport.url, metricsExport.format)
+	}
+	if len(s.TrustedProxies) > 0 {
+		log.Printf("\ttrusted proxies: %s\n", strings.Join(s.TrustedProxies, ","))
+	}
+	if passthrough != nil {
+		log.Printf("\tclient certificate proxies: %s, in %s\n", strings.Join(s.CertProxies, ","), s.CertHeader)
+	}
+	if s.AdminSocket != "" {
+		log.Printf("\tadmin socket: %s\n", s.AdminSocket)
+	}
+	for _, b := range s.EndpointBudgets {
+		log.Printf("\tbudget of %s: concurrency %d, wait %s, timeout %s\n", b.Endpoint, b.Concurrency, b.Wait, b.Timeout)
+	}
+	if pressure != nil {
+		log.Printf("\tbackpressure: %v past %.1f ingest requests/s or %d shed, checked every %s\n", pressure.Items, pressure.Rate, pressure.Shed, pressure.Interval)
+	}
+	if s.OnboardHook != nil {
+		log.Printf("\tonboarding hook: %v\n", s.OnboardHook)
+	}
+	if s.FaultInjection {
+		log.Printf("\twarning: fault injection enabled, device requests fail per the rules of /admin/fault\n")
+	}
+	if s.CertProxyPort != "" {
+		log.Printf("\tdevice API for proxies: http://%s/api\n", net.JoinHostPort(s.Address, s.CertProxyPort))
+	}
+	if len(s.CORSOrigins) > 0 {
+		log.Printf("\tCORS origins: %s\n", strings.Join(s.CORSOrigins, ","))
+	}
+	switch {
+	case s.AdminAuth && s.AdminCA != "":
+		log.Printf("\tadmin auth: API tokens or client certificates signed by %s\n", s.AdminCA)
+	case s.AdminAuth:
+		log.Printf("\tadmin auth: API tokens\n")
+	}
+	s.serve(servers, done, &background)
+}
+
+// loadCertificate load the server certificate chain from CertPath and its key from the KeyProvider
+func (s *Server) loadCertificate() (tls.Certificate, error) {
+	return s.loadCertificatePair(s.CertPath, s.KeyPath)
+}
+
+// loadCertificatePair load a server certificate chain from a file and its key from the KeyProvider
+func (s *Server) loadCertificatePair(certPath, keyPath string) (tls.Certificate, error) {
+	var cert tls.Certificate
+	b, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return cert, fmt.Errorf("error reading server cert %s: %v", certPath, err)
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return cert, fmt.Errorf("no certificates found in %s", certPath)
+	}
+	signer, err := s.KeyProvider.Signer(keyPath)
+	if err != nil {
+		return cert, fmt.Errorf("error getting server key %s: %v", keyPath, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, fmt.Errorf("error parsing server cert %s: %v", certPath, err)
+	}
+	if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); ok && !pub.Equal(leaf.PublicKey) {
+		return cert, fmt.Errorf("server key %s does not match server cert %s", keyPath, certPath)
+	}
+	cert.PrivateKey = signer
+	return cert, nil
 }
 
 // middleware handlers to check device cert and onboarding cert
@@ -184,32 +886,184 @@ func ensureMTLS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// ensure we have TLS with at least one PeerCertificate
 		if r.TLS == nil {
-			http.Error(w, "TLS required", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, ErrTLSRequired, "TLS required", nil)
 			return
 		}
 		if r.TLS.PeerCertificates == nil || len(r.TLS.PeerCertificates) < 1 {
-			http.Error(w, "client TLS authentication required", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, ErrTLSRequired, "client TLS authentication required", nil)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-// log the request and client
-func logRequest(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cert := getClientCert(r)
-		log.Printf("%s requested %s", cert.Subject.String(), r.URL.Path)
-		next.ServeHTTP(w, r)
-	})
-}
-
 // retrieve the client cert
 func getClientCert(r *http.Request) *x509.Certificate {
 	return r.TLS.PeerCertificates[0]
 }
 
 func notFound(w http.ResponseWriter, r *http.Request) {
-	log.Printf("404 returned for %s", r.URL.Path)
-	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	httpError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// routes register the admin API on its router, every route with its operation in adminOperations, for the OpenAPI
+// document and the client generated from it
+func (h *adminHandler) routes(ad *mux.Router) {
+	ad.HandleFunc("/openapi.json", h.openAPI).Methods("GET")
+	ad.HandleFunc("/onboard", h.onboardList).Methods("GET")
+	ad.HandleFunc("/onboard/{cn}", h.onboardGet).Methods("GET")
+	ad.HandleFunc("/onboard", h.onboardAdd).Methods("POST")
+	ad.HandleFunc("/onboard/generate", h.onboardGenerate).Methods("POST")
+	ad.HandleFunc("/onboard", h.onboardClear).Methods("DELETE")
+	ad.HandleFunc("/onboard/{cn}", h.onboardRemove).Methods("DELETE")
+	ad.HandleFunc("/onboard/{cn}/policy", h.onboardPolicyGet).Methods("GET")
+	ad.HandleFunc("/onboard/{cn}/policy", h.onboardPolicySet).Methods("PUT")
+	ad.HandleFunc("/onboard/{cn}/policy", h.onboardPolicyRemove).Methods("DELETE")
+	ad.HandleFunc("/onboard/{cn}/usage", h.onboardUsage).Methods("GET")
+	ad.HandleFunc("/device", h.deviceList).Methods("GET")
+	ad.HandleFunc("/device/{uuid}", h.deviceGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/config", h.deviceConfigGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/config", h.deviceConfigSet).Methods("PUT")
+	ad.HandleFunc("/device/{uuid}/config/drift", h.deviceConfigDrift).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/logs", h.deviceLogsGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/logs/sources", h.deviceLogSources).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/info", h.deviceInfoGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/metrics", h.deviceMetricsGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/metrics/export", h.deviceMetricsExport).Methods("GET")
+	ad.HandleFunc("/grafana", h.grafanaHealth).Methods("GET")
+	ad.HandleFunc("/grafana/metrics", h.grafanaMetrics).Methods("POST")
+	ad.HandleFunc("/grafana/metric-payload-options", h.grafanaPayloadOptions).Methods("POST")
+	ad.HandleFunc("/grafana/variable", h.grafanaVariable).Methods("POST")
+	ad.HandleFunc("/grafana/query", h.grafanaQuery).Methods("POST")
+	ad.HandleFunc("/device/{uuid}/{kind:logs|info|metrics}/group/{group}", h.deviceGroupRead).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/{kind:logs|info|metrics}/group/{group}/ack", h.deviceGroupAck).Methods("POST")
+	ad.HandleFunc("/device/{uuid}/inventory", h.deviceInventoryGet).Methods("GET")
+	ad.HandleFunc("/inventory", h.inventorySearch).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/twin", h.deviceTwinGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/requests", h.deviceRequestsGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/quotas", h.deviceQuotasGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/quotas", h.deviceQuotasSet).Methods("PUT")
+	ad.HandleFunc("/device/{uuid}/quotas", h.deviceQuotasRemove).Methods("DELETE")
+	ad.HandleFunc("/device/{uuid}/logfilter", h.deviceLogFilterGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/logfilter", h.deviceLogFilterSet).Methods("PUT")
+	ad.HandleFunc("/device/{uuid}/logfilter", h.deviceLogFilterRemove).Methods("DELETE")
+	ad.HandleFunc("/device/{uuid}/localprofile", h.deviceLocalProfileGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/localprofile", h.deviceLocalProfileSet).Methods("PUT")
+	ad.HandleFunc("/device/{uuid}/localprofile", h.deviceLocalProfileRemove).Methods("DELETE")
+	ad.HandleFunc("/device/{uuid}/metadata", h.deviceMetadataGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/metadata", h.deviceMetadataSet).Methods("PUT")
+	ad.HandleFunc("/device/{uuid}/metadata", h.deviceMetadataRemove).Methods("DELETE")
+	ad.HandleFunc("/device/{uuid}/hardware-model", h.deviceModelGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/hardware-model", h.deviceModelSet).Methods("PUT")
+	ad.HandleFunc("/device/{uuid}/hardware-model", h.deviceModelRemove).Methods("DELETE")
+	ad.HandleFunc("/device/{uuid}/flags", h.deviceFlagsGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/flags/{flag}", h.deviceFlagSet).Methods("PUT")
+	ad.HandleFunc("/device/{uuid}/flags/{flag}", h.deviceFlagRemove).Methods("DELETE")
+	ad.HandleFunc("/device/{uuid}/quarantine", h.deviceQuarantineGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/quarantine", h.deviceQuarantineSet).Methods("PUT")
+	ad.HandleFunc("/device/{uuid}/quarantine", h.deviceQuarantineRemove).Methods("DELETE")
+	ad.HandleFunc("/device/{uuid}/attestation", h.deviceAttestationGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/attestation", h.deviceAttestationRemove).Methods("DELETE")
+	ad.HandleFunc("/device/{uuid}/app-command", h.appCommandList).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/app-command", h.appCommandAdd).Methods("POST")
+	ad.HandleFunc("/device/{uuid}/app-command/{id}", h.appCommandGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/app-command/{id}", h.appCommandRemove).Methods("DELETE")
+	ad.HandleFunc("/device/{uuid}/reboot", h.deviceRebootGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/reboot", h.deviceReboot).Methods("POST")
+	ad.HandleFunc("/device/{uuid}/baseos", h.deviceBaseOSGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/baseos", h.deviceBaseOS).Methods("POST")
+	ad.HandleFunc("/device/{uuid}/usage", h.deviceUsageGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/stats", h.deviceStatsGet).Methods("GET")
+	ad.HandleFunc("/device/{uuid}/replay", h.deviceReplay).Methods("POST")
+	ad.HandleFunc("/device", h.deviceAdd).Methods("POST")
+	ad.HandleFunc("/device", h.deviceClear).Methods("DELETE")
+	ad.HandleFunc("/device/{uuid}", h.deviceRemove).Methods("DELETE")
+	ad.HandleFunc("/device/{uuid}/restore", h.deviceRestore).Methods("POST")
+	ad.HandleFunc("/revocation", h.revocationList).Methods("GET")
+	ad.HandleFunc("/revocation/crl", h.revocationCRL).Methods("GET")
+	ad.HandleFunc("/revocation/{fingerprint}", h.revocationGet).Methods("GET")
+	ad.HandleFunc("/revocation", h.revocationAdd).Methods("POST")
+	ad.HandleFunc("/revocation/{fingerprint}", h.revocationRemove).Methods("DELETE")
+	ad.HandleFunc("/pending", h.pendingList).Methods("GET")
+	ad.HandleFunc("/pending/{id}", h.pendingGet).Methods("GET")
+	ad.HandleFunc("/pending/{id}/approve", h.pendingApprove).Methods("POST")
+	ad.HandleFunc("/pending/{id}", h.pendingReject).Methods("DELETE")
+	ad.HandleFunc("/audit", h.auditGet).Methods("GET")
+	ad.HandleFunc("/usage", h.usageList).Methods("GET")
+	ad.HandleFunc("/stats", h.statsList).Methods("GET")
+	ad.HandleFunc("/gc", h.gcGet).Methods("GET")
+	ad.HandleFunc("/gc", h.gcRun).Methods("POST")
+	ad.HandleFunc("/archive", h.archiveRun).Methods("POST")
+	ad.HandleFunc("/token", h.tokenList).Methods("GET")
+	ad.HandleFunc("/token", h.tokenAdd).Methods("POST")
+	ad.HandleFunc("/token/{id}", h.tokenRemove).Methods("DELETE")
+	ad.HandleFunc("/rollout", h.rolloutList).Methods("GET")
+	ad.HandleFunc("/rollout", h.rolloutCreate).Methods("POST")
+	ad.HandleFunc("/rollout/{id}", h.rolloutGet).Methods("GET")
+	ad.HandleFunc("/rollout/{id}/pause", h.rolloutPause).Methods("POST")
+	ad.HandleFunc("/rollout/{id}/resume", h.rolloutResume).Methods("POST")
+	ad.HandleFunc("/rollout/{id}", h.rolloutRemove).Methods("DELETE")
+	ad.HandleFunc("/canary", h.canaryList).Methods("GET")
+	ad.HandleFunc("/canary", h.canaryCreate).Methods("POST")
+	ad.HandleFunc("/canary/{id}", h.canaryGet).Methods("GET")
+	ad.HandleFunc("/canary/{id}/revert", h.canaryRevert).Methods("POST")
+	ad.HandleFunc("/canary/{id}/promote", h.canaryPromote).Methods("POST")
+	ad.HandleFunc("/canary/{id}", h.canaryRemove).Methods("DELETE")
+	ad.HandleFunc("/schedule", h.scheduleList).Methods("GET")
+	ad.HandleFunc("/schedule", h.scheduleAdd).Methods("POST")
+	ad.HandleFunc("/schedule/{id}", h.scheduleGet).Methods("GET")
+	ad.HandleFunc("/schedule/{id}", h.scheduleRemove).Methods("DELETE")
+	ad.HandleFunc("/alert", h.alertList).Methods("GET")
+	ad.HandleFunc("/alert/rule", h.alertRuleList).Methods("GET")
+	ad.HandleFunc("/alert/rule", h.alertRuleAdd).Methods("POST")
+	ad.HandleFunc("/alert/rule/{id}", h.alertRuleGet).Methods("GET")
+	ad.HandleFunc("/alert/rule/{id}", h.alertRuleRemove).Methods("DELETE")
+	ad.HandleFunc("/snapshot", h.snapshotList).Methods("GET")
+	ad.HandleFunc("/snapshot", h.snapshotCapture).Methods("POST")
+	ad.HandleFunc("/snapshot/{name}", h.snapshotGet).Methods("GET")
+	ad.HandleFunc("/snapshot/{name}/apply", h.snapshotApply).Methods("POST")
+	ad.HandleFunc("/snapshot/{name}", h.snapshotRemove).Methods("DELETE")
+	ad.HandleFunc("/hardware-model", h.hardwareModelList).Methods("GET")
+	ad.HandleFunc("/hardware-model/{name}", h.hardwareModelGet).Methods("GET")
+	ad.HandleFunc("/hardware-model/{name}", h.hardwareModelSet).Methods("PUT")
+	ad.HandleFunc("/hardware-model/{name}", h.hardwareModelRemove).Methods("DELETE")
+	ad.HandleFunc("/datastore", h.datastoreList).Methods("GET")
+	ad.HandleFunc("/datastore/{name}", h.datastoreGet).Methods("GET")
+	ad.HandleFunc("/datastore/{name}", h.datastoreSet).Methods("PUT")
+	ad.HandleFunc("/datastore/{name}", h.datastoreRemove).Methods("DELETE")
+	ad.HandleFunc("/image", h.imageList).Methods("GET")
+	ad.HandleFunc("/image/{name}", h.imageGet).Methods("GET")
+	ad.HandleFunc("/image/{name}", h.imageSet).Methods("PUT")
+	ad.HandleFunc("/image/{name}", h.imageRemove).Methods("DELETE")
+	ad.HandleFunc("/replay", h.replayList).Methods("GET")
+	ad.HandleFunc("/replay/{id}", h.replayGet).Methods("GET")
+	ad.HandleFunc("/replay/{id}", h.replayCancel).Methods("DELETE")
+	ad.HandleFunc("/dead-letter", h.deadLetterList).Methods("GET")
+	ad.HandleFunc("/dead-letter/{id}", h.deadLetterGet).Methods("GET")
+	ad.HandleFunc("/dead-letter/{id}/replay", h.deadLetterReplay).Methods("POST")
+	ad.HandleFunc("/dead-letter/{id}", h.deadLetterRemove).Methods("DELETE")
+	ad.HandleFunc("/metrics", h.metrics).Methods("GET")
+	ad.HandleFunc("/log-levels", h.logLevelsGet).Methods("GET")
+	ad.HandleFunc("/log-levels", h.logLevelsSet).Methods("PUT")
+	if h.backpressure != nil {
+		ad.HandleFunc("/backpressure", h.backpressureGet).Methods("GET")
+	}
+	if h.faults != nil {
+		ad.HandleFunc("/fault", h.faultList).Methods("GET")
+		ad.HandleFunc("/fault", h.faultAdd).Methods("POST")
+		ad.HandleFunc("/fault/{id}", h.faultRemove).Methods("DELETE")
+	}
+	ad.HandleFunc("/federation/sync", h.federationSync).Methods("GET")
+	ad.HandleFunc("/federation/telemetry", h.federationTelemetry).Methods("POST")
+	if h.federation != nil {
+		ad.HandleFunc("/federation", h.federationStatus).Methods("GET")
+	}
+	ad.HandleFunc("/export/certs", h.certsExport).Methods("GET")
+	ad.HandleFunc("/import/certs", h.certsImport).Methods("POST")
+	ad.HandleFunc("/export/state", h.stateExport).Methods("GET")
+	ad.HandleFunc("/import/state", h.stateImport).Methods("POST")
 }
@@ -0,0 +1,321 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// DefaultShedRetryAfter how long devices are told to wait before trying again once shed, if the server does not set it
+	DefaultShedRetryAfter = 5 * time.Second
+	// AnyEndpoint the endpoint of the budget of each endpoint without one of its own
+	AnyEndpoint = "*"
+)
+
+// EndpointBudget how many requests to an endpoint of the device API are handled at once, and for how long, so that a
+// slow store, e.g. a stalled Redis, sheds the requests past the budget instead of piling them up
+type EndpointBudget struct {
+	// Endpoint the route template of the endpoint, e.g. /api/v1/edgedevice/info, after a method to budget only the
+	// requests with it, e.g. POST /api/v1/edgedevice/info, or AnyEndpoint for each endpoint without a budget of its
+	// own, each on its own
+	Endpoint string
+	// Concurrency how many requests are handled at once, others waiting up to Wait for one of them to finish before
+	// being shed; 0 means no limit
+	Concurrency int
+	Wait        time.Duration
+	// Timeout how long a request is handled for before being answered 503; it holds its place in Concurrency until its
+	// handling ends. 0 means no limit
+	Timeout time.Duration
+}
+
+// ParseEndpointBudget parse an endpoint budget from
+// <endpoint>[,concurrency=<n>][,wait=<duration>][,timeout=<duration>]
+func ParseEndpointBudget(spec string) (EndpointBudget, error) {
+	parts := strings.Split(spec, ",")
+	b := EndpointBudget{Endpoint: strings.TrimSpace(parts[0])}
+	if b.Endpoint != AnyEndpoint {
+		tpl := b.Endpoint
+		if i := strings.Index(tpl, " "); i >= 0 {
+			tpl = strings.TrimSpace(tpl[i+1:])
+		}
+		if !strings.HasPrefix(tpl, "/api/") {
+			return b, fmt.Errorf("bad endpoint %q, must be [<method> ]<route template> of the device API, or %s", b.Endpoint, AnyEndpoint)
+		}
+	}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return b, fmt.Errorf("bad budget option %q, must be key=value", part)
+		}
+		var err error
+		switch kv[0] {
+		case "concurrency":
+			b.Concurrency, err = strconv.Atoi(kv[1])
+			if err == nil && b.Concurrency < 0 {
+				err = fmt.Errorf("must be at least 0")
+			}
+		case "wait":
+			b.Wait, err = time.ParseDuration(kv[1])
+		case "timeout":
+			b.Timeout, err = time.ParseDuration(kv[1])
+		default:
+			return b, fmt.Errorf("unknown budget option %q, must be concurrency, wait or timeout", kv[0])
+		}
+		if err != nil {
+			return b, fmt.Errorf("bad budget %s %q: %v", kv[0], kv[1], err)
+		}
+	}
+	if b.Wait < 0 || b.Timeout < 0 {
+		return b, fmt.Errorf("budget of %s with a negative duration", b.Endpoint)
+	}
+	if b.Concurrency == 0 && b.Timeout == 0 {
+		return b, fmt.Errorf("budget of %s without concurrency or timeout", b.Endpoint)
+	}
+	return b, nil
+}
+
+// shedder the budgets of the endpoints of the device API, with the requests in flight under each and those shed
+type shedder struct {
+	budgets    map[string]EndpointBudget
+	retryAfter time.Duration
+	lock       sync.Mutex
+	// slots the requests handled under each budget, by what it is kept under: its endpoint, or that of each request
+	// for AnyEndpoint
+	slots map[string]chan struct{}
+	// shed and timedOut the requests shed for being past their concurrency, or answered for being past their timeout,
+	// by method and route
+	shed     map[string]uint64
+	timedOut map[string]uint64
+}
+
+func newShedder(budgets []EndpointBudget, retryAfter time.Duration) *shedder {
+	s := &shedder{
+		budgets:    map[string]EndpointBudget{},
+		retryAfter: retryAfter,
+		slots:      map[string]chan struct{}{},
+		shed:       map[string]uint64{},
+		timedOut:   map[string]uint64{},
+	}
+	if s.retryAfter <= 0 {
+		s.retryAfter = DefaultShedRetryAfter
+	}
+	for _, b := range budgets {
+		s.budgets[b.Endpoint] = b
+	}
+	return s
+}
+
+// budgetFor the budget of a request with a method to a route, and what it is kept under, false if it has none
+func (s *shedder) budgetFor(method, tpl string) (EndpointBudget, string, bool) {
+	if b, ok := s.budgets[method+" "+tpl]; ok {
+		return b, b.Endpoint, true
+	}
+	if b, ok := s.budgets[tpl]; ok {
+		return b, b.Endpoint, true
+	}
+	if b, ok := s.budgets[AnyEndpoint]; ok {
+		return b, method + " " + tpl, true
+	}
+	return EndpointBudget{}, "", false
+}
+
+// acquire take a place among the requests handled under a budget, waiting up to its Wait for one, false if there was
+// none in time
+func (s *shedder) acquire(ctx context.Context, key string, b EndpointBudget) bool {
+	s.lock.Lock()
+	slots, ok := s.slots[key]
+	if !ok {
+		slots = make(chan struct{}, b.Concurrency)
+		s.slots[key] = slots
+	}
+	s.lock.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if b.Wait <= 0 {
+		return false
+	}
+	t := time.NewTimer(b.Wait)
+	defer t.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// release give back a place taken with acquire
+func (s *shedder) release(key string) {
+	s.lock.Lock()
+	slots := s.slots[key]
+	s.lock.Unlock()
+	<-slots
+}
+
+// count count a request in a map of counters
+func (s *shedder) count(counters map[string]uint64, endpoint string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	counters[endpoint]++
+}
+
+// counts the requests shed and timed out, by method and route
+func (s *shedder) counts() (map[string]uint64, map[string]uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	shed := make(map[string]uint64, len(s.shed))
+	for k, v := range s.shed {
+		shed[k] = v
+	}
+	timedOut := make(map[string]uint64, len(s.timedOut))
+	for k, v := range s.timedOut {
+		timedOut[k] = v
+	}
+	return shed, timedOut
+}
+
+// inFlight the requests being handled under each budget with a concurrency
+func (s *shedder) inFlight() map[string]uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := make(map[string]uint64, len(s.slots))
+	for k, slots := range s.slots {
+		n[k] = uint64(len(slots))
+	}
+	return n
+}
+
+// unavailable answer a request shed with 503, telling the device when to try again
+func (s *shedder) unavailable(w http.ResponseWriter, endpoint, why string) {
+	retry := int(math.Ceil(s.retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	writeError(w, http.StatusServiceUnavailable, ErrOverloaded, fmt.Sprintf("%s: %s", endpoint, why), map[string]interface{}{"endpoint": endpoint, "retry-after": retry})
+}
+
+// limit hold the requests of the device API to the budgets of their endpoints, shedding those past them
+func (s *shedder) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tpl := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if t, err := route.GetPathTemplate(); err == nil {
+				tpl = t
+			}
+		}
+		b, key, ok := s.budgetFor(r.Method, tpl)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		endpoint := r.Method + " " + tpl
+		release := func() {}
+		if b.Concurrency > 0 {
+			if !s.acquire(r.Context(), key, b) {
+				s.count(s.shed, endpoint)
+				s.unavailable(w, endpoint, "too many requests in flight")
+				return
+			}
+			release = func() { s.release(key) }
+		}
+		if b.Timeout <= 0 {
+			defer release()
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.serveWithin(w, r, next, b.Timeout, release, endpoint)
+	})
+}
+
+// serveWithin handle a request, answering 503 if it takes more than a timeout, and releasing its place once its
+// handling ends, even past the timeout. The response is kept until then, as in http.TimeoutHandler
+func (s *shedder) serveWithin(w http.ResponseWriter, r *http.Request, next http.Handler, timeout time.Duration, release func(), endpoint string) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	tw := &timeoutWriter{header: http.Header{}}
+	done := make(chan struct{})
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer release()
+		defer func() {
+			if p := recover(); p != nil {
+				panicked <- p
+				return
+			}
+			close(done)
+		}()
+		next.ServeHTTP(tw, r.WithContext(ctx))
+	}()
+	select {
+	case p := <-panicked:
+		panic(p)
+	case <-done:
+		tw.lock.Lock()
+		defer tw.lock.Unlock()
+		for k, v := range tw.header {
+			w.Header()[k] = v
+		}
+		if tw.status == 0 {
+			tw.status = http.StatusOK
+		}
+		w.WriteHeader(tw.status)
+		w.Write(tw.body.Bytes())
+	case <-ctx.Done():
+		tw.lock.Lock()
+		defer tw.lock.Unlock()
+		tw.timedOut = true
+		if ctx.Err() != context.DeadlineExceeded {
+			// the device left
+			return
+		}
+		s.count(s.timedOut, endpoint)
+		s.unavailable(w, endpoint, fmt.Sprintf("not handled within %s", timeout))
+	}
+}
+
+// timeoutWriter a ResponseWriter keeping the response of a request handled within a timeout, until it is handled
+type timeoutWriter struct {
+	lock     sync.Mutex
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	timedOut bool
+}
+
+func (t *timeoutWriter) Header() http.Header {
+	return t.header
+}
+
+func (t *timeoutWriter) WriteHeader(status int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.status == 0 && !t.timedOut {
+		t.status = status
+	}
+}
+
+func (t *timeoutWriter) Write(b []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	return t.body.Write(b)
+}
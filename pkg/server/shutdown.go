@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+)
+
+// DefaultShutdownTimeout how long shutting down can take, if the server does not set it
+const DefaultShutdownTimeout = 30 * time.Second
+
+// serve serve each of servers on its network until SIGINT or SIGTERM, then shut down: stop accepting connections,
+// wait for the requests in flight, close done to stop streams and background work, wait for that work and close the
+// device manager, all within ShutdownTimeout. A second signal exits at once
+func (s *Server) serve(servers []listening, done chan struct{}, background *sync.WaitGroup) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	errs := make(chan error, len(servers))
+	for _, l := range servers {
+		ln, err := net.Listen(l.network, l.server.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ln = s.limitConnections(ln)
+		go func(server *http.Server) {
+			errs <- server.ServeTLS(ln, "", "")
+		}(l.server)
+	}
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("received %s, shutting down", sig)
+	}
+	go func() {
+		sig := <-signals
+		log.Fatalf("received %s while shutting down, exiting", sig)
+	}()
+
+	timeout := s.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// streams of logs and info only end when their client leaves, so end them as soon as shutdown starts
+	servers[0].server.RegisterOnShutdown(func() { close(done) })
+	for _, l := range servers {
+		if err := l.server.Shutdown(ctx); err != nil {
+			log.Printf("requests still in flight on %s after %s, closing their connections: %v", l.server.Addr, timeout, err)
+			l.server.Close()
+		}
+	}
+	if err := waitFor(ctx, func() error {
+		background.Wait()
+		return nil
+	}); err != nil {
+		log.Printf("background work still running: %v", err)
+	}
+	if c, ok := s.DeviceManager.(driver.Closer); ok {
+		if err := waitFor(ctx, c.Close); err != nil {
+			log.Printf("error closing %s device manager: %v", s.DeviceManager.Name(), err)
+		}
+	}
+	for _, hook := range s.ShutdownHooks {
+		if err := hook(ctx); err != nil {
+			log.Printf("error shutting down: %v", err)
+		}
+	}
+	log.Println("adam stopped")
+}
+
+// waitFor run f, giving up at the deadline of ctx
+func waitFor(ctx context.Context, f func() error) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- f()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
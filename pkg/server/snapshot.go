@@ -0,0 +1,195 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// SnapshotRequest a snapshot to capture from the current config of a device
+type SnapshotRequest struct {
+	Name string `json:"name"`
+	// Device UUID of the device to capture the config of
+	Device string `json:"device"`
+	// Default whether newly onboarded devices are to start with the config, in place of the snapshot that was
+	Default bool `json:"default,omitempty"`
+}
+
+// snapshotSummary summary of a snapshot for the audit log, without the config
+func snapshotSummary(s *common.ConfigSnapshot) map[string]interface{} {
+	return map[string]interface{}{"name": s.Name, "source": s.Source, "default": s.Default}
+}
+
+func (h *adminHandler) snapshotList(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := common.SnapshotList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing config snapshots: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	h.writeSnapshot(w, http.StatusOK, snapshots)
+}
+
+func (h *adminHandler) snapshotGet(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.getSnapshot(w, r)
+	if !ok {
+		return
+	}
+	h.writeSnapshot(w, http.StatusOK, s)
+}
+
+// snapshotCapture capture the config of a device as a snapshot, replacing the one of the same name. Making it the
+// default unmarks the one that was
+func (h *adminHandler) snapshotCapture(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req SnapshotRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad snapshot request: %v", err), http.StatusBadRequest)
+		return
+	}
+	uid, err := uuid.FromString(req.Device)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad device UUID %q: %v", req.Device, err), http.StatusBadRequest)
+		return
+	}
+	m := h.managerFor(r)
+	b, err := m.GetConfig(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, fmt.Sprintf("unknown device %s", uid), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting config of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	s, err := common.NewConfigSnapshot(req.Name, uid.String(), b)
+	if err != nil {
+		httpError(w, fmt.Sprintf("bad snapshot request: %v", err), http.StatusBadRequest)
+		return
+	}
+	s.Default = req.Default
+	existing, err := common.SnapshotList(m)
+	if err != nil {
+		log.Printf("error listing config snapshots: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var before interface{}
+	for _, old := range existing {
+		if old.Name == s.Name {
+			before = snapshotSummary(old)
+			continue
+		}
+		if s.Default && old.Default {
+			oldSummary := snapshotSummary(old)
+			old.Default = false
+			if err := common.SnapshotAdd(m, old); err != nil {
+				log.Printf("error unmarking default config snapshot %s: %v", old.Name, err)
+				httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			h.audit(r, auditSnapshotAdd, old.Name, oldSummary, snapshotSummary(old))
+		}
+	}
+	if err := common.SnapshotAdd(m, s); err != nil {
+		log.Printf("error saving config snapshot: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditSnapshotAdd, s.Name, before, snapshotSummary(s))
+	h.writeSnapshot(w, http.StatusCreated, s)
+}
+
+// snapshotApply apply a snapshot to devices, as a rollout of it as a template. The request is that of a rollout,
+// without the change
+func (h *adminHandler) snapshotApply(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.getSnapshot(w, r)
+	if !ok {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req RolloutRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			httpError(w, fmt.Sprintf("bad rollout request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.Patch) > 0 || len(req.Template) > 0 {
+		httpError(w, "the change of a snapshot rollout is the snapshot, it cannot have a patch or a template", http.StatusBadRequest)
+		return
+	}
+	req.Template = s.Config
+	if req.Name == "" {
+		req.Name = "snapshot " + s.Name
+	}
+	if err := checkRolloutRequest(h.managerFor(r), &req); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.createRollout(w, r, &req)
+}
+
+func (h *adminHandler) snapshotRemove(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.getSnapshot(w, r)
+	if !ok {
+		return
+	}
+	if err := common.SnapshotRemove(h.managerFor(r), s.Name); err != nil {
+		log.Printf("error removing config snapshot: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditSnapshotRemove, s.Name, snapshotSummary(s), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getSnapshot get the snapshot a request is for, writing the error response if there is none
+func (h *adminHandler) getSnapshot(w http.ResponseWriter, r *http.Request) (*common.ConfigSnapshot, bool) {
+	name := mux.Vars(r)["name"]
+	s, err := common.SnapshotGet(h.managerFor(r), name)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		log.Printf("error getting config snapshot %s: %v", name, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	return s, true
+}
+
+func (h *adminHandler) writeSnapshot(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error converting config snapshot to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
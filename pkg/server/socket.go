@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SystemdSocket the admin socket to take from systemd, as with socket activation, instead of a path
+	SystemdSocket = "systemd"
+	// DefaultAdminSocketMode permissions of the admin socket unless set
+	DefaultAdminSocketMode os.FileMode = 0600
+	// systemdFirstFD the first file descriptor systemd passes sockets in, as sd_listen_fds does
+	systemdFirstFD = 3
+	// systemdAdminName name of the socket for the admin API, when systemd passes several
+	systemdAdminName = "admin"
+)
+
+// socketKey context key of whether a request came in on the admin socket
+type socketKey struct{}
+
+// fromSocket whether a request came in on the admin socket, whose access is that of the socket file
+func fromSocket(r *http.Request) bool {
+	ok, _ := r.Context().Value(socketKey{}).(bool)
+	return ok
+}
+
+// listenAdminSocket listen on the Unix socket of a path, replacing a stale one, with permissions mode, or on the socket
+// systemd passes for SystemdSocket
+func listenAdminSocket(p string, mode os.FileMode) (net.Listener, error) {
+	if p == SystemdSocket {
+		return systemdListener(systemdAdminName)
+	}
+	// the socket of a previous run is left behind if it did not shut down
+	if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(p); err != nil {
+			return nil, fmt.Errorf("error removing stale admin socket %s: %v", p, err)
+		}
+	}
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on admin socket %s: %v", p, err)
+	}
+	if mode == 0 {
+		mode = DefaultAdminSocketMode
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("error setting permissions of admin socket %s: %v", p, err)
+	}
+	return l, nil
+}
+
+// systemdListener the socket systemd passes to the process, as with socket activation: the one with a name when it
+// passes several, named with FileDescriptorName=, or the only one
+func systemdListener(name string) (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	i := -1
+	for j := 0; j < n && j < len(names); j++ {
+		if names[j] == name {
+			i = j
+		}
+	}
+	if i < 0 {
+		if n > 1 {
+			return nil, fmt.Errorf("%d sockets passed by systemd, none named %s", n, name)
+		}
+		i = 0
+	}
+	f := os.NewFile(uintptr(systemdFirstFD+i), name)
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("error using socket %d passed by systemd: %v", systemdFirstFD+i, err)
+	}
+	return l, nil
+}
+
+// socketHandler serve the admin API of a router, and only that, to the requests of the admin socket
+func socketHandler(router http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin" && !strings.HasPrefix(r.URL.Path, "/admin/") {
+			notFound(w, r)
+			return
+		}
+		router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), socketKey{}, true)))
+	})
+}
+
+// serveAdminSocket serve the admin API on a listener until done is closed
+func serveAdminSocket(server *http.Server, l net.Listener, done <-chan struct{}) {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(l)
+	}()
+	select {
+	case err := <-errs:
+		log.Fatalf("admin socket: %v", err)
+	case <-done:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down admin socket: %v", err)
+	}
+}
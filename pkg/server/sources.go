@@ -0,0 +1,170 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// sourceSaveInterval how often the requests counted from the sources devices are still seen from are saved
+const sourceSaveInterval = time.Minute
+
+// tlsVersions the names of the TLS versions devices connect with
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// sourceKey a source of the requests of a device, without when and how many
+type sourceKey struct {
+	device     uuid.UUID
+	ip         string
+	forwarded  string
+	tlsVersion string
+	userAgent  string
+}
+
+// pendingSource the requests from a source counted since they were last saved
+type pendingSource struct {
+	requests uint64
+	lastSeen time.Time
+	saved    time.Time
+}
+
+// deviceSources records where the requests of devices come from with the devices, through the DeviceManager, so that
+// the history of each survives restarts and is shared by replicas. A source a device was not seen from since the
+// server started is saved with its first request, so that a new address is seen at once; the requests from the
+// others are counted in memory and saved every sourceSaveInterval
+type deviceSources struct {
+	manager driver.DeviceManager
+	// locks serializes the updates to the history of each device
+	locks   deviceLocks
+	lock    sync.Mutex
+	pending map[sourceKey]*pendingSource
+}
+
+func newDeviceSources(m driver.DeviceManager) *deviceSources {
+	return &deviceSources{manager: m, pending: map[sourceKey]*pendingSource{}}
+}
+
+// requestSource where a request came from, without the port, which changes with each connection, and the addresses it
+// was forwarded for if it came from one of the proxies in front of the device API
+func requestSource(r *http.Request, proxies *certProxies) common.DeviceSource {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	return common.DeviceSource{IP: ip, Forwarded: proxies.forwardedFor(r), TLSVersion: tlsVersion(r), UserAgent: r.UserAgent()}
+}
+
+// tlsVersion the name of the version of TLS a request came with, empty without TLS
+func tlsVersion(r *http.Request) string {
+	if r.TLS == nil || r.TLS.Version == 0 {
+		return ""
+	}
+	if v, ok := tlsVersions[r.TLS.Version]; ok {
+		return v
+	}
+	return fmt.Sprintf("0x%04x", r.TLS.Version)
+}
+
+// record count a request of a device from a source, saving it at once if the source is new
+func (s *deviceSources) record(u uuid.UUID, source common.DeviceSource, now time.Time) {
+	k := sourceKey{device: u, ip: source.IP, forwarded: source.Forwarded, tlsVersion: source.TLSVersion, userAgent: source.UserAgent}
+	s.lock.Lock()
+	if p, ok := s.pending[k]; ok {
+		p.requests++
+		p.lastSeen = now
+		s.lock.Unlock()
+		return
+	}
+	s.pending[k] = &pendingSource{saved: now}
+	s.lock.Unlock()
+	s.save(u, source, 1, now)
+}
+
+// run save the requests counted every sourceSaveInterval, forgetting the sources not seen since they were last saved,
+// until done is closed, when those counted are saved a last time
+func (s *deviceSources) run(done <-chan struct{}) {
+	ticker := time.NewTicker(sourceSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.flush(now)
+		case <-done:
+			s.flush(time.Now())
+			return
+		}
+	}
+}
+
+// flush save the requests counted from each source, forgetting those of the sources not seen since they were last
+// saved
+func (s *deviceSources) flush(now time.Time) {
+	type update struct {
+		key      sourceKey
+		requests uint64
+		lastSeen time.Time
+	}
+	var updates []update
+	s.lock.Lock()
+	for k, p := range s.pending {
+		if p.requests == 0 {
+			if now.Sub(p.saved) >= sourceSaveInterval {
+				delete(s.pending, k)
+			}
+			continue
+		}
+		updates = append(updates, update{key: k, requests: p.requests, lastSeen: p.lastSeen})
+		p.requests, p.saved = 0, now
+	}
+	s.lock.Unlock()
+	for _, u := range updates {
+		source := common.DeviceSource{IP: u.key.ip, Forwarded: u.key.forwarded, TLSVersion: u.key.tlsVersion, UserAgent: u.key.userAgent}
+		s.save(u.key.device, source, u.requests, u.lastSeen)
+	}
+}
+
+// save add requests from a source to the history of a device, logging when they come from an address it was not seen
+// from before
+func (s *deviceSources) save(u uuid.UUID, source common.DeviceSource, requests uint64, seen time.Time) {
+	defer s.locks.lock(u)()
+	sources, err := s.manager.GetDeviceSources(u)
+	if err != nil {
+		if _, isNotFound := err.(*common.NotFoundError); !isNotFound {
+			log.Printf("error reading the sources of device %s: %v", u, err)
+		}
+		return
+	}
+	sources, last := common.AddDeviceSource(sources, source, requests, seen)
+	if last != nil {
+		log.Printf("device %s requested from %s, last seen from %s at %s", u, sourceAddr(source), sourceAddr(*last), last.LastSeen.UTC().Format(time.RFC3339))
+	}
+	if err := s.manager.SetDeviceSources(u, sources); err != nil {
+		if _, isNotFound := err.(*common.NotFoundError); !isNotFound {
+			log.Printf("error saving the sources of device %s: %v", u, err)
+		}
+	}
+}
+
+// sourceAddr the address of a source, with the addresses it was forwarded for, if any
+func sourceAddr(s common.DeviceSource) string {
+	if s.Forwarded == "" {
+		return s.IP
+	}
+	return fmt.Sprintf("%s (for %s)", s.IP, s.Forwarded)
+}
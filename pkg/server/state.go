@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lf-edge/adam/pkg/driver"
+)
+
+// stateImportPath the route restoring state snapshots, which holds the quiescer itself
+const stateImportPath = "/admin/import/state"
+
+// quiescer holds the requests that change the state of the server while a state snapshot is taken or restored, so
+// that the snapshot is of one point in time: every request of devices, and the admin requests other than GET
+type quiescer struct {
+	lock sync.RWMutex
+}
+
+// quiesceKey marks the context of a request already held, e.g. a dead letter replayed from an admin request, which
+// must not take the lock twice, as that waits behind a snapshot waiting for the first
+type quiesceKey struct{}
+
+// hold hold a request changing state, not a GET, while a snapshot is taken or restored, and the snapshots while it
+// is handled
+func (q *quiescer) hold(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions || r.URL.Path == stateImportPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		q.serve(next, w, r)
+	})
+}
+
+// holdAll hold every request, of any method, while a snapshot is taken or restored
+func (q *quiescer) holdAll(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q.serve(next, w, r)
+	})
+}
+
+func (q *quiescer) serve(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if held, _ := r.Context().Value(quiesceKey{}).(bool); held {
+		next.ServeHTTP(w, r)
+		return
+	}
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), quiesceKey{}, true)))
+}
+
+// stateExport stream a snapshot of the state of the server, as a tar.gz, with the telemetry of devices and the audit
+// log if asked for. The changes are held until it is sent; its manifest is last, so one cut short fails to verify
+func (h *adminHandler) stateExport(w http.ResponseWriter, r *http.Request) {
+	telemetry, _ := strconv.ParseBool(r.URL.Query().Get("telemetry"))
+	h.quiesce.lock.Lock()
+	defer h.quiesce.lock.Unlock()
+	start := time.Now()
+	w.Header().Set(contentType, mimeGzip)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="adam-state-%s.tar.gz"`, start.UTC().Format(exportFilenameLayout)))
+	w.WriteHeader(http.StatusOK)
+	manifest, err := driver.WriteState(h.managerFor(r), w, telemetry)
+	if err != nil {
+		// too late for an error status, the snapshot is left without its manifest
+		log.Printf("error taking state snapshot: %v", err)
+		return
+	}
+	log.Printf("took state snapshot of %d onboarding certificates and %d devices in %s", manifest.Onboard, manifest.Devices, time.Since(start))
+}
+
+// stateImport restore a state snapshot, verified against its checksums first, so that a damaged one changes nothing.
+// Unless replace is set, the database must have no onboarding certificates or devices
+func (h *adminHandler) stateImport(w http.ResponseWriter, r *http.Request) {
+	replace, _ := strconv.ParseBool(r.URL.Query().Get("replace"))
+	f, err := ioutil.TempFile("", "adam-state-*.tar.gz")
+	if err != nil {
+		log.Printf("error creating state snapshot file: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, r.Body); err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		log.Printf("error reading state snapshot file: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if _, err := driver.VerifyState(f); err != nil {
+		writeError(w, http.StatusBadRequest, ErrBadSnapshot, fmt.Sprintf("bad state snapshot: %v", err), nil)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		log.Printf("error reading state snapshot file: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	h.quiesce.lock.Lock()
+	manifest, err := driver.RestoreState(h.managerFor(r), f, replace)
+	h.quiesce.lock.Unlock()
+	if e, ok := err.(*driver.StateNotEmptyError); ok {
+		writeError(w, http.StatusConflict, ErrConflict, e.Error(), map[string]int{"onboard": e.Onboard, "devices": e.Devices})
+		return
+	}
+	if err != nil {
+		log.Printf("error restoring state snapshot: %v", err)
+		httpError(w, fmt.Sprintf("error restoring state snapshot, it may be partly restored: %v", err), http.StatusInternalServerError)
+		return
+	}
+	summary := map[string]interface{}{"created": manifest.Created, "driver": manifest.Driver, "onboard": manifest.Onboard, "devices": manifest.Devices, "telemetry": manifest.Telemetry, "replace": replace}
+	h.audit(r, auditStateRestore, "", nil, summary)
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		log.Printf("error converting state manifest to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
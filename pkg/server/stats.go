@@ -0,0 +1,339 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// statsWindow how far back the rolling counters of the requests of devices go
+	statsWindow = time.Hour
+	// statsBuckets buckets statsWindow is split in; the rolling counters move a bucket at a time
+	statsBuckets = 12
+	// maxErrorBody how much of the body of an error answer is kept to read its code and message
+	maxErrorBody = 4096
+	// configEndpoint route of the config devices poll
+	configEndpoint = "/api/v1/edgedevice/config"
+)
+
+// ingestKinds kind of message posted to each route of the device API, whose body bytes are counted
+var ingestKinds = map[string]string{
+	"/api/v1/edgedevice/info":                              common.KindInfo,
+	"/api/v1/edgedevice/metrics":                           common.KindMetrics,
+	"/api/v1/edgedevice/logs":                              common.KindLogs,
+	"/api/v1/edgedevice/newlogs":                           common.KindLogs,
+	"/api/v1/edgedevice/apps/instances/id/{uuid}/logs":     common.KindAppLogs,
+	"/api/v1/edgedevice/apps/instanceid/id/{uuid}/newlogs": common.KindAppLogs,
+}
+
+// Rolling a count over the last statsWindow and since the server started
+type Rolling struct {
+	Hour  uint64 `json:"hour"`
+	Total uint64 `json:"total"`
+}
+
+// StatsError the last request of a device that failed
+type StatsError struct {
+	Time time.Time `json:"time"`
+	// Endpoint the method and route of the request, e.g. POST /api/v1/edgedevice/info
+	Endpoint string `json:"endpoint"`
+	Status   int    `json:"status"`
+	// Code and Message those of the error answered, see ErrorResponse
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// DeviceStats counters of the requests of a device to the device API, kept in memory since the server started
+type DeviceStats struct {
+	UUID     string    `json:"uuid"`
+	LastSeen time.Time `json:"last-seen"`
+	// ConfigPolls requests for the config of the device
+	ConfigPolls Rolling `json:"config-polls"`
+	// Bytes bytes of the bodies of the messages of each kind posted, as sent, e.g. gzipped
+	Bytes map[string]Rolling `json:"bytes"`
+	// Requests requests per endpoint, as the method and route
+	Requests map[string]Rolling `json:"requests"`
+	// Errors requests answered with a 4xx or 5xx status
+	Errors    Rolling     `json:"errors"`
+	LastError *StatsError `json:"last-error,omitempty"`
+}
+
+// Stats counters of the requests of all devices, per endpoint and per device
+type Stats struct {
+	// Window how far back the hourly counters go, in seconds
+	Window    int64              `json:"window"`
+	Endpoints map[string]Rolling `json:"endpoints"`
+	Devices   []*DeviceStats     `json:"devices"`
+}
+
+// rollingCounter a count since the server started, and over statsWindow in statsBuckets
+type rollingCounter struct {
+	total  uint64
+	counts [statsBuckets]uint64
+	// slots the slot of time each bucket counts, 0 if never used
+	slots [statsBuckets]int64
+}
+
+// slot the slot of time a bucket counts, statsWindow/statsBuckets long
+func slot(t time.Time) int64 {
+	return t.UnixNano() / int64(statsWindow/statsBuckets)
+}
+
+func (c *rollingCounter) add(now time.Time, n uint64) {
+	s := slot(now)
+	i := s % statsBuckets
+	if c.slots[i] != s {
+		c.slots[i], c.counts[i] = s, 0
+	}
+	c.counts[i] += n
+	c.total += n
+}
+
+func (c *rollingCounter) rolling(now time.Time) Rolling {
+	r := Rolling{Total: c.total}
+	s := slot(now)
+	for i, bs := range c.slots {
+		if bs > s-statsBuckets && bs <= s {
+			r.Hour += c.counts[i]
+		}
+	}
+	return r
+}
+
+// deviceStats the counters of a device
+type deviceStats struct {
+	lastSeen    time.Time
+	configPolls rollingCounter
+	bytes       map[string]*rollingCounter
+	requests    map[string]*rollingCounter
+	errors      rollingCounter
+	lastError   *StatsError
+}
+
+// ingestStats counts the requests of devices to the device API, per endpoint and per device, in memory
+type ingestStats struct {
+	lock      sync.Mutex
+	devices   map[uuid.UUID]*deviceStats
+	endpoints map[string]*rollingCounter
+}
+
+func newIngestStats() *ingestStats {
+	return &ingestStats{
+		devices:   map[uuid.UUID]*deviceStats{},
+		endpoints: map[string]*rollingCounter{},
+	}
+}
+
+// statsKey key of the statsRequest of a request, in its context
+type statsKey struct{}
+
+// statsRequest what is learnt of a request while it is handled: the device it is from, once its cert is checked,
+// and the bytes of its body read
+type statsRequest struct {
+	device *uuid.UUID
+	bytes  uint64
+}
+
+// setStatsDevice record the device a request is from, for its counters
+func setStatsDevice(r *http.Request, u uuid.UUID) {
+	if sr, ok := r.Context().Value(statsKey{}).(*statsRequest); ok {
+		sr.device = &u
+	}
+}
+
+// countingBody a request body counting the bytes read from it
+type countingBody struct {
+	io.ReadCloser
+	sr *statsRequest
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.sr.bytes += uint64(n)
+	return n, err
+}
+
+// statsRecorder a ResponseWriter keeping the status answered, and the start of the body of an error
+type statsRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (s *statsRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statsRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if s.status >= 400 && len(s.body) < maxErrorBody {
+		n := maxErrorBody - len(s.body)
+		if n > len(b) {
+			n = len(b)
+		}
+		s.body = append(s.body, b[:n]...)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// observe count each request of the device API under its endpoint, and under its device once its cert is checked
+func (s *ingestStats) observe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &statsRequest{}
+		if r.Body != nil {
+			r.Body = &countingBody{ReadCloser: r.Body, sr: sr}
+		}
+		rec := &statsRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), statsKey{}, sr)))
+		tpl := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if t, err := route.GetPathTemplate(); err == nil {
+				tpl = t
+			}
+		}
+		s.record(time.Now(), r.Method, tpl, sr, rec)
+	})
+}
+
+// record count a request, with the status it was answered with
+func (s *ingestStats) record(now time.Time, method, tpl string, sr *statsRequest, rec *statsRecorder) {
+	endpoint := method + " " + tpl
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	counter(s.endpoints, endpoint).add(now, 1)
+	if sr.device == nil {
+		return
+	}
+	d, ok := s.devices[*sr.device]
+	if !ok {
+		d = &deviceStats{bytes: map[string]*rollingCounter{}, requests: map[string]*rollingCounter{}}
+		s.devices[*sr.device] = d
+	}
+	d.lastSeen = now
+	counter(d.requests, endpoint).add(now, 1)
+	if tpl == configEndpoint {
+		d.configPolls.add(now, 1)
+	}
+	if kind, ok := ingestKinds[tpl]; ok && sr.bytes > 0 {
+		counter(d.bytes, kind).add(now, sr.bytes)
+	}
+	if status >= 400 {
+		d.errors.add(now, 1)
+		e := &StatsError{Time: now, Endpoint: endpoint, Status: status}
+		var er ErrorResponse
+		if err := json.Unmarshal(rec.body, &er); err == nil {
+			e.Code, e.Message = er.Code, er.Message
+		}
+		d.lastError = e
+	}
+}
+
+// counter the counter of a key, added if there is none yet
+func counter(counters map[string]*rollingCounter, key string) *rollingCounter {
+	c, ok := counters[key]
+	if !ok {
+		c = &rollingCounter{}
+		counters[key] = c
+	}
+	return c
+}
+
+// snapshot the counters of every device, sorted by UUID, and of every endpoint, or those of one device if not nil
+func (s *ingestStats) snapshot(now time.Time, only *uuid.UUID) *Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := &Stats{Window: int64(statsWindow / time.Second), Endpoints: rollings(s.endpoints, now), Devices: []*DeviceStats{}}
+	for u, d := range s.devices {
+		if only != nil && u != *only {
+			continue
+		}
+		ds := &DeviceStats{
+			UUID:        u.String(),
+			LastSeen:    d.lastSeen,
+			ConfigPolls: d.configPolls.rolling(now),
+			Bytes:       rollings(d.bytes, now),
+			Requests:    rollings(d.requests, now),
+			Errors:      d.errors.rolling(now),
+		}
+		if d.lastError != nil {
+			e := *d.lastError
+			ds.LastError = &e
+		}
+		stats.Devices = append(stats.Devices, ds)
+	}
+	sort.Slice(stats.Devices, func(i, j int) bool { return stats.Devices[i].UUID < stats.Devices[j].UUID })
+	return stats
+}
+
+// totals the requests per endpoint since the server started
+func (s *ingestStats) totals() map[string]uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	totals := make(map[string]uint64, len(s.endpoints))
+	for e, c := range s.endpoints {
+		totals[e] = c.total
+	}
+	return totals
+}
+
+func rollings(counters map[string]*rollingCounter, now time.Time) map[string]Rolling {
+	r := make(map[string]Rolling, len(counters))
+	for k, c := range counters {
+		r[k] = c.rolling(now)
+	}
+	return r
+}
+
+// statsList report the counters of the requests of every device, and of every endpoint
+func (h *adminHandler) statsList(w http.ResponseWriter, r *http.Request) {
+	h.writeStats(w, h.stats.snapshot(time.Now(), nil))
+}
+
+// deviceStatsGet report the counters of the requests of a device, 404 if it sent none since the server started
+func (h *adminHandler) deviceStatsGet(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stats := h.stats.snapshot(time.Now(), &uid)
+	if len(stats.Devices) == 0 {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	h.writeStats(w, stats.Devices[0])
+}
+
+func (h *adminHandler) writeStats(w http.ResponseWriter, stats interface{}) {
+	body, err := json.Marshal(stats)
+	if err != nil {
+		log.Printf("error converting stats to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// errBodyTooLarge a request body read past the limit of its kind of message
+var errBodyTooLarge = errors.New("request body over the limit")
+
+// limitedBody a request body failing with errBodyTooLarge once read past its limit, rather than ending there as
+// io.LimitReader does
+type limitedBody struct {
+	r io.Reader
+	// remaining bytes that can still be read, below 0 once the body is over the limit
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// one byte past the limit, to tell it is over
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	return n, err
+}
+
+// streamLogBody the body of a request of a device sending a log bundle, to be read as it comes rather than at once,
+// so that only the entry being stored is in memory however large the bundle is. Reading it fails with
+// errBodyTooLarge past the limit of its kind of message, and a body declaring a length over it is answered 413
+// Request Entity Too Large right away. A bundle sent in parts is read whole, as readLogBody does, to reassemble it.
+// nil if the request was answered
+func (h *apiHandler) streamLogBody(w http.ResponseWriter, r *http.Request, u uuid.UUID, kind string) io.Reader {
+	if r.Header.Get(partHeader) != "" {
+		b := h.readLogBody(w, r, u, kind)
+		if b == nil {
+			return nil
+		}
+		return bytes.NewReader(b)
+	}
+	limit := h.bodyLimits.For(kind)
+	if limit <= 0 {
+		return r.Body
+	}
+	if r.ContentLength > limit {
+		bodyTooLarge(w, r, limit)
+		return nil
+	}
+	return &limitedBody{r: r.Body, remaining: limit}
+}
+
+// streamFailed answer a log bundle that could not be read as it came, with 413 Request Entity Too Large if it went
+// past the limit of its kind of message or one of its entries is over maxEntrySize, or 400. The entries before are
+// kept
+func (h *apiHandler) streamFailed(w http.ResponseWriter, r *http.Request, kind string, err error) {
+	if err == errBodyTooLarge {
+		bodyTooLarge(w, r, h.bodyLimits.For(kind))
+		return
+	}
+	scanFailed(w, err)
+}
+
+// protoEntryScanner a scanner of the entries of a protobuf message, those of one of its repeated message fields,
+// decoded one at a time from the wire format as they are read, skipping its other fields. Like bufio.Scanner, it
+// fails with bufio.ErrTooLong for an entry over maxEntrySize
+type protoEntryScanner struct {
+	r     *bufio.Reader
+	field protowire.Number
+	entry []byte
+	err   error
+}
+
+// newProtoEntryScanner a scanner of the entries of field of the protobuf message read from r
+func newProtoEntryScanner(r io.Reader, field protowire.Number) *protoEntryScanner {
+	return &protoEntryScanner{r: bufio.NewReader(r), field: field}
+}
+
+// Scan read the next entry, false once there are none left or reading failed
+func (s *protoEntryScanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	for {
+		tag, err := binary.ReadUvarint(s.r)
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			s.err = unexpectedEOF(err)
+			return false
+		}
+		num, typ := protowire.DecodeTag(tag)
+		if num == s.field && typ == protowire.BytesType {
+			if s.entry, err = s.readBytes(); err != nil {
+				s.err = err
+				return false
+			}
+			return true
+		}
+		if err := s.skip(typ); err != nil {
+			s.err = err
+			return false
+		}
+	}
+}
+
+// Bytes the entry read by the last call to Scan, valid until the next one
+func (s *protoEntryScanner) Bytes() []byte {
+	return s.entry
+}
+
+// Err the error reading failed with, nil if all entries were read
+func (s *protoEntryScanner) Err() error {
+	return s.err
+}
+
+// readBytes read a length-delimited value, up to maxEntrySize
+func (s *protoEntryScanner) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if n > maxEntrySize {
+		return nil, bufio.ErrTooLong
+	}
+	if uint64(cap(s.entry)) < n {
+		s.entry = make([]byte, n)
+	}
+	b := s.entry[:n]
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+// skip read past the value of a field of another number, without keeping it
+func (s *protoEntryScanner) skip(typ protowire.Type) error {
+	var n uint64
+	switch typ {
+	case protowire.VarintType:
+		_, err := binary.ReadUvarint(s.r)
+		return unexpectedEOF(err)
+	case protowire.Fixed32Type:
+		n = 4
+	case protowire.Fixed64Type:
+		n = 8
+	case protowire.BytesType:
+		var err error
+		if n, err = binary.ReadUvarint(s.r); err != nil {
+			return unexpectedEOF(err)
+		}
+	default:
+		return fmt.Errorf("unsupported protobuf wire type %d", typ)
+	}
+	if _, err := io.CopyN(ioutil.Discard, s.r, int64(n)); err != nil {
+		return unexpectedEOF(err)
+	}
+	return nil
+}
+
+// unexpectedEOF io.ErrUnexpectedEOF for io.EOF, as the message ended in the middle of a field
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// StreamCursorHeader header of a response of the first or last entries of a stream with the ID of the last entry
+// returned, to read the next page after it, or before it when read newest first
+const StreamCursorHeader = "X-Stream-Cursor"
+
+// streamRangeParams the query parameters of a range of the entries of a stream
+var streamRangeParams = []string{"after", "before", "since", "until", "first", "last", "reverse"}
+
+// parseStreamRange the range of the entries of a stream to read from the query of a request, nil for all of them
+func parseStreamRange(q url.Values) (*common.StreamRange, error) {
+	var found bool
+	for _, p := range streamRangeParams {
+		if q.Get(p) != "" {
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	rng := &common.StreamRange{After: q.Get("after"), Before: q.Get("before")}
+	for _, t := range []struct {
+		param string
+		value *time.Time
+	}{{"since", &rng.Since}, {"until", &rng.Until}} {
+		v := q.Get(t.param)
+		if v == "" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s %s, must be an RFC3339 time", t.param, v)
+		}
+		*t.value = at
+	}
+	for _, n := range []struct {
+		param string
+		value *int
+	}{{"first", &rng.First}, {"last", &rng.Last}} {
+		v := q.Get(n.param)
+		if v == "" {
+			continue
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 1 {
+			return nil, fmt.Errorf("bad %s %s, must be a positive number", n.param, v)
+		}
+		*n.value = i
+	}
+	if v := q.Get("reverse"); v != "" {
+		reverse, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad reverse %s", v)
+		}
+		rng.Reverse = reverse
+	}
+	if err := rng.Validate(); err != nil {
+		return nil, err
+	}
+	return rng, nil
+}
+
+// deviceRangeGet write the entries of a device in a range, through seek if the driver can, by reading all the
+// entries readerFunc reads otherwise. The first or last entries are buffered, so that the ID of the last is sent in
+// a header before them
+func (h *adminHandler) deviceRangeGet(w http.ResponseWriter, r *http.Request, rng common.StreamRange, seek func(driver.StreamSeeker, uuid.UUID, common.StreamRange) (common.RangeReader, error), readerFunc func(u uuid.UUID) (io.Reader, error)) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var reader common.RangeReader
+	if seeker, ok := h.manager.(driver.StreamSeeker); ok {
+		reader, err = seek(seeker, uid, rng)
+	} else if rng.Seeks() {
+		httpError(w, "reading from an entry or time is not supported by the "+h.manager.Name()+" driver", http.StatusNotImplemented)
+		return
+	} else {
+		var all io.Reader
+		all, err = readerFunc(uid)
+		if err == nil && all != nil {
+			reader, err = common.NewLineRange(all, rng)
+		}
+	}
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	case reader == nil:
+		httpError(w, "found device information, but logs were empty", http.StatusInternalServerError)
+		return
+	}
+	if rng.First == 0 && rng.Last == 0 {
+		w.Header().Set("Content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, reader); err != nil && err != io.EOF {
+			log.Printf("error reading entries of %s: %v", uid, err)
+		}
+		return
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, reader); err != nil && err != io.EOF {
+		log.Printf("error reading entries of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if last := reader.LastID(); last != "" {
+		w.Header().Set(StreamCursorHeader, last)
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// streamRange the range of a request for the entries of a stream, nil for all of them or when following new ones,
+// and whether the request can be served, a bad range having been answered
+func (h *adminHandler) streamRange(w http.ResponseWriter, r *http.Request) (*common.StreamRange, bool) {
+	if r.Header.Get(StreamHeader) == StreamValue {
+		return nil, true
+	}
+	rng, err := parseStreamRange(r.URL.Query())
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return rng, true
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/eve/api/go/logs"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// syslogSDID the ID of the structured data of the entries, with the example enterprise number of RFC 5612, as
+	// Adam has none of its own
+	syslogSDID = "eve@32473"
+	// syslogMaxUDPSize how long a message sent over UDP can be, longer ones being truncated, as RFC 5426 has receivers
+	// take at least that
+	syslogMaxUDPSize = 2048
+	// syslogDefaultFacility the facility of the entries, unless the URL sets one
+	syslogDefaultFacility = 16
+)
+
+// syslogFacilities the facilities of RFC 5424 by name, as the URL can set them
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7, "uucp": 8, "cron": 9,
+	"authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14, "solaris-cron": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverity the severity of RFC 5424 of an EVE severity, informational for those it does not know
+func syslogSeverity(severity string) int {
+	switch strings.ToLower(severity) {
+	case "panic", "emerg", "emergency":
+		return 0
+	case "alert":
+		return 1
+	case "fatal", "crit", "critical":
+		return 2
+	case "error", "err":
+		return 3
+	case "warning", "warn":
+		return 4
+	case "notice":
+		return 5
+	case "debug", "trace":
+		return 7
+	}
+	return 6
+}
+
+// syslogEntry a log entry to forward, of a device or of one of its app instances
+type syslogEntry struct {
+	device string
+	app    string
+	entry  *logs.LogEntry
+	time   time.Time
+}
+
+// syslogExporter forward the logs of devices and their app instances to a syslog server, as RFC 5424 messages over
+// UDP, TCP or TLS, in batches, in the background. The host of each message is the UUID of its device, the app name its
+// source, and its structured data has the device, the app instance for app logs, the source and the severity
+type syslogExporter struct {
+	*egress
+	url      string
+	network  string
+	addr     string
+	tls      *tls.Config
+	facility int
+	// conn the connection to the server, kept between batches, nil until dialed or once it failed
+	conn net.Conn
+}
+
+// newSyslogExporter an exporter to the syslog server at a udp://, tcp:// or tls:// URL, with its facility as
+// ?facility=<name or number>, trusting the CA certificates in a PEM file for the certificate of a tls:// server if
+// not empty. The port defaults to 514, or 6514 with TLS
+func newSyslogExporter(rawURL, caPath string) (*syslogExporter, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad syslog URL %s: %v", rawURL, err)
+	}
+	s := &syslogExporter{url: u.Redacted(), facility: syslogDefaultFacility}
+	port := "514"
+	switch u.Scheme {
+	case "udp", "tcp":
+		s.network = u.Scheme
+	case "tls":
+		s.network, port = "tcp", "6514"
+		s.tls = &tls.Config{ServerName: u.Hostname()}
+		if caPath != "" {
+			if s.tls.RootCAs, err = loadCAs("syslog", caPath); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s.network == "" || u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("bad syslog URL %s: must be udp://, tcp:// or tls://host[:port]", rawURL)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	s.addr = net.JoinHostPort(u.Hostname(), port)
+	if f := u.Query().Get("facility"); f != "" {
+		n, ok := syslogFacilities[strings.ToLower(f)]
+		if !ok {
+			if n, err = strconv.Atoi(f); err != nil || n < 0 || n > 23 {
+				return nil, fmt.Errorf("bad syslog facility %s: must be a name, e.g. local0, or 0 to 23", f)
+			}
+		}
+		s.facility = n
+	}
+	s.egress = newEgress("syslog", "log entries", s.send)
+	return s, nil
+}
+
+// push queue a log entry of a device, or of one of its app instances if app is not empty, dropping it if the queue
+// is full. It does nothing without an exporter
+func (s *syslogExporter) push(device uuid.UUID, app string, entry *logs.LogEntry) {
+	if s == nil {
+		return
+	}
+	e := syslogEntry{device: device.String(), app: app, entry: entry, time: time.Now()}
+	if ts := entry.GetTimestamp(); ts != nil {
+		e.time = ts.AsTime()
+	}
+	s.add(e)
+}
+
+// send write a batch, over the connection kept if it is still up, returning whether to retry it if it failed, which
+// it always is, as syslog servers refuse nothing. Over TCP and TLS, the entries of a batch written before it failed
+// are written again
+func (s *syslogExporter) send(batch []interface{}) (bool, error) {
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return true, err
+		}
+		s.conn = conn
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(egressPushTimeout)); err != nil {
+		return true, s.fail(err)
+	}
+	var buf bytes.Buffer
+	for _, item := range batch {
+		msg := syslogMessage(item.(syslogEntry), s.facility)
+		if s.network == "udp" {
+			if len(msg) > syslogMaxUDPSize {
+				msg = msg[:syslogMaxUDPSize]
+			}
+			if _, err := s.conn.Write(msg); err != nil {
+				return true, s.fail(err)
+			}
+			continue
+		}
+		// octet counting, as RFC 6587 and RFC 5425 frame messages
+		buf.WriteString(strconv.Itoa(len(msg)))
+		buf.WriteByte(' ')
+		buf.Write(msg)
+	}
+	if buf.Len() > 0 {
+		if _, err := s.conn.Write(buf.Bytes()); err != nil {
+			return true, s.fail(err)
+		}
+	}
+	return false, nil
+}
+
+// dial connect to the server
+func (s *syslogExporter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: egressPushTimeout}
+	if s.tls != nil {
+		return tls.DialWithDialer(dialer, s.network, s.addr, s.tls)
+	}
+	return dialer.Dial(s.network, s.addr)
+}
+
+// fail close the connection after an error, for the next batch to dial again
+func (s *syslogExporter) fail(err error) error {
+	s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// syslogMessage the RFC 5424 message of an entry
+func syslogMessage(e syslogEntry, facility int) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s - [%s device=\"%s\"", facility*8+syslogSeverity(e.entry.GetSeverity()),
+		e.time.UTC().Format("2006-01-02T15:04:05.000000Z"), e.device, syslogName(e.entry.GetSource(), 48),
+		syslogName(e.entry.GetIid(), 128), syslogSDID, e.device)
+	for _, param := range [][2]string{{"app", e.app}, {"source", e.entry.GetSource()}, {"severity", strings.ToLower(e.entry.GetSeverity())}} {
+		if param[1] != "" {
+			fmt.Fprintf(&b, " %s=\"%s\"", param[0], syslogEscape(param[1]))
+		}
+	}
+	b.WriteString("] ")
+	b.WriteString(strings.TrimRight(e.entry.GetContent(), "\r\n"))
+	return b.Bytes()
+}
+
+// syslogName a header field of a message: printable ASCII without spaces, others replaced by _, up to a length, or -
+// if empty
+func syslogName(s string, max int) string {
+	if s == "" {
+		return "-"
+	}
+	b := []byte(s)
+	if len(b) > max {
+		b = b[:max]
+	}
+	for i, c := range b {
+		if c < 33 || c > 126 {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// syslogEscape a value of the structured data, with ", \ and ] escaped
+func syslogEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	authorizationHeader = "Authorization"
+	bearerScheme        = "Bearer "
+)
+
+// TokenRequest body of a request to create an admin API token
+type TokenRequest struct {
+	Name string `json:"name,omitempty"`
+	// Devices UUIDs of the devices the token is limited to, empty for all of them
+	Devices []string `json:"devices,omitempty"`
+	// ReadOnly whether the token is limited to GET requests
+	ReadOnly bool `json:"read-only,omitempty"`
+	// Expires when the token stops being accepted, nil for never
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// TokenResponse a newly created admin API token, the only time the token itself is returned
+type TokenResponse struct {
+	*common.APIToken
+	Token string `json:"token"`
+}
+
+// tokenKey key of the API token a request was authenticated with, in its context
+type tokenKey struct{}
+
+// requestToken the API token a request was authenticated with, nil if none
+func requestToken(r *http.Request) *common.APIToken {
+	t, _ := r.Context().Value(tokenKey{}).(*common.APIToken)
+	return t
+}
+
+// adminCertKey key of the client certificate a request was authenticated with, verified against the admin CAs, in
+// its context
+type adminCertKey struct{}
+
+// requestAdminCert the client certificate a request was authenticated with, nil if it had none signed by an admin CA
+func requestAdminCert(r *http.Request) *x509.Certificate {
+	c, _ := r.Context().Value(adminCertKey{}).(*x509.Certificate)
+	return c
+}
+
+// authenticate check the API token of an admin request and that it allows the request, if there is one. Without
+// a token, the client certificate must be signed by one of the admin CAs, unless authentication is not required or
+// the request came in on the admin socket
+func (h *adminHandler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get(authorizationHeader); header != "" {
+			token, status, err := h.checkToken(r, header)
+			if err != nil {
+				log.Printf("rejected admin request for %s: %v", r.URL.Path, err)
+				code := ErrInvalidToken
+				if status != http.StatusUnauthorized {
+					code = statusCode(status)
+				}
+				writeError(w, status, code, http.StatusText(status), nil)
+				return
+			}
+			if err := tokenAllows(token, r); err != nil {
+				httpError(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+			return
+		}
+		if h.adminCAs != nil {
+			err := verifyAdminCert(r, h.adminCAs)
+			if err == nil {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminCertKey{}, r.TLS.PeerCertificates[0])))
+				return
+			}
+			if h.requireAuth {
+				log.Printf("rejected admin request for %s: %v", r.URL.Path, err)
+			}
+		}
+		if !h.requireAuth || fromSocket(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="adam"`)
+		httpError(w, "admin API token or client certificate required", http.StatusUnauthorized)
+	})
+}
+
+// checkToken get the API token from an Authorization header and check its secret, with the status to reject the
+// request with if it fails
+func (h *adminHandler) checkToken(r *http.Request, header string) (*common.APIToken, int, error) {
+	if len(header) < len(bearerScheme) || !strings.EqualFold(header[:len(bearerScheme)], bearerScheme) {
+		return nil, http.StatusUnauthorized, fmt.Errorf("unsupported authorization scheme")
+	}
+	id, secret, err := common.ParseAPIToken(strings.TrimSpace(header[len(bearerScheme):]))
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	token, err := common.TokenGet(h.managerFor(r), id)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		return nil, http.StatusUnauthorized, fmt.Errorf("unknown API token %s", id)
+	case err != nil:
+		return nil, http.StatusInternalServerError, fmt.Errorf("error getting API token %s: %v", id, err)
+	}
+	if err := token.Verify(secret, time.Now()); err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	return token, http.StatusOK, nil
+}
+
+// tokenAllows check that the scope of a token covers a request. A token limited to devices can only reach the
+// endpoints of those devices, and list and search them
+func tokenAllows(token *common.APIToken, r *http.Request) error {
+	if token.ReadOnly && !isRead(r) {
+		return fmt.Errorf("API token %s is read-only", token.ID)
+	}
+	if len(token.Devices) == 0 {
+		return nil
+	}
+	if u, ok := mux.Vars(r)["uuid"]; ok {
+		if !token.AllowsDevice(u) {
+			return fmt.Errorf("API token %s does not allow device %s", token.ID, u)
+		}
+		return nil
+	}
+	if tpl, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+		switch {
+		// listing and searching devices only return those of the token
+		case (tpl == "/admin/device" || tpl == "/admin/inventory") && r.Method == http.MethodGet:
+			return nil
+		// the Grafana datasource only lists and queries the devices of the token
+		case strings.HasPrefix(tpl, grafanaPath):
+			return nil
+		// a secondary syncs, and forwards the telemetry of, the devices of the token only
+		case tpl == federationSyncPath && r.Method == http.MethodGet, tpl == federationTelemetryPath && r.Method == http.MethodPost:
+			return nil
+		}
+	}
+	return fmt.Errorf("API token %s is limited to devices", token.ID)
+}
+
+// verifyAdminCert check that the client certificate of a request is signed by one of the admin CAs
+func verifyAdminCert(r *http.Request, roots *x509.CertPool) error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	cert := r.TLS.PeerCertificates[0]
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("client certificate %s not valid for admin: %v", cert.Subject.CommonName, err)
+	}
+	return nil
+}
+
+// loadAdminCAs load the CA certificates whose client certificates have full access to the admin API
+func loadAdminCAs(p string) (*x509.CertPool, error) {
+	return loadCAs("admin", p)
+}
+
+// loadCAs load the PEM CA certificates of a path, for what they are named in errors
+func loadCAs(what, p string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s CA %s: %v", what, p, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s CA %s", what, p)
+	}
+	return pool, nil
+}
+
+// tokenSummary summary of a token for the audit log, without its hash
+func tokenSummary(t *common.APIToken) map[string]interface{} {
+	return map[string]interface{}{"name": t.Name, "devices": t.Devices, "read-only": t.ReadOnly, "expires": t.Expires}
+}
+
+func (h *adminHandler) tokenList(w http.ResponseWriter, r *http.Request) {
+	tokens, err := common.TokenList(h.managerFor(r))
+	if err != nil {
+		log.Printf("error listing API tokens: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	for _, t := range tokens {
+		t.Hash = ""
+	}
+	body, err := json.Marshal(tokens)
+	if err != nil {
+		log.Printf("error converting API tokens to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// tokenAdd create an API token, returning it. Only its hash is stored, so it cannot be retrieved later
+func (h *adminHandler) tokenAdd(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req TokenRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		httpError(w, fmt.Sprintf("bad token request: %v", err), http.StatusBadRequest)
+		return
+	}
+	devices := make([]string, 0, len(req.Devices))
+	for _, d := range req.Devices {
+		u, err := uuid.FromString(d)
+		if err != nil {
+			httpError(w, fmt.Sprintf("bad device UUID %s: %v", d, err), http.StatusBadRequest)
+			return
+		}
+		devices = append(devices, u.String())
+	}
+	if req.Expires != nil && req.Expires.Before(time.Now()) {
+		httpError(w, fmt.Sprintf("token would expire in the past, at %s", req.Expires.Format(time.RFC3339)), http.StatusBadRequest)
+		return
+	}
+	t, s, err := common.NewAPIToken(req.Name, devices, req.ReadOnly, req.Expires)
+	if err != nil {
+		log.Printf("error creating API token: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := common.TokenAdd(h.managerFor(r), t); err != nil {
+		log.Printf("error saving API token: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditTokenAdd, t.ID, nil, tokenSummary(t))
+	t.Hash = ""
+	body, err = json.Marshal(TokenResponse{APIToken: t, Token: s})
+	if err != nil {
+		log.Printf("error converting API token to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+// tokenRemove remove an API token, so that it is no longer accepted
+func (h *adminHandler) tokenRemove(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !common.ValidTokenID(id) {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	var before interface{}
+	if t, err := common.TokenGet(h.managerFor(r), id); err == nil {
+		before = tokenSummary(t)
+	}
+	err := common.TokenRemove(h.managerFor(r), id)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case err != nil:
+		log.Printf("error removing API token: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		h.audit(r, auditTokenRemove, id, before, nil)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// DefaultDeviceRetention how long devices deleted softly are kept before they are removed for good, unless set
+	// otherwise
+	DefaultDeviceRetention = 7 * 24 * time.Hour
+	// purgeInterval how often to look for devices deleted softly whose retention is over
+	purgeInterval = time.Minute
+	// retentionActor actor of the audit records of devices removed at the end of their retention
+	retentionActor = "retention"
+)
+
+// deviceSoftRemove mark a device deleted, so that it is refused, keeping its data until the retention is over.
+// The retention is the one of the server, unless the request sets one in seconds
+func (h *adminHandler) deviceSoftRemove(w http.ResponseWriter, r *http.Request, u uuid.UUID, before interface{}) {
+	if before == nil {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	retention := h.retention
+	if v := r.URL.Query().Get("retention"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			httpError(w, "retention must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+		retention = time.Duration(n) * time.Second
+	}
+	now := time.Now().UTC()
+	ts := &common.Tombstone{
+		UUID:    u.String(),
+		Deleted: now,
+		Expires: now.Add(retention),
+		Actor:   auditActor(r),
+	}
+	if err := common.TombstoneAdd(h.managerFor(r), ts); err != nil {
+		log.Printf("error deleting device %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditDeviceRemove, u.String(), before, map[string]interface{}{"soft": true, "expires": ts.Expires})
+	writeTombstone(w, ts)
+}
+
+// deviceRestore restore a device deleted softly, before its retention is over
+func (h *adminHandler) deviceRestore(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	if _, err := uuid.FromString(u); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ts, err := common.TombstoneGet(h.managerFor(r), u)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, "device is not deleted", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting tombstone of device %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := common.TombstoneRemove(h.managerFor(r), u); err != nil {
+		log.Printf("error restoring device %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditDeviceRestore, u, map[string]interface{}{"deleted": ts.Deleted, "expires": ts.Expires}, nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// purgeDeleted remove for good the devices deleted softly whose retention is over, every interval until done is
+// closed
+func (h *adminHandler) purgeDeleted(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		tombstones, err := common.TombstoneList(h.manager)
+		if err != nil {
+			log.Printf("error listing deleted devices: %v", err)
+			continue
+		}
+		now := time.Now()
+		for _, ts := range tombstones {
+			if !ts.Expired(now) {
+				continue
+			}
+			if err := purgeDevice(h.manager, ts); err != nil {
+				log.Printf("error removing deleted device %s: %v", ts.UUID, err)
+				continue
+			}
+			log.Printf("removed device %s, deleted on %s", ts.UUID, ts.Deleted.Format(time.RFC3339))
+		}
+	}
+}
+
+// purgeDevice remove a device deleted softly, then its tombstone, so that a failure is retried
+func purgeDevice(m driver.DeviceManager, ts *common.Tombstone) error {
+	u, err := uuid.FromString(ts.UUID)
+	if err != nil {
+		return common.TombstoneRemove(m, ts.UUID)
+	}
+	if err := m.DeviceRemove(&u); err != nil {
+		if _, ok := err.(*common.NotFoundError); !ok {
+			return err
+		}
+	}
+	if err := common.TombstoneRemove(m, ts.UUID); err != nil {
+		return err
+	}
+	writeAudit(m, AuditRecord{
+		Timestamp: time.Now(),
+		Actor:     retentionActor,
+		Action:    auditDeviceRemove,
+		Target:    ts.UUID,
+		Before:    map[string]interface{}{"deleted": ts.Deleted, "expires": ts.Expires},
+	})
+	return nil
+}
+
+func writeTombstone(w http.ResponseWriter, ts *common.Tombstone) {
+	body, err := json.Marshal(ts)
+	if err != nil {
+		log.Printf("error converting tombstone to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
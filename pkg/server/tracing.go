@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceRequest start a span for each request, named for its route, continuing any trace propagated by the client
+func traceRequest(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "adam", otelhttp.WithSpanNameFormatter(routeName))
+}
+
+// routeName name of the span of a request, e.g. "GET /api/v1/edgedevice/config", so that all the requests to an
+// endpoint share it whatever its variables
+func routeName(_ string, r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return r.Method + " " + tpl
+		}
+	}
+	return r.Method
+}
+
+// traced the DeviceManager to handle a request with, tracing its operations under the span of the request, if any
+func traced(r *http.Request, m driver.DeviceManager) driver.DeviceManager {
+	if !trace.SpanFromContext(r.Context()).IsRecording() {
+		return m
+	}
+	return driver.Traced(r.Context(), m)
+}
+
+// managerFor the DeviceManager to handle a request with
+func (h *apiHandler) managerFor(r *http.Request) driver.DeviceManager {
+	return traced(r, h.manager)
+}
+
+// managerFor the DeviceManager to handle a request with
+func (h *adminHandler) managerFor(r *http.Request) driver.DeviceManager {
+	return traced(r, h.manager)
+}
+
+// managerFor the DeviceManager to handle a request with
+func (h *profileHandler) managerFor(r *http.Request) driver.DeviceManager {
+	return traced(r, h.manager)
+}
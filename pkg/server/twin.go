@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// deviceTwinGet get the twin of a device: the config it is served, the state it last reported, and whether each
+// section of the config is in sync with the state
+func (h *adminHandler) deviceTwinGet(w http.ResponseWriter, r *http.Request) {
+	u := mux.Vars(r)["uuid"]
+	uid, err := uuid.FromString(u)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the config the device is served, with its hardware model, is what it acknowledges
+	conf, b, err := servedConfig(h.managerFor(r), uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting device config: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	ack, err := h.managerFor(r).GetConfigAck(uid)
+	if err != nil {
+		log.Printf("error getting config ack of %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	inv, err := h.managerFor(r).GetInventory(uid)
+	if err != nil {
+		log.Printf("error getting inventory of %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	q, err := h.managerFor(r).GetQuarantine(uid)
+	if err != nil {
+		log.Printf("error getting quarantine of %s: %v", u, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	twin := common.NewTwin(b, conf, configHash(conf), ack, inv)
+	twin.Quarantine = q
+	body, err := json.Marshal(twin)
+	if err != nil {
+		log.Printf("error converting twin to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
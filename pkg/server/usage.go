@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lf-edge/adam/pkg/driver"
+	"github.com/lf-edge/adam/pkg/driver/common"
+	uuid "github.com/satori/go.uuid"
+)
+
+// usageReporter the driver, if it can report the storage used by devices, answering 501 Not Implemented otherwise
+func (h *adminHandler) usageReporter(w http.ResponseWriter) (driver.UsageReporter, bool) {
+	ur, ok := h.manager.(driver.UsageReporter)
+	if !ok {
+		httpError(w, "storage usage not supported by the "+h.manager.Name()+" driver", http.StatusNotImplemented)
+	}
+	return ur, ok
+}
+
+// deviceUsageGet report the storage used by each kind of message of a device
+func (h *adminHandler) deviceUsageGet(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.FromString(mux.Vars(r)["uuid"])
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ur, ok := h.usageReporter(w)
+	if !ok {
+		return
+	}
+	usage, err := ur.DeviceUsage(uid)
+	_, isNotFound := err.(*common.NotFoundError)
+	switch {
+	case err != nil && isNotFound:
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("error getting storage usage of %s: %v", uid, err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.writeUsage(w, usage)
+}
+
+// usageList report the storage used by every device, those using the most first. With kind, devices are ranked by
+// the bytes of that kind of message only, and with limit, only that many are reported
+func (h *adminHandler) usageList(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	if kind != "" && !validUsageKind(kind) {
+		httpError(w, fmt.Sprintf("unknown kind %s", kind), http.StatusBadRequest)
+		return
+	}
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			httpError(w, fmt.Sprintf("bad limit %s", l), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	ur, ok := h.usageReporter(w)
+	if !ok {
+		return
+	}
+	uids, err := h.manager.DeviceList()
+	if err != nil {
+		log.Printf("error listing devices: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	usages := make([]*common.DeviceUsage, 0, len(uids))
+	for _, u := range uids {
+		if u == nil {
+			continue
+		}
+		usage, err := ur.DeviceUsage(*u)
+		switch err.(type) {
+		case nil:
+			usages = append(usages, usage)
+		case *common.NotFoundError:
+			// removed since it was listed
+		default:
+			log.Printf("error getting storage usage of %s: %v", u, err)
+			httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	bytes := func(u *common.DeviceUsage) int64 {
+		if kind != "" {
+			return u.Kinds[kind].Bytes
+		}
+		return u.Bytes
+	}
+	sort.SliceStable(usages, func(i, j int) bool {
+		if bi, bj := bytes(usages[i]), bytes(usages[j]); bi != bj {
+			return bi > bj
+		}
+		return usages[i].UUID < usages[j].UUID
+	})
+	if limit > 0 && len(usages) > limit {
+		usages = usages[:limit]
+	}
+	h.writeUsage(w, usages)
+}
+
+func (h *adminHandler) writeUsage(w http.ResponseWriter, usage interface{}) {
+	body, err := json.Marshal(usage)
+	if err != nil {
+		log.Printf("error converting storage usage to json: %v", err)
+		httpError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentType, mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// validUsageKind whether kind is one whose storage is reported
+func validUsageKind(kind string) bool {
+	for _, k := range common.UsageKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,499 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package simulator simulates EVE devices against a running adam, to load test it: each device registers with an
+// onboarding certificate, then polls its config and sends info, metrics and logs at intervals, while the latency of
+// each request is recorded
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	mrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ax "github.com/lf-edge/adam/pkg/x509"
+	"github.com/lf-edge/eve/api/go/auth"
+	"github.com/lf-edge/eve/api/go/certs"
+	"github.com/lf-edge/eve/api/go/config"
+	eveuuid "github.com/lf-edge/eve/api/go/eveuuid"
+	"github.com/lf-edge/eve/api/go/info"
+	"github.com/lf-edge/eve/api/go/logs"
+	"github.com/lf-edge/eve/api/go/metrics"
+	"github.com/lf-edge/eve/api/go/register"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	mimeProto = "application/x-proto-binary"
+
+	// defaults of the settings left empty
+	DefaultConfigInterval  = time.Minute
+	DefaultInfoInterval    = 10 * time.Minute
+	DefaultMetricsInterval = time.Minute
+	DefaultLogsInterval    = 10 * time.Second
+	DefaultLogEntries      = 10
+	DefaultTimeout         = 30 * time.Second
+)
+
+// Config settings of a simulation. Intervals of 0 mean their default, and negative ones not to make the request
+type Config struct {
+	// URL of adam, as https://host:port
+	URL string
+	// Onboard onboarding certificate and key the devices register with
+	Onboard tls.Certificate
+	// RootCAs CAs to verify the certificate of adam with; nil means those of the system
+	RootCAs *x509.CertPool
+	// Insecure whether not to verify the certificate of adam
+	Insecure bool
+	// Devices how many devices to simulate
+	Devices int
+	// SerialPrefix prefix of the serials of the devices, followed by their number; empty means a random one, as
+	// serials cannot be registered twice with the same onboarding certificate
+	SerialPrefix string
+	// RampUp how long to take to start all the devices, started at even intervals; 0 means all at once
+	RampUp time.Duration
+	// Duration how long the simulation runs once all the devices are started
+	Duration time.Duration
+	// ConfigInterval how often each device polls its config
+	ConfigInterval time.Duration
+	// InfoInterval how often each device sends its info
+	InfoInterval time.Duration
+	// MetricsInterval how often each device sends its metrics
+	MetricsInterval time.Duration
+	// LogsInterval how often each device sends a log bundle, of LogEntries entries
+	LogsInterval time.Duration
+	LogEntries   int
+	// Timeout how long a request can take
+	Timeout time.Duration
+	// Progress called with the results so far every ProgressInterval, if set
+	Progress         func(*Report)
+	ProgressInterval time.Duration
+}
+
+// setDefaults fill in the settings left empty
+func (c *Config) setDefaults() error {
+	if !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("invalid URL %s: must be https://host[:port]", c.URL)
+	}
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	if len(c.Onboard.Certificate) == 0 {
+		return errors.New("an onboarding certificate is required")
+	}
+	if c.Devices <= 0 {
+		return errors.New("at least one device is required")
+	}
+	if c.Duration <= 0 {
+		return errors.New("a duration is required")
+	}
+	if c.SerialPrefix == "" {
+		b := make([]byte, 3)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("unable to generate serial prefix: %v", err)
+		}
+		c.SerialPrefix = "sim-" + hex.EncodeToString(b) + "-"
+	}
+	for _, d := range []struct {
+		interval *time.Duration
+		def      time.Duration
+	}{
+		{&c.ConfigInterval, DefaultConfigInterval},
+		{&c.InfoInterval, DefaultInfoInterval},
+		{&c.MetricsInterval, DefaultMetricsInterval},
+		{&c.LogsInterval, DefaultLogsInterval},
+		{&c.Timeout, DefaultTimeout},
+	} {
+		if *d.interval == 0 {
+			*d.interval = d.def
+		}
+	}
+	if c.LogEntries <= 0 {
+		c.LogEntries = DefaultLogEntries
+	}
+	return nil
+}
+
+// Run simulate the devices until the simulation is over or ctx is done, returning the results
+func Run(ctx context.Context, c Config) (*Report, error) {
+	if err := c.setDefaults(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.RampUp+c.Duration)
+	defer cancel()
+
+	start := time.Now()
+	rec := newRecorder()
+	var registered int32
+	report := func() *Report {
+		return &Report{
+			Devices:    c.Devices,
+			Registered: int(atomic.LoadInt32(&registered)),
+			Elapsed:    time.Since(start),
+			Operations: rec.stats(),
+			Errors:     rec.errorExamples(),
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.Devices; i++ {
+		d := &device{
+			c:      &c,
+			rec:    rec,
+			serial: fmt.Sprintf("%s%d", c.SerialPrefix, i),
+		}
+		delay := time.Duration(0)
+		if c.Devices > 1 {
+			delay = c.RampUp * time.Duration(i) / time.Duration(c.Devices)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			if err := d.register(ctx); err != nil {
+				return
+			}
+			atomic.AddInt32(&registered, 1)
+			d.run(ctx)
+		}()
+	}
+
+	if c.Progress != nil && c.ProgressInterval > 0 {
+		ticker := time.NewTicker(c.ProgressInterval)
+		defer ticker.Stop()
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					c.Progress(report())
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return report(), nil
+}
+
+// errorExamples the first error of each operation that failed
+func (r *recorder) errorExamples() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.examples) == 0 {
+		return nil
+	}
+	examples := map[string]string{}
+	for op, e := range r.examples {
+		examples[op] = e
+	}
+	return examples
+}
+
+// device a simulated device
+type device struct {
+	c      *Config
+	rec    *recorder
+	serial string
+	client *http.Client
+	uuid   string
+	// hash of the config last received, sent with config requests so that an unchanged config is not sent again
+	configHash string
+	bootTime   time.Time
+}
+
+// register generate the certificate of the device and register it, then get the UUID it was given
+func (d *device) register(ctx context.Context) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		d.rec.record(OpRegister, 0, err)
+		return err
+	}
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: d.serial},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		d.rec.record(OpRegister, 0, err)
+		return err
+	}
+
+	onboard := d.newClient(d.c.Onboard)
+	defer onboard.CloseIdleConnections()
+	msg := &register.ZRegisterMsg{
+		PemCert: []byte(base64.StdEncoding.EncodeToString(ax.PemEncodeCert(der))),
+		Serial:  d.serial,
+	}
+	if _, _, err := d.post(ctx, onboard, OpRegister, "/api/v1/edgedevice/register", msg, http.StatusCreated); err != nil {
+		return err
+	}
+
+	d.client = d.newClient(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+	signing, err := d.controllerCert(ctx)
+	if err != nil {
+		return err
+	}
+	payload, err := proto.Marshal(&eveuuid.UuidRequest{})
+	if err != nil {
+		d.rec.record(OpUUID, 0, err)
+		return err
+	}
+	request, err := ax.SignAuthContainer(payload, key, der)
+	if err != nil {
+		d.rec.record(OpUUID, 0, err)
+		return err
+	}
+	b, _, err := d.post(ctx, d.client, OpUUID, "/api/v2/edgedevice/uuid", request, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	var response eveuuid.UuidResponse
+	if err := readAuthContainer(b, signing, &response); err != nil {
+		d.rec.record(OpUUID, 0, fmt.Errorf("invalid uuid response: %v", err))
+		return err
+	}
+	d.uuid = response.Uuid
+	d.bootTime = time.Now()
+	return nil
+}
+
+// controllerCert get the certificates of adam, as EVE does on the v2 API, returning the one whose key signs its
+// responses
+func (d *device) controllerCert(ctx context.Context) (*x509.Certificate, error) {
+	b, _, err := d.do(ctx, d.client, OpCerts, http.MethodGet, "/api/v2/edgedevice/certs", nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var msg certs.ZControllerCert
+	// the certificates are signed by the one they have, which there is nothing yet to check against
+	if err = readAuthContainer(b, nil, &msg); err == nil {
+		err = errors.New("no controller signing certificate")
+		for _, c := range msg.Certs {
+			if c.Type == certs.ZCertType_CERT_TYPE_CONTROLLER_SIGNING {
+				var cert *x509.Certificate
+				if cert, err = ax.ParseCert(c.Cert); err == nil {
+					return cert, nil
+				}
+				break
+			}
+		}
+	}
+	err = fmt.Errorf("invalid certs response: %v", err)
+	d.rec.record(OpCerts, 0, err)
+	return nil, err
+}
+
+// readAuthContainer unmarshal into msg the payload of an AuthContainer, checked to be signed by the key of signing
+// unless it is nil
+func readAuthContainer(b []byte, signing *x509.Certificate, msg proto.Message) error {
+	var container auth.AuthContainer
+	if err := proto.Unmarshal(b, &container); err != nil {
+		return err
+	}
+	payload := container.GetProtectedPayload().GetPayload()
+	if signing != nil {
+		var err error
+		if payload, err = ax.VerifyAuthContainer(&container, signing); err != nil {
+			return err
+		}
+	}
+	return proto.Unmarshal(payload, msg)
+}
+
+// newClient a client of adam presenting a client certificate, with connections of its own, as a device has
+func (d *device) newClient(cert tls.Certificate) *http.Client {
+	return &http.Client{
+		Timeout: d.c.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates:       []tls.Certificate{cert},
+				RootCAs:            d.c.RootCAs,
+				InsecureSkipVerify: d.c.Insecure,
+			},
+			MaxIdleConnsPerHost: 1,
+		},
+	}
+}
+
+// run poll the config and send info, metrics and logs at their intervals, starting at a random point of each
+// interval so that the devices do not make their requests together, until ctx is done
+func (d *device) run(ctx context.Context) {
+	defer d.client.CloseIdleConnections()
+	type periodic struct {
+		interval time.Duration
+		send     func(context.Context)
+		next     time.Time
+	}
+	tasks := []*periodic{
+		{interval: d.c.ConfigInterval, send: d.pollConfig},
+		{interval: d.c.InfoInterval, send: d.sendInfo},
+		{interval: d.c.MetricsInterval, send: d.sendMetrics},
+		{interval: d.c.LogsInterval, send: d.sendLogs},
+	}
+	now := time.Now()
+	for _, t := range tasks {
+		if t.interval > 0 {
+			t.next = now.Add(time.Duration(mrand.Int63n(int64(t.interval))))
+		}
+	}
+	// the config and info are sent on boot
+	d.pollConfig(ctx)
+	d.sendInfo(ctx)
+	for {
+		var due *periodic
+		for _, t := range tasks {
+			if t.interval > 0 && (due == nil || t.next.Before(due.next)) {
+				due = t
+			}
+		}
+		if due == nil {
+			<-ctx.Done()
+			return
+		}
+		select {
+		case <-time.After(time.Until(due.next)):
+		case <-ctx.Done():
+			return
+		}
+		due.send(ctx)
+		due.next = due.next.Add(due.interval)
+	}
+}
+
+// pollConfig request the config, sending the hash of the one last received
+func (d *device) pollConfig(ctx context.Context) {
+	b, status, err := d.post(ctx, d.client, OpConfig, "/api/v1/edgedevice/config", &config.ConfigRequest{ConfigHash: d.configHash}, http.StatusOK, http.StatusNotModified)
+	if err != nil || status != http.StatusOK {
+		return
+	}
+	var response config.ConfigResponse
+	if err := proto.Unmarshal(b, &response); err == nil {
+		d.configHash = response.ConfigHash
+	}
+}
+
+// sendInfo send the info of the device
+func (d *device) sendInfo(ctx context.Context) {
+	msg := &info.ZInfoMsg{
+		Ztype:       info.ZInfoTypes_ZiDevice,
+		DevId:       d.uuid,
+		AtTimeStamp: timestamppb.Now(),
+		InfoContent: &info.ZInfoMsg_Dinfo{Dinfo: &info.ZInfoDevice{
+			MachineArch: "x86_64",
+			CpuArch:     "x86_64",
+			Ncpu:        4,
+			Memory:      8192,
+			Storage:     65536,
+			BootTime:    timestamppb.New(d.bootTime),
+			HostName:    d.serial,
+			Minfo: &info.ZInfoManufacturer{
+				Manufacturer: "adam",
+				ProductName:  "simulator",
+				SerialNumber: d.serial,
+			},
+		}},
+	}
+	d.post(ctx, d.client, OpInfo, "/api/v1/edgedevice/info", msg, http.StatusOK, http.StatusCreated)
+}
+
+// sendMetrics send metrics of the device, with made up usage
+func (d *device) sendMetrics(ctx context.Context) {
+	used := uint64(1024 + mrand.Intn(4096))
+	msg := &metrics.ZMetricMsg{
+		DevID:       d.uuid,
+		AtTimeStamp: timestamppb.Now(),
+		MetricContent: &metrics.ZMetricMsg_Dm{Dm: &metrics.DeviceMetric{
+			CpuMetric: &metrics.AppCpuMetric{UpTime: timestamppb.New(d.bootTime), Total: uint64(time.Since(d.bootTime).Seconds())},
+			Memory:    &metrics.MemoryMetric{UsedMem: uint32(used), AvailMem: uint32(8192 - used)},
+			Disk:      []*metrics.DiskMetric{{MountPath: "/persist", Used: used, Total: 65536}},
+		}},
+	}
+	d.post(ctx, d.client, OpMetrics, "/api/v1/edgedevice/metrics", msg, http.StatusOK, http.StatusCreated)
+}
+
+// sendLogs send a bundle of LogEntries log entries
+func (d *device) sendLogs(ctx context.Context) {
+	severities := []string{"info", "info", "info", "warning", "error"}
+	bundle := &logs.LogBundle{DevID: d.uuid, Timestamp: timestamppb.Now()}
+	for i := 0; i < d.c.LogEntries; i++ {
+		bundle.Log = append(bundle.Log, &logs.LogEntry{
+			Severity:  severities[mrand.Intn(len(severities))],
+			Source:    "simulator",
+			Content:   fmt.Sprintf("simulated log entry %d of %s", i, d.serial),
+			Timestamp: timestamppb.Now(),
+		})
+	}
+	d.post(ctx, d.client, OpLogs, "/api/v1/edgedevice/logs", bundle, http.StatusOK, http.StatusCreated)
+}
+
+// post send a message as an operation, recording its latency, and failing unless the response has one of the
+// expected statuses. Returns the body and status of the response
+func (d *device) post(ctx context.Context, client *http.Client, op, p string, msg proto.Message, expected ...int) ([]byte, int, error) {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		d.rec.record(op, 0, err)
+		return nil, 0, err
+	}
+	return d.do(ctx, client, op, http.MethodPost, p, b, expected...)
+}
+
+// do make a request as an operation, recording its latency, and failing unless the response has one of the
+// expected statuses. Returns the body and status of the response
+func (d *device) do(ctx context.Context, client *http.Client, op, method, p string, b []byte, expected ...int) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, d.c.URL+p, bytes.NewReader(b))
+	if err != nil {
+		d.rec.record(op, 0, err)
+		return nil, 0, err
+	}
+	if b != nil {
+		req.Header.Set("Content-Type", mimeProto)
+	}
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		// requests cut short by the end of the simulation are not counted
+		if ctx.Err() == nil {
+			d.rec.record(op, time.Since(start), err)
+		}
+		return nil, 0, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	elapsed := time.Since(start)
+	if err == nil {
+		err = fmt.Errorf("unexpected status %s: %s", res.Status, bytes.TrimSpace(body))
+		for _, s := range expected {
+			if res.StatusCode == s {
+				err = nil
+			}
+		}
+	}
+	d.rec.record(op, elapsed, err)
+	return body, res.StatusCode, err
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package simulator
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operations the simulated devices make, in the order they are reported
+const (
+	OpRegister = "register"
+	OpCerts    = "certs"
+	OpUUID     = "uuid"
+	OpConfig   = "config"
+	OpInfo     = "info"
+	OpMetrics  = "metrics"
+	OpLogs     = "logs"
+)
+
+var operations = []string{OpRegister, OpCerts, OpUUID, OpConfig, OpInfo, OpMetrics, OpLogs}
+
+// OpStats latency statistics of one operation
+type OpStats struct {
+	Operation string        `json:"operation"`
+	Requests  int           `json:"requests"`
+	Errors    int           `json:"errors"`
+	Mean      time.Duration `json:"mean"`
+	P50       time.Duration `json:"p50"`
+	P90       time.Duration `json:"p90"`
+	P99       time.Duration `json:"p99"`
+	Max       time.Duration `json:"max"`
+}
+
+// Report the results of a simulation
+type Report struct {
+	// Devices the number of devices simulated, and Registered those that registered
+	Devices    int `json:"devices"`
+	Registered int `json:"registered"`
+	// Elapsed how long the simulation ran
+	Elapsed time.Duration `json:"elapsed"`
+	// Operations the statistics of each operation made, in the order of operations
+	Operations []OpStats `json:"operations"`
+	// Errors the first error of each operation that failed, as examples
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// recorder collects the latencies of the requests of all the devices
+type recorder struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	examples  map[string]string
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		latencies: map[string][]time.Duration{},
+		errors:    map[string]int{},
+		examples:  map[string]string{},
+	}
+}
+
+// record a request of an operation, which took d, and failed if err is not nil
+func (r *recorder) record(op string, d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies[op] = append(r.latencies[op], d)
+	if err != nil {
+		r.errors[op]++
+		if _, ok := r.examples[op]; !ok {
+			r.examples[op] = err.Error()
+		}
+	}
+}
+
+// stats the statistics of each operation made so far, in the order of operations
+func (r *recorder) stats() []OpStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var stats []OpStats
+	for _, op := range operations {
+		if l := r.latencies[op]; len(l) > 0 {
+			s := latencyStats(l)
+			s.Operation = op
+			s.Errors = r.errors[op]
+			stats = append(stats, s)
+		}
+	}
+	return stats
+}
+
+// latencyStats the count, mean, percentiles and maximum of latencies
+func latencyStats(latencies []time.Duration) OpStats {
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, l := range sorted {
+		total += l
+	}
+	return OpStats{
+		Requests: len(sorted),
+		Mean:     total / time.Duration(len(sorted)),
+		P50:      percentile(sorted, 50),
+		P90:      percentile(sorted, 90),
+		P99:      percentile(sorted, 99),
+		Max:      sorted[len(sorted)-1],
+	}
+}
+
+// percentile the nearest-rank percentile p of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package simulator
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLatencyStats(t *testing.T) {
+	ms := func(l ...int) []time.Duration {
+		var d []time.Duration
+		for _, v := range l {
+			d = append(d, time.Duration(v)*time.Millisecond)
+		}
+		return d
+	}
+	hundred := make([]int, 100)
+	for i := range hundred {
+		hundred[i] = 100 - i
+	}
+	tests := []struct {
+		latencies                []time.Duration
+		mean, p50, p90, p99, max time.Duration
+	}{
+		{ms(5), 5 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond},
+		{ms(4, 1, 3, 2), 2500 * time.Microsecond, 2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond},
+		{ms(hundred...), 50500 * time.Microsecond, 50 * time.Millisecond, 90 * time.Millisecond, 99 * time.Millisecond, 100 * time.Millisecond},
+	}
+	for i, tt := range tests {
+		s := latencyStats(tt.latencies)
+		if s.Requests != len(tt.latencies) {
+			t.Errorf("%d: requests %d, expected %d", i, s.Requests, len(tt.latencies))
+		}
+		if s.Mean != tt.mean || s.P50 != tt.p50 || s.P90 != tt.p90 || s.P99 != tt.p99 || s.Max != tt.max {
+			t.Errorf("%d: mismatched stats, actual mean %v p50 %v p90 %v p99 %v max %v, expected mean %v p50 %v p90 %v p99 %v max %v",
+				i, s.Mean, s.P50, s.P90, s.P99, s.Max, tt.mean, tt.p50, tt.p90, tt.p99, tt.max)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := newRecorder()
+	r.record(OpLogs, time.Millisecond, nil)
+	r.record(OpConfig, time.Millisecond, errors.New("first"))
+	r.record(OpConfig, 3*time.Millisecond, errors.New("second"))
+	r.record(OpRegister, 2*time.Millisecond, nil)
+
+	stats := r.stats()
+	expected := []string{OpRegister, OpConfig, OpLogs}
+	if len(stats) != len(expected) {
+		t.Fatalf("mismatched operations, actual %d, expected %d", len(stats), len(expected))
+	}
+	for i, op := range expected {
+		if stats[i].Operation != op {
+			t.Errorf("%d: operation %s, expected %s", i, stats[i].Operation, op)
+		}
+	}
+	if stats[1].Requests != 2 || stats[1].Errors != 2 {
+		t.Errorf("config: %d requests %d errors, expected 2 and 2", stats[1].Requests, stats[1].Errors)
+	}
+	if ex := r.errorExamples(); len(ex) != 1 || ex[OpConfig] != "first" {
+		t.Errorf("mismatched error examples %v", ex)
+	}
+}
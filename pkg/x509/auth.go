@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package x509
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/lf-edge/eve/api/go/auth"
+	"github.com/lf-edge/eve/api/go/evecommon"
+)
+
+// CertHash the hash by which EVE identifies a certificate: the SHA-256 of its PEM encoding
+func CertHash(cert []byte) []byte {
+	h := sha256.Sum256(PemEncodeCert(cert))
+	return h[:]
+}
+
+// SignAuthContainer wrap a payload in an AuthContainer, signed by signer and naming its certificate cert as the
+// sender, the way EVE and its controller sign the messages of the v2 API
+func SignAuthContainer(payload []byte, signer crypto.Signer, cert []byte) (*auth.AuthContainer, error) {
+	sig, err := Sign(payload, signer)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.AuthContainer{
+		ProtectedPayload: &auth.AuthBody{Payload: payload},
+		Algo:             evecommon.HashAlgorithm_HASH_ALGORITHM_SHA256_32BYTES,
+		SenderCertHash:   CertHash(cert),
+		SignatureHash:    sig,
+	}, nil
+}
+
+// Sign sign data with signer the way the messages of the v2 API are: ECDSA signatures are the r and s halves
+// padded to the size of the curve, and RSA ones PKCS #1 v1.5 of the SHA-256 of data
+func Sign(data []byte, signer crypto.Signer) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign payload: %v", err)
+	}
+	if key, ok := signer.Public().(*ecdsa.PublicKey); ok {
+		var parsed struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &parsed); err != nil {
+			return nil, fmt.Errorf("invalid ECDSA signature: %v", err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		parsed.R.FillBytes(sig[:size])
+		parsed.S.FillBytes(sig[size:])
+	}
+	return sig, nil
+}
+
+// VerifyAuthContainer check that an AuthContainer was sent by the holder of the key of cert, returning its payload
+func VerifyAuthContainer(c *auth.AuthContainer, cert *x509.Certificate) ([]byte, error) {
+	if c.ProtectedPayload == nil {
+		return nil, errors.New("no payload")
+	}
+	hash := CertHash(cert.Raw)
+	switch c.Algo {
+	case evecommon.HashAlgorithm_HASH_ALGORITHM_SHA256_16BYTES:
+		hash = hash[:16]
+	case evecommon.HashAlgorithm_HASH_ALGORITHM_SHA256_32BYTES:
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %v", c.Algo)
+	}
+	if !bytes.Equal(c.SenderCertHash, hash) {
+		return nil, errors.New("sender certificate hash does not match the certificate")
+	}
+	payload := c.ProtectedPayload.Payload
+	if err := VerifySignature(payload, c.SignatureHash, cert); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// VerifySignature check that sig is the signature of data by the key of cert, as made by Sign
+func VerifySignature(data, sig []byte, cert *x509.Certificate) error {
+	digest := sha256.Sum256(data)
+	switch key := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("ECDSA signature of %d bytes, not %d", len(sig), 2*size)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return errors.New("bad signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return errors.New("bad signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", cert.PublicKey)
+	}
+	return nil
+}
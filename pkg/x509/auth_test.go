@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package x509_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	ax "github.com/lf-edge/adam/pkg/x509"
+	"github.com/lf-edge/eve/api/go/auth"
+	"github.com/lf-edge/eve/api/go/evecommon"
+)
+
+func TestAuthContainer(t *testing.T) {
+	selfSigned := func(signer crypto.Signer) *x509.Certificate {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "sender"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCert, rsaCert := selfSigned(ecKey), selfSigned(rsaKey)
+	payload := []byte("payload")
+
+	tests := []struct {
+		signer crypto.Signer
+		cert   *x509.Certificate
+		verify *x509.Certificate
+		modify func(*auth.AuthContainer)
+		err    error
+	}{
+		{ecKey, ecCert, ecCert, nil, nil},
+		{rsaKey, rsaCert, rsaCert, nil, nil},
+		// EVE may name the sender with the first 16 bytes of the hash
+		{ecKey, ecCert, ecCert, func(c *auth.AuthContainer) {
+			c.Algo = evecommon.HashAlgorithm_HASH_ALGORITHM_SHA256_16BYTES
+			c.SenderCertHash = c.SenderCertHash[:16]
+		}, nil},
+		{ecKey, ecCert, rsaCert, nil, fmt.Errorf("sender certificate hash does not match")},
+		{ecKey, ecCert, ecCert, func(c *auth.AuthContainer) { c.ProtectedPayload.Payload = []byte("other") }, fmt.Errorf("bad signature")},
+		{rsaKey, rsaCert, rsaCert, func(c *auth.AuthContainer) { c.ProtectedPayload.Payload = []byte("other") }, fmt.Errorf("bad signature")},
+		// signed by another key than that of the named certificate
+		{rsaKey, ecCert, ecCert, nil, fmt.Errorf("ECDSA signature of 256 bytes")},
+		{ecKey, ecCert, ecCert, func(c *auth.AuthContainer) { c.Algo = evecommon.HashAlgorithm_HASH_ALGORITHM_INVALID }, fmt.Errorf("unsupported hash algorithm")},
+		{ecKey, ecCert, ecCert, func(c *auth.AuthContainer) { c.ProtectedPayload = nil }, fmt.Errorf("no payload")},
+	}
+	for i, tt := range tests {
+		c, err := ax.SignAuthContainer(payload, tt.signer, tt.cert.Raw)
+		if err != nil {
+			t.Errorf("%d: unexpected error signing: %v", i, err)
+			continue
+		}
+		if tt.modify != nil {
+			tt.modify(c)
+		}
+		b, err := ax.VerifyAuthContainer(c, tt.verify)
+		switch {
+		case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
+			t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
+		case err == nil && string(b) != string(payload):
+			t.Errorf("%d: mismatched payload, actual %q expected %q", i, b, payload)
+		}
+	}
+}
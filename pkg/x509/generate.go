@@ -4,6 +4,7 @@
 package x509
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -30,9 +31,25 @@ func Generate(cn, hosts string) ([]byte, *rsa.PrivateKey, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to generate RSA private key: %v", err)
 	}
+	derBytes, err := GenerateWithSigner(cn, hosts, privKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return derBytes, privKey, nil
+}
+
+// GenerateWithSigner generate a self-signed cert for a key held by signer, e.g. one returned by a KeyProvider,
+// so that the private key never has to be available to adam
+func GenerateWithSigner(cn, hosts string, signer crypto.Signer) ([]byte, error) {
+	if hosts == "" && cn == "" {
+		return nil, fmt.Errorf("must specify at least one hostname/IP or CN")
+	}
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
 
 	notBefore := time.Now()
 	notAfter := notBefore.Add(oneYear)
@@ -65,11 +82,11 @@ func Generate(cn, hosts string) ([]byte, *rsa.PrivateKey, error) {
 		}
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privKey.PublicKey, privKey)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, signer.Public(), signer)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create certificate: %v", err)
+		return nil, fmt.Errorf("failed to create certificate: %v", err)
 	}
-	return derBytes, privKey, nil
+	return derBytes, nil
 }
 
 // GenerateCertAndKey generate a certificate and a key, and return as x509.Certificate and rsa.PrivateKey
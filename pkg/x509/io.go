@@ -4,9 +4,11 @@
 package x509
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -63,6 +65,51 @@ func ReadCert(p string) (*x509.Certificate, error) {
 	return ParseCert(b)
 }
 
+// ReadKey read a PEM-encoded private key file, in PKCS#1, PKCS#8 or SEC 1 format
+func ReadKey(p string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file %s: %v", p, err)
+	}
+	return ParseKey(b)
+}
+
+// ParseKey parse a private key from a PEM-encoded byte slice
+func ParseKey(b []byte) (crypto.Signer, error) {
+	keyPem, _ := pem.Decode(b)
+	if keyPem == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(keyPem.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(keyPem.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyPem.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert data to private key: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// ParsePublicKey parse a PKIX public key from a PEM-encoded byte slice
+func ParsePublicKey(b []byte) (crypto.PublicKey, error) {
+	keyPem, _ := pem.Decode(b)
+	if keyPem == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(keyPem.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert data to public key: %v", err)
+	}
+	return key, nil
+}
+
 // ParseCert parse a cert from a PEM-encoded byte slice
 func ParseCert(b []byte) (*x509.Certificate, error) {
 	var (
@@ -0,0 +1,337 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package x509
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVaultTransitMount = "transit"
+	vaultTokenHeader         = "X-Vault-Token"
+	vaultNamespaceHeader     = "X-Vault-Namespace"
+	// DefaultVaultKeyCacheTTL how long data keys unwrapped with vault are kept in memory, unless told otherwise
+	DefaultVaultKeyCacheTTL = 5 * time.Minute
+	// maxVaultCachedKeys how many data keys unwrapped with vault are kept in memory at most
+	maxVaultCachedKeys = 4096
+)
+
+// KeyProvider provides the named private keys used by adam, e.g. the server TLS key, the onboarding CA key
+// or a config-signing key. Implementations may keep keys outside of adam's filesystem, only exposing
+// signing operations.
+type KeyProvider interface {
+	// Name of the provider, e.g. "file" or "vault"
+	Name() string
+	// Signer get a crypto.Signer for the named key
+	Signer(name string) (crypto.Signer, error)
+}
+
+// FileKeyProvider provides keys stored as PEM files on the local filesystem. The name of each key is its path.
+type FileKeyProvider struct{}
+
+// Name return name
+func (f *FileKeyProvider) Name() string {
+	return "file"
+}
+
+// Signer read the key at the given path
+func (f *FileKeyProvider) Signer(name string) (crypto.Signer, error) {
+	return ReadKey(name)
+}
+
+// VaultClient minimal client for the HashiCorp Vault HTTP API
+type VaultClient struct {
+	// Address of vault, e.g. https://vault.example.com:8200
+	Address string
+	// Token to authenticate to vault
+	Token string
+	// Namespace optional vault enterprise namespace
+	Namespace string
+	// Client http client to use; if nil, a client with a sensible timeout is used
+	Client *http.Client
+}
+
+// vaultResponse generic envelope of vault API responses
+type vaultResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []string        `json:"errors"`
+}
+
+// do call the vault API, decoding the data section of the response into out, if not nil
+func (v *VaultClient) do(method, p string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("unable to encode vault request: %v", err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(v.Address, "/")+"/v1/"+strings.TrimLeft(p, "/"), body)
+	if err != nil {
+		return fmt.Errorf("unable to create vault request: %v", err)
+	}
+	req.Header.Set(vaultTokenHeader, v.Token)
+	if v.Namespace != "" {
+		req.Header.Set(vaultNamespaceHeader, v.Namespace)
+	}
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault request %s %s failed: %v", method, p, err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read vault response: %v", err)
+	}
+	var vr vaultResponse
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &vr); err != nil {
+			return fmt.Errorf("unable to decode vault response: %v", err)
+		}
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("vault request %s %s returned %d: %s", method, p, res.StatusCode, strings.Join(vr.Errors, "; "))
+	}
+	if out != nil {
+		if err := json.Unmarshal(vr.Data, out); err != nil {
+			return fmt.Errorf("unable to decode vault response data: %v", err)
+		}
+	}
+	return nil
+}
+
+// VaultKeyProvider provides keys held in a vault transit secrets engine. Signing happens inside
+// vault; the private keys never leave it.
+type VaultKeyProvider struct {
+	Client *VaultClient
+	// Mount path of the transit engine, defaults to "transit"
+	Mount string
+}
+
+// Name return name
+func (p *VaultKeyProvider) Name() string {
+	return "vault"
+}
+
+// Signer get a crypto.Signer for the named transit key. The key must be an RSA or ECDSA key.
+func (p *VaultKeyProvider) Signer(name string) (crypto.Signer, error) {
+	mount := p.Mount
+	if mount == "" {
+		mount = defaultVaultTransitMount
+	}
+	var key struct {
+		Type          string `json:"type"`
+		LatestVersion int    `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	}
+	if err := p.Client.do("GET", fmt.Sprintf("%s/keys/%s", mount, name), nil, &key); err != nil {
+		return nil, fmt.Errorf("unable to read transit key %s: %v", name, err)
+	}
+	version, ok := key.Keys[strconv.Itoa(key.LatestVersion)]
+	if !ok || version.PublicKey == "" {
+		return nil, fmt.Errorf("transit key %s of type %s does not have a public key; only asymmetric keys can be used for signing", name, key.Type)
+	}
+	pub, err := ParsePublicKey([]byte(version.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse public key of transit key %s: %v", name, err)
+	}
+	return &vaultSigner{client: p.Client, mount: mount, name: name, public: pub}, nil
+}
+
+// vaultSigner crypto.Signer that delegates signing to vault transit
+type vaultSigner struct {
+	client *VaultClient
+	mount  string
+	name   string
+	public crypto.PublicKey
+}
+
+func (s *vaultSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *vaultSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var hashName string
+	switch opts.HashFunc() {
+	case crypto.SHA224:
+		hashName = "sha2-224"
+	case crypto.SHA256:
+		hashName = "sha2-256"
+	case crypto.SHA384:
+		hashName = "sha2-384"
+	case crypto.SHA512:
+		hashName = "sha2-512"
+	default:
+		return nil, fmt.Errorf("unsupported hash function for vault signing: %v", opts.HashFunc())
+	}
+	req := map[string]interface{}{
+		"input":     base64.StdEncoding.EncodeToString(digest),
+		"prehashed": true,
+	}
+	if _, ok := s.public.(*rsa.PublicKey); ok {
+		req["signature_algorithm"] = "pkcs1v15"
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			req["signature_algorithm"] = "pss"
+			// vault defaults to the largest salt, while TLS 1.3 and rsa.VerifyPSS expect one as long as the hash
+			switch pss.SaltLength {
+			case rsa.PSSSaltLengthAuto:
+				req["salt_length"] = "auto"
+			case rsa.PSSSaltLengthEqualsHash:
+				req["salt_length"] = "hash"
+			default:
+				req["salt_length"] = strconv.Itoa(pss.SaltLength)
+			}
+		}
+	}
+	var res struct {
+		Signature string `json:"signature"`
+	}
+	if err := s.client.do("POST", fmt.Sprintf("%s/sign/%s/%s", s.mount, s.name, hashName), req, &res); err != nil {
+		return nil, err
+	}
+	return decodeVaultValue(res.Signature)
+}
+
+// VaultKeyWrapper wraps data keys with a vault transit encryption key, for use as the KMS behind
+// encryption at rest in the drivers. The data keys unwrapped, and those wrapped, are kept in memory for CacheTTL,
+// keyed by their wrapped form, so that reading a value again does not take a round-trip to vault
+type VaultKeyWrapper struct {
+	Client *VaultClient
+	// Mount path of the transit engine, defaults to "transit"
+	Mount string
+	// Key name of the transit key
+	Key string
+	// CacheTTL how long data keys are kept in memory, defaults to DefaultVaultKeyCacheTTL; negative to not keep them
+	CacheTTL time.Duration
+
+	lock sync.Mutex
+	keys map[string]cachedVaultKey
+}
+
+// cachedVaultKey a data key kept in memory, until when it expires
+type cachedVaultKey struct {
+	key     []byte
+	expires time.Time
+}
+
+func (w *VaultKeyWrapper) mount() string {
+	if w.Mount == "" {
+		return defaultVaultTransitMount
+	}
+	return w.Mount
+}
+
+func (w *VaultKeyWrapper) cacheTTL() time.Duration {
+	if w.CacheTTL == 0 {
+		return DefaultVaultKeyCacheTTL
+	}
+	return w.CacheTTL
+}
+
+// cached the data key kept in memory for a wrapped key, nil if there is none or it expired
+func (w *VaultKeyWrapper) cached(wrapped []byte) []byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	c, ok := w.keys[string(wrapped)]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(c.expires) {
+		delete(w.keys, string(wrapped))
+		return nil
+	}
+	return append([]byte(nil), c.key...)
+}
+
+// cache keep a data key in memory for its wrapped key, making room by dropping the expired keys, or any if none is
+func (w *VaultKeyWrapper) cache(wrapped, key []byte) {
+	ttl := w.cacheTTL()
+	if ttl < 0 {
+		return
+	}
+	now := time.Now()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.keys == nil {
+		w.keys = map[string]cachedVaultKey{}
+	}
+	if len(w.keys) >= maxVaultCachedKeys {
+		for k, c := range w.keys {
+			if now.After(c.expires) {
+				delete(w.keys, k)
+			}
+		}
+	}
+	for k := range w.keys {
+		if len(w.keys) < maxVaultCachedKeys {
+			break
+		}
+		delete(w.keys, k)
+	}
+	w.keys[string(wrapped)] = cachedVaultKey{key: append([]byte(nil), key...), expires: now.Add(ttl)}
+}
+
+// WrapKey encrypt a data key with the transit key
+func (w *VaultKeyWrapper) WrapKey(b []byte) ([]byte, error) {
+	var res struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	req := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(b)}
+	if err := w.Client.do("POST", fmt.Sprintf("%s/encrypt/%s", w.mount(), w.Key), req, &res); err != nil {
+		return nil, err
+	}
+	wrapped := []byte(res.Ciphertext)
+	// the value it encrypts is likely read back soon
+	w.cache(wrapped, b)
+	return wrapped, nil
+}
+
+// UnwrapKey decrypt a data key with the transit key, unless it is kept in memory
+func (w *VaultKeyWrapper) UnwrapKey(b []byte) ([]byte, error) {
+	if key := w.cached(b); key != nil {
+		return key, nil
+	}
+	var res struct {
+		Plaintext string `json:"plaintext"`
+	}
+	req := map[string]string{"ciphertext": string(b)}
+	if err := w.Client.do("POST", fmt.Sprintf("%s/decrypt/%s", w.mount(), w.Key), req, &res); err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(res.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	w.cache(b, key)
+	return key, nil
+}
+
+// decodeVaultValue decode a "vault:v<N>:<base64>" value
+func decodeVaultValue(v string) ([]byte, error) {
+	parts := strings.SplitN(v, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, errors.New("invalid vault value format")
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package x509_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ax "github.com/lf-edge/adam/pkg/x509"
+)
+
+// fakeTransit a minimal stand-in for the vault transit API, backed by a local ECDSA or RSA key
+func fakeTransit(t *testing.T, key crypto.Signer) *httptest.Server {
+	var (
+		pubPem  []byte
+		keyType = "ecdsa-p256"
+	)
+	if key != nil {
+		pubDer, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatalf("unable to marshal public key: %v", err)
+		}
+		pubPem = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer})
+		if _, ok := key.(*rsa.PrivateKey); ok {
+			keyType = "rsa-2048"
+		}
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		var (
+			req  map[string]interface{}
+			data interface{}
+		)
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case r.URL.Path == "/v1/transit/keys/server":
+			data = map[string]interface{}{
+				"type":           keyType,
+				"latest_version": 1,
+				"keys":           map[string]interface{}{"1": map[string]string{"public_key": string(pubPem)}},
+			}
+		case r.URL.Path == "/v1/transit/sign/server/sha2-256":
+			digest, _ := base64.StdEncoding.DecodeString(req["input"].(string))
+			var opts crypto.SignerOpts = crypto.SHA256
+			if req["signature_algorithm"] == "pss" {
+				// as vault, the largest salt unless told otherwise
+				pss := &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: rsa.PSSSaltLengthAuto}
+				if req["salt_length"] == "hash" {
+					pss.SaltLength = rsa.PSSSaltLengthEqualsHash
+				}
+				opts = pss
+			}
+			sig, err := key.Sign(rand.Reader, digest, opts)
+			if err != nil {
+				t.Fatalf("unable to sign: %v", err)
+			}
+			data = map[string]string{"signature": "vault:v1:" + base64.StdEncoding.EncodeToString(sig)}
+		case strings.HasPrefix(r.URL.Path, "/v1/transit/encrypt/"):
+			data = map[string]string{"ciphertext": "vault:v1:" + req["plaintext"].(string)}
+		case strings.HasPrefix(r.URL.Path, "/v1/transit/decrypt/"):
+			data = map[string]string{"plaintext": strings.TrimPrefix(req["ciphertext"].(string), "vault:v1:")}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+}
+
+func TestVaultKeyProvider(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	ts := fakeTransit(t, key)
+	defer ts.Close()
+
+	provider := &ax.VaultKeyProvider{Client: &ax.VaultClient{Address: ts.URL, Token: "secret"}}
+	signer, err := provider.Signer("server")
+	if err != nil {
+		t.Fatalf("unexpected error getting signer: %v", err)
+	}
+	if !key.PublicKey.Equal(signer.Public()) {
+		t.Fatalf("mismatched public key")
+	}
+	certB, err := ax.GenerateWithSigner("adam", "localhost", signer)
+	if err != nil {
+		t.Fatalf("unexpected error generating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certB)
+	if err != nil {
+		t.Fatalf("unexpected error parsing certificate: %v", err)
+	}
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		t.Errorf("certificate not signed by vault key: %v", err)
+	}
+
+	if _, err := provider.Signer("missing"); err == nil {
+		t.Errorf("expected error for missing key")
+	}
+	badToken := &ax.VaultKeyProvider{Client: &ax.VaultClient{Address: ts.URL, Token: "wrong"}}
+	if _, err := badToken.Signer("server"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected permission denied error, got %v", err)
+	}
+}
+
+func TestVaultKeyProviderRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	ts := fakeTransit(t, key)
+	defer ts.Close()
+
+	provider := &ax.VaultKeyProvider{Client: &ax.VaultClient{Address: ts.URL, Token: "secret"}}
+	signer, err := provider.Signer("server")
+	if err != nil {
+		t.Fatalf("unexpected error getting signer: %v", err)
+	}
+	if !key.PublicKey.Equal(signer.Public()) {
+		t.Fatalf("mismatched public key")
+	}
+	certB, err := ax.GenerateWithSigner("adam", "localhost", signer)
+	if err != nil {
+		t.Fatalf("unexpected error generating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certB)
+	if err != nil {
+		t.Fatalf("unexpected error parsing certificate: %v", err)
+	}
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		t.Errorf("certificate not signed by vault key: %v", err)
+	}
+
+	// TLS 1.3 signs with PSS, and expects a salt as long as the hash
+	digest := sha256.Sum256([]byte("handshake"))
+	for _, saltLength := range []int{rsa.PSSSaltLengthEqualsHash, rsa.PSSSaltLengthAuto} {
+		opts := &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: saltLength}
+		sig, err := signer.Sign(rand.Reader, digest[:], opts)
+		if err != nil {
+			t.Errorf("salt length %d: unexpected error signing: %v", saltLength, err)
+			continue
+		}
+		if err := rsa.VerifyPSS(&key.PublicKey, crypto.SHA256, digest[:], sig, opts); err != nil {
+			t.Errorf("salt length %d: bad signature: %v", saltLength, err)
+		}
+	}
+}
+
+func TestVaultKeyWrapper(t *testing.T) {
+	ts := fakeTransit(t, nil)
+	defer ts.Close()
+
+	w := &ax.VaultKeyWrapper{Client: &ax.VaultClient{Address: ts.URL, Token: "secret"}, Key: "adam"}
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := w.WrapKey(dataKey)
+	if err != nil {
+		t.Fatalf("unexpected error wrapping key: %v", err)
+	}
+	unwrapped, err := w.UnwrapKey(wrapped)
+	if err != nil {
+		t.Fatalf("unexpected error unwrapping key: %v", err)
+	}
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("mismatched key, actual %x expected %x", unwrapped, dataKey)
+	}
+}
+
+func TestVaultKeyWrapperCache(t *testing.T) {
+	ts := fakeTransit(t, nil)
+	defer ts.Close()
+	target, _ := url.Parse(ts.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var decrypts int32
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/transit/decrypt/") {
+			atomic.AddInt32(&decrypts, 1)
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer counting.Close()
+
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	other := &ax.VaultKeyWrapper{Client: &ax.VaultClient{Address: counting.URL, Token: "secret"}, Key: "adam"}
+	wrapped, err := other.WrapKey(dataKey)
+	if err != nil {
+		t.Fatalf("unexpected error wrapping key: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		decrypts int32
+	}{
+		{"default", 0, 1},
+		{"disabled", -1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&decrypts, 0)
+			w := &ax.VaultKeyWrapper{Client: &ax.VaultClient{Address: counting.URL, Token: "secret"}, Key: "adam", CacheTTL: tt.ttl}
+			for i := 0; i < 3; i++ {
+				unwrapped, err := w.UnwrapKey(wrapped)
+				if err != nil {
+					t.Fatalf("unexpected error unwrapping key: %v", err)
+				}
+				if !bytes.Equal(unwrapped, dataKey) {
+					t.Fatalf("mismatched key, actual %x expected %x", unwrapped, dataKey)
+				}
+				// the key kept must not change with the one returned
+				unwrapped[0] ^= 0xff
+			}
+			if n := atomic.LoadInt32(&decrypts); n != tt.decrypts {
+				t.Errorf("mismatched decrypt calls, actual %d expected %d", n, tt.decrypts)
+			}
+		})
+	}
+
+	// a key wrapped is kept too
+	atomic.StoreInt32(&decrypts, 0)
+	if _, err := other.UnwrapKey(wrapped); err != nil {
+		t.Fatalf("unexpected error unwrapping key: %v", err)
+	}
+	if n := atomic.LoadInt32(&decrypts); n != 0 {
+		t.Errorf("mismatched decrypt calls for a key wrapped, actual %d expected 0", n)
+	}
+
+	// and forgotten once expired
+	short := &ax.VaultKeyWrapper{Client: &ax.VaultClient{Address: counting.URL, Token: "secret"}, Key: "adam", CacheTTL: time.Millisecond}
+	if _, err := short.UnwrapKey(wrapped); err != nil {
+		t.Fatalf("unexpected error unwrapping key: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := short.UnwrapKey(wrapped); err != nil {
+		t.Fatalf("unexpected error unwrapping key: %v", err)
+	}
+	if n := atomic.LoadInt32(&decrypts); n != 2 {
+		t.Errorf("mismatched decrypt calls after expiry, actual %d expected 2", n)
+	}
+}
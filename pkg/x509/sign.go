@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package x509
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const pemTypeCSR = "CERTIFICATE REQUEST"
+
+// IsCSR whether PEM-encoded bytes hold a certificate signing request rather than a certificate
+func IsCSR(b []byte) bool {
+	block, _ := pem.Decode(b)
+	return block != nil && block.Type == pemTypeCSR
+}
+
+// ParseCSR parse a certificate signing request from a PEM-encoded byte slice, checking it is signed by the key
+// it is for
+func ParseCSR(b []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if block.Type != pemTypeCSR {
+		return nil, fmt.Errorf("PEM data of type %s, not %s", block.Type, pemTypeCSR)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert data to certificate request: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("bad signature of certificate request: %v", err)
+	}
+	return csr, nil
+}
+
+// SignCSR issue a client certificate for the key and subject of a certificate signing request, signed by a CA
+// whose key is held by signer, valid for validity from now, or one year if 0. Extensions requested are not
+// copied, so that a device cannot ask for more than a client certificate
+func SignCSR(csr *x509.CertificateRequest, ca *x509.Certificate, signer crypto.Signer, validity time.Duration) ([]byte, error) {
+	if validity <= 0 {
+		validity = oneYear
+	}
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	notBefore := time.Now()
+	notAfter := notBefore.Add(validity)
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      csr.Subject,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, ca, csr.PublicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	return derBytes, nil
+}
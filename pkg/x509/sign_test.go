@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package x509_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	ax "github.com/lf-edge/adam/pkg/x509"
+)
+
+func TestSignCSR(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "device-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(48 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device-1"}}, deviceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDer})
+	// flip a bit of the signature, the last bytes of the request
+	badDer := append([]byte{}, csrDer...)
+	badDer[len(badDer)-1] ^= 1
+	badPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: badDer})
+
+	tests := []struct {
+		csr      []byte
+		validity time.Duration
+		isCSR    bool
+		notAfter time.Duration
+		err      error
+	}{
+		{[]byte("abc"), 0, false, 0, fmt.Errorf("no PEM data found")},
+		{ax.PemEncodeCert(caDer), 0, false, 0, fmt.Errorf("PEM data of type CERTIFICATE")},
+		{badPem, 0, true, 0, fmt.Errorf("bad signature of certificate request")},
+		{csrPem, time.Hour, true, time.Hour, nil},
+		// not valid past the CA
+		{csrPem, 0, true, 48 * time.Hour, nil},
+	}
+	for i, tt := range tests {
+		if isCSR := ax.IsCSR(tt.csr); isCSR != tt.isCSR {
+			t.Errorf("%d: mismatched IsCSR, actual %v expected %v", i, isCSR, tt.isCSR)
+		}
+		csr, err := ax.ParseCSR(tt.csr)
+		switch {
+		case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
+			t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
+			continue
+		case err != nil:
+			continue
+		}
+		certDer, err := ax.SignCSR(csr, ca, caKey, tt.validity)
+		if err != nil {
+			t.Errorf("%d: unexpected error signing: %v", i, err)
+			continue
+		}
+		cert, err := x509.ParseCertificate(certDer)
+		if err != nil {
+			t.Errorf("%d: unexpected error parsing certificate: %v", i, err)
+			continue
+		}
+		if err := cert.CheckSignatureFrom(ca); err != nil {
+			t.Errorf("%d: certificate not signed by the CA: %v", i, err)
+		}
+		if cert.Subject.CommonName != "device-1" {
+			t.Errorf("%d: mismatched CN, actual %s expected device-1", i, cert.Subject.CommonName)
+		}
+		if !deviceKey.PublicKey.Equal(cert.PublicKey) {
+			t.Errorf("%d: certificate not for the key of the request", i)
+		}
+		if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+			t.Errorf("%d: mismatched extended key usage, actual %v expected client auth", i, cert.ExtKeyUsage)
+		}
+		if d := cert.NotAfter.Sub(cert.NotBefore); d > tt.notAfter || d < tt.notAfter-time.Minute {
+			t.Errorf("%d: mismatched validity, actual %s expected %s", i, d, tt.notAfter)
+		}
+	}
+}
@@ -34,7 +34,8 @@ bootstrap() {
    fi
    UUID=$($ADAM_CMD device list | head -1)
    if [ -n "$UUID" ]; then
-      $ADAM_CMD device config set --uuid $UUID --config-path /adam/default.json
+      # a fresh device, whose base config is replaced whatever it is
+      $ADAM_CMD device config set --uuid $UUID --config-path /adam/default.json --if-match '*'
    fi
 }
 